@@ -0,0 +1,598 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The same author is spelled many ways across headers, "Dostoyevsky,
+// Fyodor", "Dostoevsky, Fyodor" and "Dostoievski, F. M.", each its own
+// author_norm, and so his own author to author_stats and random's fair
+// draws. The catalog's agents have one name each and the aliases they are
+// also known by, which gutchunk catalog keeps in author_aliases, keyed by
+// aliasKey; resolveAuthors then gives every book whose author's key is
+// there the agent's name as its author_norm, and the agent as its
+// author_id. An author no alias has the key of is matched to the nearest
+// alias spelled nearly alike (see aliasScore) when that is at least
+// aliasCutoff alike and no other agent's is as near, and the match kept as
+// an alias of its own, source fuzzy. What matches nothing keeps its own
+// author_norm, a provisional author with no author_id; gutchunk authors
+// --unresolved lists them and gutchunk alias add settles them by hand.
+// The author shown, files.author, is left as it was.
+
+// aliasCutoff is how alike an author must be to an alias, by aliasScore,
+// to be taken for it.
+const aliasCutoff = 0.85
+
+// where an alias came from: the catalog, a near spelling or alias add,
+// which neither of the others overwrites
+const (
+	aliasCatalog = "catalog"
+	aliasFuzzy   = "fuzzy"
+	aliasManual  = "manual"
+)
+
+// catalogAgent is one of the catalog's agents, with its aliases.
+type catalogAgent struct {
+	id      int
+	name    string
+	aliases []string
+}
+
+// authorWords are the words of an author's name, normalized, whichever
+// order it is given in.
+func authorWords(author string) []string {
+	return strings.Fields(strings.ReplaceAll(normalizeAuthor(author), ",", " "))
+}
+
+// aliasKey is what authors are looked up by in author_aliases: their
+// words in order, so that "Austen, Jane" and "Jane Austen" agree.
+func aliasKey(author string) string {
+	w := authorWords(author)
+	sort.Strings(w)
+	return strings.Join(w, " ")
+}
+
+// spelling folds letters that transliterations of the same name
+// trade, y and j for i and w for v, so that Dostoyevsky and
+// Dostoievski, Tolstoy and Tolstoi are spelled alike.
+var spelling = strings.NewReplacer("y", "i", "j", "i", "w", "v")
+
+// wordLikeness is how alike two words of names are, from 0 to 1: one less
+// their edit distance over the longer's length, once spelling folded them.
+func wordLikeness(a, b string) float64 {
+	a, b = spelling.Replace(a), spelling.Replace(b)
+	ra, rb := []rune(a), []rune(b)
+	n := len(ra)
+	if len(rb) > n {
+		n = len(rb)
+	}
+	if n == 0 {
+		return 0
+	}
+	return 1 - float64(editDistance(ra, rb))/float64(n)
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			d := prev[j-1]
+			if a[i-1] != b[j-1] {
+				d++
+			}
+			if prev[j]+1 < d {
+				d = prev[j] + 1
+			}
+			if cur[j-1]+1 < d {
+				d = cur[j-1] + 1
+			}
+			cur[j] = d
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func isInitial(w string) bool {
+	return utf8.RuneCountInString(w) == 1
+}
+
+// aliasScore is how alike two authors' words are, from 0 to 1. Their
+// whole words are paired off, most alike first, and the score is the
+// likeness of the pairs weighted by their length, over the length of every
+// whole word: one left unpaired counts as nothing alike, unless the other
+// has its initial, which stands for it. Initials left over count for
+// nothing, so "Dostoievski, F. M." is as alike "Fyodor Dostoyevsky" as
+// its surname is.
+func aliasScore(a, b []string) float64 {
+	var wa, wb, ia, ib []string
+	for _, w := range a {
+		if isInitial(w) {
+			ia = append(ia, w)
+		} else {
+			wa = append(wa, w)
+		}
+	}
+	for _, w := range b {
+		if isInitial(w) {
+			ib = append(ib, w)
+		} else {
+			wb = append(wb, w)
+		}
+	}
+	type pair struct {
+		i, j int
+		like float64
+	}
+	var pairs []pair
+	for i, x := range wa {
+		for j, y := range wb {
+			if l := wordLikeness(x, y); l >= 0.5 {
+				pairs = append(pairs, pair{i, j, l})
+			}
+		}
+	}
+	sort.SliceStable(pairs, func(x, y int) bool { return pairs[x].like > pairs[y].like })
+	usedA, usedB := map[int]bool{}, map[int]bool{}
+	var alike, total float64
+	for _, p := range pairs {
+		if usedA[p.i] || usedB[p.j] {
+			continue
+		}
+		usedA[p.i], usedB[p.j] = true, true
+		n := float64(utf8.RuneCountInString(wa[p.i])+utf8.RuneCountInString(wb[p.j])) / 2
+		alike += p.like * n
+		total += n
+	}
+	if alike == 0 {
+		return 0
+	}
+	// an unpaired word the other's initial stands for counts for nothing
+	unpaired := func(words []string, used map[int]bool, initials []string) {
+		left := append([]string{}, initials...)
+	next:
+		for i, w := range words {
+			if used[i] {
+				continue
+			}
+			for k, in := range left {
+				if strings.HasPrefix(w, in) {
+					left = append(left[:k], left[k+1:]...)
+					continue next
+				}
+			}
+			total += float64(utf8.RuneCountInString(w))
+		}
+	}
+	unpaired(wa, usedA, ib)
+	unpaired(wb, usedB, ia)
+	return alike / total
+}
+
+// alias is what an alias stands for: the agent, if it is the catalog's,
+// and its name.
+type alias struct {
+	agent  sql.NullInt64
+	author string
+	source string
+}
+
+// aliasIndex finds the aliases spelled near an author's, by the first
+// three letters of their whole words, spelling folded.
+type aliasIndex struct {
+	words  map[string][]string
+	blocks map[string][]string
+}
+
+func aliasBlock(w string) string {
+	r := []rune(spelling.Replace(w))
+	if len(r) > 3 {
+		r = r[:3]
+	}
+	return string(r)
+}
+
+func newAliasIndex(aliases map[string]alias) *aliasIndex {
+	ix := &aliasIndex{words: map[string][]string{}, blocks: map[string][]string{}}
+	for key, a := range aliases {
+		// a near spelling isn't matched against in its turn, lest
+		// matches drift one letter at a time
+		if a.source == aliasFuzzy {
+			continue
+		}
+		w := strings.Fields(key)
+		ix.words[key] = w
+		seen := map[string]bool{}
+		for _, x := range w {
+			if b := aliasBlock(x); !isInitial(x) && !seen[b] {
+				seen[b] = true
+				ix.blocks[b] = append(ix.blocks[b], key)
+			}
+		}
+	}
+	return ix
+}
+
+// nearest is the alias spelled nearest the author with the given key,
+// and how near, and whether another author's alias is as near, within a
+// hair, which makes the match ambiguous.
+func (ix *aliasIndex) nearest(key string, aliases map[string]alias) (string, float64, bool) {
+	w := strings.Fields(key)
+	scores := map[string]float64{}
+	var best string
+	for _, x := range w {
+		if isInitial(x) {
+			continue
+		}
+		for _, k := range ix.blocks[aliasBlock(x)] {
+			if _, ok := scores[k]; ok {
+				continue
+			}
+			scores[k] = aliasScore(w, ix.words[k])
+			if best == "" || scores[k] > scores[best] || scores[k] == scores[best] && k < best {
+				best = k
+			}
+		}
+	}
+	if best == "" {
+		return "", 0, false
+	}
+	var second float64
+	for k, s := range scores {
+		if s > second && !sameAuthor(aliases[best], aliases[k]) {
+			second = s
+		}
+	}
+	return best, scores[best], scores[best]-second < 0.02
+}
+
+func sameAuthor(a, b alias) bool {
+	if a.agent.Valid || b.agent.Valid {
+		return a.agent == b.agent
+	}
+	return normalizeAuthor(a.author) == normalizeAuthor(b.author)
+}
+
+// loadAliases reads author_aliases by key.
+func loadAliases(ctx context.Context, q interface {
+	QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
+}) (map[string]alias, error) {
+	rows, err := q.QueryContext(ctx, "SELECT alias, agent_id, author, source FROM author_aliases")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	aliases := map[string]alias{}
+	for rows.Next() {
+		var key string
+		var a alias
+		if err = rows.Scan(&key, &a.agent, &a.author, &a.source); err != nil {
+			return nil, err
+		}
+		aliases[key] = a
+	}
+	return aliases, rows.Err()
+}
+
+// saveCatalogAgents keeps the agents' names and aliases in author_aliases,
+// over those the catalog or a near spelling gave before but not those
+// given by hand. A name or alias two agents share is dropped, since it
+// can't say which of them a book's author is.
+func saveCatalogAgents(tx *sql.Tx, agents map[int]catalogAgent) (int, error) {
+	keys := map[string]int{}
+	shared := map[string]bool{}
+	ids := make([]int, 0, len(agents))
+	for id := range agents {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		ag := agents[id]
+		for _, name := range append([]string{ag.name}, ag.aliases...) {
+			k := aliasKey(name)
+			if k == "" {
+				continue
+			}
+			if other, ok := keys[k]; ok && other != id {
+				shared[k] = true
+			}
+			keys[k] = id
+		}
+	}
+	stmt, err := tx.Prepare(`INSERT INTO author_aliases (alias, agent_id, author, source, confidence, updated_at) VALUES (?, ?, ?, ?, 1, datetime('now'))
+		ON CONFLICT (alias) DO UPDATE SET agent_id = excluded.agent_id, author = excluded.author, source = excluded.source,
+			confidence = 1, updated_at = excluded.updated_at
+		WHERE source != ? AND (agent_id IS NOT excluded.agent_id OR author != excluded.author OR source != excluded.source)`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	n := 0
+	for k, id := range keys {
+		if shared[k] {
+			if _, err = tx.Exec("DELETE FROM author_aliases WHERE alias = ? AND source != ?", k, aliasManual); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if _, err = stmt.Exec(k, id, catalogName(agents[id].name), aliasCatalog, aliasManual); err != nil {
+			return 0, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// aliasCounts is how many books resolveAuthors found the author of among
+// the aliases, how many of them by a near spelling, and how many it left
+// provisional.
+type aliasCounts struct {
+	resolved, fuzzy, provisional int
+}
+
+func (c aliasCounts) String() string {
+	return fmt.Sprintf("found the author of %d books by alias, %d of them by a near spelling, leaving %d provisional",
+		c.resolved, c.fuzzy, c.provisional)
+}
+
+// resolveAuthors gives each book the author_norm and author_id of the
+// alias its author has, or is spelled nearly as (see the top of this
+// file), or its own author_norm and none.
+func resolveAuthors(ctx context.Context, db *sql.DB) (aliasCounts, error) {
+	var c aliasCounts
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return c, err
+	}
+	defer tx.Rollback()
+
+	aliases, err := loadAliases(ctx, tx)
+	if err != nil {
+		return c, err
+	}
+	var ix *aliasIndex
+
+	type book struct {
+		id                      int64
+		author, norm, titleNorm string
+		agent                   sql.NullInt64
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT id, coalesce(author, ''), coalesce(author_norm, ''), coalesce(title_norm, ''), author_id
+		FROM files WHERE deleted_at IS NULL`)
+	if err != nil {
+		return c, err
+	}
+	var books []book
+	for rows.Next() {
+		var b book
+		if err = rows.Scan(&b.id, &b.author, &b.norm, &b.titleNorm, &b.agent); err != nil {
+			rows.Close()
+			return c, err
+		}
+		books = append(books, b)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return c, err
+	}
+
+	type match struct {
+		a     alias
+		ok    bool
+		fuzzy bool
+	}
+	matched := map[string]match{}
+	for _, b := range books {
+		key := aliasKey(b.author)
+		m, seen := matched[key]
+		if !seen && key != "" {
+			if a, ok := aliases[key]; ok {
+				m = match{a: a, ok: true, fuzzy: a.source == aliasFuzzy}
+			} else {
+				if ix == nil {
+					ix = newAliasIndex(aliases)
+				}
+				if k, score, ambiguous := ix.nearest(key, aliases); score >= aliasCutoff && !ambiguous {
+					a := aliases[k]
+					a.source = aliasFuzzy
+					_, err = tx.ExecContext(ctx, "INSERT INTO author_aliases (alias, agent_id, author, source, confidence, updated_at) VALUES (?, ?, ?, ?, ?, datetime('now'))",
+						key, a.agent, a.author, aliasFuzzy, score)
+					if err != nil {
+						return c, err
+					}
+					m = match{a: a, ok: true, fuzzy: true}
+				}
+			}
+			matched[key] = m
+		}
+
+		own := normalizeAuthor(b.author)
+		norm, agent := own, sql.NullInt64{}
+		if m.ok {
+			norm, agent = normalizeAuthor(m.a.author), m.a.agent
+			c.resolved++
+			if m.fuzzy {
+				c.fuzzy++
+			}
+		} else if key != "" {
+			c.provisional++
+		}
+		if norm == b.norm && agent == b.agent {
+			continue
+		}
+		if _, err = tx.ExecContext(ctx, "UPDATE files SET author_norm = ?, author_id = ? WHERE id = ?", norm, agent, b.id); err != nil {
+			return c, err
+		}
+		// the author's words as given still find the book by --author
+		if err = saveNameWords(tx, b.id, norm+" "+own, b.titleNorm); err != nil {
+			return c, err
+		}
+	}
+	return c, tx.Commit()
+}
+
+// canonicalAuthor is the author_norm books by author have: its alias's,
+// if it has one, or else its own.
+func canonicalAuthor(db *sql.DB, author string) (string, error) {
+	var name string
+	err := db.QueryRow("SELECT author FROM author_aliases WHERE alias = ?", aliasKey(author)).Scan(&name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return normalizeAuthor(author), nil
+	}
+	return normalizeAuthor(name), err
+}
+
+// listUnresolved prints the provisional authors not given an alias by
+// hand, most books first, with the nearest alias to each and how near it
+// is.
+func listUnresolved(db *sql.DB) error {
+	aliases, err := loadAliases(context.Background(), db)
+	if err != nil {
+		return err
+	}
+	ix := newAliasIndex(aliases)
+	rows, err := db.Query(`SELECT coalesce(author, ''), count(*) FROM files
+		WHERE author_id IS NULL AND coalesce(author, '') != '' AND deleted_at IS NULL
+		GROUP BY author ORDER BY count(*) DESC, author`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var author string
+		var books int
+		if err = rows.Scan(&author, &books); err != nil {
+			return err
+		}
+		if _, ok := aliases[aliasKey(author)]; ok {
+			continue
+		}
+		line := fmt.Sprintf("%5d books  %s", books, author)
+		if k, score, _ := ix.nearest(aliasKey(author), aliases); k != "" {
+			line += fmt.Sprintf("  (nearest %s, %.2f)", aliases[k].author, score)
+		}
+		fmt.Println(line)
+	}
+	return rows.Err()
+}
+
+// gutchunk alias add "Dostoievski, F. M." "Fyodor Dostoyevsky" makes the
+// one an alias of the other, the author that is, by its name or one of its
+// aliases, or the catalog agent of that number; an author no alias has is
+// taken as given, a provisional author to gather others under. An alias
+// of an author to itself keeps it from being matched by near spelling.
+// alias rm drops an alias, and alias list lists them.
+func aliasCmd(args []string) error {
+	if len(args) == 0 {
+		return usagef("usage: gutchunk alias add|rm|list ...")
+	}
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err = requireSchema(schemaGap{"author_aliases", ""}); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "add":
+		fs := flag.NewFlagSet("alias add", flag.ExitOnError)
+		fs.Parse(args[1:])
+		if fs.NArg() != 2 {
+			return usagef("usage: gutchunk alias add AUTHOR AS")
+		}
+		key := aliasKey(fs.Arg(0))
+		if key == "" {
+			return usagef("%q has no words to go by", fs.Arg(0))
+		}
+		to, err := aliasTarget(db, fs.Arg(1))
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`INSERT INTO author_aliases (alias, agent_id, author, source, confidence, updated_at) VALUES (?, ?, ?, ?, 1, datetime('now'))
+			ON CONFLICT (alias) DO UPDATE SET agent_id = excluded.agent_id, author = excluded.author, source = excluded.source,
+				confidence = 1, updated_at = excluded.updated_at`,
+			key, to.agent, to.author, aliasManual)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s is now %s\n", fs.Arg(0), to.author)
+	case "rm":
+		if len(args) != 2 {
+			return usagef("usage: gutchunk alias rm AUTHOR")
+		}
+		res, err := db.Exec("DELETE FROM author_aliases WHERE alias = ?", aliasKey(args[1]))
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return fmt.Errorf("%s isn't an alias", args[1])
+		}
+	case "list":
+		fs := flag.NewFlagSet("alias list", flag.ExitOnError)
+		source := fs.String("source", "", "only aliases from catalog, fuzzy or manual")
+		fs.Parse(args[1:])
+		rows, err := db.Query(`SELECT alias, author, agent_id, source, confidence FROM author_aliases
+			WHERE ? IN ('', source) ORDER BY author, alias`, *source)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var key, author, source string
+			var agent sql.NullInt64
+			var confidence float64
+			if err = rows.Scan(&key, &author, &agent, &source, &confidence); err != nil {
+				return err
+			}
+			agentText := "-"
+			if agent.Valid {
+				agentText = fmt.Sprint(agent.Int64)
+			}
+			fmt.Printf("%-40s %-30s %6s %-7s %.2f\n", key, author, agentText, source, confidence)
+		}
+		return rows.Err()
+	default:
+		return usagef("usage: gutchunk alias add|rm|list ...")
+	}
+
+	c, err := resolveAuthors(context.Background(), db)
+	if err != nil {
+		return fmt.Errorf("could not resolve authors: %w", err)
+	}
+	fmt.Println(c)
+	fmt.Println("run gutchunk refresh-stats to group author_stats by it")
+	return nil
+}
+
+// aliasTarget is the author alias add makes an alias of.
+func aliasTarget(db *sql.DB, to string) (alias, error) {
+	var a alias
+	if n, err := strconv.Atoi(to); err == nil {
+		err = db.QueryRow("SELECT agent_id, author FROM author_aliases WHERE agent_id = ? LIMIT 1", n).Scan(&a.agent, &a.author)
+		if errors.Is(err, sql.ErrNoRows) {
+			return a, fmt.Errorf("the catalog has no agent %d", n)
+		}
+		return a, err
+	}
+	err := db.QueryRow("SELECT agent_id, author FROM author_aliases WHERE alias = ?", aliasKey(to)).Scan(&a.agent, &a.author)
+	if errors.Is(err, sql.ErrNoRows) {
+		return alias{author: strings.TrimSpace(to)}, nil
+	}
+	return a, err
+}
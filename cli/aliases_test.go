@@ -0,0 +1,193 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+func TestAliasScore(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		want float64
+	}{
+		// initials stand for the words they begin
+		{"Dostoievski, F. M.", "Dostoyevsky, Fyodor", 1},
+		{"L. Tolstoi", "Tolstoy, Leo", 1},
+		{"Mark Tvain", "Twain, Mark", 1},
+		{"Dostoevskij, Fiodor", "Dostoyevsky, Fyodor", 0.882},
+		{"Fedor Dostoevskii", "Dostoyevsky, Fyodor", 0.768},
+		// a word unpaired is nothing alike
+		{"Tolstoy", "Tolstoy, Leo", 0.7},
+		{"Jane Austen", "Tolstoy, Leo", 0},
+	} {
+		if got := aliasScore(authorWords(c.a), authorWords(c.b)); got < c.want-0.0005 || got > c.want+0.0005 {
+			t.Errorf("%q and %q are %.3f alike, want %.3f", c.a, c.b, got, c.want)
+		}
+	}
+	if aliasKey("Austen, Jane") != aliasKey("Jane Austen") {
+		t.Errorf("%q and %q have different keys", aliasKey("Austen, Jane"), aliasKey("Jane Austen"))
+	}
+}
+
+// aliasedLibrary is a book by each of authors, and the catalog's agents
+// for Dostoyevsky, Twain and the two Dumas, kept as gutchunk catalog keeps
+// them.
+func aliasedLibrary(t *testing.T, authors ...string) *sql.DB {
+	t.Helper()
+	db := testDB(t)
+	for _, a := range authors {
+		addBook(t, db, "A Book", a, "")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := saveCatalogAgents(tx, map[int]catalogAgent{
+		314: {314, "Dostoyevsky, Fyodor", []string{"Dostoevsky, Fyodor", "Smith, John"}},
+		53:  {53, "Twain, Mark", []string{"Clemens, Samuel Langhorne"}},
+		40:  {40, "Dumas, Alexandre", nil},
+		41:  {41, "Dumas, Alexandra", []string{"Smith, John"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	// a name two agents share is neither's
+	if n != 6 {
+		t.Errorf("%d names and aliases were kept", n)
+	}
+	return db
+}
+
+// resolvedAuthors is each book's author_norm and author_id, a line each.
+func resolvedAuthors(t *testing.T, db *sql.DB) string {
+	t.Helper()
+	return names(t, db, "SELECT author || ': ' || author_norm || ' ' || coalesce(author_id, '-') FROM files ORDER BY id")
+}
+
+func TestResolveAuthors(t *testing.T) {
+	db := aliasedLibrary(t,
+		"Dostoyevsky, Fyodor", "Fyodor Dostoevsky", "Dostoievski, F. M.", "Dostoevskij, Fiodor",
+		"Fedor Dostoevskii", "Samuel Langhorne Clemens", "Jane Austen", "Alexandr Dumas", "John Smith")
+	c, err := resolveAuthors(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != (aliasCounts{resolved: 5, fuzzy: 2, provisional: 4}) {
+		t.Errorf("resolving counted %+v", c)
+	}
+	// Fedor Dostoevskii is spelled too far off, and Alexandr Dumas as near
+	// one Dumas as the other
+	want := `Dostoyevsky, Fyodor: fyodor dostoyevsky 314
+Fyodor Dostoevsky: fyodor dostoyevsky 314
+Dostoievski, F. M.: fyodor dostoyevsky 314
+Dostoevskij, Fiodor: fyodor dostoyevsky 314
+Fedor Dostoevskii: fedor dostoevskii -
+Samuel Langhorne Clemens: mark twain 53
+Jane Austen: jane austen -
+Alexandr Dumas: alexandr dumas -
+John Smith: john smith -
+`
+	if got := resolvedAuthors(t, db); got != want {
+		t.Errorf("resolved, the books' authors are\n%s", lineDiff(want, got))
+	}
+	// the near spellings are kept as aliases, as near as they were
+	if got := names(t, db, "SELECT alias || ' ' || round(confidence, 2) FROM author_aliases WHERE source = 'fuzzy' ORDER BY alias"); got != "dostoevskij fiodor 0.94\ndostoievski f m 1.0\n" {
+		t.Errorf("the near spellings kept are\n%s", got)
+	}
+	// and a book is found by its author as given or as resolved
+	for _, author := range []string{"dostoievski", "dostoyevsky"} {
+		if got := ids(t, db, "SELECT file_id FROM name_words WHERE word = ? AND field = 'author' ORDER BY file_id", author); !strings.Contains(got, "3") {
+			t.Errorf("books with %s among their authors' words: %s", author, got)
+		}
+	}
+
+	// resolving again changes nothing
+	if c, err = resolveAuthors(context.Background(), db); err != nil || c != (aliasCounts{resolved: 5, fuzzy: 2, provisional: 4}) {
+		t.Errorf("resolving again counted %+v (%v)", c, err)
+	}
+	if got := resolvedAuthors(t, db); got != want {
+		t.Errorf("resolved again, the books' authors are\n%s", lineDiff(want, got))
+	}
+}
+
+func TestAliasCmd(t *testing.T) {
+	db := aliasedLibrary(t, "Dostoyevsky, Fyodor", "Fedor Dostoevskii", "Fedor Dostoevskii", "Jane Austen", "Tolstoy")
+	if _, err := resolveAuthors(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	out, err := captureStdout(t, func() error { return authorsCmd([]string{"--unresolved"}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "    2 books  Fedor Dostoevskii  (nearest Fyodor Dostoyevsky, 0.83)\n    1 books  Jane Austen\n    1 books  Tolstoy\n"
+	if out != want {
+		t.Errorf("authors --unresolved printed\n%s", lineDiff(want, out))
+	}
+
+	// by hand, to an agent by its number or an author by its alias, or to
+	// an author of no agent
+	for _, args := range [][]string{{"Fedor Dostoevskii", "314"}, {"Austen, Jane", "Jane Austen"}, {"Tolstoy", "Leo Tolstoy"}} {
+		if _, err = captureStdout(t, func() error { return aliasCmd(append([]string{"add"}, args...)) }); err != nil {
+			t.Fatalf("alias add %s: %v", strings.Join(args, " "), err)
+		}
+	}
+	want = `Dostoyevsky, Fyodor: fyodor dostoyevsky 314
+Fedor Dostoevskii: fyodor dostoyevsky 314
+Fedor Dostoevskii: fyodor dostoyevsky 314
+Jane Austen: jane austen -
+Tolstoy: leo tolstoy -
+`
+	if got := resolvedAuthors(t, db); got != want {
+		t.Errorf("aliased by hand, the books' authors are\n%s", lineDiff(want, got))
+	}
+	if out, err = captureStdout(t, func() error { return authorsCmd([]string{"--unresolved"}) }); err != nil || out != "" {
+		t.Errorf("aliased by hand, authors --unresolved printed %q (%v)", out, err)
+	}
+
+	// the catalog read again doesn't undo them
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = saveCatalogAgents(tx, map[int]catalogAgent{53: {53, "Twain, Mark", []string{"Tolstoy"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = resolveAuthors(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	if got := resolvedAuthors(t, db); got != want {
+		t.Errorf("the catalog read again, the books' authors are\n%s", lineDiff(want, got))
+	}
+
+	out, err = captureStdout(t, func() error { return aliasCmd([]string{"list", "--source", "manual"}) })
+	if err != nil || strings.Count(out, "\n") != 3 || !strings.Contains(out, "dostoevskii fedor") || !strings.Contains(out, "manual  1.00\n") {
+		t.Errorf("alias list --source manual printed\n%s(%v)", out, err)
+	}
+	if _, err = captureStdout(t, func() error { return aliasCmd([]string{"rm", "Fedor Dostoevskii"}) }); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.SplitN(resolvedAuthors(t, db), "\n", 3)[1]; got != "Fedor Dostoevskii: fedor dostoevskii -" {
+		t.Errorf("its alias gone, book 2's author is %q", got)
+	}
+	if _, err = captureStdout(t, func() error { return aliasCmd([]string{"rm", "Fedor Dostoevskii"}) }); err == nil {
+		t.Error("removing an alias twice succeeded")
+	}
+	if _, err = captureStdout(t, func() error { return aliasCmd([]string{"add", "Fedor Dostoevskii", "999"}) }); err == nil ||
+		!strings.Contains(err.Error(), "no agent 999") {
+		t.Errorf("alias add to agent 999: %v", err)
+	}
+
+	for _, args := range [][]string{nil, {"add", "Tolstoy"}, {"add", "...", "Leo Tolstoy"}, {"rm"}, {"sing"}} {
+		if _, err = captureStdout(t, func() error { return aliasCmd(args) }); exitCode(err) != exitUsage {
+			t.Errorf("alias %s: %v, want a usage error", strings.Join(args, " "), err)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package cli
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Anthologies put many works in one file. segment finds them by the
+// book's table of contents: entries found again, in order, as headings
+// standing alone in the body mark where each work starts. Works are
+// stored as ranges of lines of the body bookBody returns, which is what
+// the chunker reads, so each chunk can be given the work its first line
+// is in.
+
+// longest line taken for a contents entry or a heading
+const maxHeading = 80
+
+var (
+	tocHeading = regexp.MustCompile(`(?i)^(table of )?contents[.:]?$`)
+	// page numbers after an entry, and the dots leading to them
+	tocPage = regexp.MustCompile(`[\s.]*\d+$`)
+	// numbering before an entry, like "IV. " or "3) "
+	tocNumber = regexp.MustCompile(`(?i)^([0-9]+|[ivxlc]+)[.):]\s+`)
+	// entries or headings of the parts of one work, not works of their own
+	chapterish = regexp.MustCompile(`(?i)^((chapter|book|part|canto|act|scene|letter|volume|section|stave)\b|([0-9]+|[ivxlc]+)\.?$)`)
+)
+
+type workSpan struct {
+	id    int64
+	title string
+	// lines of the body, from start up to but not including end
+	start, end int
+}
+
+type segmentation struct {
+	works []workSpan
+	// from 0 to 1: the share of contents entries found as headings of
+	// works, less the share that look like chapters
+	confidence float64
+}
+
+// segmentBook finds the works of an anthology. Books without a contents
+// list, or whose contents don't lead to at least two works, have none.
+func segmentBook(content string) segmentation {
+	var seg segmentation
+	lines, _ := bookBody(content, false)
+	if lines == nil {
+		lines, _ = bookBody(content, true)
+	}
+
+	toc := -1
+	for i, line := range lines[:len(lines)/3] {
+		if tocHeading.MatchString(line) {
+			toc = i
+			break
+		}
+	}
+	if toc < 0 {
+		return seg
+	}
+	entries, from := tocEntries(lines, toc+1)
+	if len(entries) < 2 {
+		return seg
+	}
+
+	alone := func(i int) bool {
+		return lines[i] != "" && len(lines[i]) <= maxHeading &&
+			(i == 0 || lines[i-1] == "") && (i == len(lines)-1 || lines[i+1] == "")
+	}
+	chapters := 0
+	at := from
+	for _, e := range entries {
+		if chapterish.MatchString(e) {
+			chapters++
+		}
+		want := headingKey(e)
+		for i := at; i < len(lines); i++ {
+			if alone(i) && headingKey(lines[i]) == want {
+				seg.works = append(seg.works, workSpan{title: e, start: i})
+				at = i + 1
+				break
+			}
+		}
+	}
+
+	// a work too short to chunk is more likely a stray heading
+	works := seg.works[:0]
+	for i := range seg.works {
+		end := len(lines)
+		if i+1 < len(seg.works) {
+			end = seg.works[i+1].start
+		}
+		size := 0
+		for _, line := range lines[seg.works[i].start+1 : end] {
+			size += len(line)
+		}
+		if size >= minChunk {
+			works = append(works, seg.works[i])
+		}
+	}
+	if len(works) < 2 {
+		return segmentation{}
+	}
+	for i := range works {
+		works[i].end = len(lines)
+		if i+1 < len(works) {
+			works[i].end = works[i+1].start
+		}
+	}
+	seg.works = works
+	seg.confidence = float64(len(works)-chapters) / float64(len(entries))
+	if seg.confidence < 0 {
+		seg.confidence = 0
+	}
+	return seg
+}
+
+// tocEntries reads the contents list starting at line from, returning its
+// entries with numbering and page numbers dropped and the line after it.
+// It ends at a line too long to be an entry, after a few blank lines, or
+// at the first entry again, as the heading of the first work.
+func tocEntries(lines []string, from int) ([]string, int) {
+	entries := []string{}
+	blank := 0
+	for i := from; i < len(lines); i++ {
+		line := lines[i]
+		if line == "" {
+			blank++
+			continue
+		}
+		if len(line) > maxHeading || len(entries) > 0 && blank >= 3 {
+			return entries, i
+		}
+		blank = 0
+		e := strings.TrimSpace(tocNumber.ReplaceAllString(tocPage.ReplaceAllString(line, ""), ""))
+		if e == "" || strings.EqualFold(e, "page") {
+			continue
+		}
+		if len(entries) > 0 && headingKey(e) == headingKey(entries[0]) {
+			return entries, i
+		}
+		entries = append(entries, e)
+	}
+	return entries, len(lines)
+}
+
+// headingKey is what must agree between a contents entry and its heading:
+// the words, lowercased, without numbering or page numbers.
+func headingKey(s string) string {
+	s = tocNumber.ReplaceAllString(tocPage.ReplaceAllString(s, ""), "")
+	return strings.Join(strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}), " ")
+}
+
+type rowsQueryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// loadWorks returns the works segment stored for book id, in order.
+func loadWorks(q rowsQueryer, id int) ([]workSpan, error) {
+	rows, err := q.Query("SELECT id, coalesce(title, ''), start_offset, end_offset FROM works_in_file WHERE file_id = ? ORDER BY start_offset", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	works := []workSpan{}
+	for rows.Next() {
+		var w workSpan
+		if err = rows.Scan(&w.id, &w.title, &w.start, &w.end); err != nil {
+			return nil, err
+		}
+		works = append(works, w)
+	}
+	return works, rows.Err()
+}
+
+func segmentCmd(args []string) error {
+	fs := flag.NewFlagSet("segment", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "list the splits found without storing them")
+	minConfidence := fs.Float64("min-confidence", 0.8, "least confidence, from 0 to 1, for a split to be stored")
+	fs.Parse(args)
+
+	if *minConfidence < 0 || *minConfidence > 1 {
+		return usagef("--min-confidence must be from 0 to 1")
+	}
+	var ids []int
+	if fs.NArg() > 0 {
+		var err error
+		if ids, err = fileIDs("segment", fs.Args()); err != nil {
+			return err
+		}
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if ids == nil {
+		if ids, err = liveBooks(db); err != nil {
+			return err
+		}
+	}
+
+	split, low, stale := 0, 0, 0
+	for _, id := range ids {
+		b, err := loadBook(db, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("no file %d", id)
+		}
+		if err != nil {
+			return err
+		}
+		seg := segmentBook(b.Content)
+		keep := len(seg.works) > 0 && seg.confidence >= *minConfidence
+		if len(seg.works) > 0 {
+			note := ""
+			if !keep {
+				note = ", below --min-confidence"
+				low++
+			} else {
+				split++
+			}
+			fmt.Printf("%d %s (confidence %.2f%s)\n", id, b.Name, seg.confidence, note)
+			for _, w := range seg.works {
+				fmt.Printf("  %6d-%-6d %s\n", w.start, w.end, w.title)
+			}
+		}
+		if *dryRun {
+			continue
+		}
+		if !keep {
+			seg.works = nil
+		}
+		ok, err := saveWorks(db, b, seg)
+		if err != nil {
+			return fmt.Errorf("book %d: %w", id, err)
+		}
+		if !ok {
+			stale++
+		}
+	}
+
+	verb := "split"
+	if *dryRun {
+		verb = "would split"
+	}
+	fmt.Printf("%s %d books into works; %d more below --min-confidence %.2f\n", verb, split, low, *minConfidence)
+	if stale > 0 {
+		fmt.Printf("%d books were chunked with other options; delete their chunks and chunk them again to attribute them to works\n", stale)
+	}
+	return nil
+}
+
+func liveBooks(db *sql.DB) ([]int, error) {
+	rows, err := db.Query("SELECT id FROM files WHERE deleted_at IS NULL ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// saveWorks replaces the works stored for b with those of seg, and
+// attributes b's chunks to them if they are as chunk makes them by
+// default. It reports false when b's chunks differ and were left without
+// works.
+func saveWorks(db *sql.DB, b bookfile, seg segmentation) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var had int
+	if err = tx.QueryRow("SELECT count(*) FROM works_in_file WHERE file_id = ?", b.ID).Scan(&had); err != nil {
+		return false, err
+	}
+	if had == 0 && len(seg.works) == 0 {
+		return true, nil
+	}
+	for _, q := range []string{
+		"UPDATE chunks SET work_id = NULL WHERE sourceid = ? AND work_id IS NOT NULL",
+		"DELETE FROM works_in_file WHERE file_id = ?",
+	} {
+		if _, err = tx.Exec(q, b.ID); err != nil {
+			return false, err
+		}
+	}
+	for i, w := range seg.works {
+		res, err := tx.Exec(`INSERT INTO works_in_file (file_id, title, start_offset, end_offset, confidence, created_at)
+			VALUES (?, ?, ?, ?, ?, datetime('now'))`, b.ID, w.title, w.start, w.end, seg.confidence)
+		if err != nil {
+			return false, err
+		}
+		if seg.works[i].id, err = res.LastInsertId(); err != nil {
+			return false, err
+		}
+	}
+
+	ok := true
+	if len(seg.works) > 0 {
+		if ok, err = attributeChunks(tx, b, seg.works); err != nil {
+			return false, err
+		}
+	}
+	return ok, tx.Commit()
+}
+
+// attributeChunks sets the works of b's stored chunks, if they are the
+// ones a default chunking makes, so they can be matched up without
+// chunking again. It reports false when they aren't.
+func attributeChunks(tx *sql.Tx, b bookfile, works []workSpan) (bool, error) {
+	rows, err := tx.Query("SELECT chunk FROM chunks WHERE sourceid = ? ORDER BY ordinal", b.ID)
+	if err != nil {
+		return false, err
+	}
+	stored := []string{}
+	for rows.Next() {
+		var c string
+		if err = rows.Scan(&c); err != nil {
+			rows.Close()
+			return false, err
+		}
+		stored = append(stored, c)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return false, err
+	}
+	if len(stored) == 0 {
+		return true, nil
+	}
+
+	chunks, at, _, _ := splitBookAt(b.Content, chunkOptions{bodyOnly: b.BodyOnly})
+	if len(chunks) != len(stored) {
+		return false, nil
+	}
+	for i := range chunks {
+		if chunks[i] != stored[i] {
+			return false, nil
+		}
+	}
+	for ordinal, x := range chunkExtras(works, at, false) {
+		if x.work == nil {
+			continue
+		}
+		if _, err = tx.Exec("UPDATE chunks SET work_id = ? WHERE sourceid = ? AND ordinal = ?", x.work, b.ID, ordinal); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,193 @@
+package cli
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// story is a body of paragraphs each about what, so a chunk tells which
+// story it is from.
+func story(what string, n int) string {
+	var p []string
+	for i := 0; i < n; i++ {
+		p = append(p, "The tale went on about the "+what+", part "+strconv.Itoa(i+1)+" of it, "+
+			strings.Repeat("and about the "+what+" and the house it was in at some length, ", 6)+"as tales will.")
+	}
+	return strings.Join(p, "\n\n")
+}
+
+var (
+	// two stories, each headed as the contents list has it
+	twoTales = testBook("Two Tales", "CONTENTS\n\nI. The Red Room .......... 1\nII. The Blue Door ....... 40\n\n\n\n"+
+		"THE RED ROOM\n\n"+story("red room", 4)+"\n\nTHE BLUE DOOR\n\n"+story("blue door", 4))
+	// three entries, a preface whose heading is nowhere: a split less sure
+	threeTales = testBook("Three Tales", "Contents:\n\nPreface\nThe Green Gate\nThe Grey Hall\n\n\n\n"+
+		"The Green Gate\n\n"+story("green gate", 4)+"\n\nThe Grey Hall\n\n"+story("grey hall", 4))
+	// a novel's contents are of its chapters, not its works
+	novel = testBook("A Novel", "CONTENTS\n\nChapter I\nChapter II\n\n\n\n"+
+		"CHAPTER I\n\n"+story("moor", 4)+"\n\nCHAPTER II\n\n"+story("moor", 4))
+)
+
+// headingAt is the line of content's body that is heading, standing alone.
+func headingAt(t *testing.T, content, heading string) int {
+	t.Helper()
+	lines, _ := bookBody(content, false)
+	for i, l := range lines {
+		if l == heading && i > 0 && lines[i-1] == "" {
+			return i
+		}
+	}
+	t.Fatalf("no heading %q in the body", heading)
+	return -1
+}
+
+func TestSegmentBook(t *testing.T) {
+	lines, _ := bookBody(twoTales, false)
+	red, blue := headingAt(t, twoTales, "THE RED ROOM"), headingAt(t, twoTales, "THE BLUE DOOR")
+	green, grey := headingAt(t, threeTales, "The Green Gate"), headingAt(t, threeTales, "The Grey Hall")
+	threeLines, _ := bookBody(threeTales, false)
+	novelLines, _ := bookBody(novel, false)
+	for _, c := range []struct {
+		name, content string
+		works         []workSpan
+		confidence    float64
+	}{
+		{"two tales", twoTales, []workSpan{{title: "The Red Room", start: red, end: blue}, {title: "The Blue Door", start: blue, end: len(lines)}}, 1},
+		{"three tales", threeTales, []workSpan{{title: "The Green Gate", start: green, end: grey}, {title: "The Grey Hall", start: grey, end: len(threeLines)}}, 2.0 / 3},
+		// its chapters are found, and take all the confidence away
+		{"novel", novel, []workSpan{{title: "Chapter I", start: headingAt(t, novel, "CHAPTER I"), end: headingAt(t, novel, "CHAPTER II")},
+			{title: "Chapter II", start: headingAt(t, novel, "CHAPTER II"), end: len(novelLines)}}, 0},
+		{"no contents", testBook("Plain", story("moor", 8)), nil, 0},
+		// a heading with nothing under it is no work
+		{"stray heading", testBook("Stray", "CONTENTS\n\nOne\nTwo\n\n\n\nOne\n\n"+story("moor", 4)+"\n\nTwo\n\nThe end."), nil, 0},
+	} {
+		seg := segmentBook(c.content)
+		if fmt.Sprint(seg.works) != fmt.Sprint(c.works) || fmt.Sprintf("%.2f", seg.confidence) != fmt.Sprintf("%.2f", c.confidence) {
+			t.Errorf("%s: works %v, confidence %.2f, want %v, %.2f", c.name, seg.works, seg.confidence, c.works, c.confidence)
+		}
+	}
+}
+
+func TestTOCEntries(t *testing.T) {
+	for _, c := range []struct {
+		toc  string
+		want []string
+		next int
+	}{
+		{"I. The Red Room .... 1\nII. The Blue Door .... 40\n\nTHE RED ROOM\n\nIt began.", []string{"The Red Room", "The Blue Door"}, 3},
+		{"\nPAGE\nOne 3\n2) Two 9\n\n\n\nA line too far from the rest", []string{"One", "Two"}, 7},
+		{"One\nTwo\n" + strings.Repeat("x", maxHeading+1), []string{"One", "Two"}, 2},
+		{"One\nTwo", []string{"One", "Two"}, 2},
+	} {
+		entries, next := tocEntries(strings.Split(c.toc, "\n"), 0)
+		if fmt.Sprint(entries) != fmt.Sprint(c.want) || next != c.next {
+			t.Errorf("tocEntries(%q) = %q, %d, want %q, %d", c.toc, entries, next, c.want, c.next)
+		}
+	}
+}
+
+func TestSegmentCmd(t *testing.T) {
+	db := testDB(t)
+	two := addBook(t, db, "Two Tales", "Ann Author", twoTales)
+	three := addBook(t, db, "Three Tales", "Bea Author", threeTales)
+	addBook(t, db, "A Novel", "Cy Author", novel)
+	if _, err := captureStdout(t, func() error { return makeChunks(db, chunkOptions{}) }); err != nil {
+		t.Fatal(err)
+	}
+	works := func() string {
+		t.Helper()
+		rows, err := db.Query("SELECT file_id, title FROM works_in_file ORDER BY id")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var got []string
+		for rows.Next() {
+			var id int
+			var title string
+			if err = rows.Scan(&id, &title); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, fmt.Sprintf("%d %s", id, title))
+		}
+		return strings.Join(got, ", ")
+	}
+
+	// a dry run lists every split found, those below the confidence too,
+	// and stores none of them
+	out, err := captureStdout(t, func() error { return segmentCmd([]string{"--dry-run"}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		fmt.Sprintf("%d Two Tales (confidence 1.00)\n", two),
+		fmt.Sprintf("%6d-%-6d The Red Room\n", headingAt(t, twoTales, "THE RED ROOM"), headingAt(t, twoTales, "THE BLUE DOOR")),
+		fmt.Sprintf("%d Three Tales (confidence 0.67, below --min-confidence)\n", three),
+		"A Novel (confidence 0.00, below --min-confidence)\n",
+		"would split 1 books into works; 2 more below --min-confidence 0.80\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("segment --dry-run doesn't say %q:\n%s", want, out)
+		}
+	}
+	if got := works(); got != "" {
+		t.Errorf("segment --dry-run stored works: %s", got)
+	}
+
+	// a confidence out of range is refused before anything is segmented
+	if err = segmentCmd([]string{"--min-confidence", "1.5"}); exitCode(err) != exitUsage {
+		t.Errorf("segment --min-confidence 1.5: %v", err)
+	}
+
+	// below the confidence asked for a split is left out; the novel's is
+	// always, chapters and all
+	if _, err = captureStdout(t, func() error { return segmentCmd(nil) }); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := works(), fmt.Sprintf("%d The Red Room, %d The Blue Door", two, two); got != want {
+		t.Errorf("segment stored the works %s, want %s", got, want)
+	}
+	if _, err = captureStdout(t, func() error { return segmentCmd([]string{"--min-confidence", "0.6"}) }); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := works(), fmt.Sprintf("%d The Red Room, %d The Blue Door, %d The Green Gate, %d The Grey Hall", two, two, three, three); got != want {
+		t.Errorf("segment --min-confidence 0.6 stored the works %s, want %s", got, want)
+	}
+
+	// and the chunks already made are attributed to their works, so random
+	// credits each with its own, by the anthology's author
+	var unattributed int
+	if err = db.QueryRow("SELECT count(*) FROM chunks WHERE sourceid IN (?, ?) AND work_id IS NULL", two, three).Scan(&unattributed); err != nil {
+		t.Fatal(err)
+	}
+	if unattributed > 0 {
+		t.Errorf("%d chunks of the anthologies have no work", unattributed)
+	}
+	credits := map[string]string{
+		"red room":   "— The Red Room, by Ann Author",
+		"blue door":  "— The Blue Door, by Ann Author",
+		"green gate": "— The Green Gate, by Bea Author",
+		"grey hall":  "— The Grey Hall, by Bea Author",
+		"moor":       "— A Novel, by Cy Author",
+	}
+	seen := map[string]bool{}
+	for seed := 1; seed <= 60 && len(seen) < len(credits); seed++ {
+		out, err := captureStdout(t, func() error { return randomCmd([]string{"--seed", strconv.Itoa(seed), "--width", "0"}) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		for what, credit := range credits {
+			if strings.Contains(out, "about the "+what+" ") {
+				seen[what] = true
+				if !strings.Contains(out, "\n"+credit+"\n") {
+					t.Errorf("random credits a chunk about the %s otherwise than %q:\n%s", what, credit, out)
+				}
+			}
+		}
+	}
+	if len(seen) < len(credits) {
+		t.Errorf("60 draws were only of %v", seen)
+	}
+}
@@ -0,0 +1,180 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A mirror is laid out one of two ways. The aleph layout, the one rsync
+// serves, has each book's zips in numbered directories, 1/2/3/123/123.zip,
+// and the pre-2003 etexts in etextNN directories beside them. The cache
+// layout, cache/epub/123/pg123.txt.utf8, has the text itself, unzipped,
+// as pg123.txt and, where both are there, pg123.txt.utf8, which is taken
+// in preference. The walk takes both wherever it finds them, or only one
+// with ingest --mirror-layout. Books from the cache layout are filed by
+// their ebook number, 123.txt, as the aleph layout's are, so a book is the
+// same to tombstones and other sources whichever mirror it came from, and
+// the ebook from the other layout is skipped as the same book.
+
+const (
+	layoutAleph = "aleph"
+	layoutEtext = "etext"
+	layoutCache = "cache"
+)
+
+var (
+	// 12345.zip, 12345-8.zip, 12345-0.zip
+	alephName = regexp.MustCompile(`^(\d+)(?:-(\d))?\.zip$`)
+	// pre-2003 names like 1sws10.zip, 8rbaa11.zip or alice30a.zip: letters
+	// encoding the title, then a two digit edition and an optional
+	// revision letter, sometimes with an x marking a revised edition
+	etextName = regexp.MustCompile(`^(\d?[a-z][a-z0-9]*?)(x?)(\d\d)([a-z])?\.zip$`)
+	etextDir  = regexp.MustCompile(`^etext\d\d$`)
+	// cache/epub/123/pg123.txt and pg123.txt.utf8
+	cacheName = regexp.MustCompile(`^pg(\d+)\.txt(\.utf8)?$`)
+
+	headerEbook = regexp.MustCompile(`(?i)\[\s*e-?(?:book|text)\s*#\s*(\d+)\s*\]`)
+	headerLang  = regexp.MustCompile(`(?im)^[ \t]*Language:[ \t]*(\S[^\r\n]*?)[ \t]*\r?$`)
+)
+
+type archiveName struct {
+	layout string
+	// ebook number, 0 when the name does not carry one
+	ebook int
+	// for the etext layout, the title code and edition; x revisions and
+	// revision letters count after the edition number, so x10 > 10a > 10
+	code    string
+	edition int
+}
+
+func parseArchiveName(archive string) archiveName {
+	base := strings.ToLower(filepath.Base(archive))
+	dir := strings.ToLower(filepath.Base(filepath.Dir(archive)))
+
+	if m := cacheName.FindStringSubmatch(base); m != nil && m[1] == dir {
+		n, _ := strconv.Atoi(m[1])
+		return archiveName{layout: layoutCache, ebook: n}
+	}
+	if m := alephName.FindStringSubmatch(base); m != nil && !etextDir.MatchString(dir) {
+		n, _ := strconv.Atoi(m[1])
+		return archiveName{layout: layoutAleph, ebook: n}
+	}
+	if m := etextName.FindStringSubmatch(base); m != nil {
+		ed, _ := strconv.Atoi(m[3])
+		ed *= 100
+		if m[2] != "" {
+			ed += 50
+		}
+		if m[4] != "" {
+			ed += int(m[4][0]-'a') + 1
+		}
+		return archiveName{layout: layoutEtext, code: m[1], edition: ed}
+	}
+	return archiveName{layout: layoutAleph}
+}
+
+// headerEbookNumber finds the [EBook #123] or [Etext #123] line near the top
+// of a text, for names that do not carry the number.
+func headerEbookNumber(content []byte) int {
+	if len(content) > 8192 {
+		content = content[:8192]
+	}
+	m := headerEbook.FindSubmatch(content)
+	if m == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(string(m[1]))
+	return n
+}
+
+// headerLanguage returns the codes for a Gutenberg header's Language:
+// line (see normalizeLanguages), or "" without one.
+func headerLanguage(content []byte) string {
+	if len(content) > 8192 {
+		content = content[:8192]
+	}
+	m := headerLang.FindSubmatch(content)
+	if m == nil {
+		return ""
+	}
+	return normalizeLanguages(string(m[1]))
+}
+
+// editionFilter remembers the newest edition of each title code in the
+// etext directory it last looked at, so the walk can skip superseded
+// editions without listing a directory more than once.
+type editionFilter struct {
+	dir    string
+	newest map[string]int
+}
+
+// superseded reports whether a newer edition of the same etext sits next to
+// the archive, or for the cache layout, the utf8 text beside a pgN.txt.
+func (f *editionFilter) superseded(archive string) bool {
+	n := parseArchiveName(archive)
+	if n.layout == layoutCache && !strings.HasSuffix(strings.ToLower(archive), ".utf8") {
+		_, err := os.Stat(archive + ".utf8")
+		return err == nil
+	}
+	if n.layout != layoutEtext {
+		return false
+	}
+	dir := filepath.Dir(archive)
+	if dir != f.dir {
+		f.dir = dir
+		f.newest = map[string]int{}
+		entries, _ := os.ReadDir(dir)
+		for _, e := range entries {
+			o := parseArchiveName(filepath.Join(dir, e.Name()))
+			if o.layout == layoutEtext && o.edition > f.newest[o.code] {
+				f.newest[o.code] = o.edition
+			}
+		}
+	}
+	return n.edition < f.newest[n.code]
+}
+
+// isCacheText reports whether file is a book's text in the cache layout.
+func isCacheText(file string) bool {
+	return parseArchiveName(file).layout == layoutCache
+}
+
+// mirrorLayout is the mirror layout an archive of layout is from: the etext
+// directories are part of the aleph layout's tree.
+func mirrorLayout(layout string) string {
+	if layout == layoutCache {
+		return layoutCache
+	}
+	return layoutAleph
+}
+
+// bookFilename is the filename of the book in m, the same whichever
+// mirror layout it came from: the member's name, or for the cache layout,
+// its ebook number as the aleph layout names it.
+func bookFilename(m zipMember, an archiveName) string {
+	if an.layout == layoutCache {
+		if m.part > 1 {
+			return fmt.Sprintf("%d.txt#%d", an.ebook, m.part)
+		}
+		return fmt.Sprintf("%d.txt", an.ebook)
+	}
+	return path.Base(m.name)
+}
+
+func mirrorLayoutFlag(fs *flag.FlagSet, o *ingestOptions) func() error {
+	layout := fs.String("mirror-layout", "", "walk only the archives of this mirror layout, aleph (1/2/3/123/123.zip) or cache (cache/epub/123/pg123.txt.utf8), instead of both")
+	return func() error {
+		switch *layout {
+		case "", layoutAleph, layoutCache:
+			o.mirrorLayout = *layout
+			return nil
+		}
+		return usagef("unknown --mirror-layout %q; want aleph or cache", *layout)
+	}
+}
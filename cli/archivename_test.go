@@ -0,0 +1,179 @@
+package cli
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseArchiveName(t *testing.T) {
+	for _, c := range []struct {
+		archive string
+		want    archiveName
+	}{
+		{"1/2/3/123/123.zip", archiveName{layout: layoutAleph, ebook: 123}},
+		{"1/3/4/1342/1342-8.zip", archiveName{layout: layoutAleph, ebook: 1342}},
+		{"cache/epub/84/pg84.txt.utf8", archiveName{layout: layoutCache, ebook: 84}},
+		{"cache/epub/84/pg84.txt", archiveName{layout: layoutCache, ebook: 84}},
+
+		// the old etext names: a title code, then the edition
+		{"etext91/1sws10.zip", archiveName{layout: layoutEtext, code: "1sws", edition: 1000}},
+		{"etext97/8rbaa11.zip", archiveName{layout: layoutEtext, code: "8rbaa", edition: 1100}},
+		{"etext91/alice30a.zip", archiveName{layout: layoutEtext, code: "alice", edition: 3001}},
+		{"etext95/DRACU13.ZIP", archiveName{layout: layoutEtext, code: "dracu", edition: 1300}},
+		{"etext94/warpx10.zip", archiveName{layout: layoutEtext, code: "warp", edition: 1050}},
+		{"etext92/hfinn11b.zip", archiveName{layout: layoutEtext, code: "hfinn", edition: 1102}},
+
+		// names that carry no number
+		{"etext99/12345.zip", archiveName{layout: layoutAleph}},
+		{"elsewhere/pg84.txt", archiveName{layout: layoutAleph}},
+		{"1/2/3/readme.zip", archiveName{layout: layoutAleph}},
+	} {
+		if got := parseArchiveName(filepath.FromSlash(c.archive)); got != c.want {
+			t.Errorf("parseArchiveName(%q) = %+v, want %+v", c.archive, got, c.want)
+		}
+	}
+}
+
+func TestHeaderEbookNumber(t *testing.T) {
+	for _, c := range []struct {
+		header string
+		want   int
+	}{
+		{"Release Date: June, 2004 [EBook #1342]\n", 1342},
+		{"Release Date: March, 1994  [Etext #84]\n", 84},
+		{"[E-text # 12 ]", 12},
+		{"[eBook #6]", 6},
+		{"Release Date: 1994\n", 0},
+		{strings.Repeat("x", 9000) + "[EBook #1342]", 0},
+	} {
+		if got := headerEbookNumber([]byte(c.header)); got != c.want {
+			t.Errorf("headerEbookNumber(%.40q) = %d, want %d", c.header, got, c.want)
+		}
+	}
+}
+
+func TestEditionSuperseded(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "etext97")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{
+		"dracu10.zip":  true,
+		"dracu11.zip":  true,
+		"dracu11a.zip": true,
+		"dracux11.zip": false,
+		"alice30.zip":  false,
+	}
+	for name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f := &editionFilter{}
+	for name, want := range names {
+		if got := f.superseded(filepath.Join(dir, name)); got != want {
+			t.Errorf("superseded(%s) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestIngestEtext(t *testing.T) {
+	root := t.TempDir()
+	dracula := testBook("Dracula", testParagraphs(2))
+	dracula = strings.Replace(dracula, "\n\nTitle:", " [Etext #345]\n\nTitle:", 1)
+	writeTestZip(t, filepath.Join(root, "etext95", "dracu10.zip"), zipEntry{"dracu10.txt", testBook("Dracula", "the first edition")})
+	writeTestZip(t, filepath.Join(root, "etext95", "dracu12.zip"), zipEntry{"dracu12.txt", dracula})
+	db := testDB(t)
+	if err := readFiles(db, root, ingestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	var n, ebook, edition int
+	var layout string
+	if err := db.QueryRow("SELECT count(*), max(ebook), max(edition), max(layout) FROM files").Scan(&n, &ebook, &edition, &layout); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || ebook != 345 || edition != 1200 || layout != layoutEtext {
+		t.Errorf("ingested %d books, ebook %d, edition %d, layout %q; want the one of ebook 345's newest edition, 1200, of the etext layout", n, ebook, edition, layout)
+	}
+}
+
+func TestIngestMirrorLayouts(t *testing.T) {
+	frankenstein := testBook("Frankenstein", testParagraphs(3))
+	aleph := t.TempDir()
+	writeTestZip(t, filepath.Join(aleph, "8", "84", "84.zip"), zipEntry{"84.txt", frankenstein})
+	cache := t.TempDir()
+	writeText := func(root, name, content string) {
+		t.Helper()
+		file := filepath.Join(root, "cache", "epub", "84", name)
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the utf8 text is taken over the plain one beside it
+	writeText(cache, "pg84.txt", testBook("Frankenstein", "the ascii text"))
+	writeText(cache, "pg84.txt.utf8", frankenstein)
+	rows := func(db *sql.DB) string {
+		t.Helper()
+		return names(t, db, "SELECT filename || ' ' || member_name || ' ' || layout || ' ' || coalesce(ebook, 0) FROM files WHERE deleted_at IS NULL ORDER BY id")
+	}
+	ingest := func(args ...string) string {
+		t.Helper()
+		out, err := captureStdout(t, func() error { return ingestCmd(args) })
+		if err != nil {
+			t.Fatalf("ingest %s: %v", strings.Join(args, " "), err)
+		}
+		return out
+	}
+
+	db := testDB(t)
+	if out := ingest("--target", cache); !strings.Contains(out, "skipping superseded edition "+filepath.Join("cache", "epub", "84", "pg84.txt")+"\n") {
+		t.Errorf("ingest of the cache layout printed\n%s", out)
+	}
+	if got := rows(db); got != "84.txt pg84.txt.utf8 cache 84\n" {
+		t.Errorf("ingest of the cache layout stored\n%s", got)
+	}
+
+	// the same ebook from both mirrors is the one book
+	for _, order := range [][2]string{{aleph, cache}, {cache, aleph}} {
+		db = testDB(t)
+		ingest("--target", order[0])
+		ingest("--target", order[1])
+		if got := names(t, db, "SELECT count(*) FROM files WHERE deleted_at IS NULL"); got != "1\n" {
+			t.Errorf("ingest of %s then %s stored\n%s", order[0], order[1], rows(db))
+		}
+	}
+
+	// and from one mirror holding both layouts, whose texts differ in
+	// their line endings
+	both := t.TempDir()
+	writeTestZip(t, filepath.Join(both, "8", "84", "84.zip"), zipEntry{"84.txt", frankenstein})
+	writeText(both, "pg84.txt.utf8", strings.ReplaceAll(frankenstein, "\n", "\r\n"))
+	db = testDB(t)
+	manifest := filepath.Join(t.TempDir(), "run.jsonl")
+	ingest("--target", both, "--manifest", manifest)
+	if b, err := os.ReadFile(manifest); err != nil || !strings.Contains(string(b), `"code":"other_mirror"`) {
+		t.Errorf("the manifest of a mirror of both layouts is\n%s(%v)", b, err)
+	}
+	if got := rows(db); got != "84.txt 84.txt aleph 84\n" {
+		t.Errorf("ingest of a mirror of both layouts stored\n%s", got)
+	}
+	if got := warningRows(t, db); strings.Contains(got, "ingest ") {
+		t.Errorf("ingest of a mirror of both layouts warned of the other\n%s", got)
+	}
+	for layout, want := range map[string]string{layoutAleph: "84.txt 84.txt aleph 84\n", layoutCache: "84.txt pg84.txt.utf8 cache 84\n"} {
+		db = testDB(t)
+		ingest("--target", both, "--mirror-layout", layout)
+		if got := rows(db); got != want {
+			t.Errorf("ingest --mirror-layout %s stored\n%s", layout, got)
+		}
+	}
+	if _, err := captureStdout(t, func() error { return ingestCmd([]string{"--target", both, "--mirror-layout", "epub"}) }); exitCode(err) != exitUsage {
+		t.Errorf("ingest --mirror-layout epub: %v, want a usage error", err)
+	}
+}
@@ -0,0 +1,226 @@
+package cli
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type bookAudit struct {
+	ID      int      `json:"id"`
+	Title   string   `json:"title"`
+	Stored  int      `json:"stored"`
+	Current int      `json:"current"`
+	Added   int      `json:"added_chars"`
+	Removed int      `json:"removed_chars"`
+	Samples []string `json:"samples,omitempty"`
+}
+
+type auditReport struct {
+	Books        int         `json:"books"`
+	Identical    int         `json:"identical"`
+	CountChanged int         `json:"count_changed"`
+	Added        int         `json:"added_chars"`
+	Removed      int         `json:"removed_chars"`
+	Changed      []bookAudit `json:"changed"`
+}
+
+// diffChunks compares stored and freshly produced chunks as multisets, so
+// renumbered but otherwise identical chunks do not count as changes.
+func diffChunks(stored, current []string) (added, removed []string) {
+	have := map[string]int{}
+	for _, c := range stored {
+		have[c]++
+	}
+	for _, c := range current {
+		if have[c] > 0 {
+			have[c]--
+			continue
+		}
+		added = append(added, c)
+	}
+	for _, c := range stored {
+		if have[c] > 0 {
+			have[c]--
+			removed = append(removed, c)
+		}
+	}
+	return added, removed
+}
+
+func sumLen(ss []string) int {
+	n := 0
+	for _, s := range ss {
+		n += len(s)
+	}
+	return n
+}
+
+func auditChunksCmd(args []string) error {
+	fs := flag.NewFlagSet("audit-chunks", flag.ExitOnError)
+	sample := fs.Int("sample", 200, "number of chunked books to re-chunk")
+	examples := fs.Int("examples", 3, "example diffs to show per changed book")
+	asJSON := fs.Bool("json", false, "print the report as json")
+	var opts chunkOptions
+	fs.BoolVar(&opts.stripRefs, "strip-refs", false, "re-chunk as chunk --strip-refs would")
+	footer := footerFlags(fs)
+	breaks := sceneFlags(fs)
+	overrides := overridesFlag(fs)
+	langMins := langMinFlag(fs)
+	sizes := chunkSizeFlags(fs, &opts)
+	fs.Parse(args)
+
+	var err error
+	if opts.footer, err = footer(); err != nil {
+		return err
+	}
+	if opts.breaks, err = breaks(); err != nil {
+		return err
+	}
+	if opts.overrides, err = overrides(); err != nil {
+		return err
+	}
+	if opts.langMins, err = langMins(); err != nil {
+		return err
+	}
+	if err = sizes(); err != nil {
+		return err
+	}
+	if err = opts.oneStrategy("audit-chunks"); err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rep, err := auditChunks(db, *sample, *examples, opts)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		if err = json.NewEncoder(os.Stdout).Encode(rep); err != nil {
+			return err
+		}
+	} else {
+		printAudit(rep)
+	}
+
+	if len(rep.Changed) > 0 {
+		return exitStatus(1)
+	}
+	return nil
+}
+
+func auditChunks(db *sql.DB, sample, examples int, opts chunkOptions) (auditReport, error) {
+	var rep auditReport
+	rep.Changed = []bookAudit{}
+
+	// books stored without content, by run --no-store-content or
+	// dump-sample --strip-content, have nothing to chunk again
+	rows, err := db.Query("SELECT id FROM files WHERE "+hasContent("")+" AND id IN (SELECT DISTINCT sourceid FROM chunks) ORDER BY random() LIMIT ?", sample)
+	if err != nil {
+		return rep, err
+	}
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return rep, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return rep, err
+	}
+
+	for _, id := range ids {
+		b, err := loadBook(db, id)
+		if err != nil {
+			return rep, err
+		}
+		stored, err := storedChunks(db, id)
+		if err != nil {
+			return rep, err
+		}
+		bopts, err := opts.overrides.apply(b, opts.forBook(b))
+		if err != nil {
+			return rep, fmt.Errorf("book %d: %w", id, err)
+		}
+		current, _, _ := splitBook(b.Content, bopts)
+
+		rep.Books++
+		added, removed := diffChunks(stored, current)
+		if len(added) == 0 && len(removed) == 0 {
+			rep.Identical++
+			continue
+		}
+		if len(stored) != len(current) {
+			rep.CountChanged++
+		}
+		ba := bookAudit{ID: id, Title: b.Name, Stored: len(stored), Current: len(current),
+			Added: sumLen(added), Removed: sumLen(removed)}
+		for i := 0; i < examples && (i < len(added) || i < len(removed)); i++ {
+			d := ""
+			if i < len(removed) {
+				d += "- " + clip(removed[i], 160) + "\n"
+			}
+			if i < len(added) {
+				d += "+ " + clip(added[i], 160) + "\n"
+			}
+			ba.Samples = append(ba.Samples, d)
+		}
+		rep.Added += ba.Added
+		rep.Removed += ba.Removed
+		rep.Changed = append(rep.Changed, ba)
+	}
+
+	return rep, nil
+}
+
+func storedChunks(db *sql.DB, id int) ([]string, error) {
+	rows, err := db.Query("SELECT chunk FROM chunks WHERE sourceid = ? ORDER BY ordinal, id", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []string{}
+	for rows.Next() {
+		var c string
+		if err = rows.Scan(&c); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// clip shortens s to about n runes on one line.
+func clip(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	rs := []rune(s)
+	if len(rs) <= n {
+		return s
+	}
+	return string(rs[:n]) + "…"
+}
+
+func printAudit(rep auditReport) {
+	fmt.Printf("audited %d books: %d identical, %d changed (%d with a different chunk count)\n",
+		rep.Books, rep.Identical, len(rep.Changed), rep.CountChanged)
+	fmt.Printf("characters: +%d -%d\n", rep.Added, rep.Removed)
+	for _, b := range rep.Changed {
+		fmt.Printf("\nbook %d %s: %d -> %d chunks, +%d -%d chars\n", b.ID, b.Title, b.Stored, b.Current, b.Added, b.Removed)
+		for _, s := range b.Samples {
+			fmt.Print(s)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDiffChunks(t *testing.T) {
+	for _, c := range []struct {
+		name            string
+		stored, current []string
+		added, removed  []string
+	}{
+		{"identical", []string{"a", "b", "c"}, []string{"a", "b", "c"}, nil, nil},
+		{"renumbered", []string{"a", "b", "c"}, []string{"c", "a", "b"}, nil, nil},
+		{"added", []string{"a", "b"}, []string{"a", "x", "b", "y"}, []string{"x", "y"}, nil},
+		{"removed", []string{"a", "x", "b", "y"}, []string{"b", "a"}, nil, []string{"x", "y"}},
+		{"changed", []string{"a", "b", "c"}, []string{"a", "B", "c"}, []string{"B"}, []string{"b"}},
+		// as multisets: a chunk twice is not the chunk once
+		{"duplicated", []string{"a", "b"}, []string{"a", "b", "a"}, []string{"a"}, nil},
+		{"deduplicated", []string{"a", "a", "b", "a"}, []string{"b", "a"}, nil, []string{"a", "a"}},
+		{"from nothing", nil, []string{"a", "a"}, []string{"a", "a"}, nil},
+		{"to nothing", []string{"a", "b"}, nil, nil, []string{"a", "b"}},
+	} {
+		added, removed := diffChunks(c.stored, c.current)
+		if fmt.Sprint(added) != fmt.Sprint(c.added) || fmt.Sprint(removed) != fmt.Sprint(c.removed) {
+			t.Errorf("%s: added %q, removed %q, want %q, %q", c.name, added, removed, c.added, c.removed)
+		}
+	}
+}
+
+func TestAuditChunksCmd(t *testing.T) {
+	db := testDB(t)
+	moors := addBook(t, db, "Moors", "Someone", testBook("Moors", testParagraphs(6)))
+	tales := addBook(t, db, "Tales", "Someone", testBook("Tales", story("red room", 6)))
+	if _, err := captureStdout(t, func() error { return makeChunks(db, chunkOptions{}) }); err != nil {
+		t.Fatal(err)
+	}
+	audit := func() (auditReport, error) {
+		t.Helper()
+		var rep auditReport
+		out, err := captureStdout(t, func() error { return auditChunksCmd([]string{"--json"}) })
+		if jerr := json.Unmarshal([]byte(out), &rep); jerr != nil {
+			t.Fatalf("audit-chunks --json wrote %q: %v", out, jerr)
+		}
+		return rep, err
+	}
+
+	// chunks as chunk made them, and renumbered, are as chunk makes them
+	if rep, err := audit(); err != nil || rep.Books != 2 || rep.Identical != 2 {
+		t.Errorf("audit-chunks of chunks as made: %v, %+v", err, rep)
+	}
+	if _, err := db.Exec("UPDATE chunks SET ordinal = ordinal + 100 WHERE sourceid = ?", moors); err != nil {
+		t.Fatal(err)
+	}
+	if rep, err := audit(); err != nil || rep.Identical != 2 {
+		t.Errorf("audit-chunks of chunks renumbered: %v, %+v", err, rep)
+	}
+
+	// one lost and one edited are found, and it exits 1
+	var last string
+	if err := db.QueryRow("SELECT chunk FROM chunks WHERE sourceid = ? ORDER BY ordinal DESC LIMIT 1", tales).Scan(&last); err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{
+		"DELETE FROM chunks WHERE sourceid = ? AND ordinal = (SELECT max(ordinal) FROM chunks WHERE sourceid = ?)",
+		"UPDATE chunks SET chunk = chunk || ' More.' WHERE sourceid = ? AND ordinal = (SELECT min(ordinal) FROM chunks WHERE sourceid = ?)",
+	} {
+		if _, err := db.Exec(q, tales, tales); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rep, err := audit()
+	if exitCode(err) != 1 || rep.Identical != 1 || rep.CountChanged != 1 || len(rep.Changed) != 1 {
+		t.Fatalf("audit-chunks with a book changed: %v, %+v", err, rep)
+	}
+	// the first chunk as it was, and the last, against the first edited
+	c := rep.Changed[0]
+	samples := strings.Join(c.Samples, "")
+	if c.ID != tales || c.Current != c.Stored+1 || c.Added-c.Removed != len(last)-len(" More.") ||
+		len(c.Samples) != 2 || !strings.HasPrefix(samples, "- ") || !strings.Contains(samples, "…\n+ ") || !strings.HasSuffix(samples, "\n+ "+clip(last, 160)+"\n") {
+		t.Errorf("audit-chunks found %+v", c)
+	}
+}
@@ -0,0 +1,235 @@
+package cli
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// An authors file says whose books to leave alone:
+//
+//	deny = ["Verne*", "Anonymous"]
+//	allow = [
+//	    "Austen",
+//	    "Bronte*",
+//	]
+//
+// Patterns are matched against the normalized author (see
+// normalizeAuthor), whole or from any word of it on, so "Verne*" finds
+// both "Jules Verne" and "Verne, Jules"; * matches anything. A book whose
+// author a deny pattern matches is left out even if an allow pattern
+// matches it too, and with an allow list only the books it matches are
+// kept. chunk leaves the books out of chunking; random and serve take the
+// same file to leave out chunks already made.
+
+// authorList is a loaded authors file. It also counts what it decided for
+// the books chunk asked about, and is safe to share between workers. A nil
+// *authorList keeps every book.
+type authorList struct {
+	deny, allow     []string
+	denyRE, allowRE []*regexp.Regexp
+
+	mu      sync.Mutex
+	counts  map[string]int
+	skipped []string
+}
+
+// what an authors file decides for a book
+const (
+	authorAllowed    = "allowed"
+	authorDenied     = "denied"
+	authorNotAllowed = "not_allowed"
+)
+
+func loadAuthorList(path string) (*authorList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read authors file: %w", err)
+	}
+	defer f.Close()
+
+	l := &authorList{counts: map[string]int{}}
+	seen := map[string]bool{}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		fail := func(format string, args ...interface{}) error {
+			return fmt.Errorf("%s:%d: %s", path, n, fmt.Sprintf(format, args...))
+		}
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fail("want key = value")
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if key != "deny" && key != "allow" {
+			return nil, fail("unknown key %s; want deny or allow", key)
+		}
+		if seen[key] {
+			return nil, fail("%s is set twice", key)
+		}
+		seen[key] = true
+		// an array may go on over the lines that follow
+		start := n
+		if strings.HasPrefix(value, "[") {
+			value = cutComment(value)
+		}
+		patterns, err := tomlStrings(value)
+		for err != nil && strings.HasPrefix(value, "[") && s.Scan() {
+			n++
+			if next := cutComment(s.Text()); next != "" {
+				value += " " + next
+			}
+			patterns, err = tomlStrings(value)
+		}
+		if err != nil {
+			n = start
+			return nil, fail("%s: %v", key, err)
+		}
+		for _, p := range patterns {
+			glob := normalizeGlob(p)
+			if strings.Trim(glob, "*") == "" && glob != "*" {
+				return nil, fail("%s: pattern %q has nothing to match", key, p)
+			}
+			re := globRegexp(glob)
+			if key == "deny" {
+				l.deny, l.denyRE = append(l.deny, glob), append(l.denyRE, re)
+			} else {
+				l.allow, l.allowRE = append(l.allow, glob), append(l.allowRE, re)
+			}
+		}
+	}
+	if err = s.Err(); err != nil {
+		return nil, fmt.Errorf("could not read authors file: %w", err)
+	}
+	if !seen["deny"] && !seen["allow"] {
+		return nil, fmt.Errorf("%s: no deny or allow list", path)
+	}
+	return l, nil
+}
+
+// cutComment drops a # comment from a line of an array, outside its
+// strings, and the space around what is left.
+func cutComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#':
+			return strings.TrimSpace(line[:i])
+		}
+	}
+	return strings.TrimSpace(line)
+}
+
+// normalizeGlob normalizes the text between the *s of a pattern as
+// normalizeAuthor does an author.
+func normalizeGlob(p string) string {
+	parts := strings.Split(p, "*")
+	for i, part := range parts {
+		part = authorJunk.ReplaceAllString(fold(part), " ")
+		parts[i] = spaces.ReplaceAllString(part, " ")
+	}
+	return strings.Trim(strings.Join(parts, "*"), " ,-")
+}
+
+// globRegexp matches what glob does against the whole of an author or
+// from the start of any word on, as the GLOBs of authorList.where do.
+func globRegexp(glob string) *regexp.Regexp {
+	parts := strings.Split(glob, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return regexp.MustCompile("^(?:.* )?" + strings.Join(parts, ".*") + "$")
+}
+
+func anyMatches(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// decide says what the list makes of a book by the normalized author.
+func (l *authorList) decide(author string) string {
+	if l == nil {
+		return authorAllowed
+	}
+	if anyMatches(l.denyRE, author) {
+		return authorDenied
+	}
+	if len(l.allow) > 0 && !anyMatches(l.allowRE, author) {
+		return authorNotAllowed
+	}
+	return authorAllowed
+}
+
+// record decides for book id by author as decide does, recording the
+// books left out to list once chunking is done.
+func (l *authorList) record(id int, author string) string {
+	if l == nil {
+		return authorAllowed
+	}
+	d := l.decide(author)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.counts[d]++
+	if d != authorAllowed {
+		what := fmt.Sprintf("book %d: %s by the authors file (author %q)", id, strings.Replace(d, "_", " ", 1), author)
+		events.warn("", "", what)
+		l.skipped = append(l.skipped, what)
+	}
+	return d
+}
+
+func (l *authorList) report() {
+	if l == nil {
+		return
+	}
+	fmt.Printf("authors file: %d allowed, %d denied, %d not allowed\n", l.counts[authorAllowed], l.counts[authorDenied], l.counts[authorNotAllowed])
+	for _, what := range l.skipped {
+		fmt.Println("  " + what)
+	}
+}
+
+// where gives the lists as the json arrays chunkFilter passes to the
+// condition in filterWhere, "" for no list.
+func (l *authorList) where() (deny, allow string) {
+	if l == nil {
+		return "", ""
+	}
+	list := func(globs []string) string {
+		if len(globs) == 0 {
+			return ""
+		}
+		bs, _ := json.Marshal(globs)
+		return string(bs)
+	}
+	return list(l.deny), list(l.allow)
+}
+
+// authorsFlag adds --authors-file to fs and returns what loads the file it
+// names, giving nil without one.
+func authorsFlag(fs *flag.FlagSet, usage string) func() (*authorList, error) {
+	path := fs.String("authors-file", "", usage)
+	return func() (*authorList, error) {
+		if *path == "" {
+			return nil, nil
+		}
+		return loadAuthorList(*path)
+	}
+}
@@ -0,0 +1,159 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeAuthorsFile writes an authors file of text, returning its path.
+func writeAuthorsFile(t *testing.T, text string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "authors.toml")
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadAuthorList(t *testing.T) {
+	l, err := loadAuthorList(writeAuthorsFile(t, `# whose books to leave alone
+deny = ["Verne*", 'Anonymous']
+allow = [
+    "Austen",   # Jane
+    "Brontë*",
+    "Verne, Jules",
+]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(l.deny, "|") != "verne*|anonymous" || strings.Join(l.allow, "|") != "austen|bronte*|verne, jules" {
+		t.Errorf("loaded deny %q and allow %q", l.deny, l.allow)
+	}
+
+	for text, want := range map[string]string{
+		`deny = "Verne"`:                  "deny:",
+		`refuse = ["Verne"]`:              "unknown key refuse",
+		"deny = [\"Verne\"]\ndeny = []":   "deny is set twice",
+		`allow = ["**"]`:                  "has nothing to match",
+		"# nothing but this\n":            "no deny or allow list",
+		"deny = [\"Verne\",\n\"Wells\"\n": "want , or ]",
+		`deny ["Verne"]`:                  "want key = value",
+	} {
+		_, err := loadAuthorList(writeAuthorsFile(t, text))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("loading %q: %v, want %q", text, err, want)
+		}
+	}
+	if _, err = loadAuthorList(filepath.Join(t.TempDir(), "none.toml")); err == nil {
+		t.Error("loading an authors file that isn't there worked")
+	}
+}
+
+func TestAuthorDecisions(t *testing.T) {
+	l, err := loadAuthorList(writeAuthorsFile(t, "deny = [\"Verne*\", \"*Anonymous*\"]\nallow = [\"Austen\", \"Bronte*\", \"Jules Verne\"]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	denyOnly, err := loadAuthorList(writeAuthorsFile(t, `deny = ["Verne*"]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := testDB(t)
+	for _, c := range []struct {
+		author                 string
+		decision, denyDecision string
+	}{
+		{"Jane Austen", authorAllowed, authorAllowed},
+		{"AUSTEN, JANE (1775-1817)", authorNotAllowed, authorAllowed},
+		{"Austenite Smith", authorNotAllowed, authorAllowed},
+		{"Charlotte Brontë", authorAllowed, authorAllowed},
+		{"Brontë, Emily", authorAllowed, authorAllowed},
+		// allowed and denied both, and denied wins
+		{"Jules Verne", authorDenied, authorDenied},
+		{"Verne, Jules", authorDenied, authorDenied},
+		{"Anonymous", authorDenied, authorAllowed},
+		{"H. G. Wells", authorNotAllowed, authorAllowed},
+		{"", authorNotAllowed, authorAllowed},
+	} {
+		author := normalizeAuthor(c.author)
+		if d := l.decide(author); d != c.decision {
+			t.Errorf("%q is %s, want %s", c.author, d, c.decision)
+		}
+		if d := denyOnly.decide(author); d != c.denyDecision {
+			t.Errorf("with only a deny list, %q is %s, want %s", c.author, d, c.denyDecision)
+		}
+		var none *authorList
+		if d := none.decide(author); d != authorAllowed {
+			t.Errorf("without an authors file, %q is %s", c.author, d)
+		}
+
+		// selection decides as chunking does
+		id := addBook(t, db, c.author, c.author, "")
+		insertChunk(t, db, id, 0, "a chunk by "+c.author)
+		var f chunkFilter
+		f.DenyAuthors, f.AllowAuthors = l.where()
+		n, err := countChunks(db, "%s c JOIN files f ON f.id = c.sourceid WHERE "+filterWhere+" AND c.sourceid = ?", append(f.args(), id)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if drawn := n == 1; drawn != (c.decision == authorAllowed) {
+			t.Errorf("a chunk by %q is drawn %v, but it is %s", c.author, drawn, c.decision)
+		}
+	}
+}
+
+func TestChunkAuthorsFile(t *testing.T) {
+	for _, c := range []struct {
+		file    string
+		chunked []string
+		report  string
+	}{
+		{"", []string{"Emma", "Twenty Thousand Leagues", "The Time Machine", "Jane Eyre"}, ""},
+		{`deny = ["Verne*"]`, []string{"Emma", "The Time Machine", "Jane Eyre"}, "authors file: 3 allowed, 1 denied, 0 not allowed"},
+		{"deny = [\"Verne*\"]\nallow = [\"Austen\", \"Verne*\", \"Bronte*\"]", []string{"Emma", "Jane Eyre"}, "authors file: 2 allowed, 1 denied, 1 not allowed"},
+	} {
+		db := testDB(t)
+		ids := map[string]int{}
+		for title, author := range map[string]string{
+			"Emma":                    "Jane Austen",
+			"Twenty Thousand Leagues": "Jules Verne",
+			"The Time Machine":        "H. G. Wells",
+			"Jane Eyre":               "Charlotte Brontë",
+		} {
+			ids[title] = addBook(t, db, title, author, testBook(title, testParagraphs(2)))
+		}
+		opts := chunkOptions{timings: newTimings()}
+		if c.file != "" {
+			var err error
+			if opts.authors, err = loadAuthorList(writeAuthorsFile(t, c.file)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		out, err := captureStdout(t, func() error { return makeChunks(db, opts) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]bool{}
+		for _, title := range c.chunked {
+			want[title] = true
+		}
+		for title, id := range ids {
+			if n := chunkCount(t, db, id); (n > 0) != want[title] {
+				t.Errorf("with %q, %s gave %d chunks", c.file, title, n)
+			}
+		}
+		if c.report == "" && strings.Contains(out, "authors file") || c.report != "" && !strings.Contains(out, c.report) {
+			t.Errorf("with %q, the run reported %q", c.file, out)
+		}
+		if c.file != "" && !strings.Contains(out, `denied by the authors file (author "jules verne")`) {
+			t.Errorf("with %q, the run didn't list Verne denied: %q", c.file, out)
+		}
+		if s := opts.timings.summary("chunk"); len(s.Authors) == 0 != (c.file == "") ||
+			c.file != "" && s.Authors[authorAllowed] != len(c.chunked) {
+			t.Errorf("with %q, the run summary has authors %v", c.file, s.Authors)
+		}
+	}
+}
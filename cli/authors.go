@@ -0,0 +1,261 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+)
+
+var (
+	authorDates = regexp.MustCompile(`\(?\b\d{3,4}\??\s*-\s*(\d{3,4})?\??\)?`)
+	authorJunk  = regexp.MustCompile(`[^\pL\pN,' -]+`)
+	spaces      = regexp.MustCompile(`\s+`)
+)
+
+// normalizeAuthor folds the many spellings of a header's Author: line into a
+// grouping key: folded (see fold), life dates and punctuation dropped,
+// whitespace collapsed. "Brontë, Charlotte (1816-1855)" and "bronte,
+// charlotte" agree.
+func normalizeAuthor(author string) string {
+	a := authorDates.ReplaceAllString(fold(author), " ")
+	a = authorJunk.ReplaceAllString(a, " ")
+	a = spaces.ReplaceAllString(a, " ")
+	return strings.Trim(a, " ,-")
+}
+
+func refreshStatsCmd(args []string) error {
+	fs := flag.NewFlagSet("refresh-stats", flag.ExitOnError)
+	fs.Parse(args)
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err = backfillLanguage(db); err != nil {
+		return fmt.Errorf("could not fill in languages: %w", err)
+	}
+	names, err := resolveNames(context.Background(), db)
+	if err != nil {
+		return fmt.Errorf("could not choose books' names: %w", err)
+	}
+	fmt.Println(names)
+	c, err := deriveEras(context.Background(), db)
+	if err != nil {
+		return fmt.Errorf("could not date books: %w", err)
+	}
+	fmt.Println(c)
+	n, err := refreshAuthorStats(context.Background(), db)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("refreshed stats for %d authors\n", n)
+	return nil
+}
+
+// refreshAuthorStats recomputes author_stats, giving up once ctx is done,
+// and returns the number of authors.
+func refreshAuthorStats(ctx context.Context, db *sql.DB) (int, error) {
+	if err := backfillNorms(ctx, db); err != nil {
+		return 0, fmt.Errorf("could not normalize authors and titles: %w", err)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM author_stats"); err != nil {
+		return 0, err
+	}
+
+	// a book's chunks are all in one shard, so per shard book counts add up
+	arms, args := eachShard(`SELECT f.author_norm AS author, count(DISTINCT f.id) AS books, count(*) AS chunks
+		FROM %s c JOIN files f ON f.id = c.sourceid
+		GROUP BY f.author_norm`)
+	rows, err := tx.QueryContext(ctx, `SELECT author, sum(books), sum(chunks) FROM (`+arms+`)
+		GROUP BY author ORDER BY author`, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	type stat struct {
+		author        string
+		books, chunks int
+	}
+	stats := []stat{}
+	for rows.Next() {
+		var s stat
+		if err = rows.Scan(&s.author, &s.books, &s.chunks); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		stats = append(stats, s)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	stmt, err := tx.Prepare("INSERT INTO author_stats (author, books, chunks, cum_sqrt) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	cum := 0.0
+	for _, s := range stats {
+		cum += math.Sqrt(float64(s.chunks))
+		if _, err = stmt.Exec(s.author, s.books, s.chunks, cum); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(stats), tx.Commit()
+}
+
+func backfillNorms(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, "SELECT id, coalesce(author, ''), coalesce(name, '') FROM files WHERE author_norm IS NULL OR title_norm IS NULL")
+	if err != nil {
+		return err
+	}
+	todo := map[int][2]string{}
+	for rows.Next() {
+		var id int
+		var author, title string
+		if err = rows.Scan(&id, &author, &title); err != nil {
+			rows.Close()
+			return err
+		}
+		todo[id] = [2]string{normalizeAuthor(author), normalizeTitle(title)}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || len(todo) == 0 {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare("UPDATE files SET author_norm = ?, title_norm = ? WHERE id = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for id, n := range todo {
+		if _, err = stmt.Exec(n[0], n[1], id); err != nil {
+			return err
+		}
+		if err = saveNameWords(tx, int64(id), n[0], n[1]); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// backfillLanguage fills in files.language for books ingested before it
+// was recorded, reading only the start of each, and turns languages stored
+// by name into codes.
+func backfillLanguage(db *sql.DB) error {
+	rows, err := db.Query("SELECT id, language, CASE WHEN language IS NULL THEN substr(" + contentCol("") + ", 1, 8192) END FROM files")
+	if err != nil {
+		return err
+	}
+	todo := map[int]string{}
+	for rows.Next() {
+		var id int
+		var lang, head sql.NullString
+		if err = rows.Scan(&id, &lang, &head); err != nil {
+			rows.Close()
+			return err
+		}
+		if !lang.Valid {
+			todo[id] = headerLanguage([]byte(head.String))
+		} else if l := normalizeLanguages(lang.String); l != lang.String {
+			todo[id] = l
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || len(todo) == 0 {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare("UPDATE files SET language = ? WHERE id = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for id, l := range todo {
+		if _, err = stmt.Exec(l, id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func authorsCmd(args []string) error {
+	fs := flag.NewFlagSet("authors", flag.ExitOnError)
+	stats := fs.Bool("stats", false, "include book and chunk counts")
+	unresolved := fs.Bool("unresolved", false, "list the authors no alias was found for, to give one with gutchunk alias add")
+	fs.Parse(args)
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if *unresolved {
+		if err = requireSchema(schemaGap{"author_aliases", ""}, schemaGap{"files", "author_id"}); err != nil {
+			return err
+		}
+		return listUnresolved(db)
+	}
+
+	var total int
+	if err = db.QueryRow("SELECT coalesce(sum(chunks), 0) FROM author_stats").Scan(&total); err != nil {
+		return err
+	}
+	if total == 0 {
+		return errNoStats
+	}
+
+	rows, err := db.Query("SELECT author, books, chunks FROM author_stats ORDER BY chunks DESC, author")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var author string
+		var books, chunks int
+		if err = rows.Scan(&author, &books, &chunks); err != nil {
+			return err
+		}
+		if author == "" {
+			author = "(unknown)"
+		}
+		if *stats {
+			fmt.Printf("%8d chunks %5d books %6.2f%%  %s\n", chunks, books, 100*float64(chunks)/float64(total), author)
+		} else {
+			fmt.Println(author)
+		}
+	}
+
+	return rows.Err()
+}
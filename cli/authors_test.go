@@ -0,0 +1,99 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// skewedDB has four books by a prolific author, of 9 chunks each, and one
+// of 4 chunks by a rare one, with their author stats refreshed.
+func skewedDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db := testDB(t)
+	for _, title := range []string{"One", "Two", "Three", "Four"} {
+		addBook(t, db, title, "Prolific, Penelope", testBook(title, testParagraphs(9)))
+	}
+	addBook(t, db, "Only", "Rare, Rupert (1801-1850)", testBook("Only", testParagraphs(4)))
+	if err := makeChunks(db, chunkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := refreshAuthorStats(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestRefreshAuthorStats(t *testing.T) {
+	db := skewedDB(t)
+	rows, err := db.Query("SELECT author, books, chunks, cum_sqrt FROM author_stats ORDER BY rowid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	type stat struct {
+		author        string
+		books, chunks int
+		cum           float64
+	}
+	var got []stat
+	for rows.Next() {
+		var s stat
+		if err = rows.Scan(&s.author, &s.books, &s.chunks, &s.cum); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, s)
+	}
+	want := []stat{{"prolific, penelope", 4, 36, 6}, {"rare, rupert", 1, 4, 8}}
+	if len(got) != len(want) {
+		t.Fatalf("author stats %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i].author != want[i].author || got[i].books != want[i].books || got[i].chunks != want[i].chunks || math.Abs(got[i].cum-want[i].cum) > 1e-9 {
+			t.Errorf("author stats %d: %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+// The rare author's share of draws: a tenth of the chunks drawn
+// uniformly, half of them drawing an author first, and a quarter weighting
+// authors by the square root of their chunks.
+func TestFairSampling(t *testing.T) {
+	db := skewedDB(t)
+	const draws = 2000
+	for _, c := range []struct {
+		name string
+		draw func(r *rand.Rand) (chunkrow, error)
+		want float64
+	}{
+		{"uniform", func(r *rand.Rand) (chunkrow, error) { return randomChunk(db, r, drawable(false)) }, 4.0 / 40},
+		{"fair", func(r *rand.Rand) (chunkrow, error) { return fairChunk(db, r, false, servedExclusion{}) }, 0.5},
+		{"sqrt", func(r *rand.Rand) (chunkrow, error) { return fairChunk(db, r, true, servedExclusion{}) }, 2.0 / 8},
+	} {
+		r := rand.New(rand.NewSource(1))
+		rare := 0
+		for i := 0; i < draws; i++ {
+			ch, err := c.draw(r)
+			if err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+			if ch.Title == "Only" {
+				rare++
+			}
+		}
+		// a few standard deviations of a binomial share's
+		share := float64(rare) / draws
+		if sd := math.Sqrt(c.want * (1 - c.want) / draws); math.Abs(share-c.want) > 4*sd {
+			t.Errorf("%s: the rare author drawn %.3f of the time, want %.3f", c.name, share, c.want)
+		}
+	}
+}
+
+func TestFairSamplingNeedsStats(t *testing.T) {
+	db := testDB(t)
+	if _, err := fairChunk(db, rand.New(rand.NewSource(1)), false, servedExclusion{}); err != errNoStats {
+		t.Errorf("fair draw without stats: %v, want %v", err, errNoStats)
+	}
+}
@@ -0,0 +1,93 @@
+package cli
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// chunkInsertRows is how many of a book's chunks writeChunks inserts in
+// one statement, as a statement a row spends most of a chunk run in Exec.
+// A statement that fails is tried again a row at a time, so the error
+// names the chunk at fault; the rows left over after the last full
+// statement go in one at a time too. bench --insert-rows sets it, 1 for a
+// statement a row.
+var chunkInsertRows = 20
+
+// sqliteVariables is the most parameters a statement may have: 999 before
+// sqlite 3.32, 32766 since.
+func sqliteVariables() int {
+	if _, v, _ := sqlite3.Version(); v >= 3032000 {
+		return 32766
+	}
+	return 999
+}
+
+// rowsPerInsert is how many rows of width values each fit in a statement,
+// at most chunkInsertRows.
+func rowsPerInsert(width int) int {
+	n := chunkInsertRows
+	if most := sqliteVariables() / width; n > most {
+		n = most
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// insertChunkRows inserts rows, each the values of cols in order, into
+// chunks, the row at i being the chunk at ordinal i. Given ids, it inserts
+// them one at a time and keeps the rowid each is given there.
+func insertChunkRows(tx *sql.Tx, cols []string, rows [][]interface{}, ids []int64) error {
+	values := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(cols)), ", ") + ")"
+	insert := "INSERT INTO chunks (" + strings.Join(cols, ", ") + ") VALUES "
+	one, err := tx.Prepare(insert + values)
+	if err != nil {
+		return fmt.Errorf("could not prepare: %w", err)
+	}
+	defer one.Close()
+
+	at := 0
+	if per := rowsPerInsert(len(cols)); ids == nil && per > 1 && len(rows) >= per {
+		many, err := tx.Prepare(insert + strings.TrimSuffix(strings.Repeat(values+", ", per), ", "))
+		if err != nil {
+			return fmt.Errorf("could not prepare: %w", err)
+		}
+		defer many.Close()
+		args := make([]interface{}, 0, per*len(cols))
+		for ; at+per <= len(rows); at += per {
+			args = args[:0]
+			for _, r := range rows[at : at+per] {
+				args = append(args, r...)
+			}
+			if _, err = many.Exec(args...); err != nil {
+				// a failed statement takes back all its rows, and one by
+				// one the row at fault is found
+				if err = insertEach(one, rows, at, at+per, nil); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return insertEach(one, rows, at, len(rows), ids)
+}
+
+// insertEach inserts rows from up to to with stmt one at a time, keeping
+// their rowids in ids unless it is nil.
+func insertEach(stmt *sql.Stmt, rows [][]interface{}, from, to int, ids []int64) error {
+	for i := from; i < to; i++ {
+		res, err := stmt.Exec(rows[i]...)
+		if err != nil {
+			return fmt.Errorf("could not insert the chunk at ordinal %d: %w", i, err)
+		}
+		if ids != nil {
+			if ids[i], err = res.LastInsertId(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package cli
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRowsPerInsert(t *testing.T) {
+	defer func(was int) { chunkInsertRows = was }(chunkInsertRows)
+	most := sqliteVariables()
+	if most != 999 && most != 32766 {
+		t.Fatalf("sqlite takes %d variables", most)
+	}
+	for _, c := range []struct{ rows, width, want int }{
+		{20, 8, 20},
+		{20, 11, 20},
+		{1, 8, 1},
+		{20, most / 5, 5},
+		{20, most + 1, 1},
+	} {
+		chunkInsertRows = c.rows
+		if got := rowsPerInsert(c.width); got != c.want {
+			t.Errorf("at %d rows a statement, rowsPerInsert(%d) = %d, want %d", c.rows, c.width, got, c.want)
+		}
+	}
+}
+
+// chunkTable is every column chunking writes of every chunk, a line each.
+func chunkTable(t *testing.T, db *sql.DB) string {
+	t.Helper()
+	return names(t, db, `SELECT id || ' ' || sourceid || ' ' || ordinal || ' ' || coalesce(scene, '-') || ' ' || printf('%.4f', position_pct) || ' ' ||
+		coalesce(kind, '-') || ' ' || chunk FROM chunks ORDER BY id`)
+}
+
+func TestBatchedChunkInserts(t *testing.T) {
+	defer func(was int) { chunkInsertRows = was }(chunkInsertRows)
+	// books of more chunks than a statement takes, with some left over,
+	// and of fewer
+	chunkAll := func(rows int) string {
+		t.Helper()
+		chunkInsertRows = rows
+		db := testDB(t)
+		for i, n := range []int{57, 3, 40} {
+			title := string(rune('A' + i))
+			addBook(t, db, title, "", testBook(title, testParagraphs(n)))
+		}
+		if _, err := captureStdout(t, func() error { return makeChunks(db, chunkOptions{tagKinds: true, scenes: true}) }); err != nil {
+			t.Fatal(err)
+		}
+		return chunkTable(t, db)
+	}
+	one := chunkAll(1)
+	if n := strings.Count(one, "\n"); n != 100 {
+		t.Fatalf("chunked a row a statement, there are %d chunks", n)
+	}
+	for _, rows := range []int{20, 7, 100} {
+		if got := chunkAll(rows); got != one {
+			t.Errorf("chunked %d rows a statement, the chunks differ from a row a statement:\n%s", rows, lineDiff(one, got))
+		}
+	}
+}
+
+func TestInsertChunkRowsIsolation(t *testing.T) {
+	defer func(was int) { chunkInsertRows = was }(chunkInsertRows)
+	chunkInsertRows = 20
+	db := testDB(t)
+	book := addBook(t, db, "Bad", "", "")
+	cols := []string{"id", "sourceid", "chunk", "ordinal"}
+	rows := func(n, bad int) [][]interface{} {
+		rs := make([][]interface{}, n)
+		for i := range rs {
+			rs[i] = []interface{}{i + 1, book, "A chunk.", i}
+		}
+		// the bad row has the id of the first
+		rs[bad][0] = 1
+		return rs
+	}
+	// at fault in a full statement, and in the rows left over after them
+	for _, bad := range []int{57, 125} {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = insertChunkRows(tx, cols, rows(130, bad), nil)
+		if err == nil || !strings.HasPrefix(err.Error(), fmt.Sprintf("could not insert the chunk at ordinal %d: ", bad)) || !strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			t.Errorf("with a bad row at ordinal %d: %v", bad, err)
+		}
+		// the rows before it are in
+		var n int
+		if err = tx.QueryRow("SELECT count(*) FROM chunks").Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != bad {
+			t.Errorf("with a bad row at ordinal %d, %d rows were inserted before it", bad, n)
+		}
+		tx.Rollback()
+	}
+
+	// and given ids to keep, each row's rowid is kept
+	t.Run("rowids", func(t *testing.T) {
+		rowidOnly(t, "keeping rowids")
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+		rs := rows(30, 0)
+		for _, r := range rs {
+			r[0] = nil
+		}
+		ids := make([]int64, len(rs))
+		if err = insertChunkRows(tx, cols, rs, ids); err != nil {
+			t.Fatal(err)
+		}
+		if ids[0] != 1 || ids[29] != 30 {
+			t.Errorf("the rowids kept are %v", ids)
+		}
+	})
+}
@@ -0,0 +1,463 @@
+package cli
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.tilde.town/gutchunker/corpus"
+)
+
+func benchCmd(args []string) error {
+	opts := corpus.DefaultOptions()
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	fs.IntVar(&opts.Books, "books", opts.Books, "number of synthetic books")
+	size := fs.String("size", "200k", "approximate body size of each book")
+	fs.Int64Var(&opts.Seed, "seed", opts.Seed, "generator seed; equal seeds give identical corpora")
+	fs.IntVar(&opts.ParagraphWords, "para-words", opts.ParagraphWords, "mean paragraph length in words")
+	fs.IntVar(&opts.ParagraphSpread, "para-spread", opts.ParagraphSpread, "standard deviation of paragraph length")
+	fs.Float64Var(&opts.Latin1, "latin1", opts.Latin1, "fraction of books encoded as ISO-8859-1")
+	workers := fs.Int("workers", 1, "number of chunk workers")
+	pipelined := fs.Bool("pipeline", false, "ingest and chunk as run --pipeline does instead of in two phases")
+	noContent := fs.Bool("no-store-content", false, "with --pipeline, don't keep books' content")
+	reference := fs.Bool("reference", false, "then convert the chunks to reference storage and read them again, to compare size and read time")
+	fs.IntVar(&chunkInsertRows, "insert-rows", chunkInsertRows, "chunks inserted per statement, 1 for one statement a chunk")
+	keep := fs.Bool("keep", false, "keep the temp directory instead of removing it")
+	interactive := fs.Duration("interactive", 0, "then chunk every book again, drawing a random chunk and logging it served this often beside it, and time the draws (0 for none)")
+	lanes := fs.Bool("lanes", true, "with --interactive, draw in the interactive lane (see lanes.go); false draws as bulk writes are made, to compare")
+	maxP99 := fs.Duration("interactive-p99", 0, "with --interactive, fail if the 99th percentile draw took longer than this")
+	fs.Parse(args)
+
+	n, err := parseSize(*size)
+	if err != nil {
+		return err
+	}
+	opts.BookSize = int(n)
+	if chunkInsertRows < 1 {
+		return usagef("--insert-rows must be at least 1")
+	}
+	if *interactive < 0 || *interactive > 0 && *pipelined {
+		return usagef("--interactive can't be negative, and times draws beside chunking in two phases, not with --pipeline")
+	}
+
+	dir, err := os.MkdirTemp("", "gutchunk-bench")
+	if err != nil {
+		return err
+	}
+	if *keep {
+		fmt.Fprintf(os.Stderr, "keeping %s\n", dir)
+	} else {
+		defer os.RemoveAll(dir)
+	}
+
+	mirror := filepath.Join(dir, "mirror")
+	st, err := corpus.Generate(mirror, opts)
+	if err != nil {
+		return fmt.Errorf("could not generate corpus: %w", err)
+	}
+
+	key, err := dbKey()
+	if err != nil {
+		return err
+	}
+	// opened as every database is, to measure what a run would do
+	path := fileDSN(filepath.Join(dir, "bench.db"))
+	db, err := connectDB(path, key, connOptions{foreignKeys: true})
+	if err != nil {
+		return err
+	}
+	defer func() { db.Close() }()
+	if err = createSchema(db); err != nil {
+		return err
+	}
+	if err = walMode(db, path); err != nil {
+		return err
+	}
+
+	heap := watchHeap()
+	disk := startIO()
+
+	var ingested, chunked, piped time.Duration
+	if *pipelined {
+		start := time.Now()
+		if err = runPipeline(db, mirror, ingestOptions{noContent: *noContent}, chunkOptions{workers: *workers}); err != nil {
+			return fmt.Errorf("pipeline failed: %w", err)
+		}
+		piped = time.Since(start)
+	} else {
+		start := time.Now()
+		if err = readFiles(db, mirror, ingestOptions{}); err != nil {
+			return fmt.Errorf("ingest failed: %w", err)
+		}
+		ingested = time.Since(start)
+
+		start = time.Now()
+		if err = makeChunks(db, chunkOptions{workers: *workers}); err != nil {
+			return fmt.Errorf("chunk failed: %w", err)
+		}
+		chunked = time.Since(start)
+	}
+	read, wrote := disk()
+
+	var draws *latencies
+	var rechunked time.Duration
+	if *interactive > 0 {
+		start := time.Now()
+		if draws, err = drawBeside(db, path, key, *interactive, *lanes, func() error {
+			return makeChunks(db, chunkOptions{workers: *workers, fullRechunk: true})
+		}); err != nil {
+			return err
+		}
+		rechunked = time.Since(start)
+	}
+
+	var chunks int
+	if err = db.QueryRow("SELECT count(*) FROM chunks").Scan(&chunks); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	if _, err = libraryCounts(db, 0, true); err != nil {
+		return err
+	}
+	statsExact := time.Since(start)
+	start = time.Now()
+	if _, err = libraryCounts(db, 0, false); err != nil {
+		return err
+	}
+	statsKept := time.Since(start)
+
+	start = time.Now()
+	if err = scanBooks(db); err != nil {
+		return fmt.Errorf("scan failed: %w", err)
+	}
+	scanned := time.Since(start)
+	if *reference {
+		// the reference database is vacuumed once converted, so this one is
+		// too for the sizes to compare
+		if _, err = db.Exec("VACUUM"); err != nil {
+			return err
+		}
+	}
+	inlineSize, err := dbPagesSize(db)
+	if err != nil {
+		return err
+	}
+
+	peak := heap()
+	mb := float64(st.Bytes) / (1 << 20)
+	fmt.Printf("\ncorpus: %d books, %s, seed %d\n", st.Books, formatSize(st.Bytes), opts.Seed)
+	if *pipelined {
+		fmt.Printf("pipeline: %v, %.1f books/sec, %.1f chunks/sec, %.1f MB/sec\n", piped.Round(time.Millisecond),
+			float64(st.Books)/piped.Seconds(), float64(chunks)/piped.Seconds(), mb/piped.Seconds())
+	} else {
+		fmt.Printf("ingest: %v, %.1f books/sec, %.1f MB/sec\n", ingested.Round(time.Millisecond),
+			float64(st.Books)/ingested.Seconds(), mb/ingested.Seconds())
+		fmt.Printf("chunk:  %v, %.1f books/sec, %.1f chunks/sec, %.1f MB/sec\n", chunked.Round(time.Millisecond),
+			float64(st.Books)/chunked.Seconds(), float64(chunks)/chunked.Seconds(), mb/chunked.Seconds())
+		fmt.Printf("total:  %v\n", (ingested + chunked).Round(time.Millisecond))
+	}
+	if read >= 0 {
+		fmt.Printf("io:     %s read, %s written\n", formatSize(read), formatSize(wrote))
+	}
+	fmt.Printf("scan:   %v, %.1f books/sec reading each book's chunks in order\n", scanned.Round(time.Millisecond),
+		float64(st.Books)/scanned.Seconds())
+	fmt.Printf("stats:  %v counting the chunks, %v from the kept counts\n", statsExact.Round(time.Microsecond), statsKept.Round(time.Microsecond))
+	fmt.Printf("chunks: %d, %s layout, database %s\n", chunks, chunkLayout, formatSize(inlineSize))
+	fmt.Printf("peak heap: %s\n", formatSize(int64(peak)))
+	if draws != nil {
+		st := draws.stats()
+		lane := "the interactive lane"
+		if !*lanes {
+			lane = "the bulk lane"
+		}
+		fmt.Printf("drawn:  %d chunks in %s beside chunking again in %v: p50 %.1fms, p99 %.1fms, max %.1fms, %d tries on a busy database\n",
+			st.Requests, lane, rechunked.Round(time.Millisecond), st.P50, st.P99, st.Max, st.BusyRetries)
+		if *maxP99 > 0 && st.P99 > float64(maxP99.Microseconds())/1000 {
+			return fmt.Errorf("the 99th percentile draw took %.1fms, over --interactive-p99 %v", st.P99, *maxP99)
+		}
+	}
+
+	if *reference {
+		start = time.Now()
+		if err = convertStorage(runCtx, db, storageReference, 1000, true); err != nil {
+			return fmt.Errorf("convert failed: %w", err)
+		}
+		converted := time.Since(start)
+		db.Close()
+		if db, err = connectDB(path, key, connOptions{foreignKeys: true, refs: true}); err != nil {
+			return err
+		}
+		if err = createSchema(db); err != nil {
+			return err
+		}
+		start = time.Now()
+		if err = scanBooks(db); err != nil {
+			return fmt.Errorf("scan failed: %w", err)
+		}
+		refScanned := time.Since(start)
+		refSize, err := dbPagesSize(db)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("reference: converted in %v, database %s (%.0f%% of inline), scan %v (%.1fx inline)\n",
+			converted.Round(time.Millisecond), formatSize(refSize), 100*float64(refSize)/float64(inlineSize),
+			refScanned.Round(time.Millisecond), refScanned.Seconds()/scanned.Seconds())
+
+		ids, err := hotChunks(db, benchHotBooks, benchHotReads)
+		if err != nil {
+			return err
+		}
+		uncached, err := readChunks(db, ids)
+		if err != nil {
+			return fmt.Errorf("reads failed: %w", err)
+		}
+		sharedContent = newContentCache(64, 256<<20)
+		defer func() { sharedContent = nil }()
+		cached, err := readChunks(db, ids)
+		if err != nil {
+			return fmt.Errorf("reads failed: %w", err)
+		}
+		st := sharedContent.stats()
+		fmt.Printf("reads:  %v a chunk of %d books at random, %v with serve's content cache (%d hits, %d misses)\n",
+			(uncached / time.Duration(len(ids))).Round(time.Microsecond), benchHotBooks,
+			(cached / time.Duration(len(ids))).Round(time.Microsecond), st.Hits, st.Misses)
+	}
+	return nil
+}
+
+// drawBeside runs bulk, drawing a random chunk and logging it served every
+// interval while it does, and is how long the draws took. In the
+// interactive lane they read on a pool of their own, as serve's requests
+// do; otherwise they read on db and log in the bulk lane, not yielding.
+func drawBeside(db *sql.DB, path, key string, interval time.Duration, lanes bool, bulk func() error) (*latencies, error) {
+	w := writerOf(db)
+	quick, log := db, w.do
+	if lanes {
+		var err error
+		if quick, err = connectDB(path, key, connOptions{foreignKeys: true, busy: quickBusyTimeout}); err != nil {
+			return nil, err
+		}
+		defer quick.Close()
+		w.quick, log = quick, w.interactive
+		defer func() { w.quick = nil }()
+	} else {
+		yield := *bulkYield
+		*bulkYield = 0
+		defer func() { *bulkYield = yield }()
+	}
+
+	draws := &latencies{}
+	done := make(chan struct{})
+	failed := make(chan error, 1)
+	go func() {
+		defer close(failed)
+		rng := rand.New(rand.NewSource(1))
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-tick.C:
+			}
+			start := time.Now()
+			var c chunkrow
+			err := retryBusy(func() (err error) {
+				c, err = randomChunk(quick, rng, notBanned)
+				return err
+			})
+			if err == nil {
+				err = log(func(tx *sql.Tx) error { return logServed(tx, c.ID, "bench") })
+			}
+			if err != nil {
+				failed <- fmt.Errorf("draw failed: %w", err)
+				return
+			}
+			draws.add(time.Since(start))
+		}
+	}()
+	err := bulk()
+	close(done)
+	if drawErr := <-failed; drawErr != nil && err == nil {
+		err = drawErr
+	}
+	return draws, err
+}
+
+// the books and chunk reads of bench --reference's reads, as serve has a
+// few books' chunks asked for again and again
+const (
+	benchHotBooks = 16
+	benchHotReads = 2000
+)
+
+// hotChunks are reads chunk ids, drawn at random from the chunks of the
+// first books books.
+func hotChunks(db *sql.DB, books, reads int) ([]int, error) {
+	rows, err := db.Query("SELECT id FROM chunks WHERE sourceid IN (SELECT id FROM files ORDER BY id LIMIT ?)", books)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	all := []int{}
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		all = append(all, id)
+	}
+	if err = rows.Err(); err != nil || len(all) == 0 {
+		return nil, err
+	}
+	r := rand.New(rand.NewSource(1))
+	ids := make([]int, reads)
+	for i := range ids {
+		ids[i] = all[r.Intn(len(all))]
+	}
+	return ids, nil
+}
+
+// readChunks reads each chunk of ids on its own, as serve does, and how long
+// that took.
+func readChunks(db *sql.DB, ids []int) (time.Duration, error) {
+	start := time.Now()
+	for _, id := range ids {
+		var chunk string
+		if err := db.QueryRow("SELECT chunk FROM chunks WHERE id = ?", id).Scan(&chunk); err != nil {
+			return 0, err
+		}
+	}
+	return time.Since(start), nil
+}
+
+// dbPagesSize is the size of db's pages.
+func dbPagesSize(db *sql.DB) (int64, error) {
+	var pages, pageSize int64
+	if err := db.QueryRow("PRAGMA page_count").Scan(&pages); err != nil {
+		return 0, err
+	}
+	err := db.QueryRow("PRAGMA page_size").Scan(&pageSize)
+	return pages * pageSize, err
+}
+
+// scanBooks reads every book's chunks in order, as cat and export do.
+func scanBooks(db *sql.DB) error {
+	rows, err := db.Query("SELECT id FROM files ORDER BY id")
+	if err != nil {
+		return err
+	}
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		chunks, err := db.Query("SELECT chunk FROM chunks WHERE sourceid = ? ORDER BY ordinal", id)
+		if err != nil {
+			return err
+		}
+		for chunks.Next() {
+			var chunk string
+			if err = chunks.Scan(&chunk); err != nil {
+				chunks.Close()
+				return err
+			}
+		}
+		chunks.Close()
+		if err = chunks.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startIO returns what gives the bytes the process read from and wrote to
+// storage since, from /proc/self/io; -1 each where there is none.
+func startIO() func() (read, wrote int64) {
+	r0, w0 := procIO()
+	return func() (int64, int64) {
+		r, w := procIO()
+		if r < 0 || r0 < 0 {
+			return -1, -1
+		}
+		return r - r0, w - w0
+	}
+}
+
+func procIO() (read, wrote int64) {
+	bs, err := os.ReadFile("/proc/self/io")
+	if err != nil {
+		return -1, -1
+	}
+	read, wrote = -1, -1
+	for _, line := range strings.Split(string(bs), "\n") {
+		key, value, _ := strings.Cut(line, ":")
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			continue
+		}
+		switch key {
+		case "read_bytes":
+			read = n
+		case "write_bytes":
+			wrote = n
+		}
+	}
+	return read, wrote
+}
+
+// watchHeap samples the heap until the returned function is called, which
+// stops sampling and reports the highest HeapAlloc seen.
+func watchHeap() func() uint64 {
+	var peak uint64
+	var mu sync.Mutex
+	done := make(chan struct{})
+	sample := func() {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		mu.Lock()
+		if ms.HeapAlloc > peak {
+			peak = ms.HeapAlloc
+		}
+		mu.Unlock()
+	}
+
+	go func() {
+		t := time.NewTicker(50 * time.Millisecond)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				sample()
+			}
+		}
+	}()
+
+	return func() uint64 {
+		close(done)
+		sample()
+		mu.Lock()
+		defer mu.Unlock()
+		return peak
+	}
+}
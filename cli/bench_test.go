@@ -0,0 +1,119 @@
+package cli
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.tilde.town/gutchunker/corpus"
+)
+
+// benchMirror is a synthetic mirror of books of size bytes, made once for
+// a benchmark.
+func benchMirror(b *testing.B, books, size int) string {
+	b.Helper()
+	opts := corpus.DefaultOptions()
+	opts.Books, opts.BookSize = books, size
+	dir := filepath.Join(b.TempDir(), "mirror")
+	if _, err := corpus.Generate(dir, opts); err != nil {
+		b.Fatal(err)
+	}
+	return dir
+}
+
+func TestBenchCmd(t *testing.T) {
+	if err := benchCmd([]string{"--books", "3", "--size", "8k"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkIngest(b *testing.B) {
+	mirror := benchMirror(b, 20, 32*1024)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		db := testDB(b)
+		b.StartTimer()
+		if err := readFiles(db, mirror, ingestOptions{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkChunk(b *testing.B) {
+	mirror := benchMirror(b, 20, 32*1024)
+	db := testDB(b)
+	if err := readFiles(db, mirror, ingestOptions{}); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := makeChunks(db, chunkOptions{fullRechunk: true}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkChunkInsertRows chunks short paragraphs, where writing the
+// chunks counts for most, a row a statement and batched.
+func BenchmarkChunkInsertRows(b *testing.B) {
+	defer func(was int) { chunkInsertRows = was }(chunkInsertRows)
+	var body strings.Builder
+	for i := 0; i < 3000; i++ {
+		fmt.Fprintf(&body, "Paragraph %d, of sixty words or so, %s\n\n", i, strings.Repeat("and on it goes about the weather ", 9))
+	}
+	for _, rows := range []int{1, 20} {
+		b.Run(fmt.Sprintf("rows=%d", rows), func(b *testing.B) {
+			chunkInsertRows = rows
+			db := testDB(b)
+			addBook(b, db, "Short Paragraphs", "", testBook("Short Paragraphs", body.String()))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := makeChunks(db, chunkOptions{fullRechunk: true}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkReferenceReads reads chunks of a few books at random from
+// reference storage, without the shared content cache and with it.
+func BenchmarkReferenceReads(b *testing.B) {
+	mirror := benchMirror(b, 20, 32*1024)
+	db := testDB(b)
+	if err := readFiles(db, mirror, ingestOptions{}); err != nil {
+		b.Fatal(err)
+	}
+	if err := makeChunks(db, chunkOptions{}); err != nil {
+		b.Fatal(err)
+	}
+	if err := convertStorageCmd([]string{"--mode", storageReference}); err != nil {
+		b.Fatal(err)
+	}
+	refs, err := openDB()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer refs.Close()
+	ids, err := hotChunks(refs, benchHotBooks, 100)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() { sharedContent = nil }()
+	for _, cache := range []bool{false, true} {
+		b.Run(fmt.Sprintf("cache=%v", cache), func(b *testing.B) {
+			sharedContent = nil
+			if cache {
+				sharedContent = newContentCache(64, 256<<20)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := readChunks(refs, ids); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,489 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/mattn/go-sqlite3"
+)
+
+// A book's content is most of its row, and of the database: the chunks of
+// a corpus are smaller than the texts they were cut from. gutchunk
+// migrate-blobs --dir blobs moves it out of files.content into a blob
+// store, a file to a text compressed with zstd, named by the sha256 of the
+// text, blobs/ab/cdef...zst, so books with the same text share one. The
+// row keeps the hash in content_blob, and its size in content_bytes for
+// what counts sizes without reading it. The directory is recorded in
+// blob_store, relative to the database's own, so the two can be moved or
+// rsynced together; only what changed is sent again, a new book being a
+// file of its own rather than pages all through the database.
+//
+// Content is read through contentCol, which takes it from the row while
+// it is there and from the store once it isn't, so a database partly
+// moved reads as well as one all moved or not at all. New books are
+// written to the row as ever, for the next migrate-blobs to move, and
+// writing a moved book's content again keeps it in the row
+// (files_content_au), but for fix-encoding, which saves a repaired book
+// as a blob of its own. Books are moved a --batch to a transaction: each
+// text is written to the store and read back, and only the texts that
+// came back as they went are cleared from their rows. A blob is written
+// under a temporary name and renamed into place, so a reader never finds
+// one half written, and a book's row points at its blob only once the
+// blob is there. verify-content reports a book whose blob is missing, and
+// gc-content deletes the blobs of the books it clears once no other book
+// has them.
+
+// blobStore keeps texts by the hash of each.
+type blobStore interface {
+	put(hash string, data []byte) error
+	get(hash string) ([]byte, error)
+	delete(hash string) error
+}
+
+// errBlobCorrupt is what a blob no longer holding the text of its hash
+// gives.
+var errBlobCorrupt = errors.New("the blob is corrupt")
+
+// dirBlobs is a blobStore of zstd files in a directory, in a directory for
+// the first two characters of each hash.
+type dirBlobs struct {
+	dir string
+}
+
+var (
+	zstdOnce sync.Once
+	zstdEnc  *zstd.Encoder
+	zstdDec  *zstd.Decoder
+)
+
+// zstdCodec is the encoder and decoder shared by every store, each safe to
+// use from several goroutines at once through EncodeAll and DecodeAll.
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder) {
+	zstdOnce.Do(func() {
+		zstdEnc, _ = zstd.NewWriter(nil)
+		zstdDec, _ = zstd.NewReader(nil)
+	})
+	return zstdEnc, zstdDec
+}
+
+func (b dirBlobs) path(hash string) string {
+	return filepath.Join(b.dir, hash[:2], hash[2:]+".zst")
+}
+
+func (b dirBlobs) put(hash string, data []byte) error {
+	path := b.path(hash)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	enc, _ := zstdCodec()
+	f, err := os.CreateTemp(filepath.Dir(path), ".blob-*")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(enc.EncodeAll(data, nil)); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (b dirBlobs) get(hash string) ([]byte, error) {
+	compressed, err := os.ReadFile(b.path(hash))
+	if err != nil {
+		return nil, err
+	}
+	_, dec := zstdCodec()
+	data, err := dec.DecodeAll(compressed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("blob %s: %w: %v", short(hash), errBlobCorrupt, err)
+	}
+	if textHash(string(data)) != hash {
+		return nil, fmt.Errorf("blob %s: %w: it no longer hashes to its name", short(hash), errBlobCorrupt)
+	}
+	return data, nil
+}
+
+func (b dirBlobs) delete(hash string) error {
+	if err := os.Remove(b.path(hash)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+var (
+	blobsMu sync.Mutex
+	// the blob store of the open database, nil while it records none
+	openBlobs blobStore
+)
+
+// contentBlobs is the blob store of the open database, nil when it records
+// none.
+func contentBlobs() blobStore {
+	blobsMu.Lock()
+	defer blobsMu.Unlock()
+	return openBlobs
+}
+
+func setContentBlobs(store blobStore) {
+	blobsMu.Lock()
+	openBlobs = store
+	blobsMu.Unlock()
+}
+
+// contentCol is the content of the files row of alias, given with its
+// dot, or "" for files itself: the row's own, or else its blob's.
+func contentCol(alias string) string {
+	return "coalesce(" + alias + "content, blob_content(" + alias + "content_blob))"
+}
+
+// hasContent is whether the files row of alias has content, in the row or
+// in the store.
+func hasContent(alias string) string {
+	return "(" + alias + "content IS NOT NULL OR " + alias + "content_blob IS NOT NULL)"
+}
+
+// contentBytes is the size of the content of the files row of alias, in
+// bytes, NULL for none.
+func contentBytes(alias string) string {
+	return "coalesce(length(CAST(" + alias + "content AS BLOB)), " + alias + "content_bytes)"
+}
+
+// blobContent is blob_content(hash) for conn, the text of a blob, NULL for
+// none. A database the blob store was recorded in since it was opened, by
+// migrate-blobs beside serve, say, is asked for it again on conn.
+func blobContent(conn *sqlite3.SQLiteConn) func(interface{}) (interface{}, error) {
+	return func(hash interface{}) (interface{}, error) {
+		h := driverString(hash)
+		if h == "" {
+			return nil, nil
+		}
+		store := contentBlobs()
+		if store == nil {
+			dir, err := connBlobDir(conn)
+			if err != nil {
+				return nil, fmt.Errorf("could not read the blob store: %w", err)
+			}
+			if dir == "" {
+				return nil, fmt.Errorf("a book's content is in blob %s, but the database records no blob store", short(h))
+			}
+			store = dirBlobs{dir}
+			setContentBlobs(store)
+		}
+		return blobText(store, h)
+	}
+}
+
+// blobText is the text of blob hash in store.
+func blobText(store blobStore, hash string) (interface{}, error) {
+	data, err := store.get(hash)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("blob %s is missing from the blob store; gutchunk verify-content lists the books without theirs", short(hash))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// blobDir is the directory blob_store records, "" for none.
+func blobDir(db queryer) (string, error) {
+	var dir string
+	err := db.QueryRow("SELECT dir FROM blob_store LIMIT 1").Scan(&dir)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return blobPath(dir), err
+}
+
+// connBlobDir is blobDir on conn.
+func connBlobDir(conn *sqlite3.SQLiteConn) (string, error) {
+	rows, err := conn.Query("SELECT dir FROM blob_store LIMIT 1", nil)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	dest := make([]driver.Value, 1)
+	if err = rows.Next(dest); errors.Is(err, io.EOF) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return blobPath(driverString(dest[0])), nil
+}
+
+// blobPath is dir, as blob_store records it, made absolute.
+func blobPath(dir string) string {
+	if dir == "" || filepath.IsAbs(dir) {
+		return dir
+	}
+	dir = filepath.Join(filepath.Dir(dbFile(dsn)), dir)
+	if abs, err := filepath.Abs(dir); err == nil {
+		return abs
+	}
+	return dir
+}
+
+// loadBlobStore is the blob store of the database, nil for none.
+func loadBlobStore(db queryer) (blobStore, error) {
+	dir, err := blobDir(db)
+	if err != nil || dir == "" {
+		return nil, err
+	}
+	return dirBlobs{dir}, nil
+}
+
+// blobReport is what migrate-blobs moved.
+type blobReport struct {
+	Dir   string `json:"dir"`
+	Books int    `json:"books"`
+	Bytes int64  `json:"bytes"`
+	// books whose content changed while being moved, left for another run
+	Changed int `json:"changed"`
+	// the space free in the database's file once moved, and how much of
+	// it --vacuum gave back
+	Free     int64 `json:"free"`
+	Returned int64 `json:"returned"`
+}
+
+func migrateBlobsCmd(args []string) error {
+	fs := flag.NewFlagSet("migrate-blobs", flag.ExitOnError)
+	dir := fs.String("dir", "", "the directory to move books' content to; the one the database records by default")
+	batch := fs.Int("batch", 100, "books moved per transaction")
+	vacuum := fs.Bool("vacuum", false, "give the space moved out back to the filesystem with an incremental vacuum")
+	asJSON := fs.Bool("json", false, "print the report as json")
+	fs.Parse(args)
+
+	if fs.NArg() > 0 {
+		return usagef("usage: gutchunk migrate-blobs [--dir DIR] [--batch N] [--vacuum] [--json]")
+	}
+	if *batch < 1 {
+		return usagef("--batch must be at least 1")
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if *vacuum {
+		if mode, err := autoVacuum(db); err != nil {
+			return err
+		} else if mode != autoVacuumIncremental {
+			return fmt.Errorf("the database was made without incremental vacuuming; turn it on once with gutchunk migrate --incremental-vacuum, or give the space back with a full VACUUM")
+		}
+	}
+
+	recorded, err := blobDir(db)
+	if err != nil {
+		return err
+	}
+	var rep blobReport
+	switch {
+	case *dir == "" && recorded == "":
+		return usagef("the database records no blob store yet; give one with --dir")
+	case *dir == "":
+		rep.Dir = recorded
+	default:
+		if rep.Dir, err = filepath.Abs(*dir); err != nil {
+			return err
+		}
+		if recorded != "" && recorded != rep.Dir {
+			return fmt.Errorf("the database's blob store is %s already, and migrate-blobs moves content into it; leave out --dir", recorded)
+		}
+	}
+	if err = os.MkdirAll(rep.Dir, 0o755); err != nil {
+		return err
+	}
+	if recorded == "" {
+		stored := rep.Dir
+		if path := dbFile(dsn); path != "" {
+			if base, err := filepath.Abs(filepath.Dir(path)); err == nil {
+				if rel, err := filepath.Rel(base, rep.Dir); err == nil {
+					stored = rel
+				}
+			}
+		}
+		if _, err = db.Exec("INSERT INTO blob_store (dir) VALUES (?)", stored); err != nil {
+			return err
+		}
+	}
+	store := dirBlobs{rep.Dir}
+	setContentBlobs(store)
+
+	if err = moveContent(runCtx, db, store, *batch, &rep); err != nil {
+		return err
+	}
+	if rep.Free, err = freeBytes(db); err != nil {
+		return err
+	}
+	if *vacuum {
+		if err = incrementalVacuum(runCtx, db); err != nil {
+			return fmt.Errorf("could not vacuum: %w", err)
+		}
+		left, err := freeBytes(db)
+		if err != nil {
+			return err
+		}
+		rep.Returned = rep.Free - left
+	}
+
+	if *asJSON {
+		return json.NewEncoder(os.Stdout).Encode(rep)
+	}
+	fmt.Printf("moved the content of %d books (%s) to %s\n", rep.Books, formatSize(rep.Bytes), rep.Dir)
+	if rep.Changed > 0 {
+		fmt.Printf("left %d books whose content changed while being moved, for another run\n", rep.Changed)
+	}
+	if *vacuum {
+		fmt.Printf("gave %s back to the filesystem\n", formatSize(rep.Returned))
+	} else {
+		fmt.Printf("%s of the database's file is free, for --vacuum or gc-content --vacuum to give back\n", formatSize(rep.Free))
+	}
+	return nil
+}
+
+// contentRow is a book's content as migrate-blobs read it.
+type contentRow struct {
+	id      int64
+	content string
+}
+
+// moveContent moves the content of every book keeping it in its row to
+// store, batch to a transaction.
+func moveContent(ctx context.Context, db *sql.DB, store blobStore, batch int, rep *blobReport) error {
+	var total int
+	if err := db.QueryRowContext(ctx, "SELECT count(*) FROM files WHERE content IS NOT NULL").Scan(&total); err != nil {
+		return err
+	}
+	last := int64(0)
+	shown := time.Now()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rows, err := db.QueryContext(ctx, "SELECT id, content FROM files WHERE content IS NOT NULL AND id > ? ORDER BY id LIMIT ?", last, batch)
+		if err != nil {
+			return err
+		}
+		var books []contentRow
+		for rows.Next() {
+			var b contentRow
+			if err = rows.Scan(&b.id, &b.content); err != nil {
+				rows.Close()
+				return err
+			}
+			books = append(books, b)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		if len(books) == 0 {
+			return nil
+		}
+		last = books[len(books)-1].id
+		if err = moveBatch(ctx, db, store, books, rep); err != nil {
+			return fmt.Errorf("could not move content: %w", err)
+		}
+		if time.Since(shown) >= 5*time.Second {
+			shown = time.Now()
+			fmt.Printf("moved %d of %d books (%.0f%%)\n", rep.Books, total, 100*float64(rep.Books)/float64(total))
+		}
+	}
+}
+
+// saveBlob writes text to store and reads it back, returning the hash it
+// is kept by.
+func saveBlob(store blobStore, text string) (string, error) {
+	hash := textHash(text)
+	if err := store.put(hash, []byte(text)); err != nil {
+		return "", err
+	}
+	back, err := store.get(hash)
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Equal(back, []byte(text)) {
+		return "", errors.New("its blob reads back different")
+	}
+	return hash, nil
+}
+
+// dropBlob deletes blob hash from the store once no book has it.
+func dropBlob(ctx context.Context, db *sql.DB, hash string) error {
+	var kept int
+	if err := db.QueryRowContext(ctx, "SELECT count(*) FROM files WHERE content_blob = ?", hash).Scan(&kept); err != nil {
+		return err
+	}
+	if kept > 0 || contentBlobs() == nil {
+		return nil
+	}
+	if err := contentBlobs().delete(hash); err != nil {
+		return fmt.Errorf("could not delete blob %s: %w", short(hash), err)
+	}
+	return nil
+}
+
+// moveBatch writes the content of books to store, reads each back, and
+// clears it from the rows of those that came back whole, but for a row
+// whose content changed since it was read.
+func moveBatch(ctx context.Context, db *sql.DB, store blobStore, books []contentRow, rep *blobReport) error {
+	hashes := make([]string, len(books))
+	for i, b := range books {
+		var err error
+		if hashes[i], err = saveBlob(store, b.content); err != nil {
+			return fmt.Errorf("book %d: %w", b.id, err)
+		}
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	moved, changed, size := 0, 0, int64(0)
+	for i, b := range books {
+		res, err := tx.ExecContext(ctx, `UPDATE files SET content = NULL, content_blob = ?, content_bytes = ?, content_hash = coalesce(content_hash, ?)
+			WHERE id = ? AND content = ?`, hashes[i], len(b.content), hashes[i], b.id, b.content)
+		if err != nil {
+			return fmt.Errorf("book %d: %w", b.id, err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			changed++
+			continue
+		}
+		moved++
+		size += int64(len(b.content))
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	rep.Books += moved
+	rep.Changed += changed
+	rep.Bytes += size
+	return nil
+}
@@ -0,0 +1,453 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstFiles is the blobs of the store in dir, relative to it, a line each,
+// and any file left beside them.
+func zstFiles(t *testing.T, dir string) string {
+	t.Helper()
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		files = append(files, filepath.ToSlash(rel)+"\n")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(files, "")
+}
+
+// blobFile is the path of the blob hash in dirBlobs dir.
+func blobFile(dir, hash string) string {
+	return filepath.Join(dir, hash[:2], hash[2:]+".zst")
+}
+
+func TestDirBlobs(t *testing.T) {
+	store := dirBlobs{t.TempDir()}
+	text := "It is a truth universally acknowledged."
+	hash := textHash(text)
+	if err := store.put(hash, []byte(text)); err != nil {
+		t.Fatal(err)
+	}
+	if got := zstFiles(t, store.dir); got != hash[:2]+"/"+hash[2:]+".zst\n" {
+		t.Errorf("the store holds\n%s", got)
+	}
+	if got, err := store.get(hash); err != nil || string(got) != text {
+		t.Errorf("get = %q (%v)", got, err)
+	}
+	// kept by its hash, it is never written again
+	if err := os.WriteFile(blobFile(store.dir, hash), []byte("garbled"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.put(hash, []byte(text)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.get(hash); !errors.Is(err, errBlobCorrupt) {
+		t.Errorf("get of a garbled blob: %v", err)
+	}
+	// nor read as another text than its own
+	enc, _ := zstd.NewWriter(nil)
+	if err := os.WriteFile(blobFile(store.dir, hash), enc.EncodeAll([]byte("Another text."), nil), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.get(hash); !errors.Is(err, errBlobCorrupt) || !strings.Contains(err.Error(), "no longer hashes to its name") {
+		t.Errorf("get of another text's blob: %v", err)
+	}
+
+	if err := store.delete(hash); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.get(hash); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("get of a deleted blob: %v", err)
+	}
+	if err := store.delete(hash); err != nil {
+		t.Errorf("deleting a blob there isn't: %v", err)
+	}
+	if got, err := saveBlob(store, text); err != nil || got != hash {
+		t.Errorf("saveBlob = %s (%v), want %s", got, err, hash)
+	}
+}
+
+// blobLibrary is a file database of three books ingested from a mirror and
+// chunked, and one stored with the first's text, by their content by id,
+// with the directory beside it to move them to.
+func blobLibrary(t *testing.T) (*sql.DB, map[int]string, string) {
+	t.Helper()
+	db := testFileDB(t)
+	t.Cleanup(func() { setContentBlobs(nil) })
+	root := t.TempDir()
+	for _, n := range []string{"11", "22", "33"} {
+		writeTestZip(t, filepath.Join(root, n[:1], n+".zip"), zipEntry{n + ".txt", testBook("Book "+n, testParagraphs(12))})
+	}
+	if _, err := captureStdout(t, func() error { return ingestCmd([]string{"--target", root}) }); err != nil {
+		t.Fatal(err)
+	}
+	texts := map[int]string{}
+	rows, err := db.Query("SELECT id, content FROM files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var id int
+		var text string
+		if err = rows.Scan(&id, &text); err != nil {
+			t.Fatal(err)
+		}
+		texts[id] = text
+	}
+	rows.Close()
+	texts[addBook(t, db, "Book 11 again", "", texts[1])] = texts[1]
+	if _, err := captureStderr(t, func() error { return chunkCmd(nil) }); err != nil {
+		t.Fatal(err)
+	}
+	return db, texts, filepath.Join(filepath.Dir(dbFile(dsn)), "blobs")
+}
+
+// stored is the content of every book as it is read, by id.
+func stored(t *testing.T, db *sql.DB) map[int]string {
+	t.Helper()
+	rows, err := db.Query("SELECT id, " + contentCol("") + " FROM files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	texts := map[int]string{}
+	for rows.Next() {
+		var id int
+		var text sql.NullString
+		if err = rows.Scan(&id, &text); err != nil {
+			t.Fatal(err)
+		}
+		texts[id] = text.String
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return texts
+}
+
+func sameTexts(t *testing.T, what string, got, want map[int]string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%s, %d books were read, want %d", what, len(got), len(want))
+	}
+	for id, text := range want {
+		if got[id] != text {
+			t.Errorf("%s, book %d reads %d bytes, want %d", what, id, len(got[id]), len(text))
+		}
+	}
+}
+
+func TestMigrateBlobs(t *testing.T) {
+	db, texts, dir := blobLibrary(t)
+	migrate := func(args ...string) (string, error) {
+		t.Helper()
+		return captureStdout(t, func() error { return migrateBlobsCmd(args) })
+	}
+	verify := func() string {
+		t.Helper()
+		out, _ := captureStdout(t, func() error { return verifyContentCmd([]string{"--workers", "1"}) })
+		return out
+	}
+	chunks := func() string {
+		t.Helper()
+		return names(t, db, "SELECT sourceid || ' ' || ordinal || ' ' || chunk FROM chunks ORDER BY sourceid, ordinal")
+	}
+	stats, err := captureStdout(t, func() error { return statsCmd([]string{"--exact"}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	checked, chunked := verify(), chunks()
+
+	out, err := migrate("--dir", dir, "--batch", "3", "--json")
+	var rep blobReport
+	if err != nil || json.Unmarshal([]byte(out), &rep) != nil {
+		t.Fatalf("migrate-blobs: %v, printing\n%s", err, out)
+	}
+	size := 0
+	for _, text := range texts {
+		size += len(text)
+	}
+	if rep.Dir != dir || rep.Books != 4 || rep.Bytes != int64(size) || rep.Changed != 0 || rep.Free == 0 {
+		t.Errorf("migrate-blobs reported %+v", rep)
+	}
+	// the row keeps its hash and size, and the two books of one text one
+	// blob
+	if got := names(t, db, "SELECT count(*) FROM files WHERE content IS NULL AND content_blob = content_hash AND content_bytes = length(CAST("+contentCol("")+" AS BLOB))"); got != "4\n" {
+		t.Errorf("%s books were moved", got)
+	}
+	var want []string
+	for _, id := range []int{1, 2, 3} {
+		hash := textHash(texts[id])
+		want = append(want, hash[:2]+"/"+hash[2:]+".zst\n")
+	}
+	if got := zstFiles(t, dir); len(got) != len(strings.Join(want, "")) || !strings.Contains(got, want[0]) || !strings.Contains(got, want[1]) || !strings.Contains(got, want[2]) {
+		t.Errorf("the store holds\n%s", got)
+	}
+	if got := names(t, db, "SELECT dir FROM blob_store"); got != "blobs\n" {
+		t.Errorf("the store recorded is %s", got)
+	}
+
+	// read from the store, everything reads as it did
+	sameTexts(t, "moved", stored(t, db), texts)
+	if out, err = captureStdout(t, func() error { return statsCmd([]string{"--exact"}) }); err != nil || out != stats {
+		t.Errorf("stats of the books moved: %v, printing\n%s\nwant\n%s", err, out, stats)
+	}
+	if out = verify(); out != checked {
+		t.Errorf("verify-content of the books moved printed\n%s\nwant\n%s", out, checked)
+	}
+	if _, err = captureStderr(t, func() error { return chunkCmd([]string{"--full-rechunk"}) }); err != nil {
+		t.Fatal(err)
+	}
+	if got := chunks(); got != chunked {
+		t.Errorf("chunked from the store, the chunks are\n%s", lineDiff(chunked, got))
+	}
+
+	// a book added later, or written again, is kept in its row, and read
+	// beside those moved, until it is moved too
+	texts[addBook(t, db, "New", "", "A new book.")] = "A new book."
+	if _, err = db.Exec("UPDATE files SET content = 'Written again.' WHERE id = 2"); err != nil {
+		t.Fatal(err)
+	}
+	texts[2] = "Written again."
+	if got := names(t, db, "SELECT id FROM files WHERE content_blob IS NULL ORDER BY id"); got != "2\n5\n" {
+		t.Errorf("the books kept in their rows are\n%s", got)
+	}
+	sameTexts(t, "partly moved", stored(t, db), texts)
+	if out, err = migrate(); err != nil || !strings.HasPrefix(out, fmt.Sprintf("moved the content of 2 books (%s) to %s\n", formatSize(int64(len("A new book.Written again."))), dir)) {
+		t.Errorf("migrate-blobs again: %v, printing\n%s", err, out)
+	}
+	sameTexts(t, "all moved", stored(t, db), texts)
+
+	// opened again, the store is found beside the database, and a
+	// connection that never had it looks it up
+	setContentBlobs(nil)
+	sameTexts(t, "looked up", stored(t, db), texts)
+	again, err := openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	sameTexts(t, "opened again", stored(t, again), texts)
+
+	// a book changed while it was being moved is left for another run
+	if _, err = db.Exec("UPDATE files SET content = 'Changed.' WHERE id = 5"); err != nil {
+		t.Fatal(err)
+	}
+	rep = blobReport{}
+	if err = moveBatch(context.Background(), db, contentBlobs(), []contentRow{{5, "Before the change."}}, &rep); err != nil || rep.Changed != 1 || rep.Books != 0 {
+		t.Errorf("moving a book changed since: %+v (%v)", rep, err)
+	}
+	if got := names(t, db, "SELECT content FROM files WHERE id = 5"); got != "Changed.\n" {
+		t.Errorf("the book changed reads %s", got)
+	}
+
+	if _, err = migrate("--dir", t.TempDir()); err == nil || !strings.Contains(err.Error(), "blob store is "+dir+" already") {
+		t.Errorf("migrate-blobs into another directory: %v", err)
+	}
+	for _, args := range [][]string{{"books"}, {"--batch", "0"}} {
+		if _, err = migrate(args...); exitCode(err) != exitUsage {
+			t.Errorf("migrate-blobs %s: %v, want a usage error", strings.Join(args, " "), err)
+		}
+	}
+	if _, err = db.Exec("DELETE FROM blob_store"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = migrate(); exitCode(err) != exitUsage {
+		t.Errorf("migrate-blobs with no store recorded nor --dir: %v, want a usage error", err)
+	}
+}
+
+func TestMissingBlobs(t *testing.T) {
+	db, texts, dir := blobLibrary(t)
+	if _, err := captureStdout(t, func() error { return migrateBlobsCmd([]string{"--dir", dir}) }); err != nil {
+		t.Fatal(err)
+	}
+	verify := func() (string, error) {
+		t.Helper()
+		return captureStdout(t, func() error { return verifyContentCmd([]string{"--workers", "1"}) })
+	}
+	// the blob of two books deleted, and another garbled
+	if err := os.Remove(blobFile(dir, textHash(texts[1]))); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(blobFile(dir, textHash(texts[3])), []byte("garbled"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := verify()
+	if exitCode(err) != 1 {
+		t.Errorf("verify-content with blobs missing: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	for i, want := range []string{
+		"book 1 (1/11.zip): blob_missing, blob " + short(textHash(texts[1])) + " is missing from the blob store",
+		"book 3 (3/33.zip): corrupt, blob " + short(textHash(texts[3])) + ": the blob is corrupt",
+		"book 4 (): blob_missing, blob " + short(textHash(texts[1])) + " is missing from the blob store",
+		"checked 4 books: 1 ok, 1 corrupt, 2 blob missing",
+	} {
+		if i >= len(lines) || !strings.HasPrefix(lines[i], want) {
+			t.Errorf("verify-content printed\n%s\nwant line %d to be %q", out, i+1, want)
+			break
+		}
+	}
+	var text string
+	if err = db.QueryRow("SELECT " + contentCol("") + " FROM files WHERE id = 1").Scan(&text); err == nil ||
+		!strings.Contains(err.Error(), "is missing from the blob store; gutchunk verify-content lists the books without theirs") {
+		t.Errorf("reading a book whose blob is missing: %v", err)
+	}
+	// the book read, rather than the rest
+	if got := names(t, db, "SELECT id FROM files WHERE "+hasContent("")+" AND id = 2"); got != "2\n" {
+		t.Errorf("a book of a blob there is reads as %q", got)
+	}
+
+	// with no store recorded, every book moved is missing its blob
+	if _, err = db.Exec("DELETE FROM blob_store"); err != nil {
+		t.Fatal(err)
+	}
+	setContentBlobs(nil)
+	if out, _ = verify(); !strings.Contains(out, "book 2 (2/22.zip): blob_missing, its content is in blob "+short(textHash(texts[2]))+", but the database records no blob store") {
+		t.Errorf("verify-content with no blob store printed\n%s", out)
+	}
+	if err = db.QueryRow("SELECT " + contentCol("") + " FROM files WHERE id = 2").Scan(&text); err == nil || !strings.Contains(err.Error(), "the database records no blob store") {
+		t.Errorf("reading a moved book with no blob store: %v", err)
+	}
+}
+
+// Books are read as they are moved, from the row or the store, but never
+// from neither.
+func TestBlobsConcurrent(t *testing.T) {
+	db := testFileDB(t)
+	t.Cleanup(func() { setContentBlobs(nil) })
+	texts := map[int]string{}
+	for i := 0; i < 60; i++ {
+		text := testBook(fmt.Sprint("Book ", i), testParagraphs(5+i%7))
+		texts[addBook(t, db, fmt.Sprint("Book ", i), "", text)] = text
+	}
+	dir := filepath.Join(t.TempDir(), "blobs")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	done := make(chan struct{})
+	for r := 0; r < 6; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					if i > 0 {
+						return
+					}
+				default:
+				}
+				id := 1 + (r*7+i)%len(texts)
+				var text string
+				if err := db.QueryRow("SELECT "+contentCol("")+" FROM files WHERE id = ?", id).Scan(&text); err != nil {
+					errs <- err
+					return
+				}
+				if text != texts[id] {
+					errs <- fmt.Errorf("book %d read %d bytes, want %d", id, len(text), len(texts[id]))
+					return
+				}
+			}
+		}(r)
+	}
+	_, err := captureStdout(t, func() error { return migrateBlobsCmd([]string{"--dir", dir, "--batch", "4"}) })
+	close(done)
+	wg.Wait()
+	close(errs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for err := range errs {
+		t.Errorf("read beside migrate-blobs: %v", err)
+	}
+	if got := names(t, db, "SELECT count(*) FROM files WHERE content_blob IS NOT NULL AND content IS NULL"); got != "60\n" {
+		t.Errorf("%s books were moved", got)
+	}
+
+	// and blobs written at once, of the same text or not, all land
+	store := dirBlobs{filepath.Join(t.TempDir(), "blobs")}
+	errs = make(chan error, 40)
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := saveBlob(store, texts[1+i%8]); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("saving blobs at once: %v", err)
+	}
+	if got := zstFiles(t, store.dir); strings.Count(got, "\n") != 8 || strings.Contains(got, ".blob-") {
+		t.Errorf("the store holds\n%s", got)
+	}
+}
+
+func TestGCContentBlobs(t *testing.T) {
+	db, clear := gcLibrary(t)
+	t.Cleanup(func() { setContentBlobs(nil) })
+	// a book not chunked keeps the blob it shares with one cleared
+	var shared string
+	if err := db.QueryRow("SELECT content FROM files WHERE id = ?", clear[0]).Scan(&shared); err != nil {
+		t.Fatal(err)
+	}
+	twin := addBook(t, db, "Unchunked twin", "", shared)
+	dir := filepath.Join(t.TempDir(), "blobs")
+	if _, err := captureStdout(t, func() error { return migrateBlobsCmd([]string{"--dir", dir}) }); err != nil {
+		t.Fatal(err)
+	}
+	// moved, the book stored without a hash has one, and can be cleared
+	// too
+	clear = append(clear, 2)
+	gone := strings.Fields(names(t, db, fmt.Sprintf("SELECT content_blob FROM files WHERE id IN (%d, %d)", clear[1], clear[2])))
+	before := zstFiles(t, dir)
+
+	if out, err := captureStdout(t, func() error { return gcContentCmd([]string{"--dry-run"}) }); err != nil || !strings.HasPrefix(out, "would clear the content of 3 books (") {
+		t.Errorf("gc-content --dry-run: %v, printing\n%s", err, out)
+	}
+	if got := zstFiles(t, dir); got != before {
+		t.Errorf("gc-content --dry-run deleted blobs:\n%s", lineDiff(before, got))
+	}
+	if out, err := captureStdout(t, func() error { return gcContentCmd([]string{"--batch", "1"}) }); err != nil || !strings.HasPrefix(out, "cleared the content of 3 books (") {
+		t.Errorf("gc-content: %v, printing\n%s", err, out)
+	}
+	if got, want := kept(t, db), fmt.Sprintf("3\n4\n%d\n", twin); got != want {
+		t.Errorf("gc-content left the content of\n%s\nwant\n%s", got, want)
+	}
+	if got := names(t, db, fmt.Sprintf("SELECT count(*) FROM files WHERE id IN (%d, %d, %d) AND (content_blob IS NOT NULL OR content_bytes IS NOT NULL)", clear[0], clear[1], clear[2])); got != "0\n" {
+		t.Errorf("%s books cleared keep their blobs", got)
+	}
+	after := zstFiles(t, dir)
+	if strings.Count(before, "\n")-strings.Count(after, "\n") != 2 || strings.Contains(after, gone[0][2:]) || strings.Contains(after, gone[1][2:]) ||
+		!strings.Contains(after, textHash(shared)[2:]) {
+		t.Errorf("gc-content left the blobs\n%s\nof\n%s", after, before)
+	}
+	var text string
+	if err := db.QueryRow("SELECT "+contentCol("")+" FROM files WHERE id = ?", twin).Scan(&text); err != nil || text != shared {
+		t.Errorf("the twin reads %d bytes (%v)", len(text), err)
+	}
+}
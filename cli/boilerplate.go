@@ -0,0 +1,145 @@
+package cli
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"git.tilde.town/gutchunker/gutchunk"
+)
+
+// phrases that only turn up in license text and producer credits. A novel
+// that talks about donations or archives won't match any of them whole.
+var defaultBlockphrases = []string{
+	"Project Gutenberg Literary Archive Foundation",
+	"Project Gutenberg-tm",
+	"full Project Gutenberg license",
+	"gutenberg.org/license",
+	"donations are gratefully accepted",
+	"this etext was prepared by",
+	"this ebook was prepared by",
+	"end of the project gutenberg ebook",
+	"end of this project gutenberg ebook",
+}
+
+// blocklist catches chunks that quote Gutenberg boilerplate the END marker
+// didn't cut off. Matching ignores case and treats any run of whitespace,
+// line breaks included, as one space. It counts what each phrase caught and
+// is safe to share between workers.
+type blocklist struct {
+	phrases []string
+	// drop caught chunks instead of only counting them
+	strict bool
+	caught []int64
+}
+
+func newBlocklist(phrases []string, strict bool) *blocklist {
+	bl := &blocklist{strict: strict}
+	for _, p := range phrases {
+		if p = normalizeSpace(p); p != "" {
+			bl.phrases = append(bl.phrases, p)
+		}
+	}
+	bl.caught = make([]int64, len(bl.phrases))
+	return bl
+}
+
+// loadBlocklist returns the default phrases plus those in file.
+func loadBlocklist(file string, strict bool) (*blocklist, error) {
+	phrases, err := loadPhrases(file, defaultBlockphrases)
+	if err != nil {
+		return nil, fmt.Errorf("could not read blockphrases: %w", err)
+	}
+	return newBlocklist(phrases, strict), nil
+}
+
+// loadPhrases returns defaults plus the phrases in file, one per line.
+// Blank lines and lines starting with # are ignored.
+func loadPhrases(file string, defaults []string) ([]string, error) {
+	phrases := append([]string{}, defaults...)
+	if file == "" {
+		return phrases, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		phrases = append(phrases, line)
+	}
+	return phrases, s.Err()
+}
+
+func normalizeSpace(s string) string {
+	return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+}
+
+// match returns the index of the first phrase chunk contains, or -1.
+func (bl *blocklist) match(chunk string) int {
+	text := normalizeSpace(chunk)
+	for i, p := range bl.phrases {
+		if strings.Contains(text, p) {
+			return i
+		}
+	}
+	return -1
+}
+
+// filter counts the chunks that match and, when strict, drops them,
+// moving footnotes that followed a dropped chunk onto the last chunk kept
+// before it. at, where the chunks are, is kept in step.
+func (bl *blocklist) filter(chunks []string, at []chunkPos, notes []gutchunk.Footnote) ([]string, []chunkPos, []gutchunk.Footnote) {
+	kept := chunks[:0]
+	keptAt := at[:0]
+	// newIndex[i] is the ordinal chunk i's footnotes now follow
+	newIndex := make([]int, len(chunks))
+	for i, c := range chunks {
+		if m := bl.match(c); m >= 0 {
+			atomic.AddInt64(&bl.caught[m], 1)
+			if bl.strict {
+				newIndex[i] = len(kept) - 1
+				continue
+			}
+		}
+		newIndex[i] = len(kept)
+		kept = append(kept, c)
+		keptAt = append(keptAt, at[i])
+	}
+	for i := range notes {
+		if notes[i].Ordinal >= 0 {
+			notes[i].Ordinal = newIndex[notes[i].Ordinal]
+		}
+	}
+	return kept, keptAt, notes
+}
+
+func (bl *blocklist) report() {
+	what := "flagged"
+	if bl.strict {
+		what = "dropped"
+	}
+	for i, p := range bl.phrases {
+		if n := atomic.LoadInt64(&bl.caught[i]); n > 0 {
+			fmt.Printf("%s %d chunks containing %q\n", what, n, p)
+		}
+	}
+}
+
+// footerFlags adds --strict-footer and --blockphrase-file to fs and returns
+// a func building the blocklist they describe once fs is parsed.
+func footerFlags(fs *flag.FlagSet) func() (*blocklist, error) {
+	strict := fs.Bool("strict-footer", false, "drop chunks quoting license boilerplate instead of only counting them")
+	file := fs.String("blockphrase-file", "", "file of extra boilerplate phrases, one per line")
+	return func() (*blocklist, error) {
+		return loadBlocklist(*file, *strict)
+	}
+}
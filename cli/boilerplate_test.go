@@ -0,0 +1,107 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.tilde.town/gutchunker/gutchunk"
+)
+
+// the license boilerplate a chunk quotes when the END marker was missed
+const licenseChunk = "Section 4. Information about Donations to the Project\nGutenberg LITERARY Archive   Foundation. Donations are gratefully accepted."
+
+// a novel's paragraph that talks of donations but quotes no license
+const donationChunk = "She made a donation to the archive of the parish, and the foundation of the new church was laid that spring, with gratitude from all."
+
+func TestBlocklistMatch(t *testing.T) {
+	bl := newBlocklist(defaultBlockphrases, false)
+	if m := bl.match(licenseChunk); m < 0 || bl.phrases[m] != "project gutenberg literary archive foundation" {
+		t.Errorf("the license chunk matched %d, want the phrase across its line break and capitals", m)
+	}
+	if m := bl.match(donationChunk); m >= 0 {
+		t.Errorf("the novel's mention of donations matched %q", bl.phrases[m])
+	}
+}
+
+func TestLoadBlocklist(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "phrases.txt")
+	if err := os.WriteFile(file, []byte("# producers' credits\n\nProduced by  Distributed\tProofreaders\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	bl, err := loadBlocklist(file, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bl.phrases) != len(defaultBlockphrases)+1 {
+		t.Errorf("%d phrases, want the defaults and one more", len(bl.phrases))
+	}
+	if bl.match("This book was produced by distributed proofreaders.") < 0 {
+		t.Error("the --blockphrase-file phrase caught nothing")
+	}
+	if bl.match(licenseChunk) < 0 {
+		t.Error("with a --blockphrase-file the default phrases caught nothing")
+	}
+	if _, err = loadBlocklist(filepath.Join(t.TempDir(), "none"), false); err == nil {
+		t.Error("a missing --blockphrase-file was no error")
+	}
+}
+
+func TestBlocklistFilter(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		bl := newBlocklist(defaultBlockphrases, strict)
+		chunks := []string{donationChunk, donationChunk, licenseChunk, licenseChunk}
+		at := make([]chunkPos, len(chunks))
+		notes := []gutchunk.Footnote{{Marker: "1", Ordinal: 1}, {Marker: "2", Ordinal: 3}, {Marker: "3", Ordinal: -1}}
+		kept, keptAt, notes := bl.filter(chunks, at, notes)
+
+		want, wantNotes := 4, []int{1, 3, -1}
+		if strict {
+			// the footnote after a dropped chunk follows the last kept
+			want, wantNotes = 2, []int{1, 1, -1}
+		}
+		if len(kept) != want || len(keptAt) != want {
+			t.Errorf("strict %v: kept %d chunks at %d places, want %d", strict, len(kept), len(keptAt), want)
+		}
+		for i, n := range notes {
+			if n.Ordinal != wantNotes[i] {
+				t.Errorf("strict %v: footnote %s follows %d, want %d", strict, n.Marker, n.Ordinal, wantNotes[i])
+			}
+		}
+		if bl.caught[0] != 2 {
+			t.Errorf("strict %v: the foundation phrase caught %d chunks, want 2", strict, bl.caught[0])
+		}
+	}
+}
+
+func TestChunkStrictFooter(t *testing.T) {
+	db := testDB(t)
+	paras := strings.Split(testParagraphs(2), "\n\n")
+	body := paras[0] + "\n\n" + strings.Repeat(donationChunk+" ", 3) + "\n\n" + strings.Repeat(licenseChunk+" ", 3) + "\n\n" + paras[1]
+	id := addBook(t, db, "Missed", "Someone", testBook("Missed", body))
+	if err := makeChunks(db, chunkOptions{footer: newBlocklist(defaultBlockphrases, true)}); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.Query("SELECT chunk FROM chunks WHERE sourceid = ? ORDER BY ordinal", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var n int
+	donation := false
+	for rows.Next() {
+		var c string
+		if err = rows.Scan(&c); err != nil {
+			t.Fatal(err)
+		}
+		n++
+		if strings.Contains(c, "gratefully accepted") {
+			t.Errorf("chunk %d quotes the license: %.60q", n, c)
+		}
+		donation = donation || strings.Contains(c, "made a donation")
+	}
+	if n != 3 || !donation {
+		t.Errorf("%d chunks, the novel's donation among them %v; want 3 with it", n, donation)
+	}
+}
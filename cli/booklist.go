@@ -0,0 +1,268 @@
+package cli
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// gutchunk books without --search lists the books, sorted and a page at a
+// time, with their chunk counts from one join rather than a query each.
+
+// what books --sort takes, and what it sorts by. Titles and authors sort
+// by their folded forms, so without regard to case or diacritics, and
+// bare, so by their indexes.
+var bookSorts = map[string]string{
+	"id":     "f.id",
+	"title":  "f.title_norm",
+	"author": "f.author_norm",
+	"chunks": "coalesce(c.n, 0)",
+	"size":   "coalesce(length(CAST(f.content AS BLOB)), f.content_bytes, 0)",
+}
+
+type bookListQuery struct {
+	sort string
+	desc bool
+	// sort titles by title_sort, past a leading article
+	ignoreArticles bool
+	// sort titles and authors by the collation of this locale, as
+	// sortLocale gives it, "" for their folded forms (see collation.go)
+	locale        string
+	limit, offset int
+	names         nameQuery
+	// a language code, "" for any, and with one, whether to take books
+	// with no language or und too
+	language     string
+	undetermined bool
+	// only books with no chunks
+	noChunks bool
+	// a metadata status, "" for any
+	status string
+}
+
+type bookRow struct {
+	ID       int    `json:"id"`
+	Ebook    *int   `json:"ebook"`
+	Title    string `json:"title"`
+	Author   string `json:"author"`
+	Language string `json:"language"`
+	Chunks   int    `json:"chunks"`
+	// bytes of content, nil for books stored without it
+	Size           *int64 `json:"size"`
+	MetadataStatus string `json:"metadata_status"`
+	// the series it is in with its position in each; GET /books/{id}
+	// gives the books of the library before and after it as well
+	Series []seriesPlace `json:"series"`
+	// its translators, editors and illustrators (see contributors.go)
+	Contributors []contributor `json:"contributors"`
+}
+
+// where is the condition and arguments of q's filters, over files f and
+// the chunk counts c.
+func (q bookListQuery) where() (string, []interface{}) {
+	names, args := q.names.where()
+	where := "f.deleted_at IS NULL AND " + activeVersion + " AND " + names +
+		" AND (? = '' OR ',' || f.language || ',' LIKE '%,' || ? || ',%' OR ? AND " + undeterminedLanguage + ")" +
+		" AND (? = '' OR f.metadata_status = ?)" +
+		" AND (NOT ? OR c.n IS NULL)"
+	return where, append(args, q.language, q.language, q.undetermined, q.status, q.status, q.noChunks)
+}
+
+// leadingArticles are the articles a title may start with, folded, in
+// the languages the corpus has most of. "l" is French l', its apostrophe
+// gone with normalizeTitle.
+var leadingArticles = map[string]bool{
+	"the": true, "a": true, "an": true,
+	"le": true, "la": true, "les": true, "l": true,
+	"el": true, "los": true, "las": true,
+	"der": true, "die": true, "das": true,
+	"il": true, "lo": true, "gli": true,
+}
+
+// sortTitle is what a folded title sorts by with --ignore-articles: the
+// title past its leading article, "the time machine" by "time machine".
+// A title that is only an article keeps it.
+func sortTitle(titleNorm string) string {
+	if i := strings.IndexByte(titleNorm, ' '); i > 0 && leadingArticles[titleNorm[:i]] {
+		return titleNorm[i+1:]
+	}
+	return titleNorm
+}
+
+// fillTitleSort gives the books there were before title_sort their titles'
+// sort keys.
+func fillTitleSort(db *sql.DB) error {
+	rows, err := db.Query("SELECT id, coalesce(title_norm, '') FROM files WHERE title_sort IS NULL")
+	if err != nil {
+		return err
+	}
+	todo := map[int64]string{}
+	for rows.Next() {
+		var id int64
+		var title string
+		if err = rows.Scan(&id, &title); err != nil {
+			rows.Close()
+			return err
+		}
+		todo[id] = sortTitle(title)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || len(todo) == 0 {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for id, key := range todo {
+		if _, err = tx.Exec("UPDATE files SET title_sort = ? WHERE id = ?", key, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// bookColumns are what scanBookRow reads of files f, with bookCounts.
+const bookColumns = `f.id, f.ebook, coalesce(f.name, ''), coalesce(f.author, ''), coalesce(f.language, ''),
+	coalesce(c.n, 0), coalesce(length(CAST(f.content AS BLOB)), f.content_bytes), coalesce(f.metadata_status, ''),
+	(SELECT json_group_array(json_object('name', s.name, 'position', s.position))
+		FROM (SELECT name, position FROM ` + seriesRows + ` s WHERE s.ebook = f.ebook ORDER BY name) s),
+	` + contributorsJSON
+
+func scanBookRow(rows interface{ Scan(...interface{}) error }) (bookRow, error) {
+	var b bookRow
+	var ebook, size sql.NullInt64
+	var series, credits string
+	if err := rows.Scan(&b.ID, &ebook, &b.Title, &b.Author, &b.Language, &b.Chunks, &size, &b.MetadataStatus, &series, &credits); err != nil {
+		return b, err
+	}
+	b.Ebook = nullableInt(ebook)
+	if size.Valid {
+		b.Size = &size.Int64
+	}
+	b.Series = []seriesPlace{}
+	if ebook.Valid {
+		if err := json.Unmarshal([]byte(series), &b.Series); err != nil {
+			return b, err
+		}
+	}
+	var err error
+	b.Contributors, err = parseContributors(credits)
+	return b, err
+}
+
+// loadBookRow reads book id as listBooks would list it. It is
+// sql.ErrNoRows when there is no such book.
+func loadBookRow(db *sql.DB, id int) (bookRow, error) {
+	return scanBookRow(db.QueryRow(`SELECT `+bookColumns+` FROM files f `+bookCounts()+` WHERE f.id = ? AND f.deleted_at IS NULL`, id))
+}
+
+// listBooks returns the page of books q asks for and how many books its
+// filters match in all.
+func listBooks(db *sql.DB, q bookListQuery) ([]bookRow, int, error) {
+	by, ok := bookSorts[q.sort]
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown sort %q", q.sort)
+	}
+	if q.sort == "title" && q.ignoreArticles {
+		by = "f.title_sort"
+	}
+	// the count goes without the keys, a book without them yet counting
+	from := "FROM files f " + bookCounts()
+	keyed, keyArgs := from, []interface{}{}
+	if q.locale != "" && (q.sort == "title" || q.sort == "author") {
+		if err := fillSortKeys(db, q.locale); err != nil {
+			return nil, 0, fmt.Errorf("could not make the sort keys for %s: %w", q.locale, err)
+		}
+		keyed = "FROM sort_keys sk JOIN files f ON f.id = sk.file_id AND sk.locale = ? " + bookCounts()
+		keyArgs = append(keyArgs, q.locale)
+		by = "sk." + q.sort
+		if q.sort == "title" && q.ignoreArticles {
+			by = "sk.title_bare"
+		}
+	}
+	order := " ASC"
+	if q.desc {
+		order = " DESC"
+	}
+	limit := q.limit
+	if limit == 0 {
+		limit = -1
+	}
+	where, args := q.where()
+
+	var total int
+	if err := db.QueryRow("SELECT count(*) "+from+" WHERE "+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := db.Query(`SELECT `+bookColumns+`
+		`+keyed+` WHERE `+where+`
+		ORDER BY `+by+order+`, f.id`+order+` LIMIT ? OFFSET ?`, append(append(keyArgs, args...), limit, q.offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	books := []bookRow{}
+	for rows.Next() {
+		b, err := scanBookRow(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		books = append(books, b)
+	}
+	return books, total, rows.Err()
+}
+
+// widths of the title and author columns of books' table
+const (
+	bookTitleWidth  = 40
+	bookAuthorWidth = 24
+)
+
+// printBookTable prints books as a table, its columns lined up by runes
+// rather than bytes, with a column of their series when any has one.
+func printBookTable(books []bookRow) {
+	withSeries := false
+	for _, b := range books {
+		withSeries = withSeries || len(b.Series) > 0
+	}
+	last := "\n"
+	if withSeries {
+		last = "  series\n"
+	}
+	fmt.Printf("%6s %6s  %s  %s  %-8s %7s %8s"+last, "id", "ebook", padRunes("title", bookTitleWidth), padRunes("author", bookAuthorWidth), "language", "chunks", "size")
+	for _, b := range books {
+		ebook, size, lang := "-", "-", b.Language
+		if b.Ebook != nil {
+			ebook = fmt.Sprint(*b.Ebook)
+		}
+		if b.Size != nil {
+			size = formatSize(*b.Size)
+		}
+		if lang == "" {
+			lang = "-"
+		}
+		fmt.Printf("%6d %6s  %s  %s  %-8s %7d %8s", b.ID, ebook,
+			padRunes(clip(b.Title, bookTitleWidth-1), bookTitleWidth), padRunes(clip(b.Author, bookAuthorWidth-1), bookAuthorWidth),
+			lang, b.Chunks, size)
+		if withSeries && len(b.Series) > 0 {
+			fmt.Printf("  %s", b.Series[0])
+			if len(b.Series) > 1 {
+				fmt.Printf(" (and %d more)", len(b.Series)-1)
+			}
+		}
+		fmt.Println()
+	}
+}
+
+// padRunes pads s with spaces to n runes.
+func padRunes(s string, n int) string {
+	if k := utf8.RuneCountInString(s); k < n {
+		return s + strings.Repeat(" ", n-k)
+	}
+	return s
+}
@@ -0,0 +1,133 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// listedBooks seeds a library of five books, in three languages, three
+// of them chunked, one with a header missing its author.
+func listedBooks(t *testing.T) *sql.DB {
+	t.Helper()
+	db := testDB(t)
+	for _, b := range []struct {
+		title, author, lang, status, content string
+		chunks                               int
+	}{
+		{"Emma", "Jane Austen", "en", metadataOK, testParagraphs(1), 3},
+		{"Persuasion", "Jane Austen", "en", metadataOK, testParagraphs(4), 0},
+		{"Les Misérables, tome Ier, Fantine, l'évêque, la chute et la rédemption", "Victor Hugo", "fr", metadataOK, testParagraphs(2), 2},
+		{"Notre-Dame de Paris", "Victor Hugo", "fr", metadataNoAuthor, testParagraphs(3), 0},
+		{"Le Tour du monde en quatre-vingts jours", "Jules Verne", "fr,en", metadataOK, testParagraphs(5), 1},
+	} {
+		id := addBook(t, db, b.title, b.author, b.content)
+		if _, err := db.Exec("UPDATE files SET language = ?, metadata_status = ? WHERE id = ?", b.lang, b.status, id); err != nil {
+			t.Fatal(err)
+		}
+		if err := saveNameWords(db, int64(id), normalizeAuthor(b.author), normalizeTitle(b.title)); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < b.chunks; i++ {
+			insertChunk(t, db, id, i, testParagraphs(1))
+		}
+	}
+	// chunks stored by hand are counted as by a tool gutchunk doesn't know
+	if _, err := recountChunks(context.Background(), db, false); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestListBooks(t *testing.T) {
+	db := listedBooks(t)
+	for _, c := range []struct {
+		q     bookListQuery
+		want  string
+		total int
+	}{
+		{bookListQuery{sort: "id"}, "1 2 3 4 5", 5},
+		{bookListQuery{sort: "title"}, "1 5 3 4 2", 5},
+		{bookListQuery{sort: "author", desc: true}, "4 3 5 2 1", 5},
+		{bookListQuery{sort: "chunks", desc: true}, "1 3 5 4 2", 5},
+		{bookListQuery{sort: "size"}, "1 3 4 2 5", 5},
+		{bookListQuery{sort: "id", limit: 2, offset: 1}, "2 3", 5},
+		{bookListQuery{sort: "id", offset: 9}, "", 5},
+		// the filters compose
+		{bookListQuery{sort: "id", names: parseNameQuery("austen", "")}, "1 2", 2},
+		{bookListQuery{sort: "id", language: "en"}, "1 2 5", 3},
+		{bookListQuery{sort: "id", language: "fr", noChunks: true}, "4", 1},
+		{bookListQuery{sort: "id", names: parseNameQuery("hugo", ""), status: metadataNoAuthor}, "4", 1},
+		{bookListQuery{sort: "id", names: parseNameQuery("hugo", ""), language: "en"}, "", 0},
+		{bookListQuery{sort: "id", noChunks: true, limit: 1}, "2", 2},
+	} {
+		books, total, err := listBooks(db, c.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, b := range books {
+			ids = append(ids, strconv.Itoa(b.ID))
+		}
+		if strings.Join(ids, " ") != c.want || total != c.total {
+			t.Errorf("%+v listed %v of %d, want %q of %d", c.q, ids, total, c.want, c.total)
+		}
+	}
+	if _, _, err := listBooks(db, bookListQuery{sort: "pages"}); err == nil {
+		t.Error("listing books by pages worked")
+	}
+}
+
+func TestBooksTable(t *testing.T) {
+	listedBooks(t)
+	out, err := captureStdout(t, func() error { return booksCmd([]string{"--sort", "title"}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	if len(lines) != 7 || lines[6] != "books 1 to 5 of 5" {
+		t.Fatalf("books printed\n%s", out)
+	}
+	// every column starts on the same rune of every line
+	at := utf8.RuneCountInString(lines[0][:strings.Index(lines[0], "author")])
+	for _, line := range lines[1:6] {
+		if !utf8.ValidString(line) {
+			t.Errorf("%q isn't utf-8", line)
+		}
+		if n := len([]rune(line)); n != len([]rune(lines[0])) {
+			t.Errorf("%q is %d runes, its header %d", line, n, len([]rune(lines[0])))
+		}
+		if rs := []rune(line); string(rs[at-2:at]) != "  " || rs[at] == ' ' {
+			t.Errorf("the author of %q isn't in its column", line)
+		}
+	}
+	if !strings.Contains(lines[3], "Les Misérables, tome Ier, Fantine, l'év…") || !strings.Contains(lines[3], "fr") ||
+		!strings.Contains(lines[3], "      2 ") {
+		t.Errorf("the long title's line is %q", lines[3])
+	}
+
+	out, err = captureStdout(t, func() error {
+		return booksCmd([]string{"--json", "--author", "hugo", "--no-chunks", "--metadata-status", metadataNoAuthor})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var books []bookRow
+	if err = json.Unmarshal([]byte(out), &books); err != nil || len(books) != 1 || books[0].Title != "Notre-Dame de Paris" ||
+		books[0].Chunks != 0 || books[0].Size == nil || books[0].Language != "fr" {
+		t.Errorf("books --json gave %s", out)
+	}
+
+	for _, args := range [][]string{{"--sort", "pages"}, {"--limit", "-1"}, {"--metadata-status", "lost"}} {
+		if _, err = captureStdout(t, func() error { return booksCmd(args) }); exitCode(err) != exitUsage {
+			t.Errorf("books %s: %v, want a usage error", strings.Join(args, " "), err)
+		}
+	}
+	if _, err = captureStdout(t, func() error { return booksCmd([]string{"--language", "de"}) }); exitCode(err) != exitFailure {
+		t.Errorf("books finding none: %v, want exit status 1", err)
+	}
+}
@@ -0,0 +1,357 @@
+package cli
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+type upload struct {
+	Title  string `json:"title"`
+	Author string `json:"author"`
+	Text   string `json:"text"`
+}
+
+// handleBooks accepts either a json upload or a raw text body with the
+// metadata in X-Book-Title and X-Book-Author headers. Texts containing a
+// START marker go through the usual header stripping; anything else is
+// chunked from the first line. GET searches books instead, with the api
+// key as for the other reads of books.
+func (s *server) handleBooks(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		requireKey(s.apiKey, http.HandlerFunc(s.handleBookSearch)).ServeHTTP(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !s.authorized(r) {
+		httpError(w, http.StatusUnauthorized, "missing or wrong token")
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, s.maxBody+1))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if int64(len(body)) > s.maxBody {
+		httpError(w, http.StatusRequestEntityTooLarge, "upload larger than "+formatSize(s.maxBody))
+		return
+	}
+
+	var u upload
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct == "application/json" {
+		if err = json.Unmarshal(body, &u); err != nil {
+			httpError(w, http.StatusBadRequest, "bad json: "+err.Error())
+			return
+		}
+	} else {
+		u = upload{
+			Title:  r.Header.Get("X-Book-Title"),
+			Author: r.Header.Get("X-Book-Author"),
+			Text:   string(body),
+		}
+	}
+	if strings.TrimSpace(u.Text) == "" {
+		httpError(w, http.StatusBadRequest, "no text")
+		return
+	}
+	if u.Title == "" || u.Author == "" {
+		title, author := extractNameAuthor(*bytes.NewBufferString(u.Text))
+		if u.Title == "" {
+			u.Title = title
+		}
+		if u.Author == "" {
+			u.Author = author
+		}
+	}
+	if u.Title == "" {
+		u.Title = "untitled"
+	}
+
+	if int64(len(u.Text)) <= s.asyncAbove {
+		id, n, err := s.storeUpload(u)
+		if err != nil {
+			uploadError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]int{"id": id, "chunks": n})
+		return
+	}
+
+	j, err := s.jobs.add("upload", u)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"job":        j,
+		"status_url": "/jobs/" + strconv.FormatInt(j, 10),
+	})
+}
+
+// uploadError answers an upload storeUpload failed to store: 409 when it
+// broke a uniqueness constraint, 503 with a Retry-After when the database
+// was too busy to take it, or a statement ran out of --db-timeout, so that
+// nobody goes looking for a duplicate that isn't there, and 500 otherwise.
+func uploadError(w http.ResponseWriter, err error) {
+	switch {
+	case isUnique(err):
+		httpError(w, http.StatusConflict, "the upload conflicts with what is stored: "+err.Error())
+	case isBusy(err) || timedOut(err):
+		w.Header().Set("Retry-After", "1")
+		httpError(w, http.StatusServiceUnavailable, "the database is busy; try again")
+	default:
+		httpError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// isUnique reports whether err is sqlite's for a row a UNIQUE or PRIMARY
+// KEY constraint already has.
+func isUnique(err error) bool {
+	var serr sqlite3.Error
+	return errors.As(err, &serr) && (serr.ExtendedCode == sqlite3.ErrConstraintUnique || serr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey)
+}
+
+func (s *server) storeUpload(u upload) (int, int, error) {
+	var id, n int
+	err := s.w.do(func(tx *sql.Tx) error {
+		header := rawHeader(u.Text)
+		// kept, so that chunking it again starts at the top as this does
+		bodyOnly := !hasStartMarker(u.Text)
+		res, err := tx.Exec("INSERT INTO files (name, author, content, author_norm, title_norm, header, content_hash, body_only) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			u.Title, u.Author, u.Text, normalizeAuthor(u.Author), normalizeTitle(u.Title), header, textHash(u.Text), bodyOnly)
+		if err != nil {
+			return err
+		}
+		last, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		id = int(last)
+		if err = saveNameWords(tx, last, normalizeAuthor(u.Author), normalizeTitle(u.Title)); err != nil {
+			return err
+		}
+		if err = saveHeaderContributors(tx, last, headerContributors(header)); err != nil {
+			return err
+		}
+		c := s.conf()
+		n, err = chunkBook(tx, id, chunkOptions{footer: c.footer, overrides: c.overrides})
+		return err
+	})
+	// the new chunks should be drawn as often as any other
+	if err == nil && s.reservoir != nil {
+		s.reservoir.invalidate()
+	}
+	return id, n, err
+}
+
+// fillBodyOnly marks the uploads stored before body_only was kept that had
+// no START marker, so they are chunked again as they were first: uploads
+// are the books with no filename.
+func fillBodyOnly(db *sql.DB) error {
+	rows, err := db.Query("SELECT id, " + contentCol("") + " FROM files WHERE filename IS NULL AND body_only IS NULL AND " + hasContent(""))
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		var content string
+		if err = rows.Scan(&id, &content); err != nil {
+			rows.Close()
+			return err
+		}
+		if !hasStartMarker(content) {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err = db.Exec("UPDATE files SET body_only = 1 WHERE id = ?", id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type bookChunk struct {
+	ID       int    `json:"id"`
+	StableID string `json:"stable_id,omitempty"`
+	Ordinal  *int   `json:"ordinal"`
+	Text     string `json:"text"`
+}
+
+type bookChunks struct {
+	ID     int         `json:"id"`
+	Title  string      `json:"title"`
+	Author string      `json:"author"`
+	Chunks []bookChunk `json:"chunks"`
+}
+
+// handleBook serves GET /books/{id}, GET /books/{id}/chunks and GET
+// /books/{id}/header.
+func (s *server) handleBook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/books/"), "/")
+	id, err := strconv.Atoi(parts[0])
+	if err != nil || len(parts) > 2 {
+		httpError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if len(parts) == 1 {
+		s.handleBookInfo(w, r, id)
+		return
+	}
+	switch parts[1] {
+	case "chunks":
+		s.handleBookChunks(w, r, id)
+	case "header":
+		s.handleBookHeader(w, id)
+	default:
+		httpError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// handleBookInfo serves a book as books --json lists it, with the books of
+// the library before and after it in each of its series.
+func (s *server) handleBookInfo(w http.ResponseWriter, r *http.Request, id int) {
+	var b bookRow
+	err := s.w.interactiveRead(func(db *sql.DB) (err error) {
+		if b, err = loadBookRow(db, id); err != nil {
+			return err
+		}
+		if b.Ebook != nil {
+			b.Series, err = bookSeries(db, *b.Ebook)
+		}
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		httpError(w, http.StatusNotFound, "no such book")
+		return
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	b.Title, b.Author = s.names(r, b.Title, b.Author)
+	for _, p := range b.Series {
+		for _, n := range []*seriesBook{p.Previous, p.Next} {
+			if n != nil {
+				n.Title, n.Author = s.names(r, n.Title, n.Author)
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, b)
+}
+
+// handleBookChunks serves a book's chunks in order.
+func (s *server) handleBookChunks(w http.ResponseWriter, r *http.Request, id int) {
+	p, err := s.parseTransform(r.URL.Query())
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	fields, err := s.parseFields(r.URL.Query())
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	bc, err := s.loadBookChunks(id, 0, -1)
+	if errors.Is(err, sql.ErrNoRows) {
+		httpError(w, http.StatusNotFound, "no such book")
+		return
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for i, c := range bc.Chunks {
+		bc.Chunks[i].Text = s.render(r, p.apply(c.Text))
+	}
+	bc.Title, bc.Author = s.names(r, bc.Title, bc.Author)
+	if !fields.custom() {
+		writeJSON(w, http.StatusOK, bc)
+		return
+	}
+
+	// the book's fields stay as they are; its chunks take the ones asked for
+	ids := make([]int, len(bc.Chunks))
+	for i, c := range bc.Chunks {
+		ids[i] = c.ID
+	}
+	var facts map[int]chunkFacts
+	err = s.w.interactiveRead(func(db *sql.DB) (err error) {
+		facts, err = loadChunkFacts(db, ids)
+		return err
+	})
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	res := struct {
+		ID     int           `json:"id"`
+		Title  string        `json:"title"`
+		Author string        `json:"author"`
+		Chunks []fieldRecord `json:"chunks"`
+	}{bc.ID, bc.Title, bc.Author, make([]fieldRecord, len(bc.Chunks))}
+	for i, c := range bc.Chunks {
+		f := facts[c.ID]
+		f.Text = c.Text
+		f.Title, f.Author = s.names(r, f.Title, f.Author)
+		if res.Chunks[i], err = fields.record(f, c); err != nil {
+			httpError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// loadBookChunks reads book id with limit of its chunks in order from
+// offset, all of them for a limit of -1, their text as stored. It is
+// sql.ErrNoRows when there is no such book.
+func (s *server) loadBookChunks(id, offset, limit int) (bookChunks, error) {
+	bc := bookChunks{ID: id, Chunks: []bookChunk{}}
+	err := s.w.interactiveRead(func(db *sql.DB) error {
+		err := db.QueryRow("SELECT coalesce(name, ''), coalesce(author, '') FROM files WHERE id = ? AND deleted_at IS NULL", id).Scan(&bc.Title, &bc.Author)
+		if err != nil {
+			return err
+		}
+		rows, err := db.Query("SELECT id, coalesce(stable_id, ''), ordinal, chunk FROM chunks WHERE sourceid = ? ORDER BY ordinal, id LIMIT ? OFFSET ?", id, limit, offset)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var c bookChunk
+			var ordinal sql.NullInt64
+			if err = rows.Scan(&c.ID, &c.StableID, &ordinal, &c.Text); err != nil {
+				return err
+			}
+			if ordinal.Valid {
+				o := int(ordinal.Int64)
+				c.Ordinal = &o
+			}
+			bc.Chunks = append(bc.Chunks, c)
+		}
+		return rows.Err()
+	})
+	return bc, err
+}
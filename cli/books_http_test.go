@@ -0,0 +1,221 @@
+package cli
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testServer is serve over db with token, no key and no reservoir.
+func testServer(t testing.TB, db *sql.DB) *server {
+	t.Helper()
+	s := &server{db: db, quick: db, w: writerOf(db), token: "tok", clientIP: remoteIP(0),
+		maxBody: 1 << 20, asyncAbove: 1 << 20}
+	s.jobs = newJobQueue(db, s.w, 10*time.Second, 3)
+	s.loadConfig = func() (*serveConfig, error) { return &serveConfig{}, nil }
+	c, err := s.readConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.config.Store(c)
+	return s
+}
+
+func postBook(h http.Handler, token, contentType, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/books", strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	r.Header.Set("Content-Type", contentType)
+	r.Header.Set("X-Book-Title", "Upload")
+	r.Header.Set("X-Book-Author", "Someone")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestUploadAuth(t *testing.T) {
+	h := testServer(t, testDB(t)).routes()
+	for _, token := range []string{"", "wrong"} {
+		if w := postBook(h, token, "text/plain", testParagraphs(3)); w.Code != http.StatusUnauthorized {
+			t.Errorf("token %q: %d, want 401", token, w.Code)
+		}
+	}
+}
+
+func TestUploadTooLarge(t *testing.T) {
+	s := testServer(t, testDB(t))
+	s.maxBody = 100
+	w := postBook(s.routes(), "tok", "text/plain", testParagraphs(3))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("%d, want 413", w.Code)
+	}
+}
+
+func TestUploadRoundTrip(t *testing.T) {
+	db := testDB(t)
+	h := testServer(t, db).routes()
+	body, _ := json.Marshal(upload{Title: "Round", Author: "Trip", Text: testBook("Round", testParagraphs(4))})
+	w := postBook(h, "tok", "application/json", string(body))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("%d %s", w.Code, w.Body)
+	}
+	var got struct{ ID, Chunks int }
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Chunks == 0 || chunkCount(t, db, got.ID) != got.Chunks {
+		t.Errorf("answered %d chunks, stored %d", got.Chunks, chunkCount(t, db, got.ID))
+	}
+	var chunk string
+	db.QueryRow("SELECT chunk FROM chunks WHERE sourceid = ? ORDER BY ordinal LIMIT 1", got.ID).Scan(&chunk)
+	if strings.Contains(chunk, "PROJECT GUTENBERG") || !strings.HasPrefix(chunk, "It was a paragraph") {
+		t.Errorf("the header was chunked: %q", chunk)
+	}
+}
+
+// An upload with no START marker is chunked from its first line, by the
+// upload and by everything chunking it again.
+func TestUploadBodyOnlyKept(t *testing.T) {
+	db := testDB(t)
+	h := testServer(t, db).routes()
+	w := postBook(h, "tok", "text/plain", testParagraphs(5))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("%d %s", w.Code, w.Body)
+	}
+	var got struct{ ID, Chunks int }
+	json.Unmarshal(w.Body.Bytes(), &got)
+	if got.Chunks == 0 {
+		t.Fatal("no chunks")
+	}
+	var bodyOnly int
+	db.QueryRow("SELECT body_only FROM files WHERE id = ?", got.ID).Scan(&bodyOnly)
+	if bodyOnly != 1 {
+		t.Errorf("body_only = %d, want 1", bodyOnly)
+	}
+
+	rep, err := auditChunks(db, 10, 0, chunkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Changed) != 0 {
+		t.Errorf("audit-chunks found the upload changed: %+v", rep.Changed)
+	}
+	if _, err := chunkHeld(writerOf(db), got.ID, chunkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := chunkCount(t, db, got.ID); n != got.Chunks {
+		t.Errorf("chunking again left %d chunks of %d", n, got.Chunks)
+	}
+}
+
+func TestUploadAsync(t *testing.T) {
+	db := testDB(t)
+	s := testServer(t, db)
+	s.asyncAbove = 10
+	go s.work(s.jobs)
+	h := s.routes()
+	w := postBook(h, "tok", "text/plain", testParagraphs(3))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("%d %s", w.Code, w.Body)
+	}
+	var queued struct {
+		StatusURL string `json:"status_url"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &queued)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", queued.StatusURL, nil))
+		var j job
+		json.Unmarshal(w.Body.Bytes(), &j)
+		if j.Status == jobDone {
+			break
+		}
+		if j.Status == jobFailed || time.Now().After(deadline) {
+			t.Fatalf("job %s: %s", j.Status, w.Body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var n int
+	db.QueryRow("SELECT count(*) FROM chunks").Scan(&n)
+	if n == 0 {
+		t.Error("the job stored no chunks")
+	}
+}
+
+func TestFillBodyOnly(t *testing.T) {
+	db := testDB(t)
+	bare, _ := db.Exec("INSERT INTO files (name, content) VALUES ('bare', ?)", testParagraphs(2))
+	marked, _ := db.Exec("INSERT INTO files (name, content) VALUES ('marked', ?)", testBook("Marked", testParagraphs(2)))
+	ingested := addBook(t, db, "ingested", "Someone", testParagraphs(2))
+	if err := fillBodyOnly(db); err != nil {
+		t.Fatal(err)
+	}
+	bareID, _ := bare.LastInsertId()
+	markedID, _ := marked.LastInsertId()
+	for id, want := range map[int64]bool{bareID: true, markedID: false, int64(ingested): false} {
+		var got bool
+		db.QueryRow("SELECT coalesce(body_only, 0) FROM files WHERE id = ?", id).Scan(&got)
+		if got != want {
+			t.Errorf("book %d: body_only %v, want %v", id, got, want)
+		}
+	}
+}
+
+// An upload breaking a uniqueness constraint is a conflict, and one the
+// database is too busy to take isn't.
+func TestUploadConflict(t *testing.T) {
+	db := testDB(t)
+	if _, err := db.Exec("CREATE UNIQUE INDEX files_content_hash_once ON files(content_hash)"); err != nil {
+		t.Fatal(err)
+	}
+	h := testServer(t, db).routes()
+	text := testParagraphs(3)
+	if w := postBook(h, "tok", "text/plain", text); w.Code != http.StatusCreated {
+		t.Fatalf("first upload: %d %s", w.Code, w.Body)
+	}
+	if w := postBook(h, "tok", "text/plain", text); w.Code != http.StatusConflict {
+		t.Errorf("the same text again: %d %s, want 409", w.Code, w.Body)
+	}
+}
+
+func TestUploadBusy(t *testing.T) {
+	// the schema is made without the timeout, which a loaded machine can
+	// take longer than, and the database opened again with it
+	testFileDB(t).Close()
+	was := *dbTimeout
+	*dbTimeout = 50 * time.Millisecond
+	defer func() { *dbTimeout = was }()
+	db, err := openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	h := testServer(t, db).routes()
+
+	// another process holding the write lock
+	other, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	other.SetMaxOpenConns(1)
+	if _, err = other.Exec("BEGIN IMMEDIATE"); err != nil {
+		t.Fatal(err)
+	}
+	w := postBook(h, "tok", "text/plain", testParagraphs(3))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("upload while the database is locked: %d %s, want 503 with a Retry-After", w.Code, w.Body)
+	}
+	if _, err = other.Exec("ROLLBACK"); err != nil {
+		t.Fatal(err)
+	}
+	if w = postBook(h, "tok", "text/plain", testParagraphs(3)); w.Code != http.StatusCreated {
+		t.Errorf("upload once it was let go: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,280 @@
+package cli
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Finding a book's id by its title or author: "pride prejudice" finds
+// every book with words starting "pride" and "prejudice" in its folded
+// title or author, through name_words as --title and --author do. A title
+// that is the query itself comes first, then books with every word of the
+// query whole, then the rest, shortest title first within each. Titles in
+// Cyrillic or Greek are found by their transliteration as well (see
+// translit.go).
+
+const (
+	matchExact  = "exact"
+	matchWords  = "words"
+	matchPrefix = "prefix"
+)
+
+type bookMatch struct {
+	ID      int    `json:"id"`
+	Title   string `json:"title"`
+	Author  string `json:"author"`
+	Chunks  int    `json:"chunks"`
+	Ebook   *int   `json:"ebook"`
+	Edition *int   `json:"edition"`
+	Match   string `json:"match"`
+
+	titleNorm string
+}
+
+func (m bookMatch) rank() int {
+	switch m.Match {
+	case matchExact:
+		return 0
+	case matchWords:
+		return 1
+	}
+	return 2
+}
+
+// searchBooks returns the books matching query, best first, at most limit
+// of them.
+func searchBooks(db *sql.DB, query string, limit int) ([]bookMatch, error) {
+	words := nameWords(fold(query))
+	if len(words) == 0 {
+		return []bookMatch{}, nil
+	}
+	where := "f.deleted_at IS NULL AND " + activeVersion
+	args := []interface{}{}
+	for _, w := range words {
+		where += " AND f.id IN (SELECT file_id FROM name_words WHERE field IN ('author', 'title') AND word >= ? AND word < ?)"
+		args = append(args, w, w+wordAfter)
+	}
+	rows, err := db.Query(`SELECT f.id, coalesce(f.name, ''), coalesce(f.author, ''), f.ebook, f.edition,
+			coalesce(f.title_norm, ''), coalesce(f.author_norm, ''), coalesce(f.title_translit, '')
+		FROM files f WHERE `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	res := []bookMatch{}
+	exact := normalizeTitle(query)
+	for rows.Next() {
+		var m bookMatch
+		var ebook, edition sql.NullInt64
+		var authorNorm, translitNorm string
+		if err = rows.Scan(&m.ID, &m.Title, &m.Author, &ebook, &edition, &m.titleNorm, &authorNorm, &translitNorm); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		m.Ebook, m.Edition = nullableInt(ebook), nullableInt(edition)
+		m.Match = matchPrefix
+		if m.titleNorm == exact || translitNorm == exact {
+			m.Match = matchExact
+		} else if allWhole(words, append(append(nameWords(m.titleNorm), nameWords(authorNorm)...), nameWords(translitNorm)...)) {
+			m.Match = matchWords
+		}
+		res = append(res, m)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		a, b := res[i], res[j]
+		if a.rank() != b.rank() {
+			return a.rank() < b.rank()
+		}
+		if len(a.titleNorm) != len(b.titleNorm) {
+			return len(a.titleNorm) < len(b.titleNorm)
+		}
+		return a.ID < b.ID
+	})
+	if limit > 0 && len(res) > limit {
+		res = res[:limit]
+	}
+	for i := range res {
+		if res[i].Chunks, err = countChunks(db, "%s WHERE sourceid = ?", res[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// allWhole reports whether each of words is one of have.
+func allWhole(words, have []string) bool {
+	set := map[string]bool{}
+	for _, w := range have {
+		set[w] = true
+	}
+	for _, w := range words {
+		if !set[w] {
+			return false
+		}
+	}
+	return true
+}
+
+func nullableInt(n sql.NullInt64) *int {
+	if !n.Valid {
+		return nil
+	}
+	i := int(n.Int64)
+	return &i
+}
+
+func booksCmd(args []string) error {
+	fs := flag.NewFlagSet("books", flag.ExitOnError)
+	search := fs.String("search", "", "words of the title or author to find books by, like \"pride prejudice\"")
+	limit := fs.Int("limit", 20, "most books to print (0 for all)")
+	asJSON := fs.Bool("json", false, "print the books as json")
+	smartCase := fs.Bool("smart-case", false, "print titles and authors in capitals in title case")
+	var q bookListQuery
+	fs.StringVar(&q.sort, "sort", "id", "without --search, list books by id, title, author, chunks or size")
+	fs.BoolVar(&q.desc, "desc", false, "without --search, list books in descending order")
+	fs.BoolVar(&q.ignoreArticles, "ignore-articles", false, "with --sort title, sort titles past a leading article, like The, A or La")
+	locale := fs.String("locale", "", "with --sort title or author, sort as this locale's collation does, like en, fr or sv, rather than by folded names")
+	fs.IntVar(&q.offset, "offset", 0, "without --search, skip this many books first")
+	author := fs.String("author", "", "without --search, only books by this author, by the starts of words of their name")
+	fs.StringVar(&q.language, "language", "", "without --search, only books in this language, by code (en) or name (English)")
+	fs.BoolVar(&q.undetermined, "include-undetermined", false, "with --language, also books with no language or und")
+	fs.BoolVar(&q.noChunks, "no-chunks", false, "without --search, only books never chunked")
+	fs.StringVar(&q.status, "metadata-status", "", "without --search, only books with this metadata status: "+strings.Join(metadataStatuses, ", "))
+	fs.Parse(args)
+
+	if *limit < 0 || q.offset < 0 {
+		return usagef("--limit and --offset can't be negative")
+	}
+	listing := false
+	fs.Visit(func(f *flag.Flag) {
+		listing = listing || f.Name != "search" && f.Name != "limit" && f.Name != "json" && f.Name != "smart-case"
+	})
+	if *search == "" {
+		if _, ok := bookSorts[q.sort]; !ok {
+			return usagef("unknown --sort %q; want id, title, author, chunks or size", q.sort)
+		}
+		if err := checkMetadataStatus(q.status); err != nil {
+			return err
+		}
+		if *locale != "" {
+			var err error
+			if q.locale, err = sortLocale(*locale); err != nil {
+				return usagef("--locale: %v", err)
+			}
+		}
+	} else if listing {
+		return usagef("--search finds books by their best match; --sort, --desc, --offset and the filters only go with listing them")
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if *search == "" {
+		q.limit = *limit
+		q.names = parseNameQuery(*author, "")
+		q.language = normalizeLanguages(q.language)
+		return printBookList(db, q, *asJSON, *smartCase)
+	}
+
+	books, err := searchBooks(db, *search, *limit)
+	if err != nil {
+		return err
+	}
+	if *smartCase {
+		for i, b := range books {
+			books[i].Title, books[i].Author = SmartCase(b.Title), SmartCase(b.Author)
+		}
+	}
+	if *asJSON {
+		if err = json.NewEncoder(os.Stdout).Encode(books); err != nil {
+			return err
+		}
+	} else {
+		for _, b := range books {
+			edition := ""
+			if b.Edition != nil {
+				edition = fmt.Sprintf(" (edition %d)", *b.Edition)
+			}
+			fmt.Printf("%6d  %s / %s%s, %d chunks\n", b.ID, b.Title, b.Author, edition, b.Chunks)
+		}
+	}
+	// like grep, finding nothing is exit status 1
+	if len(books) == 0 {
+		if !*asJSON {
+			fmt.Fprintln(os.Stderr, "no books match")
+		}
+		return exitStatus(1)
+	}
+	return nil
+}
+
+func printBookList(db *sql.DB, q bookListQuery, asJSON, smartCase bool) error {
+	books, total, err := listBooks(db, q)
+	if err != nil {
+		return err
+	}
+	if smartCase {
+		for i, b := range books {
+			books[i].Title, books[i].Author = SmartCase(b.Title), SmartCase(b.Author)
+		}
+	}
+	if asJSON {
+		if err = json.NewEncoder(os.Stdout).Encode(books); err != nil {
+			return err
+		}
+	} else if len(books) > 0 {
+		printBookTable(books)
+		fmt.Printf("books %d to %d of %d\n", q.offset+1, q.offset+len(books), total)
+	}
+	if len(books) == 0 {
+		if !asJSON && total > 0 {
+			fmt.Fprintf(os.Stderr, "no books past %d; %d match\n", q.offset, total)
+		} else if !asJSON {
+			fmt.Fprintln(os.Stderr, "no books match")
+		}
+		return exitStatus(1)
+	}
+	return nil
+}
+
+// handleBookSearch serves GET /books?q=, the books searchBooks finds for
+// q, up to limit (default 20, at most 100).
+func (s *server) handleBookSearch(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("q") == "" {
+		httpError(w, http.StatusBadRequest, "q is required")
+		return
+	}
+	limit := 20
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			httpError(w, http.StatusBadRequest, "limit must be a number from 1 to 100")
+			return
+		}
+		limit = n
+	}
+	books, err := searchBooks(s.db, q.Get("q"), limit)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for i, b := range books {
+		books[i].Title, books[i].Author = s.names(r, b.Title, b.Author)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"books": books})
+}
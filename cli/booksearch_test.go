@@ -0,0 +1,79 @@
+package cli
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSearchBooks(t *testing.T) {
+	db := testDB(t)
+	for _, b := range [][2]string{
+		{"Prides and Prejudices", "Anonymous"},
+		{"Pride and Prejudice and Zombies", "Seth Grahame-Smith"},
+		{"Pride and Prejudice", "Jane Austen"},
+		{"Emma", "Jane Austen"},
+		{"Jane Eyre", "Charlotte Brontë"},
+		{"Wuthering Heights", "Emily Bronte"},
+	} {
+		id := addBook(t, db, b[0], b[1], "")
+		if err := saveNameWords(db, int64(id), normalizeAuthor(b[1]), normalizeTitle(b[0])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []struct{ query, want string }{
+		// the title itself first, then every word whole, then the rest
+		{"pride and prejudice", "Pride and Prejudice:exact Pride and Prejudice and Zombies:words Prides and Prejudices:prefix"},
+		{"PREJUDICE pride", "Pride and Prejudice:words Pride and Prejudice and Zombies:words Prides and Prejudices:prefix"},
+		{"jane", "Emma:words Jane Eyre:words Pride and Prejudice:words"},
+		{"brontë", "Jane Eyre:words Wuthering Heights:words"},
+		{"BRONTE eyre", "Jane Eyre:words"},
+		{"pride emma", ""},
+		{"  ", ""},
+	} {
+		matches, err := searchBooks(db, c.query, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, m := range matches {
+			got = append(got, m.Title+":"+m.Match)
+		}
+		if strings.Join(got, " ") != c.want {
+			t.Errorf("searching for %q found %q, want %q", c.query, got, c.want)
+		}
+	}
+	if matches, _ := searchBooks(db, "pride", 1); len(matches) != 1 || matches[0].Title != "Pride and Prejudice" {
+		t.Errorf("the best book for pride is %+v", matches)
+	}
+}
+
+func TestBooksSearchEmpty(t *testing.T) {
+	db := testDB(t)
+	addBook(t, db, "Emma", "Jane Austen", "")
+
+	out, err := captureStdout(t, func() error { return booksCmd([]string{"--search", "nonesuch", "--json"}) })
+	if exitCode(err) != exitFailure || strings.TrimSpace(out) != "[]" {
+		t.Errorf("books --search finding nothing: %q, %v, want [] and exit status 1", out, err)
+	}
+	if _, err = captureStdout(t, func() error { return booksCmd([]string{"--search", "emma", "--sort", "title"}) }); exitCode(err) != exitUsage {
+		t.Errorf("--search with --sort: %v, want a usage error", err)
+	}
+
+	s := testServer(t, db)
+	for query, want := range map[string]int{"q=nonesuch": http.StatusOK, "q=emma&limit=0": http.StatusBadRequest, "": http.StatusBadRequest} {
+		w := httptest.NewRecorder()
+		s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/books?"+query, nil))
+		if w.Code != want {
+			t.Errorf("GET /books?%s: %d %s, want %d", query, w.Code, w.Body, want)
+		}
+	}
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/books?q=nonesuch", nil))
+	var page struct{ Books []bookMatch }
+	if err = json.Unmarshal(w.Body.Bytes(), &page); err != nil || page.Books == nil || len(page.Books) != 0 {
+		t.Errorf("GET /books?q=nonesuch gave %s, want an empty list of books", w.Body)
+	}
+}
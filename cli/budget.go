@@ -0,0 +1,54 @@
+package cli
+
+import "sync"
+
+// memBudget is a weighted semaphore over bytes of book content held in
+// memory by chunk workers. Each worker acquires a book's size before loading
+// it and releases it when done.
+type memBudget struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	max  int64
+	used int64
+	peak int64
+}
+
+// newMemBudget returns a budget of max bytes. With max 0 nothing ever
+// blocks, but the peak is still tracked.
+func newMemBudget(max int64) *memBudget {
+	b := &memBudget{max: max}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire blocks until n bytes are available and returns the amount taken,
+// to be passed to release. A request larger than the whole budget waits for
+// the budget to drain and then takes all of it, so such a book is processed
+// alone instead of deadlocking.
+func (b *memBudget) acquire(n int64) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	take := n
+	if b.max > 0 {
+		if take > b.max {
+			take = b.max
+		}
+		for b.used+take > b.max {
+			b.cond.Wait()
+		}
+	}
+	b.used += take
+	// record what is really resident, including an oversized book
+	if b.used-take+n > b.peak {
+		b.peak = b.used - take + n
+	}
+	return take
+}
+
+func (b *memBudget) release(n int64) {
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
@@ -0,0 +1,105 @@
+package cli
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemBudgetSmallInParallel(t *testing.T) {
+	b := newMemBudget(100)
+	// four books of 10 bytes are all held at once, each waiting on the
+	// others before it lets go
+	var all sync.WaitGroup
+	all.Add(4)
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		go func() {
+			held := b.acquire(10)
+			all.Done()
+			all.Wait()
+			b.release(held)
+			done <- struct{}{}
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("small books under the budget weren't held together")
+		}
+	}
+	if b.peak != 40 {
+		t.Errorf("peak %d, want 40", b.peak)
+	}
+}
+
+func TestMemBudgetLargeAlone(t *testing.T) {
+	b := newMemBudget(100)
+	small := b.acquire(10)
+
+	// a book over the whole budget waits for it to drain
+	big := make(chan int64)
+	go func() { big <- b.acquire(500) }()
+	select {
+	case <-big:
+		t.Fatal("a book over the budget was taken while another was held")
+	case <-time.After(50 * time.Millisecond):
+	}
+	b.release(small)
+	var held int64
+	select {
+	case held = <-big:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a book over the budget never got it, the budget drained")
+	}
+	if held != 100 {
+		t.Errorf("the book over the budget took %d, want all 100", held)
+	}
+
+	// and nothing more is taken until it is done
+	next := make(chan int64)
+	go func() { next <- b.acquire(10) }()
+	select {
+	case <-next:
+		t.Fatal("a small book was taken alongside the one over the budget")
+	case <-time.After(50 * time.Millisecond):
+	}
+	b.release(held)
+	select {
+	case n := <-next:
+		b.release(n)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the small book never got the budget back")
+	}
+	if b.peak != 500 {
+		t.Errorf("peak %d, want the 500 the big book really held", b.peak)
+	}
+}
+
+func TestMemBudgetUnlimited(t *testing.T) {
+	b := newMemBudget(0)
+	a, c := b.acquire(1<<40), b.acquire(1<<40)
+	b.release(a)
+	b.release(c)
+	if b.peak != 2<<40 {
+		t.Errorf("peak %d, want %d", b.peak, int64(2<<40))
+	}
+}
+
+func TestChunkWithinBudget(t *testing.T) {
+	db := testDB(t)
+	var ids []int
+	for _, n := range []int{40, 40, 2, 2, 2} {
+		ids = append(ids, addBook(t, db, "Book", "Someone", testBook("Book", testParagraphs(n))))
+	}
+	// smaller than the big books and bigger than the small ones
+	if err := makeChunks(db, chunkOptions{workers: 4, maxMemory: 4 << 10}); err != nil {
+		t.Fatal(err)
+	}
+	for i, n := range []int{40, 40, 2, 2, 2} {
+		if got := chunkCount(t, db, ids[i]); got != n {
+			t.Errorf("book %d has %d chunks, want %d", ids[i], got, n)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+)
+
+func catCmd(args []string) error {
+	fs := flag.NewFlagSet("cat", flag.ExitOnError)
+	work := fs.Int("work", 0, "print every volume of this work in volume order")
+	width := fs.Int("width", 72, "wrap prose to this many columns (0 for none)")
+	spec := fs.String("transform", "", transformUsage)
+	strategy := fs.String("strategy", "", "print the chunks this strategy of chunk --strategy a,b cut, other than the first")
+	fs.Parse(args)
+
+	p, err := parsePipeline(*spec, nil)
+	if err != nil {
+		return err
+	}
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	q := "SELECT c.chunk FROM chunks c JOIN files f ON f.id = c.sourceid "
+	if *strategy != "" {
+		q = "SELECT c.chunk FROM strategy_chunks c JOIN files f ON f.id = c.sourceid AND c.strategy = ? "
+	}
+	var arg int
+	switch {
+	case *work != 0:
+		q += "WHERE f.work_id = ? ORDER BY f.volume, c.ordinal, c.id"
+		arg = *work
+	case fs.NArg() == 1:
+		if arg, err = strconv.Atoi(fs.Arg(0)); err != nil {
+			return usagef("bad file id %q", fs.Arg(0))
+		}
+		q += "WHERE c.sourceid = ? ORDER BY c.ordinal, c.id"
+	default:
+		return usagef("usage: gutchunk cat <fileid> | --work <id>")
+	}
+
+	params := []interface{}{arg}
+	if *strategy != "" {
+		params = []interface{}{*strategy, arg}
+	}
+	rows, err := db.Query(q, params...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		var chunk string
+		if err = rows.Scan(&chunk); err != nil {
+			return err
+		}
+		if n > 0 {
+			fmt.Println()
+		}
+		fmt.Println(RenderChunk(p.apply(chunk), *width, StyleText))
+		n++
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNoChunks
+	}
+
+	return nil
+}
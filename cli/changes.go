@@ -0,0 +1,345 @@
+package cli
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A copy of the chunks kept elsewhere can be brought up to date from what
+// changed since it was made, rather than by exporting everything again.
+// Chunking a book replaces whatever chunks it had, and every time a book's
+// chunks are written or taken away chunk_log records it, with the run doing
+// it and the run whose chunks went. gutchunk changes --since-run 42, or
+// --since 2024-06-01, goes through what was logged since and gives each book
+// touched its net change: new, when it had no chunks before and has now;
+// replaced, from one run's chunks to another's; or gone, removed,
+// superseded, pruned or rolled back. A book chunked twice since is replaced
+// once, from what it had before to what it has now, and one chunked and
+// removed since isn't there at all. GET /changes?since_run=42 serves the
+// same.
+
+// events of chunk_log
+const (
+	eventChunked    = "chunked"
+	eventRemoved    = "removed"
+	eventSuperseded = "superseded"
+	eventPruned     = "pruned"
+	eventRolledBack = "rolled_back"
+)
+
+// logChunks records event for the books the subquery books selects, with
+// written the chunks it wrote each, and keeps their chunk counts. It is to
+// run before the chunks it takes away go, counting them and looking up the
+// run that wrote them.
+func logChunks(tx execer, event string, written int, books string, args ...interface{}) error {
+	_, err := tx.Exec(`INSERT INTO chunk_log (file_id, run_id, event, chunks, replaced, replaced_run, created_at)
+		SELECT f.id, ?, ?, ?, (SELECT count(*) FROM chunks c WHERE c.sourceid = f.id),
+			(SELECT l.run_id FROM chunk_log l WHERE l.file_id = f.id AND l.event = 'chunked' ORDER BY l.id DESC LIMIT 1),
+			datetime('now')
+		FROM files f WHERE f.id IN (`+books+`)`, append([]interface{}{nullInt64(currentRun), event, written}, args...)...)
+	if err != nil {
+		return err
+	}
+	return keepCounts(tx, event, written, books, args...)
+}
+
+// replaceChunks logs that book id is being chunked into written chunks and
+// takes away those it has. Flags on them keep their hashes and follow the
+// text onto the new ones, as for rm, but for those of the chunks of kept,
+// a json list of ids, which are written again as they were (see
+// rechunk.go).
+func replaceChunks(tx *sql.Tx, id, written int, kept string) error {
+	if err := logChunks(tx, eventChunked, written, "?", id); err != nil {
+		return err
+	}
+	gone := "(SELECT id FROM chunks WHERE sourceid = ? AND id NOT IN (SELECT value FROM json_each(?)))"
+	for _, q := range []string{
+		"UPDATE chunk_flags SET chunk_id = NULL WHERE chunk_id IN " + gone,
+		"DELETE FROM content_flags WHERE chunk_id IN " + gone,
+		"DELETE FROM content_scans WHERE chunk_id IN " + gone,
+	} {
+		if _, err := tx.Exec(q, id, kept); err != nil {
+			return err
+		}
+	}
+	for _, q := range []string{
+		"DELETE FROM chunks WHERE sourceid = ?",
+		"DELETE FROM footnotes WHERE sourceid = ?",
+		"DELETE FROM strategy_chunks WHERE sourceid = ?",
+	} {
+		if _, err := tx.Exec(q, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// changeSince is where changes start from: after run, or at time.
+type changeSince struct {
+	run  int64
+	time string
+}
+
+func (s changeSince) String() string {
+	if s.time != "" {
+		return "since " + s.time
+	}
+	return fmt.Sprintf("since run %d", s.run)
+}
+
+// parseSince parses a date, or a date and time in UTC as sqlite gives
+// them, into the form chunk_log keeps them in.
+func parseSince(s string) (string, error) {
+	for _, layout := range []string{"2006-01-02", "2006-01-02 15:04:05", "2006-01-02T15:04:05", time.RFC3339} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC().Format("2006-01-02 15:04:05"), nil
+		}
+	}
+	return "", fmt.Errorf("bad date %q; give it as 2006-01-02 or 2006-01-02 15:04:05, in UTC", s)
+}
+
+// bookChange is the net change to one book's chunks.
+type bookChange struct {
+	Book int64 `json:"book"`
+	// for books gone, what took them
+	Event string `json:"event,omitempty"`
+	// the run that wrote the book's chunks now, or took them away, and how
+	// many there are now
+	Run    *int64 `json:"run"`
+	Chunks int    `json:"chunks"`
+	// the run that wrote the chunks there were before, when known, and how
+	// many
+	OldRun    *int64 `json:"old_run"`
+	OldChunks int    `json:"old_chunks"`
+}
+
+type changeSet struct {
+	SinceRun *int64 `json:"since_run,omitempty"`
+	Since    string `json:"since,omitempty"`
+	// the latest run, to ask for changes since next time
+	Run      int64        `json:"run"`
+	New      []bookChange `json:"new"`
+	Replaced []bookChange `json:"replaced"`
+	Gone     []bookChange `json:"gone"`
+}
+
+// books are the books whose chunks are new or replaced, for exporting.
+func (cs changeSet) books() []int64 {
+	ids := []int64{}
+	for _, c := range append(append([]bookChange{}, cs.New...), cs.Replaced...) {
+		ids = append(ids, c.Book)
+	}
+	return ids
+}
+
+func (cs changeSet) chunks() int {
+	n := 0
+	for _, c := range append(append([]bookChange{}, cs.New...), cs.Replaced...) {
+		n += c.Chunks
+	}
+	return n
+}
+
+// findChanges works out the net change to each book chunk_log has logged
+// anything for since.
+func findChanges(db *sql.DB, since changeSince) (changeSet, error) {
+	cs := changeSet{New: []bookChange{}, Replaced: []bookChange{}, Gone: []bookChange{}}
+	if since.time != "" {
+		cs.Since = since.time
+	} else {
+		cs.SinceRun = &since.run
+	}
+	if err := db.QueryRow("SELECT coalesce(max(id), 0) FROM runs").Scan(&cs.Run); err != nil {
+		return cs, err
+	}
+
+	rows, err := db.Query(`SELECT l.file_id, l.run_id, l.event, l.chunks, l.replaced, l.replaced_run, f.id IS NOT NULL
+		FROM chunk_log l LEFT JOIN files f ON f.id = l.file_id
+		WHERE (? = '' AND l.run_id > ?) OR (? != '' AND l.created_at >= ?)
+		ORDER BY l.id`, since.time, since.run, since.time, since.time)
+	if err != nil {
+		return cs, err
+	}
+	defer rows.Close()
+	type span struct {
+		first, last bookChange
+		exists      bool
+	}
+	var order []int64
+	books := map[int64]*span{}
+	for rows.Next() {
+		var c bookChange
+		var run, oldRun sql.NullInt64
+		var exists bool
+		if err = rows.Scan(&c.Book, &run, &c.Event, &c.Chunks, &c.OldChunks, &oldRun, &exists); err != nil {
+			return cs, err
+		}
+		c.Run, c.OldRun = nullableInt64(run), nullableInt64(oldRun)
+		s, ok := books[c.Book]
+		if !ok {
+			s = &span{first: c}
+			books[c.Book] = s
+			order = append(order, c.Book)
+		}
+		s.last, s.exists = c, exists
+	}
+	if err = rows.Err(); err != nil {
+		return cs, err
+	}
+
+	for _, id := range order {
+		s := books[id]
+		had := s.first.OldChunks > 0
+		now := s.last.Event == eventChunked && s.last.Chunks > 0 && s.exists
+		c := bookChange{Book: id, Run: s.last.Run, OldRun: s.first.OldRun, OldChunks: s.first.OldChunks}
+		switch {
+		case had && now:
+			c.Chunks = s.last.Chunks
+			cs.Replaced = append(cs.Replaced, c)
+		case now:
+			c.Chunks, c.OldRun = s.last.Chunks, nil
+			cs.New = append(cs.New, c)
+		case had:
+			c.Event = s.last.Event
+			cs.Gone = append(cs.Gone, c)
+		}
+	}
+	return cs, nil
+}
+
+func nullableInt64(n sql.NullInt64) *int64 {
+	if !n.Valid {
+		return nil
+	}
+	return &n.Int64
+}
+
+// runName is a run as changes prints it.
+func runName(run *int64) string {
+	if run == nil {
+		return "an unknown run"
+	}
+	return fmt.Sprintf("run %d", *run)
+}
+
+func printChanges(cs changeSet, since changeSince) {
+	for _, c := range cs.New {
+		fmt.Printf("%-11s book %d: %d chunks from %s\n", "new", c.Book, c.Chunks, runName(c.Run))
+	}
+	for _, c := range cs.Replaced {
+		fmt.Printf("%-11s book %d: %d chunks from %s by %d from %s\n", "replaced", c.Book, c.OldChunks, runName(c.OldRun), c.Chunks, runName(c.Run))
+	}
+	for _, c := range cs.Gone {
+		fmt.Printf("%-11s book %d: %d chunks from %s, by %s\n", strings.ReplaceAll(c.Event, "_", " "), c.Book, c.OldChunks, runName(c.OldRun), runName(c.Run))
+	}
+	fmt.Printf("%s: %d books new, %d replaced and %d gone, with %d chunks to take; next time, --since-run %d\n",
+		since, len(cs.New), len(cs.Replaced), len(cs.Gone), cs.chunks(), cs.Run)
+}
+
+func changesCmd(args []string) error {
+	fs := flag.NewFlagSet("changes", flag.ExitOnError)
+	sinceRun := fs.Int64("since-run", -1, "what changed after this run, by its id (see gutchunk warnings --run)")
+	sinceDate := fs.String("since", "", "what changed since this date, or date and time, in UTC")
+	asJSON := fs.Bool("json", false, "print the changes as json")
+	export := fs.String("export", "", "instead, write the chunks of the books new and replaced as export does: jsonl")
+	fields := fieldsFlags(fs)
+	fs.Parse(args)
+
+	var since changeSince
+	switch {
+	case (*sinceRun >= 0) == (*sinceDate != ""):
+		return usagef("give one of --since-run and --since")
+	case *sinceDate != "":
+		t, err := parseSince(*sinceDate)
+		if err != nil {
+			return usageError{err.Error()}
+		}
+		since.time = t
+	default:
+		since.run = *sinceRun
+	}
+	if *export != "" && *export != "jsonl" {
+		return usagef("--export only writes jsonl")
+	}
+	if *export != "" && *asJSON {
+		return usagef("--export and --json don't go together")
+	}
+	var opts exportOptions
+	var err error
+	if opts.fields, err = fields(); err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	cs, err := findChanges(db, since)
+	if err != nil {
+		return err
+	}
+	switch {
+	case *export != "":
+		opts.books = cs.books()
+		bw := bufio.NewWriter(os.Stdout)
+		defer bw.Flush()
+		return exportChunks(db, bw, opts)
+	case *asJSON:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(cs)
+	}
+	printChanges(cs, since)
+	return nil
+}
+
+// parseChangeSince reads since_run or since from a query.
+func parseChangeSince(q url.Values) (changeSince, error) {
+	run, date := q.Get("since_run"), q.Get("since")
+	if (run == "") == (date == "") {
+		return changeSince{}, errors.New("give one of since_run and since")
+	}
+	if date != "" {
+		t, err := parseSince(date)
+		return changeSince{time: t}, err
+	}
+	n, err := strconv.ParseInt(run, 10, 64)
+	if err != nil || n < 0 {
+		return changeSince{}, fmt.Errorf("bad since_run %q", run)
+	}
+	return changeSince{run: n}, nil
+}
+
+// handleChanges serves GET /changes?since_run=42, or ?since=2024-06-01:
+// the books new, replaced and gone since, as gutchunk changes --json gives
+// them. The chunks of the books new and replaced are at
+// /books/{id}/chunks.
+func (s *server) handleChanges(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	since, err := parseChangeSince(r.URL.Query())
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	cs, err := findChanges(s.db, since)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, cs)
+}
@@ -0,0 +1,124 @@
+package cli
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestChanges(t *testing.T) {
+	db := testDB(t)
+	root := t.TempDir()
+	for i, title := range []string{"Emma", "Persuasion", "Villette"} {
+		dir := string(rune('1' + i))
+		writeTestZip(t, filepath.Join(root, dir, dir+dir+".zip"), zipEntry{dir + dir + ".txt", testBook(title, testParagraphs(2+i))})
+	}
+	run := func(cmd func([]string) error, args ...string) string {
+		t.Helper()
+		out, err := captureStdout(t, func() error { return cmd(args) })
+		if err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+		return out
+	}
+	changes := func(args ...string) changeSet {
+		t.Helper()
+		var cs changeSet
+		if err := json.Unmarshal([]byte(run(changesCmd, append(args, "--json")...)), &cs); err != nil {
+			t.Fatal(err)
+		}
+		return cs
+	}
+	check := func(what string, cs changeSet, want string) {
+		t.Helper()
+		got, err := json.Marshal(struct{ New, Replaced, Gone []bookChange }{cs.New, cs.Replaced, cs.Gone})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s, the changes are\n%s\nwant\n%s", what, got, want)
+		}
+	}
+
+	// runs 1 and 2
+	run(ingestCmd, "--target", root)
+	run(chunkCmd)
+	check("chunked", changes("--since-run", "0"),
+		`{"New":[{"book":1,"run":2,"chunks":2,"old_run":null,"old_chunks":0},{"book":2,"run":2,"chunks":3,"old_run":null,"old_chunks":0},{"book":3,"run":2,"chunks":4,"old_run":null,"old_chunks":0}],"Replaced":[],"Gone":[]}`)
+
+	// run 3 chunks book 2 again, longer, and run 4 takes book 3 away
+	if _, err := db.Exec("UPDATE files SET content = ? WHERE id = 2", testBook("Persuasion", testParagraphs(5))); err != nil {
+		t.Fatal(err)
+	}
+	ids := filepath.Join(t.TempDir(), "ids")
+	if err := os.WriteFile(ids, []byte("2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	run(chunkCmd, "--paths-file", ids)
+	run(rmCmd, "3")
+
+	since2 := changes("--since-run", "2")
+	if since2.Run != 4 || since2.SinceRun == nil || *since2.SinceRun != 2 {
+		t.Errorf("the changes since run 2 are up to run %d, since %v", since2.Run, since2.SinceRun)
+	}
+	check("since run 2", since2,
+		`{"New":[],"Replaced":[{"book":2,"run":3,"chunks":5,"old_run":2,"old_chunks":3}],"Gone":[{"book":3,"event":"removed","run":4,"chunks":0,"old_run":2,"old_chunks":4}]}`)
+	// from the start, book 2 is new as it is now and book 3 was never
+	// there
+	want := `{"New":[{"book":1,"run":2,"chunks":2,"old_run":null,"old_chunks":0},{"book":2,"run":3,"chunks":5,"old_run":null,"old_chunks":0}],"Replaced":[],"Gone":[]}`
+	check("since run 0", changes("--since-run", "0"), want)
+	check("since 2000", changes("--since", "2000-01-01"), want)
+	check("since run 4", changes("--since-run", "4"), `{"New":[],"Replaced":[],"Gone":[]}`)
+
+	out := run(changesCmd, "--since-run", "2")
+	for _, line := range []string{
+		"replaced    book 2: 3 chunks from run 2 by 5 from run 3\n",
+		"removed     book 3: 4 chunks from run 2, by run 4\n",
+		"since run 2: 0 books new, 1 replaced and 1 gone, with 5 chunks to take; next time, --since-run 4\n",
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("changes printed\n%s\nwant %q", out, line)
+		}
+	}
+
+	// exported, the delta is the chunks of book 2 alone
+	lines := strings.Split(strings.TrimSuffix(run(changesCmd, "--since-run", "2", "--export", "jsonl"), "\n"), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("changes --export wrote %d lines", len(lines))
+	}
+	for _, line := range lines {
+		var c struct {
+			SourceID int `json:"sourceid"`
+		}
+		if err := json.Unmarshal([]byte(line), &c); err != nil || c.SourceID != 2 {
+			t.Errorf("changes --export wrote %s (%v)", line, err)
+		}
+	}
+
+	s := testServer(t, db)
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/changes?since_run=2", nil))
+	var served changeSet
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &served) != nil {
+		t.Fatalf("GET /changes: %d %s", w.Code, w.Body)
+	}
+	check("served since run 2", served,
+		`{"New":[],"Replaced":[{"book":2,"run":3,"chunks":5,"old_run":2,"old_chunks":3}],"Gone":[{"book":3,"event":"removed","run":4,"chunks":0,"old_run":2,"old_chunks":4}]}`)
+	for _, q := range []string{"", "since_run=-1", "since_run=2&since=2000-01-01", "since=yesterday"} {
+		w := httptest.NewRecorder()
+		s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/changes?"+q, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("GET /changes?%s: %d, want 400", q, w.Code)
+		}
+	}
+
+	for _, args := range [][]string{nil, {"--since-run", "1", "--since", "2000-01-01"}, {"--since", "yesterday"}, {"--since-run", "1", "--export", "csv"}} {
+		if _, err := captureStdout(t, func() error { return changesCmd(args) }); exitCode(err) != exitUsage {
+			t.Errorf("changes %s: %v, want a usage error", strings.Join(args, " "), err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package cli
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// In wal mode sqlite checkpoints the log once it passes a thousand pages,
+// but a checkpoint can't go past a reader's snapshot, so over an hours
+// long run of writes the log can grow to gigabytes and fill the disk. The
+// writers checkpoint it themselves as well: passively after every
+// --checkpoint-every committed transactions, or once it is over
+// --checkpoint-size and has grown since the last, and truncating it once
+// a run is between phases with nothing writing. A database not in wal
+// mode is left alone.
+
+var (
+	checkpointEvery = flag.Int("checkpoint-every", 500, "checkpoint the wal after this many committed write transactions (0 for only by size)")
+	checkpointSize  = flag.String("checkpoint-size", "256MB", "checkpoint the wal when it is over this size and has grown since the last checkpoint (0 for only by count)")
+)
+
+// walCheckpoints counts the commits since the last checkpoint and the
+// largest the log has been.
+type walCheckpoints struct {
+	mu      sync.Mutex
+	commits int
+	// the log's size after the last checkpoint, 0 for one that moved
+	// every frame, the log then starting over; one a reader held back
+	// leaves the log as large, and shouldn't be run again until it grows
+	lastWAL int64
+	maxWAL  int64
+	done    int
+	// --checkpoint-size is bad
+	off bool
+	// --checkpoint-size, read the first time
+	size int64
+	// each database's log, "" for one in memory or not in wal mode
+	logs map[*sql.DB]string
+}
+
+var walState = &walCheckpoints{size: -1, logs: map[*sql.DB]string{}}
+
+// committed is called after each write transaction db commits,
+// checkpointing passively once it is time to.
+func (c *walCheckpoints) committed(db *sql.DB) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.off || c.log(db) == "" {
+		return
+	}
+	if c.size < 0 {
+		size, err := parseSize(*checkpointSize)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "bad --checkpoint-size, not checkpointing: %v\n", err)
+			c.off = true
+			return
+		}
+		c.size = size
+	}
+	c.commits++
+	wal := c.walSize(db)
+	switch {
+	case *checkpointEvery > 0 && c.commits >= *checkpointEvery:
+		c.checkpoint(db, "PASSIVE", fmt.Sprintf("after %d commits", c.commits))
+	case c.size > 0 && wal >= c.size && wal > c.lastWAL:
+		c.checkpoint(db, "PASSIVE", "the wal is "+formatSize(wal))
+	}
+}
+
+// idle truncates the log, for a run between phases with nothing writing.
+func (c *walCheckpoints) idle(db *sql.DB) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.log(db) != "" {
+		c.walSize(db)
+		c.checkpoint(db, "TRUNCATE", "between phases")
+	}
+}
+
+// log is db's write-ahead log, looked up the first time.
+func (c *walCheckpoints) log(db *sql.DB) string {
+	wal, ok := c.logs[db]
+	if !ok {
+		var file, mode string
+		err := db.QueryRow("SELECT file FROM pragma_database_list WHERE name = 'main'").Scan(&file)
+		if err == nil {
+			err = db.QueryRow("PRAGMA journal_mode").Scan(&mode)
+		}
+		if err == nil && file != "" && strings.EqualFold(mode, "wal") {
+			wal = file + "-wal"
+		}
+		c.logs[db] = wal
+	}
+	return wal
+}
+
+func (c *walCheckpoints) walSize(db *sql.DB) int64 {
+	st, err := os.Stat(c.log(db))
+	if err != nil {
+		return 0
+	}
+	if st.Size() > c.maxWAL {
+		c.maxWAL = st.Size()
+	}
+	return st.Size()
+}
+
+func (c *walCheckpoints) checkpoint(db *sql.DB, mode, why string) {
+	c.commits = 0
+	var busy, log, moved int
+	if err := db.QueryRow("PRAGMA wal_checkpoint("+mode+")").Scan(&busy, &log, &moved); err != nil {
+		if *debug {
+			fmt.Fprintf(os.Stderr, "wal checkpoint (%s) failed: %v\n", why, err)
+		}
+		return
+	}
+	c.done++
+	c.lastWAL = c.walSize(db)
+	if busy == 0 && moved == log {
+		c.lastWAL = 0
+	}
+	if *debug {
+		fmt.Fprintf(os.Stderr, "wal checkpoint (%s), %s: %d of %d frames, busy %d\n", why, mode, moved, log, busy)
+	}
+}
+
+// peak is the largest the log was seen to be and how many checkpoints
+// ran.
+func (c *walCheckpoints) peak() (int64, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.maxWAL, c.done
+}
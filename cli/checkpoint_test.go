@@ -0,0 +1,114 @@
+package cli
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.tilde.town/gutchunker/corpus"
+)
+
+// walRun is run over mirror into a file database, with the checkpoint
+// flags as given and debug on, returning what it printed to stdout and
+// to stderr, the database, and the largest its wal was seen to be.
+func walRun(t *testing.T, mirror string, every int, size string) (string, string, *sql.DB, int64) {
+	t.Helper()
+	defer func(every int, size string, dbg bool, state *walCheckpoints) {
+		*checkpointEvery, *checkpointSize, *debug, walState = every, size, dbg, state
+	}(*checkpointEvery, *checkpointSize, *debug, walState)
+	walState = &walCheckpoints{size: -1, logs: map[*sql.DB]string{}}
+	*checkpointEvery, *checkpointSize, *debug = every, size, true
+	db := testFileDB(t)
+	var out string
+	stderr, err := captureStderr(t, func() error {
+		var err error
+		out, err = captureStdout(t, func() error { return runCmd([]string{"--target", mirror}) })
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	most, _ := walState.peak()
+	return out, stderr, db, most
+}
+
+func TestWALCheckpoints(t *testing.T) {
+	opts := corpus.DefaultOptions()
+	opts.Books, opts.BookSize = 40, 64*1024
+	mirror := filepath.Join(t.TempDir(), "mirror")
+	if _, err := corpus.Generate(mirror, opts); err != nil {
+		t.Fatal(err)
+	}
+	// each book ingested is a commit of about 450KB; left to sqlite, the
+	// wal grows to its thousand pages
+	_, stderr, _, unchecked := walRun(t, mirror, 0, "0")
+	if unchecked < 3<<20 || strings.Contains(stderr, "wal checkpoint (after") {
+		t.Fatalf("without checkpoints of its own, the wal was at most %s", formatSize(unchecked))
+	}
+	for _, c := range []struct {
+		every int
+		size  string
+		why   string
+	}{
+		{2, "0", "wal checkpoint (after 2 commits), PASSIVE: "},
+		{0, "256KB", "wal checkpoint (the wal is "},
+		{2, "256KB", "wal checkpoint (after 2 commits), PASSIVE: "},
+	} {
+		out, stderr, db, most := walRun(t, mirror, c.every, c.size)
+		if most == 0 || most > 1<<20 {
+			t.Errorf("checkpointing every %d commits or at %s, the wal was at most %s", c.every, c.size, formatSize(most))
+		}
+		if _, done := walState.peak(); strings.Count(stderr, "wal checkpoint (") < 10 || !strings.Contains(stderr, c.why) {
+			t.Errorf("checkpointing every %d commits or at %s, %d checkpoints logged\n%s", c.every, c.size, done, stderr)
+		}
+		if !strings.Contains(out, "wal: at most "+formatSize(most)+", ") {
+			t.Errorf("the run summary is\n%s", out)
+		}
+		// between ingest and chunk, nothing writing, the wal is truncated
+		if !strings.Contains(stderr, "wal checkpoint (between phases), TRUNCATE: ") {
+			t.Errorf("no checkpoint between phases:\n%s", stderr)
+		}
+		if n := names(t, db, "SELECT count(*) FROM chunks"); n != "3838\n" {
+			t.Errorf("checkpointing every %d commits or at %s, the run left %s chunks", c.every, c.size, n)
+		}
+	}
+
+	// a bad size leaves the checkpoints during the phases to sqlite
+	if _, stderr, _, _ := walRun(t, mirror, 2, "lots"); !strings.Contains(stderr, "bad --checkpoint-size, not checkpointing: invalid size \"lots\"\n") ||
+		strings.Contains(stderr, "wal checkpoint (after") {
+		t.Errorf("with a bad --checkpoint-size, the run logged\n%s", stderr)
+	}
+}
+
+func TestWALCheckpointsInMemory(t *testing.T) {
+	defer func(state *walCheckpoints) { walState = state }(walState)
+	walState = &walCheckpoints{size: -1, logs: map[*sql.DB]string{}}
+	db := testDB(t)
+	for i := 0; i < 3; i++ {
+		addBook(t, db, "Book", "", testParagraphs(2))
+		walState.committed(db)
+	}
+	walState.idle(db)
+	if most, done := walState.peak(); most != 0 || done != 0 {
+		t.Errorf("in memory, the wal was at most %d bytes over %d checkpoints", most, done)
+	}
+	// nor is a file database out of wal mode checkpointed
+	path := filepath.Join(t.TempDir(), "rollback.db")
+	plain, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if _, err = plain.Exec("CREATE TABLE t (x)"); err != nil {
+		t.Fatal(err)
+	}
+	walState.committed(plain)
+	if walState.logs[plain] != "" {
+		t.Errorf("a database out of wal mode has the log %s", walState.logs[plain])
+	}
+	if _, err = os.Stat(path + "-wal"); !os.IsNotExist(err) {
+		t.Errorf("a database out of wal mode has a wal: %v", err)
+	}
+}
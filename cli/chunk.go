@@ -0,0 +1,678 @@
+package cli
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"git.tilde.town/gutchunker/gutchunk"
+)
+
+type bookfile struct {
+	ID       int
+	Name     string
+	Author   string
+	Content  string
+	Filename string
+	Ebook    int
+	Language string
+	// stored with no header (see chunkOptions.bodyOnly)
+	BodyOnly bool
+}
+
+type chunkOptions struct {
+	// strip in-text footnote reference markers like [12] from chunks
+	stripRefs bool
+	// the content has no Gutenberg header, chunk from the first line
+	bodyOnly bool
+	// count, or drop, chunks quoting license boilerplate; nil to skip
+	footer *blocklist
+	// what separator lines between scenes match, nil for the defaults (see
+	// sceneBreaks), and whether to number chunks by scene
+	breaks []*regexp.Regexp
+	scenes bool
+	// tag each chunk with its kind (see kinds.go)
+	tagKinds bool
+
+	// set for single books by --overrides: what starts and ends the body in
+	// place of the START and END markers, or nil, and the lines it starts
+	// at and ends before, by number, 0 for none, which go before either;
+	// lines at the top of the body to leave out; the least size of a chunk,
+	// 0 for minChunk, also set by the book's language; and whether to
+	// leave footnotes in the text
+	start, end         *regexp.Regexp
+	startLine, endLine int
+	skipLines          int
+	minChunk           int
+	keepFootnotes      bool
+	// the overrides file, or nil
+	overrides *overrides
+	// minimum chunk sizes by language, nil for the built-in ones
+	langMins *langMinimums
+	// whose books to chunk by the --authors-file, nil for everyone's
+	authors *authorList
+
+	// run wide: number of books chunked concurrently, and the most book
+	// content in bytes those workers may hold at once (0 for no limit)
+	workers   int
+	maxMemory int64
+	// books with more content than this are skipped, 0 for no limit; and
+	// whether a book that panics is tried again with conservative settings
+	maxBookSize  int64
+	retryReduced bool
+	// chunk with conservative settings, and the most bytes a chunk grows
+	// to before it is cut, 0 for no limit, runes for a book in script
+	// ScriptCJK (see conservative and chunkSizeFlags)
+	reduced bool
+	window  int
+	script  Script
+	// join a paragraph under the least size to those after it until they
+	// make a chunk, rather than dropping it
+	mergeShort bool
+	// the registered strategy cutting the body into chunks, "" for
+	// paragraphs (see strategy.go), and those cutting it besides, with
+	// --strategy a,b (see multistrategy.go)
+	strategyName    string
+	otherStrategies []string
+	// write every chunk of a book chunked before anew rather than keeping
+	// those cut again (see rechunk.go)
+	fullRechunk bool
+
+	// only chunk the files with these ids; nil for all of them. Books
+	// removed with rm are never chunked.
+	ids []int
+
+	// where the time goes, or nil
+	timings *timings
+	// books with repeated START markers, or nil
+	starts *startLog
+	// what each step does to each paragraph, for chunk-one --trace, or
+	// nil (see trace.go)
+	trace *chunkTrace
+}
+
+func hasStartMarker(content string) bool {
+	s := bufio.NewScanner(strings.NewReader(content))
+	for s.Scan() {
+		if isStart(strings.TrimSpace(s.Text())) {
+			return true
+		}
+	}
+	return false
+}
+
+func extractChunks(db *sql.DB, id int, opts chunkOptions) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = chunkBook(tx, id, opts); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func loadBook(q queryer, id int) (bookfile, error) {
+	b := bookfile{ID: id}
+	err := q.QueryRow("SELECT coalesce(name, ''), coalesce(author, ''), coalesce(filename, ''), coalesce(ebook, 0), coalesce(language, ''), coalesce(body_only, 0), "+contentCol("")+" FROM files WHERE id = ?", id).
+		Scan(&b.Name, &b.Author, &b.Filename, &b.Ebook, &b.Language, &b.BodyOnly, &b.Content)
+	return b, err
+}
+
+// forBook is o for chunking b: from its first line if it was stored with no
+// header, and by its language (see langmin.go).
+func (o chunkOptions) forBook(b bookfile) chunkOptions {
+	if b.BodyOnly {
+		o.bodyOnly = true
+	}
+	return o.forLanguage(b)
+}
+
+// chunkBook chunks one files row inside tx and returns the number of chunks
+// written.
+func chunkBook(tx *sql.Tx, id int, opts chunkOptions) (int, error) {
+	b, err := loadBook(tx, id)
+	if err != nil {
+		return 0, err
+	}
+
+	if opts, err = opts.overrides.apply(b, opts.forBook(b)); err != nil {
+		return 0, err
+	}
+	chunks, at, notes, cuts, m := splitBookAll(b.Content, opts)
+	opts.starts.add(id, m)
+	works, err := loadWorks(tx, id)
+	if err != nil {
+		return 0, err
+	}
+	if err = markerWarnings(tx, id, m, len(chunks)); err != nil {
+		return 0, err
+	}
+	if err = writeChunks(tx, id, opts.strategy(), chunks, chunkExtras(works, at, opts.scenes), notes, opts.fullRechunk); err != nil {
+		return 0, err
+	}
+	return len(chunks), writeStrategyChunks(tx, id, cuts, works, opts.scenes)
+}
+
+// chunks are paragraphs at least this many bytes long
+const minChunk = gutchunk.MinChunk
+
+// chunkSizeFlags adds --strategy, --min-chunk, --max-chunk and
+// --merge-short to fs, setting them in opts, and returns what checks them.
+// A language with a least size of its own (see langmin.go) and an
+// override's min-chunk go before --min-chunk.
+func chunkSizeFlags(fs *flag.FlagSet, opts *chunkOptions) func() error {
+	strategies := strategyFlag(fs, opts)
+	least := fs.Int("min-chunk", minChunk, "drop paragraphs under this many bytes, or with --merge-short join them to the next")
+	fs.IntVar(&opts.window, "max-chunk", 0, "cut a chunk once it grows to this many bytes, or characters in Chinese and Japanese (0 for no limit)")
+	fs.BoolVar(&opts.mergeShort, "merge-short", false, "join paragraphs under --min-chunk to the ones after them instead of dropping them")
+	return func() error {
+		if err := strategies(); err != nil {
+			return err
+		}
+		if *least < 1 || opts.window < 0 {
+			return usagef("--min-chunk must be positive and --max-chunk not negative")
+		}
+		if opts.window > 0 && opts.window <= *least {
+			return usagef("--max-chunk %d is no more than --min-chunk %d", opts.window, *least)
+		}
+		opts.minChunk = *least
+		return nil
+	}
+}
+
+// splitBook is the chunker proper, package gutchunk's with the footer
+// blocklist after it: it finds the body between the START and END markers
+// (see gutchunk.FindBody), pulls out footnotes and returns the paragraphs
+// long enough to keep, in the canonical form (see gutchunk.Canonical). It
+// does not touch the database.
+//
+// It goes in three steps, each with its own rules, changed for one book by
+// chunkOptions: the body, by the markers or an override's start and end
+// lines or patterns; chunks, by the strategy splitBody runs, paragraphs
+// unless --strategy names another, ended by blank lines and scene breaks
+// and kept by minChunk or the language's least size, footnotes taken out;
+// and which are kept, by the footer blocklist. chunkBook, audit-chunks,
+// anthology and run --pipeline all chunk through it, writing or comparing
+// what it returns.
+func splitBook(content string, opts chunkOptions) ([]string, []gutchunk.Footnote, gutchunk.Found) {
+	chunks, _, notes, m := splitBookAt(content, opts)
+	return chunks, notes, m
+}
+
+// chunkPos is where in its book a chunk is: the line of the body it starts
+// on, for placing it in the works of an anthology, the number of scene
+// breaks before it, how far through the body its middle is, from 0 to 1,
+// by bytes, and its kind with --tag-kinds, or "".
+type chunkPos struct {
+	line, scene int
+	position    float64
+	kind        string
+}
+
+// splitBookAt is splitBook also returning where each chunk is.
+func splitBookAt(content string, opts chunkOptions) ([]string, []chunkPos, []gutchunk.Footnote, gutchunk.Found) {
+	body, m := opts.body(content)
+	chunks, at, notes := splitBody(body, opts)
+	return chunks, at, notes, m
+}
+
+// splitBody is the rest of splitBookAt once the body is found: the chunks
+// opts' strategy cuts body, the lines between a book's markers, into, and
+// which of them are kept. It reads nothing of the book but body, so one
+// body can be split again with other options without finding it anew.
+func splitBody(body []string, opts chunkOptions) ([]string, []chunkPos, []gutchunk.Footnote) {
+	cut, notes, err := gutchunk.Split(gutchunk.Body{Lines: body}, opts.chunker())
+	if err != nil {
+		// --strategy is checked as the flags are read
+		panic(fmt.Sprintf("gutchunk: %v", err))
+	}
+	chunks, at := make([]string, len(cut)), make([]chunkPos, len(cut))
+	for i, c := range cut {
+		chunks[i] = c.Text
+		at[i] = chunkPos{line: c.Line, scene: c.Scene, position: c.Position, kind: c.Kind}
+	}
+	opts.trace.footer(opts.footer, chunks)
+	if opts.footer != nil {
+		chunks, at, notes = opts.footer.filter(chunks, at, notes)
+	}
+	// the blocklist may leave a book one chunk, all middle
+	if len(at) == 1 {
+		at[0].position = 0.5
+	}
+	return chunks, at, notes
+}
+
+// chunkExtra is what is stored with a chunk beyond its text: its
+// works_in_file id, its scene when scenes are numbered, its position_pct
+// and its kind when tagged, each nil for none.
+type chunkExtra struct {
+	work, scene, position, kind interface{}
+}
+
+// chunkExtras gives the extras of chunks at pos.
+func chunkExtras(works []workSpan, pos []chunkPos, scenes bool) []chunkExtra {
+	extras := make([]chunkExtra, len(pos))
+	for i, p := range pos {
+		extras[i].position = p.position
+		for _, w := range works {
+			if p.line >= w.start && p.line < w.end {
+				extras[i].work = w.id
+				break
+			}
+		}
+		if scenes {
+			extras[i].scene = p.scene
+		}
+		if p.kind != "" {
+			extras[i].kind = p.kind
+		}
+	}
+	return extras
+}
+
+// writeChunks replaces a book's chunks with chunks, inserted in order, as
+// cut by strategy, with extras for each, or nil for none. Those of them it
+// had already, or its old version had, are kept unless full (see
+// rechunk.go).
+func writeChunks(tx *sql.Tx, sourceid int, strategy string, chunks []string, extras []chunkExtra, notes []gutchunk.Footnote, full bool) error {
+	kept := make([]*priorChunk, len(chunks))
+	from, had := sourceid, 0
+	var err error
+	if !full {
+		if kept, from, had, err = alignChunks(tx, sourceid, strategy, chunks); err != nil {
+			return fmt.Errorf("could not align the chunks there were: %w", err)
+		}
+	}
+	stable, moved, err := newStableIDs(tx, sourceid, strategy, chunks)
+	if err != nil {
+		return fmt.Errorf("could not give the chunks stable ids: %w", err)
+	}
+	keptIDs, nkept := keptList(kept)
+	if err := replaceChunks(tx, sourceid, len(chunks), keptIDs); err != nil {
+		return fmt.Errorf("could not replace the chunks there were: %w", err)
+	}
+	if from != sourceid && nkept > 0 {
+		if err = takeKept(tx, from, keptIDs, nkept); err != nil {
+			return fmt.Errorf("could not take the chunks kept from book %d: %w", from, err)
+		}
+	}
+	var refs []*chunkRef
+	cols := []string{"id", "sourceid", "chunk", "ordinal", "work_id", "scene", "position_pct", "kind", "stable_id", "token_count", "boilerplate"}
+	if chunkStorage == storageReference {
+		if refs, err = bookRefs(tx, sourceid, chunks); err != nil {
+			return fmt.Errorf("could not find chunks in their book: %w", err)
+		}
+		cols = append(cols, "start_offset", "end_offset", "strip_refs")
+	}
+
+	// chunks inserted many to a statement, sharded ones inserted through a
+	// view and clustered ones into a table without rowids have no rowid of
+	// their own to report back, so pick the ids here, as for new chunks
+	// beside kept ones, which a rowid past the last could be taken from
+	var next int64
+	pick := pickChunkIDs() || nkept > 0
+	if pick {
+		if next, err = maxChunkID(tx); err != nil {
+			return err
+		}
+		if last := lastKept(kept); last > next {
+			next = last
+		}
+	}
+	ids := make([]int64, len(chunks))
+	rows := make([][]interface{}, len(chunks))
+	var fresh []int
+	for ordinal, chunk := range chunks {
+		var id, tokens, boilerplate interface{}
+		if k := kept[ordinal]; k != nil {
+			id = k.id
+			ids[ordinal] = k.id
+			boilerplate = k.boilerplate
+			if k.text == chunk {
+				tokens = k.tokens
+			}
+		} else {
+			fresh = append(fresh, ordinal)
+			if pick {
+				next++
+				id = next
+				ids[ordinal] = next
+			}
+		}
+		var x chunkExtra
+		if extras != nil {
+			x = extras[ordinal]
+		}
+		rows[ordinal] = []interface{}{id, sourceid, chunk, ordinal, x.work, x.scene, x.position, x.kind, stable[ordinal], tokens, boilerplate}
+		if refs != nil {
+			start, end, strip := refValues(refs[ordinal])
+			rows[ordinal] = append(rows[ordinal], start, end, strip)
+		}
+	}
+	reported := ids
+	if pick {
+		reported = nil
+	}
+	if err = insertChunkRows(tx, cols, rows, reported); err != nil {
+		return err
+	}
+	if err = moved(); err != nil {
+		return fmt.Errorf("could not record the stable ids moved: %w", err)
+	}
+	if err = rewordKept(tx, kept, ids, chunks); err != nil {
+		return fmt.Errorf("could not update the chunks kept: %w", err)
+	}
+	freshIDs, freshChunks := make([]int64, len(fresh)), make([]string, len(fresh))
+	for i, ordinal := range fresh {
+		freshIDs[i], freshChunks[i] = ids[ordinal], chunks[ordinal]
+	}
+	if err = reattachFlags(tx, freshIDs, freshChunks); err != nil {
+		return fmt.Errorf("could not reattach flags: %w", err)
+	}
+	if err = markBoilerplate(tx, freshIDs, freshChunks); err != nil {
+		return fmt.Errorf("could not mark boilerplate: %w", err)
+	}
+	if had > 0 {
+		rechunked(had, nkept, len(chunks)-nkept, from == sourceid)
+	}
+
+	return saveFootnotes(tx, sourceid, notes)
+}
+
+func saveFootnotes(tx *sql.Tx, sourceid int, notes []gutchunk.Footnote) error {
+	if len(notes) == 0 {
+		return nil
+	}
+	stmt, err := tx.Prepare("INSERT INTO footnotes (sourceid, marker, text, ordinal) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return fmt.Errorf("could not prepare: %w", err)
+	}
+	defer stmt.Close()
+	for _, n := range notes {
+		var ordinal interface{}
+		if n.Ordinal >= 0 {
+			ordinal = n.Ordinal
+		}
+		if _, err = stmt.Exec(sourceid, n.Marker, n.Text, ordinal); err != nil {
+			return fmt.Errorf("could not insert footnote: %w", err)
+		}
+	}
+	return nil
+}
+
+// chunkPage is how many books of files a chunk run reads at a time.
+var chunkPage = 500
+
+// chunkCandidate is a book a chunk run may take, as read of files.
+type chunkCandidate struct {
+	id     int
+	size   int64
+	author string
+}
+
+// chunkWhere is the condition on files f a book a chunk run takes meets,
+// the authors file aside, and its arguments: not removed or superseded,
+// with its content kept, of opts.ids if given, and no newer than book
+// last, the newest when the run began. Superseded versions keep the
+// chunks they have, as do books run --no-store-content chunked without
+// keeping their content.
+func (opts chunkOptions) chunkWhere(last int) (string, []interface{}) {
+	ids := ""
+	if opts.ids != nil {
+		bs, _ := json.Marshal(opts.ids)
+		ids = string(bs)
+	}
+	return `f.deleted_at IS NULL AND f.superseded_by IS NULL AND ` + hasContent("f.") + ` AND f.id <= ?
+		AND (? = '' OR f.id IN (SELECT value FROM json_each(?)))`, []interface{}{last, ids, ids}
+}
+
+// chunkCandidates reads up to n of the books meeting where, by id after
+// after.
+func chunkCandidates(db *sql.DB, where string, args []interface{}, after, n int) ([]chunkCandidate, error) {
+	rows, err := db.Query(`SELECT f.id, coalesce(`+contentBytes("f.")+`, 0), coalesce(f.author_norm, ''), coalesce(f.author, ''), f.author_norm IS NULL
+		FROM files f WHERE `+where+` AND f.id > ? ORDER BY f.id LIMIT ?`, append(args, after, n)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var page []chunkCandidate
+	for rows.Next() {
+		var b chunkCandidate
+		var author string
+		var unnormed bool
+		if err = rows.Scan(&b.id, &b.size, &b.author, &author, &unnormed); err != nil {
+			return nil, err
+		}
+		if unnormed {
+			b.author = normalizeAuthor(author)
+		}
+		page = append(page, b)
+	}
+	return page, rows.Err()
+}
+
+// countChunkable is how many books chunkCandidates gives over where, by
+// the authors file too.
+func countChunkable(db *sql.DB, where string, args []interface{}, authors *authorList) (int, error) {
+	deny, allow := authors.where()
+	var n int
+	err := db.QueryRow(`SELECT count(*) FROM files f WHERE `+where+`
+		AND (? = '' OR NOT EXISTS (SELECT 1 FROM json_each(?) WHERE `+authorGlobs+`))
+		AND (? = '' OR EXISTS (SELECT 1 FROM json_each(?) WHERE `+authorGlobs+`))`,
+		append(args, deny, deny, allow, allow)...).Scan(&n)
+	return n, err
+}
+
+// makeChunks chunks the books opts takes, reading them of files a page at
+// a time as the run goes so that what it holds doesn't grow with the
+// library. A run takes the books there were when it began: one ingested
+// while it runs waits for the next, and one removed or superseded before
+// the run gets to it is passed over. The count it shows progress against
+// is of the books there were to take at the start.
+func makeChunks(db *sql.DB, opts chunkOptions) error {
+	resetRechunks()
+	wanted := map[int]bool{}
+	for _, id := range opts.ids {
+		wanted[id] = true
+	}
+	var last int
+	if err := db.QueryRow("SELECT coalesce(max(id), 0) FROM files").Scan(&last); err != nil {
+		return err
+	}
+	where, args := opts.chunkWhere(last)
+	max, err := countChunkable(db, where, args, opts.authors)
+	if err != nil {
+		return err
+	}
+
+	if opts.workers < 1 {
+		opts.workers = 1
+	}
+
+	w := writerOf(db)
+	budget := newMemBudget(opts.maxMemory)
+	var chunks, panicked, tooLarge int64
+	var failed error
+	var mu sync.Mutex
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failed == nil {
+			failed = err
+		}
+	}
+	failing := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return failed != nil
+	}
+
+	// workers only hold the writer's lock to read the content and to write
+	// the results; the chunking itself runs in parallel
+	queue := make(chan chunkCandidate)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range queue {
+				if opts.maxBookSize > 0 && b.size > opts.maxBookSize {
+					if err := skipTooLarge(w, b.id, b.size, opts.maxBookSize); err != nil {
+						fail(fmt.Errorf("book %d: %w", b.id, err))
+					}
+					atomic.AddInt64(&tooLarge, 1)
+					opts.timings.skipTooLarge()
+					continue
+				}
+				if opts.maxMemory > 0 && b.size > opts.maxMemory {
+					fmt.Fprintf(os.Stderr, "book %d is %s, more than --max-memory; chunking it alone\n", b.id, formatSize(b.size))
+				}
+				held := budget.acquire(b.size)
+				n, err := chunkGuarded(w, b.id, opts)
+				budget.release(held)
+				var p *bookPanic
+				if errors.As(err, &p) {
+					atomic.AddInt64(&panicked, 1)
+					opts.timings.bookFailed()
+					continue
+				}
+				if err != nil {
+					fail(fmt.Errorf("book %d: %w", b.id, err))
+					continue
+				}
+				atomic.AddInt64(&chunks, int64(n))
+			}
+		}()
+	}
+
+	// each page is read whole before its books go to the workers, so no
+	// read is left open while they write
+	sent, after := 0, 0
+	for !failing() {
+		var page []chunkCandidate
+		err := w.read(func(db *sql.DB) (err error) {
+			page, err = chunkCandidates(db, where, args, after, chunkPage)
+			return err
+		})
+		if err != nil {
+			fail(err)
+			break
+		}
+		if len(page) == 0 {
+			break
+		}
+		after = page[len(page)-1].id
+		for _, b := range page {
+			if failing() {
+				break
+			}
+			delete(wanted, b.id)
+			if opts.authors != nil {
+				d := opts.authors.record(b.id, b.author)
+				opts.timings.author(d)
+				if d != authorAllowed {
+					continue
+				}
+			}
+			fmt.Printf("%d of %d\r", sent, max)
+			queue <- b
+			sent++
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	if failed != nil {
+		return failed
+	}
+
+	fmt.Printf("chunked %d books into %d chunks; peak %s of content held\n", sent-int(panicked+tooLarge), chunks, formatSize(budget.peak))
+	if s := rechunkReport(); s != "" {
+		fmt.Println(s)
+	}
+	if opts.footer != nil {
+		opts.footer.report()
+	}
+	opts.starts.report()
+	opts.overrides.report()
+	opts.langMins.report()
+	opts.authors.report()
+
+	if len(wanted) > 0 {
+		missing := []int{}
+		for id := range wanted {
+			missing = append(missing, id)
+		}
+		sort.Ints(missing)
+		for _, id := range missing {
+			fmt.Fprintln(os.Stderr, "no such file id:", id)
+		}
+		return partialError{len(missing), len(opts.ids), "file ids", "don't exist"}
+	}
+	if panicked > 0 {
+		return partialError{int(panicked), sent, "books", "failed; see gutchunk warnings --code panic"}
+	}
+	return nil
+}
+
+func chunkHeld(w *writer, id int, opts chunkOptions) (int, error) {
+	sw := opts.timings.start("book " + strconv.Itoa(id))
+	var b bookfile
+	var works []workSpan
+	err := w.read(func(db *sql.DB) error {
+		var err error
+		if b, err = loadBook(db, id); err != nil {
+			return err
+		}
+		works, err = loadWorks(db, id)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	sw.lap(phaseRead)
+
+	if opts, err = opts.overrides.apply(b, opts.forBook(b)); err != nil {
+		return 0, err
+	}
+	if opts.reduced {
+		opts = opts.conservative()
+	}
+	chunks, at, notes, cuts, m := splitContent(b.Content, opts)
+	opts.starts.add(id, m)
+	sw.lap(phaseScan)
+
+	err = w.do(func(tx *sql.Tx) error {
+		if err := markerWarnings(tx, id, m, len(chunks)); err != nil {
+			return err
+		}
+		if err := writeChunks(tx, id, opts.strategy(), chunks, chunkExtras(works, at, opts.scenes), notes, opts.fullRechunk); err != nil {
+			return err
+		}
+		return writeStrategyChunks(tx, id, cuts, works, opts.scenes)
+	})
+	if err != nil {
+		return 0, err
+	}
+	sw.lap(phaseWrite)
+	sw.done(len(chunks))
+	events.emit("book_chunked", map[string]interface{}{"book": id, "chunks": len(chunks)})
+
+	return len(chunks), nil
+}
@@ -0,0 +1,226 @@
+package cli
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// footnoted is three paragraphs, the second after an inline footnote and
+// the third followed by a footnote section, the next chapter after it.
+func footnoted() string {
+	paras := strings.Split(testParagraphs(4), "\n\n")
+	return paras[0] + "[1]\n\n" +
+		"[Footnote 1: He called it \"the [old] road\",\nas the maps did.]\n\n" +
+		paras[1] + "[2]\n\n" +
+		"FOOTNOTES:\n\n[2] The other note.\n\nCHAPTER II.\n\n" +
+		paras[2] + "\n\n" + paras[3]
+}
+
+func TestChunkFootnotes(t *testing.T) {
+	for _, strip := range []bool{false, true} {
+		db := testDB(t)
+		id := addBook(t, db, "Decline", "Gibbon", testBook("Decline", footnoted()))
+		if err := makeChunks(db, chunkOptions{stripRefs: strip}); err != nil {
+			t.Fatal(err)
+		}
+
+		rows, err := db.Query("SELECT marker, text, ordinal FROM footnotes WHERE sourceid = ? ORDER BY id", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		type footnote struct {
+			marker, text string
+			ordinal      int
+		}
+		var got []footnote
+		for rows.Next() {
+			var f footnote
+			if err = rows.Scan(&f.marker, &f.text, &f.ordinal); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, f)
+		}
+		rows.Close()
+		want := []footnote{
+			{"1", "He called it \"the [old] road\",\nas the maps did.", 0},
+			{"2", "The other note.", 1},
+		}
+		if len(got) != len(want) {
+			t.Fatalf("footnotes %+v, want %+v", got, want)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("footnote %d is %+v, want %+v", i, got[i], want[i])
+			}
+		}
+
+		chunks, err := db.Query("SELECT chunk FROM chunks WHERE sourceid = ? ORDER BY ordinal", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var texts []string
+		for chunks.Next() {
+			var c string
+			if err = chunks.Scan(&c); err != nil {
+				t.Fatal(err)
+			}
+			texts = append(texts, c)
+		}
+		chunks.Close()
+		if len(texts) != 4 {
+			t.Fatalf("%d chunks, want 4", len(texts))
+		}
+		for _, c := range texts {
+			if strings.Contains(c, "maps") || strings.Contains(c, "other note") || strings.Contains(c, "FOOTNOTES") {
+				t.Errorf("a footnote was quoted as prose: %q", c)
+			}
+		}
+		if refs := strings.HasSuffix(texts[0], "will.[1]"); refs == strip {
+			t.Errorf("with strip-refs %v, the first chunk ends %q", strip, texts[0][len(texts[0])-10:])
+		}
+	}
+}
+
+// pagedLibrary is seven books, Austen's and Verne's by turns, as a chunk
+// run reads them, the fourth removed, the fifth superseded by the sixth
+// and the seventh stored without its content.
+func pagedLibrary(t *testing.T) *sql.DB {
+	t.Helper()
+	db := testDB(t)
+	for i := 1; i <= 7; i++ {
+		author := map[bool]string{true: "Jane Austen", false: "Jules Verne"}[i%2 == 1]
+		title := fmt.Sprint("Book ", i)
+		addBook(t, db, title, author, testBook(title, testParagraphs(2)))
+	}
+	for _, q := range []string{
+		"UPDATE files SET deleted_at = CURRENT_TIMESTAMP WHERE id = 4",
+		"UPDATE files SET superseded_by = 6 WHERE id = 5",
+		"UPDATE files SET content = NULL WHERE id = 7",
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestChunkCandidates(t *testing.T) {
+	db := pagedLibrary(t)
+	read := func(opts chunkOptions, last, n int) string {
+		t.Helper()
+		where, args := opts.chunkWhere(last)
+		var ids []string
+		for after := 0; ; {
+			page, err := chunkCandidates(db, where, args, after, n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page) > n {
+				t.Fatalf("a page of %d holds %d books", n, len(page))
+			}
+			if len(page) == 0 {
+				break
+			}
+			for _, b := range page {
+				ids = append(ids, fmt.Sprint(b.id))
+			}
+			after = page[len(page)-1].id
+		}
+		return strings.Join(ids, " ")
+	}
+	// pages of every size, across their ends, read the same books once
+	for _, n := range []int{1, 2, 3, 500} {
+		if got := read(chunkOptions{}, 7, n); got != "1 2 3 6" {
+			t.Errorf("in pages of %d, read books %s, want 1 2 3 6", n, got)
+		}
+	}
+	// with --paths-file, and under the newest book when the run began
+	if got := read(chunkOptions{ids: []int{2, 4, 6, 9}}, 7, 1); got != "2 6" {
+		t.Errorf("of the ids 2 4 6 9, read books %s", got)
+	}
+	if got := read(chunkOptions{}, 2, 1); got != "1 2" {
+		t.Errorf("up to book 2, read books %s", got)
+	}
+
+	// the count is by the same condition, and the authors file's; an
+	// empty --paths-file takes no books
+	path := filepath.Join(t.TempDir(), "authors.toml")
+	if err := os.WriteFile(path, []byte("deny = [\"Verne*\"]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	authors, err := loadAuthorList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		opts    chunkOptions
+		authors *authorList
+		want    int
+	}{{chunkOptions{}, nil, 4}, {chunkOptions{}, authors, 2}, {chunkOptions{ids: []int{2, 3, 4}}, authors, 1}, {chunkOptions{ids: []int{}}, nil, 0}} {
+		where, args := c.opts.chunkWhere(7)
+		if n, err := countChunkable(db, where, args, c.authors); err != nil || n != c.want {
+			t.Errorf("of ids %v, authors %v, counted %d books (%v), want %d", c.opts.ids, c.authors != nil, n, err, c.want)
+		}
+	}
+}
+
+func TestChunkPages(t *testing.T) {
+	defer func(was int) { chunkPage = was }(chunkPage)
+	chunkPage = 2
+	db := pagedLibrary(t)
+	chunked := func() string {
+		return names(t, db, "SELECT DISTINCT sourceid FROM chunks ORDER BY sourceid")
+	}
+
+	// as the first book's chunks are written, another book is ingested
+	// and one not yet read removed
+	for _, q := range []string{
+		"UPDATE files SET deleted_at = NULL, superseded_by = NULL WHERE id IN (4, 5)",
+		`CREATE TEMP TRIGGER midrun AFTER INSERT ON chunks WHEN NEW.sourceid = 1 AND NEW.ordinal = 0 BEGIN
+			INSERT INTO files (name, author, filename, content) VALUES ('Book 8', 'Jane Austen', 'Book 8.txt', (SELECT content FROM files WHERE id = 1));
+			UPDATE files SET deleted_at = CURRENT_TIMESTAMP WHERE id = 5;
+		END`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out, err := captureStdout(t, func() error { return makeChunks(db, chunkOptions{workers: 1}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the run took the books there were, less the one removed, and left
+	// the new one for the next
+	if got := chunked(); got != "1\n2\n3\n4\n6\n" {
+		t.Errorf("chunked books\n%s", got)
+	}
+	if !strings.Contains(out, "4 of 6\r") || strings.Contains(out, "of 7\r") || !strings.Contains(out, "chunked 5 books into ") {
+		t.Errorf("the run printed\n%q", out)
+	}
+	if _, err = db.Exec("DROP TRIGGER midrun"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = captureStdout(t, func() error { return makeChunks(db, chunkOptions{workers: 1}) }); err != nil {
+		t.Fatal(err)
+	}
+	if got := chunked(); got != "1\n2\n3\n4\n6\n8\n" {
+		t.Errorf("run again, chunked books\n%s", got)
+	}
+
+	// --paths-file's ids are found across the pages, and one that isn't
+	// said so
+	if _, err = db.Exec("DELETE FROM chunks"); err != nil {
+		t.Fatal(err)
+	}
+	stderr, err := captureStderr(t, func() error {
+		_, err := captureStdout(t, func() error { return makeChunks(db, chunkOptions{ids: []int{8, 1, 6, 40}}) })
+		return err
+	})
+	if exitCode(err) != exitPartial || stderr != "no such file id: 40\n" || chunked() != "1\n6\n8\n" {
+		t.Errorf("chunk --paths-file of 8 1 6 40: %v, chunking\n%s", err, chunked())
+	}
+}
@@ -0,0 +1,125 @@
+package cli
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"runtime"
+)
+
+// A book that crashes the chunker shouldn't take a run of sixty thousand
+// down with it. A panic chunking a book is recovered, kept as a warning
+// with its stack, and the run goes on to the next book; so are books
+// skipped for being over --max-book-size. With --retry-reduced a
+// book that panicked is chunked once more with conservative settings (see
+// conservative) before it is given up on.
+
+const (
+	warnPanic    = "panic"
+	warnTooLarge = "too_large"
+	// chunked with conservative settings after a panic
+	warnReduced = "reduced"
+)
+
+// splitContent splits a book as the guarded chunking does. It is a
+// variable to be swapped for a chunker that panics.
+var splitContent = splitBookAll
+
+// reducedWindow is the most bytes a chunk may grow to with conservative
+// settings before it is cut, whether or not its paragraph has ended.
+const reducedWindow = 64 << 10
+
+// bookPanic is a panic recovered chunking a book.
+type bookPanic struct {
+	value interface{}
+	stack []byte
+}
+
+func (p *bookPanic) Error() string {
+	return fmt.Sprintf("panic: %v", p.value)
+}
+
+// conservative is o with everything optional about chunking a book turned
+// off: footnotes are left in the text, no lines are scene breaks, and
+// chunks are paragraphs, cut at reducedWindow bytes, or --max-chunk when
+// less, whatever --strategy says.
+func (o chunkOptions) conservative() chunkOptions {
+	o.strategyName, o.otherStrategies = "", nil
+	o.keepFootnotes = true
+	o.stripRefs = false
+	o.breaks = []*regexp.Regexp{}
+	o.scenes = false
+	if o.window == 0 || o.window > reducedWindow {
+		o.window = reducedWindow
+	}
+	return o
+}
+
+// chunkRecovered is chunkHeld, giving a panic as a *bookPanic.
+func chunkRecovered(w *writer, id int, opts chunkOptions) (n int, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			stack := make([]byte, 64<<10)
+			n, err = 0, &bookPanic{v, stack[:runtime.Stack(stack, false)]}
+		}
+	}()
+	return chunkHeld(w, id, opts)
+}
+
+// chunkGuarded chunks book id, recording a panic as a warning and
+// returning it as a *bookPanic instead of crashing. Other errors are
+// returned as they are.
+func chunkGuarded(w *writer, id int, opts chunkOptions) (int, error) {
+	n, err := chunkRecovered(w, id, opts)
+	var p *bookPanic
+	if !errors.As(err, &p) {
+		return n, err
+	}
+	fmt.Fprintf(os.Stderr, "book %d: %v\n", id, p)
+	if err = recordChunkWarning(w, id, warnPanic, p.Error(), string(p.stack)); err != nil {
+		return 0, err
+	}
+	if !opts.retryReduced {
+		return 0, p
+	}
+
+	opts.reduced = true
+	n, err = chunkRecovered(w, id, opts)
+	if !errors.As(err, &p) {
+		if err == nil {
+			fmt.Fprintf(os.Stderr, "book %d: chunked with reduced settings\n", id)
+			err = recordChunkWarning(w, id, warnReduced, fmt.Sprintf("chunked into %d chunks with reduced settings", n), "")
+		}
+		return n, err
+	}
+	fmt.Fprintf(os.Stderr, "book %d: with reduced settings too: %v\n", id, p)
+	if err = recordChunkWarning(w, id, warnPanic, "with reduced settings: "+p.Error(), string(p.stack)); err != nil {
+		return 0, err
+	}
+	return 0, p
+}
+
+// skipTooLarge records that book id, size bytes long, was not chunked for
+// being over --max-book-size.
+func skipTooLarge(w *writer, id int, size, max int64) error {
+	msg := fmt.Sprintf("%s, more than --max-book-size %s; not chunked", formatSize(size), formatSize(max))
+	fmt.Fprintf(os.Stderr, "book %d is %s\n", id, msg)
+	events.warn("", "", fmt.Sprintf("book %d is %s", id, msg))
+	return recordChunkWarning(w, id, warnTooLarge, msg, "")
+}
+
+func recordChunkWarning(w *writer, id int, kind, message, stack string) error {
+	return w.do(func(tx *sql.Tx) error {
+		return insertChunkWarning(tx, int64(id), kind, message, stack)
+	})
+}
+
+func insertChunkWarning(tx *sql.Tx, id int64, kind, message, stack string) error {
+	severity := sevWarn
+	if kind == warnPanic {
+		severity = sevError
+	}
+	return addWarning(tx, warnAt{scope: scopeChunk, fileID: id}, severity, kind, message, stack)
+}
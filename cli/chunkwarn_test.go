@@ -0,0 +1,90 @@
+package cli
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+
+	"git.tilde.town/gutchunker/gutchunk"
+)
+
+// poisonChunker panics on books containing POISON, unless chunking them
+// with conservative settings when reduced is set.
+func poisonChunker(t *testing.T, reduced bool) {
+	was := splitContent
+	splitContent = func(content string, opts chunkOptions) ([]string, []chunkPos, []gutchunk.Footnote, []strategyCut, gutchunk.Found) {
+		if strings.Contains(content, "POISON") && !(reduced && opts.window == reducedWindow) {
+			panic("the chunker choked")
+		}
+		return was(content, opts)
+	}
+	t.Cleanup(func() { splitContent = was })
+}
+
+func TestChunkPanic(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		opts    chunkOptions
+		reduced bool
+		// the poisoned book's chunks, the warnings about it and the
+		// books that failed
+		chunks   int
+		warnings string
+		failed   int
+	}{
+		{"plain", chunkOptions{}, false, 0, "panic", 1},
+		{"across workers", chunkOptions{workers: 3}, false, 0, "panic", 1},
+		{"retried", chunkOptions{retryReduced: true}, true, 2, "panic reduced", 0},
+		{"failing again", chunkOptions{retryReduced: true}, false, 0, "panic panic", 1},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			db := testDB(t)
+			poisonChunker(t, c.reduced)
+			before := addBook(t, db, "Emma", "Jane Austen", testBook("Emma", testParagraphs(2)))
+			poisoned := addBook(t, db, "Poison", "Anonymous", testBook("Poison", testParagraphs(2)+"\n\nPOISON"))
+			after := addBook(t, db, "Persuasion", "Jane Austen", testBook("Persuasion", testParagraphs(2)))
+			big := addBook(t, db, "Clarissa", "Samuel Richardson", testBook("Clarissa", testParagraphs(40)))
+
+			c.opts.timings = newTimings()
+			c.opts.maxBookSize = 8 << 10
+			_, err := captureStdout(t, func() error { return makeChunks(db, c.opts) })
+			if c.failed > 0 && exitCode(err) != exitPartial || c.failed == 0 && err != nil {
+				t.Errorf("chunking: %v", err)
+			}
+			for _, id := range []int{before, after} {
+				if n := chunkCount(t, db, id); n != 2 {
+					t.Errorf("book %d, not poisoned, gave %d chunks", id, n)
+				}
+			}
+			if n := chunkCount(t, db, poisoned); n != c.chunks {
+				t.Errorf("the poisoned book gave %d chunks, want %d", n, c.chunks)
+			}
+			if n := chunkCount(t, db, big); n != 0 {
+				t.Errorf("the book over --max-book-size gave %d chunks", n)
+			}
+			if got := warningCodes(t, db, poisoned); got != c.warnings {
+				t.Errorf("the poisoned book has warnings %q, want %q", got, c.warnings)
+			}
+			if got := warningCodes(t, db, big); got != "too_large" {
+				t.Errorf("the book over --max-book-size has warnings %q", got)
+			}
+			var stack string
+			if err = db.QueryRow("SELECT detail FROM warnings WHERE file_id = ? AND code = 'panic'", poisoned).Scan(&stack); err != nil || !strings.Contains(stack, "poisonChunker") {
+				t.Errorf("the panic's stack is %q (%v)", stack, err)
+			}
+			if s := c.opts.timings.summary("chunk"); s.Failed != c.failed || s.SkippedTooLarge != 1 {
+				t.Errorf("the run summary has %d failed and %d skipped too large, want %d and 1", s.Failed, s.SkippedTooLarge, c.failed)
+			}
+		})
+	}
+}
+
+// warningCodes is the codes of the warnings about book id, in order.
+func warningCodes(t *testing.T, db *sql.DB, id int) string {
+	t.Helper()
+	var codes sql.NullString
+	if err := db.QueryRow("SELECT group_concat(code, ' ') FROM (SELECT code FROM warnings WHERE file_id = ? ORDER BY id)", id).Scan(&codes); err != nil {
+		t.Fatal(err)
+	}
+	return codes.String
+}
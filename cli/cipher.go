@@ -0,0 +1,48 @@
+//go:build sqlcipher
+
+package cli
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// cipherKey is applied to every pooled connection as it is opened; PRAGMA key
+// only affects the connection it runs on.
+var cipherKey string
+
+func init() {
+	sql.Register("sqlcipher", &sqlite3.SQLiteDriver{
+		ConnectHook: func(c *sqlite3.SQLiteConn) error {
+			if cipherKey == "" {
+				return nil
+			}
+			q := fmt.Sprintf("PRAGMA key = '%s'", strings.ReplaceAll(cipherKey, "'", "''"))
+			if _, err := c.Exec(q, nil); err != nil {
+				return fmt.Errorf("could not apply key: %w", err)
+			}
+
+			// plain sqlite silently ignores PRAGMA key, so make sure we are
+			// really talking to SQLCipher
+			rows, err := c.Query("PRAGMA cipher_version", nil)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			if rows.Next(make([]driver.Value, 1)) != nil {
+				return errors.New("built with the sqlcipher tag but not linked against SQLCipher")
+			}
+			return nil
+		},
+	})
+}
+
+func sqliteDriver(key string) (string, error) {
+	cipherKey = key
+	return "sqlcipher", nil
+}
@@ -0,0 +1,57 @@
+//go:build sqlcipher
+
+package cli
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// These need gutchunk built against SQLCipher, as go test -tags
+// "sqlcipher libsqlite3" is.
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	t.Setenv("GUTCHUNK_DB_KEY", "correct horse")
+	db := testFileDB(t)
+	id := addBook(t, db, "Emma", "Jane Austen", testBook("Emma", testParagraphs(3)))
+	db.Close()
+
+	raw, err := os.ReadFile(dbFile(dsn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.HasPrefix(raw, []byte("SQLite format 3")) || bytes.Contains(raw, []byte("weather and the moors")) {
+		t.Error("the database file is readable without the key")
+	}
+
+	db, err = openDB()
+	if err != nil {
+		t.Fatalf("opening again with the key: %v", err)
+	}
+	var name string
+	err = db.QueryRow("SELECT name FROM files WHERE id = ?", id).Scan(&name)
+	db.Close()
+	if err != nil || name != "Emma" {
+		t.Errorf("read back %q, %v; want Emma", name, err)
+	}
+
+	t.Setenv("GUTCHUNK_DB_KEY", "wrong horse")
+	if db, err = openDB(); err == nil {
+		db.Close()
+		t.Error("opened the database with the wrong key")
+	}
+}
+
+// Every connection of the pool gets the key, not just the first.
+func TestEncryptedPool(t *testing.T) {
+	t.Setenv("GUTCHUNK_DB_KEY", "correct horse")
+	db := testFileDB(t)
+	db.SetMaxIdleConns(0)
+	for i := 0; i < 4; i++ {
+		var n int
+		if err := db.QueryRow("SELECT count(*) FROM files").Scan(&n); err != nil {
+			t.Fatalf("connection %d: %v", i, err)
+		}
+	}
+}
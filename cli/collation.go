@@ -0,0 +1,90 @@
+package cli
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+)
+
+// books --sort title or author with --locale sorts as the locale's
+// collation has it (golang.org/x/text/collate), rather than by the folded
+// columns: "Ångström" after "Zola" with --locale sv, where it is a letter
+// of its own, and "Æsop" with the A's in English. Each book's keys for a
+// locale are kept in sort_keys, indexed by locale and key, so a listing a
+// page at a time still reads an index rather than sorting the table. A
+// locale's keys are made the first time it is asked for, for the books
+// without them, and a book's are dropped as its title or author changes
+// (see saveNameWords) and made again the next time.
+
+// sortLocale is the locale --locale names, as sort_keys keeps it.
+func sortLocale(name string) (string, error) {
+	tag, err := language.Parse(name)
+	if err != nil {
+		return "", fmt.Errorf("unknown locale %q: %w", name, err)
+	}
+	return tag.String(), nil
+}
+
+// bareTitle is title past its leading article, as sortTitle has it for a
+// folded one: "The Time Machine" sorts by "Time Machine" and "L'Homme qui
+// rit" by "Homme qui rit".
+func bareTitle(title string) string {
+	i := strings.IndexFunc(title, func(r rune) bool { return unicode.IsSpace(r) || r == '\'' || r == '’' })
+	if i <= 0 || !leadingArticles[strings.ToLower(title[:i])] {
+		return title
+	}
+	if rest := strings.TrimLeftFunc(title[i:], func(r rune) bool { return unicode.IsSpace(r) || r == '\'' || r == '’' }); rest != "" {
+		return rest
+	}
+	return title
+}
+
+// fillSortKeys makes the keys for locale of the books without them.
+func fillSortKeys(db *sql.DB, locale string) error {
+	rows, err := db.Query("SELECT id, coalesce(name, ''), coalesce(author, '') FROM files f WHERE NOT EXISTS (SELECT 1 FROM sort_keys k WHERE k.file_id = f.id AND k.locale = ?)", locale)
+	if err != nil {
+		return err
+	}
+	type names struct {
+		id            int64
+		title, author string
+	}
+	var todo []names
+	for rows.Next() {
+		var n names
+		if err = rows.Scan(&n.id, &n.title, &n.author); err != nil {
+			rows.Close()
+			return err
+		}
+		todo = append(todo, n)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || len(todo) == 0 {
+		return err
+	}
+
+	c := collate.New(language.Make(locale))
+	var buf collate.Buffer
+	return writerOf(db).do(func(tx *sql.Tx) error {
+		stmt, err := tx.Prepare("INSERT OR REPLACE INTO sort_keys (file_id, locale, title, title_bare, author) VALUES (?, ?, ?, ?, ?)")
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, n := range todo {
+			// the keys are made in buf, which each Reset reuses
+			title := append([]byte{}, c.KeyFromString(&buf, n.title)...)
+			bare := append([]byte{}, c.KeyFromString(&buf, bareTitle(n.title))...)
+			author := append([]byte{}, c.KeyFromString(&buf, n.author)...)
+			buf.Reset()
+			if _, err = stmt.Exec(n.id, locale, title, bare, author); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
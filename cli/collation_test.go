@@ -0,0 +1,129 @@
+package cli
+
+import (
+	"database/sql"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// sortedTitles are the titles of the books listBooks lists by q.
+func sortedTitles(t *testing.T, db *sql.DB, q bookListQuery) []string {
+	t.Helper()
+	books, total, err := listBooks(db, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != len(books) {
+		t.Errorf("%d books listed of %d", len(books), total)
+	}
+	titles := []string{}
+	for _, b := range books {
+		titles = append(titles, b.Title)
+	}
+	return titles
+}
+
+// sortedBooks is a database of books with titles accented, with articles
+// before them and in either case, each named as ingest names them.
+func sortedBooks(t *testing.T) *sql.DB {
+	db := testDB(t)
+	for _, title := range []string{"The Time Machine", "de la Mare", "Zuleika Dobson", "Émile", "Ångström Days", "A Tale of Two Cities", "apple", "L'Homme qui rit", "Bleak House"} {
+		id := addBook(t, db, title, "Someone", testBook(title, testParagraphs(1)))
+		if err := saveNameWords(db, int64(id), normalizeAuthor("Someone"), normalizeTitle(title)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestSortTitles(t *testing.T) {
+	db := sortedBooks(t)
+	tests := []struct {
+		name string
+		q    bookListQuery
+		want []string
+	}{
+		{"folded", bookListQuery{sort: "title"},
+			[]string{"A Tale of Two Cities", "Ångström Days", "apple", "Bleak House", "de la Mare", "Émile", "L'Homme qui rit", "The Time Machine", "Zuleika Dobson"}},
+		{"folded past articles", bookListQuery{sort: "title", ignoreArticles: true},
+			[]string{"Ångström Days", "apple", "Bleak House", "de la Mare", "Émile", "L'Homme qui rit", "A Tale of Two Cities", "The Time Machine", "Zuleika Dobson"}},
+		{"en", bookListQuery{sort: "title", locale: "en"},
+			[]string{"A Tale of Two Cities", "Ångström Days", "apple", "Bleak House", "de la Mare", "Émile", "L'Homme qui rit", "The Time Machine", "Zuleika Dobson"}},
+		{"en past articles", bookListQuery{sort: "title", locale: "en", ignoreArticles: true},
+			[]string{"Ångström Days", "apple", "Bleak House", "de la Mare", "Émile", "L'Homme qui rit", "A Tale of Two Cities", "The Time Machine", "Zuleika Dobson"}},
+		{"sv", bookListQuery{sort: "title", locale: "sv"},
+			[]string{"A Tale of Two Cities", "apple", "Bleak House", "de la Mare", "Émile", "L'Homme qui rit", "The Time Machine", "Zuleika Dobson", "Ångström Days"}},
+		{"sv descending", bookListQuery{sort: "title", locale: "sv", desc: true},
+			[]string{"Ångström Days", "Zuleika Dobson", "The Time Machine", "L'Homme qui rit", "Émile", "de la Mare", "Bleak House", "apple", "A Tale of Two Cities"}},
+	}
+	for _, tt := range tests {
+		if got := sortedTitles(t, db, tt.q); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: %q\nwant %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// A book renamed has its keys made again, as the new name sorts.
+func TestSortKeysRenamed(t *testing.T) {
+	db := sortedBooks(t)
+	q := bookListQuery{sort: "title", locale: "en"}
+	sortedTitles(t, db, q)
+	var id int64
+	if err := db.QueryRow("SELECT id FROM files WHERE name = 'apple'").Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE files SET name = 'Zyzzyva', title_norm = 'zyzzyva' WHERE id = ?", id); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveNameWords(db, id, normalizeAuthor("Someone"), "zyzzyva"); err != nil {
+		t.Fatal(err)
+	}
+	got := sortedTitles(t, db, q)
+	if got[len(got)-1] != "Zyzzyva" {
+		t.Errorf("renamed, the book isn't last: %q", got)
+	}
+}
+
+func TestSortKeysIndexed(t *testing.T) {
+	db := sortedBooks(t)
+	if err := fillSortKeys(db, "en"); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.Query("EXPLAIN QUERY PLAN SELECT f.id FROM sort_keys sk JOIN files f ON f.id = sk.file_id AND sk.locale = ? ORDER BY sk.title LIMIT 5", "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	plan := ""
+	for rows.Next() {
+		var id, parent, unused int
+		var detail string
+		if err = rows.Scan(&id, &parent, &unused, &detail); err != nil {
+			t.Fatal(err)
+		}
+		plan += detail + "\n"
+	}
+	if !strings.Contains(plan, "sort_keys_title ") || strings.Contains(plan, "TEMP B-TREE") {
+		t.Errorf("not sorted by the index:\n%s", plan)
+	}
+}
+
+func TestBareTitle(t *testing.T) {
+	for title, want := range map[string]string{
+		"The Time Machine": "Time Machine",
+		"L'Homme qui rit":  "Homme qui rit",
+		"L’Homme qui rit":  "Homme qui rit",
+		"Die Verwandlung":  "Verwandlung",
+		"The":              "The",
+		"Theory of Light":  "Theory of Light",
+		"An":               "An",
+	} {
+		if got := bareTitle(title); got != want {
+			t.Errorf("bareTitle(%q) = %q, want %q", title, got, want)
+		}
+	}
+	if _, err := sortLocale("not a locale!"); err == nil {
+		t.Error("a bad locale was taken")
+	}
+}
@@ -0,0 +1,313 @@
+package cli
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// check-complete looks for books that were cut short on the way in, by a
+// partial download, a bad zip or a scanner's line limit, by how their
+// bodies end, and sets each book's files.completeness to complete or
+// incomplete, with the reasons for the second in completeness_reasons.
+// The footer is the first thing a truncation loses, so a book with an END
+// marker is complete however it ends, and one with a START marker and no
+// END marker is incomplete. A book with no markers at all is incomplete
+// when its body both ends mid-sentence and is far shorter than the median
+// of the books of its type in the catalog (see gutchunk catalog); either
+// alone is no more than a short poem, or one whose last line has no stop.
+// For an incomplete book the other two are given as reasons as well when
+// they hold. An override's start and end count as its markers.
+
+const (
+	completenessComplete   = "complete"
+	completenessIncomplete = "incomplete"
+)
+
+// codes of the reasons a book is incomplete
+const (
+	reasonNoEnd       = "no_end_marker"
+	reasonMidSentence = "mid_sentence"
+	reasonShort       = "short"
+)
+
+const (
+	// a body under this part of its type's median is short for it
+	shortFraction = 10
+	// the fewest books of a type whose median is taken
+	minMedianBooks = 20
+)
+
+// bookEnding is what check-complete reads of how one book's body ends.
+type bookEnding struct {
+	id        int
+	archive   string
+	ebook     int
+	kind      string
+	bodyBytes int
+	// has a START marker or an override's start, and an END marker that
+	// closes its body or an override's end
+	started, ended bool
+	lastLine       string
+}
+
+type completenessCheck struct {
+	ID      int      `json:"id"`
+	Archive string   `json:"archive"`
+	Ebook   int      `json:"ebook,omitempty"`
+	Reasons []string `json:"reasons"`
+	Detail  string   `json:"detail"`
+}
+
+type completenessReport struct {
+	Books      int `json:"books"`
+	Complete   int `json:"complete"`
+	Incomplete int `json:"incomplete"`
+	// the median body bytes of each catalog type taken, "" for books
+	// not in the catalog
+	Medians map[string]int `json:"medians"`
+	// every incomplete book, by id
+	Problems []completenessCheck `json:"problems"`
+}
+
+func checkCompleteCmd(args []string) error {
+	fs := flag.NewFlagSet("check-complete", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the report as json")
+	dryRun := fs.Bool("dry-run", false, "report without setting files.completeness")
+	paths := fs.String("paths", "", "write the archives of incomplete books to this file, for ingest --paths-file")
+	ids := fs.String("ids", "", "write the ebook numbers of incomplete books to this file, for ingest --from-url --ids-file")
+	loadOverrides := overridesFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return usagef("usage: gutchunk check-complete [--dry-run] [--json] [--paths FILE] [--ids FILE] [--overrides FILE]")
+	}
+	ovr, err := loadOverrides()
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	endings, err := readEndings(db, ovr)
+	if err != nil {
+		return err
+	}
+	rep := judgeEndings(endings)
+	if !*dryRun {
+		if err = saveCompleteness(db, endings, rep); err != nil {
+			return err
+		}
+	}
+	if *paths != "" {
+		lines := []string{}
+		for _, c := range rep.Problems {
+			if c.Archive != "" && !strings.Contains(c.Archive, "://") {
+				lines = append(lines, c.Archive)
+			}
+		}
+		if err = writeLines(*paths, lines); err != nil {
+			return err
+		}
+	}
+	if *ids != "" {
+		lines := []string{}
+		for _, c := range rep.Problems {
+			if c.Ebook != 0 {
+				lines = append(lines, fmt.Sprint(c.Ebook))
+			}
+		}
+		if err = writeLines(*ids, lines); err != nil {
+			return err
+		}
+	}
+	if *asJSON {
+		if err = json.NewEncoder(os.Stdout).Encode(rep); err != nil {
+			return err
+		}
+	} else {
+		printCompleteness(rep)
+	}
+	if len(rep.Problems) > 0 {
+		return exitStatus(1)
+	}
+	return nil
+}
+
+// readEndings finds the body of each current book with content, as chunk
+// would with the overrides ovr, and reads how it ends.
+func readEndings(db *sql.DB, ovr *overrides) ([]bookEnding, error) {
+	rows, err := db.Query(`SELECT f.id, coalesce(f.name, ''), coalesce(f.author, ''), coalesce(f.filename, ''), coalesce(f.ebook, 0),
+			coalesce(f.language, ''), coalesce(f.body_only, 0), coalesce(f.archive, ''), coalesce(c.type, ''), ` + contentCol("f.") + `
+		FROM files f LEFT JOIN catalog c ON c.ebook = f.ebook
+		WHERE f.deleted_at IS NULL AND f.superseded_by IS NULL AND ` + hasContent("f.") + `
+		ORDER BY f.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	endings := []bookEnding{}
+	for rows.Next() {
+		var b bookfile
+		var e bookEnding
+		if err = rows.Scan(&b.ID, &b.Name, &b.Author, &b.Filename, &b.Ebook, &b.Language, &b.BodyOnly, &e.archive, &e.kind, &b.Content); err != nil {
+			return nil, err
+		}
+		opts, err := ovr.apply(b, chunkOptions{bodyOnly: b.BodyOnly})
+		if err != nil {
+			return nil, fmt.Errorf("book %d: %w", b.ID, err)
+		}
+		e.id, e.ebook = b.ID, b.Ebook
+		readEnding(&e, b.Content, opts)
+		endings = append(endings, e)
+	}
+	return endings, rows.Err()
+}
+
+// readEnding fills in e from content, whose body opts find. A book with no
+// START marker and nothing in opts to start it is body from the top.
+func readEnding(e *bookEnding, content string, opts chunkOptions) {
+	body, m := opts.body(content)
+	e.started = m.Starts > 0 || opts.start != nil || opts.startLine > 0
+	if !e.started && !opts.bodyOnly {
+		body = contentLines(content)
+	}
+	e.ended = opts.end != nil || opts.endLine > 0
+	if !e.ended {
+		for _, l := range contentLines(content) {
+			if isEnd(l) {
+				e.ended = true
+				break
+			}
+		}
+	}
+	for _, l := range body {
+		e.bodyBytes += len(l) + 1
+	}
+	for i := len(body) - 1; i >= 0; i-- {
+		if body[i] != "" {
+			e.lastLine = body[i]
+			break
+		}
+	}
+}
+
+// endsSentence reports whether line ends as the last line of a finished
+// text does: with a stop, after which only closing quotes, brackets and
+// emphasis may follow, or as THE END or FINIS.
+func endsSentence(line string) bool {
+	line = strings.TrimRight(line, "\"'”’»)]_* ")
+	switch strings.ToUpper(strings.TrimRight(line, ".!")) {
+	case "THE END", "END", "FINIS":
+		return true
+	}
+	r, _ := utf8.DecodeLastRuneInString(line)
+	return strings.ContainsRune(".!?…", r)
+}
+
+// judgeEndings reports which of endings are incomplete.
+func judgeEndings(endings []bookEnding) completenessReport {
+	rep := completenessReport{Medians: map[string]int{}, Problems: []completenessCheck{}}
+	byKind := map[string][]int{}
+	for _, e := range endings {
+		byKind[e.kind] = append(byKind[e.kind], e.bodyBytes)
+	}
+	for kind, sizes := range byKind {
+		if len(sizes) >= minMedianBooks {
+			sort.Ints(sizes)
+			rep.Medians[kind] = sizes[len(sizes)/2]
+		}
+	}
+	for _, e := range endings {
+		rep.Books++
+		c, ok := judgeEnding(e, rep.Medians)
+		if !ok {
+			rep.Complete++
+			continue
+		}
+		rep.Incomplete++
+		rep.Problems = append(rep.Problems, c)
+	}
+	return rep
+}
+
+// judgeEnding says why e is incomplete, ok false when it isn't.
+func judgeEnding(e bookEnding, medians map[string]int) (c completenessCheck, ok bool) {
+	c = completenessCheck{ID: e.id, Archive: e.archive, Ebook: e.ebook, Reasons: []string{}}
+	details := []string{}
+	if e.started && !e.ended {
+		c.Reasons = append(c.Reasons, reasonNoEnd)
+		details = append(details, "a START marker and no END marker")
+	}
+	mid := e.lastLine != "" && !endsSentence(e.lastLine)
+	if mid {
+		c.Reasons = append(c.Reasons, reasonMidSentence)
+		details = append(details, fmt.Sprintf("ends mid-sentence at %q", clip(lastWords(e.lastLine, 8), 60)))
+	}
+	median, known := medians[e.kind]
+	short := known && e.bodyBytes*shortFraction < median
+	if short {
+		c.Reasons = append(c.Reasons, reasonShort)
+		of := "books not in the catalog"
+		if e.kind != "" {
+			of = "the catalog's " + e.kind + " books"
+		}
+		details = append(details, fmt.Sprintf("a body of %s, against %s for %s", formatSize(int64(e.bodyBytes)), formatSize(int64(median)), of))
+	}
+	c.Detail = strings.Join(details, "; ")
+	return c, !e.ended && (e.started || mid && short)
+}
+
+// lastWords is the last n words of line.
+func lastWords(line string, n int) string {
+	words := strings.FieldsFunc(line, unicode.IsSpace)
+	if len(words) > n {
+		words = append([]string{"…"}, words[len(words)-n:]...)
+	}
+	return strings.Join(words, " ")
+}
+
+// saveCompleteness sets the completeness of each of endings as rep has it.
+func saveCompleteness(db *sql.DB, endings []bookEnding, rep completenessReport) error {
+	reasons := map[int]string{}
+	for _, c := range rep.Problems {
+		reasons[c.ID] = strings.Join(c.Reasons, ",")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare("UPDATE files SET completeness = ?, completeness_reasons = ? WHERE id = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, e := range endings {
+		status := completenessComplete
+		why, ok := reasons[e.id]
+		if ok {
+			status = completenessIncomplete
+		}
+		if _, err = stmt.Exec(status, nullString(why), e.id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func printCompleteness(rep completenessReport) {
+	for _, c := range rep.Problems {
+		fmt.Printf("book %d (%s): %s\n", c.ID, c.Archive, c.Detail)
+	}
+	fmt.Printf("checked %d books: %d complete, %d incomplete\n", rep.Books, rep.Complete, rep.Incomplete)
+}
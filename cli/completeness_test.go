@@ -0,0 +1,207 @@
+package cli
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var (
+	finished = testBook("Finished", testParagraphs(3)+"\n\nTHE END")
+	// a download that stopped partway, the footer and all after the cut
+	chopped = strings.SplitAfter(testBook("Chopped", testParagraphs(3)+"\n\nAnd then the door opened, and in came the last of them, who said"), " who said")[0]
+	// no markers, a few lines and the last ends with a stop: a short poem
+	poem = "A Short Poem\n\nThe rain is on the roof,\nThe wind is at the door;\nAnd no one comes\nTo the house any more.\n"
+)
+
+func TestEndsSentence(t *testing.T) {
+	for _, c := range []struct {
+		line string
+		want bool
+	}{
+		{"And that was all.", true},
+		{"Was it?", true},
+		{"Never again!", true},
+		{"and so on…", true},
+		{`"I shall," said he.”`, true},
+		{"(as it was written.)", true},
+		{"_Finis._", true},
+		{"THE END", true},
+		{"The End.", true},
+		{"FINIS", true},
+		{"and then the door opened and", false},
+		{"they went on,", false},
+		{"the last of the", false},
+		{"“and so—", false},
+	} {
+		if got := endsSentence(c.line); got != c.want {
+			t.Errorf("endsSentence(%q) = %v, want %v", c.line, got, c.want)
+		}
+	}
+}
+
+func TestReadEnding(t *testing.T) {
+	for _, c := range []struct {
+		name, content  string
+		started, ended bool
+		lastLine       string
+	}{
+		{"finished", finished, true, true, "THE END"},
+		{"chopped", chopped, true, false, "And then the door opened, and in came the last of them, who said"},
+		{"poem", poem, false, false, "To the house any more."},
+	} {
+		var e bookEnding
+		readEnding(&e, c.content, chunkOptions{})
+		if e.started != c.started || e.ended != c.ended || e.lastLine != c.lastLine || e.bodyBytes == 0 {
+			t.Errorf("%s: started %v, ended %v, last line %q, %d bytes, want %v, %v, %q", c.name, e.started, e.ended, e.lastLine, e.bodyBytes, c.started, c.ended, c.lastLine)
+		}
+	}
+	// an override's end is as good as an END marker
+	var e bookEnding
+	readEnding(&e, chopped, chunkOptions{endLine: 6})
+	if !e.started || !e.ended {
+		t.Errorf("chopped with an override's end: started %v, ended %v", e.started, e.ended)
+	}
+}
+
+func TestJudgeEndings(t *testing.T) {
+	// twenty novels of about 100k make the median; each case is judged
+	// among them
+	catalog := func(extra bookEnding, n int) []bookEnding {
+		var endings []bookEnding
+		for i := 0; i < n; i++ {
+			endings = append(endings, bookEnding{id: 100 + i, kind: "Text", bodyBytes: 100000 + i, started: true, ended: true, lastLine: "The end."})
+		}
+		return append(endings, extra)
+	}
+	for _, c := range []struct {
+		name    string
+		e       bookEnding
+		books   int
+		reasons string
+	}{
+		{"finished", bookEnding{id: 1, kind: "Text", bodyBytes: 90000, started: true, ended: true, lastLine: "THE END"}, 20, ""},
+		// the footer says it's whole, however it ends
+		{"ended mid-sentence", bookEnding{id: 1, kind: "Text", bodyBytes: 500, started: true, ended: true, lastLine: "and so"}, 20, ""},
+		{"chopped", bookEnding{id: 1, kind: "Text", bodyBytes: 90000, started: true, lastLine: "in came the"}, 20, "no_end_marker,mid_sentence"},
+		{"chopped short", bookEnding{id: 1, kind: "Text", bodyBytes: 900, started: true, lastLine: "in came the"}, 20, "no_end_marker,mid_sentence,short"},
+		{"chopped at a stop", bookEnding{id: 1, kind: "Text", bodyBytes: 90000, started: true, lastLine: "They went in."}, 20, "no_end_marker"},
+		// without markers it takes both
+		{"short poem", bookEnding{id: 1, kind: "Text", bodyBytes: 300, lastLine: "To the house any more."}, 20, ""},
+		{"long, without a stop", bookEnding{id: 1, kind: "Text", bodyBytes: 90000, lastLine: "and so"}, 20, ""},
+		{"short, without a stop", bookEnding{id: 1, kind: "Text", bodyBytes: 300, lastLine: "and so"}, 20, "mid_sentence,short"},
+		// a tenth of the median is short, and no shorter
+		{"a tenth of the median", bookEnding{id: 1, kind: "Text", bodyBytes: 10001, lastLine: "and so"}, 20, ""},
+		// too few of its type to take a median of, it can't be short
+		{"short, without a stop, among few", bookEnding{id: 1, kind: "Text", bodyBytes: 300, lastLine: "and so"}, 18, ""},
+		// nor the median of another type taken for it
+		{"short, without a stop, of another type", bookEnding{id: 1, kind: "Sound", bodyBytes: 300, lastLine: "and so"}, 20, ""},
+	} {
+		rep := judgeEndings(catalog(c.e, c.books))
+		var got []string
+		for _, p := range rep.Problems {
+			if p.ID == c.e.id {
+				got = append(got, strings.Join(p.Reasons, ","))
+			}
+		}
+		if strings.Join(got, "") != c.reasons || rep.Books != c.books+1 || rep.Complete+rep.Incomplete != rep.Books {
+			t.Errorf("%s: reasons %q of %d books, %d complete, want %q", c.name, got, rep.Books, rep.Complete, c.reasons)
+		}
+	}
+
+	// twenty of a type, counting the one judged, have their median taken
+	rep := judgeEndings(catalog(bookEnding{id: 1, kind: "Text", bodyBytes: 300, lastLine: "and so"}, 19))
+	if rep.Medians["Text"] != 100009 || rep.Incomplete != 1 {
+		t.Errorf("of twenty books, medians %v and %d incomplete", rep.Medians, rep.Incomplete)
+	}
+	rep = judgeEndings(catalog(bookEnding{id: 1, kind: "Sound", bodyBytes: 300}, 18))
+	if len(rep.Medians) != 0 {
+		t.Errorf("medians %v of fewer than %d books", rep.Medians, minMedianBooks)
+	}
+}
+
+func TestCheckCompleteCmd(t *testing.T) {
+	db := testDB(t)
+	for _, b := range []struct {
+		name, content, archive string
+		ebook                  int
+	}{
+		{"Finished", finished, "1/0/100/100.zip", 100},
+		{"Chopped", chopped, "2/0/200/200.zip", 200},
+		{"A Short Poem", poem, "3/0/300/300.zip", 300},
+		// fetched, with no archive of the mirror to fetch again
+		{"Chopped Too", strings.Replace(chopped, "Chopped", "Chopped Too", -1), "https://www.gutenberg.org/ebooks/400.txt.utf-8", 400},
+	} {
+		id := addBook(t, db, b.name, "Someone", b.content)
+		if _, err := db.Exec("UPDATE files SET archive = ?, ebook = ? WHERE id = ?", b.archive, b.ebook, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := captureStdout(t, func() error { return makeChunks(db, chunkOptions{}) }); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	paths, ids := filepath.Join(dir, "paths"), filepath.Join(dir, "ids")
+	out, err := captureStdout(t, func() error { return checkCompleteCmd([]string{"--paths", paths, "--ids", ids}) })
+	if exitCode(err) != 1 {
+		t.Fatalf("check-complete with books incomplete: %v", err)
+	}
+	for _, want := range []string{
+		`book 2 (2/0/200/200.zip): a START marker and no END marker; ends mid-sentence at "… in came the last of them, who said"`,
+		"checked 4 books: 2 complete, 2 incomplete",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("check-complete doesn't say %q:\n%s", want, out)
+		}
+	}
+	// only the archives of the mirror, but the ebook numbers of both
+	for file, want := range map[string]string{paths: "2/0/200/200.zip\n", ids: "200\n400\n"} {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Errorf("%s is %q, want %q", filepath.Base(file), b, want)
+		}
+	}
+	if got := names(t, db, "SELECT name || ' ' || completeness || ' ' || coalesce(completeness_reasons, '') FROM files ORDER BY id"); got != "Finished complete \n"+
+		"Chopped incomplete no_end_marker,mid_sentence\nA Short Poem complete \nChopped Too incomplete no_end_marker,mid_sentence\n" {
+		t.Errorf("check-complete set\n%s", got)
+	}
+
+	// the incomplete left out of export and random, with --complete-only
+	complete := exported(t, "--complete-only")
+	for _, l := range complete {
+		var c struct{ SourceID int }
+		if err = json.Unmarshal([]byte(l), &c); err != nil {
+			t.Fatal(err)
+		}
+		if c.SourceID != 1 && c.SourceID != 3 {
+			t.Errorf("export --complete-only exported a chunk of book %d", c.SourceID)
+		}
+	}
+	if all := exported(t); len(complete) == 0 || len(all) <= len(complete) {
+		t.Errorf("export exported %d chunks, and %d with --complete-only", len(all), len(complete))
+	}
+	for seed := 1; seed <= 20; seed++ {
+		out, err := captureStdout(t, func() error { return randomCmd([]string{"--complete-only", "--seed", strconv.Itoa(seed)}) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out, "— Finished, by Someone\n") && !strings.Contains(out, "— A Short Poem, by Someone\n") {
+			t.Errorf("random --complete-only drew\n%s", out)
+		}
+	}
+
+	// once the books are whole, nothing is incomplete and it exits 0
+	if _, err = db.Exec("UPDATE files SET content = ?, content_hash = NULL WHERE name LIKE 'Chopped%'", finished); err != nil {
+		t.Fatal(err)
+	}
+	if out, err = captureStdout(t, func() error { return checkCompleteCmd(nil) }); err != nil || !strings.Contains(out, "checked 4 books: 4 complete, 0 incomplete") {
+		t.Errorf("check-complete of books all complete: %v\n%s", err, out)
+	}
+}
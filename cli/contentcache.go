@@ -0,0 +1,113 @@
+package cli
+
+import (
+	"container/list"
+	"sync"
+)
+
+// A connection's own few books (see refContent) are its alone and are
+// dropped whenever anything writes, so serve, its requests spread over
+// the pool's connections, would read a book's whole content again for
+// most chunks of it it serves. serve --content-cache keeps the content of
+// the books read most lately across all its connections as well, by book
+// id and content hash: a book whose content has changed under the same id
+// hashes differently and misses, so nothing has to drop the cache, and
+// what is left stale ages out. Books with no content hash aren't kept. It holds at most so
+// many books and so many bytes of them, evicting the least lately read
+// before it takes another, and a book larger than the whole budget isn't
+// kept at all.
+
+type contentKey struct {
+	id   int64
+	hash string
+}
+
+type cachedContent struct {
+	key     contentKey
+	content *string
+}
+
+type contentCache struct {
+	maxEntries int
+	maxBytes   int64
+
+	mu    sync.Mutex
+	bytes int64
+	// the latest read at the front
+	order *list.List
+	items map[contentKey]*list.Element
+
+	hits, misses, evictions int64
+}
+
+// sharedContent is the cache the chunks view of every connection reads
+// through, nil for none.
+var sharedContent *contentCache
+
+func newContentCache(entries int, bytes int64) *contentCache {
+	return &contentCache{maxEntries: entries, maxBytes: bytes, order: list.New(), items: map[contentKey]*list.Element{}}
+}
+
+func (c *contentCache) get(key contentKey) (*string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(e)
+	return e.Value.(*cachedContent).content, true
+}
+
+func (c *contentCache) put(key contentKey, content *string) {
+	size := contentSize(content)
+	if size > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		// another connection read it in the meantime
+		c.order.MoveToFront(e)
+		return
+	}
+	for c.order.Len() > 0 && (c.order.Len() >= c.maxEntries || c.bytes+size > c.maxBytes) {
+		c.evict(c.order.Back())
+	}
+	c.items[key] = c.order.PushFront(&cachedContent{key: key, content: content})
+	c.bytes += size
+}
+
+func (c *contentCache) evict(e *list.Element) {
+	cc := e.Value.(*cachedContent)
+	c.order.Remove(e)
+	delete(c.items, cc.key)
+	c.bytes -= contentSize(cc.content)
+	c.evictions++
+}
+
+func contentSize(content *string) int64 {
+	if content == nil {
+		return 0
+	}
+	return int64(len(*content))
+}
+
+type contentCacheStats struct {
+	Books     int   `json:"books"`
+	Bytes     int64 `json:"bytes"`
+	MaxBooks  int   `json:"max_books"`
+	MaxBytes  int64 `json:"max_bytes"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+}
+
+func (c *contentCache) stats() contentCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return contentCacheStats{Books: c.order.Len(), Bytes: c.bytes, MaxBooks: c.maxEntries, MaxBytes: c.maxBytes,
+		Hits: c.hits, Misses: c.misses, Evictions: c.evictions}
+}
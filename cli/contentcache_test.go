@@ -0,0 +1,173 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestContentCache(t *testing.T) {
+	text := func(n int) *string {
+		s := strings.Repeat("x", n)
+		return &s
+	}
+	key := func(id int64) contentKey { return contentKey{id, fmt.Sprint("hash", id)} }
+	kept := func(c *contentCache) string {
+		var ids []string
+		for e := c.order.Front(); e != nil; e = e.Next() {
+			ids = append(ids, fmt.Sprint(e.Value.(*cachedContent).key.id))
+		}
+		return strings.Join(ids, " ")
+	}
+
+	// by the books kept, the least lately read goes first
+	c := newContentCache(3, 1000)
+	for id := int64(1); id <= 3; id++ {
+		c.put(key(id), text(10))
+	}
+	if _, ok := c.get(key(1)); !ok {
+		t.Fatal("book 1 isn't kept")
+	}
+	c.put(key(4), text(10))
+	if got := kept(c); got != "4 1 3" {
+		t.Errorf("kept %s, want 4 1 3", got)
+	}
+	// a book put again is only read
+	c.put(key(3), text(10))
+	if got := kept(c); got != "3 4 1" {
+		t.Errorf("put again, kept %s, want 3 4 1", got)
+	}
+	// another hash for the same book is another book
+	if _, ok := c.get(contentKey{3, "changed"}); ok {
+		t.Error("book 3 with another hash is kept")
+	}
+	if st := c.stats(); st != (contentCacheStats{Books: 3, Bytes: 30, MaxBooks: 3, MaxBytes: 1000, Hits: 1, Misses: 1, Evictions: 1}) {
+		t.Errorf("the stats are %+v", st)
+	}
+
+	// by bytes, as many go as make room, before the book is taken
+	c = newContentCache(10, 100)
+	for id := int64(1); id <= 4; id++ {
+		c.put(key(id), text(25))
+	}
+	c.put(key(5), text(60))
+	if got, st := kept(c), c.stats(); got != "5 4" || st.Bytes != 85 || st.Evictions != 3 {
+		t.Errorf("kept %s in %d bytes, want 5 4 in 85", got, st.Bytes)
+	}
+	// one larger than the budget isn't kept, nor is anything dropped for it
+	c.put(key(6), text(101))
+	if got := kept(c); got != "5 4" {
+		t.Errorf("with a book over the budget put, kept %s", got)
+	}
+	c.put(key(7), nil)
+	if content, ok := c.get(key(7)); !ok || content != nil {
+		t.Error("a book with no content isn't kept as such")
+	}
+
+	// however many read and put at once, the budget holds
+	c = newContentCache(50, 10000)
+	var wg sync.WaitGroup
+	over := make(chan int64, 1)
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				id := int64(w*1000 + i%70)
+				if _, ok := c.get(key(id)); !ok {
+					c.put(key(id), text(100+(i*37)%900))
+				}
+				if st := c.stats(); st.Bytes > st.MaxBytes || st.Books > st.MaxBooks {
+					select {
+					case over <- st.Bytes:
+					default:
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	select {
+	case b := <-over:
+		t.Errorf("the cache held %d bytes, over its budget", b)
+	default:
+	}
+	st := c.stats()
+	var bytes int64
+	for e := c.order.Front(); e != nil; e = e.Next() {
+		bytes += contentSize(e.Value.(*cachedContent).content)
+	}
+	if bytes != st.Bytes || len(c.items) != st.Books || st.Hits+st.Misses != 8*500 {
+		t.Errorf("after reads at once, the cache holds %d bytes, counting %+v", bytes, st)
+	}
+}
+
+func TestSharedContentCache(t *testing.T) {
+	db := testDB(t)
+	for i := 0; i < 6; i++ {
+		title := fmt.Sprint("Book ", i+1)
+		addBook(t, db, title, "", testBook(title, testParagraphs(3)))
+	}
+	if _, err := captureStdout(t, func() error { return makeChunks(db, chunkOptions{}) }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := captureStdout(t, func() error { return convertStorageCmd([]string{"--mode", storageReference}) }); err != nil {
+		t.Fatal(err)
+	}
+	refs, err := openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer refs.Close()
+	// one connection, keeping the last few books it read of its own
+	refs.SetMaxOpenConns(1)
+	sharedContent = newContentCache(64, 1<<20)
+	defer func() { sharedContent = nil }()
+
+	first := func(book int) string {
+		t.Helper()
+		var chunk string
+		if err := refs.QueryRow("SELECT chunk FROM chunks WHERE sourceid = ? ORDER BY ordinal LIMIT 1", book).Scan(&chunk); err != nil {
+			t.Fatal(err)
+		}
+		return chunk
+	}
+	// six books, more than the connection keeps, read over twice
+	for pass := 0; pass < 2; pass++ {
+		for book := 1; book <= 6; book++ {
+			if got := first(book); !strings.HasPrefix(got, "It was a paragraph of the book, number i, ") {
+				t.Fatalf("book %d's first chunk reads %q", book, got)
+			}
+		}
+	}
+	if st := sharedContent.stats(); st.Misses != 6 || st.Hits != 6 || st.Books != 6 {
+		t.Errorf("read twice over, the cache counts %+v", st)
+	}
+
+	// a book's content changed, the cache misses it and reads the new
+	var content string
+	if err = db.QueryRow("SELECT content FROM files WHERE id = 1").Scan(&content); err != nil {
+		t.Fatal(err)
+	}
+	content = strings.ReplaceAll(content, "weather", "climate")
+	if _, err = db.Exec("UPDATE files SET content = ?, content_hash = ? WHERE id = 1", content, textHash(content)); err != nil {
+		t.Fatal(err)
+	}
+	if got := first(1); !strings.Contains(got, "about the climate") {
+		t.Errorf("with its content changed, book 1's first chunk reads %q", got)
+	}
+	if st := sharedContent.stats(); st.Misses != 7 || st.Books != 7 {
+		t.Errorf("with a book's content changed, the cache counts %+v", st)
+	}
+
+	// and /metrics says so
+	w := httptest.NewRecorder()
+	testServer(t, db).routes().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	var m metrics
+	if err = json.Unmarshal(w.Body.Bytes(), &m); err != nil || m.ContentCache == nil || m.ContentCache.Misses != 7 || m.ContentCache.MaxBooks != 64 {
+		t.Errorf("GET /metrics: %s", w.Body)
+	}
+}
@@ -0,0 +1,309 @@
+package cli
+
+import (
+	"bufio"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// gutchunk flag-content --wordlist words.txt looks for the terms of a
+// wordlist in every chunk, a term to a line, # for comments, and writes
+// how many times each is in each chunk to content_flags. random, export,
+// presets, /chunks/random and /search take --exclude-flagged
+// (?exclude_flagged=true) to leave the chunks with any out, for screening
+// what goes to an all-ages audience, say; no wordlist comes with gutchunk,
+// and any list of terms tags chunks as well.
+//
+// Terms and text are folded first (see fold.go), so case and diacritics
+// don't matter. A term matches only as a whole word, the characters either
+// side of it being neither letters nor digits, so a term inside an
+// innocent word, as in Scunthorpe, isn't found. It matches a few ways of
+// disguising it too: each letter repeated, letters split by a dot, dash or
+// underscore, and the commonest substitutions, 4 or @ for a, 3 for e, 0
+// for o, $ or 5 for s, a * for any vowel and so on. A term of several
+// words matches them with any white space between.
+//
+// content_scans keeps the hash of the wordlist each chunk was last scanned
+// with, and flag-content scans only the chunks not scanned with the one it
+// is given: new chunks after a run of chunk, or them all once the list is
+// edited. Rescanning a chunk replaces its flags.
+
+// contentFlagged is whether chunk c has any flags.
+const contentFlagged = "EXISTS (SELECT 1 FROM content_flags cf WHERE cf.chunk_id = c.id)"
+
+// wordlistVersion is part of a wordlist's hash, to be raised when how terms
+// match changes, so every chunk is scanned again.
+const wordlistVersion = 1
+
+// termVariants are the characters each letter of a term matches besides
+// itself.
+var termVariants = map[rune]string{
+	'a': "@4*", 'b': "8", 'e': "3*", 'g': "9", 'i': "1!|*", 'l': "1|",
+	'o': "0*", 's': "$5", 't': "7+", 'u': "*v", 'y': "*",
+}
+
+// wordlist is the terms of a wordlist file, folded, and what matches them.
+type wordlist struct {
+	terms []string
+	hash  string
+	re    *regexp.Regexp
+}
+
+// parseWordlist reads the terms of text, a term to a line.
+func parseWordlist(text string) (*wordlist, error) {
+	seen := map[string]bool{}
+	w := &wordlist{}
+	for _, line := range strings.Split(text, "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		term := strings.Join(strings.Fields(fold(line)), " ")
+		if term == "" || seen[term] {
+			continue
+		}
+		seen[term] = true
+		w.terms = append(w.terms, term)
+	}
+	if len(w.terms) == 0 {
+		return nil, fmt.Errorf("no terms")
+	}
+	// the longest first, so a term isn't passed over for one it starts
+	// with that isn't a whole word there
+	sort.Slice(w.terms, func(i, j int) bool {
+		if len(w.terms[i]) != len(w.terms[j]) {
+			return len(w.terms[i]) > len(w.terms[j])
+		}
+		return w.terms[i] < w.terms[j]
+	})
+	sorted := append([]string(nil), w.terms...)
+	sort.Strings(sorted)
+	w.hash = textHash(fmt.Sprintf("%d\n%s", wordlistVersion, strings.Join(sorted, "\n")))
+	alts := make([]string, len(w.terms))
+	for i, t := range w.terms {
+		alts[i] = "(" + termPattern(t) + ")"
+	}
+	var err error
+	w.re, err = regexp.Compile(strings.Join(alts, "|"))
+	return w, err
+}
+
+func loadWordlist(path string) (*wordlist, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	w, err := parseWordlist(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return w, nil
+}
+
+// termPattern is the regexp matching term, folded, and its disguises.
+func termPattern(term string) string {
+	var b strings.Builder
+	prev := false
+	for _, word := range strings.Fields(term) {
+		if prev {
+			b.WriteString(`\s+`)
+		}
+		prev = true
+		letters := []rune(word)
+		for i, r := range letters {
+			if i > 0 && unicode.IsLetter(letters[i-1]) && unicode.IsLetter(r) {
+				b.WriteString(`[._-]?`)
+			}
+			if v, ok := termVariants[r]; ok {
+				b.WriteString("[" + regexp.QuoteMeta(string(r)+v) + "]+")
+			} else if unicode.IsLetter(r) {
+				b.WriteString(regexp.QuoteMeta(string(r)) + "+")
+			} else {
+				b.WriteString(regexp.QuoteMeta(string(r)))
+			}
+		}
+	}
+	return b.String()
+}
+
+// wordRune is whether r is part of a word, for where a term may start and
+// end.
+func wordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// count is how many times each term is in text as a whole word.
+func (w *wordlist) count(text string) map[string]int {
+	text = fold(text)
+	var found map[string]int
+	for at := 0; at < len(text); {
+		m := w.re.FindStringSubmatchIndex(text[at:])
+		if m == nil {
+			break
+		}
+		start, end := at+m[0], at+m[1]
+		before, _ := utf8.DecodeLastRuneInString(text[:start])
+		after, _ := utf8.DecodeRuneInString(text[end:])
+		if start > 0 && wordRune(before) || end < len(text) && wordRune(after) {
+			// a part of a word, after which a term may still start
+			_, size := utf8.DecodeRuneInString(text[start:])
+			at = start + size
+			continue
+		}
+		for i := range w.terms {
+			if m[2+2*i] >= 0 {
+				if found == nil {
+					found = map[string]int{}
+				}
+				found[w.terms[i]]++
+				break
+			}
+		}
+		if end == start {
+			end++
+		}
+		at = end
+	}
+	return found
+}
+
+func flagContentCmd(args []string) error {
+	fs := flag.NewFlagSet("flag-content", flag.ExitOnError)
+	path := fs.String("wordlist", "", "file of the terms to flag chunks for, one per line, # for comments")
+	report := fs.Bool("report", false, "then list each term with how many chunks it flags")
+	fs.Parse(args)
+
+	if fs.NArg() > 0 || *path == "" {
+		return usagef("usage: gutchunk flag-content --wordlist FILE [--report]")
+	}
+	w, err := loadWordlist(*path)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	scanned, flagged, err := scanContent(db, w)
+	if err != nil {
+		return err
+	}
+	var total int
+	if err = db.QueryRow("SELECT count(DISTINCT chunk_id) FROM content_flags").Scan(&total); err != nil {
+		return err
+	}
+	fmt.Printf("scanned %d chunks for %d terms, flagging %d; %d chunks are flagged in all\n", scanned, len(w.terms), flagged, total)
+	if *report {
+		return printContentFlags(db)
+	}
+	return nil
+}
+
+// scanContent scans the chunks not yet scanned with w, a batch to a
+// transaction, returning how many it scanned and flagged.
+func scanContent(db *sql.DB, w *wordlist) (int, int, error) {
+	type scan struct {
+		id    int
+		terms map[string]int
+	}
+	last, scanned, flagged := 0, 0, 0
+	shown := time.Now()
+	for {
+		if err := runCtx.Err(); err != nil {
+			return scanned, flagged, err
+		}
+		rows, err := db.Query(`SELECT c.id, c.chunk FROM chunks c
+			WHERE c.id > ? AND NOT EXISTS (SELECT 1 FROM content_scans s WHERE s.chunk_id = c.id AND s.wordlist = ?)
+			ORDER BY c.id LIMIT ?`, last, w.hash, exportBatch)
+		if err != nil {
+			return scanned, flagged, err
+		}
+		var batch []scan
+		for rows.Next() {
+			var id int
+			var text string
+			if err = rows.Scan(&id, &text); err != nil {
+				rows.Close()
+				return scanned, flagged, err
+			}
+			last = id
+			batch = append(batch, scan{id, w.count(text)})
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return scanned, flagged, err
+		}
+		if len(batch) == 0 {
+			return scanned, flagged, nil
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return scanned, flagged, err
+		}
+		for _, s := range batch {
+			if err = saveContentScan(tx, s.id, w.hash, s.terms); err != nil {
+				tx.Rollback()
+				return scanned, flagged, err
+			}
+			if len(s.terms) > 0 {
+				flagged++
+			}
+		}
+		if err = tx.Commit(); err != nil {
+			return scanned, flagged, err
+		}
+		scanned += len(batch)
+		if time.Since(shown) >= 5*time.Second {
+			shown = time.Now()
+			fmt.Printf("scanned %d chunks, up to chunk %d\n", scanned, last)
+		}
+	}
+}
+
+// saveContentScan replaces chunk id's flags with terms, as scanned with
+// the wordlist of hash.
+func saveContentScan(tx *sql.Tx, id int, hash string, terms map[string]int) error {
+	if _, err := tx.Exec("DELETE FROM content_flags WHERE chunk_id = ?", id); err != nil {
+		return err
+	}
+	for term, n := range terms {
+		if _, err := tx.Exec("INSERT INTO content_flags (chunk_id, term, count) VALUES (?, ?, ?)", id, term, n); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec(`INSERT INTO content_scans (chunk_id, wordlist, scanned_at) VALUES (?, ?, datetime('now'))
+		ON CONFLICT (chunk_id) DO UPDATE SET wordlist = excluded.wordlist, scanned_at = excluded.scanned_at`, id, hash)
+	return err
+}
+
+// printContentFlags lists each term flagged with how many chunks and times
+// it is in, the most chunks first.
+func printContentFlags(db *sql.DB) error {
+	rows, err := db.Query("SELECT term, count(*), sum(count) FROM content_flags GROUP BY term ORDER BY count(*) DESC, term")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	for rows.Next() {
+		var term string
+		var chunks, times int
+		if err = rows.Scan(&term, &chunks, &times); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%8d chunks %8d times  %s\n", chunks, times, term)
+	}
+	return rows.Err()
+}
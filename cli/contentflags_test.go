@@ -0,0 +1,173 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testWordlist = "# to screen for\ndamn\nHell  # folded\nbloody   hell\nass\n\nhell\n"
+
+func TestWordlistCount(t *testing.T) {
+	w, err := parseWordlist(testWordlist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"bloody hell", "damn", "hell", "ass"}; !reflect.DeepEqual(w.terms, want) {
+		t.Errorf("the terms are %q, want %q", w.terms, want)
+	}
+	for text, want := range map[string]map[string]int{
+		// never inside a word
+		"The class went to Scunthorpe and passed the assassin's bass.": nil,
+		"Oh, hello, shell, and hellish Hellespont.":                    nil,
+		"Damn it, said the squire, d4mn and D-A-M-N it all!":           {"damn": 3},
+		"What the HËLL, and bloody\n  hell.":                           {"hell": 1, "bloody hell": 1},
+		"You silly a$$. Heeeelll no, h3ll and h.e.l.l.":                {"ass": 1, "hell": 3},
+		"'Damn!' (damn) damnable":                                      {"damn": 2},
+		"":                                                             nil,
+	} {
+		if got := w.count(text); !reflect.DeepEqual(got, want) {
+			t.Errorf("count(%q) = %v, want %v", text, got, want)
+		}
+	}
+
+	// the hash is of the terms, however listed, and of how they match
+	same, err := parseWordlist("ass\nbloody hell\nhell\nDAMN\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := parseWordlist("ass\nbloody hell\nhell\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same.hash != w.hash || other.hash == w.hash {
+		t.Errorf("the hashes are %s, the same list's %s and another's %s", w.hash, same.hash, other.hash)
+	}
+	if _, err = parseWordlist("# nothing\n\n"); err == nil {
+		t.Error("a wordlist of no terms was read")
+	}
+}
+
+func TestFlagContent(t *testing.T) {
+	db := testDB(t)
+	book := addBook(t, db, "Tom Jones", "Henry Fielding", "")
+	for i, text := range []string{
+		"The class went to Scunthorpe and passed the assassin's bass.",
+		"Damn it, said the squire, d4mn and D-A-M-N it all!",
+		"A quiet chunk about the weather.",
+		"What the hell, and bloody hell.",
+	} {
+		insertChunk(t, db, book, i, text)
+	}
+	dir := t.TempDir()
+	list := filepath.Join(dir, "words.txt")
+	write := func(text string) {
+		t.Helper()
+		if err := os.WriteFile(list, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flagContent := func(args ...string) string {
+		t.Helper()
+		out, err := captureStdout(t, func() error { return flagContentCmd(append([]string{"--wordlist", list}, args...)) })
+		if err != nil {
+			t.Fatalf("flag-content %s: %v", strings.Join(args, " "), err)
+		}
+		return out
+	}
+	flags := func() string {
+		t.Helper()
+		return names(t, db, "SELECT chunk_id || ' ' || term || ' ' || count FROM content_flags ORDER BY chunk_id, term")
+	}
+
+	write(testWordlist)
+	if out := flagContent("--report"); out != "scanned 4 chunks for 4 terms, flagging 2; 2 chunks are flagged in all\n"+
+		"       1 chunks        1 times  bloody hell\n       1 chunks        3 times  damn\n       1 chunks        1 times  hell\n" {
+		t.Errorf("flag-content --report printed\n%s", out)
+	}
+	if got := flags(); got != "2 damn 3\n4 bloody hell 1\n4 hell 1\n" {
+		t.Errorf("the flags are\n%s", got)
+	}
+
+	// only what wasn't scanned with the list is scanned
+	if out := flagContent(); out != "scanned 0 chunks for 4 terms, flagging 0; 2 chunks are flagged in all\n" {
+		t.Errorf("flag-content again printed\n%s", out)
+	}
+	insertChunk(t, db, book, 4, "Hell and damnation.")
+	if out := flagContent(); out != "scanned 1 chunks for 4 terms, flagging 1; 3 chunks are flagged in all\n" {
+		t.Errorf("flag-content of a new chunk printed\n%s", out)
+	}
+	// listed in another order, it is the same list
+	write("hell\nass\nbloody hell\ndamn\n")
+	if out := flagContent(); !strings.HasPrefix(out, "scanned 0 chunks") {
+		t.Errorf("flag-content of the list reordered printed\n%s", out)
+	}
+	// edited, every chunk is scanned again and its flags replaced
+	write("damn\nweather\n")
+	if out := flagContent(); out != "scanned 5 chunks for 2 terms, flagging 2; 2 chunks are flagged in all\n" {
+		t.Errorf("flag-content of an edited list printed\n%s", out)
+	}
+	if got := flags(); got != "2 damn 3\n3 weather 1\n" {
+		t.Errorf("scanned again, the flags are\n%s", got)
+	}
+
+	write("# none\n")
+	if _, err := captureStdout(t, func() error { return flagContentCmd([]string{"--wordlist", list}) }); err == nil || !strings.Contains(err.Error(), "no terms") {
+		t.Errorf("flag-content of an empty list: %v", err)
+	}
+	for _, args := range [][]string{{}, {"--wordlist", list, "more"}} {
+		if _, err := captureStdout(t, func() error { return flagContentCmd(args) }); exitCode(err) != exitUsage {
+			t.Errorf("flag-content %s: %v, want a usage error", strings.Join(args, " "), err)
+		}
+	}
+}
+
+func TestExcludeFlagged(t *testing.T) {
+	db := testDB(t)
+	book := addBook(t, db, "Tom Jones", "Henry Fielding", "")
+	clean := insertChunk(t, db, book, 0, "A quiet chunk about the weather and the roads, which were muddy.")
+	insertChunk(t, db, book, 1, "Damn the weather, said the squire, and damn the roads too, which were muddy.")
+	list := filepath.Join(t.TempDir(), "words.txt")
+	if err := os.WriteFile(list, []byte("damn\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := captureStdout(t, func() error { return flagContentCmd([]string{"--wordlist", list}) }); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if out, err := captureStdout(t, func() error { return randomCmd([]string{"--exclude-flagged", "--width", "0"}) }); err != nil || strings.Contains(out, "Damn") {
+			t.Fatalf("random --exclude-flagged: %v, printing\n%s", err, out)
+		}
+	}
+	if lines := exported(t, "--exclude-flagged"); len(lines) != 1 || !strings.Contains(lines[0], fmt.Sprintf(`"id":%d,`, clean)) {
+		t.Errorf("export --exclude-flagged wrote\n%s", strings.Join(lines, "\n"))
+	}
+	if lines := exported(t); len(lines) != 2 {
+		t.Errorf("export wrote\n%s", strings.Join(lines, "\n"))
+	}
+
+	s := testServer(t, db)
+	get := func(path string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		s.routes().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	for i := 0; i < 10; i++ {
+		w := get("/chunks/random?exclude_flagged=true")
+		var c chunkrow
+		if err := json.Unmarshal(w.Body.Bytes(), &c); err != nil || c.ID != clean {
+			t.Fatalf("GET /chunks/random?exclude_flagged=true: %d %s", w.Code, w.Body)
+		}
+	}
+	if w := get("/chunks/random?exclude_flagged=perhaps"); w.Code != http.StatusBadRequest {
+		t.Errorf("GET /chunks/random?exclude_flagged=perhaps: %d %s", w.Code, w.Body)
+	}
+}
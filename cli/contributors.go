@@ -0,0 +1,240 @@
+package cli
+
+import (
+	"database/sql"
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// A translation's header credits its translator, "Translator: Constance
+// Garnett", and some books an editor or illustrator; the catalog has them
+// as the marcrel roles trl, edt and ill of its records. Ingest and
+// reparse-headers keep a book's header credits in the contributors table
+// and gutchunk catalog the catalog's, by ebook, as series are; a book's
+// header goes before the catalog for each role it credits anyone in, as
+// being of the edition ingested. A credit may name several people,
+// "Louise and Aylmer Maude", and "Various" or "Unknown" name no one.
+// books and GET /books/{id} give a book's contributors, and random
+// --credit-translator adds "translated by" its translators to the
+// attribution.
+
+const (
+	roleTranslator  = "translator"
+	roleEditor      = "editor"
+	roleIllustrator = "illustrator"
+)
+
+const (
+	contributorHeader  = "header"
+	contributorCatalog = "catalog"
+)
+
+// contributor is one person credited with a book besides its author.
+type contributor struct {
+	Role string `json:"role"`
+	Name string `json:"name"`
+}
+
+// contributorRows are the role, name and position of the contributors of
+// the book f: its header's, and the catalog's for its ebook in the roles
+// its header credits no one in.
+const contributorRows = `(SELECT role, name, position FROM contributors k
+	WHERE k.source = 'header' AND k.file_id = f.id
+		OR k.source = 'catalog' AND k.ebook = f.ebook AND NOT EXISTS (SELECT 1 FROM contributors h
+			WHERE h.source = 'header' AND h.file_id = f.id AND h.role = k.role))`
+
+// contributorsJSON is the contributors of f as a json array, in order of
+// role and then as credited.
+const contributorsJSON = `(SELECT json_group_array(json_object('role', k.role, 'name', k.name))
+	FROM (SELECT role, name FROM ` + contributorRows + ` k ORDER BY role, position) k)`
+
+// a header line crediting someone: "Translator: ", "Editors: ",
+// "Illustrated by "
+var headerCredit = regexp.MustCompile(`(?i)^(?:(translator|editor|illustrator)s?\s*:|(translated|edited|illustrated)\s+by\b:?)\s*(.*)$`)
+
+var creditRoles = map[string]string{
+	"translator": roleTranslator, "translated": roleTranslator,
+	"editor": roleEditor, "edited": roleEditor,
+	"illustrator": roleIllustrator, "illustrated": roleIllustrator,
+}
+
+// noOne are the credits that name no one, folded.
+var noOne = map[string]bool{
+	"various": true, "various authors": true, "various editors": true, "various translators": true,
+	"unknown": true, "anonymous": true, "anon": true, "none": true, "n/a": true, "": true,
+}
+
+var (
+	creditDates = regexp.MustCompile(`\s*\([^)]*\)`)
+	// between the names of a credit; a comma only when the names are
+	// whole, not "Garnett, Constance"
+	creditAnd   = regexp.MustCompile(`(?i)\s*(?:;|&|\band\b)\s*`)
+	creditComma = regexp.MustCompile(`\s*,\s*`)
+)
+
+// creditNames are the people a credit names, in order.
+func creditNames(value string) []string {
+	value = strings.Join(strings.Fields(creditDates.ReplaceAllString(value, "")), " ")
+	var parts []string
+	for _, p := range creditAnd.Split(value, -1) {
+		commas := creditComma.Split(p, -1)
+		whole := len(commas) > 1
+		for _, c := range commas {
+			whole = whole && strings.Contains(c, " ")
+		}
+		if whole {
+			parts = append(parts, commas...)
+		} else {
+			parts = append(parts, p)
+		}
+	}
+	var names []string
+	for i, p := range parts {
+		p = strings.Trim(p, " ,.:")
+		if noOne[strings.ToLower(p)] {
+			continue
+		}
+		// "Louise and Aylmer Maude": a lone first name takes the surname
+		// of the name after it
+		if !strings.Contains(p, " ") && i+1 < len(parts) {
+			if next := strings.Fields(parts[i+1]); len(next) > 1 {
+				p += " " + strings.Trim(next[len(next)-1], " ,.:")
+			}
+		}
+		names = append(names, p)
+	}
+	return names
+}
+
+// headerContributors are the people header credits, by role in the order
+// it does. A credit goes on over the indented lines after it.
+func headerContributors(header string) []contributor {
+	var out []contributor
+	seen := map[contributor]bool{}
+	add := func(role, value string) {
+		for _, n := range creditNames(value) {
+			c := contributor{role, n}
+			if !seen[c] {
+				seen[c] = true
+				out = append(out, c)
+			}
+		}
+	}
+	role := ""
+	for _, line := range strings.Split(header, "\n") {
+		text := strings.TrimSpace(line)
+		if m := headerCredit.FindStringSubmatch(text); m != nil {
+			role = creditRoles[strings.ToLower(m[1]+m[2])]
+			add(role, m[3])
+			continue
+		}
+		if role != "" && text != "" && text != line && !strings.Contains(text, ":") {
+			add(role, text)
+			continue
+		}
+		role = ""
+	}
+	return out
+}
+
+// saveHeaderContributors replaces the contributors kept of book id's
+// header with cs.
+func saveHeaderContributors(tx execer, id int64, cs []contributor) error {
+	if _, err := tx.Exec("DELETE FROM contributors WHERE file_id = ? AND source = ?", id, contributorHeader); err != nil {
+		return err
+	}
+	for i, c := range cs {
+		if _, err := tx.Exec("INSERT INTO contributors (file_id, role, name, position, source) VALUES (?, ?, ?, ?, ?)",
+			id, c.Role, c.Name, i, contributorHeader); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveCatalogContributors replaces what the catalog said before of the
+// contributors of the ebooks in recs, returning how many it keeps.
+func saveCatalogContributors(tx *sql.Tx, recs []catalogAuthor) (int, error) {
+	n := 0
+	for _, a := range recs {
+		if _, err := tx.Exec("DELETE FROM contributors WHERE ebook = ? AND source = ?", a.ebook, contributorCatalog); err != nil {
+			return n, err
+		}
+		for i, c := range a.contributors {
+			if _, err := tx.Exec("INSERT INTO contributors (ebook, role, name, position, source) VALUES (?, ?, ?, ?, ?)",
+				a.ebook, c.Role, c.Name, i, contributorCatalog); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+// fillContributors keeps the credits of the headers stored before the
+// contributors table was.
+func fillContributors(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query("SELECT id, header FROM files WHERE coalesce(header, '') != '' AND id NOT IN (SELECT file_id FROM contributors WHERE file_id IS NOT NULL)")
+	if err != nil {
+		return err
+	}
+	headers := map[int64]string{}
+	for rows.Next() {
+		var id int64
+		var header string
+		if err = rows.Scan(&id, &header); err != nil {
+			rows.Close()
+			return err
+		}
+		headers[id] = header
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for id, header := range headers {
+		if err = saveHeaderContributors(tx, id, headerContributors(header)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// parseContributors reads a contributorsJSON column.
+func parseContributors(s string) ([]contributor, error) {
+	cs := []contributor{}
+	if s == "" {
+		return cs, nil
+	}
+	return cs, json.Unmarshal([]byte(s), &cs)
+}
+
+// chunkTranslators are the translators of the book chunk id is of.
+func chunkTranslators(db *sql.DB, id int) ([]string, error) {
+	var list string
+	err := db.QueryRow(`SELECT (SELECT json_group_array(k.name) FROM (SELECT name FROM `+contributorRows+` k
+			WHERE k.role = ? ORDER BY position) k)
+		FROM chunks c JOIN files f ON f.id = c.sourceid WHERE c.id = ?`, roleTranslator, id).Scan(&list)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	return names, json.Unmarshal([]byte(list), &names)
+}
+
+// joinNames is names as a list in prose: "A", "A and B", "A, B and C".
+func joinNames(names []string) string {
+	switch len(names) {
+	case 0:
+		return ""
+	case 1:
+		return names[0]
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+}
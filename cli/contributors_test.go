@@ -0,0 +1,208 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCreditNames(t *testing.T) {
+	for value, want := range map[string]string{
+		"Constance Garnett":                       "Constance Garnett",
+		"Constance Garnett (1861-1946)":           "Constance Garnett",
+		"Louise and Aylmer Maude":                 "Louise Maude | Aylmer Maude",
+		"Richard Pevear & Larissa Volokhonsky":    "Richard Pevear | Larissa Volokhonsky",
+		"Aylmer Maude; Louise Maude":              "Aylmer Maude | Louise Maude",
+		"H. G. Wells, Grant Allen, Arthur Machen": "H. G. Wells | Grant Allen | Arthur Machen",
+		// a name given surname first is one name
+		"Garnett, Constance":     "Garnett, Constance",
+		"Various":                "",
+		"Unknown.":               "",
+		"Various and John Smith": "John Smith",
+	} {
+		if got := strings.Join(creditNames(value), " | "); got != want {
+			t.Errorf("creditNames(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestHeaderContributors(t *testing.T) {
+	header := strings.Join([]string{
+		"The Project Gutenberg EBook of Childhood",
+		"",
+		"Title: Childhood",
+		"Author: Leo Tolstoy",
+		"Translators: Louise and Aylmer Maude",
+		"             C. J. Hogarth",
+		"Editor: Various",
+		"Illustrated by Gustave Doré",
+		"Release Date: May 4, 2006",
+		"    Not a credit",
+		"Translator: Louise Maude",
+	}, "\n")
+	var got []string
+	for _, c := range headerContributors(header) {
+		got = append(got, c.Role+": "+c.Name)
+	}
+	if want := "translator: Louise Maude, translator: Aylmer Maude, translator: C. J. Hogarth, illustrator: Gustave Doré"; strings.Join(got, ", ") != want {
+		t.Errorf("the header credits %s, want %s", strings.Join(got, ", "), want)
+	}
+	if cs := headerContributors("Title: Emma\nAuthor: Jane Austen\n"); len(cs) != 0 {
+		t.Errorf("a header crediting no one credits %v", cs)
+	}
+}
+
+// creditedBook is a book whose header has lines after the title's.
+func creditedBook(title, credits string) string {
+	return strings.Replace(testBook(title, testParagraphs(2)), "Title: "+title+"\n", "Title: "+title+"\n"+credits, 1)
+}
+
+func TestContributors(t *testing.T) {
+	root := t.TempDir()
+	writeTestZip(t, filepath.Join(root, "1", "11.zip"), zipEntry{"11.txt", creditedBook("Childhood", "Author: Leo Tolstoy\nTranslator: Louise and Aylmer Maude\nEditor: Various\n")})
+	writeTestZip(t, filepath.Join(root, "2", "22.zip"), zipEntry{"22.txt", creditedBook("Emma", "Author: Jane Austen\nIllustrator: Hugh Thomson\n")})
+	db := testDB(t)
+	if _, err := captureStdout(t, func() error { return ingestCmd([]string{"--target", root}) }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := captureStdout(t, func() error { return chunkCmd(nil) }); err != nil {
+		t.Fatal(err)
+	}
+	ids := map[string]int{}
+	for _, title := range []string{"Childhood", "Emma"} {
+		var id int
+		if err := db.QueryRow("SELECT id FROM files WHERE name = ?", title).Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids[title] = id
+	}
+	credits := func(title string) string {
+		t.Helper()
+		out, err := captureStdout(t, func() error { return booksCmd([]string{"--json"}) })
+		var books []bookRow
+		if err != nil || json.Unmarshal([]byte(out), &books) != nil {
+			t.Fatalf("books --json: %v\n%s", err, out)
+		}
+		for _, b := range books {
+			if b.Title == title {
+				var s []string
+				for _, c := range b.Contributors {
+					s = append(s, c.Role+": "+c.Name)
+				}
+				return strings.Join(s, ", ")
+			}
+		}
+		t.Fatalf("books --json gave no %s", title)
+		return ""
+	}
+	if got := credits("Childhood"); got != "translator: Louise Maude, translator: Aylmer Maude" {
+		t.Errorf("Childhood's contributors are %q", got)
+	}
+	if got := credits("Emma"); got != "illustrator: Hugh Thomson" {
+		t.Errorf("Emma's contributors are %q", got)
+	}
+
+	// the attribution credits translators, and only when asked
+	attributed := func(title string, args ...string) string {
+		t.Helper()
+		out, err := captureStdout(t, func() error { return randomCmd(append([]string{"--title", title, "--width", "0"}, args...)) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+		return lines[len(lines)-1]
+	}
+	for _, c := range []struct {
+		title string
+		args  []string
+		want  string
+	}{
+		{"childhood", []string{"--credit-translator"}, "— Childhood, by Leo Tolstoy, translated by Louise Maude and Aylmer Maude"},
+		{"childhood", nil, "— Childhood, by Leo Tolstoy"},
+		{"emma", []string{"--credit-translator"}, "— Emma, by Jane Austen"},
+		{"emma", nil, "— Emma, by Jane Austen"},
+	} {
+		if got := attributed(c.title, c.args...); got != c.want {
+			t.Errorf("random --title %s %s attributed %q, want %q", c.title, strings.Join(c.args, " "), got, c.want)
+		}
+	}
+	if got := attribution(chunkrow{Title: "Beowulf"}, []string{"Francis Gummere", "John Lesslie Hall", "William Morris"}); got != "— Beowulf, translated by Francis Gummere, John Lesslie Hall and William Morris" {
+		t.Errorf("a book of no author with three translators is attributed %q", got)
+	}
+
+	// the catalog's, for the roles the header credits no one in
+	if _, err := db.Exec("UPDATE files SET ebook = CASE name WHEN 'Childhood' THEN 2142 ELSE 158 END"); err != nil {
+		t.Fatal(err)
+	}
+	marcrel := func(rdf, role string, names ...string) string {
+		var agents []string
+		for i, n := range names {
+			agents = append(agents, fmt.Sprintf(`<pgterms:agent rdf:about="2009/agents/%d"><pgterms:name>%s</pgterms:name></pgterms:agent>`, 900+i, n))
+		}
+		rdf = strings.Replace(rdf, `xmlns:dcterms=`, `xmlns:marcrel="http://id.loc.gov/vocabulary/relators/" xmlns:dcterms=`, 1)
+		return strings.Replace(rdf, "</dcterms:creator>", "</dcterms:creator>\n    <marcrel:"+role+">"+strings.Join(agents, "")+"</marcrel:"+role+">", 1)
+	}
+	out, err := captureStdout(t, func() error {
+		return catalogCmd([]string{writeCatalog(t, map[int]string{
+			2142: marcrel(catalogRDF(2142, "Childhood", "Tolstoy, Leo, graf", "1828", "1910"), "trl", "Maude, Louise", "Maude, Aylmer", "Hogarth, C. J."),
+			158:  marcrel(marcrel(catalogRDF(158, "Emma", "Austen, Jane", "1775", "1817"), "edt", "Chapman, R. W.", "Various"), "ill", "Brock, C. E."),
+		})})
+	})
+	if err != nil || !strings.Contains(out, "it credits 5 translators, editors and illustrators\n") {
+		t.Errorf("catalog: %v, printing\n%s", err, out)
+	}
+	if got := credits("Childhood"); got != "translator: Louise Maude, translator: Aylmer Maude" {
+		t.Errorf("with the catalog, Childhood's contributors are %q", got)
+	}
+	if got := credits("Emma"); got != "editor: R. W. Chapman, illustrator: Hugh Thomson" {
+		t.Errorf("with the catalog, Emma's contributors are %q", got)
+	}
+
+	// GET /books/{id} and the book page give them
+	s := testServer(t, db)
+	s.ui = true
+	h := s.routes()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", fmt.Sprintf("/books/%d", ids["Emma"]), nil))
+	var b bookRow
+	if err = json.Unmarshal(w.Body.Bytes(), &b); err != nil || len(b.Contributors) != 2 || b.Contributors[0] != (contributor{roleEditor, "R. W. Chapman"}) {
+		t.Errorf("GET /books/%d: %d\n%s", ids["Emma"], w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", fmt.Sprintf("/ui/books/%d", ids["Childhood"]), nil))
+	if page := w.Body.String(); !strings.Contains(page, "<dt>translator</dt><dd>Louise Maude</dd><dt>translator</dt><dd>Aylmer Maude</dd>") {
+		t.Errorf("the book page of Childhood:\n%s", page)
+	}
+
+	// reparse-headers reads them again, and a header's taken out leaves
+	// the catalog's
+	if _, err = db.Exec("UPDATE files SET header = replace(header, 'Translator: Louise and Aylmer Maude', 'Translated by Rosemary Edmonds') WHERE name = 'Childhood'"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec("UPDATE files SET header = replace(header, 'Illustrator: Hugh Thomson', '') WHERE name = 'Emma'"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = captureStdout(t, func() error { return reparseHeadersCmd(nil) }); err != nil {
+		t.Fatal(err)
+	}
+	if got := credits("Childhood"); got != "translator: Rosemary Edmonds" {
+		t.Errorf("reparsed, Childhood's contributors are %q", got)
+	}
+	if got := credits("Emma"); got != "editor: R. W. Chapman, illustrator: C. E. Brock" {
+		t.Errorf("reparsed, Emma's contributors are %q", got)
+	}
+
+	// and a database from before the table has its headers' filled in
+	if _, err = db.Exec("DELETE FROM contributors WHERE source = 'header'"); err != nil {
+		t.Fatal(err)
+	}
+	if err = fillContributors(db); err != nil {
+		t.Fatal(err)
+	}
+	if got := credits("Childhood"); got != "translator: Rosemary Edmonds" {
+		t.Errorf("filled in, Childhood's contributors are %q", got)
+	}
+}
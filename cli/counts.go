@@ -0,0 +1,219 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Counting a hundred million chunks takes a scan of all of them, and stats
+// and books --sort chunks did one each time. chunk_counts keeps how many
+// chunks each book has instead: everything that writes or takes away a
+// book's chunks logs it with logChunks, which sets the book's count in the
+// same transaction, once a book rather than once a chunk, so a bulk chunk
+// pays a statement a book. A superseded book keeps its chunks, and its
+// count. The library's total is the sum of the books' counts, a row a
+// book. stats and books read the kept counts, stats saying when gutchunk
+// recount last counted them from the chunks themselves, which it does in
+// full, fixing any kept wrong, as by a tool gutchunk doesn't know of
+// writing chunks, and saying how many were; --check only says. stats
+// --exact counts the chunks as before, and a database too old to keep
+// counts and opened read-only is counted too. What depends on exact
+// counts, like verify-content and publish, counts for itself.
+
+// countState is when the kept chunk counts were last recounted, and how
+// many books' counts that found wrong.
+type countState struct {
+	RecountedAt string `json:"recounted_at"`
+	Drift       int    `json:"drift"`
+}
+
+// keptCounts reports whether the database keeps chunk counts, and its
+// countState, a zero RecountedAt when it keeps them but never recounted.
+func keptCounts(q queryer) (countState, bool, error) {
+	var st countState
+	if lacks("chunk_counts", "") || lacks("chunk_counts_state", "") {
+		return st, false, nil
+	}
+	err := q.QueryRow("SELECT recounted_at, drift FROM chunk_counts_state WHERE id = 1").Scan(&st.RecountedAt, &st.Drift)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	return st, err == nil, err
+}
+
+// keepCounts sets the kept chunk counts of the books for event, as
+// logChunks logs it.
+func keepCounts(tx execer, event string, written int, books string, args ...interface{}) error {
+	var err error
+	switch event {
+	case eventChunked:
+		_, err = tx.Exec("INSERT OR REPLACE INTO chunk_counts (sourceid, chunks) SELECT id, ? FROM files WHERE id IN ("+books+")",
+			append([]interface{}{written}, args...)...)
+	case eventSuperseded:
+		// a superseded book keeps its chunks
+	default:
+		_, err = tx.Exec("DELETE FROM chunk_counts WHERE sourceid IN ("+books+")", args...)
+	}
+	return err
+}
+
+// countedChunks is how many chunks the books the subquery books selects
+// have, from the kept counts when the database keeps them and by counting
+// otherwise.
+func countedChunks(q queryer, books string, args ...interface{}) (int, error) {
+	if _, ok, err := keptCounts(q); err != nil || !ok {
+		if err != nil {
+			return 0, err
+		}
+		return countChunks(q, "%s c WHERE c.sourceid IN ("+books+")", args...)
+	}
+	var n int
+	err := q.QueryRow("SELECT coalesce(sum(chunks), 0) FROM chunk_counts WHERE sourceid IN ("+books+")", args...).Scan(&n)
+	return n, err
+}
+
+// bookCounts joins each book f to c.n, its chunks, or null when it has
+// none, from the kept counts when the database keeps them.
+func bookCounts() string {
+	if lacks("chunk_counts", "") {
+		return "LEFT JOIN (SELECT sourceid, count(*) AS n FROM chunks GROUP BY sourceid) c ON c.sourceid = f.id"
+	}
+	return "LEFT JOIN (SELECT sourceid, chunks AS n FROM chunk_counts) c ON c.sourceid = f.id"
+}
+
+// recountReport is what recount found.
+type recountReport struct {
+	Books  int `json:"books"`
+	Chunks int `json:"chunks"`
+	// books whose kept counts were wrong, and which --check left so
+	Drift int  `json:"drift"`
+	Check bool `json:"check,omitempty"`
+}
+
+func recountCmd(args []string) error {
+	fs := flag.NewFlagSet("recount", flag.ExitOnError)
+	check := fs.Bool("check", false, "only compare the kept counts with the chunks, changing nothing")
+	asJSON := fs.Bool("json", false, "print the report as json")
+	fs.Parse(args)
+
+	if fs.NArg() > 0 {
+		return usagef("usage: gutchunk recount [--check] [--json]")
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rep, err := recountChunks(runCtx, db, *check)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		if err = json.NewEncoder(os.Stdout).Encode(rep); err != nil {
+			return err
+		}
+	} else {
+		verb := "recounted"
+		if rep.Check {
+			verb = "counted"
+		}
+		fmt.Printf("%s %d chunks of %d books\n", verb, rep.Chunks, rep.Books)
+		switch {
+		case rep.Drift == 0:
+			fmt.Println("the kept counts were right")
+		case rep.Check:
+			fmt.Printf("the kept counts of %d books are wrong; run gutchunk recount to fix them\n", rep.Drift)
+		default:
+			fmt.Printf("fixed the kept counts of %d books\n", rep.Drift)
+		}
+	}
+	if rep.Check && rep.Drift > 0 {
+		return exitStatus(1)
+	}
+	return nil
+}
+
+// recountChunks counts every book's chunks, compares the counts with those
+// kept and, but with check, keeps them in their place.
+func recountChunks(ctx context.Context, db *sql.DB, check bool) (recountReport, error) {
+	rep := recountReport{Check: check}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return rep, err
+	}
+	defer tx.Rollback()
+
+	counted, err := sourceCounts(ctx, tx, "SELECT sourceid, count(*) FROM chunks WHERE sourceid IS NOT NULL GROUP BY sourceid")
+	if err != nil {
+		return rep, err
+	}
+	kept, err := sourceCounts(ctx, tx, "SELECT sourceid, chunks FROM chunk_counts")
+	if err != nil {
+		return rep, err
+	}
+	for id, n := range counted {
+		rep.Books++
+		rep.Chunks += n
+		if kept[id] != n {
+			rep.Drift++
+		}
+	}
+	for id, n := range kept {
+		if _, ok := counted[id]; !ok && n != 0 {
+			rep.Drift++
+		}
+	}
+	if check {
+		return rep, nil
+	}
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM chunk_counts"); err != nil {
+		return rep, err
+	}
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO chunk_counts (sourceid, chunks) VALUES (?, ?)")
+	if err != nil {
+		return rep, err
+	}
+	defer stmt.Close()
+	for id, n := range counted {
+		if _, err = stmt.ExecContext(ctx, id, n); err != nil {
+			return rep, err
+		}
+	}
+	if _, err = tx.ExecContext(ctx, "INSERT OR REPLACE INTO chunk_counts_state (id, recounted_at, drift) VALUES (1, datetime('now'), ?)", rep.Drift); err != nil {
+		return rep, err
+	}
+	return rep, tx.Commit()
+}
+
+func sourceCounts(ctx context.Context, tx *sql.Tx, q string) (map[int64]int, error) {
+	rows, err := tx.QueryContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := map[int64]int{}
+	for rows.Next() {
+		var id int64
+		var n int
+		if err = rows.Scan(&id, &n); err != nil {
+			return nil, err
+		}
+		counts[id] = n
+	}
+	return counts, rows.Err()
+}
+
+// fillChunkCounts counts the chunks of a database from before counts were
+// kept.
+func fillChunkCounts(db *sql.DB) error {
+	_, err := recountChunks(context.Background(), db, false)
+	return err
+}
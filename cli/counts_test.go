@@ -0,0 +1,225 @@
+package cli
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// keptRows is each book's kept chunk count, a line each.
+func keptRows(t *testing.T, db *sql.DB) string {
+	t.Helper()
+	return names(t, db, "SELECT sourceid || ' ' || chunks FROM chunk_counts ORDER BY sourceid")
+}
+
+// countedRows is each book's chunks, counted, a line each.
+func countedRows(t *testing.T, db *sql.DB) string {
+	t.Helper()
+	return names(t, db, "SELECT sourceid || ' ' || count(*) FROM chunks GROUP BY sourceid ORDER BY sourceid")
+}
+
+// statsChunks is the chunks line stats prints.
+func statsChunks(t *testing.T, args ...string) string {
+	t.Helper()
+	out, err := captureStdout(t, func() error { return statsCmd(args) })
+	if err != nil {
+		t.Fatalf("stats %s: %v", strings.Join(args, " "), err)
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "chunks:") {
+			return line
+		}
+	}
+	t.Fatalf("stats printed\n%s", out)
+	return ""
+}
+
+func TestKeptCounts(t *testing.T) {
+	db := testDB(t)
+	root := writeRunMirror(t)
+	run := func(cmd func([]string) error, args ...string) string {
+		t.Helper()
+		var out string
+		if _, err := captureStderr(t, func() error {
+			var err error
+			out, err = captureStdout(t, func() error { return cmd(args) })
+			return err
+		}); err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+		return out
+	}
+	consistent := func(when string) {
+		t.Helper()
+		if kept, counted := keptRows(t, db), countedRows(t, db); kept != counted || kept == "" {
+			t.Errorf("%s, the kept counts are\n%s\nwant\n%s", when, kept, counted)
+		}
+	}
+	run(ingestCmd, "--target", root)
+	if got := keptRows(t, db); got != "" {
+		t.Errorf("ingested, the books have counts\n%s", got)
+	}
+	run(chunkCmd, "--scenes")
+	consistent("chunked")
+	var total int
+	if err := db.QueryRow("SELECT count(*) FROM chunks").Scan(&total); err != nil {
+		t.Fatal(err)
+	}
+	// counted once, as the database was made
+	recounted := func(total int) *regexp.Regexp {
+		return regexp.MustCompile(fmt.Sprintf(`^chunks:    %d \(kept counts, recounted \d{4}-\d\d-\d\d \d\d:\d\d:\d\d\)$`, total))
+	}
+	if got := statsChunks(t); !recounted(total).MatchString(got) {
+		t.Errorf("stats printed %q", got)
+	}
+	if got, want := statsChunks(t, "--exact"), fmt.Sprintf("chunks:    %d", total); got != want {
+		t.Errorf("stats --exact printed %q, want %q", got, want)
+	}
+
+	run(chunkCmd, "--full-rechunk", "--max-chunk", "400")
+	consistent("re-chunked")
+	run(rmCmd, "1")
+	consistent("with a book removed")
+	if strings.HasPrefix(keptRows(t, db), "1 ") {
+		t.Error("a removed book keeps its count")
+	}
+	run(purgeCmd, "--yes")
+	consistent("purged")
+
+	// a re-release keeps the old version's count until it is pruned
+	writeTestZip(t, filepath.Join(root, "etext98", "pandp10.zip"), zipEntry{"pandp10.txt", pandp("first")})
+	run(ingestCmd, "--target", root)
+	run(chunkCmd)
+	writeTestZip(t, filepath.Join(root, "etext98", "pandp11.zip"), zipEntry{"pandp11.txt", pandp("corrected")})
+	run(ingestCmd, "--target", root)
+	run(chunkCmd)
+	consistent("re-released")
+	run(pruneVersionsCmd, "--yes")
+	consistent("pruned")
+
+	// what gutchunk didn't do, recount --check finds, and recount fixes
+	if out := run(recountCmd, "--check"); !strings.HasSuffix(out, "\nthe kept counts were right\n") {
+		t.Errorf("recount --check printed\n%s", out)
+	}
+	if _, err := db.Exec("DELETE FROM chunks WHERE id IN (SELECT min(id) FROM chunks GROUP BY sourceid LIMIT 2)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO chunk_counts (sourceid, chunks) VALUES (999, 4)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("SELECT count(*) FROM chunks").Scan(&total); err != nil {
+		t.Fatal(err)
+	}
+	out, err := captureStdout(t, func() error { return recountCmd([]string{"--check"}) })
+	var books int
+	if err := db.QueryRow("SELECT count(DISTINCT sourceid) FROM chunks").Scan(&books); err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("counted %d chunks of %d books\nthe kept counts of 3 books are wrong; run gutchunk recount to fix them\n", total, books); exitCode(err) != 1 || out != want {
+		t.Errorf("recount --check of wrong counts: %v, printing\n%s\nwant\n%s", err, out, want)
+	}
+	if kept := keptRows(t, db); kept == countedRows(t, db) {
+		t.Errorf("recount --check changed the kept counts")
+	}
+	out = run(recountCmd, "--json")
+	var rep recountReport
+	if err = json.Unmarshal([]byte(out), &rep); err != nil || rep != (recountReport{Books: books, Chunks: total, Drift: 3}) {
+		t.Errorf("recount --json printed %s", out)
+	}
+	consistent("recounted")
+	if got := statsChunks(t); !recounted(total).MatchString(got) {
+		t.Errorf("recounted, stats printed %q", got)
+	}
+	if out = run(recountCmd); out != fmt.Sprintf("recounted %d chunks of %d books\nthe kept counts were right\n", total, books) {
+		t.Errorf("recount again printed\n%s", out)
+	}
+	if _, err = captureStdout(t, func() error { return recountCmd([]string{"books"}) }); exitCode(err) != exitUsage {
+		t.Errorf("recount books: %v, want a usage error", err)
+	}
+}
+
+func TestBooksKeptCounts(t *testing.T) {
+	db := testDB(t)
+	for i, n := range []int{1, 3, 2} {
+		title := fmt.Sprint("Book ", i+1)
+		addBook(t, db, title, "", testBook(title, testParagraphs(n)))
+	}
+	if _, err := captureStdout(t, func() error { return chunkCmd(nil) }); err != nil {
+		t.Fatal(err)
+	}
+	sorted := func() string {
+		t.Helper()
+		out, err := captureStdout(t, func() error { return booksCmd([]string{"--sort", "chunks", "--json"}) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		var books []struct {
+			ID     int `json:"id"`
+			Chunks int `json:"chunks"`
+		}
+		if err = json.Unmarshal([]byte(out), &books); err != nil {
+			t.Fatalf("books --json printed %s", out)
+		}
+		var got []string
+		for _, b := range books {
+			got = append(got, fmt.Sprintf("%d:%d", b.ID, b.Chunks))
+		}
+		return strings.Join(got, " ")
+	}
+	if got := sorted(); got != "1:1 3:2 2:3" {
+		t.Errorf("books --sort chunks lists %s", got)
+	}
+	// read from the kept counts, however wrong
+	if _, err := db.Exec("UPDATE chunk_counts SET chunks = 9 WHERE sourceid = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := sorted(); got != "3:2 2:3 1:9" {
+		t.Errorf("with a kept count changed, books --sort chunks lists %s", got)
+	}
+	if got := statsChunks(t, "--exact"); got != "chunks:    6" {
+		t.Errorf("stats --exact printed %q", got)
+	}
+}
+
+func TestOldDatabaseCounts(t *testing.T) {
+	path := oldDatabase(t)
+	raw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{"DROP TABLE chunk_counts", "DROP TABLE chunk_counts_state", "PRAGMA user_version = 8"} {
+		if _, err = raw.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	raw.Close()
+
+	// read-only and too old to keep counts, the chunks are counted
+	asCommand(t, "stats")
+	if _, err = captureStderr(t, func() error {
+		if got := statsChunks(t); got != "chunks:    2" {
+			t.Errorf("stats of the old database printed %q", got)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	dsn = fileDSN(path)
+	asCommand(t, "migrate")
+	if _, err = captureStdout(t, func() error { return migrateCmd(nil) }); err != nil {
+		t.Fatal(err)
+	}
+	db, err := openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if got := keptRows(t, db); got != "1 1\n2 1\n" {
+		t.Errorf("migrated, the kept counts are\n%s", got)
+	}
+}
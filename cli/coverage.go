@@ -0,0 +1,227 @@
+package cli
+
+import (
+	"bufio"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+func coverageCmd(args []string) error {
+	fs := flag.NewFlagSet("coverage", flag.ExitOnError)
+	root := fs.String("target", target, "root of the gutenberg mirror")
+	manifest := fs.String("manifest", "", "read the archives to expect from this file, one path per line, instead of walking --target")
+	save := fs.String("save-manifest", "", "write the archives found walking --target to this file for later --manifest runs")
+	depth := fs.Int("depth", 1, "directory levels under the target to group archives by")
+	missingFile := fs.String("list-missing", "", "write the paths of archives not in the database to this file")
+	fs.Parse(args)
+
+	if *depth < 1 {
+		return usagef("--depth must be at least 1")
+	}
+
+	var archives []string
+	var err error
+	if *root, err = resolveTarget(*root); err != nil {
+		return err
+	}
+	if *manifest != "" {
+		archives, err = readManifest(*manifest, *root)
+	} else {
+		archives, err = expectedArchives(*root)
+	}
+	if err != nil {
+		return err
+	}
+	// by their names, as the database has them
+	for i, a := range archives {
+		archives[i] = mirrorName(*root, a)
+	}
+	if *save != "" {
+		if err = writeLines(*save, archives); err != nil {
+			return err
+		}
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	have, err := loadIngested(db)
+	if err != nil {
+		return err
+	}
+
+	type count struct{ archives, present int }
+	counts := map[string]*count{}
+	missing := []string{}
+	var all count
+	for _, a := range archives {
+		p := archivePrefix(a, *depth)
+		c := counts[p]
+		if c == nil {
+			c = &count{}
+			counts[p] = c
+		}
+		c.archives++
+		all.archives++
+		if have.has(a) {
+			c.present++
+			all.present++
+		} else {
+			missing = append(missing, a)
+		}
+	}
+
+	prefixes := []string{}
+	for p := range counts {
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+	fmt.Printf("%-24s %9s %9s %9s\n", "prefix", "archives", "present", "missing")
+	line := func(p string, c count) {
+		fmt.Printf("%-24s %9d %9d %9d  %5.1f%%\n", p, c.archives, c.present, c.archives-c.present,
+			100*float64(c.present)/float64(c.archives))
+	}
+	for _, p := range prefixes {
+		line(p, *counts[p])
+	}
+	if all.archives > 0 {
+		line("total", all)
+	}
+
+	if *missingFile != "" {
+		if err = writeLines(*missingFile, missing); err != nil {
+			return err
+		}
+		fmt.Printf("wrote %d missing archives to %s\n", len(missing), *missingFile)
+	}
+	return nil
+}
+
+// expectedArchives lists the archives under root that ingest would read.
+func expectedArchives(root string) ([]string, error) {
+	archives := []string{}
+	err := walkArchives(root, nil, func(archive string, info ArchiveInfo) error {
+		if !info.Superseded && (info.Ignore == nil || !info.Ignore.ignored) {
+			archives = append(archives, archive)
+		}
+		return nil
+	})
+	return archives, err
+}
+
+// readManifest reads archive paths, taking relative ones, in either
+// slash, as names under root.
+func readManifest(file, root string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	archives := []string{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = filepath.FromSlash(slashPath(line))
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(root, line)
+		}
+		archives = append(archives, line)
+	}
+	return archives, s.Err()
+}
+
+func writeLines(file string, lines []string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, l := range lines {
+		fmt.Fprintln(w, l)
+	}
+	if err = w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// archivePrefix is the first depth directories of the archive name under
+// the root.
+func archivePrefix(name string, depth int) string {
+	if isURL(name) || isAbsSlash(name) {
+		return "(outside target)"
+	}
+	parts := strings.Split(name, "/")
+	if len(parts) <= depth {
+		return strings.Join(parts[:len(parts)-1], "/") + "/"
+	}
+	return strings.Join(parts[:depth], "/") + "/"
+}
+
+// ingested is what the database knows was ingested: the archives the
+// journal and the files table name, and for books from before archives
+// were recorded, their ebook numbers and filenames.
+type ingested struct {
+	archives map[string]bool
+	ebooks   map[int]bool
+	stems    map[string]bool
+}
+
+func (in ingested) has(archive string) bool {
+	if in.archives[archive] {
+		return true
+	}
+	if n := parseArchiveName(archive).ebook; n != 0 && in.ebooks[n] {
+		return true
+	}
+	return in.stems[bookStem(archive)]
+}
+
+// bookStem is a file's name without its extension or encoding suffix, so
+// 1342.zip, 1342-0.zip and 1342-8.txt all give 1342.
+func bookStem(name string) string {
+	stem := strings.TrimSuffix(path.Base(filepath.ToSlash(name)), path.Ext(name))
+	return strings.TrimSuffix(strings.TrimSuffix(stem, "-0"), "-8")
+}
+
+func loadIngested(db *sql.DB) (ingested, error) {
+	in := ingested{archives: map[string]bool{}, ebooks: map[int]bool{}, stems: map[string]bool{}}
+	rows, err := db.Query(`
+		SELECT archive, 0, '' FROM ingest_journal WHERE status = 'completed'
+		UNION ALL
+		SELECT coalesce(archive, ''), coalesce(ebook, 0), coalesce(filename, '') FROM files`)
+	if err != nil {
+		return in, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var archive, filename string
+		var ebook int
+		if err = rows.Scan(&archive, &ebook, &filename); err != nil {
+			return in, err
+		}
+		if archive != "" {
+			in.archives[archive] = true
+		}
+		if ebook != 0 {
+			in.ebooks[ebook] = true
+		}
+		if filename != "" {
+			in.stems[bookStem(filename)] = true
+		}
+	}
+	return in, rows.Err()
+}
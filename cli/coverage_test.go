@@ -0,0 +1,134 @@
+package cli
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// captureStdout runs f, returning what it printed.
+func captureStdout(t *testing.T, f func() error) (string, error) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	was := os.Stdout
+	os.Stdout = w
+	out := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- string(b)
+	}()
+	err = f()
+	os.Stdout = was
+	w.Close()
+	return <-out, err
+}
+
+// coverageFixture is a mirror of five archives, two of them ingested and
+// a third known from a book stored before archives were recorded.
+func coverageFixture(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	for _, a := range []string{"1/11.zip", "1/12.zip", "2/21.zip", "2/22/22.zip", "3/31.zip"} {
+		stem := strings.TrimSuffix(filepath.Base(a), ".zip")
+		writeTestZip(t, filepath.Join(root, filepath.FromSlash(a)), zipEntry{stem + ".txt", testBook("Book "+stem, testParagraphs(2)+"\n\n"+stem+".")})
+	}
+	db := testDB(t)
+	for _, a := range []string{"1/11.zip", "2/21.zip"} {
+		if err := ingestOne(db, root, filepath.Join(root, filepath.FromSlash(a)), a, ingestOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	id := addBook(t, db, "Book 31", "Someone", testParagraphs(1))
+	if _, err := db.Exec("UPDATE files SET ebook = 31 WHERE id = ?", id); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestCoverage(t *testing.T) {
+	root := coverageFixture(t)
+	missing := filepath.Join(t.TempDir(), "missing.txt")
+	out, err := captureStdout(t, func() error {
+		return coverageCmd([]string{"--target", root, "--list-missing", missing})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `prefix                    archives   present   missing
+1/                               2         1         1   50.0%
+2/                               2         1         1   50.0%
+3/                               1         1         0  100.0%
+total                            5         3         2   60.0%
+wrote 2 missing archives to ` + missing + "\n"
+	if out != want {
+		t.Errorf("coverage printed\n%s\nwant\n%s", out, want)
+	}
+	b, err := os.ReadFile(missing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "1/12.zip\n2/22/22.zip\n" {
+		t.Errorf("--list-missing wrote %q", b)
+	}
+
+	out, err = captureStdout(t, func() error { return coverageCmd([]string{"--target", root, "--depth", "2"}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "\n2/                               1         1         0  100.0%\n2/22/                            1         0         1    0.0%\n") {
+		t.Errorf("--depth 2 printed\n%s\nwant 2/22/ counted apart from what is directly in 2/", out)
+	}
+}
+
+func TestCoverageManifest(t *testing.T) {
+	root := coverageFixture(t)
+	dir := t.TempDir()
+	saved := filepath.Join(dir, "saved.txt")
+	if _, err := captureStdout(t, func() error { return coverageCmd([]string{"--target", root, "--save-manifest", saved}) }); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "1/11.zip\n1/12.zip\n2/21.zip\n2/22/22.zip\n3/31.zip\n" {
+		t.Errorf("--save-manifest wrote %q", b)
+	}
+
+	// a manifest of its own: a comment, slashes either way, one absolute
+	manifest := filepath.Join(dir, "manifest.txt")
+	lines := "# the first directory\n1/11.zip\n\n1\\12.zip\n" + filepath.Join(root, "3", "31.zip") + "\n"
+	if err = os.WriteFile(manifest, []byte(lines), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := captureStdout(t, func() error { return coverageCmd([]string{"--target", root, "--manifest", manifest}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "\ntotal                            3         2         1   66.7%\n") {
+		t.Errorf("coverage of the manifest printed\n%s", out)
+	}
+}
+
+func TestArchivePrefix(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		depth int
+		want  string
+	}{
+		{"1/2/123/123.zip", 1, "1/"},
+		{"1/2/123/123.zip", 2, "1/2/"},
+		{"1/2/123/123.zip", 5, "1/2/123/"},
+		{"x.zip", 1, "/"},
+		{"https://example.org/1/12.zip", 1, "(outside target)"},
+	} {
+		if got := archivePrefix(c.name, c.depth); got != c.want {
+			t.Errorf("archivePrefix(%q, %d) = %q, want %q", c.name, c.depth, got, c.want)
+		}
+	}
+}
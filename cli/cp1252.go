@@ -0,0 +1,421 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"sort"
+	"time"
+	"unicode/utf8"
+)
+
+// Texts otherwise ASCII or UTF-8 often have a few Windows-1252 bytes in
+// them, curly quotes and dashes pasted in from a word processor: 0x93 and
+// 0x94 for “ and ”, 0x96 for –. Each is invalid UTF-8 by itself, and comes
+// out of a chunk as a replacement character. ingest puts the character in
+// place of each, and fix-encoding does the same in the books and chunks
+// already stored, but only in a text whose every invalid byte is one of
+// them. A text with other bytes invalid, é as 0xE9 say, is in an 8-bit
+// encoding throughout, Latin-1 or Windows-1252, and is decoded as a whole
+// instead: repairing its punctuation alone would leave it half one
+// encoding and half the other. Windows-1252 is Latin-1 with characters in
+// place of the control codes 0x80 to 0x9F, which no book means, so both
+// are decoded as it. A text with more UTF-8 past ASCII in it than bytes
+// invalid is UTF-8 with a few stray bytes, and is left as it is. Each book
+// repaired or decoded gets an info warning saying how many bytes were.
+
+const (
+	warnCP1252  = "cp1252_punctuation"
+	warnDecoded = "cp1252_decoded"
+)
+
+// the Windows-1252 punctuation repaired
+var cp1252Punctuation = map[byte]rune{
+	0x82: '‚', 0x84: '„', 0x85: '…', 0x8B: '‹',
+	0x91: '‘', 0x92: '’', 0x93: '“', 0x94: '”',
+	0x95: '•', 0x96: '–', 0x97: '—', 0x9B: '›',
+}
+
+// repairCP1252 is b with each Windows-1252 punctuation byte in it made the
+// character it stands for, and how many were, when those are the only
+// bytes of b that aren't UTF-8; b itself and 0 otherwise.
+func repairCP1252(b []byte) ([]byte, int) {
+	if utf8.Valid(b) {
+		return b, 0
+	}
+	n := 0
+	for i := 0; i < len(b); {
+		r, size := utf8.DecodeRune(b[i:])
+		if r == utf8.RuneError && size == 1 {
+			if _, ok := cp1252Punctuation[b[i]]; !ok {
+				return b, 0
+			}
+			n++
+		}
+		i += size
+	}
+	out := make([]byte, 0, len(b)+2*n)
+	for i := 0; i < len(b); {
+		r, size := utf8.DecodeRune(b[i:])
+		if r == utf8.RuneError && size == 1 {
+			out = utf8.AppendRune(out, cp1252Punctuation[b[i]])
+		} else {
+			out = append(out, b[i:i+size]...)
+		}
+		i += size
+	}
+	return out, n
+}
+
+// the characters Windows-1252 has for 0x80 to 0x9F; the five it leaves
+// undefined stand for themselves, as browsers have them
+var cp1252High = [32]rune{
+	'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8D, 'Ž', 0x8F,
+	0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9D, 'ž', 'Ÿ',
+}
+
+// cp1252Rune is the character byte c stands for in Windows-1252.
+func cp1252Rune(c byte) rune {
+	if c >= 0x80 && c < 0xA0 {
+		return cp1252High[c-0x80]
+	}
+	return rune(c)
+}
+
+// eightBit reports whether b, not UTF-8, is in an 8-bit encoding
+// throughout: it has fewer characters of UTF-8 past ASCII than bytes that
+// aren't UTF-8.
+func eightBit(b []byte) bool {
+	multi, bad := 0, 0
+	for i := 0; i < len(b); {
+		r, size := utf8.DecodeRune(b[i:])
+		if r == utf8.RuneError && size == 1 {
+			bad++
+		} else if size > 1 {
+			multi++
+		}
+		i += size
+	}
+	return bad > multi
+}
+
+// decodeCP1252 is b decoded from Windows-1252, and how many of its bytes
+// were past ASCII.
+func decodeCP1252(b []byte) ([]byte, int) {
+	n := 0
+	out := make([]byte, 0, len(b)+len(b)/8)
+	for _, c := range b {
+		if c < 0x80 {
+			out = append(out, c)
+			continue
+		}
+		out = utf8.AppendRune(out, cp1252Rune(c))
+		n++
+	}
+	return out, n
+}
+
+// fixEncoding is b with its Windows-1252 punctuation repaired, and how
+// many bytes were, or else decoded from Windows-1252 throughout, and how
+// many bytes past ASCII were; b itself and 0, 0 when it is UTF-8, or mostly
+// UTF-8 with other bytes astray.
+func fixEncoding(b []byte) (fixed []byte, repaired, decoded int) {
+	if fixed, n := repairCP1252(b); n > 0 {
+		return fixed, n, 0
+	}
+	if utf8.Valid(b) || !eightBit(b) {
+		return b, 0, 0
+	}
+	fixed, n := decodeCP1252(b)
+	return fixed, 0, n
+}
+
+// fixedAt maps a byte offset into a text fixEncoding fixed to where the
+// same byte is in the fix: each byte repaired before it, or once decoded
+// each past ASCII, became the bytes of the character it stands for.
+func fixedAt(b []byte, decoded bool) func(int) int {
+	// the offsets of the bytes that grew, and how much all those up to
+	// each had
+	var at, grown []int
+	total := 0
+	for i := 0; i < len(b); {
+		size := 1
+		if decoded {
+			if b[i] >= 0x80 {
+				total += utf8.RuneLen(cp1252Rune(b[i])) - 1
+				at, grown = append(at, i), append(grown, total)
+			}
+		} else {
+			var r rune
+			if r, size = utf8.DecodeRune(b[i:]); r == utf8.RuneError && size == 1 {
+				total += 2
+				at, grown = append(at, i), append(grown, total)
+			}
+		}
+		i += size
+	}
+	return func(off int) int {
+		n := sort.SearchInts(at, off)
+		if n == 0 {
+			return off
+		}
+		return off + grown[n-1]
+	}
+}
+
+// fixMember repairs or decodes each text of m as fixEncoding does.
+func fixMember(m zipMember) zipMember {
+	if fixed, repaired, decoded := fixEncoding(m.text.Bytes()); repaired+decoded > 0 {
+		m.text, m.repaired, m.decoded = bytes.NewBuffer(fixed), repaired, decoded
+	}
+	for i := range m.more {
+		m.more[i] = fixMember(m.more[i])
+	}
+	return m
+}
+
+func fixEncodingCmd(args []string) error {
+	fs := flag.NewFlagSet("fix-encoding", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "count the books and chunks that would be repaired, without writing")
+	fs.Parse(args)
+
+	if fs.NArg() > 0 {
+		return usagef("usage: gutchunk fix-encoding [--dry-run]")
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	books, err := fixBooks(db, *dryRun)
+	if err != nil {
+		return err
+	}
+	chunks, err := fixChunks(db, "chunks", "chunk", *dryRun)
+	if err != nil {
+		return err
+	}
+	notes, err := fixChunks(db, "footnotes", "text", *dryRun)
+	if err != nil {
+		return err
+	}
+	verb, decode := "repaired", "decoded"
+	if *dryRun {
+		verb, decode = "would repair", "would decode"
+	}
+	fmt.Printf("%s %d Windows-1252 punctuation bytes in %d books, %s %d books from Windows-1252, and %s %d chunks and %d footnotes\n",
+		verb, books.bytes, books.repaired, decode, books.decoded, verb, chunks, notes)
+	if books.repaired+books.decoded > 0 && !*dryRun {
+		fmt.Println("their headers are repaired too; run gutchunk reparse-headers for their titles and authors, and gutchunk chunk for text the chunker passed over")
+	}
+	return nil
+}
+
+// bookFixes are the books fix-encoding repaired, and the bytes of them it
+// did, and decoded.
+type bookFixes struct {
+	repaired, bytes, decoded int
+}
+
+// fixBooks repairs or decodes the content and header of each book whose
+// content has Windows-1252 in it, a book to a transaction, with its
+// content hash and the offsets of its chunks stored as references into
+// it, returning how many books it fixed.
+func fixBooks(db *sql.DB, dryRun bool) (bookFixes, error) {
+	var books bookFixes
+	last := int64(0)
+	shown := time.Now()
+	for {
+		var id int64
+		var blob string
+		var content []byte
+		err := db.QueryRow("SELECT id, coalesce(content_blob, ''), CAST("+contentCol("")+" AS BLOB) FROM files WHERE id > ? AND "+hasContent("")+" AND deleted_at IS NULL ORDER BY id LIMIT 1", last).
+			Scan(&id, &blob, &content)
+		if err == sql.ErrNoRows {
+			return books, nil
+		}
+		if err != nil {
+			return books, err
+		}
+		last = id
+		fixed, repaired, decoded := fixEncoding(content)
+		if repaired > 0 {
+			books.repaired++
+			books.bytes += repaired
+		} else if decoded > 0 {
+			books.decoded++
+		} else {
+			continue
+		}
+		if dryRun {
+			continue
+		}
+		if err = fixBook(db, id, blob, content, fixed, repaired, decoded); err != nil {
+			return books, fmt.Errorf("could not repair book %d: %w", id, err)
+		}
+		if time.Since(shown) >= 5*time.Second {
+			shown = time.Now()
+			fmt.Printf("repaired %d books and decoded %d, up to book %d\n", books.repaired, books.decoded, id)
+		}
+	}
+}
+
+// fixBook writes fixed, book id's content repaired or decoded, in the bulk
+// lane.
+// A book moved to the blob store, its blob, gets a blob of the repair in
+// place of that one, which is deleted once no other book has it.
+func fixBook(db *sql.DB, id int64, blob string, content, fixed []byte, repaired, decoded int) error {
+	var hash string
+	if blob != "" {
+		store := contentBlobs()
+		if store == nil {
+			return fmt.Errorf("its content is blob %s, and the database records no blob store", short(blob))
+		}
+		var err error
+		if hash, err = saveBlob(store, string(fixed)); err != nil {
+			return err
+		}
+	}
+	err := writerOf(db).do(func(tx *sql.Tx) error {
+		return fixBookRow(tx, id, hash, content, fixed, repaired, decoded)
+	})
+	if err != nil || blob == "" || blob == hash {
+		return err
+	}
+	return dropBlob(context.Background(), db, blob)
+}
+
+// fixBookRow writes fixed to book id's row, or blob the repair is kept in
+// to it.
+func fixBookRow(tx *sql.Tx, id int64, blob string, content, fixed []byte, repaired, decoded int) error {
+	var header sql.NullString
+	err := tx.QueryRow("SELECT header FROM files WHERE id = ?", id).Scan(&header)
+	if err != nil {
+		return err
+	}
+	if header.Valid {
+		h, _, _ := fixEncoding([]byte(header.String))
+		header.String = string(h)
+	}
+	if blob != "" {
+		_, err = tx.Exec("UPDATE files SET content_blob = ?, content_bytes = ?, header = ?, content_hash = ? WHERE id = ?",
+			blob, len(fixed), header, blob, id)
+	} else {
+		_, err = tx.Exec("UPDATE files SET content = ?, header = ?, content_hash = ? WHERE id = ?",
+			string(fixed), header, textHash(string(fixed)), id)
+	}
+	if err != nil {
+		return err
+	}
+	if chunkStorage == storageReference {
+		at := fixedAt(content, decoded > 0)
+		rows, err := tx.Query("SELECT id, start_offset, end_offset FROM chunk_refs WHERE sourceid = ? AND start_offset IS NOT NULL", id)
+		if err != nil {
+			return err
+		}
+		type ref struct{ id, start, end int }
+		var refs []ref
+		for rows.Next() {
+			var r ref
+			if err = rows.Scan(&r.id, &r.start, &r.end); err != nil {
+				rows.Close()
+				return err
+			}
+			refs = append(refs, r)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		for _, r := range refs {
+			if _, err = tx.Exec("UPDATE chunk_refs SET start_offset = ?, end_offset = ?, token_count = NULL WHERE id = ?", at(r.start), at(r.end), r.id); err != nil {
+				return err
+			}
+		}
+	}
+	return encodingWarning(tx, id, repaired, decoded)
+}
+
+// encodingWarning is the info warning of book id having had repaired bytes
+// of Windows-1252 punctuation repaired, or decoded bytes decoded.
+func encodingWarning(tx *sql.Tx, id int64, repaired, decoded int) error {
+	at := warnAt{scope: scopeIngest, fileID: id}
+	switch {
+	case repaired > 0:
+		return warnf(tx, at, sevInfo, warnCP1252, "repaired %d Windows-1252 punctuation bytes", repaired)
+	case decoded > 0:
+		return warnf(tx, at, sevInfo, warnDecoded, "decoded from Windows-1252, %d bytes past ascii", decoded)
+	}
+	return nil
+}
+
+// fixChunks repairs the Windows-1252 punctuation of column of table, the
+// chunks or the footnotes, or decodes it, each row judged by itself as
+// fixEncoding judges a book, a batch at a time,
+// returning how many rows it repaired. Token counts no longer apply and
+// are cleared for count-tokens to redo, and chunks' content scans for
+// flag-content to.
+func fixChunks(db *sql.DB, table, column string, dryRun bool) (int, error) {
+	clear, rescan := "", false
+	if table == "chunks" {
+		clear, rescan = ", token_count = NULL", true
+	}
+	last, changed := 0, 0
+	for {
+		rows, err := db.Query(fmt.Sprintf("SELECT id, CAST(%s AS BLOB) FROM %s WHERE id > ? ORDER BY id LIMIT ?", column, table), last, exportBatch)
+		if err != nil {
+			return changed, err
+		}
+		type fix struct {
+			id   int
+			text string
+		}
+		var batch []fix
+		n := 0
+		for rows.Next() {
+			var id int
+			var text []byte
+			if err = rows.Scan(&id, &text); err != nil {
+				rows.Close()
+				return changed, err
+			}
+			n++
+			last = id
+			if fixed, repaired, decoded := fixEncoding(text); repaired+decoded > 0 {
+				batch = append(batch, fix{id, string(fixed)})
+			}
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return changed, err
+		}
+		if n == 0 {
+			return changed, nil
+		}
+		if dryRun || len(batch) == 0 {
+			changed += len(batch)
+			continue
+		}
+		err = writerOf(db).do(func(tx *sql.Tx) error {
+			for _, f := range batch {
+				if _, err := tx.Exec(fmt.Sprintf("UPDATE %s SET %s = ?%s WHERE id = ?", table, column, clear), f.text, f.id); err != nil {
+					return err
+				}
+				if rescan {
+					if _, err := tx.Exec("DELETE FROM content_scans WHERE chunk_id = ?", f.id); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return changed, err
+		}
+		changed += len(batch)
+	}
+}
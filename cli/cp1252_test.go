@@ -0,0 +1,258 @@
+package cli
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestRepairCP1252(t *testing.T) {
+	tests := []struct {
+		in, want string
+		n        int
+	}{
+		{"plain", "plain", 0},
+		{"already “quoted”", "already “quoted”", 0},
+		{"\x93quoted\x94", "“quoted”", 2},
+		{"it\x92s 1914\x961918", "it’s 1914–1918", 2},
+		// another invalid byte: an 8-bit text throughout, not repaired
+		{"\x93Bront\xeb\x94", "\x93Bront\xeb\x94", 0},
+	}
+	for _, tt := range tests {
+		got, n := repairCP1252([]byte(tt.in))
+		if string(got) != tt.want || n != tt.n {
+			t.Errorf("repairCP1252(%q) = %q, %d, want %q, %d", tt.in, got, n, tt.want, tt.n)
+		}
+	}
+}
+
+func TestFixEncoding(t *testing.T) {
+	tests := []struct {
+		in, want          string
+		repaired, decoded int
+	}{
+		{"plain", "plain", 0, 0},
+		{"Brontë, “quoted”", "Brontë, “quoted”", 0, 0},
+		{"\x93quoted\x94", "“quoted”", 2, 0},
+		// UTF-8 with a few punctuation bytes is repaired
+		{"Brontë said \x93no\x94", "Brontë said “no”", 2, 0},
+		// Latin-1, and Windows-1252 throughout, are decoded
+		{"Bront\xeb", "Brontë", 0, 1},
+		{"\x93Bront\xeb\x94 \x80 5", "“Brontë” € 5", 0, 4},
+		{"caf\xe9 na\xefve d\xe9bris", "café naïve débris", 0, 3},
+		{"undefined \x81", "undefined \u0081", 0, 1},
+		// UTF-8 with more characters past ASCII than stray bytes is left
+		{"Brontë, café, naïve, \xe9", "Brontë, café, naïve, \xe9", 0, 0},
+	}
+	for _, tt := range tests {
+		got, repaired, decoded := fixEncoding([]byte(tt.in))
+		if string(got) != tt.want || repaired != tt.repaired || decoded != tt.decoded {
+			t.Errorf("fixEncoding(%q) = %q, %d, %d, want %q, %d, %d", tt.in, got, repaired, decoded, tt.want, tt.repaired, tt.decoded)
+		}
+	}
+}
+
+func TestFixedAt(t *testing.T) {
+	tests := []struct {
+		in      string
+		decoded bool
+		bytes   map[int]string
+	}{
+		{"a\x93b\x94c", false, map[int]string{0: "a", 2: "b", 4: "c"}},
+		{"Bront\xeb \x80x", true, map[int]string{0: "B", 5: "ë", 6: " ", 7: "€", 8: "x"}},
+	}
+	for _, tt := range tests {
+		at := fixedAt([]byte(tt.in), tt.decoded)
+		fixed, _, _ := fixEncoding([]byte(tt.in))
+		for i, want := range tt.bytes {
+			if got := string(fixed[at(i) : at(i)+len(want)]); got != want {
+				t.Errorf("%q: at(%d) is %q, want %q", tt.in, i, got, want)
+			}
+		}
+	}
+}
+
+// testArchives zips each fixture of testdata/encoding as a book of its
+// own in a mirror of the test's.
+func testArchives(t *testing.T, names ...string) string {
+	t.Helper()
+	root := t.TempDir()
+	for i, name := range names {
+		text, err := os.ReadFile(filepath.Join("testdata", "encoding", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		num := strconv.Itoa(10001 + i)
+		f, err := os.Create(filepath.Join(root, num+".zip"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		zw := zip.NewWriter(f)
+		w, _ := zw.Create(num + ".txt")
+		w.Write(text)
+		if err = zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	return root
+}
+
+// Ingest repairs the punctuation of a mostly ASCII text and decodes a
+// Latin-1 one, and the chunks of both are UTF-8.
+func TestIngestFixesEncoding(t *testing.T) {
+	db := testDB(t)
+	if err := readFiles(db, testArchives(t, "quotes.txt", "latin1.txt"), ingestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := makeChunks(db, chunkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.Query("SELECT chunk FROM chunks ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var all []string
+	for rows.Next() {
+		var c string
+		rows.Scan(&c)
+		if !utf8.ValidString(c) {
+			t.Errorf("chunk %q isn't UTF-8", c)
+		}
+		all = append(all, c)
+	}
+	text := strings.Join(all, "\n")
+	for _, want := range []string{"“I shall not go out to-day,”", "‘You said as much on Tuesday,’", "wet to the knees –", "Charlotte Brontë", "café", "À la fin", "señora"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("no chunk has %q", want)
+		}
+	}
+	var warned []string
+	wrows, _ := db.Query("SELECT code FROM warnings ORDER BY file_id")
+	for wrows.Next() {
+		var code string
+		wrows.Scan(&code)
+		warned = append(warned, code)
+	}
+	wrows.Close()
+	if strings.Join(warned, " ") != warnCP1252+" "+warnDecoded {
+		t.Errorf("warnings %v, want %s and %s", warned, warnCP1252, warnDecoded)
+	}
+}
+
+func TestFixBooksDecodes(t *testing.T) {
+	db := testDB(t)
+	latin, err := os.ReadFile(filepath.Join("testdata", "encoding", "latin1.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := addBook(t, db, "haworth", "Someone", string(latin))
+	books, err := fixBooks(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if books.decoded != 1 || books.repaired != 0 {
+		t.Errorf("fixed %+v, want one book decoded", books)
+	}
+	var content string
+	db.QueryRow("SELECT content FROM files WHERE id = ?", id).Scan(&content)
+	if !utf8.ValidString(content) || !strings.Contains(content, "Charlotte Brontë") {
+		t.Errorf("content still isn't UTF-8: %q", content[:80])
+	}
+}
+
+// testBlobStore moves the content of db's books to a blob store of the
+// test's own.
+func testBlobStore(t *testing.T, db *sql.DB) dirBlobs {
+	t.Helper()
+	store := dirBlobs{t.TempDir()}
+	if _, err := db.Exec("INSERT INTO blob_store (dir) VALUES (?)", store.dir); err != nil {
+		t.Fatal(err)
+	}
+	setContentBlobs(store)
+	t.Cleanup(func() { setContentBlobs(nil) })
+	if err := moveContent(context.Background(), db, store, 10, &blobReport{}); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestFixBooksInRow(t *testing.T) {
+	db := testDB(t)
+	id := addBook(t, db, "quotes", "Someone", "He said \x93hello\x94.")
+	books, err := fixBooks(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if books.repaired != 1 || books.bytes != 2 {
+		t.Errorf("repaired %d bytes of %d books, want 2 of 1", books.bytes, books.repaired)
+	}
+	var content, hash string
+	db.QueryRow("SELECT content, content_hash FROM files WHERE id = ?", id).Scan(&content, &hash)
+	if content != "He said “hello”." || hash != textHash(content) {
+		t.Errorf("content %q, hash %s", content, hash)
+	}
+}
+
+// A book moved to the blob store stays there, its blob the repair's.
+func TestFixBooksBlob(t *testing.T) {
+	db := testDB(t)
+	id := addBook(t, db, "quotes", "Someone", "He said \x93hello\x94.")
+	store := testBlobStore(t, db)
+	var old string
+	db.QueryRow("SELECT content_blob FROM files WHERE id = ?", id).Scan(&old)
+
+	if _, err := fixBooks(db, false); err != nil {
+		t.Fatal(err)
+	}
+	var inRow *string
+	var blob, content string
+	var size int
+	err := db.QueryRow("SELECT content, content_blob, content_bytes, "+contentCol("")+" FROM files WHERE id = ?", id).
+		Scan(&inRow, &blob, &size, &content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inRow != nil {
+		t.Error("the repair was written to the row")
+	}
+	if content != "He said “hello”." || blob != textHash(content) || size != len(content) {
+		t.Errorf("reads %q from blob %s of %d bytes", content, short(blob), size)
+	}
+	if _, err := os.Stat(store.path(old)); !os.IsNotExist(err) {
+		t.Errorf("the old blob is left: %v", err)
+	}
+	if _, err := os.Stat(store.path(blob)); err != nil {
+		t.Errorf("no new blob: %v", err)
+	}
+}
+
+func TestFixChunks(t *testing.T) {
+	db := testDB(t)
+	id := addBook(t, db, "quotes", "Someone", "x")
+	insertChunk(t, db, id, 0, "\x93chunked\x94")
+	insertChunk(t, db, id, 1, "fine")
+	if _, err := db.Exec("UPDATE chunks SET token_count = CASE ordinal WHEN 0 THEN 5 ELSE 1 END"); err != nil {
+		t.Fatal(err)
+	}
+	n, err := fixChunks(db, "chunks", "chunk", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("repaired %d chunks, want 1", n)
+	}
+	var chunk string
+	var tokens *int
+	db.QueryRow("SELECT chunk, token_count FROM chunks WHERE ordinal = 0").Scan(&chunk, &tokens)
+	if chunk != "“chunked”" || tokens != nil {
+		t.Errorf("chunk %q, token count %v", chunk, tokens)
+	}
+}
@@ -0,0 +1,940 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+var keyFile = flag.String("key-file", "", "file containing the database encryption key (or set GUTCHUNK_DB_KEY)")
+
+func dbKey() (string, error) {
+	if *keyFile == "" {
+		return os.Getenv("GUTCHUNK_DB_KEY"), nil
+	}
+	bs, err := os.ReadFile(*keyFile)
+	if err != nil {
+		return "", fmt.Errorf("could not read key file: %w", err)
+	}
+	key := strings.TrimRight(string(bs), "\r\n")
+	if key == "" {
+		return "", fmt.Errorf("key file %s is empty", *keyFile)
+	}
+	return key, nil
+}
+
+// connOptions are what every connection of a pool is opened with.
+type connOptions struct {
+	// shards of chunks to attach, 0 for none
+	shards int
+	// enforce foreign keys (see chunksKeyed)
+	foreignKeys bool
+	// see chunk_refs through the chunks view (see storage.go)
+	refs bool
+	// temporary tables and views standing in for what a database that
+	// can't be migrated lacks (see schema.go)
+	standIns []string
+	// busy_timeout, 0 for busyTimeout()
+	busy time.Duration
+}
+
+// dbConnOptions are the options openDB last connected with.
+var dbConnOptions connOptions
+
+func connectDB(dsn, key string, o connOptions) (*sql.DB, error) {
+	driver, err := sqliteDriver(key)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	// pragmas only hold for the connection they run on, so every one is
+	// opened through connector to set them
+	d := db.Driver()
+	db.Close()
+	db = sql.OpenDB(connector{dsn, d, o})
+
+	// the key is only checked once sqlite actually reads a page
+	_, err = db.Exec("SELECT count(*) FROM sqlite_master")
+	var serr sqlite3.Error
+	if errors.As(err, &serr) && serr.Code == sqlite3.ErrNotADB {
+		db.Close()
+		if key == "" {
+			return nil, errors.New("database is encrypted or not a sqlite database; supply --key-file or GUTCHUNK_DB_KEY")
+		}
+		return nil, errors.New("wrong database key")
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// chunksTable is the chunks table, named table, in layout (see layout.go).
+// In the clustered layout id is picked by writeChunks rather than being the
+// rowid, and a book's chunks need no index of their own.
+func chunksTable(layout, table string) string {
+	id, notNull, key, without, index := "INTEGER PRIMARY KEY", "", "", "", ""
+	if layout == chunksClustered {
+		id, notNull, key, without = "INTEGER NOT NULL UNIQUE", " NOT NULL", ",\n\t\t\tPRIMARY KEY (sourceid, ordinal)", " WITHOUT ROWID"
+	} else if table == "chunks" {
+		index = ";\n\t\tCREATE INDEX IF NOT EXISTS chunks_sourceid ON chunks(sourceid)"
+	}
+	return fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			id       %s,
+			chunk    TEXT,
+			sourceid INTEGER%s,
+			-- position of the chunk within its book, from 0
+			ordinal  INTEGER%[3]s,
+			-- filled in by count-tokens
+			token_count INTEGER,
+			-- the works_in_file row of the anthology work the chunk is from
+			work_id  INTEGER,
+			-- scene breaks before the chunk in its book, with chunk --scenes
+			scene    INTEGER,
+			-- 1 when boilerplate --suppress approved the chunk's text
+			boilerplate INTEGER,
+			-- how far through its book's body the chunk's middle is, 0 to 1
+			position_pct REAL,
+			-- narrative, dialogue, letter or epigraph, with chunk --tag-kinds
+			kind     TEXT,
+			-- the same for the same text of the same book (see stableid.go)
+			stable_id TEXT,
+
+			FOREIGN KEY (sourceid) REFERENCES files(id)%s
+		)%s%s`, table, id, notNull, key, without, index)
+}
+
+// schemaTables are the tables besides chunks (see chunksTable) as this
+// version makes them.
+const schemaTables = `
+		CREATE TABLE IF NOT EXISTS files (
+			id       INTEGER PRIMARY KEY,
+			name     TEXT,
+			author   TEXT,
+			filename TEXT,
+			content  TEXT,
+			-- base name of the zip member and its full path inside the archive,
+			-- for the cache layout the text's name, where filename is the
+			-- ebook number's as the aleph layout has it (see archivename.go)
+			member_name  TEXT,
+			archive_path TEXT,
+			author_norm  TEXT,
+			-- the title folded, see normalizeTitle
+			title_norm   TEXT,
+			-- title_norm transliterated, for titles in Cyrillic or Greek
+			-- (see translit.go); null for the rest
+			title_translit TEXT,
+			-- title_norm without a leading article, for books --sort title
+			-- --ignore-articles (see sortTitle)
+			title_sort   TEXT,
+			-- set by group-volumes for files that are one volume of a work
+			work_id      INTEGER,
+			volume       INTEGER,
+			-- ebook number from the archive name or the header, the etext
+			-- edition (x100, see parseArchiveName) and which mirror layout
+			-- the archive came from
+			ebook        INTEGER,
+			edition      INTEGER,
+			layout       TEXT,
+			source_id    INTEGER,
+			-- the archive ingested from, as named in ingest_journal
+			archive      TEXT,
+			-- comma separated codes for the Language: header line, ''
+			-- when there is none
+			language     TEXT,
+			-- set by near-dupes --prefer to the book kept in place of this
+			-- one; random never draws suppressed books
+			suppressed_by INTEGER,
+			-- set by dupes --mark to the id of the book representing the
+			-- editions of one work; random --unique-works draws only from
+			-- representatives
+			duplicate_group INTEGER,
+			-- the text before the START marker, as it was, for parsing
+			-- metadata again without reading content (see rawHeader)
+			header       TEXT,
+			-- ok, no_title, no_author or no_header: what ingest found of
+			-- the title and author (see metadataStatus)
+			metadata_status TEXT,
+			-- versions of one ebook count from 1; superseded_by is the
+			-- version that replaced this one (see versions.go), and
+			-- content_hash the sha256 of content
+			version       INTEGER,
+			superseded_by INTEGER,
+			content_hash  TEXT,
+			-- the year a first published line near the start gives, 0 for
+			-- none; and the year the book is dated to, with what dated it:
+			-- meta, header or author (see era.go)
+			first_published INTEGER,
+			era_year      INTEGER,
+			era_basis     TEXT,
+			-- where name and author came from: header, catalog or meta,
+			-- null for the header or meta before they were recorded (see
+			-- names.go)
+			title_source  TEXT,
+			author_source TEXT,
+			-- where language came from: header, meta or detected from the
+			-- body, null for a book with none (see langdetect.go)
+			language_source TEXT,
+			-- the catalog agent author_norm is the name of, null for a
+			-- provisional author (see aliases.go)
+			author_id     INTEGER,
+			-- when name, author or language last changed after ingest,
+			-- by files_metadata_au (see reexport.go)
+			metadata_updated_at TEXT,
+			-- complete or incomplete, as check-complete last found the
+			-- book, and why incomplete, null for one not checked (see
+			-- completeness.go)
+			completeness  TEXT,
+			completeness_reasons TEXT,
+			-- set by rm; purge deletes the row for good
+			deleted_at   TEXT,
+			-- set by migrate-blobs for a book whose content was moved to
+			-- the blob store: the sha256 its blob is named by, and the
+			-- content's size in bytes (see blobs.go)
+			content_blob  TEXT,
+			content_bytes INTEGER,
+			-- 1 for a book stored without a Gutenberg header, an upload
+			-- with no START marker, chunked from its first line whatever
+			-- chunks it again
+			body_only     INTEGER
+		);
+
+		-- where ingested books came from: the mirror root walked and a
+		-- label for that snapshot
+		CREATE TABLE IF NOT EXISTS sources (
+			id         INTEGER PRIMARY KEY,
+			root       TEXT,
+			label      TEXT UNIQUE,
+			created_at TEXT
+		);
+
+		-- books ingest refused because a book of the same filename but
+		-- different content came from another source first
+		CREATE TABLE IF NOT EXISTS source_conflicts (
+			id           INTEGER PRIMARY KEY,
+			filename     TEXT,
+			file_id      INTEGER,
+			source_id    INTEGER,
+			archive_path TEXT,
+			created_at   TEXT
+		);
+
+		CREATE TABLE IF NOT EXISTS works (
+			id     INTEGER PRIMARY KEY,
+			title  TEXT,
+			author TEXT
+		);
+
+		-- precomputed by refresh-stats so sampling never has to count at
+		-- query time. cum_sqrt is the running total of sqrt(chunks) in rowid
+		-- order, for weighted author selection.
+		CREATE TABLE IF NOT EXISTS author_stats (
+			author   TEXT PRIMARY KEY,
+			books    INTEGER,
+			chunks   INTEGER,
+			cum_sqrt REAL
+		);
+
+		-- footnotes pulled out of the prose during chunking. ordinal is the
+		-- chunk the note followed, NULL when it came before the first chunk.
+		CREATE TABLE IF NOT EXISTS footnotes (
+			id       INTEGER PRIMARY KEY,
+			sourceid INTEGER,
+			marker   TEXT,
+			text     TEXT,
+			ordinal  INTEGER
+		);
+
+		CREATE INDEX IF NOT EXISTS footnotes_sourceid ON footnotes(sourceid);
+
+		-- the collation keys of books' titles and authors, books --locale
+		-- sorting by them, made the first time a locale is asked for (see
+		-- collation.go); title_bare is the title past a leading article
+		CREATE TABLE IF NOT EXISTS sort_keys (
+			file_id    INTEGER NOT NULL,
+			locale     TEXT NOT NULL,
+			title      BLOB,
+			title_bare BLOB,
+			author     BLOB,
+			PRIMARY KEY (file_id, locale)
+		);
+
+		CREATE INDEX IF NOT EXISTS sort_keys_title ON sort_keys(locale, title);
+		CREATE INDEX IF NOT EXISTS sort_keys_title_bare ON sort_keys(locale, title_bare);
+		CREATE INDEX IF NOT EXISTS sort_keys_author ON sort_keys(locale, author);
+
+		-- the chunks of each strategy after the first of chunk --strategy
+		-- a,b, written beside the first's in chunks, tagged with the
+		-- strategy as --strategy named it (see multistrategy.go)
+		CREATE TABLE IF NOT EXISTS strategy_chunks (
+			sourceid     INTEGER NOT NULL,
+			strategy     TEXT NOT NULL,
+			ordinal      INTEGER NOT NULL,
+			chunk        TEXT,
+			work_id      INTEGER,
+			scene        INTEGER,
+			position_pct REAL,
+			kind         TEXT,
+			stable_id    TEXT,
+			PRIMARY KEY (sourceid, strategy, ordinal)
+		);
+
+		-- every archive ingest has begun on, by the root walked and its
+		-- name under it (see paths.go): started before its transaction,
+		-- completed within it
+		CREATE TABLE IF NOT EXISTS ingest_journal (
+			archive      TEXT,
+			root         TEXT,
+			status       TEXT,
+			started_at   TEXT,
+			completed_at TEXT,
+			PRIMARY KEY (root, archive)
+		);
+
+		CREATE INDEX IF NOT EXISTS ingest_journal_root ON ingest_journal(root, status);
+
+
+		-- pinned and banned chunks. hash is of the chunk's text, so the flag
+		-- can follow it to a new row when its book is chunked again.
+		CREATE TABLE IF NOT EXISTS chunk_flags (
+			id         INTEGER PRIMARY KEY,
+			chunk_id   INTEGER,
+			hash       TEXT NOT NULL,
+			flag       TEXT NOT NULL,
+			note       TEXT,
+			created_at TEXT
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS chunk_flags_chunk_id ON chunk_flags(chunk_id);
+
+		-- how many times each term of a flag-content wordlist is in a
+		-- chunk, and the hash of the wordlist each chunk was last scanned
+		-- with (see contentflags.go)
+		CREATE TABLE IF NOT EXISTS content_flags (
+			chunk_id INTEGER NOT NULL,
+			term     TEXT NOT NULL,
+			count    INTEGER NOT NULL,
+			PRIMARY KEY (chunk_id, term)
+		);
+		CREATE TABLE IF NOT EXISTS content_scans (
+			chunk_id   INTEGER PRIMARY KEY,
+			wordlist   TEXT NOT NULL,
+			scanned_at TEXT
+		);
+
+		-- chunk texts found in many books and approved as boilerplate by
+		-- boilerplate --suppress; chunks written with one of them are
+		-- marked too. books is how many books had it when it was approved.
+		CREATE TABLE IF NOT EXISTS boilerplate (
+			hash       TEXT PRIMARY KEY,
+			chunk      TEXT,
+			books      INTEGER,
+			created_at TEXT
+		);
+
+		-- named sets of /chunks/random filters, see gutchunk preset;
+		-- params is a query string like "language=en&min_words=80"
+		CREATE TABLE IF NOT EXISTS presets (
+			name       TEXT PRIMARY KEY,
+			params     TEXT NOT NULL,
+			created_at TEXT,
+			updated_at TEXT
+		);
+
+		-- set by migrate-blobs: the directory of the blob store books'
+		-- content is moved to, relative to the database's own
+		CREATE TABLE IF NOT EXISTS blob_store (
+			dir TEXT NOT NULL
+		);
+
+		-- set by shard: the number of chunks_NN.db files chunks were moved to
+		CREATE TABLE IF NOT EXISTS chunk_shards (
+			n INTEGER NOT NULL
+		);
+
+		-- curated metadata imported by meta import. title, author and
+		-- language are written to files itself.
+		CREATE TABLE IF NOT EXISTS book_meta (
+			file_id    INTEGER PRIMARY KEY,
+			subjects   TEXT,
+			flags      TEXT,
+			-- the year to date the book to, over what else would
+			year       INTEGER,
+			updated_at TEXT
+		);
+
+		-- the title, type and author of each ebook in Project
+		-- Gutenberg's catalog, with the author's birth and death years,
+		-- as gutchunk catalog read them
+		CREATE TABLE IF NOT EXISTS catalog (
+			ebook      INTEGER PRIMARY KEY,
+			author     TEXT,
+			birth      INTEGER,
+			death      INTEGER,
+			updated_at TEXT,
+			title      TEXT,
+			type       TEXT
+		);
+
+		-- what GUTINDEX.ALL lists of an ebook, as gutchunk gutindex read it;
+		-- audio for an audio book (see gutindex.go)
+		CREATE TABLE IF NOT EXISTS gutindex (
+			ebook      INTEGER PRIMARY KEY,
+			title      TEXT,
+			author     TEXT,
+			language   TEXT,
+			audio      INTEGER NOT NULL DEFAULT 0,
+			updated_at TEXT
+		);
+
+		-- the series an ebook is in and its position there, null when not
+		-- known, as the catalog has them or series load read them from an
+		-- overrides file: source is catalog or override (see series.go)
+		CREATE TABLE IF NOT EXISTS series (
+			ebook    INTEGER NOT NULL,
+			name     TEXT NOT NULL COLLATE NOCASE,
+			position INTEGER,
+			source   TEXT NOT NULL,
+			PRIMARY KEY (ebook, name, source)
+		);
+		CREATE INDEX IF NOT EXISTS series_name ON series(name, position);
+
+		-- the translators, editors and illustrators credited with a book in
+		-- the order credited: by file_id as its header credits them, source
+		-- header, or by ebook as the catalog does, source catalog (see
+		-- contributors.go)
+		CREATE TABLE IF NOT EXISTS contributors (
+			file_id  INTEGER,
+			ebook    INTEGER,
+			role     TEXT NOT NULL,
+			name     TEXT NOT NULL,
+			position INTEGER NOT NULL,
+			source   TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS contributors_file ON contributors(file_id);
+		CREATE INDEX IF NOT EXISTS contributors_ebook ON contributors(ebook);
+
+		-- every title and author a book has been given, by where from:
+		-- its header, gutindex, the catalog or meta; files has the one shown
+		CREATE TABLE IF NOT EXISTS name_sources (
+			file_id    INTEGER NOT NULL,
+			-- title or author
+			field      TEXT NOT NULL,
+			source     TEXT NOT NULL,
+			value      TEXT NOT NULL,
+			updated_at TEXT,
+			PRIMARY KEY (file_id, field, source)
+		);
+
+		-- the names authors go by, keyed by aliasKey, and the author each
+		-- stands for: the catalog agent's name and id, or an author given
+		-- by alias add with no agent. source is catalog, fuzzy for a near
+		-- spelling resolveAuthors matched, with how near, or manual
+		CREATE TABLE IF NOT EXISTS author_aliases (
+			alias      TEXT PRIMARY KEY,
+			agent_id   INTEGER,
+			author     TEXT NOT NULL,
+			source     TEXT NOT NULL,
+			confidence REAL,
+			updated_at TEXT
+		);
+
+		-- suspected duplicate books found by near-dupes, a < b, with the
+		-- estimated Jaccard similarity of their word shingles
+		CREATE TABLE IF NOT EXISTS book_similarities (
+			a          INTEGER,
+			b          INTEGER,
+			similarity REAL,
+			created_at TEXT,
+
+			PRIMARY KEY (a, b)
+		);
+
+		-- books removed with rm, kept after purge so ingest doesn't add
+		-- them again. hash is of the content.
+		CREATE TABLE IF NOT EXISTS tombstones (
+			id         INTEGER PRIMARY KEY,
+			file_id    INTEGER,
+			filename   TEXT,
+			hash       TEXT,
+			reason     TEXT,
+			created_at TEXT
+		);
+		CREATE INDEX IF NOT EXISTS tombstones_file_id ON tombstones(file_id);
+		CREATE INDEX IF NOT EXISTS tombstones_filename ON tombstones(filename);
+		CREATE INDEX IF NOT EXISTS tombstones_hash ON tombstones(hash);
+
+		-- every word of each book's author_norm, title_norm and
+		-- title_translit, for matching them word by word
+		CREATE TABLE IF NOT EXISTS name_words (
+			field   TEXT,
+			word    TEXT,
+			file_id INTEGER,
+
+			PRIMARY KEY (field, word, file_id)
+		);
+		CREATE INDEX IF NOT EXISTS name_words_file_id ON name_words(file_id);
+
+		-- the works segment found in anthologies, at lines of the book's body
+		CREATE TABLE IF NOT EXISTS works_in_file (
+			id           INTEGER PRIMARY KEY,
+			file_id      INTEGER,
+			title        TEXT,
+			start_offset INTEGER,
+			end_offset   INTEGER,
+			confidence   REAL,
+			created_at   TEXT
+		);
+		CREATE INDEX IF NOT EXISTS works_in_file_file_id ON works_in_file(file_id);
+
+		-- top terms per book written by freq --per-book
+		CREATE TABLE IF NOT EXISTS book_terms (
+			sourceid INTEGER,
+			n        INTEGER,
+			term     TEXT,
+			count    INTEGER,
+
+			PRIMARY KEY (sourceid, n, term)
+		);
+
+		-- what ingest, chunk and the metadata parsers found wrong and went
+		-- on past (see warnings.go): about a book, or an archive and member
+		-- of it that wasn't ingested, from the runs row of the command
+		CREATE TABLE IF NOT EXISTS warnings (
+			id         INTEGER PRIMARY KEY,
+			-- ingest, chunk or metadata
+			scope      TEXT NOT NULL,
+			-- info, warn or error
+			severity   TEXT NOT NULL,
+			-- like panic, binary or no_start_marker
+			code       TEXT NOT NULL,
+			file_id    INTEGER,
+			path       TEXT,
+			member     TEXT,
+			message    TEXT,
+			-- a panic's stack
+			detail     TEXT,
+			run_id     INTEGER,
+			created_at TEXT,
+			-- when gutchunk warnings --ack marked it reviewed
+			acked_at   TEXT
+		);
+		CREATE INDEX IF NOT EXISTS warnings_file_id ON warnings(file_id, scope);
+		CREATE INDEX IF NOT EXISTS warnings_run_id ON warnings(run_id);
+		CREATE INDEX IF NOT EXISTS warnings_path ON warnings(path);
+
+		CREATE TABLE IF NOT EXISTS runs (
+			id         INTEGER PRIMARY KEY,
+			command    TEXT,
+			started_at TEXT
+		);
+
+		-- what each run did to each book's chunks, for gutchunk changes
+		-- (see changes.go): chunks written by chunking it, or taken away
+		-- with it by rm, a re-release superseding it, prune-versions or an
+		-- ingest rolled back
+		CREATE TABLE IF NOT EXISTS chunk_log (
+			id         INTEGER PRIMARY KEY,
+			file_id    INTEGER NOT NULL,
+			run_id     INTEGER,
+			-- chunked, removed, superseded, pruned or rolled_back
+			event      TEXT NOT NULL,
+			-- chunks written, and those there were before with the run
+			-- that wrote them, null when that predates chunk_log
+			chunks     INTEGER NOT NULL,
+			replaced   INTEGER NOT NULL,
+			replaced_run INTEGER,
+			created_at TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS chunk_log_file_id ON chunk_log(file_id, id);
+		CREATE INDEX IF NOT EXISTS chunk_log_run_id ON chunk_log(run_id);
+		CREATE INDEX IF NOT EXISTS chunk_log_created_at ON chunk_log(created_at);
+
+		-- how many chunks each book has, kept as chunk_log is (see
+		-- counts.go), and when gutchunk recount last counted them all and
+		-- how many it found wrong
+		CREATE TABLE IF NOT EXISTS chunk_counts (
+			sourceid INTEGER PRIMARY KEY,
+			chunks   INTEGER NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS chunk_counts_state (
+			id           INTEGER PRIMARY KEY CHECK (id = 1),
+			recounted_at TEXT NOT NULL,
+			drift        INTEGER NOT NULL
+		);
+
+		-- the chunks random and /chunks/random served, to whom (see served.go)
+		CREATE TABLE IF NOT EXISTS served_log (
+			id        INTEGER PRIMARY KEY,
+			chunk_id  INTEGER NOT NULL,
+			served_at TEXT NOT NULL,
+			label     TEXT NOT NULL DEFAULT ''
+		);
+		CREATE INDEX IF NOT EXISTS served_log_label ON served_log(label, chunk_id, served_at);
+		CREATE INDEX IF NOT EXISTS served_log_served_at ON served_log(served_at);
+
+		-- work serve does in the background, kept till done (see jobs.go)
+		CREATE TABLE IF NOT EXISTS jobs (
+			id            INTEGER PRIMARY KEY,
+			type          TEXT NOT NULL,
+			-- what the job's handler runs it from, json; dropped once done
+			payload       TEXT,
+			-- queued, running, done or failed
+			state         TEXT NOT NULL,
+			attempts      INTEGER NOT NULL DEFAULT 0,
+			-- what the handler returned, json
+			result        TEXT,
+			last_error    TEXT,
+			-- not to be claimed before
+			run_after     TEXT NOT NULL,
+			-- a running job not done by then is claimed again
+			claimed_until TEXT,
+			created_at    TEXT NOT NULL,
+			updated_at    TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS jobs_due ON jobs(state, run_after);
+
+		-- where a database dump-sample wrote came from, its one row a
+		-- provenance record, json (see provenance.go); empty otherwise
+		CREATE TABLE IF NOT EXISTS provenance (
+			id     INTEGER PRIMARY KEY CHECK (id = 1),
+			record TEXT NOT NULL
+		);
+
+		-- the stable id each chunk a re-chunk changed had, and the one the
+		-- chunk in its place has (see stableid.go)
+		CREATE TABLE IF NOT EXISTS stable_id_map (
+			old_id     TEXT PRIMARY KEY,
+			new_id     TEXT NOT NULL,
+			sourceid   INTEGER,
+			run_id     INTEGER,
+			created_at TEXT NOT NULL
+		);
+
+		-- how far gutchunk review is through each queue, by the queue with
+		-- its filters, and each decision made in it, by run, for its
+		-- reviewers' throughput (see review.go)
+		CREATE TABLE IF NOT EXISTS review_positions (
+			queue      TEXT PRIMARY KEY,
+			position   INTEGER NOT NULL,
+			updated_at TEXT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS review_log (
+			id          INTEGER PRIMARY KEY,
+			run_id      INTEGER,
+			queue       TEXT NOT NULL,
+			item        INTEGER NOT NULL,
+			action      TEXT NOT NULL,
+			reviewed_at TEXT NOT NULL
+		);
+
+		CREATE INDEX IF NOT EXISTS author_stats_cum_sqrt ON author_stats(cum_sqrt)`
+
+func createSchema(db *sql.DB) error {
+	// auto_vacuum can be set only before the first table, and lets
+	// gc-content --vacuum give space back (see gccontent.go)
+	var tables int
+	if err := db.QueryRow("SELECT count(*) FROM sqlite_master").Scan(&tables); err != nil {
+		return err
+	}
+	if tables == 0 {
+		if _, err := db.Exec("PRAGMA auto_vacuum = INCREMENTAL"); err != nil {
+			return err
+		}
+	}
+	if _, err := db.Exec(schemaTables); err != nil {
+		return err
+	}
+	if err := createChunks(db); err != nil {
+		return err
+	}
+
+	return migrate(db)
+}
+
+// migrate brings databases created by older versions up to date. Columns are
+// only ever added, so this is safe to run on every open.
+func migrate(db *sql.DB) error {
+	cols := []struct{ table, name, decl string }{
+		{"files", "member_name", "TEXT"},
+		{"files", "archive_path", "TEXT"},
+		{"files", "author_norm", "TEXT"},
+		{"chunks", "ordinal", "INTEGER"},
+		{"chunks", "token_count", "INTEGER"},
+		{"files", "work_id", "INTEGER"},
+		{"files", "volume", "INTEGER"},
+		{"files", "ebook", "INTEGER"},
+		{"files", "edition", "INTEGER"},
+		{"files", "layout", "TEXT"},
+		{"files", "source_id", "INTEGER"},
+		{"files", "archive", "TEXT"},
+		{"files", "language", "TEXT"},
+		{"files", "suppressed_by", "INTEGER"},
+		{"files", "header", "TEXT"},
+		{"files", "metadata_status", "TEXT"},
+		{"files", "version", "INTEGER"},
+		{"files", "superseded_by", "INTEGER"},
+		{"files", "content_hash", "TEXT"},
+		{"files", "deleted_at", "TEXT"},
+		{"chunks", "work_id", "INTEGER"},
+		{"files", "title_norm", "TEXT"},
+		{"chunks", "scene", "INTEGER"},
+		{"files", "duplicate_group", "INTEGER"},
+		{"chunks", "boilerplate", "INTEGER"},
+		{"files", "title_translit", "TEXT"},
+		{"files", "first_published", "INTEGER"},
+		{"files", "era_year", "INTEGER"},
+		{"files", "era_basis", "TEXT"},
+		{"book_meta", "year", "INTEGER"},
+		{"files", "title_source", "TEXT"},
+		{"files", "author_source", "TEXT"},
+		{"catalog", "title", "TEXT"},
+		{"catalog", "type", "TEXT"},
+		{"files", "author_id", "INTEGER"},
+		{"files", "metadata_updated_at", "TEXT"},
+		{"files", "title_sort", "TEXT"},
+		{"chunks", "position_pct", "REAL"},
+		{"files", "language_source", "TEXT"},
+		{"files", "completeness", "TEXT"},
+		{"files", "completeness_reasons", "TEXT"},
+		{"chunks", "kind", "TEXT"},
+		{"chunks", "stable_id", "TEXT"},
+		{"files", "content_blob", "TEXT"},
+		{"files", "content_bytes", "INTEGER"},
+		{"files", "body_only", "INTEGER"},
+	}
+	chunks := "chunks"
+	if chunkStorage == storageReference {
+		chunks = "chunk_refs"
+	}
+	for _, c := range cols {
+		// chunks stored as references are in chunk_refs, chunks being a
+		// view over it
+		if c.table == "chunks" {
+			c.table = chunks
+		}
+		if err := ensureColumn(db, c.table, c.name, c.decl); err != nil {
+			return err
+		}
+	}
+	if _, err := db.Exec(stableIndex(chunks)); err != nil {
+		return err
+	}
+
+	_, err := db.Exec(`
+		CREATE INDEX IF NOT EXISTS files_author_norm ON files(author_norm);
+		CREATE INDEX IF NOT EXISTS files_title_norm ON files(title_norm);
+		CREATE INDEX IF NOT EXISTS files_work_id ON files(work_id);
+		CREATE INDEX IF NOT EXISTS files_ebook ON files(ebook);
+		CREATE INDEX IF NOT EXISTS files_filename ON files(filename);
+		CREATE INDEX IF NOT EXISTS files_source_id ON files(source_id);
+		CREATE INDEX IF NOT EXISTS files_archive ON files(archive);
+		CREATE INDEX IF NOT EXISTS files_language ON files(language);
+		CREATE INDEX IF NOT EXISTS files_era_year ON files(era_year);
+		CREATE INDEX IF NOT EXISTS files_metadata_updated_at ON files(metadata_updated_at);
+		CREATE INDEX IF NOT EXISTS files_title_sort ON files(title_sort);
+		CREATE INDEX IF NOT EXISTS files_content_blob ON files(content_blob);
+		CREATE TRIGGER IF NOT EXISTS files_metadata_au AFTER UPDATE OF name, author, language ON files
+		WHEN old.name IS NOT new.name OR old.author IS NOT new.author OR old.language IS NOT new.language BEGIN
+			UPDATE files SET metadata_updated_at = datetime('now') WHERE id = new.id;
+		END;
+		-- content written to the row again is the book's, over its blob
+		CREATE TRIGGER IF NOT EXISTS files_content_au AFTER UPDATE OF content ON files
+		WHEN new.content IS NOT NULL AND new.content_blob IS NOT NULL BEGIN
+			UPDATE files SET content_blob = NULL, content_bytes = NULL WHERE id = new.id;
+		END`)
+	if err != nil {
+		return err
+	}
+
+	return upgradeSchema(db)
+}
+
+// stableIndex keeps the stable ids of the chunks in table unique.
+func stableIndex(table string) string {
+	return fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %[1]s_stable_id ON %[1]s(stable_id)", table)
+}
+
+func hasColumn(db *sql.DB, table, column string) (bool, error) {
+	rows, err := db.Query(fmt.Sprintf("SELECT name FROM pragma_table_info('%s')", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+func ensureColumn(db *sql.DB, table, column, decl string) error {
+	ok, err := hasColumn(db, table, column)
+	if err != nil || ok {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, decl))
+	if err != nil {
+		return fmt.Errorf("could not add %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+func openDB() (*sql.DB, error) {
+	key, err := dbKey()
+	if err != nil {
+		return nil, err
+	}
+
+	o := connOptions{foreignKeys: true}
+	db, err := connectDB(dsn, key, o)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to %s: %w", dsn, err)
+	}
+
+	// what a database opened before lacked, until bridgeSchema finds this
+	// one lacks anything
+	missingSchema = nil
+	if err = checkSchemaVersion(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err = createSchema(db); err != nil && !isReadonly(err) {
+		db.Close()
+		return nil, fmt.Errorf("failed to create db schema: %w", err)
+	} else if err == nil && !inMemory(dsn) {
+		if err = walMode(db, dsn); err != nil {
+			db.Close()
+			return nil, err
+		}
+	} else if err != nil {
+		if err = createChunks(db); err == nil {
+			o.standIns, err = bridgeSchema(db)
+		}
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		if len(o.standIns) > 0 {
+			db.Close()
+			if db, err = connectDB(dsn, key, o); err != nil {
+				return nil, fmt.Errorf("could not connect to %s again: %w", dsn, err)
+			}
+		}
+	}
+
+	if o.shards, err = loadShardCount(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	chunkShards = o.shards
+	blobs, err := loadBlobStore(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	setContentBlobs(blobs)
+	o.refs = chunkStorage == storageReference
+	if o.foreignKeys, err = chunksKeyed(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if !o.foreignKeys {
+		fmt.Fprintln(os.Stderr, "warning: chunks were created with a foreign key naming files(sourceid), so it isn't enforced; gutchunk migrate-layout rowid declares it again")
+	}
+	if o.shards > 0 || !o.foreignKeys || o.refs {
+		db.Close()
+		if db, err = connectDB(dsn, key, o); err != nil {
+			return nil, fmt.Errorf("could not connect to %s again: %w", dsn, err)
+		}
+	}
+
+	if err = checkConnections(db, o.pragmas(), 4); err != nil {
+		db.Close()
+		return nil, err
+	}
+	dbConnOptions = o
+	return db, nil
+}
+
+// connector opens connections with the pragmas of its options, with
+// statement deadlines when there are timeouts (see deadlineConn), attaching
+// shards of chunks if there are any, the chunks view over chunk_refs in
+// the reference storage mode and any stand-ins, and registering translit
+// and blob_content.
+type connector struct {
+	dsn string
+	d   driver.Driver
+	connOptions
+}
+
+func (c connector) Connect(context.Context) (driver.Conn, error) {
+	conn, err := c.d.Open(c.dsn)
+	if err != nil {
+		return nil, deadlineErr(context.Background(), err)
+	}
+	sc := conn.(*sqlite3.SQLiteConn)
+	if err = setPragmas(sc, c.pragmas()); err != nil {
+		sc.Close()
+		return nil, err
+	}
+	if c.shards > 0 {
+		if err = attachShards(sc, c.dsn, c.shards); err != nil {
+			sc.Close()
+			return nil, err
+		}
+	}
+	if c.refs {
+		if err = attachRefs(sc); err != nil {
+			sc.Close()
+			return nil, err
+		}
+	}
+	if err = sc.RegisterFunc("translit", translitSQL, true); err != nil {
+		sc.Close()
+		return nil, fmt.Errorf("could not register translit: %w", err)
+	}
+	if err = sc.RegisterFunc("blob_content", blobContent(sc), false); err != nil {
+		sc.Close()
+		return nil, fmt.Errorf("could not register blob_content: %w", err)
+	}
+	for _, q := range c.standIns {
+		if _, err = sc.Exec(q, nil); err != nil {
+			sc.Close()
+			return nil, fmt.Errorf("could not stand in for a missing table: %w", err)
+		}
+	}
+	if withDeadlines() {
+		return deadlineConn{sc}, nil
+	}
+	return sc, nil
+}
+
+func (c connector) Driver() driver.Driver { return c.d }
+
+// nullInt stores 0 as NULL.
+func nullInt(n int) interface{} {
+	if n == 0 {
+		return nil
+	}
+	return n
+}
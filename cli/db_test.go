@@ -0,0 +1,131 @@
+package cli
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.tilde.town/gutchunker/gutchunk"
+)
+
+// testDB opens a new database of the test's own in memory, as --db
+// :memory: would, closing it when the test is done, so that tests write
+// nothing to disk.
+func testDB(t testing.TB) *sql.DB {
+	t.Helper()
+	s, err := gutchunk.NewMemoryStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	was := dsn
+	dsn = s.DSN()
+	db, err := openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		dsn = was
+	})
+	return db
+}
+
+// testFileDB opens a new database in a file under the test's temp
+// directory, for what needs files beside it, as shards do.
+func testFileDB(t testing.TB) *sql.DB {
+	t.Helper()
+	was := dsn
+	dsn = fileDSN(filepath.Join(t.TempDir(), "chunker.db"))
+	db, err := openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		dsn = was
+		chunkShards = 0
+	})
+	return db
+}
+
+// addBook stores a book as ingest would, without chunking it.
+func addBook(t testing.TB, db *sql.DB, name, author, content string) int {
+	t.Helper()
+	res, err := db.Exec("INSERT INTO files (name, author, filename, content, author_norm, title_norm, content_hash) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		name, author, name+".txt", content, normalizeAuthor(author), normalizeTitle(name), textHash(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := res.LastInsertId()
+	return int(id)
+}
+
+// insertChunk stores a chunk of book id at ordinal, returning its id. The
+// id is picked as writeChunks picks it, so it works in either layout of
+// the chunks table.
+func insertChunk(t testing.TB, db *sql.DB, id, ordinal int, text string) int {
+	t.Helper()
+	var chunk int
+	if err := db.QueryRow("SELECT coalesce(max(id), 0) + 1 FROM chunks").Scan(&chunk); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO chunks (id, sourceid, ordinal, chunk) VALUES (?, ?, ?, ?)", chunk, id, ordinal, text); err != nil {
+		t.Fatal(err)
+	}
+	return chunk
+}
+
+// rowidOnly skips a test of what the clustered layout doesn't have, when
+// the tests are run with -layout clustered.
+func rowidOnly(t testing.TB, what string) {
+	t.Helper()
+	if *chunksLayout == chunksClustered {
+		t.Skipf("%s needs the rowid layout", what)
+	}
+}
+
+// chunkCount is how many chunks book id has.
+func chunkCount(t testing.TB, db *sql.DB, id int) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM chunks WHERE sourceid = ?", id).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// testParagraphs is n paragraphs, each long enough to be a chunk of its own.
+func testParagraphs(n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b.WriteString("\n\n")
+		}
+		b.WriteString("It was a paragraph of the book, number " + strings.Repeat("i", i+1) + ", ")
+		b.WriteString(strings.Repeat("and it went on about the weather and the moors at some length, ", 6))
+		b.WriteString("as paragraphs will.")
+	}
+	return b.String()
+}
+
+// testBook is body between a Gutenberg header and footer.
+func testBook(title, body string) string {
+	return "The Project Gutenberg EBook of " + title + "\n\nTitle: " + title + "\n\n" +
+		"*** START OF THIS PROJECT GUTENBERG EBOOK " + strings.ToUpper(title) + " ***\n\n" +
+		body + "\n\n*** END OF THIS PROJECT GUTENBERG EBOOK " + strings.ToUpper(title) + " ***\n\nEnd of the license.\n"
+}
+
+func TestOpenDBCreatesSchema(t *testing.T) {
+	db := testDB(t)
+	for _, col := range []string{"content_blob", "body_only", "author_norm"} {
+		var n int
+		if err := db.QueryRow("SELECT count(*) FROM pragma_table_info('files') WHERE name = ?", col).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("files has no %s column", col)
+		}
+	}
+}
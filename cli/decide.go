@@ -0,0 +1,474 @@
+package cli
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Whether ingest takes an archive is up to a chain of rules, any of which
+// can turn it away: its name, the ignore files (see ignore.go), its mirror
+// layout, the journal, a newer edition beside it, the limits and stub
+// checks on its members, tombstones, another source's copy and the
+// current version of the ebook. Decide applies them in that order
+// and gives back each it applied and what it found, its reasons, and the
+// walks, ingest's store and gutchunk explain all go by it. A reason's code
+// is what the manifest's lines, the archive_skipped events and, for
+// members, the warnings table record.
+
+// the rules, in the order Decide applies them
+const (
+	ruleSuffix    = "suffix"
+	ruleIgnore    = "ignore"
+	ruleLayout    = "layout"
+	ruleJournal   = "journal"
+	ruleEdition   = "edition"
+	ruleLimits    = "limits"
+	ruleContent   = "content"
+	ruleStub      = "stub"
+	ruleMembers   = "members"
+	ruleTombstone = "tombstone"
+	ruleSource    = "source"
+	ruleVersion   = "version"
+)
+
+// the codes of what the rules find, besides the members' warning codes
+const (
+	codeBookArchive  = "book_archive"
+	codeNotBook      = "not_book_archive"
+	codeIgnored      = "ignored"
+	codeNotIgnored   = "not_ignored"
+	codeInLayout     = "in_layout"
+	codeOtherLayout  = "other_layout"
+	codeNotIngested  = "not_ingested"
+	codeIngested     = "already_ingested"
+	codeNewest       = "newest_edition"
+	codeSuperseded   = "superseded_edition"
+	codeBookMember   = "book_member"
+	codeNotRemoved   = "not_removed"
+	codeTombstoned   = "tombstoned"
+	codeNoConflict   = "no_conflict"
+	codeOtherSource  = "other_source"
+	codeFirstVersion = "first_version"
+	codeNewVersion   = "new_version"
+	codeSameText     = "same_text"
+	codeOtherMirror  = "other_mirror"
+)
+
+// memberRules is the rule behind each code readZip rejects a member with.
+var memberRules = map[string]string{
+	warnManyMembers: ruleLimits,
+	warnTooLarge:    ruleLimits,
+	"binary":        ruleContent,
+	"nul":           ruleContent,
+	warnStub:        ruleStub,
+	warnNoText:      ruleMembers,
+}
+
+// reasonTexts is how the log and the manifest's reason put the codes
+// turning an archive away that aren't about one of its members.
+var reasonTexts = map[string]string{
+	codeNotBook:     "not the zip of a book",
+	codeOtherLayout: "not in --mirror-layout",
+	codeIngested:    "already ingested",
+	codeSuperseded:  "superseded edition",
+	codeTombstoned:  "removed with gutchunk rm",
+	codeOtherSource: "in another source",
+	codeSameText:    "same text as the current version",
+	codeOtherMirror: "ingested from the other mirror layout",
+}
+
+// Reason is a rule Decide applied to an archive and what it found.
+type Reason struct {
+	Rule   string `json:"rule"`
+	Code   string `json:"code"`
+	Accept bool   `json:"accept"`
+	// the member the rule looked at, when it was about one
+	Member string `json:"member,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// text is r as the log, the events and the manifest give a reason: one of
+// reasonTexts, what turned away an archive with no book member to look
+// at, or else the member's code.
+func (r Reason) text() string {
+	if t, ok := reasonTexts[r.Code]; ok {
+		return t
+	}
+	if r.Member == "" && r.Detail != "" {
+		return r.Detail
+	}
+	return r.Code
+}
+
+// Decision is what Decide made of an archive.
+type Decision struct {
+	Ingest  bool     `json:"ingest"`
+	Reasons []Reason `json:"reasons"`
+	// the rules left unapplied for want of what they look at: the members
+	// of an archive not yet read, the database without a transaction
+	Pending []string `json:"pending,omitempty"`
+
+	// for storeBook: the member holding the book, its ebook number and
+	// the ebook's current version
+	book  *zipMember
+	ebook int
+	prior priorVersion
+}
+
+// Rejected is the reason d turns its archive away, the zero Reason when
+// no rule did.
+func (d Decision) Rejected() Reason {
+	if n := len(d.Reasons); n > 0 && !d.Reasons[n-1].Accept {
+		return d.Reasons[n-1]
+	}
+	return Reason{}
+}
+
+func (d *Decision) accept(rule, code, member, detail string) {
+	d.Reasons = append(d.Reasons, Reason{rule, code, true, member, detail})
+}
+
+func (d *Decision) reject(rule, code, member, detail string) {
+	d.Reasons = append(d.Reasons, Reason{rule, code, false, member, detail})
+}
+
+// ArchiveInfo is what Decide knows of an archive besides its name.
+type ArchiveInfo struct {
+	// where it was read from when that isn't its name, a download's cache
+	// file; its name is the one parsed for the ebook and edition
+	File string
+	// a newer edition of the etext sits beside it
+	Superseded bool
+	// the line of the ignore files deciding it, nil for none
+	Ignore *ignoreMatch
+	// whether it was read, Members being what readZip made of it
+	Read    bool
+	Members []zipMember
+}
+
+// DBState is what Decide looks up in the database, and how the run was
+// asked to ingest.
+type DBState struct {
+	// the archives the journal has as ingested, with --resume
+	Done map[string]bool
+	// where tombstones, books from other sources and the current versions
+	// are looked up; nil leaves those rules pending
+	Tx   *sql.Tx
+	Opts ingestOptions
+}
+
+// Decide applies ingest's rules to archive, as the journal and the files
+// table name it, in order until one turns it away. Rules are
+// left pending, not failed, for want of info.Read or st.Tx, so a walk can
+// decide what it can before reading an archive and again once it has.
+// Finding a book in another source records the conflict, as ingest
+// always has; explain's transaction is rolled back.
+func Decide(archive string, info ArchiveInfo, st DBState) (Decision, error) {
+	var d Decision
+	file := info.File
+	if file == "" {
+		file = archive
+	}
+	an := parseArchiveName(file)
+	if name := filepath.Base(file); an.layout == layoutCache {
+		d.accept(ruleSuffix, codeBookArchive, "", "a book's text in the cache layout")
+	} else if encoding := strings.HasSuffix(name, "-8.zip") || strings.HasSuffix(name, "-0.zip"); encoding && st.Opts.encodings {
+		d.accept(ruleSuffix, codeBookArchive, "", "an encoding of a book's zip, fetched for want of the plain one")
+	} else if !isBookArchive(name) {
+		detail := "not a zip"
+		if encoding {
+			detail = "one of the -8 and -0 encodings of a book's zip"
+		}
+		d.reject(ruleSuffix, codeNotBook, "", detail)
+		return d, nil
+	} else {
+		d.accept(ruleSuffix, codeBookArchive, "", "")
+	}
+	if m := info.Ignore; m != nil {
+		if m.ignored {
+			d.reject(ruleIgnore, codeIgnored, "", "ignored by "+m.String())
+			return d, nil
+		}
+		d.accept(ruleIgnore, codeNotIgnored, "", "kept by "+m.String())
+	}
+	if want := st.Opts.mirrorLayout; want != "" {
+		if got := mirrorLayout(an.layout); got != want {
+			d.reject(ruleLayout, codeOtherLayout, "", fmt.Sprintf("in the %s layout, not --mirror-layout %s", got, want))
+			return d, nil
+		}
+		d.accept(ruleLayout, codeInLayout, "", "")
+	}
+	if st.Done != nil {
+		if st.Done[archive] {
+			d.reject(ruleJournal, codeIngested, "", "the journal has it as ingested by an earlier walk of this target")
+			return d, nil
+		}
+		d.accept(ruleJournal, codeNotIngested, "", "")
+	}
+	if info.Superseded {
+		detail := "a newer edition of the etext sits beside it"
+		if an.layout == layoutCache {
+			detail = "the utf8 text sits beside it"
+		}
+		d.reject(ruleEdition, codeSuperseded, "", detail)
+		return d, nil
+	}
+	if an.layout == layoutEtext {
+		d.accept(ruleEdition, codeNewest, "", fmt.Sprintf("edition %d, the newest beside it", an.edition))
+	}
+
+	if !info.Read {
+		d.Pending = []string{ruleMembers, ruleTombstone, ruleSource, ruleVersion}
+		return d, nil
+	}
+	for i := range info.Members {
+		m := &info.Members[i]
+		if m.reason != "" {
+			d.reject(memberRules[m.reason], m.reason, m.name, m.detail)
+			continue
+		}
+		d.book = m
+		d.accept(ruleMembers, codeBookMember, m.name, formatSize(int64(m.text.Len()))+" of text")
+	}
+	if d.book == nil {
+		return d, nil
+	}
+	if st.Tx == nil {
+		d.Pending = []string{ruleTombstone, ruleSource, ruleVersion}
+		return d, nil
+	}
+	err := d.bookRules(archive, an, st)
+	if err == nil {
+		d.Ingest = d.Rejected().Code == ""
+	}
+	return d, err
+}
+
+// bookRules applies the rules looking up d's book in the database.
+func (d *Decision) bookRules(archive string, an archiveName, st DBState) error {
+	m := *d.book
+	member := bookFilename(m, an)
+	text := m.text.String()
+	if !st.Opts.ignoreTombstones {
+		gone, err := tombstoned(st.Tx, member, text)
+		if err != nil {
+			return err
+		}
+		if gone {
+			d.reject(ruleTombstone, codeTombstoned, m.name, "removed with gutchunk rm")
+			return nil
+		}
+		d.accept(ruleTombstone, codeNotRemoved, m.name, "")
+	}
+	if st.Opts.sourceID != 0 {
+		conflict, err := sourceConflict(st.Tx, st.Opts.sourceID, member, archive, text)
+		if err != nil {
+			return err
+		}
+		if conflict != "" {
+			d.reject(ruleSource, codeOtherSource, m.name, conflict)
+			return nil
+		}
+		d.accept(ruleSource, codeNoConflict, m.name, "")
+	}
+	if d.ebook = memberEbook(m, an); d.ebook == 0 {
+		return nil
+	}
+	var err error
+	if d.prior, err = currentVersion(st.Tx, d.ebook); err != nil {
+		return err
+	}
+	switch {
+	case d.prior.id == 0:
+		d.accept(ruleVersion, codeFirstVersion, m.name, fmt.Sprintf("the first version of ebook %d", d.ebook))
+	case d.prior.hash == textHash(text):
+		d.reject(ruleVersion, codeSameText, m.name, fmt.Sprintf("same text as book %d", d.prior.id))
+	case mirrorLayout(d.prior.layout) != mirrorLayout(an.layout):
+		// the two layouts' texts of a book differ in encoding and line
+		// endings, not in being another version
+		d.reject(ruleVersion, codeOtherMirror, m.name,
+			fmt.Sprintf("ebook %d is book %d, from the %s layout", d.ebook, d.prior.id, mirrorLayout(d.prior.layout)))
+	default:
+		d.accept(ruleVersion, codeNewVersion, m.name,
+			fmt.Sprintf("version %d of ebook %d, superseding book %d", d.prior.version+1, d.ebook, d.prior.id))
+	}
+	return nil
+}
+
+// turnedAway applies the rules Decide can to an archive before it is read,
+// and when one turns it away, says so and records it.
+func turnedAway(archive string, info ArchiveInfo, done map[string]bool, opts ingestOptions) bool {
+	// without a transaction nothing is looked up that could fail
+	d, _ := Decide(archive, info, DBState{Done: done, Opts: opts})
+	r := d.Rejected()
+	switch r.Code {
+	case "":
+		return false
+	case codeNotBook:
+		fmt.Println("skipping", archive, "(not the zip of a book)")
+	case codeIgnored:
+		fmt.Printf("skipping %s (%s)\n", archive, r.Detail)
+	case codeSuperseded:
+		fmt.Println("skipping superseded edition", archive)
+	}
+	skippedArchive(archive, r)
+	return true
+}
+
+func explainCmd(args []string) error {
+	fs := flag.NewFlagSet("explain", flag.ExitOnError)
+	root := fs.String("target", target, "root of the gutenberg mirror the archives are under")
+	var opts ingestOptions
+	fs.BoolVar(&opts.ignoreTombstones, "ignore-tombstones", false, "as ingest --ignore-tombstones")
+	fs.BoolVar(&opts.resume, "resume", false, "as ingest --resume, skipping archives the journal has as ingested under --target")
+	nul := fs.String("nul", "strip", "as ingest --nul: strip or reject")
+	label := fs.String("source-label", "", "as ingest --source-label (default --target)")
+	fs.IntVar(&opts.headerLines, "header-lines", defaultHeaderLines, "as ingest --header-lines")
+	asJSON := fs.Bool("json", false, "print each decision as a line of json")
+	limits := limitFlags(fs, &opts)
+	stubs := stubFlags(fs, &opts)
+	layout := mirrorLayoutFlag(fs, &opts)
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return usagef("usage: gutchunk explain [flags] ARCHIVE...")
+	}
+	if *nul != "strip" && *nul != "reject" {
+		return usagef("--nul must be strip or reject")
+	}
+	opts.rejectNULs = *nul == "reject"
+	if opts.headerLines <= 0 {
+		return usagef("--header-lines must be positive")
+	}
+	if err := limits(); err != nil {
+		return err
+	}
+	if err := stubs(); err != nil {
+		return err
+	}
+	if err := layout(); err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if *root, err = resolveTarget(*root); err != nil {
+		return err
+	}
+	if *label == "" {
+		*label = *root
+	}
+	if opts.sourceID, err = lookupSource(db, *label); err != nil {
+		// a source not ingested from yet: every book in is from another
+		opts.sourceID = -1
+	}
+	var done map[string]bool
+	if opts.resume {
+		if done, _, err = completedArchives(db, *root); err != nil {
+			return err
+		}
+	}
+
+	ignores := newIgnoreRules(*root)
+	skipped := 0
+	for _, archive := range fs.Args() {
+		d, err := explainArchive(db, ignores, archive, mirrorName(*root, archive), done, opts)
+		if err != nil {
+			return fmt.Errorf("%s: %w", archive, err)
+		}
+		if !d.Ingest {
+			skipped++
+		}
+		if *asJSON {
+			bs, err := json.Marshal(struct {
+				Archive string `json:"archive"`
+				Decision
+			}{archive, d})
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(bs))
+			continue
+		}
+		printDecision(archive, d)
+	}
+	// like manifest diff, archives turned away are exit status 1
+	if skipped > 0 {
+		return exitStatus(1)
+	}
+	return nil
+}
+
+// explainArchive decides the archive at file, named name under the root,
+// as ingest would now, reading it and looking its book up in a transaction
+// left uncommitted.
+func explainArchive(db *sql.DB, ignores *ignoreRules, file, name string, done map[string]bool, opts ingestOptions) (Decision, error) {
+	archive := file
+	m, err := ignores.ignored(archive)
+	if err != nil {
+		return Decision{}, err
+	}
+	info := ArchiveInfo{File: archive, Superseded: (&editionFilter{}).superseded(archive), Ignore: m}
+	d, err := Decide(name, info, DBState{Done: done})
+	if err != nil || d.Rejected().Code != "" {
+		return d, err
+	}
+	var sw stopwatch
+	if isCacheText(archive) {
+		info.Members, err = readText(archive, archive, opts, &sw)
+	} else {
+		var r *zip.ReadCloser
+		if r, err = zip.OpenReader(archive); err != nil {
+			return d, err
+		}
+		defer r.Close()
+		info.Members, err = readZip(&r.Reader, archive, opts, &sw)
+	}
+	if err != nil {
+		return d, err
+	}
+	info.Read = true
+	tx, err := db.Begin()
+	if err != nil {
+		return d, err
+	}
+	defer tx.Rollback()
+	return Decide(name, info, DBState{Done: done, Tx: tx, Opts: opts})
+}
+
+func printDecision(archive string, d Decision) {
+	switch r := d.Rejected(); {
+	case d.Ingest:
+		fmt.Printf("%s: would be ingested\n", archive)
+	case r.Code != "":
+		fmt.Printf("%s: would be skipped, %s\n", archive, r.text())
+	default:
+		fmt.Printf("%s: undecided\n", archive)
+	}
+	for _, r := range d.Reasons {
+		verdict := "accept"
+		if !r.Accept {
+			verdict = "reject"
+		}
+		line := fmt.Sprintf("  %s  %-9s  %-18s", verdict, r.Rule, r.Code)
+		switch {
+		case r.Member != "" && r.Detail != "":
+			line += "  " + r.Member + ": " + r.Detail
+		case r.Member != "" || r.Detail != "":
+			line += "  " + r.Member + r.Detail
+		}
+		fmt.Println(strings.TrimRight(line, " "))
+	}
+	for _, rule := range d.Pending {
+		fmt.Printf("  ...     %s\n", rule)
+	}
+}
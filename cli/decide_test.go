@@ -0,0 +1,175 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// reasons is d's reasons a line each, as "accept rule code", then its
+// pending rules.
+func reasons(d Decision) string {
+	var b strings.Builder
+	for _, r := range d.Reasons {
+		verdict := "accept"
+		if !r.Accept {
+			verdict = "reject"
+		}
+		fmt.Fprintf(&b, "%s %s %s\n", verdict, r.Rule, r.Code)
+	}
+	if len(d.Pending) > 0 {
+		fmt.Fprintf(&b, "pending %s\n", strings.Join(d.Pending, " "))
+	}
+	return b.String()
+}
+
+func TestDecide(t *testing.T) {
+	const read = "pending members tombstone source version\n"
+	for _, c := range []struct {
+		archive string
+		info    ArchiveInfo
+		st      DBState
+		want    string
+	}{
+		{"1/2/12.zip", ArchiveInfo{}, DBState{}, "accept suffix book_archive\n" + read},
+		{"1/2/12.txt", ArchiveInfo{}, DBState{}, "reject suffix not_book_archive\n"},
+		{"1/2/12-8.zip", ArchiveInfo{}, DBState{}, "reject suffix not_book_archive\n"},
+		{"1/2/12-8.zip", ArchiveInfo{}, DBState{Opts: ingestOptions{encodings: true}}, "accept suffix book_archive\n" + read},
+		{"cache/epub/12/pg12.txt.utf8", ArchiveInfo{}, DBState{}, "accept suffix book_archive\n" + read},
+		{"1/2/12.zip", ArchiveInfo{Ignore: &ignoreMatch{".gutchunkignore", 1, "1/", true}}, DBState{}, "accept suffix book_archive\nreject ignore ignored\n"},
+		{"1/2/12.zip", ArchiveInfo{Ignore: &ignoreMatch{".gutchunkignore", 2, "!12.zip", false}}, DBState{}, "accept suffix book_archive\naccept ignore not_ignored\n" + read},
+		{"1/2/12.zip", ArchiveInfo{}, DBState{Opts: ingestOptions{mirrorLayout: layoutCache}}, "accept suffix book_archive\nreject layout other_layout\n"},
+		{"cache/epub/12/pg12.txt.utf8", ArchiveInfo{}, DBState{Opts: ingestOptions{mirrorLayout: layoutCache}}, "accept suffix book_archive\naccept layout in_layout\n" + read},
+		{"1/2/12.zip", ArchiveInfo{}, DBState{Done: map[string]bool{"1/2/12.zip": true}}, "accept suffix book_archive\nreject journal already_ingested\n"},
+		{"1/2/12.zip", ArchiveInfo{}, DBState{Done: map[string]bool{"1/2/13.zip": true}}, "accept suffix book_archive\naccept journal not_ingested\n" + read},
+		{"etext98/1sws10.zip", ArchiveInfo{Superseded: true}, DBState{}, "accept suffix book_archive\nreject edition superseded_edition\n"},
+		{"etext98/1sws11.zip", ArchiveInfo{}, DBState{}, "accept suffix book_archive\naccept edition newest_edition\n" + read},
+		// the name gone by is that of the file read, when it is another
+		{"1/2/12.zip", ArchiveInfo{File: "/tmp/download"}, DBState{}, "reject suffix not_book_archive\n"},
+	} {
+		d, err := Decide(c.archive, c.info, c.st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := reasons(d); got != c.want {
+			t.Errorf("Decide(%s, %+v) is\n%swant\n%s", c.archive, c.info, got, c.want)
+		}
+		if d.Ingest {
+			t.Errorf("Decide(%s) would ingest it unread", c.archive)
+		}
+	}
+
+	// read, its members decide it, and with no transaction the rules
+	// looking it up wait
+	text := func(s string) *bytes.Buffer { return bytes.NewBufferString(s) }
+	info := ArchiveInfo{Read: true, Members: []zipMember{
+		{name: "12.htm", reason: "binary"},
+		{name: "12.txt", text: text(testBook("Emma", testParagraphs(2)))},
+		{name: "12-readme.txt", reason: warnStub, detail: "a placeholder"},
+	}}
+	d, err := Decide("1/2/12.zip", info, DBState{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := reasons(d), "accept suffix book_archive\nreject content binary\naccept members book_member\nreject stub stub\npending tombstone source version\n"; got != want {
+		t.Errorf("with its members read, Decide is\n%swant\n%s", got, want)
+	}
+	if r := d.Rejected(); r.Code != warnStub || r.Member != "12-readme.txt" {
+		t.Errorf("with its members read, it is rejected by %+v", r)
+	}
+	d, err = Decide("1/2/12.zip", ArchiveInfo{Read: true, Members: []zipMember{{name: "12.png", reason: warnNoText, detail: "no text member"}}}, DBState{})
+	if err != nil || reasons(d) != "accept suffix book_archive\nreject members no_text_member\n" || d.Rejected().text() != warnNoText {
+		t.Errorf("with no text member, Decide is\n%s(%v)", reasons(d), err)
+	}
+
+	// and with a transaction, the database
+	db := testDB(t)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	info.Members = info.Members[1:2]
+	if d, err = Decide("1/2/12.zip", info, DBState{Tx: tx}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := reasons(d), "accept suffix book_archive\naccept members book_member\naccept tombstone not_removed\naccept version first_version\n"; got != want || !d.Ingest {
+		t.Errorf("with the database, Decide is\n%swant\n%s", got, want)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	root := t.TempDir()
+	emma := filepath.Join(root, "1", "11.zip")
+	persuasion := filepath.Join(root, "2", "22.zip")
+	writeTestZip(t, emma, zipEntry{"11.txt", testBook("Emma", testParagraphs(2))})
+	writeTestZip(t, persuasion, zipEntry{"22.txt", testBook("Persuasion", testParagraphs(2))})
+	db := testDB(t)
+	if _, err := captureStdout(t, func() error { return ingestCmd([]string{"--target", root}) }); err != nil {
+		t.Fatal(err)
+	}
+	explain := func(args ...string) (string, error) {
+		t.Helper()
+		return captureStdout(t, func() error { return explainCmd(append([]string{"--target", root}, args...)) })
+	}
+
+	// what ingest took once it turns away as the same text again
+	out, err := explain(emma)
+	if exitCode(err) != 1 || !strings.HasPrefix(out, emma+": would be skipped, same text as the current version\n") ||
+		!strings.Contains(out, "  reject  version    same_text           11.txt: same text as book 1\n") {
+		t.Errorf("explain of a book ingested: %v, printing\n%s", err, out)
+	}
+
+	// a new version of it is taken
+	writeTestZip(t, emma, zipEntry{"11.txt", testBook("Emma", testParagraphs(3))})
+	if out, err = explain(emma); err != nil || !strings.HasPrefix(out, emma+": would be ingested\n") ||
+		!strings.Contains(out, "  accept  version    new_version         11.txt: version 2 of ebook 11, superseding book 1\n") {
+		t.Errorf("explain of a new version: %v, printing\n%s", err, out)
+	}
+	// and nothing explain looked up is kept
+	if got := names(t, db, "SELECT count(*) FROM files"); got != "2\n" {
+		t.Errorf("after explain there are %s books", got)
+	}
+
+	// one removed, and one from another source
+	if _, err = captureStdout(t, func() error { return rmCmd([]string{"2"}) }); err != nil {
+		t.Fatal(err)
+	}
+	if out, err = explain(persuasion); exitCode(err) != 1 || !strings.Contains(out, "would be skipped, removed with gutchunk rm\n") {
+		t.Errorf("explain of a book removed: %v, printing\n%s", err, out)
+	}
+	// removed, it is no one's current version
+	if out, err = explain("--ignore-tombstones", persuasion); err != nil || !strings.HasPrefix(out, persuasion+": would be ingested\n") ||
+		!strings.Contains(out, "  accept  version    first_version       22.txt: the first version of ebook 22\n") {
+		t.Errorf("explain --ignore-tombstones of a book removed: %v, printing\n%s", err, out)
+	}
+	if out, err = explain("--source-label", "elsewhere", emma); exitCode(err) != 1 || !strings.Contains(out, "  reject  source     other_source") {
+		t.Errorf("explain from another source: %v, printing\n%s", err, out)
+	}
+
+	// as json, a line for each archive
+	if out, err = explain("--json", emma, filepath.Join(root, "notes.txt")); exitCode(err) != 1 {
+		t.Errorf("explain --json: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("explain --json of two archives printed\n%s", out)
+	}
+	var d struct {
+		Archive string
+		Decision
+	}
+	if err = json.Unmarshal([]byte(lines[1]), &d); err != nil || d.Ingest || d.Rejected().Code != codeNotBook {
+		t.Errorf("explain --json of a text file is %+v (%v)", d, err)
+	}
+
+	if _, err = explain(); exitCode(err) != exitUsage {
+		t.Errorf("explain of nothing: %v, want a usage error", err)
+	}
+	if _, err = explain("--nul", "keep", emma); exitCode(err) != exitUsage {
+		t.Errorf("explain --nul keep: %v, want a usage error", err)
+	}
+}
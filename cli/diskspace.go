@@ -0,0 +1,175 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// VACUUM, migrate-layout, shard and building the full text index can each
+// need up to twice the database's size in free space while they run, and
+// a disk filling halfway leaves them to fail however SQLite does at the
+// time. They check first that the filesystem holding the database has
+// --headroom times its size free, refusing to start otherwise unless given
+// --force, and while they run they watch the free space, stopping and
+// rolling back once it falls below --min-free.
+
+// freeSpace is the bytes free to gutchunk on the filesystem holding path.
+// It is a variable to be swapped for made up figures.
+var freeSpace = statFree
+
+// how often a spaceWatch looks at the free space
+var spaceEvery = time.Second
+
+// errLowSpace is what an operation stopped for lack of space fails with.
+var errLowSpace = errors.New("free space fell below --min-free")
+
+type spaceOptions struct {
+	headroom float64
+	minFree  int64
+	force    bool
+}
+
+// spaceFlags adds --headroom, --min-free and --force to fs and returns what
+// reads them.
+func spaceFlags(fs *flag.FlagSet) func() (spaceOptions, error) {
+	headroom := fs.Float64("headroom", 2, "refuse to start without this many times the database's size free on its filesystem")
+	minFree := fs.String("min-free", "256MB", "stop and roll back if free space falls below this while running")
+	force := fs.Bool("force", false, "start even without --headroom free")
+	return func() (spaceOptions, error) {
+		o := spaceOptions{headroom: *headroom, force: *force}
+		if o.headroom < 0 {
+			return o, usagef("--headroom can't be negative")
+		}
+		var err error
+		if o.minFree, err = parseSize(*minFree); err != nil {
+			return o, usageError{err.Error()}
+		}
+		return o, nil
+	}
+}
+
+// dbFile is the path of the database file the dsn names, "" for one in
+// memory.
+func dbFile(dsn string) string {
+	if inMemory(dsn) {
+		return ""
+	}
+	return dsnPath(dsn)
+}
+
+// dbSize is the size of the database at path with its write-ahead log,
+// and of any shards beside it.
+func dbSize(path string) (int64, error) {
+	files := []string{path, path + "-wal"}
+	for i := 0; i < chunkShards; i++ {
+		files = append(files, shardFile(path, i))
+	}
+	var size int64
+	for _, f := range files {
+		st, err := os.Stat(f)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		size += st.Size()
+	}
+	return size, nil
+}
+
+// checkSpace fails unless the filesystem holding the database at path has
+// o.headroom times its size free, saying so as a warning instead with
+// o.force. what is the operation, for the message. A database in memory,
+// at "", needs none.
+func checkSpace(path, what string, o spaceOptions) error {
+	if path == "" {
+		return nil
+	}
+	size, err := dbSize(path)
+	if err != nil {
+		return err
+	}
+	free, err := freeSpace(filepath.Dir(path))
+	if err != nil {
+		return fmt.Errorf("could not find the free space for %s: %w", what, err)
+	}
+	need := int64(o.headroom * float64(size))
+	if free >= need {
+		return nil
+	}
+	msg := fmt.Sprintf("%s needs %s free (%.1f times the database's %s) and %s has %s",
+		what, formatSize(need), o.headroom, formatSize(size), filepath.Dir(path), formatSize(free))
+	if o.force {
+		fmt.Fprintln(os.Stderr, "warning:", msg+"; going ahead with --force")
+		return nil
+	}
+	return fmt.Errorf("%s; free some space, lower --headroom or pass --force", msg)
+}
+
+// spaceWatch cancels its context once the free space beside a database
+// falls below a floor, interrupting the statement running under it.
+type spaceWatch struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu  sync.Mutex
+	low error
+}
+
+// watchSpace starts watching the free space on the filesystem holding the
+// database at path, from parent, the context of the run.
+func watchSpace(parent context.Context, path string, floor int64) *spaceWatch {
+	ctx, cancel := context.WithCancel(parent)
+	w := &spaceWatch{ctx: ctx, cancel: cancel, done: make(chan struct{})}
+	dir := filepath.Dir(path)
+	if path == "" {
+		return w
+	}
+	go func() {
+		t := time.NewTicker(spaceEvery)
+		defer t.Stop()
+		for {
+			select {
+			case <-w.done:
+				return
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			free, err := freeSpace(dir)
+			if err != nil || free >= floor {
+				continue
+			}
+			w.mu.Lock()
+			w.low = fmt.Errorf("%w: %s has %s free; stopped and rolled back", errLowSpace, dir, formatSize(free))
+			w.mu.Unlock()
+			cancel()
+			return
+		}
+	}()
+	return w
+}
+
+// err is why the watch stopped the operation, or the error the operation
+// failed with, err, when it didn't.
+func (w *spaceWatch) err(err error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.low != nil {
+		return w.low
+	}
+	return err
+}
+
+func (w *spaceWatch) stop() {
+	close(w.done)
+	w.cancel()
+}
@@ -0,0 +1,141 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeFree makes free the free space beside the database, given how many
+// times it was asked before.
+func fakeFree(t *testing.T, free func(asked int64) int64) {
+	t.Helper()
+	var asked int64
+	was := freeSpace
+	freeSpace = func(string) (int64, error) { return free(atomic.AddInt64(&asked, 1) - 1), nil }
+	t.Cleanup(func() { freeSpace = was })
+}
+
+func TestCheckSpace(t *testing.T) {
+	testFileDB(t)
+	path := dbFile(dsn)
+	size, err := dbSize(path)
+	if err != nil || size == 0 {
+		t.Fatalf("the database is %d bytes (%v)", size, err)
+	}
+	for _, c := range []struct {
+		free int64
+		o    spaceOptions
+		want string
+	}{
+		{2 * size, spaceOptions{headroom: 2}, ""},
+		{2*size - 1, spaceOptions{headroom: 2}, "shard needs " + formatSize(2*size) + " free (2.0 times the database's " + formatSize(size) + ")"},
+		{size, spaceOptions{headroom: 1.5}, "lower --headroom or pass --force"},
+		{size, spaceOptions{headroom: 1.5, force: true}, ""},
+		{0, spaceOptions{headroom: 0}, ""},
+	} {
+		fakeFree(t, func(int64) int64 { return c.free })
+		err := checkSpace(path, "shard", c.o)
+		if c.want == "" && err != nil || c.want != "" && (err == nil || !strings.Contains(err.Error(), c.want)) {
+			t.Errorf("%d bytes free with %+v: %v, want %q", c.free, c.o, err, c.want)
+		}
+	}
+	if err = checkSpace("", "shard", spaceOptions{headroom: 2}); err != nil {
+		t.Errorf("a database in memory: %v", err)
+	}
+
+	for args, want := range map[string]string{
+		"--headroom -1":     "--headroom can't be negative",
+		"--min-free plenty": "plenty",
+	} {
+		fs := flag.NewFlagSet("shard", flag.ContinueOnError)
+		space := spaceFlags(fs)
+		fs.Parse(strings.Fields(args))
+		if _, err := space(); exitCode(err) != exitUsage || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: %v", args, err)
+		}
+	}
+}
+
+func TestSpaceRefused(t *testing.T) {
+	rowidOnly(t, "the full text index")
+	db := testFileDB(t)
+	id := addBook(t, db, "Emma", "Jane Austen", "")
+	insertChunk(t, db, id, 0, testParagraphs(1))
+	fakeFree(t, func(int64) int64 { return 1 << 10 })
+
+	if _, err := captureStdout(t, func() error { return indexCmd(nil) }); err == nil || !strings.Contains(err.Error(), "building the full text index needs") {
+		t.Errorf("indexing without the space: %v", err)
+	}
+	var tables int
+	if err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE name LIKE 'chunks_fts%'").Scan(&tables); err != nil || tables != 0 {
+		t.Errorf("refusing to index made %d tables of the index", tables)
+	}
+	if _, err := captureStdout(t, func() error { return indexCmd([]string{"--force"}) }); err != nil {
+		t.Errorf("indexing with --force: %v", err)
+	}
+}
+
+func TestSpaceFallsMidway(t *testing.T) {
+	db := testFileDB(t)
+	for i := 0; i < 20; i++ {
+		id := addBook(t, db, "Emma", "Jane Austen", "")
+		insertChunk(t, db, id, 0, testParagraphs(1))
+	}
+	before := chunkRows(t, db)
+	layout := chunkLayout
+	to := chunksClustered
+	if layout == chunksClustered {
+		to = chunksRowid
+	}
+
+	// the migration waits on the write lock held here until the watch
+	// has seen the disk fill, however soon it would be done otherwise
+	lock, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Close()
+	if _, err = lock.ExecContext(context.Background(), "BEGIN IMMEDIATE"); err != nil {
+		t.Fatal(err)
+	}
+	filled := make(chan struct{})
+	var once sync.Once
+	go func() {
+		<-filled
+		time.Sleep(20 * time.Millisecond)
+		lock.ExecContext(context.Background(), "ROLLBACK")
+	}()
+
+	was := spaceEvery
+	spaceEvery = time.Millisecond
+	t.Cleanup(func() { spaceEvery = was })
+	// plenty to start with, and then the disk fills
+	fakeFree(t, func(asked int64) int64 {
+		if asked == 0 {
+			return 1 << 40
+		}
+		once.Do(func() { close(filled) })
+		return 1 << 20
+	})
+
+	_, err = captureStdout(t, func() error { return migrateLayoutCmd([]string{"--batch", "1", to}) })
+	if !errors.Is(err, errLowSpace) || !strings.Contains(err.Error(), "1.0MB free; stopped and rolled back") {
+		t.Fatalf("migrating as the disk filled: %v", err)
+	}
+	var copies int
+	if err = db.QueryRow("SELECT count(*) FROM sqlite_master WHERE name = 'chunks_new'").Scan(&copies); err != nil || copies != 0 {
+		t.Errorf("stopping left the chunks copied so far (%v)", err)
+	}
+	if got, err := tableLayout(db, "chunks"); err != nil || got != layout {
+		t.Errorf("stopping left chunks in the %s layout (%v), want %s", got, err, layout)
+	}
+	if after := chunkRows(t, db); after != before {
+		t.Errorf("stopping changed the chunks from\n%s\nto\n%s", before, after)
+	}
+}
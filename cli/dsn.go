@@ -0,0 +1,128 @@
+package cli
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// A database file is opened as a uri, file:PATH?mode=rwc, each connection
+// of the pool with a cache of its own, and put in wal mode the first time
+// it's opened for writing, so a command's readers read beside its writer
+// rather than waiting on it, and a writer waits on another for as long as
+// busy_timeout.
+//
+// sqlite's shared cache instead has the connections of a process share one
+// cache and lock its tables between them, rather than the database. A
+// statement finding a table locked fails at once with "database table is
+// locked", SQLITE_LOCKED, which busy_timeout doesn't wait on, and gutchunk
+// writes from several connections at once: chunk's workers, serve's jobs
+// beside its requests. So it's off unless --shared-cache asks for it, for
+// --db :memory: as much as a file, or --db gives a file: uri with
+// cache=shared of its own, and either way gutchunk warns. --db takes any
+// file: uri as it is, and warns of the other options that don't go with a
+// pool of connections: a database in memory without a shared cache, one
+// for each connection, and exclusive locking, the first connection to write
+// keeping the others out until it closes.
+
+var sharedCache = flag.Bool("shared-cache", false, "open the database in sqlite's shared cache, its connections locking tables between them and failing on a lock at once rather than waiting (see dsn.go)")
+
+// uriEscaper escapes what would end a file: uri's path early.
+var uriEscaper = strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23")
+
+// fileDSN is the dsn opening the database file at path, made if need be.
+func fileDSN(path string) string {
+	dsn := "file:" + uriEscaper.Replace(path) + dsnOptions
+	if *sharedCache {
+		dsn += "&cache=shared"
+	}
+	return dsn
+}
+
+// userDSN is the dsn --db gives as a file: uri, with cache=shared added
+// for --shared-cache.
+func userDSN(uri string) string {
+	if !*sharedCache || dsnParams(uri).Get("cache") == "shared" {
+		return uri
+	}
+	if strings.Contains(uri, "?") {
+		return uri + "&cache=shared"
+	}
+	return uri + "?cache=shared"
+}
+
+// dsnParams are the options of a dsn, after its ?.
+func dsnParams(dsn string) url.Values {
+	_, query, _ := strings.Cut(dsn, "?")
+	params, _ := url.ParseQuery(query)
+	return params
+}
+
+// dsnPath is the database a dsn names, without file: and its options.
+func dsnPath(dsn string) string {
+	path, _, _ := strings.Cut(dsn, "?")
+	if !strings.HasPrefix(path, "file:") {
+		return path
+	}
+	path = strings.TrimPrefix(path, "file:")
+	// file://localhost/path and file:///path
+	if strings.HasPrefix(path, "//") {
+		path = path[2:]
+		if i := strings.IndexByte(path, '/'); i >= 0 {
+			path = path[i:]
+		}
+	}
+	if p, err := url.PathUnescape(path); err == nil {
+		path = p
+	}
+	return path
+}
+
+// dsnWarnings are what is wrong with a pool of connections opened by dsn.
+func dsnWarnings(dsn string) []string {
+	params := dsnParams(dsn)
+	var warnings []string
+	shared := strings.EqualFold(params.Get("cache"), "shared")
+	if shared {
+		warnings = append(warnings, "the database is in sqlite's shared cache, whose connections lock tables between them: with gutchunk writing from several at once, a statement finding a table locked fails with \"database table is locked\" rather than waiting --db-timeout; leave it out for the database's own locking, in wal mode")
+	}
+	if inMemory(dsn) && !shared && params.Get("vfs") != "memdb" {
+		warnings = append(warnings, "a database in memory without cache=shared gives each connection a database of its own, empty; --db :memory: keeps one in memory for them all")
+	}
+	for _, k := range []string{"_locking_mode", "_locking"} {
+		if strings.EqualFold(params.Get(k), "exclusive") {
+			warnings = append(warnings, "with exclusive locking the first connection to write keeps the others out of the database until it closes, and they time out")
+			break
+		}
+	}
+	return warnings
+}
+
+// walMode puts the database in wal mode unless it is in it, or dsn names
+// a journal mode of its own; the mode is kept in the file, so this is only
+// done once. A database that can't be, on a file system without the shared
+// memory wal needs, say, stays as it was, with a warning.
+func walMode(db *sql.DB, dsn string) error {
+	params := dsnParams(dsn)
+	if params.Get("_journal_mode") != "" || params.Get("_journal") != "" {
+		return nil
+	}
+	var mode string
+	if err := db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+		return err
+	}
+	if strings.EqualFold(mode, "wal") {
+		return nil
+	}
+	was := mode
+	if err := db.QueryRow("PRAGMA journal_mode = WAL").Scan(&mode); err != nil {
+		return fmt.Errorf("could not put the database in wal mode: %w", err)
+	}
+	if !strings.EqualFold(mode, "wal") {
+		fmt.Fprintf(os.Stderr, "warning: the database couldn't be put in wal mode, and stays in %s mode: its readers wait on a writer\n", was)
+	}
+	return nil
+}
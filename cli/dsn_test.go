@@ -0,0 +1,251 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// withSharedCache runs f with --shared-cache set to shared.
+func withSharedCache(shared bool, f func()) {
+	defer func(was bool) { *sharedCache = was }(*sharedCache)
+	*sharedCache = shared
+	f()
+}
+
+func TestFileDSN(t *testing.T) {
+	for path, want := range map[string]string{
+		"/data/chunker.db":  "file:/data/chunker.db?mode=rwc",
+		"/data/a?b#c%d.db":  "file:/data/a%3fb%23c%25d.db?mode=rwc",
+		"relative/books.db": "file:relative/books.db?mode=rwc",
+	} {
+		got := fileDSN(path)
+		if got != want {
+			t.Errorf("fileDSN(%q) = %q, want %q", path, got, want)
+		}
+		if back := dsnPath(got); back != path {
+			t.Errorf("dsnPath(%q) = %q, want %q", got, back, path)
+		}
+	}
+	withSharedCache(true, func() {
+		if got := fileDSN("/data/chunker.db"); got != "file:/data/chunker.db?mode=rwc&cache=shared" {
+			t.Errorf("fileDSN with --shared-cache = %q", got)
+		}
+	})
+	for dsn, want := range map[string]string{
+		"file://localhost/data/chunker.db?mode=ro": "/data/chunker.db",
+		"file:///data/chunker.db":                  "/data/chunker.db",
+		"chunker.db?cache=shared":                  "chunker.db",
+		":memory:":                                 ":memory:",
+	} {
+		if got := dsnPath(dsn); got != want {
+			t.Errorf("dsnPath(%q) = %q, want %q", dsn, got, want)
+		}
+	}
+}
+
+func TestUserDSN(t *testing.T) {
+	for _, c := range []struct {
+		uri      string
+		shared   bool
+		want     string
+		inMemory bool
+		warnings []string
+	}{
+		{"file:/data/chunker.db", false, "file:/data/chunker.db", false, nil},
+		{"file:/data/chunker.db", true, "file:/data/chunker.db?cache=shared", false, []string{"shared cache"}},
+		{"file:/data/chunker.db?mode=ro", true, "file:/data/chunker.db?mode=ro&cache=shared", false, []string{"shared cache"}},
+		{"file:/data/chunker.db?cache=shared", true, "file:/data/chunker.db?cache=shared", false, []string{"shared cache"}},
+		{"file:/data/chunker.db?cache=SHARED", false, "file:/data/chunker.db?cache=SHARED", false, []string{"shared cache"}},
+		{"file:books?mode=memory", false, "file:books?mode=memory", true, []string{"a database of its own"}},
+		{"file:books?mode=memory", true, "file:books?mode=memory&cache=shared", true, []string{"shared cache"}},
+		{"file:/books?vfs=memdb", false, "file:/books?vfs=memdb", true, nil},
+		{"file:/data/chunker.db?_locking_mode=EXCLUSIVE&cache=shared", false, "file:/data/chunker.db?_locking_mode=EXCLUSIVE&cache=shared", false,
+			[]string{"shared cache", "exclusive locking"}},
+		{"file:/data/chunker.db?_locking=exclusive", false, "file:/data/chunker.db?_locking=exclusive", false, []string{"exclusive locking"}},
+	} {
+		withSharedCache(c.shared, func() {
+			got := userDSN(c.uri)
+			if got != c.want {
+				t.Errorf("userDSN(%q), shared %v = %q, want %q", c.uri, c.shared, got, c.want)
+			}
+			if inMemory(got) != c.inMemory {
+				t.Errorf("inMemory(%q) = %v", got, !c.inMemory)
+			}
+			warnings := dsnWarnings(got)
+			if len(warnings) != len(c.warnings) {
+				t.Errorf("dsnWarnings(%q) = %q, want of %q", got, warnings, c.warnings)
+				return
+			}
+			for i, w := range warnings {
+				if !strings.Contains(w, c.warnings[i]) {
+					t.Errorf("dsnWarnings(%q) = %q, want of %q", got, warnings, c.warnings)
+				}
+			}
+		})
+	}
+}
+
+// A --db given as a file: uri is opened as it is, with what is wrong with
+// it said.
+func TestOpenDatabaseURI(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chunker.db")
+	uri := "file:" + path + "?mode=rwc&cache=shared"
+	errs, err := captureStderr(t, func() error {
+		openScratch(t, uri)()
+		return nil
+	})
+	if err != nil || dsn != uri || !strings.HasPrefix(errs, "warning: the database is in sqlite's shared cache, ") || strings.Count(errs, "\n") != 1 {
+		t.Errorf("--db %s opened %s, warning\n%s", uri, dsn, errs)
+	}
+	if errs, _ = captureStderr(t, func() error {
+		openScratch(t, path)()
+		return nil
+	}); dsn != fileDSN(path) || errs != "" {
+		t.Errorf("--db %s opened %s, warning\n%s", path, dsn, errs)
+	}
+
+	// one kept in memory by uri is kept for every connection
+	errs, _ = captureStderr(t, func() error {
+		release := openScratch(t, "file:gutchunk-dsn-test?mode=memory&cache=shared")
+		defer release()
+		db, err := openDB()
+		if err != nil {
+			return err
+		}
+		addBook(t, db, "Kept", "Someone", "")
+		db.Close()
+		if db, err = openDB(); err != nil {
+			return err
+		}
+		defer db.Close()
+		if got := names(t, db, "SELECT name FROM files"); got != "Kept\n" {
+			t.Errorf("reconnected, the books are %q", got)
+		}
+		return nil
+	})
+	if !strings.Contains(errs, "shared cache") {
+		t.Errorf("a database in memory in a shared cache warned\n%s", errs)
+	}
+}
+
+func TestWALMode(t *testing.T) {
+	mode := func(dsn string) string {
+		t.Helper()
+		db, err := sql.Open("sqlite3", dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		var mode string
+		if err = db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+			t.Fatal(err)
+		}
+		return strings.ToLower(mode)
+	}
+	testFileDB(t)
+	if got := mode(dsn); got != "wal" {
+		t.Errorf("a new database is in %s mode", got)
+	}
+	// a journal mode the dsn names is kept
+	was := dsn
+	defer func() { dsn = was }()
+	dsn = fileDSN(filepath.Join(t.TempDir(), "chunker.db")) + "&_journal_mode=DELETE"
+	db, err := openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if got := mode(dsn); got != "delete" {
+		t.Errorf("a database opened with _journal_mode=DELETE is in %s mode", got)
+	}
+}
+
+// holdWrite begins a write on a connection of db, writing a book, and
+// leaves it open until the returned func commits it.
+func holdWrite(t *testing.T, db *sql.DB) func() {
+	t.Helper()
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.ExecContext(ctx, "INSERT INTO files (name, author, filename) VALUES ('Pending', 'Someone', 'pending.txt')"); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		if _, err := conn.ExecContext(ctx, "COMMIT"); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+}
+
+// With a cache of its own, and wal, a connection reads beside another
+// writing; in a shared cache it finds the table locked.
+func TestReadBesideWriter(t *testing.T) {
+	db := testFileDB(t)
+	addBook(t, db, "Emma", "Jane Austen", "")
+	commit := holdWrite(t, db)
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM files").Scan(&n); err != nil || n != 1 {
+		t.Errorf("beside a write, a reader counted %d books (%v)", n, err)
+	}
+	commit()
+	if err := db.QueryRow("SELECT count(*) FROM files").Scan(&n); err != nil || n != 2 {
+		t.Errorf("once written, a reader counted %d books (%v)", n, err)
+	}
+
+	// readers and writers at once, none failing
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for w := 0; w < 3; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if _, err := db.Exec("INSERT INTO files (name, filename) VALUES (?, ?)", fmt.Sprint("Book ", w, i), fmt.Sprint(w, i, ".txt")); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	for r := 0; r < 6; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 40; i++ {
+				var n int
+				if err := db.QueryRow("SELECT count(*) FROM files").Scan(&n); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("beside one another: %v", err)
+	}
+	if err := db.QueryRow("SELECT count(*) FROM files").Scan(&n); err != nil || n != 62 {
+		t.Errorf("the writers left %d books (%v)", n, err)
+	}
+
+	withSharedCache(true, func() {
+		shared := testFileDB(t)
+		commit := holdWrite(t, shared)
+		defer commit()
+		if err := shared.QueryRow("SELECT count(*) FROM files").Scan(&n); err == nil || !strings.Contains(err.Error(), "database table is locked") {
+			t.Errorf("beside a write in a shared cache, a reader: %v", err)
+		}
+	})
+}
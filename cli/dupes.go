@@ -0,0 +1,204 @@
+package cli
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// dupes finds the books that are one work under different filenames, like
+// editions ingested from overlapping snapshots: their content differs, so
+// near-dupes can miss them, but their title and author agree. Grouping
+// would rather miss a pair than merge two works, so the whole author must
+// agree, not just part of it, and books without one or by a catch-all like
+// Anonymous are never grouped: "Emma" by Jane Austen and "Emma" by anyone
+// else stay apart, as do two books of "Poems" by Various.
+
+// leading articles dropped from titles being compared
+var titleArticles = []string{"the", "a", "an"}
+
+// catch-all authors, shared by books with nothing else in common
+var unknownAuthors = map[string]bool{"anonymous": true, "anon": true, "unknown": true, "various": true}
+
+// workTitle is the key titles are grouped by in dupes: normalizeTitle
+// without a leading article, so "The Time Machine" and "Time Machine."
+// agree. A title that is nothing but an article is left as it is.
+func workTitle(title string) string {
+	t := normalizeTitle(title)
+	for _, a := range titleArticles {
+		if rest := strings.TrimPrefix(t, a+" "); rest != t && rest != "" {
+			return rest
+		}
+	}
+	return t
+}
+
+// workKey is the key books are grouped by in dupes, "" for books that are
+// never grouped.
+func workKey(title, author string) string {
+	t, a := workTitle(title), normalizeAuthor(author)
+	if t == "" || a == "" || unknownAuthors[a] {
+		return ""
+	}
+	return t + "\x00" + a
+}
+
+type dupeMember struct {
+	id, ebook, edition int
+	title, filename    string
+	source             string
+	chunks             int
+}
+
+type dupeGroup struct {
+	title, author string
+	// the representative first, then the rest by id
+	members []dupeMember
+}
+
+// groupDupes groups books by workKey, returning the groups of more than one
+// in the order of their first book. Each group's representative is the
+// member with the most chunks, the earliest of those that tie.
+func groupDupes(books []dupeMember, authors map[int]string) []dupeGroup {
+	byKey := map[string]*dupeGroup{}
+	keys := []string{}
+	for _, b := range books {
+		key := workKey(b.title, authors[b.id])
+		if key == "" {
+			continue
+		}
+		g, ok := byKey[key]
+		if !ok {
+			g = &dupeGroup{title: b.title, author: authors[b.id]}
+			byKey[key] = g
+			keys = append(keys, key)
+		}
+		g.members = append(g.members, b)
+	}
+
+	groups := []dupeGroup{}
+	for _, key := range keys {
+		g := byKey[key]
+		if len(g.members) < 2 {
+			continue
+		}
+		sort.Slice(g.members, func(i, j int) bool { return g.members[i].id < g.members[j].id })
+		best := 0
+		for i, m := range g.members {
+			if m.chunks > g.members[best].chunks {
+				best = i
+			}
+		}
+		rest := append(append([]dupeMember{}, g.members[:best]...), g.members[best+1:]...)
+		g.members = append([]dupeMember{g.members[best]}, rest...)
+		groups = append(groups, *g)
+	}
+	return groups
+}
+
+// loadDupeMembers reads the books dupes groups, with their authors by id.
+func loadDupeMembers(db *sql.DB) ([]dupeMember, map[int]string, error) {
+	rows, err := db.Query(`SELECT f.id, coalesce(f.ebook, 0), coalesce(f.edition, 0), coalesce(f.name, ''), coalesce(f.filename, ''),
+			coalesce(s.label, ''), coalesce(f.author, '')
+		FROM files f LEFT JOIN sources s ON s.id = f.source_id
+		WHERE f.deleted_at IS NULL ORDER BY f.id`)
+	if err != nil {
+		return nil, nil, err
+	}
+	books := []dupeMember{}
+	authors := map[int]string{}
+	for rows.Next() {
+		var b dupeMember
+		var author string
+		if err = rows.Scan(&b.id, &b.ebook, &b.edition, &b.title, &b.filename, &b.source, &author); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		books = append(books, b)
+		authors[b.id] = author
+	}
+	rows.Close()
+	return books, authors, rows.Err()
+}
+
+func dupesCmd(args []string) error {
+	fs := flag.NewFlagSet("dupes", flag.ExitOnError)
+	by := fs.String("by", "title-author", "what books must share to be grouped: title-author")
+	mark := fs.Bool("mark", false, "write each group's representative into files.duplicate_group, for random --unique-works")
+	fs.Parse(args)
+
+	if *by != "title-author" {
+		return usagef("unknown --by %q; want title-author", *by)
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	books, authors, err := loadDupeMembers(db)
+	if err != nil {
+		return err
+	}
+	// only books sharing a key need their chunks counted
+	keys := map[string]int{}
+	for _, b := range books {
+		if key := workKey(b.title, authors[b.id]); key != "" {
+			keys[key]++
+		}
+	}
+	for i, b := range books {
+		if keys[workKey(b.title, authors[b.id])] < 2 {
+			continue
+		}
+		if books[i].chunks, err = countChunks(db, "%s c WHERE c.sourceid = ?", b.id); err != nil {
+			return err
+		}
+	}
+	groups := groupDupes(books, authors)
+
+	files := 0
+	for _, g := range groups {
+		fmt.Printf("%s (%s): %d books\n", g.title, g.author, len(g.members))
+		for i, m := range g.members {
+			edition := ""
+			if m.edition != 0 {
+				edition = fmt.Sprintf(", edition %d", m.edition)
+			}
+			first := " "
+			if i == 0 {
+				first = "*"
+			}
+			fmt.Printf(" %s %6d  ebook %d%s  %d chunks  %s  %s\n", first, m.id, m.ebook, edition, m.chunks, m.filename, m.source)
+		}
+		files += len(g.members)
+	}
+	fmt.Printf("%d groups of %d books share a title and author\n", len(groups), files)
+	if !*mark {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec("UPDATE files SET duplicate_group = NULL WHERE duplicate_group IS NOT NULL"); err != nil {
+		return err
+	}
+	for _, g := range groups {
+		for _, m := range g.members {
+			if _, err = tx.Exec("UPDATE files SET duplicate_group = ? WHERE id = ?", g.members[0].id, m.id); err != nil {
+				return err
+			}
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	fmt.Printf("marked %d groups; the book marked * in each is the one random --unique-works draws from\n", len(groups))
+	return nil
+}
@@ -0,0 +1,87 @@
+package cli
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestWorkTitle(t *testing.T) {
+	for title, want := range map[string]string{
+		"The Time Machine":     "time machine",
+		"Time Machine.":        "time machine",
+		"THE TIME MACHINE":     "time machine",
+		"An Essay on Man":      "essay on man",
+		"A Tale of Two Cities": "tale of two cities",
+		"Anne of Green Gables": "anne of green gables",
+		"Theodora":             "theodora",
+		"The":                  "the",
+		"A":                    "a",
+		"The The":              "the",
+	} {
+		if got := workTitle(title); got != want {
+			t.Errorf("workTitle(%q) = %q, want %q", title, got, want)
+		}
+	}
+}
+
+func TestGroupDupes(t *testing.T) {
+	books := []dupeMember{
+		{id: 1, title: "Emma", chunks: 10},
+		{id: 2, title: "Emma", chunks: 10},
+		{id: 3, title: "The Time Machine", chunks: 4},
+		{id: 4, title: "EMMA.", chunks: 12},
+		{id: 5, title: "Time Machine", chunks: 5},
+		{id: 6, title: "Poems", chunks: 3},
+		{id: 7, title: "Poems", chunks: 3},
+		{id: 8, title: "Emma", chunks: 20},
+		{id: 9, title: "Untitled", chunks: 1},
+		{id: 10, title: "Untitled", chunks: 1},
+		{id: 11, title: "Persuasion", chunks: 8},
+	}
+	authors := map[int]string{
+		1: "Jane Austen", 2: "JANE AUSTEN (1775-1817)", 3: "Wells, H. G.", 4: "Jane Austen", 5: "Wells, H.G.",
+		6: "Various", 7: "Various", 8: "Someone Else", 11: "Jane Austen",
+	}
+	var got []string
+	for _, g := range groupDupes(books, authors) {
+		var ids []string
+		for _, m := range g.members {
+			ids = append(ids, fmt.Sprint(m.id))
+		}
+		got = append(got, g.title+": "+strings.Join(ids, " "))
+	}
+	// the most chunked first; Emma by someone else, Poems by Various and
+	// the books with no author aren't grouped
+	want := "Emma: 4 1 2, The Time Machine: 5 3"
+	if strings.Join(got, ", ") != want {
+		t.Errorf("groups %q, want %s", got, want)
+	}
+}
+
+func TestDupesMark(t *testing.T) {
+	db := testDB(t)
+	first := addBook(t, db, "Emma", "Jane Austen", testBook("Emma", testParagraphs(2)))
+	second := addBook(t, db, "The Emma", "Jane Austen", testBook("Emma", testParagraphs(3)+"\n\nThe end."))
+	other := addBook(t, db, "Emma", "Emma Tennant", testBook("Emma", testParagraphs(1)))
+	if err := makeChunks(db, chunkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	out, err := captureStdout(t, func() error { return dupesCmd([]string{"--mark"}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "1 groups of 2 books share a title and author") {
+		t.Errorf("dupes printed %q", out)
+	}
+	for id, want := range map[int]int64{first: int64(second), second: int64(second), other: 0} {
+		var group sql.NullInt64
+		if err = db.QueryRow("SELECT duplicate_group FROM files WHERE id = ?", id).Scan(&group); err != nil {
+			t.Fatal(err)
+		}
+		if group.Int64 != want {
+			t.Errorf("book %d is marked in group %+v, want %d", id, group, want)
+		}
+	}
+}
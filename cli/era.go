@@ -0,0 +1,475 @@
+package cli
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A book is dated to one year, era_year, for slicing the corpus by when
+// its texts were written: random --era 1700-1799 draws only from books
+// dated to the eighteenth century. Headers seldom say when a book was
+// first published, so the year comes from the first of these there is:
+//
+//   - a year in its meta sidecar, for the books the rest gets wrong
+//   - a "First published in 1813" line near the start of the book
+//   - the midpoint of its author's life, from the birth and death years
+//     of Project Gutenberg's catalog, which gutchunk catalog reads
+//
+// and era_basis says which: meta, header or author. A book with none of
+// these, or an author with only one of the years, isn't dated rather than
+// guessed at, and no --era draws it. The catalog gives the years before
+// the common era as negative, and so does --era: -499--400.
+//
+// The dates are worked out again after gutchunk catalog and meta import,
+// and by refresh-stats and maintain for the books ingested since.
+
+// the bases of era_year
+const (
+	eraMeta   = "meta"
+	eraHeader = "header"
+	eraAuthor = "author"
+)
+
+// yearRange is the years from and to, inclusive, of an --era. The zero
+// value, unset, is any year, dated or not.
+type yearRange struct {
+	from, to int
+	set      bool
+}
+
+func (r yearRange) String() string {
+	return fmt.Sprintf("%d-%d", r.from, r.to)
+}
+
+var eraSpec = regexp.MustCompile(`^(-?\d{1,4})(?:-(-?\d{1,4}))?$`)
+
+// parseEra parses an --era, FROM-TO or one year.
+func parseEra(s string) (yearRange, error) {
+	m := eraSpec.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return yearRange{}, fmt.Errorf("bad era %q; give it as 1700-1799, or one year", s)
+	}
+	from, _ := strconv.Atoi(m[1])
+	to := from
+	if m[2] != "" {
+		to, _ = strconv.Atoi(m[2])
+	}
+	if to < from {
+		return yearRange{}, fmt.Errorf("bad era %q; %d is after %d", s, from, to)
+	}
+	return yearRange{from, to, true}, nil
+}
+
+// firstPublished finds the year of a "First published" line, or one of
+// "Originally published", in text.
+var firstPublished = regexp.MustCompile(`(?i)\b(?:first|originally)\s+published\b[^\n\d]{0,40}?\b(\d{4})\b`)
+
+// how far into a book firstPublished looks, past the header into the front
+// matter where such lines usually are
+const publishedScan = 32768
+
+// headerYear is the year text says the book was first published, 0 when
+// it doesn't say or gives a year that can't be.
+func headerYear(text string) int {
+	m := firstPublished.FindStringSubmatch(text)
+	if m == nil {
+		return 0
+	}
+	y, _ := strconv.Atoi(m[1])
+	if y < 1400 || y > time.Now().Year() {
+		return 0
+	}
+	return y
+}
+
+// lifeMidpoint is the year halfway through a life, or false without both
+// years or with them the wrong way round.
+func lifeMidpoint(birth, death sql.NullInt64) (int, bool) {
+	if !birth.Valid || !death.Valid || death.Int64 < birth.Int64 {
+		return 0, false
+	}
+	return int(birth.Int64 + (death.Int64-birth.Int64)/2), true
+}
+
+// eraCounts is how many books deriveEras dated by each basis, and how many
+// it couldn't.
+type eraCounts struct {
+	meta, header, author, undated int
+}
+
+func (c eraCounts) String() string {
+	return fmt.Sprintf("dated %d books: %d by meta, %d by a first published line and %d by their author's years, and %d left undated",
+		c.meta+c.header+c.author, c.meta, c.header, c.author, c.undated)
+}
+
+// deriveEras works out every book's era_year again, looking for first
+// published lines in the books not yet looked in.
+func deriveEras(ctx context.Context, db *sql.DB) (eraCounts, error) {
+	var c eraCounts
+	rows, err := db.QueryContext(ctx, "SELECT id, substr("+contentCol("")+", 1, ?) FROM files WHERE first_published IS NULL AND "+hasContent(""), publishedScan)
+	if err != nil {
+		return c, err
+	}
+	found := map[int64]int{}
+	for rows.Next() {
+		var id int64
+		var text string
+		if err = rows.Scan(&id, &text); err != nil {
+			rows.Close()
+			return c, err
+		}
+		found[id] = headerYear(text)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return c, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return c, err
+	}
+	defer tx.Rollback()
+	for id, y := range found {
+		if _, err = tx.ExecContext(ctx, "UPDATE files SET first_published = ? WHERE id = ?", y, id); err != nil {
+			return c, err
+		}
+	}
+
+	rows, err = tx.QueryContext(ctx, `SELECT f.id, f.era_year, coalesce(f.era_basis, ''), m.year, coalesce(f.first_published, 0), a.birth, a.death
+		FROM files f LEFT JOIN book_meta m ON m.file_id = f.id LEFT JOIN catalog a ON a.ebook = f.ebook`)
+	if err != nil {
+		return c, err
+	}
+	type dated struct {
+		year  sql.NullInt64
+		basis string
+	}
+	changed := map[int64]dated{}
+	for rows.Next() {
+		var id int64
+		var year, meta, birth, death sql.NullInt64
+		var basis string
+		var published int
+		if err = rows.Scan(&id, &year, &basis, &meta, &published, &birth, &death); err != nil {
+			rows.Close()
+			return c, err
+		}
+		d := dated{}
+		if mid, ok := lifeMidpoint(birth, death); ok {
+			d = dated{sql.NullInt64{Int64: int64(mid), Valid: true}, eraAuthor}
+		}
+		if published != 0 {
+			d = dated{sql.NullInt64{Int64: int64(published), Valid: true}, eraHeader}
+		}
+		if meta.Valid {
+			d = dated{meta, eraMeta}
+		}
+		switch d.basis {
+		case eraMeta:
+			c.meta++
+		case eraHeader:
+			c.header++
+		case eraAuthor:
+			c.author++
+		default:
+			c.undated++
+		}
+		if d != (dated{year, basis}) {
+			changed[id] = d
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return c, err
+	}
+	for id, d := range changed {
+		if _, err = tx.ExecContext(ctx, "UPDATE files SET era_year = ?, era_basis = ? WHERE id = ?", d.year, nullString(d.basis), id); err != nil {
+			return c, err
+		}
+	}
+	return c, tx.Commit()
+}
+
+// catalogAuthor is what gutchunk catalog keeps of one ebook's record: its
+// title and type, Text or Sound say; its first author with both years
+// given, or else its first author; each of its agents with an id, for
+// author_aliases; the series it is in (see series.go); and its
+// translators, editors and illustrators (see contributors.go).
+type catalogAuthor struct {
+	ebook        int
+	title        string
+	kind         string
+	name         string
+	birth, death sql.NullInt64
+	agents       []catalogAgent
+	series       []catalogSeries
+	contributors []contributor
+}
+
+// rdfAgent is an agent of a catalog record, its author or another.
+type rdfAgent struct {
+	About   string   `xml:"http://www.w3.org/1999/02/22-rdf-syntax-ns# about,attr"`
+	Aliases []string `xml:"http://www.gutenberg.org/2009/pgterms/ alias"`
+	Name    string   `xml:"http://www.gutenberg.org/2009/pgterms/ name"`
+	Birth   string   `xml:"http://www.gutenberg.org/2009/pgterms/ birthdate"`
+	Death   string   `xml:"http://www.gutenberg.org/2009/pgterms/ deathdate"`
+}
+
+// rdfRole is the agents of a record in one marcrel role.
+type rdfRole struct {
+	Agents []rdfAgent `xml:"http://www.gutenberg.org/2009/pgterms/ agent"`
+}
+
+// rdfRecord is as much of one of the catalog's RDF files as catalog reads.
+type rdfRecord struct {
+	Ebooks []struct {
+		About        string    `xml:"http://www.w3.org/1999/02/22-rdf-syntax-ns# about,attr"`
+		Title        string    `xml:"http://purl.org/dc/terms/ title"`
+		Creators     []rdfRole `xml:"http://purl.org/dc/terms/ creator"`
+		Translators  []rdfRole `xml:"http://id.loc.gov/vocabulary/relators/ trl"`
+		Editors      []rdfRole `xml:"http://id.loc.gov/vocabulary/relators/ edt"`
+		Illustrators []rdfRole `xml:"http://id.loc.gov/vocabulary/relators/ ill"`
+		Type         struct {
+			Value string `xml:"http://www.w3.org/1999/02/22-rdf-syntax-ns# Description>value"`
+		} `xml:"http://purl.org/dc/terms/ type"`
+		Series []string `xml:"http://www.gutenberg.org/2009/pgterms/ marc440"`
+	} `xml:"http://www.gutenberg.org/2009/pgterms/ ebook"`
+}
+
+// parseRDF reads the ebooks of one RDF file.
+func parseRDF(r io.Reader) ([]catalogAuthor, error) {
+	var rec rdfRecord
+	if err := xml.NewDecoder(r).Decode(&rec); err != nil {
+		return nil, err
+	}
+	var out []catalogAuthor
+	for _, e := range rec.Ebooks {
+		n, err := strconv.Atoi(strings.TrimPrefix(e.About, "ebooks/"))
+		if err != nil || n <= 0 {
+			continue
+		}
+		a := catalogAuthor{ebook: n, title: strings.Join(strings.Fields(e.Title), " "), kind: strings.TrimSpace(e.Type.Value)}
+		for _, v := range e.Series {
+			if s, ok := parseSeries(v); ok {
+				a.series = append(a.series, s)
+			}
+		}
+		for _, r := range []struct {
+			role  string
+			roles []rdfRole
+		}{{roleTranslator, e.Translators}, {roleEditor, e.Editors}, {roleIllustrator, e.Illustrators}} {
+			for _, cr := range r.roles {
+				for _, ag := range cr.Agents {
+					if n := catalogName(ag.Name); !noOne[strings.ToLower(n)] {
+						a.contributors = append(a.contributors, contributor{r.role, n})
+					}
+				}
+			}
+		}
+		first := true
+		for _, cr := range e.Creators {
+			for _, ag := range cr.Agents {
+				birth, death := rdfYear(ag.Birth), rdfYear(ag.Death)
+				if first || birth.Valid && death.Valid && !(a.birth.Valid && a.death.Valid) {
+					a.name, a.birth, a.death = strings.TrimSpace(ag.Name), birth, death
+				}
+				first = false
+				id, err := strconv.Atoi(strings.TrimPrefix(ag.About, "2009/agents/"))
+				if err == nil && id > 0 && strings.TrimSpace(ag.Name) != "" {
+					agent := catalogAgent{id: id, name: strings.TrimSpace(ag.Name)}
+					for _, al := range ag.Aliases {
+						if al = strings.TrimSpace(al); al != "" {
+							agent.aliases = append(agent.aliases, al)
+						}
+					}
+					a.agents = append(a.agents, agent)
+				}
+			}
+		}
+		out = append(out, a)
+	}
+	return out, nil
+}
+
+func rdfYear(s string) sql.NullInt64 {
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	return sql.NullInt64{Int64: n, Valid: err == nil}
+}
+
+// readCatalog calls add with the records of each RDF file under path: a
+// directory of them, one of them, or a tar of them, compressed with gzip or
+// bzip2 or not, like the catalog's own rdf-files.tar.bz2.
+func readCatalog(path string, add func([]catalogAuthor) error) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || !strings.HasSuffix(p, ".rdf") {
+				return err
+			}
+			return readRDFFile(p, add)
+		})
+	}
+	if strings.HasSuffix(path, ".rdf") {
+		return readRDFFile(path, add)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	magic, _ := br.Peek(3)
+	switch {
+	case bytes.Equal(magic[:2], []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	case bytes.Equal(magic, []byte("BZh")):
+		r = bzip2.NewReader(br)
+	}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if !h.FileInfo().Mode().IsRegular() || !strings.HasSuffix(h.Name, ".rdf") {
+			continue
+		}
+		recs, err := parseRDF(tr)
+		if err != nil {
+			return fmt.Errorf("%s: %s: %w", path, h.Name, err)
+		}
+		if err = add(recs); err != nil {
+			return err
+		}
+	}
+}
+
+func readRDFFile(path string, add func([]catalogAuthor) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	recs, err := parseRDF(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return add(recs)
+}
+
+func catalogCmd(args []string) error {
+	fs := flag.NewFlagSet("catalog", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return usagef("usage: gutchunk catalog rdf-files.tar.bz2|DIR|FILE.rdf")
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`INSERT INTO catalog (ebook, title, type, author, birth, death, updated_at) VALUES (?, ?, ?, ?, ?, ?, datetime('now'))
+		ON CONFLICT (ebook) DO UPDATE SET title = excluded.title, type = excluded.type, author = excluded.author, birth = excluded.birth,
+			death = excluded.death, updated_at = excluded.updated_at`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	var records, withYears, places, credits int
+	agents := map[int]catalogAgent{}
+	err = readCatalog(fs.Arg(0), func(recs []catalogAuthor) error {
+		n, err := saveCatalogSeries(tx, recs)
+		if err != nil {
+			return fmt.Errorf("could not keep the catalog's series: %w", err)
+		}
+		places += n
+		if n, err = saveCatalogContributors(tx, recs); err != nil {
+			return fmt.Errorf("could not keep the catalog's contributors: %w", err)
+		}
+		credits += n
+		for _, a := range recs {
+			for _, ag := range a.agents {
+				agents[ag.id] = ag
+			}
+			if _, err := stmt.Exec(a.ebook, nullString(a.title), nullString(a.kind), nullString(a.name), a.birth, a.death); err != nil {
+				return err
+			}
+			records++
+			if _, ok := lifeMidpoint(a.birth, a.death); ok {
+				withYears++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if records == 0 {
+		return errors.New("found no ebooks in " + fs.Arg(0))
+	}
+	aliases, err := saveCatalogAgents(tx, agents)
+	if err != nil {
+		return fmt.Errorf("could not keep the catalog's aliases: %w", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	fmt.Printf("read %d ebooks from the catalog, %d with their author's years, and %d names and aliases of %d agents\n",
+		records, withYears, aliases, len(agents))
+	if places > 0 {
+		fmt.Printf("%d of them are in series (see gutchunk series list)\n", places)
+	}
+	if credits > 0 {
+		fmt.Printf("it credits %d translators, editors and illustrators\n", credits)
+	}
+
+	n, err := resolveNames(context.Background(), db)
+	if err != nil {
+		return fmt.Errorf("could not choose books' names: %w", err)
+	}
+	fmt.Println(n)
+	c, err := deriveEras(context.Background(), db)
+	if err != nil {
+		return fmt.Errorf("could not date books: %w", err)
+	}
+	fmt.Println(c)
+	return nil
+}
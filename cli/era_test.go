@@ -0,0 +1,285 @@
+package cli
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// catalogRDF is the RDF file of the catalog for one ebook by one author,
+// a year left empty being one the catalog doesn't give.
+func catalogRDF(ebook int, title, author, birth, death string) string {
+	years := ""
+	if birth != "" {
+		years += "<pgterms:birthdate>" + birth + "</pgterms:birthdate>"
+	}
+	if death != "" {
+		years += "<pgterms:deathdate>" + death + "</pgterms:deathdate>"
+	}
+	return fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
+<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#" xmlns:pgterms="http://www.gutenberg.org/2009/pgterms/" xmlns:dcterms="http://purl.org/dc/terms/">
+  <pgterms:ebook rdf:about="ebooks/%d">
+    <dcterms:title>%s</dcterms:title>
+    <dcterms:creator>
+      <pgterms:agent rdf:about="2009/agents/%d">
+        <pgterms:name>%s</pgterms:name>%s
+      </pgterms:agent>
+    </dcterms:creator>
+    <dcterms:type><rdf:Description><rdf:value>Text</rdf:value></rdf:Description></dcterms:type>
+  </pgterms:ebook>
+</rdf:RDF>
+`, ebook, title, ebook, author, years)
+}
+
+// writeCatalog writes the RDF files of rdfs, by ebook, to a gzipped tar as
+// the catalog is published, returning its path.
+func writeCatalog(t *testing.T, rdfs map[int]string) string {
+	t.Helper()
+	tarball := filepath.Join(t.TempDir(), "rdf-files.tar.gz")
+	f, err := os.Create(tarball)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for ebook, rdf := range rdfs {
+		if err = tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("cache/epub/%d/pg%d.rdf", ebook, ebook), Mode: 0o644, Size: int64(len(rdf))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = tw.Write([]byte(rdf)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []interface{ Close() error }{tw, gz, f} {
+		if err = c.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tarball
+}
+
+// eraBooks are books by authors of five centuries, as the catalog gives
+// them, by ebook number.
+var eraBooks = []struct {
+	ebook                       int
+	title, author, birth, death string
+	// what the book says of itself
+	content string
+}{
+	{1727, "The Odyssey", "Homer", "-750", "-650", ""},
+	{2383, "The Canterbury Tales", "Chaucer, Geoffrey", "1343", "1400", ""},
+	{521, "Robinson Crusoe", "Defoe, Daniel", "1660", "1731", ""},
+	{1342, "Pride and Prejudice", "Austen, Jane", "1775", "1817", "Pride and Prejudice was first published in 1813, by Egerton.\n\n"},
+	{98, "A Tale of Two Cities", "Dickens, Charles", "1812", "1870", ""},
+	// only born, so not dated
+	{996, "Don Quixote", "Cervantes Saavedra, Miguel de", "1547", "", ""},
+}
+
+// datedLibrary is a database of eraBooks, one chunk each, Don Quixote
+// dated by its meta sidecar, the catalog read from a gzipped tar of it.
+func datedLibrary(t *testing.T) *sql.DB {
+	t.Helper()
+	db := testDB(t)
+	rdfs := map[int]string{}
+	for _, b := range eraBooks {
+		id := addBook(t, db, b.title, b.author, b.content+testParagraphs(1))
+		if _, err := db.Exec("UPDATE files SET ebook = ? WHERE id = ?", b.ebook, id); err != nil {
+			t.Fatal(err)
+		}
+		insertChunk(t, db, id, 0, "A chunk of "+b.title+".")
+		rdfs[b.ebook] = catalogRDF(b.ebook, b.title, b.author, b.birth, b.death)
+	}
+
+	out, err := captureStdout(t, func() error { return catalogCmd([]string{writeCatalog(t, rdfs)}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"read 6 ebooks from the catalog, 5 with their author's years",
+		"dated 5 books: 0 by meta, 1 by a first published line and 4 by their author's years, and 1 left undated",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("catalog printed\n%s\nwant %q", out, want)
+		}
+	}
+
+	// the sidecar dates the one the catalog can't
+	dir := t.TempDir()
+	if _, err = captureStdout(t, func() error { return metaCmd([]string{"export", "--dir", dir}) }); err != nil {
+		t.Fatal(err)
+	}
+	side := filepath.Join(dir, "996.json")
+	b, err := os.ReadFile(side)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m bookMeta
+	if err = json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	year := 1605
+	m.Year = &year
+	if b, err = json.Marshal(m); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(side, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = captureStdout(t, func() error { return metaCmd([]string{"import", "--dir", dir}) }); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestParseEra(t *testing.T) {
+	for in, want := range map[string]yearRange{
+		"1700-1799": {1700, 1799, true},
+		" 1813 ":    {1813, 1813, true},
+		"-499--400": {-499, -400, true},
+		"-50-50":    {-50, 50, true},
+	} {
+		if got, err := parseEra(in); err != nil || got != want {
+			t.Errorf("parseEra(%q) = %v, %v, want %v", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "1799-1700", "C18", "1700s", "17000-17999", "1700-"} {
+		if got, err := parseEra(in); err == nil {
+			t.Errorf("parseEra(%q) = %v", in, got)
+		}
+	}
+}
+
+func TestHeaderYear(t *testing.T) {
+	for text, want := range map[string]int{
+		"First published in 1813.":                    1813,
+		"ORIGINALLY PUBLISHED, London: Egerton, 1811": 1811,
+		"It was first\npublished 1847 by Smith":       1847,
+		"Published in 1813.":                          0,
+		"First published in the year of our Lord":     0,
+		"First published in 1066.":                    0,
+		"First published in 9999.":                    0,
+	} {
+		if got := headerYear(text); got != want {
+			t.Errorf("headerYear(%q) = %d, want %d", text, got, want)
+		}
+	}
+}
+
+func TestDeriveEras(t *testing.T) {
+	db := datedLibrary(t)
+	got := map[int]string{}
+	rows, err := db.Query("SELECT ebook, coalesce(era_year, 0), coalesce(era_basis, '') FROM files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ebook, year int
+		var basis string
+		if err = rows.Scan(&ebook, &year, &basis); err != nil {
+			t.Fatal(err)
+		}
+		got[ebook] = fmt.Sprint(year, " ", basis)
+	}
+	for ebook, want := range map[int]string{
+		1727: "-700 author",
+		2383: "1371 author",
+		521:  "1695 author",
+		1342: "1813 header",
+		98:   "1841 author",
+		996:  "1605 meta",
+	} {
+		if got[ebook] != want {
+			t.Errorf("ebook %d is dated %q, want %q", ebook, got[ebook], want)
+		}
+	}
+
+	// a sidecar's year gone, the book is undated again
+	if _, err = db.Exec("DELETE FROM book_meta WHERE file_id = (SELECT id FROM files WHERE ebook = 996)"); err != nil {
+		t.Fatal(err)
+	}
+	c, err := deriveEras(runCtx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != (eraCounts{header: 1, author: 4, undated: 1}) {
+		t.Errorf("dated again, %v", c)
+	}
+	var year sql.NullInt64
+	if err = db.QueryRow("SELECT era_year FROM files WHERE ebook = 996").Scan(&year); err != nil || year.Valid {
+		t.Errorf("without its sidecar, Don Quixote is dated %v (%v)", year, err)
+	}
+}
+
+func TestEraFilters(t *testing.T) {
+	datedLibrary(t)
+	titles := func(args ...string) string {
+		t.Helper()
+		out, err := captureStdout(t, func() error { return exportCmd(args) })
+		if err != nil {
+			t.Fatalf("export %s: %v", strings.Join(args, " "), err)
+		}
+		var got []string
+		for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+			var c exportRecord
+			if err = json.Unmarshal([]byte(line), &c); err != nil {
+				t.Fatal(err)
+			}
+			// the provenance line first
+			if c.Text != "" {
+				got = append(got, c.Title)
+			}
+		}
+		return strings.Join(got, ", ")
+	}
+	for era, want := range map[string]string{
+		// by its author's life, Robinson Crusoe is dated 1695
+		"1700-1799": "",
+		"1800-1899": "Pride and Prejudice, A Tale of Two Cities",
+		"1600-1699": "Robinson Crusoe, Don Quixote",
+		"-800--600": "The Odyssey",
+		"1371":      "The Canterbury Tales",
+		"1900-1999": "",
+	} {
+		if got := titles("--era", era); got != want {
+			t.Errorf("export --era %s gave %q, want %q", era, got, want)
+		}
+	}
+	if _, err := captureStdout(t, func() error { return exportCmd([]string{"--era", "C18"}) }); exitCode(err) != exitUsage {
+		t.Errorf("export --era C18: %v, want a usage error", err)
+	}
+
+	out, err := captureStdout(t, func() error { return randomCmd([]string{"--era", "1300-1399", "--width", "0"}) })
+	if err != nil || !strings.Contains(out, "A chunk of The Canterbury Tales.") {
+		t.Errorf("random --era 1300-1399 drew %q (%v)", out, err)
+	}
+	if _, err = captureStdout(t, func() error { return randomCmd([]string{"--era", "1900-1999"}) }); err == nil {
+		t.Error("random --era 1900-1999 drew a chunk")
+	}
+}
+
+func TestSearchByEra(t *testing.T) {
+	db := datedLibrary(t)
+	indexChunks(t, db)
+	s := testServer(t, db)
+	for era, want := range map[string]int{"": 6, "1800-1899": 2, "1371-1371": 1, "1900-1999": 0} {
+		q := "q=chunk"
+		if era != "" {
+			q += "&era=" + era
+		}
+		w, p := getSearch(t, s, q)
+		if w.Code != http.StatusOK || p.Total != want {
+			t.Errorf("searching with era %q found %d (%d %s), want %d", era, p.Total, w.Code, w.Body, want)
+		}
+	}
+	if w, _ := getSearch(t, s, "q=chunk&era=C18"); w.Code != http.StatusBadRequest {
+		t.Errorf("searching with era C18: %d, want 400", w.Code)
+	}
+}
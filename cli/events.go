@@ -0,0 +1,114 @@
+package cli
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var eventsTo = flag.String("events", "", "write progress events as json lines to this file, or to an open file descriptor as fd://3")
+
+// eventsHelp is the events' schema. Consumers depend on it: add fields and
+// types, but don't rename or drop them.
+const eventsHelp = `every event is one json object on a line of its own, written as it
+happens, with
+  run      the id of the run, the same for all its events
+  seq      1 for the run's first event, counting up by one, so a gap
+           means events were lost
+  time     when, in RFC 3339 with nanoseconds
+  type     one of the types below, with the fields listed
+run_started       command
+archive_ingested  archive, books
+archive_skipped   archive, reason
+book_chunked      book (the file id), chunks
+warning           message, and archive and member when about one
+run_finished      summary: the run summary --summary-json writes
+`
+
+// eventLog writes events for --events. Each is written whole with a single
+// write, unbuffered, so a consumer sees it as soon as it happens. A nil
+// *eventLog writes nothing.
+type eventLog struct {
+	mu  sync.Mutex
+	w   io.Writer
+	run string
+	seq int64
+}
+
+// events is the running command's event log, nil without --events.
+var events *eventLog
+
+// openEvents opens --events, returning what closes it.
+func openEvents() (func(), error) {
+	if *eventsTo == "" {
+		return func() {}, nil
+	}
+	var f *os.File
+	if strings.HasPrefix(*eventsTo, "fd://") {
+		fd := strings.TrimPrefix(*eventsTo, "fd://")
+		n, err := strconv.Atoi(fd)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("bad --events descriptor %q", fd)
+		}
+		f = os.NewFile(uintptr(n), "events")
+		if _, err = f.Stat(); err != nil {
+			return nil, fmt.Errorf("--events descriptor %d isn't open", n)
+		}
+	} else {
+		var err error
+		if f, err = os.OpenFile(*eventsTo, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+			return nil, fmt.Errorf("could not open --events: %w", err)
+		}
+	}
+	events = &eventLog{w: f, run: fmt.Sprintf("%x-%d", time.Now().UnixNano(), os.Getpid())}
+	return func() { f.Close() }, nil
+}
+
+// emit writes an event of type typ with fields besides the ones every
+// event has. An event that can't be written is reported on stderr once
+// and the rest are dropped; the run goes on.
+func (l *eventLog) emit(typ string, fields map[string]interface{}) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.w == nil {
+		return
+	}
+
+	l.seq++
+	e := map[string]interface{}{"run": l.run, "seq": l.seq, "time": time.Now().Format(time.RFC3339Nano), "type": typ}
+	for k, v := range fields {
+		e[k] = v
+	}
+	bs, err := json.Marshal(e)
+	if err == nil {
+		_, err = l.w.Write(append(bs, '\n'))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not write event, writing no more: %v\n", err)
+		l.w = nil
+	}
+}
+
+func (l *eventLog) warn(archive, member, message string) {
+	fields := map[string]interface{}{"message": message}
+	if archive != "" {
+		fields["archive"] = archive
+	}
+	if member != "" {
+		fields["member"] = member
+	}
+	l.emit("warning", fields)
+}
+
+func (l *eventLog) skipped(archive string, r Reason) {
+	l.emit("archive_skipped", map[string]interface{}{"archive": archive, "reason": r.text(), "code": r.Code})
+}
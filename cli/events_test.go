@@ -0,0 +1,153 @@
+package cli
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// event is an event as a consumer reads it.
+type event struct {
+	Run     string                 `json:"run"`
+	Seq     int64                  `json:"seq"`
+	Time    string                 `json:"time"`
+	Type    string                 `json:"type"`
+	Archive string                 `json:"archive"`
+	Books   int                    `json:"books"`
+	Reason  string                 `json:"reason"`
+	Book    int                    `json:"book"`
+	Chunks  int                    `json:"chunks"`
+	Message string                 `json:"message"`
+	Summary map[string]interface{} `json:"summary"`
+}
+
+// withEvents runs cmd as gutchunk --events path would.
+func withEvents(t *testing.T, path string, cmd func() error) {
+	t.Helper()
+	saved := *eventsTo
+	*eventsTo = path
+	t.Cleanup(func() { *eventsTo, events = saved, nil })
+	closeEvents, err := openEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { closeEvents(); events = nil }()
+	if _, err = captureStdout(t, cmd); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// eventTime is when e happened.
+func eventTime(t *testing.T, e event) time.Time {
+	t.Helper()
+	at, err := time.Parse(time.RFC3339Nano, e.Time)
+	if err != nil {
+		t.Errorf("an event at %q: %v", e.Time, err)
+	}
+	return at
+}
+
+func TestEvents(t *testing.T) {
+	root := t.TempDir()
+	writeTestZip(t, filepath.Join(root, "1", "11.zip"), zipEntry{"11.txt", testBook("Emma", testParagraphs(2))})
+	writeTestZip(t, filepath.Join(root, "2", "22.zip"), zipEntry{"22.txt", testBook("Persuasion", testParagraphs(3)+"\n\nThe end.")})
+	testDB(t)
+	path := filepath.Join(t.TempDir(), "events.ndjson")
+	withEvents(t, path, func() error { return ingestCmd([]string{"--target", root}) })
+	withEvents(t, path, func() error { return chunkCmd(nil) })
+	withEvents(t, path, func() error { return ingestCmd([]string{"--target", root, "--restart"}) })
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var runs [][]event
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e event
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("%q: %v", sc.Text(), err)
+		}
+		if e.Run == "" || e.Type == "" {
+			t.Errorf("an event without its run or type: %s", sc.Text())
+		}
+		if len(runs) == 0 || runs[len(runs)-1][0].Run != e.Run {
+			runs = append(runs, nil)
+		}
+		runs[len(runs)-1] = append(runs[len(runs)-1], e)
+	}
+	if len(runs) != 3 {
+		t.Fatalf("events from %d runs, want 3", len(runs))
+	}
+
+	want := [][]string{
+		{"run_started", "archive_ingested", "archive_ingested", "run_finished"},
+		{"run_started", "book_chunked", "book_chunked", "run_finished"},
+		{"run_started", "archive_skipped", "archive_skipped", "run_finished"},
+	}
+	for i, run := range runs {
+		var types []string
+		for j, e := range run {
+			types = append(types, e.Type)
+			if e.Seq != int64(j+1) {
+				t.Errorf("run %d: event %d is numbered %d", i+1, j+1, e.Seq)
+			}
+			if j > 0 && eventTime(t, e).Before(eventTime(t, run[j-1])) {
+				t.Errorf("run %d: event %d at %s, before the one before it", i+1, j+1, e.Time)
+			}
+			switch e.Type {
+			case "archive_ingested":
+				if e.Books != 1 || !strings.HasSuffix(e.Archive, ".zip") {
+					t.Errorf("run %d: %+v", i+1, e)
+				}
+			case "archive_skipped":
+				if e.Reason != "same text as the current version" || e.Archive == "" {
+					t.Errorf("run %d: %+v", i+1, e)
+				}
+			case "book_chunked":
+				if e.Book == 0 || e.Chunks == 0 {
+					t.Errorf("run %d: %+v", i+1, e)
+				}
+			case "run_finished":
+				if e.Summary == nil {
+					t.Errorf("run %d finished without its summary", i+1)
+				}
+			}
+		}
+		if got := strings.Join(types, " "); got != strings.Join(want[i], " ") {
+			t.Errorf("run %d: %s, want %s", i+1, got, strings.Join(want[i], " "))
+		}
+	}
+}
+
+func TestEventsDescriptor(t *testing.T) {
+	saved := *eventsTo
+	t.Cleanup(func() { *eventsTo = saved })
+	for _, to := range []string{"fd://x", "fd://-1", "fd://97"} {
+		*eventsTo = to
+		if _, err := openEvents(); err == nil {
+			t.Errorf("--events %s opened", to)
+		}
+	}
+
+	// a stream that can't be written stops, and the run goes on
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	l := &eventLog{w: w, run: "r"}
+	l.emit("run_started", nil)
+	l.emit("run_finished", nil)
+	if l.w != nil || l.seq != 1 {
+		t.Errorf("after a failed write, the log writes on, at %d", l.seq)
+	}
+	w.Close()
+	var none *eventLog
+	none.emit("run_started", nil)
+}
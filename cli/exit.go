@@ -0,0 +1,95 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Exit statuses. Commands return errors and main maps them to these, so
+// scripts can tell a run that failed from one that was called wrong, or
+// that went through but failed for some of what it worked on.
+const (
+	exitOK        = 0
+	exitFailure   = 1
+	exitUsage     = 2
+	exitPartial   = 3
+	exitCancelled = 4
+	// went through, but left warnings --strict counts
+	exitStrict = 5
+)
+
+// exitStatus is returned by commands whose outcome is reported through the
+// exit code rather than as an error, like audit-chunks finding differences
+// or grep finding nothing, both 1.
+type exitStatus int
+
+func (e exitStatus) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+// usageError is a command called wrong: a bad argument, a flag out of
+// range or flags that don't go together.
+type usageError struct {
+	msg string
+}
+
+func (e usageError) Error() string { return e.msg }
+
+func usagef(format string, args ...interface{}) error {
+	return usageError{fmt.Sprintf(format, args...)}
+}
+
+// partialError is a run that went through but failed for some of the
+// items it worked on, like ids that don't exist or downloads that failed.
+type partialError struct {
+	failed, total int
+	// what the items are, plural, and what went wrong with them, like
+	// "paths" and "don't exist"
+	what, reason string
+}
+
+func (e partialError) Error() string {
+	return fmt.Sprintf("%d of %d %s %s", e.failed, e.total, e.what, e.reason)
+}
+
+// exitCode is the exit status for how a command ended.
+func exitCode(err error) int {
+	var status exitStatus
+	var usage usageError
+	var partial partialError
+	var strict strictError
+	switch {
+	case err == nil:
+		return exitOK
+	case timedOut(err) || errors.Is(err, context.Canceled):
+		return exitCancelled
+	case errors.As(err, &status):
+		return int(status)
+	case errors.As(err, &usage):
+		return exitUsage
+	case errors.As(err, &partial):
+		return exitPartial
+	case errors.As(err, &strict):
+		return exitStrict
+	}
+	return exitFailure
+}
+
+// finish prints the final line for how a command ended, when it didn't end
+// well, and is the status to exit with.
+func finish(err error) int {
+	code := exitCode(err)
+	var status exitStatus
+	switch {
+	case err == nil || errors.As(err, &status):
+	case code == exitPartial:
+		fmt.Fprintf(os.Stderr, "partial failure: %v\n", err)
+	case code == exitStrict:
+		fmt.Fprintf(os.Stderr, "strict failure: %v\n", err)
+	default:
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+	}
+	return code
+}
@@ -0,0 +1,64 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want int
+	}{
+		{nil, exitOK},
+		{fmt.Errorf("could not read overrides: %w", os.ErrNotExist), exitFailure},
+		{usagef("bad file id %q", "x"), exitUsage},
+		{fmt.Errorf("chunk: %w", partialError{1, 2, "file ids", "don't exist"}), exitPartial},
+		{fmt.Errorf("reading 1.zip: %w", errTimedOut), exitCancelled},
+		{context.Canceled, exitCancelled},
+		{exitStatus(1), 1},
+		{strictError{3}, exitStrict},
+	} {
+		if got := exitCode(c.err); got != c.want {
+			t.Errorf("%v: exit status %d, want %d", c.err, got, c.want)
+		}
+	}
+}
+
+func TestCommandExitCodes(t *testing.T) {
+	db := testDB(t)
+	id := addBook(t, db, "Emma", "Jane Austen", testBook("Emma", testParagraphs(3)))
+	dir := t.TempDir()
+	ids := filepath.Join(dir, "ids")
+	if err := os.WriteFile(ids, []byte(fmt.Sprintf("%d\n%d\n", id, id+100)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name string
+		run  func() error
+		want int
+	}{
+		{"chunk", func() error { return chunkCmd(nil) }, exitOK},
+		{"cat, a bad id", func() error { return catCmd([]string{"Emma"}) }, exitUsage},
+		{"chunk, flags that don't go together", func() error {
+			return chunkCmd([]string{"--no-scene-breaks", "--scene-break", "^~$"})
+		}, exitUsage},
+		{"chunk, a missing --paths-file", func() error {
+			return chunkCmd([]string{"--paths-file", filepath.Join(dir, "nonesuch")})
+		}, exitFailure},
+		{"chunk, an id that doesn't exist", func() error { return chunkCmd([]string{"--paths-file", ids}) }, exitPartial},
+		{"grep, nothing found", func() error { return grepCmd([]string{"narwhal"}) }, 1},
+	} {
+		_, err := captureStdout(t, c.run)
+		if got := exitCode(err); got != c.want {
+			t.Errorf("%s: %v, exit status %d, want %d", c.name, err, got, c.want)
+		}
+		if c.want == exitPartial && err.Error() != "1 of 2 file ids don't exist" {
+			t.Errorf("%s: %q", c.name, err)
+		}
+	}
+}
@@ -0,0 +1,670 @@
+package cli
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+type exportRecord struct {
+	ID       int    `json:"id"`
+	StableID string `json:"stable_id,omitempty"`
+	SourceID int    `json:"sourceid"`
+	Ordinal  *int   `json:"ordinal"`
+	Part     int    `json:"part,omitempty"`
+	Scene    *int   `json:"scene,omitempty"`
+	Title    string `json:"title"`
+	Author   string `json:"author"`
+	Text     string `json:"text"`
+	Tokens   int    `json:"tokens,omitempty"`
+
+	// for --fields
+	Ebook    int    `json:"-"`
+	Language string `json:"-"`
+	// the --split-by keys it is written under
+	keys []string
+}
+
+func (r exportRecord) facts() chunkFacts {
+	return chunkFacts{ID: r.ID, StableID: r.StableID, SourceID: r.SourceID, Ordinal: r.Ordinal, Scene: r.Scene, Part: r.Part,
+		Title: r.Title, Author: r.Author, Text: r.Text, Tokens: r.Tokens, Ebook: r.Ebook, Language: r.Language}
+}
+
+type exportOptions struct {
+	maxTokens int
+	// drop chunks over maxTokens instead of splitting them
+	drop bool
+	tok  tokenizer
+	// only chunks of books from this sources row, 0 for all
+	source int
+	// only chunks of the books these match
+	names nameQuery
+	// applied to each chunk before counting and splitting
+	transform pipeline
+	// also export the chunks of versions superseded by a re-release
+	superseded bool
+	// what each chunk is written with
+	fields fieldSet
+	// only chunks of these books, nil for all
+	books []int64
+	// only chunks of books dated to these years
+	era yearRange
+	// only chunks this far through their books
+	position positionRange
+	// only chunks of books check-complete found complete
+	completeOnly bool
+	// leave out chunks flag-content flagged
+	excludeFlagged bool
+	// only chunks --filter's expression keeps, nil for all
+	filter *chunkFilter
+	// write each chunk with the ids of the chunks before and after it in
+	// its book (see exportByBook)
+	neighbors bool
+	// write a record per book holding its chunks rather than one per chunk
+	byBook bool
+	// give titles and authors in capitals as SmartCase has them
+	smartCase bool
+	// how many chunks to write of each book and author and in all, and
+	// the chunks sampleCapped picked under them by split key, nil for all
+	// (see exportcaps.go)
+	caps exportCaps
+	keep map[string]map[int]bool
+	// with --split-by, what the chunks are split by and the files they
+	// are written to instead of w (see exportsplit.go)
+	splitBy *splitKey
+	split   *splitWriter
+}
+
+func exportCmd(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	out := fs.String("out", "-", "file to write jsonl to")
+	var opts exportOptions
+	fs.IntVar(&opts.maxTokens, "max-tokens", 0, "split chunks longer than this many tokens at sentence boundaries")
+	over := fs.String("over", "split", "what to do with chunks over --max-tokens: split or drop")
+	cmd := fs.String("tokenizer-cmd", "", "external tokenizer for chunks without a stored token count")
+	source := fs.String("source", "", "only export books ingested with this --source-label")
+	author := fs.String("author", "", "only export books by this author, by the starts of words of their name, without regard to case or diacritics")
+	title := fs.String("title", "", "only export books with this title, by the starts of its words, without regard to case or diacritics")
+	spec := fs.String("transform", "", transformUsage)
+	fs.BoolVar(&opts.superseded, "include-superseded", false, "also export the chunks of book versions a re-release superseded")
+	era := fs.String("era", "", "only export books dated to these years, as 1700-1799 (see gutchunk catalog)")
+	position := fs.String("position", "", "only export chunks this far through their books, as 0.0-0.1 for the first tenth")
+	fs.BoolVar(&opts.completeOnly, "complete-only", false, "only export books check-complete found complete, leaving out those not checked")
+	fs.BoolVar(&opts.excludeFlagged, "exclude-flagged", false, "leave out chunks flag-content flagged")
+	fs.BoolVar(&opts.neighbors, "with-neighbors", false, "write each chunk with prev_id and next_id, the chunks before and after it in its book, null where there is none written")
+	fs.BoolVar(&opts.byBook, "group-by-book", false, "write a record per book, its id, title, author and chunks in order")
+	snapshot := fs.Bool("snapshot", false, "export the database as it was when the export began, in one read transaction; needs wal mode")
+	fs.BoolVar(&opts.smartCase, "smart-case", false, "write titles and authors in capitals in title case")
+	fs.IntVar(&opts.caps.perBook, "max-per-book", 0, "write at most this many chunks of each book, sampled uniformly (0 for no limit)")
+	fs.IntVar(&opts.caps.perAuthor, "max-per-author", 0, "write at most this many chunks of each author's books, sampled uniformly (0 for no limit)")
+	fs.IntVar(&opts.caps.total, "max-total", 0, "write at most this many chunks in all, sampled uniformly (0 for no limit)")
+	fs.Int64Var(&opts.caps.seed, "seed", 0, "random seed for the --max-* samples (default: time based)")
+	splitBy := fs.String("split-by", "", "write a file of chunks for each "+splitKeyNames()+" to --out-dir, in one pass")
+	outDir := fs.String("out-dir", "", "the directory --split-by writes its files to")
+	unknown := fs.String("unknown", defaultSplitUnknown, "the name of --split-by's file for chunks with no key, without .jsonl")
+	maxOpen := fs.Int("max-open", defaultSplitOpen, "most --split-by files to keep open at once")
+	fields := fieldsFlags(fs)
+	license := provenanceFlags(fs, true)
+	filter := filterFlag(fs, map[string][]string{"source": {"source"}, "author": {"author", "not_author"}, "era": {"era"},
+		"position": {"position"}, "complete-only": {"complete_only"}, "exclude-flagged": {"exclude_flagged"}})
+	fs.Parse(args)
+
+	if *over != "split" && *over != "drop" {
+		return usagef("--over must be split or drop")
+	}
+	opts.drop = *over == "drop"
+	if opts.caps.perBook < 0 || opts.caps.perAuthor < 0 || opts.caps.total < 0 {
+		return usagef("--max-per-book, --max-per-author and --max-total can't be negative")
+	}
+	if opts.caps.set() && (opts.neighbors || opts.byBook) {
+		return usagef("--max-per-book, --max-per-author and --max-total don't combine with --with-neighbors or --group-by-book")
+	}
+	if opts.caps.seed == 0 {
+		opts.caps.seed = time.Now().UnixNano()
+	}
+	if *splitBy != "" {
+		k, ok := splitKeys[*splitBy]
+		if !ok {
+			return usagef("--split-by must be one of %s", splitKeyNames())
+		}
+		if *outDir == "" || *out != "-" {
+			return usagef("--split-by writes to --out-dir, not --out")
+		}
+		if opts.neighbors || opts.byBook {
+			return usagef("--split-by doesn't combine with --with-neighbors or --group-by-book")
+		}
+		if *maxOpen < 1 {
+			return usagef("--max-open must be at least 1")
+		}
+		if *unknown == "" || sanitizeName(*unknown) != *unknown {
+			return usagef("--unknown must be a plain file name")
+		}
+		opts.splitBy = &k
+	} else if *outDir != "" {
+		return usagef("--out-dir is for --split-by")
+	}
+	opts.names = parseNameQuery(*author, *title)
+	opts.tok = newTokenizer(*cmd)
+	var err error
+	if *era != "" {
+		if opts.era, err = parseEra(*era); err != nil {
+			return usageError{err.Error()}
+		}
+	}
+	if *position != "" {
+		if opts.position, err = parsePosition(*position); err != nil {
+			return usageError{err.Error()}
+		}
+		if opts.neighbors || opts.byBook {
+			return usagef("--position doesn't combine with --with-neighbors or --group-by-book")
+		}
+	}
+	if opts.transform, err = parsePipeline(*spec, nil); err != nil {
+		return err
+	}
+	if opts.fields, err = fields(); err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if opts.era.set {
+		if err = requireSchema(schemaGap{"files", "era_year"}); err != nil {
+			return err
+		}
+	}
+	if opts.position.set {
+		if err = requireSchema(schemaGap{"chunks", "position_pct"}); err != nil {
+			return err
+		}
+	}
+	if opts.completeOnly {
+		if err = requireSchema(schemaGap{"files", "completeness"}); err != nil {
+			return err
+		}
+	}
+	if *source != "" {
+		if opts.source, err = lookupSource(db, *source); err != nil {
+			return err
+		}
+	}
+	if opts.filter, err = filter(db); err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	var q identityQueryer = db
+	var watch *writeWatch
+	if *snapshot {
+		tx, err := readSnapshot(db)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		q = tx
+	} else if watch, err = watchWrites(db); err != nil {
+		return err
+	}
+	var prov *provenance
+	if note, ok := license(); ok {
+		p, err := newProvenance(q, "export", fs, note)
+		if err != nil {
+			return err
+		}
+		if opts.caps.set() {
+			p.Flags["seed"] = fmt.Sprint(opts.caps.seed)
+		}
+		prov = &p
+	}
+	if opts.splitBy != nil {
+		if err = os.MkdirAll(*outDir, 0755); err != nil {
+			return err
+		}
+		opts.split = newSplitWriter(*outDir, *unknown, *maxOpen, prov)
+		defer opts.split.close()
+	} else if prov != nil {
+		if err = writeProvenance(bw, *prov); err != nil {
+			return err
+		}
+	}
+	if opts.caps.set() {
+		var caps capReport
+		if opts.keep, caps, err = sampleCapped(q, opts); err != nil {
+			return err
+		}
+		reportCaps(opts.caps, caps)
+	}
+	if opts.neighbors || opts.byBook {
+		err = exportByBook(q, bw, opts)
+	} else {
+		err = exportChunks(q, bw, opts)
+	}
+	if err == nil && opts.split != nil {
+		err = finishSplit(opts.split, *splitBy, *outDir)
+	}
+	if err != nil || watch == nil {
+		return err
+	}
+	if written, err := watch.written(); err != nil {
+		return err
+	} else if written {
+		fmt.Fprintln(os.Stderr, "warning: the database was written to during the export, so it may have some books from before the write and some from after; export --snapshot reads it as of one moment")
+	}
+	return bw.Flush()
+}
+
+const exportBatch = 500
+
+// chunkWhere is the condition and arguments of opts' filters over chunks
+// c of files f.
+func (opts exportOptions) chunkWhere() (string, []interface{}) {
+	names, nameArgs := opts.names.where()
+	var books interface{}
+	if opts.books != nil {
+		list, _ := json.Marshal(opts.books)
+		books = string(list)
+	}
+	return `c.boilerplate IS NULL AND (? = 0 OR f.source_id = ?) AND (? OR ` + activeVersion + `) AND ` + names + `
+			AND (? IS NULL OR c.sourceid IN (SELECT value FROM json_each(?)))
+			AND (? = 0 OR f.era_year BETWEEN ? AND ?) AND (? = 0 OR c.position_pct BETWEEN ? AND ?)
+			AND (? = 0 OR f.completeness = 'complete') AND (? = 0 OR NOT ` + contentFlagged + `) AND ` + opts.filterCond(),
+		append(append(append([]interface{}{opts.source, opts.source, opts.superseded}, nameArgs...),
+			books, books, opts.era.set, opts.era.from, opts.era.to, opts.position.set, opts.position.from, opts.position.to, opts.completeOnly,
+			opts.excludeFlagged), opts.filterArgs()...)
+}
+
+// filterCond is the condition of --filter's expression over chunks c of
+// files f, true without one, and filterArgs its arguments.
+func (opts exportOptions) filterCond() string {
+	if opts.filter == nil {
+		return "1"
+	}
+	return "(" + filterConds + ")"
+}
+
+func (opts exportOptions) filterArgs() []interface{} {
+	if opts.filter == nil {
+		return nil
+	}
+	return opts.filter.args()
+}
+
+// exportChunks streams chunks in id order, a batch at a time so that token
+// counting can be batched too.
+func exportChunks(db rowsQueryer, w io.Writer, opts exportOptions) error {
+	var sink chunkSink = encoderSink{json.NewEncoder(w)}
+	keyColumn := "''"
+	if opts.split != nil {
+		sink, keyColumn = opts.split, opts.splitBy.column
+	}
+	last := 0
+	where, args := opts.chunkWhere()
+	for {
+		rows, err := db.Query(`
+			SELECT c.id, c.sourceid, c.ordinal, coalesce(f.name, ''), coalesce(f.author, ''), c.chunk, c.token_count, c.scene,
+				coalesce(c.stable_id, ''), coalesce(f.ebook, 0), coalesce(f.language, ''), `+keyColumn+`
+			FROM chunks c JOIN files f ON f.id = c.sourceid
+			WHERE c.id > ? AND `+where+`
+			ORDER BY c.id LIMIT ?`, append(append([]interface{}{last}, args...), exportBatch)...)
+		if err != nil {
+			return err
+		}
+		recs := []exportRecord{}
+		var missing []int
+		read := 0
+		for rows.Next() {
+			var key string
+			r, counted, err := scanExportRecord(rows, opts, &key)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			read++
+			last = r.ID
+			if r.keys = opts.splitBy.chunkKeys(key); opts.keep != nil {
+				r.keys = keptKeys(opts.keep, r.keys, r.ID)
+			}
+			if len(r.keys) == 0 {
+				continue
+			}
+			if !counted {
+				missing = append(missing, len(recs))
+			}
+			recs = append(recs, r)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		if read == 0 {
+			return nil
+		}
+		if opts.split != nil {
+			opts.split.read += read
+		}
+		if err = countTokens(recs, missing, opts); err != nil {
+			return err
+		}
+
+		for _, r := range recs {
+			parts, err := exportParts(r, opts)
+			if err != nil {
+				return err
+			}
+			for _, p := range parts {
+				v, err := exportValue(p, nil, opts)
+				if err != nil {
+					return err
+				}
+				if err = sink.write(p, v); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// scanExportRecord reads a chunk as exportChunks selects it, transformed,
+// reporting whether its token count, if one is needed, is known.
+func scanExportRecord(rows *sql.Rows, opts exportOptions, more ...interface{}) (exportRecord, bool, error) {
+	var r exportRecord
+	var ordinal, tokens, scene sql.NullInt64
+	dest := append([]interface{}{&r.ID, &r.SourceID, &ordinal, &r.Title, &r.Author, &r.Text, &tokens, &scene, &r.StableID, &r.Ebook, &r.Language}, more...)
+	if err := rows.Scan(dest...); err != nil {
+		return r, false, err
+	}
+	r.Ordinal, r.Scene = nullableInt(ordinal), nullableInt(scene)
+	if opts.smartCase {
+		r.Title, r.Author = SmartCase(r.Title), SmartCase(r.Author)
+	}
+	r.Text = strings.TrimSpace(r.Text)
+	r.Tokens = int(tokens.Int64)
+	// stored counts are of the text as stored
+	if opts.transform != nil {
+		r.Text = opts.transform.apply(r.Text)
+		tokens.Valid = false
+	}
+	return r, tokens.Valid || opts.maxTokens <= 0, nil
+}
+
+// countTokens counts the tokens of the records at missing, in one batch.
+func countTokens(recs []exportRecord, missing []int, opts exportOptions) error {
+	if len(missing) == 0 {
+		return nil
+	}
+	texts := make([]string, len(missing))
+	for i, m := range missing {
+		texts[i] = recs[m].Text
+	}
+	counts, err := opts.tok.count(texts)
+	if err != nil {
+		return err
+	}
+	for i, m := range missing {
+		recs[m].Tokens = counts[i]
+	}
+	return nil
+}
+
+// exportParts is what r is written as: itself, the parts it is split into
+// over --max-tokens, or nothing when it is dropped.
+func exportParts(r exportRecord, opts exportOptions) ([]exportRecord, error) {
+	if opts.maxTokens <= 0 || r.Tokens <= opts.maxTokens {
+		return []exportRecord{r}, nil
+	}
+	if opts.drop {
+		return nil, nil
+	}
+	return splitRecord(r, opts)
+}
+
+// neighbors are the chunks before and after one in its book, nil where no
+// chunk is written.
+type neighbors struct {
+	PrevID *int `json:"prev_id"`
+	NextID *int `json:"next_id"`
+}
+
+// neighborRecord is a chunk written with its neighbors.
+type neighborRecord struct {
+	exportRecord
+	neighbors
+}
+
+// exportValue is what p is encoded as, with its --fields and, given n, its
+// neighbors last.
+func exportValue(p exportRecord, n *neighbors, opts exportOptions) (interface{}, error) {
+	var v interface{} = p
+	if n != nil {
+		v = neighborRecord{p, *n}
+	}
+	if !opts.fields.custom() {
+		return v, nil
+	}
+	fr, err := opts.fields.record(p.facts(), v)
+	if err != nil || n == nil || opts.fields.names == nil {
+		return fr, err
+	}
+	fr.keys = append(fr.keys, "prev_id", "next_id")
+	fr.values = append(fr.values, n.PrevID, n.NextID)
+	return fr, nil
+}
+
+// groupedBook is a book as --group-by-book writes it.
+type groupedBook struct {
+	ID     int           `json:"id"`
+	Title  string        `json:"title"`
+	Author string        `json:"author"`
+	Chunks []interface{} `json:"chunks"`
+}
+
+// exportByBook exports the chunks a book at a time, in the order of the
+// books' ids, each book's in order, with --with-neighbors and
+// --group-by-book. A chunk's neighbors are the chunks next to it in its
+// book as stored; one that isn't written, as boilerplate or dropped over
+// --max-tokens, leaves the link null rather than the chunks past it
+// taking its place, so two chunks are linked only when they were next to
+// each other in the book. The parts of a split chunk all have the chunk's
+// neighbors. Only one book's chunks are held at a time.
+func exportByBook(db rowsQueryer, w io.Writer, opts exportOptions) error {
+	enc := json.NewEncoder(w)
+	names, nameArgs := opts.names.where()
+	var books interface{}
+	if opts.books != nil {
+		list, _ := json.Marshal(opts.books)
+		books = string(list)
+	}
+	rows, err := db.Query(`
+		SELECT f.id FROM files f
+		WHERE (? = 0 OR f.source_id = ?) AND (? OR `+activeVersion+`) AND `+names+`
+			AND (? IS NULL OR f.id IN (SELECT value FROM json_each(?)))
+			AND (? = 0 OR f.era_year BETWEEN ? AND ?) AND (? = 0 OR f.completeness = 'complete')
+			AND EXISTS (SELECT 1 FROM chunks c WHERE c.sourceid = f.id AND `+opts.filterCond()+`)
+		ORDER BY f.id`, append(append(append([]interface{}{opts.source, opts.source, opts.superseded}, nameArgs...),
+		books, books, opts.era.set, opts.era.from, opts.era.to, opts.completeOnly), opts.filterArgs()...)...)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		recs, written, err := loadExportBook(db, id, opts)
+		if err != nil {
+			return err
+		}
+		b := groupedBook{ID: int(id), Chunks: []interface{}{}}
+		for i, r := range recs {
+			if written[i] == nil {
+				continue
+			}
+			b.Title, b.Author = r.Title, r.Author
+			var n *neighbors
+			if opts.neighbors {
+				n = &neighbors{}
+				if i > 0 && written[i-1] != nil {
+					n.PrevID = &recs[i-1].ID
+				}
+				if i+1 < len(recs) && written[i+1] != nil {
+					n.NextID = &recs[i+1].ID
+				}
+			}
+			for _, p := range written[i] {
+				v, err := exportValue(p, n, opts)
+				if err != nil {
+					return err
+				}
+				if opts.byBook {
+					b.Chunks = append(b.Chunks, v)
+				} else if err = enc.Encode(v); err != nil {
+					return err
+				}
+			}
+		}
+		if opts.byBook && len(b.Chunks) > 0 {
+			if err = enc.Encode(b); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// loadExportBook reads all of book id's chunks in order, with what each is
+// written as, nil for those that aren't: boilerplate, and those the
+// filters leave out.
+func loadExportBook(db rowsQueryer, id int64, opts exportOptions) ([]exportRecord, [][]exportRecord, error) {
+	skip := `c.boilerplate IS NOT NULL OR ? AND ` + contentFlagged + ` OR NOT ` + opts.filterCond()
+	skipArgs := append([]interface{}{opts.excludeFlagged}, opts.filterArgs()...)
+	rows, err := db.Query(`
+		SELECT c.id, c.sourceid, c.ordinal, coalesce(f.name, ''), coalesce(f.author, ''),
+			CASE WHEN `+skip+` THEN '' ELSE c.chunk END, c.token_count, c.scene,
+			coalesce(c.stable_id, ''), coalesce(f.ebook, 0), coalesce(f.language, ''), `+skip+`
+		FROM chunks c JOIN files f ON f.id = c.sourceid
+		WHERE c.sourceid = ?
+		ORDER BY c.ordinal, c.id`, append(append(skipArgs, skipArgs...), id)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	var recs []exportRecord
+	var boilerplate []bool
+	var missing []int
+	for rows.Next() {
+		var b bool
+		r, counted, err := scanExportRecord(rows, opts, &b)
+		if err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		if !counted && !b {
+			missing = append(missing, len(recs))
+		}
+		recs = append(recs, r)
+		boilerplate = append(boilerplate, b)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	if err = countTokens(recs, missing, opts); err != nil {
+		return nil, nil, err
+	}
+
+	written := make([][]exportRecord, len(recs))
+	for i, r := range recs {
+		if boilerplate[i] {
+			continue
+		}
+		parts, err := exportParts(r, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(parts) > 0 {
+			written[i] = parts
+		}
+	}
+	return recs, written, nil
+}
+
+// splitRecord packs whole sentences into parts of at most maxTokens. Each
+// sentence is counted once and parts are sized by summing, which slightly
+// overestimates since tokens rarely span sentences. A single sentence over
+// the budget is broken between words. Sentences and words are those of
+// the script of r's language, or of its text.
+func splitRecord(r exportRecord, opts exportOptions) ([]exportRecord, error) {
+	script := ScriptOf(r.Language, r.Text)
+	ss := Sentences(r.Text, script)
+	counts, err := opts.tok.count(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	pieces, pcounts := []string{}, []int{}
+	for i, s := range ss {
+		if counts[i] <= opts.maxTokens {
+			pieces = append(pieces, s)
+			pcounts = append(pcounts, counts[i])
+			continue
+		}
+		for _, w := range wordPieces(s, script) {
+			pieces = append(pieces, w)
+			pcounts = append(pcounts, estimateTokens(w))
+		}
+	}
+
+	parts := []exportRecord{}
+	cur, n := []string{}, 0
+	flush := func() {
+		if len(cur) == 0 {
+			return
+		}
+		p := r
+		p.Part = len(parts) + 1
+		p.Text = strings.Join(cur, script.Joiner())
+		p.Tokens = n
+		parts = append(parts, p)
+		cur, n = []string{}, 0
+	}
+	for i, p := range pieces {
+		if n+pcounts[i] > opts.maxTokens {
+			flush()
+		}
+		cur = append(cur, p)
+		n += pcounts[i]
+	}
+	flush()
+
+	return parts, nil
+}
@@ -0,0 +1,139 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// neighborLibrary is two books of chunks, in order: 1 to 5 of Emma, 3
+// boilerplate and 2 of 100 tokens, the rest of 8; and 6 to 8 of
+// Persuasion, 7 too short for length:20.., with no count of its tokens.
+func neighborLibrary(t *testing.T) {
+	t.Helper()
+	db := testDB(t)
+	emma := addBook(t, db, "Emma", "Jane Austen", "")
+	for i := 0; i < 5; i++ {
+		insertChunk(t, db, emma, i, fmt.Sprintf("Chunk %d of Emma, which went on a while.", i))
+	}
+	persuasion := addBook(t, db, "Persuasion", "Jane Austen", "")
+	for i, text := range []string{"The first of Persuasion, long enough.", "Oh.", "The last of Persuasion, long enough."} {
+		insertChunk(t, db, persuasion, i, text)
+	}
+	for id, title := range map[int]string{emma: "Emma", persuasion: "Persuasion"} {
+		if err := saveNameWords(db, int64(id), normalizeAuthor("Jane Austen"), normalizeTitle(title)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, q := range []string{
+		"UPDATE chunks SET token_count = 8 WHERE sourceid = 1",
+		"UPDATE chunks SET token_count = 100 WHERE id = 2",
+		"UPDATE chunks SET boilerplate = 1 WHERE id = 3",
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// exported is what export wrote for args, past its provenance line.
+func exported(t *testing.T, args ...string) []string {
+	t.Helper()
+	out, err := captureStdout(t, func() error { return exportCmd(args) })
+	if err != nil {
+		t.Fatalf("export %s: %v", strings.Join(args, " "), err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	if len(lines) == 0 || !strings.Contains(lines[0], `"gutchunk_provenance"`) {
+		t.Fatalf("export %s wrote no provenance line first:\n%s", strings.Join(args, " "), out)
+	}
+	return lines[1:]
+}
+
+// links is each chunk export --with-neighbors wrote, with its links, as
+// id:prev:next, 0 for null.
+func links(t *testing.T, lines []string) string {
+	t.Helper()
+	var got []string
+	for _, line := range lines {
+		var r neighborRecord
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatal(err)
+		}
+		link := func(id *int) int {
+			if id == nil {
+				return 0
+			}
+			return *id
+		}
+		got = append(got, fmt.Sprintf("%d:%d:%d", r.ID, link(r.PrevID), link(r.NextID)))
+	}
+	return strings.Join(got, " ")
+}
+
+func TestExportNeighbors(t *testing.T) {
+	neighborLibrary(t)
+	for _, c := range []struct {
+		args []string
+		want string
+	}{
+		// the books' ends and the boilerplate break the links
+		{nil, "1:0:2 2:1:0 4:0:5 5:4:0 6:0:7 7:6:8 8:7:0"},
+		// as do chunks filtered out, or dropped over --max-tokens
+		{[]string{"--filter", "length:20.."}, "1:0:2 2:1:0 4:0:5 5:4:0 6:0:0 8:0:0"},
+		{[]string{"--max-tokens", "50", "--over", "drop", "--author", "austen", "--title", "emma"}, "1:0:0 4:0:5 5:4:0"},
+		{[]string{"--title", "persuasion"}, "6:0:7 7:6:8 8:7:0"},
+	} {
+		if got := links(t, exported(t, append([]string{"--with-neighbors"}, c.args...)...)); got != c.want {
+			t.Errorf("export --with-neighbors %s linked %s, want %s", strings.Join(c.args, " "), got, c.want)
+		}
+	}
+	if out := exported(t, "--with-neighbors", "--fields", "id,text"); !strings.HasSuffix(out[0], `"prev_id":null,"next_id":2}`) {
+		t.Errorf("export --with-neighbors --fields wrote %s", out[0])
+	}
+}
+
+func TestExportByBook(t *testing.T) {
+	neighborLibrary(t)
+	lines := exported(t, "--group-by-book", "--with-neighbors", "--filter", "length:20..")
+	if len(lines) != 2 {
+		t.Fatalf("export --group-by-book wrote %d books", len(lines))
+	}
+	for i, want := range []struct {
+		id     int
+		title  string
+		chunks string
+	}{{1, "Emma", "1:0:2 2:1:0 4:0:5 5:4:0"}, {2, "Persuasion", "6:0:0 8:0:0"}} {
+		var b struct {
+			ID     int               `json:"id"`
+			Title  string            `json:"title"`
+			Author string            `json:"author"`
+			Chunks []json.RawMessage `json:"chunks"`
+		}
+		if err := json.Unmarshal([]byte(lines[i]), &b); err != nil {
+			t.Fatal(err)
+		}
+		chunks := make([]string, len(b.Chunks))
+		for j, c := range b.Chunks {
+			chunks[j] = string(c)
+		}
+		if b.ID != want.id || b.Title != want.title || b.Author != "Jane Austen" || links(t, chunks) != want.chunks {
+			t.Errorf("book %d was written as %s", want.id, lines[i])
+		}
+	}
+	// a book with nothing written isn't
+	if lines = exported(t, "--group-by-book", "--filter", "length:1000.."); len(lines) != 0 {
+		t.Errorf("export --group-by-book of nothing wrote %q", lines)
+	}
+
+	for _, args := range [][]string{
+		{"--group-by-book", "--max-per-book", "2"},
+		{"--with-neighbors", "--max-total", "2"},
+		{"--with-neighbors", "--position", "0..0.5"},
+	} {
+		if _, err := captureStdout(t, func() error { return exportCmd(args) }); exitCode(err) != exitUsage {
+			t.Errorf("export %s: %v, want a usage error", strings.Join(args, " "), err)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package cli
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// export-books writes each book to a file of its own, named by a template
+// like "{author}/{title}.txt", for a plain text corpus outside the
+// database. Books are written one at a time, their chunks streamed from
+// one query, so memory doesn't grow with the corpus.
+//
+// With --sidecar json each book's file has its metadata beside it, in the
+// same path with .json after it, for tools pairing the texts with it; and
+// manifest.json, at the top of --dir, lists every book written with its
+// paths, size and content hash, after the options the export was made
+// with, so two exports can be diffed and one made again. Each is written
+// to a temp file and renamed into place, so an interrupted export leaves
+// no half written JSON, and the manifest, written last, is removed first,
+// so an export without one didn't finish.
+
+type bookExport struct {
+	id, ebook               int
+	title, author, language string
+	// for sidecars
+	filename, hash string
+	subjects       []string
+	chunks         int
+}
+
+// bookSidecar is what --sidecar json writes beside a book.
+type bookSidecar struct {
+	ID          int      `json:"id"`
+	Ebook       *int     `json:"ebook"`
+	Title       string   `json:"title"`
+	Author      string   `json:"author"`
+	Language    string   `json:"language"`
+	Subjects    []string `json:"subjects"`
+	Filename    string   `json:"filename"`
+	ContentHash string   `json:"content_hash"`
+	Chunks      int      `json:"chunks"`
+}
+
+// exportManifest is manifest.json: what the export was made with, and
+// each book written, in id order.
+type exportManifest struct {
+	Template          string         `json:"template"`
+	Raw               bool           `json:"raw"`
+	Language          string         `json:"language,omitempty"`
+	Author            string         `json:"author,omitempty"`
+	Title             string         `json:"title,omitempty"`
+	IncludeSuperseded bool           `json:"include_superseded"`
+	Provenance        *provenance    `json:"provenance,omitempty"`
+	Books             []exportedBook `json:"books"`
+}
+
+type exportedBook struct {
+	ID          int    `json:"id"`
+	Path        string `json:"path"`
+	Sidecar     string `json:"sidecar"`
+	Bytes       int64  `json:"bytes"`
+	ContentHash string `json:"content_hash"`
+}
+
+const manifestName = "manifest.json"
+
+var templateField = regexp.MustCompile(`\{(\w*)\}`)
+
+// the fields a template may use
+var templateFields = map[string]func(b bookExport) string{
+	"author":   func(b bookExport) string { return b.author },
+	"title":    func(b bookExport) string { return b.title },
+	"language": func(b bookExport) string { return b.language },
+	"ebook":    func(b bookExport) string { return strconv.Itoa(b.ebook) },
+	"id":       func(b bookExport) string { return strconv.Itoa(b.id) },
+}
+
+// checkTemplate reports a template using fields there are none of, or
+// leading out of the directory written to.
+func checkTemplate(tmpl string) error {
+	for _, m := range templateField.FindAllStringSubmatch(tmpl, -1) {
+		if templateFields[m[1]] == nil {
+			return usagef("unknown field {%s} in --template; want {author}, {title}, {language}, {ebook} or {id}", m[1])
+		}
+	}
+	if filepath.IsAbs(tmpl) || strings.HasPrefix(filepath.Clean(tmpl), "..") {
+		return usagef("--template must be a path under --dir")
+	}
+	return nil
+}
+
+// expandTemplate is the path, relative to the directory written to, of b's
+// file. The slashes of the template separate directories; those of a field
+// are replaced like every other character unsafe in a filename.
+func expandTemplate(tmpl string, b bookExport) string {
+	parts := strings.Split(tmpl, "/")
+	for i, part := range parts {
+		part = templateField.ReplaceAllStringFunc(part, func(f string) string {
+			v := templateFields[f[1:len(f)-1]](b)
+			if v == "" || v == "0" {
+				v = "unknown"
+			}
+			// "Emma." makes "Emma.txt", not "Emma..txt"
+			return strings.TrimRight(strings.NewReplacer("/", "_", "\\", "_").Replace(v), ". ")
+		})
+		parts[i] = sanitizeName(part)
+	}
+	return filepath.Join(parts...)
+}
+
+var (
+	// characters not allowed in filenames somewhere, Windows being the
+	// strictest, and control characters
+	unsafeName = regexp.MustCompile(`[<>:"/\\|?*\x00-\x1f\x7f]+`)
+	// device names Windows won't create a file by, with any extension
+	reservedName = regexp.MustCompile(`(?i)^(con|prn|aux|nul|com[0-9]|lpt[0-9])(\.|$)`)
+)
+
+// longest path part written, in bytes, within the 255 most filesystems
+// allow with room for a collision suffix
+const maxNameBytes = 200
+
+// sanitizeName makes one part of a path safe to create on any common
+// filesystem: unsafe characters become "_", trailing dots and spaces are
+// dropped, device names are suffixed and long names are cut, keeping the
+// extension.
+func sanitizeName(name string) string {
+	name = unsafeName.ReplaceAllString(name, "_")
+	name = strings.Join(strings.Fields(name), " ")
+	name = strings.TrimRight(name, ". ")
+	if name == "" {
+		name = "_"
+	}
+	if reservedName.MatchString(name) {
+		ext := filepath.Ext(name)
+		name = strings.TrimSuffix(name, ext) + "_" + ext
+	}
+	if len(name) > maxNameBytes {
+		ext := nameExt(name)
+		stem := name[:maxNameBytes-len(ext)]
+		for !utf8.ValidString(stem) {
+			stem = stem[:len(stem)-1]
+		}
+		name = strings.TrimRight(stem, ". ") + ext
+	}
+	return name
+}
+
+// nameExt is the extension of a filename, like ".txt", or "" when what
+// follows its last dot doesn't look like one, as in "St. Ives".
+func nameExt(name string) string {
+	ext := filepath.Ext(name)
+	if len(ext) > 16 || strings.ContainsAny(ext, " ") {
+		return ""
+	}
+	return ext
+}
+
+// pathSet hands out the paths books are written to, keeping two books from
+// being given one path. Paths are compared without regard to case, as
+// they are on Windows and macOS.
+type pathSet map[string]bool
+
+// claim returns path, or when it is taken already, path with b's ebook
+// number, or failing that its file id, before the extension.
+func (s pathSet) claim(path string, b bookExport) string {
+	ext := nameExt(path)
+	stem := strings.TrimSuffix(path, ext)
+	tries := []string{path}
+	if b.ebook != 0 {
+		tries = append(tries, fmt.Sprintf("%s (ebook %d)%s", stem, b.ebook, ext))
+	}
+	tries = append(tries, fmt.Sprintf("%s (file %d)%s", stem, b.id, ext))
+	for _, p := range tries {
+		if !s[strings.ToLower(p)] {
+			s[strings.ToLower(p)] = true
+			return p
+		}
+	}
+	// file ids are unique, so only a book given twice gets here
+	for n := 2; ; n++ {
+		p := fmt.Sprintf("%s (file %d, %d)%s", stem, b.id, n, ext)
+		if !s[strings.ToLower(p)] {
+			s[strings.ToLower(p)] = true
+			return p
+		}
+	}
+}
+
+func exportBooksCmd(args []string) error {
+	fs := flag.NewFlagSet("export-books", flag.ExitOnError)
+	dir := fs.String("dir", "", "directory to write the books under")
+	tmpl := fs.String("template", "{author}/{title}.txt", "path of each book under --dir, from {author}, {title}, {language}, {ebook} and {id}")
+	raw := fs.Bool("raw", false, "write each book's content as ingested, header and all, instead of its chunks")
+	lang := fs.String("language", "", "only export books in this language, by code (en) or name (English)")
+	undetermined := fs.Bool("include-undetermined", false, "with --language, also books with no language or und")
+	author := fs.String("author", "", "only export books by this author, by the starts of words of their name, without regard to case or diacritics")
+	title := fs.String("title", "", "only export books with this title, by the starts of its words, without regard to case or diacritics")
+	superseded := fs.Bool("include-superseded", false, "also export the book versions a re-release superseded")
+	sidecar := fs.String("sidecar", "", "also write each book's metadata beside it, and a manifest.json of them all: json")
+	license := provenanceFlags(fs, false)
+	fs.Parse(args)
+
+	if *dir == "" {
+		return usagef("export-books needs --dir")
+	}
+	if *sidecar != "" && *sidecar != "json" {
+		return usagef("--sidecar only writes json")
+	}
+	if err := checkTemplate(*tmpl); err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	names, nameArgs := parseNameQuery(*author, *title).where()
+	code := normalizeLanguages(*lang)
+	rows, err := db.Query(`SELECT f.id, coalesce(f.ebook, 0), coalesce(f.name, ''), coalesce(f.author, ''), coalesce(f.language, ''),
+			coalesce(f.filename, ''), coalesce(f.content_hash, ''), coalesce(m.subjects, '[]'),
+			(SELECT count(*) FROM chunks c WHERE c.sourceid = f.id AND c.boilerplate IS NULL)
+		FROM files f LEFT JOIN book_meta m ON m.file_id = f.id
+		WHERE f.deleted_at IS NULL AND (? OR `+activeVersion+`) AND `+names+` 
+			AND (? = '' OR ',' || f.language || ',' LIKE '%,' || ? || ',%' OR ? AND `+undeterminedLanguage+`)
+		ORDER BY f.id`, append(append([]interface{}{*superseded}, nameArgs...), code, code, *undetermined && code != "")...)
+	if err != nil {
+		return err
+	}
+	books := []bookExport{}
+	for rows.Next() {
+		var b bookExport
+		var subjects string
+		if err = rows.Scan(&b.id, &b.ebook, &b.title, &b.author, &b.language, &b.filename, &b.hash, &subjects, &b.chunks); err != nil {
+			rows.Close()
+			return err
+		}
+		if err = json.Unmarshal([]byte(subjects), &b.subjects); err != nil {
+			rows.Close()
+			return fmt.Errorf("book %d subjects: %w", b.id, err)
+		}
+		books = append(books, b)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	paths := pathSet{}
+	manifest := exportManifest{Template: *tmpl, Raw: *raw, Language: code, Author: *author, Title: *title,
+		IncludeSuperseded: *superseded, Books: []exportedBook{}}
+	if *sidecar != "" {
+		note, _ := license()
+		p, err := newProvenance(db, "export-books", fs, note)
+		if err != nil {
+			return err
+		}
+		manifest.Provenance = &p
+		paths[manifestName] = true
+		if err = os.Remove(filepath.Join(*dir, manifestName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	written, empty := 0, 0
+	var bytes int64
+	for _, b := range books {
+		rel := paths.claim(expandTemplate(*tmpl, b), b)
+		n, err := exportBook(db, filepath.Join(*dir, rel), b.id, *raw)
+		if err != nil {
+			return fmt.Errorf("book %d: %w", b.id, err)
+		}
+		if n == 0 {
+			delete(paths, strings.ToLower(rel))
+			empty++
+			continue
+		}
+		written++
+		bytes += n
+		if *sidecar == "" {
+			continue
+		}
+		side := rel + ".json"
+		paths[strings.ToLower(side)] = true
+		if err = writeJSONFile(filepath.Join(*dir, side), b.sidecar()); err != nil {
+			return fmt.Errorf("book %d: %w", b.id, err)
+		}
+		manifest.Books = append(manifest.Books, exportedBook{ID: b.id, Path: filepath.ToSlash(rel), Sidecar: filepath.ToSlash(side),
+			Bytes: n, ContentHash: b.hash})
+	}
+	if *sidecar != "" {
+		if err = writeJSONFile(filepath.Join(*dir, manifestName), manifest); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("wrote %d books, %s, under %s\n", written, formatSize(bytes), *dir)
+	if empty > 0 {
+		fmt.Printf("%d books have no chunks and were left out; chunk them first\n", empty)
+	}
+	return nil
+}
+
+func (b bookExport) sidecar() bookSidecar {
+	s := bookSidecar{ID: b.id, Title: b.title, Author: b.author, Language: b.language, Subjects: b.subjects,
+		Filename: b.filename, ContentHash: b.hash, Chunks: b.chunks}
+	if b.ebook != 0 {
+		s.Ebook = &b.ebook
+	}
+	if s.Subjects == nil {
+		s.Subjects = []string{}
+	}
+	return s
+}
+
+// writeJSONFile writes v to path as indented json, through a temp file
+// beside it renamed over it, so that path is never left half written.
+func writeJSONFile(path string, v interface{}) error {
+	bs, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".export-*.json")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(bs, '\n')); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err = os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// exportBook writes book id to path, its chunks in order a blank line
+// apart, leaving out boilerplate, or with raw its content, and returns the bytes written. A book
+// with nothing to write gets no file.
+func exportBook(db *sql.DB, path string, id int, raw bool) (int64, error) {
+	q := "SELECT c.chunk FROM chunks c WHERE c.sourceid = ? AND c.boilerplate IS NULL ORDER BY c.ordinal, c.id"
+	if raw {
+		q = "SELECT " + contentCol("") + " FROM files WHERE id = ? AND coalesce(" + contentCol("") + ", '') != ''"
+	}
+	rows, err := db.Query(q, id)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var f *os.File
+	var w *bufio.Writer
+	var n int64
+	for rows.Next() {
+		var text string
+		if err = rows.Scan(&text); err != nil {
+			return 0, err
+		}
+		if f == nil {
+			if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return 0, err
+			}
+			if f, err = os.Create(path); err != nil {
+				return 0, err
+			}
+			defer f.Close()
+			w = bufio.NewWriter(f)
+		}
+		if !raw {
+			text = strings.TrimSpace(text) + "\n"
+			if n > 0 {
+				text = "\n" + text
+			}
+		}
+		m, err := w.WriteString(text)
+		n += int64(m)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if err = rows.Err(); err != nil || f == nil {
+		return 0, err
+	}
+	if err = w.Flush(); err != nil {
+		return 0, err
+	}
+	return n, f.Close()
+}
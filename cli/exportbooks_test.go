@@ -0,0 +1,271 @@
+package cli
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestExpandTemplate(t *testing.T) {
+	for _, c := range []struct {
+		tmpl string
+		b    bookExport
+		want string
+	}{
+		{"{author}/{title}.txt", bookExport{title: "Emma", author: "Jane Austen"}, "Jane Austen/Emma.txt"},
+		{"{author}/{title}.txt", bookExport{title: "What? Where: <Here>/There|*", author: "AC/DC"}, "AC_DC/What_ Where_ _Here__There_.txt"},
+		{"{author}/{title}.txt", bookExport{title: "Emma."}, "unknown/Emma.txt"},
+		{"{title}.txt", bookExport{title: "CON"}, "CON_.txt"},
+		{"{title}.txt", bookExport{title: "Tab\tand\nnewline  "}, "Tab_and_newline.txt"},
+		{"{language}/{ebook}-{id}.txt", bookExport{id: 3, ebook: 158, language: "en"}, "en/158-3.txt"},
+		{"{language}/{ebook}-{id}.txt", bookExport{id: 3}, "unknown/unknown-3.txt"},
+		{"books/{title}", bookExport{title: "St. Ives"}, "books/St. Ives"},
+	} {
+		if got := expandTemplate(c.tmpl, c.b); got != filepath.FromSlash(c.want) {
+			t.Errorf("%s of %+v = %q, want %q", c.tmpl, c.b, got, c.want)
+		}
+	}
+
+	// cut on a rune, keeping the extension
+	long := expandTemplate("{title}.txt", bookExport{title: strings.Repeat("é", 150)})
+	if len(long) > maxNameBytes || !strings.HasSuffix(long, "é.txt") || !utf8.ValidString(long) {
+		t.Errorf("a 300 byte title gave %q, %d bytes", long, len(long))
+	}
+}
+
+func TestCheckTemplate(t *testing.T) {
+	for _, tmpl := range []string{"{name}.txt", "{Title}.txt", "../{title}.txt", "a/../../{title}.txt", "/tmp/{title}.txt"} {
+		if err := checkTemplate(tmpl); exitCode(err) != exitUsage {
+			t.Errorf("--template %s: %v, want a usage error", tmpl, err)
+		}
+	}
+	if err := checkTemplate("{language}/{author}/{ebook} {title} ({id}).txt"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPathSetClaim(t *testing.T) {
+	paths := pathSet{}
+	for _, c := range []struct {
+		path string
+		b    bookExport
+		want string
+	}{
+		{"Jane Austen/Emma.txt", bookExport{id: 1, ebook: 158}, "Jane Austen/Emma.txt"},
+		{"Jane Austen/EMMA.txt", bookExport{id: 2, ebook: 19839}, "Jane Austen/EMMA (ebook 19839).txt"},
+		{"Jane Austen/Emma.txt", bookExport{id: 3}, "Jane Austen/Emma (file 3).txt"},
+		{"Jane Austen/Emma.txt", bookExport{id: 3}, "Jane Austen/Emma (file 3, 2).txt"},
+		{"Jane Austen/Persuasion.txt", bookExport{id: 4, ebook: 105}, "Jane Austen/Persuasion.txt"},
+	} {
+		if got := paths.claim(c.path, c.b); got != c.want {
+			t.Errorf("book %d claiming %s got %s, want %s", c.b.id, c.path, got, c.want)
+		}
+	}
+}
+
+// exportLibrary is three books chunked, two of them Emma, and one not.
+func exportLibrary(t *testing.T) *sql.DB {
+	t.Helper()
+	db := testDB(t)
+	for _, b := range []struct {
+		title, author string
+		ebook         int
+	}{
+		{"Emma", "Jane Austen", 158},
+		{"EMMA", "Jane Austen", 19839},
+		{"Who? Me.", "Anonymous", 0},
+	} {
+		id := addBook(t, db, b.title, b.author, testBook(b.title, testParagraphs(2)))
+		if b.ebook != 0 {
+			if _, err := db.Exec("UPDATE files SET ebook = ? WHERE id = ?", b.ebook, id); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	addBook(t, db, "Unchunked", "Nobody", "")
+	if err := makeChunks(db, chunkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// filesUnder is the paths of the files under dir, relative to it.
+func filesUnder(t *testing.T, dir string) []string {
+	t.Helper()
+	var got []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			got = append(got, filepath.ToSlash(rel))
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestExportBooks(t *testing.T) {
+	exportLibrary(t)
+	dir := t.TempDir()
+	out, err := captureStdout(t, func() error { return exportBooksCmd([]string{"--dir", dir}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "wrote 3 books") || !strings.Contains(out, "1 books have no chunks") {
+		t.Errorf("export-books printed %q", out)
+	}
+	got := filesUnder(t, dir)
+	want := "Anonymous/Who_ Me.txt, Jane Austen/EMMA (ebook 19839).txt, Jane Austen/Emma.txt"
+	if strings.Join(got, ", ") != want {
+		t.Errorf("wrote %q, want %s", got, want)
+	}
+
+	bs, err := os.ReadFile(filepath.Join(dir, "Jane Austen", "Emma.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(bs)
+	if strings.Count(text, "\n\n") != 1 || !strings.HasSuffix(text, "as paragraphs will.\n") || strings.Contains(text, "GUTENBERG") {
+		t.Errorf("Emma was written as %q, want its 2 chunks a blank line apart", text)
+	}
+}
+
+func TestExportBooksSidecars(t *testing.T) {
+	db := exportLibrary(t)
+	for _, q := range []string{
+		"UPDATE files SET filename = '158.txt', content_hash = 'abc123', language = 'en' WHERE id = 1",
+		`INSERT INTO book_meta (file_id, subjects) VALUES (1, '["Courtship -- Fiction","England -- Fiction"]')`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	export := func(dir string) exportManifest {
+		t.Helper()
+		if _, err := captureStdout(t, func() error { return exportBooksCmd([]string{"--dir", dir, "--sidecar", "json"}) }); err != nil {
+			t.Fatal(err)
+		}
+		var m exportManifest
+		readJSON(t, filepath.Join(dir, manifestName), &m)
+		return m
+	}
+	dir := t.TempDir()
+	m := export(dir)
+
+	// each book's file has its sidecar beside it, and the manifest lists
+	// them all, and nothing else is there
+	want := "Anonymous/Who_ Me.txt, Anonymous/Who_ Me.txt.json, Jane Austen/EMMA (ebook 19839).txt, Jane Austen/EMMA (ebook 19839).txt.json, " +
+		"Jane Austen/Emma.txt, Jane Austen/Emma.txt.json, manifest.json"
+	if got := strings.Join(filesUnder(t, dir), ", "); got != want {
+		t.Errorf("wrote %s, want %s", got, want)
+	}
+	if len(m.Books) != 3 || m.Template != "{author}/{title}.txt" || m.Provenance == nil || m.Provenance.Command != "export-books" {
+		t.Fatalf("the manifest is %+v", m)
+	}
+	for i, b := range m.Books {
+		fi, err := os.Stat(filepath.Join(dir, filepath.FromSlash(b.Path)))
+		if err != nil || fi.Size() != b.Bytes || b.ID != i+1 || b.Sidecar != b.Path+".json" {
+			t.Errorf("the manifest lists %+v (%v)", b, err)
+		}
+	}
+
+	var s bookSidecar
+	readJSON(t, filepath.Join(dir, "Jane Austen", "Emma.txt.json"), &s)
+	ebook := 158
+	if want := (bookSidecar{ID: 1, Ebook: &ebook, Title: "Emma", Author: "Jane Austen", Language: "en",
+		Subjects: []string{"Courtship -- Fiction", "England -- Fiction"}, Filename: "158.txt", ContentHash: "abc123", Chunks: 2}); mustJSON(t, s) != mustJSON(t, want) {
+		t.Errorf("Emma's sidecar is %+v", s)
+	}
+	bs, err := os.ReadFile(filepath.Join(dir, "Anonymous", "Who_ Me.txt.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// no ebook is null, and no subjects a list of none
+	if !bytes.Contains(bs, []byte(`"ebook": null,`)) || !bytes.Contains(bs, []byte(`"subjects": [],`)) {
+		t.Errorf("the anonymous book's sidecar is\n%s", bs)
+	}
+
+	// exported again, the books are listed the same
+	again := export(t.TempDir())
+	if a, b := mustJSON(t, m.Books), mustJSON(t, again.Books); a != b {
+		t.Errorf("exported again, the manifest lists\n%s\nwant\n%s", b, a)
+	}
+
+	// an export cut short leaves no manifest, nor any half written json
+	if err = os.Remove(filepath.Join(dir, "Jane Austen", "EMMA (ebook 19839).txt.json")); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(filepath.Join(dir, "Jane Austen", "EMMA (ebook 19839).txt.json"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = captureStdout(t, func() error { return exportBooksCmd([]string{"--dir", dir, "--sidecar", "json"}) }); err == nil {
+		t.Fatal("exporting over a directory where a sidecar goes succeeded")
+	}
+	if _, err = os.Stat(filepath.Join(dir, manifestName)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("cut short, the export left its manifest (%v)", err)
+	}
+	for _, f := range filesUnder(t, dir) {
+		if strings.Contains(f, ".export-") {
+			t.Errorf("cut short, the export left %s", f)
+		}
+	}
+	readJSON(t, filepath.Join(dir, "Jane Austen", "Emma.txt.json"), &s)
+
+	if _, err = captureStdout(t, func() error { return exportBooksCmd([]string{"--dir", dir, "--sidecar", "yaml"}) }); exitCode(err) != exitUsage {
+		t.Errorf("export-books --sidecar yaml: %v, want a usage error", err)
+	}
+}
+
+func TestWriteJSONFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a", "b.json")
+	for _, v := range []interface{}{map[string]int{"one": 1}, []string{"two"}} {
+		if err := writeJSONFile(path, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bs, err := os.ReadFile(path)
+	if err != nil || string(bs) != "[\n  \"two\"\n]\n" {
+		t.Errorf("written over, the file is %q (%v)", bs, err)
+	}
+	// what can't be marshaled leaves the file as it was
+	if err = writeJSONFile(path, func() {}); err == nil {
+		t.Error("writing a func succeeded")
+	}
+	if bs, _ = os.ReadFile(path); string(bs) != "[\n  \"two\"\n]\n" {
+		t.Errorf("after a failed write, the file is %q", bs)
+	}
+	if got := filesUnder(t, filepath.Dir(path)); len(got) != 1 {
+		t.Errorf("writing left %q", got)
+	}
+}
+
+// readJSON decodes the json at path into v, failing on a field v hasn't.
+func readJSON(t *testing.T, path string, v interface{}) {
+	t.Helper()
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(bs))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(v); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	bs, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(bs)
+}
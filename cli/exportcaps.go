@@ -0,0 +1,197 @@
+package cli
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+)
+
+// export --max-per-book, --max-per-author and --max-total cap how many
+// chunks it writes, for a training set that no one long book or prolific
+// author outweighs. The chunks the other filters leave are read first, by
+// book and then id, and sampled uniformly: each book down to its cap, the
+// books of each author down to theirs and all of them down to the total,
+// each by a reservoir, so what is held is at most the caps' chunk ids
+// whatever the size of a book or author. The same --seed over the same
+// chunks samples the same ones. Caps count chunks as stored, before any
+// are split or dropped over --max-tokens, and chunks of books with no
+// author are capped by book and in total but not as one author. With
+// --split-by each file is sampled by itself, its books and authors capped
+// within it and in total (see exportsplit.go).
+
+// exportCaps are the caps on an export, 0 for none, and the seed they
+// sample by.
+type exportCaps struct {
+	perBook, perAuthor, total int
+	seed                      int64
+}
+
+func (c exportCaps) set() bool {
+	return c.perBook > 0 || c.perAuthor > 0 || c.total > 0
+}
+
+// idReservoir is a uniform sample of at most size of the ids offered it,
+// all of them for a size of 0.
+type idReservoir struct {
+	size, seen int
+	ids        []int
+}
+
+func (rv *idReservoir) offer(id int, r *rand.Rand) {
+	rv.seen++
+	if rv.size == 0 || len(rv.ids) < rv.size {
+		rv.ids = append(rv.ids, id)
+	} else if j := r.Intn(rv.seen); j < rv.size {
+		rv.ids[j] = id
+	}
+}
+
+func (rv *idReservoir) capped() bool {
+	return rv.size > 0 && rv.seen > rv.size
+}
+
+// capReport is what sampling under the caps did.
+type capReport struct {
+	eligible, kept int
+	// of the books and authors, how many had more chunks than their cap
+	books, booksCapped     int
+	authors, authorsCapped int
+	totalCapped            bool
+}
+
+func (c capReport) String() string {
+	s := fmt.Sprintf("kept %d of %d eligible chunks", c.kept, c.eligible)
+	if c.booksCapped > 0 {
+		s += fmt.Sprintf("; %d of %d books capped", c.booksCapped, c.books)
+	}
+	if c.authorsCapped > 0 {
+		s += fmt.Sprintf("; %d of %d authors capped", c.authorsCapped, c.authors)
+	}
+	if c.totalCapped {
+		s += "; capped in total"
+	}
+	return s
+}
+
+// capGroup is the sampling of the chunks of one --split-by file, or of
+// all of them without it.
+type capGroup struct {
+	total   *idReservoir
+	authors map[string]*idReservoir
+	// a book's chunks go to its reservoir and from there, once it is read,
+	// into its author's, or with no cap by author or no author, the
+	// total's; with no cap by book they go straight on
+	book, into *idReservoir
+	bookID     int
+}
+
+// sampleCapped picks the chunks export writes under opts.caps from those
+// its filters leave, by the --split-by key they are written under, "" for
+// all without it.
+func sampleCapped(db rowsQueryer, opts exportOptions) (map[string]map[int]bool, capReport, error) {
+	var rep capReport
+	where, args := opts.chunkWhere()
+	keyColumn := "''"
+	if opts.splitBy != nil {
+		keyColumn = opts.splitBy.column
+	}
+	rows, err := db.Query(`SELECT c.id, c.sourceid, coalesce(f.author_norm, ''), `+keyColumn+`
+		FROM chunks c JOIN files f ON f.id = c.sourceid
+		WHERE `+where+` ORDER BY c.sourceid, c.id`, args...)
+	if err != nil {
+		return nil, rep, err
+	}
+	defer rows.Close()
+
+	caps := opts.caps
+	r := rand.New(rand.NewSource(caps.seed))
+	groups := map[string]*capGroup{}
+	flush := func(g *capGroup) {
+		if g.bookID < 0 {
+			return
+		}
+		rep.books++
+		if g.book.capped() {
+			rep.booksCapped++
+		}
+		if caps.perBook > 0 {
+			for _, id := range g.book.ids {
+				g.into.offer(id, r)
+			}
+		}
+	}
+	for rows.Next() {
+		var id, sourceid int
+		var author, key string
+		if err = rows.Scan(&id, &sourceid, &author, &key); err != nil {
+			return nil, rep, err
+		}
+		for _, k := range opts.splitBy.chunkKeys(key) {
+			g := groups[k]
+			if g == nil {
+				g = &capGroup{total: &idReservoir{size: caps.total}, authors: map[string]*idReservoir{}, bookID: -1}
+				groups[k] = g
+			}
+			if sourceid != g.bookID {
+				flush(g)
+				g.bookID, g.book, g.into = sourceid, &idReservoir{size: caps.perBook}, g.total
+				if caps.perAuthor > 0 && author != "" {
+					if g.into = g.authors[author]; g.into == nil {
+						g.into = &idReservoir{size: caps.perAuthor}
+						g.authors[author] = g.into
+					}
+				}
+			}
+			rep.eligible++
+			if caps.perBook > 0 {
+				g.book.offer(id, r)
+			} else {
+				g.into.offer(id, r)
+			}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, rep, err
+	}
+
+	// in order of key and name, so the draws for the totals come the same
+	// each time
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	keep := make(map[string]map[int]bool, len(groups))
+	for _, k := range keys {
+		g := groups[k]
+		flush(g)
+		names := make([]string, 0, len(g.authors))
+		for a := range g.authors {
+			names = append(names, a)
+		}
+		sort.Strings(names)
+		rep.authors += len(names)
+		for _, a := range names {
+			if g.authors[a].capped() {
+				rep.authorsCapped++
+			}
+			for _, id := range g.authors[a].ids {
+				g.total.offer(id, r)
+			}
+		}
+		rep.totalCapped = rep.totalCapped || g.total.capped()
+		keep[k] = make(map[int]bool, len(g.total.ids))
+		for _, id := range g.total.ids {
+			keep[k][id] = true
+		}
+		rep.kept += len(keep[k])
+	}
+	return keep, rep, nil
+}
+
+// reportCaps prints rep for an export under caps, to stderr as the
+// chunks may be on stdout.
+func reportCaps(caps exportCaps, rep capReport) {
+	fmt.Fprintf(os.Stderr, "%s (seed %d)\n", rep, caps.seed)
+}
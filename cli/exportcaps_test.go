@@ -0,0 +1,167 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestIDReservoir(t *testing.T) {
+	// every id offered is as likely to be kept as any other
+	kept := make([]int, 20)
+	for seed := int64(1); seed <= 2000; seed++ {
+		r := rand.New(rand.NewSource(seed))
+		rv := &idReservoir{size: 5}
+		for id := 0; id < 20; id++ {
+			rv.offer(id, r)
+		}
+		if len(rv.ids) != 5 || !rv.capped() {
+			t.Fatalf("a reservoir of 5 offered 20 holds %v", rv.ids)
+		}
+		for _, id := range rv.ids {
+			kept[id]++
+		}
+	}
+	for id, n := range kept {
+		if n < 425 || n > 575 {
+			t.Errorf("id %d was kept %d times of 2000, want about 500", id, n)
+		}
+	}
+	rv := &idReservoir{}
+	for id := 0; id < 20; id++ {
+		rv.offer(id, nil)
+	}
+	if len(rv.ids) != 20 || rv.capped() {
+		t.Errorf("a reservoir of no size holds %v", rv.ids)
+	}
+}
+
+// skewedLibrary is five books of very different sizes: three short to long
+// of Jane Austen's, a long one of Charles Dickens's whose every other
+// chunk is too short for length:20.., and one with no author.
+func skewedLibrary(t *testing.T) {
+	t.Helper()
+	db := testDB(t)
+	for _, b := range []struct {
+		title, author string
+		chunks        int
+	}{{"Emma", "Jane Austen", 60}, {"Persuasion", "Jane Austen", 30}, {"Lady Susan", "Jane Austen", 5}, {"Bleak House", "Charles Dickens", 200}, {"Beowulf", "", 40}} {
+		id := addBook(t, db, b.title, b.author, "")
+		if err := saveNameWords(db, int64(id), normalizeAuthor(b.author), normalizeTitle(b.title)); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < b.chunks; i++ {
+			text := fmt.Sprintf("Chunk %d of %s, which went on a while.", i, b.title)
+			if b.title == "Bleak House" && i%2 == 1 {
+				text = fmt.Sprintf("Oh %d.", i)
+			}
+			insertChunk(t, db, id, i, text)
+		}
+	}
+}
+
+func TestExportCaps(t *testing.T) {
+	skewedLibrary(t)
+	export := func(args ...string) ([]exportRecord, string) {
+		t.Helper()
+		var lines []string
+		stderr, err := captureStderr(t, func() error {
+			lines = exported(t, args...)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		recs := make([]exportRecord, len(lines))
+		for i, line := range lines {
+			if err := json.Unmarshal([]byte(line), &recs[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return recs, strings.TrimSuffix(stderr, "\n")
+	}
+	counts := func(recs []exportRecord) string {
+		byBook := map[string]int{}
+		byAuthor := map[string]int{}
+		seen := map[int]bool{}
+		for _, r := range recs {
+			if seen[r.ID] {
+				t.Errorf("chunk %d was written twice", r.ID)
+			}
+			seen[r.ID] = true
+			byBook[r.Title]++
+			byAuthor[r.Author]++
+		}
+		return fmt.Sprintf("%d: Emma %d, Persuasion %d, Lady Susan %d, Bleak House %d, Beowulf %d; Austen %d",
+			len(recs), byBook["Emma"], byBook["Persuasion"], byBook["Lady Susan"], byBook["Bleak House"], byBook["Beowulf"], byAuthor["Jane Austen"])
+	}
+
+	// each cap holds, and what is under it is all kept
+	for _, c := range []struct {
+		args           []string
+		counts, report string
+	}{
+		{[]string{"--max-per-book", "25"}, "105: Emma 25, Persuasion 25, Lady Susan 5, Bleak House 25, Beowulf 25; Austen 55",
+			"kept 105 of 335 eligible chunks; 4 of 5 books capped"},
+		// the book with no author isn't capped as one
+		{[]string{"--max-per-author", "40"}, "",
+			"kept 120 of 335 eligible chunks; 2 of 2 authors capped"},
+		{[]string{"--max-total", "100"}, "",
+			"kept 100 of 335 eligible chunks; capped in total"},
+		{[]string{"--max-per-book", "25", "--max-per-author", "40", "--max-total", "70"}, "",
+			"kept 70 of 335 eligible chunks; 4 of 5 books capped; 1 of 2 authors capped; capped in total"},
+		// the other filters go first, the caps counting what they leave
+		{[]string{"--filter", "length:20..", "--max-per-book", "150"}, "235: Emma 60, Persuasion 30, Lady Susan 5, Bleak House 100, Beowulf 40; Austen 95",
+			"kept 235 of 235 eligible chunks"},
+		{[]string{"--title", "bleak", "--max-total", "1000"}, "200: Emma 0, Persuasion 0, Lady Susan 0, Bleak House 200, Beowulf 0; Austen 0",
+			"kept 200 of 200 eligible chunks"},
+	} {
+		args := append([]string{"--seed", "7"}, c.args...)
+		recs, report := export(args...)
+		if report != c.report+" (seed 7)" {
+			t.Errorf("export %s reported %q, want %q", strings.Join(args, " "), report, c.report)
+		}
+		if c.counts != "" && counts(recs) != c.counts {
+			t.Errorf("export %s wrote %s, want %s", strings.Join(args, " "), counts(recs), c.counts)
+		}
+	}
+	recs, _ := export("--seed", "7", "--max-per-author", "40")
+	if got := counts(recs); !strings.HasPrefix(got, "120: ") || !strings.Contains(got, "Bleak House 40, Beowulf 40; Austen 40") {
+		t.Errorf("export --max-per-author 40 wrote %s", got)
+	}
+	recs, _ = export("--seed", "7", "--max-per-book", "25", "--max-per-author", "40", "--max-total", "70")
+	byBook := map[string]int{}
+	for _, r := range recs {
+		byBook[r.Title]++
+	}
+	if austen := byBook["Emma"] + byBook["Persuasion"] + byBook["Lady Susan"]; len(recs) != 70 || austen > 40 || byBook["Emma"] > 25 || byBook["Bleak House"] > 25 || byBook["Beowulf"] > 25 {
+		t.Errorf("under every cap, export wrote %s", counts(recs))
+	}
+	// written in id order as without caps
+	for i := 1; i < len(recs); i++ {
+		if recs[i].ID <= recs[i-1].ID {
+			t.Fatalf("under caps, chunk %d was written after %d", recs[i].ID, recs[i-1].ID)
+		}
+	}
+
+	// the same seed samples the same chunks, and another others
+	ids := func(seed string) string {
+		recs, _ := export("--seed", seed, "--max-per-book", "25", "--max-per-author", "40", "--max-total", "70")
+		var s []string
+		for _, r := range recs {
+			s = append(s, fmt.Sprint(r.ID))
+		}
+		return strings.Join(s, " ")
+	}
+	if seven := ids("7"); ids("7") != seven || ids("8") == seven {
+		t.Error("the samples of seeds 7, 7 and 8 aren't two the same and one not")
+	}
+
+	for _, args := range [][]string{{"--max-per-book", "-1"}, {"--max-total", "5", "--with-neighbors"}, {"--max-per-author", "5", "--group-by-book"}} {
+		if _, err := captureStdout(t, func() error { return exportCmd(args) }); exitCode(err) != exitUsage {
+			t.Errorf("export %s: %v, want a usage error", strings.Join(args, " "), err)
+		}
+	}
+}
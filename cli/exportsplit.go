@@ -0,0 +1,300 @@
+package cli
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// export --split-by language --out-dir exports/ writes en.jsonl, fr.jsonl
+// and so on, a file for each language, in the one pass over the chunks an
+// export makes, rather than a filtered export for each, each reading all
+// of them. --split-by author splits by the books' normalized authors and
+// subject by their meta subjects, a chunk of a book with several going to
+// each of their files. The chunks of books with none, no language, author
+// or subject, go to --unknown's file, unknown.jsonl. A file is named for
+// its key made safe as export-books makes names (see sanitizeName), two
+// keys named alike, as by case, getting -2 and so on after the second.
+// Only --max-open files are kept open at once, the one written to least
+// lately closed to open another and opened again to append to should a
+// chunk need it, so a split by author with thousands of them doesn't run
+// out of file handles. --fields, --transform, --max-tokens and the rest
+// apply to every file, and the --max-* caps to each file by itself: each
+// file has at most --max-total chunks, each book and author in it at most
+// theirs. Each file starts with the provenance line, unless
+// --no-provenance, and manifest.json in the directory says which key went
+// to which file and how many records each has, with the provenance.
+
+const (
+	defaultSplitUnknown = "unknown"
+	defaultSplitOpen    = 64
+)
+
+// splitKey is what export --split-by splits by: column, of chunks c of
+// files f, is the key of each chunk, a json list of keys with list.
+type splitKey struct {
+	column string
+	list   bool
+}
+
+var splitKeys = map[string]splitKey{
+	"language": {column: "coalesce(f.language, '')"},
+	"author":   {column: "coalesce(f.author_norm, '')"},
+	"subject":  {column: "coalesce((SELECT m.subjects FROM book_meta m WHERE m.file_id = f.id), '[]')", list: true},
+}
+
+func splitKeyNames() string {
+	names := make([]string, 0, len(splitKeys))
+	for name := range splitKeys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// keys are the keys v, the column as read, gives a chunk, "" for unknown.
+func (k splitKey) keys(v string) []string {
+	if !k.list {
+		return []string{strings.TrimSpace(v)}
+	}
+	var list []string
+	json.Unmarshal([]byte(v), &list)
+	keys := []string{}
+	seen := map[string]bool{}
+	for _, key := range list {
+		if key = strings.TrimSpace(key); key != "" && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return []string{""}
+	}
+	return keys
+}
+
+// chunkSink is where exportChunks writes each chunk: one stream, or
+// export --split-by's files by the chunk's keys.
+type chunkSink interface {
+	write(r exportRecord, v interface{}) error
+}
+
+type encoderSink struct{ enc *json.Encoder }
+
+func (s encoderSink) write(r exportRecord, v interface{}) error {
+	return s.enc.Encode(v)
+}
+
+// splitFile is one of the files of a split export.
+type splitFile struct {
+	key, path string
+	records   int
+	// when it was last written to, by splitWriter's clock
+	used    int
+	created bool
+	f       *os.File
+	bw      *bufio.Writer
+	enc     *json.Encoder
+}
+
+// splitWriter writes a split export's files, at most maxOpen of them open
+// at once.
+type splitWriter struct {
+	dir, unknown string
+	maxOpen      int
+	// written first in each file, nil for none
+	prov *provenance
+
+	files map[string]*splitFile
+	// the names given out, lower-cased
+	names      map[string]bool
+	open, tick int
+	// chunks read, each once, and how many times a file closed to make
+	// room was opened again
+	read, reopened int
+}
+
+func newSplitWriter(dir, unknown string, maxOpen int, prov *provenance) *splitWriter {
+	return &splitWriter{dir: dir, unknown: unknown, maxOpen: maxOpen, prov: prov,
+		files: map[string]*splitFile{}, names: map[string]bool{}}
+}
+
+func (s *splitWriter) write(r exportRecord, v interface{}) error {
+	for _, key := range r.keys {
+		sf, err := s.file(key)
+		if err != nil {
+			return err
+		}
+		if err = sf.enc.Encode(v); err != nil {
+			return fmt.Errorf("%s: %w", sf.path, err)
+		}
+		sf.records++
+	}
+	return nil
+}
+
+// file is the open file of key, opened, or made, as need be.
+func (s *splitWriter) file(key string) (*splitFile, error) {
+	s.tick++
+	sf := s.files[key]
+	if sf == nil {
+		sf = &splitFile{key: key, path: filepath.Join(s.dir, s.claim(key))}
+		s.files[key] = sf
+	}
+	sf.used = s.tick
+	if sf.f != nil {
+		return sf, nil
+	}
+	if s.open >= s.maxOpen {
+		if err := s.closeOldest(); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if sf.created {
+		sf.f, err = os.OpenFile(sf.path, os.O_WRONLY|os.O_APPEND, 0)
+		s.reopened++
+	} else {
+		sf.f, err = os.Create(sf.path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.open++
+	sf.bw = bufio.NewWriter(sf.f)
+	sf.enc = json.NewEncoder(sf.bw)
+	if !sf.created {
+		sf.created = true
+		if s.prov != nil {
+			if err = writeProvenance(sf.bw, *s.prov); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return sf, nil
+}
+
+// claim is the name of key's file: the key made safe, or the --unknown
+// name for none, with -2 and so on when another key has it.
+func (s *splitWriter) claim(key string) string {
+	stem := s.unknown
+	if key != "" {
+		stem = sanitizeName(key)
+	}
+	name := stem + ".jsonl"
+	for n := 2; s.names[strings.ToLower(name)] || strings.EqualFold(name, manifestName); n++ {
+		name = fmt.Sprintf("%s-%d.jsonl", stem, n)
+	}
+	s.names[strings.ToLower(name)] = true
+	return name
+}
+
+func (s *splitWriter) closeOldest() error {
+	var oldest *splitFile
+	for _, sf := range s.files {
+		if sf.f != nil && (oldest == nil || sf.used < oldest.used) {
+			oldest = sf
+		}
+	}
+	return s.closeFile(oldest)
+}
+
+func (s *splitWriter) closeFile(sf *splitFile) error {
+	err := sf.bw.Flush()
+	if cerr := sf.f.Close(); err == nil {
+		err = cerr
+	}
+	sf.f, sf.bw, sf.enc = nil, nil, nil
+	s.open--
+	if err != nil {
+		return fmt.Errorf("%s: %w", sf.path, err)
+	}
+	return nil
+}
+
+// close closes every file still open.
+func (s *splitWriter) close() error {
+	var first error
+	for _, sf := range s.files {
+		if sf.f != nil {
+			if err := s.closeFile(sf); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// splitManifest is the manifest.json of a split export.
+type splitManifest struct {
+	SplitBy string `json:"split_by"`
+	// chunks read, each once, and records written in all, more with
+	// chunks split over --max-tokens or of books with several subjects
+	Chunks     int              `json:"chunks"`
+	Records    int              `json:"records"`
+	Provenance *provenance      `json:"provenance,omitempty"`
+	Files      []splitFileEntry `json:"files"`
+}
+
+type splitFileEntry struct {
+	// null for the chunks with none
+	Key     *string `json:"key"`
+	File    string  `json:"file"`
+	Records int     `json:"records"`
+}
+
+// manifest is what s wrote, its files in order of name.
+func (s *splitWriter) manifest(by string) splitManifest {
+	m := splitManifest{SplitBy: by, Chunks: s.read, Provenance: s.prov, Files: []splitFileEntry{}}
+	for _, sf := range s.files {
+		e := splitFileEntry{File: filepath.Base(sf.path), Records: sf.records}
+		if sf.key != "" {
+			key := sf.key
+			e.Key = &key
+		}
+		m.Files = append(m.Files, e)
+		m.Records += sf.records
+	}
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].File < m.Files[j].File })
+	return m
+}
+
+// chunkKeys are the keys of a chunk whose key column is v, "" alone
+// without --split-by, k being nil.
+func (k *splitKey) chunkKeys(v string) []string {
+	if k == nil {
+		return []string{""}
+	}
+	return k.keys(v)
+}
+
+// keptKeys are those of keys whose sample under the caps kept chunk id.
+func keptKeys(keep map[string]map[int]bool, keys []string, id int) []string {
+	kept := keys[:0:0]
+	for _, key := range keys {
+		if keep[key][id] {
+			kept = append(kept, key)
+		}
+	}
+	return kept
+}
+
+// finishSplit closes s's files and writes its manifest to dir.
+func finishSplit(s *splitWriter, by, dir string) error {
+	if err := s.close(); err != nil {
+		return err
+	}
+	m := s.manifest(by)
+	if err := writeJSONFile(filepath.Join(dir, manifestName), m); err != nil {
+		return err
+	}
+	fmt.Printf("read %d chunks once, writing %d records to %d files under %s\n", m.Chunks, m.Records, len(m.Files), dir)
+	if s.reopened > 0 {
+		fmt.Printf("opened files again %d times to append, keeping --max-open %d open\n", s.reopened, s.maxOpen)
+	}
+	return nil
+}
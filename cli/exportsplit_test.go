@@ -0,0 +1,237 @@
+package cli
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// splitLibrary is four books, their chunks stored in turn so that the
+// files of a split export are written to in turn: Emma, in English, of
+// two subjects, Candide in French, of one, Werther in English spelt EN,
+// and Beowulf with no language, neither with a subject.
+func splitLibrary(t *testing.T) *sql.DB {
+	t.Helper()
+	db := testDB(t)
+	books := []struct {
+		title, author string
+		language      interface{}
+		subjects      string
+		chunks        int
+	}{
+		{"Emma", "Jane Austen", "en", `["Courtship -- Fiction", "War / Peace"]`, 3},
+		{"Candide", "Voltaire", "fr", `["War / Peace", " War / Peace ", ""]`, 2},
+		{"Werther", "J. W. von Goethe", "EN", "", 1},
+		{"Beowulf", "", nil, "", 2},
+	}
+	ids := make([]int, len(books))
+	for i, b := range books {
+		ids[i] = addBook(t, db, b.title, b.author, "")
+		if _, err := db.Exec("UPDATE files SET language = ? WHERE id = ?", b.language, ids[i]); err != nil {
+			t.Fatal(err)
+		}
+		if b.subjects != "" {
+			if _, err := db.Exec("INSERT INTO book_meta (file_id, subjects) VALUES (?, ?)", ids[i], b.subjects); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for ordinal := 0; ordinal < 3; ordinal++ {
+		for i, b := range books {
+			if ordinal < b.chunks {
+				insertChunk(t, db, ids[i], ordinal, fmt.Sprintf("Chunk %d of %s, which went on a while.", ordinal, b.title))
+			}
+		}
+	}
+	return db
+}
+
+// splitFiles is each file of a split export in dir but its manifest, with
+// the books of its records in order, after the provenance line it must
+// start with.
+func splitFiles(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, name := range names {
+		bs, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSuffix(string(bs), "\n"), "\n")
+		if _, ok := readProvenanceLine([]byte(lines[0])); !ok {
+			t.Fatalf("%s starts with %s", filepath.Base(name), lines[0])
+		}
+		var got []string
+		for _, line := range lines[1:] {
+			var r exportRecord
+			if err := json.Unmarshal([]byte(line), &r); err != nil {
+				t.Fatalf("%s holds %s", filepath.Base(name), line)
+			}
+			got = append(got, fmt.Sprint(r.SourceID, ":", *r.Ordinal))
+		}
+		files[filepath.Base(name)] = strings.Join(got, " ")
+	}
+	return files
+}
+
+// splitManifestOf is the manifest.json of the split export in dir, and
+// each file's key and records as key=file:records, "-" for no key.
+func splitManifestOf(t *testing.T, dir string) (splitManifest, string) {
+	t.Helper()
+	bs, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m splitManifest
+	if err = json.Unmarshal(bs, &m); err != nil {
+		t.Fatalf("the manifest is %s", bs)
+	}
+	var files []string
+	for _, f := range m.Files {
+		key := "-"
+		if f.Key != nil {
+			key = *f.Key
+		}
+		files = append(files, fmt.Sprintf("%s=%s:%d", key, f.File, f.Records))
+	}
+	return m, strings.Join(files, " ")
+}
+
+func TestExportSplitBy(t *testing.T) {
+	splitLibrary(t)
+	base := t.TempDir()
+	split := func(name string, args ...string) (string, string) {
+		t.Helper()
+		dir := filepath.Join(base, name)
+		out, err := captureStdout(t, func() error { return exportCmd(append(args, "--out-dir", dir)) })
+		if err != nil {
+			t.Fatalf("export %s: %v", strings.Join(args, " "), err)
+		}
+		return dir, out
+	}
+
+	// one file open at a time, each opened again to append to in turn
+	dir, out := split("language", "--split-by", "language", "--max-open", "1")
+	if want := "read 8 chunks once, writing 8 records to 4 files under " + dir + "\nopened files again 4 times to append, keeping --max-open 1 open\n"; out != want {
+		t.Errorf("export --split-by language printed\n%s\nwant\n%s", out, want)
+	}
+	want := map[string]string{"en.jsonl": "1:0 1:1 1:2", "fr.jsonl": "2:0 2:1", "EN-2.jsonl": "3:0", "unknown.jsonl": "4:0 4:1"}
+	if got := splitFiles(t, dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("export --split-by language wrote %v, want %v", got, want)
+	}
+	m, files := splitManifestOf(t, dir)
+	if m.SplitBy != "language" || m.Chunks != 8 || m.Records != 8 || files != "EN=EN-2.jsonl:1 en=en.jsonl:3 fr=fr.jsonl:2 -=unknown.jsonl:2" {
+		t.Errorf("the manifest is %+v, of files %s", m, files)
+	}
+	if m.Provenance == nil || m.Provenance.Command != "export" || m.Provenance.Source.Chunks != 8 || m.Provenance.Flags["split-by"] != "language" {
+		t.Errorf("the manifest's provenance is %+v", m.Provenance)
+	}
+	if got := provenanceOf(t, filepath.Join(dir, "fr.jsonl")); !reflect.DeepEqual(got, *m.Provenance) {
+		t.Errorf("fr.jsonl's provenance is %+v, want the manifest's %+v", got, *m.Provenance)
+	}
+
+	// a chunk of a book of two subjects in each's file, and the subjects'
+	// names made safe
+	dir, out = split("subject", "--split-by", "subject", "--unknown", "none")
+	if !strings.HasPrefix(out, "read 8 chunks once, writing 11 records to 3 files under ") || strings.Contains(out, "opened files again") {
+		t.Errorf("export --split-by subject printed\n%s", out)
+	}
+	want = map[string]string{"Courtship -- Fiction.jsonl": "1:0 1:1 1:2", "War _ Peace.jsonl": "1:0 2:0 1:1 2:1 1:2", "none.jsonl": "3:0 4:0 4:1"}
+	if got := splitFiles(t, dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("export --split-by subject wrote %v, want %v", got, want)
+	}
+	if m, files = splitManifestOf(t, dir); m.Chunks != 8 || m.Records != 11 ||
+		files != "Courtship -- Fiction=Courtship -- Fiction.jsonl:3 War / Peace=War _ Peace.jsonl:5 -=none.jsonl:3" {
+		t.Errorf("the manifest is %+v, of files %s", m, files)
+	}
+
+	// the caps apply to each file by itself, and the fields to each
+	if _, err := captureStderr(t, func() error {
+		dir, _ = split("capped", "--split-by", "author", "--max-per-book", "1", "--seed", "5", "--fields", "sourceid,text", "--no-provenance")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for name, book := range map[string]int{"j w von goethe.jsonl": 3, "jane austen.jsonl": 1, "unknown.jsonl": 4, "voltaire.jsonl": 2} {
+		bs, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r map[string]interface{}
+		if err = json.Unmarshal(bs, &r); err != nil || len(r) != 2 || r["sourceid"] != float64(book) || r["text"] == nil {
+			t.Errorf("export --split-by author --max-per-book 1 wrote %s %s", name, bs)
+		}
+	}
+	if m, files = splitManifestOf(t, dir); m.Chunks != 8 || m.Records != 4 || m.Provenance != nil ||
+		files != "j w von goethe=j w von goethe.jsonl:1 jane austen=jane austen.jsonl:1 -=unknown.jsonl:1 voltaire=voltaire.jsonl:1" {
+		t.Errorf("the manifest is %+v, of files %s", m, files)
+	}
+
+	for _, args := range [][]string{
+		{"--split-by", "century", "--out-dir", base},
+		{"--split-by", "language"},
+		{"--split-by", "language", "--out-dir", base, "--out", filepath.Join(base, "all.jsonl")},
+		{"--out-dir", base},
+		{"--split-by", "language", "--out-dir", base, "--group-by-book"},
+		{"--split-by", "language", "--out-dir", base, "--max-open", "0"},
+		{"--split-by", "language", "--out-dir", base, "--unknown", "a/b"},
+	} {
+		if _, err := captureStdout(t, func() error { return exportCmd(args) }); exitCode(err) != exitUsage {
+			t.Errorf("export %s: %v, want a usage error", strings.Join(args, " "), err)
+		}
+	}
+}
+
+// countedQueries counts the queries made of q.
+type countedQueries struct {
+	q rowsQueryer
+	n int
+}
+
+func (c *countedQueries) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	c.n++
+	return c.q.Query(query, args...)
+}
+
+func TestExportSplitOnePass(t *testing.T) {
+	db := splitLibrary(t)
+	// more chunks than a batch, in a file for each
+	for i := 0; i < exportBatch; i++ {
+		id := addBook(t, db, fmt.Sprint("Tract ", i), "", "")
+		if _, err := db.Exec("UPDATE files SET language = ? WHERE id = ?", fmt.Sprint("x", i), id); err != nil {
+			t.Fatal(err)
+		}
+		insertChunk(t, db, id, 0, "A tract.")
+	}
+
+	dir := t.TempDir()
+	k := splitKeys["language"]
+	s := newSplitWriter(dir, defaultSplitUnknown, 2, nil)
+	q := &countedQueries{q: db}
+	if err := exportChunks(q, io.Discard, exportOptions{splitBy: &k, split: s}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+	// a batch, the rest and none left, however many files
+	if total := exportBatch + 8; q.n != 3 || s.read != total {
+		t.Errorf("a split export made %d queries reading %d chunks, want 3 reading %d", q.n, s.read, total)
+	}
+	if m := s.manifest("language"); len(m.Files) != exportBatch+4 || m.Records != s.read {
+		t.Errorf("a split export wrote %d records to %d files", m.Records, len(m.Files))
+	}
+	if s.open != 0 || s.reopened == 0 {
+		t.Errorf("a split export left %d files open, having opened them again %d times", s.open, s.reopened)
+	}
+}
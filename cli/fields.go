@@ -0,0 +1,249 @@
+package cli
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// export --fields, and ?fields= on the api's chunk responses, choose which
+// fields each chunk is written with and in what order, from knownFields;
+// --add-field key=value (?add_field=) adds the same value to every chunk,
+// a source or license line say. Without either each keeps its own shape.
+
+// knownFields are the fields a chunk can be written with. ebook, language
+// and gutenberg_url are of its book, null when ingest found none, and
+// stable_id null for a chunk without one.
+var knownFields = []string{"id", "stable_id", "sourceid", "ordinal", "part", "scene", "title", "author", "text", "tokens", "ebook", "language", "gutenberg_url"}
+
+const gutenbergURL = "https://www.gutenberg.org/ebooks/%d"
+
+// chunkFacts is what a chunk's fields are made from.
+type chunkFacts struct {
+	ID, SourceID   int
+	StableID       string
+	Ordinal, Scene *int
+	// the part of a chunk export split, 0 when it wasn't
+	Part                int
+	Title, Author, Text string
+	// 0 when not counted
+	Tokens   int
+	Ebook    int
+	Language string
+}
+
+func (c chunkFacts) field(name string) interface{} {
+	switch name {
+	case "id":
+		return c.ID
+	case "stable_id":
+		if c.StableID == "" {
+			return nil
+		}
+		return c.StableID
+	case "sourceid":
+		return c.SourceID
+	case "ordinal":
+		return c.Ordinal
+	case "part":
+		return nonZero(c.Part)
+	case "scene":
+		return c.Scene
+	case "title":
+		return c.Title
+	case "author":
+		return c.Author
+	case "text":
+		return c.Text
+	case "tokens":
+		return nonZero(c.Tokens)
+	case "ebook":
+		return nonZero(c.Ebook)
+	case "language":
+		if c.Language == "" {
+			return nil
+		}
+		return c.Language
+	case "gutenberg_url":
+		if c.Ebook == 0 {
+			return nil
+		}
+		return fmt.Sprintf(gutenbergURL, c.Ebook)
+	}
+	return nil
+}
+
+func nonZero(n int) interface{} {
+	if n == 0 {
+		return nil
+	}
+	return n
+}
+
+type staticField struct {
+	key, value string
+}
+
+// fieldSet is the fields chunks are written with: names, nil for the
+// shape of the response or command, then the static ones.
+type fieldSet struct {
+	names  []string
+	static []staticField
+}
+
+// custom reports whether f changes anything.
+func (f fieldSet) custom() bool {
+	return f.names != nil || len(f.static) > 0
+}
+
+// record gives c's fields, the fields of base, already encoded in its own
+// shape, in place of names when there are none.
+func (f fieldSet) record(c chunkFacts, base interface{}) (fieldRecord, error) {
+	var r fieldRecord
+	if f.names == nil {
+		bs, err := json.Marshal(base)
+		if err != nil {
+			return r, err
+		}
+		r.base = bs
+	}
+	for _, name := range f.names {
+		r.keys = append(r.keys, name)
+		r.values = append(r.values, c.field(name))
+	}
+	for _, sf := range f.static {
+		r.keys = append(r.keys, sf.key)
+		r.values = append(r.values, sf.value)
+	}
+	return r, nil
+}
+
+// fieldRecord is a json object of the fields of base, if any, then keys in
+// order.
+type fieldRecord struct {
+	base   json.RawMessage
+	keys   []string
+	values []interface{}
+}
+
+func (r fieldRecord) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	if r.base != nil {
+		inner := bytes.TrimSpace(r.base)
+		inner = bytes.TrimSpace(inner[1 : len(inner)-1])
+		b.Write(inner)
+		if len(inner) > 0 && len(r.keys) > 0 {
+			b.WriteByte(',')
+		}
+	}
+	for i, key := range r.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(r.values[i])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// parseFields reads a list of fields like "id,text,gutenberg_url" and
+// key=value static fields. A name not in knownFields, or a static field
+// taking one's name, is an error listing them.
+func parseFields(spec string, static []string) (fieldSet, error) {
+	var fs fieldSet
+	known := map[string]bool{}
+	for _, name := range knownFields {
+		known[name] = true
+	}
+	if strings.TrimSpace(spec) != "" {
+		seen := map[string]bool{}
+		fs.names = []string{}
+		for _, name := range strings.Split(spec, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" || seen[name] {
+				continue
+			}
+			if !known[name] {
+				return fs, usagef("unknown field %q; the fields are %s", name, strings.Join(knownFields, ", "))
+			}
+			seen[name] = true
+			fs.names = append(fs.names, name)
+		}
+	}
+	keys := map[string]bool{}
+	for _, kv := range static {
+		key, value, ok := strings.Cut(kv, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return fs, usagef("bad field %q; want key=value", kv)
+		}
+		if known[key] {
+			return fs, usagef("can't add field %s, it is one of the fields %s", key, strings.Join(knownFields, ", "))
+		}
+		if keys[key] {
+			return fs, usagef("field %s is added twice", key)
+		}
+		keys[key] = true
+		fs.static = append(fs.static, staticField{key, value})
+	}
+	return fs, nil
+}
+
+// fieldsFlags adds --fields and --add-field to fs and returns what reads
+// them.
+func fieldsFlags(fs *flag.FlagSet) func() (fieldSet, error) {
+	spec := fs.String("fields", "", "write each chunk with only these fields, in this order, comma separated: "+strings.Join(knownFields, ", "))
+	var static patternList
+	fs.Var(&static, "add-field", "key=value to add to every chunk written (repeatable)")
+	return func() (fieldSet, error) {
+		return parseFields(*spec, static)
+	}
+}
+
+// parseFields reads ?fields= and ?add_field= as parseFields does.
+func (s *server) parseFields(q url.Values) (fieldSet, error) {
+	return parseFields(q.Get("fields"), q["add_field"])
+}
+
+// loadChunkFacts reads the facts of the chunks with ids, by id, their text
+// as stored.
+func loadChunkFacts(db *sql.DB, ids []int) (map[int]chunkFacts, error) {
+	list, err := json.Marshal(ids)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT c.id, c.sourceid, c.ordinal, c.scene, coalesce(c.token_count, 0), c.chunk,
+			coalesce(f.name, ''), coalesce(f.author, ''), coalesce(f.ebook, 0), coalesce(f.language, ''),
+			coalesce(c.stable_id, '')
+		FROM chunks c JOIN files f ON f.id = c.sourceid WHERE c.id IN (SELECT value FROM json_each(?))`, string(list))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	facts := map[int]chunkFacts{}
+	for rows.Next() {
+		var c chunkFacts
+		var ordinal, scene sql.NullInt64
+		if err = rows.Scan(&c.ID, &c.SourceID, &ordinal, &scene, &c.Tokens, &c.Text, &c.Title, &c.Author, &c.Ebook, &c.Language, &c.StableID); err != nil {
+			return nil, err
+		}
+		c.Ordinal, c.Scene = nullableInt(ordinal), nullableInt(scene)
+		facts[c.ID] = c
+	}
+	return facts, rows.Err()
+}
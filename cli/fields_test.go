@@ -0,0 +1,165 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// jsonKeys is the keys of the json object raw, in order.
+func jsonKeys(t *testing.T, raw []byte) []string {
+	t.Helper()
+	d := json.NewDecoder(bytes.NewReader(raw))
+	if tok, err := d.Token(); err != nil || tok != json.Delim('{') {
+		t.Fatalf("%s is no object", raw)
+	}
+	var keys []string
+	for d.More() {
+		tok, err := d.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, tok.(string))
+		var v json.RawMessage
+		if err = d.Decode(&v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return keys
+}
+
+func TestParseFields(t *testing.T) {
+	f, err := parseFields(" id, text,id,,gutenberg_url", []string{"source=gutenberg", "license=public domain = free"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(f.names, ",") != "id,text,gutenberg_url" || fmt.Sprint(f.static) != "[{source gutenberg} {license public domain = free}]" {
+		t.Errorf("parsed %v and %v", f.names, f.static)
+	}
+	if f, err = parseFields("", nil); err != nil || f.custom() {
+		t.Errorf("no fields parsed as %+v, %v", f, err)
+	}
+
+	for _, c := range []struct {
+		spec   string
+		static []string
+		want   string
+	}{
+		{"id,url", nil, `unknown field "url"; the fields are id, stable_id, sourceid, ordinal, part, scene, title, author, text, tokens, ebook, language, gutenberg_url`},
+		{"", []string{"source"}, `bad field "source"; want key=value`},
+		{"", []string{"=gutenberg"}, `bad field "=gutenberg"`},
+		{"", []string{"title=Emma"}, "can't add field title, it is one of the fields id, stable_id"},
+		{"", []string{"source=a", "source=b"}, "field source is added twice"},
+	} {
+		_, err := parseFields(c.spec, c.static)
+		if exitCode(err) != exitUsage || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("fields %q and %q: %v, want a usage error saying %q", c.spec, c.static, err, c.want)
+		}
+	}
+}
+
+func TestFieldRecord(t *testing.T) {
+	ordinal := 3
+	c := chunkFacts{ID: 7, SourceID: 2, Ordinal: &ordinal, Title: "Emma", Text: "It was so.", Ebook: 158}
+	for _, cc := range []struct {
+		spec   string
+		static []string
+		want   string
+	}{
+		{"id,text,gutenberg_url", []string{"source=gutenberg"}, `{"id":7,"text":"It was so.","gutenberg_url":"https://www.gutenberg.org/ebooks/158","source":"gutenberg"}`},
+		{"ordinal,scene,stable_id,tokens,language", nil, `{"ordinal":3,"scene":null,"stable_id":null,"tokens":null,"language":null}`},
+		// the base's own shape, with the static fields after it
+		{"", []string{"source=gutenberg", "license=PD"}, `{"id":7,"chunk":"It was so.","source":"gutenberg","license":"PD"}`},
+	} {
+		f, err := parseFields(cc.spec, cc.static)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := f.record(c, struct {
+			ID    int    `json:"id"`
+			Chunk string `json:"chunk"`
+		}{7, c.Text})
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs, err := json.Marshal(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(bs) != cc.want {
+			t.Errorf("fields %q and %q gave %s, want %s", cc.spec, cc.static, bs, cc.want)
+		}
+	}
+	c.Ebook = 0
+	f, _ := parseFields("ebook,gutenberg_url", nil)
+	r, _ := f.record(c, nil)
+	if bs, _ := json.Marshal(r); string(bs) != `{"ebook":null,"gutenberg_url":null}` {
+		t.Errorf("a book with no ebook number gave %s", bs)
+	}
+}
+
+func TestExportFields(t *testing.T) {
+	db := testDB(t)
+	id := addBook(t, db, "Emma", "Jane Austen", "")
+	if _, err := db.Exec("UPDATE files SET ebook = 158, language = 'en' WHERE id = ?", id); err != nil {
+		t.Fatal(err)
+	}
+	insertChunk(t, db, id, 0, testParagraphs(1))
+	insertChunk(t, db, id, 1, testParagraphs(1))
+
+	out, err := captureStdout(t, func() error {
+		return exportCmd([]string{"--fields", "id,title,gutenberg_url,language", "--add-field", "source=gutenberg", "--add-field", "license=Public domain in the USA"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// after the provenance line
+	lines := strings.Split(strings.TrimSpace(out), "\n")[1:]
+	if len(lines) != 2 {
+		t.Fatalf("exported %q", out)
+	}
+	for _, line := range lines {
+		if keys := strings.Join(jsonKeys(t, []byte(line)), ","); keys != "id,title,gutenberg_url,language,source,license" {
+			t.Errorf("exported a chunk with fields %s", keys)
+		}
+		var rec map[string]interface{}
+		if err = json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec["gutenberg_url"] != "https://www.gutenberg.org/ebooks/158" || rec["license"] != "Public domain in the USA" || rec["title"] != "Emma" {
+			t.Errorf("exported %s", line)
+		}
+	}
+	if _, err = captureStdout(t, func() error { return exportCmd([]string{"--fields", "id,body"}) }); exitCode(err) != exitUsage ||
+		!strings.Contains(err.Error(), "the fields are id, stable_id") {
+		t.Errorf("export --fields id,body: %v", err)
+	}
+
+	s := testServer(t, db)
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.routes().ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w
+	}
+	w := get("/chunks/random?fields=text,ebook&add_field=source%3Dgutenberg")
+	if keys := strings.Join(jsonKeys(t, w.Body.Bytes()), ","); w.Code != http.StatusOK || keys != "text,ebook,source" {
+		t.Errorf("GET /chunks/random?fields=text,ebook: %d with fields %s", w.Code, keys)
+	}
+	w = get(fmt.Sprintf("/books/%d/chunks?fields=id,ordinal", id))
+	var page struct{ Chunks []json.RawMessage }
+	if err = json.Unmarshal(w.Body.Bytes(), &page); err != nil || len(page.Chunks) != 2 {
+		t.Fatalf("GET /books/%d/chunks?fields=id,ordinal: %d %s", id, w.Code, w.Body)
+	}
+	for _, c := range page.Chunks {
+		if keys := strings.Join(jsonKeys(t, c), ","); keys != "id,ordinal" {
+			t.Errorf("the book's chunk %s has fields %s", c, keys)
+		}
+	}
+	if w = get("/chunks/random?fields=body"); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "the fields are id, stable_id") {
+		t.Errorf("GET /chunks/random?fields=body: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,520 @@
+package cli
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// A filter expression says in one string what the filter flags and
+// parameters do over many:
+//
+//	author:"Austen" lang:en words:80..160 -kind:dialogue @bot-default
+//
+// random, export, grep, stats and dump-sample take one as --filter, and
+// /chunks/random and /search as ?filter=. A term is key:value, the value
+// in double quotes if it has spaces, with \" and \\ inside them for a
+// quote and a backslash, and - before the key to negate it where the key
+// allows. A range is from..to, either end left off for none. The keys:
+//
+//	author:GLOB      books by this author, as an authors file's patterns
+//	                 match (see authorlist.go); given again, by any of
+//	                 them; -author leaves them out
+//	lang:en          books in this language, by code or name; -lang
+//	                 leaves them out (language: too)
+//	words:80..160    chunks of so many words; words:100 just that many
+//	length:200..     chunks of at least so many bytes
+//	kind:dialogue    chunks of this kind (see kinds.go); -kind leaves
+//	                 them out
+//	era:1800..1899   books dated to these years, or era:1850 to one
+//	position:0..0.1  chunks this far through their books (pos: too)
+//	fits:280         chunks that fit in so many characters, attributed
+//	source:LABEL     books ingested with this --source-label
+//	series:NAME      books of this series
+//	is:complete      books check-complete found complete
+//	is:unique        the one book of each group dupes --mark found
+//	is:undetermined  with lang, books with no language or und too
+//	-is:flagged      leaving out chunks flag-content flagged
+//
+// @name takes the filters of the preset of that name (see presets.go), for
+// those the terms don't set themselves. A key given twice is an error, but
+// author's. An expression is read into the query parameters of
+// filterParams, so it composes with a command's flags and the api's
+// parameters as a preset does: those given win over the expression's.
+
+// filterKey is what a key of a filter expression stands for: the
+// parameter its value is given as, and negated, "" where it can't be, or
+// else the parameters its value is read into, as a range's ends.
+type filterKey struct {
+	param, negated string
+	// several of the key are kept, rather than an error
+	many bool
+	// what checks the value, giving it as the parameter takes it
+	check  func(v string) (string, error)
+	params func(v string) (url.Values, error)
+}
+
+var filterKeys = map[string]filterKey{
+	"author":   {param: "author", negated: "not_author", many: true},
+	"lang":     {param: "language", negated: "not_language"},
+	"words":    {params: wordsValue},
+	"length":   {params: lengthValue},
+	"kind":     {param: "kind", negated: "not_kind", check: kindValue},
+	"era":      {params: eraValue},
+	"position": {params: positionValue},
+	"fits":     {param: "fits", check: countValue},
+	"source":   {param: "source"},
+	"series":   {param: "series"},
+	// see filterIs
+	"is": {},
+}
+
+// filterAliases are other names of keys.
+var filterAliases = map[string]string{"language": "lang", "pos": "position"}
+
+// filterIs are the values of is:, by the parameter each sets true, and
+// whether it is negated.
+var filterIs = map[string]struct {
+	param   string
+	negated bool
+}{
+	"complete":     {"complete_only", false},
+	"unique":       {"unique_works", false},
+	"undetermined": {"include_undetermined", false},
+	"flagged":      {"exclude_flagged", true},
+}
+
+// filterTerm is one term of a filter expression.
+type filterTerm struct {
+	// where it starts in the expression, in bytes
+	pos    int
+	negate bool
+	// the key as given, "" for @preset
+	key, value string
+	// where the value starts
+	valuePos int
+	preset   string
+}
+
+// filterError is what is wrong with a filter expression, and where.
+type filterError struct {
+	expr string
+	pos  int
+	msg  string
+}
+
+func (e filterError) Error() string {
+	at := e.expr[e.pos:]
+	if i := strings.IndexAny(at, " \t"); i > 0 {
+		at = at[:i]
+	}
+	if at == "" {
+		return fmt.Sprintf("bad filter, at its end: %s", e.msg)
+	}
+	return fmt.Sprintf("bad filter at column %d, %q: %s", utf8.RuneCountInString(e.expr[:e.pos])+1, clip(at, 40), e.msg)
+}
+
+func isFilterSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r'
+}
+
+// parseFilterExpr splits expr into its terms, unquoting their values.
+func parseFilterExpr(expr string) ([]filterTerm, error) {
+	fail := func(pos int, format string, args ...interface{}) error {
+		return filterError{expr, pos, fmt.Sprintf(format, args...)}
+	}
+	var terms []filterTerm
+	for i := 0; i < len(expr); {
+		if isFilterSpace(expr[i]) {
+			i++
+			continue
+		}
+		t := filterTerm{pos: i}
+		if expr[i] == '-' {
+			t.negate = true
+			i++
+		}
+		if i < len(expr) && expr[i] == '@' {
+			start := i
+			for i++; i < len(expr) && !isFilterSpace(expr[i]); i++ {
+			}
+			t.preset = expr[start+1 : i]
+			if t.preset == "" {
+				return nil, fail(start, "@ needs the name of a preset, as @bot-default")
+			}
+			if t.negate {
+				return nil, fail(t.pos, "a preset can't be negated")
+			}
+			terms = append(terms, t)
+			continue
+		}
+		start := i
+		for i < len(expr) && expr[i] != ':' && !isFilterSpace(expr[i]) && expr[i] != '"' {
+			i++
+		}
+		t.key = expr[start:i]
+		if i < len(expr) && expr[i] == '"' {
+			return nil, fail(i, "a quote inside a key; keys go unquoted, as author:\"...\"")
+		}
+		if i == len(expr) || expr[i] != ':' {
+			if t.key == "" {
+				return nil, fail(start, "want a key before the value, as lang:en")
+			}
+			return nil, fail(start, "%q has no value; want key:value, as lang:en", t.key)
+		}
+		if t.key == "" {
+			return nil, fail(start, "want a key before the :, as lang:en")
+		}
+		i++
+		t.valuePos = i
+		if i < len(expr) && expr[i] == '"' {
+			var b strings.Builder
+			closed := false
+			for i++; i < len(expr); i++ {
+				c := expr[i]
+				if c == '\\' && i+1 < len(expr) && (expr[i+1] == '"' || expr[i+1] == '\\') {
+					i++
+					b.WriteByte(expr[i])
+					continue
+				}
+				if c == '"' {
+					closed = true
+					i++
+					break
+				}
+				b.WriteByte(c)
+			}
+			if !closed {
+				return nil, fail(t.valuePos, "the quote is never closed")
+			}
+			if i < len(expr) && !isFilterSpace(expr[i]) {
+				return nil, fail(i, "want a space after the quoted value")
+			}
+			t.value = b.String()
+		} else {
+			v := i
+			for i < len(expr) && !isFilterSpace(expr[i]) {
+				if expr[i] == '"' {
+					return nil, fail(i, "a quote inside a value; quote the value whole, as %s:\"...\"", t.key)
+				}
+				i++
+			}
+			t.value = expr[v:i]
+		}
+		if strings.TrimSpace(t.value) == "" {
+			return nil, fail(t.valuePos, "%s needs a value", t.key)
+		}
+		terms = append(terms, t)
+	}
+	return terms, nil
+}
+
+// filterExprValues reads expr into the parameters its terms set, and the
+// presets it names, in order.
+func filterExprValues(expr string) (url.Values, []string, error) {
+	terms, err := parseFilterExpr(expr)
+	if err != nil {
+		return nil, nil, err
+	}
+	q := url.Values{}
+	var presets []string
+	// the range keys given, which may set one end each
+	ranges := map[string]bool{}
+	set := func(t filterTerm, param, v string, many bool) error {
+		if _, ok := q[param]; ok && !many {
+			return filterError{expr, t.pos, fmt.Sprintf("%s is given twice", termName(t))}
+		}
+		q.Add(param, v)
+		return nil
+	}
+	for _, t := range terms {
+		if t.preset != "" {
+			presets = append(presets, t.preset)
+			continue
+		}
+		name := strings.ToLower(t.key)
+		if alias, ok := filterAliases[name]; ok {
+			name = alias
+		}
+		k, ok := filterKeys[name]
+		if !ok {
+			return nil, nil, filterError{expr, t.pos + boolInt(t.negate), unknownFilterKey(t.key)}
+		}
+		valueErr := func(err error) error {
+			return filterError{expr, t.valuePos, err.Error()}
+		}
+		if name == "is" {
+			is, ok := filterIs[strings.ToLower(t.value)]
+			switch {
+			case !ok:
+				return nil, nil, valueErr(fmt.Errorf("is:%s isn't known; want %s", t.value, isNames()))
+			case is.negated && !t.negate:
+				return nil, nil, filterError{expr, t.pos, fmt.Sprintf("is:%s only goes negated, -is:%s leaving them out", t.value, t.value)}
+			case !is.negated && t.negate:
+				return nil, nil, filterError{expr, t.pos, fmt.Sprintf("is:%s can't be negated", t.value)}
+			}
+			if err = set(t, is.param, "true", false); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		if t.negate && k.negated == "" {
+			return nil, nil, filterError{expr, t.pos, fmt.Sprintf("%s can't be negated", name)}
+		}
+		if k.params != nil {
+			if ranges[name] {
+				return nil, nil, filterError{expr, t.pos, fmt.Sprintf("%s is given twice", termName(t))}
+			}
+			ranges[name] = true
+			params, err := k.params(t.value)
+			if err != nil {
+				return nil, nil, valueErr(err)
+			}
+			for _, p := range filterParams {
+				if v := params.Get(p); v != "" {
+					if err = set(t, p, v, false); err != nil {
+						return nil, nil, err
+					}
+				}
+			}
+			continue
+		}
+		param, v := k.param, t.value
+		if t.negate {
+			param = k.negated
+		}
+		if k.check != nil {
+			if v, err = k.check(v); err != nil {
+				return nil, nil, valueErr(err)
+			}
+		}
+		if err = set(t, param, v, k.many); err != nil {
+			return nil, nil, err
+		}
+	}
+	return q, presets, nil
+}
+
+func termName(t filterTerm) string {
+	if t.negate {
+		return "-" + t.key
+	}
+	return t.key
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func isNames() string {
+	names := make([]string, 0, len(filterIs))
+	for name := range filterIs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// unknownFilterKey says key isn't one, with the key nearest it, like
+// length for lenght.
+func unknownFilterKey(key string) string {
+	names := make([]string, 0, len(filterKeys)+len(filterAliases))
+	for name := range filterKeys {
+		names = append(names, name)
+	}
+	for name := range filterAliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	best, bestD := "", 3
+	for _, name := range names {
+		if d := editDistance([]rune(strings.ToLower(key)), []rune(name)); d < bestD {
+			best, bestD = name, d
+		}
+	}
+	if best != "" {
+		return fmt.Sprintf("unknown key %q; did you mean %s?", key, best)
+	}
+	return fmt.Sprintf("unknown key %q; want one of %s", key, strings.Join(names, ", "))
+}
+
+// filterRange reads v as from..to, either left off, or one value for both
+// with single.
+func filterRange(v string, single bool) (from, to string, err error) {
+	from, to, ok := strings.Cut(v, "..")
+	switch {
+	case !ok && single:
+		return v, v, nil
+	case !ok:
+		return "", "", fmt.Errorf("want a range, as %s..", v)
+	case from == "" && to == "":
+		return "", "", fmt.Errorf("a range needs at least one end")
+	}
+	return from, to, nil
+}
+
+// parseCount reads a count of something, 0 or more.
+func parseCount(v string) (int, error) {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad number %q", v)
+	}
+	return n, nil
+}
+
+func countValue(v string) (string, error) {
+	n, err := parseCount(v)
+	return strconv.Itoa(n), err
+}
+
+func wordsValue(v string) (url.Values, error) {
+	from, to, err := filterRange(v, true)
+	if err != nil {
+		return nil, err
+	}
+	q := url.Values{}
+	least, most := 0, -1
+	if from != "" {
+		if least, err = parseCount(from); err != nil {
+			return nil, err
+		}
+		q.Set("min_words", from)
+	}
+	if to != "" {
+		if most, err = parseCount(to); err != nil {
+			return nil, err
+		}
+		q.Set("max_words", to)
+	}
+	if most >= 0 && least > most {
+		return nil, fmt.Errorf("%d words is over %d", least, most)
+	}
+	return q, nil
+}
+
+func lengthValue(v string) (url.Values, error) {
+	from, to, err := filterRange(v, true)
+	if err != nil {
+		return nil, err
+	}
+	if to != "" && to != from {
+		if from == "" {
+			from = to
+		}
+		return nil, fmt.Errorf("length goes by the least only, as length:%s..", from)
+	}
+	if _, err = parseCount(from); err != nil {
+		return nil, err
+	}
+	return url.Values{"min_length": {from}}, nil
+}
+
+func kindValue(v string) (string, error) {
+	return parseKind(strings.ToLower(v))
+}
+
+func eraValue(v string) (url.Values, error) {
+	from, to, err := filterRange(v, true)
+	if err != nil {
+		return nil, err
+	}
+	if from == "" || to == "" {
+		return nil, fmt.Errorf("an era needs both its years, as era:1800..1899")
+	}
+	era := from + "-" + to
+	if from == to {
+		era = from
+	}
+	if _, err = parseEra(era); err != nil {
+		return nil, err
+	}
+	return url.Values{"era": {era}}, nil
+}
+
+func positionValue(v string) (url.Values, error) {
+	from, to, err := filterRange(v, false)
+	if err != nil {
+		return nil, err
+	}
+	if from == "" {
+		from = "0"
+	}
+	if to == "" {
+		to = "1"
+	}
+	pos := from + "-" + to
+	if _, err = parsePosition(pos); err != nil {
+		return nil, err
+	}
+	return url.Values{"position": {pos}}, nil
+}
+
+// filterValues reads expr into the parameters of filterParams it stands
+// for, the presets it names filling in, in order, those its terms don't
+// set.
+func filterValues(db *sql.DB, expr string) (url.Values, error) {
+	q, presets, err := filterExprValues(expr)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range presets {
+		p, err := loadPreset(db, name)
+		if err != nil {
+			return nil, err
+		}
+		fillFilters(q, p)
+	}
+	return q, nil
+}
+
+// fillFilters sets in q the filters of from that q doesn't set itself.
+func fillFilters(q, from url.Values) {
+	for _, k := range filterParams {
+		if _, ok := q[k]; !ok && from.Get(k) != "" {
+			q[k] = from[k]
+		}
+	}
+}
+
+// filterFlag adds --filter to fs, for the commands that read the
+// expression themselves, and returns what reads it as a chunkFilter, nil
+// without one. own names, for each of the command's flags for a filter,
+// the parameters it stands for, so that those given win over the
+// expression's.
+func filterFlag(fs *flag.FlagSet, own map[string][]string) func(db *sql.DB) (*chunkFilter, error) {
+	expr := fs.String("filter", "", "only chunks matching this filter expression, like 'author:Austen lang:en words:80..160 -kind:dialogue', @name taking a preset's filters")
+	return func(db *sql.DB) (*chunkFilter, error) {
+		if *expr == "" {
+			return nil, nil
+		}
+		q, err := filterValues(db, *expr)
+		if err != nil {
+			if errors.Is(err, errNoPreset) {
+				return nil, err
+			}
+			return nil, usageError{err.Error()}
+		}
+		fs.Visit(func(f *flag.Flag) {
+			for _, p := range own[f.Name] {
+				q.Del(p)
+			}
+		})
+		f, err := parseFilter(db, q)
+		if err != nil {
+			return nil, usageError{err.Error()}
+		}
+		if u := f.unbridged(false); u != nil {
+			return nil, fmt.Errorf("the %s filter needs %s, which this database lacks; run gutchunk migrate", u[0][0], u[0][1])
+		}
+		return &f, nil
+	}
+}
@@ -0,0 +1,313 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestParseFilterExpr(t *testing.T) {
+	for expr, want := range map[string][]filterTerm{
+		"": nil,
+		`author:"Jane Austen" -kind:dialogue`: {
+			{pos: 0, key: "author", value: "Jane Austen", valuePos: 7},
+			{pos: 21, negate: true, key: "kind", value: "dialogue", valuePos: 27},
+		},
+		"  @bot-default\tlang:en\n": {
+			{pos: 2, preset: "bot-default"},
+			{pos: 15, key: "lang", value: "en", valuePos: 20},
+		},
+		`series:"say \"hi\" \\ \n" source:a:b`: {
+			{pos: 0, key: "series", value: `say "hi" \ \n`, valuePos: 7},
+			{pos: 26, key: "source", value: "a:b", valuePos: 33},
+		},
+	} {
+		got, err := parseFilterExpr(expr)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("parseFilterExpr(%q) = %+v (%v), want %+v", expr, got, err, want)
+		}
+	}
+}
+
+func TestFilterExprErrors(t *testing.T) {
+	for expr, want := range map[string]string{
+		// as the terms are read
+		"lang:":          `bad filter, at its end: lang needs a value`,
+		`lang:"  "`:      `bad filter at column 6, "\"": lang needs a value`,
+		"lang:en @":      `bad filter at column 9, "@": @ needs the name of a preset, as @bot-default`,
+		"-@bot":          `bad filter at column 1, "-@bot": a preset can't be negated`,
+		`au"thor:x`:      `bad filter at column 3, "\"thor:x": a quote inside a key; keys go unquoted, as author:"..."`,
+		"lang en":        `bad filter at column 1, "lang": "lang" has no value; want key:value, as lang:en`,
+		`"Austen"`:       `bad filter at column 1, "\"Austen\"": a quote inside a key; keys go unquoted, as author:"..."`,
+		":en":            `bad filter at column 1, ":en": want a key before the :, as lang:en`,
+		`author:"Jane`:   `bad filter at column 8, "\"Jane": the quote is never closed`,
+		`author:"Jane"x`: `bad filter at column 14, "x": want a space after the quoted value`,
+		`lang:e"n"`:      `bad filter at column 7, "\"n\"": a quote inside a value; quote the value whole, as lang:"..."`,
+		// as what they stand for is
+		"lenght:100":               `bad filter at column 1, "lenght:100": unknown key "lenght"; did you mean length?`,
+		"lang:en -Lenght:100":      `bad filter at column 10, "Lenght:100": unknown key "Lenght"; did you mean length?`,
+		`author:"Brontë" lenght:1`: `bad filter at column 17, "lenght:1": unknown key "lenght"; did you mean length?`,
+		"colour:red":               `bad filter at column 1, "colour:red": unknown key "colour"; want one of author, era, fits, is, kind, lang, language, length, pos, position, series, source, words`,
+		"lang:en lang:fr":          `bad filter at column 9, "lang:fr": lang is given twice`,
+		"language:en lang:fr":      `bad filter at column 13, "lang:fr": lang is given twice`,
+		"words:5.. words:..9":      `bad filter at column 11, "words:..9": words is given twice`,
+		"-is:flagged -is:flagged":  `bad filter at column 13, "-is:flagged": -is is given twice`,
+		"words:10..5":              `bad filter at column 7, "10..5": 10 words is over 5`,
+		"words:..":                 `bad filter at column 7, "..": a range needs at least one end`,
+		"words:many":               `bad filter at column 7, "many": bad number "many"`,
+		"length:..200":             `bad filter at column 8, "..200": length goes by the least only, as length:200..`,
+		"length:100..200":          `bad filter at column 8, "100..200": length goes by the least only, as length:100..`,
+		"era:1800..":               `bad filter at column 5, "1800..": an era needs both its years, as era:1800..1899`,
+		"position:0.5":             `bad filter at column 10, "0.5": want a range, as 0.5..`,
+		"fits:-1":                  `bad filter at column 6, "-1": bad number "-1"`,
+		"-words:5":                 `bad filter at column 1, "-words:5": words can't be negated`,
+		"-source:x":                `bad filter at column 1, "-source:x": source can't be negated`,
+		"kind:monologue":           `bad filter at column 6, "monologue": bad kind "monologue"; want narrative, dialogue, letter, epigraph`,
+		"is:flagged":               `bad filter at column 1, "is:flagged": is:flagged only goes negated, -is:flagged leaving them out`,
+		"-is:complete":             `bad filter at column 1, "-is:complete": is:complete can't be negated`,
+		"is:nonesuch":              `bad filter at column 4, "nonesuch": is:nonesuch isn't known; want complete, flagged, undetermined, unique`,
+		"lang:en " + strings.Repeat("x", 60) + ":1": `bad filter at column 9, "` + strings.Repeat("x", 40) + `…": unknown key "` + strings.Repeat("x", 60) + `"; want one of author, era, fits, is, kind, lang, language, length, pos, position, series, source, words`,
+	} {
+		_, _, err := filterExprValues(expr)
+		if err == nil || err.Error() != want {
+			t.Errorf("filterExprValues(%q): %v\nwant %s", expr, err, want)
+		}
+	}
+}
+
+func TestFilterExprValues(t *testing.T) {
+	for _, c := range []struct {
+		expr, want string
+		presets    []string
+	}{
+		{`author:"Jane Austen" author:Scott -author:Anon lang:en -kind:dialogue`,
+			"author=Jane+Austen&author=Scott&language=en&not_author=Anon&not_kind=dialogue", nil},
+		{"words:80..160 length:200.. era:1800..1899 pos:..0.1 fits:280",
+			"era=1800-1899&fits=280&max_words=160&min_length=200&min_words=80&position=0-0.1", nil},
+		{"words:100 era:1850 position:0.5.. length:0", "era=1850&max_words=100&min_length=0&min_words=100&position=0.5-1", nil},
+		{"words:..20", "max_words=20", nil},
+		{"is:complete is:Unique lang:en is:undetermined -is:flagged -lang:fr",
+			"complete_only=true&exclude_flagged=true&include_undetermined=true&language=en&not_language=fr&unique_works=true", nil},
+		{"KIND:Dialogue Language:fr source:gutenberg-dvd series:Barsetshire",
+			"kind=dialogue&language=fr&series=Barsetshire&source=gutenberg-dvd", nil},
+		{"@bot words:5.. @wide", "min_words=5", []string{"bot", "wide"}},
+		{"", "", nil},
+	} {
+		q, presets, err := filterExprValues(c.expr)
+		if err != nil || q.Encode() != c.want || !reflect.DeepEqual(presets, c.presets) {
+			t.Errorf("filterExprValues(%q) = %s, presets %q (%v), want %s, presets %q", c.expr, q.Encode(), presets, err, c.want, c.presets)
+		}
+	}
+}
+
+func TestFilterExprPresets(t *testing.T) {
+	db := testDB(t)
+	preset := func(args ...string) {
+		t.Helper()
+		if _, err := captureStdout(t, func() error { return presetCmd(args) }); err != nil {
+			t.Fatalf("preset %s: %v", strings.Join(args, " "), err)
+		}
+	}
+	preset("create", "wide", "--min-words", "1", "--max-words", "50", "--language", "en")
+	preset("create", "french", "--language", "fr", "--kind", "dialogue")
+	for expr, want := range map[string]string{
+		"@wide":                   "language=en&max_words=50&min_words=1",
+		"words:5.. @wide":         "language=en&max_words=50&min_words=5",
+		"@wide @french":           "kind=dialogue&language=en&max_words=50&min_words=1",
+		"@french @wide lang:de":   "kind=dialogue&language=de&max_words=50&min_words=1",
+		"-kind:letter @french":    "kind=dialogue&language=fr&not_kind=letter",
+		"author:Austen @wide ":    "author=Austen&language=en&max_words=50&min_words=1",
+		"is:complete @nonesuch-x": "",
+	} {
+		q, err := filterValues(db, expr)
+		if want == "" {
+			if !errors.Is(err, errNoPreset) {
+				t.Errorf("filterValues(%q): %v, want %v", expr, err, errNoPreset)
+			}
+			continue
+		}
+		if err != nil || q.Encode() != want {
+			t.Errorf("filterValues(%q) = %s (%v), want %s", expr, q.Encode(), err, want)
+		}
+	}
+
+	// a preset saved from an expression keeps what it stands for
+	preset("create", "bot", "--filter", "@wide words:..20 -kind:dialogue")
+	preset("update", "wide", "--max-words", "10")
+	if got := names(t, db, "SELECT params FROM presets WHERE name = 'bot'"); got != "language=en&max_words=20&min_words=1&not_kind=dialogue\n" {
+		t.Errorf("the preset saved is %s", got)
+	}
+	for _, args := range [][]string{{"create", "other", "--filter", "lenght:5"}, {"create", "other", "--filter", "words:5 words:6"}} {
+		if _, err := captureStdout(t, func() error { return presetCmd(args) }); exitCode(err) != exitUsage {
+			t.Errorf("preset %s: %v, want a usage error", strings.Join(args, " "), err)
+		}
+	}
+	if _, err := captureStdout(t, func() error { return presetCmd([]string{"create", "other", "--filter", "@nonesuch"}) }); !errors.Is(err, errNoPreset) {
+		t.Errorf("preset create --filter @nonesuch: %v", err)
+	}
+}
+
+// filterLibrary is a library of chunks of a kind each, about whales, in
+// books of two authors and two languages, and the expression that keeps
+// the two of them it names.
+func filterLibrary(t *testing.T) (*server, []int) {
+	t.Helper()
+	db := testDB(t)
+	emma := addBook(t, db, "Emma", "Jane Austen", "")
+	persuasion := addBook(t, db, "Persuasion", "Jane Austen", "")
+	ivanhoe := addBook(t, db, "Ivanhoe", "Walter Scott", "")
+	for id, b := range map[int][2]string{emma: {"Emma", "Jane Austen"}, persuasion: {"Persuasion", "Jane Austen"}, ivanhoe: {"Ivanhoe", "Walter Scott"}} {
+		if err := saveNameWords(db, int64(id), normalizeAuthor(b[1]), normalizeTitle(b[0])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec("UPDATE files SET language = CASE id WHEN ? THEN 'fr' ELSE 'en' END", persuasion); err != nil {
+		t.Fatal(err)
+	}
+	words := func(n int) string {
+		return "The whale" + strings.Repeat(" swam", n-2) + "."
+	}
+	var kept []int
+	for _, c := range []struct {
+		book, words int
+		kind        string
+		keep        bool
+	}{
+		{emma, 10, kindNarrative, true},
+		{emma, 10, kindDialogue, false},
+		{emma, 30, kindNarrative, false},
+		{emma, 8, "", true},
+		{emma, 12, kindLetter, true},
+		{persuasion, 10, kindNarrative, false},
+		{ivanhoe, 10, kindNarrative, false},
+	} {
+		id := insertChunk(t, db, c.book, chunkCount(t, db, c.book), words(c.words))
+		if _, err := db.Exec("UPDATE chunks SET kind = nullif(?, '') WHERE id = ?", c.kind, id); err != nil {
+			t.Fatal(err)
+		}
+		if c.keep {
+			kept = append(kept, id)
+		}
+	}
+	return testServer(t, db), kept
+}
+
+const libraryFilter = `author:"austen" lang:EN words:5..20 -kind:dialogue`
+
+// The same expression keeps the same chunks whichever command or request
+// gives it.
+func TestFilterEverywhere(t *testing.T) {
+	s, kept := filterLibrary(t)
+	want := fmt.Sprint(kept)
+
+	var ids []int
+	for _, line := range exported(t, "--filter", libraryFilter) {
+		var r struct{ ID int }
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, r.ID)
+	}
+	if got := fmt.Sprint(ids); got != want {
+		t.Errorf("export --filter wrote %s, want %s", got, want)
+	}
+	if out, err := captureStdout(t, func() error { return statsCmd([]string{"--filter", libraryFilter}) }); err != nil ||
+		!strings.Contains(out, "books:     1 ") || !strings.Contains(out, fmt.Sprintf("chunks:    %d (", len(kept))) {
+		t.Errorf("stats --filter: %v, printing\n%s", err, out)
+	}
+	out, err := captureStdout(t, func() error { return grepCmd([]string{"--filter", libraryFilter, "whale"}) })
+	ids = nil
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		var id int
+		fmt.Sscan(line, &id)
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	if got := fmt.Sprint(ids); err != nil || got != want {
+		t.Errorf("grep --filter: %v, finding %s, want %s", err, got, want)
+	}
+
+	// drawn at random, only the chunks kept are, and all of them
+	texts := map[string]bool{}
+	for _, id := range kept {
+		texts[names(t, s.db, fmt.Sprintf("SELECT chunk FROM chunks WHERE id = %d", id))] = true
+	}
+	seen := map[int]bool{}
+	for i := 0; i < 80; i++ {
+		w := httptest.NewRecorder()
+		s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/chunks/random?filter="+url.QueryEscape(libraryFilter), nil))
+		var c chunkrow
+		if err := json.Unmarshal(w.Body.Bytes(), &c); err != nil || !strings.Contains(want, fmt.Sprint(c.ID)) {
+			t.Fatalf("GET /chunks/random?filter=: %d %s", w.Code, w.Body)
+		}
+		seen[c.ID] = true
+
+		out, err := captureStdout(t, func() error {
+			return randomCmd([]string{"--filter", libraryFilter, "--width", "0", "--seed", fmt.Sprint(i + 1)})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunk, _, _ := strings.Cut(out, "\n")
+		if !texts[chunk+"\n"] {
+			t.Fatalf("random --filter printed\n%s", out)
+		}
+	}
+	if len(seen) != len(kept) {
+		t.Errorf("GET /chunks/random?filter= drew %v of %v", seen, kept)
+	}
+
+	// the flags and parameters given win over it
+	for _, c := range []struct {
+		path string
+		code int
+	}{
+		{"/chunks/random?filter=" + url.QueryEscape("lang:de") + "&language=fr", http.StatusOK},
+		{"/chunks/random?filter=" + url.QueryEscape("lang:fr") + "&language=de", http.StatusNotFound},
+		{"/chunks/random?filter=" + url.QueryEscape("lenght:5"), http.StatusBadRequest},
+		{"/chunks/random?filter=" + url.QueryEscape("@nonesuch"), http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		s.routes().ServeHTTP(w, httptest.NewRequest("GET", c.path, nil))
+		if w.Code != c.code {
+			t.Errorf("GET %s: %d %s, want %d", c.path, w.Code, w.Body, c.code)
+		}
+	}
+	if out, err := captureStdout(t, func() error { return statsCmd([]string{"--filter", "lang:fr words:30", "--source", "nonesuch"}) }); err == nil {
+		t.Errorf("stats --filter --source nonesuch printed\n%s", out)
+	}
+	if lines := exported(t, "--filter", libraryFilter+" author:nobody"); len(lines) != len(kept) {
+		t.Errorf("export of any of two authors wrote\n%s", strings.Join(lines, "\n"))
+	}
+	if lines := exported(t, "--filter", libraryFilter, "--author", "Walter Scott"); len(lines) != 1 || !strings.Contains(lines[0], `"author":"Walter Scott"`) {
+		t.Errorf("export --filter --author wrote\n%s", strings.Join(lines, "\n"))
+	}
+	for _, cmd := range []func([]string) error{exportCmd, statsCmd, randomCmd} {
+		if _, err := captureStdout(t, func() error { return cmd([]string{"--filter", "words:5 lenght:5"}) }); exitCode(err) != exitUsage {
+			t.Errorf("--filter with a typo: %v, want a usage error", err)
+		}
+		if _, err := captureStdout(t, func() error { return cmd([]string{"--filter", "@nonesuch"}) }); !errors.Is(err, errNoPreset) {
+			t.Errorf("--filter of a preset there isn't: %v", err)
+		}
+	}
+
+	t.Run("search", func(t *testing.T) {
+		indexChunks(t, s.db)
+		_, p := getSearch(t, s, "q=whale&filter="+url.QueryEscape(libraryFilter))
+		ids := []int{}
+		for _, r := range p.Results {
+			ids = append(ids, r.ID)
+		}
+		sort.Ints(ids)
+		if got := fmt.Sprint(ids); got != want {
+			t.Errorf("GET /search?filter= found %s, want %s", got, want)
+		}
+	})
+}
@@ -0,0 +1,106 @@
+package cli
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// find-body shows the paragraphs at the top of a book, each by the number
+// of its first line, for picking the start-line, or the start-at text, of
+// an override for a book whose markers are missing or wrong; and says
+// where the body starts now, with the override when given --overrides.
+
+func findBodyCmd(args []string) error {
+	fs := flag.NewFlagSet("find-body", flag.ExitOnError)
+	paragraphs := fs.Int("paragraphs", 20, "paragraphs to show")
+	from := fs.Int("from", 1, "show paragraphs from this line on")
+	width := fs.Int("width", 100, "cut each paragraph to about this many characters")
+	loadOverrides := overridesFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return usagef("usage: gutchunk find-body [--paragraphs N] [--from LINE] [--overrides FILE] <file id>")
+	}
+	id, err := strconv.Atoi(fs.Arg(0))
+	if err != nil {
+		return usagef("bad file id %q", fs.Arg(0))
+	}
+	if *paragraphs < 1 || *from < 1 || *width < 1 {
+		return usagef("--paragraphs, --from and --width must be positive")
+	}
+	ovr, err := loadOverrides()
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	b, err := loadBook(db, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("no file %d", id)
+	} else if err != nil {
+		return err
+	}
+	lines := contentLines(b.Content)
+	shown := 0
+	for i := *from - 1; i < len(lines) && shown < *paragraphs; i++ {
+		if lines[i] == "" {
+			continue
+		}
+		first := i
+		for i < len(lines) && lines[i] != "" {
+			i++
+		}
+		at := strconv.Itoa(first + 1)
+		if i-first > 1 {
+			at += "-" + strconv.Itoa(i)
+		}
+		fmt.Printf("%11s  %s\n", at, clip(strings.Join(lines[first:i], " "), *width))
+		shown++
+	}
+
+	opts, err := ovr.apply(b, chunkOptions{bodyOnly: b.BodyOnly})
+	if err != nil {
+		return err
+	}
+	fmt.Println(describeBodyStart(lines, opts, ovr.find(b)))
+	return nil
+}
+
+// describeBodyStart says where opts, with the override x, nil for none,
+// have the body of a book of lines start.
+func describeBodyStart(lines []string, opts chunkOptions, x *bookOverride) string {
+	switch {
+	case opts.startLine > 0 && x.startAt != "":
+		return fmt.Sprintf("the body starts at line %d, the one with %s's start-at", opts.startLine, x.name)
+	case opts.startLine > 0:
+		return fmt.Sprintf("the body starts at line %d, %s's start-line", opts.startLine, x.name)
+	case opts.start != nil:
+		for i, l := range lines {
+			if opts.start.MatchString(l) {
+				return fmt.Sprintf("the body starts at line %d, after the line %s's start pattern matches", i+2, x.name)
+			}
+		}
+		return fmt.Sprintf("%s's start pattern matches no line, so the book has no body", x.name)
+	case opts.bodyOnly:
+		return "the body starts at line 1, the book being body only"
+	}
+	starts := []int{}
+	for i, l := range lines {
+		if isStart(l) {
+			starts = append(starts, i)
+		}
+	}
+	if len(starts) == 0 {
+		return "no START marker, so without an override the book has no body"
+	}
+	at := starts[bodyStart(lines, starts)]
+	return fmt.Sprintf("the body starts at line %d, after the START marker at line %d", at+2, at+1)
+}
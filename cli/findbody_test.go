@@ -0,0 +1,72 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFindBody(t *testing.T) {
+	db := testDB(t)
+	addBook(t, db, "Moby Dick", "Herman Melville", etextPreamble+"CALL me Ishmael.\nSome years ago.\n\n"+testParagraphs(3)+"\n")
+	addBook(t, db, "Emma", "Jane Austen", testBook("Emma", testParagraphs(2)))
+	findBody := func(args ...string) (string, error) {
+		t.Helper()
+		return captureStdout(t, func() error { return findBodyCmd(args) })
+	}
+
+	out, err := findBody("--width", "30", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Join([]string{
+		"          1  The Project Gutenberg Etext of…",
+		"          3  To order these etexts on flopp…",
+		"          5  CHAPTER 1. Loomings.",
+		"        7-8  CALL me Ishmael. Some years ag…",
+		"         10  It was a paragraph of the book…",
+		"         12  It was a paragraph of the book…",
+		"         14  It was a paragraph of the book…",
+		"no START marker, so without an override the book has no body",
+	}, "\n") + "\n"; out != want {
+		t.Errorf("find-body of a book without markers printed\n%s", lineDiff(want, out))
+	}
+	if out, _ = findBody("--paragraphs", "2", "--from", "6", "1"); !strings.HasPrefix(out, "        7-8  CALL me Ishmael. Some years ago.\n         10  It was") || strings.Count(out, "\n") != 3 {
+		t.Errorf("find-body --paragraphs 2 --from 6 printed\n%s", out)
+	}
+	if out, _ = findBody("2"); !strings.HasSuffix(out, "the body starts at line 6, after the START marker at line 5\n") {
+		t.Errorf("find-body of a book with markers printed\n%s", out)
+	}
+
+	path := filepath.Join(t.TempDir(), "book-overrides.toml")
+	for ovr, want := range map[string]string{
+		"start-line = 7":          `the body starts at line 7, file."Moby Dick.txt"'s start-line`,
+		"start-at = 'Ishmael'":    `the body starts at line 7, the one with file."Moby Dick.txt"'s start-at`,
+		"start = '^CHAPTER 1\\.'": `the body starts at line 6, after the line file."Moby Dick.txt"'s start pattern matches`,
+		"start = '^PROLOGUE'":     `file."Moby Dick.txt"'s start pattern matches no line, so the book has no body`,
+		"body-only = true":        "the body starts at line 1, the book being body only",
+	} {
+		if err = os.WriteFile(path, []byte("[file.\"Moby Dick.txt\"]\n"+ovr+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if out, err = findBody("--overrides", path, "1"); err != nil || !strings.HasSuffix(out, want+"\n") {
+			t.Errorf("find-body with %q: %v, printing\n%s", ovr, err, out)
+		}
+	}
+	if err = os.WriteFile(path, []byte("[file.\"Moby Dick.txt\"]\nstart-at = 'paragraph'\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = findBody("--overrides", path, "1"); err == nil || !strings.Contains(err.Error(), `"paragraph" is on 3 lines (10, 12, 14)`) {
+		t.Errorf("find-body with an anchor on several lines: %v", err)
+	}
+
+	if _, err = findBody("99"); err == nil || err.Error() != "no file 99" {
+		t.Errorf("find-body 99: %v", err)
+	}
+	for _, args := range [][]string{{}, {"moby"}, {"--paragraphs", "0", "1"}, {"1", "2"}} {
+		if _, err = findBody(args...); exitCode(err) != exitUsage {
+			t.Errorf("find-body %s: %v, want a usage error", strings.Join(args, " "), err)
+		}
+	}
+}
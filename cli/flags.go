@@ -0,0 +1,291 @@
+package cli
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Chunks can be pinned, to be drawn more often by random --prefer-pinned,
+// or banned, to never be drawn at all. A flag remembers the chunk's text by
+// hash so that when its row is deleted and the book chunked again the flag
+// moves to the new row with the same text.
+const (
+	flagPin = "pin"
+	flagBan = "ban"
+)
+
+// textHash is what flags match chunks by and tombstones remember books by.
+func textHash(chunk string) string {
+	sum := sha256.Sum256([]byte(chunk))
+	return hex.EncodeToString(sum[:])
+}
+
+func pinCmd(args []string) error    { return flagChunksCmd("pin", flagPin, args) }
+func banCmd(args []string) error    { return flagChunksCmd("ban", flagBan, args) }
+func unflagCmd(args []string) error { return flagChunksCmd("unflag", "", args) }
+
+func flagChunksCmd(name, kind string, args []string) error {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	note := fs.String("note", "", "why, for flags listing")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return usagef("usage: gutchunk %s <chunkid>...", name)
+	}
+	ids := []int{}
+	for _, a := range fs.Args() {
+		id, err := strconv.Atoi(a)
+		if err != nil {
+			return usagef("bad chunk id %q", a)
+		}
+		ids = append(ids, id)
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, id := range ids {
+		if err = setChunkFlag(tx, id, kind, *note); err != nil {
+			return fmt.Errorf("chunk %d: %w", id, err)
+		}
+	}
+	return tx.Commit()
+}
+
+var (
+	errNoChunk = errors.New("no such chunk")
+	errBadFlag = errors.New("flag must be pin, ban or none")
+)
+
+// setChunkFlag pins or bans chunk id, replacing any flag it had, or with
+// kind "" clears it.
+func setChunkFlag(tx *sql.Tx, id int, kind, note string) error {
+	if kind == "" {
+		_, err := tx.Exec("DELETE FROM chunk_flags WHERE chunk_id = ?", id)
+		return err
+	}
+	if kind != flagPin && kind != flagBan {
+		return errBadFlag
+	}
+	var text string
+	err := tx.QueryRow("SELECT chunk FROM chunks WHERE id = ?", id).Scan(&text)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errNoChunk
+	}
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM chunk_flags WHERE chunk_id = ?", id); err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO chunk_flags (chunk_id, hash, flag, note, created_at) VALUES (?, ?, ?, ?, datetime('now'))",
+		id, textHash(text), kind, note)
+	return err
+}
+
+// reattachFlags moves flags whose chunk row is gone onto newly written
+// chunks with the same text. ids and chunks are parallel. Deleted chunks'
+// ids can be reused, so a flag already on one of the new ids is stale too.
+func reattachFlags(tx *sql.Tx, ids []int64, chunks []string) error {
+	fresh := map[int64]bool{}
+	for _, id := range ids {
+		fresh[id] = true
+	}
+	rows, err := tx.Query(`SELECT cf.id, cf.hash, coalesce(cf.chunk_id, 0), c.id IS NULL
+		FROM chunk_flags cf LEFT JOIN chunks c ON c.id = cf.chunk_id`)
+	if err != nil {
+		return err
+	}
+	orphans := map[string]int{}
+	stale := []int{}
+	for rows.Next() {
+		var id int
+		var chunk int64
+		var hash string
+		var gone bool
+		if err = rows.Scan(&id, &hash, &chunk, &gone); err != nil {
+			rows.Close()
+			return err
+		}
+		if fresh[chunk] {
+			stale = append(stale, id)
+			gone = true
+		}
+		if gone {
+			orphans[hash] = id
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || len(orphans) == 0 {
+		return err
+	}
+
+	for _, id := range stale {
+		if _, err = tx.Exec("UPDATE chunk_flags SET chunk_id = NULL WHERE id = ?", id); err != nil {
+			return err
+		}
+	}
+	for i, c := range chunks {
+		h := textHash(c)
+		flag, ok := orphans[h]
+		if !ok {
+			continue
+		}
+		if _, err = tx.Exec("UPDATE chunk_flags SET chunk_id = ? WHERE id = ?", ids[i], flag); err != nil {
+			return err
+		}
+		delete(orphans, h)
+	}
+	return nil
+}
+
+func flagsCmd(args []string) error {
+	fs := flag.NewFlagSet("flags", flag.ExitOnError)
+	only := fs.String("only", "", "list only pin or ban flags")
+	fs.Parse(args)
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT coalesce(cf.chunk_id, 0), cf.flag, coalesce(cf.note, ''), c.chunk, coalesce(f.name, '')
+		FROM chunk_flags cf LEFT JOIN chunks c ON c.id = cf.chunk_id LEFT JOIN files f ON f.id = c.sourceid
+		WHERE ? = '' OR cf.flag = ?
+		ORDER BY cf.flag, cf.chunk_id`, *only, *only)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var kind, note, title string
+		var text sql.NullString
+		if err = rows.Scan(&id, &kind, &note, &text, &title); err != nil {
+			return err
+		}
+		if !text.Valid {
+			// waiting for its text to be chunked again
+			title = "(chunk gone)"
+		}
+		line := fmt.Sprintf("%s %8d  %s  %s", kind, id, title, clip(text.String, 60))
+		if note != "" {
+			line += "  # " + note
+		}
+		fmt.Println(line)
+	}
+	return rows.Err()
+}
+
+func isBanned(db *sql.DB, id int) (bool, error) {
+	var n int
+	err := db.QueryRow("SELECT count(*) FROM chunk_flags WHERE chunk_id = ? AND flag = ?", id, flagBan).Scan(&n)
+	return n > 0, err
+}
+
+// pinBoost is how many times likelier a pinned chunk is to be drawn than
+// any other under random --prefer-pinned.
+const pinBoost = 10
+
+// pinnedChunk decides whether this draw comes from the pinned chunks (of
+// work, if not 0) and if so makes it. Each of P pinned chunks among N
+// weighs pinBoost against 1 for the rest.
+func pinnedChunk(db *sql.DB, r *rand.Rand, work int) (chunkrow, bool, error) {
+	var c chunkrow
+	pinned, err := countChunks(db, `chunk_flags cf JOIN %s c ON c.id = cf.chunk_id JOIN files f ON f.id = c.sourceid
+		WHERE cf.flag = ? AND (? = 0 OR f.work_id = ?) AND f.suppressed_by IS NULL AND `+activeVersion, flagPin, work, work)
+	if err != nil || pinned == 0 {
+		return c, false, err
+	}
+	var total int
+	if work != 0 {
+		total, err = countChunks(db, "files f JOIN %s c ON c.sourceid = f.id WHERE f.work_id = ?", work)
+	} else {
+		var max int64
+		max, err = maxChunkID(db)
+		total = int(max)
+	}
+	if err != nil {
+		return c, false, err
+	}
+	weight := float64(pinned * pinBoost)
+	if r.Float64()*(weight+float64(total-pinned)) >= weight {
+		return c, false, nil
+	}
+	err = db.QueryRow(`SELECT `+chunkrowCols+`
+		FROM chunk_flags cf JOIN chunks c ON c.id = cf.chunk_id JOIN files f ON f.id = c.sourceid
+		WHERE cf.flag = ? AND (? = 0 OR f.work_id = ?) AND f.suppressed_by IS NULL AND `+activeVersion+` ORDER BY c.id LIMIT 1 OFFSET ?`, flagPin, work, work, r.Intn(pinned)).
+		Scan(&c.ID, &c.Text, &c.Title, &c.Author, &c.StableID)
+	return c, err == nil, err
+}
+
+type flagRequest struct {
+	// pin, ban, or none to clear
+	Flag string `json:"flag"`
+	Note string `json:"note"`
+}
+
+// handleChunkFlag serves POST /chunks/{id}/flag. It changes what is drawn,
+// so unlike the read endpoints it is refused outright without --api-key.
+// GET /chunks/{id}/similar goes to handleSimilar.
+func (s *server) handleChunkFlag(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/chunks/"), "/")
+	id, err := strconv.Atoi(parts[0])
+	if err == nil && len(parts) == 2 && parts[1] == "similar" {
+		s.handleSimilar(w, r, id)
+		return
+	}
+	if err != nil || len(parts) != 2 || parts[1] != "flag" {
+		httpError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if r.Method != http.MethodPost {
+		httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.apiKey == "" {
+		httpError(w, http.StatusForbidden, "flagging chunks needs serve --api-key")
+		return
+	}
+	var req flagRequest
+	if err = json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, "bad json: "+err.Error())
+		return
+	}
+	kind := req.Flag
+	if kind == "none" {
+		kind = ""
+	}
+	if err = s.w.interactive(func(tx *sql.Tx) error { return setChunkFlag(tx, id, kind, req.Note) }); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errNoChunk) {
+			status = http.StatusNotFound
+		} else if errors.Is(err, errBadFlag) {
+			status = http.StatusBadRequest
+		}
+		httpError(w, status, err.Error())
+		return
+	}
+	// banned chunks must stop being drawn now, not at the next refresh
+	if s.reservoir != nil {
+		s.reservoir.invalidate()
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"id": id, "flag": req.Flag})
+}
@@ -0,0 +1,157 @@
+package cli
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+// flagged returns the flag on each of book id's chunks by ordinal, "" for
+// none.
+func flagged(t *testing.T, db *sql.DB, id int) []string {
+	t.Helper()
+	rows, err := db.Query(`SELECT coalesce(cf.flag, '') FROM chunks c LEFT JOIN chunk_flags cf ON cf.chunk_id = c.id
+		WHERE c.sourceid = ? ORDER BY c.ordinal`, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var f string
+		if err = rows.Scan(&f); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, f)
+	}
+	return out
+}
+
+func rechunkBook(t *testing.T, db *sql.DB, id int, content string) {
+	t.Helper()
+	if _, err := db.Exec("UPDATE files SET content = ?, content_hash = ? WHERE id = ?", content, textHash(content), id); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, err = chunkBook(tx, id, chunkOptions{fullRechunk: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFlagsSurviveRechunk(t *testing.T) {
+	db := testDB(t)
+	content := testBook("Moors", testParagraphs(4))
+	id := addBook(t, db, "Moors", "Someone", content)
+	if err := makeChunks(db, chunkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	var pin, ban int
+	if err := db.QueryRow("SELECT id FROM chunks WHERE sourceid = ? AND ordinal = 1", id).Scan(&pin); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("SELECT id FROM chunks WHERE sourceid = ? AND ordinal = 2", id).Scan(&ban); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []struct {
+		id   int
+		kind string
+	}{{pin, flagPin}, {ban, flagBan}} {
+		if err = setChunkFlag(tx, f.id, f.kind, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// every chunk written anew at the ids there were, the banned one's
+	// text changed
+	edited := strings.Replace(content, "number iii,", "number three,", 1)
+	rechunkBook(t, db, id, edited)
+	if got := strings.Join(flagged(t, db, id), ","); got != ",pin,," {
+		t.Errorf("flags by ordinal %q after re-chunking, want the pin on the chunk with its text and the ban on none", got)
+	}
+	var orphaned int
+	if err = db.QueryRow("SELECT count(*) FROM chunk_flags WHERE flag = ? AND chunk_id IS NULL", flagBan).Scan(&orphaned); err != nil {
+		t.Fatal(err)
+	}
+	if orphaned != 1 {
+		t.Errorf("%d bans kept without a chunk, want the one whose text is gone kept for it", orphaned)
+	}
+
+	// the text back, the ban finds it again, at ids past another book's;
+	// that book's text is its own, or the ban would go to its copy there
+	addBook(t, db, "Fells", "Someone", testBook("Fells", strings.ReplaceAll(testParagraphs(5), "moors", "fells")))
+	if err = makeChunks(db, chunkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	rechunkBook(t, db, id, content)
+	if got := strings.Join(flagged(t, db, id), ","); got != ",pin,ban," {
+		t.Errorf("flags by ordinal %q after the text came back, want both on their chunks", got)
+	}
+	var now int
+	if err = db.QueryRow("SELECT chunk_id FROM chunk_flags WHERE flag = ?", flagPin).Scan(&now); err != nil {
+		t.Fatal(err)
+	}
+	if now == pin {
+		t.Errorf("the pinned chunk has its first id %d still, so wasn't found by its text", pin)
+	}
+	var flags int
+	if err = db.QueryRow("SELECT count(*) FROM chunk_flags").Scan(&flags); err != nil {
+		t.Fatal(err)
+	}
+	if flags != 2 {
+		t.Errorf("%d flags, want the two set", flags)
+	}
+}
+
+func TestSetChunkFlag(t *testing.T) {
+	db := testDB(t)
+	id := addBook(t, db, "Moors", "Someone", "")
+	chunk := insertChunk(t, db, id, 0, "A chunk.")
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err = setChunkFlag(tx, chunk+1, flagBan, ""); err != errNoChunk {
+		t.Errorf("banning a missing chunk: %v, want errNoChunk", err)
+	}
+	if err = setChunkFlag(tx, chunk, "star", ""); err != errBadFlag {
+		t.Errorf("an unknown flag: %v, want errBadFlag", err)
+	}
+	// a ban replaces a pin, and unflagging clears it
+	for _, kind := range []string{flagPin, flagBan} {
+		if err = setChunkFlag(tx, chunk, kind, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var kinds string
+	if err = tx.QueryRow("SELECT group_concat(flag) FROM chunk_flags").Scan(&kinds); err != nil {
+		t.Fatal(err)
+	}
+	if kinds != flagBan {
+		t.Errorf("flags %q, want the ban alone", kinds)
+	}
+	if err = setChunkFlag(tx, chunk, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err = tx.QueryRow("SELECT count(*) FROM chunk_flags").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("%d flags after unflagging", n)
+	}
+}
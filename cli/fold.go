@@ -0,0 +1,174 @@
+package cli
+
+import (
+	"database/sql"
+	"regexp/syntax"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Folding makes "Brontë" and "BRONTE", or "naïve" and "Naive", the same:
+// text is lowercased and letters with diacritics lose them. Decomposed
+// text folds too, its combining marks being dropped. The full text index
+// folds the same way by itself, with unicode61's remove_diacritics=2.
+
+// foldTable maps the lowercase letters of the Latin-1 and Latin
+// Extended-A blocks, and the few others Gutenberg texts use, to what they
+// fold to.
+var foldTable = func() map[rune]string {
+	m := map[rune]string{'æ': "ae", 'œ': "oe", 'ß': "ss", 'þ': "th"}
+	for plain, marked := range map[string]string{
+		"a": "àáâãäåāăąǎǻ",
+		"c": "çćĉċč",
+		"d": "ďđð",
+		"e": "èéêëēĕėęě",
+		"g": "ĝğġģ",
+		"h": "ĥħ",
+		"i": "ìíîïĩīĭįıǐ",
+		"j": "ĵ",
+		"k": "ķ",
+		"l": "ĺļľŀł",
+		"n": "ñńņňŉ",
+		"o": "òóôõöøōŏőǒ",
+		"r": "ŕŗř",
+		"s": "śŝşšș",
+		"t": "ţťŧț",
+		"u": "ùúûüũūŭůűųǔ",
+		"w": "ŵ",
+		"y": "ýÿŷ",
+		"z": "źżž",
+	} {
+		for _, r := range marked {
+			m[r] = plain
+		}
+	}
+	return m
+}()
+
+// foldRune appends what r folds to onto b.
+func foldRune(b []byte, r rune) []byte {
+	if unicode.Is(unicode.Mn, r) {
+		return b
+	}
+	r = unicode.ToLower(r)
+	if s, ok := foldTable[r]; ok {
+		return append(b, s...)
+	}
+	return utf8.AppendRune(b, r)
+}
+
+func fold(s string) string {
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		b = foldRune(b, r)
+	}
+	return string(b)
+}
+
+// foldIndexed is fold also returning, for each byte of the folded text and
+// one past its end, the offset in s of the text it came from, so matches
+// in the folded text can be found in s.
+func foldIndexed(s string) (string, []int) {
+	b := make([]byte, 0, len(s))
+	at := make([]int, 0, len(s)+1)
+	for i, r := range s {
+		n := len(b)
+		b = foldRune(b, r)
+		for ; n < len(b); n++ {
+			at = append(at, i)
+		}
+	}
+	return string(b), append(at, len(s))
+}
+
+// foldPattern folds the literal text of a regexp, so it can be matched
+// against folded text. Classes are left alone.
+func foldPattern(re *syntax.Regexp) {
+	if re.Op == syntax.OpLiteral {
+		re.Rune = []rune(fold(string(re.Rune)))
+	}
+	for _, sub := range re.Sub {
+		foldPattern(sub)
+	}
+}
+
+// Authors and titles are matched word by word: "bronte" finds "Charlotte
+// Brontë" and "tale hea" finds "The Tell-Tale Heart". Every word of their
+// folded forms is in name_words, and a query matches when each of its
+// words starts one of a book's. Each word is looked up as a range over
+// name_words' index, where LIKE would scan.
+
+// nameWords splits a folded author or title into words.
+func nameWords(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// wordAfter sorts after every word starting with the prefix it ends, sqlite
+// comparing text as bytes.
+const wordAfter = "\U0010FFFF"
+
+// nameQuery is what books are narrowed to by --author and --title.
+type nameQuery struct {
+	author, title []string
+}
+
+func parseNameQuery(author, title string) nameQuery {
+	return nameQuery{nameWords(normalizeAuthor(author)), nameWords(normalizeTitle(title))}
+}
+
+func (q nameQuery) empty() bool {
+	return len(q.author) == 0 && len(q.title) == 0
+}
+
+// where is a WHERE clause term over "files f" matching q, and its args.
+func (q nameQuery) where() (string, []interface{}) {
+	terms := []string{"1 = 1"}
+	args := []interface{}{}
+	for _, field := range []struct {
+		name  string
+		words []string
+	}{{"author", q.author}, {"title", q.title}} {
+		for _, w := range field.words {
+			terms = append(terms, "f.id IN (SELECT file_id FROM name_words WHERE field = ? AND word >= ? AND word < ?)")
+			args = append(args, field.name, w, w+wordAfter)
+		}
+	}
+	return strings.Join(terms, " AND "), args
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// saveNameWords replaces the words book id is found by, its title's
+// transliteration's among them, and the transliteration itself and the
+// title's sort key, dropping its keys by locale.
+func saveNameWords(tx execer, id int64, authorNorm, titleNorm string) error {
+	tt := titleTranslit(titleNorm)
+	if _, err := tx.Exec("UPDATE files SET title_translit = ?, title_sort = ? WHERE id = ?", tt, sortTitle(titleNorm), id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM name_words WHERE file_id = ?", id); err != nil {
+		return err
+	}
+	// made again for each locale as it is next sorted by
+	if _, err := tx.Exec("DELETE FROM sort_keys WHERE file_id = ?", id); err != nil {
+		return err
+	}
+	for _, field := range [][2]string{{"author", authorNorm}, {"title", titleNorm + " " + tt.String}} {
+		seen := map[string]bool{}
+		for _, w := range nameWords(field[1]) {
+			if seen[w] {
+				continue
+			}
+			seen[w] = true
+			if _, err := tx.Exec("INSERT INTO name_words (field, word, file_id) VALUES (?, ?, ?)", field[0], w, id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestFold(t *testing.T) {
+	for in, want := range map[string]string{
+		"Brontë":             "bronte",
+		"NAÏVE":              "naive",
+		"nai\u0308ve":        "naive",
+		"Ærø Straße, Łódź":   "aero strasse, lodz",
+		"Émile Zola":         "emile zola",
+		"plain ascii 1850.":  "plain ascii 1850.",
+		"Достоевский":        "достоевский",
+		"CAFÉ\u0301 crème\n": "cafe creme\n",
+	} {
+		if got := fold(in); got != want {
+			t.Errorf("fold(%q) = %q, want %q", in, got, want)
+		}
+	}
+
+	// every byte of the folded text leads back to where it came from
+	s := "Naïve Brontë"
+	folded, at := foldIndexed(s)
+	if folded != "naive bronte" || len(at) != len(folded)+1 || at[len(folded)] != len(s) {
+		t.Fatalf("foldIndexed(%q) = %q, %v", s, folded, at)
+	}
+	if i := strings.Index(folded, "bronte"); s[at[i]:at[i+len("bronte")]] != "Brontë" {
+		t.Errorf("the match of bronte leads back to %q", s[at[i]:at[i+len("bronte")]])
+	}
+}
+
+// foldedLibrary is a database of books whose names and text have
+// diacritics, some decomposed.
+func foldedLibrary(t *testing.T) *sql.DB {
+	t.Helper()
+	db := testDB(t)
+	for _, b := range []struct {
+		title, author, chunk string
+	}{
+		{"Villette", "Charlotte Brontë", "Lucy was not naïve about Madame Beck."},
+		{"Wuthering Heights", "Emily Bronte\u0308", "Heathcliff was never NAI\u0308VE."},
+		{"A Naïve Heart", "Anonymous", "Nothing much happened to anyone."},
+		{"Emma", "Jane Austen", "Emma was naive, as Mr. Knightley said."},
+		{"Persuasion", "Jane Austen", "Anne had read her Shakespeare."},
+	} {
+		id := addBook(t, db, b.title, b.author, "")
+		if err := saveNameWords(db, int64(id), normalizeAuthor(b.author), normalizeTitle(b.title)); err != nil {
+			t.Fatal(err)
+		}
+		insertChunk(t, db, id, 0, b.chunk)
+	}
+	return db
+}
+
+// bookTitles is the titles of the books q finds, in id order.
+func bookTitles(t *testing.T, db *sql.DB, q nameQuery) string {
+	t.Helper()
+	where, args := q.where()
+	rows, err := db.Query("SELECT name FROM files f WHERE "+where+" ORDER BY id", args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var titles []string
+	for rows.Next() {
+		var title string
+		if err = rows.Scan(&title); err != nil {
+			t.Fatal(err)
+		}
+		titles = append(titles, title)
+	}
+	return strings.Join(titles, ", ")
+}
+
+func TestFoldedNames(t *testing.T) {
+	db := foldedLibrary(t)
+	for _, c := range []struct {
+		author, title, want string
+	}{
+		{"bronte", "", "Villette, Wuthering Heights"},
+		{"BRONTË", "", "Villette, Wuthering Heights"},
+		{"charl bron", "", "Villette"},
+		{"", "NAIVE", "A Naïve Heart"},
+		{"", "naïve heart", "A Naïve Heart"},
+		{"austen", "naive", ""},
+	} {
+		if got := bookTitles(t, db, parseNameQuery(c.author, c.title)); got != c.want {
+			t.Errorf("--author %q --title %q found %q, want %q", c.author, c.title, got, c.want)
+		}
+	}
+	matches, err := searchBooks(db, "bronte", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 2 {
+		t.Errorf("a search for bronte found %+v, want both sisters", matches)
+	}
+}
+
+func TestFoldedText(t *testing.T) {
+	db := foldedLibrary(t)
+	want := []string{"Villette", "Wuthering Heights", "Emma"}
+
+	// grep -i scanning every chunk, and narrowed by the index
+	re, parsed := compileGrep(t, `\bNAIVE\b`, true)
+	terms := []string{""}
+	if chunkLayout != chunksClustered {
+		indexChunks(t, db)
+		terms = append(terms, regexpTerms(parsed))
+	}
+	for _, terms := range terms {
+		var out bytes.Buffer
+		n, err := grepChunks(context.Background(), db, re, grepOptions{fold: true, terms: terms}, &out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(want) {
+			t.Errorf("grep -i with terms %q: %d chunks, want %d:\n%s", terms, n, len(want), out.String())
+		}
+		for _, w := range []string{"naïve", "NAI\u0308VE", "naive,"} {
+			if !strings.Contains(out.String(), w) {
+				t.Errorf("grep -i with terms %q printed no %q:\n%s", terms, w, out.String())
+			}
+		}
+	}
+	// grep --author through name_words
+	var out bytes.Buffer
+	n, err := grepChunks(context.Background(), db, re, grepOptions{fold: true, names: parseNameQuery("bronte", "")}, &out)
+	if err != nil || n != 2 {
+		t.Errorf("grep -i --author bronte: %d chunks, %v", n, err)
+	}
+
+	// the full text index folds by itself
+	rowidOnly(t, "the full text index")
+	s := testServer(t, db)
+	for _, q := range []string{"NAIVE", "naïve"} {
+		w, p := getSearch(t, s, "q="+q)
+		if w.Code != http.StatusOK || p.Total != len(want) {
+			t.Errorf("/search?q=%s: %d, %d results, want %d", q, w.Code, p.Total, len(want))
+		}
+	}
+}
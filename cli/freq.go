@@ -0,0 +1,287 @@
+package cli
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+var stopwords = map[string]bool{}
+
+func init() {
+	for _, w := range strings.Fields(`a about above after again against all am an and any are
+		as at be because been before being below between both but by can could did do does
+		doing down during each few for from further had has have having he her here hers
+		herself him himself his how i if in into is it its itself just me more most my myself
+		no nor not now of off on once only or other our ours ourselves out over own same she
+		should so some such than that the their theirs them themselves then there these they
+		this those through to too under until up upon very was we were what when where which
+		while who whom why will with would you your yours yourself yourselves thee thou thy
+		said shall must may might one oh o`) {
+		stopwords[w] = true
+	}
+}
+
+// words splits text into lowercased words, keeping apostrophes that sit
+// between letters ("don't") and dropping everything else.
+func words(text string) []string {
+	out := []string{}
+	rs := []rune(text)
+	start := -1
+	for i, r := range rs {
+		inWord := unicode.IsLetter(r) || unicode.IsDigit(r) ||
+			((r == '\'' || r == '’') && start >= 0 && i+1 < len(rs) && unicode.IsLetter(rs[i+1]))
+		if inWord && start < 0 {
+			start = i
+		} else if !inWord && start >= 0 {
+			out = append(out, strings.ToLower(string(rs[start:i])))
+			start = -1
+		}
+	}
+	if start >= 0 {
+		out = append(out, strings.ToLower(string(rs[start:])))
+	}
+	return out
+}
+
+// ngrams returns the space joined n-grams of ws. With skipStop, unigrams that
+// are stopwords and n-grams made only of stopwords are left out.
+func ngrams(ws []string, n int, skipStop bool) []string {
+	out := []string{}
+	for i := 0; i+n <= len(ws); i++ {
+		g := ws[i : i+n]
+		if skipStop {
+			all := true
+			for _, w := range g {
+				if !stopwords[w] {
+					all = false
+					break
+				}
+			}
+			if all {
+				continue
+			}
+		}
+		out = append(out, strings.Join(g, " "))
+	}
+	return out
+}
+
+// termCounter counts terms in at most max entries. When it grows past max,
+// the rarest terms are pruned, so the counts it reports are lower bounds on
+// the true counts and very rare terms may be missing. Frequent terms survive
+// pruning so the top of the list stays accurate.
+type termCounter struct {
+	counts map[string]int
+	max    int
+	pruned int
+}
+
+func newTermCounter(max int) *termCounter {
+	return &termCounter{counts: map[string]int{}, max: max}
+}
+
+func (tc *termCounter) add(term string) {
+	tc.counts[term]++
+	if tc.max > 0 && len(tc.counts) > tc.max {
+		tc.prune()
+	}
+}
+
+// prune keeps roughly the most frequent half of the entries.
+func (tc *termCounter) prune() {
+	cs := make([]int, 0, len(tc.counts))
+	for _, c := range tc.counts {
+		cs = append(cs, c)
+	}
+	sort.Ints(cs)
+	cutoff := cs[len(cs)/2]
+	for t, c := range tc.counts {
+		if c <= cutoff {
+			delete(tc.counts, t)
+		}
+	}
+	tc.pruned++
+}
+
+type termCount struct {
+	Term  string `json:"term"`
+	Count int    `json:"count"`
+}
+
+func (tc *termCounter) top(k int) []termCount {
+	out := make([]termCount, 0, len(tc.counts))
+	for t, c := range tc.counts {
+		out = append(out, termCount{t, c})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Term < out[j].Term
+	})
+	if k > 0 && len(out) > k {
+		out = out[:k]
+	}
+	return out
+}
+
+func freqCmd(args []string) error {
+	fs := flag.NewFlagSet("freq", flag.ExitOnError)
+	n := fs.Int("n", 1, "n-gram size: 1 for words, 2 for bigrams, 3 for trigrams")
+	top := fs.Int("top", 100, "number of terms to report")
+	author := fs.String("author", "", "only count chunks by this author")
+	book := fs.Int("book", 0, "only count chunks from this file id")
+	keepStop := fs.Bool("keep-stopwords", false, "do not filter stopwords")
+	maxTerms := fs.Int("max-terms", 1000000, "most distinct terms held in memory before pruning rare ones")
+	asJSON := fs.Bool("json", false, "print results as json")
+	perBook := fs.Bool("per-book", false, "write each book's top terms into the book_terms table instead of printing")
+	fs.Parse(args)
+
+	if *n < 1 || *n > 3 {
+		return usagef("--n must be 1, 2 or 3")
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	q := "SELECT c.sourceid, c.chunk FROM chunks c JOIN files f ON f.id = c.sourceid WHERE 1=1"
+	qargs := []interface{}{}
+	if *author != "" {
+		norm, err := canonicalAuthor(db, *author)
+		if err != nil {
+			return err
+		}
+		q += " AND f.author_norm = ?"
+		qargs = append(qargs, norm)
+	}
+	if *book != 0 {
+		q += " AND c.sourceid = ?"
+		qargs = append(qargs, *book)
+	}
+	q += " ORDER BY c.sourceid, c.id"
+
+	if *perBook {
+		return bookTerms(db, q, qargs, *n, *top, !*keepStop, *maxTerms)
+	}
+
+	rows, err := db.Query(q, qargs...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	tc := newTermCounter(*maxTerms)
+	for rows.Next() {
+		var id int
+		var chunk string
+		if err = rows.Scan(&id, &chunk); err != nil {
+			return err
+		}
+		for _, t := range ngrams(words(chunk), *n, !*keepStop) {
+			tc.add(t)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if tc.pruned > 0 {
+		fmt.Fprintf(os.Stderr, "pruned rare terms %d times; counts are lower bounds\n", tc.pruned)
+	}
+
+	res := tc.top(*top)
+	if *asJSON {
+		return json.NewEncoder(os.Stdout).Encode(res)
+	}
+	for i, r := range res {
+		fmt.Printf("%4d %10d  %s\n", i+1, r.Count, r.Term)
+	}
+
+	return nil
+}
+
+// bookTerms counts each book separately and replaces its book_terms rows
+// with its top terms. Rows arrive ordered by sourceid so only one book is
+// counted at a time.
+func bookTerms(db *sql.DB, q string, qargs []interface{}, n, top int, skipStop bool, maxTerms int) error {
+	rows, err := db.Query(q, qargs...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type book struct {
+		id    int
+		terms []termCount
+	}
+	books := []book{}
+	cur := 0
+	tc := newTermCounter(maxTerms)
+	flush := func() {
+		if cur != 0 {
+			books = append(books, book{cur, tc.top(top)})
+		}
+	}
+	for rows.Next() {
+		var id int
+		var chunk string
+		if err = rows.Scan(&id, &chunk); err != nil {
+			return err
+		}
+		if id != cur {
+			flush()
+			cur = id
+			tc = newTermCounter(maxTerms)
+		}
+		for _, t := range ngrams(words(chunk), n, skipStop) {
+			tc.add(t)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	flush()
+	rows.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	del, err := tx.Prepare("DELETE FROM book_terms WHERE sourceid = ? AND n = ?")
+	if err != nil {
+		return err
+	}
+	defer del.Close()
+	ins, err := tx.Prepare("INSERT INTO book_terms (sourceid, n, term, count) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer ins.Close()
+
+	for _, b := range books {
+		if _, err = del.Exec(b.id, n); err != nil {
+			return err
+		}
+		for _, t := range b.terms {
+			if _, err = ins.Exec(b.id, n, t.Term, t.Count); err != nil {
+				return err
+			}
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	fmt.Printf("wrote top %d terms for %d books\n", top, len(books))
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package cli
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestWords(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want []string
+	}{
+		{"The Whale, the WHALE!", []string{"the", "whale", "the", "whale"}},
+		{"Don't—it’s O'Brien's 1851 'quoted'", []string{"don't", "it’s", "o'brien's", "1851", "quoted"}},
+		{"  ", []string{}},
+	} {
+		if got := words(c.in); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("words(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestNgrams(t *testing.T) {
+	ws := words("the old man and the sea")
+	for _, c := range []struct {
+		n        int
+		skipStop bool
+		want     []string
+	}{
+		{1, false, []string{"the", "old", "man", "and", "the", "sea"}},
+		{1, true, []string{"old", "man", "sea"}},
+		{2, true, []string{"the old", "old man", "man and", "the sea"}},
+		{3, false, []string{"the old man", "old man and", "man and the", "and the sea"}},
+	} {
+		if got := ngrams(ws, c.n, c.skipStop); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("ngrams(%d, %v) = %q, want %q", c.n, c.skipStop, got, c.want)
+		}
+	}
+}
+
+// The counts of a small corpus, pinned.
+func TestTermCounts(t *testing.T) {
+	tc := newTermCounter(0)
+	for _, chunk := range []string{
+		"Call me Ishmael. The whale, the white whale!",
+		"Ishmael saw the whale; the whale saw Ishmael.",
+	} {
+		for _, term := range ngrams(words(chunk), 1, true) {
+			tc.add(term)
+		}
+	}
+	want := []termCount{{"whale", 4}, {"ishmael", 3}, {"saw", 2}, {"call", 1}}
+	if got := tc.top(4); !reflect.DeepEqual(got, want) {
+		t.Errorf("top 4 = %v, want %v", got, want)
+	}
+	if tc.pruned != 0 {
+		t.Errorf("pruned %d times without a bound", tc.pruned)
+	}
+}
+
+// With far more distinct terms than it may hold, the counter stays within
+// its bound, and a frequent term keeps its exact count.
+func TestTermCounterBounded(t *testing.T) {
+	const max = 1000
+	tc := newTermCounter(max)
+	for i := 0; i < 100000; i++ {
+		tc.add(fmt.Sprintf("rare%d", i))
+		if i%100 == 0 {
+			tc.add("whale")
+		}
+		if len(tc.counts) > max {
+			t.Fatalf("holding %d terms, over %d", len(tc.counts), max)
+		}
+	}
+	if tc.pruned == 0 {
+		t.Error("never pruned")
+	}
+	if top := tc.top(1); len(top) != 1 || top[0] != (termCount{"whale", 1000}) {
+		t.Errorf("top = %v, want whale 1000", top)
+	}
+}
+
+func TestBookTerms(t *testing.T) {
+	db := testDB(t)
+	a := addBook(t, db, "Moby Dick", "Herman Melville", testBook("Moby Dick", "Call me Ishmael, for the whale was white, a whale of a whale, said he in the end."))
+	b := addBook(t, db, "Emma", "Jane Austen", testBook("Emma", "Emma Woodhouse, handsome, clever, and rich, with a comfortable home and happy disposition."))
+	if err := makeChunks(db, chunkOptions{minChunk: 10}); err != nil {
+		t.Fatal(err)
+	}
+	q := "SELECT c.sourceid, c.chunk FROM chunks c JOIN files f ON f.id = c.sourceid WHERE 1=1 ORDER BY c.sourceid, c.id"
+	if err := bookTerms(db, q, nil, 1, 2, true, 0); err != nil {
+		t.Fatal(err)
+	}
+	// twice, to see the rows are replaced
+	if err := bookTerms(db, q, nil, 1, 2, true, 0); err != nil {
+		t.Fatal(err)
+	}
+	got := map[int][]termCount{}
+	rows, err := db.Query("SELECT sourceid, term, count FROM book_terms WHERE n = 1 ORDER BY sourceid, count DESC, term")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var tc termCount
+		if err = rows.Scan(&id, &tc.Term, &tc.Count); err != nil {
+			t.Fatal(err)
+		}
+		got[id] = append(got[id], tc)
+	}
+	want := map[int][]termCount{
+		a: {{"whale", 3}, {"call", 1}},
+		b: {{"clever", 1}, {"comfortable", 1}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("book_terms %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,413 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"regexp/syntax"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The full text index is opt in: gutchunk index creates chunks_fts, an
+// external content FTS4 table over chunks, along with the triggers that keep
+// it in step with every later insert, update and delete. Building it is a
+// pass over the chunks there were when it began, up to fts_state.pass_end,
+// in batches of chunk ids, each committed with how far the pass has got in
+// fts_state.indexed_upto; a run stopped by --max-duration or anything else
+// goes on from there next time. The triggers only touch chunks outside the
+// stretch the pass has yet to index, so whatever inserts, updates or deletes
+// there meanwhile, re-chunking included, is indexed as it is once the pass
+// gets to it, and the index never holds a chunk twice or one since gone.
+//
+// Built with --translit, the index has a shadow, chunks_translit_fts,
+// holding the transliteration of every chunk with Cyrillic or Greek in it
+// (see translit.go), so /search finds them in Latin letters too. It is
+// built and kept in step alongside chunks_fts, by the same pass and
+// triggers of its own, and is as big again as what it indexes, which is
+// why it is left out unless asked for. It stays until index --drop.
+const ftsTable = `
+	CREATE VIRTUAL TABLE IF NOT EXISTS chunks_fts USING fts4(content="chunks", chunk, tokenize=unicode61 "remove_diacritics=2");
+	CREATE TABLE IF NOT EXISTS fts_state (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		indexed_upto INTEGER NOT NULL,
+		pass_end INTEGER NOT NULL
+	)`
+
+// ftsIndexed is whether the chunk with id col is in the index.
+const ftsIndexed = "(%[1]s <= (SELECT indexed_upto FROM fts_state) OR %[1]s > (SELECT pass_end FROM fts_state))"
+
+const translitFTSTable = `CREATE VIRTUAL TABLE IF NOT EXISTS chunks_translit_fts USING fts4(chunk, tokenize=unicode61 "remove_diacritics=2")`
+
+var ftsTriggers = fmt.Sprintf(`
+	CREATE TRIGGER chunks_fts_bu BEFORE UPDATE ON chunks WHEN %[1]s BEGIN
+		DELETE FROM chunks_fts WHERE docid = old.id;
+	END;
+	CREATE TRIGGER chunks_fts_bd BEFORE DELETE ON chunks WHEN %[1]s BEGIN
+		DELETE FROM chunks_fts WHERE docid = old.id;
+	END;
+	CREATE TRIGGER chunks_fts_au AFTER UPDATE ON chunks WHEN %[2]s BEGIN
+		INSERT INTO chunks_fts (docid, chunk) VALUES (new.id, new.chunk);
+	END;
+	CREATE TRIGGER chunks_fts_ai AFTER INSERT ON chunks WHEN %[2]s BEGIN
+		INSERT INTO chunks_fts (docid, chunk) VALUES (new.id, new.chunk);
+	END`, fmt.Sprintf(ftsIndexed, "old.id"), fmt.Sprintf(ftsIndexed, "new.id"))
+
+// translitTriggers keep the shadow in step as ftsTriggers do the index,
+// missing out chunks with nothing to transliterate.
+var translitTriggers = fmt.Sprintf(`
+	CREATE TRIGGER chunks_translit_fts_bu BEFORE UPDATE ON chunks WHEN %[1]s BEGIN
+		DELETE FROM chunks_translit_fts WHERE docid = old.id;
+	END;
+	CREATE TRIGGER chunks_translit_fts_bd BEFORE DELETE ON chunks WHEN %[1]s BEGIN
+		DELETE FROM chunks_translit_fts WHERE docid = old.id;
+	END;
+	CREATE TRIGGER chunks_translit_fts_au AFTER UPDATE ON chunks WHEN %[2]s BEGIN
+		%[3]s;
+	END;
+	CREATE TRIGGER chunks_translit_fts_ai AFTER INSERT ON chunks WHEN %[2]s BEGIN
+		%[3]s;
+	END`, fmt.Sprintf(ftsIndexed, "old.id"), fmt.Sprintf(ftsIndexed, "new.id"),
+	"INSERT INTO chunks_translit_fts (docid, chunk) SELECT new.id, t FROM (SELECT translit(new.chunk) AS t) WHERE t IS NOT NULL")
+
+const ftsDropTriggers = `
+	DROP TRIGGER IF EXISTS chunks_fts_bu;
+	DROP TRIGGER IF EXISTS chunks_fts_bd;
+	DROP TRIGGER IF EXISTS chunks_fts_au;
+	DROP TRIGGER IF EXISTS chunks_fts_ai;
+	DROP TRIGGER IF EXISTS chunks_translit_fts_bu;
+	DROP TRIGGER IF EXISTS chunks_translit_fts_bd;
+	DROP TRIGGER IF EXISTS chunks_translit_fts_au;
+	DROP TRIGGER IF EXISTS chunks_translit_fts_ai`
+
+const ftsDrop = ftsDropTriggers + `;
+	DROP TABLE IF EXISTS chunks_fts;
+	DROP TABLE IF EXISTS chunks_translit_fts;
+	DROP TABLE IF EXISTS fts_state`
+
+func indexCmd(args []string) error {
+	fs := flag.NewFlagSet("index", flag.ExitOnError)
+	drop := fs.Bool("drop", false, "remove the index and its triggers instead")
+	batch := fs.Int("batch", 10000, "chunks to index per transaction")
+	budget := fs.Duration("max-duration", 0, "stop after the batch running when this much time is up, to go on from there next run; 0 for no limit")
+	withTranslit := fs.Bool("translit", false, "also index the chunks' text transliterated into Latin letters, so /search finds Cyrillic and Greek text by it; about doubles the index")
+	space := spaceFlags(fs)
+	fs.Parse(args)
+	so, err := space()
+	if err != nil {
+		return err
+	}
+	if *batch < 1 {
+		return usagef("--batch must be at least 1")
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if *drop {
+		_, err = db.Exec(ftsDrop)
+		return err
+	}
+	if chunkShards > 0 {
+		return fmt.Errorf("the full text index doesn't work over chunks split into %d shards; move them back into the main database first with gutchunk shard --unshard", chunkShards)
+	}
+	if chunkLayout == chunksClustered {
+		return errors.New("the full text index doesn't work with the clustered layout, having no rowids to index by")
+	}
+	if chunkStorage == storageReference {
+		return errors.New("the full text index needs chunks to keep their text; convert them back first with gutchunk convert-storage --mode inline")
+	}
+
+	// the index and the journal of a batch run to about the chunks' size
+	// again
+	if err = checkSpace(dbFile(dsn), "building the full text index", so); err != nil {
+		return err
+	}
+	sw := watchSpace(runCtx, dbFile(dsn), so.minFree)
+	defer sw.stop()
+
+	upto, end, err := startFTSPass(sw.ctx, db, *withTranslit)
+	if err != nil {
+		return fmt.Errorf("could not build the index: %w", sw.err(err))
+	}
+	if upto == end {
+		fmt.Println("the full text index is up to date")
+		return nil
+	}
+	started := time.Now()
+	var indexed int
+	for upto < end {
+		n, to, err := indexFTSBatch(sw.ctx, db, upto, end, *batch)
+		if err != nil {
+			return fmt.Errorf("could not build the index: %w", sw.err(err))
+		}
+		indexed += n
+		upto = to
+		fmt.Printf("indexed chunks up to id %d of %d\n", upto, end)
+		if upto < end && *budget > 0 && time.Since(started) >= *budget {
+			left, err := countChunks(db, "%s WHERE id > ? AND id <= ?", upto, end)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("indexed %d chunks in %s, stopping with %d left; run gutchunk index again to go on\n", indexed, time.Since(started).Round(time.Second), left)
+			return nil
+		}
+	}
+
+	// merging the pass's segments into one is only worth it once
+	fmt.Println("optimizing the full text index")
+	shadow, err := hasTranslit(db)
+	if err != nil {
+		return err
+	}
+	for _, t := range ftsTables(shadow) {
+		if _, err = db.ExecContext(sw.ctx, fmt.Sprintf("INSERT INTO %[1]s (%[1]s) VALUES ('optimize')", t)); err != nil {
+			return fmt.Errorf("could not optimize the index: %w", sw.err(err))
+		}
+	}
+	fmt.Printf("indexed %d chunks in %s\n", indexed, time.Since(started).Round(time.Second))
+	return nil
+}
+
+// startFTSPass creates the index and its state if there are none, and the
+// shadow if withTranslit asks for it, puts the triggers in place and
+// reconciles the index with the chunks, returning how far the pass has got
+// and where it ends.
+func startFTSPass(ctx context.Context, db *sql.DB, withTranslit bool) (upto, end int, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	var legacy int
+	if err = tx.QueryRowContext(ctx, `SELECT count(*) FROM sqlite_master
+		WHERE name = 'chunks_fts' AND NOT EXISTS (SELECT 1 FROM sqlite_master WHERE name = 'fts_state')`).Scan(&legacy); err != nil {
+		return 0, 0, err
+	}
+	var max int
+	if err = tx.QueryRowContext(ctx, "SELECT coalesce(max(id), 0) FROM chunks").Scan(&max); err != nil {
+		return 0, 0, err
+	}
+	if _, err = tx.ExecContext(ctx, ftsTable); err != nil {
+		return 0, 0, err
+	}
+	// an index built before there was any state was kept whole by its
+	// triggers, which indexed every chunk
+	start := 0
+	if legacy > 0 {
+		start = max
+	}
+	if _, err = tx.ExecContext(ctx, "INSERT OR IGNORE INTO fts_state (id, indexed_upto, pass_end) VALUES (1, ?, ?)", start, max); err != nil {
+		return 0, 0, err
+	}
+	if err = tx.QueryRowContext(ctx, "SELECT indexed_upto, pass_end FROM fts_state").Scan(&upto, &end); err != nil {
+		return 0, 0, err
+	}
+	shadow, err := hasTranslit(tx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// rows of chunks that are gone, or that the pass is yet to reach, could
+	// only have been left by writes the triggers missed. Without the text
+	// they were indexed with they can't be taken out one by one, so the
+	// index starts over. So it does for a shadow asked for after the pass
+	// had begun, the chunks before it being indexed without one.
+	var stale int
+	for _, t := range ftsTables(shadow) {
+		var n int
+		if err = tx.QueryRowContext(ctx, `SELECT count(*) FROM `+t+`_docsize d
+			WHERE (d.docid > ? AND d.docid <= ?) OR NOT EXISTS (SELECT 1 FROM chunks c WHERE c.id = d.docid)`, upto, end).Scan(&n); err != nil {
+			return 0, 0, err
+		}
+		stale += n
+	}
+	restart := stale > 0
+	if stale > 0 {
+		fmt.Printf("the full text index holds %d rows it shouldn't; starting it over\n", stale)
+	} else if withTranslit && !shadow && upto > 0 {
+		fmt.Println("the full text index was built without --translit; starting it over")
+		restart = true
+	}
+	if restart {
+		for _, q := range []string{ftsDrop, ftsTable} {
+			if _, err = tx.ExecContext(ctx, q); err != nil {
+				return 0, 0, err
+			}
+		}
+		upto, end = 0, max
+		if _, err = tx.ExecContext(ctx, "INSERT INTO fts_state (id, indexed_upto, pass_end) VALUES (1, 0, ?)", max); err != nil {
+			return 0, 0, err
+		}
+	}
+	triggers := []string{ftsDropTriggers, ftsTriggers}
+	if shadow || withTranslit {
+		if _, err = tx.ExecContext(ctx, translitFTSTable); err != nil {
+			return 0, 0, err
+		}
+		triggers = append(triggers, translitTriggers)
+	}
+	for _, q := range triggers {
+		if _, err = tx.ExecContext(ctx, q); err != nil {
+			return 0, 0, err
+		}
+	}
+	return upto, end, tx.Commit()
+}
+
+// indexFTSBatch indexes up to batch of the chunks after upto and no later
+// than end, returning how many it indexed and the id it got to.
+func indexFTSBatch(ctx context.Context, db *sql.DB, upto, end, batch int) (int, int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+	to := end
+	err = tx.QueryRowContext(ctx, "SELECT id FROM chunks WHERE id > ? AND id <= ? ORDER BY id LIMIT 1 OFFSET ?", upto, end, batch-1).Scan(&to)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, err
+	}
+	res, err := tx.ExecContext(ctx, "INSERT INTO chunks_fts (docid, chunk) SELECT id, chunk FROM chunks WHERE id > ? AND id <= ?", upto, to)
+	if err != nil {
+		return 0, 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, 0, err
+	}
+	shadow, err := hasTranslit(tx)
+	if err != nil {
+		return 0, 0, err
+	}
+	if shadow {
+		_, err = tx.ExecContext(ctx, `INSERT INTO chunks_translit_fts (docid, chunk)
+			SELECT id, t FROM (SELECT id, translit(chunk) AS t FROM chunks WHERE id > ? AND id <= ?) WHERE t IS NOT NULL`, upto, to)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if _, err = tx.ExecContext(ctx, "UPDATE fts_state SET indexed_upto = ?", to); err != nil {
+		return 0, 0, err
+	}
+	return int(n), to, tx.Commit()
+}
+
+func hasFTS(db *sql.DB) (bool, error) {
+	var n int
+	err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE name = 'chunks_fts'").Scan(&n)
+	return n > 0, err
+}
+
+// hasTranslit reports whether the index has its transliterated shadow.
+func hasTranslit(q queryer) (bool, error) {
+	var n int
+	err := q.QueryRow("SELECT count(*) FROM sqlite_master WHERE name = 'chunks_translit_fts'").Scan(&n)
+	return n > 0, err
+}
+
+// ftsTables are the FTS tables of the index, with the shadow or without.
+func ftsTables(shadow bool) []string {
+	if shadow {
+		return []string{"chunks_fts", "chunks_translit_fts"}
+	}
+	return []string{"chunks_fts"}
+}
+
+// regexpTerms turns the literal text a regexp requires into an FTS query
+// that every match also satisfies, or "" when nothing can be required. A
+// literal only yields a term where it is known to hold a whole token, or
+// the start of one: "\bwhale[- ]?bone\b" gives "whale*" but not "bone",
+// which could be the tail of "whalebone".
+func regexpTerms(re *syntax.Regexp) string {
+	re = re.Simplify()
+	seq := []*syntax.Regexp{re}
+	if re.Op == syntax.OpConcat {
+		seq = re.Sub
+	}
+	for len(seq) == 1 && seq[0].Op == syntax.OpCapture {
+		seq = seq[0].Sub
+		if len(seq) == 1 && seq[0].Op == syntax.OpConcat {
+			seq = seq[0].Sub
+		}
+	}
+
+	terms := []string{}
+	for i, node := range seq {
+		if node.Op != syntax.OpLiteral {
+			continue
+		}
+		left := i > 0 && isBoundary(seq[i-1])
+		right := i+1 < len(seq) && isBoundary(seq[i+1])
+		terms = append(terms, literalTerms(string(node.Rune), left, right)...)
+	}
+	return strings.Join(terms, " ")
+}
+
+// isBoundary reports whether re can only match where a token ends: at a
+// word boundary, an end of the text, or on at least one non-word rune like
+// \s+ or [-,].
+func isBoundary(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpWordBoundary, syntax.OpBeginLine, syntax.OpBeginText, syntax.OpEndLine, syntax.OpEndText:
+		return true
+	case syntax.OpPlus, syntax.OpCapture:
+		return isBoundary(re.Sub[0])
+	case syntax.OpRepeat:
+		return re.Min > 0 && isBoundary(re.Sub[0])
+	case syntax.OpCharClass:
+		for i := 0; i < len(re.Rune); i += 2 {
+			for r := re.Rune[i]; r <= re.Rune[i+1]; r++ {
+				if isWordRune(r) {
+					return false
+				}
+				// a class this wide holds word runes somewhere
+				if r-re.Rune[i] > 256 {
+					return false
+				}
+			}
+		}
+		return len(re.Rune) > 0
+	}
+	return false
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// literalTerms splits lit into tokens the way the index does. Tokens with
+// a separator or boundary before them are terms, as prefixes unless a
+// separator or boundary follows too.
+func literalTerms(lit string, left, right bool) []string {
+	rs := []rune(lit)
+	terms := []string{}
+	for i := 0; i < len(rs); {
+		if !isWordRune(rs[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(rs) && isWordRune(rs[j]) {
+			j++
+		}
+		before := i > 0 || left
+		after := j < len(rs) || right
+		if before {
+			t := strings.ToLower(string(rs[i:j]))
+			if !after {
+				t += "*"
+			}
+			terms = append(terms, t)
+		}
+		i = j
+	}
+	return terms
+}
@@ -0,0 +1,106 @@
+package cli
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// ids is the ids query selects, in order.
+func ids(t *testing.T, db *sql.DB, query string, args ...interface{}) string {
+	t.Helper()
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got []string
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprint(id))
+	}
+	return strings.Join(got, " ")
+}
+
+// checkIndexed fails unless what the index finds for word is what it may
+// have found by now: chunks holding it as they are, none since gone or
+// changed, and all of those the pass has got past.
+func checkIndexed(t *testing.T, db *sql.DB, word, when string) {
+	t.Helper()
+	found := ids(t, db, "SELECT docid FROM chunks_fts WHERE chunks_fts MATCH ? ORDER BY docid", word)
+	want := ids(t, db, "SELECT id FROM chunks WHERE chunk LIKE '%' || ? || '%' AND "+fmt.Sprintf(ftsIndexed, "id")+" ORDER BY id", word)
+	if found != want {
+		t.Errorf("%s, the index finds %s in chunks [%s], want [%s]", when, word, found, want)
+	}
+}
+
+func TestIndexIncrementally(t *testing.T) {
+	rowidOnly(t, "the full text index")
+	db := testDB(t)
+	moby := addBook(t, db, "Moby-Dick", "Herman Melville", "")
+	for i := 0; i < 6; i++ {
+		insertChunk(t, db, moby, i, fmt.Sprintf("Chunk %d, of the whale.", i))
+	}
+	index := func(args ...string) string {
+		t.Helper()
+		out, err := captureStdout(t, func() error { return indexCmd(args) })
+		if err != nil {
+			t.Fatalf("index %s: %v", strings.Join(args, " "), err)
+		}
+		return out
+	}
+
+	// out of time after the first batch
+	if out := index("--batch", "2", "--max-duration", "1ns"); !strings.Contains(out, "indexed 2 chunks in 0s, stopping with 4 left") ||
+		strings.Contains(out, "optimizing") {
+		t.Errorf("the first pass printed %q", out)
+	}
+	checkIndexed(t, db, "whale", "a batch in")
+
+	// re-chunked between passes, both before and after where the pass got:
+	// the new chunks are given the ids the old ones had, and more
+	if _, err := db.Exec("DELETE FROM chunks WHERE sourceid = ?", moby); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		insertChunk(t, db, moby, i, fmt.Sprintf("Chunk %d, of the squid.", i))
+	}
+	checkIndexed(t, db, "whale", "re-chunked")
+	checkIndexed(t, db, "squid", "re-chunked")
+
+	if out := index("--batch", "2", "--max-duration", "1ns"); !strings.Contains(out, "indexed chunks up to id 4 of 6") {
+		t.Errorf("the second pass printed %q", out)
+	}
+	checkIndexed(t, db, "whale", "two batches in")
+	checkIndexed(t, db, "squid", "two batches in")
+
+	if out := index("--batch", "2"); !strings.Contains(out, "optimizing the full text index") {
+		t.Errorf("the last pass printed %q", out)
+	}
+	checkIndexed(t, db, "whale", "indexed")
+	checkIndexed(t, db, "squid", "indexed")
+	if got := ids(t, db, "SELECT docid FROM chunks_fts WHERE chunks_fts MATCH 'squid' ORDER BY docid"); got != "1 2 3 4 5 6 7 8" {
+		t.Errorf("the index finds squid in chunks %s, want every one", got)
+	}
+	if out := index(); !strings.Contains(out, "up to date") {
+		t.Errorf("indexing again printed %q", out)
+	}
+
+	// a row the triggers missed the taking out of starts the index over
+	if _, err := db.Exec("DROP TRIGGER chunks_fts_bd"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("DELETE FROM chunks WHERE id = 8"); err != nil {
+		t.Fatal(err)
+	}
+	if out := index(); !strings.Contains(out, "holds 1 rows it shouldn't; starting it over") {
+		t.Errorf("indexing with a stale row printed %q", out)
+	}
+	if got := ids(t, db, "SELECT docid FROM chunks_fts WHERE chunks_fts MATCH 'squid' ORDER BY docid"); got != "1 2 3 4 5 6 7" {
+		t.Errorf("started over, the index finds squid in chunks %s", got)
+	}
+}
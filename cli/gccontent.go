@@ -0,0 +1,259 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Every book keeps its content in files.content once chunked, and most
+// never need it again: their chunks hold their own text. gutchunk
+// gc-content clears the content of those books, as run --no-store-content
+// would have left it, a --batch of them to a transaction. A book's content
+// is cleared only when it has chunks, none of them stored in the reference
+// mode as where they are in it (see storage.go), and its content_hash,
+// which ingest and sources compare in its place, is recorded; removed
+// books are left to purge. Chunking such a book again, auditing its chunks
+// or exporting it with export-books can't be done without it, as for
+// books run --no-store-content ingested. A book whose content was moved to
+// the blob store (see blobs.go) is cleared of its blob, which is deleted
+// once no book has it. --dry-run reports what would be cleared.
+//
+// The space cleared stays the database's, free pages in its file, until a
+// vacuum gives it back. --vacuum does so with PRAGMA incremental_vacuum,
+// moving no more than it frees, in a database made with auto_vacuum set
+// to incremental as gutchunk makes them; an older one is turned over to it
+// once, by a full VACUUM, with gutchunk migrate --incremental-vacuum.
+
+// contentNotNeeded is whether the content of the book f can be cleared.
+func contentNotNeeded() string {
+	refs := ""
+	if chunkStorage == storageReference {
+		refs = " AND NOT EXISTS (SELECT 1 FROM chunk_refs r WHERE r.sourceid = f.id AND r.chunk IS NULL)"
+	}
+	return hasContent("f.") + ` AND f.content_hash IS NOT NULL AND f.deleted_at IS NULL
+		AND EXISTS (SELECT 1 FROM chunks c WHERE c.sourceid = f.id)` + refs
+}
+
+// gcReport is what gc-content cleared, or with --dry-run would have.
+type gcReport struct {
+	Books int   `json:"books"`
+	Bytes int64 `json:"bytes"`
+	// books keeping their content as chunks are stored as references into
+	// it
+	Referenced int `json:"referenced"`
+	// the space free in the database's file once cleared, and how much of
+	// it --vacuum gave back
+	Free     int64 `json:"free"`
+	Returned int64 `json:"returned"`
+	DryRun   bool  `json:"dry_run,omitempty"`
+}
+
+func gcContentCmd(args []string) error {
+	fs := flag.NewFlagSet("gc-content", flag.ExitOnError)
+	batch := fs.Int("batch", 500, "books cleared per transaction")
+	dryRun := fs.Bool("dry-run", false, "report what would be cleared, clearing nothing")
+	vacuum := fs.Bool("vacuum", false, "give the space cleared back to the filesystem with an incremental vacuum")
+	asJSON := fs.Bool("json", false, "print the report as json")
+	fs.Parse(args)
+
+	if fs.NArg() > 0 {
+		return usagef("usage: gutchunk gc-content [--batch N] [--dry-run] [--vacuum] [--json]")
+	}
+	if *batch < 1 {
+		return usagef("--batch must be at least 1")
+	}
+	if *dryRun && *vacuum {
+		return usagef("--vacuum gives back what was cleared, and --dry-run clears nothing")
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if *vacuum {
+		// found out before clearing anything, which can't be undone
+		if mode, err := autoVacuum(db); err != nil {
+			return err
+		} else if mode != autoVacuumIncremental {
+			return fmt.Errorf("the database was made without incremental vacuuming; turn it on once with gutchunk migrate --incremental-vacuum, or give the space back with a full VACUUM")
+		}
+	}
+
+	var rep gcReport
+	rep.DryRun = *dryRun
+	if chunkStorage == storageReference {
+		if err = db.QueryRow(`SELECT count(*) FROM files f WHERE ` + hasContent("f.") + ` AND f.deleted_at IS NULL
+			AND EXISTS (SELECT 1 FROM chunk_refs r WHERE r.sourceid = f.id AND r.chunk IS NULL)`).Scan(&rep.Referenced); err != nil {
+			return err
+		}
+	}
+	if *dryRun {
+		if err = db.QueryRow("SELECT count(*), coalesce(sum("+contentBytes("f.")+"), 0) FROM files f WHERE "+contentNotNeeded()).
+			Scan(&rep.Books, &rep.Bytes); err != nil {
+			return err
+		}
+	} else if rep.Books, rep.Bytes, err = clearContent(runCtx, db, *batch); err != nil {
+		return err
+	}
+	if rep.Free, err = freeBytes(db); err != nil {
+		return err
+	}
+	if *vacuum {
+		if err = incrementalVacuum(runCtx, db); err != nil {
+			return fmt.Errorf("could not vacuum: %w", err)
+		}
+		left, err := freeBytes(db)
+		if err != nil {
+			return err
+		}
+		rep.Returned = rep.Free - left
+	}
+
+	if *asJSON {
+		return json.NewEncoder(os.Stdout).Encode(rep)
+	}
+	verb := "cleared"
+	if rep.DryRun {
+		verb = "would clear"
+	}
+	fmt.Printf("%s the content of %d books (%s)\n", verb, rep.Books, formatSize(rep.Bytes))
+	if rep.Referenced > 0 {
+		fmt.Printf("kept the content of %d books whose chunks are stored as references into it\n", rep.Referenced)
+	}
+	if *vacuum {
+		fmt.Printf("gave %s back to the filesystem\n", formatSize(rep.Returned))
+	} else if !rep.DryRun {
+		fmt.Printf("%s of the database's file is free, for --vacuum to give back\n", formatSize(rep.Free))
+	}
+	return nil
+}
+
+// clearContent clears the content of the books that don't need it, batch
+// to a transaction, returning how many it cleared and the bytes they held.
+func clearContent(ctx context.Context, db *sql.DB, batch int) (int, int64, error) {
+	var total int
+	if err := db.QueryRowContext(ctx, "SELECT count(*) FROM files f WHERE "+contentNotNeeded()).Scan(&total); err != nil {
+		return 0, 0, err
+	}
+	books, bytes, last := 0, int64(0), int64(-1)
+	shown := time.Now()
+	for {
+		n, b, upto, err := clearBatch(ctx, db, last, batch)
+		if err != nil {
+			return books, bytes, fmt.Errorf("could not clear content: %w", err)
+		}
+		if upto < 0 {
+			return books, bytes, nil
+		}
+		books += n
+		bytes += b
+		last = upto
+		if time.Since(shown) >= 5*time.Second {
+			shown = time.Now()
+			fmt.Printf("cleared %d of %d books (%.0f%%)\n", books, total, 100*float64(books)/float64(total))
+		}
+	}
+}
+
+// clearBatch clears the content of the next batch books after book last
+// that don't need it, returning how many, the bytes they held and the
+// last of them, -1 when there were none left. Which books don't is asked
+// again inside the transaction, so a book chunked as references since the
+// run began keeps its content. The blobs of those in the blob store are
+// deleted once it commits, but for those another book has.
+func clearBatch(ctx context.Context, db *sql.DB, last int64, batch int) (int, int64, int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, -1, err
+	}
+	defer tx.Rollback()
+	var n int
+	var bytes int64
+	upto := int64(-1)
+	err = tx.QueryRowContext(ctx, `SELECT count(*), coalesce(sum(size), 0), coalesce(max(id), -1) FROM
+		(SELECT f.id, `+contentBytes("f.")+` AS size FROM files f
+			WHERE `+contentNotNeeded()+` AND f.id > ? ORDER BY f.id LIMIT ?)`, last, batch).Scan(&n, &bytes, &upto)
+	if err != nil || upto < 0 {
+		return 0, 0, upto, err
+	}
+	blobs, err := batchBlobs(ctx, tx, last, upto)
+	if err != nil {
+		return 0, 0, -1, err
+	}
+	if _, err = tx.ExecContext(ctx, `UPDATE files AS f SET content = NULL, content_blob = NULL, content_bytes = NULL
+		WHERE `+contentNotNeeded()+` AND f.id > ? AND f.id <= ?`, last, upto); err != nil {
+		return 0, 0, -1, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, 0, -1, err
+	}
+	for _, hash := range blobs {
+		if err = dropBlob(ctx, db, hash); err != nil {
+			return n, bytes, upto, err
+		}
+	}
+	return n, bytes, upto, nil
+}
+
+// batchBlobs are the blobs of the books clearBatch clears between last
+// and upto.
+func batchBlobs(ctx context.Context, tx *sql.Tx, last, upto int64) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT DISTINCT f.content_blob FROM files f
+		WHERE `+contentNotNeeded()+` AND f.content_blob IS NOT NULL AND f.id > ? AND f.id <= ?`, last, upto)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var blobs []string
+	for rows.Next() {
+		var hash string
+		if err = rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, hash)
+	}
+	return blobs, rows.Err()
+}
+
+// incrementalVacuum gives every free page of the database back. The pragma
+// frees a page each step, so it is stepped through as a query rather than
+// run once.
+func incrementalVacuum(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, "PRAGMA incremental_vacuum")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	return rows.Err()
+}
+
+// auto_vacuum's incremental mode, as PRAGMA auto_vacuum gives it
+const autoVacuumIncremental = 2
+
+func autoVacuum(db queryer) (int, error) {
+	var mode int
+	err := db.QueryRow("PRAGMA auto_vacuum").Scan(&mode)
+	return mode, err
+}
+
+// freeBytes is the space free in the database's file, in pages kept for
+// reuse.
+func freeBytes(db queryer) (int64, error) {
+	var pages, size int64
+	if err := db.QueryRow("PRAGMA freelist_count").Scan(&pages); err != nil {
+		return 0, err
+	}
+	if err := db.QueryRow("PRAGMA page_size").Scan(&size); err != nil {
+		return 0, err
+	}
+	return pages * size, nil
+}
@@ -0,0 +1,189 @@
+package cli
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// gcLibrary is a file database of books gc-content should clear, and of
+// each kind of book it shouldn't, returning the ids of those it should.
+func gcLibrary(t *testing.T) (*sql.DB, []int) {
+	t.Helper()
+	db := testFileDB(t)
+	book := func(title string, chunked bool) int {
+		t.Helper()
+		id := addBook(t, db, title, "", testBook(title, testParagraphs(40)))
+		if chunked {
+			insertChunk(t, db, id, 0, "A chunk of "+title+".")
+		}
+		return id
+	}
+	clear := []int{book("Chunked", true)}
+	if _, err := db.Exec("UPDATE files SET content_hash = NULL WHERE id = ?", book("Unhashed", true)); err != nil {
+		t.Fatal(err)
+	}
+	book("Unchunked", false)
+	if _, err := db.Exec("UPDATE files SET deleted_at = 1 WHERE id = ?", book("Removed", true)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE files SET content = NULL WHERE id = ?", book("Cleared", true)); err != nil {
+		t.Fatal(err)
+	}
+	clear = append(clear, book("Chunked too", true))
+	return db, clear
+}
+
+// kept is the ids of the books of db with content, a line each.
+func kept(t *testing.T, db *sql.DB) string {
+	t.Helper()
+	return names(t, db, "SELECT id FROM files f WHERE "+hasContent("f.")+" ORDER BY id")
+}
+
+func TestGCContent(t *testing.T) {
+	db, clear := gcLibrary(t)
+	var bytes int64
+	if err := db.QueryRow(fmt.Sprintf("SELECT sum(length(content)) FROM files WHERE id IN (%d, %d)", clear[0], clear[1])).Scan(&bytes); err != nil {
+		t.Fatal(err)
+	}
+	gc := func(args ...string) (string, error) {
+		t.Helper()
+		return captureStdout(t, func() error { return gcContentCmd(args) })
+	}
+	before := kept(t, db)
+
+	// --dry-run clears nothing
+	out, err := gc("--dry-run")
+	if want := fmt.Sprintf("would clear the content of 2 books (%s)\n", formatSize(bytes)); err != nil || out != want {
+		t.Errorf("gc-content --dry-run: %v, printing\n%s\nwant\n%s", err, out, want)
+	}
+	if got := kept(t, db); got != before {
+		t.Errorf("gc-content --dry-run cleared books:\n%s", lineDiff(before, got))
+	}
+
+	// a book a batch, exactly those that don't need their content
+	if out, err = gc("--batch", "1"); err != nil ||
+		!strings.HasPrefix(out, fmt.Sprintf("cleared the content of 2 books (%s)\n", formatSize(bytes))) ||
+		!strings.HasSuffix(out, " of the database's file is free, for --vacuum to give back\n") {
+		t.Errorf("gc-content --batch 1: %v, printing\n%s", err, out)
+	}
+	if got, want := kept(t, db), "2\n3\n4\n"; got != want {
+		t.Errorf("gc-content left the content of\n%s\nwant\n%s", got, want)
+	}
+	var hashes int
+	if err = db.QueryRow(fmt.Sprintf("SELECT count(content_hash) FROM files WHERE id IN (%d, %d)", clear[0], clear[1])).Scan(&hashes); err != nil || hashes != 2 {
+		t.Errorf("the books cleared kept %d hashes (%v)", hashes, err)
+	}
+	if got := names(t, db, "SELECT chunk FROM chunks ORDER BY id"); !strings.HasPrefix(got, "A chunk of Chunked.\n") || strings.Count(got, "\n") != 5 {
+		t.Errorf("gc-content changed the chunks:\n%s", got)
+	}
+
+	// and again, with nothing left to clear, gives the space back
+	free, err := freeBytes(db)
+	if err != nil || free == 0 {
+		t.Fatalf("the database has %d bytes free (%v)", free, err)
+	}
+	out, err = gc("--vacuum", "--json")
+	var rep gcReport
+	if err != nil || json.Unmarshal([]byte(out), &rep) != nil {
+		t.Fatalf("gc-content --vacuum --json: %v, printing\n%s", err, out)
+	}
+	if rep.Books != 0 || rep.Free != free || rep.Returned != free {
+		t.Errorf("gc-content --vacuum reported %+v, with %d bytes free", rep, free)
+	}
+	if left, err := freeBytes(db); err != nil || left != 0 {
+		t.Errorf("after gc-content --vacuum, %d bytes are free (%v)", left, err)
+	}
+
+	for _, args := range [][]string{{"books"}, {"--batch", "0"}, {"--dry-run", "--vacuum"}} {
+		if _, err = gc(args...); exitCode(err) != exitUsage {
+			t.Errorf("gc-content %s: %v, want a usage error", strings.Join(args, " "), err)
+		}
+	}
+}
+
+func TestGCContentOlderDatabase(t *testing.T) {
+	db, _ := gcLibrary(t)
+	// as made before gutchunk set auto_vacuum
+	if _, err := db.Exec("PRAGMA auto_vacuum = NONE"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("VACUUM"); err != nil {
+		t.Fatal(err)
+	}
+	before := kept(t, db)
+	if _, err := captureStdout(t, func() error { return gcContentCmd([]string{"--vacuum"}) }); err == nil ||
+		!strings.Contains(err.Error(), "gutchunk migrate --incremental-vacuum") {
+		t.Errorf("gc-content --vacuum without incremental vacuuming: %v", err)
+	}
+	if got := kept(t, db); got != before {
+		t.Errorf("gc-content --vacuum, refused, cleared books:\n%s", lineDiff(before, got))
+	}
+
+	migrate := func() string {
+		t.Helper()
+		out, err := captureStdout(t, func() error { return migrateCmd([]string{"--incremental-vacuum", "--force"}) })
+		if err != nil {
+			t.Fatalf("migrate --incremental-vacuum: %v", err)
+		}
+		return out
+	}
+	if out := migrate(); !strings.HasSuffix(out, "turned on incremental vacuuming\n") {
+		t.Errorf("migrate --incremental-vacuum printed\n%s", out)
+	}
+	// as a connection opened since sees it
+	again, err := openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	if mode, err := autoVacuum(again); err != nil || mode != autoVacuumIncremental {
+		t.Errorf("after migrate --incremental-vacuum, auto_vacuum is %d (%v)", mode, err)
+	}
+	if out := migrate(); !strings.HasSuffix(out, "incremental vacuuming is on already\n") {
+		t.Errorf("migrate --incremental-vacuum again printed\n%s", out)
+	}
+	if out, err := captureStdout(t, func() error { return gcContentCmd([]string{"--vacuum"}) }); err != nil ||
+		!strings.HasPrefix(out, "cleared the content of 2 books (") || !strings.Contains(out, "gave ") {
+		t.Errorf("gc-content --vacuum, once migrated: %v, printing\n%s", err, out)
+	}
+}
+
+func TestGCContentReferences(t *testing.T) {
+	db := testFileDB(t)
+	for i := 1; i <= 3; i++ {
+		title := fmt.Sprint("Book ", i)
+		addBook(t, db, title, "", testBook(title, testParagraphs(3)))
+	}
+	if _, err := captureStdout(t, func() error { return makeChunks(db, chunkOptions{}) }); err != nil {
+		t.Fatal(err)
+	}
+	// every chunk of book 3 no longer what its content gives, so stored
+	// whole
+	if _, err := db.Exec("UPDATE chunks SET chunk = 'Changed by hand.' WHERE sourceid = 3"); err != nil {
+		t.Fatal(err)
+	}
+	inline := storedTexts(t, db)
+	if _, err := captureStdout(t, func() error { return convertStorageCmd([]string{"--mode", storageReference}) }); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := captureStdout(t, func() error { return gcContentCmd(nil) })
+	if err != nil || !strings.HasPrefix(out, "cleared the content of 1 books (") ||
+		!strings.Contains(out, "\nkept the content of 2 books whose chunks are stored as references into it\n") {
+		t.Errorf("gc-content of references: %v, printing\n%s", err, out)
+	}
+	refs, err := openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer refs.Close()
+	if got := kept(t, refs); got != "1\n2\n" {
+		t.Errorf("gc-content left the content of\n%s", got)
+	}
+	if got := storedTexts(t, refs); got != inline {
+		t.Errorf("after gc-content, the chunks read otherwise:\n%s", lineDiff(inline, got))
+	}
+}
@@ -0,0 +1,250 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"unicode/utf8"
+)
+
+type grepOptions struct {
+	names nameQuery
+	lang  string
+	// with lang, also books with no language or und
+	undetermined bool
+	// match folded text, see fold
+	fold bool
+	// FTS query every match satisfies, "" to scan every chunk
+	terms string
+	count bool
+	color bool
+	// also search the chunks of versions superseded by a re-release
+	superseded bool
+	// only the chunks --filter's expression keeps, nil for all
+	filter *chunkFilter
+}
+
+func grepCmd(args []string) error {
+	fs := flag.NewFlagSet("grep", flag.ExitOnError)
+	var opts grepOptions
+	fs.BoolVar(&opts.fold, "i", false, "match without regard to case or diacritics")
+	fs.BoolVar(&opts.count, "c", false, "only print the number of matching chunks")
+	author := fs.String("author", "", "only search books by this author, by the starts of words of their name")
+	title := fs.String("title", "", "only search books with this title, by the starts of its words")
+	fs.StringVar(&opts.lang, "lang", "", "only search books in this language, by code (en) or name (English)")
+	fs.BoolVar(&opts.undetermined, "include-undetermined", false, "with --lang, also books with no language or und")
+	color := fs.String("color", "auto", "highlight matches: auto, always or never")
+	noIndex := fs.Bool("no-index", false, "scan every chunk even where the full text index could narrow it down")
+	fs.BoolVar(&opts.superseded, "include-superseded", false, "also search the chunks of book versions a re-release superseded")
+	filter := filterFlag(fs, map[string][]string{"author": {"author", "not_author"}, "lang": {"language", "include_undetermined"},
+		"include-undetermined": {"include_undetermined"}})
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: gutchunk grep [flags] PATTERN")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return usagef("grep needs one pattern")
+	}
+	pattern := fs.Arg(0)
+	if opts.fold {
+		pattern = "(?i)" + pattern
+	}
+	parsed, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return err
+	}
+	if opts.fold {
+		foldPattern(parsed)
+	}
+	re, err := regexp.Compile(parsed.String())
+	if err != nil {
+		return err
+	}
+	switch *color {
+	case "always":
+		opts.color = true
+	case "auto":
+		fi, err := os.Stdout.Stat()
+		opts.color = err == nil && fi.Mode()&os.ModeCharDevice != 0
+	case "never":
+	default:
+		return usagef("--color must be auto, always or never")
+	}
+	opts.names = parseNameQuery(*author, *title)
+	opts.lang = normalizeLanguages(opts.lang)
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if opts.filter, err = filter(db); err != nil {
+		return err
+	}
+	if !*noIndex {
+		indexed, err := hasFTS(db)
+		if err != nil {
+			return err
+		}
+		if indexed {
+			// the index folds terms itself
+			opts.terms = regexpTerms(parsed)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	n, err := grepChunks(ctx, db, re, opts, out)
+	if ctx.Err() != nil {
+		out.Flush()
+		fmt.Fprintf(os.Stderr, "interrupted after %d matching chunks\n", n)
+		return exitStatus(exitCancelled)
+	}
+	if err != nil {
+		return err
+	}
+	if opts.count {
+		fmt.Fprintln(out, n)
+	}
+	// like grep, finding nothing is exit status 1
+	if n == 0 {
+		return exitStatus(1)
+	}
+	return nil
+}
+
+// grepMatcher finds a regexp's matches in text, or with fold in the text
+// folded, giving their offsets in the text as it was.
+type grepMatcher struct {
+	re   *regexp.Regexp
+	fold bool
+}
+
+func (m grepMatcher) find(s string) [][]int {
+	if !m.fold {
+		return m.re.FindAllStringIndex(s, -1)
+	}
+	folded, at := foldIndexed(s)
+	locs := m.re.FindAllStringIndex(folded, -1)
+	for _, loc := range locs {
+		loc[0], loc[1] = at[loc[0]], at[loc[1]]
+	}
+	return locs
+}
+
+func (m grepMatcher) match(s string) bool {
+	if m.fold {
+		s = fold(s)
+	}
+	return m.re.MatchString(s)
+}
+
+// grepChunks streams chunks in id order through re, writing each matching
+// line, and returns how many chunks matched. The rows are read from one
+// query as they come, so memory doesn't grow with the corpus.
+func grepChunks(ctx context.Context, db *sql.DB, re *regexp.Regexp, opts grepOptions, w io.Writer) (int, error) {
+	m := grepMatcher{re, opts.fold}
+	names, args := opts.names.where()
+	q := `SELECT c.id, c.chunk, coalesce(f.name, '')
+		FROM chunks c JOIN files f ON f.id = c.sourceid
+		WHERE ` + names + ` AND (? = '' OR ',' || f.language || ',' LIKE '%,' || ? || ',%' OR ? AND ` + undeterminedLanguage + `)
+			AND (? OR ` + activeVersion + `)`
+	args = append(args, opts.lang, opts.lang, opts.undetermined && opts.lang != "", opts.superseded)
+	if opts.filter != nil {
+		q += " AND (" + filterConds + ")"
+		args = append(args, opts.filter.args()...)
+	}
+	if opts.terms != "" {
+		q += " AND c.id IN (SELECT docid FROM chunks_fts WHERE chunks_fts MATCH ?)"
+		args = append(args, opts.terms)
+	}
+	rows, err := db.QueryContext(ctx, q+" ORDER BY c.id", args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		var id int
+		var chunk, title string
+		if err = rows.Scan(&id, &chunk, &title); err != nil {
+			return n, err
+		}
+		if !m.match(chunk) {
+			continue
+		}
+		n++
+		if opts.count {
+			continue
+		}
+		printed := false
+		for _, line := range strings.Split(chunk, "\n") {
+			if locs := m.find(line); locs != nil {
+				fmt.Fprintf(w, "%d %s: %s\n", id, title, matchWindow(line, locs, opts.color))
+				printed = true
+			}
+		}
+		// the match spans a line break
+		if !printed {
+			fmt.Fprintf(w, "%d %s: %s\n", id, title, strings.ReplaceAll(matchWindow(chunk, m.find(chunk), opts.color), "\n", " "))
+		}
+	}
+	return n, rows.Err()
+}
+
+// context kept either side of the first match on a line
+const grepContext = 80
+
+// matchWindow clips a line to the text around its first match, of the
+// matches at locs, and highlights the matches left in it.
+func matchWindow(line string, locs [][]int, color bool) string {
+	loc := locs[0]
+	start, end := 0, len(line)
+	prefix, suffix := "", ""
+	if loc[0] > grepContext {
+		start = loc[0] - grepContext
+		for start < loc[0] && !utf8.RuneStart(line[start]) {
+			start++
+		}
+		prefix = "…"
+	}
+	if end-loc[1] > grepContext {
+		end = loc[1] + grepContext
+		for end > loc[1] && !utf8.RuneStart(line[end]) {
+			end--
+		}
+		suffix = "…"
+	}
+	if !color {
+		return prefix + line[start:end] + suffix
+	}
+	var b strings.Builder
+	at := start
+	for _, l := range locs {
+		if l[0] < at || l[1] > end || l[0] == l[1] {
+			continue
+		}
+		b.WriteString(line[at:l[0]])
+		b.WriteString("\x1b[1;31m" + line[l[0]:l[1]] + "\x1b[0m")
+		at = l[1]
+	}
+	b.WriteString(line[at:end])
+	return prefix + b.String() + suffix
+}
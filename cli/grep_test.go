@@ -0,0 +1,149 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"testing"
+)
+
+// grepCorpus holds chunks each pattern in TestGrepIndexedAsScanned tells
+// apart by what the index tokenizes and the regexp doesn't: words joined
+// and hyphenated, in capitals and with diacritics, matches in the middle of
+// a word and across a line break.
+var grepCorpus = map[string][]string{
+	"Moby-Dick": {
+		"Call me Ishmael. Some years ago, never mind how long precisely.",
+		"The stays were of whalebone, and the whale-bone creaked.",
+		"A whale bone lay on the beach,\nbleached white.",
+		"WHALE BONE, said the sign above the door.",
+		"The whales sang, and a bone was thrown.",
+		"The narwhale bone is a tusk.",
+	},
+	"Café Society": {
+		"They met at the café on the corner.",
+		"The cafe was shut on Sundays; the CAFÉ was not.",
+		"Cafés lined the rue, and a whale\nbone hung in one.",
+		"Nothing of note happened on the boulevard that day.",
+	},
+}
+
+// indexChunks builds the full text index over db's chunks, as gutchunk
+// index does.
+func indexChunks(t *testing.T, db *sql.DB) {
+	t.Helper()
+	rowidOnly(t, "the full text index")
+	ctx := context.Background()
+	upto, end, err := startFTSPass(ctx, db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for upto < end {
+		if _, upto, err = indexFTSBatch(ctx, db, upto, end, 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// compileGrep compiles pattern as grep does, returning it parsed too.
+func compileGrep(t *testing.T, pattern string, fold bool) (*regexp.Regexp, *syntax.Regexp) {
+	t.Helper()
+	if fold {
+		pattern = "(?i)" + pattern
+	}
+	parsed, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fold {
+		foldPattern(parsed)
+	}
+	return regexp.MustCompile(parsed.String()), parsed
+}
+
+func TestGrepIndexedAsScanned(t *testing.T) {
+	db := testDB(t)
+	for title, chunks := range grepCorpus {
+		id := addBook(t, db, title, "Someone", "")
+		for i, c := range chunks {
+			insertChunk(t, db, id, i, c)
+		}
+	}
+	indexChunks(t, db)
+
+	for _, c := range []struct {
+		pattern string
+		fold    bool
+		// the terms the index narrows the scan by
+		terms string
+	}{
+		{`\bwhale[- ]?bone\b`, false, "whale*"},
+		{`\bwhale[- ]?bone\b`, true, "whale*"},
+		{`\bwhale\s+bone\b`, false, "whale bone"},
+		{`whale`, false, ""},
+		{`\bbone\b`, false, "bone"},
+		{`^Call me\b`, false, "call me"},
+		{`\bcafé\b`, false, "café"},
+		{`\bcafe\b`, true, "cafe"},
+		{`\bcaf`, true, "caf*"},
+		{`\bnothing\b`, false, "nothing"},
+		{`\bwhale bone\b`, false, "whale bone"},
+	} {
+		re, parsed := compileGrep(t, c.pattern, c.fold)
+		opts := grepOptions{fold: c.fold}
+		var scanned bytes.Buffer
+		n, err := grepChunks(context.Background(), db, re, opts, &scanned)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opts.terms = regexpTerms(parsed); opts.terms != c.terms {
+			t.Errorf("%s: the index is queried for %q, want %q", c.pattern, opts.terms, c.terms)
+		}
+		var indexed bytes.Buffer
+		m, err := grepChunks(context.Background(), db, re, opts, &indexed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m != n || indexed.String() != scanned.String() {
+			t.Errorf("%s (fold %v): %d chunks with the index:\n%s\nand %d scanning them all:\n%s", c.pattern, c.fold, m, indexed.String(), n, scanned.String())
+		}
+	}
+}
+
+func TestGrepCount(t *testing.T) {
+	db := testDB(t)
+	id := addBook(t, db, "Moby-Dick", "Herman Melville", "")
+	for i, c := range grepCorpus["Moby-Dick"] {
+		insertChunk(t, db, id, i, c)
+	}
+	re, _ := compileGrep(t, `bone`, false)
+	var out bytes.Buffer
+	n, err := grepChunks(context.Background(), db, re, grepOptions{count: true}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// all but Ishmael's and the sign's, in capitals
+	if n != 4 || out.Len() != 0 {
+		t.Errorf("-c counted %d chunks and printed %q, want 4 and nothing", n, out.String())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = grepChunks(ctx, db, re, grepOptions{}, &out); err == nil {
+		t.Error("a scan cancelled before it began was no error")
+	}
+}
+
+func TestMatchWindow(t *testing.T) {
+	line := strings.Repeat("x ", 60) + "whale" + strings.Repeat(" y", 60)
+	got := matchWindow(line, [][]int{{120, 125}}, false)
+	if !strings.HasPrefix(got, "…") || !strings.HasSuffix(got, "…") || len(got) != 80+5+80+2*len("…") {
+		t.Errorf("matchWindow clipped to %q", got)
+	}
+	if got = matchWindow("a whale", [][]int{{2, 7}}, true); got != "a \x1b[1;31mwhale\x1b[0m" {
+		t.Errorf("matchWindow highlighted %q", got)
+	}
+}
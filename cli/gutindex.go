@@ -0,0 +1,243 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// GUTINDEX.ALL is Project Gutenberg's index in plain text: a line for each
+// ebook giving its title, author and number, newest first, one file where
+// the catalog is tens of thousands of RDF files. gutchunk gutindex --file
+// GUTINDEX.ALL reads it into the gutindex table, and the books with those
+// ebook numbers are given its titles and authors as a source of their own,
+// trusted over their headers but under the catalog (see names.go), and its
+// languages over their headers' and detected ones, but not over meta's.
+// It marks only the languages of books not in English, so a book it gives
+// none keeps what it had.
+//
+// The format has drifted over the decades the file covers. An entry is a
+// line starting at the margin and ending in the ebook number, with a C
+// after it for a copyrighted one; the older sections start it with the
+// month it was posted, "Dec 2003", and give a filename in brackets before
+// the number, "[lnpetxxx.xxx]". Lines indented under an entry go on with
+// it: a title or author too long for one line, or notes in brackets, like
+// [Subtitle: ...] and [Language: French], one of which may itself run
+// over several lines. A note saying an entry is an audio book marks it as
+// one, and its names are kept but given to no book, as its number is of
+// the recording. The title is what comes before the last ", by ", the
+// author what comes after. The preamble, everything before the first
+// "TITLE and AUTHOR" heading, is passed over, and so are the section
+// headings; any other line that isn't part of an entry is reported with
+// its number, and the rest of the file read as ever.
+
+// gutindexShown is how many of the lines gutindex couldn't read it prints.
+const gutindexShown = 20
+
+var (
+	gutindexEntry   = regexp.MustCompile(`^(\S.*?)\s+(\d{1,6})C?$`)
+	gutindexPosted  = regexp.MustCompile(`^(?:Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Oct|Nov|Dec)[a-z]*\.?\s+\d{4}\s+`)
+	gutindexFile    = regexp.MustCompile(`\[(?:#\d+|[\w-]*x*\.[\w-]*x*)\]`)
+	gutindexNote    = regexp.MustCompile(`\[([^\]]*)\]|\(([^)]*\baudio\b[^)]*)\)`)
+	gutindexAudio   = regexp.MustCompile(`(?i)\baudio\b`)
+	gutindexBy      = regexp.MustCompile(`,\s+by\s+`)
+	gutindexHeading = regexp.MustCompile(`(?i)^(?:title and author\b|~ ~ ~|<==|[-=*~ ]+$)`)
+)
+
+// gutindexRecord is one ebook of GUTINDEX.ALL.
+type gutindexRecord struct {
+	ebook                   int
+	title, author, language string
+	audio                   bool
+}
+
+// gutindexSkip is a line of GUTINDEX.ALL that is part of no entry.
+type gutindexSkip struct {
+	line int
+	text string
+}
+
+// parseGutindex reads the entries of GUTINDEX.ALL, or an excerpt of it,
+// the first for each ebook only, the file listing corrections before what
+// they correct, and the lines it couldn't read.
+func parseGutindex(r io.Reader) ([]gutindexRecord, []gutindexSkip, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	var lines []string
+	listings := -1
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), " \t\r")
+		if listings < 0 && strings.HasPrefix(strings.ToUpper(strings.TrimSpace(line)), "TITLE AND AUTHOR") {
+			listings = len(lines)
+		}
+		lines = append(lines, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, nil, err
+	}
+	// an excerpt without the heading is listings throughout
+	if listings < 0 {
+		listings = 0
+	}
+
+	var recs []gutindexRecord
+	var skipped []gutindexSkip
+	seen := map[int]bool{}
+	var entry []string
+	ebook := 0
+	finish := func() {
+		if entry != nil && !seen[ebook] {
+			seen[ebook] = true
+			recs = append(recs, gutindexFields(ebook, strings.Join(entry, " ")))
+		}
+		entry = nil
+	}
+	for i := listings; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			finish()
+		case strings.HasPrefix(trimmed, "<==End of GUTINDEX"):
+			finish()
+			return recs, skipped, nil
+		case gutindexHeading.MatchString(trimmed):
+			finish()
+		case line[0] == ' ' || line[0] == '\t':
+			if entry == nil {
+				skipped = append(skipped, gutindexSkip{i + 1, trimmed})
+				continue
+			}
+			entry = append(entry, trimmed)
+		default:
+			finish()
+			m := gutindexEntry.FindStringSubmatch(gutindexPosted.ReplaceAllString(line, ""))
+			if m == nil {
+				skipped = append(skipped, gutindexSkip{i + 1, trimmed})
+				continue
+			}
+			ebook, _ = strconv.Atoi(m[2])
+			entry = []string{m[1]}
+		}
+	}
+	finish()
+	return recs, skipped, nil
+}
+
+// gutindexFields makes an entry's text, its lines joined, into its record.
+func gutindexFields(ebook int, text string) gutindexRecord {
+	rec := gutindexRecord{ebook: ebook}
+	text = gutindexFile.ReplaceAllString(text, "")
+	text = gutindexNote.ReplaceAllStringFunc(text, func(note string) string {
+		body := strings.TrimSpace(note[1 : len(note)-1])
+		if k, v, ok := strings.Cut(body, ":"); ok && strings.EqualFold(strings.TrimSpace(k), "language") {
+			rec.language = normalizeLanguages(v)
+		}
+		if gutindexAudio.MatchString(body) {
+			rec.audio = true
+		}
+		return " "
+	})
+	// a note the file cuts off
+	if i := strings.IndexByte(text, '['); i >= 0 {
+		text = text[:i]
+	}
+	if strings.HasPrefix(strings.ToLower(text), "audio:") {
+		rec.audio, text = true, text[len("audio:"):]
+	}
+	text = strings.Join(strings.Fields(text), " ")
+	if loc := gutindexBy.FindAllStringIndex(text, -1); loc != nil {
+		last := loc[len(loc)-1]
+		rec.title, rec.author = text[:last[0]], text[last[1]:]
+	} else {
+		rec.title = text
+	}
+	rec.title = strings.TrimRight(strings.TrimSpace(rec.title), ",")
+	rec.author = strings.TrimRight(strings.TrimSpace(rec.author), ",")
+	return rec
+}
+
+func gutindexCmd(args []string) error {
+	fs := flag.NewFlagSet("gutindex", flag.ExitOnError)
+	file := fs.String("file", "", "the GUTINDEX.ALL to read, or an excerpt of it")
+	dryRun := fs.Bool("dry-run", false, "read the file and say what it holds, without writing")
+	fs.Parse(args)
+
+	if fs.NArg() > 0 || *file == "" {
+		return usagef("usage: gutchunk gutindex --file GUTINDEX.ALL [--dry-run]")
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	recs, skipped, err := parseGutindex(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("could not read %s: %w", *file, err)
+	}
+	for i, s := range skipped {
+		if i == gutindexShown {
+			fmt.Fprintf(os.Stderr, "and %d more\n", len(skipped)-i)
+			break
+		}
+		fmt.Fprintf(os.Stderr, "%s:%d: not an entry: %s\n", *file, s.line, clip(s.text, 80))
+	}
+	languages, audio := 0, 0
+	for _, r := range recs {
+		if r.language != "" {
+			languages++
+		}
+		if r.audio {
+			audio++
+		}
+	}
+	fmt.Printf("read %d ebooks from %s, %d with a language and %d of them audio books; %d lines were part of no entry\n",
+		len(recs), *file, languages, audio, len(skipped))
+	if len(recs) == 0 {
+		return exitStatus(1)
+	}
+	if *dryRun {
+		return nil
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`INSERT INTO gutindex (ebook, title, author, language, audio, updated_at) VALUES (?, ?, ?, ?, ?, datetime('now'))
+		ON CONFLICT (ebook) DO UPDATE SET title = excluded.title, author = excluded.author, language = excluded.language,
+			audio = excluded.audio, updated_at = excluded.updated_at`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, r := range recs {
+		if _, err = stmt.Exec(r.ebook, nullString(r.title), nullString(r.author), nullString(r.language), r.audio); err != nil {
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	n, err := resolveNames(context.Background(), db)
+	if err != nil {
+		return fmt.Errorf("could not choose books' names: %w", err)
+	}
+	fmt.Println(n)
+	return nil
+}
@@ -0,0 +1,198 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// gutindexExcerpt is GUTINDEX.ALL cut down: its preamble, a section of
+// the new format with notes, a language, a title running over two lines,
+// a correction listed before what it corrects and an audio book, and one
+// of the old, with posting dates and filenames, and lines of neither.
+const gutindexExcerpt = `GUTINDEX.ALL
+
+This is the index of Project Gutenberg eBooks, 1 2 3 and so on
+    those in brackets are notes.
+
+TITLE and AUTHOR                                                     EBOOK NO.
+
+Le Comte de Monte-Cristo, Tome I, by Alexandre Dumas                     17989
+ [Language: French]
+
+The Life and Most Surprising Adventures of Robinson Crusoe, of York,     12623
+ Mariner, by Daniel Defoe
+ [Subtitle: Who lived Eight and Twenty Years, all alone in an
+  un-inhabited Island on the Coast of America]
+
+Memoirs of Fanny Hill, by John Cleland                                   25305
+ [Subtitle: A New and Genuine Edition from the Original Text]
+
+Audio: The Art of War, by Sun Tzu                                        20292
+
+The Hound of the Baskervilles, by Arthur Conan Doyle                     2852C
+
+A stray line no entry has
+  and an indented one after it
+
+Fanny Hill, by John Cleland                                              25305
+
+~ ~ ~ ~ Posting Dates for the below eBooks:  1 Dec 2003 to 31 Dec 2003 ~ ~ ~ ~
+
+Dec 2003 Pride and Prejudice, by Jane Austen                [pandpXXx.xxx] 1342
+Dec 2003 Faust, Erster Teil, by Johann Wolfgang von Goethe   [7fau1xxx.xxx] 2229
+         [Language: German]
+Dec 2003 The War of the Worlds, by H. G. Wells                 [#36]         36
+         (Read by the LibriVox volunteers, an audio book)
+
+<==End of GUTINDEX.ALL==>
+
+Never read, 1
+`
+
+func TestParseGutindex(t *testing.T) {
+	recs, skipped, err := parseGutindex(strings.NewReader(gutindexExcerpt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []gutindexRecord{
+		{ebook: 17989, title: "Le Comte de Monte-Cristo, Tome I", author: "Alexandre Dumas", language: "fr"},
+		{ebook: 12623, title: "The Life and Most Surprising Adventures of Robinson Crusoe, of York, Mariner", author: "Daniel Defoe"},
+		{ebook: 25305, title: "Memoirs of Fanny Hill", author: "John Cleland"},
+		{ebook: 20292, title: "The Art of War", author: "Sun Tzu", audio: true},
+		{ebook: 2852, title: "The Hound of the Baskervilles", author: "Arthur Conan Doyle"},
+		{ebook: 1342, title: "Pride and Prejudice", author: "Jane Austen"},
+		{ebook: 2229, title: "Faust, Erster Teil", author: "Johann Wolfgang von Goethe", language: "de"},
+		{ebook: 36, title: "The War of the Worlds", author: "H. G. Wells", audio: true},
+	}
+	if len(recs) != len(want) {
+		t.Fatalf("parseGutindex read %+v", recs)
+	}
+	for i := range want {
+		if recs[i] != want[i] {
+			t.Errorf("entry %d is %+v, want %+v", i+1, recs[i], want[i])
+		}
+	}
+	// a stray line, and lines indented under it, are reported and the
+	// rest read
+	if want := []gutindexSkip{{23, "A stray line no entry has"}, {24, "and an indented one after it"}}; !reflect.DeepEqual(skipped, want) {
+		t.Errorf("parseGutindex passed over %+v, want %+v", skipped, want)
+	}
+
+	// an excerpt without its heading is entries throughout
+	recs, skipped, err = parseGutindex(strings.NewReader("Emma, by Jane Austen        158\n\nnot an entry\n"))
+	if err != nil || len(recs) != 1 || recs[0] != (gutindexRecord{ebook: 158, title: "Emma", author: "Jane Austen"}) ||
+		!reflect.DeepEqual(skipped, []gutindexSkip{{3, "not an entry"}}) {
+		t.Errorf("parseGutindex of an excerpt: %+v, passing over %+v (%v)", recs, skipped, err)
+	}
+}
+
+func TestGutindexFields(t *testing.T) {
+	for text, want := range map[string]gutindexRecord{
+		"Anonymous Works":                                        {title: "Anonymous Works"},
+		"A Tale, by Him, by the Other":                           {title: "A Tale, by Him", author: "the Other"},
+		"Poems, by Emily Dickinson [Editor: Higginson] [Illustr": {title: "Poems", author: "Emily Dickinson"},
+		"Storia, by Dante [Language: Italian and Latin]":         {title: "Storia", author: "Dante", language: "it,la"},
+		"Hamlet (An audio reading), by William Shakespeare,":     {title: "Hamlet", author: "William Shakespeare", audio: true},
+	} {
+		if got := gutindexFields(0, text); got != want {
+			t.Errorf("gutindexFields(%q) = %+v, want %+v", text, got, want)
+		}
+	}
+}
+
+func TestGutindexCmd(t *testing.T) {
+	db := testDB(t)
+	for _, b := range []struct {
+		title, author string
+		ebook         int
+	}{
+		{"Monte Cristo", "Dumas", 17989},
+		{"Pride & Prejudice", "J. Austen", 1342},
+		{"The Art of War", "Sunzi", 20292},
+		{"Hamlet", "Shakespeare", 1524},
+	} {
+		id := addBook(t, db, b.title, b.author, "")
+		if _, err := db.Exec("UPDATE files SET ebook = ?, language = 'en', language_source = 'header' WHERE id = ?", b.ebook, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the catalog goes over it
+	if _, err := db.Exec("INSERT INTO catalog (ebook, title, author) VALUES (1342, 'Pride and Prejudice: A Novel', 'Austen, Jane')"); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "GUTINDEX.ALL")
+	if err := os.WriteFile(path, []byte(gutindexExcerpt), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	run := func(args ...string) (string, string, error) {
+		t.Helper()
+		var out string
+		errs, err := captureStderr(t, func() error {
+			var err error
+			out, err = captureStdout(t, func() error { return gutindexCmd(args) })
+			return err
+		})
+		return out, errs, err
+	}
+
+	read := "read 8 ebooks from " + path + ", 2 with a language and 2 of them audio books; 2 lines were part of no entry\n"
+	out, errs, err := run("--file", path, "--dry-run")
+	if err != nil || out != read || errs != path+":23: not an entry: A stray line no entry has\n"+path+":24: not an entry: and an indented one after it\n" {
+		t.Errorf("gutindex --dry-run: %v, printing\n%s\nand on stderr\n%s", err, out, errs)
+	}
+	if got := names(t, db, "SELECT count(*) FROM gutindex"); got != "0\n" {
+		t.Errorf("gutindex --dry-run wrote %s entries", got)
+	}
+
+	if out, _, err = run("--file", path); err != nil || !strings.HasPrefix(out, read+"titled 0 books by meta, 1 by the catalog, 1 by GUTINDEX.ALL and 2 by their headers, renaming 2; ") ||
+		!strings.HasSuffix(out, "; gave 1 books GUTINDEX.ALL's languages\n") {
+		t.Errorf("gutindex: %v, printing\n%s", err, out)
+	}
+	// over the header, under the catalog, and never of an audio book
+	want := []string{
+		"Le Comte de Monte-Cristo, Tome I / Alexandre Dumas (gutindex, gutindex)",
+		"Pride and Prejudice: A Novel / Jane Austen (catalog, catalog)",
+		"The Art of War / Sunzi (header, header)",
+		"Hamlet / Shakespeare (header, header)",
+	}
+	if got := shownNames(t, db); !reflect.DeepEqual(got, want) {
+		t.Errorf("the books are shown as\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if got := names(t, db, "SELECT language || ' ' || language_source FROM files ORDER BY id"); got != "fr gutindex\nen header\nen header\nen header\n" {
+		t.Errorf("the languages are\n%s", got)
+	}
+	if got := names(t, db, "SELECT ebook || ' ' || audio FROM gutindex WHERE audio ORDER BY ebook"); got != "36 1\n20292 1\n" {
+		t.Errorf("the audio books are\n%s", got)
+	}
+
+	// read again, it changes nothing, and meta's language stands
+	if _, err = db.Exec("UPDATE files SET language = 'it', language_source = ? WHERE id = 1", langMeta); err != nil {
+		t.Fatal(err)
+	}
+	if out, _, err = run("--file", path); err != nil || !strings.Contains(out, "renaming 0") || strings.Contains(out, "languages") {
+		t.Errorf("gutindex again: %v, printing\n%s", err, out)
+	}
+	if got := names(t, db, "SELECT language FROM files WHERE id = 1"); got != "it\n" {
+		t.Errorf("meta's language is now %s", got)
+	}
+
+	// a file of no entries is an error, and so is none
+	empty := filepath.Join(t.TempDir(), "empty")
+	if err = os.WriteFile(empty, []byte("TITLE and AUTHOR\n\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if out, _, err = run("--file", empty); exitCode(err) != 1 || !strings.HasPrefix(out, "read 0 ebooks from ") {
+		t.Errorf("gutindex of no entries: %v, printing\n%s", err, out)
+	}
+	for _, args := range [][]string{{}, {"--file", path, "more"}} {
+		if _, _, err = run(args...); exitCode(err) != exitUsage {
+			t.Errorf("gutindex %s: %v, want a usage error", strings.Join(args, " "), err)
+		}
+	}
+	if _, _, err = run("--file", filepath.Join(t.TempDir(), "nonesuch")); err == nil {
+		t.Error("gutindex of a file there isn't succeeded")
+	}
+}
@@ -0,0 +1,347 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// bookHeader returns the raw header of book id, from the header column or,
+// for books ingested before it was kept, from the content.
+func bookHeader(q queryer, id int) (string, error) {
+	var header, content sql.NullString
+	err := q.QueryRow("SELECT header, CASE WHEN header IS NULL THEN "+contentCol("")+" END FROM files WHERE id = ? AND deleted_at IS NULL", id).
+		Scan(&header, &content)
+	if err != nil {
+		return "", err
+	}
+	if header.Valid {
+		return header.String, nil
+	}
+	return rawHeader(content.String), nil
+}
+
+func headerCmd(args []string) error {
+	fs := flag.NewFlagSet("header", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return usagef("usage: gutchunk header <file id>")
+	}
+	id, err := strconv.Atoi(fs.Arg(0))
+	if err != nil {
+		return usagef("bad file id %q", fs.Arg(0))
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	header, err := bookHeader(db, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("no file %d", id)
+	}
+	if err != nil {
+		return err
+	}
+	if header == "" {
+		return fmt.Errorf("file %d has no header", id)
+	}
+	fmt.Print(header)
+	return nil
+}
+
+// handleBookHeader serves a book's raw header.
+func (s *server) handleBookHeader(w http.ResponseWriter, id int) {
+	var header string
+	err := s.w.interactiveRead(func(db *sql.DB) error {
+		var err error
+		header, err = bookHeader(db, id)
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		httpError(w, http.StatusNotFound, "no such book")
+		return
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"id": id, "header": header})
+}
+
+func reparseHeadersCmd(args []string) error {
+	fs := flag.NewFlagSet("reparse-headers", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "print what would change without changing it")
+	fs.Parse(args)
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if !*dryRun {
+		if err = startRun(db, "reparse-headers"); err != nil {
+			return err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	filled, err := fillHeaders(tx)
+	if err != nil {
+		return fmt.Errorf("could not fill in headers: %w", err)
+	}
+	changed, curated, err := reparseHeaders(tx, *dryRun)
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		fmt.Printf("would update %d books\n", changed)
+		return nil
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	if filled > 0 {
+		fmt.Printf("stored headers for %d books ingested before headers were kept\n", filled)
+	}
+	fmt.Printf("updated %d books; left %d curated by meta import alone\n", changed, curated)
+	n, err := resolveNames(context.Background(), db)
+	if err != nil {
+		return fmt.Errorf("could not choose books' names: %w", err)
+	}
+	fmt.Println(n)
+	if changed > 0 {
+		fmt.Println("run gutchunk refresh-stats to count changed authors")
+	}
+	return nil
+}
+
+// restatusHeaderless sets the metadata_status of books without a header,
+// which reparseHeaders has nothing to parse for, from their content, where
+// it isn't set yet.
+func restatusHeaderless(tx *sql.Tx, dryRun bool) error {
+	rows, err := tx.Query("SELECT id FROM files WHERE coalesce(header, '') = '' AND metadata_status IS NULL AND deleted_at IS NULL")
+	if err != nil {
+		return err
+	}
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || dryRun {
+		return err
+	}
+	for _, id := range ids {
+		var content string
+		if err = tx.QueryRow("SELECT coalesce("+contentCol("")+", '') FROM files WHERE id = ?", id).Scan(&content); err != nil {
+			return err
+		}
+		title, author := extractNameAuthor(*bytes.NewBufferString(content))
+		if err = setMetadataStatus(tx, int64(id), metadataStatus("", title, author)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fillHeaders stores the headers of books ingested before they were kept,
+// reading their content one at a time.
+func fillHeaders(tx *sql.Tx) (int, error) {
+	rows, err := tx.Query("SELECT id FROM files WHERE header IS NULL AND " + hasContent("") + " AND deleted_at IS NULL")
+	if err != nil {
+		return 0, err
+	}
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		header, err := bookHeader(tx, id)
+		if err != nil {
+			return 0, err
+		}
+		if _, err = tx.Exec("UPDATE files SET header = ? WHERE id = ?", header, id); err != nil {
+			return 0, err
+		}
+	}
+	return len(ids), nil
+}
+
+// files.metadata_status: what extractNameAuthor found in a book's header
+const (
+	metadataOK       = "ok"
+	metadataNoTitle  = "no_title"
+	metadataNoAuthor = "no_author"
+	metadataNoHeader = "no_header"
+)
+
+var metadataStatuses = []string{metadataOK, metadataNoTitle, metadataNoAuthor, metadataNoHeader}
+
+// metadataStatus is the metadata_status of a book with header, "" for
+// none, of which extractNameAuthor found title and author. A book without
+// a header is only no_header when they weren't found above its text
+// either.
+func metadataStatus(header, title, author string) string {
+	switch {
+	case header == "" && title == "" && author == "":
+		return metadataNoHeader
+	case title == "":
+		return metadataNoTitle
+	case author == "":
+		return metadataNoAuthor
+	}
+	return metadataOK
+}
+
+// reparseHeaders runs the metadata parsers over every stored header and
+// updates the title, author and language they find, and the ebook number
+// where the archive name gave none. What a parser doesn't find is left as
+// it is, as are books whose metadata was curated with meta import, and
+// the title or author of a book showing another source's (see names.go),
+// though what was found is recorded as the header's. It returns the number
+// of books changed and left alone. Each book's metadata_status and
+// contributors are set again from what was found, curated or not.
+func reparseHeaders(tx *sql.Tx, dryRun bool) (int, int, error) {
+	var curated int
+	if err := tx.QueryRow("SELECT count(*) FROM files WHERE id IN (SELECT file_id FROM book_meta)").Scan(&curated); err != nil {
+		return 0, 0, err
+	}
+	if err := restatusHeaderless(tx, dryRun); err != nil {
+		return 0, 0, err
+	}
+
+	type book struct {
+		id, ebook           int
+		title, author, lang string
+		langSource          string
+		status              string
+	}
+	rows, err := tx.Query(`SELECT id, coalesce(ebook, 0), coalesce(name, ''), coalesce(author, ''), coalesce(language, ''),
+			coalesce(language_source, ''), coalesce(metadata_status, ''), id IN (SELECT file_id FROM book_meta), header,
+			coalesce(title_source, '') IN ('', ?), coalesce(author_source, '') IN ('', ?)
+		FROM files WHERE header != '' AND deleted_at IS NULL`, nameHeader, nameHeader)
+	if err != nil {
+		return 0, 0, err
+	}
+	changes := []book{}
+	statuses := []book{}
+	var found [][3]interface{}
+	credits := map[int][]contributor{}
+	for rows.Next() {
+		var b book
+		var isCurated, titleShown, authorShown bool
+		var header string
+		if err = rows.Scan(&b.id, &b.ebook, &b.title, &b.author, &b.lang, &b.langSource, &b.status, &isCurated, &header, &titleShown, &authorShown); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		title, author := extractNameAuthor(*bytes.NewBufferString(header))
+		if status := metadataStatus(header, title, author); status != b.status {
+			b.status = status
+			statuses = append(statuses, b)
+		}
+		credits[b.id] = headerContributors(header)
+		if isCurated {
+			continue
+		}
+		was := b
+		if title != "" {
+			found = append(found, [3]interface{}{b.id, "title", title})
+			if titleShown {
+				b.title = title
+			}
+		}
+		if author != "" {
+			found = append(found, [3]interface{}{b.id, "author", author})
+			if authorShown {
+				b.author = author
+			}
+		}
+		if l := headerLanguage([]byte(header)); l != "" && b.langSource != langGutindex {
+			b.lang, b.langSource = l, langHeader
+		}
+		if b.ebook == 0 {
+			b.ebook = headerEbookNumber([]byte(header))
+		}
+		if b == was {
+			continue
+		}
+		if dryRun {
+			fmt.Printf("%d: %q by %q (%s, ebook %d) -> %q by %q (%s, ebook %d)\n", b.id,
+				was.title, was.author, was.lang, was.ebook, b.title, b.author, b.lang, b.ebook)
+		}
+		changes = append(changes, b)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	if dryRun {
+		if len(statuses) > 0 {
+			fmt.Printf("would set the metadata status of %d books\n", len(statuses))
+		}
+		return len(changes), curated, nil
+	}
+	for _, b := range statuses {
+		if err = setMetadataStatus(tx, int64(b.id), b.status); err != nil {
+			return 0, 0, err
+		}
+	}
+	if len(statuses) > 0 {
+		fmt.Printf("set the metadata status of %d books\n", len(statuses))
+	}
+	for _, f := range found {
+		if _, err = tx.Exec(upsertNameSource, f[0], f[1], nameHeader, f[2]); err != nil {
+			return 0, 0, err
+		}
+	}
+	for id, cs := range credits {
+		if err = saveHeaderContributors(tx, int64(id), cs); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	stmt, err := tx.Prepare("UPDATE files SET name = ?, author = ?, author_norm = ?, title_norm = ?, language = ?, language_source = nullif(?, ''), ebook = ?, " +
+		"title_source = coalesce(title_source, 'header'), author_source = coalesce(author_source, 'header') WHERE id = ?")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer stmt.Close()
+	for _, b := range changes {
+		if _, err = stmt.Exec(b.title, b.author, normalizeAuthor(b.author), normalizeTitle(b.title), b.lang, b.langSource, nullInt(b.ebook), b.id); err != nil {
+			return 0, 0, err
+		}
+		if err = saveNameWords(tx, int64(b.id), normalizeAuthor(b.author), normalizeTitle(b.title)); err != nil {
+			return 0, 0, err
+		}
+	}
+	return len(changes), curated, nil
+}
@@ -0,0 +1,102 @@
+package cli
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const moonstone = "The Project Gutenberg EBook of The Moonstone, by Wilkie Collins\n\n" +
+	"Title: The Moonstone\n\nAuthor: Wilkie Collins\n\nRelease Date: January 1994 [EBook #155]\n\nLanguage: English\n\n"
+
+// ingestMoonstone ingests a book with a full header, returning its id and
+// the header kept.
+func ingestMoonstone(t *testing.T) (*sql.DB, int, string) {
+	t.Helper()
+	db := testDB(t)
+	root := t.TempDir()
+	file := filepath.Join(root, "1", "5", "155", "155.zip")
+	content := moonstone + "*** START OF THIS PROJECT GUTENBERG EBOOK THE MOONSTONE ***\n\n" + testParagraphs(3) +
+		"\n\n*** END OF THIS PROJECT GUTENBERG EBOOK THE MOONSTONE ***\n"
+	writeTestZip(t, file, zipEntry{"155.txt", content})
+	if err := ingestOne(db, root, file, "1/5/155/155.zip", ingestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	var id int
+	var header string
+	if err := db.QueryRow("SELECT id, coalesce(header, '') FROM files").Scan(&id, &header); err != nil {
+		t.Fatal(err)
+	}
+	return db, id, header
+}
+
+func TestIngestKeepsHeader(t *testing.T) {
+	db, id, header := ingestMoonstone(t)
+	if !strings.HasPrefix(header, "The Project Gutenberg EBook of The Moonstone") || !strings.Contains(header, "Author: Wilkie Collins") {
+		t.Errorf("the header kept is %q", header)
+	}
+	if strings.Contains(header, "START OF") || strings.Contains(header, "paragraph of the book") {
+		t.Errorf("the header kept runs into the text: %q", header)
+	}
+
+	w := httptest.NewRecorder()
+	testServer(t, db).routes().ServeHTTP(w, httptest.NewRequest("GET", fmt.Sprintf("/books/%d/header", id), nil))
+	var got struct {
+		Header string `json:"header"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || w.Code != http.StatusOK || got.Header != header {
+		t.Errorf("/books/%d/header: %d %s", id, w.Code, w.Body)
+	}
+
+	// a book ingested before headers were kept has its header read from
+	// its content, and stored by reparse-headers
+	if _, err := db.Exec("UPDATE files SET header = NULL"); err != nil {
+		t.Fatal(err)
+	}
+	if h, err := bookHeader(db, id); err != nil || h != header {
+		t.Errorf("the header read from the content is %q, %v, want %q", h, err, header)
+	}
+	if _, err := captureStdout(t, func() error { return reparseHeadersCmd(nil) }); err != nil {
+		t.Fatal(err)
+	}
+	var stored sql.NullString
+	if err := db.QueryRow("SELECT header FROM files WHERE id = ?", id).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.String != header {
+		t.Errorf("reparse-headers stored the header %+v, want %q", stored, header)
+	}
+}
+
+func TestReparseHeaders(t *testing.T) {
+	db, id, _ := ingestMoonstone(t)
+	if _, err := db.Exec("UPDATE files SET name = '', author = 'Anonymous' WHERE id = ?", id); err != nil {
+		t.Fatal(err)
+	}
+	named := func() string {
+		var name, author string
+		if err := db.QueryRow("SELECT name, author FROM files WHERE id = ?", id).Scan(&name, &author); err != nil {
+			t.Fatal(err)
+		}
+		return name + " by " + author
+	}
+
+	out, err := captureStdout(t, func() error { return reparseHeadersCmd([]string{"--dry-run"}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, `"" by "Anonymous"`) || !strings.Contains(out, "would update 1 books") || named() != " by Anonymous" {
+		t.Errorf("--dry-run printed %q and left %q", out, named())
+	}
+	if _, err = captureStdout(t, func() error { return reparseHeadersCmd(nil) }); err != nil {
+		t.Fatal(err)
+	}
+	if got := named(); got != "The Moonstone by Wilkie Collins" {
+		t.Errorf("reparsed to %q, want it named from its header again", got)
+	}
+}
@@ -0,0 +1,249 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// A mirror picks up things of its owner's, notes, scripts and partial
+// downloads, that aren't the mirror's. A .gutchunkignore file in any
+// directory of it has patterns, as a .gitignore has, for what under that
+// directory ingest, run and coverage leave out: a pattern with a slash
+// but at its end goes by the path from the file's directory, "/" at its
+// start anchoring it there, one without by the name at any depth; a
+// trailing slash matches only directories, "*" and "?" don't match a
+// slash, "**" matches any directories, and "!" keeps again what a line
+// before it ignores. The last line matching a path decides it, of the
+// deepest file with one that does, so a deeper file overrides those above
+// it; and as in git, nothing under an ignored directory can be kept
+// again, the walk not going into it. explain shows the file and line that
+// decided an archive.
+
+const ignoreFileName = ".gutchunkignore"
+
+type ignorePattern struct {
+	line    int
+	text    string
+	negate  bool
+	dirOnly bool
+	re      *regexp.Regexp
+}
+
+// ignoreMatch is the line of an ignore file that decided a path.
+type ignoreMatch struct {
+	file    string
+	line    int
+	pattern string
+	// false for a ! line, keeping what a line before it ignores
+	ignored bool
+}
+
+func (m *ignoreMatch) String() string {
+	return fmt.Sprintf("%s:%d: %s", m.file, m.line, m.pattern)
+}
+
+// ignoreRules are the ignore files of the mirror at root, each read the
+// first time a path under its directory is looked up.
+type ignoreRules struct {
+	root  string
+	files map[string][]ignorePattern
+}
+
+func newIgnoreRules(root string) *ignoreRules {
+	return &ignoreRules{root: filepath.Clean(root), files: map[string][]ignorePattern{}}
+}
+
+// patterns are those of dir's ignore file, none when it has none.
+func (r *ignoreRules) patterns(dir string) ([]ignorePattern, error) {
+	if ps, ok := r.files[dir]; ok {
+		return ps, nil
+	}
+	ps, err := readIgnoreFile(filepath.Join(dir, ignoreFileName))
+	if err != nil {
+		return nil, err
+	}
+	r.files[dir] = ps
+	return ps, nil
+}
+
+func readIgnoreFile(file string) ([]ignorePattern, error) {
+	bs, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	ps := []ignorePattern{}
+	for i, line := range strings.Split(string(bs), "\n") {
+		p, err := parseIgnoreLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", file, i+1, err)
+		}
+		if p != nil {
+			p.line = i + 1
+			ps = append(ps, *p)
+		}
+	}
+	return ps, nil
+}
+
+// parseIgnoreLine reads a line of an ignore file, nil for a blank line or
+// a comment.
+func parseIgnoreLine(line string) (*ignorePattern, error) {
+	line = strings.TrimSuffix(line, "\r")
+	// trailing spaces are dropped unless escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+	p := &ignorePattern{text: line}
+	glob := line
+	if strings.HasPrefix(glob, "!") {
+		p.negate = true
+		glob = glob[1:]
+	}
+	if strings.HasSuffix(glob, "/") {
+		p.dirOnly = true
+		glob = strings.TrimRight(glob, "/")
+	}
+	if glob == "" {
+		return nil, nil
+	}
+	// a slash anywhere but the end anchors the pattern to the file's
+	// directory
+	prefix := "(?:.*/)?"
+	if strings.Contains(glob, "/") {
+		prefix = ""
+		glob = strings.TrimPrefix(glob, "/")
+	}
+	re, err := regexp.Compile("^" + prefix + ignoreGlobRegexp(glob) + "$")
+	if err != nil {
+		return nil, fmt.Errorf("bad pattern %q", line)
+	}
+	p.re = re
+	return p, nil
+}
+
+// ignoreGlobRegexp is the regexp matching the paths glob does, as
+// gitignore has it.
+func ignoreGlobRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**") && (i == 0 || glob[i-1] == '/'):
+			switch rest := glob[i+2:]; {
+			case rest == "":
+				b.WriteString(".*")
+				i++
+			case rest[0] == '/':
+				b.WriteString("(?:.*/)?")
+				i += 2
+			default:
+				b.WriteString("[^/]*")
+				i++
+			}
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := classEnd(glob, i)
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, "/", "") + "]")
+			i = end
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	return b.String()
+}
+
+// classEnd is where the bracket expression opening at glob[i] closes, -1
+// when it doesn't, a "]" first in it being one of its characters.
+func classEnd(glob string, i int) int {
+	j := i + 1
+	if j < len(glob) && (glob[j] == '!' || glob[j] == '^') {
+		j++
+	}
+	if j < len(glob) && glob[j] == ']' {
+		j++
+	}
+	if end := strings.IndexByte(glob[j:], ']'); end >= 0 {
+		return j + end
+	}
+	return -1
+}
+
+// match is the line deciding path, a directory when dir is set, as the
+// ignore files of its own directory and those above it up to root have
+// it; nil when none has a line matching it, and for root and what isn't
+// under it.
+func (r *ignoreRules) match(path string, dir bool) (*ignoreMatch, error) {
+	return r.matchParts(r.rel(path), dir)
+}
+
+// ignored is match for a file looked up on its own rather than come to by
+// a walk, which would have left it out with any ignored directory above
+// it.
+func (r *ignoreRules) ignored(path string) (*ignoreMatch, error) {
+	parts := r.rel(path)
+	for k := 1; k < len(parts); k++ {
+		m, err := r.matchParts(parts[:k], true)
+		if err != nil || m != nil && m.ignored {
+			return m, err
+		}
+	}
+	return r.matchParts(parts, false)
+}
+
+// rel is path from root, by its parts; nil for root and what isn't under
+// it.
+func (r *ignoreRules) rel(path string) []string {
+	root := r.root
+	if filepath.IsAbs(path) != filepath.IsAbs(root) {
+		path, _ = filepath.Abs(path)
+		root, _ = filepath.Abs(root)
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil
+	}
+	return strings.Split(filepath.ToSlash(rel), "/")
+}
+
+func (r *ignoreRules) matchParts(parts []string, dir bool) (*ignoreMatch, error) {
+	for k := len(parts) - 1; k >= 0; k-- {
+		in := filepath.Join(append([]string{r.root}, parts[:k]...)...)
+		ps, err := r.patterns(in)
+		if err != nil {
+			return nil, err
+		}
+		sub := strings.Join(parts[k:], "/")
+		for i := len(ps) - 1; i >= 0; i-- {
+			p := ps[i]
+			if p.dirOnly && !dir || !p.re.MatchString(sub) {
+				continue
+			}
+			return &ignoreMatch{file: filepath.Join(in, ignoreFileName), line: p.line, pattern: p.text, ignored: !p.negate}, nil
+		}
+	}
+	return nil, nil
+}
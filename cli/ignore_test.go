@@ -0,0 +1,194 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseIgnoreLine(t *testing.T) {
+	for _, c := range []struct {
+		pattern string
+		match   []string
+		miss    []string
+	}{
+		// without a slash, the name at any depth
+		{"*.zip", []string{"a.zip", "1/2/a.zip"}, []string{"a.zip.part"}},
+		{"notes", []string{"notes", "1/notes"}, []string{"notes.txt"}},
+		// with one, the path from the file's directory
+		{"/a.zip", []string{"a.zip"}, []string{"1/a.zip"}},
+		{"1/a.zip", []string{"1/a.zip"}, []string{"2/1/a.zip", "a.zip"}},
+		{"1/*", []string{"1/a.zip"}, []string{"1/2/a.zip"}},
+		{"**/a.zip", []string{"a.zip", "1/2/a.zip"}, []string{"b.zip"}},
+		{"1/**", []string{"1/a.zip", "1/2/3"}, []string{"1", "2/1/a"}},
+		{"1/**/a.zip", []string{"1/a.zip", "1/2/3/a.zip"}, []string{"2/a.zip"}},
+		{"?.zip", []string{"1.zip"}, []string{"12.zip", "/.zip"}},
+		{"[0-9].zip", []string{"5.zip"}, []string{"a.zip"}},
+		{"[!0-9].zip", []string{"a.zip"}, []string{"5.zip"}},
+		{"[].zip", []string{"[].zip"}, []string{"].zip"}},
+		{`\#1.zip`, []string{"#1.zip"}, []string{"1.zip"}},
+		{"trailing.zip   ", []string{"trailing.zip"}, []string{"trailing.zip   "}},
+	} {
+		p, err := parseIgnoreLine(c.pattern)
+		if err != nil || p == nil {
+			t.Errorf("parseIgnoreLine(%q) = %v, %v", c.pattern, p, err)
+			continue
+		}
+		for _, path := range c.match {
+			if !p.re.MatchString(path) {
+				t.Errorf("%q doesn't match %s", c.pattern, path)
+			}
+		}
+		for _, path := range c.miss {
+			if p.re.MatchString(path) {
+				t.Errorf("%q matches %s", c.pattern, path)
+			}
+		}
+	}
+	if p, _ := parseIgnoreLine("!notes/"); p == nil || !p.negate || !p.dirOnly {
+		t.Errorf(`parseIgnoreLine("!notes/") = %+v`, p)
+	}
+	for _, blank := range []string{"", "   ", "# a comment", "!", "/", "\r"} {
+		if p, err := parseIgnoreLine(blank); p != nil || err != nil {
+			t.Errorf("parseIgnoreLine(%q) = %+v, %v", blank, p, err)
+		}
+	}
+	if _, err := parseIgnoreLine("[z-a].zip"); err == nil || err.Error() != `bad pattern "[z-a].zip"` {
+		t.Errorf("parseIgnoreLine([z-a].zip): %v", err)
+	}
+}
+
+// ignoreFixture is a mirror with ignore files at three depths, and the
+// archives ingest should take from it.
+func ignoreFixture(t *testing.T) (string, []string) {
+	t.Helper()
+	root := t.TempDir()
+	for file, lines := range map[string]string{
+		".gutchunkignore":       "# local additions\nnotes/\n/scratch/\n*.bak.zip\n3/**/\n1/11.zip\n",
+		"notes/.gutchunkignore": "# too late: notes/ isn't walked\n!*.zip\n",
+		"1/.gutchunkignore":     "!11.zip\n",
+		"2/.gutchunkignore":     "*\n!22.zip\n",
+	} {
+		file = filepath.Join(root, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(lines), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, a := range []string{"1/11.zip", "1/12.bak.zip", "2/22.zip", "2/23.zip", "notes/44.zip", "scratch/55.zip", "4/scratch/66.zip", "3/5/77.zip", "3/88.zip"} {
+		stem := strings.TrimSuffix(filepath.Base(a), ".zip")
+		writeTestZip(t, filepath.Join(root, filepath.FromSlash(a)), zipEntry{strings.TrimSuffix(stem, ".bak") + ".txt", testBook("Book "+stem, testParagraphs(2))})
+	}
+	return root, []string{"Book 11", "Book 22", "Book 66", "Book 88"}
+}
+
+func TestIgnoreRules(t *testing.T) {
+	root, _ := ignoreFixture(t)
+	r := newIgnoreRules(root)
+	for _, c := range []struct {
+		path string
+		dir  bool
+		want string
+	}{
+		{"notes", true, ".gutchunkignore:2: notes/ ignored"},
+		// a file named for a directory pattern is no match
+		{"1/notes", false, ""},
+		{"scratch", true, ".gutchunkignore:3: /scratch/ ignored"},
+		{"4/scratch", true, ""},
+		{"1/12.bak.zip", false, ".gutchunkignore:4: *.bak.zip ignored"},
+		{"3", true, ""},
+		{"3/5", true, ".gutchunkignore:5: 3/**/ ignored"},
+		{"3/88.zip", false, ""},
+		// the deeper file overrides the root's
+		{"1/11.zip", false, "1/.gutchunkignore:1: !11.zip kept"},
+		{"2/23.zip", false, "2/.gutchunkignore:1: * ignored"},
+		{"2/22.zip", false, "2/.gutchunkignore:2: !22.zip kept"},
+		{"notes/44.zip", false, "notes/.gutchunkignore:2: !*.zip kept"},
+	} {
+		m, err := r.match(filepath.Join(root, filepath.FromSlash(c.path)), c.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if m != nil {
+			rel, _ := filepath.Rel(root, m.file)
+			got = filepath.ToSlash(rel) + strings.TrimPrefix(m.String(), m.file) + map[bool]string{true: " ignored", false: " kept"}[m.ignored]
+		}
+		if got != c.want {
+			t.Errorf("match(%s) = %q, want %q", c.path, got, c.want)
+		}
+	}
+	// looked up on its own, a file is ignored with the directory it is in
+	for path, want := range map[string]bool{"notes/44.zip": true, "3/5/77.zip": true, "1/11.zip": false, "4/scratch/66.zip": false} {
+		m, err := r.ignored(filepath.Join(root, filepath.FromSlash(path)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := m != nil && m.ignored; got != want {
+			t.Errorf("ignored(%s) = %v, want %v", path, got, want)
+		}
+	}
+	if m, err := r.match(root, true); m != nil || err != nil {
+		t.Errorf("match of the root = %v, %v", m, err)
+	}
+	if m, err := r.match(filepath.Dir(root), true); m != nil || err != nil {
+		t.Errorf("match of what isn't under the root = %v, %v", m, err)
+	}
+}
+
+func TestIngestIgnored(t *testing.T) {
+	root, want := ignoreFixture(t)
+	db := testDB(t)
+	out, err := captureStdout(t, func() error { return ingestCmd([]string{"--target", root}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(t, db, "SELECT name FROM files ORDER BY name"); got != strings.Join(want, "\n")+"\n" {
+		t.Errorf("ingest of a mirror with ignore files stored\n%s", got)
+	}
+	for _, line := range []string{
+		"skipping 1/12.bak.zip (ignored by " + filepath.Join(root, ".gutchunkignore") + ":4: *.bak.zip)\n",
+		"skipping 2/23.zip (ignored by " + filepath.Join(root, "2", ".gutchunkignore") + ":1: *)\n",
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("ingest printed\n%s\nwant %q", out, line)
+		}
+	}
+	if strings.Contains(out, "44.zip") || strings.Contains(out, "77.zip") {
+		t.Errorf("ingest walked into an ignored directory:\n%s", out)
+	}
+
+	// --paths-file and explain go by them too
+	paths := filepath.Join(t.TempDir(), "paths")
+	if err = os.WriteFile(paths, []byte("notes/44.zip\n2/23.zip\n2/22.zip\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	db = testDB(t)
+	if _, err = captureStdout(t, func() error { return ingestCmd([]string{"--target", root, "--paths-file", paths}) }); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(t, db, "SELECT name FROM files"); got != "Book 22\n" {
+		t.Errorf("ingest --paths-file stored\n%s", got)
+	}
+	out, err = captureStdout(t, func() error {
+		return explainCmd([]string{"--target", root, filepath.Join(root, "notes", "44.zip"), filepath.Join(root, "1", "11.zip")})
+	})
+	if exitCode(err) != 1 ||
+		!strings.Contains(out, "  reject  ignore     ignored             ignored by "+filepath.Join(root, ".gutchunkignore")+":2: notes/\n") ||
+		!strings.Contains(out, "  accept  ignore     not_ignored         kept by "+filepath.Join(root, "1", ".gutchunkignore")+":1: !11.zip\n") {
+		t.Errorf("explain: %v, printing\n%s", err, out)
+	}
+
+	// a bad pattern fails the walk, saying where it is
+	if err = os.WriteFile(filepath.Join(root, "4", ".gutchunkignore"), []byte("# fine\n[z-a]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	testDB(t)
+	if _, err = captureStdout(t, func() error { return ingestCmd([]string{"--target", root}) }); err == nil ||
+		!strings.Contains(err.Error(), filepath.Join(root, "4", ".gutchunkignore")+`:2: bad pattern "[z-a]"`) {
+		t.Errorf("ingest with a bad pattern: %v", err)
+	}
+}
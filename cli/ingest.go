@@ -0,0 +1,729 @@
+package cli
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type ingestOptions struct {
+	// skip archives the journal has as completed for this root
+	resume bool
+	// reject members containing NUL bytes instead of stripping them
+	rejectNULs bool
+	// where the time goes, or nil
+	timings *timings
+	// sources row the books came from, 0 to not track it
+	sourceID int
+	// ingest books removed with rm all the same
+	ignoreTombstones bool
+	// leave files.content empty, for run --pipeline --no-store-content,
+	// which chunks books before they are stored
+	noContent bool
+	// lines of each book looked through for its title and author, 0 for
+	// defaultHeaderLines
+	headerLines int
+	// the most a member may decompress to, and the most members an
+	// archive may list, 0 for defaultMaxFileSize and defaultMaxMembers and
+	// -1 for no limit
+	maxFileSize int64
+	maxMembers  int
+	// the smallest body a member may have, 0 for defaultMinBodySize and
+	// -1 for none, and the phrases marking a placeholder, nil for the
+	// defaults (see stub.go)
+	minBodySize int64
+	stubPhrases *blocklist
+	// detect the language of books whose header gives none (see
+	// langdetect.go)
+	detectLanguage bool
+	// walk only this mirror layout's archives, aleph or cache, "" for
+	// both (see archivename.go)
+	mirrorLayout string
+	// take the -8 and -0 encodings of a book's zip too, as readRemote
+	// does, fetching one only for a book without the plain zip
+	encodings bool
+}
+
+func (o ingestOptions) headerScan() int {
+	if o.headerLines > 0 {
+		return o.headerLines
+	}
+	return defaultHeaderLines
+}
+
+// An archive from somewhere other than the mirror could hold a member that
+// decompresses to far more than any book, a zip bomb, or list more
+// members than any book's archive would. A member declaring more than
+// --max-file-size uncompressed is rejected before it is read, and one
+// read is cut off once it passes it, whatever it declared; one
+// decompressing to more than it declares, which archive/zip fails, is
+// rejected the same. An archive listing more than --max-members isn't looked in at all. Either
+// way the archive is warned of and the run goes on.
+const (
+	defaultMaxFileSize = 512 << 20
+	defaultMaxMembers  = 1000
+)
+
+func (o ingestOptions) fileSizeCap() int64 {
+	if o.maxFileSize == 0 {
+		return defaultMaxFileSize
+	}
+	return o.maxFileSize
+}
+
+func (o ingestOptions) memberCap() int {
+	if o.maxMembers == 0 {
+		return defaultMaxMembers
+	}
+	return o.maxMembers
+}
+
+// limitFlags adds --max-file-size and --max-members to fs and returns what
+// sets them in o.
+func limitFlags(fs *flag.FlagSet, o *ingestOptions) func() error {
+	size := fs.String("max-file-size", formatSize(defaultMaxFileSize), "reject archive members that decompress to more than this (0 for no limit)")
+	members := fs.Int("max-members", defaultMaxMembers, "skip archives listing more members than this (0 for no limit)")
+	return func() error {
+		n, err := parseSize(*size)
+		if err != nil {
+			return usageError{err.Error()}
+		}
+		if *members < 0 {
+			return usagef("--max-members can't be negative")
+		}
+		o.maxFileSize, o.maxMembers = n, *members
+		if n == 0 {
+			o.maxFileSize = -1
+		}
+		if *members == 0 {
+			o.maxMembers = -1
+		}
+		return nil
+	}
+}
+
+// startIngest cleans up after archives of root left half ingested and,
+// with opts.resume, returns those already ingested, by name, and where in
+// the walk to resume from, as a path.
+func startIngest(db *sql.DB, root string, opts ingestOptions) (map[string]bool, string, error) {
+	undone, err := repairJournal(db, root)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(undone) > 0 {
+		fmt.Printf("cleaned up %d archives interrupted mid-ingest; ingesting them again\n", len(undone))
+		for _, a := range undone {
+			events.warn(a, "", "interrupted mid-ingest; ingesting it again")
+		}
+	}
+	if !opts.resume {
+		return nil, "", nil
+	}
+
+	done, resumeAt, err := completedArchives(db, root)
+	if err != nil {
+		return nil, "", err
+	}
+	// directories holding an interrupted archive can't be skipped
+	if len(undone) > 0 && walkBefore(undone[0], resumeAt) {
+		resumeAt = undone[0]
+	}
+	if len(done) > 0 {
+		fmt.Printf("resuming, %d archives already ingested\n", len(done))
+	}
+	if resumeAt != "" {
+		resumeAt = archiveFile(root, resumeAt)
+	}
+	return done, resumeAt, nil
+}
+
+func readFiles(db *sql.DB, root string, opts ingestOptions) error {
+	done, resumeAt, err := startIngest(db, root, opts)
+	if err != nil {
+		return err
+	}
+
+	var skip func(string) bool
+	if resumeAt != "" {
+		skip = func(dir string) bool { return walkBefore(dir, resumeAt) && !isAncestor(dir, resumeAt) }
+	}
+	return walkArchives(root, skip, func(archive string, info ArchiveInfo) error {
+		name := mirrorName(root, archive)
+		if turnedAway(name, info, done, opts) {
+			return nil
+		}
+		return ingestOne(db, root, archive, name, opts)
+	})
+}
+
+// readPaths ingests the given archives under root as readFiles would
+// ingest them walking it, the ignore files under root included. Paths
+// that don't exist are listed once the rest are done.
+func readPaths(db *sql.DB, root string, paths []string, opts ingestOptions) error {
+	done, _, err := startIngest(db, root, opts)
+	if err != nil {
+		return err
+	}
+
+	editions := &editionFilter{}
+	ignores := newIgnoreRules(root)
+	missing := []string{}
+	for _, archive := range paths {
+		if _, err = os.Stat(archive); errors.Is(err, fs.ErrNotExist) {
+			missing = append(missing, archive)
+			continue
+		} else if err != nil {
+			return err
+		}
+		m, err := ignores.ignored(archive)
+		if err != nil {
+			return err
+		}
+		name := mirrorName(root, archive)
+		if turnedAway(name, ArchiveInfo{Superseded: editions.superseded(archive), Ignore: m}, done, opts) {
+			continue
+		}
+		if err = ingestOne(db, root, archive, name, opts); err != nil {
+			return err
+		}
+	}
+
+	if len(missing) > 0 {
+		for _, m := range missing {
+			fmt.Fprintln(os.Stderr, "no such archive:", m)
+			events.warn(m, "", "no such archive")
+		}
+		return partialError{len(missing), len(paths), "paths", "don't exist"}
+	}
+	return nil
+}
+
+// isBookArchive reports whether name is the zip of a book, not one of its
+// -8 and -0 encodings. The cache layout's texts are books too (see
+// isCacheText).
+func isBookArchive(name string) bool {
+	return strings.HasSuffix(name, "zip") && !strings.HasSuffix(name, "-8.zip") && !strings.HasSuffix(name, "-0.zip")
+}
+
+// walkArchives calls fn with each archive under root in walk order: the
+// zips of books, but not their -8 and -0 encodings, and the cache layout's
+// texts, with whether a newer edition sits beside it and the line of the
+// ignore files deciding it, if any. Directories skip returns true for, and
+// those the ignore files ignore, are left out.
+func walkArchives(root string, skip func(dir string) bool, fn func(archive string, info ArchiveInfo) error) error {
+	editions := &editionFilter{}
+	ignores := newIgnoreRules(root)
+	return filepath.WalkDir(root, func(archive string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if skip != nil && skip(archive) {
+				return filepath.SkipDir
+			}
+			if m, err := ignores.match(archive, true); err != nil {
+				return err
+			} else if m != nil && m.ignored {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !isBookArchive(d.Name()) && !isCacheText(archive) {
+			return nil
+		}
+		m, err := ignores.match(archive, false)
+		if err != nil {
+			return err
+		}
+		return fn(archive, ArchiveInfo{Superseded: editions.superseded(archive), Ignore: m})
+	})
+}
+
+// ingestOne ingests the archive at file, known to the journal and the files
+// table as archive, in a transaction of its own.
+func ingestOne(db *sql.DB, root, file, archive string, opts ingestOptions) error {
+	return ingestJournaled(db, root, archive, func(tx *sql.Tx) (Reason, error) {
+		return ingestArchive(tx, file, archive, opts)
+	})
+}
+
+// ingestJournaled runs ingest, which ingests archive and returns why not
+// when it didn't, in a transaction of its own, journaled under root.
+func ingestJournaled(db *sql.DB, root, archive string, ingest func(tx *sql.Tx) (Reason, error)) error {
+	skipped, err := ingestInTx(db, root, archive, ingest)
+	if err != nil {
+		manifestOut.failed(archive, err)
+		return err
+	}
+	if skipped.Code != "" {
+		skippedArchive(archive, skipped)
+	} else {
+		events.emit("archive_ingested", map[string]interface{}{"archive": archive, "books": 1})
+		manifestOut.done(archive, Reason{})
+	}
+	return nil
+}
+
+func ingestInTx(db *sql.DB, root, archive string, ingest func(tx *sql.Tx) (Reason, error)) (Reason, error) {
+	if err := journalStart(db, root, archive); err != nil {
+		return Reason{}, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return Reason{}, err
+	}
+	skipped, err := ingest(tx)
+	if err != nil {
+		tx.Rollback()
+		return Reason{}, err
+	}
+	if err = journalDone(tx, root, archive); err != nil {
+		tx.Rollback()
+		return Reason{}, err
+	}
+	if err = tx.Commit(); err != nil {
+		return Reason{}, err
+	}
+	walState.committed(db)
+	return skipped, nil
+}
+
+// ingestArchive ingests the book in an archive, or a cache layout text,
+// returning why not when it didn't.
+func ingestArchive(tx *sql.Tx, file, archive string, opts ingestOptions) (Reason, error) {
+	sw := opts.timings.start(archive)
+	if isCacheText(file) {
+		members, err := readText(file, archive, opts, &sw)
+		if err != nil {
+			return Reason{}, err
+		}
+		skipped, _, err := storeZip(tx, members, file, archive, opts, &sw)
+		if err != nil || skipped.Code != "" {
+			return skipped, err
+		}
+		sw.done(0)
+		return Reason{}, nil
+	}
+	var r *zip.ReadCloser
+	err := withinRead(file, func() (err error) {
+		r, err = zip.OpenReader(file)
+		return err
+	})
+	if err != nil {
+		return Reason{}, err
+	}
+	defer r.Close()
+	return ingestZip(tx, &r.Reader, file, archive, opts, &sw)
+}
+
+// ingestZip is ingestArchive for a zip already open, named file, the path
+// its ebook number and edition are read from.
+func ingestZip(tx *sql.Tx, r *zip.Reader, file, archive string, opts ingestOptions, sw *stopwatch) (Reason, error) {
+	members, err := readZip(r, archive, opts, sw)
+	if err != nil {
+		return Reason{}, err
+	}
+	skipped, _, err := storeZip(tx, members, file, archive, opts, sw)
+	if err != nil || skipped.Code != "" {
+		return skipped, err
+	}
+	sw.done(0)
+	return Reason{}, nil
+}
+
+// zipMember is a text member of an archive read for ingest: one rejected,
+// and why, or the book.
+type zipMember struct {
+	name string
+	text *bytes.Buffer
+	// why and how the member was rejected, "" for the book
+	reason, detail string
+	// the texts after the first of a book holding several, and which of
+	// them this is, from 2, 0 for the first or only one (see multitext.go)
+	more []zipMember
+	part int
+	// Windows-1252 punctuation bytes repaired, or bytes decoded from
+	// Windows-1252 (see cp1252.go)
+	repaired, decoded int
+}
+
+// the codes of the warnings left for an archive holding no text member at
+// all and one listing too many members; a member decompressing to too much
+// is too_large, as a book too large to chunk is
+const (
+	warnNoText      = "no_text_member"
+	warnManyMembers = "too_many_members"
+)
+
+// readZip reads the text members of r up to the first holding a book,
+// which comes last, without touching the database. An archive without a
+// text member, or listing too many, gives one member, nameless, saying
+// why.
+func readZip(r *zip.Reader, archive string, opts ingestOptions, sw *stopwatch) ([]zipMember, error) {
+	if max := opts.memberCap(); max > 0 && len(r.File) > max {
+		return []zipMember{{reason: warnManyMembers,
+			detail: fmt.Sprintf("lists %d members, more than --max-members %d", len(r.File), max)}}, nil
+	}
+	candidates, others := textCandidates(r.File)
+	if len(candidates) == 0 {
+		return []zipMember{{reason: warnNoText, detail: noTextDetail(others)}}, nil
+	}
+	members := []zipMember{}
+	for _, f := range candidates {
+		m, err := readMember(f.Name, f.UncompressedSize64, f.Open, archive, opts, sw)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+		if m.reason == "" {
+			break
+		}
+	}
+	return members, nil
+}
+
+// readText reads a cache layout text at file, a book on its own, as
+// readZip would a member of an archive.
+func readText(file, archive string, opts ingestOptions, sw *stopwatch) ([]zipMember, error) {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	open := func() (io.ReadCloser, error) { return os.Open(file) }
+	m, err := readMember(filepath.Base(file), uint64(fi.Size()), open, archive, opts, sw)
+	if err != nil {
+		return nil, err
+	}
+	return []zipMember{m}, nil
+}
+
+// readMember reads the member name of archive, declaring size bytes
+// uncompressed, and checks it as a book: the book, or why it was rejected.
+func readMember(name string, size uint64, open func() (io.ReadCloser, error), archive string, opts ingestOptions, sw *stopwatch) (zipMember, error) {
+	max := opts.fileSizeCap()
+	if max > 0 && size > uint64(max) {
+		return zipMember{name: name, reason: warnTooLarge,
+			detail: fmt.Sprintf("declares %s uncompressed, more than --max-file-size %s", formatSize(int64(size)), formatSize(max))}, nil
+	}
+	bs := bytes.NewBuffer([]byte{})
+	overran := false
+	err := withinRead(name, func() error {
+		c, err := open()
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		var from io.Reader = c
+		if max > 0 {
+			from = io.LimitReader(c, max+1)
+		}
+		_, err = io.Copy(bs, from)
+		if errors.Is(err, zip.ErrFormat) {
+			overran, err = true, nil
+		}
+		return err
+	})
+	if err != nil {
+		return zipMember{}, err
+	}
+	sw.lap(phaseRead)
+	if overran {
+		return zipMember{name: name, reason: warnTooLarge,
+			detail: fmt.Sprintf("decompresses to more than the %s it declares", formatSize(int64(size)))}, nil
+	}
+	if max > 0 && int64(bs.Len()) > max {
+		return zipMember{name: name, reason: warnTooLarge,
+			detail: fmt.Sprintf("decompresses to more than --max-file-size %s", formatSize(max))}, nil
+	}
+	manifestOut.member(archive, name, bs.Bytes())
+
+	sniff := SniffText(bs.Bytes())
+	if sniff.Binary {
+		return zipMember{name: name, reason: "binary", detail: sniff.Reason}, nil
+	}
+	if sniff.NULs > 0 {
+		if opts.rejectNULs {
+			return zipMember{name: name, reason: "nul", detail: fmt.Sprintf("%d NUL bytes", sniff.NULs)}, nil
+		}
+		bs = bytes.NewBuffer(bytes.ReplaceAll(bs.Bytes(), []byte{0}, nil))
+	}
+	if why := stubReason(bs.String(), opts); why != "" {
+		opts.timings.skipStub()
+		return zipMember{name: name, reason: warnStub, detail: why}, nil
+	}
+	return fixMember(withTexts(zipMember{name: name, text: bs})), nil
+}
+
+// textCandidates picks the members of an archive that may hold its book
+// from the archive's list of them, before any is read: the text members,
+// largest first, as the book outweighs any readme
+// beside it. The rest, images, audio, html and the like, are only
+// counted, by extension.
+func textCandidates(files []*zip.File) ([]*zip.File, map[string]int) {
+	var candidates []*zip.File
+	others := map[string]int{}
+	for _, f := range files {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if !isTextMember(f) {
+			if *debug {
+				fmt.Fprintln(os.Stderr, "skipping", f.Name)
+			}
+			ext := strings.ToLower(path.Ext(f.Name))
+			if ext == "" {
+				ext = "extensionless"
+			}
+			if f.UncompressedSize64 == 0 {
+				ext = "empty " + ext
+			}
+			others[ext]++
+			continue
+		}
+		candidates = append(candidates, f)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].UncompressedSize64 > candidates[j].UncompressedSize64
+	})
+	return candidates, others
+}
+
+// noTextDetail says what an archive without a text member holds.
+func noTextDetail(others map[string]int) string {
+	if len(others) == 0 {
+		return "the archive is empty"
+	}
+	exts := make([]string, 0, len(others))
+	for ext := range others {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+	parts := make([]string, len(exts))
+	for i, ext := range exts {
+		parts[i] = fmt.Sprintf("%d %s", others[ext], ext)
+	}
+	return "no .txt member, only " + strings.Join(parts, ", ")
+}
+
+// storeZip records the members readZip rejected and inserts the book, if
+// it found one and Decide takes it, returning its id or why it wasn't
+// ingested. A book holding several texts is Decided and inserted a text
+// at a time, the ids given in order, 0 for a text turned away; why the
+// first was is the reason when every one was.
+func storeZip(tx *sql.Tx, members []zipMember, file, archive string, opts ingestOptions, sw *stopwatch) (Reason, []int64, error) {
+	for _, m := range members {
+		if m.reason == "" {
+			break
+		}
+		if err := skipMember(tx, archive, m.name, m.reason, m.detail); err != nil {
+			return Reason{}, nil, err
+		}
+	}
+	d, err := Decide(archive, ArchiveInfo{File: file, Read: true, Members: members}, DBState{Tx: tx, Opts: opts})
+	if err != nil {
+		return Reason{}, nil, err
+	}
+	texts := []Decision{d}
+	if d.book != nil && len(d.book.more) > 0 {
+		opts.timings.splitFile()
+		for i := range d.book.more {
+			t, err := Decide(archive, ArchiveInfo{File: file, Read: true, Members: d.book.more[i : i+1]}, DBState{Tx: tx, Opts: opts})
+			if err != nil {
+				return Reason{}, nil, err
+			}
+			texts = append(texts, t)
+		}
+	}
+	ids := make([]int64, len(texts))
+	stored := false
+	for i, t := range texts {
+		if r := t.Rejected(); r.Code != "" {
+			if t.book != nil {
+				fmt.Printf("skipping %s (%s)\n", path.Base(t.book.name), r.Detail)
+			}
+			continue
+		}
+		if ids[i], err = storeBook(tx, t, parseArchiveName(file), archive, opts, sw); err != nil {
+			return Reason{}, nil, err
+		}
+		stored = true
+	}
+	if !stored {
+		return d.Rejected(), ids, nil
+	}
+	return Reason{}, ids, nil
+}
+
+// memberEbook is the ebook number of the book in m, from the archive's
+// name or else its header, 0 for none. A member's texts after the first
+// go by their headers alone.
+func memberEbook(m zipMember, an archiveName) int {
+	if an.ebook != 0 && m.part == 0 {
+		return an.ebook
+	}
+	return headerEbookNumber(m.text.Bytes())
+}
+
+// storeBook inserts the book d took, superseding the ebook's current
+// version.
+func storeBook(tx *sql.Tx, d Decision, an archiveName, archive string, opts ingestOptions, sw *stopwatch) (int64, error) {
+	m := *d.book
+	bs := m.text
+	member := path.Base(m.name)
+	filename := bookFilename(m, an)
+	name, author, cut := scanNameAuthor(*bs, opts.headerScan())
+	header := rawHeader(bs.String())
+	status := metadataStatus(header, name, author)
+	if cut && name == "" && author == "" {
+		status = metadataNoHeader
+	}
+	if name == "" {
+		name = member
+	}
+	ebook, prior := d.ebook, d.prior
+	hash := textHash(bs.String())
+	var edition interface{}
+	if an.layout == layoutEtext {
+		edition = an.edition
+	}
+	sw.lap(phaseMeta)
+
+	var content interface{} = bs.String()
+	if opts.noContent {
+		content = nil
+	}
+	var langSource interface{}
+	lang := headerLanguage(bs.Bytes())
+	if lang != "" {
+		langSource = langHeader
+	} else if opts.detectLanguage {
+		if lang, _ = detectLanguage(bs.String(), defaultLangConfidence); lang != "" {
+			langSource = langDetected
+		}
+	}
+	res, err := tx.Exec("INSERT INTO files (name, author, content, filename, member_name, archive_path, author_norm, title_norm, ebook, edition, layout, source_id, archive, language, language_source, header, metadata_status, version, content_hash) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		name, author, content, filename, member, m.name, normalizeAuthor(author), normalizeTitle(name), nullInt(ebook), edition, an.layout, nullInt(opts.sourceID), archive, lang, langSource, header, status, prior.version+1, hash)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if prior.id != 0 {
+		if _, err = tx.Exec("UPDATE files SET superseded_by = ? WHERE id = ?", id, prior.id); err != nil {
+			return 0, err
+		}
+		if err = logChunks(tx, eventSuperseded, 0, "?", prior.id); err != nil {
+			return 0, err
+		}
+		fmt.Printf("book %d is version %d of ebook %d, superseding book %d\n", id, prior.version+1, ebook, prior.id)
+	}
+	if err = saveNameWords(tx, id, normalizeAuthor(author), normalizeTitle(name)); err != nil {
+		return 0, err
+	}
+	if err = saveHeaderContributors(tx, id, headerContributors(header)); err != nil {
+		return 0, err
+	}
+	if err = metadataWarning(tx, id, status); err != nil {
+		return 0, err
+	}
+	if err = encodingWarning(tx, id, m.repaired, m.decoded); err != nil {
+		return 0, err
+	}
+	sw.lap(phaseWrite)
+	opts.timings.metadata(status)
+	return id, nil
+}
+
+// isTextMember reports whether a zip member looks like a book: a non-empty
+// regular file ending in .txt in any case, and not resource fork junk.
+func isTextMember(f *zip.File) bool {
+	if f.FileInfo().IsDir() || strings.HasSuffix(f.Name, "/") || f.UncompressedSize64 == 0 {
+		return false
+	}
+	name := strings.ReplaceAll(f.Name, "\\", "/")
+	if strings.HasPrefix(name, "__MACOSX/") || strings.Contains(name, "/__MACOSX/") ||
+		strings.HasPrefix(path.Base(name), "._") {
+		return false
+	}
+	return strings.EqualFold(path.Ext(name), ".txt")
+}
+
+func skipMember(tx *sql.Tx, archive, member, reason, detail string) error {
+	if member == "" {
+		fmt.Printf("skipping %s: %s\n", archive, detail)
+		events.warn(archive, "", detail)
+		return addWarning(tx, warnAt{scope: scopeIngest, path: archive}, sevWarn, reason, detail, "")
+	}
+	fmt.Printf("rejecting %s in %s: %s\n", member, archive, detail)
+	events.warn(archive, member, "rejected: "+detail)
+	return addWarning(tx, warnAt{scope: scopeIngest, path: archive, member: member}, sevWarn, reason, detail, "")
+}
+
+// metadata lives in the first few dozen lines; never read a whole book
+// looking for it. ingest --header-lines looks through more, or fewer.
+const defaultHeaderLines = 500
+
+// bytes a line the title and author scan reads on average before it stops,
+// so that a book of a few very long lines isn't read whole either
+const headerLineBytes = 128
+
+func extractNameAuthor(content bytes.Buffer) (string, string) {
+	title, author, _ := scanNameAuthor(content, defaultHeaderLines)
+	return title, author
+}
+
+// scanNameAuthor looks for the Title: and Author: lines in the first
+// maxLines lines of content, stopping at a *** line or once it has both.
+// cut reports that it stopped at maxLines, or at headerLineBytes a line,
+// before either.
+func scanNameAuthor(content bytes.Buffer, maxLines int) (title, author string, cut bool) {
+	s := bufio.NewScanner(&content)
+	read := 0
+
+	for lines := 0; s.Scan(); lines++ {
+		if lines >= maxLines || read >= maxLines*headerLineBytes {
+			return title, author, true
+		}
+		read += len(s.Bytes()) + 1
+
+		text := strings.TrimSpace(s.Text())
+
+		if strings.HasPrefix(text, "***") {
+			break
+		}
+
+		if strings.HasPrefix(text, "Title") {
+			sp := strings.SplitN(text, ":", 2)
+			if len(sp) == 2 {
+				title = strings.TrimSpace(sp[1])
+			}
+		}
+
+		if strings.HasPrefix(text, "Author") {
+			sp := strings.SplitN(text, ":", 2)
+			if len(sp) == 2 {
+				author = strings.TrimSpace(sp[1])
+			}
+		}
+
+		if author != "" && title != "" {
+			break
+		}
+	}
+
+	// a line too long to scan is as far as it goes
+	return title, author, s.Err() != nil
+}
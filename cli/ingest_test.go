@@ -0,0 +1,464 @@
+package cli
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"database/sql"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// zipEntry is a member of a test archive; a name ending in / is a
+// directory.
+type zipEntry struct {
+	name, text string
+}
+
+// writeTestZip writes an archive of entries at path, making its directory.
+func writeTestZip(t testing.TB, path string, entries ...zipEntry) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Write([]byte(e.text)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// ingestRow is a files row as ingest stored it.
+type ingestRow struct {
+	name, filename, member, archivePath string
+}
+
+// ingestRows is every files row, in the order they were stored.
+func ingestRows(t testing.TB, db *sql.DB) []ingestRow {
+	t.Helper()
+	rows, err := db.Query("SELECT coalesce(name, ''), coalesce(filename, ''), coalesce(member_name, ''), coalesce(archive_path, '') FROM files ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var books []ingestRow
+	for rows.Next() {
+		var b ingestRow
+		if err = rows.Scan(&b.name, &b.filename, &b.member, &b.archivePath); err != nil {
+			t.Fatal(err)
+		}
+		books = append(books, b)
+	}
+	return books
+}
+
+func TestIngestMemberNames(t *testing.T) {
+	root := t.TempDir()
+	writeTestZip(t, filepath.Join(root, "12345.zip"),
+		zipEntry{"12345/", ""},
+		zipEntry{"__MACOSX/12345/._12345.TXT", "resource fork junk, long enough to be a book if it were read as one"},
+		zipEntry{"12345/empty.txt", ""},
+		zipEntry{"12345/12345.TXT", testBook("Nested Upper", testParagraphs(3))})
+	writeTestZip(t, filepath.Join(root, "222.zip"),
+		zipEntry{"files/book.Txt", testBook("Mixed Case", testParagraphs(3))})
+	writeTestZip(t, filepath.Join(root, "333.zip"),
+		zipEntry{"333.txt", testBook("Flat", testParagraphs(3))})
+	writeTestZip(t, filepath.Join(root, "444.zip"),
+		zipEntry{"444/", ""},
+		zipEntry{"__MACOSX/._444.txt", "junk"},
+		zipEntry{"444/cover.jpg", "not text"})
+
+	db := testDB(t)
+	if err := readFiles(db, root, ingestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]ingestRow{}
+	for _, b := range ingestRows(t, db) {
+		got[b.name] = b
+	}
+	if len(got) != 3 {
+		t.Errorf("ingested %v, want the three books and nothing of 444.zip", got)
+	}
+	for _, want := range []ingestRow{
+		{"Nested Upper", "12345.TXT", "12345.TXT", "12345/12345.TXT"},
+		{"Mixed Case", "book.Txt", "book.Txt", "files/book.Txt"},
+		{"Flat", "333.txt", "333.txt", "333.txt"},
+	} {
+		b, ok := got[want.name]
+		if !ok {
+			t.Errorf("%s wasn't ingested", want.name)
+			continue
+		}
+		if b.member != want.member || b.archivePath != want.archivePath {
+			t.Errorf("%s stored as member %q at %q, want %q at %q", want.name, b.member, b.archivePath, want.member, want.archivePath)
+		}
+		if filepath.Base(b.filename) != want.filename {
+			t.Errorf("%s has filename %q, want it to end in %q", want.name, b.filename, want.filename)
+		}
+	}
+}
+
+func TestIsTextMember(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		size int
+		want bool
+	}{
+		{"1342.txt", 10, true},
+		{"1342.TXT", 10, true},
+		{"dir/1342.Txt", 10, true},
+		{"dir\\1342.txt", 10, true},
+		{"1342.txt", 0, false},
+		{"dir/", 0, false},
+		{"__MACOSX/1342.txt", 10, false},
+		{"dir/__MACOSX/1342.txt", 10, false},
+		{"dir/._1342.txt", 10, false},
+		{"1342.html", 10, false},
+		{"1342.txt.bak", 10, false},
+	} {
+		f := &zip.File{FileHeader: zip.FileHeader{Name: c.name, UncompressedSize64: uint64(c.size)}}
+		if got := isTextMember(f); got != c.want {
+			t.Errorf("isTextMember(%q, %d bytes) = %v, want %v", c.name, c.size, got, c.want)
+		}
+	}
+}
+
+func TestIngestPathsFile(t *testing.T) {
+	root := t.TempDir()
+	for _, a := range []string{"1/11.zip", "1/12.zip", "2/21.zip", "2/22.zip"} {
+		stem := strings.TrimSuffix(filepath.Base(a), ".zip")
+		writeTestZip(t, filepath.Join(root, filepath.FromSlash(a)), zipEntry{stem + ".txt", testBook("Book "+stem, testParagraphs(2)+"\n\n"+stem+".")})
+	}
+	db := testDB(t)
+	list := filepath.Join(t.TempDir(), "paths.txt")
+	lines := "# to redo\n1/11.zip\n\n  2\\21.zip  \n" + filepath.Join(root, "2", "22.zip") + "\n3/31.zip\n"
+	if err := os.WriteFile(list, []byte(lines), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err := ingestCmd([]string{"--target", root, "--paths-file", list})
+	var partial partialError
+	if !errors.As(err, &partial) || partial.failed != 1 || partial.total != 4 || exitCode(err) != exitPartial {
+		t.Fatalf("ingest --paths-file: %v, want it partial for the one path missing of 4", err)
+	}
+	var names []string
+	for _, b := range ingestRows(t, db) {
+		names = append(names, b.name)
+	}
+	sort.Strings(names)
+	if want := []string{"Book 11", "Book 21", "Book 22"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("ingested %v, want %v: those listed, relative, either slash or absolute, and not 1/12.zip", names, want)
+	}
+	var archives []string
+	rows, err := db.Query("SELECT archive FROM files ORDER BY archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a string
+		if err = rows.Scan(&a); err != nil {
+			t.Fatal(err)
+		}
+		archives = append(archives, a)
+	}
+	if want := []string{"1/11.zip", "2/21.zip", "2/22.zip"}; !reflect.DeepEqual(archives, want) {
+		t.Errorf("archives recorded as %v, want the names under --target %v", archives, want)
+	}
+}
+
+func TestScanNameAuthor(t *testing.T) {
+	lines := func(n int, line string) string { return strings.Repeat(line+"\n", n) }
+	for _, c := range []struct {
+		name, content string
+		maxLines      int
+		title, author string
+		cut           bool
+	}{
+		// it stops on the line it has both by, not the one after
+		{"both", "Title: Emma\nAuthor: Jane Austen\nTitle: Not Emma\n", 500, "Emma", "Jane Austen", false},
+		{"marker", "Title: Emma\n*** START OF THIS PROJECT GUTENBERG EBOOK EMMA ***\nAuthor: Jane Austen\n", 500, "Emma", "", false},
+		{"ended", "Title: Emma\n\nIt was so.\n", 500, "Emma", "", false},
+		{"lines", lines(500, "It was so.") + "Title: Emma\n", 500, "", "", true},
+		{"more lines", lines(500, "It was so.") + "Title: Emma\nAuthor: Jane Austen\n", 600, "Emma", "Jane Austen", false},
+		{"fewer lines", "\n\nTitle: Emma\n", 2, "", "", true},
+		// 500 lines of 128 bytes are read at most, however few the lines
+		{"bytes", lines(3, strings.Repeat("so ", 10000)) + "Title: Emma\n", 500, "", "", true},
+		{"too long", strings.Repeat("so", 40000) + "\nTitle: Emma\n", 500, "", "", true},
+	} {
+		title, author, cut := scanNameAuthor(*bytes.NewBufferString(c.content), c.maxLines)
+		if title != c.title || author != c.author || cut != c.cut {
+			t.Errorf("%s: scanned %q, %q, cut %v, want %q, %q, %v", c.name, title, author, cut, c.title, c.author, c.cut)
+		}
+	}
+}
+
+func TestIngestHeaderLines(t *testing.T) {
+	db := testDB(t)
+	root := t.TempDir()
+	writeTestZip(t, filepath.Join(root, "1", "11.zip"), zipEntry{"11.txt", strings.Repeat(testParagraphs(1)+"\n\n", 300)})
+	writeTestZip(t, filepath.Join(root, "2", "22.zip"), zipEntry{"22.txt", strings.Repeat("\n", 9) + testBook("Emma", testParagraphs(2))})
+	writeTestZip(t, filepath.Join(root, "3", "33.zip"), zipEntry{"33.txt", "Title: Villette\nAuthor: Charlotte Brontë\n\n" + testBook("Villette", testParagraphs(2))})
+	if _, err := captureStdout(t, func() error { return ingestCmd([]string{"--target", root, "--header-lines", "5"}) }); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	rows, err := db.Query("SELECT filename, name, coalesce(metadata_status, '') FROM files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var file, name, status string
+		if err = rows.Scan(&file, &name, &status); err != nil {
+			t.Fatal(err)
+		}
+		got[file] = name + " " + status
+	}
+	for file, want := range map[string]string{
+		"11.txt": "11.txt " + metadataNoHeader,
+		"22.txt": "22.txt " + metadataNoHeader,
+		"33.txt": "Villette " + metadataOK,
+	} {
+		if got[file] != want {
+			t.Errorf("%s was ingested as %q, want %q ", file, got[file], want)
+		}
+	}
+
+	for _, n := range []string{"0", "-1"} {
+		if _, err = captureStdout(t, func() error { return ingestCmd([]string{"--target", root, "--header-lines", n}) }); exitCode(err) != exitUsage {
+			t.Errorf("ingest --header-lines %s: %v, want a usage error", n, err)
+		}
+	}
+}
+
+// BenchmarkScanNameAuthor scans a 20 MB book with no header, as ingest
+// does, and to its end.
+func BenchmarkScanNameAuthor(b *testing.B) {
+	content := bytes.NewBufferString(strings.Repeat(testParagraphs(1)+"\n\n", 20<<20/(len(testParagraphs(1))+2)))
+	for _, c := range []struct {
+		name     string
+		maxLines int
+	}{{"bounded", defaultHeaderLines}, {"whole", content.Len()}} {
+		b.Run(c.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if title, _, _ := scanNameAuthor(*content, c.maxLines); title != "" {
+					b.Fatalf("found the title %q", title)
+				}
+			}
+		})
+	}
+}
+
+func TestIngestTextAmongPayloads(t *testing.T) {
+	db := testDB(t)
+	root := t.TempDir()
+	writeTestZip(t, filepath.Join(root, "1", "11.zip"),
+		zipEntry{"11/cover.png", "\x89PNG\r\n\x1a\n not a book"},
+		zipEntry{"11/frontispiece.png", "\x89PNG\r\n\x1a\n not a book either"},
+		zipEntry{"11/11.txt", testBook("Emma", testParagraphs(2))})
+	writeTestZip(t, filepath.Join(root, "2", "22.zip"),
+		zipEntry{"22/readme.txt", "Read the book beside this one."},
+		zipEntry{"22/22-h.htm", "<html>Persuasion</html>"},
+		zipEntry{"22/22.txt", testBook("Persuasion", testParagraphs(3))})
+	writeTestZip(t, filepath.Join(root, "3", "33.zip"),
+		zipEntry{"33/33.mp3", "ID3 chapter one"},
+		zipEntry{"33/cover.png", "\x89PNG\r\n\x1a\n"},
+		zipEntry{"33/back.png", "\x89PNG\r\n\x1a\n"},
+		zipEntry{"33/empty.png", ""})
+	out, err := captureStdout(t, func() error { return ingestCmd([]string{"--target", root}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out, "cover.png") || strings.Contains(out, "22-h.htm") {
+		t.Errorf("ingest printed the members it passed over:\n%s", out)
+	}
+	if got := ids(t, db, "SELECT id FROM files WHERE name IN ('Emma', 'Persuasion') ORDER BY id"); got != "1 2" {
+		t.Errorf("books %q were ingested, want Emma and Persuasion", got)
+	}
+	var n int
+	if err = db.QueryRow("SELECT count(*) FROM files").Scan(&n); err != nil || n != 2 {
+		t.Errorf("%d books were ingested (%v)", n, err)
+	}
+	want := "no .txt member, only 1 .mp3, 2 .png, 1 empty .png"
+	var detail string
+	if err = db.QueryRow("SELECT message FROM warnings WHERE code = 'no_text_member' AND path LIKE '%33.zip'").Scan(&detail); err != nil || !strings.Contains(detail, want) {
+		t.Errorf("the archive of no text is warned of as %q (%v), want %q", detail, err, want)
+	}
+	if !strings.Contains(out, want) {
+		t.Errorf("ingest printed\n%s\nwant %q", out, want)
+	}
+}
+
+func TestTextCandidates(t *testing.T) {
+	member := func(name string, size int) *zip.File {
+		return &zip.File{FileHeader: zip.FileHeader{Name: name, UncompressedSize64: uint64(size)}}
+	}
+	files := []*zip.File{
+		member("1342/", 0),
+		member("1342/cover.JPG", 900),
+		member("1342/readme.txt", 40),
+		member("1342/LICENSE", 30),
+		member("1342/1342.txt", 7000),
+		member("1342/blank.jpg", 0),
+		member("1342/notes.TXT", 400),
+	}
+	candidates, others := textCandidates(files)
+	var names []string
+	for _, f := range candidates {
+		names = append(names, f.Name)
+	}
+	if got := strings.Join(names, " "); got != "1342/1342.txt 1342/notes.TXT 1342/readme.txt" {
+		t.Errorf("the candidates are %s", got)
+	}
+	if want := map[string]int{".jpg": 1, "empty .jpg": 1, "extensionless": 1}; !reflect.DeepEqual(others, want) {
+		t.Errorf("the others are %v, want %v", others, want)
+	}
+	if got := noTextDetail(others); got != "no .txt member, only 1 .jpg, 1 empty .jpg, 1 extensionless" {
+		t.Errorf("noTextDetail gave %q", got)
+	}
+	if got := noTextDetail(map[string]int{}); got != "the archive is empty" {
+		t.Errorf("noTextDetail of nothing gave %q", got)
+	}
+}
+
+// writeLyingZip writes an archive at path of one member, name, holding
+// text deflated but declaring only declared bytes of it uncompressed.
+func writeLyingZip(t *testing.T, path, name, text string, declared uint64) {
+	t.Helper()
+	var deflated bytes.Buffer
+	fw, err := flate.NewWriter(&deflated, flate.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fw.Write([]byte(text)); err != nil {
+		t.Fatal(err)
+	}
+	if err = fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	w, err := zw.CreateRaw(&zip.FileHeader{Name: name, Method: zip.Deflate,
+		CRC32: crc32.ChecksumIEEE([]byte(text)), CompressedSize64: uint64(deflated.Len()), UncompressedSize64: declared})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(deflated.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err = zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIngestDecompressionCaps(t *testing.T) {
+	// 3MB of one paragraph over and over, deflating to a few KB
+	bomb := testBook("Bomb", strings.Repeat("All work and no play makes Jack a dull boy.\n", 3<<20/44))
+	root := t.TempDir()
+	writeTestZip(t, filepath.Join(root, "1", "11.zip"), zipEntry{"11.txt", bomb})
+	writeLyingZip(t, filepath.Join(root, "2", "22.zip"), "22.txt", bomb, 4096)
+	// a bomb beside the book is passed over for it
+	writeTestZip(t, filepath.Join(root, "3", "33.zip"), zipEntry{"33.txt", bomb}, zipEntry{"33-0.txt", testBook("Emma", testParagraphs(2))})
+	writeTestZip(t, filepath.Join(root, "4", "44.zip"), zipEntry{"a.png", "x"}, zipEntry{"b.png", "x"}, zipEntry{"44.txt", testBook("Crowded", testParagraphs(2))})
+	writeTestZip(t, filepath.Join(root, "5", "55.zip"), zipEntry{"55.txt", testBook("Persuasion", testParagraphs(2))})
+	// and the same as a tar, of zips held in memory or spilled
+	packed := filepath.Join(t.TempDir(), "mirror.tar")
+	f, err := os.Create(packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(f)
+	for _, n := range []string{"1/11.zip", "2/22.zip", "3/33.zip", "4/44.zip", "5/55.zip"} {
+		b, err := os.ReadFile(filepath.Join(root, n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = tw.WriteHeader(&tar.Header{Name: n, Mode: 0o644, Size: int64(len(b))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = tw.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	limits := []string{"--max-file-size", "1MB", "--max-members", "2"}
+
+	for _, c := range []struct {
+		name string
+		run  func() error
+	}{
+		{"ingest", func() error { return ingestCmd(append([]string{"--target", root}, limits...)) }},
+		{"run --pipeline", func() error { return runCmd(append([]string{"--target", root, "--pipeline"}, limits...)) }},
+		{"ingest --archive", func() error { return ingestCmd(append([]string{"--target", root, "--archive", packed}, limits...)) }},
+		{"ingest --archive --spill-size", func() error {
+			return ingestCmd(append([]string{"--target", root, "--archive", packed, "--spill-size", "1KB"}, limits...))
+		}},
+	} {
+		db := testDB(t)
+		if _, err := captureStdout(t, c.run); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if got, want := names(t, db, "SELECT name FROM files ORDER BY id"), "Emma\nPersuasion\n"; got != want {
+			t.Errorf("%s stored\n%s\nwant\n%s", c.name, got, want)
+		}
+		want := "ingest warn too_large 11.txt\ningest warn too_large 22.txt\ningest warn too_large 33.txt\ningest warn too_many_members 44.zip\n"
+		if got := warningRows(t, db); !strings.HasPrefix(got, want) {
+			t.Errorf("%s warned\n%s\nwant\n%s", c.name, got, want)
+		}
+		if got, want := names(t, db, "SELECT message FROM warnings WHERE scope = 'ingest' ORDER BY path"),
+			"declares 3.0MB uncompressed, more than --max-file-size 1.0MB\ndecompresses to more than the 4.0KB it declares\n"+
+				"declares 3.0MB uncompressed, more than --max-file-size 1.0MB\nlists 3 members, more than --max-members 2\n"; got != want {
+			t.Errorf("%s warned\n%s\nwant\n%s", c.name, got, want)
+		}
+	}
+
+	// with no limit, the bomb is a book like another
+	db := testDB(t)
+	if _, err = captureStdout(t, func() error {
+		return ingestCmd([]string{"--target", root, "--max-file-size", "0", "--max-members", "0"})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// but for the one lying of its size
+	if got := names(t, db, "SELECT name FROM files ORDER BY id"); got != "Bomb\nBomb\nCrowded\nPersuasion\n" {
+		t.Errorf("without limits, ingest stored\n%s", got)
+	}
+
+	for _, args := range [][]string{{"--max-file-size", "lots"}, {"--max-members", "-1"}} {
+		if _, err := captureStdout(t, func() error { return ingestCmd(args) }); exitCode(err) != exitUsage {
+			t.Errorf("ingest %s: %v, want a usage error", strings.Join(args, " "), err)
+		}
+	}
+}
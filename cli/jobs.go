@@ -0,0 +1,350 @@
+package cli
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Work the API starts without waiting for it, like chunking a large
+// upload, is a row of the jobs table until it is done, so it outlives the
+// serve that took it. Each of serve's --job-workers claims the oldest job
+// due, marking it running until --job-timeout from now and moving that on
+// while the job runs, and runs it by its type's handler in jobHandlers. A
+// job whose serve died running it is claimed again once that time is up,
+// but one that has had its --job-attempts is failed instead, so a job
+// that kills its serve doesn't kill every serve after it. A job that fails
+// is tried again after a wait doubling from jobBackoff, up to
+// --job-attempts times in all, and then left failed with its last error. GET /jobs lists the latest jobs and GET /jobs/{id} shows one.
+// New kinds of background work plug in as handlers.
+
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// jobHandler runs a job from its payload, returning what to show as its
+// result.
+type jobHandler func(s *server, payload []byte) (interface{}, error)
+
+// jobHandlers run each type of job.
+var jobHandlers = map[string]jobHandler{
+	"upload": runUpload,
+}
+
+const (
+	// how long a job that failed waits to be tried again the first time
+	jobBackoff = 30 * time.Second
+	// how long an idle worker waits before looking for jobs again
+	jobPoll = 5 * time.Second
+)
+
+// job is a jobs row as the API shows it.
+type job struct {
+	ID        int64           `json:"id"`
+	Type      string          `json:"type"`
+	Status    string          `json:"status"`
+	Attempts  int             `json:"attempts"`
+	Result    json.RawMessage `json:"result,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	CreatedAt string          `json:"created_at"`
+	UpdatedAt string          `json:"updated_at"`
+}
+
+const jobCols = "id, type, state, attempts, coalesce(result, ''), coalesce(last_error, ''), created_at, updated_at"
+
+func scanJob(row interface{ Scan(...interface{}) error }) (job, error) {
+	var j job
+	var result string
+	err := row.Scan(&j.ID, &j.Type, &j.Status, &j.Attempts, &result, &j.Error, &j.CreatedAt, &j.UpdatedAt)
+	if result != "" {
+		j.Result = json.RawMessage(result)
+	}
+	return j, err
+}
+
+// jobQueue is the jobs table as serve works through it.
+type jobQueue struct {
+	db *sql.DB
+	w  *writer
+	// a claim lasts this long, and is renewed at half of it
+	timeout  time.Duration
+	attempts int
+	// a worker waiting for jobs is woken by one added
+	added chan struct{}
+}
+
+func newJobQueue(db *sql.DB, w *writer, timeout time.Duration, attempts int) *jobQueue {
+	return &jobQueue{db: db, w: w, timeout: timeout, attempts: attempts, added: make(chan struct{}, 1)}
+}
+
+// seconds is d as an sqlite datetime modifier.
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("+%d seconds", int64(d/time.Second))
+}
+
+// add queues a job of type typ to run from payload.
+func (q *jobQueue) add(typ string, payload interface{}) (int64, error) {
+	bs, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	var id int64
+	err = q.w.do(func(tx *sql.Tx) error {
+		res, err := tx.Exec(`INSERT INTO jobs (type, payload, state, run_after, created_at, updated_at)
+			VALUES (?, ?, ?, datetime('now'), datetime('now'), datetime('now'))`, typ, string(bs), jobQueued)
+		if err != nil {
+			return err
+		}
+		id, err = res.LastInsertId()
+		return err
+	})
+	if err == nil {
+		select {
+		case q.added <- struct{}{}:
+		default:
+		}
+	}
+	return id, err
+}
+
+// claimedJob is a job a worker has claimed: the attempts it is on tell its
+// claim from a later one, should it run past its timeout.
+type claimedJob struct {
+	id       int64
+	typ      string
+	payload  []byte
+	attempts int
+}
+
+// claim takes the oldest job due, queued or running past its claim, in
+// one statement, so no two workers get the same one. One running past its
+// claim on its last attempt is failed by the same statement, and the next
+// due is taken. It is nil when none is due.
+func (q *jobQueue) claim() (*claimedJob, error) {
+	var c *claimedJob
+	err := q.w.do(func(tx *sql.Tx) error {
+		for {
+			var j claimedJob
+			var payload sql.NullString
+			var state string
+			err := tx.QueryRow(`UPDATE jobs SET
+					state = CASE WHEN state = ? AND attempts >= ? THEN ? ELSE ? END,
+					last_error = CASE WHEN state = ? AND attempts >= ?
+						THEN printf('its claim ran out on attempt %d of %d; the job stopped its serve or hung', attempts, ?)
+						ELSE last_error END,
+					attempts = CASE WHEN state = ? AND attempts >= ? THEN attempts ELSE attempts + 1 END,
+					claimed_until = CASE WHEN state = ? AND attempts >= ? THEN NULL ELSE datetime('now', ?) END,
+					updated_at = datetime('now')
+				WHERE id = (SELECT id FROM jobs
+					WHERE state = ? AND run_after <= datetime('now') OR state = ? AND claimed_until <= datetime('now')
+					ORDER BY id LIMIT 1)
+				RETURNING id, type, payload, attempts, state`,
+				jobRunning, q.attempts, jobFailed, jobRunning,
+				jobRunning, q.attempts, q.attempts,
+				jobRunning, q.attempts,
+				jobRunning, q.attempts, seconds(q.timeout),
+				jobQueued, jobRunning).
+				Scan(&j.id, &j.typ, &payload, &j.attempts, &state)
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if state == jobFailed {
+				log.Printf("job %d (%s): its claim ran out on its last attempt, %d; failed it", j.id, j.typ, j.attempts)
+				continue
+			}
+			j.payload = []byte(payload.String)
+			c = &j
+			return nil
+		}
+	})
+	return c, err
+}
+
+// renew moves c's claim on to timeout from now, while it runs.
+func (q *jobQueue) renew(c *claimedJob) error {
+	return q.w.do(func(tx *sql.Tx) error {
+		_, err := tx.Exec("UPDATE jobs SET claimed_until = datetime('now', ?) WHERE id = ? AND state = ? AND attempts = ?",
+			seconds(q.timeout), c.id, jobRunning, c.attempts)
+		return err
+	})
+}
+
+// finish records how c went: done with result, or failed with err, to be
+// tried again after a backoff while it has attempts left. A claim taken
+// over by another worker in the meantime is left to that one.
+func (q *jobQueue) finish(c *claimedJob, result interface{}, jobErr error) error {
+	return q.w.do(func(tx *sql.Tx) error {
+		if jobErr == nil {
+			bs, err := json.Marshal(result)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(`UPDATE jobs SET state = ?, result = ?, payload = NULL, last_error = NULL, claimed_until = NULL, updated_at = datetime('now')
+				WHERE id = ? AND state = ? AND attempts = ?`, jobDone, string(bs), c.id, jobRunning, c.attempts)
+			return err
+		}
+		state, wait := jobFailed, time.Duration(0)
+		if c.attempts < q.attempts {
+			state, wait = jobQueued, jobBackoff<<(c.attempts-1)
+		}
+		_, err := tx.Exec(`UPDATE jobs SET state = ?, last_error = ?, run_after = datetime('now', ?), claimed_until = NULL, updated_at = datetime('now')
+			WHERE id = ? AND state = ? AND attempts = ?`, state, jobErr.Error(), seconds(wait), c.id, jobRunning, c.attempts)
+		return err
+	})
+}
+
+// pending counts the jobs not done or failed yet.
+func (q *jobQueue) pending() (int, error) {
+	var n int
+	err := q.db.QueryRow("SELECT count(*) FROM jobs WHERE state IN (?, ?)", jobQueued, jobRunning).Scan(&n)
+	return n, err
+}
+
+// work runs jobs as they come due, for good.
+func (s *server) work(q *jobQueue) {
+	for {
+		c, err := q.claim()
+		if err != nil {
+			log.Printf("could not claim a job: %v", err)
+		}
+		if c == nil {
+			select {
+			case <-q.added:
+			case <-time.After(jobPoll):
+			}
+			continue
+		}
+		result, err := s.runJob(q, c)
+		if err != nil {
+			log.Printf("job %d (%s), attempt %d: %v", c.id, c.typ, c.attempts, err)
+		}
+		if err = q.finish(c, result, err); err != nil {
+			log.Printf("could not record how job %d went: %v", c.id, err)
+		}
+	}
+}
+
+// runJob runs c by its handler, renewing its claim meanwhile. A panic is
+// the job failing.
+func (s *server) runJob(q *jobQueue, c *claimedJob) (result interface{}, err error) {
+	run, ok := jobHandlers[c.typ]
+	if !ok {
+		return nil, fmt.Errorf("no handler for jobs of type %q", c.typ)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		t := time.NewTicker(q.timeout / 2)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				if err := q.renew(c); err != nil {
+					log.Printf("could not renew the claim on job %d: %v", c.id, err)
+				}
+			}
+		}
+	}()
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("panic: %v", v)
+		}
+	}()
+	return run(s, c.payload)
+}
+
+// runUpload chunks an upload too large to chunk while its POST /books
+// waited.
+func runUpload(s *server, payload []byte) (interface{}, error) {
+	var u upload
+	if err := json.Unmarshal(payload, &u); err != nil {
+		return nil, err
+	}
+	id, n, err := s.storeUpload(u)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]int{"file_id": id, "chunks": n}, nil
+}
+
+// handleJobs serves GET /jobs, the latest ?limit= (100) jobs, only those
+// in ?state= when given, and GET /jobs/{id}.
+func (s *server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if rest := strings.TrimPrefix(r.URL.Path, "/jobs/"); rest != r.URL.Path && rest != "" {
+		s.handleJob(w, rest)
+		return
+	}
+	q := r.URL.Query()
+	state := q.Get("state")
+	switch state {
+	case "", jobQueued, jobRunning, jobDone, jobFailed:
+	default:
+		httpError(w, http.StatusBadRequest, "unknown state "+strconv.Quote(state))
+		return
+	}
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			httpError(w, http.StatusBadRequest, "bad limit "+strconv.Quote(v))
+			return
+		}
+		limit = n
+	}
+	rows, err := s.db.Query("SELECT "+jobCols+" FROM jobs WHERE ? = '' OR state = ? ORDER BY id DESC LIMIT ?", state, state, limit)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+	list := []job{}
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		list = append(list, j)
+	}
+	if err = rows.Err(); err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"jobs": list})
+}
+
+func (s *server) handleJob(w http.ResponseWriter, rest string) {
+	id, err := strconv.ParseInt(rest, 10, 64)
+	if err != nil {
+		httpError(w, http.StatusNotFound, "no such job")
+		return
+	}
+	j, err := scanJob(s.db.QueryRow("SELECT "+jobCols+" FROM jobs WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		httpError(w, http.StatusNotFound, "no such job")
+		return
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, j)
+}
@@ -0,0 +1,208 @@
+package cli
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testJobs registers a job type for the test, run by run.
+func testJobs(t *testing.T, typ string, run jobHandler) {
+	t.Helper()
+	jobHandlers[typ] = run
+	t.Cleanup(func() { delete(jobHandlers, typ) })
+}
+
+func jobState(t *testing.T, db *sql.DB, id int64) (state string, attempts int, lastErr string) {
+	t.Helper()
+	err := db.QueryRow("SELECT state, attempts, coalesce(last_error, '') FROM jobs WHERE id = ?", id).Scan(&state, &attempts, &lastErr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state, attempts, lastErr
+}
+
+// expireClaims moves every claim and wait to the past, as if the time were
+// up.
+func expireClaims(t *testing.T, db *sql.DB) {
+	t.Helper()
+	if _, err := db.Exec("UPDATE jobs SET claimed_until = datetime('now', '-1 seconds') WHERE claimed_until IS NOT NULL"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE jobs SET run_after = datetime('now', '-1 seconds')"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Two serves' workers over the one database never claim the same job.
+func TestJobClaimContention(t *testing.T) {
+	db := testDB(t)
+	other, err := connectDB(dsn, "", connOptions{foreignKeys: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	q := newJobQueue(db, writerOf(db), time.Minute, 3)
+	const jobs = 40
+	for i := 0; i < jobs; i++ {
+		if _, err := q.add("noop", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	queues := []*jobQueue{q, newJobQueue(other, writerOf(other), time.Minute, 3)}
+	var mu sync.Mutex
+	claimed := map[int64]int{}
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(q *jobQueue) {
+			defer wg.Done()
+			for {
+				c, err := retryClaim(q)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if c == nil {
+					return
+				}
+				mu.Lock()
+				claimed[c.id]++
+				mu.Unlock()
+			}
+		}(queues[w%2])
+	}
+	wg.Wait()
+	if len(claimed) != jobs {
+		t.Errorf("%d jobs claimed of %d", len(claimed), jobs)
+	}
+	for id, n := range claimed {
+		if n != 1 {
+			t.Errorf("job %d claimed %d times", id, n)
+		}
+	}
+}
+
+// retryClaim is claim, the database busy with the other connection's
+// claims tried again.
+func retryClaim(q *jobQueue) (*claimedJob, error) {
+	for {
+		c, err := q.claim()
+		if !isBusy(err) {
+			return c, err
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// A job that fails every time is tried --job-attempts times, and then
+// left failed with its error.
+func TestJobRetryExhaustion(t *testing.T) {
+	db := testDB(t)
+	runs := 0
+	testJobs(t, "doomed", func(s *server, payload []byte) (interface{}, error) {
+		runs++
+		return nil, errors.New("no good")
+	})
+	s := &server{db: db}
+	q := newJobQueue(db, writerOf(db), time.Minute, 3)
+	id, err := q.add("doomed", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		expireClaims(t, db)
+		c, err := q.claim()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c == nil {
+			break
+		}
+		result, err := s.runJob(q, c)
+		if err = q.finish(c, result, err); err != nil {
+			t.Fatal(err)
+		}
+	}
+	state, attempts, lastErr := jobState(t, db, id)
+	if state != jobFailed || attempts != 3 || runs != 3 || lastErr != "no good" {
+		t.Errorf("%s after %d attempts and %d runs, error %q; want failed after 3", state, attempts, runs, lastErr)
+	}
+}
+
+// A job whose serve died running it is claimed again once its claim is
+// up, by a serve started after, and run to the end.
+func TestJobRestartRecovery(t *testing.T) {
+	db := testDB(t)
+	testJobs(t, "survivor", func(s *server, payload []byte) (interface{}, error) {
+		return map[string]string{"said": string(payload)}, nil
+	})
+	first := newJobQueue(db, writerOf(db), time.Minute, 3)
+	id, err := first.add("survivor", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := first.claim(); err != nil || c == nil || c.id != id {
+		t.Fatalf("claimed %v, %v", c, err)
+	}
+	// the first serve dies here, its claim left to run out
+
+	again := newJobQueue(db, writerOf(db), time.Minute, 3)
+	if c, err := again.claim(); err != nil || c != nil {
+		t.Fatalf("claimed %v, %v while the first claim holds", c, err)
+	}
+	expireClaims(t, db)
+	c, err := again.claim()
+	if err != nil || c == nil || c.id != id || c.attempts != 2 {
+		t.Fatalf("claimed %+v, %v; want job %d on attempt 2", c, err, id)
+	}
+	s := &server{db: db}
+	result, err := s.runJob(again, c)
+	if err = again.finish(c, result, err); err != nil {
+		t.Fatal(err)
+	}
+	if state, _, _ := jobState(t, db, id); state != jobDone {
+		t.Errorf("job %s, want done", state)
+	}
+	// the first serve's claim is over, and what it would record is ignored
+	if err = first.finish(&claimedJob{id: id, attempts: 1}, nil, errors.New("late")); err != nil {
+		t.Fatal(err)
+	}
+	if state, _, _ := jobState(t, db, id); state != jobDone {
+		t.Errorf("a stale claim's failure was recorded: %s", state)
+	}
+}
+
+// A job that kills every serve claiming it is failed once it has had its
+// attempts, rather than claimed again for good.
+func TestJobCrashExhaustion(t *testing.T) {
+	db := testDB(t)
+	q := newJobQueue(db, writerOf(db), time.Minute, 2)
+	crash, err := q.add("crash", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := q.add("noop", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for attempt := 1; attempt <= 2; attempt++ {
+		c, err := q.claim()
+		if err != nil || c == nil || c.id != crash || c.attempts != attempt {
+			t.Fatalf("claimed %+v, %v; want the crashing job on attempt %d", c, err, attempt)
+		}
+		// serve dies running it
+		expireClaims(t, db)
+	}
+	c, err := q.claim()
+	if err != nil || c == nil || c.id != next {
+		t.Fatalf("claimed %+v, %v; want the next job", c, err)
+	}
+	state, attempts, lastErr := jobState(t, db, crash)
+	if state != jobFailed || attempts != 2 || lastErr == "" {
+		t.Errorf("crashing job %s after %d attempts, error %q; want failed after 2", state, attempts, lastErr)
+	}
+}
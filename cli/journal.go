@@ -0,0 +1,145 @@
+package cli
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// The ingest journal records each archive as started before its
+// transaction opens and as completed inside it. An archive left started was
+// interrupted: whatever it wrote is cleaned up and it is ingested again.
+// Archives are journaled by root and name under it (see paths.go), so
+// two mirrors sharing names journal their walks apart; the books stored
+// under a name are one mirror's at most, the other's being from another
+// source.
+
+func journalStart(db *sql.DB, root, archive string) error {
+	_, err := db.Exec(`
+		INSERT INTO ingest_journal (archive, root, status, started_at) VALUES (?, ?, 'started', datetime('now'))
+		ON CONFLICT (root, archive) DO UPDATE SET status = 'started',
+			started_at = excluded.started_at, completed_at = NULL`,
+		archive, root)
+	return err
+}
+
+// journalDone must run in the archive's transaction, so an archive is never
+// marked completed without its rows or the other way around.
+func journalDone(tx *sql.Tx, root, archive string) error {
+	_, err := tx.Exec("UPDATE ingest_journal SET status = 'completed', completed_at = datetime('now') WHERE root = ? AND archive = ?", root, archive)
+	return err
+}
+
+func clearJournal(db *sql.DB, root string) error {
+	_, err := db.Exec("DELETE FROM ingest_journal WHERE root = ?", root)
+	return err
+}
+
+// completedArchives returns the archives under root ingested to completion,
+// and the last of them in walk order.
+func completedArchives(db *sql.DB, root string) (map[string]bool, string, error) {
+	rows, err := db.Query("SELECT archive FROM ingest_journal WHERE root = ? AND status = 'completed'", root)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+	done := map[string]bool{}
+	last := ""
+	for rows.Next() {
+		var a string
+		if err = rows.Scan(&a); err != nil {
+			return nil, "", err
+		}
+		done[a] = true
+		if last == "" || walkBefore(last, a) {
+			last = a
+		}
+	}
+	return done, last, rows.Err()
+}
+
+// repairJournal removes anything written for archives under root that
+// started but never completed, and returns them, first in walk order first.
+// Their journal rows stay started until they are ingested again.
+func repairJournal(db *sql.DB, root string) ([]string, error) {
+	rows, err := db.Query("SELECT archive FROM ingest_journal WHERE root = ? AND status = 'started'", root)
+	if err != nil {
+		return nil, err
+	}
+	undone := []string{}
+	for rows.Next() {
+		var a string
+		if err = rows.Scan(&a); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		undone = append(undone, a)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, a := range undone {
+		tx, err := db.Begin()
+		if err != nil {
+			return nil, err
+		}
+		if err = removeArchive(tx, a); err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("could not clean up %s: %w", a, err)
+		}
+		if err = tx.Commit(); err != nil {
+			return nil, err
+		}
+	}
+	for i := 1; i < len(undone); i++ {
+		for j := i; j > 0 && walkBefore(undone[j], undone[j-1]); j-- {
+			undone[j], undone[j-1] = undone[j-1], undone[j]
+		}
+	}
+	return undone, nil
+}
+
+// removeArchive deletes every row ingesting archive wrote, and what was
+// made from its books since.
+func removeArchive(tx *sql.Tx, archive string) error {
+	books := "SELECT id FROM files WHERE archive = ?"
+	if err := logChunks(tx, eventRolledBack, 0, books, archive); err != nil {
+		return err
+	}
+	for _, q := range []string{
+		"DELETE FROM chunks WHERE sourceid IN (" + books + ")",
+		"DELETE FROM footnotes WHERE sourceid IN (" + books + ")",
+		"DELETE FROM strategy_chunks WHERE sourceid IN (" + books + ")",
+		"DELETE FROM book_terms WHERE sourceid IN (" + books + ")",
+		"DELETE FROM warnings WHERE file_id IN (" + books + ")",
+		"DELETE FROM files WHERE archive = ?",
+		"DELETE FROM warnings WHERE path = ?",
+		"DELETE FROM source_conflicts WHERE archive_path = ?",
+	} {
+		if _, err := tx.Exec(q, archive); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkBefore reports whether WalkDir visits a before b. WalkDir sorts the
+// entries of each directory by name, which is not plain string order on the
+// whole path: "1/2/x" is walked before "1/2-a" although '-' sorts before '/'.
+func walkBefore(a, b string) bool {
+	as := strings.Split(filepath.ToSlash(a), "/")
+	bs := strings.Split(filepath.ToSlash(b), "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] != bs[i] {
+			return as[i] < bs[i]
+		}
+	}
+	return len(as) < len(bs)
+}
+
+func isAncestor(dir, path string) bool {
+	return strings.HasPrefix(filepath.ToSlash(path), strings.TrimSuffix(filepath.ToSlash(dir), "/")+"/")
+}
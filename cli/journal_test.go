@@ -0,0 +1,161 @@
+package cli
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// walkFixture is a mirror of six archives in three directories, in walk
+// order, the fourth not yet a zip, as a walk reaching it mid-copy would
+// find it.
+func walkFixture(t *testing.T) (root string, archives []string) {
+	t.Helper()
+	root = t.TempDir()
+	for i := 1; i <= 6; i++ {
+		name := fmt.Sprintf("%d/%d%d.zip", (i+1)/2, i, i)
+		path := filepath.Join(root, filepath.FromSlash(name))
+		title := fmt.Sprintf("Book %d", i)
+		writeTestZip(t, path, zipEntry{fmt.Sprintf("%d%d.txt", i, i), testBook(title, testParagraphs(2))})
+		archives = append(archives, path)
+	}
+	if err := os.WriteFile(archives[3], []byte("half copied"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return root, archives
+}
+
+func TestIngestResume(t *testing.T) {
+	root, archives := walkFixture(t)
+	db := testDB(t)
+	if err := readFiles(db, root, ingestOptions{}); err == nil {
+		t.Fatal("the walk went on past an archive it couldn't read")
+	}
+	if n := len(ingestRows(t, db)); n != 3 {
+		t.Fatalf("the interrupted walk ingested %d archives, want the 3 before it stopped", n)
+	}
+	var completed int
+	if err := db.QueryRow("SELECT count(*) FROM ingest_journal WHERE root = ? AND status = 'completed'", root).Scan(&completed); err != nil {
+		t.Fatal(err)
+	}
+	if completed != 3 {
+		t.Errorf("the journal has %d archives completed, want 3: the one that failed never committed", completed)
+	}
+
+	// what was ingested can no longer be read, so resuming must not read it
+	for _, a := range archives[:3] {
+		if err := os.WriteFile(a, []byte("gone"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestZip(t, archives[3], zipEntry{"44.txt", testBook("Book 4", testParagraphs(2))})
+	if err := readFiles(db, root, ingestOptions{resume: true}); err != nil {
+		t.Fatalf("resuming: %v", err)
+	}
+
+	seen := map[string]int{}
+	for _, b := range ingestRows(t, db) {
+		seen[b.name]++
+	}
+	for i := 1; i <= 6; i++ {
+		if n := seen[fmt.Sprintf("Book %d", i)]; n != 1 {
+			t.Errorf("Book %d was ingested %d times, want once", i, n)
+		}
+	}
+	if len(seen) != 6 {
+		t.Errorf("ingested %v, want the six books", seen)
+	}
+}
+
+func TestWalkBefore(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		want bool
+	}{
+		{"1/11.zip", "2/33.zip", true},
+		{"2/33.zip", "1/11.zip", false},
+		{"1", "1/11.zip", true},
+		{"1/11.zip", "1", false},
+		// by path element, as WalkDir visits, not byte by byte
+		{"1/9.zip", "1-x/1.zip", true},
+		{"1/11.zip", "1/11.zip", false},
+	} {
+		if got := walkBefore(c.a, c.b); got != c.want {
+			t.Errorf("walkBefore(%q, %q) = %v, want %v", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestIngestRepairsInterrupted(t *testing.T) {
+	root := t.TempDir()
+	// the cover, misnamed, is read and rejected before the smaller text
+	first, second := filepath.Join(root, "1", "11.zip"), filepath.Join(root, "2", "22.zip")
+	writeTestZip(t, first, zipEntry{"11.txt", testBook("Book 1", testParagraphs(2))}, zipEntry{"cover.txt", strings.Repeat(string(pngBytes(t)), 100)})
+	writeTestZip(t, second, zipEntry{"22.txt", testBook("Book 2", testParagraphs(3))})
+	db := testDB(t)
+
+	// the first dies after its rows are written, before it is journaled done
+	killed := errors.New("killed")
+	err := ingestJournaled(db, root, mirrorName(root, first), func(tx *sql.Tx) (Reason, error) {
+		if _, err := ingestArchive(tx, first, mirrorName(root, first), ingestOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		return Reason{}, killed
+	})
+	if !errors.Is(err, killed) {
+		t.Fatalf("ingestJournaled: %v, want the failure injected", err)
+	}
+	if n := len(ingestRows(t, db)); n != 0 {
+		t.Errorf("%d books stored by the archive that failed", n)
+	}
+	var warned int
+	if err = db.QueryRow("SELECT count(*) FROM warnings").Scan(&warned); err != nil {
+		t.Fatal(err)
+	}
+	if warned != 0 {
+		t.Errorf("%d warnings kept of the archive that failed", warned)
+	}
+	// the second's rows were committed and chunked, its journal row left
+	// started, as by a run from before archives had a transaction each
+	if err = ingestOne(db, root, second, mirrorName(root, second), ingestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = makeChunks(db, chunkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec("UPDATE ingest_journal SET status = 'started', completed_at = NULL"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = readFiles(db, root, ingestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]int{}
+	for _, b := range ingestRows(t, db) {
+		seen[b.name]++
+	}
+	if len(seen) != 2 || seen["Book 1"] != 1 || seen["Book 2"] != 1 {
+		t.Errorf("ingested %v, want each book once", seen)
+	}
+	for _, c := range []struct {
+		what, query string
+		want        int
+	}{
+		{"the cover's warnings", "SELECT count(*) FROM warnings WHERE member = 'cover.txt'", 1},
+		{"chunks of books no longer stored", "SELECT count(*) FROM chunks WHERE sourceid NOT IN (SELECT id FROM files)", 0},
+		{"archives not journaled completed", "SELECT count(*) FROM ingest_journal WHERE status != 'completed'", 0},
+		{"journal rows", "SELECT count(*) FROM ingest_journal", 2},
+	} {
+		var n int
+		if err = db.QueryRow(c.query).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != c.want {
+			t.Errorf("%d %s, want %d", n, c.what, c.want)
+		}
+	}
+}
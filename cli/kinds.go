@@ -0,0 +1,205 @@
+package cli
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// chunk --tag-kinds tags each chunk in chunks.kind with the coarse kind of
+// writing it is, for sampling by style: dialogue, a letter, an epigraph,
+// or narrative. random and serve take --kind, and ?kind=, for chunks of
+// one kind. Each detector would rather miss a chunk than claim one that
+// isn't its kind, so what none is sure of is narrative. Chunks chunked
+// without --tag-kinds have no kind and match none.
+
+const (
+	kindNarrative = "narrative"
+	kindDialogue  = "dialogue"
+	kindLetter    = "letter"
+	kindEpigraph  = "epigraph"
+)
+
+// chunkKinds are the kinds a chunk can be tagged with.
+var chunkKinds = []string{kindNarrative, kindDialogue, kindLetter, kindEpigraph}
+
+// kindDetectors are tried in order on a chunk's lines, the first to claim
+// it giving its kind: an epigraph or a letter may well quote someone, so
+// both go before dialogue.
+var kindDetectors = []struct {
+	kind   string
+	detect func(lines []string) bool
+}{
+	{kindEpigraph, isEpigraph},
+	{kindLetter, isLetter},
+	{kindDialogue, isDialogue},
+}
+
+// chunkKind is the kind of the chunk text, a paragraph as chunking reads
+// it, one line of the book to a line, or stored.
+func chunkKind(text string) string {
+	lines := []string{}
+	for _, l := range strings.Split(text, "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			lines = append(lines, l)
+		}
+	}
+	if len(lines) == 0 {
+		return kindNarrative
+	}
+	for _, d := range kindDetectors {
+		if d.detect(lines) {
+			return d.kind
+		}
+	}
+	return kindNarrative
+}
+
+func parseKind(s string) (string, error) {
+	for _, k := range chunkKinds {
+		if s == k {
+			return s, nil
+		}
+	}
+	return "", fmt.Errorf("bad kind %q; want %s", s, strings.Join(chunkKinds, ", "))
+}
+
+const (
+	// the most words an epigraph's quotation has, and its lines
+	epigraphWords = 80
+	epigraphLines = 10
+)
+
+// epigraphBy is the line closing an epigraph, "—Shakespeare." or
+// "-- _Hamlet_, Act III": a dash, then a name or a title, perhaps in
+// underscores.
+var epigraphBy = regexp.MustCompile(`^(?:—|―|--)\s*(?:_|\*)?\p{Lu}[^.!?]{0,60}[.!?]?(?:_|\*)?$`)
+
+// isEpigraph reports whether lines are a short quotation ending with its
+// attribution on a line of its own.
+func isEpigraph(lines []string) bool {
+	if len(lines) < 2 || len(lines) > epigraphLines+1 {
+		return false
+	}
+	last := lines[len(lines)-1]
+	if !epigraphBy.MatchString(last) || len(strings.Fields(last)) > 10 {
+		return false
+	}
+	// a name or a title has its longer words in capitals, where a line of
+	// prose set after a dash, "-- Then he came.", hasn't
+	for _, w := range strings.FieldsFunc(last, func(r rune) bool { return !unicode.IsLetter(r) }) {
+		if r, _ := utf8.DecodeRuneInString(w); utf8.RuneCountInString(w) > 3 && unicode.IsLower(r) {
+			return false
+		}
+	}
+	words := 0
+	for _, l := range lines[:len(lines)-1] {
+		words += len(strings.Fields(l))
+	}
+	return words <= epigraphWords
+}
+
+var (
+	// "My dear Harriet," "Dear Sir:" "Honoured Madam,"
+	salutation = regexp.MustCompile(`^(?:(?:(?:My|Mine) (?i:dear|dearest|darling|beloved|honou?red|respected|esteemed)|Dear|Dearest|Darling|Beloved|Honou?red|Respected|Esteemed)(?: [\p{L}.']+){0,3}|Sir|Madam|Madame|Gentlemen|Sirs)[,:]$`)
+	// "Yours truly," "Your affectionate son," "Believe me, ever yours,"
+	signOff = regexp.MustCompile(`^(?:(?:I am|I remain|Believe me),? )?(?:(?:[Ee]ver|[Aa]lways|[Vv]ery|[Mm]ost|[Ff]aithfully|[Ss]incerely|[Aa]ffectionately|[Tt]ruly) )*(?:[Yy]ours|Your(?: \p{Ll}+){1,2})(?: \p{Ll}+){0,2},$`)
+)
+
+// isLetter reports whether lines open with a salutation on a line of its
+// own, or close with a sign-off on one with the name signed after it.
+func isLetter(lines []string) bool {
+	if len(lines) < 2 {
+		return false
+	}
+	if salutation.MatchString(lines[0]) {
+		return true
+	}
+	// the sign-off, then the name, perhaps with a place or date after
+	from := len(lines) - 3
+	if from < 0 {
+		from = 0
+	}
+	for i := from; i < len(lines)-1; i++ {
+		if signOff.MatchString(lines[i]) && len(strings.Fields(lines[i+1])) <= 5 {
+			return true
+		}
+	}
+	return false
+}
+
+// speechTag is the most letters a sentence opening with a quotation may
+// have outside it and still be counted as speech, as in "I will," he
+// answered.
+const speechTag = 20
+
+// isDialogue reports whether most of the sentences of lines are speech:
+// more than half their letters inside quotation marks, or opening with a
+// quotation and having no more than a speechTag outside it. A tag left
+// over after a quotation's ! or ?, "Go!" she said., isn't counted at all.
+// A speech run on from the paragraph before, opened and never closed as
+// books set them, is quoted to its end. A narrative sentence quoting a
+// phrase of a few words isn't speech.
+func isDialogue(lines []string) bool {
+	text := strings.Join(lines, " ")
+	inside := quotedRunes(text)
+	sentences, quoted := 0, 0
+	count := func(start, end int) {
+		letters, in := 0, 0
+		opens, tag := false, false
+		for i, r := range text[start:end] {
+			if unicode.IsLetter(r) {
+				if letters == 0 {
+					opens, tag = inside[start+i], unicode.IsLower(r)
+				}
+				letters++
+				if inside[start+i] {
+					in++
+				}
+			}
+		}
+		if letters == 0 || tag && in == 0 {
+			return
+		}
+		sentences++
+		if in*2 > letters || opens && letters-in <= speechTag {
+			quoted++
+		}
+	}
+	start := 0
+	for _, e := range sentenceEnd.FindAllStringIndex(text, -1) {
+		count(start, e[1])
+		start = e[1]
+	}
+	count(start, len(text))
+	return sentences > 0 && quoted*2 > sentences
+}
+
+// quotedRunes marks the bytes of text that begin a rune inside double
+// quotation marks, straight or curly.
+func quotedRunes(text string) map[int]bool {
+	inside := map[int]bool{}
+	in := false
+	for i, r := range text {
+		switch r {
+		case '“':
+			in = true
+			continue
+		case '”':
+			in = false
+			continue
+		case '"':
+			// a straight quote opens after a space, or at the start, and
+			// closes anywhere else
+			prev, _ := utf8.DecodeLastRuneInString(text[:i])
+			in = i == 0 || unicode.IsSpace(prev) || strings.ContainsRune("([—-", prev)
+			continue
+		}
+		if in {
+			inside[i] = true
+		}
+	}
+	return inside
+}
@@ -0,0 +1,96 @@
+package cli
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestChunkKind(t *testing.T) {
+	for _, c := range []struct {
+		name, text, want string
+	}{
+		// dialogue
+		{"an exchange", `"Where have you been?" asked Marianne. "Out walking," said Elinor. "In this rain?" "In this rain."`, kindDialogue},
+		{"curly quotes", "“I will,” he answered. “You may be sure of it.” She did not reply.", kindDialogue},
+		{"a speech run on from the paragraph before", `"And so I went to the door, and there was no one there, and I went back to my chair, and sat, and waited for the knock again.`, kindDialogue},
+		{"a narrative paragraph quoting one phrase", `He had been called "the terror of the parish" in his youth, and it was a name he never quite lived down. The years went by, the parish grew, and the old men who remembered it died one by one.`, kindNarrative},
+		{"narrative with a short quotation in each of two sentences", `The sign said "closed" but the door was open. Someone had written "back soon" beneath it, a long time ago by the look of the ink, and nobody had come back.`, kindNarrative},
+
+		// letters
+		{"a salutation", "My dear Harriet,\nI write in haste, for the post goes at six, and I would not have you hear it from anyone else.", kindLetter},
+		{"a formal one", "Dear Sir:\nIn reply to yours of the 3rd, I regret that the rooms are let.", kindLetter},
+		{"a sign-off and a name", "I shall be with you on Thursday, if the roads allow it, and we shall talk of it then.\nYours affectionately,\nE. Woodhouse", kindLetter},
+		{"a sign-off, a name and a place", "Do not trouble to answer this.\nBelieve me, ever yours,\nJohn\nHartfield, May 4.", kindLetter},
+		{"dear in a sentence", "Dear me, she thought, how the time goes, and the kettle not yet on.", kindNarrative},
+		{"a sign-off closing a long line", "It ended as all his letters did, yours truly, and the name scrawled under it.", kindNarrative},
+
+		// epigraphs
+		{"a quotation and its author", "The quality of mercy is not strain'd,\nIt droppeth as the gentle rain from heaven\n—Shakespeare.", kindEpigraph},
+		{"a title in underscores", "Full fathom five thy father lies;\nOf his bones are coral made.\n-- _The Tempest_", kindEpigraph},
+		{"prose after a dash", "He waited at the gate until dark.\n-- Then he came, at last, along the lane.", kindNarrative},
+		{"too long to be one", strings.Repeat("A line of verse that goes on for a while,\n", 12) + "—Anonymous.", kindNarrative},
+
+		{"plain narrative", testParagraphs(1), kindNarrative},
+		{"nothing", "\n\n", kindNarrative},
+	} {
+		if got := chunkKind(c.text); got != c.want {
+			t.Errorf("%s is %s, want %s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestParseKind(t *testing.T) {
+	for _, k := range chunkKinds {
+		if got, err := parseKind(k); err != nil || got != k {
+			t.Errorf("parseKind(%q) = %q, %v", k, got, err)
+		}
+	}
+	if _, err := parseKind("poem"); err == nil || err.Error() != `bad kind "poem"; want narrative, dialogue, letter, epigraph` {
+		t.Errorf("parseKind(poem): %v", err)
+	}
+}
+
+func TestTagKinds(t *testing.T) {
+	db := testDB(t)
+	body := strings.Join([]string{
+		testParagraphs(1),
+		`"Where have you been all this while, and in such weather?" asked Marianne. "Out walking on the downs," said Elinor. "In this rain, and with no coat?" "In this rain, and with no coat; I did not feel it." "You will catch your death, and then what shall we do?" "Then you shall have my room, which is the larger, and the view of the church." "I do not want your room." "Then you shall have my coat, which is drier than I am."`,
+		"My dear Harriet,\nI write in haste, for the post goes at six, and I would not have you hear it from anyone else but me, who was there and saw it all.\nThe carriage overturned at the foot of the hill, and though nobody was hurt, the horses ran off across the common and were not found until the morning, by which time the whole village had heard of it.",
+	}, "\n\n")
+	addBook(t, db, "Sense and Sensibility", "Jane Austen", testBook("Sense and Sensibility", body))
+	chunk := func(args ...string) string {
+		t.Helper()
+		if _, err := captureStdout(t, func() error { return chunkCmd(args) }); err != nil {
+			t.Fatal(err)
+		}
+		return names(t, db, "SELECT coalesce(kind, 'null') FROM chunks ORDER BY ordinal")
+	}
+	random := func(kind string) (string, error) {
+		return captureStdout(t, func() error { return randomCmd([]string{"--kind", kind, "--width", "0"}) })
+	}
+
+	// untagged, no chunk is of any kind
+	if got := chunk(); got != "null\nnull\nnull\n" {
+		t.Fatalf("chunked without --tag-kinds, the kinds are\n%s", got)
+	}
+	if _, err := random(kindNarrative); err == nil {
+		t.Error("random --kind narrative drew from untagged chunks")
+	}
+
+	if got := chunk("--tag-kinds", "--full-rechunk"); got != "narrative\ndialogue\nletter\n" {
+		t.Fatalf("chunked with --tag-kinds, the kinds are\n%s", got)
+	}
+	for kind, want := range map[string]string{kindNarrative: "number i,", kindDialogue: "asked Marianne", kindLetter: "My dear Harriet,"} {
+		for i := 0; i < 5; i++ {
+			if out, err := random(kind); err != nil || !strings.Contains(out, want) {
+				t.Errorf("random --kind %s drew %q (%v)", kind, out, err)
+			}
+		}
+	}
+	if _, err := random(kindEpigraph); err == nil || err.Error() != "no chunk satisfies the filters" {
+		t.Errorf("random --kind epigraph: %v", err)
+	}
+	if _, err := random("poem"); exitCode(err) != exitUsage {
+		t.Errorf("random --kind poem: %v, want a usage error", err)
+	}
+}
@@ -0,0 +1,140 @@
+package cli
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Interactive requests, serve's /chunks/random above all, are answered
+// beside bulk work writing the same database: chunk or run chunking the
+// library again, count-tokens filling in counts, serve's own background
+// jobs. Within a process every writer of a database is the one writer,
+// whose lock has two lanes: an interactive transaction, the one logging a
+// chunk served say, takes it as soon as the transaction holding it is done,
+// before every bulk one waiting, and the passive checkpoint after a bulk
+// commit is made with the lock let go, so nothing queues behind it.
+//
+// Another process can't see that queue, so each bulk write transaction, a
+// book's chunks, leaves the database unlocked for --bulk-yield (2ms) after
+// the one before it, and serve reads and writes for /chunks/random on a
+// pool of its own whose busy_timeout is 2ms, trying again every
+// millisecond for --interactive-wait (2s) rather than waiting out sqlite's
+// ever longer sleeps behind a checkpoint or another process's write, and
+// answering 503 with a Retry-After if the database is busy still. Its
+// /metrics give the 50th and 99th percentile latency of the last thousand
+// /chunks/random, and how many tries found the database busy; gutchunk
+// bench --interactive times draws made beside its chunking the same way.
+
+var bulkYield = flag.Duration("bulk-yield", 2*time.Millisecond, "leave the database unlocked this long between bulk write transactions, for other processes' writes (see lanes.go)")
+
+// interactiveWait is how long an interactive statement is tried again
+// while the database is busy, serve --interactive-wait.
+var interactiveWait = 2 * time.Second
+
+// quickBusyTimeout is the busy_timeout of serve's pool for requests.
+const quickBusyTimeout = 2 * time.Millisecond
+
+// busyRetries counts the tries retryBusy made again.
+var busyRetries int64
+
+// writers are the writer of each database, shared by everything writing
+// it in the process.
+var writers = struct {
+	sync.Mutex
+	of map[*sql.DB]*writer
+}{of: map[*sql.DB]*writer{}}
+
+func isBusy(err error) bool {
+	var serr sqlite3.Error
+	return errors.As(err, &serr) && (serr.Code == sqlite3.ErrBusy || serr.Code == sqlite3.ErrLocked)
+}
+
+// retryBusy runs fn, and again every millisecond it finds the database
+// busy, for interactiveWait.
+func retryBusy(fn func() error) error {
+	deadline := time.Now().Add(interactiveWait)
+	for {
+		err := fn()
+		if !isBusy(err) || time.Now().After(deadline) {
+			return err
+		}
+		atomic.AddInt64(&busyRetries, 1)
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// openQuickDB opens the database openDB opened again, as its pool for
+// interactive requests, with quickBusyTimeout.
+func openQuickDB() (*sql.DB, error) {
+	key, err := dbKey()
+	if err != nil {
+		return nil, err
+	}
+	o := dbConnOptions
+	o.busy = quickBusyTimeout
+	db, err := connectDB(dsn, key, o)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to %s: %w", dsn, err)
+	}
+	if err = checkConnections(db, o.pragmas(), 2); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// latencyWindow is how many of the latest interactive requests latencies
+// keeps.
+const latencyWindow = 1000
+
+// latencies are the times interactive requests took.
+type latencies struct {
+	mu    sync.Mutex
+	times []time.Duration
+	next  int
+	count int64
+}
+
+type latencyStats struct {
+	Requests    int64   `json:"requests"`
+	P50         float64 `json:"p50_ms"`
+	P99         float64 `json:"p99_ms"`
+	Max         float64 `json:"max_ms"`
+	BusyRetries int64   `json:"busy_retries"`
+}
+
+func (l *latencies) add(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.count++
+	if len(l.times) < latencyWindow {
+		l.times = append(l.times, d)
+		return
+	}
+	l.times[l.next] = d
+	l.next = (l.next + 1) % latencyWindow
+}
+
+// stats are the percentiles of the requests kept, in milliseconds.
+func (l *latencies) stats() latencyStats {
+	l.mu.Lock()
+	times := append([]time.Duration{}, l.times...)
+	st := latencyStats{Requests: l.count, BusyRetries: atomic.LoadInt64(&busyRetries)}
+	l.mu.Unlock()
+	if len(times) == 0 {
+		return st
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	at := func(p float64) time.Duration { return times[int(p*float64(len(times)-1))] }
+	st.P50, st.P99, st.Max = ms(at(0.5)), ms(at(0.99)), ms(times[len(times)-1])
+	return st
+}
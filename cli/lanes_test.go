@@ -0,0 +1,292 @@
+package cli
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// withBulkYield runs f with --bulk-yield set to d.
+func withBulkYield(d time.Duration, f func()) {
+	defer func(was time.Duration) { *bulkYield = was }(*bulkYield)
+	*bulkYield = d
+	f()
+}
+
+func TestLatencies(t *testing.T) {
+	var l latencies
+	if st := l.stats(); st.Requests != 0 || st.P50 != 0 || st.P99 != 0 || st.Max != 0 {
+		t.Errorf("no requests' stats are %+v", st)
+	}
+	// only the latest latencyWindow are kept
+	for i := 1; i <= 2000; i++ {
+		l.add(time.Duration(i) * time.Millisecond)
+	}
+	st := l.stats()
+	if st.Requests != 2000 || st.P50 != 1500 || st.P99 != 1990 || st.Max != 2000 {
+		t.Errorf("the stats of 1ms to 2000ms are %+v", st)
+	}
+	l = latencies{}
+	l.add(1500 * time.Microsecond)
+	if st = l.stats(); st.Requests != 1 || st.P50 != 1.5 || st.P99 != 1.5 || st.Max != 1.5 {
+		t.Errorf("the stats of one request of 1.5ms are %+v", st)
+	}
+}
+
+func TestRetryBusy(t *testing.T) {
+	defer func(was time.Duration) { interactiveWait = was }(interactiveWait)
+	interactiveWait = 50 * time.Millisecond
+	if !isBusy(sqlite3.Error{Code: sqlite3.ErrBusy}) || !isBusy(fmt.Errorf("read: %w", sqlite3.Error{Code: sqlite3.ErrLocked})) ||
+		isBusy(sqlite3.Error{Code: sqlite3.ErrConstraint}) || isBusy(errors.New("busy")) || isBusy(nil) {
+		t.Error("isBusy told busy from not")
+	}
+
+	retries := atomic.LoadInt64(&busyRetries)
+	tries := 0
+	if err := retryBusy(func() error {
+		if tries++; tries < 3 {
+			return sqlite3.Error{Code: sqlite3.ErrBusy}
+		}
+		return nil
+	}); err != nil || tries != 3 || atomic.LoadInt64(&busyRetries)-retries != 2 {
+		t.Errorf("retryBusy of two busy tries: %v, after %d tries, counting %d again", err, tries, atomic.LoadInt64(&busyRetries)-retries)
+	}
+	// another error isn't tried again
+	tries = 0
+	if err := retryBusy(func() error { tries++; return sqlite3.Error{Code: sqlite3.ErrConstraint} }); tries != 1 || isBusy(err) {
+		t.Errorf("retryBusy of a constraint failing: %v, after %d tries", err, tries)
+	}
+	// busy throughout, it gives up after interactiveWait
+	start := time.Now()
+	err := retryBusy(func() error { return sqlite3.Error{Code: sqlite3.ErrBusy} })
+	if took := time.Since(start); !isBusy(err) || took < interactiveWait || took > 20*interactiveWait {
+		t.Errorf("retryBusy of a database busy throughout: %v after %v", err, took)
+	}
+}
+
+// An interactive transaction takes the writer's lock before the bulk ones
+// waiting for it, and a bulk one waits out --bulk-yield after the one
+// before it; the interactive lane doesn't.
+func TestWriterLanes(t *testing.T) {
+	db := testDB(t)
+	w := writerOf(db)
+	if writerOf(db) != w {
+		t.Error("a database has two writers")
+	}
+	var mu sync.Mutex
+	var order []string
+	did := func(what string) func(tx *sql.Tx) error {
+		return func(tx *sql.Tx) error {
+			mu.Lock()
+			defer mu.Unlock()
+			order = append(order, what)
+			return nil
+		}
+	}
+
+	held, release := make(chan struct{}), make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		w.do(func(tx *sql.Tx) error {
+			close(held)
+			<-release
+			return nil
+		})
+	}()
+	<-held
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w.do(did(fmt.Sprint("bulk ", i)))
+		}(i)
+	}
+	time.Sleep(20 * time.Millisecond)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := w.interactive(did("interactive")); err != nil {
+			t.Error(err)
+		}
+	}()
+	for {
+		w.mu.Lock()
+		waiting := w.waiting
+		w.mu.Unlock()
+		if waiting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if len(order) != 4 || order[0] != "interactive" {
+		t.Errorf("the transactions went in the order %q", order)
+	}
+
+	withBulkYield(30*time.Millisecond, func() {
+		var bulks []time.Time
+		for i := 0; i < 3; i++ {
+			if err := w.do(func(tx *sql.Tx) error { bulks = append(bulks, time.Now()); return nil }); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 1; i < len(bulks); i++ {
+			if gap := bulks[i].Sub(bulks[i-1]); gap < 30*time.Millisecond {
+				t.Errorf("bulk transaction %d began %v after the one before", i, gap)
+			}
+		}
+		start := time.Now()
+		if err := w.interactive(did("right away")); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.interactiveRead(func(db *sql.DB) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+		if took := time.Since(start); took > 20*time.Millisecond {
+			t.Errorf("just after a bulk transaction, an interactive one waited %v", took)
+		}
+		// a read in the bulk lane doesn't wait out the yield either
+		start = time.Now()
+		if err := w.read(func(db *sql.DB) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+		if took := time.Since(start); took > 20*time.Millisecond {
+			t.Errorf("a bulk read waited %v", took)
+		}
+	})
+}
+
+// The writers of databases closed are forgotten as another is made, and
+// those open kept, even with every connection taken.
+func TestWritersForgetClosed(t *testing.T) {
+	open := func() *sql.DB {
+		t.Helper()
+		db, err := sql.Open("sqlite3", ":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	kept, gone := open(), open()
+	defer kept.Close()
+	kept.SetMaxOpenConns(1)
+	w := writerOf(kept)
+	writerOf(gone)
+	if isClosed(kept) || isClosed(gone) {
+		t.Fatal("a database open was taken to be closed")
+	}
+	gone.Close()
+	tx, err := kept.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	another := open()
+	defer another.Close()
+	writerOf(another)
+	writers.Lock()
+	_, hasGone := writers.of[gone]
+	_, hasAnother := writers.of[another]
+	writers.Unlock()
+	if hasGone || !hasAnother || writerOf(kept) != w {
+		t.Errorf("with one database closed, the writers are %v", writers.of)
+	}
+}
+
+// In a shared cache a write holds the table locked to readers, as to
+// another process's: /chunks/random tries again for --interactive-wait,
+// then answers 503, and its metrics count the requests and tries.
+func TestRandomBusy(t *testing.T) {
+	defer func(was time.Duration) { interactiveWait = was }(interactiveWait)
+	interactiveWait = 30 * time.Millisecond
+	withSharedCache(true, func() {
+		db := testFileDB(t)
+		book := addBook(t, db, "Emma", "Jane Austen", "")
+		insertChunk(t, db, book, 0, "Emma Woodhouse, handsome, clever, and rich, with a comfortable home and happy disposition.")
+		s := testServer(t, db)
+		get := func(path string) *httptest.ResponseRecorder {
+			t.Helper()
+			w := httptest.NewRecorder()
+			s.routes().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+			return w
+		}
+		retries := atomic.LoadInt64(&busyRetries)
+		commit := holdWrite(t, db)
+		start := time.Now()
+		w := get("/chunks/random")
+		if took := time.Since(start); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" || took < interactiveWait {
+			t.Errorf("beside a write, GET /chunks/random answered after %v: %d %s", took, w.Code, w.Body)
+		}
+		commit()
+		if w = get("/chunks/random"); w.Code != http.StatusOK {
+			t.Errorf("once written, GET /chunks/random: %d %s", w.Code, w.Body)
+		}
+		if got := names(t, db, "SELECT count(*) FROM served_log"); got != "1\n" {
+			t.Errorf("%s chunks are logged served", got)
+		}
+		var m metrics
+		if w = get("/metrics"); json.Unmarshal(w.Body.Bytes(), &m) != nil || m.Random.Requests != 2 || m.Random.BusyRetries <= retries || m.Random.Max < m.Random.P50 {
+			t.Errorf("GET /metrics: %d %s", w.Code, w.Body)
+		}
+	})
+}
+
+// Random draws beside a library chunked again stay quick in the
+// interactive lane; drawn as bulk writes are, each waits out whatever
+// queues before it.
+func TestInteractiveBesideBulk(t *testing.T) {
+	if testing.Short() {
+		t.Skip("chunks a library while drawing from it")
+	}
+	// on one core, as the chunking and the draws contend most
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	db := testFileDB(t)
+	for i := 0; i < 60; i++ {
+		title := fmt.Sprint("Volume ", i)
+		addBook(t, db, title, "Someone", testBook(title, testParagraphs(400)))
+	}
+	chunk := func() error {
+		_, err := captureStdout(t, func() error { return makeChunks(db, chunkOptions{workers: 8, fullRechunk: true}) })
+		return err
+	}
+	if err := chunk(); err != nil {
+		t.Fatal(err)
+	}
+	draw := func(lanes bool) latencyStats {
+		t.Helper()
+		draws, err := drawBeside(db, dsn, "", 2*time.Millisecond, lanes, chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return draws.stats()
+	}
+	fast, slow := draw(true), draw(false)
+	t.Logf("interactive %+v, bulk %+v", fast, slow)
+	if fast.Requests < 10 || slow.Requests < 1 {
+		t.Fatalf("drew %d and %d chunks beside the chunking", fast.Requests, slow.Requests)
+	}
+	// 99 in 100 under 200ms in the interactive lane; in the bulk one the
+	// draws are queued behind the chunking, against the other lane rather
+	// than the clock: fewer of them, and the slowest several times slower
+	if fast.P99 > 200 || slow.Max < 3*fast.P99 || slow.Requests >= fast.Requests {
+		t.Errorf("drew %d chunks in the interactive lane, the 99th percentile in %.1fms, and %d in the bulk one, the slowest in %.1fms",
+			fast.Requests, fast.P99, slow.Requests, slow.Max)
+	}
+	if got, want := names(t, db, "SELECT count(*) FROM served_log"), fmt.Sprintln(fast.Requests+slow.Requests); got != want {
+		t.Errorf("%s draws were logged served, want %s", strings.TrimSpace(got), want)
+	}
+}
@@ -0,0 +1,358 @@
+package cli
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Thousands of books have no Language: in their header, and a filter by
+// language leaves them all out. Their language can be told from their
+// text instead: a few samples spread through the body are each given the
+// language whose letter trigrams they share most of, as built from the
+// passages in languageSeeds, or for a script few languages are written in,
+// like Greek or Hangul, the language of that script; and the book the
+// language most of them agree on. A book whose samples don't agree well
+// enough, an anthology in two languages, say, is given und, undetermined,
+// rather than a guess. files.language_source says where a book's language
+// came from: its header, meta import, GUTINDEX.ALL (see gutindex.go), or
+// detected.
+//
+// gutchunk detect-language detects the language of the books with none,
+// and again of those it detected before; ingest --detect-language does it
+// as books with none are ingested. Filters by language take
+// --include-undetermined for the books with none or und as well.
+
+// the sources of files.language_source
+const (
+	langHeader   = "header"
+	langMeta     = "meta"
+	langDetected = "detected"
+	langGutindex = "gutindex"
+)
+
+// undetermined is the language of a book detect-language couldn't tell.
+const undetermined = "und"
+
+const (
+	// samples taken of a book's body, and the runes in each
+	langSamples    = 5
+	langSampleSize = 2000
+	// the samples that must agree on a language for a book to be given it
+	defaultLangConfidence = 0.7
+)
+
+// undeterminedLanguage is whether f, a files row, has no language or und,
+// for --include-undetermined.
+const undeterminedLanguage = "coalesce(f.language, '') IN ('', 'und')"
+
+// languageSeeds are a passage of everyday prose in each language detected
+// by its trigrams, those written in the Latin alphabet.
+var languageSeeds = map[string]string{
+	"en": `It was the best of times and the worst of times, and there was nothing that he could do about it. She said that they would come
+		back to the house in the morning, when the weather was better and the children were not so tired. What have you done with the
+		letter which I gave you? I think that it is in my room, on the table by the window. They had not seen each other for many years,
+		and he was surprised to find how little she had changed. There is no one here who knows the way through the forest at night.`,
+	"fr": `Il était une fois un homme qui vivait seul dans une petite maison au bord de la rivière. Elle m'a dit qu'ils reviendraient
+		demain matin, quand le temps serait plus beau et que les enfants ne seraient plus fatigués. Qu'avez-vous fait de la lettre que
+		je vous ai donnée? Je crois qu'elle est dans ma chambre, sur la table près de la fenêtre. Ils ne s'étaient pas vus depuis
+		longtemps, et il fut étonné de voir combien elle avait peu changé. Il n'y a personne ici qui connaisse le chemin de la forêt.`,
+	"de": `Es war einmal ein Mann, der ganz allein in einem kleinen Haus am Ufer des Flusses wohnte. Sie sagte mir, dass sie morgen
+		früh wiederkommen würden, wenn das Wetter schöner wäre und die Kinder nicht mehr so müde seien. Was haben Sie mit dem Brief
+		gemacht, den ich Ihnen gegeben habe? Ich glaube, er liegt in meinem Zimmer auf dem Tisch neben dem Fenster. Sie hatten sich
+		seit vielen Jahren nicht gesehen, und er war erstaunt, wie wenig sie sich verändert hatte. Niemand hier kennt den Weg durch den Wald.`,
+	"es": `Había una vez un hombre que vivía solo en una casa pequeña a la orilla del río. Ella me dijo que volverían mañana por la
+		mañana, cuando el tiempo fuera mejor y los niños no estuvieran tan cansados. ¿Qué ha hecho usted con la carta que le di? Creo
+		que está en mi cuarto, sobre la mesa junto a la ventana. No se habían visto desde hacía muchos años, y él se sorprendió de lo
+		poco que ella había cambiado. No hay nadie aquí que conozca el camino a través del bosque por la noche.`,
+	"it": `C'era una volta un uomo che viveva da solo in una piccola casa sulla riva del fiume. Lei mi disse che sarebbero tornati
+		domani mattina, quando il tempo fosse stato migliore e i bambini non fossero stati così stanchi. Che cosa ha fatto della
+		lettera che le ho dato? Credo che sia nella mia camera, sul tavolo vicino alla finestra. Non si vedevano da molti anni, e
+		lui fu sorpreso di vedere quanto poco lei fosse cambiata. Non c'è nessuno qui che conosca la strada attraverso il bosco.`,
+	"pt": `Era uma vez um homem que vivia sozinho numa pequena casa à beira do rio. Ela disse-me que voltariam amanhã de manhã,
+		quando o tempo estivesse melhor e as crianças não estivessem tão cansadas. O que fez o senhor com a carta que lhe dei? Creio
+		que está no meu quarto, em cima da mesa ao pé da janela. Não se viam havia muitos anos, e ele ficou admirado de ver quão
+		pouco ela tinha mudado. Não há ninguém aqui que conheça o caminho através da floresta durante a noite.`,
+	"nl": `Er was eens een man die helemaal alleen woonde in een klein huis aan de oever van de rivier. Zij zei mij dat ze morgenochtend
+		terug zouden komen, als het weer beter was en de kinderen niet meer zo moe waren. Wat hebt u gedaan met de brief die ik u
+		gegeven heb? Ik geloof dat hij in mijn kamer ligt, op de tafel bij het raam. Zij hadden elkaar in vele jaren niet gezien, en
+		hij was verbaasd hoe weinig zij veranderd was. Er is hier niemand die de weg door het bos kent bij nacht.`,
+	"la": `Gallia est omnis divisa in partes tres, quarum unam incolunt Belgae, aliam Aquitani, tertiam qui ipsorum lingua Celtae,
+		nostra Galli appellantur. Hi omnes lingua, institutis, legibus inter se differunt. Quo usque tandem abutere patientia nostra?
+		Quam diu etiam furor iste tuus nos eludet? In principio erat verbum, et verbum erat apud deum. Arma virumque cano, qui primus
+		ab oris Italiae fato profugus venit. Sed nunc dicendum est quid sit virtus et quibus rebus hominum animi regantur.`,
+	"sv": `Det var en gång en man som bodde alldeles ensam i ett litet hus vid stranden av floden. Hon sade till mig att de skulle
+		komma tillbaka i morgon bitti, när vädret var bättre och barnen inte längre var så trötta. Vad har ni gjort med brevet som
+		jag gav er? Jag tror att det ligger i mitt rum, på bordet vid fönstret. De hade inte sett varandra på många år, och han blev
+		förvånad över hur lite hon hade förändrats. Det finns ingen här som känner vägen genom skogen om natten.`,
+	"da": `Der var engang en mand, som boede helt alene i et lille hus ved bredden af floden. Hun sagde til mig, at de ville komme
+		tilbage i morgen tidlig, når vejret var bedre og børnene ikke længere var så trætte. Hvad har De gjort med brevet, som jeg gav
+		Dem? Jeg tror, det ligger på mit værelse, på bordet ved vinduet. De havde ikke set hinanden i mange år, og han blev forbavset
+		over, hvor lidt hun havde forandret sig. Der er ingen her, som kender vejen gennem skoven om natten.`,
+	"fi": `Olipa kerran mies, joka asui aivan yksin pienessä talossa joen rannalla. Hän sanoi minulle, että he tulisivat takaisin
+		huomenna aamulla, kun ilma olisi kauniimpi eivätkä lapset olisi enää niin väsyneitä. Mitä te teitte kirjeelle, jonka annoin
+		teille? Luulen, että se on huoneessani pöydällä ikkunan vieressä. He eivät olleet nähneet toisiaan moneen vuoteen, ja hän
+		ihmetteli, kuinka vähän nainen oli muuttunut. Täällä ei ole ketään, joka tuntisi tien metsän läpi yöllä.`,
+	"pl": `Był sobie raz człowiek, który mieszkał zupełnie sam w małym domu nad brzegiem rzeki. Powiedziała mi, że wrócą jutro
+		rano, kiedy pogoda będzie lepsza, a dzieci nie będą już takie zmęczone. Co pan zrobił z listem, który panu dałem? Myślę, że
+		leży w moim pokoju, na stole przy oknie. Nie widzieli się od wielu lat i zdziwił się, jak mało się zmieniła. Nie ma tu
+		nikogo, kto znałby drogę przez las w nocy.`,
+}
+
+// languageProfiles are the trigram counts of languageSeeds.
+var languageProfiles = func() map[string]map[string]float64 {
+	ps := map[string]map[string]float64{}
+	for code, seed := range languageSeeds {
+		ps[code] = trigrams(seed)
+	}
+	return ps
+}()
+
+// scriptLanguages are the scripts a text may be told the language of by
+// its letters alone, each with the language.
+var scriptLanguages = []struct {
+	script *unicode.RangeTable
+	code   string
+}{
+	{unicode.Cyrillic, "ru"},
+	{unicode.Greek, "el"},
+	{unicode.Hebrew, "he"},
+	{unicode.Arabic, "ar"},
+	{unicode.Hangul, "ko"},
+	{unicode.Hiragana, "ja"},
+	{unicode.Katakana, "ja"},
+	{unicode.Han, "zh"},
+	{unicode.Devanagari, "hi"},
+}
+
+// trigrams counts the letter trigrams of text's words, lowercased, each
+// word with a space either side so its start and end count too.
+func trigrams(text string) map[string]float64 {
+	counts := map[string]float64{}
+	for _, w := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) }) {
+		rs := []rune(" " + w + " ")
+		for i := 0; i+3 <= len(rs); i++ {
+			counts[string(rs[i:i+3])]++
+		}
+	}
+	return counts
+}
+
+// trigramSimilarity is the cosine similarity of two trigram counts.
+func trigramSimilarity(a, b map[string]float64) float64 {
+	var dot, na, nb float64
+	for t, n := range a {
+		dot += n * b[t]
+		na += n * n
+	}
+	for _, n := range b {
+		nb += n * n
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(na*nb)
+}
+
+// sampleLanguage is the language of one sample: that of its script when
+// most of its letters are in one of scriptLanguages, the seed's it is most
+// like otherwise, and "" when it has too few letters to tell.
+func sampleLanguage(text string) string {
+	letters := 0
+	scripts := make([]int, len(scriptLanguages))
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		for i, s := range scriptLanguages {
+			if unicode.Is(s.script, r) {
+				scripts[i]++
+				break
+			}
+		}
+	}
+	if letters < 100 {
+		return ""
+	}
+	kana := 0
+	for i, s := range scriptLanguages {
+		if s.code == "ja" {
+			kana += scripts[i]
+		}
+	}
+	for i, s := range scriptLanguages {
+		if scripts[i]*2 > letters || s.code == "ja" && kana*10 > letters {
+			return s.code
+		}
+	}
+	grams := trigrams(text)
+	best, bestScore := "", 0.0
+	for code, p := range languageProfiles {
+		if s := trigramSimilarity(grams, p); s > bestScore {
+			best, bestScore = code, s
+		}
+	}
+	return best
+}
+
+// bodySamples takes n samples of about size runes each, spread evenly
+// through body, each starting at a line.
+func bodySamples(body []string, n, size int) []string {
+	var samples []string
+	for i := 0; i < n; i++ {
+		var b strings.Builder
+		runes := 0
+		for l := (2*i + 1) * len(body) / (2 * n); l < len(body) && runes < size; l++ {
+			if body[l] == "" {
+				continue
+			}
+			b.WriteString(body[l])
+			b.WriteByte(' ')
+			runes += len([]rune(body[l])) + 1
+		}
+		samples = append(samples, b.String())
+	}
+	return samples
+}
+
+// detectLanguage tells the language of a book's content from samples of
+// its body: the language at least confidence of them agree on, und when
+// none does, and "" when the book has too little text to tell.
+func detectLanguage(content string, confidence float64) (string, float64) {
+	body, _ := bookBody(content, !hasStartMarker(content))
+	votes := map[string]int{}
+	told := 0
+	for _, s := range bodySamples(body, langSamples, langSampleSize) {
+		if l := sampleLanguage(s); l != "" {
+			votes[l]++
+			told++
+		}
+	}
+	if told == 0 {
+		return "", 0
+	}
+	best := ""
+	for l, n := range votes {
+		if n > votes[best] || n == votes[best] && l < best {
+			best = l
+		}
+	}
+	share := float64(votes[best]) / float64(told)
+	if share < confidence {
+		return undetermined, share
+	}
+	return best, share
+}
+
+// fillLanguageSource records where the languages of the books ingested
+// before language_source was kept came from: meta import for the books it
+// curated, their headers for the rest.
+func fillLanguageSource(db *sql.DB) error {
+	_, err := db.Exec(`UPDATE files SET language_source = CASE WHEN id IN (SELECT file_id FROM book_meta) THEN ? ELSE ? END
+		WHERE language_source IS NULL AND coalesce(language, '') != ''`, langMeta, langHeader)
+	return err
+}
+
+func detectLanguageCmd(args []string) error {
+	fs := flag.NewFlagSet("detect-language", flag.ExitOnError)
+	missingOnly := fs.Bool("missing-only", false, "only books with no language at all, not those detected before")
+	confidence := fs.Float64("min-confidence", defaultLangConfidence, "share of a book's samples that must agree on a language, or it is und")
+	dryRun := fs.Bool("dry-run", false, "print what each book would be given without storing it")
+	fs.Parse(args)
+
+	if *confidence <= 0 || *confidence > 1 {
+		return usagef("--min-confidence must be over 0 and at most 1")
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT id FROM files
+		WHERE deleted_at IS NULL AND `+hasContent("")+` AND (coalesce(language, '') = '' OR NOT ? AND language_source = ?)
+		ORDER BY id`, *missingOnly, langDetected)
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	type detected struct {
+		id   int
+		lang string
+	}
+	var found []detected
+	counts := map[string]int{}
+	for _, id := range ids {
+		b, err := loadBook(db, id)
+		if err != nil {
+			return err
+		}
+		lang, share := detectLanguage(b.Content, *confidence)
+		if lang == "" {
+			continue
+		}
+		if *dryRun {
+			fmt.Printf("%6d  %s: %s (%.0f%% of samples)\n", id, b.Name, lang, share*100)
+		}
+		found = append(found, detected{id, lang})
+		counts[lang]++
+	}
+
+	if !*dryRun {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		for _, d := range found {
+			if _, err = tx.Exec("UPDATE files SET language = ?, language_source = ? WHERE id = ?", d.lang, langDetected, d.id); err != nil {
+				return err
+			}
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	langs := make([]string, 0, len(counts))
+	for l := range counts {
+		langs = append(langs, l)
+	}
+	sort.Slice(langs, func(i, j int) bool {
+		return counts[langs[i]] > counts[langs[j]] || counts[langs[i]] == counts[langs[j]] && langs[i] < langs[j]
+	})
+	parts := make([]string, len(langs))
+	for i, l := range langs {
+		parts[i] = fmt.Sprintf("%s %d", l, counts[l])
+	}
+	verb := "detected"
+	if *dryRun {
+		verb = "would detect"
+	}
+	fmt.Fprintf(os.Stderr, "%s the language of %d of %d books", verb, len(found), len(ids))
+	if len(parts) > 0 {
+		fmt.Fprint(os.Stderr, ": "+strings.Join(parts, ", "))
+	}
+	fmt.Fprintln(os.Stderr)
+	return nil
+}
@@ -0,0 +1,151 @@
+package cli
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// frenchParagraphs is n paragraphs of French, each long enough to be a
+// chunk of its own.
+func frenchParagraphs(n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b.WriteString("\n\n")
+		}
+		b.WriteString("C'était le paragraphe numéro " + strings.Repeat("i", i+1) + " du livre, ")
+		b.WriteString(strings.Repeat("et l'on y parlait longuement du temps qu'il faisait sur la lande et des gens du village, ", 4))
+		b.WriteString("comme le font les paragraphes.")
+	}
+	return b.String()
+}
+
+func TestDetectLanguage(t *testing.T) {
+	for _, c := range []struct {
+		name, content, want string
+	}{
+		{"an unlabelled French book", testBook("Les Misérables", frenchParagraphs(12)), "fr"},
+		{"an English one", testBook("Emma", testParagraphs(12)), "en"},
+		{"an anthology, half English and half French", testBook("Anthology", testParagraphs(10)+"\n\n"+frenchParagraphs(10)), undetermined},
+		{"a Russian one, by its script", testBook("Анна Каренина", strings.Repeat("Все счастливые семьи похожи друг на друга, каждая несчастливая семья несчастлива по-своему.\n\n", 30)), "ru"},
+		{"one too short to tell", testBook("Short", "Il était une fois."), ""},
+		// with no START marker, all of it is taken for the body
+		{"one with no START marker", frenchParagraphs(12), "fr"},
+	} {
+		if got, _ := detectLanguage(c.content, defaultLangConfidence); got != c.want {
+			t.Errorf("%s is detected as %q, want %q", c.name, got, c.want)
+		}
+	}
+	if got := sampleLanguage("Il était une fois."); got != "" {
+		t.Errorf("a sentence of a few letters is given %q", got)
+	}
+	// under a confidence low enough, the anthology is given the language
+	// most of its samples are in
+	if got, share := detectLanguage(testBook("Anthology", testParagraphs(10)+"\n\n"+frenchParagraphs(10)), 0.5); got == undetermined || share < 0.5 {
+		t.Errorf("at 0.5, the anthology is detected as %s, by %.2f of its samples", got, share)
+	}
+
+	// each seed's language is told from a sentence not of its seed, twice
+	// over to have letters enough
+	for want, s := range map[string]string{
+		"en": "The old captain walked slowly along the harbour wall, looking out at the ships that were waiting for the tide to turn.",
+		"fr": "Le vieux capitaine marchait lentement le long du mur du port, regardant les navires qui attendaient que la marée tourne.",
+		"de": "Der alte Kapitän ging langsam an der Hafenmauer entlang und sah auf die Schiffe, die darauf warteten, dass die Flut kam.",
+		"es": "El viejo capitán caminaba despacio a lo largo del muro del puerto, mirando los barcos que esperaban a que subiera la marea.",
+		"it": "Il vecchio capitano camminava lentamente lungo il muro del porto, guardando le navi che aspettavano che la marea cambiasse.",
+		"nl": "De oude kapitein liep langzaam langs de muur van de haven en keek naar de schepen die wachtten tot het tij zou keren.",
+	} {
+		if got := sampleLanguage(s + " " + s); got != want {
+			t.Errorf("sampleLanguage(%.30q) = %q, want %q", s, got, want)
+		}
+	}
+}
+
+func TestDetectLanguageCmd(t *testing.T) {
+	db := testDB(t)
+	french := addBook(t, db, "Les Misérables", "Victor Hugo", testBook("Les Misérables", frenchParagraphs(12)))
+	anthology := addBook(t, db, "Anthology", "", testBook("Anthology", testParagraphs(10)+"\n\n"+frenchParagraphs(10)))
+	labelled := addBook(t, db, "Emma", "Jane Austen", testBook("Emma", testParagraphs(12)))
+	if _, err := db.Exec("UPDATE files SET language = 'en', language_source = ? WHERE id = ?", langHeader, labelled); err != nil {
+		t.Fatal(err)
+	}
+	languages := func() string {
+		t.Helper()
+		return names(t, db, "SELECT id || ' ' || coalesce(language, '') || ' ' || coalesce(language_source, '') FROM files ORDER BY id")
+	}
+
+	out, err := captureStderr(t, func() error {
+		_, err := captureStdout(t, func() error { return detectLanguageCmd([]string{"--dry-run"}) })
+		return err
+	})
+	if err != nil || out != "would detect the language of 2 of 2 books: fr 1, und 1\n" {
+		t.Errorf("detect-language --dry-run: %v, printing %q", err, out)
+	}
+	if got := languages(); got != "1  \n2  \n3 en header\n" {
+		t.Errorf("detect-language --dry-run stored\n%s", got)
+	}
+	if out, err = captureStderr(t, func() error { return detectLanguageCmd(nil) }); err != nil || out != "detected the language of 2 of 2 books: fr 1, und 1\n" {
+		t.Errorf("detect-language: %v, printing %q", err, out)
+	}
+	if got := languages(); got != "1 fr detected\n2 und detected\n3 en header\n" {
+		t.Errorf("detect-language stored\n%s", got)
+	}
+	// those detected before are detected again unless --missing-only
+	if out, err = captureStderr(t, func() error { return detectLanguageCmd([]string{"--missing-only"}) }); err != nil || out != "detected the language of 0 of 0 books\n" {
+		t.Errorf("detect-language --missing-only: %v, printing %q", err, out)
+	}
+	if out, err = captureStderr(t, func() error { return detectLanguageCmd([]string{"--min-confidence", "0.5"}) }); err != nil || strings.Contains(out, "und") {
+		t.Errorf("detect-language --min-confidence 0.5: %v, printing %q", err, out)
+	}
+	for _, c := range []string{"0", "1.5"} {
+		if _, err = captureStderr(t, func() error { return detectLanguageCmd([]string{"--min-confidence", c}) }); exitCode(err) != exitUsage {
+			t.Errorf("detect-language --min-confidence %s: %v, want a usage error", c, err)
+		}
+	}
+
+	// --include-undetermined takes the books with none or und as well
+	if _, err = db.Exec("UPDATE files SET language = 'und' WHERE id = ?; UPDATE files SET language = NULL, language_source = NULL WHERE id = ?", anthology, french); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		q    bookListQuery
+		want int
+	}{
+		{bookListQuery{language: "en"}, 1},
+		{bookListQuery{language: "en", undetermined: true}, 3},
+		{bookListQuery{language: "fr", undetermined: true}, 2},
+		{bookListQuery{}, 3},
+	} {
+		where, args := c.q.where()
+		var n int
+		if err = db.QueryRow("SELECT count(*) FROM files f LEFT JOIN (SELECT sourceid, count(*) AS n FROM chunks GROUP BY sourceid) c ON c.sourceid = f.id WHERE "+where, args...).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != c.want {
+			t.Errorf("books of %q, undetermined %t, are %d, want %d", c.q.language, c.q.undetermined, n, c.want)
+		}
+	}
+}
+
+func TestIngestDetectLanguage(t *testing.T) {
+	root := t.TempDir()
+	writeTestZip(t, filepath.Join(root, "1", "11.zip"), zipEntry{"11.txt", testBook("Les Misérables", frenchParagraphs(12))})
+	writeTestZip(t, filepath.Join(root, "2", "22.zip"), zipEntry{"22.txt", strings.Replace(testBook("Emma", testParagraphs(12)), "Title: Emma\n", "Title: Emma\nLanguage: French\n", 1)})
+
+	db := testDB(t)
+	if _, err := captureStdout(t, func() error { return ingestCmd([]string{"--target", root}) }); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(t, db, "SELECT name || ' ' || coalesce(language, '') || ' ' || coalesce(language_source, '') FROM files ORDER BY name"); got != "Emma fr header\nLes Misérables  \n" {
+		t.Errorf("ingest stored\n%s", got)
+	}
+	// a header's language is kept however the text reads
+	db = testDB(t)
+	if _, err := captureStdout(t, func() error { return ingestCmd([]string{"--target", root, "--detect-language"}) }); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(t, db, "SELECT name || ' ' || coalesce(language, '') || ' ' || coalesce(language_source, '') FROM files ORDER BY name"); got != "Emma fr header\nLes Misérables fr detected\n" {
+		t.Errorf("ingest --detect-language stored\n%s", got)
+	}
+}
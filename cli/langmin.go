@@ -0,0 +1,121 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// minChunk is set for English, where 300 bytes is a few sentences. Chinese
+// and Japanese put a word in a character or two of three bytes each, so the
+// same limit drops paragraphs that say as much; a book's minimum is looked
+// up by the first code in its language column instead, books of languages
+// not listed keeping minChunk.
+
+// minimums, in bytes, for languages minChunk is wrong for
+var languageMinChunks = map[string]int{"zh": 100, "ja": 100, "ko": 150}
+
+// langMinimums is the minimum chunk size by language for a run, the
+// built-in ones as changed by --min-chunk-lang. It also counts the books
+// given a minimum other than minChunk, to report once chunking is done,
+// and is safe to share between workers. A nil *langMinimums is the
+// built-in ones, reporting nothing.
+type langMinimums struct {
+	mins map[string]int
+
+	mu   sync.Mutex
+	used map[string]int
+}
+
+// parseLangMinimums reads --min-chunk-lang, a comma separated list of
+// languages, by code or name, and minimums, like "zh=100,en=300".
+func parseLangMinimums(spec string) (*langMinimums, error) {
+	l := &langMinimums{mins: map[string]int{}, used: map[string]int{}}
+	for code, n := range languageMinChunks {
+		l.mins[code] = n
+	}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		lang, num, ok := strings.Cut(item, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(num))
+		if !ok || err != nil || n < 1 {
+			return nil, usagef("bad --min-chunk-lang %q; want language=bytes, like zh=100", item)
+		}
+		code := normalizeLanguages(lang)
+		if code == "" || strings.Contains(code, ",") || !knownLanguages(code) {
+			return nil, usagef("unknown language %q in --min-chunk-lang", strings.TrimSpace(lang))
+		}
+		l.mins[code] = n
+	}
+	return l, nil
+}
+
+// min is the minimum chunk size for books in language, a language column.
+func (l *langMinimums) min(language string) (int, string) {
+	code, _, _ := strings.Cut(language, ",")
+	mins := languageMinChunks
+	if l != nil {
+		mins = l.mins
+	}
+	if n, ok := mins[code]; ok {
+		return n, code
+	}
+	return minChunk, code
+}
+
+// forLanguage returns opts with the minimum chunk size for b's language,
+// recording it in the run's warnings when it isn't minChunk, and the
+// script --max-chunk measures b in.
+func (o chunkOptions) forLanguage(b bookfile) chunkOptions {
+	o.script = ScriptOf(b.Language, b.Content)
+	n, code := o.langMins.min(b.Language)
+	if n == minChunk {
+		return o
+	}
+	o.minChunk = n
+	events.warn("", "", fmt.Sprintf("book %d: minimum chunk %d bytes for language %s", b.ID, n, code))
+	if l := o.langMins; l != nil {
+		l.mu.Lock()
+		l.used[code]++
+		l.mu.Unlock()
+	}
+	return o
+}
+
+func (l *langMinimums) report() {
+	if l == nil || len(l.used) == 0 {
+		return
+	}
+	codes := []string{}
+	for code := range l.used {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		fmt.Printf("%d books in %s chunked with a minimum of %d bytes\n", l.used[code], code, l.mins[code])
+	}
+}
+
+// langMinFlag adds --min-chunk-lang to fs and returns what reads it.
+func langMinFlag(fs *flag.FlagSet) func() (*langMinimums, error) {
+	spec := fs.String("min-chunk-lang", "", fmt.Sprintf("least chunk size in bytes by language, like zh=100,en=300, over the built-in %s and %d for the rest",
+		builtinLangMins(), minChunk))
+	return func() (*langMinimums, error) {
+		return parseLangMinimums(*spec)
+	}
+}
+
+func builtinLangMins() string {
+	items := []string{}
+	for code, n := range languageMinChunks {
+		items = append(items, fmt.Sprintf("%s=%d", code, n))
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
@@ -0,0 +1,62 @@
+package cli
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseLangMinimums(t *testing.T) {
+	l, err := parseLangMinimums("zh=80, English=250")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for language, want := range map[string]int{"zh": 80, "en": 250, "ja,en": 100, "ko": 150, "fr": minChunk, "": minChunk, "tlh": minChunk} {
+		if n, _ := l.min(language); n != want {
+			t.Errorf("with zh=80,English=250, books in %q have a minimum of %d, want %d", language, n, want)
+		}
+	}
+	var none *langMinimums
+	if n, code := none.min("zh,en"); n != 100 || code != "zh" {
+		t.Errorf("the built-in minimum for zh,en is %d for %s", n, code)
+	}
+
+	for _, spec := range []string{"zh", "zh=", "zh=0", "zh=ten", "klingon=100", "en,fr=100"} {
+		if _, err := parseLangMinimums(spec); exitCode(err) != exitUsage {
+			t.Errorf("--min-chunk-lang %s: %v, want a usage error", spec, err)
+		}
+	}
+}
+
+func TestChunkByLanguage(t *testing.T) {
+	db := testDB(t)
+	// paragraphs of 192 bytes, under the default minimum
+	para := strings.Repeat("天下没有不散的筵席，", 6) + strings.Repeat("好。", 2)
+	body := strings.Repeat(para+"\n\n", 4)
+	books := map[string]int{}
+	for _, language := range []string{"zh", "", "tlh"} {
+		title := "Book in " + language
+		books[language] = addBook(t, db, title, "Someone", testBook(title, body+title+"。"))
+		if _, err := db.Exec("UPDATE files SET language = nullif(?, '') WHERE id = ?", language, books[language]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mins, err := parseLangMinimums("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := captureStdout(t, func() error { return makeChunks(db, chunkOptions{langMins: mins}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := chunkCount(t, db, books["zh"]); n != 4 {
+		t.Errorf("the Chinese book gave %d chunks, want its 4 paragraphs", n)
+	}
+	for _, language := range []string{"", "tlh"} {
+		if n := chunkCount(t, db, books[language]); n != 0 {
+			t.Errorf("the book in %q gave %d chunks, want none under the default minimum", language, n)
+		}
+	}
+	if !strings.Contains(out, "1 books in zh chunked with a minimum of 100 bytes") {
+		t.Errorf("the run reported %q", out)
+	}
+}
@@ -0,0 +1,68 @@
+package cli
+
+import (
+	"regexp"
+	"strings"
+)
+
+// languageNames maps the ISO 639 codes books are stored under to the names
+// Gutenberg headers use for them.
+var languageNames = map[string]string{
+	"af": "afrikaans", "ang": "old english", "ar": "arabic", "bg": "bulgarian",
+	"bn": "bengali", "br": "breton", "ca": "catalan", "chr": "cherokee",
+	"cs": "czech", "cy": "welsh", "da": "danish", "de": "german",
+	"el": "greek", "en": "english", "enm": "middle english", "eo": "esperanto",
+	"es": "spanish", "et": "estonian", "eu": "basque", "fa": "persian",
+	"fi": "finnish", "fr": "french", "fy": "frisian", "ga": "irish",
+	"gd": "scottish gaelic", "gl": "galician", "grc": "ancient greek", "he": "hebrew",
+	"hi": "hindi", "hr": "croatian", "hu": "hungarian", "ia": "interlingua",
+	"is": "icelandic", "it": "italian", "iu": "inuktitut", "ja": "japanese",
+	"ko": "korean", "la": "latin", "lt": "lithuanian", "lv": "latvian",
+	"mi": "maori", "nah": "nahuatl", "nl": "dutch", "no": "norwegian",
+	"oc": "occitan", "pl": "polish", "pt": "portuguese", "ro": "romanian",
+	"ru": "russian", "sa": "sanskrit", "sk": "slovak", "sl": "slovenian",
+	"sr": "serbian", "sv": "swedish", "tl": "tagalog", "tr": "turkish",
+	"uk": "ukrainian", "yi": "yiddish", "zh": "chinese",
+	// what detect-language stores when it can't tell
+	"und": "undetermined",
+}
+
+var languageCodes = func() map[string]string {
+	m := map[string]string{}
+	for code, name := range languageNames {
+		m[name] = code
+	}
+	m["gaelic"] = "gd"
+	m["anglo-saxon"] = "ang"
+	return m
+}()
+
+var languageSep = regexp.MustCompile(`\s*(?:[,;/&]|\band\b)\s*`)
+
+// normalizeLanguages turns a Language: header value like "English and
+// French" into the comma separated codes "en,fr". Languages it doesn't
+// know are kept lowercased.
+func normalizeLanguages(s string) string {
+	codes := []string{}
+	for _, part := range languageSep.Split(strings.ToLower(strings.TrimSpace(s)), -1) {
+		if part == "" {
+			continue
+		}
+		if c, ok := languageCodes[part]; ok {
+			part = c
+		}
+		codes = append(codes, part)
+	}
+	return strings.Join(codes, ",")
+}
+
+// knownLanguages reports whether every language in a comma separated list
+// is a code from languageNames.
+func knownLanguages(codes string) bool {
+	for _, c := range strings.Split(codes, ",") {
+		if _, ok := languageNames[c]; !ok {
+			return false
+		}
+	}
+	return true
+}
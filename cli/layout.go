@@ -0,0 +1,286 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The chunks table is keyed by its rowid, id, with chunks_sourceid beside
+// it for finding a book's chunks. At hundreds of millions of chunks that
+// index is nearly as big as the keys it points at, and a book's chunks lie
+// wherever they were inserted. The clustered layout is a WITHOUT ROWID
+// table keyed by (sourceid, ordinal) instead, so a book's chunks are stored
+// together in order and need no index of their own. id stays, unique and
+// picked by writeChunks as it is for shards, so whatever names chunks by id
+// works with either layout.
+
+const (
+	chunksRowid     = "rowid"
+	chunksClustered = "clustered"
+)
+
+var chunksLayout = flag.String("layout", "", "layout of the chunks table when creating it: rowid or clustered (default rowid; see migrate-layout)")
+
+// chunkLayout is the layout of the open database's chunks table.
+var chunkLayout = chunksRowid
+
+// createChunks creates the chunks table in the --layout asked for if there
+// isn't one yet, and notes the layout of the one there is.
+func createChunks(db *sql.DB) error {
+	if *chunksLayout != "" && *chunksLayout != chunksRowid && *chunksLayout != chunksClustered {
+		return usagef("unknown --layout %q; want rowid or clustered", *chunksLayout)
+	}
+	refs, err := tableLayout(db, "chunk_refs")
+	if err != nil {
+		return err
+	}
+	if refs != "" {
+		if *chunksLayout != "" && *chunksLayout != refs {
+			return fmt.Errorf("chunks are in the %s layout already; convert them with gutchunk migrate-layout %s", refs, *chunksLayout)
+		}
+		chunkStorage, chunkLayout = storageReference, refs
+		return nil
+	}
+	chunkStorage = storageInline
+	layout, err := tableLayout(db, "chunks")
+	if err != nil {
+		return err
+	}
+	if layout == "" {
+		layout = chunksRowid
+		if *chunksLayout != "" {
+			layout = *chunksLayout
+		}
+	} else if *chunksLayout != "" && *chunksLayout != layout {
+		return fmt.Errorf("chunks are in the %s layout already; convert them with gutchunk migrate-layout %s", layout, *chunksLayout)
+	}
+	if _, err = db.Exec(chunksTable(layout, "chunks")); err != nil {
+		return err
+	}
+	chunkLayout = layout
+	return nil
+}
+
+// tableLayout is the layout of table, "" when there is no such table.
+func tableLayout(q queryer, table string) (string, error) {
+	var ddl string
+	err := q.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&ddl)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(strings.ToUpper(ddl), "WITHOUT ROWID") {
+		return chunksClustered, nil
+	}
+	return chunksRowid, nil
+}
+
+// pickChunkIDs reports whether writeChunks must pick chunk ids itself,
+// there being no rowid to report back for each chunk.
+func pickChunkIDs() bool {
+	return chunkInsertRows > 1 || chunkShards > 0 || chunkLayout == chunksClustered || chunkStorage == storageReference
+}
+
+func migrateLayoutCmd(args []string) error {
+	fs := flag.NewFlagSet("migrate-layout", flag.ExitOnError)
+	batch := fs.Int("batch", 1000, "books copied per transaction")
+	vacuum := fs.Bool("vacuum", false, "vacuum the database afterwards to give back the space the old table took")
+	space := spaceFlags(fs)
+	fs.Parse(args)
+
+	to := fs.Arg(0)
+	if fs.NArg() != 1 || to != chunksRowid && to != chunksClustered {
+		return usagef("usage: gutchunk migrate-layout [flags] rowid|clustered")
+	}
+	if *batch < 1 {
+		return usagef("--batch must be at least 1")
+	}
+	so, err := space()
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if chunkShards > 0 {
+		return errors.New("sharded chunks are always in the rowid layout")
+	}
+	if chunkStorage == storageReference {
+		return errors.New("migrate-layout copies chunks' text; convert them back first with gutchunk convert-storage --mode inline")
+	}
+	// rebuilding in the same layout declares chunks' foreign key again
+	keyed, err := chunksKeyed(db)
+	if err != nil {
+		return err
+	}
+	if chunkLayout == to && keyed {
+		fmt.Printf("chunks are in the %s layout already\n", to)
+		return nil
+	}
+	if err = checkOrphans(db); err != nil {
+		return err
+	}
+	if to == chunksClustered {
+		if err = clusterable(db); err != nil {
+			return err
+		}
+	}
+
+	// the copy and the vacuum each take about as much again as there is
+	if err = checkSpace(dbFile(dsn), "migrate-layout", so); err != nil {
+		return err
+	}
+	sw := watchSpace(runCtx, dbFile(dsn), so.minFree)
+	defer sw.stop()
+	if err = migrateLayout(sw.ctx, db, to, *batch, *vacuum); err != nil {
+		err = sw.err(err)
+		if errors.Is(err, errLowSpace) {
+			// the batches copied are given back too
+			db.Exec("DROP TABLE IF EXISTS chunks_new")
+		}
+	}
+	return err
+}
+
+func migrateLayout(ctx context.Context, db *sql.DB, to string, batch int, vacuum bool) error {
+	// left by a run that was interrupted; the chunks may have changed since
+	if _, err := db.ExecContext(ctx, "DROP TABLE IF EXISTS chunks_new"); err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, chunksTable(to, "chunks_new")); err != nil {
+		return err
+	}
+	var total int64
+	if err := db.QueryRowContext(ctx, "SELECT count(*) FROM chunks").Scan(&total); err != nil {
+		return err
+	}
+
+	var copied, last int64 = 0, -1
+	shown := time.Now()
+	for {
+		n, upto, err := copyChunkBatch(ctx, db, last, batch)
+		if err != nil {
+			return fmt.Errorf("could not copy chunks: %w", err)
+		}
+		if upto < 0 {
+			break
+		}
+		copied += n
+		last = upto
+		if time.Since(shown) >= 5*time.Second {
+			shown = time.Now()
+			fmt.Printf("copied %d of %d chunks (%.0f%%)\n", copied, total, 100*float64(copied)/float64(total))
+		}
+	}
+	if copied != total {
+		return fmt.Errorf("copied %d chunks of %d; the chunks changed while copying, run migrate-layout again", copied, total)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, q := range []string{
+		"DROP TABLE chunks",
+		"ALTER TABLE chunks_new RENAME TO chunks",
+		chunksTable(to, "chunks"),
+		stableIndex("chunks"),
+	} {
+		if _, err = tx.ExecContext(ctx, q); err != nil {
+			return fmt.Errorf("could not replace chunks: %w", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	fmt.Printf("moved %d chunks to the %s layout\n", copied, to)
+
+	if vacuum {
+		if _, err = db.ExecContext(ctx, "VACUUM"); err != nil {
+			return fmt.Errorf("could not vacuum: %w", err)
+		}
+	}
+	return nil
+}
+
+// checkOrphans checks that every chunk belongs to a book, as the foreign
+// key on chunks has it.
+func checkOrphans(db *sql.DB) error {
+	var orphans int
+	if err := db.QueryRow("SELECT count(*) FROM chunks WHERE sourceid IS NULL OR sourceid NOT IN (SELECT id FROM files)").Scan(&orphans); err != nil {
+		return err
+	}
+	if orphans > 0 {
+		return fmt.Errorf("%d chunks belong to no book, which the foreign key on chunks won't allow; delete them first", orphans)
+	}
+	return nil
+}
+
+// clusterable checks that every chunk of a book can be keyed by (sourceid,
+// ordinal) and that nothing depends on chunks having rowids.
+func clusterable(db *sql.DB) error {
+	fts, err := hasFTS(db)
+	if err != nil {
+		return err
+	}
+	if fts {
+		return errors.New("the full text index doesn't work with the clustered layout; drop it first with gutchunk index --drop")
+	}
+	troubles, err := ordinalTroubles(db, 0)
+	if err != nil {
+		return err
+	}
+	n := 0
+	for _, t := range troubles {
+		// gaps are fine, only missing and shared ordinals aren't
+		if t.numbered < t.chunks || t.distinct < t.chunks {
+			fmt.Println(t)
+			n++
+		}
+	}
+	if n > 0 {
+		return fmt.Errorf("%d books have chunks without an ordinal of their own, which the clustered layout can't key; run gutchunk renumber first", n)
+	}
+	return nil
+}
+
+// copyChunkBatch copies the chunks of the next batch books after the book
+// last into chunks_new, returning how many it copied and the last book
+// copied, -1 when there were none left.
+func copyChunkBatch(ctx context.Context, db *sql.DB, last int64, batch int) (int64, int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+	var upto sql.NullInt64
+	if err = tx.QueryRowContext(ctx, "SELECT max(sourceid) FROM (SELECT DISTINCT sourceid FROM chunks WHERE sourceid > ? ORDER BY sourceid LIMIT ?)",
+		last, batch).Scan(&upto); err != nil {
+		return 0, 0, err
+	}
+	if !upto.Valid {
+		return 0, -1, nil
+	}
+	res, err := tx.ExecContext(ctx, "INSERT INTO chunks_new ("+chunkCols+") SELECT "+chunkCols+" FROM chunks WHERE sourceid > ? AND sourceid <= ?",
+		last, upto.Int64)
+	if err != nil {
+		return 0, 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, 0, err
+	}
+	return n, upto.Int64, tx.Commit()
+}
@@ -0,0 +1,128 @@
+package cli
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// The rest of the tests run against whichever layout -layout asks for, so
+// go test -args -layout clustered runs them against the clustered one.
+
+func TestLayouts(t *testing.T) {
+	for _, c := range []struct{ from, to string }{
+		{chunksRowid, chunksClustered},
+		{chunksClustered, chunksRowid},
+	} {
+		t.Run(c.from, func(t *testing.T) {
+			setLayout(t, c.from)
+			db := testFileDB(t)
+			if layout, err := tableLayout(db, "chunks"); err != nil || layout != c.from || chunkLayout != c.from {
+				t.Fatalf("--layout %s made a %s table (%v), noted as %s", c.from, layout, err, chunkLayout)
+			}
+			emma := addBook(t, db, "Emma", "Jane Austen", testBook("Emma", testParagraphs(3)))
+			addBook(t, db, "Persuasion", "Jane Austen", testBook("Persuasion", testParagraphs(2)))
+			if _, err := captureStdout(t, func() error { return makeChunks(db, chunkOptions{}) }); err != nil {
+				t.Fatal(err)
+			}
+			before := chunkRows(t, db)
+			if strings.Count(before, "\n") != 5 {
+				t.Errorf("chunked into %q, want 5 chunks", before)
+			}
+			// a book rechunked keeps its place in either layout
+			rechunkBook(t, db, emma, testBook("Emma", testParagraphs(3)))
+			if after := chunkRows(t, db); strings.Count(after, "\n") != 5 {
+				t.Errorf("rechunking Emma left %q", after)
+			}
+			before = chunkRows(t, db)
+
+			// the table already there decides, not a --layout at odds with it
+			setLayout(t, c.to)
+			if _, err := openDB(); err == nil || !strings.Contains(err.Error(), "migrate-layout "+c.to) {
+				t.Errorf("opening %s chunks with --layout %s: %v", c.from, c.to, err)
+			}
+			setLayout(t, "")
+			out, err := captureStdout(t, func() error { return migrateLayoutCmd([]string{"--batch", "1", c.to}) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(out, fmt.Sprintf("moved 5 chunks to the %s layout", c.to)) {
+				t.Errorf("migrate-layout printed %q", out)
+			}
+			moved, err := openDB()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer moved.Close()
+			if layout, _ := tableLayout(moved, "chunks"); layout != c.to || chunkLayout != c.to {
+				t.Errorf("migrated to a %s table, noted as %s, want %s", layout, chunkLayout, c.to)
+			}
+			if after := chunkRows(t, moved); after != before {
+				t.Errorf("migrating changed the chunks from\n%s\nto\n%s", before, after)
+			}
+			if out, err = captureStdout(t, func() error { return migrateLayoutCmd([]string{c.to}) }); err != nil || !strings.Contains(out, "already") {
+				t.Errorf("migrating to %s again: %q, %v", c.to, out, err)
+			}
+		})
+	}
+}
+
+func TestClusterable(t *testing.T) {
+	rowidOnly(t, "migrating to the clustered layout")
+	db := testFileDB(t)
+	id := addBook(t, db, "Villette", "Charlotte Brontë", "")
+	for i := 0; i < 2; i++ {
+		if _, err := db.Exec("INSERT INTO chunks (sourceid, chunk) VALUES (?, 'unnumbered')", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if out, err := captureStdout(t, func() error { return migrateLayoutCmd([]string{chunksClustered}) }); err == nil || !strings.Contains(err.Error(), "renumber") {
+		t.Errorf("clustering chunks without ordinals: %q, %v", out, err)
+	}
+	if _, err := captureStdout(t, func() error { return renumberCmd(nil) }); err != nil {
+		t.Fatal(err)
+	}
+	indexChunks(t, db)
+	if _, err := captureStdout(t, func() error { return migrateLayoutCmd([]string{chunksClustered}) }); err == nil || !strings.Contains(err.Error(), "index --drop") {
+		t.Errorf("clustering indexed chunks: %v", err)
+	}
+	if layout, _ := tableLayout(db, "chunks"); layout != chunksRowid {
+		t.Errorf("refusing to migrate left a %s table", layout)
+	}
+	for _, args := range [][]string{nil, {"heap"}, {"--batch", "0", chunksClustered}} {
+		if _, err := captureStdout(t, func() error { return migrateLayoutCmd(args) }); exitCode(err) != exitUsage {
+			t.Errorf("migrate-layout %s: %v, want a usage error", strings.Join(args, " "), err)
+		}
+	}
+}
+
+// setLayout sets -layout for the rest of the test.
+func setLayout(t *testing.T, layout string) {
+	was, noted := *chunksLayout, chunkLayout
+	*chunksLayout = layout
+	t.Cleanup(func() { *chunksLayout, chunkLayout = was, noted })
+}
+
+// chunkRows is every chunk in db as a line of id, book, ordinal and text.
+func chunkRows(t *testing.T, db *sql.DB) string {
+	t.Helper()
+	rows, err := db.Query("SELECT id, sourceid, ordinal, chunk FROM chunks ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var b strings.Builder
+	for rows.Next() {
+		var id, book, ordinal int
+		var text string
+		if err = rows.Scan(&id, &book, &ordinal, &text); err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&b, "%d %d %d %.20q\n", id, book, ordinal, text)
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
@@ -0,0 +1,62 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+func listCmd(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	status := fs.String("metadata-status", "", "only books with this metadata status: "+strings.Join(metadataStatuses, ", "))
+	fs.Parse(args)
+
+	if err := checkMetadataStatus(*status); err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT id, coalesce(ebook, 0), coalesce(metadata_status, ''), coalesce(name, ''), coalesce(author, ''), filename
+		FROM files WHERE deleted_at IS NULL AND (? = '' OR metadata_status = ?) ORDER BY id`, *status, *status)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		var id, ebook int
+		var st, title, author, filename string
+		if err = rows.Scan(&id, &ebook, &st, &title, &author, &filename); err != nil {
+			return err
+		}
+		if st == "" {
+			st = "-"
+		}
+		fmt.Printf("%6d %6d  %-9s  %s / %s  (%s)\n", id, ebook, st, title, author, filename)
+		n++
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	fmt.Printf("%d books\n", n)
+	return nil
+}
+
+// checkMetadataStatus fails unless status is one of metadataStatuses or
+// "" for any.
+func checkMetadataStatus(status string) error {
+	if status == "" {
+		return nil
+	}
+	for _, s := range metadataStatuses {
+		if s == status {
+			return nil
+		}
+	}
+	return usagef("unknown --metadata-status %q; want one of %s", status, strings.Join(metadataStatuses, ", "))
+}
@@ -0,0 +1,48 @@
+package cli
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMetadataStatus(t *testing.T) {
+	start := "*** START OF THIS PROJECT GUTENBERG EBOOK A BOOK ***\n\n"
+	end := "\n\n*** END OF THIS PROJECT GUTENBERG EBOOK A BOOK ***\n"
+	root := t.TempDir()
+	for archive, content := range map[string]string{
+		"1/11.zip": "Title: Emma\n\nAuthor: Jane Austen\n\n" + start + testParagraphs(2) + end,
+		"2/22.zip": "Author: Anonymous\n\nRelease Date: May 1999\n\n" + start + testParagraphs(2) + end,
+		"3/33.zip": "Title: Persuasion\n\nLanguage: English\n\n" + start + testParagraphs(2) + end,
+		"4/44.zip": testParagraphs(3),
+	} {
+		writeTestZip(t, filepath.Join(root, archive), zipEntry{strings.TrimSuffix(filepath.Base(archive), ".zip") + ".txt", content})
+	}
+	db := testDB(t)
+	out, err := captureStdout(t, func() error { return ingestCmd([]string{"--target", root}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "metadata: ok 1, no_title 1, no_author 1, no_header 1") {
+		t.Errorf("ingest reported %q", out)
+	}
+	for archive, want := range map[string]string{"1/11.zip": "ok", "2/22.zip": "no_title", "3/33.zip": "no_author", "4/44.zip": "no_header"} {
+		var status string
+		if err = db.QueryRow("SELECT coalesce(metadata_status, '') FROM files WHERE archive = ?", archive).Scan(&status); err != nil {
+			t.Fatal(err)
+		}
+		if status != want {
+			t.Errorf("%s has metadata status %q, want %s", archive, status, want)
+		}
+	}
+
+	if out, err = captureStdout(t, func() error { return listCmd([]string{"--metadata-status", "no_author"}) }); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "Persuasion") || strings.Contains(out, "Emma") || strings.Contains(out, "Anonymous") {
+		t.Errorf("list --metadata-status no_author printed %q", out)
+	}
+	if _, err = captureStdout(t, func() error { return listCmd([]string{"--metadata-status", "no_date"}) }); exitCode(err) != exitUsage {
+		t.Errorf("an unknown --metadata-status: %v, want a usage error", err)
+	}
+}
@@ -0,0 +1,370 @@
+// Package cli is the gutchunk command, every command of it behind Main: the
+// gutchunk program at the top of the module is Main and nothing else, and
+// a program of one's own importing a chunking strategy of its own is
+// gutchunk with that strategy (see strategy.go).
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDB = "/mnt/volume_tor1_01/gutenberg/chunker.db"
+	target    = "/mnt/volume_tor1_01/gutenberg/aleph.gutenberg.org"
+	// what the dsn opens a database file with (see dsn.go)
+	dsnOptions = "?mode=rwc"
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"ingest":             {"read books from the mirror into the files table", ingestCmd},
+	"chunk":              {"split ingested books into chunks", chunkCmd},
+	"bench":              {"measure ingest and chunk throughput on a synthetic corpus", benchCmd},
+	"serve":              {"serve chunks over http", serveCmd},
+	"random":             {"print a random chunk", randomCmd},
+	"authors":            {"list normalized authors", authorsCmd},
+	"freq":               {"count the most frequent words or n-grams", freqCmd},
+	"refresh-stats":      {"recompute the precomputed per-author chunk counts", refreshStatsCmd},
+	"export":             {"write chunks as jsonl", exportCmd},
+	"count-tokens":       {"fill in token counts for chunks", countTokensCmd},
+	"cat":                {"print a book's chunks in order", catCmd},
+	"group-volumes":      {"group multi-volume works", groupVolumesCmd},
+	"audit-chunks":       {"compare stored chunks with what the current chunker produces", auditChunksCmd},
+	"stats":              {"count books, chunks and authors, optionally per source", statsCmd},
+	"renormalize":        {"rewrite chunks stored before the canonical form", renormalizeCmd},
+	"index":              {"build the full text index over chunks", indexCmd},
+	"grep":               {"search chunks with a regular expression", grepCmd},
+	"meta":               {"export or import per-book metadata files for curation", metaCmd},
+	"pin":                {"pin chunks so random --prefer-pinned favors them", pinCmd},
+	"ban":                {"ban chunks from ever being drawn", banCmd},
+	"unflag":             {"clear chunks' pin or ban", unflagCmd},
+	"flags":              {"list pinned and banned chunks", flagsCmd},
+	"shard":              {"move chunks into several database files", shardCmd},
+	"coverage":           {"count ingested and missing archives per directory of the mirror", coverageCmd},
+	"near-dupes":         {"find books that are nearly the same text and optionally suppress the older", nearDupesCmd},
+	"maintain":           {"run the nightly checkpoint, analyze, stats refresh, index merge and integrity check", maintainCmd},
+	"header":             {"print a book's raw header", headerCmd},
+	"reparse-headers":    {"parse metadata again from stored headers", reparseHeadersCmd},
+	"rm":                 {"remove books, leaving tombstones so ingest skips them", rmCmd},
+	"restore":            {"bring back books removed with rm", restoreCmd},
+	"tombstones":         {"list books removed with rm", tombstonesCmd},
+	"purge":              {"delete removed books for good", purgeCmd},
+	"segment":            {"find the works in anthologies by their contents lists", segmentCmd},
+	"dupes":              {"group books that are one work under different filenames by title and author", dupesCmd},
+	"export-books":       {"write each book to a text file of its own", exportBooksCmd},
+	"boilerplate":        {"report chunk texts shared by many books and suppress them", boilerplateCmd},
+	"preset":             {"save named sets of random filters for random --preset and /chunks/random?preset=", presetCmd},
+	"renumber":           {"number each book's chunks 0 to n-1 again after deletions", renumberCmd},
+	"list":               {"list books, optionally by the metadata ingest found", listCmd},
+	"migrate-layout":     {"rebuild the chunks table in the rowid or clustered layout", migrateLayoutCmd},
+	"books":              {"list books, or find them by words of their title or author", booksCmd},
+	"manifest":           {"compare the manifests of two ingest --manifest runs", manifestCmd},
+	"versions":           {"list the versions of an ebook re-releases have made", versionsCmd},
+	"prune-versions":     {"delete book versions a re-release superseded, and their chunks", pruneVersionsCmd},
+	"run":                {"ingest the mirror and chunk the books ingested, optionally as one pipeline", runCmd},
+	"convert-storage":    {"store chunks as references into their books' content, or with their text again", convertStorageCmd},
+	"migrate":            {"add the tables and columns this version uses to an older database", migrateCmd},
+	"warnings":           {"list and count what ingest, chunk and metadata parsing warned of, and acknowledge it", warningsCmd},
+	"changes":            {"report the chunks new, replaced and gone since a run or date", changesCmd},
+	"catalog":            {"read authors' birth and death years from Project Gutenberg's catalog, to date books by for --era", catalogCmd},
+	"schema":             {"print the database's CREATE statements and schema version", schemaCmd},
+	"dump-sample":        {"write a few books drawn at random, with their chunks and metadata, to a small database to share", dumpSampleCmd},
+	"metadata-conflicts": {"list books whose header and catalog disagree on their names, and settle them", metadataConflictsCmd},
+	"alias":              {"make, drop and list author aliases", aliasCmd},
+	"reexport-metadata":  {"write the new names of chunks whose books were renamed since a run", reexportMetadataCmd},
+	"truncate":           {"cut stdin to a limit of runes, words or sentences at a sentence or word boundary", truncateCmd},
+	"detect-language":    {"tell the language of books with none in their header from their text", detectLanguageCmd},
+	"explain":            {"say which of ingest's rules take or turn away each archive given, and why", explainCmd},
+	"verify-content":     {"check the stored books against the mirror they were ingested from", verifyContentCmd},
+	"find-body":          {"show the paragraphs at the top of a book by line number, and where its body starts", findBodyCmd},
+	"check-complete":     {"flag books that look truncated, by their endings and lengths, for selection and re-ingest", checkCompleteCmd},
+	"tune":               {"chunk a sample of books under a grid of chunk sizes and recommend the one keeping the most text in a target length", tuneCmd},
+	"series":             {"list the catalog's series and show their books in order, or load them from an overrides file", seriesCmd},
+	"chunk-one":          {"chunk one book in memory and print its chunks, or with --trace what each step of the chunker did to each paragraph", chunkOneCmd},
+	"publish":            {"verify the database and swap a copy of it into place for a reader, atomically", publishCmd},
+	"gc-content":         {"clear the content of books whose chunks no longer need it", gcContentCmd},
+	"similar-lexical":    {"find chunks like a chunk by the rare words they share", similarLexicalCmd},
+	"provenance":         {"print where an export, export-books directory or sample database came from, and its license note", provenanceCmd},
+	"recount":            {"count every book's chunks again and fix the kept counts stats and books read", recountCmd},
+	"fix-encoding":       {"repair Windows-1252 punctuation in stored books and chunks", fixEncodingCmd},
+	"replicate":          {"keep a copy of the database up to date for serve --replica", replicateCmd},
+	"review":             {"review chunks, warned books, name conflicts or volume groups one at a time", reviewCmd},
+	"stable-ids":         {"give chunks written before stable ids theirs, or look ids up", stableIDsCmd},
+	"gutindex":           {"read titles, authors and languages from GUTINDEX.ALL", gutindexCmd},
+	"flag-content":       {"flag chunks holding the terms of a wordlist, for --exclude-flagged", flagContentCmd},
+	"migrate-blobs":      {"move books' content out of the database into a directory of compressed files", migrateBlobsCmd},
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "usage: gutchunk [flags] <command> [args]\n\ncommands:\n")
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(flag.CommandLine.Output(), "  %-14s %s\n", name, commands[name].usage)
+	}
+	fmt.Fprintf(flag.CommandLine.Output(), "\nflags:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(flag.CommandLine.Output(), "\nevents (--events, from ingest and chunk):\n%s", eventsHelp)
+}
+
+func _main() error {
+	if flag.NArg() == 0 {
+		flag.Usage()
+		return usagef("no command given")
+	}
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		flag.Usage()
+		return usagef("unknown command %q", flag.Arg(0))
+	}
+
+	return cmd.run(flag.Args()[1:])
+}
+
+func ingestCmd(args []string) error {
+	fs := flag.NewFlagSet("ingest", flag.ExitOnError)
+	root := fs.String("target", target, "root of the gutenberg mirror")
+	var opts ingestOptions
+	fs.BoolVar(&opts.ignoreTombstones, "ignore-tombstones", false, "ingest books removed with gutchunk rm too")
+	fs.BoolVar(&opts.resume, "resume", false, "skip archives up to where the last interrupted walk of this target stopped")
+	restart := fs.Bool("restart", false, "forget which archives of this target were already ingested before starting")
+	nul := fs.String("nul", "strip", "what to do with members containing NUL bytes: strip or reject")
+	label := fs.String("source-label", "", "name for the mirror snapshot being ingested (default the target path or url)")
+	var ro remoteOptions
+	fs.StringVar(&ro.base, "from-url", "", "download from a mirror at this url instead of walking --target")
+	idsFile := fs.String("ids-file", "", "with --from-url, file of ebook numbers and ranges like 100-200 to fetch")
+	ids := fs.String("ids", "", "with --from-url, ebook numbers and ranges to fetch, comma separated")
+	fs.IntVar(&ro.concurrency, "concurrency", 4, "with --from-url, downloads in flight at once")
+	fs.DurationVar(&ro.delay, "delay", time.Second, "with --from-url, least time between starting two requests")
+	fs.DurationVar(&ro.hostDelay, "host-delay", 0, "with --from-url, least time between starting two requests to one host, redirects included")
+	maxRate := fs.String("max-rate", "0", "with --from-url, most bytes a second to download across all downloads, like 2MB/s, 0 for no limit")
+	fs.IntVar(&ro.retries, "retries", 3, "with --from-url, retries of a download failing transiently")
+	fs.StringVar(&ro.cacheDir, "cache-dir", "", "with --from-url, keep downloads here and reuse them")
+	pathsFile := fs.String("paths-file", "", "ingest the archives listed in this file, one per line, absolute or under --target, instead of walking")
+	tarPath := fs.String("archive", "", "ingest from a tar or tar.gz of the mirror, taking its paths to be under --target, instead of walking")
+	spill := fs.String("spill-size", "64MB", "with --archive, zips larger than this are held in a temporary file instead of memory")
+	manifest := fs.String("manifest", "", "write a line of json for each archive looked at to this file (see gutchunk manifest diff)")
+	fs.IntVar(&opts.headerLines, "header-lines", defaultHeaderLines, "lines of each book to look through for its title and author before taking it to have no header")
+	fs.BoolVar(&opts.detectLanguage, "detect-language", false, "detect the language of books whose header gives none from their text")
+	limits := limitFlags(fs, &opts)
+	stubs := stubFlags(fs, &opts)
+	layout := mirrorLayoutFlag(fs, &opts)
+	strict := strictFlags(fs)
+	fs.Parse(args)
+
+	modes := 0
+	for _, set := range []bool{ro.base != "", *pathsFile != "", *tarPath != ""} {
+		if set {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return usagef("--from-url, --paths-file and --archive don't go together")
+	}
+	spillSize, err := parseSize(*spill)
+	if err != nil {
+		return usageError{err.Error()}
+	}
+	if ro.maxRate, err = parseRate(*maxRate); err != nil {
+		return usageError{err.Error()}
+	}
+	if *nul != "strip" && *nul != "reject" {
+		return usagef("--nul must be strip or reject")
+	}
+	opts.rejectNULs = *nul == "reject"
+	if opts.headerLines <= 0 {
+		return usagef("--header-lines must be positive")
+	}
+	if err = limits(); err != nil {
+		return err
+	}
+	if err = stubs(); err != nil {
+		return err
+	}
+	if err = layout(); err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err = startRun(db, "ingest"); err != nil {
+		return err
+	}
+
+	if ro.base == "" {
+		if *root, err = resolveTarget(*root); err != nil {
+			return err
+		}
+	}
+	if *restart {
+		if err = clearJournal(db, *root); err != nil {
+			return err
+		}
+	}
+	from := *root
+	if ro.base != "" {
+		from = ro.base
+	}
+	if *label == "" {
+		*label = from
+	}
+	if opts.sourceID, err = ensureSource(db, from, *label); err != nil {
+		return err
+	}
+
+	if *manifest != "" {
+		if manifestOut, err = openManifest(*manifest); err != nil {
+			return err
+		}
+		defer manifestOut.close()
+	}
+
+	opts.timings = runTimings("ingest")
+	if ro.base != "" {
+		list, err := ebookList(*idsFile, *ids)
+		if err != nil {
+			return err
+		}
+		ro.polite = newPoliteness(ro.delay, ro.hostDelay, ro.maxRate)
+		ro.fetch = httpFetcher{client: ro.polite.client(5 * time.Minute)}
+		err = readRemote(db, list, opts, ro)
+	} else if *pathsFile != "" {
+		var paths []string
+		if paths, err = readManifest(*pathsFile, *root); err != nil {
+			return err
+		}
+		err = readPaths(db, *root, paths, opts)
+	} else if *tarPath != "" {
+		err = readTar(db, *root, *tarPath, spillSize, opts)
+	} else {
+		err = readFiles(db, *root, opts)
+	}
+	return strict.check(db, opts.timings.report("ingest", err))
+}
+
+func ebookList(file, list string) ([]int, error) {
+	if file == "" && list == "" {
+		return nil, usagef("--from-url needs --ids-file or --ids")
+	}
+	ids, err := parseIDs(strings.NewReader(list))
+	if err != nil || file == "" {
+		return ids, err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	more, err := parseIDs(f)
+	return append(ids, more...), err
+}
+
+func chunkCmd(args []string) error {
+	fs := flag.NewFlagSet("chunk", flag.ExitOnError)
+	var opts chunkOptions
+	fs.BoolVar(&opts.stripRefs, "strip-refs", false, "remove footnote reference markers like [12] from chunk text")
+	fs.IntVar(&opts.workers, "workers", 1, "number of books to chunk concurrently")
+	maxMemory := fs.String("max-memory", "0", "most book content workers may hold at once, e.g. 512MB (0 for no limit)")
+	maxBookSize := fs.String("max-book-size", "0", "skip books with more content than this, e.g. 50MB, noting them as warnings (0 for no limit)")
+	fs.BoolVar(&opts.retryReduced, "retry-reduced", false, "chunk a book that crashes the chunker once more with conservative settings")
+	footer := footerFlags(fs)
+	breaks := sceneFlags(fs)
+	fs.BoolVar(&opts.scenes, "scenes", false, "number chunks by the scene breaks before them, in chunks.scene")
+	fs.BoolVar(&opts.tagKinds, "tag-kinds", false, "tag chunks as narrative, dialogue, letter or epigraph, in chunks.kind")
+	overrides := overridesFlag(fs)
+	langMins := langMinFlag(fs)
+	sizes := chunkSizeFlags(fs, &opts)
+	fs.BoolVar(&opts.fullRechunk, "full-rechunk", false, "write every chunk of a book chunked before anew, rather than keeping those cut again")
+	authors := authorsFlag(fs, "authors.toml whose deny and allow lists say whose books to chunk")
+	pathsFile := fs.String("paths-file", "", "only chunk the file ids listed in this file, one per line or ranges like 100-200")
+	strict := strictFlags(fs)
+	fs.Parse(args)
+
+	var err error
+	if opts.maxMemory, err = parseSize(*maxMemory); err != nil {
+		return err
+	}
+	if opts.maxBookSize, err = parseSize(*maxBookSize); err != nil {
+		return err
+	}
+	if *pathsFile != "" {
+		f, err := os.Open(*pathsFile)
+		if err != nil {
+			return err
+		}
+		opts.ids, err = parseIDs(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if opts.footer, err = footer(); err != nil {
+		return err
+	}
+	if opts.breaks, err = breaks(); err != nil {
+		return err
+	}
+	if opts.overrides, err = overrides(); err != nil {
+		return err
+	}
+	if opts.langMins, err = langMins(); err != nil {
+		return err
+	}
+	if err = sizes(); err != nil {
+		return err
+	}
+	if opts.authors, err = authors(); err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err = startRun(db, "chunk"); err != nil {
+		return err
+	}
+
+	opts.timings = runTimings("chunk")
+	opts.starts = &startLog{}
+	return strict.check(db, opts.timings.report("chunk", makeChunks(db, opts)))
+}
+
+// Main runs the gutchunk command given args, the command line after the
+// program's name, and is the status to exit with.
+func Main(args []string) int {
+	flag.Usage = usage
+	flag.CommandLine.Parse(args)
+	closeEvents, err := openEvents()
+	if err != nil {
+		return finish(usageError{err.Error()})
+	}
+	closeDatabase, err := openDatabase()
+	if err != nil {
+		closeEvents()
+		return finish(usageError{err.Error()})
+	}
+	cancel := startTimeout()
+	err = _main()
+	cancel()
+	closeDatabase()
+	closeEvents()
+	return finish(err)
+}
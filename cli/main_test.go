@@ -0,0 +1,119 @@
+package cli_test
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.tilde.town/gutchunker/cli"
+	"git.tilde.town/gutchunker/gutchunk"
+)
+
+// halves cuts a body into two chunks, its first half of lines and the
+// rest: a strategy of one's own, for a thin main to import.
+type halves struct{}
+
+func (halves) Name() string { return "halves" }
+
+func (halves) Split(b gutchunk.Body) ([]gutchunk.Chunk, []gutchunk.Footnote) {
+	var lines []int
+	for i, l := range b.Lines {
+		if l != "" {
+			lines = append(lines, i)
+		}
+	}
+	var chunks []gutchunk.Chunk
+	for _, half := range [][]int{lines[:len(lines)/2], lines[len(lines)/2:]} {
+		var text []string
+		for _, i := range half {
+			text = append(text, b.Lines[i])
+		}
+		chunks = append(chunks, gutchunk.Chunk{Ordinal: len(chunks), Text: gutchunk.Canonical(strings.Join(text, " ")), Line: half[0]})
+	}
+	return chunks, nil
+}
+
+// thinMain is set, to the arguments joined by newlines, in the test run
+// again as a thin main of its own.
+const thinMain = "GUTCHUNK_THIN_MAIN"
+
+// A program of a few lines, registering a strategy and running cli.Main,
+// is gutchunk with that strategy, every command of it.
+func TestThinMain(t *testing.T) {
+	if args := os.Getenv(thinMain); args != "" {
+		if err := gutchunk.RegisterStrategy("halves", func(gutchunk.Options) gutchunk.Strategy { return halves{} }); err != nil {
+			t.Fatal(err)
+		}
+		os.Exit(cli.Main(strings.Split(args, "\n")))
+	}
+
+	dir := t.TempDir()
+	db := filepath.Join(dir, "chunker.db")
+	run := func(args ...string) (string, int) {
+		t.Helper()
+		cmd := exec.Command(os.Args[0], "-test.run=^TestThinMain$")
+		cmd.Env = append(os.Environ(), thinMain+"="+strings.Join(append([]string{"--db", db}, args...), "\n"))
+		out, err := cmd.Output()
+		if exit, ok := err.(*exec.ExitError); ok {
+			return string(out) + string(exit.Stderr), exit.ExitCode()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(out), 0
+	}
+
+	mirror := filepath.Join(dir, "mirror")
+	var body []string
+	for _, l := range []string{"The first line of the story.", "The second line of it.", "The third line of it.", "The last line of the story."} {
+		body = append(body, strings.Repeat(l+" ", 12))
+	}
+	book := "Title: Halves\n\nAuthor: Someone\n\n*** START OF THIS PROJECT GUTENBERG EBOOK HALVES ***\n\n" +
+		strings.Join(body, "\n\n") + "\n\n*** END OF THIS PROJECT GUTENBERG EBOOK HALVES ***\n"
+	if err := os.MkdirAll(filepath.Join(mirror, "etext98"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(mirror, "etext98", "halves10.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	w, err := zw.Create("halves10.txt")
+	if err == nil {
+		_, err = w.Write([]byte(book))
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out, code := run("ingest", "--target", mirror); code != 0 {
+		t.Fatalf("ingest exited %d:\n%s", code, out)
+	}
+	if out, code := run("chunk", "--strategy", "halves"); code != 0 {
+		t.Fatalf("chunk --strategy halves exited %d:\n%s", code, out)
+	}
+	out, code := run("export")
+	// after the provenance line, the book's two halves
+	lines := strings.Split(strings.TrimSpace(out), "\n")[1:]
+	if code != 0 || len(lines) != 2 {
+		t.Fatalf("export exited %d:\n%s", code, out)
+	}
+	for i, want := range []string{"The first line", "The third line"} {
+		var c struct{ Text string }
+		if err = json.Unmarshal([]byte(lines[i]), &c); err != nil || !strings.HasPrefix(c.Text, want) {
+			t.Errorf("chunk %d is %s", i, lines[i])
+		}
+	}
+	// and a strategy it doesn't know is refused as any gutchunk refuses it
+	if out, code = run("chunk", "--strategy", "thirds"); code != 2 || !strings.Contains(out, `no strategy "thirds"; there are halves, paragraphs`) {
+		t.Errorf("chunk --strategy thirds exited %d:\n%s", code, out)
+	}
+}
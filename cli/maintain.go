@@ -0,0 +1,244 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// maintStep is one job of gutchunk maintain. run returns a line on what it
+// did; it must give up once ctx is done.
+type maintStep struct {
+	name    string
+	usage   string
+	timeout time.Duration
+	run     func(ctx context.Context, db *sql.DB, opts maintOptions) (string, error)
+}
+
+type maintOptions struct {
+	// books the integrity step checks
+	sample int
+	// how long served_log keeps what was served
+	keepServed time.Duration
+}
+
+var errStepSkipped = errors.New("nothing to do")
+
+var maintSteps = []maintStep{
+	{"checkpoint", "the wal checkpoint", time.Minute, checkpointStep},
+	{"analyze", "ANALYZE", 10 * time.Minute, analyzeStep},
+	{"stats", "the author stats refresh", 10 * time.Minute, statsStep},
+	{"fts", "the full text index merge", 10 * time.Minute, ftsStep},
+	{"served", "the served_log pruning", 5 * time.Minute, servedStep},
+	{"integrity", "the sampled check of books' chunks", 5 * time.Minute, integrityStep},
+}
+
+type stepReport struct {
+	Name string `json:"name"`
+	// ok, skipped, failed or timed out
+	Status  string  `json:"status"`
+	Seconds float64 `json:"seconds"`
+	Detail  string  `json:"detail,omitempty"`
+	Error   string  `json:"error,omitempty"`
+}
+
+type maintReport struct {
+	OK    bool         `json:"ok"`
+	Steps []stepReport `json:"steps"`
+}
+
+func maintainCmd(args []string) error {
+	fs := flag.NewFlagSet("maintain", flag.ExitOnError)
+	var opts maintOptions
+	fs.IntVar(&opts.sample, "sample", 20, "books the integrity step checks")
+	opts.keepServed = 90 * 24 * time.Hour
+	fs.Var((*windowFlag)(&opts.keepServed), "keep-served", "prune served_log of chunks served longer ago than this; keep it past any --exclude-served window")
+	skip := map[string]*bool{}
+	timeouts := map[string]*time.Duration{}
+	for _, s := range maintSteps {
+		skip[s.name] = fs.Bool("skip-"+s.name, false, "skip "+s.usage)
+		timeouts[s.name] = fs.Duration(s.name+"-timeout", s.timeout, "give up on "+s.usage+" after this long")
+	}
+	fs.Parse(args)
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rep := maintReport{OK: true, Steps: []stepReport{}}
+	ran, failed := 0, 0
+	for _, s := range maintSteps {
+		if *skip[s.name] {
+			rep.Steps = append(rep.Steps, stepReport{Name: s.name, Status: "skipped", Detail: "--skip-" + s.name})
+			continue
+		}
+		sr := runStep(db, s, *timeouts[s.name], opts)
+		ran++
+		if sr.Status == "failed" || sr.Status == "timed out" {
+			rep.OK = false
+			failed++
+		}
+		rep.Steps = append(rep.Steps, sr)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(rep); err != nil {
+		return err
+	}
+	if !rep.OK {
+		return partialError{failed, ran, "steps", "failed or timed out"}
+	}
+	return nil
+}
+
+// runStep runs s within timeout, and within --timeout, turning how it went
+// into its part of the report.
+func runStep(db *sql.DB, s maintStep, timeout time.Duration, opts maintOptions) stepReport {
+	ctx, cancel := runCtx, context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(runCtx, timeout)
+	}
+	defer cancel()
+
+	start := time.Now()
+	detail, err := s.run(ctx, db, opts)
+	sr := stepReport{Name: s.name, Status: "ok", Seconds: time.Since(start).Round(time.Millisecond).Seconds(), Detail: detail}
+	switch {
+	case errors.Is(err, errStepSkipped):
+		sr.Status = "skipped"
+	case err != nil && (timedOut(err) || ctx.Err() != nil):
+		sr.Status = "timed out"
+		sr.Error = err.Error()
+	case err != nil:
+		sr.Status = "failed"
+		sr.Error = err.Error()
+	}
+	return sr
+}
+
+func checkpointStep(ctx context.Context, db *sql.DB, opts maintOptions) (string, error) {
+	var busy, log, done int
+	if err := db.QueryRowContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &log, &done); err != nil {
+		return "", err
+	}
+	if log < 0 {
+		return "not in wal mode", errStepSkipped
+	}
+	if busy != 0 {
+		return "", fmt.Errorf("checkpoint blocked by another connection after %d of %d frames", done, log)
+	}
+	return fmt.Sprintf("checkpointed %d frames", done), nil
+}
+
+func analyzeStep(ctx context.Context, db *sql.DB, opts maintOptions) (string, error) {
+	_, err := db.ExecContext(ctx, "ANALYZE")
+	return "", err
+}
+
+func statsStep(ctx context.Context, db *sql.DB, opts maintOptions) (string, error) {
+	// the reservoir lives in serve, which resamples it by itself
+	names, err := resolveNames(ctx, db)
+	if err != nil {
+		return "", fmt.Errorf("could not choose books' names: %w", err)
+	}
+	n, err := refreshAuthorStats(ctx, db)
+	if err != nil {
+		return "", err
+	}
+	c, err := deriveEras(ctx, db)
+	if err != nil {
+		return "", fmt.Errorf("could not date books: %w", err)
+	}
+	return fmt.Sprintf("%s, refreshed stats for %d authors and %s", names, n, c), nil
+}
+
+// ftsStep does a bounded share of the index's segment merging, and its
+// shadow's, as much as an optimize would at once but without rewriting
+// everything.
+func ftsStep(ctx context.Context, db *sql.DB, opts maintOptions) (string, error) {
+	ok, err := hasFTS(db)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "no full text index", errStepSkipped
+	}
+	shadow, err := hasTranslit(db)
+	if err != nil {
+		return "", err
+	}
+	for _, t := range ftsTables(shadow) {
+		if _, err = db.ExecContext(ctx, fmt.Sprintf("INSERT INTO %[1]s (%[1]s) VALUES ('merge=500,8')", t)); err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// servedStep prunes served_log, which random and /chunks/random add to on
+// every draw.
+func servedStep(ctx context.Context, db *sql.DB, opts maintOptions) (string, error) {
+	n, err := pruneServed(ctx, db, opts.keepServed)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("pruned %d chunks served over %s ago", n, formatWindow(opts.keepServed)), nil
+}
+
+// integrityStep checks that the chunks of a sample of chunked books are
+// numbered 0 to n-1 without gaps or repeats and none is empty.
+func integrityStep(ctx context.Context, db *sql.DB, opts maintOptions) (string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id FROM files WHERE id IN (SELECT DISTINCT sourceid FROM chunks) ORDER BY random() LIMIT ?", opts.sample)
+	if err != nil {
+		return "", err
+	}
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return "", err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return "", err
+	}
+
+	bad := []string{}
+	for _, id := range ids {
+		var n, distinct, unnumbered, empty int
+		var lo, hi sql.NullInt64
+		err = db.QueryRowContext(ctx, `SELECT count(*), count(DISTINCT ordinal), count(*) - count(ordinal),
+				sum(length(trim(chunk)) = 0), min(ordinal), max(ordinal)
+			FROM chunks WHERE sourceid = ?`, id).Scan(&n, &distinct, &unnumbered, &empty, &lo, &hi)
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case empty > 0:
+			bad = append(bad, fmt.Sprintf("book %d has %d empty chunks", id, empty))
+		case unnumbered > 0:
+			// chunked before ordinals were stored; nothing to check
+		case distinct != n:
+			bad = append(bad, fmt.Sprintf("book %d repeats ordinals", id))
+		case lo.Int64 != 0 || hi.Int64 != int64(n-1):
+			bad = append(bad, fmt.Sprintf("book %d has gaps in its ordinals %d to %d over %d chunks", id, lo.Int64, hi.Int64, n))
+		}
+	}
+	detail := fmt.Sprintf("checked %d books", len(ids))
+	if len(bad) > 0 {
+		return detail, errors.New(strings.Join(bad, "; "))
+	}
+	return detail, nil
+}
@@ -0,0 +1,89 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// maintain runs gutchunk maintain with args, returning its report.
+func maintain(t *testing.T, args ...string) (maintReport, error) {
+	t.Helper()
+	out, err := captureStdout(t, func() error { return maintainCmd(args) })
+	var rep maintReport
+	if jerr := json.Unmarshal([]byte(out), &rep); jerr != nil {
+		t.Fatalf("maintain printed %q: %v", out, jerr)
+	}
+	return rep, err
+}
+
+// statuses is each step's name and status, in order.
+func statuses(rep maintReport) string {
+	var s []string
+	for _, st := range rep.Steps {
+		s = append(s, st.Name+" "+st.Status)
+	}
+	return strings.Join(s, ", ")
+}
+
+func TestMaintain(t *testing.T) {
+	db := testFileDB(t)
+	for _, title := range []string{"Emma", "Persuasion"} {
+		addBook(t, db, title, "Jane Austen", testBook(title, testParagraphs(3)+"\n\n"+title+"."))
+	}
+	if err := makeChunks(db, chunkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	rep, err := maintain(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "checkpoint ok, analyze ok, stats ok, fts skipped, served ok, integrity ok"
+	if got := statuses(rep); got != want || !rep.OK {
+		t.Errorf("steps %s, ok %v; want %s", got, rep.OK, want)
+	}
+	for _, st := range rep.Steps {
+		if st.Name == "integrity" && st.Detail != "checked 2 books" {
+			t.Errorf("the integrity step says %q", st.Detail)
+		}
+		if st.Error != "" || st.Seconds < 0 {
+			t.Errorf("step %s: %+v", st.Name, st)
+		}
+	}
+
+	rep, err = maintain(t, "--skip-analyze", "--skip-stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := statuses(rep); !strings.Contains(got, "analyze skipped, stats skipped, fts skipped") {
+		t.Errorf("with --skip- flags, steps %s", got)
+	}
+}
+
+func TestMaintainPartialFailure(t *testing.T) {
+	db := testFileDB(t)
+	id := addBook(t, db, "Emma", "Jane Austen", testBook("Emma", testParagraphs(3)))
+	if err := makeChunks(db, chunkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("DELETE FROM chunks WHERE sourceid = ? AND ordinal = 1", id); err != nil {
+		t.Fatal(err)
+	}
+
+	// one step failing and one out of time, the others still run
+	rep, err := maintain(t, "--analyze-timeout", "1ns")
+	var partial partialError
+	if !errors.As(err, &partial) || partial.failed != 2 || partial.total != 6 {
+		t.Fatalf("maintain: %v, want 2 of 6 steps failed", err)
+	}
+	want := "checkpoint ok, analyze timed out, stats ok, fts skipped, served ok, integrity failed"
+	if got := statuses(rep); got != want || rep.OK {
+		t.Errorf("steps %s, ok %v; want %s and not ok", got, rep.OK, want)
+	}
+	integrity := rep.Steps[len(rep.Steps)-1]
+	if !strings.Contains(integrity.Error, "has gaps in its ordinals 0 to 2 over 2 chunks") {
+		t.Errorf("the integrity step failed with %q", integrity.Error)
+	}
+}
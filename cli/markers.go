@@ -0,0 +1,94 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"git.tilde.town/gutchunker/gutchunk"
+)
+
+// A book's body is found by gutchunk.FindBody (see body.go there); these
+// are it for the rest of gutchunk.
+
+func isStart(line string) bool { return gutchunk.GutenbergMarkers.Start(line) }
+func isEnd(line string) bool   { return gutchunk.GutenbergMarkers.End(line) }
+
+// bookBody returns the lines of a book's body and what was found of its
+// markers, from the top with bodyOnly.
+func bookBody(content string, bodyOnly bool) ([]string, gutchunk.Found) {
+	return chunkOptions{bodyOnly: bodyOnly}.body(content)
+}
+
+// body is the body of content as the options have it, with their
+// overrides. A line too long to read ends the book, as it always has.
+func (o chunkOptions) body(content string) ([]string, gutchunk.Found) {
+	b, _ := gutchunk.ReadBody(strings.NewReader(content), o.chunker())
+	return b.Lines, b.Found
+}
+
+// contentLines are the lines of content, trimmed, as the body is made of
+// them; line n of a book is contentLines(content)[n-1].
+func contentLines(content string) []string {
+	lines, _ := gutchunk.Lines(strings.NewReader(content))
+	return lines
+}
+
+func bodyStart(lines []string, starts []int) int { return gutchunk.BodyStart(lines, starts) }
+func hasBodyText(lines []string) bool            { return gutchunk.HasBodyText(lines) }
+
+// most of a header rawHeader keeps
+const maxHeaderBytes = 16 << 10
+
+// rawHeader returns the text of a book before the START marker bookBody
+// would begin the body after, as it is, cut at a line end to fit in
+// maxHeaderBytes. Books without a START marker have no header.
+func rawHeader(content string) string {
+	raw := strings.SplitAfter(content, "\n")
+	lines := make([]string, len(raw))
+	starts := []int{}
+	for i, l := range raw {
+		lines[i] = strings.TrimSpace(l)
+		if isStart(lines[i]) {
+			starts = append(starts, i)
+		}
+	}
+	if len(starts) == 0 {
+		return ""
+	}
+	header := ""
+	for _, l := range raw[:starts[bodyStart(lines, starts)]] {
+		if len(header)+len(l) > maxHeaderBytes {
+			break
+		}
+		header += l
+	}
+	return header
+}
+
+// startLog collects the books chunked with more than one START marker, to
+// list once chunking is done. A nil startLog collects nothing.
+type startLog struct {
+	mu    sync.Mutex
+	books []string
+}
+
+func (l *startLog) add(id int, m gutchunk.Found) {
+	if l == nil || m.Starts < 2 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.books = append(l.books, fmt.Sprintf("book %d: %d START markers, %d repeated headers removed", id, m.Starts, m.Stripped))
+}
+
+func (l *startLog) report() {
+	if l == nil || len(l.books) == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "warning: %d books have more than one START marker; check their chunks:\n", len(l.books))
+	for _, b := range l.books {
+		fmt.Fprintln(os.Stderr, "  "+b)
+	}
+}
@@ -0,0 +1,384 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bookMeta is one book's sidecar file. A book is named by its ebook number,
+// or by its filename when it has none, or by its files id for uploads that
+// have neither.
+type bookMeta struct {
+	Ebook    int      `json:"ebook,omitempty"`
+	Filename string   `json:"filename,omitempty"`
+	ID       int      `json:"id,omitempty"`
+	Title    string   `json:"title"`
+	Author   string   `json:"author"`
+	Language string   `json:"language"`
+	Subjects []string `json:"subjects"`
+	Flags    []string `json:"flags"`
+	// the year to date the book to for --era, over its first published
+	// line and its author's years
+	Year *int `json:"year,omitempty"`
+}
+
+func (m bookMeta) file() string {
+	switch {
+	case m.Ebook != 0:
+		return strconv.Itoa(m.Ebook) + ".json"
+	case m.Filename != "":
+		return strings.NewReplacer("/", "_", "\\", "_").Replace(m.Filename) + ".json"
+	}
+	return "id-" + strconv.Itoa(m.ID) + ".json"
+}
+
+func metaCmd(args []string) error {
+	if len(args) == 0 {
+		return usagef("usage: gutchunk meta export|import --dir DIR")
+	}
+	switch args[0] {
+	case "export":
+		return metaExportCmd(args[1:])
+	case "import":
+		return metaImportCmd(args[1:])
+	}
+	return usagef("unknown meta command %q; want export or import", args[0])
+}
+
+func metaExportCmd(args []string) error {
+	fs := flag.NewFlagSet("meta export", flag.ExitOnError)
+	dir := fs.String("dir", "meta", "directory to write one json file per book to")
+	fs.Parse(args)
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	metas, err := loadBookMeta(db)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(*dir, 0755); err != nil {
+		return err
+	}
+	written := map[string]bool{}
+	for _, m := range metas {
+		name := m.file()
+		// later copies of a book share the first one's file
+		if written[name] {
+			continue
+		}
+		written[name] = true
+		bs, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err = os.WriteFile(filepath.Join(*dir, name), append(bs, '\n'), 0644); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("wrote metadata for %d books to %s\n", len(written), *dir)
+	return nil
+}
+
+// loadBookMeta returns every book's current metadata in id order, with the
+// files id each came from.
+func loadBookMeta(db *sql.DB) (map[int]bookMeta, error) {
+	rows, err := db.Query(`
+		SELECT f.id, coalesce(f.ebook, 0), coalesce(f.filename, ''), coalesce(f.name, ''), coalesce(f.author, ''),
+			coalesce(f.language, ''), coalesce(m.subjects, '[]'), coalesce(m.flags, '[]'), m.year
+		FROM files f LEFT JOIN book_meta m ON m.file_id = f.id
+		WHERE f.deleted_at IS NULL
+		ORDER BY f.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	metas := map[int]bookMeta{}
+	for rows.Next() {
+		var id int
+		var m bookMeta
+		var subjects, flags string
+		var year sql.NullInt64
+		if err = rows.Scan(&id, &m.Ebook, &m.Filename, &m.Title, &m.Author, &m.Language, &subjects, &flags, &year); err != nil {
+			return nil, err
+		}
+		m.Year = nullableInt(year)
+		if m.Ebook != 0 {
+			m.Filename = ""
+		} else if m.Filename == "" {
+			m.ID = id
+		}
+		if err = json.Unmarshal([]byte(subjects), &m.Subjects); err != nil {
+			return nil, fmt.Errorf("book %d subjects: %w", id, err)
+		}
+		if err = json.Unmarshal([]byte(flags), &m.Flags); err != nil {
+			return nil, fmt.Errorf("book %d flags: %w", id, err)
+		}
+		metas[id] = m
+	}
+	return metas, rows.Err()
+}
+
+func metaImportCmd(args []string) error {
+	fs := flag.NewFlagSet("meta import", flag.ExitOnError)
+	dir := fs.String("dir", "meta", "directory of json files written by meta export")
+	createMissing := fs.Bool("create-missing", false, "add books the database doesn't have instead of refusing them")
+	fs.Parse(args)
+
+	sidecars, err := readSidecars(*dir)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	current, err := loadBookMeta(db)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var created, updated, unchanged int
+	for _, sc := range sidecars {
+		ids, err := sidecarBooks(tx, sc.meta)
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			if !*createMissing {
+				return fmt.Errorf("%s: no such book in the database (use --create-missing to add it)", sc.path)
+			}
+			if err = createBook(tx, sc.meta); err != nil {
+				return fmt.Errorf("%s: %w", sc.path, err)
+			}
+			created++
+			continue
+		}
+		for _, id := range ids {
+			cur := current[id]
+			if sameMeta(cur, sc.meta) {
+				unchanged++
+				continue
+			}
+			if err = updateBookMeta(tx, id, sc.meta); err != nil {
+				return fmt.Errorf("%s: %w", sc.path, err)
+			}
+			updated++
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	fmt.Printf("%d created, %d updated, %d unchanged\n", created, updated, unchanged)
+	if created+updated > 0 {
+		n, err := resolveNames(context.Background(), db)
+		if err != nil {
+			return fmt.Errorf("could not choose books' names: %w", err)
+		}
+		fmt.Println(n)
+		c, err := deriveEras(context.Background(), db)
+		if err != nil {
+			return fmt.Errorf("could not date books: %w", err)
+		}
+		fmt.Println(c)
+	}
+	return nil
+}
+
+type sidecar struct {
+	path string
+	meta bookMeta
+}
+
+// readSidecars reads and checks every file in dir before anything is
+// written, so one bad file doesn't leave an import half done.
+func readSidecars(dir string) ([]sidecar, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	out := []sidecar{}
+	problems := []string{}
+	for _, p := range paths {
+		bs, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		var m bookMeta
+		dec := json.NewDecoder(bytes.NewReader(bs))
+		dec.DisallowUnknownFields()
+		if err = dec.Decode(&m); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", p, err))
+			continue
+		}
+		if err = cleanMeta(&m); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", p, err))
+			continue
+		}
+		out = append(out, sidecar{p, m})
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("refusing to import:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return out, nil
+}
+
+// cleanMeta trims m's fields and checks them.
+func cleanMeta(m *bookMeta) error {
+	keys := 0
+	for _, set := range []bool{m.Ebook != 0, m.Filename != "", m.ID != 0} {
+		if set {
+			keys++
+		}
+	}
+	if keys != 1 {
+		return errors.New("need exactly one of ebook, filename or id")
+	}
+	if m.Ebook < 0 || m.ID < 0 {
+		return errors.New("ebook and id must be positive")
+	}
+	m.Title = strings.TrimSpace(m.Title)
+	m.Author = strings.TrimSpace(m.Author)
+	m.Language = strings.ReplaceAll(strings.ToLower(m.Language), " ", "")
+	if m.Title == "" {
+		return errors.New("title is empty")
+	}
+	if m.Language != "" && !knownLanguages(m.Language) {
+		return fmt.Errorf("unknown language code in %q", m.Language)
+	}
+	if m.Year != nil && *m.Year > time.Now().Year() {
+		return fmt.Errorf("year %d is yet to come", *m.Year)
+	}
+	var err error
+	if m.Subjects, err = cleanList("subjects", m.Subjects); err != nil {
+		return err
+	}
+	m.Flags, err = cleanList("flags", m.Flags)
+	return err
+}
+
+func cleanList(what string, l []string) ([]string, error) {
+	out := []string{}
+	for _, s := range l {
+		if s = strings.TrimSpace(s); s == "" {
+			return nil, fmt.Errorf("empty entry in %s", what)
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+func sameMeta(a, b bookMeta) bool {
+	return a.Title == b.Title && a.Author == b.Author && a.Language == b.Language &&
+		reflect.DeepEqual(a.Subjects, b.Subjects) && reflect.DeepEqual(a.Flags, b.Flags) &&
+		reflect.DeepEqual(a.Year, b.Year)
+}
+
+// sidecarBooks returns the files rows a sidecar is about; every copy of an
+// ebook gets the same metadata.
+func sidecarBooks(tx *sql.Tx, m bookMeta) ([]int, error) {
+	q, arg := "SELECT id FROM files WHERE id = ?", interface{}(m.ID)
+	switch {
+	case m.Ebook != 0:
+		q, arg = "SELECT id FROM files WHERE ebook = ?", m.Ebook
+	case m.Filename != "":
+		q, arg = "SELECT id FROM files WHERE filename = ? AND ebook IS NULL", m.Filename
+	}
+	rows, err := tx.Query(q, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func updateBookMeta(tx *sql.Tx, id int, m bookMeta) error {
+	var authorSource, langSource interface{}
+	if m.Author != "" {
+		authorSource = nameMeta
+	}
+	if m.Language != "" {
+		langSource = langMeta
+	}
+	_, err := tx.Exec("UPDATE files SET name = ?, author = ?, author_norm = ?, title_norm = ?, language = ?, language_source = ?, title_source = ?, author_source = ? WHERE id = ?",
+		m.Title, m.Author, normalizeAuthor(m.Author), normalizeTitle(m.Title), m.Language, langSource, nameMeta, authorSource, id)
+	if err != nil {
+		return err
+	}
+	for _, f := range [][2]string{{"title", m.Title}, {"author", m.Author}} {
+		q, args := upsertNameSource, []interface{}{id, f[0], nameMeta, f[1]}
+		// an empty author leaves it to the other sources
+		if f[1] == "" {
+			q, args = "DELETE FROM name_sources WHERE file_id = ? AND field = ? AND source = ?", args[:3]
+		}
+		if _, err = tx.Exec(q, args...); err != nil {
+			return err
+		}
+	}
+	if err = saveNameWords(tx, int64(id), normalizeAuthor(m.Author), normalizeTitle(m.Title)); err != nil {
+		return err
+	}
+	subjects, _ := json.Marshal(m.Subjects)
+	flags, _ := json.Marshal(m.Flags)
+	_, err = tx.Exec(`
+		INSERT INTO book_meta (file_id, subjects, flags, year, updated_at) VALUES (?, ?, ?, ?, datetime('now'))
+		ON CONFLICT (file_id) DO UPDATE SET subjects = excluded.subjects, flags = excluded.flags, year = excluded.year, updated_at = excluded.updated_at`,
+		id, string(subjects), string(flags), m.Year)
+	return err
+}
+
+// createBook adds a book known only from its sidecar. It has no content
+// until it is ingested.
+func createBook(tx *sql.Tx, m bookMeta) error {
+	if m.ID != 0 {
+		return errors.New("can't create a book by id")
+	}
+	var filename interface{}
+	if m.Filename != "" {
+		filename = m.Filename
+	}
+	res, err := tx.Exec("INSERT INTO files (ebook, filename, member_name) VALUES (?, ?, ?)", nullInt(m.Ebook), filename, filename)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	return updateBookMeta(tx, int(id), m)
+}
@@ -0,0 +1,159 @@
+package cli
+
+import (
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// metaLibrary is a database of three books, two by ebook number and one
+// known only by its filename.
+func metaLibrary(t *testing.T) *sql.DB {
+	t.Helper()
+	db := testFileDB(t)
+	for i, b := range []struct {
+		title, author string
+		ebook         int
+	}{{"Emma", "Jane Austen", 158}, {"Persuasion", "Jane Austen", 105}, {"Villette", "Charlotte Brontë", 0}} {
+		id := addBook(t, db, b.title, b.author, testBook(b.title, testParagraphs(2+i)))
+		if b.ebook != 0 {
+			if _, err := db.Exec("UPDATE files SET ebook = ? WHERE id = ?", b.ebook, id); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := db.Exec("UPDATE files SET language = 'en'"); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func editSidecar(t *testing.T, path string, edit func(m *bookMeta)) {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m bookMeta
+	if err = json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	edit(&m)
+	if b, err = json.Marshal(m); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetaRoundTrip(t *testing.T) {
+	db := metaLibrary(t)
+	dir := t.TempDir()
+	if err := metaCmd([]string{"export", "--dir", dir}); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	for i := range files {
+		files[i] = filepath.Base(files[i])
+	}
+	if want := []string{"105.json", "158.json", "Villette.txt.json"}; !reflect.DeepEqual(files, want) {
+		t.Fatalf("exported %v, want %v", files, want)
+	}
+	before, err := loadBookMeta(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// importing what was exported changes nothing
+	if err = metaCmd([]string{"import", "--dir", dir}); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := loadBookMeta(db); !reflect.DeepEqual(again, before) {
+		t.Errorf("importing the export changed the metadata from %+v to %+v", before, again)
+	}
+
+	year := 1816
+	editSidecar(t, filepath.Join(dir, "158.json"), func(m *bookMeta) {
+		m.Title = " Emma: A Novel "
+		m.Language = "en, fr"
+		m.Subjects = []string{"Courtship -- Fiction"}
+		m.Flags = []string{"ocr-errors"}
+		m.Year = &year
+	})
+	if err = metaCmd([]string{"import", "--dir", dir}); err != nil {
+		t.Fatal(err)
+	}
+	after, err := loadBookMeta(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, m := range before {
+		if m.Ebook != 158 {
+			if !reflect.DeepEqual(after[id], m) {
+				t.Errorf("book %d, not edited, is now %+v, was %+v", id, after[id], m)
+			}
+			continue
+		}
+		want := m
+		want.Title, want.Language, want.Subjects, want.Flags, want.Year = "Emma: A Novel", "en,fr", []string{"Courtship -- Fiction"}, []string{"ocr-errors"}, &year
+		if !reflect.DeepEqual(after[id], want) {
+			t.Errorf("the edited book is %+v, want %+v", after[id], want)
+		}
+	}
+}
+
+func TestMetaImportRefuses(t *testing.T) {
+	for _, c := range []struct {
+		name, file, want string
+		// whether --create-missing takes it
+		create bool
+	}{
+		{"bad language", `{"ebook": 158, "title": "Emma", "language": "en,xx"}`, `unknown language code`, false},
+		{"empty title", `{"ebook": 158, "title": "  "}`, `title is empty`, false},
+		{"no key", `{"title": "Emma"}`, `exactly one of ebook, filename or id`, false},
+		{"unknown field", `{"ebook": 158, "title": "Emma", "colour": "red"}`, `unknown field`, false},
+		{"unknown book", `{"ebook": 999, "title": "Shirley", "author": "Charlotte Brontë"}`, `no such book`, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			db := metaLibrary(t)
+			before, err := loadBookMeta(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dir := t.TempDir()
+			if err = os.WriteFile(filepath.Join(dir, "bad.json"), []byte(c.file), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			err = metaCmd([]string{"import", "--dir", dir})
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Fatalf("import: %v, want it refused for %s", err, c.want)
+			}
+			if after, _ := loadBookMeta(db); !reflect.DeepEqual(after, before) {
+				t.Error("a refused import wrote")
+			}
+
+			err = metaCmd([]string{"import", "--dir", dir, "--create-missing"})
+			if !c.create {
+				if err == nil {
+					t.Error("--create-missing took a file it should refuse")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			after, err := loadBookMeta(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(after) != len(before)+1 {
+				t.Errorf("%d books after --create-missing, want %d", len(after), len(before)+1)
+			}
+		})
+	}
+}
@@ -0,0 +1,375 @@
+package cli
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	debug       = flag.Bool("debug", false, "log extra detail, like the slowest books of a run")
+	summaryJSON = flag.String("summary-json", "", "also write the run summary as json to this file")
+)
+
+type phase int
+
+const (
+	phaseRead phase = iota
+	phaseMeta
+	phaseScan
+	phaseWrite
+	numPhases
+)
+
+var phaseNames = [numPhases]string{"read", "metadata", "scan", "write"}
+
+// bookTiming is the time one book spent in each phase.
+type bookTiming struct {
+	book  string
+	spent [numPhases]time.Duration
+}
+
+func (b bookTiming) total() time.Duration {
+	var d time.Duration
+	for _, s := range b.spent {
+		d += s
+	}
+	return d
+}
+
+const slowestKept = 10
+
+// timings adds up phase times over a run. Workers time each book with a
+// stopwatch and hand the result over once, so the lock is taken once per
+// book rather than once per phase. A nil *timings times nothing.
+type timings struct {
+	now     func() time.Time
+	started time.Time
+
+	mu      sync.Mutex
+	books   int
+	chunks  int64
+	spent   [numPhases]time.Duration
+	slowest []bookTiming // slowest first
+	// books ingested by metadata_status
+	statuses map[string]int
+	// books chunk gave up on, and skipped for --max-book-size
+	failed, tooLarge int
+	// text members ingest rejected as stubs
+	stubs int
+	// members ingest split into the several texts they hold
+	split int
+	// books chunk asked the --authors-file about, by what it decided
+	authors map[string]int
+}
+
+func newTimings() *timings {
+	return newTimingsClock(time.Now)
+}
+
+func newTimingsClock(now func() time.Time) *timings {
+	return &timings{now: now, started: now(), slowest: make([]bookTiming, 0, slowestKept)}
+}
+
+type stopwatch struct {
+	t    *timings
+	last time.Time
+	bookTiming
+}
+
+func (t *timings) start(book string) stopwatch {
+	if t == nil {
+		return stopwatch{}
+	}
+	return stopwatch{t: t, last: t.now(), bookTiming: bookTiming{book: book}}
+}
+
+// lap charges the time since the previous lap, or since start, to p.
+func (s *stopwatch) lap(p phase) {
+	if s.t == nil {
+		return
+	}
+	now := s.t.now()
+	s.spent[p] += now.Sub(s.last)
+	s.last = now
+}
+
+// wait starts the next lap now, charging the time since the last to no
+// phase, for a book waiting its turn between the stages of run --pipeline.
+func (s *stopwatch) wait() {
+	if s.t == nil {
+		return
+	}
+	s.last = s.t.now()
+}
+
+// done hands the book's timing and the number of chunks it produced over to
+// the run's totals.
+func (s *stopwatch) done(chunks int) {
+	if s.t == nil {
+		return
+	}
+	s.t.add(s.bookTiming, chunks)
+}
+
+func (t *timings) add(b bookTiming, chunks int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.books++
+	t.chunks += int64(chunks)
+	for p, d := range b.spent {
+		t.spent[p] += d
+	}
+
+	d := b.total()
+	i := len(t.slowest)
+	for i > 0 && t.slowest[i-1].total() < d {
+		i--
+	}
+	if i >= slowestKept {
+		return
+	}
+	if len(t.slowest) < slowestKept {
+		t.slowest = append(t.slowest, bookTiming{})
+	}
+	copy(t.slowest[i+1:], t.slowest[i:])
+	t.slowest[i] = b
+}
+
+// metadata counts a book ingested with metadata_status status.
+func (t *timings) metadata(status string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.statuses == nil {
+		t.statuses = map[string]int{}
+	}
+	t.statuses[status]++
+}
+
+func (t *timings) bookFailed() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failed++
+}
+
+func (t *timings) skipTooLarge() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tooLarge++
+}
+
+func (t *timings) skipStub() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stubs++
+}
+
+func (t *timings) splitFile() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.split++
+}
+
+func (t *timings) author(decision string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.authors == nil {
+		t.authors = map[string]int{}
+	}
+	t.authors[decision]++
+}
+
+type runSummary struct {
+	Command string             `json:"command"`
+	Status  string             `json:"status"`
+	Books   int                `json:"books"`
+	Chunks  int64              `json:"chunks"`
+	Seconds float64            `json:"seconds"`
+	Phases  map[string]float64 `json:"phases"`
+	Slowest []bookSummary      `json:"slowest"`
+	// books ingested by metadata_status
+	Metadata map[string]int `json:"metadata,omitempty"`
+	// books chunk gave up on, and those it skipped for --max-book-size
+	Failed          int `json:"failed,omitempty"`
+	SkippedTooLarge int `json:"skipped_too_large,omitempty"`
+	// text members ingest rejected as stubs
+	SkippedStubs int `json:"skipped_stubs,omitempty"`
+	// members ingest split into the several texts they hold
+	SplitFiles int `json:"split_files,omitempty"`
+	// books by what the --authors-file decided for them
+	Authors map[string]int `json:"authors,omitempty"`
+	// the largest the wal was seen to be, and the checkpoints run, in wal
+	// mode (see checkpoint.go)
+	MaxWAL      int64 `json:"max_wal_bytes,omitempty"`
+	Checkpoints int   `json:"checkpoints,omitempty"`
+}
+
+type bookSummary struct {
+	Book    string             `json:"book"`
+	Seconds float64            `json:"seconds"`
+	Phases  map[string]float64 `json:"phases"`
+}
+
+// phaseSeconds leaves out phases a command never enters, like scan during
+// ingest.
+func phaseSeconds(spent [numPhases]time.Duration) map[string]float64 {
+	m := map[string]float64{}
+	for p, d := range spent {
+		if d > 0 {
+			m[phaseNames[p]] = d.Seconds()
+		}
+	}
+	return m
+}
+
+func (t *timings) summary(command string) runSummary {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := runSummary{
+		Command: command,
+		Books:   t.books,
+		Chunks:  t.chunks,
+		Seconds: t.now().Sub(t.started).Seconds(),
+		Phases:  phaseSeconds(t.spent),
+		Slowest: []bookSummary{},
+
+		Failed:          t.failed,
+		SkippedTooLarge: t.tooLarge,
+		SkippedStubs:    t.stubs,
+		SplitFiles:      t.split,
+	}
+	s.MaxWAL, s.Checkpoints = walState.peak()
+	if len(t.statuses) > 0 {
+		s.Metadata = map[string]int{}
+		for status, n := range t.statuses {
+			s.Metadata[status] = n
+		}
+	}
+	if len(t.authors) > 0 {
+		s.Authors = map[string]int{}
+		for d, n := range t.authors {
+			s.Authors[d] = n
+		}
+	}
+	for _, b := range t.slowest {
+		s.Slowest = append(s.Slowest, bookSummary{b.book, b.total().Seconds(), phaseSeconds(b.spent)})
+	}
+	return s
+}
+
+// formatPhases gives each phase's share of the time spent in all of them.
+// With several workers that sum is more than the wall clock time.
+func formatPhases(spent [numPhases]time.Duration) string {
+	var all time.Duration
+	for _, d := range spent {
+		all += d
+	}
+	parts := []string{}
+	for p, d := range spent {
+		if d == 0 {
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s %s (%.0f%%)", phaseNames[p], roundDuration(d), 100*float64(d)/float64(all)))
+	}
+	if len(parts) == 0 {
+		return "nothing timed"
+	}
+	return strings.Join(parts, ", ")
+}
+
+func roundDuration(d time.Duration) time.Duration {
+	if d < time.Millisecond {
+		return d.Round(time.Microsecond)
+	}
+	return d.Round(time.Millisecond)
+}
+
+// report prints where the run's time went, the slowest books with --debug,
+// and writes the summary to --summary-json if given. runErr is how the run
+// ended, and is returned; a run that failed or timed out is still reported
+// up to where it got.
+func (t *timings) report(command string, runErr error) error {
+	if t == nil {
+		return runErr
+	}
+	s := t.summary(command)
+	s.Status = "ok"
+	if timedOut(runErr) {
+		s.Status = "timed out"
+	} else if exitCode(runErr) == exitPartial {
+		s.Status = "partial"
+	} else if runErr != nil {
+		s.Status = "failed"
+	}
+
+	t.mu.Lock()
+	line := fmt.Sprintf("%s: %d books in %s; %s", command, s.Books, roundDuration(t.now().Sub(t.started)), formatPhases(t.spent))
+	if runErr != nil {
+		line += " (" + s.Status + ")"
+	}
+	fmt.Println(line)
+	if len(t.statuses) > 0 {
+		parts := []string{}
+		for _, status := range metadataStatuses {
+			if n := t.statuses[status]; n > 0 {
+				parts = append(parts, fmt.Sprintf("%s %d", status, n))
+			}
+		}
+		fmt.Println("metadata:", strings.Join(parts, ", "))
+	}
+	if t.failed > 0 || t.tooLarge > 0 {
+		fmt.Printf("failed %d, skipped-too-large %d\n", t.failed, t.tooLarge)
+	}
+	if t.stubs > 0 {
+		fmt.Printf("skipped %d stubs\n", t.stubs)
+	}
+	if t.split > 0 {
+		fmt.Printf("split %d files holding several texts\n", t.split)
+	}
+	if s.MaxWAL > 0 {
+		fmt.Printf("wal: at most %s, %d checkpoints\n", formatSize(s.MaxWAL), s.Checkpoints)
+	}
+	if *debug {
+		for _, b := range t.slowest {
+			fmt.Fprintf(os.Stderr, "slow: %s %s: %s\n", b.book, roundDuration(b.total()), formatPhases(b.spent))
+		}
+	}
+	t.mu.Unlock()
+
+	events.emit("run_finished", map[string]interface{}{"summary": s})
+	if *summaryJSON == "" {
+		return runErr
+	}
+	bs, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(*summaryJSON, append(bs, '\n'), 0644); err != nil {
+		return fmt.Errorf("could not write summary: %w", err)
+	}
+	return runErr
+}
@@ -0,0 +1,120 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// timeBooks times n books on clock, book i spending i seconds reading,
+// waiting a minute its turn, then 2i seconds scanning.
+func timeBooks(tm *timings, clock *fakeClock, n int) {
+	for i := 1; i <= n; i++ {
+		sw := tm.start(fmt.Sprintf("book %d", i))
+		clock.advance(time.Duration(i) * time.Second)
+		sw.lap(phaseRead)
+		clock.advance(time.Minute)
+		sw.wait()
+		clock.advance(time.Duration(2*i) * time.Second)
+		sw.lap(phaseScan)
+		sw.done(i)
+	}
+}
+
+func TestTimingsSummary(t *testing.T) {
+	clock := newFakeClock()
+	tm := newTimingsClock(clock.now)
+	timeBooks(tm, clock, 12)
+
+	s := tm.summary("chunk")
+	if s.Books != 12 || s.Chunks != 78 {
+		t.Errorf("%d books of %d chunks, want 12 of 78", s.Books, s.Chunks)
+	}
+	// 1+...+12 seconds read, twice that scanned, and 12 minutes waited
+	want := map[string]float64{"read": 78, "scan": 156}
+	if len(s.Phases) != len(want) || s.Phases["read"] != want["read"] || s.Phases["scan"] != want["scan"] {
+		t.Errorf("phases %v, want %v", s.Phases, want)
+	}
+	if s.Seconds != 78+156+12*60 {
+		t.Errorf("the run took %v seconds, want %d", s.Seconds, 78+156+12*60)
+	}
+
+	if len(s.Slowest) != slowestKept {
+		t.Fatalf("%d slowest books kept, want %d", len(s.Slowest), slowestKept)
+	}
+	for i, b := range s.Slowest {
+		n := 12 - i
+		if b.Book != fmt.Sprintf("book %d", n) || b.Seconds != float64(3*n) {
+			t.Errorf("slowest %d is %s at %vs, want book %d at %ds", i, b.Book, b.Seconds, n, 3*n)
+		}
+	}
+
+	if got := formatPhases(tm.spent); got != "read 1m18s (33%), scan 2m36s (67%)" {
+		t.Errorf("formatPhases = %q", got)
+	}
+	if got := formatPhases([numPhases]time.Duration{}); got != "nothing timed" {
+		t.Errorf("formatPhases of nothing = %q", got)
+	}
+}
+
+func TestTimingsSlowestOrder(t *testing.T) {
+	clock := newFakeClock()
+	tm := newTimingsClock(clock.now)
+	for _, secs := range []int{5, 1, 9, 3, 9, 7} {
+		sw := tm.start(fmt.Sprint(secs))
+		clock.advance(time.Duration(secs) * time.Second)
+		sw.lap(phaseWrite)
+		sw.done(0)
+	}
+	var got []string
+	for _, b := range tm.summary("ingest").Slowest {
+		got = append(got, b.Book)
+	}
+	if fmt.Sprint(got) != "[9 9 7 5 3 1]" {
+		t.Errorf("slowest %v, want [9 9 7 5 3 1]", got)
+	}
+}
+
+func TestTimingsNil(t *testing.T) {
+	var tm *timings
+	sw := tm.start("book")
+	sw.lap(phaseRead)
+	sw.wait()
+	sw.done(3)
+	tm.metadata("complete")
+	tm.bookFailed()
+	if err := tm.report("chunk", nil); err != nil {
+		t.Errorf("report of no timings: %v", err)
+	}
+}
+
+func TestTimingsReportJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "summary.json")
+	was := *summaryJSON
+	*summaryJSON = path
+	t.Cleanup(func() { *summaryJSON = was })
+
+	clock := newFakeClock()
+	tm := newTimingsClock(clock.now)
+	timeBooks(tm, clock, 2)
+	tm.metadata("complete")
+	tm.metadata("complete")
+	tm.skipStub()
+	if err := tm.report("ingest", nil); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s runSummary
+	if err = json.Unmarshal(b, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Command != "ingest" || s.Status != "ok" || s.Books != 2 || s.Phases["read"] != 3 || s.Metadata["complete"] != 2 || s.SkippedStubs != 1 {
+		t.Errorf("--summary-json wrote %s", b)
+	}
+}
@@ -0,0 +1,209 @@
+package cli
+
+import (
+	"crypto/subtle"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// limiter is a per-client token bucket: each client may make burst requests
+// at once and gets rps more every second. Buckets idle long enough to have
+// refilled are swept out now and then, so a flood of one-off clients can't
+// grow the map without bound.
+type limiter struct {
+	rps   float64
+	burst float64
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	// sweep at most this often
+	sweepEvery time.Duration
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rps float64, burst int, now func() time.Time) *limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &limiter{
+		rps:        rps,
+		burst:      float64(burst),
+		now:        now,
+		buckets:    map[string]*bucket{},
+		lastSweep:  now(),
+		sweepEvery: time.Minute,
+	}
+}
+
+// allow takes a token from client's bucket. When there is none it returns
+// false and how long until there will be.
+func (l *limiter) allow(client string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastSweep) >= l.sweepEvery {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rps)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := (1 - b.tokens) / l.rps
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// sweep drops buckets that would be full by now; forgetting them changes
+// nothing for their clients.
+func (l *limiter) sweep(now time.Time) {
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rps >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+	l.lastSweep = now
+}
+
+func (l *limiter) middleware(clientIP func(*http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, wait := l.allow(clientIP(r))
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			httpError(w, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// remoteIP is the address the request came from. Behind hops reverse
+// proxies, each appending the address it was called from to
+// X-Forwarded-For, it is the entry the farthest of them appended, hops from
+// the right: any entry left of it the client may have sent itself. With
+// fewer entries than that the request didn't come through them all, and the
+// address it came from is taken.
+func remoteIP(hops int) func(*http.Request) string {
+	return func(r *http.Request) string {
+		if hops > 0 {
+			var fwd []string
+			for _, h := range r.Header.Values("X-Forwarded-For") {
+				fwd = append(fwd, strings.Split(h, ",")...)
+			}
+			if len(fwd) >= hops {
+				if ip := strings.TrimSpace(fwd[len(fwd)-hops]); ip != "" {
+					return ip
+				}
+			}
+		}
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return r.RemoteAddr
+		}
+		return host
+	}
+}
+
+// requireKey guards an endpoint with an API key given in X-API-Key or the
+// key query parameter. With no key configured the endpoint is open.
+func requireKey(key string, next http.Handler) http.Handler {
+	if key == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := r.Header.Get("X-API-Key")
+		if got == "" {
+			got = r.URL.Query().Get("key")
+		}
+		if subtle.ConstantTimeCompare([]byte(got), []byte(key)) != 1 {
+			httpError(w, http.StatusUnauthorized, "missing or wrong api key")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// cors allows browsers on the given origins, or any origin for "*", to call
+// the API, answering preflight requests itself.
+func cors(origins []string, next http.Handler) http.Handler {
+	if len(origins) == 0 {
+		return next
+	}
+	allowed := map[string]bool{}
+	for _, o := range origins {
+		allowed[o] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin != "" && (allowed["*"] || allowed[origin]) {
+			h := w.Header()
+			if allowed["*"] {
+				h.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				h.Set("Access-Control-Allow-Origin", origin)
+				h.Add("Vary", "Origin")
+			}
+			h.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			h.Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-API-Key, X-Book-Title, X-Book-Author")
+			h.Set("Access-Control-Expose-Headers", "Retry-After")
+		}
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+	return n, err
+}
+
+// logRequests logs each request with its status, size and latency.
+func logRequests(logger *log.Logger, clientIP func(*http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		logger.Printf("%s %s %s %d %dB %s", clientIP(r), r.Method, r.URL.Path, rec.status, rec.bytes, time.Since(start).Round(time.Microsecond))
+	})
+}
@@ -0,0 +1,248 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock a test moves by hand.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+})
+
+func TestLimiterBurstAndRefill(t *testing.T) {
+	clock := newFakeClock()
+	l := newLimiter(2, 3, clock.now)
+
+	for i := 0; i < 3; i++ {
+		if allowed, _ := l.allow("a"); !allowed {
+			t.Fatalf("request %d of the burst was refused", i+1)
+		}
+	}
+	allowed, wait := l.allow("a")
+	if allowed {
+		t.Fatal("a request past the burst was allowed")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("wait = %v, want 500ms at 2rps", wait)
+	}
+	if allowed, _ := l.allow("b"); !allowed {
+		t.Error("another client shared a's bucket")
+	}
+
+	clock.advance(500 * time.Millisecond)
+	if allowed, _ := l.allow("a"); !allowed {
+		t.Error("no token after waiting for one to refill")
+	}
+	if allowed, _ := l.allow("a"); allowed {
+		t.Error("more than one token refilled in half a second")
+	}
+
+	// a long idle refills to the burst, and no further
+	clock.advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		if allowed, _ := l.allow("a"); !allowed {
+			t.Fatalf("request %d after idling was refused", i+1)
+		}
+	}
+	if allowed, _ := l.allow("a"); allowed {
+		t.Error("the bucket refilled past the burst")
+	}
+}
+
+func TestLimiterSweep(t *testing.T) {
+	clock := newFakeClock()
+	l := newLimiter(1, 2, clock.now)
+	l.allow("idle")
+	clock.advance(time.Minute - 500*time.Millisecond)
+	l.allow("busy")
+	l.allow("busy")
+
+	// a minute on, idle has long been full again and busy not yet
+	clock.advance(500 * time.Millisecond)
+	l.allow("other")
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, kept := l.buckets["idle"]; kept {
+		t.Error("an idle, full bucket was not swept")
+	}
+	if _, kept := l.buckets["busy"]; !kept {
+		t.Error("a bucket in use was swept")
+	}
+}
+
+func TestLimiterMiddleware(t *testing.T) {
+	clock := newFakeClock()
+	h := newLimiter(0.5, 1, clock.now).middleware(remoteIP(0), okHandler)
+
+	get := func(addr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/chunks/random", nil)
+		r.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	if w := get("192.0.2.1:1000"); w.Code != http.StatusOK {
+		t.Fatalf("first request: %d", w.Code)
+	}
+	w := get("192.0.2.1:1001")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request: %d, want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q, want 2", got)
+	}
+	if w := get("192.0.2.2:1000"); w.Code != http.StatusOK {
+		t.Errorf("another IP: %d", w.Code)
+	}
+	clock.advance(2 * time.Second)
+	if w := get("192.0.2.1:1002"); w.Code != http.StatusOK {
+		t.Errorf("after Retry-After: %d", w.Code)
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	tests := []struct {
+		hops int
+		xff  []string
+		want string
+	}{
+		{0, nil, "10.0.0.1"},
+		{0, []string{"203.0.113.9"}, "10.0.0.1"},
+		{1, nil, "10.0.0.1"},
+		{1, []string{"203.0.113.9"}, "203.0.113.9"},
+		// what the client sent itself is left of what the proxy appended
+		{1, []string{"1.2.3.4, 203.0.113.9"}, "203.0.113.9"},
+		{1, []string{"1.2.3.4", "203.0.113.9"}, "203.0.113.9"},
+		{2, []string{"1.2.3.4, 203.0.113.9, 10.0.0.2"}, "203.0.113.9"},
+		// fewer entries than proxies: it didn't come through them all
+		{2, []string{"203.0.113.9"}, "10.0.0.1"},
+		{1, []string{" "}, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "10.0.0.1:5555"
+		for _, v := range tt.xff {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := remoteIP(tt.hops)(r); got != tt.want {
+			t.Errorf("remoteIP(%d) with %q = %q, want %q", tt.hops, tt.xff, got, tt.want)
+		}
+	}
+}
+
+// Rotating the X-Forwarded-For a client sends must not get it past the
+// limit.
+func TestRateLimitForwardedRotation(t *testing.T) {
+	h := newLimiter(1, 2, newFakeClock().now).middleware(remoteIP(1), okHandler)
+	limited := 0
+	for i := 0; i < 10; i++ {
+		r := httptest.NewRequest("GET", "/chunks/random", nil)
+		r.RemoteAddr = "10.0.0.1:5555"
+		r.Header.Set("X-Forwarded-For", fmt.Sprintf("198.51.100.%d, 203.0.113.9", i))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code == http.StatusTooManyRequests {
+			limited++
+		}
+	}
+	if limited != 8 {
+		t.Errorf("%d of 10 requests limited, want 8", limited)
+	}
+}
+
+func TestRequireKey(t *testing.T) {
+	if h := requireKey("", okHandler); h == nil {
+		t.Fatal("no handler with no key")
+	}
+	h := requireKey("sekrit", okHandler)
+	tests := []struct {
+		header, query string
+		want          int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"wrong", "", http.StatusUnauthorized},
+		{"sekrit", "", http.StatusOK},
+		{"", "sekrit", http.StatusOK},
+		{"", "sekri", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/search?q=x&key="+tt.query, nil)
+		if tt.header != "" {
+			r.Header.Set("X-API-Key", tt.header)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("header %q, key %q: %d, want %d", tt.header, tt.query, w.Code, tt.want)
+		}
+	}
+}
+
+func TestCORS(t *testing.T) {
+	h := cors([]string{"https://toy.example"}, okHandler)
+
+	r := httptest.NewRequest("GET", "/chunks/random", nil)
+	r.Header.Set("Origin", "https://toy.example")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://toy.example" {
+		t.Errorf("Access-Control-Allow-Origin = %q", got)
+	}
+
+	r = httptest.NewRequest("GET", "/chunks/random", nil)
+	r.Header.Set("Origin", "https://elsewhere.example")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("an origin not allowed got Access-Control-Allow-Origin %q", got)
+	}
+
+	r = httptest.NewRequest("OPTIONS", "/search", nil)
+	r.Header.Set("Origin", "https://toy.example")
+	r.Header.Set("Access-Control-Request-Method", "GET")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+		t.Errorf("preflight: %d %q, want 204 and no body", w.Code, w.Body)
+	}
+
+	h = cors([]string{"*"}, okHandler)
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Origin", "https://any.example")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("with *, Access-Control-Allow-Origin = %q", got)
+	}
+}
+
+func TestLogRequests(t *testing.T) {
+	var buf bytes.Buffer
+	teapot := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("short and stout"))
+	})
+	h := logRequests(log.New(&buf, "", 0), remoteIP(0), teapot)
+	r := httptest.NewRequest("GET", "/books/1", nil)
+	r.RemoteAddr = "192.0.2.7:80"
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if line := buf.String(); !strings.HasPrefix(line, "192.0.2.7 GET /books/1 418 15B ") {
+		t.Errorf("logged %q", line)
+	}
+}
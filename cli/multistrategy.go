@@ -0,0 +1,83 @@
+package cli
+
+import (
+	"database/sql"
+	"fmt"
+
+	"git.tilde.town/gutchunker/gutchunk"
+)
+
+// chunk and run take more than one strategy, as --strategy a,b, to
+// compare how they cut the same books. Each book is read, decompressed and
+// its body found once, as a gutchunk.Body, and each strategy splits that
+// body in turn, so a second strategy costs what its split does and no
+// more. The first strategy's chunks are the book's chunks, as with one
+// strategy, with footnotes, stable ids kept across rechunks, flags and
+// everything drawing from chunks; those of the rest go into
+// strategy_chunks beside them, tagged with the strategy as --strategy
+// named it and given the stable ids that strategy would give them, in the
+// same transaction. Chunking a book again, by any strategies, replaces
+// them all, so strategy_chunks only ever hold what the last run cut.
+//
+// A book retried reduced (see chunkwarn.go) is cut by paragraphs alone.
+// chunk-one and audit-chunks take one strategy.
+
+// strategyCut is what a strategy after the first cut a book into.
+type strategyCut struct {
+	// the strategy as --strategy named it, and the name it gives itself,
+	// with its options, which goes into stable ids
+	name, strategy string
+	chunks         []string
+	at             []chunkPos
+}
+
+// splitBookAll is splitBookAt, with what each of opts' other strategies
+// cut the body into, found only the once.
+func splitBookAll(content string, opts chunkOptions) ([]string, []chunkPos, []gutchunk.Footnote, []strategyCut, gutchunk.Found) {
+	body, m := opts.body(content)
+	chunks, at, notes := splitBody(body, opts)
+	return chunks, at, notes, opts.splitOthers(body), m
+}
+
+// splitOthers is what each of opts' other strategies cut body into, the
+// footer blocklist applied as to the first's. Their footnotes are the
+// first's to keep.
+func (opts chunkOptions) splitOthers(body []string) []strategyCut {
+	var cuts []strategyCut
+	for _, name := range opts.otherStrategies {
+		o := opts
+		o.strategyName, o.otherStrategies = name, nil
+		chunks, at, _ := splitBody(body, o)
+		cuts = append(cuts, strategyCut{name: name, strategy: o.strategy(), chunks: chunks, at: at})
+	}
+	return cuts
+}
+
+// writeStrategyChunks writes what book id's other strategies cut it into,
+// their chunks placed in works as the first's are. writeChunks has cleared
+// those there were.
+func writeStrategyChunks(tx *sql.Tx, id int, cuts []strategyCut, works []workSpan, scenes bool) error {
+	if len(cuts) == 0 {
+		return nil
+	}
+	var ebook int
+	if err := tx.QueryRow("SELECT coalesce(ebook, 0) FROM files WHERE id = ?", id).Scan(&ebook); err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare("INSERT INTO strategy_chunks (sourceid, strategy, ordinal, chunk, work_id, scene, position_pct, kind, stable_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return fmt.Errorf("could not prepare: %w", err)
+	}
+	defer stmt.Close()
+	for _, c := range cuts {
+		stable := stableIDs(stableScope(id, ebook), c.strategy, c.chunks)
+		extras := chunkExtras(works, c.at, scenes)
+		for ordinal, chunk := range c.chunks {
+			x := extras[ordinal]
+			if _, err = stmt.Exec(id, c.name, ordinal, chunk, x.work, x.scene, x.position, x.kind, stable[ordinal]); err != nil {
+				return fmt.Errorf("could not insert the %s chunk at ordinal %d: %w", c.name, ordinal, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package cli
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// cutRows are the chunks of book id in table, one string each of what is
+// stored of them, in order; strategy_chunks by strategy.
+func cutRows(t testing.TB, db *sql.DB, table, strategy string, id int) []string {
+	t.Helper()
+	q := "SELECT ordinal, chunk, coalesce(kind, ''), coalesce(position_pct, 0), coalesce(stable_id, '') FROM " + table + " WHERE sourceid = ?"
+	args := []interface{}{id}
+	if strategy != "" {
+		q += " AND strategy = ?"
+		args = append(args, strategy)
+	}
+	rows, err := db.Query(q+" ORDER BY ordinal", args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	cut := []string{}
+	for rows.Next() {
+		var ordinal int
+		var chunk, kind, stable string
+		var position float64
+		if err = rows.Scan(&ordinal, &chunk, &kind, &position, &stable); err != nil {
+			t.Fatal(err)
+		}
+		cut = append(cut, fmt.Sprintf("%d %q %s %.4f %s", ordinal, chunk, kind, position, stable))
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return cut
+}
+
+// chunkedBy chunks a book of content alone by --strategy strategies,
+// returning its database and the book's id.
+func chunkedBy(t testing.TB, content string, strategies string) (*sql.DB, int) {
+	t.Helper()
+	db := testDB(t)
+	id := addBook(t, db, "Strategies", "Someone", content)
+	opts, err := parseChunkFlags("--strategy", strategies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = chunkHeld(writerOf(db), id, opts); err != nil {
+		t.Fatal(err)
+	}
+	return db, id
+}
+
+// Each strategy of --strategy a,b cuts a book as it would alone, the first
+// into chunks and the rest into strategy_chunks.
+func TestStrategiesAsAlone(t *testing.T) {
+	content := testBook("Strategies", testParagraphs(5)+"\n\nA short one.\n\n* * *\n\n"+testParagraphs(2))
+	alone := map[string][]string{}
+	for _, s := range []string{"paragraphs", "toy"} {
+		db, id := chunkedBy(t, content, s)
+		alone[s] = cutRows(t, db, "chunks", "", id)
+		if len(alone[s]) == 0 {
+			t.Fatalf("%s cut no chunks", s)
+		}
+	}
+	for _, order := range [][2]string{{"paragraphs", "toy"}, {"toy", "paragraphs"}} {
+		db, id := chunkedBy(t, content, order[0]+","+order[1])
+		if got := cutRows(t, db, "chunks", "", id); !reflect.DeepEqual(got, alone[order[0]]) {
+			t.Errorf("%s,%s: chunks\n%q\nnot as %s alone\n%q", order[0], order[1], got, order[0], alone[order[0]])
+		}
+		if got := cutRows(t, db, "strategy_chunks", order[1], id); !reflect.DeepEqual(got, alone[order[1]]) {
+			t.Errorf("%s,%s: %s chunks\n%q\nnot as alone\n%q", order[0], order[1], order[1], got, alone[order[1]])
+		}
+		var others int
+		db.QueryRow("SELECT count(*) FROM strategy_chunks WHERE strategy != ?", order[1]).Scan(&others)
+		if others != 0 {
+			t.Errorf("%s,%s: %d chunks in strategy_chunks of other strategies", order[0], order[1], others)
+		}
+	}
+}
+
+// Chunking a book again by one strategy clears what others cut before.
+func TestStrategiesRechunked(t *testing.T) {
+	db, id := chunkedBy(t, testBook("Strategies", testParagraphs(3)), "paragraphs,toy")
+	if len(cutRows(t, db, "strategy_chunks", "toy", id)) == 0 {
+		t.Fatal("toy cut nothing")
+	}
+	if _, err := chunkHeld(writerOf(db), id, chunkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := cutRows(t, db, "strategy_chunks", "", id); len(got) != 0 {
+		t.Errorf("chunked again by paragraphs, strategy_chunks still has %q", got)
+	}
+	if chunkCount(t, db, id) != 3 {
+		t.Errorf("%d chunks", chunkCount(t, db, id))
+	}
+}
+
+func TestStrategyList(t *testing.T) {
+	opts, err := parseChunkFlags("--strategy", "toy,paragraphs")
+	if err != nil || opts.strategyName != "toy" || !reflect.DeepEqual(opts.otherStrategies, []string{"paragraphs"}) {
+		t.Errorf("toy,paragraphs: %q, %q, %v", opts.strategyName, opts.otherStrategies, err)
+	}
+	if err = opts.oneStrategy("chunk-one"); err == nil {
+		t.Error("chunk-one took two strategies")
+	}
+	for _, bad := range []string{"toy,toy", "toy,", ",toy", "toy,nonesuch"} {
+		if _, err := parseChunkFlags("--strategy", bad); err == nil {
+			t.Errorf("--strategy %s was taken", bad)
+		}
+	}
+	if opts, err = parseChunkFlags("--strategy", "toy"); err != nil || opts.oneStrategy("chunk-one") != nil {
+		t.Errorf("one strategy: %v", err)
+	}
+}
+
+// The second strategy of --strategy a,b costs its split and no more: the
+// book isn't read, decompressed or its body found again, as chunking it
+// once by each does.
+func BenchmarkStrategies(b *testing.B) {
+	content := testBook("Strategies", strings.Repeat(testParagraphs(20)+"\n\n", 20))
+	for _, bench := range []struct {
+		name string
+		runs []string
+	}{
+		{"one", []string{"paragraphs"}},
+		{"two", []string{"paragraphs,toy"}},
+		{"each", []string{"paragraphs", "toy"}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			db := testDB(b)
+			id := addBook(b, db, "Strategies", "Someone", content)
+			w := writerOf(db)
+			var runs []chunkOptions
+			for _, s := range bench.runs {
+				opts, err := parseChunkFlags("--strategy", s)
+				if err != nil {
+					b.Fatal(err)
+				}
+				runs = append(runs, opts)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, opts := range runs {
+					if _, err := chunkHeld(w, id, opts); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkSplitStrategies is BenchmarkStrategies without the database,
+// finding the body once for both strategies or once for each.
+func BenchmarkSplitStrategies(b *testing.B) {
+	content := testBook("Strategies", strings.Repeat(testParagraphs(20)+"\n\n", 20))
+	both, err := parseChunkFlags("--strategy", "paragraphs,toy")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run("together", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			splitBookAll(content, both)
+		}
+	})
+	b.Run("apart", func(b *testing.B) {
+		first, second := both, both
+		first.otherStrategies, second.strategyName, second.otherStrategies = nil, "toy", nil
+		for i := 0; i < b.N; i++ {
+			splitBookAt(content, first)
+			splitBookAt(content, second)
+		}
+	})
+}
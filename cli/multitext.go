@@ -0,0 +1,122 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A few archive members hold several complete etexts back to back, each
+// with its own header, START and END markers and license, and bookBody,
+// stopping at the first END, would find only the first. ingest splits such
+// a member into its texts, each a files row of its own, read for its own
+// title, author, language and ebook number and chunked by itself. It
+// splits only where, after an END marker, a header with Title: and Author:
+// lines comes before another START marker with a body after it, cutting
+// at that header's "The Project Gutenberg EBook of" line, or its Title:
+// line without one, so each text keeps its license. The texts after the
+// first are named for the member with #2, #3 and so on after its path, in
+// the filename, member_name and archive_path of their rows, and take their
+// ebook numbers from their own headers, never the archive's name.
+
+// the first line of a Gutenberg header, as the texts of a member start
+var textBanner = regexp.MustCompile(`(?i)^the project gutenberg('s)? e-?(book|text)\b`)
+
+// splitTexts cuts text at the start of each etext after the first that it
+// holds, giving text back alone when it holds one.
+func splitTexts(text string) []string {
+	raw := strings.SplitAfter(text, "\n")
+	lines := make([]string, len(raw))
+	for i, l := range raw {
+		lines[i] = strings.TrimSpace(l)
+	}
+	texts := []string{}
+	from := 0
+	for {
+		at := nextText(lines, from)
+		if at < 0 {
+			break
+		}
+		texts = append(texts, strings.Join(raw[from:at], ""))
+		from = at
+	}
+	return append(texts, strings.Join(raw[from:], ""))
+}
+
+// nextText is the line the etext after the one starting at line from
+// begins at, -1 when there is none.
+func nextText(lines []string, from int) int {
+	start := indexLine(lines, from, isStart)
+	if start < 0 {
+		return -1
+	}
+	end := indexLine(lines, start+1, isEnd)
+	if end < 0 || !hasBodyText(lines[start+1:end]) {
+		return -1
+	}
+	next := indexLine(lines, end+1, isStart)
+	if next < 0 {
+		return -1
+	}
+	title, author := -1, -1
+	for i := end + 1; i < next; i++ {
+		switch {
+		case title < 0 && strings.HasPrefix(lines[i], "Title:"):
+			title = i
+		case author < 0 && strings.HasPrefix(lines[i], "Author:"):
+			author = i
+		}
+	}
+	if title < 0 || author < 0 {
+		return -1
+	}
+	body := len(lines)
+	if e := indexLine(lines, next+1, isEnd); e >= 0 {
+		body = e
+	}
+	if !hasBodyText(lines[next+1 : body]) {
+		return -1
+	}
+	for i := title - 1; i > end; i-- {
+		if textBanner.MatchString(lines[i]) {
+			return i
+		}
+	}
+	return title
+}
+
+func indexLine(lines []string, from int, is func(string) bool) int {
+	for i := from; i < len(lines); i++ {
+		if is(lines[i]) {
+			return i
+		}
+	}
+	return -1
+}
+
+// withTexts is m, a book, split into the texts it holds: m with the first
+// of them, and the rest in its more.
+func withTexts(m zipMember) zipMember {
+	texts := splitTexts(m.text.String())
+	if len(texts) == 1 {
+		return m
+	}
+	m.text = bytes.NewBufferString(texts[0])
+	for i, t := range texts[1:] {
+		m.more = append(m.more, zipMember{name: fmt.Sprintf("%s#%d", m.name, i+2), text: bytes.NewBufferString(t), part: i + 2})
+	}
+	return m
+}
+
+// memberPart is the member name names, taking off a text's #N, and which
+// of the texts of that member it is, from 1.
+func memberPart(name string) (string, int) {
+	if i := strings.LastIndexByte(name, '#'); i >= 0 {
+		if n, err := strconv.Atoi(name[i+1:]); err == nil && n > 1 {
+			return name[:i], n
+		}
+	}
+	return name, 1
+}
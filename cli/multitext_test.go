@@ -0,0 +1,161 @@
+package cli
+
+import (
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// headedBook is a book as testBook gives it, with an Author: line, an
+// ebook number and a language in its header.
+func headedBook(title, author, ebook, language, body string) string {
+	return "The Project Gutenberg EBook of " + title + ", by " + author + "\n\nTitle: " + title + "\n\nAuthor: " + author +
+		"\n\nRelease Date: May 1, 2004 [EBook #" + ebook + "]\n\nLanguage: " + language + "\n\n" +
+		"*** START OF THIS PROJECT GUTENBERG EBOOK " + strings.ToUpper(title) + " ***\n\n" +
+		body + "\n\n*** END OF THIS PROJECT GUTENBERG EBOOK " + strings.ToUpper(title) + " ***\n\nEnd of the license.\n"
+}
+
+func TestSplitTexts(t *testing.T) {
+	emma := headedBook("Emma", "Jane Austen", "158", "English", testParagraphs(2))
+	persuasion := headedBook("Persuasion", "Jane Austen", "105", "English", testParagraphs(2))
+	// a header with no banner line is cut at its first line
+	bare := strings.TrimPrefix(headedBook("Sanditon", "Jane Austen", "9", "English", testParagraphs(1)), "The Project Gutenberg EBook of Sanditon, by Jane Austen\n\n")
+	for _, c := range []struct {
+		name string
+		text string
+		want []string
+	}{
+		{"one book", emma, []string{emma}},
+		{"two", emma + persuasion, []string{emma, persuasion}},
+		{"three, with space between them", emma + "\n\n" + persuasion + bare, []string{emma + "\n\n", persuasion, bare}},
+		{"a header without a banner", emma + "Some notes on the text.\n" + bare, []string{emma + "Some notes on the text.\n", bare}},
+		{"a header without an author", emma + testBook("Notes", testParagraphs(1)), nil},
+		{"a START before any END", strings.Replace(emma, "*** END", "*** START", 1) + persuasion, nil},
+		{"nothing after the second START", emma + strings.Split(persuasion, "\n\n*** START")[0] + "\n\n*** START OF IT ***\n\n\n\n*** END OF IT ***\n", nil},
+		{"nothing before the first END", headedBook("Blank", "Nobody", "1", "English", "") + persuasion, nil},
+	} {
+		if c.want == nil {
+			c.want = []string{c.text}
+		}
+		got := splitTexts(c.text)
+		if strings.Join(got, "") != c.text {
+			t.Errorf("%s: splitTexts lost text", c.name)
+		}
+		if len(got) != len(c.want) {
+			t.Errorf("%s: splitTexts gave %d texts, want %d", c.name, len(got), len(c.want))
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("%s: text %d is\n%s\nwant\n%s", c.name, i+1, got[i], c.want[i])
+			}
+		}
+	}
+}
+
+func TestMemberPart(t *testing.T) {
+	for name, want := range map[string]struct {
+		name string
+		part int
+	}{
+		"12345.txt":      {"12345.txt", 1},
+		"12345.txt#2":    {"12345.txt", 2},
+		"dir/a#b.txt#13": {"dir/a#b.txt", 13},
+		"a#b.txt":        {"a#b.txt", 1},
+		"12345.txt#1":    {"12345.txt#1", 1},
+		"12345.txt#":     {"12345.txt#", 1},
+	} {
+		if got, part := memberPart(name); got != want.name || part != want.part {
+			t.Errorf("memberPart(%q) = %q, %d, want %q, %d", name, got, part, want.name, want.part)
+		}
+	}
+}
+
+// multiTextMirror is a mirror of an archive holding one book, and one
+// whose member holds three.
+func multiTextMirror(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	writeTestZip(t, filepath.Join(root, "1", "11.zip"), zipEntry{"11.txt", headedBook("Emma", "Jane Austen", "158", "English", testParagraphs(3))})
+	writeTestZip(t, filepath.Join(root, "2", "22.zip"), zipEntry{"22.txt",
+		headedBook("Candide", "Voltaire", "4650", "French", testParagraphs(2)) +
+			headedBook("The Sorrows of Young Werther", "J. W. von Goethe", "2527", "German", testParagraphs(4)) +
+			headedBook("Cranford", "Elizabeth Gaskell", "394", "English", testParagraphs(1))})
+	return root
+}
+
+// splitRows is each book of db, with where it was read from and how many
+// chunks it has, a line each.
+func splitRows(t *testing.T, db *sql.DB) string {
+	t.Helper()
+	return names(t, db, `SELECT f.id || ' ' || name || ' | ' || author || ' | ' || coalesce(ebook, '-') || ' ' || language || ' ' ||
+		filename || ' ' || member_name || ' ' || archive_path || ' ' || (SELECT count(*) FROM chunks c WHERE c.sourceid = f.id)
+		FROM files f ORDER BY f.id`)
+}
+
+func TestIngestMultiText(t *testing.T) {
+	root := multiTextMirror(t)
+	db := testDB(t)
+	summary := filepath.Join(t.TempDir(), "summary.json")
+	defer func(was string) { *summaryJSON = was }(*summaryJSON)
+	*summaryJSON = summary
+	out, err := captureStdout(t, func() error { return ingestCmd([]string{"--target", root}) })
+	*summaryJSON = ""
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "\nsplit 1 files holding several texts\n") {
+		t.Errorf("ingest printed\n%s", out)
+	}
+	bs, err := os.ReadFile(summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s runSummary
+	if err = json.Unmarshal(bs, &s); err != nil || s.SplitFiles != 1 {
+		t.Errorf("ingest's summary has split_files %d (%v)", s.SplitFiles, err)
+	}
+	if _, err = captureStdout(t, func() error { return chunkCmd(nil) }); err != nil {
+		t.Fatal(err)
+	}
+	want := "1 Emma | Jane Austen | 11 en 11.txt 11.txt 11.txt 3\n" +
+		"2 Candide | Voltaire | 22 fr 22.txt 22.txt 22.txt 2\n" +
+		"3 The Sorrows of Young Werther | J. W. von Goethe | 2527 de 22.txt#2 22.txt#2 22.txt#2 4\n" +
+		"4 Cranford | Elizabeth Gaskell | 394 en 22.txt#3 22.txt#3 22.txt#3 1\n"
+	if got := splitRows(t, db); got != want {
+		t.Errorf("ingest and chunk stored\n%s\nwant\n%s", got, want)
+	}
+	// each text with only its own header and body
+	var werther string
+	if err = db.QueryRow("SELECT content FROM files WHERE id = 3").Scan(&werther); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(werther, "The Project Gutenberg EBook of The Sorrows of Young Werther") || strings.Contains(werther, "Candide") ||
+		strings.Contains(werther, "Cranford") || !strings.HasSuffix(werther, "End of the license.\n") {
+		t.Errorf("Werther's content is\n%s", werther)
+	}
+
+	// the mirror as it was read, and read again as the same
+	if out, err = captureStdout(t, func() error { return verifyContentCmd(nil) }); err != nil || out != "checked 4 books: 4 ok\n" {
+		t.Errorf("verify-content: %v, printing\n%s", err, out)
+	}
+	if _, err = captureStdout(t, func() error { return ingestCmd([]string{"--target", root}) }); err != nil {
+		t.Fatal(err)
+	}
+	if got := splitRows(t, db); got != want {
+		t.Errorf("ingested again, the books are\n%s", lineDiff(want, got))
+	}
+
+	// and the pipeline stores the same
+	phases := dumpDB(t, db)
+	piped := testDB(t)
+	if _, err = captureStdout(t, func() error { return runCmd([]string{"--target", root, "--pipeline", "--workers", "2"}) }); err != nil {
+		t.Fatal(err)
+	}
+	if got := dumpDB(t, piped); got != phases {
+		t.Errorf("run --pipeline stored what ingest and chunk did but\n%s", lineDiff(phases, got))
+	}
+}
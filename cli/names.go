@@ -0,0 +1,563 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A book's title and author can come from four places, which sometimes
+// disagree: its header, as ingest found them; Project Gutenberg's catalog,
+// as gutchunk catalog read it, by ebook number; its index, GUTINDEX.ALL,
+// as gutchunk gutindex read it, by the same; and meta import, which is
+// someone saying what they are. name_sources keeps every one a book has
+// been given, and files the one shown, from the source trusted most:
+//
+//	header    low
+//	gutindex  medium
+//	catalog   high
+//	meta      authoritative
+//
+// so everything showing a book's name, random, export, serve and the rest,
+// shows the catalog's over the header's and meta's over both, and the
+// others can still be looked up, with gutchunk metadata-conflicts --book.
+// The catalog gives authors as "Austen, Jane", which are shown as "Jane
+// Austen". title_source and author_source in files say where the shown
+// ones came from.
+//
+// The names are chosen again after gutchunk catalog, gutindex, meta import
+// and reparse-headers, and by refresh-stats and maintain for the books
+// ingested since.
+//
+// gutchunk metadata-conflicts lists the books whose header and catalog
+// disagree beyond --threshold and meta hasn't settled. Titles are compared
+// by their words, without regard to case, diacritics or punctuation, and
+// only up to a subtitle, so "Frankenstein" and "Frankenstein; Or, The
+// Modern Prometheus" agree; authors by their words in any order, and
+// initials by the names they start, so "M. Twain" and "Twain, Mark" do. --resolve BOOK --use catalog (or header)
+// settles one by writing that source's names as the book's meta ones.
+
+// the sources of name_sources
+const (
+	nameHeader   = "header"
+	nameGutindex = "gutindex"
+	nameCatalog  = "catalog"
+	nameMeta     = "meta"
+)
+
+// nameSources are the sources, the most trusted first, with how much.
+var nameSources = []struct{ name, confidence string }{
+	{nameMeta, "authoritative"},
+	{nameCatalog, "high"},
+	{nameGutindex, "medium"},
+	{nameHeader, "low"},
+}
+
+func nameConfidence(source string) string {
+	for _, s := range nameSources {
+		if s.name == source {
+			return s.confidence
+		}
+	}
+	return ""
+}
+
+// catalogName turns a catalog author, "Austen, Jane" or "Tolstoy, Leo,
+// graf", into how headers give it: "Jane Austen". A name without a comma
+// is left as it is.
+func catalogName(name string) string {
+	parts := strings.Split(name, ",")
+	if len(parts) < 2 {
+		return strings.TrimSpace(name)
+	}
+	last, first := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	if first == "" || authorDates.MatchString(first) {
+		return last
+	}
+	return first + " " + last
+}
+
+// subtitle is where a title's subtitle starts
+var subtitle = regexp.MustCompile(`[:;(\[]|\s[—–-]+\s|,\s*or\b`)
+
+// titleWords are the words of a title up to its subtitle, normalized.
+func titleWords(title string) []string {
+	if loc := subtitle.FindStringIndex(fold(title)); loc != nil && loc[0] > 0 {
+		title = fold(title)[:loc[0]]
+	}
+	return strings.Fields(normalizeTitle(title))
+}
+
+// wordOverlap is the share of the words of the one of a and b with fewer
+// the other has too, 1 when either has none. With prefixes a word starting
+// another counts as it, for initials: "j" as "jane".
+func wordOverlap(a, b []string, prefixes bool) float64 {
+	a, b = uniqueWords(a), uniqueWords(b)
+	if len(a) == 0 || len(b) == 0 {
+		return 1
+	}
+	if len(b) < len(a) {
+		a, b = b, a
+	}
+	shared := 0
+	for _, w := range a {
+		for _, o := range b {
+			if w == o || prefixes && (strings.HasPrefix(o, w) || strings.HasPrefix(w, o)) {
+				shared++
+				break
+			}
+		}
+	}
+	return float64(shared) / float64(len(a))
+}
+
+func uniqueWords(ws []string) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, w := range ws {
+		if !seen[w] {
+			seen[w] = true
+			out = append(out, w)
+		}
+	}
+	return out
+}
+
+// titleAgreement and authorAgreement are how alike two titles or two
+// authors are, from 0 to 1.
+func titleAgreement(a, b string) float64 {
+	return wordOverlap(titleWords(a), titleWords(b), false)
+}
+
+func authorAgreement(a, b string) float64 {
+	return wordOverlap(nameWords(normalizeAuthor(a)), nameWords(normalizeAuthor(b)), true)
+}
+
+// nameCounts is how many books resolveNames shows the title of from each
+// source, and how many it renamed, and what resolveAuthors made of their
+// authors.
+type nameCounts struct {
+	meta, catalog, gutindex, header, renamed int
+	// the books given GUTINDEX.ALL's languages
+	languages int
+	authors   aliasCounts
+}
+
+func (c nameCounts) String() string {
+	s := fmt.Sprintf("titled %d books by meta, %d by the catalog, %d by GUTINDEX.ALL and %d by their headers, renaming %d; %s",
+		c.meta, c.catalog, c.gutindex, c.header, c.renamed, c.authors)
+	if c.languages > 0 {
+		s += fmt.Sprintf("; gave %d books GUTINDEX.ALL's languages", c.languages)
+	}
+	return s
+}
+
+// upsertNameSource is the statement recording one source's value for a
+// field of a book.
+const upsertNameSource = `INSERT INTO name_sources (file_id, field, source, value, updated_at) VALUES (?, ?, ?, ?, datetime('now'))
+	ON CONFLICT (file_id, field, source) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at
+	WHERE value != excluded.value`
+
+// resolveNames records what the catalog and GUTINDEX.ALL say of each book,
+// and the header or meta names of those whose names weren't recorded yet,
+// and shows the most trusted of each book's, with GUTINDEX.ALL's language
+// over all but meta's; then resolves their authors by alias (see
+// aliases.go).
+func resolveNames(ctx context.Context, db *sql.DB) (nameCounts, error) {
+	var c nameCounts
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return c, err
+	}
+	defer tx.Rollback()
+
+	// names not recorded are the header's, or meta's for books with a
+	// sidecar imported before name_sources
+	for _, f := range []struct{ field, column string }{{"title", "name"}, {"author", "author"}} {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(`INSERT INTO name_sources (file_id, field, source, value, updated_at)
+			SELECT id, ?, CASE WHEN id IN (SELECT file_id FROM book_meta) THEN ? ELSE ? END, %[1]s, datetime('now')
+			FROM files WHERE %[2]s_source IS NULL AND coalesce(%[1]s, '') != '' AND deleted_at IS NULL
+			ON CONFLICT (file_id, field, source) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at`,
+			f.column, f.field), f.field, nameMeta, nameHeader)
+		if err != nil {
+			return c, err
+		}
+	}
+
+	for _, from := range []struct{ source, query string }{
+		{nameCatalog, `SELECT f.id, coalesce(a.title, ''), coalesce(a.author, '')
+			FROM files f JOIN catalog a ON a.ebook = f.ebook WHERE f.deleted_at IS NULL`},
+		// an audio book's number is of the recording, not of a text
+		{nameGutindex, `SELECT f.id, coalesce(g.title, ''), coalesce(g.author, '')
+			FROM files f JOIN gutindex g ON g.ebook = f.ebook WHERE f.deleted_at IS NULL AND NOT g.audio`},
+	} {
+		if err = recordListedNames(ctx, tx, from.source, from.query); err != nil {
+			return c, err
+		}
+	}
+	res, err := tx.ExecContext(ctx, `UPDATE files SET language = g.language, language_source = ?
+		FROM gutindex g WHERE g.ebook = files.ebook AND coalesce(g.language, '') != '' AND NOT g.audio
+			AND files.deleted_at IS NULL AND coalesce(files.language_source, '') != ?
+			AND (files.language IS NOT g.language OR files.language_source IS NOT ?)`, langGutindex, langMeta, langGutindex)
+	if err != nil {
+		return c, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return c, err
+	}
+	c.languages = int(n)
+
+	rows, err := tx.QueryContext(ctx, `SELECT f.id, coalesce(f.name, ''), coalesce(f.author, ''),
+			coalesce(f.title_source, ''), coalesce(f.author_source, ''), s.field, s.source, s.value
+		FROM files f JOIN name_sources s ON s.file_id = f.id
+		WHERE f.deleted_at IS NULL ORDER BY f.id`)
+	if err != nil {
+		return c, err
+	}
+	type shown struct {
+		title, author             string
+		titleSource, authorSource string
+	}
+	was := map[int64]shown{}
+	best := map[int64]shown{}
+	var order []int64
+	better := func(source, than string) bool {
+		return than == "" || nameRank(source) < nameRank(than)
+	}
+	for rows.Next() {
+		var id int64
+		var cur shown
+		var field, source, value string
+		if err = rows.Scan(&id, &cur.title, &cur.author, &cur.titleSource, &cur.authorSource, &field, &source, &value); err != nil {
+			rows.Close()
+			return c, err
+		}
+		if _, ok := was[id]; !ok {
+			was[id] = cur
+			// a field no source has keeps what it shows
+			best[id] = shown{title: cur.title, author: cur.author}
+			order = append(order, id)
+		}
+		b := best[id]
+		switch {
+		case field == "title" && better(source, b.titleSource):
+			b.title, b.titleSource = value, source
+		case field == "author" && better(source, b.authorSource):
+			b.author, b.authorSource = value, source
+		}
+		best[id] = b
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return c, err
+	}
+
+	for _, id := range order {
+		b := best[id]
+		switch b.titleSource {
+		case nameMeta:
+			c.meta++
+		case nameCatalog:
+			c.catalog++
+		case nameGutindex:
+			c.gutindex++
+		case nameHeader:
+			c.header++
+		}
+		w := was[id]
+		if b == w {
+			continue
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE files SET name = ?, author = ?, title_source = ?, author_source = ? WHERE id = ?",
+			b.title, b.author, nullString(b.titleSource), nullString(b.authorSource), id)
+		if err != nil {
+			return c, err
+		}
+		if b.title == w.title && b.author == w.author {
+			continue
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE files SET author_norm = ?, title_norm = ? WHERE id = ?",
+			normalizeAuthor(b.author), normalizeTitle(b.title), id)
+		if err != nil {
+			return c, err
+		}
+		if err = saveNameWords(tx, id, normalizeAuthor(b.author), normalizeTitle(b.title)); err != nil {
+			return c, err
+		}
+		c.renamed++
+	}
+	if err = tx.Commit(); err != nil {
+		return c, err
+	}
+	// renaming gives a book its author's own author_norm again
+	c.authors, err = resolveAuthors(ctx, db)
+	return c, err
+}
+
+// recordListedNames records as source's the titles and authors query gives
+// books, by id.
+func recordListedNames(ctx context.Context, tx *sql.Tx, source, query string) error {
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	type named struct {
+		id            int64
+		title, author string
+	}
+	var listed []named
+	for rows.Next() {
+		var n named
+		if err = rows.Scan(&n.id, &n.title, &n.author); err != nil {
+			rows.Close()
+			return err
+		}
+		listed = append(listed, n)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, n := range listed {
+		author := n.author
+		// the catalog's are "Austen, Jane", where GUTINDEX.ALL's are as
+		// headers give them
+		if source == nameCatalog {
+			author = catalogName(author)
+		}
+		for _, f := range [][2]string{{"title", n.title}, {"author", author}} {
+			if f[1] == "" {
+				continue
+			}
+			if _, err = tx.ExecContext(ctx, upsertNameSource, n.id, f[0], source, f[1]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func nameRank(source string) int {
+	for i, s := range nameSources {
+		if s.name == source {
+			return i
+		}
+	}
+	return len(nameSources)
+}
+
+// nameConflict is a book whose header and catalog disagree about a field.
+type nameConflict struct {
+	id, ebook       int64
+	field           string
+	header, catalog string
+	agreement       float64
+}
+
+// findNameConflicts lists the books without meta names whose header and
+// catalog agree on their title or author less than threshold, by book.
+func findNameConflicts(db *sql.DB, threshold float64) ([]nameConflict, error) {
+	rows, err := db.Query(`SELECT f.id, coalesce(f.ebook, 0), h.field, h.value, c.value
+		FROM name_sources h
+		JOIN name_sources c ON c.file_id = h.file_id AND c.field = h.field AND c.source = ?
+		JOIN files f ON f.id = h.file_id
+		WHERE h.source = ? AND f.deleted_at IS NULL
+			AND NOT EXISTS (SELECT 1 FROM name_sources m WHERE m.file_id = h.file_id AND m.field = h.field AND m.source = ?)
+		ORDER BY f.id, h.field DESC`, nameCatalog, nameHeader, nameMeta)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []nameConflict
+	for rows.Next() {
+		var nc nameConflict
+		if err = rows.Scan(&nc.id, &nc.ebook, &nc.field, &nc.header, &nc.catalog); err != nil {
+			return nil, err
+		}
+		if nc.field == "title" {
+			nc.agreement = titleAgreement(nc.header, nc.catalog)
+		} else {
+			nc.agreement = authorAgreement(nc.header, nc.catalog)
+		}
+		if nc.agreement < threshold {
+			out = append(out, nc)
+		}
+	}
+	return out, rows.Err()
+}
+
+// settleNames writes the names source gives book id as its meta ones.
+func settleNames(db *sql.DB, id int64, source string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err = settleNamesIn(tx, id, source); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// settleNamesIn is settleNames in tx.
+func settleNamesIn(tx *sql.Tx, id int64, source string) error {
+	res, err := tx.Exec(`INSERT INTO name_sources (file_id, field, source, value, updated_at)
+		SELECT file_id, field, ?, value, datetime('now') FROM name_sources WHERE file_id = ? AND source = ?
+		ON CONFLICT (file_id, field, source) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at`,
+		nameMeta, id, source)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("book %d has no %s title or author", id, source)
+	}
+	// a sidecar, so reparse-headers leaves the names alone as it does
+	// others' imported by meta import
+	_, err = tx.Exec(sidecarRow, id)
+	return err
+}
+
+// makes a book a sidecar, if it isn't, so that reparse-headers keeps the
+// meta names written for it outside meta import
+const sidecarRow = "INSERT INTO book_meta (file_id, updated_at) VALUES (?, datetime('now')) ON CONFLICT (file_id) DO NOTHING"
+
+// setMetaTitle gives book id title as its meta title, shown from then on
+// over its header's and the catalog's, its author left to the sources it
+// has.
+func setMetaTitle(tx *sql.Tx, id int64, title string) error {
+	var authorNorm string
+	err := tx.QueryRow("SELECT coalesce(author_norm, '') FROM files WHERE id = ? AND deleted_at IS NULL", id).Scan(&authorNorm)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errNoBook
+	}
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec("UPDATE files SET name = ?, title_norm = ?, title_source = ? WHERE id = ?", title, normalizeTitle(title), nameMeta, id); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(upsertNameSource, id, "title", nameMeta, title); err != nil {
+		return err
+	}
+	if err = saveNameWords(tx, id, authorNorm, normalizeTitle(title)); err != nil {
+		return err
+	}
+	_, err = tx.Exec(sidecarRow, id)
+	return err
+}
+
+func metadataConflictsCmd(args []string) error {
+	fs := flag.NewFlagSet("metadata-conflicts", flag.ExitOnError)
+	threshold := fs.Float64("threshold", 0.5, "list titles or authors sharing less than this share of their words, from 0 to 1")
+	book := fs.Int64("book", 0, "instead, list every title and author this book has been given, by source")
+	resolve := fs.Int64("resolve", 0, "settle this book's conflict with --use, writing its names as meta ones")
+	use := fs.String("use", "", "with --resolve, the source whose names to keep: catalog, gutindex or header")
+	fs.Parse(args)
+
+	if *threshold < 0 || *threshold > 1 {
+		return usagef("--threshold must be between 0 and 1")
+	}
+	if (*resolve != 0) != (*use != "") {
+		return usagef("--resolve and --use go together")
+	}
+	if *use != "" && *use != nameCatalog && *use != nameGutindex && *use != nameHeader {
+		return usagef("--use must be catalog, gutindex or header")
+	}
+	if *book != 0 && *resolve != 0 {
+		return usagef("--book and --resolve don't go together")
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	if _, err = resolveNames(ctx, db); err != nil {
+		return fmt.Errorf("could not choose books' names: %w", err)
+	}
+
+	switch {
+	case *book != 0:
+		return printNameSources(db, *book)
+	case *resolve != 0:
+		if err = settleNames(db, *resolve, *use); err != nil {
+			return err
+		}
+		if _, err = resolveNames(ctx, db); err != nil {
+			return fmt.Errorf("could not choose books' names: %w", err)
+		}
+		return printNameSources(db, *resolve)
+	}
+
+	conflicts, err := findNameConflicts(db, *threshold)
+	if err != nil {
+		return err
+	}
+	books := map[int64]bool{}
+	for _, nc := range conflicts {
+		books[nc.id] = true
+		ebook := "no ebook"
+		if nc.ebook != 0 {
+			ebook = "ebook " + strconv.FormatInt(nc.ebook, 10)
+		}
+		fmt.Printf("book %d (%s): %s %.2f alike: header %q, catalog %q\n", nc.id, ebook, nc.field, nc.agreement,
+			clip(nc.header, 60), clip(nc.catalog, 60))
+	}
+	fmt.Printf("%d books whose header and catalog disagree; see one with --book, settle it with --resolve and --use\n", len(books))
+	return nil
+}
+
+// printNameSources lists every title and author book id has been given,
+// the one shown first.
+func printNameSources(db *sql.DB, id int64) error {
+	var title, author, titleSource, authorSource string
+	err := db.QueryRow("SELECT coalesce(name, ''), coalesce(author, ''), coalesce(title_source, ''), coalesce(author_source, '') FROM files WHERE id = ?", id).
+		Scan(&title, &author, &titleSource, &authorSource)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no book %d", id)
+	}
+	if err != nil {
+		return err
+	}
+	rows, err := db.Query("SELECT field, source, value FROM name_sources WHERE file_id = ?", id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	type given struct{ field, source, value string }
+	var all []given
+	for rows.Next() {
+		var g given
+		if err = rows.Scan(&g.field, &g.source, &g.value); err != nil {
+			return err
+		}
+		all = append(all, g)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].field != all[j].field {
+			return all[i].field > all[j].field
+		}
+		return nameRank(all[i].source) < nameRank(all[j].source)
+	})
+	fmt.Printf("book %d: %q by %q\n", id, title, author)
+	for _, g := range all {
+		mark := " "
+		if g.field == "title" && g.source == titleSource || g.field == "author" && g.source == authorSource {
+			mark = "*"
+		}
+		fmt.Printf("%s %-6s %-8s %-13s %q\n", mark, g.field, g.source, nameConfidence(g.source), g.value)
+	}
+	return nil
+}
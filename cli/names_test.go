@@ -0,0 +1,231 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+func TestCatalogName(t *testing.T) {
+	for in, want := range map[string]string{
+		"Austen, Jane":           "Jane Austen",
+		"Tolstoy, Leo, graf":     "Leo Tolstoy",
+		"Homer":                  "Homer",
+		"Shakespeare, 1564-1616": "Shakespeare",
+		" Plato ":                "Plato",
+	} {
+		if got := catalogName(in); got != want {
+			t.Errorf("catalogName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestNameAgreement(t *testing.T) {
+	for _, c := range []struct {
+		a, b   string
+		author bool
+		want   float64
+	}{
+		// a subtitle isn't a disagreement
+		{"Frankenstein", "Frankenstein; Or, The Modern Prometheus", false, 1},
+		{"Moby Dick, or The Whale", "Moby-Dick", false, 1},
+		{"Dracula: A Novel", "DRACULA", false, 1},
+		{"Les Misérables", "Les Miserables", false, 1},
+		{"Pride and Prejudice", "Emma", false, 0},
+		{"The Works of Shakespeare", "The Complete Works of Milton", false, 0.75},
+		// nor an author's order, initials or dates
+		{"M. Twain", "Twain, Mark", true, 1},
+		{"Jane Austen", "Austen, Jane, 1775-1817", true, 1},
+		{"Charlotte Brontë", "Bronte, Emily", true, 0.5},
+		{"Anonymous", "Defoe, Daniel", true, 0},
+	} {
+		got := titleAgreement(c.a, c.b)
+		if c.author {
+			got = authorAgreement(c.a, c.b)
+		}
+		if got != c.want {
+			t.Errorf("%q and %q agree %.2f, want %.2f", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+// namedBooks is four books as their headers name them, three listed in
+// the catalog and one of those in GUTINDEX.ALL, and the fourth only in
+// GUTINDEX.ALL.
+func namedBooks(t *testing.T) *sql.DB {
+	t.Helper()
+	db := testDB(t)
+	for _, b := range []struct {
+		ebook                         int
+		title, author                 string
+		catalogTitle, catalogAuthor   string
+		gutindexTitle, gutindexAuthor string
+	}{
+		{84, "Frankenstein", "Mary Shelley", "Frankenstein; Or, The Modern Prometheus", "Shelley, Mary Wollstonecraft", "", ""},
+		{1342, "Pride & Prejudice", "J. Austen", "Emma", "Austen, Jane", "Pride and Prejudice", "Jane Austen"},
+		{76, "Huckleberry Finn and Tom", "Anonymous", "Adventures of Huckleberry Finn", "Twain, Mark", "", ""},
+		{11, "Alice", "L. Carroll", "", "", "Alice's Adventures in Wonderland", "Lewis Carroll"},
+	} {
+		id := addBook(t, db, b.title, b.author, "")
+		if _, err := db.Exec("UPDATE files SET ebook = ? WHERE id = ?", b.ebook, id); err != nil {
+			t.Fatal(err)
+		}
+		if b.catalogTitle != "" {
+			if _, err := db.Exec("INSERT INTO catalog (ebook, title, author) VALUES (?, ?, ?)", b.ebook, b.catalogTitle, b.catalogAuthor); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if b.gutindexTitle != "" {
+			if _, err := db.Exec("INSERT INTO gutindex (ebook, title, author) VALUES (?, ?, ?)", b.ebook, b.gutindexTitle, b.gutindexAuthor); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return db
+}
+
+// shownNames is each book's title and author as files shows them, with
+// their sources.
+func shownNames(t *testing.T, db *sql.DB) []string {
+	t.Helper()
+	rows, err := db.Query("SELECT name || ' / ' || author || ' (' || coalesce(title_source, '') || ', ' || coalesce(author_source, '') || ')' FROM files ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got []string
+	for rows.Next() {
+		var s string
+		if err = rows.Scan(&s); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, s)
+	}
+	return got
+}
+
+func TestResolveNames(t *testing.T) {
+	db := namedBooks(t)
+	ctx := context.Background()
+	c, err := resolveNames(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.catalog != 3 || c.gutindex != 1 || c.header != 0 || c.renamed != 4 {
+		t.Errorf("resolving counted %+v", c)
+	}
+	want := []string{
+		"Frankenstein; Or, The Modern Prometheus / Mary Wollstonecraft Shelley (catalog, catalog)",
+		"Emma / Jane Austen (catalog, catalog)",
+		"Adventures of Huckleberry Finn / Mark Twain (catalog, catalog)",
+		"Alice's Adventures in Wonderland / Lewis Carroll (gutindex, gutindex)",
+	}
+	if got := shownNames(t, db); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("resolved, the books are shown as\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	// the header's are kept, and the shown names are found from then on
+	var n int
+	if err = db.QueryRow("SELECT count(*) FROM name_sources WHERE source = 'header'").Scan(&n); err != nil || n != 8 {
+		t.Errorf("%d header names are kept (%v)", n, err)
+	}
+	if matches, err := searchBooks(db, "modern prometheus", 0); err != nil || len(matches) != 1 || matches[0].ID != 1 {
+		t.Errorf("searching by the catalog's title found %+v (%v)", matches, err)
+	}
+
+	// meta's title goes over the catalog's; the author is still the
+	// catalog's
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = setMetaTitle(tx, 2, "Pride and Prejudice"); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if c, err = resolveNames(ctx, db); err != nil || c.meta != 1 || c.renamed != 0 {
+		t.Errorf("resolving again counted %+v (%v)", c, err)
+	}
+	if got := shownNames(t, db)[1]; got != "Pride and Prejudice / Jane Austen (meta, catalog)" {
+		t.Errorf("with a meta title, book 2 is shown as %q", got)
+	}
+
+	// the catalog changing its mind renames the book
+	if _, err = db.Exec("UPDATE catalog SET title = 'Huckleberry Finn, Tom Sawyer''s Comrade' WHERE ebook = 76"); err != nil {
+		t.Fatal(err)
+	}
+	if c, err = resolveNames(ctx, db); err != nil || c.renamed != 1 {
+		t.Errorf("resolving after the catalog changed counted %+v (%v)", c, err)
+	}
+	if got := shownNames(t, db)[2]; !strings.HasPrefix(got, "Huckleberry Finn, Tom Sawyer's Comrade / ") {
+		t.Errorf("the catalog changed, book 3 is shown as %q", got)
+	}
+}
+
+func TestMetadataConflicts(t *testing.T) {
+	namedBooks(t)
+	run := func(args ...string) string {
+		t.Helper()
+		out, err := captureStdout(t, func() error { return metadataConflictsCmd(args) })
+		if err != nil {
+			t.Fatalf("metadata-conflicts %s: %v", strings.Join(args, " "), err)
+		}
+		return out
+	}
+
+	// Frankenstein's subtitle and Mary Shelley's middle name aren't
+	// conflicts, nor is Alice with no catalog record
+	out := run()
+	for _, want := range []string{
+		`book 2 (ebook 1342): title 0.00 alike: header "Pride & Prejudice", catalog "Emma"`,
+		`book 3 (ebook 76): author 0.00 alike: header "Anonymous", catalog "Mark Twain"`,
+		"\n2 books whose header and catalog disagree",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metadata-conflicts printed\n%s\nwant %q", out, want)
+		}
+	}
+	if strings.Contains(out, "book 1 ") || strings.Contains(out, "book 4 ") || strings.Contains(out, "book 2 (ebook 1342): author") {
+		t.Errorf("metadata-conflicts printed books that agree:\n%s", out)
+	}
+	if out = run("--threshold", "0"); !strings.HasPrefix(out, "0 books") {
+		t.Errorf("metadata-conflicts --threshold 0 printed\n%s", out)
+	}
+	// agreeing wholly is never a conflict
+	if out = run("--threshold", "1"); !strings.Contains(out, "\n2 books") || !strings.Contains(out, `book 3 (ebook 76): title 0.50 alike`) || strings.Contains(out, "book 1 ") {
+		t.Errorf("metadata-conflicts --threshold 1 printed\n%s", out)
+	}
+
+	out = run("--book", "2")
+	for _, want := range []string{
+		`book 2: "Emma" by "Jane Austen"`,
+		`* title  catalog  high          "Emma"`,
+		`  title  gutindex medium        "Pride and Prejudice"`,
+		`  title  header   low           "Pride & Prejudice"`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metadata-conflicts --book 2 printed\n%s\nwant %q", out, want)
+		}
+	}
+
+	// settled, the header's names are meta's, and shown over the catalog's
+	out = run("--resolve", "2", "--use", "header")
+	if !strings.Contains(out, `book 2: "Pride & Prejudice" by "J. Austen"`) || !strings.Contains(out, `* title  meta     authoritative "Pride & Prejudice"`) {
+		t.Errorf("metadata-conflicts --resolve printed\n%s", out)
+	}
+	if out = run(); strings.Contains(out, "book 2 ") || !strings.Contains(out, "\n1 books") {
+		t.Errorf("settled, metadata-conflicts printed\n%s", out)
+	}
+
+	for _, args := range [][]string{{"--threshold", "2"}, {"--resolve", "2"}, {"--use", "catalog"}, {"--resolve", "2", "--use", "meta"}, {"--book", "1", "--resolve", "2", "--use", "header"}} {
+		if _, err := captureStdout(t, func() error { return metadataConflictsCmd(args) }); exitCode(err) != exitUsage {
+			t.Errorf("metadata-conflicts %s: %v, want a usage error", strings.Join(args, " "), err)
+		}
+	}
+	if _, err := captureStdout(t, func() error { return metadataConflictsCmd([]string{"--resolve", "4", "--use", "catalog"}) }); err == nil ||
+		!strings.Contains(err.Error(), "book 4 has no catalog title or author") {
+		t.Errorf("settling book 4 by the catalog it isn't in: %v", err)
+	}
+}
@@ -0,0 +1,254 @@
+package cli
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	// words per shingle
+	shingleWords = 5
+	// signature length, as lshBands bands of lshRows values. Pairs agreeing
+	// on about 40% of their shingles or more are likely to share a band.
+	lshBands  = 32
+	lshRows   = 4
+	sigLength = lshBands * lshRows
+)
+
+// minhashSeeds are the multipliers and offsets of the signature's hash
+// functions. They are fixed so signatures are comparable between runs.
+var minhashSeeds = func() [sigLength][2]uint64 {
+	var s [sigLength][2]uint64
+	r := rand.New(rand.NewSource(1))
+	for i := range s {
+		s[i] = [2]uint64{r.Uint64() | 1, r.Uint64()}
+	}
+	return s
+}()
+
+type signature [sigLength]uint32
+
+// minhash signs the body of a book: for each hash function, the least hash
+// of any run of shingleWords words, lowercased with punctuation dropped so
+// OCR fixes to it don't count. Books too short for a shingle return false.
+func minhash(content string) (signature, bool) {
+	var sig signature
+	for i := range sig {
+		sig[i] = ^uint32(0)
+	}
+
+	lines, _ := bookBody(content, false)
+	if lines == nil {
+		lines, _ = bookBody(content, true)
+	}
+	window := make([]string, 0, shingleWords)
+	shingles := 0
+	h := fnv.New64a()
+	for _, line := range lines {
+		for _, w := range strings.FieldsFunc(strings.ToLower(line), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+		}) {
+			if len(window) == shingleWords {
+				window = append(window[:0], window[1:]...)
+			}
+			window = append(window, w)
+			if len(window) < shingleWords {
+				continue
+			}
+			h.Reset()
+			h.Write([]byte(strings.Join(window, " ")))
+			base := h.Sum64()
+			for i, s := range minhashSeeds {
+				if v := uint32((base*s[0] + s[1]) >> 32); v < sig[i] {
+					sig[i] = v
+				}
+			}
+			shingles++
+		}
+	}
+	return sig, shingles > 0
+}
+
+// similarity estimates the Jaccard similarity of the shingles behind two
+// signatures as the share of hash functions they agree on.
+func similarity(a, b *signature) float64 {
+	same := 0
+	for i := range a {
+		if a[i] == b[i] {
+			same++
+		}
+	}
+	return float64(same) / sigLength
+}
+
+type dupeBook struct {
+	id, ebook, edition int
+	title              string
+}
+
+// newer reports whether b is a later release than o: a higher ebook
+// number, then a later etext edition, then ingested later.
+func (b dupeBook) newer(o dupeBook) bool {
+	if b.ebook != o.ebook {
+		return b.ebook > o.ebook
+	}
+	if b.edition != o.edition {
+		return b.edition > o.edition
+	}
+	return b.id > o.id
+}
+
+type dupePair struct {
+	a, b       dupeBook
+	similarity float64
+}
+
+// keep returns the book of the pair --prefer newest-edition keeps, then
+// the one it suppresses.
+func (p dupePair) keep() (dupeBook, dupeBook) {
+	if p.b.newer(p.a) {
+		return p.b, p.a
+	}
+	return p.a, p.b
+}
+
+func nearDupesCmd(args []string) error {
+	fs := flag.NewFlagSet("near-dupes", flag.ExitOnError)
+	threshold := fs.Float64("threshold", 0.9, "least estimated similarity, from 0 to 1, for two books to count as duplicates")
+	prefer := fs.String("prefer", "", "suppress one book of each pair: newest-edition keeps the latest release")
+	fs.Parse(args)
+
+	if *threshold <= 0 || *threshold > 1 {
+		return usagef("--threshold must be above 0 and at most 1")
+	}
+	if *prefer != "" && *prefer != "newest-edition" {
+		return usagef("unknown --prefer %q", *prefer)
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	pairs, books, err := nearDupes(db, *threshold)
+	if err != nil {
+		return err
+	}
+	if err = saveSimilarities(db, pairs, *prefer != ""); err != nil {
+		return err
+	}
+
+	for _, p := range pairs {
+		fmt.Printf("%.3f  %d %s (ebook %d)  ~  %d %s (ebook %d)\n", p.similarity,
+			p.a.id, p.a.title, p.a.ebook, p.b.id, p.b.title, p.b.ebook)
+		if *prefer != "" {
+			keep, drop := p.keep()
+			fmt.Printf("       suppressed %d in favor of %d\n", drop.id, keep.id)
+		}
+	}
+	fmt.Printf("signed %d books, %d suspected duplicate pairs at %.2f\n", books, len(pairs), *threshold)
+	return nil
+}
+
+// nearDupes signs every book, reading one at a time, and returns the pairs
+// whose signatures agree on at least threshold of their values, best first,
+// along with the number of books signed.
+func nearDupes(db *sql.DB, threshold float64) ([]dupePair, int, error) {
+	rows, err := db.Query("SELECT id, coalesce(ebook, 0), coalesce(edition, 0), coalesce(name, ''), coalesce(" + contentCol("") + ", '') FROM files WHERE deleted_at IS NULL ORDER BY id")
+	if err != nil {
+		return nil, 0, err
+	}
+	books := []dupeBook{}
+	sigs := []signature{}
+	for rows.Next() {
+		var b dupeBook
+		var content string
+		if err = rows.Scan(&b.id, &b.ebook, &b.edition, &b.title, &content); err != nil {
+			rows.Close()
+			return nil, 0, err
+		}
+		sig, ok := minhash(content)
+		if !ok {
+			continue
+		}
+		books = append(books, b)
+		sigs = append(sigs, sig)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	// books sharing every value of some band are candidates
+	seen := map[[2]int]bool{}
+	pairs := []dupePair{}
+	for band := 0; band < lshBands; band++ {
+		buckets := map[[lshRows]uint32][]int{}
+		for i := range sigs {
+			var key [lshRows]uint32
+			copy(key[:], sigs[i][band*lshRows:])
+			buckets[key] = append(buckets[key], i)
+		}
+		for _, bucket := range buckets {
+			for x := 0; x < len(bucket); x++ {
+				for _, j := range bucket[x+1:] {
+					i := bucket[x]
+					if seen[[2]int{i, j}] {
+						continue
+					}
+					seen[[2]int{i, j}] = true
+					if s := similarity(&sigs[i], &sigs[j]); s >= threshold {
+						pairs = append(pairs, dupePair{books[i], books[j], s})
+					}
+				}
+			}
+		}
+	}
+
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].similarity != pairs[j].similarity {
+			return pairs[i].similarity > pairs[j].similarity
+		}
+		if pairs[i].a.id != pairs[j].a.id {
+			return pairs[i].a.id < pairs[j].a.id
+		}
+		return pairs[i].b.id < pairs[j].b.id
+	})
+	return pairs, len(books), nil
+}
+
+// saveSimilarities replaces book_similarities with pairs and, with
+// suppress, suppresses the older book of each.
+func saveSimilarities(db *sql.DB, pairs []dupePair, suppress bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("DELETE FROM book_similarities"); err != nil {
+		return err
+	}
+	for _, p := range pairs {
+		_, err = tx.Exec("INSERT INTO book_similarities (a, b, similarity, created_at) VALUES (?, ?, ?, datetime('now'))",
+			p.a.id, p.b.id, p.similarity)
+		if err != nil {
+			return err
+		}
+		if !suppress {
+			continue
+		}
+		keep, drop := p.keep()
+		if _, err = tx.Exec("UPDATE files SET suppressed_by = ? WHERE id = ?", keep.id, drop.id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
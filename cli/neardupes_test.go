@@ -0,0 +1,133 @@
+package cli
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// proseWords are what randomProse makes its sentences of.
+var proseWords = strings.Fields(`the a of and to in was he she it that his her with as on at by from
+	had not but they were been which one all would there their said what so out up into over
+	who them then could more some time when very old house road field river hill door window
+	morning evening letter horse carriage garden kitchen table candle fire winter summer
+	spring autumn rain snow wind cloud stone bridge church market village town city ship
+	harbour sailor captain doctor lawyer parson widow daughter son father mother brother
+	sister uncle aunt cousin friend stranger servant master mistress walked ran spoke
+	wrote read heard saw felt thought knew came went stood sat lay rose fell laughed cried
+	quiet loud bright dark cold warm long short narrow broad green grey red white black`)
+
+// randomProse is sentences of made up prose, the same for the same seed,
+// with no run of words in common with another seed's to speak of.
+func randomProse(seed int64, sentences int) []string {
+	r := rand.New(rand.NewSource(seed))
+	out := make([]string, sentences)
+	for i := range out {
+		words := make([]string, 8+r.Intn(6))
+		for j := range words {
+			words[j] = proseWords[r.Intn(len(proseWords))]
+		}
+		out[i] = strings.ToUpper(words[0][:1]) + strings.Join(words, " ")[1:] + "."
+	}
+	return out
+}
+
+func proseBook(title string, sentences []string) string {
+	var paras []string
+	for i := 0; i < len(sentences); i += 10 {
+		end := i + 10
+		if end > len(sentences) {
+			end = len(sentences)
+		}
+		paras = append(paras, strings.Join(sentences[i:end], " "))
+	}
+	return testBook(title, strings.Join(paras, "\n\n"))
+}
+
+func TestNearDupes(t *testing.T) {
+	db := testDB(t)
+	original := randomProse(1, 200)
+	revised := append([]string(nil), original...)
+	revised[40] = "The printer's errors were put right in this edition."
+	revised[120] = "A sentence was added here by the new editor."
+	first := addBook(t, db, "The Mill", "Someone", proseBook("The Mill", original))
+	second := addBook(t, db, "The Mill, revised", "Someone", proseBook("The Mill", revised))
+	addBook(t, db, "The Harbour", "Someone Else", proseBook("The Harbour", randomProse(2, 200)))
+	addBook(t, db, "The Hill", "Another", proseBook("The Hill", randomProse(3, 200)))
+	if _, err := db.Exec("UPDATE files SET ebook = id + 100"); err != nil {
+		t.Fatal(err)
+	}
+
+	pairs, signed, err := nearDupes(db, 0.9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signed != 4 {
+		t.Errorf("signed %d books, want 4", signed)
+	}
+	if len(pairs) != 1 || pairs[0].a.id != first || pairs[0].b.id != second {
+		t.Fatalf("pairs %+v, want the two editions of The Mill alone", pairs)
+	}
+	if s := pairs[0].similarity; s < 0.9 || s == 1 {
+		t.Errorf("the editions are %.3f alike, want near but not 1", s)
+	}
+
+	// the unrelated books share next to nothing
+	sigs := make([]signature, 3)
+	for i, seed := range []int64{1, 2, 3} {
+		var ok bool
+		if sigs[i], ok = minhash(proseBook("", randomProse(seed, 200))); !ok {
+			t.Fatal("no signature of a book of 200 sentences")
+		}
+	}
+	for _, p := range [][2]int{{0, 1}, {0, 2}, {1, 2}} {
+		if s := similarity(&sigs[p[0]], &sigs[p[1]]); s > 0.1 {
+			t.Errorf("unrelated books %v are %.3f alike", p, s)
+		}
+	}
+
+	if err = saveSimilarities(db, pairs, true); err != nil {
+		t.Fatal(err)
+	}
+	var suppressed, by int
+	if err = db.QueryRow("SELECT id, suppressed_by FROM files WHERE suppressed_by IS NOT NULL").Scan(&suppressed, &by); err != nil {
+		t.Fatal(err)
+	}
+	if suppressed != first || by != second {
+		t.Errorf("book %d was suppressed in favor of %d, want the older, %d, in favor of %d", suppressed, by, first, second)
+	}
+	var recorded int
+	if err = db.QueryRow("SELECT count(*) FROM book_similarities").Scan(&recorded); err != nil {
+		t.Fatal(err)
+	}
+	if recorded != 1 {
+		t.Errorf("%d similarities recorded, want 1", recorded)
+	}
+}
+
+func TestMinhashShort(t *testing.T) {
+	if _, ok := minhash(testBook("Short", "Too few words.")); ok {
+		t.Error("a book of fewer words than a shingle was signed")
+	}
+	// punctuation and case are left out of the shingles
+	a, _ := minhash(proseBook("", randomProse(4, 50)))
+	b, _ := minhash(strings.ToUpper(strings.ReplaceAll(proseBook("", randomProse(4, 50)), ".", ";")))
+	if similarity(&a, &b) != 1 {
+		t.Error("a book and its copy in capitals with other punctuation are signed apart")
+	}
+}
+
+func TestDupeKeep(t *testing.T) {
+	for _, c := range []struct {
+		a, b dupeBook
+		keep int
+	}{
+		{dupeBook{id: 1, ebook: 100}, dupeBook{id: 2, ebook: 99}, 1},
+		{dupeBook{id: 1, ebook: 100, edition: 11}, dupeBook{id: 2, ebook: 100, edition: 10}, 1},
+		{dupeBook{id: 1, ebook: 100, edition: 10}, dupeBook{id: 2, ebook: 100, edition: 10}, 2},
+	} {
+		if keep, _ := (dupePair{a: c.a, b: c.b}).keep(); keep.id != c.keep {
+			t.Errorf("of %+v and %+v kept %d, want %d", c.a, c.b, keep.id, c.keep)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !sqlcipher
+
+package cli
+
+import "errors"
+
+func sqliteDriver(key string) (string, error) {
+	if key != "" {
+		return "", errors.New("a database key was given but gutchunk was not compiled with encryption support (rebuild with -tags \"sqlcipher libsqlite3\")")
+	}
+	return "sqlite3", nil
+}
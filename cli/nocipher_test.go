@@ -0,0 +1,22 @@
+//go:build !sqlcipher
+
+package cli
+
+import (
+	"strings"
+	"testing"
+)
+
+// Without the tag a key is refused rather than ignored, which would leave
+// the database unencrypted.
+func TestKeyNeedsCipher(t *testing.T) {
+	t.Setenv("GUTCHUNK_DB_KEY", "correct horse")
+	s, err := openDB()
+	if err == nil {
+		s.Close()
+		t.Fatal("opened a database with a key, built without encryption")
+	}
+	if !strings.Contains(err.Error(), "sqlcipher") {
+		t.Errorf("error %q doesn't say to build with the sqlcipher tag", err)
+	}
+}
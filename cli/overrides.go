@@ -0,0 +1,539 @@
+package cli
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// An overrides file sets chunker options for the few books the defaults
+// get wrong, as tables keyed by ebook number or by filename:
+//
+//	[ebook.2701]
+//	start = '^CHAPTER 1\. Loomings'
+//	skip-lines = 4
+//
+//	[file."poems.txt"]
+//	disable = ["scene-breaks"]
+//
+//	[ebook.10]
+//	start-at = "GENESIS"
+//	end-line = 4120
+//
+//	[ebook.3166]
+//	series = "Chronicles of Barsetshire"
+//	series-position = 1
+//
+// series and series-position aren't chunker options but a book's place in
+// a series, which gutchunk series load keeps (see series.go); chunk
+// passes over them.
+//
+// It is read as a small part of TOML: tables, and strings, integers,
+// booleans and arrays of strings on one line each. A key or table it
+// doesn't know is an error, so a typo can't quietly leave a book as it was.
+
+// bookOverride is what an overrides file sets for one book.
+type bookOverride struct {
+	// the table it came from, like "ebook.2701", and its keys, in order
+	name string
+	keys []string
+
+	start, end *regexp.Regexp
+	// the lines the body starts at and ends before, by number or by a
+	// string only one line of the book has; 0 and "" for none
+	startLine, endLine int
+	startAt, endAt     string
+	skipLines          int
+	minChunk           int
+	bodyOnly           *bool
+	stripRefs          *bool
+	strictFooter       *bool
+	disable            map[string]bool
+	// the series the book is in and its place there, 0 for none
+	series         string
+	seriesPosition int
+}
+
+// the cleaners disable may name
+var overridableCleaners = map[string]bool{"footnotes": true, "footer": true, "scene-breaks": true}
+
+// overrides is a loaded overrides file. It also collects the books it was
+// applied to, to list once chunking is done, and is safe to share between
+// workers. A nil *overrides changes nothing.
+type overrides struct {
+	ebooks map[int]*bookOverride
+	files  map[string]*bookOverride
+	// a hash of the file's lines, for a reload to tell whether it changed
+	hash string
+
+	mu      sync.Mutex
+	applied []string
+}
+
+var overrideTable = regexp.MustCompile(`^\[\s*(ebook|file)\s*\.\s*(.+?)\s*\]\s*(#.*)?$`)
+
+// loadOverrides reads the overrides file at path.
+func loadOverrides(path string) (*overrides, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read overrides: %w", err)
+	}
+	defer f.Close()
+
+	o := &overrides{ebooks: map[int]*bookOverride{}, files: map[string]*bookOverride{}}
+	var cur *bookOverride
+	var text strings.Builder
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		text.WriteString(s.Text() + "\n")
+		fail := func(format string, args ...interface{}) error {
+			return fmt.Errorf("%s:%d: %s", path, n, fmt.Sprintf(format, args...))
+		}
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			m := overrideTable.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fail("unknown table %s; want [ebook.N] or [file.\"name\"]", line)
+			}
+			cur = &bookOverride{name: m[1] + "." + m[2], disable: map[string]bool{}}
+			if m[1] == "ebook" {
+				ebook, err := strconv.Atoi(m[2])
+				if err != nil || ebook < 1 {
+					return nil, fail("bad ebook number %s", m[2])
+				}
+				if o.ebooks[ebook] != nil {
+					return nil, fail("ebook %d is already overridden", ebook)
+				}
+				o.ebooks[ebook] = cur
+			} else {
+				name := m[2]
+				if strings.HasPrefix(name, `"`) || strings.HasPrefix(name, "'") {
+					v, rest, err := tomlString(name)
+					if err != nil || rest != "" {
+						return nil, fail("bad filename %s", name)
+					}
+					name = v
+				}
+				if o.files[name] != nil {
+					return nil, fail("file %q is already overridden", name)
+				}
+				o.files[name] = cur
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fail("want key = value")
+		}
+		key = strings.TrimSpace(key)
+		if cur == nil {
+			return nil, fail("%s is outside any [ebook.N] or [file.\"name\"] table", key)
+		}
+		for _, k := range cur.keys {
+			if k == key {
+				return nil, fail("%s is set twice", key)
+			}
+		}
+		if err := cur.set(key, strings.TrimSpace(value)); err != nil {
+			return nil, fail("%s: %v", key, err)
+		}
+		cur.keys = append(cur.keys, key)
+	}
+	if err = s.Err(); err != nil {
+		return nil, fmt.Errorf("could not read overrides: %w", err)
+	}
+	all := []*bookOverride{}
+	for _, x := range o.ebooks {
+		all = append(all, x)
+	}
+	for _, x := range o.files {
+		all = append(all, x)
+	}
+	for _, x := range all {
+		if x.seriesPosition > 0 && x.series == "" {
+			return nil, fmt.Errorf("%s: %s: series-position needs series", path, x.name)
+		}
+	}
+	o.hash = textHash(text.String())
+	return o, nil
+}
+
+// count is how many books o overrides.
+func (o *overrides) count() int {
+	if o == nil {
+		return 0
+	}
+	return len(o.ebooks) + len(o.files)
+}
+
+// set sets key from its TOML value.
+func (b *bookOverride) set(key, value string) error {
+	switch key {
+	case "start", "end":
+		v, err := tomlStringValue(value)
+		if err != nil {
+			return err
+		}
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return err
+		}
+		if key == "start" {
+			b.start = re
+		} else {
+			b.end = re
+		}
+	case "start-line", "end-line":
+		n, err := strconv.Atoi(stripComment(value))
+		if err != nil || n < 1 {
+			return fmt.Errorf("want a line number, not %s", value)
+		}
+		if key == "start-line" {
+			b.startLine = n
+		} else {
+			b.endLine = n
+		}
+	case "start-at", "end-at":
+		v, err := tomlStringValue(value)
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(v) == "" {
+			return fmt.Errorf("want some text to find")
+		}
+		if key == "start-at" {
+			b.startAt = strings.TrimSpace(v)
+		} else {
+			b.endAt = strings.TrimSpace(v)
+		}
+	case "skip-lines", "min-chunk":
+		n, err := strconv.Atoi(stripComment(value))
+		if err != nil || n < 0 || key == "min-chunk" && n == 0 {
+			return fmt.Errorf("want a positive number, not %s", value)
+		}
+		if key == "skip-lines" {
+			b.skipLines = n
+		} else {
+			b.minChunk = n
+		}
+	case "body-only", "strip-refs", "strict-footer":
+		word := stripComment(value)
+		if word != "true" && word != "false" {
+			return fmt.Errorf("want true or false, not %s", value)
+		}
+		v := word == "true"
+		switch key {
+		case "body-only":
+			b.bodyOnly = &v
+		case "strip-refs":
+			b.stripRefs = &v
+		default:
+			b.strictFooter = &v
+		}
+	case "series":
+		v, err := tomlStringValue(value)
+		if err != nil {
+			return err
+		}
+		if b.series = strings.Join(strings.Fields(v), " "); b.series == "" {
+			return fmt.Errorf("want the series' name")
+		}
+	case "series-position":
+		n, err := strconv.Atoi(stripComment(value))
+		if err != nil || n < 1 {
+			return fmt.Errorf("want a positive number, not %s", value)
+		}
+		b.seriesPosition = n
+	case "disable":
+		names, err := tomlStrings(value)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if !overridableCleaners[name] {
+				return fmt.Errorf("unknown cleaner %q; want footnotes, footer or scene-breaks", name)
+			}
+			b.disable[name] = true
+		}
+	default:
+		return fmt.Errorf("unknown key; want start, end, start-line, end-line, start-at, end-at, skip-lines, min-chunk, body-only, strip-refs, strict-footer, disable, series or series-position")
+	}
+	for _, same := range [][]string{{"start", "start-line", "start-at"}, {"end", "end-line", "end-at"}} {
+		if err := b.oneOf(key, same); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunks reports whether b sets any of the chunker's options, and not only
+// a series.
+func (b *bookOverride) chunks() bool {
+	for _, k := range b.keys {
+		if k != "series" && k != "series-position" {
+			return true
+		}
+	}
+	return false
+}
+
+// oneOf is an error when key is one of same, keys saying the same thing,
+// and another of them is set already.
+func (b *bookOverride) oneOf(key string, same []string) error {
+	in := func(k string) bool {
+		for _, s := range same {
+			if k == s {
+				return true
+			}
+		}
+		return false
+	}
+	if !in(key) {
+		return nil
+	}
+	for _, k := range b.keys {
+		if in(k) {
+			return fmt.Errorf("%s and %s don't go together", k, key)
+		}
+	}
+	return nil
+}
+
+// stripComment drops a trailing comment from a value holding no strings.
+func stripComment(value string) string {
+	if i := strings.Index(value, "#"); i >= 0 {
+		value = value[:i]
+	}
+	return strings.TrimSpace(value)
+}
+
+// tomlString reads the string value starts with, basic ("...", with
+// escapes) or literal ('...', as it is), returning what follows it.
+func tomlString(value string) (string, string, error) {
+	if strings.HasPrefix(value, "'") {
+		end := strings.Index(value[1:], "'")
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated string")
+		}
+		return value[1 : end+1], strings.TrimSpace(value[end+2:]), nil
+	}
+	if !strings.HasPrefix(value, `"`) {
+		return "", "", fmt.Errorf("want a string, not %s", value)
+	}
+	for i := 1; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			i++
+		case '"':
+			v, err := strconv.Unquote(value[:i+1])
+			if err != nil {
+				return "", "", fmt.Errorf("bad string %s", value[:i+1])
+			}
+			return v, strings.TrimSpace(value[i+1:]), nil
+		}
+	}
+	return "", "", fmt.Errorf("unterminated string")
+}
+
+// tomlStringValue reads a value that is one string.
+func tomlStringValue(value string) (string, error) {
+	v, rest, err := tomlString(value)
+	if err != nil {
+		return "", err
+	}
+	if rest != "" && !strings.HasPrefix(rest, "#") {
+		return "", fmt.Errorf("unexpected %s after the string", rest)
+	}
+	return v, nil
+}
+
+// tomlStrings reads a value that is an array of strings.
+func tomlStrings(value string) ([]string, error) {
+	if !strings.HasPrefix(value, "[") {
+		return nil, fmt.Errorf("want an array of strings, not %s", value)
+	}
+	rest := strings.TrimSpace(value[1:])
+	res := []string{}
+	for !strings.HasPrefix(rest, "]") {
+		v, after, err := tomlString(rest)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+		if strings.HasPrefix(after, ",") {
+			after = strings.TrimSpace(after[1:])
+		} else if !strings.HasPrefix(after, "]") {
+			return nil, fmt.Errorf("want , or ] after %q", v)
+		}
+		rest = after
+	}
+	if rest = strings.TrimSpace(rest[1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+		return nil, fmt.Errorf("unexpected %s after the array", rest)
+	}
+	return res, nil
+}
+
+// find returns the override for b, by ebook number before filename, which
+// matches the stored filename or the last part of it. An upload to serve,
+// stored with neither, is found by the ebook number its header gives.
+func (o *overrides) find(b bookfile) *bookOverride {
+	if o == nil {
+		return nil
+	}
+	ebook := b.Ebook
+	if ebook == 0 && b.Filename == "" {
+		ebook = headerEbookNumber([]byte(b.Content))
+	}
+	if x := o.ebooks[ebook]; ebook != 0 && x != nil {
+		return x
+	}
+	if b.Filename == "" {
+		return nil
+	}
+	if x := o.files[b.Filename]; x != nil {
+		return x
+	}
+	return o.files[filepath.Base(b.Filename)]
+}
+
+// apply returns opts as the override for b, if there is one, changes them,
+// recording that it did in the run's warnings. It is an error for the
+// override to give lines of the body b's content doesn't have.
+func (o *overrides) apply(b bookfile, opts chunkOptions) (chunkOptions, error) {
+	x := o.find(b)
+	if x == nil || !x.chunks() {
+		return opts, nil
+	}
+	var err error
+	if opts.startLine, opts.endLine, err = x.bodyLines(b.Content); err != nil {
+		return opts, fmt.Errorf("override %s: %w", x.name, err)
+	}
+	if x.start != nil {
+		opts.start = x.start
+	}
+	if x.end != nil {
+		opts.end = x.end
+	}
+	if x.skipLines > 0 {
+		opts.skipLines = x.skipLines
+	}
+	if x.minChunk > 0 {
+		opts.minChunk = x.minChunk
+	}
+	if x.bodyOnly != nil {
+		opts.bodyOnly = *x.bodyOnly
+	}
+	if x.stripRefs != nil {
+		opts.stripRefs = *x.stripRefs
+	}
+	if x.strictFooter != nil && opts.footer != nil {
+		// shares the counts, so what it catches is still reported
+		bl := *opts.footer
+		bl.strict = *x.strictFooter
+		opts.footer = &bl
+	}
+	if x.disable["footnotes"] {
+		opts.keepFootnotes = true
+	}
+	if x.disable["footer"] {
+		opts.footer = nil
+	}
+	if x.disable["scene-breaks"] {
+		opts.breaks = []*regexp.Regexp{}
+	}
+
+	what := fmt.Sprintf("book %d: applied override %s (%s)", b.ID, x.name, strings.Join(x.keys, ", "))
+	events.warn("", "", what)
+	o.mu.Lock()
+	o.applied = append(o.applied, what)
+	o.mu.Unlock()
+	return opts, nil
+}
+
+// bodyLines are the numbers of the lines of content the override has the
+// body start at and end before, 0 for those it leaves to the markers or
+// its patterns.
+func (b *bookOverride) bodyLines(content string) (int, int, error) {
+	if b.startLine == 0 && b.endLine == 0 && b.startAt == "" && b.endAt == "" {
+		return 0, 0, nil
+	}
+	lines := contentLines(content)
+	// by the line's number or what it holds, start-line or start-at
+	line := func(which string, n int, at string) (int, error) {
+		if at != "" {
+			return anchorLine(lines, which+"-at", at)
+		}
+		if n > len(lines) {
+			return 0, fmt.Errorf("%s-line = %d is past the end of the book, line %d", which, n, len(lines))
+		}
+		return n, nil
+	}
+	start, err := line("start", b.startLine, b.startAt)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := line("end", b.endLine, b.endAt)
+	if err != nil {
+		return 0, 0, err
+	}
+	if end > 0 && end <= start {
+		return 0, 0, fmt.Errorf("the body would end at line %d, before it starts at line %d", end, start)
+	}
+	return start, end, nil
+}
+
+// anchorLine is the number of the one line of lines holding at, for key.
+func anchorLine(lines []string, key, at string) (int, error) {
+	found := []string{}
+	n := 0
+	for i, l := range lines {
+		if strings.Contains(l, at) {
+			n = i + 1
+			found = append(found, strconv.Itoa(n))
+		}
+	}
+	switch {
+	case len(found) == 0:
+		return 0, fmt.Errorf("%s: no line has %q", key, at)
+	case len(found) > 1:
+		count := len(found)
+		if count > 5 {
+			found = append(found[:5], "...")
+		}
+		return 0, fmt.Errorf("%s: %q is on %d lines (%s); give more of the line", key, at, count, strings.Join(found, ", "))
+	}
+	return n, nil
+}
+
+func (o *overrides) report() {
+	if o == nil || len(o.applied) == 0 {
+		return
+	}
+	fmt.Printf("%d books chunked with overrides:\n", len(o.applied))
+	for _, what := range o.applied {
+		fmt.Println("  " + what)
+	}
+}
+
+// overridesFlag adds --overrides to fs and returns what loads the file it
+// names, giving nil without one.
+func overridesFlag(fs *flag.FlagSet) func() (*overrides, error) {
+	path := fs.String("overrides", "", "book-overrides.toml setting chunker options for single books, by ebook number or filename")
+	return func() (*overrides, error) {
+		if *path == "" {
+			return nil, nil
+		}
+		return loadOverrides(*path)
+	}
+}
@@ -0,0 +1,203 @@
+package cli
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// chunkTexts is book id's chunks, in order.
+func chunkTexts(t *testing.T, db *sql.DB, id int) []string {
+	t.Helper()
+	rows, err := db.Query("SELECT chunk FROM chunks WHERE sourceid = ? ORDER BY ordinal", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var texts []string
+	for rows.Next() {
+		var c string
+		if err = rows.Scan(&c); err != nil {
+			t.Fatal(err)
+		}
+		texts = append(texts, c)
+	}
+	return texts
+}
+
+func TestOverrideStart(t *testing.T) {
+	db := testDB(t)
+	// scanned from a print edition, with no START line
+	quixote := addBook(t, db, "Don Quixote", "Miguel de Cervantes",
+		"Don Quixote, scanned by a volunteer.\n\nCHAPTER I.\n\n"+testParagraphs(5)+
+			"\n\n*** END OF THIS PROJECT GUTENBERG EBOOK DON QUIXOTE ***\n")
+	var others []int
+	for _, title := range []string{"Emma", "Persuasion"} {
+		others = append(others, addBook(t, db, title, "Jane Austen", testBook(title, testParagraphs(3)+"\n\n"+title+".")))
+	}
+	if err := makeChunks(db, chunkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := chunkCount(t, db, quixote); n != 0 {
+		t.Fatalf("without its START line, Don Quixote gave %d chunks", n)
+	}
+	before := map[int][]string{}
+	for _, id := range others {
+		before[id] = chunkTexts(t, db, id)
+	}
+
+	path := filepath.Join(t.TempDir(), "book-overrides.toml")
+	if err := os.WriteFile(path, []byte("[file.\"Don Quixote.txt\"]\nstart = '^CHAPTER I\\.$'\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := captureStdout(t, func() error { return chunkCmd([]string{"--overrides", path, "--full-rechunk"}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := chunkCount(t, db, quixote); n != 5 {
+		t.Errorf("with a start of its own, Don Quixote gave %d chunks, want 5", n)
+	}
+	for _, c := range chunkTexts(t, db, quixote) {
+		if strings.Contains(c, "volunteer") || strings.Contains(c, "CHAPTER I.") {
+			t.Errorf("a chunk from before the start: %q", c)
+		}
+	}
+	for _, id := range others {
+		if got := chunkTexts(t, db, id); strings.Join(got, "\n") != strings.Join(before[id], "\n") {
+			t.Errorf("book %d was chunked again differently: %q, was %q", id, got, before[id])
+		}
+	}
+	if !strings.Contains(out, "applied override file.\"Don Quixote.txt\" (start)") {
+		t.Errorf("the run reported %q", out)
+	}
+}
+
+func TestLoadOverridesRefuses(t *testing.T) {
+	for _, c := range []struct {
+		file, want string
+	}{
+		{"[ebook.12]\nstrat = 'x'\n", ":2: "},
+		{"[book.12]\n", ":1: "},
+		{"[ebook.12]\ndisable = [\"headers\"]\n", "headers"},
+		{"[ebook.12]\nstart = '(unclosed'\n", ":2: "},
+		{"skip-lines = 2\n", ":1: "},
+	} {
+		path := filepath.Join(t.TempDir(), "book-overrides.toml")
+		if err := os.WriteFile(path, []byte(c.file), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadOverrides(path); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%q: %v, want an error with %q", c.file, err, c.want)
+		}
+	}
+}
+
+// etextPreamble is the top of an early etext, with no START marker, before
+// its first chapter at line 5; the body from line 7 on is paragraphs.
+const etextPreamble = "The Project Gutenberg Etext of Moby Dick\n\n" +
+	"To order these etexts on floppy disk, send a check to the Project at the address below.\n\n" +
+	"CHAPTER 1. Loomings.\n\n"
+
+func TestOverrideBodyLines(t *testing.T) {
+	db := testDB(t)
+	moby := addBook(t, db, "Moby Dick", "Herman Melville", etextPreamble+testParagraphs(6)+"\n\nThus ends the etext, typed in by volunteers.\n")
+	// with a START marker in the wrong place, after the second paragraph
+	wrong := strings.SplitAfterN(testParagraphs(6), "\n\n", 3)
+	whale := addBook(t, db, "The Whale", "Herman Melville", etextPreamble+wrong[0]+wrong[1]+
+		"*** START OF THIS PROJECT GUTENBERG EBOOK THE WHALE ***\n\n"+wrong[2]+
+		"\n\n*** END OF THIS PROJECT GUTENBERG EBOOK THE WHALE ***\n")
+	path := filepath.Join(t.TempDir(), "book-overrides.toml")
+	chunk := func(moby, whale string) error {
+		t.Helper()
+		if err := os.WriteFile(path, []byte("[file.\"Moby Dick.txt\"]\n"+moby+"\n[file.\"The Whale.txt\"]\n"+whale+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := captureStdout(t, func() error { return chunkCmd([]string{"--overrides", path, "--full-rechunk"}) })
+		return err
+	}
+	if err := makeChunks(db, chunkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if n, m := chunkCount(t, db, moby), chunkCount(t, db, whale); n != 0 || m != 4 {
+		t.Fatalf("by their markers, the books gave %d and %d chunks, want 0 and 4", n, m)
+	}
+
+	for _, c := range []struct {
+		moby, whale string
+		n, m        int
+	}{
+		{"start-line = 7", "start-line = 7", 6, 6},
+		{"start-at = 'Loomings'", "start-at = 'CHAPTER 1'", 6, 6},
+		{"start-line = 7\nend-line = 11", "start-line = 9\nend-at = 'number iiii,'", 2, 2},
+		// a line past the end of the body ends it where it would
+		{"start-line = 7\nend-line = 19", "start-line = 7 # the first paragraph", 6, 6},
+	} {
+		if err := chunk(c.moby, c.whale); err != nil {
+			t.Errorf("with %q and %q: %v", c.moby, c.whale, err)
+			continue
+		}
+		if n, m := chunkCount(t, db, moby), chunkCount(t, db, whale); n != c.n || m != c.m {
+			t.Errorf("with %q and %q, the books gave %d and %d chunks, want %d and %d", c.moby, c.whale, n, m, c.n, c.m)
+		}
+		for _, id := range []int{moby, whale} {
+			for _, text := range chunkTexts(t, db, id) {
+				if strings.Contains(text, "floppy") || strings.Contains(text, "START OF") || strings.Contains(text, "volunteers") {
+					t.Errorf("with %q and %q, book %d has a chunk from outside its body: %q", c.moby, c.whale, id, text)
+				}
+			}
+		}
+	}
+
+	// lines that aren't in the book fail it, and leave its chunks as they were
+	for _, c := range []struct{ moby, want string }{
+		{"start-at = 'the weather'", `override file."Moby Dick.txt": start-at: "the weather" is on 6 lines (7, 9, 11, 13, 15, ...); give more of the line`},
+		{"start-line = 7\nend-at = 'whaling'", `override file."Moby Dick.txt": end-at: no line has "whaling"`},
+		{"start-line = 99", `override file."Moby Dick.txt": start-line = 99 is past the end of the book, line 19`},
+		{"start-line = 11\nend-line = 9", `override file."Moby Dick.txt": the body would end at line 9, before it starts at line 11`},
+	} {
+		if err := chunk(c.moby, "start-line = 7"); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("with %q: %v, want an error with %q", c.moby, err, c.want)
+		}
+		if n := chunkCount(t, db, moby); n != 6 {
+			t.Errorf("with %q, Moby Dick was left %d chunks", c.moby, n)
+		}
+		if _, err := captureStdout(t, func() error { return auditChunksCmd([]string{"--overrides", path}) }); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("audit-chunks with %q: %v, want an error with %q", c.moby, err, c.want)
+		}
+	}
+
+	// run --pipeline goes by them too
+	root := t.TempDir()
+	writeTestZip(t, filepath.Join(root, "2", "2701.zip"), zipEntry{"2701.txt", etextPreamble + testParagraphs(6) + "\n\nThus ends the etext, typed in by volunteers.\n"})
+	for moby, want := range map[string]string{"start-line = 7": "", "start-at = 'paragraph'": `override file."2701.txt": start-at: "paragraph" is on 6 lines`} {
+		if err := os.WriteFile(path, []byte("[file.\"2701.txt\"]\n"+moby+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		db = testDB(t)
+		out, err := captureStderr(t, func() error {
+			_, err := captureStdout(t, func() error { return runCmd([]string{"--target", root, "--pipeline", "--overrides", path}) })
+			return err
+		})
+		if want == "" && (err != nil || names(t, db, "SELECT count(*) FROM chunks") != "6\n") {
+			t.Errorf("run --pipeline with %q: %v, and %s chunks", moby, err, names(t, db, "SELECT count(*) FROM chunks"))
+		} else if want != "" && (err == nil || !strings.Contains(out, "2/2701.zip: 2701.txt: "+want)) {
+			t.Errorf("run --pipeline with %q: %v, printing\n%s\nwant %q", moby, err, out, want)
+		}
+	}
+
+	for _, c := range []struct{ file, want string }{
+		{"start-line = 7\nstart-at = 'Loomings'", ":3: start-at: start-line and start-at don't go together"},
+		{"end = '^Thus'\nend-line = 19", ":3: end-line: end and end-line don't go together"},
+		{"start-line = 0", ":2: start-line: want a line number, not 0"},
+		{"end-at = '  '", ":2: end-at: want some text to find"},
+	} {
+		if err := os.WriteFile(path, []byte("[file.\"Moby Dick.txt\"]\n"+c.file+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadOverrides(path); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%q: %v, want an error with %q", c.file, err, c.want)
+		}
+	}
+}
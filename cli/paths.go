@@ -0,0 +1,279 @@
+package cli
+
+import (
+	"database/sql"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// An archive is known to the journal, the files table and the warnings by
+// its name under the mirror root it was ingested from, with forward
+// slashes whatever the OS: 1/2/3/123/123.zip, never /mnt/mirror/1/2/3/...
+// nor 1\2\3\... So one mirror ingested on two machines, or walked once as
+// ./mirror and once by its absolute path, names its archives the same,
+// and the journal, coverage and --paths-file lists match across them.
+// --target is made absolute and clean, its symlinks resolved, before
+// anything is walked or looked up; an archive outside the mirror keeps
+// its absolute path, in forward slashes, and a download its url. What
+// reads an archive again joins its name to the root of its source.
+
+// resolveTarget is root made absolute and clean, with its symlinks
+// resolved when it exists.
+func resolveTarget(root string) (string, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	if real, err := filepath.EvalSymlinks(abs); err == nil {
+		abs = real
+	}
+	return filepath.Clean(abs), nil
+}
+
+// mirrorName is the name of the archive at file under root. A file not
+// found under root as given is looked for under it with the symlinks of
+// both resolved.
+func mirrorName(root, file string) string {
+	if isURL(file) {
+		return file
+	}
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		abs = file
+	}
+	name := canonicalName(slashPath(root), slashPath(abs))
+	if !isAbsSlash(name) {
+		return name
+	}
+	realRoot, err1 := filepath.EvalSymlinks(root)
+	realFile, err2 := filepath.EvalSymlinks(abs)
+	if err1 != nil || err2 != nil {
+		return name
+	}
+	if n := canonicalName(slashPath(realRoot), slashPath(realFile)); !isAbsSlash(n) {
+		return n
+	}
+	return name
+}
+
+// canonicalName is p's name under root, both absolute and in forward
+// slashes: the path below root, or p cleaned when it isn't below it. A
+// relative p is taken to be a name already.
+func canonicalName(root, p string) string {
+	if isURL(p) {
+		return p
+	}
+	p = path.Clean(p)
+	if !isAbsSlash(p) {
+		return p
+	}
+	root = path.Clean(root)
+	if root != "" && root != "." && strings.HasPrefix(p, strings.TrimSuffix(root, "/")+"/") {
+		return p[len(strings.TrimSuffix(root, "/"))+1:]
+	}
+	return p
+}
+
+// archiveFile is where the archive name under root is on disk.
+func archiveFile(root, name string) string {
+	if isURL(name) || isAbsSlash(name) || root == "" {
+		return filepath.FromSlash(name)
+	}
+	return filepath.Join(root, filepath.FromSlash(name))
+}
+
+// slashPath is p with forward slashes, a Windows path's backslashes
+// included wherever it is read.
+func slashPath(p string) string {
+	return strings.ReplaceAll(filepath.ToSlash(p), `\`, "/")
+}
+
+// isAbsSlash reports whether p, in forward slashes, is absolute on any
+// OS: /mnt/mirror, C:/mirror or //server/share.
+func isAbsSlash(p string) bool {
+	return strings.HasPrefix(p, "/") || len(p) >= 3 && p[1] == ':' && p[2] == '/' && isDriveLetter(p[0])
+}
+
+func isDriveLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isURL(p string) bool {
+	return strings.Contains(p, "://")
+}
+
+// canonicalizePaths brings the archives a database names to the form
+// above: each source's and the journal's roots made absolute, against
+// the working directory for one ingested with a relative --target, and
+// each archive, and warning and source conflict about one, named under
+// the longest of those roots it is below. The journal is made again keyed
+// by root and archive, as two mirrors' archives can now share a name.
+func canonicalizePaths(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	roots := map[string]string{}
+	for _, q := range []string{"SELECT DISTINCT root FROM sources WHERE root IS NOT NULL",
+		"SELECT DISTINCT root FROM ingest_journal WHERE root IS NOT NULL"} {
+		found, err := stringColumn(tx, q)
+		if err != nil {
+			return err
+		}
+		for _, r := range found {
+			roots[r] = canonicalRoot(r)
+		}
+	}
+	// each root as it is now and, made absolute, as it was walked; longest
+	// first, so an archive goes under the deepest root it is below
+	order := []string{}
+	for old, r := range roots {
+		if isURL(r) {
+			continue
+		}
+		order = append(order, slashPath(r))
+		if abs, err := filepath.Abs(old); err == nil {
+			order = append(order, slashPath(abs))
+		}
+	}
+	sort.Slice(order, func(i, j int) bool { return len(order[i]) > len(order[j]) })
+	name := func(p string) string {
+		p = slashPath(p)
+		for _, r := range order {
+			if n := canonicalName(r, p); !isAbsSlash(n) {
+				return n
+			}
+		}
+		return canonicalName("", p)
+	}
+	renamed := func(p string) string {
+		if isURL(p) {
+			return p
+		}
+		if !isAbsSlash(slashPath(p)) {
+			// relative to the working directory ingest ran in
+			if abs, err := filepath.Abs(p); err == nil {
+				p = abs
+			}
+		}
+		return name(p)
+	}
+
+	// a source labelled by default with its root is labelled with the root
+	// resolved, as ingest now labels it
+	for old, root := range roots {
+		if _, err = tx.Exec(`UPDATE sources SET root = ?,
+				label = CASE WHEN label = root AND NOT EXISTS (SELECT 1 FROM sources s WHERE s.label = ?) THEN ? ELSE label END
+			WHERE root = ?`, root, root, root, old); err != nil {
+			return err
+		}
+	}
+	for _, c := range []struct{ table, column string }{
+		{"files", "archive"}, {"warnings", "path"}, {"source_conflicts", "archive_path"},
+	} {
+		values, err := stringColumn(tx, fmt.Sprintf("SELECT DISTINCT %s FROM %s WHERE %s IS NOT NULL", c.column, c.table, c.column))
+		if err != nil {
+			return err
+		}
+		for _, v := range values {
+			if n := renamed(v); n != v {
+				if _, err = tx.Exec(fmt.Sprintf("UPDATE %s SET %s = ? WHERE %s = ?", c.table, c.column, c.column), n, v); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if _, err = tx.Exec(`CREATE TABLE ingest_journal_new (
+			archive      TEXT,
+			root         TEXT,
+			status       TEXT,
+			started_at   TEXT,
+			completed_at TEXT,
+			PRIMARY KEY (root, archive)
+		)`); err != nil {
+		return err
+	}
+	rows, err := tx.Query("SELECT archive, coalesce(root, ''), status, started_at, completed_at FROM ingest_journal ORDER BY rowid")
+	if err != nil {
+		return err
+	}
+	type entry struct {
+		archive, root             string
+		status, started, complete sql.NullString
+	}
+	var entries []entry
+	for rows.Next() {
+		var e entry
+		if err = rows.Scan(&e.archive, &e.root, &e.status, &e.started, &e.complete); err != nil {
+			rows.Close()
+			return err
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		root := e.root
+		if r, ok := roots[root]; ok {
+			root = r
+		}
+		// the later of two entries coming to one name wins, as a walk
+		// would have it
+		if _, err = tx.Exec("INSERT OR REPLACE INTO ingest_journal_new (archive, root, status, started_at, completed_at) VALUES (?, ?, ?, ?, ?)",
+			renamed(e.archive), root, e.status, e.started, e.complete); err != nil {
+			return err
+		}
+	}
+	for _, q := range []string{
+		"DROP TABLE ingest_journal",
+		"ALTER TABLE ingest_journal_new RENAME TO ingest_journal",
+		"CREATE INDEX IF NOT EXISTS ingest_journal_root ON ingest_journal(root, status)",
+	} {
+		if _, err = tx.Exec(q); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// canonicalRoot is a root as a database recorded it, as resolveTarget
+// would make it now; a url is left as it is.
+func canonicalRoot(root string) string {
+	if isURL(root) {
+		return root
+	}
+	if isAbsSlash(slashPath(root)) && !filepath.IsAbs(root) {
+		// another OS's absolute path, which can't be resolved here
+		return path.Clean(slashPath(root))
+	}
+	r, err := resolveTarget(root)
+	if err != nil {
+		return root
+	}
+	return r
+}
+
+func stringColumn(tx *sql.Tx, q string) ([]string, error) {
+	rows, err := tx.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var s string
+		if err = rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,208 @@
+package cli
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalName(t *testing.T) {
+	for _, c := range []struct{ root, p, want string }{
+		{"/mnt/mirror", "/mnt/mirror/1/2/12.zip", "1/2/12.zip"},
+		{"/mnt/mirror/", "/mnt/mirror/./1/../1/12.zip", "1/12.zip"},
+		// another mirror whose name starts the same isn't below it
+		{"/mnt/mirror", "/mnt/mirror2/1/12.zip", "/mnt/mirror2/1/12.zip"},
+		{"/mnt/mirror", "/elsewhere/12.zip", "/elsewhere/12.zip"},
+		// a name already, however it is written
+		{"/mnt/mirror", "1/2/12.zip", "1/2/12.zip"},
+		{"/mnt/mirror", "./1//2/12.zip", "1/2/12.zip"},
+		// Windows paths, their backslashes made forward ones
+		{slashPath(`C:\mirror`), slashPath(`C:\mirror\1\2\12.zip`), "1/2/12.zip"},
+		{slashPath(`C:\mirror`), slashPath(`D:\mirror\1\2\12.zip`), "D:/mirror/1/2/12.zip"},
+		{slashPath(`C:\mirror`), slashPath(`1\2\12.zip`), "1/2/12.zip"},
+		{slashPath(`\\server\share\mirror`), slashPath(`\\server\share\mirror\1\12.zip`), "1/12.zip"},
+		{"/mnt/mirror", "https://mirror.example/1/12.zip", "https://mirror.example/1/12.zip"},
+		{"", "/mnt/mirror/1/12.zip", "/mnt/mirror/1/12.zip"},
+	} {
+		if got := canonicalName(c.root, c.p); got != c.want {
+			t.Errorf("canonicalName(%q, %q) = %q, want %q", c.root, c.p, got, c.want)
+		}
+	}
+	for p, want := range map[string]bool{"/mnt": true, "C:/mirror": true, "c:/": true, "//server/share": true, "1/12.zip": false, "C:mirror": false, "1:/12.zip": false, "": false} {
+		if got := isAbsSlash(p); got != want {
+			t.Errorf("isAbsSlash(%q) = %v", p, got)
+		}
+	}
+	for _, c := range []struct{ root, name, want string }{
+		{"/mnt/mirror", "1/12.zip", filepath.Join("/mnt/mirror", "1", "12.zip")},
+		{"/mnt/mirror", "/elsewhere/12.zip", filepath.FromSlash("/elsewhere/12.zip")},
+		{"", "1/12.zip", filepath.FromSlash("1/12.zip")},
+		{"/mnt/mirror", "https://mirror.example/1/12.zip", filepath.FromSlash("https://mirror.example/1/12.zip")},
+	} {
+		if got := archiveFile(c.root, c.name); got != c.want {
+			t.Errorf("archiveFile(%q, %q) = %q, want %q", c.root, c.name, got, c.want)
+		}
+	}
+}
+
+// pathsFixture is a mirror of two archives, in a directory of its own
+// with a symlink to it beside it, and that directory.
+func pathsFixture(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, a := range []string{"1/11.zip", "2/22.zip"} {
+		stem := strings.TrimSuffix(filepath.Base(a), ".zip")
+		writeTestZip(t, filepath.Join(dir, "mirror", filepath.FromSlash(a)), zipEntry{stem + ".txt", testBook("Book "+stem, testParagraphs(2))})
+	}
+	if err := os.Symlink(filepath.Join(dir, "mirror"), filepath.Join(dir, "link")); err != nil {
+		t.Skipf("no symlinks: %v", err)
+	}
+	return dir
+}
+
+func TestMirrorName(t *testing.T) {
+	dir := pathsFixture(t)
+	t.Chdir(dir)
+	real, err := resolveTarget(filepath.Join(dir, "mirror"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"mirror", "./mirror/", filepath.Join(dir, "mirror"), "link", filepath.Join(dir, "link", ".")} {
+		root, err := resolveTarget(target)
+		if err != nil || root != real {
+			t.Errorf("resolveTarget(%q) = %q, %v, want %q", target, root, err, real)
+		}
+	}
+	for _, file := range []string{filepath.Join(real, "1", "11.zip"), filepath.Join("mirror", "1", "11.zip"), filepath.Join("link", "1", "11.zip"), filepath.Join(dir, "link", "1", "11.zip")} {
+		if got := mirrorName(real, file); got != "1/11.zip" {
+			t.Errorf("mirrorName of %s = %q", file, got)
+		}
+	}
+	if got := mirrorName(real, filepath.Join(dir, "other.zip")); got != slashPath(filepath.Join(dir, "other.zip")) {
+		t.Errorf("mirrorName of an archive outside the mirror = %q", got)
+	}
+}
+
+func TestIngestPathForms(t *testing.T) {
+	dir := pathsFixture(t)
+	t.Chdir(dir)
+	db := testDB(t)
+	ingest := func(args ...string) string {
+		t.Helper()
+		out, err := captureStdout(t, func() error { return ingestCmd(args) })
+		if err != nil {
+			t.Fatalf("ingest %s: %v", strings.Join(args, " "), err)
+		}
+		return out
+	}
+	ingest("--target", "./mirror")
+	want := "1/11.zip\n2/22.zip\n"
+	if got := names(t, db, "SELECT archive FROM files ORDER BY archive"); got != want {
+		t.Fatalf("ingest of ./mirror named the archives\n%s", got)
+	}
+	real, _ := resolveTarget("mirror")
+	if got := names(t, db, "SELECT DISTINCT root FROM ingest_journal"); got != real+"\n" {
+		t.Errorf("the journal's roots are\n%s", got)
+	}
+
+	// the same mirror by other paths is the same archives
+	for _, target := range []string{filepath.Join(dir, "mirror"), "link", filepath.Join(dir, "link")} {
+		ingest("--target", target)
+		if got := names(t, db, "SELECT archive FROM files ORDER BY archive"); got != want {
+			t.Errorf("ingest of %s after ./mirror stored\n%s", target, got)
+		}
+		if got := names(t, db, "SELECT root || ' ' || archive FROM ingest_journal ORDER BY archive"); got != real+" 1/11.zip\n"+real+" 2/22.zip\n" {
+			t.Errorf("ingest of %s after ./mirror journaled\n%s", target, got)
+		}
+	}
+
+	// and listed in either slash, relative to the target or not
+	paths := filepath.Join(dir, "paths")
+	if err := os.WriteFile(paths, []byte(`1\11.zip`+"\n"+filepath.Join(dir, "link", "2", "22.zip")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	db = testDB(t)
+	ingest("--target", "link", "--paths-file", paths)
+	if got := names(t, db, "SELECT archive FROM files ORDER BY archive"); got != want {
+		t.Errorf("ingest --paths-file stored\n%s", got)
+	}
+	manifest := filepath.Join(dir, "manifest")
+	if err := os.WriteFile(manifest, []byte(`1\11.zip`+"\n2/22.zip\n3/33.zip\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := captureStdout(t, func() error { return coverageCmd([]string{"--target", "./link", "--manifest", manifest}) })
+	if err != nil || !strings.Contains(out, "total") || !strings.Contains(out, "        3         2         1") {
+		t.Errorf("coverage of a manifest in both slashes: %v, printing\n%s", err, out)
+	}
+}
+
+func TestCanonicalizePaths(t *testing.T) {
+	dir := pathsFixture(t)
+	t.Chdir(dir)
+	db := testFileDB(t)
+	if _, err := captureStdout(t, func() error { return ingestCmd([]string{"--target", "mirror"}) }); err != nil {
+		t.Fatal(err)
+	}
+	path := dbFile(dsn)
+	db.Close()
+
+	// as an older gutchunk left them: the walks' paths, under a relative
+	// target, through a symlink and on Windows, and the journal keyed by
+	// archive alone
+	raw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	abs := filepath.Join(dir, "link", "2", "22.zip")
+	for _, q := range []struct {
+		q    string
+		args []interface{}
+	}{
+		{"UPDATE sources SET root = 'mirror', label = 'mirror'", nil},
+		{"UPDATE files SET archive = ? WHERE archive = '1/11.zip'", []interface{}{filepath.Join("mirror", "1", "11.zip")}},
+		{"UPDATE files SET archive = ? WHERE archive = '2/22.zip'", []interface{}{abs}},
+		{"INSERT INTO warnings (scope, severity, code, path, message) VALUES ('ingest', 'warn', 'test', ?, 'a warning')", []interface{}{`C:\mirror\3\33.zip`}},
+		{"DROP TABLE ingest_journal", nil},
+		{"CREATE TABLE ingest_journal (archive TEXT PRIMARY KEY, root TEXT, status TEXT, started_at TEXT, completed_at TEXT)", nil},
+		{"INSERT INTO ingest_journal (archive, root, status) VALUES (?, 'mirror', 'completed'), (?, 'link', 'completed'), (?, ?, 'completed')",
+			[]interface{}{filepath.Join("mirror", "1", "11.zip"), abs, `C:\mirror\3\33.zip`, `C:\mirror`}},
+		{"PRAGMA user_version = 6", nil},
+	} {
+		if _, err = raw.Exec(q.q, q.args...); err != nil {
+			t.Fatalf("%s: %v", q.q, err)
+		}
+	}
+	raw.Close()
+
+	asCommand(t, "migrate")
+	if _, err = captureStdout(t, func() error { return migrateCmd(nil) }); err != nil {
+		t.Fatal(err)
+	}
+	db, err = openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	real, _ := resolveTarget("mirror")
+	for q, want := range map[string]string{
+		"SELECT archive FROM files ORDER BY archive":                               "1/11.zip\n2/22.zip\n",
+		"SELECT root || ' ' || label FROM sources":                                 real + " " + real + "\n",
+		"SELECT path FROM warnings WHERE code = 'test'":                            "3/33.zip\n",
+		"SELECT root || ' ' || archive FROM ingest_journal ORDER BY root, archive": real + " 1/11.zip\n" + real + " 2/22.zip\nC:/mirror 3/33.zip\n",
+	} {
+		if got := names(t, db, q); got != want {
+			t.Errorf("migrated, %s gives\n%s\nwant\n%s", q, got, want)
+		}
+	}
+
+	// and another walk, by another path, finds them all ingested
+	out, err := captureStdout(t, func() error { return ingestCmd([]string{"--target", filepath.Join(dir, "link"), "--resume"}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(t, db, "SELECT count(*) FROM files"); got != "2\n" {
+		t.Errorf("ingest after migrating stored %s books, printing\n%s", got, out)
+	}
+}
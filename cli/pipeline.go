@@ -0,0 +1,409 @@
+package cli
+
+import (
+	"archive/zip"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+
+	"git.tilde.town/gutchunker/gutchunk"
+)
+
+// gutchunk run ingests a mirror and chunks the books it ingested. Done as
+// two phases, ingest then chunk, every book's content is written to files
+// only to be read straight back out. With --pipeline the walker hands the
+// books it reads over to the chunk workers instead, and a book's files row
+// is written in the same transaction as its chunks, without its content
+// under --no-store-content. The walker blocks once a few books per worker
+// are read and not yet written, so a slow writer never has the mirror
+// buffered in memory. An archive that fails anywhere in the pipe is
+// reported and counted once the run ends, and the rest go on through.
+
+// books read ahead of the writer, per worker
+const pipelineDepth = 2
+
+// pipeBook is an archive on its way through the pipeline.
+type pipeBook struct {
+	// its place in walk order, which the writer writes in
+	seq int
+	// its name under the root (see mirrorName)
+	archive string
+	sw      stopwatch
+	members []zipMember
+	// reading it failed
+	err error
+
+	// filled in by a worker
+	opts   chunkOptions
+	chunks []string
+	at     []chunkPos
+	notes  []gutchunk.Footnote
+	cuts   []strategyCut
+	marks  gutchunk.Found
+	panic  *bookPanic
+	// the texts after the first of a member holding several, chunked
+	// alongside it (see multitext.go), and the book each was stored as
+	more []*pipeBook
+	id   int64
+}
+
+// book is the member holding the book, nil for none.
+func (b *pipeBook) book() *zipMember {
+	if n := len(b.members); n > 0 && b.members[n-1].reason == "" {
+		return &b.members[n-1]
+	}
+	return nil
+}
+
+func runCmd(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	root := fs.String("target", target, "root of the gutenberg mirror")
+	pipelined := fs.Bool("pipeline", false, "chunk books as they are read instead of ingesting them all first")
+	noContent := fs.Bool("no-store-content", false, "with --pipeline, don't keep books' content in the files table")
+	var iopts ingestOptions
+	fs.BoolVar(&iopts.resume, "resume", false, "skip archives up to where the last interrupted walk of this target stopped")
+	var copts chunkOptions
+	fs.BoolVar(&copts.stripRefs, "strip-refs", false, "remove footnote reference markers like [12] from chunk text")
+	fs.IntVar(&copts.workers, "workers", 1, "number of books to chunk concurrently")
+	breaks := sceneFlags(fs)
+	fs.BoolVar(&copts.scenes, "scenes", false, "number chunks by the scene breaks before them, in chunks.scene")
+	fs.BoolVar(&copts.tagKinds, "tag-kinds", false, "tag chunks as narrative, dialogue, letter or epigraph, in chunks.kind")
+	overrides := overridesFlag(fs)
+	langMins := langMinFlag(fs)
+	sizes := chunkSizeFlags(fs, &copts)
+	fs.BoolVar(&copts.fullRechunk, "full-rechunk", false, "write every chunk of a book chunked before anew, rather than keeping those cut again")
+	fs.BoolVar(&iopts.detectLanguage, "detect-language", false, "detect the language of books whose header gives none from their text")
+	limits := limitFlags(fs, &iopts)
+	stubs := stubFlags(fs, &iopts)
+	layout := mirrorLayoutFlag(fs, &iopts)
+	strict := strictFlags(fs)
+	fs.Parse(args)
+
+	if *noContent && !*pipelined {
+		return usagef("--no-store-content needs --pipeline")
+	}
+	iopts.noContent = *noContent
+	var err error
+	if err = limits(); err != nil {
+		return err
+	}
+	if err = stubs(); err != nil {
+		return err
+	}
+	if err = layout(); err != nil {
+		return err
+	}
+	if copts.breaks, err = breaks(); err != nil {
+		return err
+	}
+	if copts.overrides, err = overrides(); err != nil {
+		return err
+	}
+	if copts.langMins, err = langMins(); err != nil {
+		return err
+	}
+	if err = sizes(); err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err = startRun(db, "run"); err != nil {
+		return err
+	}
+
+	if *root, err = resolveTarget(*root); err != nil {
+		return err
+	}
+	if iopts.sourceID, err = ensureSource(db, *root, *root); err != nil {
+		return err
+	}
+	copts.starts = &startLog{}
+	if *pipelined {
+		iopts.timings = runTimings("run")
+		copts.timings = iopts.timings
+		return strict.check(db, iopts.timings.report("run", runPipeline(db, *root, iopts, copts)))
+	}
+	return strict.check(db, runPhases(db, *root, iopts, copts))
+}
+
+// runPhases is run without --pipeline: ingest, then chunk the books it
+// ingested.
+func runPhases(db *sql.DB, root string, iopts ingestOptions, copts chunkOptions) error {
+	var last int
+	if err := db.QueryRow("SELECT coalesce(max(id), 0) FROM files").Scan(&last); err != nil {
+		return err
+	}
+	iopts.timings = runTimings("ingest")
+	if err := iopts.timings.report("ingest", readFiles(db, root, iopts)); err != nil {
+		return err
+	}
+	walState.idle(db)
+
+	rows, err := db.Query("SELECT id FROM files WHERE id > ? ORDER BY id", last)
+	if err != nil {
+		return err
+	}
+	copts.ids = []int{}
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		copts.ids = append(copts.ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	copts.timings = runTimings("chunk")
+	return copts.timings.report("chunk", makeChunks(db, copts))
+}
+
+// runPipeline ingests the archives under root as readFiles does, chunking
+// each book on its way to the database.
+func runPipeline(db *sql.DB, root string, iopts ingestOptions, copts chunkOptions) error {
+	resetRechunks()
+	done, resumeAt, err := startIngest(db, root, iopts)
+	if err != nil {
+		return err
+	}
+	if copts.workers < 1 {
+		copts.workers = 1
+	}
+
+	// a token for each archive read and not yet written
+	inFlight := make(chan struct{}, pipelineDepth*copts.workers)
+	toChunk := make(chan *pipeBook)
+	toWrite := make(chan *pipeBook, copts.workers)
+
+	type failure struct {
+		archive string
+		err     error
+	}
+	failures := make(chan failure)
+	var failed int
+	collected := make(chan struct{})
+	go func() {
+		for f := range failures {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", f.archive, f.err)
+			events.warn(f.archive, "", f.err.Error())
+			failed++
+		}
+		close(collected)
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < copts.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range toChunk {
+				if b.err == nil {
+					chunkPiped(b, copts)
+				}
+				toWrite <- b
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(toWrite)
+	}()
+
+	var books, chunks, panicked int
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		// workers finish out of order; books are written in walk order,
+		// so file and chunk ids come out as the two phases would give them
+		pending := map[int]*pipeBook{}
+		next := 0
+		for b := range toWrite {
+			pending[b.seq] = b
+			for b = pending[next]; b != nil; b = pending[next] {
+				delete(pending, next)
+				next++
+				w, n, p, err := writePiped(db, root, b, iopts, copts)
+				<-inFlight
+				if err != nil {
+					failures <- failure{b.archive, err}
+					continue
+				}
+				books += w
+				chunks += n
+				panicked += p
+			}
+		}
+		close(failures)
+	}()
+
+	var skip func(string) bool
+	if resumeAt != "" {
+		skip = func(dir string) bool { return walkBefore(dir, resumeAt) && !isAncestor(dir, resumeAt) }
+	}
+	seq, walked := 0, 0
+	walkErr := walkArchives(root, skip, func(archive string, info ArchiveInfo) error {
+		walked++
+		name := mirrorName(root, archive)
+		if turnedAway(name, info, done, iopts) {
+			return nil
+		}
+		// blocks while the writer is behind
+		inFlight <- struct{}{}
+		b := &pipeBook{seq: seq, archive: name, sw: iopts.timings.start(name)}
+		seq++
+		b.members, b.err = readPiped(archive, iopts, &b.sw)
+		toChunk <- b
+		return nil
+	})
+	close(toChunk)
+	<-written
+	<-collected
+
+	if walkErr != nil {
+		return walkErr
+	}
+	fmt.Printf("ingested and chunked %d books into %d chunks\n", books, chunks)
+	if s := rechunkReport(); s != "" {
+		fmt.Println(s)
+	}
+	copts.starts.report()
+	copts.overrides.report()
+	copts.langMins.report()
+	if failed > 0 {
+		return partialError{failed, walked, "archives", "failed"}
+	}
+	if panicked > 0 {
+		return partialError{panicked, books + panicked, "books", "failed to chunk; see gutchunk warnings --code panic"}
+	}
+	return nil
+}
+
+func readPiped(archive string, opts ingestOptions, sw *stopwatch) ([]zipMember, error) {
+	if isCacheText(archive) {
+		return readText(archive, archive, opts, sw)
+	}
+	var r *zip.ReadCloser
+	err := withinRead(archive, func() (err error) {
+		r, err = zip.OpenReader(archive)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readZip(&r.Reader, archive, opts, sw)
+}
+
+// chunkPiped chunks the book b holds, if it holds one, as chunkHeld would
+// once it was stored. A panic is kept in b for the writer to record.
+func chunkPiped(b *pipeBook, opts chunkOptions) {
+	m := b.book()
+	if m == nil {
+		return
+	}
+	bf := bookfile{
+		Filename: bookFilename(*m, parseArchiveName(b.archive)),
+		Ebook:    memberEbook(*m, parseArchiveName(b.archive)),
+		Language: headerLanguage(m.text.Bytes()),
+		Content:  m.text.String(),
+	}
+	for _, t := range m.more {
+		more := &pipeBook{seq: b.seq, archive: b.archive, members: []zipMember{t}}
+		if chunkPiped(more, opts); more.err != nil {
+			b.err = more.err
+			return
+		}
+		b.more = append(b.more, more)
+	}
+	b.sw.wait()
+	opts, err := opts.overrides.apply(bf, opts.forBook(bf))
+	if err != nil {
+		b.err = fmt.Errorf("%s: %w", bf.Filename, err)
+		return
+	}
+	b.opts = opts
+	defer func() {
+		if v := recover(); v != nil {
+			stack := make([]byte, 64<<10)
+			b.panic = &bookPanic{v, stack[:runtime.Stack(stack, false)]}
+			b.chunks, b.at, b.notes, b.cuts = nil, nil, nil, nil
+		}
+	}()
+	b.chunks, b.at, b.notes, b.cuts, b.marks = splitContent(bf.Content, opts)
+	b.sw.lap(phaseScan)
+}
+
+// writePiped ingests b and writes its chunks in one transaction, returning
+// how many books and chunks it wrote, and how many books it stored without
+// chunks for chunking them panicked; b can hold no book to ingest, or a
+// member's several texts.
+func writePiped(db *sql.DB, root string, b *pipeBook, iopts ingestOptions, copts chunkOptions) (int, int, int, error) {
+	if b.err != nil {
+		manifestOut.failed(b.archive, b.err)
+		return 0, 0, 0, b.err
+	}
+	b.sw.wait()
+	texts := append([]*pipeBook{b}, b.more...)
+	err := ingestJournaled(db, root, b.archive, func(tx *sql.Tx) (Reason, error) {
+		skipped, ids, err := storeZip(tx, b.members, b.archive, b.archive, iopts, &b.sw)
+		if err != nil || skipped.Code != "" {
+			return skipped, err
+		}
+		for i, t := range texts {
+			if t.id = ids[i]; t.id == 0 {
+				continue
+			}
+			if err := writePipedText(tx, t); err != nil {
+				return Reason{}, err
+			}
+		}
+		return Reason{}, nil
+	})
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	books, chunks, panicked := 0, 0, 0
+	for _, t := range texts {
+		switch {
+		case t.id == 0:
+		case t.panic != nil:
+			copts.timings.bookFailed()
+			panicked++
+		default:
+			copts.starts.add(int(t.id), t.marks)
+			events.emit("book_chunked", map[string]interface{}{"book": t.id, "chunks": len(t.chunks)})
+			books++
+			chunks += len(t.chunks)
+		}
+	}
+	if books > 0 {
+		b.sw.lap(phaseWrite)
+		b.sw.done(chunks)
+	}
+	return books, chunks, panicked, nil
+}
+
+// writePipedText writes the chunks of t, a text stored as book t.id, or
+// the warning that chunking it panicked.
+func writePipedText(tx *sql.Tx, t *pipeBook) error {
+	if t.panic != nil {
+		fmt.Fprintf(os.Stderr, "book %d: %v\n", t.id, t.panic)
+		return insertChunkWarning(tx, t.id, warnPanic, t.panic.Error(), string(t.panic.stack))
+	}
+	if err := markerWarnings(tx, int(t.id), t.marks, len(t.chunks)); err != nil {
+		return err
+	}
+	if err := writeChunks(tx, int(t.id), t.opts.strategy(), t.chunks, chunkExtras(nil, t.at, t.opts.scenes), t.notes, t.opts.fullRechunk); err != nil {
+		return err
+	}
+	return writeStrategyChunks(tx, int(t.id), t.cuts, nil, t.opts.scenes)
+}
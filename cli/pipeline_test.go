@@ -0,0 +1,157 @@
+package cli
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writeRunMirror writes a mirror of four books for run to ingest and
+// chunk: one with footnotes, one with a scene break, one with two START
+// markers, and an archive with no book in it.
+func writeRunMirror(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	writeTestZip(t, filepath.Join(root, "1", "11.zip"), zipEntry{"11.txt", testBook("Emma", testParagraphs(3))})
+	writeTestZip(t, filepath.Join(root, "2", "22.zip"), zipEntry{"22.txt", testBook("Notes", testParagraphs(2)+"[1] and a reference.\n\nFootnotes\n\n[1] A note at the end.")})
+	writeTestZip(t, filepath.Join(root, "3", "33.zip"), zipEntry{"33.txt", testBook("Scenes", testParagraphs(2)+"\n\n* * *\n\n"+testParagraphs(2))})
+	writeTestZip(t, filepath.Join(root, "4", "44.zip"), zipEntry{"44.txt", testBook("Twice", testParagraphs(2)) + testBook("Twice Again", testParagraphs(2)+"\n\nThe end.")})
+	writeTestZip(t, filepath.Join(root, "5", "55.zip"), zipEntry{"55.html", "<html>not a text</html>"})
+	return root
+}
+
+// dumpDB is every row of db's tables, leaving out when they were written
+// and the run that wrote them, and the ids of warnings, which the two
+// phases give in another order.
+func dumpDB(t *testing.T, db *sql.DB) string {
+	t.Helper()
+	tables, err := db.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' AND name NOT IN ('runs', 'schema_version') ORDER BY name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for tables.Next() {
+		var name string
+		if err = tables.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	tables.Close()
+
+	var b strings.Builder
+	for _, table := range names {
+		rows, err := db.Query("SELECT * FROM " + table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cols, _ := rows.Columns()
+		var lines []string
+		for rows.Next() {
+			values := make([]interface{}, len(cols))
+			ptrs := make([]interface{}, len(cols))
+			for i := range values {
+				ptrs[i] = &values[i]
+			}
+			if err = rows.Scan(ptrs...); err != nil {
+				t.Fatal(err)
+			}
+			var fields []string
+			for i, col := range cols {
+				if strings.HasSuffix(col, "_at") || col == "run_id" || table == "warnings" && col == "id" {
+					continue
+				}
+				if bs, ok := values[i].([]byte); ok {
+					values[i] = string(bs)
+				}
+				fields = append(fields, fmt.Sprintf("%s=%v", col, values[i]))
+			}
+			lines = append(lines, strings.Join(fields, " "))
+		}
+		rows.Close()
+		sort.Strings(lines)
+		fmt.Fprintf(&b, "%s:\n%s\n", table, strings.Join(lines, "\n"))
+	}
+	return b.String()
+}
+
+func TestPipelineSameAsPhases(t *testing.T) {
+	root := writeRunMirror(t)
+	run := func(args ...string) *sql.DB {
+		t.Helper()
+		db := testDB(t)
+		if _, err := captureStdout(t, func() error { return runCmd(append([]string{"--target", root, "--scenes"}, args...)) }); err != nil {
+			t.Fatalf("run %s: %v", strings.Join(args, " "), err)
+		}
+		return db
+	}
+	phases := dumpDB(t, run())
+	if !strings.Contains(phases, "chunks:\n") || strings.Count(phases, "sourceid=") < 10 {
+		t.Fatalf("the two phases stored\n%s", phases)
+	}
+	for _, args := range [][]string{{"--pipeline"}, {"--pipeline", "--workers", "3"}} {
+		if piped := dumpDB(t, run(args...)); piped != phases {
+			t.Errorf("run %s stored what the two phases did but\n%s", strings.Join(args, " "), lineDiff(phases, piped))
+		}
+	}
+
+	db := run("--pipeline", "--no-store-content")
+	var stored int
+	if err := db.QueryRow("SELECT count(*) FROM files WHERE content IS NOT NULL AND content != ''").Scan(&stored); err != nil || stored != 0 {
+		t.Errorf("--no-store-content stored the content of %d books (%v)", stored, err)
+	}
+	if n := chunkCount(t, db, 1); n != 3 {
+		t.Errorf("--no-store-content gave Emma %d chunks", n)
+	}
+}
+
+func TestPipelineFailures(t *testing.T) {
+	root := writeRunMirror(t)
+	for _, bad := range []string{"6/66.zip", "7/77.zip"} {
+		path := filepath.Join(root, bad)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("PK\x03\x04 not really a zip"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db := testDB(t)
+	// fewer places in the pipe than archives
+	_, err := captureStdout(t, func() error { return runCmd([]string{"--target", root, "--pipeline", "--workers", "2"}) })
+	if exitCode(err) != exitPartial || !strings.Contains(err.Error(), "2 of 7 archives failed") {
+		t.Errorf("running with two bad archives: %v", err)
+	}
+	var books int
+	if err = db.QueryRow("SELECT count(*) FROM files").Scan(&books); err != nil || books != 4 {
+		t.Errorf("stored %d books past the bad archives, want 4", books)
+	}
+}
+
+// lineDiff is the lines of b not in a and of a not in b.
+func lineDiff(a, b string) string {
+	in := func(s string) map[string]bool {
+		m := map[string]bool{}
+		for _, l := range strings.Split(s, "\n") {
+			m[l] = true
+		}
+		return m
+	}
+	ina, inb := in(a), in(b)
+	var d []string
+	for _, l := range strings.Split(b, "\n") {
+		if !ina[l] {
+			d = append(d, "+ "+l)
+		}
+	}
+	for _, l := range strings.Split(a, "\n") {
+		if !inb[l] {
+			d = append(d, "- "+l)
+		}
+	}
+	return strings.Join(d, "\n")
+}
@@ -0,0 +1,398 @@
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ingest --from-url fetches from mirrors run by volunteers, and keeps to
+// what they ask of it. Every request of every worker, redirects too, waits
+// its turn with one pacer: --delay apart from any other, --host-delay apart
+// from another to the same host, and, once a host answers 429 or 503 with a
+// Retry-After, not before then to that host, for all the workers rather than
+// the one that was told. --max-rate caps the bytes a second read by them all
+// at once, a bucket of a second's worth that each read takes from and waits
+// on when it's empty. --concurrency caps how many downloads are in flight.
+//
+// Before fetching, ingest reads the robots.txt of the mirror's host, and
+// warns once if its rules for gutchunk, or for * without any, disallow a
+// path it fetches; a Crawl-delay longer than --host-delay is kept to.
+//
+// A download is written to a .part file beside where it goes, with what the
+// mirror gave to tell its version by, its ETag or Last-Modified, in a .tag
+// file beside that. A retry asks for the rest, from where the part stops,
+// if the file is still that version, which under --cache-dir holds from one
+// run to the next too, so an aborted fetch goes on where it stopped rather
+// than from the start of the book it was in. Each run ends with how much it
+// downloaded in how many requests, and how long the workers waited on the
+// limits between them.
+
+// politeness is the pacer, bandwidth limit and counts shared by the
+// workers of a fetch.
+type politeness struct {
+	mu        sync.Mutex
+	delay     time.Duration
+	hostDelay time.Duration
+	next      time.Time
+	// hosts are when each host may next be asked, holds until when one
+	// asked not to be with Retry-After, and crawlDelays the hosts whose
+	// robots.txt asks for longer than hostDelay
+	hosts       map[string]time.Time
+	holds       map[string]time.Time
+	crawlDelays map[string]time.Duration
+	rate        *byteRate
+	robots      *robotsRules
+	warnRobots  sync.Once
+
+	requests   int64
+	bytes      int64
+	throttled  int64 // nanoseconds, summed over workers
+	disallowed int64
+}
+
+func newPoliteness(delay, hostDelay time.Duration, maxRate int64) *politeness {
+	p := &politeness{
+		delay:       delay,
+		hostDelay:   hostDelay,
+		hosts:       map[string]time.Time{},
+		holds:       map[string]time.Time{},
+		crawlDelays: map[string]time.Duration{},
+	}
+	if maxRate > 0 {
+		p.rate = &byteRate{rate: float64(maxRate), b: bucket{tokens: float64(maxRate), last: time.Now()}}
+	}
+	return p
+}
+
+// parseRate parses a rate of bytes like "2MB/s", or "0" for none.
+func parseRate(s string) (int64, error) {
+	n, err := parseSize(strings.TrimSuffix(strings.TrimSpace(s), "/s"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q; want one like 2MB/s", s)
+	}
+	return n, nil
+}
+
+// wait waits for the turn of a request to host, and counts it. A turn
+// come after a hold was put on the host while waiting for it is given up,
+// and another waited for after the hold.
+func (p *politeness) wait(host string) {
+	for {
+		p.mu.Lock()
+		now := time.Now()
+		at := now
+		for _, t := range []time.Time{p.next, p.hosts[host], p.holds[host]} {
+			if t.After(at) {
+				at = t
+			}
+		}
+		p.next = at.Add(p.delay)
+		gap := p.hostDelay
+		if d := p.crawlDelays[host]; d > gap {
+			gap = d
+		}
+		p.hosts[host] = at.Add(gap)
+		p.mu.Unlock()
+
+		p.sleep(at.Sub(now))
+		p.mu.Lock()
+		held := p.holds[host].After(at)
+		p.mu.Unlock()
+		if !held {
+			break
+		}
+	}
+	atomic.AddInt64(&p.requests, 1)
+}
+
+// hold keeps every worker from asking host again for d.
+func (p *politeness) hold(host string, d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if until := time.Now().Add(d); until.After(p.holds[host]) {
+		p.holds[host] = until
+	}
+}
+
+func (p *politeness) sleep(d time.Duration) {
+	if d > 0 {
+		atomic.AddInt64(&p.throttled, int64(d))
+		time.Sleep(d)
+	}
+}
+
+// client is an http client whose redirects wait their turn too.
+func (p *politeness) client(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			p.wait(req.URL.Host)
+			return nil
+		},
+	}
+}
+
+// reader counts what is read from r, keeping to --max-rate.
+func (p *politeness) reader(r io.Reader) io.Reader {
+	return &limitedReader{r: r, p: p}
+}
+
+// summary is how much was fetched, and how long was spent waiting.
+func (p *politeness) summary() string {
+	s := fmt.Sprintf("downloaded %s in %d requests; the workers waited %s in all on the limits",
+		formatSize(atomic.LoadInt64(&p.bytes)), atomic.LoadInt64(&p.requests),
+		time.Duration(atomic.LoadInt64(&p.throttled)).Round(time.Millisecond))
+	if n := atomic.LoadInt64(&p.disallowed); n > 0 {
+		s += fmt.Sprintf("; %d of the files fetched are disallowed by robots.txt", n)
+	}
+	return s
+}
+
+// byteRate is a token bucket of bytes, as limiter's are of requests,
+// holding a second's worth at most.
+type byteRate struct {
+	mu   sync.Mutex
+	rate float64
+	b    bucket
+}
+
+// take takes n bytes from the bucket, and is how long to wait for them
+// when it hasn't that many; what one read waits for the next waits after.
+func (r *byteRate) take(n int) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.b.tokens = math.Min(r.rate, r.b.tokens+now.Sub(r.b.last).Seconds()*r.rate)
+	r.b.last = now
+	r.b.tokens -= float64(n)
+	if r.b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-r.b.tokens / r.rate * float64(time.Second))
+}
+
+type limitedReader struct {
+	r io.Reader
+	p *politeness
+}
+
+// Read reads 32KB at most at a time, so a slow rate is kept to smoothly.
+func (l *limitedReader) Read(b []byte) (int, error) {
+	if l.p.rate != nil && len(b) > 32<<10 {
+		b = b[:32<<10]
+	}
+	n, err := l.r.Read(b)
+	atomic.AddInt64(&l.p.bytes, int64(n))
+	if l.p.rate != nil && n > 0 {
+		l.p.sleep(l.p.rate.take(n))
+	}
+	return n, err
+}
+
+// retryAfter is a transient failure whose response said how long to wait
+// before asking again.
+type retryAfter struct {
+	status string
+	wait   time.Duration
+}
+
+func (r retryAfter) Error() string {
+	return fmt.Sprintf("%s, asked to retry after %s", r.status, r.wait)
+}
+
+func (r retryAfter) Unwrap() error { return errTransient }
+
+// parseRetryAfter is how long a Retry-After header, in seconds or an http
+// date, asks for.
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	if n, err := strconv.Atoi(v); err == nil {
+		if n < 0 {
+			return 0, false
+		}
+		return time.Duration(n) * time.Second, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	if d := t.Sub(now); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
+
+// robotsRules are the allow and disallow rules of a robots.txt for one
+// user agent.
+type robotsRules struct {
+	host  string
+	rules []robotsRule
+}
+
+type robotsRule struct {
+	allow   bool
+	pattern string
+	re      *regexp.Regexp
+}
+
+// parseRobots reads the rules of robots.txt for agent, gathering every
+// group naming it, else every group for *, and its Crawl-delay.
+func parseRobots(r io.Reader, agent string) ([]robotsRule, time.Duration) {
+	type group struct {
+		rules []robotsRule
+		delay time.Duration
+	}
+	var mine, all group
+	var agents []string
+	inRules, named := false, false
+	s := bufio.NewScanner(io.LimitReader(r, 512<<10))
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		if key == "user-agent" {
+			if inRules {
+				agents, inRules = nil, false
+			}
+			agents = append(agents, strings.ToLower(value))
+			continue
+		}
+		inRules = true
+		var to []*group
+		for _, a := range agents {
+			if a == agent {
+				named = true
+				to = append(to, &mine)
+			} else if a == "*" {
+				to = append(to, &all)
+			}
+		}
+		for _, g := range to {
+			switch key {
+			case "allow", "disallow":
+				if value != "" {
+					g.rules = append(g.rules, robotsRule{allow: key == "allow", pattern: value, re: robotsPattern(value)})
+				}
+			case "crawl-delay":
+				if secs, err := strconv.ParseFloat(value, 64); err == nil && secs > 0 {
+					g.delay = time.Duration(secs * float64(time.Second))
+				}
+			}
+		}
+	}
+	if named {
+		return mine.rules, mine.delay
+	}
+	return all.rules, all.delay
+}
+
+// robotsPattern is the regexp of a rule's path, where * is anything and a
+// $ at the end ends the path.
+func robotsPattern(pattern string) *regexp.Regexp {
+	end := strings.HasSuffix(pattern, "$")
+	pattern = strings.TrimSuffix(pattern, "$")
+	parts := strings.Split(pattern, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	expr := "^" + strings.Join(parts, ".*")
+	if end {
+		expr += "$"
+	}
+	return regexp.MustCompile(expr)
+}
+
+// disallows is the rule disallowing path, if any: that of the longest
+// pattern matching it, an allow winning a tie.
+func (r *robotsRules) disallows(path string) (string, bool) {
+	var best *robotsRule
+	for i := range r.rules {
+		rule := &r.rules[i]
+		if !rule.re.MatchString(path) {
+			continue
+		}
+		if best == nil || len(rule.pattern) > len(best.pattern) || len(rule.pattern) == len(best.pattern) && rule.allow {
+			best = rule
+		}
+	}
+	if best == nil || best.allow {
+		return "", false
+	}
+	return best.pattern, true
+}
+
+// readRobots reads the robots.txt of base's host, keeping to its
+// Crawl-delay. One that can't be read is taken to allow everything.
+func (p *politeness) readRobots(base string, f fetcher) {
+	u, err := url.Parse(base)
+	if err != nil || u.Host == "" {
+		return
+	}
+	robotsURL := (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/robots.txt"}).String()
+	p.wait(u.Host)
+	got, err := f.fetch(robotsURL, 0, "")
+	if err != nil {
+		if !errors.Is(err, errNotFound) {
+			fmt.Printf("could not read %s, taking it to allow everything: %v\n", robotsURL, err)
+		}
+		return
+	}
+	defer got.body.Close()
+	rules, delay := parseRobots(p.reader(got.body), "gutchunk")
+	p.robots = &robotsRules{host: u.Host, rules: rules}
+	if delay > p.hostDelay {
+		fmt.Printf("%s asks for %s between requests; keeping to it\n", robotsURL, delay)
+		p.mu.Lock()
+		p.crawlDelays[u.Host] = delay
+		// from robots.txt itself too
+		if next := time.Now().Add(delay); next.After(p.hosts[u.Host]) {
+			p.hosts[u.Host] = next
+		}
+		p.mu.Unlock()
+	}
+}
+
+// checkRobots warns, the first time, that robots.txt disallows fetching
+// rawURL.
+func (p *politeness) checkRobots(rawURL string) {
+	if p.robots == nil {
+		return
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host != p.robots.host {
+		return
+	}
+	pattern, ok := p.robots.disallows(u.EscapedPath())
+	if !ok {
+		return
+	}
+	atomic.AddInt64(&p.disallowed, 1)
+	p.warnRobots.Do(func() {
+		fmt.Fprintf(os.Stderr, "warning: the robots.txt of %s disallows %s (Disallow: %s), fetched anyway; the end of the run counts the files it disallows\n", u.Host, u.EscapedPath(), pattern)
+	})
+}
@@ -0,0 +1,431 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	for v, want := range map[string]time.Duration{
+		"5":                             5 * time.Second,
+		" 0 ":                           0,
+		"Wed, 14 Oct 2026 12:00:30 GMT": 30 * time.Second,
+		"Wed, 14 Oct 2026 11:00:00 GMT": 0,
+	} {
+		if got, ok := parseRetryAfter(v, now); !ok || got != want {
+			t.Errorf("parseRetryAfter(%q) = %s, %v, want %s", v, got, ok, want)
+		}
+	}
+	for _, v := range []string{"", "-1", "soon", "1.5"} {
+		if got, ok := parseRetryAfter(v, now); ok {
+			t.Errorf("parseRetryAfter(%q) = %s, want none", v, got)
+		}
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	for s, want := range map[string]int64{"2MB/s": 2 << 20, "512kb/s": 512 << 10, "100": 100, "0": 0} {
+		if got, err := parseRate(s); err != nil || got != want {
+			t.Errorf("parseRate(%q) = %d (%v), want %d", s, got, err, want)
+		}
+	}
+	if _, err := parseRate("fast"); err == nil || !strings.Contains(err.Error(), "like 2MB/s") {
+		t.Errorf("parseRate(fast): %v", err)
+	}
+}
+
+func TestParseRobots(t *testing.T) {
+	const robots = `# the mirror's
+User-agent: *
+Disallow: /private/
+Crawl-delay: 10
+
+User-agent: Gutchunk
+User-agent: other
+Disallow: /cache/
+Allow: /cache/epub/
+Disallow: /*.zip$
+Allow: /1/*.zip$
+Crawl-delay: 0.5
+
+user-agent: gutchunk
+disallow: /tmp  # a second group of it
+Disallow:
+`
+	rules, delay := parseRobots(strings.NewReader(robots), "gutchunk")
+	if delay != 500*time.Millisecond {
+		t.Errorf("the crawl delay is %s", delay)
+	}
+	var patterns []string
+	for _, r := range rules {
+		patterns = append(patterns, fmt.Sprintf("%v %s", r.allow, r.pattern))
+	}
+	if want := []string{"false /cache/", "true /cache/epub/", "false /*.zip$", "true /1/*.zip$", "false /tmp"}; !reflect.DeepEqual(patterns, want) {
+		t.Errorf("the rules are %q, want %q", patterns, want)
+	}
+	r := robotsRules{rules: rules}
+	for path, want := range map[string]string{
+		"/cache/x.txt":       "/cache/",
+		"/cache/epub/12.zip": "",
+		"/2/12/12.zip":       "/*.zip$",
+		"/2/12/12.zip.txt":   "",
+		"/1/2/123/123.zip":   "",
+		"/tmpfile":           "/tmp",
+		"/private/x":         "",
+	} {
+		if got, ok := r.disallows(path); got != want || ok != (want != "") {
+			t.Errorf("disallows(%s) = %q, %v, want %q", path, got, ok, want)
+		}
+	}
+
+	// with no group of its own, gutchunk keeps to *'s
+	rules, delay = parseRobots(strings.NewReader(robots), "somebot")
+	if len(rules) != 1 || rules[0].pattern != "/private/" || delay != 10*time.Second {
+		t.Errorf("the rules for another agent are %+v, %s", rules, delay)
+	}
+	if rules, delay = parseRobots(strings.NewReader("<html>no robots here</html>\n"), "gutchunk"); rules != nil || delay != 0 {
+		t.Errorf("the rules of a page that isn't robots.txt are %+v, %s", rules, delay)
+	}
+}
+
+// turns is when waits of p for each of hosts, at once, got their turns,
+// from before the first, in order.
+func turns(p *politeness, hosts ...string) []time.Duration {
+	start := time.Now()
+	at := make([]time.Duration, len(hosts))
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			p.wait(host)
+			at[i] = time.Since(start)
+		}(i, host)
+	}
+	wg.Wait()
+	sort.Slice(at, func(i, j int) bool { return at[i] < at[j] })
+	return at
+}
+
+// spaced checks that at are gap apart at least, but for slack.
+func spaced(t *testing.T, what string, at []time.Duration, gap time.Duration) {
+	t.Helper()
+	for i := 1; i < len(at); i++ {
+		if at[i]-at[i-1] < gap-15*time.Millisecond {
+			t.Errorf("%s, the turns were at %v, want them %s apart", what, at, gap)
+			return
+		}
+	}
+}
+
+func TestPoliteWait(t *testing.T) {
+	// every request delay apart, and host delay apart to one host
+	p := newPoliteness(20*time.Millisecond, 80*time.Millisecond, 0)
+	spaced(t, "to one host", turns(p, "a", "a", "a", "a"), 80*time.Millisecond)
+	at := turns(p, "b", "b", "b", "b")
+	spaced(t, "to another", at, 80*time.Millisecond)
+	if at[0] > 40*time.Millisecond {
+		t.Errorf("the first turn to another host waited %s", at[0])
+	}
+	p = newPoliteness(40*time.Millisecond, 0, 0)
+	spaced(t, "to any hosts", turns(p, "a", "b", "a", "b", "c", "a"), 40*time.Millisecond)
+
+	// a hold keeps every worker off the host, and them alone
+	p = newPoliteness(0, 50*time.Millisecond, 0)
+	start := time.Now()
+	p.wait("a")
+	done := make(chan time.Duration)
+	go func() {
+		// its turn, at 50ms, is given up for one after the hold
+		p.wait("a")
+		done <- time.Since(start)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	p.hold("a", 200*time.Millisecond)
+	p.hold("a", 10*time.Millisecond)
+	if at := turns(p, "b", "b"); at[1] > 100*time.Millisecond {
+		t.Errorf("another host, the turns waited %v for the hold", at)
+	}
+	if at := <-done; at < 220*time.Millisecond-5*time.Millisecond {
+		t.Errorf("a turn come during the hold was taken at %s", at)
+	}
+	if at := turns(p, "a"); at[0] < 40*time.Millisecond {
+		t.Errorf("after the hold, the next turn waited %s", at[0])
+	}
+	if p.requests != 5 {
+		t.Errorf("%d requests were counted, want 5", p.requests)
+	}
+	if !strings.HasPrefix(p.summary(), "downloaded 0B in 5 requests; the workers waited ") {
+		t.Errorf("summary = %q", p.summary())
+	}
+}
+
+func TestPoliteMaxRate(t *testing.T) {
+	// a second's worth is there at once, and the rest at the rate by all
+	// the readers together
+	p := newPoliteness(0, 0, 1<<20)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if n, err := io.Copy(io.Discard, p.reader(bytes.NewReader(make([]byte, 512<<10)))); err != nil || n != 512<<10 {
+				t.Errorf("read %d bytes (%v)", n, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if took := time.Since(start); took < 450*time.Millisecond || took > 2*time.Second {
+		t.Errorf("1.5MB at 1MB/s took %s", took)
+	}
+	if p.bytes != 3*512<<10 || p.throttled == 0 {
+		t.Errorf("counted %d bytes, waiting %s", p.bytes, time.Duration(p.throttled))
+	}
+
+	// with no limit, none is waited for
+	p = newPoliteness(0, 0, 0)
+	start = time.Now()
+	if _, err := io.Copy(io.Discard, p.reader(bytes.NewReader(make([]byte, 4<<20)))); err != nil || time.Since(start) > time.Second || p.throttled != 0 {
+		t.Errorf("4MB unlimited took %s, waiting %s (%v)", time.Since(start), time.Duration(p.throttled), err)
+	}
+}
+
+// politeMirror is a fakeMirror that serves robots.txt, with an ETag and
+// ranges, answers the first request for the paths in tooMany with a 429
+// and a Retry-After of so many seconds, and cuts off halfway the first
+// answer for those in cut, logging every request.
+type politeMirror struct {
+	*fakeMirror
+	robots  string
+	tooMany map[string]int
+	cut     map[string]bool
+	log     []hit
+}
+
+type hit struct {
+	path, rangeOf string
+	at            time.Time
+	status        int
+}
+
+func (m *politeMirror) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	m.requests[r.URL.Path]++
+	n := m.requests[r.URL.Path]
+	b, ok := m.files[r.URL.Path]
+	h := hit{path: r.URL.Path, rangeOf: r.Header.Get("Range"), at: time.Now(), status: http.StatusOK}
+	defer func() {
+		m.mu.Lock()
+		m.log = append(m.log, h)
+		m.mu.Unlock()
+	}()
+	m.mu.Unlock()
+	switch {
+	case r.URL.Path == "/robots.txt" && m.robots != "":
+		io.WriteString(w, m.robots)
+	case !ok:
+		h.status = http.StatusNotFound
+		http.NotFound(w, r)
+	case n == 1 && m.tooMany[r.URL.Path] > 0:
+		h.status = http.StatusTooManyRequests
+		w.Header().Set("Retry-After", fmt.Sprint(m.tooMany[r.URL.Path]))
+		w.WriteHeader(http.StatusTooManyRequests)
+	case n == 1 && m.cut[r.URL.Path]:
+		h.status = -1
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", fmt.Sprint(len(b)))
+		w.Write(b[:len(b)/2])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	default:
+		w.Header().Set("ETag", `"v1"`)
+		rw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		http.ServeContent(rw, r, "", time.Time{}, bytes.NewReader(b))
+		h.status = rw.status
+	}
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (m *politeMirror) hits(path string) []hit {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var hits []hit
+	for _, h := range m.log {
+		if path == "" || h.path == path {
+			hits = append(hits, h)
+		}
+	}
+	return hits
+}
+
+func politeOpts(url string, concurrency int) remoteOptions {
+	ro := remoteOptions{base: url, concurrency: concurrency, retries: 2}
+	ro.polite = newPoliteness(0, 0, 0)
+	ro.fetch = httpFetcher{ro.polite.client(time.Minute)}
+	return ro
+}
+
+func TestReadRemotePolitely(t *testing.T) {
+	books := map[string]string{}
+	var ids []int
+	for n := 12; n < 18; n++ {
+		books[fmt.Sprintf("1/%d/%d.zip", n, n)] = fmt.Sprint("Book ", n)
+		ids = append(ids, n)
+	}
+	m := &politeMirror{fakeMirror: newFakeMirror(t, books), tooMany: map[string]int{"/1/13/13.zip": 1},
+		robots: "User-agent: *\nDisallow: /1/15/\nDisallow: /1/16/\nCrawl-delay: 0.06\n"}
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	t.Setenv("TMPDIR", t.TempDir())
+	db := testDB(t)
+
+	var out string
+	errs, err := captureStderr(t, func() error {
+		var err error
+		out, err = captureStdout(t, func() error { return readRemote(db, ids, ingestOptions{}, politeOpts(srv.URL, 3)) })
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(ingestRows(t, db)); got != 6 {
+		t.Errorf("ingested %d books, want 6", got)
+	}
+
+	// every worker keeps to the crawl delay, and off the host while it
+	// is held
+	hits := m.hits("")
+	if len(hits) != 8 || hits[0].path != "/robots.txt" {
+		t.Fatalf("the mirror was asked for %+v", hits)
+	}
+	var held time.Time
+	for i, h := range hits {
+		if i > 0 && h.at.Sub(hits[i-1].at) < 45*time.Millisecond {
+			t.Errorf("%s was asked for %s after %s", h.path, h.at.Sub(hits[i-1].at), hits[i-1].path)
+		}
+		if h.status == http.StatusTooManyRequests {
+			held = h.at
+		} else if !held.IsZero() && h.at.Sub(held) < 950*time.Millisecond {
+			t.Errorf("%s was asked for %s into the hold of a second", h.path, h.at.Sub(held))
+		}
+	}
+	if held.IsZero() {
+		t.Error("the mirror never answered 429")
+	}
+
+	size := int64(len(m.robots))
+	for _, b := range m.files {
+		size += int64(len(b))
+	}
+	for _, want := range []string{
+		srv.URL + "/robots.txt asks for 60ms between requests; keeping to it\n",
+		fmt.Sprintf("downloaded %s in 8 requests; the workers waited ", formatSize(size)),
+		" in all on the limits; 2 of the files fetched are disallowed by robots.txt\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("readRemote printed\n%s\nwant it to say %q", out, want)
+		}
+	}
+	host := strings.TrimPrefix(srv.URL, "http://")
+	if strings.Count(errs, "warning: ") != 1 || !strings.Contains(errs, "warning: the robots.txt of "+host+" disallows /1/1") {
+		t.Errorf("readRemote warned\n%s", errs)
+	}
+}
+
+func TestReadRemoteResumes(t *testing.T) {
+	m := &politeMirror{fakeMirror: newFakeMirror(t, map[string]string{
+		"1/12/12.zip": "Cut off", "1/13/13.zip": "Part left", "1/14/14.zip": "Part changed", "1/15/15.zip": "Part too long",
+	}), cut: map[string]bool{"/1/12/12.zip": true}}
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	ro := politeOpts(srv.URL, 1)
+	ro.cacheDir = t.TempDir()
+	// parts an earlier run left: one of the version served, one of another
+	// and one longer than the file
+	part := func(n int, size int, tag string) {
+		t.Helper()
+		file := filepath.Join(ro.cacheDir, "1", fmt.Sprint(n), fmt.Sprintf("%d.zip.part", n))
+		b := m.files[fmt.Sprintf("/1/%d/%d.zip", n, n)]
+		if size > len(b) {
+			b = append(b, make([]byte, size-len(b))...)
+		}
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, b[:size], 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file+".tag", []byte(tag), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	part(13, 100, `"v1"`)
+	part(14, 100, `"v0"`)
+	part(15, len(m.files["/1/15/15.zip"])+10, `"v1"`)
+
+	db := testDB(t)
+	if _, err := captureStdout(t, func() error { return readRemote(db, []int{12, 13, 14, 15}, ingestOptions{}, ro) }); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(ingestRows(t, db)); got != 4 {
+		t.Errorf("ingested %d books, want 4", got)
+	}
+	var requests []string
+	for _, p := range []string{"/1/12/12.zip", "/1/13/13.zip", "/1/14/14.zip", "/1/15/15.zip"} {
+		var of []string
+		for _, h := range m.hits(p) {
+			of = append(of, fmt.Sprintf("%d %s", h.status, h.rangeOf))
+		}
+		requests = append(requests, p+": "+strings.Join(of, ", "))
+	}
+	want := []string{
+		// cut off, it goes on from where it stopped
+		fmt.Sprintf("/1/12/12.zip: -1 , 206 bytes=%d-", len(m.files["/1/12/12.zip"])/2),
+		"/1/13/13.zip: 206 bytes=100-",
+		// changed since, the mirror sends it whole
+		"/1/14/14.zip: 200 bytes=100-",
+		// and one it can't go on with is started over
+		fmt.Sprintf("/1/15/15.zip: 416 bytes=%d-, 200 ", len(m.files["/1/15/15.zip"])+10),
+	}
+	if !reflect.DeepEqual(requests, want) {
+		t.Errorf("the mirror was asked for\n%s\nwant\n%s", strings.Join(requests, "\n"), strings.Join(want, "\n"))
+	}
+	for p, b := range m.files {
+		got, err := os.ReadFile(filepath.Join(ro.cacheDir, filepath.FromSlash(p)))
+		if err != nil || !bytes.Equal(got, b) {
+			t.Errorf("%s was saved as %d bytes, want %d (%v)", p, len(got), len(b), err)
+		}
+	}
+	var left []string
+	filepath.WalkDir(ro.cacheDir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && strings.Contains(path, ".part") {
+			left = append(left, path)
+		}
+		return err
+	})
+	if len(left) > 0 {
+		t.Errorf("parts were left: %v", left)
+	}
+}
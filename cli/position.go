@@ -0,0 +1,81 @@
+package cli
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// chunks.position_pct is how far through its book a chunk is: the byte
+// offset of its middle in the body, between the header and the footer,
+// over the body's length, so 0 is the opening lines and 1 the closing
+// ones. A book of one chunk has it at 0.5. Chunking sets it; chunks made
+// before it was kept are given (ordinal + 0.5) / chunks by migrate, as
+// good as the book's paragraphs are even. random, serve and export take
+// --position 0.9-1.0 for the chunks in that stretch of their books, and
+// stats --positions shows how the chunks of the library fall through
+// them.
+
+// positionRange is a --position, FROM-TO.
+type positionRange struct {
+	from, to float64
+	set      bool
+}
+
+func (r positionRange) String() string {
+	return strconv.FormatFloat(r.from, 'f', -1, 64) + "-" + strconv.FormatFloat(r.to, 'f', -1, 64)
+}
+
+var positionSpec = regexp.MustCompile(`^(\d*\.?\d+)-(\d*\.?\d+)$`)
+
+// parsePosition parses a --position, FROM-TO with both from 0 to 1.
+func parsePosition(s string) (positionRange, error) {
+	m := positionSpec.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return positionRange{}, fmt.Errorf("bad position %q; give it as 0.9-1.0", s)
+	}
+	from, _ := strconv.ParseFloat(m[1], 64)
+	to, _ := strconv.ParseFloat(m[2], 64)
+	if to > 1 {
+		return positionRange{}, fmt.Errorf("bad position %q; positions go from 0 to 1", s)
+	}
+	if to < from {
+		return positionRange{}, fmt.Errorf("bad position %q; %s is after %s", s, m[1], m[2])
+	}
+	return positionRange{from, to, true}, nil
+}
+
+// fillPositions gives the chunks chunked before position_pct was kept
+// one from their ordinals.
+func fillPositions(db *sql.DB) error {
+	_, err := db.Exec(`UPDATE chunks SET position_pct = (
+			SELECT CASE WHEN b.n = 1 THEN 0.5 ELSE (chunks.ordinal + 0.5) / b.n END
+			FROM (SELECT count(*) AS n FROM chunks o WHERE o.sourceid = chunks.sourceid) b)
+		WHERE position_pct IS NULL AND ordinal IS NOT NULL`)
+	return err
+}
+
+// positionTenths counts the chunks of the books from source, or from
+// everywhere when source is 0, by the tenth of their book they are in.
+func positionTenths(db *sql.DB, source int) ([10]int, error) {
+	var tenths [10]int
+	arms, args := eachShard(`SELECT min(9, CAST(c.position_pct * 10 AS INTEGER)) AS tenth, count(*) AS n FROM %s c
+		WHERE c.position_pct IS NOT NULL
+			AND c.sourceid IN (SELECT id FROM files WHERE (? = 0 OR source_id = ?) AND deleted_at IS NULL)
+		GROUP BY tenth`, source, source)
+	rows, err := db.Query("SELECT tenth, sum(n) FROM ("+arms+") GROUP BY tenth", args...)
+	if err != nil {
+		return tenths, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tenth, n int
+		if err = rows.Scan(&tenth, &n); err != nil {
+			return tenths, err
+		}
+		tenths[tenth] = n
+	}
+	return tenths, rows.Err()
+}
@@ -0,0 +1,121 @@
+package cli
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestParsePosition(t *testing.T) {
+	for in, want := range map[string]positionRange{
+		"0.9-1.0":   {0.9, 1, true},
+		" 0-.1 ":    {0, 0.1, true},
+		"0.5-0.5":   {0.5, 0.5, true},
+		"0.25-0.75": {0.25, 0.75, true},
+	} {
+		if got, err := parsePosition(in); err != nil || got != want {
+			t.Errorf("parsePosition(%q) = %v, %v, want %v", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "0.9", "0.9-1.1", "1-0.5", "-0.1-0.2", "a-b", "90%-100%"} {
+		if got, err := parsePosition(in); err == nil {
+			t.Errorf("parsePosition(%q) = %v", in, got)
+		}
+	}
+}
+
+func TestChunkPositions(t *testing.T) {
+	// a body of a blank line, 304 bytes, a blank, 994 bytes and a blank
+	// is 1303 bytes with the lines' ends, its chunks' middles at bytes
+	// 153 and 804
+	short := strings.Repeat("word ", 60) + "end."
+	long := strings.Repeat("more words ", 90) + "end."
+	want := []float64{153.0 / 1303, 804.0 / 1303}
+	for _, content := range []string{
+		testBook("Uneven", short+"\n\n"+long),
+		// however long the header and the license
+		strings.Repeat("A line of the header, at some length.\n", 40) + testBook("Uneven", short+"\n\n"+long) + strings.Repeat("A line of the license.\n", 300),
+	} {
+		chunks, at, _, _ := splitBookAt(content, chunkOptions{})
+		if len(chunks) != 2 {
+			t.Fatalf("split into %d chunks", len(chunks))
+		}
+		for i, p := range at {
+			if math.Abs(p.position-want[i]) > 1e-9 {
+				t.Errorf("chunk %d is at %.4f, want %.4f", i, p.position, want[i])
+			}
+		}
+	}
+
+	// evenly, the middles of quarters
+	_, at, _, _ := splitBookAt(testBook("Even", testParagraphs(4)), chunkOptions{})
+	for i, p := range at {
+		if want := (float64(i) + 0.5) / 4; math.Abs(p.position-want) > 0.005 {
+			t.Errorf("chunk %d of 4 even ones is at %.4f, want about %.3f", i, p.position, want)
+		}
+	}
+	if _, at, _, _ = splitBookAt(testBook("One", testParagraphs(1)), chunkOptions{}); len(at) != 1 || at[0].position != 0.5 {
+		t.Errorf("one chunk is at %+v, want 0.5", at)
+	}
+}
+
+func TestFillPositions(t *testing.T) {
+	db := testDB(t)
+	four := addBook(t, db, "Four", "", "")
+	for i := 0; i < 4; i++ {
+		insertChunk(t, db, four, i, "A chunk.")
+	}
+	one := addBook(t, db, "One", "", "")
+	insertChunk(t, db, one, 0, "A chunk.")
+	// a chunk chunking placed is left where it is
+	if _, err := db.Exec("UPDATE chunks SET position_pct = 0.99 WHERE id = 4"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fillPositions(db); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(t, db, "SELECT printf('%.3f', position_pct) FROM chunks ORDER BY id"); got != "0.125\n0.375\n0.625\n0.990\n0.500\n" {
+		t.Errorf("filled, the chunks are at\n%s", got)
+	}
+}
+
+func TestPositionFilters(t *testing.T) {
+	db := testDB(t)
+	for _, title := range []string{"Emma", "Persuasion"} {
+		addBook(t, db, title, "Jane Austen", testBook(title, testParagraphs(10)))
+	}
+	if _, err := captureStdout(t, func() error { return makeChunks(db, chunkOptions{}) }); err != nil {
+		t.Fatal(err)
+	}
+	count := func(args ...string) int {
+		t.Helper()
+		return len(exported(t, args...))
+	}
+	for pos, want := range map[string]int{"0-1": 20, "0.9-1.0": 2, "0.0-0.1": 2, "0.4-0.6": 4, "0.2-0.21": 0} {
+		if got := count("--position", pos); got != want {
+			t.Errorf("export --position %s wrote %d chunks, want %d", pos, got, want)
+		}
+	}
+	if got := count("--filter", "position:0.9..1.0"); got != 2 {
+		t.Errorf("export --filter position:0.9..1.0 wrote %d chunks", got)
+	}
+	out, err := captureStdout(t, func() error { return randomCmd([]string{"--position", "0.9-1.0", "--width", "0"}) })
+	if err != nil || !strings.Contains(out, "number iiiiiiiiii,") {
+		t.Errorf("random --position 0.9-1.0 drew %q (%v)", out, err)
+	}
+	for _, args := range [][]string{{"--position", "1-0"}, {"--position", "0.1"}} {
+		if _, err = captureStdout(t, func() error { return exportCmd(args) }); exitCode(err) != exitUsage {
+			t.Errorf("export %s: %v, want a usage error", strings.Join(args, " "), err)
+		}
+	}
+
+	out, err = captureStdout(t, func() error { return statsCmd([]string{"--positions"}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"chunks by position in their books:\n", "  0.0-0.1:       2  10.0%\n", "  0.9-1.0:       2  10.0%\n"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("stats --positions printed\n%s\nwant %q", out, want)
+		}
+	}
+}
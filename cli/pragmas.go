@@ -0,0 +1,111 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// A pragma only holds for the connection it runs on, and database/sql
+// keeps a pool of them, so a db.Exec("PRAGMA ...") after opening sets it
+// on whichever connection ran it. connector sets these on every
+// connection as it is opened instead, whichever driver opened it, and
+// openDB checks that they took.
+
+type pragma struct{ name, value string }
+
+// busyTimeout is how long a connection waits on another's lock: the
+// driver's default, or --db-timeout.
+func busyTimeout() time.Duration {
+	if *dbTimeout > 0 {
+		return *dbTimeout
+	}
+	return 5 * time.Second
+}
+
+func (o connOptions) pragmas() []pragma {
+	fk := "0"
+	if o.foreignKeys {
+		fk = "1"
+	}
+	busy := o.busy
+	if busy == 0 {
+		busy = busyTimeout()
+	}
+	return []pragma{
+		{"foreign_keys", fk},
+		{"busy_timeout", strconv.FormatInt(busy.Milliseconds(), 10)},
+		// the wal is cut back as it restarts after a checkpoint, so its
+		// file is as large as what it holds, which checkpoint.go goes by
+		{"journal_size_limit", "0"},
+	}
+}
+
+func setPragmas(c *sqlite3.SQLiteConn, pragmas []pragma) error {
+	for _, p := range pragmas {
+		if _, err := c.Exec(fmt.Sprintf("PRAGMA %s = %s", p.name, p.value), nil); err != nil {
+			return fmt.Errorf("could not set %s: %w", p.name, err)
+		}
+	}
+	return nil
+}
+
+// checkConnections takes n connections from db at once, so the pool must
+// open new ones rather than hand back the one it has, and checks that each
+// reports pragmas as set.
+func checkConnections(db *sql.DB, pragmas []pragma, n int) error {
+	ctx := context.Background()
+	conns := make([]*sql.Conn, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range conns {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, err := db.Conn(ctx)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			conns[i] = c
+			for _, p := range pragmas {
+				var got string
+				if err = c.QueryRowContext(ctx, "PRAGMA "+p.name).Scan(&got); err != nil {
+					errs[i] = err
+					return
+				}
+				if got != p.value {
+					errs[i] = fmt.Errorf("connection %d has %s = %s, not %s", i+1, p.name, got, p.value)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, c := range conns {
+		if c != nil {
+			c.Close()
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			return fmt.Errorf("checking connection pragmas: %w", err)
+		}
+	}
+	return nil
+}
+
+// chunksKeyed reports whether chunks' foreign key can be enforced. Before
+// it named files(id) it named files(sourceid), which doesn't exist, and
+// with foreign keys on sqlite refuses every write to a table whose key
+// names no key.
+func chunksKeyed(db *sql.DB) (bool, error) {
+	var n int
+	err := db.QueryRow(`SELECT count(*) FROM pragma_foreign_key_list('chunks') WHERE "table" = 'files' AND "to" = 'sourceid'`).Scan(&n)
+	return n == 0, err
+}
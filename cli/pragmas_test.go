@@ -0,0 +1,42 @@
+package cli
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestForeignKeysOnEveryConnection(t *testing.T) {
+	db := testFileDB(t)
+	db.SetMaxOpenConns(8)
+	if err := checkConnections(db, connOptions{foreignKeys: true}.pragmas(), 8); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkConnections(db, connOptions{}.pragmas(), 2); err == nil || !strings.Contains(err.Error(), "foreign_keys = 1") {
+		t.Errorf("checking for foreign keys off: %v", err)
+	}
+
+	// a chunk of no book, from many connections at once
+	errs := make([]error, 64)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			_, errs[i] = db.Exec("INSERT INTO chunks (id, sourceid, ordinal, chunk) VALUES (?, 999999, 0, 'orphan')", 1000+i)
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	for i, err := range errs {
+		if err == nil || !strings.Contains(err.Error(), "FOREIGN KEY") {
+			t.Errorf("insert %d of a chunk of no book: %v", i, err)
+		}
+	}
+	var orphans int
+	if err := db.QueryRow("SELECT count(*) FROM chunks").Scan(&orphans); err != nil || orphans != 0 {
+		t.Errorf("%d chunks of no book were stored (%v)", orphans, err)
+	}
+}
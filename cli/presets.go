@@ -0,0 +1,251 @@
+package cli
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// A preset is a named set of the filters /chunks/random takes, kept in the
+// presets table as a query string, so a bot can ask for ?preset=bot-default
+// instead of repeating them, or a filter expression @bot-default (see
+// filterexpr.go). Parameters given alongside the preset win over its own.
+
+var errNoPreset = errors.New("no such preset")
+
+func loadPreset(db *sql.DB, name string) (url.Values, error) {
+	var params string
+	err := db.QueryRow("SELECT params FROM presets WHERE name = ?", name).Scan(&params)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w %q; see gutchunk preset list", errNoPreset, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return url.ParseQuery(params)
+}
+
+// withPreset returns q with the filters of the filter expression it
+// gives, if it gives one, and then of the preset it names, if it names
+// one, filled in where q doesn't set them itself.
+func withPreset(db *sql.DB, q url.Values) (url.Values, error) {
+	expr, name := q.Get("filter"), q.Get("preset")
+	if expr == "" && name == "" {
+		return q, nil
+	}
+	merged := url.Values{}
+	for k, v := range q {
+		merged[k] = v
+	}
+	if expr != "" {
+		fq, err := filterValues(db, expr)
+		if err != nil {
+			return nil, err
+		}
+		fillFilters(merged, fq)
+	}
+	if name != "" {
+		p, err := loadPreset(db, name)
+		if err != nil {
+			return nil, err
+		}
+		fillFilters(merged, p)
+	}
+	return merged, nil
+}
+
+// filterFlags adds flags for the filters in filterParams to fs and returns
+// what gives those set, as the query parameters they stand for.
+func filterFlags(fs *flag.FlagSet) func() url.Values {
+	flags := map[string]string{}
+	for _, f := range []struct{ name, param, usage string }{
+		{"min-length", "min_length", "only chunks at least this many bytes long"},
+		{"source", "source", "only books ingested with this --source-label"},
+		{"language", "language", "only books in this language, by code (en) or name (English)"},
+		{"min-words", "min_words", "only chunks of at least this many words"},
+		{"max-words", "max_words", "only chunks of at most this many words"},
+		{"era", "era", "only books dated to these years, as 1700-1799 (see gutchunk catalog)"},
+		{"position", "position", "only chunks this far through their books, as 0.9-1.0 for the last tenth"},
+		{"kind", "kind", "only chunks chunk --tag-kinds tagged narrative, dialogue, letter or epigraph"},
+		{"fits", "fits", "only chunks that fit in this many characters with their attribution, as in a post"},
+		{"series", "series", "only books of this series, by name (see gutchunk series list)"},
+	} {
+		fs.String(f.name, "", f.usage)
+		flags[f.name] = f.param
+	}
+	fs.Bool("unique-works", false, "only the one book of each group dupes --mark found")
+	flags["unique-works"] = "unique_works"
+	fs.Bool("complete-only", false, "only books check-complete found complete, leaving out those not checked")
+	flags["complete-only"] = "complete_only"
+	fs.Bool("exclude-flagged", false, "leave out chunks flag-content flagged")
+	flags["exclude-flagged"] = "exclude_flagged"
+	fs.Bool("include-undetermined", false, "with --language, also books with no language or und")
+	flags["include-undetermined"] = "include_undetermined"
+	fs.String("filter", "", "only chunks matching this filter expression, like 'author:Austen lang:en words:80..160 -kind:dialogue', @name taking a preset's filters; the other filter flags win over it")
+	flags["filter"] = "filter"
+	return func() url.Values {
+		q := url.Values{}
+		fs.Visit(func(f *flag.Flag) {
+			if param, ok := flags[f.Name]; ok {
+				q.Set(param, f.Value.String())
+			}
+		})
+		return q
+	}
+}
+
+func presetCmd(args []string) error {
+	if len(args) == 0 {
+		return usagef("usage: gutchunk preset create|update|list|delete [NAME] [filters]")
+	}
+	switch args[0] {
+	case "create", "update":
+		return presetSaveCmd(args[0], args[1:])
+	case "list":
+		return presetListCmd(args[1:])
+	case "delete":
+		return presetDeleteCmd(args[1:])
+	}
+	return usagef("unknown preset command %q; want create, update, list or delete", args[0])
+}
+
+func presetSaveCmd(verb string, args []string) error {
+	fs := flag.NewFlagSet("preset "+verb, flag.ExitOnError)
+	filters := filterFlags(fs)
+	unset := fs.String("unset", "", "with update, filters to drop from the preset, comma separated, like min_words,source")
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return usagef("usage: gutchunk preset %s NAME [filters]", verb)
+	}
+	name := args[0]
+	fs.Parse(args[1:])
+	if fs.NArg() > 0 {
+		return usagef("unexpected %q; filters go after the preset's name", fs.Arg(0))
+	}
+	if *unset != "" && verb == "create" {
+		return usagef("--unset is for update")
+	}
+	q := filters()
+	if len(q) == 0 && *unset == "" {
+		return usagef("preset %s needs at least one filter", verb)
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// a preset keeps what an expression stands for, not the expression,
+	// so the presets it names can change without changing it
+	if q, err = withPreset(db, q); err != nil {
+		if errors.Is(err, errNoPreset) {
+			return err
+		}
+		return usageError{err.Error()}
+	}
+	q.Del("filter")
+
+	if verb == "update" {
+		old, err := loadPreset(db, name)
+		if err != nil {
+			return err
+		}
+		for _, k := range strings.Split(*unset, ",") {
+			if k = strings.TrimSpace(k); k == "" {
+				continue
+			}
+			if _, ok := old[k]; !ok {
+				return usagef("preset %q doesn't set %s", name, k)
+			}
+			old.Del(k)
+		}
+		for k := range q {
+			old[k] = q[k]
+		}
+		q = old
+	}
+	// catches a source that doesn't exist, or a bad number
+	if _, err = parseFilter(db, q); err != nil {
+		return usageError{err.Error()}
+	}
+
+	if verb == "create" {
+		if _, err = loadPreset(db, name); err == nil {
+			return fmt.Errorf("preset %q exists already; change it with gutchunk preset update", name)
+		} else if !errors.Is(err, errNoPreset) {
+			return err
+		}
+		_, err = db.Exec("INSERT INTO presets (name, params, created_at, updated_at) VALUES (?, ?, datetime('now'), datetime('now'))", name, q.Encode())
+	} else {
+		_, err = db.Exec("UPDATE presets SET params = ?, updated_at = datetime('now') WHERE name = ?", q.Encode(), name)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %s\n", name, q.Encode())
+	return nil
+}
+
+func presetListCmd(args []string) error {
+	fs := flag.NewFlagSet("preset list", flag.ExitOnError)
+	fs.Parse(args)
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT name, params, updated_at FROM presets WHERE ? = '' OR name = ? ORDER BY name", fs.Arg(0), fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		var name, params, at string
+		if err = rows.Scan(&name, &params, &at); err != nil {
+			return err
+		}
+		fmt.Printf("%-20s  %s  %s\n", name, at, params)
+		n++
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if n == 0 && fs.NArg() > 0 {
+		return fmt.Errorf("%w %q", errNoPreset, fs.Arg(0))
+	}
+	return nil
+}
+
+func presetDeleteCmd(args []string) error {
+	fs := flag.NewFlagSet("preset delete", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return usagef("usage: gutchunk preset delete NAME...")
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for _, name := range fs.Args() {
+		res, err := db.Exec("DELETE FROM presets WHERE name = ?", name)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return fmt.Errorf("%w %q", errNoPreset, name)
+		}
+	}
+	fmt.Printf("deleted %d presets\n", fs.NArg())
+	return nil
+}
@@ -0,0 +1,92 @@
+package cli
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPresetPrecedence(t *testing.T) {
+	db := testDB(t)
+	addBook(t, db, "Emma", "Jane Austen", "")
+	if _, err := captureStdout(t, func() error {
+		return presetCmd([]string{"create", "bot", "--min-words", "5", "--max-words", "50", "--language", "en"})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	s := testServer(t, db)
+	for _, c := range []struct {
+		query              string
+		minWords, maxWords int
+		language           string
+	}{
+		{"preset=bot", 5, 50, "en"},
+		{"preset=bot&max_words=80", 5, 80, "en"},
+		{"preset=bot&min_words=1&language=fr", 1, 50, "fr"},
+		{"min_words=2", 2, 0, ""},
+	} {
+		q, _ := url.ParseQuery(c.query)
+		f, err := s.parseFilter(q)
+		if err != nil {
+			t.Fatalf("%s: %v", c.query, err)
+		}
+		if f.MinWords != c.minWords || f.MaxWords != c.maxWords || f.Language != c.language {
+			t.Errorf("%s: %+v, want words %d to %d in %q", c.query, f, c.minWords, c.maxWords, c.language)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/chunks/random?preset=nonesuch", nil))
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "no such preset") {
+		t.Errorf("an unknown preset: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestPresetCommands(t *testing.T) {
+	db := testDB(t)
+	addBook(t, db, "Emma", "Jane Austen", "")
+	preset := func(args ...string) (string, error) {
+		return captureStdout(t, func() error { return presetCmd(args) })
+	}
+	if _, err := preset("create", "bot", "--min-words", "5", "--language", "en"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := preset("create", "bot", "--min-words", "6"); err == nil || !strings.Contains(err.Error(), "exists already") {
+		t.Errorf("creating bot again: %v", err)
+	}
+	out, err := preset("update", "bot", "--max-words", "80", "--unset", "language")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(out) != "bot: max_words=80&min_words=5" {
+		t.Errorf("update printed %q", out)
+	}
+	if out, err = preset("list"); err != nil || !strings.Contains(out, "max_words=80&min_words=5") || strings.Contains(out, "language") {
+		t.Errorf("list printed %q, %v", out, err)
+	}
+
+	for _, args := range [][]string{
+		{"update", "bot", "--unset", "source"},
+		{"create", "other", "--source", "nonesuch"},
+		{"create", "other", "--min-words", "many"},
+		{"create", "other", "--min-words", "9", "--max-words", "3"},
+		{"create", "other"},
+		{"rename", "bot"},
+	} {
+		if _, err = preset(args...); exitCode(err) != exitUsage {
+			t.Errorf("preset %s: %v, want a usage error", strings.Join(args, " "), err)
+		}
+	}
+
+	if _, err = preset("delete", "bot"); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{{"delete", "bot"}, {"update", "bot", "--min-words", "2"}, {"list", "bot"}} {
+		if _, err = preset(args...); !errors.Is(err, errNoPreset) {
+			t.Errorf("preset %s after deleting it: %v", strings.Join(args, " "), err)
+		}
+	}
+}
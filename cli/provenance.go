@@ -0,0 +1,278 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	buildinfo "runtime/debug"
+	"sort"
+	"time"
+)
+
+// What leaves the database for someone else says where it came from and
+// on what terms: export's first line, the provenance of export-books'
+// manifest.json and the provenance table of a database dump-sample wrote
+// each hold a provenance record of the gutchunk that made it, when, the
+// database it was made from, the flags it was made with and a note of the
+// texts' license, --license-note, which has Project Gutenberg's terms by
+// default. The database is named by a hash of its schema and of how many
+// books and chunks it has, which says whether two exports were made from
+// the same one, near enough, without naming its file. export's record is
+// a line of its own, {"gutchunk_provenance": {...}}, which no chunk has;
+// --no-provenance leaves it out for readers taking every line for a
+// chunk. gutchunk provenance reads the record of any of them back.
+
+const defaultLicenseNote = "The texts are from Project Gutenberg (https://www.gutenberg.org). Most are in the public domain in the USA; check the laws of your country before using them. Redistributing them with Project Gutenberg's name is under the Project Gutenberg License: https://www.gutenberg.org/policy/license.html"
+
+// provenanceKey is the field of export's first line holding the record.
+const provenanceKey = "gutchunk_provenance"
+
+type provenance struct {
+	Gutchunk   string         `json:"gutchunk"`
+	Command    string         `json:"command"`
+	ExportedAt string         `json:"exported_at"`
+	Source     sourceIdentity `json:"source"`
+	// the flags given, as given, and seeds drawn for those not
+	Flags   map[string]string `json:"flags"`
+	License string            `json:"license"`
+}
+
+// sourceIdentity is the database a record was made from.
+type sourceIdentity struct {
+	// the first 16 hex digits of the sha256 of its schema and counts
+	ID            string `json:"id"`
+	SchemaVersion int    `json:"schema_version"`
+	Books         int    `json:"books"`
+	Chunks        int    `json:"chunks"`
+}
+
+// flags a record leaves out, naming where the output went or the record
+// itself
+var provenanceSkip = map[string]bool{"out": true, "dir": true, "out-dir": true, "license-note": true, "no-provenance": true}
+
+// provenanceFlags adds --license-note to fs, and with noneFlag
+// --no-provenance, returning what reads them: the note, and whether to
+// write the record.
+func provenanceFlags(fs *flag.FlagSet, noneFlag bool) func() (string, bool) {
+	note := fs.String("license-note", defaultLicenseNote, "the license and attribution of the texts, for the provenance record")
+	none := new(bool)
+	if noneFlag {
+		none = fs.Bool("no-provenance", false, "leave out the provenance record")
+	}
+	return func() (string, bool) {
+		return *note, !*none
+	}
+}
+
+// gutchunkVersion is the version of the module this binary was built from,
+// with its commit for a build of a checkout, which has none.
+func gutchunkVersion() string {
+	info, ok := buildinfo.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	v := info.Main.Version
+	if v != "(devel)" {
+		return v
+	}
+	for _, s := range info.Settings {
+		if s.Key == "vcs.revision" && len(s.Value) >= 12 {
+			v += " " + s.Value[:12]
+		}
+	}
+	return v
+}
+
+// identityQueryer is what reads a database's identity: a *sql.DB or
+// *sql.Tx.
+type identityQueryer interface {
+	queryer
+	rowsQueryer
+}
+
+// newProvenance is the record of command, run with fs's flags, over the
+// database q reads.
+func newProvenance(q identityQueryer, command string, fs *flag.FlagSet, license string) (provenance, error) {
+	p := provenance{Gutchunk: gutchunkVersion(), Command: command, ExportedAt: time.Now().UTC().Format(time.RFC3339),
+		Flags: map[string]string{}, License: license}
+	fs.Visit(func(f *flag.Flag) {
+		if !provenanceSkip[f.Name] {
+			p.Flags[f.Name] = f.Value.String()
+		}
+	})
+	var err error
+	p.Source, err = dbIdentity(q)
+	return p, err
+}
+
+func dbIdentity(q identityQueryer) (sourceIdentity, error) {
+	var id sourceIdentity
+	if err := q.QueryRow("PRAGMA main.user_version").Scan(&id.SchemaVersion); err != nil {
+		return id, err
+	}
+	if err := q.QueryRow("SELECT (SELECT count(*) FROM files WHERE deleted_at IS NULL), (SELECT count(*) FROM chunks)").
+		Scan(&id.Books, &id.Chunks); err != nil {
+		return id, err
+	}
+	rows, err := q.Query(schemaStatements)
+	if err != nil {
+		return id, err
+	}
+	defer rows.Close()
+	h := sha256.New()
+	for rows.Next() {
+		var stmt string
+		if err = rows.Scan(&stmt); err != nil {
+			return id, err
+		}
+		fmt.Fprintf(h, "%s;\n", stmt)
+	}
+	if err = rows.Err(); err != nil {
+		return id, err
+	}
+	fmt.Fprintf(h, "%d %d %d\n", id.SchemaVersion, id.Books, id.Chunks)
+	id.ID = hex.EncodeToString(h.Sum(nil))[:16]
+	return id, nil
+}
+
+// writeProvenance writes p as export's first line.
+func writeProvenance(w io.Writer, p provenance) error {
+	return json.NewEncoder(w).Encode(map[string]provenance{provenanceKey: p})
+}
+
+// readProvenanceLine is the record line holds, if it is export's first
+// line.
+func readProvenanceLine(line []byte) (provenance, bool) {
+	var rec map[string]json.RawMessage
+	if json.Unmarshal(line, &rec) != nil || len(rec) != 1 || rec[provenanceKey] == nil {
+		return provenance{}, false
+	}
+	var p provenance
+	if json.Unmarshal(rec[provenanceKey], &p) != nil {
+		return provenance{}, false
+	}
+	return p, true
+}
+
+// saveProvenance keeps p in the provenance table of the database db.
+func saveProvenance(db execer, p provenance) error {
+	bs, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT OR REPLACE INTO provenance (id, record) VALUES (1, ?)", string(bs))
+	return err
+}
+
+// errNoProvenance is a file holding no provenance record.
+var errNoProvenance = errors.New("no provenance record")
+
+// findProvenance reads the record of what is at path: an export, a
+// directory export-books wrote a manifest to, or a database.
+func findProvenance(path string) (provenance, error) {
+	var p provenance
+	st, err := os.Stat(path)
+	if err != nil {
+		return p, err
+	}
+	if st.IsDir() {
+		bs, err := os.ReadFile(filepath.Join(path, manifestName))
+		if err != nil {
+			return p, err
+		}
+		var m exportManifest
+		if err = json.Unmarshal(bs, &m); err != nil {
+			return p, fmt.Errorf("%s: %w", manifestName, err)
+		}
+		if m.Provenance == nil {
+			return p, errNoProvenance
+		}
+		return *m.Provenance, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return p, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	if head, _ := r.Peek(16); bytes.Equal(head, []byte("SQLite format 3\x00")) {
+		f.Close()
+		return databaseProvenance(path)
+	}
+	line, err := r.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return p, err
+	}
+	if p, ok := readProvenanceLine(line); ok {
+		return p, nil
+	}
+	return p, errNoProvenance
+}
+
+func databaseProvenance(path string) (provenance, error) {
+	var p provenance
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return p, err
+	}
+	defer db.Close()
+	var tables int
+	if err = db.QueryRow("SELECT count(*) FROM sqlite_master WHERE name = 'provenance'").Scan(&tables); err != nil {
+		return p, err
+	}
+	if tables == 0 {
+		return p, errNoProvenance
+	}
+	var record string
+	err = db.QueryRow("SELECT record FROM provenance WHERE id = 1").Scan(&record)
+	if errors.Is(err, sql.ErrNoRows) {
+		return p, errNoProvenance
+	}
+	if err != nil {
+		return p, err
+	}
+	return p, json.Unmarshal([]byte(record), &p)
+}
+
+func provenanceCmd(args []string) error {
+	fs := flag.NewFlagSet("provenance", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the record as json")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return usagef("usage: gutchunk provenance [--json] EXPORT|DIR|DATABASE")
+	}
+	p, err := findProvenance(fs.Arg(0))
+	if errors.Is(err, errNoProvenance) {
+		fmt.Printf("%s has no provenance record\n", fs.Arg(0))
+		return exitStatus(1)
+	}
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return json.NewEncoder(os.Stdout).Encode(p)
+	}
+	fmt.Printf("made by gutchunk %s %s at %s\n", p.Gutchunk, p.Command, p.ExportedAt)
+	fmt.Printf("from database %s: schema version %d, %d books, %d chunks\n",
+		p.Source.ID, p.Source.SchemaVersion, p.Source.Books, p.Source.Chunks)
+	names := make([]string, 0, len(p.Flags))
+	for name := range p.Flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("  --%s=%s\n", name, p.Flags[name])
+	}
+	fmt.Printf("license: %s\n", p.License)
+	return nil
+}
@@ -0,0 +1,158 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// provenanceOf is the record gutchunk provenance --json reads from path.
+func provenanceOf(t *testing.T, path string) provenance {
+	t.Helper()
+	out, err := captureStdout(t, func() error { return provenanceCmd([]string{"--json", path}) })
+	var p provenance
+	if err != nil || json.Unmarshal([]byte(out), &p) != nil {
+		t.Fatalf("provenance --json %s: %v, printing\n%s", path, err, out)
+	}
+	return p
+}
+
+func TestExportProvenance(t *testing.T) {
+	db := sampledLibrary(t)
+	var books, chunks int
+	if err := db.QueryRow("SELECT (SELECT count(*) FROM files), (SELECT count(*) FROM chunks)").Scan(&books, &chunks); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	export := func(name string, args ...string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if _, err := captureStdout(t, func() error { return exportCmd(append(args, "--out", path)) }); err != nil {
+			t.Fatalf("export %s: %v", strings.Join(args, " "), err)
+		}
+		return path
+	}
+
+	path := export("capped.jsonl", "--max-total", "3", "--license-note", "CC0, by the transcribers")
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(bs), "\n"), "\n")
+	p, ok := readProvenanceLine([]byte(lines[0]))
+	if !ok {
+		t.Fatalf("the export's first line is %s", lines[0])
+	}
+	if at, err := time.Parse(time.RFC3339, p.ExportedAt); err != nil || time.Since(at) > time.Minute {
+		t.Errorf("the export was made at %q", p.ExportedAt)
+	}
+	if p.Gutchunk == "" || p.Command != "export" || p.License != "CC0, by the transcribers" {
+		t.Errorf("the record is %+v", p)
+	}
+	// the flags as given, the seed drawn, and neither where it went nor
+	// the note
+	if len(p.Flags) != 2 || p.Flags["max-total"] != "3" || !regexp.MustCompile(`^-?[0-9]+$`).MatchString(p.Flags["seed"]) {
+		t.Errorf("the record's flags are %v", p.Flags)
+	}
+	if !regexp.MustCompile(`^[0-9a-f]{16}$`).MatchString(p.Source.ID) ||
+		p.Source != (sourceIdentity{ID: p.Source.ID, SchemaVersion: schemaVersion, Books: books, Chunks: chunks}) {
+		t.Errorf("the record's source is %+v", p.Source)
+	}
+	// and the rest are chunks, of which it isn't one
+	if len(lines) != 4 {
+		t.Errorf("export --max-total 3 wrote\n%s", bs)
+	}
+	for _, line := range lines[1:] {
+		var r exportRecord
+		if _, ok := readProvenanceLine([]byte(line)); ok || json.Unmarshal([]byte(line), &r) != nil || r.Text == "" {
+			t.Errorf("the export holds %s", line)
+		}
+	}
+	if got := provenanceOf(t, path); !reflect.DeepEqual(got, p) {
+		t.Errorf("provenance reads\n%+v\nwant\n%+v", got, p)
+	}
+	out, err := captureStdout(t, func() error { return provenanceCmd([]string{path}) })
+	if want := fmt.Sprintf("made by gutchunk %s export at %s\nfrom database %s: schema version %d, %d books, %d chunks\n  --max-total=3\n  --seed=%s\nlicense: CC0, by the transcribers\n",
+		p.Gutchunk, p.ExportedAt, p.Source.ID, schemaVersion, books, chunks, p.Flags["seed"]); err != nil || out != want {
+		t.Errorf("provenance: %v, printing\n%s\nwant\n%s", err, out, want)
+	}
+
+	// the same database is the same source, and another isn't
+	again := provenanceOf(t, export("again.jsonl", "--seed", "7"))
+	if again.Source != p.Source || again.License != defaultLicenseNote || !reflect.DeepEqual(again.Flags, map[string]string{"seed": "7"}) {
+		t.Errorf("exported again, the record is %+v", again)
+	}
+	insertChunk(t, db, 1, 99, "One more chunk.")
+	if changed := provenanceOf(t, export("changed.jsonl")); changed.Source.ID == p.Source.ID || changed.Source.Chunks != chunks+1 {
+		t.Errorf("with a chunk more, the source is %+v", changed.Source)
+	}
+
+	// --no-provenance leaves it out
+	path = export("bare.jsonl", "--no-provenance")
+	if bs, err = os.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	var r exportRecord
+	if err = json.Unmarshal(bs[:strings.IndexByte(string(bs), '\n')], &r); err != nil || r.Text == "" || strings.Contains(string(bs), provenanceKey) {
+		t.Errorf("export --no-provenance wrote\n%s", bs)
+	}
+	if out, err = captureStdout(t, func() error { return provenanceCmd([]string{path}) }); exitCode(err) != 1 || out != path+" has no provenance record\n" {
+		t.Errorf("provenance of an export without one: %v, printing\n%s", err, out)
+	}
+}
+
+func TestExportBooksAndSampleProvenance(t *testing.T) {
+	db := sampledLibrary(t)
+	dir := t.TempDir()
+	books := filepath.Join(dir, "books")
+	if _, err := captureStdout(t, func() error {
+		return exportBooksCmd([]string{"--dir", books, "--sidecar", "json", "--title", "emma", "--license-note", "PD"})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	p := provenanceOf(t, books)
+	if p.Command != "export-books" || p.License != "PD" || !reflect.DeepEqual(p.Flags, map[string]string{"sidecar": "json", "title": "emma"}) {
+		t.Errorf("export-books' record is %+v", p)
+	}
+	source, err := dbIdentity(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Source != source {
+		t.Errorf("export-books' source is %+v, want %+v", p.Source, source)
+	}
+
+	path := filepath.Join(dir, "sample.db")
+	if _, err = captureStdout(t, func() error { return dumpSampleCmd([]string{"--books", "2", "--seed", "3", "--out", path}) }); err != nil {
+		t.Fatal(err)
+	}
+	if p = provenanceOf(t, path); p.Command != "dump-sample" || p.Source != source || p.License != defaultLicenseNote ||
+		!reflect.DeepEqual(p.Flags, map[string]string{"books": "2", "seed": "3"}) {
+		t.Errorf("dump-sample's record is %+v", p)
+	}
+
+	// a database, a directory and a file with none don't have one
+	empty := filepath.Join(dir, "notes.txt")
+	if err = os.WriteFile(empty, []byte("nothing to see\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{dbFile(dsn), empty} {
+		if out, err := captureStdout(t, func() error { return provenanceCmd([]string{path}) }); exitCode(err) != 1 || out != path+" has no provenance record\n" {
+			t.Errorf("provenance of %s: %v, printing\n%s", path, err, out)
+		}
+	}
+	for _, path := range []string{dir, filepath.Join(dir, "nonesuch")} {
+		if _, err := captureStdout(t, func() error { return provenanceCmd([]string{path}) }); err == nil || exitCode(err) == exitUsage {
+			t.Errorf("provenance of %s: %v", path, err)
+		}
+	}
+	if _, err = captureStdout(t, func() error { return provenanceCmd(nil) }); exitCode(err) != exitUsage {
+		t.Errorf("provenance of nothing: %v, want a usage error", err)
+	}
+}
@@ -0,0 +1,411 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// gutchunk publish --to /srv/bot/chunker.db hands the database --db names
+// to something that only reads it, such as a bot, without it ever seeing
+// the database halfway through a rebuild. The database is checkpointed
+// with TRUNCATE, emptying its write-ahead log into the file, and read in
+// one transaction while the file is copied, so the copy is the database
+// as of that moment whatever is written meanwhile; it must pass sqlite's
+// integrity and foreign key checks and hold chunks, all of them of books
+// it has. The copy is made beside the target, on its filesystem, synced
+// and renamed over it, so a reader opening the target finds either the
+// old database or the new one, never a part of either; one with the old
+// open keeps reading it until it opens the target again, which
+// --hup-pid and --pid-file send it a SIGHUP for and --touch marks by
+// writing the time to a file. publish refuses to replace a target of a
+// newer schema version than the copy's, which a reader built for it may
+// rely on.
+//
+// sqlite keeps a database's -wal and -shm beside it by name, so the
+// target's outlast the rename and would be taken for the new database's.
+// The target is checkpointed with TRUNCATE first, leaving its log empty,
+// and publish refuses if a writer of its own keeps it from doing so;
+// which is also why the target is for readers only.
+
+// publishTries is how many times publish tries to catch the database
+// with its log empty, or the target's, before giving up.
+const publishTries = 5
+
+// publishWait is how long it waits between tries.
+var publishWait = 200 * time.Millisecond
+
+// publishSource is the database being published, read as it was when the
+// transaction began until it is rolled back.
+type publishSource struct {
+	tx      *sql.Tx
+	conn    *sql.Conn
+	version int
+	books   int
+	chunks  int
+}
+
+func (s *publishSource) close() {
+	if s.tx != nil {
+		s.tx.Rollback()
+		s.conn.Close()
+		s.tx = nil
+	}
+}
+
+func publishCmd(args []string) error {
+	fs := flag.NewFlagSet("publish", flag.ExitOnError)
+	to := fs.String("to", "", "the file to publish the database as")
+	hupPID := fs.Int("hup-pid", 0, "send this process a SIGHUP once the database is published")
+	pidFile := fs.String("pid-file", "", "send the process whose pid is in this file a SIGHUP once the database is published")
+	touch := fs.String("touch", "", "write the time to this file once the database is published")
+	fs.Parse(args)
+
+	if fs.NArg() > 0 || *to == "" {
+		return usagef("usage: gutchunk publish --to FILE [--hup-pid PID | --pid-file FILE] [--touch FILE]")
+	}
+	if *hupPID != 0 && *pidFile != "" {
+		return usagef("give --hup-pid or --pid-file, not both")
+	}
+	if *hupPID < 0 {
+		return usagef("--hup-pid must be positive")
+	}
+	path := dbFile(dsn)
+	if path == "" {
+		return usagef("publish copies the database's file, and a database in memory has none")
+	}
+	if same, err := sameFile(path, *to); err != nil {
+		return err
+	} else if same {
+		return usagef("--to %s is the database itself", *to)
+	}
+	key, err := dbKey()
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if chunkShards > 0 {
+		return fmt.Errorf("the database keeps its chunks in %d shards, and publish copies only the main file", chunkShards)
+	}
+
+	src, err := publishCopy(db, path, *to, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("published %d books and %d chunks to %s (schema version %d)\n", src.books, src.chunks, *to, src.version)
+
+	if *touch != "" {
+		if err = os.WriteFile(*touch, []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), 0o644); err != nil {
+			return fmt.Errorf("published, but could not touch %s: %w", *touch, err)
+		}
+	}
+	if *pidFile != "" {
+		if *hupPID, err = readPID(*pidFile); err != nil {
+			return fmt.Errorf("published, but %w", err)
+		}
+	}
+	if *hupPID != 0 {
+		p, err := os.FindProcess(*hupPID)
+		if err == nil {
+			err = p.Signal(syscall.SIGHUP)
+		}
+		if err != nil {
+			return fmt.Errorf("published, but could not send process %d a SIGHUP: %w", *hupPID, err)
+		}
+		fmt.Printf("sent process %d a SIGHUP\n", *hupPID)
+	}
+	return nil
+}
+
+// publishCopy copies the database db has open, the file at path, to to
+// as publish does, returning what it copied. checkpointed, if not nil, is
+// called as holdSource empties the log, and stamp, if not nil, is given
+// the source as it was copied and the copy, to write to, before the copy
+// is checked and put in place.
+func publishCopy(db *sql.DB, path, to, key string, checkpointed func() error, stamp func(src *publishSource, tmp string) error) (*publishSource, error) {
+	src, err := holdSource(db, path, checkpointed)
+	if err != nil {
+		return nil, err
+	}
+	defer src.close()
+	problems, err := checkPublish(src.tx)
+	if err != nil {
+		return nil, err
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("the database fails its checks, so it isn't published:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	tmp, err := copyForPublish(path, to)
+	if err != nil {
+		return nil, err
+	}
+	published := false
+	defer func() {
+		if !published {
+			os.Remove(tmp)
+		}
+	}()
+	if stamp != nil {
+		if err = stamp(src, tmp); err != nil {
+			return nil, err
+		}
+	}
+	src.close()
+	if err = checkCopy(tmp, key, src.version); err != nil {
+		return nil, err
+	}
+	if err = clearTarget(to, key, src.version); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(tmp, to); err != nil {
+		return nil, err
+	}
+	published = true
+	if err = syncDir(filepath.Dir(to)); err != nil {
+		return src, fmt.Errorf("published %s, but could not sync its directory: %w", to, err)
+	}
+	return src, nil
+}
+
+// sameFile says whether a and b are the one file, false if b doesn't
+// exist yet.
+func sameFile(a, b string) (bool, error) {
+	sa, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	sb, err := os.Stat(b)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return os.SameFile(sa, sb), nil
+}
+
+// holdSource checkpoints the database at path and begins a transaction
+// reading it with its log empty, so the file alone is the database as the
+// transaction sees it: in wal mode no checkpoint can write the file past
+// what a reader reads, and in the rollback journal modes no write can be
+// made while it reads. checkpointed, if not nil, is called after each
+// checkpoint and before the transaction reads.
+func holdSource(db *sql.DB, path string, checkpointed func() error) (*publishSource, error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for try := 1; ; try++ {
+		if _, err = conn.ExecContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if checkpointed != nil {
+			if err = checkpointed(); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		s := &publishSource{tx: tx, conn: conn}
+		// the transaction takes its snapshot when it first reads
+		err = tx.QueryRow("PRAGMA user_version").Scan(&s.version)
+		if err == nil {
+			err = tx.QueryRow("SELECT (SELECT count(*) FROM files WHERE deleted_at IS NULL AND superseded_by IS NULL), (SELECT count(*) FROM chunks)").Scan(&s.books, &s.chunks)
+		}
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+		st, err := os.Stat(path + "-wal")
+		if errors.Is(err, os.ErrNotExist) || err == nil && st.Size() == 0 {
+			return s, nil
+		}
+		tx.Rollback()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if try == publishTries {
+			conn.Close()
+			return nil, fmt.Errorf("the database was written to each of %d times publish emptied its log; try again once it is quieter", publishTries)
+		}
+		time.Sleep(publishWait)
+	}
+}
+
+// checkPublish is what is wrong with the database publish reads through
+// tx, if anything.
+func checkPublish(tx *sql.Tx) ([]string, error) {
+	problems, err := checkIntegrity(tx)
+	if err != nil {
+		return nil, err
+	}
+	var chunks, orphans int
+	if err = tx.QueryRow("SELECT count(*), count(*) FILTER (WHERE sourceid NOT IN (SELECT id FROM files)) FROM chunks").Scan(&chunks, &orphans); err != nil {
+		return nil, err
+	}
+	if chunks == 0 {
+		problems = append(problems, "it holds no chunks")
+	}
+	if orphans > 0 {
+		problems = append(problems, fmt.Sprintf("%d chunks of books not in it", orphans))
+	}
+	return problems, nil
+}
+
+// copyForPublish copies the database at path to a temporary file beside
+// to and syncs it, returning its name. It has the permissions of to, or
+// with no to yet of the database.
+func copyForPublish(path, to string) (string, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	st, err := in.Stat()
+	if err != nil {
+		return "", err
+	}
+	mode := st.Mode().Perm()
+	if tst, err := os.Stat(to); err == nil {
+		mode = tst.Mode().Perm()
+	}
+	dir := filepath.Dir(to)
+	// a filesystem that can't tell says so by failing the copy instead
+	if free, err := freeSpace(dir); err == nil && free < st.Size() {
+		return "", fmt.Errorf("publishing needs %s free in %s and it has %s", formatSize(st.Size()), dir, formatSize(free))
+	}
+
+	out, err := os.CreateTemp(dir, "."+filepath.Base(to)+".*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("could not copy the database to %s: %w", dir, err)
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Chmod(mode)
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", fmt.Errorf("could not copy the database to %s: %w", dir, err)
+	}
+	return out.Name(), nil
+}
+
+// checkCopy checks that the copy at path reads back as a database of the
+// version copied.
+func checkCopy(path, key string, version int) error {
+	db, err := connectDB("file:"+path, key, connOptions{})
+	if err != nil {
+		return fmt.Errorf("could not open the copy: %w", err)
+	}
+	defer db.Close()
+	var v int
+	var msg string
+	if err = db.QueryRow("PRAGMA user_version").Scan(&v); err != nil {
+		return err
+	}
+	if err = db.QueryRow("PRAGMA quick_check(1)").Scan(&msg); err != nil {
+		return err
+	}
+	if msg != "ok" {
+		return fmt.Errorf("the copy doesn't read back as the database: %s", msg)
+	}
+	if v != version {
+		return fmt.Errorf("the copy reads back as schema version %d, not the database's %d", v, version)
+	}
+	return nil
+}
+
+// clearTarget makes ready to replace the database at to, if there is one:
+// it fails if to is of a newer schema version than version, and leaves
+// its log empty for the new database to take over. A to that isn't a
+// database gutchunk can read is refused rather than replaced.
+func clearTarget(to, key string, version int) error {
+	if _, err := os.Stat(to); errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	db, err := connectDB("file:"+to, key, connOptions{})
+	if err != nil {
+		return fmt.Errorf("could not read the database at %s to replace it: %w", to, err)
+	}
+	defer db.Close()
+	var v int
+	if err = db.QueryRow("PRAGMA user_version").Scan(&v); err != nil {
+		return err
+	}
+	if v > version {
+		return fmt.Errorf("%s is of schema version %d, and the database of %d; publishing it would take its readers back a version", to, v, version)
+	}
+	for try := 1; ; try++ {
+		var busy, log, done int
+		if err = db.QueryRow("PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &log, &done); err != nil {
+			return err
+		}
+		// log is -1 out of wal mode, where there is no log to empty
+		if busy == 0 {
+			return nil
+		}
+		if try == publishTries {
+			return fmt.Errorf("could not empty the log of %s, which something is writing to; publish needs its readers only reading it", to)
+		}
+		time.Sleep(publishWait)
+	}
+}
+
+// syncDir makes a rename in dir durable. Windows can't open a directory to
+// sync it, and needn't.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// readPID reads the process id in the file at path.
+func readPID(path string) (int, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("could not read the pid file: %w", err)
+	}
+	var pid int
+	if _, err = fmt.Sscan(string(bs), &pid); err != nil || pid <= 0 {
+		return 0, fmt.Errorf("%s doesn't hold a process id", path)
+	}
+	return pid, nil
+}
@@ -0,0 +1,216 @@
+package cli
+
+import (
+	"database/sql"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// publishFixture is a file database of two books and their chunks, and a
+// directory to publish it to.
+func publishFixture(t *testing.T) (*sql.DB, string) {
+	t.Helper()
+	db := testFileDB(t)
+	for _, title := range []string{"Emma", "Persuasion"} {
+		id := addBook(t, db, title, "Jane Austen", "")
+		for i := 0; i < 3; i++ {
+			insertChunk(t, db, id, i, "A chunk of "+title+".")
+		}
+	}
+	return db, t.TempDir()
+}
+
+// published is how many chunks the database at path holds, and its
+// schema version, reading it as a reader of it would.
+func published(t *testing.T, path string) (int, int) {
+	t.Helper()
+	db, err := connectDB(fileDSN(path), "", connOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var chunks, version int
+	if err = db.QueryRow("SELECT (SELECT count(*) FROM chunks), (SELECT user_version FROM pragma_user_version)").Scan(&chunks, &version); err != nil {
+		t.Fatal(err)
+	}
+	return chunks, version
+}
+
+// leftOver is what publish left in dir other than the target's files.
+func leftOver(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".tmp") {
+			names = append(names, e.Name())
+		}
+	}
+	return names
+}
+
+func TestPublish(t *testing.T) {
+	db, dir := publishFixture(t)
+	to := filepath.Join(dir, "chunker.db")
+	touched := filepath.Join(dir, "reopen")
+	publish := func(args ...string) (string, error) {
+		t.Helper()
+		return captureStdout(t, func() error { return publishCmd(append([]string{"--to", to}, args...)) })
+	}
+
+	// to a target not there yet
+	out, err := publish("--touch", touched)
+	if err != nil || out != "published 2 books and 6 chunks to "+to+" (schema version "+strconv.Itoa(schemaVersion)+")\n" {
+		t.Fatalf("publish: %v, printing %q", err, out)
+	}
+	if chunks, version := published(t, to); chunks != 6 || version != schemaVersion {
+		t.Errorf("the target holds %d chunks at schema version %d", chunks, version)
+	}
+	if stamp, err := os.ReadFile(touched); err != nil {
+		t.Error(err)
+	} else if _, err = time.Parse(time.RFC3339, strings.TrimSpace(string(stamp))); err != nil {
+		t.Errorf("--touch wrote %q", stamp)
+	}
+	if names := leftOver(t, dir); names != nil {
+		t.Errorf("publish left %v", names)
+	}
+
+	// over a target a reader has open, with writes in its log: the reader
+	// keeps what it read, and whoever opens it next gets the new database
+	reader, err := connectDB(fileDSN(to), "", connOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	reader.SetMaxOpenConns(1)
+	if _, err = reader.Exec("PRAGMA journal_mode = wal"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = reader.Exec("DELETE FROM chunks WHERE ordinal = 2"); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := os.Stat(to + "-wal"); err != nil || st.Size() == 0 {
+		t.Fatalf("the target's log isn't held: %v", err)
+	}
+	insertChunk(t, db, 1, 3, "The last chunk of Emma.")
+	if out, err = publish(); err != nil || !strings.HasPrefix(out, "published 2 books and 7 chunks") {
+		t.Fatalf("publish over a target in use: %v, printing %q", err, out)
+	}
+	if chunks, _ := published(t, to); chunks != 7 {
+		t.Errorf("opened again, the target holds %d chunks, want 7", chunks)
+	}
+	var n int
+	if err = reader.QueryRow("SELECT count(*) FROM chunks").Scan(&n); err != nil || n != 4 {
+		t.Errorf("the reader with the old target open reads %d chunks (%v), want 4", n, err)
+	}
+
+	// a SIGHUP, to a process by its id or its pid file
+	hup := make(chan os.Signal, 2)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	pidFile := filepath.Join(dir, "bot.pid")
+	if err = os.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{{"--hup-pid", strconv.Itoa(os.Getpid())}, {"--pid-file", pidFile}} {
+		if out, err = publish(args...); err != nil || !strings.HasSuffix(out, "sent process "+strconv.Itoa(os.Getpid())+" a SIGHUP\n") {
+			t.Errorf("publish %s: %v, printing %q", strings.Join(args, " "), err, out)
+		}
+		select {
+		case <-hup:
+		case <-time.After(5 * time.Second):
+			t.Errorf("publish %s sent no SIGHUP", strings.Join(args, " "))
+		}
+	}
+	if err = os.WriteFile(pidFile, []byte("nobody\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = publish("--pid-file", pidFile); err == nil || err.Error() != "published, but "+pidFile+" doesn't hold a process id" {
+		t.Errorf("publish with a bad pid file: %v", err)
+	}
+
+	for _, args := range [][]string{{}, {"--to", to, "extra"}, {"--to", to, "--hup-pid", "1", "--pid-file", pidFile}, {"--to", to, "--hup-pid", "-1"}, {"--to", dbFile(dsn)}} {
+		if _, err = captureStdout(t, func() error { return publishCmd(args) }); exitCode(err) != exitUsage {
+			t.Errorf("publish %s: %v, want a usage error", strings.Join(args, " "), err)
+		}
+	}
+	testDB(t)
+	if _, err = publish(); exitCode(err) != exitUsage {
+		t.Errorf("publish of a database in memory: %v, want a usage error", err)
+	}
+}
+
+func TestPublishRefused(t *testing.T) {
+	db, dir := publishFixture(t)
+	to := filepath.Join(dir, "chunker.db")
+	publish := func() error {
+		_, err := captureStdout(t, func() error { return publishCmd([]string{"--to", to}) })
+		return err
+	}
+	if err := publish(); err != nil {
+		t.Fatal(err)
+	}
+	// each refusal leaves the target as it was, and no copy beside it
+	refused := func(what, want string) {
+		t.Helper()
+		if err := publish(); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("publish of %s: %v, want %q", what, err, want)
+		}
+		if chunks, _ := published(t, to); chunks != 6 {
+			t.Errorf("refusing %s, publish left the target with %d chunks", what, chunks)
+		}
+		if names := leftOver(t, dir); names != nil {
+			t.Errorf("refusing %s, publish left %v", what, names)
+		}
+	}
+
+	// chunks of a book the database hasn't
+	conn, err := db.Conn(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{"PRAGMA foreign_keys = OFF", "INSERT INTO chunks (id, sourceid, ordinal, chunk) VALUES (100, 99, 0, 'A chunk of nothing.')", "PRAGMA foreign_keys = ON"} {
+		if _, err = conn.ExecContext(t.Context(), q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.Close()
+	refused("a database with orphaned chunks", "the database fails its checks, so it isn't published:\n  ")
+	refused("a database with orphaned chunks", "\n  1 chunks of books not in it")
+	if _, err = db.Exec("DELETE FROM chunks"); err != nil {
+		t.Fatal(err)
+	}
+	refused("a database of no chunks", "\n  it holds no chunks")
+
+	// a target newer than the database
+	insertChunk(t, db, 1, 0, "A chunk of Emma again.")
+	target, err := sql.Open("sqlite3", to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = target.Exec("PRAGMA user_version = " + strconv.Itoa(schemaVersion+1)); err != nil {
+		t.Fatal(err)
+	}
+	target.Close()
+	refused("an older schema over a newer", "publishing it would take its readers back a version")
+
+	// and one that isn't a database at all
+	if err = os.WriteFile(to, []byte("not a database"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err = publish(); err == nil || !strings.Contains(err.Error(), "could not read the database at "+to+" to replace it") {
+		t.Errorf("publish over a file not a database: %v", err)
+	}
+	if bs, _ := os.ReadFile(to); string(bs) != "not a database" {
+		t.Error("publish replaced a file not a database")
+	}
+}
@@ -0,0 +1,357 @@
+package cli
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+)
+
+type chunkrow struct {
+	ID       int    `json:"id"`
+	StableID string `json:"stable_id,omitempty"`
+	Text     string `json:"text"`
+	Title    string `json:"title"`
+	Author   string `json:"author"`
+}
+
+func randomCmd(args []string) error {
+	fs := flag.NewFlagSet("random", flag.ExitOnError)
+	fair := fs.String("fair", "", "sample fairly by: author (pick an author first, then one of their chunks)")
+	weight := fs.String("weight", "uniform", "author weighting under --fair author: uniform or sqrt (by chunk count)")
+	work := fs.Int("work", 0, "only pick from the volumes of this work")
+	author := fs.String("author", "", "only pick from books by this author, by the starts of words of their name, without regard to case or diacritics")
+	title := fs.String("title", "", "only pick from books with this title, by the starts of its words, without regard to case or diacritics")
+	seed := fs.Int64("seed", 0, "random seed (default: time based)")
+	width := fs.Int("width", 72, "wrap prose to this many columns (0 for none)")
+	smartCase := fs.Bool("smart-case", false, "attribute the chunk in title case where its title or author is in capitals")
+	creditTranslator := fs.Bool("credit-translator", false, "add \"translated by\" the book's translators to the attribution, where it has any")
+	preferPinned := fs.Bool("prefer-pinned", false, "draw pinned chunks ten times as often as the rest")
+	preset := fs.String("preset", "", "draw with the filters of this preset, see gutchunk preset; filter flags given win over it")
+	filters := filterFlags(fs)
+	spec := fs.String("transform", "", transformUsage)
+	authorsFile := authorsFlag(fs, "authors.toml whose deny and allow lists say whose chunks never to draw")
+	var ex servedExclusion
+	fs.StringVar(&ex.label, "label", "", "who the chunk is for, logged with it and what --exclude-served goes by")
+	fs.Var((*windowFlag)(&ex.window), "exclude-served", "leave out chunks served under --label within this long, like 30d")
+	fs.Parse(args)
+
+	q := filters()
+	// --unique-works draws the ways below too; the other filters and
+	// presets need filteredChunk
+	uniqueWorks := q.Get("unique_works") == "true"
+	filtered := *preset != "" || len(q) > 1 || len(q) == 1 && q.Get("unique_works") == ""
+	if *preset != "" {
+		q.Set("preset", *preset)
+	}
+
+	p, err := parsePipeline(*spec, nil)
+	if err != nil {
+		return err
+	}
+	authors, err := authorsFile()
+	if err != nil {
+		return err
+	}
+	// the lists are a filter like the others
+	filtered = filtered || authors != nil
+	if *fair != "" && *fair != "author" {
+		return usagef("unknown --fair mode %q", *fair)
+	}
+	if *weight != "uniform" && *weight != "sqrt" {
+		return usagef("unknown --weight %q", *weight)
+	}
+	if (*author != "" || *title != "") && (*work != 0 || *fair != "" || *preferPinned) {
+		return usagef("--author and --title don't combine with --work, --fair or --prefer-pinned")
+	}
+	if uniqueWorks && (*fair != "" || *preferPinned) {
+		return usagef("--unique-works doesn't combine with --fair or --prefer-pinned")
+	}
+	if filtered && (*author != "" || *title != "" || *work != 0 || *fair != "" || *preferPinned) {
+		return usagef("--preset, --authors-file and the filter flags don't combine with --author, --title, --work, --fair or --prefer-pinned")
+	}
+	only := drawable(uniqueWorks)
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	r := rand.New(rand.NewSource(*seed))
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if *author != "" || *title != "" {
+		if err = requireSchema(schemaGap{"name_words", ""}); err != nil {
+			return err
+		}
+	}
+	if uniqueWorks && !filtered && lacks("files", "duplicate_group") {
+		fmt.Fprintln(os.Stderr, "note: drawing from every edition, as this database lacks files.duplicate_group for --unique-works; run gutchunk migrate")
+		only = drawable(false)
+	}
+
+	var f chunkFilter
+	if filtered {
+		if q, err = withPreset(db, q); err != nil {
+			if errors.Is(err, errNoPreset) {
+				return err
+			}
+			return usageError{err.Error()}
+		}
+		if f, err = parseFilter(db, q); err != nil {
+			return usageError{err.Error()}
+		}
+		f.DenyAuthors, f.AllowAuthors = authors.where()
+		for _, u := range f.unbridged(true) {
+			fmt.Fprintf(os.Stderr, "note: ignoring the %s filter, as this database has no %s; run gutchunk migrate\n", u[0], u[1])
+		}
+	}
+	draw := func(ex servedExclusion) (chunkrow, error) {
+		and, args := ex.and()
+		only := only + and
+		switch {
+		case filtered:
+			return filteredChunk(db, r, f, ex)
+		case *work != 0:
+			return workChunk(db, r, *work, only, args...)
+		case *author != "" || *title != "":
+			return matchingChunk(db, r, parseNameQuery(*author, *title), only, args...)
+		case *fair == "author":
+			return fairChunk(db, r, *weight == "sqrt", ex)
+		}
+		return randomChunk(db, r, only, args...)
+	}
+
+	var c chunkrow
+	picked := false
+	if *preferPinned {
+		c, picked, err = pinnedChunk(db, r, *work)
+	}
+	if err == nil && picked {
+		// a pinned chunk served lately is drawn again only as any other is
+		var served bool
+		served, err = ex.served(db, c.ID)
+		picked = !served
+	}
+	if err != nil {
+		return err
+	}
+	if !picked {
+		var fellBack bool
+		c, fellBack, err = drawUnserved(ex, draw)
+		if err != nil {
+			return err
+		}
+		if fellBack {
+			fmt.Fprintln(os.Stderr, "note: "+fellBackNotice(ex))
+		}
+	}
+	if err = logServed(db, c.ID, ex.label); isReadonly(err) {
+		fmt.Fprintln(os.Stderr, "note: not logging the chunk served, as this database can't be written")
+	} else if err != nil {
+		return err
+	}
+
+	fmt.Println(RenderChunk(p.apply(c.Text), *width, StyleText))
+	if *smartCase {
+		c.Title, c.Author = SmartCase(c.Title), SmartCase(c.Author)
+	}
+	var translators []string
+	if *creditTranslator {
+		if translators, err = chunkTranslators(db, c.ID); err != nil {
+			return err
+		}
+	}
+	fmt.Println(attribution(c, translators))
+
+	return nil
+}
+
+// attribution is the line random credits c with, and with translators
+// them after its author.
+func attribution(c chunkrow, translators []string) string {
+	a := "— " + c.Title
+	if c.Author != "" {
+		a += ", by " + c.Author
+	}
+	if len(translators) > 0 {
+		a += ", translated by " + joinNames(translators)
+	}
+	return a
+}
+
+var (
+	errNoChunks = errors.New("no chunks to choose from")
+	// there are chunks, but the filters keep none of them
+	errNoMatch error = noMatch{}
+	errNoStats       = errors.New("no author stats; run gutchunk refresh-stats first")
+)
+
+type noMatch struct{}
+
+func (noMatch) Error() string { return "no chunk satisfies the filters" }
+
+// Is has a noMatch taken for errNoChunks, as what serve, drawUnserved and
+// the rest look for.
+func (noMatch) Is(err error) bool { return err == errNoChunks }
+
+const (
+	// chunks from an anthology are attributed to their own work
+	chunkrowCols = "c.id, c.chunk, " + chunkTitle + ", coalesce(f.author, ''), coalesce(c.stable_id, '')"
+	// the title a chunk is attributed to: its work's, in an anthology
+	chunkTitle = "coalesce((SELECT w.title FROM works_in_file w WHERE w.id = c.work_id), f.name, '')"
+	// banned chunks, boilerplate, the books near-dupes suppressed and
+	// versions superseded by a re-release are never drawn
+	notBanned = "c.id NOT IN (SELECT chunk_id FROM chunk_flags WHERE flag = 'ban') AND f.suppressed_by IS NULL AND c.boilerplate IS NULL AND " + activeVersion
+	// nor, with --unique-works, the books dupes --mark found another
+	// edition of one work represents
+	representative = "(f.duplicate_group IS NULL OR f.duplicate_group = f.id)"
+)
+
+// drawable is the condition on "chunks c" and "files f" a chunk that may
+// be drawn meets.
+func drawable(uniqueWorks bool) string {
+	if uniqueWorks {
+		return notBanned + " AND " + representative
+	}
+	return notBanned
+}
+
+// randomChunk picks uniformly over chunk ids with a primary key seek rather
+// than ORDER BY random(), which would sort the whole table. Gaps in the id
+// sequence, banned and suppressed chunks included, make chunks after a gap slightly more
+// likely. only is what a chunk drawn must meet, see drawable.
+func randomChunk(db *sql.DB, r *rand.Rand, only string, args ...interface{}) (chunkrow, error) {
+	var c chunkrow
+	max, err := maxChunkID(db)
+	if err != nil {
+		return c, err
+	}
+	if max == 0 {
+		return c, errNoChunks
+	}
+
+	seek := func(from int64) error {
+		return db.QueryRow(`SELECT `+chunkrowCols+`
+			FROM chunks c JOIN files f ON f.id = c.sourceid
+			WHERE c.id >= ? AND `+only+` ORDER BY c.id LIMIT 1`, append([]interface{}{from}, args...)...).
+			Scan(&c.ID, &c.Text, &c.Title, &c.Author, &c.StableID)
+	}
+	err = seek(1 + r.Int63n(max))
+	// everything from there on is banned; wrap around
+	if errors.Is(err, sql.ErrNoRows) {
+		err = seek(1)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return c, errNoChunks
+	}
+	return c, err
+}
+
+// fairChunk picks an author from author_stats (uniformly, or weighted by
+// the square root of their chunk count) and then a uniform chunk by that
+// author.
+func fairChunk(db *sql.DB, r *rand.Rand, sqrtWeight bool, ex servedExclusion) (chunkrow, error) {
+	var c chunkrow
+	var author string
+	var chunks int
+
+	if sqrtWeight {
+		var total sql.NullFloat64
+		if err := db.QueryRow("SELECT max(cum_sqrt) FROM author_stats").Scan(&total); err != nil {
+			return c, err
+		}
+		if !total.Valid {
+			return c, errNoStats
+		}
+		err := db.QueryRow("SELECT author, chunks FROM author_stats WHERE cum_sqrt > ? ORDER BY cum_sqrt LIMIT 1",
+			r.Float64()*total.Float64).Scan(&author, &chunks)
+		if err != nil {
+			return c, err
+		}
+	} else {
+		var n int
+		if err := db.QueryRow("SELECT count(*) FROM author_stats").Scan(&n); err != nil {
+			return c, err
+		}
+		if n == 0 {
+			return c, errNoStats
+		}
+		err := db.QueryRow("SELECT author, chunks FROM author_stats ORDER BY rowid LIMIT 1 OFFSET ?",
+			r.Intn(n)).Scan(&author, &chunks)
+		if err != nil {
+			return c, err
+		}
+	}
+
+	// author_stats counts banned, suppressed and superseded chunks too, so
+	// draw again on hitting one, or one ex leaves out
+	for tries := 0; tries < 100; tries++ {
+		var suppressed bool
+		err := db.QueryRow(`SELECT `+chunkrowCols+`, f.suppressed_by IS NOT NULL OR c.boilerplate IS NOT NULL OR f.superseded_by IS NOT NULL
+			FROM files f JOIN chunks c ON c.sourceid = f.id
+			WHERE f.author_norm = ? LIMIT 1 OFFSET ?`, author, r.Intn(chunks)).
+			Scan(&c.ID, &c.Text, &c.Title, &c.Author, &c.StableID, &suppressed)
+		if errors.Is(err, sql.ErrNoRows) {
+			return c, fmt.Errorf("author stats are stale; run gutchunk refresh-stats")
+		}
+		if err != nil {
+			return c, err
+		}
+		if suppressed {
+			continue
+		}
+		skip, err := isBanned(db, c.ID)
+		if err == nil && !skip {
+			skip, err = ex.served(db, c.ID)
+		}
+		if err != nil || !skip {
+			return c, err
+		}
+	}
+	return c, errNoChunks
+}
+
+// matchingChunk picks uniformly over the chunks of the books q matches.
+func matchingChunk(db *sql.DB, r *rand.Rand, q nameQuery, only string, onlyArgs ...interface{}) (chunkrow, error) {
+	var c chunkrow
+	where, args := q.where()
+	where += " AND " + only
+	args = append(args, onlyArgs...)
+	n, err := countChunks(db, "files f JOIN %s c ON c.sourceid = f.id WHERE "+where, args...)
+	if err != nil {
+		return c, err
+	}
+	if n == 0 {
+		return c, errNoChunks
+	}
+	err = db.QueryRow(`SELECT `+chunkrowCols+`
+		FROM files f JOIN chunks c ON c.sourceid = f.id
+		WHERE `+where+` LIMIT 1 OFFSET ?`, append(args, r.Intn(n))...).
+		Scan(&c.ID, &c.Text, &c.Title, &c.Author, &c.StableID)
+	return c, err
+}
+
+// workChunk picks uniformly over the chunks of every volume of a work.
+func workChunk(db *sql.DB, r *rand.Rand, work int, only string, args ...interface{}) (chunkrow, error) {
+	var c chunkrow
+	var n int
+	args = append([]interface{}{work}, args...)
+	n, err := countChunks(db, "files f JOIN %s c ON c.sourceid = f.id WHERE f.work_id = ? AND "+only, args...)
+	if err != nil {
+		return c, err
+	}
+	if n == 0 {
+		return c, errNoChunks
+	}
+	err = db.QueryRow(`SELECT `+chunkrowCols+`
+		FROM files f JOIN chunks c ON c.sourceid = f.id
+		WHERE f.work_id = ? AND `+only+` LIMIT 1 OFFSET ?`, append(args, r.Intn(n))...).
+		Scan(&c.ID, &c.Text, &c.Title, &c.Author, &c.StableID)
+	return c, err
+}
@@ -0,0 +1,101 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// quoted is how many characters c comes to as a post: its text, verse
+// breaks as " / ", a line break and its attribution.
+func quoted(c chunkrow) int {
+	return utf8.RuneCountInString(strings.ReplaceAll(c.Text, "\n\n", " / ")) + 1 + utf8.RuneCountInString(attribution(c, nil))
+}
+
+func TestFits(t *testing.T) {
+	db := testDB(t)
+	crusoe := addBook(t, db, "The Life and Strange Surprizing Adventures of Robinson Crusoe, of York, Mariner", "Daniel Defoe", "")
+	insertChunk(t, db, crusoe, 0, "I was born in the year 1632, in the city of York, of a good family, though not of that country.")
+	insertChunk(t, db, crusoe, 1, "It happened one day, about noon, going towards my boat, I was exceedingly surprised with the print of a man's naked foot on the shore, which was very plain to be seen on the sand.")
+	anon := addBook(t, db, "Beowulf", "", "")
+	insertChunk(t, db, anon, 0, "Lo, praise of the prowess of people-kings\n\nof spear-armed Danes, in days long sped,\n\nwe have heard, and what honor the athelings won!")
+	misérables := addBook(t, db, "Les Misérables, Tome I: Fantine", "Victor Hugo", "")
+	insertChunk(t, db, misérables, 0, "En 1815, M. Charles-François-Bienvenu Myriel était évêque de Digne.")
+
+	var all []chunkrow
+	for _, id := range []int{1, 2, 3, 4} {
+		c, err := chunkByID(db, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, c)
+	}
+	// at and about each chunk's length as a post, exactly those that come
+	// to no more are drawn from
+	for _, c := range all {
+		for _, n := range []int{quoted(c) - 1, quoted(c), quoted(c) + 1} {
+			var want []int
+			for _, o := range all {
+				if quoted(o) <= n {
+					want = append(want, o.ID)
+				}
+			}
+			got, err := sampleIDs(db, chunkFilter{Fits: n}, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Ints(got)
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("fitting %d characters drew from %v, want %v", n, got, want)
+			}
+		}
+	}
+
+	// what random prints fits, attribution and all
+	longest := quoted(all[1])
+	for i := 0; i < 20; i++ {
+		out, err := captureStdout(t, func() error { return randomCmd([]string{"--fits", "150", "--width", "0"}) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = strings.ReplaceAll(strings.TrimSuffix(out, "\n"), "\n\n", " / ")
+		if n := utf8.RuneCountInString(out); n > 150 || strings.Contains(out, "naked foot") {
+			t.Errorf("random --fits 150 printed %d characters:\n%s", n, out)
+		}
+	}
+	if _, err := captureStdout(t, func() error { return randomCmd([]string{"--fits", "50"}) }); err == nil || err.Error() != "no chunk satisfies the filters" {
+		t.Errorf("random --fits 50: %v", err)
+	} else if !errors.Is(err, errNoChunks) {
+		t.Errorf("random --fits 50: %v isn't errNoChunks", err)
+	}
+
+	s := testServer(t, db)
+	get := func(q string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/chunks/random?"+q, nil))
+		return w
+	}
+	for i := 0; i < 10; i++ {
+		w := get("fits=150")
+		var c chunkrow
+		if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &c) != nil || quoted(c) > 150 {
+			t.Fatalf("GET /chunks/random?fits=150: %d %s", w.Code, w.Body)
+		}
+	}
+	if w := get("fits=" + strconv.Itoa(longest)); w.Code != http.StatusOK {
+		t.Errorf("GET /chunks/random fitting the longest: %d %s", w.Code, w.Body)
+	}
+	if w := get("fits=50"); w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "no chunk satisfies the filters") {
+		t.Errorf("GET /chunks/random?fits=50: %d %s", w.Code, w.Body)
+	}
+	if w := get("fits=lots"); w.Code != http.StatusBadRequest {
+		t.Errorf("GET /chunks/random?fits=lots: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,268 @@
+package cli
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync/atomic"
+)
+
+// Chunking a book that has chunks already, or whose old version does,
+// keeps those the new chunking cuts again rather than writing them anew. A
+// corrected edition mostly differs in a few paragraphs, and a chunk kept
+// keeps its id, and with it its flags, content flags, token count, what it
+// was served as and whatever is kept of it outside gutchunk by its id. The
+// chunks there were and the new ones are aligned by their stable ids (see
+// stableid.go), hashes of their text with its runs of white space made
+// single spaces, made for those there were written without them. The
+// longest sequence of them both have in order is kept, and a chunk kept
+// whose text differs in white space only takes the new text. Each chunk
+// kept is written as the chunk it is now, at its new ordinal with its new
+// position, work and kind; the new ones are written with ids of their own,
+// and the chunks not kept are gone as ever, their stable ids mapped to the
+// chunks in their place. A new version takes the chunks it keeps from the
+// version it supersedes, which goes on holding those it didn't keep,
+// superseded with it. chunk and run say how many chunks were kept and how
+// many written new, and --full-rechunk writes every chunk anew, as before.
+
+// rechunks are how many books chunked before, or with an old version
+// chunked, a run chunked, and how many of their chunks it kept, wrote new
+// and took away.
+var rechunks struct {
+	books, kept, written, dropped int64
+}
+
+// priorChunk is a chunk there was, as alignChunks reads it.
+type priorChunk struct {
+	id          int64
+	text        string
+	stableID    string
+	tokens      interface{}
+	boilerplate interface{}
+}
+
+// resetRechunks starts the counts rechunkReport gives over, for a run of
+// their own.
+func resetRechunks() {
+	atomic.StoreInt64(&rechunks.books, 0)
+	atomic.StoreInt64(&rechunks.kept, 0)
+	atomic.StoreInt64(&rechunks.written, 0)
+	atomic.StoreInt64(&rechunks.dropped, 0)
+}
+
+// rechunkReport says how many chunks of the books chunked before were
+// kept, "" when there were none.
+func rechunkReport() string {
+	books := atomic.LoadInt64(&rechunks.books)
+	if books == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d books had chunks, or an old version with them: kept %d of the chunks, wrote %d new and took away %d",
+		books, atomic.LoadInt64(&rechunks.kept), atomic.LoadInt64(&rechunks.written), atomic.LoadInt64(&rechunks.dropped))
+}
+
+// alignChunks is the chunk there was that each of chunks, book id's new
+// ones as cut by strategy, keeps, nil for one written new, the book the
+// chunks there were are of, id or the version id supersedes when id has
+// none, and how many there were.
+func alignChunks(tx *sql.Tx, id int, strategy string, chunks []string) ([]*priorChunk, int, int, error) {
+	var ebook int
+	if err := tx.QueryRow("SELECT coalesce(ebook, 0) FROM files WHERE id = ?", id).Scan(&ebook); err != nil {
+		return nil, 0, 0, err
+	}
+	from := id
+	prior, err := priorChunks(tx, id)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if len(prior) == 0 {
+		err = tx.QueryRow("SELECT id FROM files WHERE superseded_by = ? ORDER BY id DESC LIMIT 1", id).Scan(&from)
+		if err == sql.ErrNoRows {
+			return make([]*priorChunk, len(chunks)), id, 0, nil
+		}
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		if prior, err = priorChunks(tx, from); err != nil {
+			return nil, 0, 0, err
+		}
+	}
+	// the stable ids they had, or would have had, and will have; in the
+	// reference storage mode a chunk's text is read from the content as it
+	// is now, which an edit in place has changed
+	scope := stableScope(id, ebook)
+	texts := make([]string, len(prior))
+	for i, c := range prior {
+		texts[i] = c.text
+	}
+	olds := stableIDs(scope, strategy, texts)
+	for i, c := range prior {
+		if c.stableID != "" {
+			olds[i] = c.stableID
+		}
+	}
+	news := stableIDs(scope, strategy, chunks)
+	kept := make([]*priorChunk, len(chunks))
+	for n, o := range alignHashes(olds, news) {
+		if o >= 0 {
+			kept[n] = &prior[o]
+		}
+	}
+	return kept, from, len(prior), nil
+}
+
+// priorChunks reads book id's chunks, in order.
+func priorChunks(tx *sql.Tx, id int) ([]priorChunk, error) {
+	rows, err := tx.Query("SELECT id, coalesce(chunk, ''), coalesce(stable_id, ''), token_count, boilerplate FROM chunks WHERE sourceid = ? ORDER BY ordinal, id", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var chunks []priorChunk
+	for rows.Next() {
+		var c priorChunk
+		if err = rows.Scan(&c.id, &c.text, &c.stableID, &c.tokens, &c.boilerplate); err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, c)
+	}
+	return chunks, rows.Err()
+}
+
+// alignCells is the most cells the table alignHashes fills may have; past
+// it, what is between the unchanged start and end is aligned greedily.
+const alignCells = 1 << 22
+
+// alignHashes is, for each of news, the index of the one of olds it is
+// paired with, or -1: a longest common subsequence of the two, after the
+// start and end they have in common.
+func alignHashes(olds, news []string) []int {
+	pairs := make([]int, len(news))
+	for i := range pairs {
+		pairs[i] = -1
+	}
+	start := 0
+	for start < len(olds) && start < len(news) && olds[start] == news[start] {
+		pairs[start] = start
+		start++
+	}
+	oe, ne := len(olds), len(news)
+	for oe > start && ne > start && olds[oe-1] == news[ne-1] {
+		oe--
+		ne--
+		pairs[ne] = oe
+	}
+	o, n := olds[start:oe], news[start:ne]
+	if len(o) == 0 || len(n) == 0 {
+		return pairs
+	}
+	if len(o)*len(n) > alignCells {
+		// in order, each to the first like one after the last paired
+		at := map[string][]int{}
+		for i, h := range o {
+			at[h] = append(at[h], i)
+		}
+		next := 0
+		for j, h := range n {
+			is := at[h]
+			k := sort.SearchInts(is, next)
+			if k < len(is) {
+				pairs[start+j] = start + is[k]
+				next = is[k] + 1
+			}
+		}
+		return pairs
+	}
+	// lcs[i][j] is the length of the longest common subsequence of o[i:]
+	// and n[j:]
+	w := len(n) + 1
+	lcs := make([]int32, (len(o)+1)*w)
+	for i := len(o) - 1; i >= 0; i-- {
+		for j := len(n) - 1; j >= 0; j-- {
+			switch {
+			case o[i] == n[j]:
+				lcs[i*w+j] = lcs[(i+1)*w+j+1] + 1
+			case lcs[(i+1)*w+j] >= lcs[i*w+j+1]:
+				lcs[i*w+j] = lcs[(i+1)*w+j]
+			default:
+				lcs[i*w+j] = lcs[i*w+j+1]
+			}
+		}
+	}
+	for i, j := 0, 0; i < len(o) && j < len(n); {
+		switch {
+		case o[i] == n[j]:
+			pairs[start+j] = start + i
+			i++
+			j++
+		case lcs[(i+1)*w+j] >= lcs[i*w+j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return pairs
+}
+
+// rechunked counts a book that had chunks, of which kept were kept and
+// written new, the others taken away unless they were of its old version.
+func rechunked(had, kept, written int, own bool) {
+	atomic.AddInt64(&rechunks.books, 1)
+	atomic.AddInt64(&rechunks.kept, int64(kept))
+	atomic.AddInt64(&rechunks.written, int64(written))
+	if own {
+		atomic.AddInt64(&rechunks.dropped, int64(had-kept))
+	}
+}
+
+// rewordKept gives the chunks kept whose text changed in white space only,
+// at ids, the hash of their text in their flags, and has flag-content scan
+// them again.
+func rewordKept(tx *sql.Tx, kept []*priorChunk, ids []int64, chunks []string) error {
+	for i, k := range kept {
+		if k == nil || k.text == chunks[i] {
+			continue
+		}
+		if _, err := tx.Exec("UPDATE chunk_flags SET hash = ? WHERE chunk_id = ?", textHash(chunks[i]), ids[i]); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM content_scans WHERE chunk_id = ?", ids[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// takeKept takes the chunks kept from book from, the version sourceid
+// supersedes, to be written again as sourceid's, keeping its count.
+func takeKept(tx *sql.Tx, from int, keptIDs string, n int) error {
+	if _, err := tx.Exec("DELETE FROM chunks WHERE id IN (SELECT value FROM json_each(?))", keptIDs); err != nil {
+		return err
+	}
+	_, err := tx.Exec("UPDATE chunk_counts SET chunks = max(chunks - ?, 0) WHERE sourceid = ?", n, from)
+	return err
+}
+
+// lastKept is the highest id of the chunks kept.
+func lastKept(kept []*priorChunk) int64 {
+	var last int64
+	for _, k := range kept {
+		if k != nil && k.id > last {
+			last = k.id
+		}
+	}
+	return last
+}
+
+// keptList is the ids of the chunks kept, as json.
+func keptList(kept []*priorChunk) (string, int) {
+	ids := []int64{}
+	for _, k := range kept {
+		if k != nil {
+			ids = append(ids, k.id)
+		}
+	}
+	b, _ := json.Marshal(ids)
+	return string(b), len(ids)
+}
@@ -0,0 +1,278 @@
+package cli
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAlignHashes(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		olds, news []string
+		want       []int
+	}{
+		{"the same", []string{"a", "b", "c"}, []string{"a", "b", "c"}, []int{0, 1, 2}},
+		{"one changed", []string{"a", "b", "c"}, []string{"a", "x", "c"}, []int{0, -1, 2}},
+		{"two changed", []string{"a", "b", "c", "d", "e"}, []string{"a", "x", "c", "y", "e"}, []int{0, -1, 2, -1, 4}},
+		{"one put in", []string{"a", "c"}, []string{"a", "b", "c"}, []int{0, -1, 1}},
+		{"one taken out", []string{"a", "b", "c"}, []string{"a", "c"}, []int{0, 2}},
+		{"the first and last changed", []string{"a", "b", "c"}, []string{"x", "b", "y"}, []int{-1, 1, -1}},
+		{"moved past others", []string{"a", "b", "c", "d"}, []string{"c", "a", "b", "d"}, []int{-1, 0, 1, 3}},
+		{"all new", []string{"a", "b"}, []string{"x", "y", "z"}, []int{-1, -1, -1}},
+		{"none before", nil, []string{"x", "y"}, []int{-1, -1}},
+		{"none now", []string{"a", "b"}, nil, []int{}},
+	} {
+		if got := alignHashes(c.olds, c.news); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: alignHashes(%v, %v) = %v, want %v", c.name, c.olds, c.news, got, c.want)
+		}
+	}
+
+	// past alignCells, what is between the start and end is aligned
+	// greedily, in order
+	n := 2100
+	olds, news := make([]string, n), make([]string, n)
+	want := make([]int, n)
+	for i := range olds {
+		olds[i] = fmt.Sprint("o", i)
+		news[i] = olds[i]
+		want[i] = i
+	}
+	news[0], news[n-1] = "first", "last"
+	news[1000], news[1001] = olds[1001], olds[1000]
+	want[0], want[n-1], want[1000], want[1001] = -1, -1, 1001, -1
+	if got := alignHashes(olds, news); !reflect.DeepEqual(got, want) {
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("aligned greedily, chunk %d is paired with %d, want %d", i, got[i], want[i])
+			}
+		}
+	}
+}
+
+// rechunkLibrary is a book of eight paragraphs, chunked, with a flag, a
+// content flag and scan, a token count and boilerplate on its chunks,
+// the book's id and its chunks' ids.
+func rechunkLibrary(t *testing.T, db *sql.DB) (int, []int) {
+	t.Helper()
+	book := addBook(t, db, "Villette", "Charlotte Brontë", testBook("Villette", testParagraphs(8)))
+	if _, err := captureStdout(t, func() error { return chunkCmd(nil) }); err != nil {
+		t.Fatal(err)
+	}
+	ids := chunkIDs(t, db, book)
+	if len(ids) != 8 {
+		t.Fatalf("chunked, the book has chunks %v", ids)
+	}
+	for _, f := range []int{ids[0], ids[2]} {
+		var text string
+		if err := db.QueryRow("SELECT chunk FROM chunks WHERE id = ?", f).Scan(&text); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("INSERT INTO chunk_flags (chunk_id, hash, flag) VALUES (?, ?, ?)", f, textHash(text), flagPin); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, q := range []string{
+		fmt.Sprintf("INSERT INTO content_flags (chunk_id, term, count) VALUES (%d, 'moors', 1), (%d, 'moors', 1)", ids[1], ids[2]),
+		fmt.Sprintf("INSERT INTO content_scans (chunk_id, wordlist) SELECT id, 'list' FROM chunks WHERE sourceid = %d", book),
+		fmt.Sprintf("UPDATE chunks SET token_count = 100 + ordinal WHERE sourceid = %d", book),
+		fmt.Sprintf("UPDATE chunks SET boilerplate = 1 WHERE id = %d", ids[7]),
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return book, ids
+}
+
+// editParagraphs rewrites book as testParagraphs(8) with edit made to
+// its paragraphs.
+func editParagraphs(t *testing.T, db *sql.DB, book int, edit func(body []string) []string) {
+	t.Helper()
+	body := edit(strings.Split(testParagraphs(8), "\n\n"))
+	if _, err := db.Exec("UPDATE files SET content = ? WHERE id = ?", testBook("Villette", strings.Join(body, "\n\n")), book); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRechunkKeepsChunks(t *testing.T) {
+	db := testDB(t)
+	book, ids := rechunkLibrary(t, db)
+	chunk := func(args ...string) string {
+		t.Helper()
+		out, err := captureStdout(t, func() error { return chunkCmd(args) })
+		if err != nil {
+			t.Fatalf("chunk %s: %v", strings.Join(args, " "), err)
+		}
+		return out
+	}
+
+	// two paragraphs edited, their chunks alone are written new
+	editParagraphs(t, db, book, func(body []string) []string {
+		body[2] = strings.Replace(body[2], "number iii,", "number three,", 1)
+		body[5] = strings.Replace(body[5], "number iiiiii,", "number six,", 1)
+		return body
+	})
+	if out := chunk(); !strings.Contains(out, "\n1 books had chunks, or an old version with them: kept 6 of the chunks, wrote 2 new and took away 2\n") {
+		t.Errorf("chunk of two paragraphs edited printed\n%s", out)
+	}
+	now := chunkIDs(t, db, book)
+	if len(now) != 8 {
+		t.Fatalf("rechunked, the book has chunks %v", now)
+	}
+	for i := range ids {
+		if (now[i] == ids[i]) != (i != 2 && i != 5) {
+			t.Errorf("with the third and sixth paragraphs edited, chunk %d went from id %d to %d", i, ids[i], now[i])
+		}
+	}
+	if now[2] <= ids[7] || now[5] <= now[2] {
+		t.Errorf("the chunks written new have ids %d and %d, after %v", now[2], now[5], ids)
+	}
+	if got := names(t, db, "SELECT coalesce(chunk_id, '-') FROM chunk_flags ORDER BY id"); got != fmt.Sprintf("%d\n-\n", ids[0]) {
+		t.Errorf("the flags are on chunks\n%s", got)
+	}
+	if got := names(t, db, "SELECT chunk_id FROM content_flags"); got != fmt.Sprintf("%d\n", ids[1]) {
+		t.Errorf("the content flags are on chunks\n%s", got)
+	}
+	if got := names(t, db, "SELECT count(*) FROM content_scans"); got != "6\n" {
+		t.Errorf("%s chunks are scanned", got)
+	}
+	if got := names(t, db, fmt.Sprintf("SELECT ordinal || ' ' || coalesce(token_count, '-') || ' ' || coalesce(boilerplate, '-') FROM chunks WHERE sourceid = %d ORDER BY ordinal", book)); got !=
+		"0 100 -\n1 101 -\n2 - -\n3 103 -\n4 104 -\n5 - -\n6 106 -\n7 107 1\n" {
+		t.Errorf("the chunks' token counts and boilerplate are\n%s", got)
+	}
+	if got := names(t, db, fmt.Sprintf("SELECT count(*) FROM chunks WHERE sourceid = %d AND chunk LIKE '%%number three,%%'", book)); got != "1\n" {
+		t.Errorf("%s chunks have the third paragraph's new text", got)
+	}
+
+	// chunked again as it is, every chunk is kept
+	if out := chunk(); !strings.Contains(out, "kept 8 of the chunks, wrote 0 new and took away 0\n") {
+		t.Errorf("chunk of the book unchanged printed\n%s", out)
+	}
+	if got := chunkIDs(t, db, book); !reflect.DeepEqual(got, now) {
+		t.Errorf("chunked again, the ids are %v, want %v", got, now)
+	}
+
+	// a chunk cut again differing in white space only is kept, taking
+	// the new text, and is counted and scanned again
+	texts := strings.Split(strings.TrimSuffix(names(t, db, fmt.Sprintf("SELECT chunk FROM chunks WHERE sourceid = %d ORDER BY ordinal", book)), "\n"), "\n")
+	texts[0] = strings.Replace(texts[0], "of the book,", "of  the book,", 1)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = writeChunks(tx, book, defaultStrategy, texts, nil, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got := chunkIDs(t, db, book); !reflect.DeepEqual(got, now) {
+		t.Errorf("respaced, the ids are %v, want %v", got, now)
+	}
+	var text, hash string
+	var tokens sql.NullInt64
+	if err = db.QueryRow("SELECT c.chunk, c.token_count, f.hash FROM chunks c JOIN chunk_flags f ON f.chunk_id = c.id WHERE c.id = ?", ids[0]).Scan(&text, &tokens, &hash); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(text, "of  the book,") || tokens.Valid || hash != textHash(text) {
+		t.Errorf("respaced, the chunk is %q, of %v tokens, flagged with hash %s", text, tokens, hash)
+	}
+	if got := names(t, db, fmt.Sprintf("SELECT count(*) FROM content_scans WHERE chunk_id = %d", ids[0])); got != "0\n" {
+		t.Errorf("respaced, the chunk has %s scans", got)
+	}
+
+	// a paragraph taken out, those after it keep their ids at new
+	// ordinals
+	editParagraphs(t, db, book, func(body []string) []string {
+		body[2] = strings.Replace(body[2], "number iii,", "number three,", 1)
+		body[5] = strings.Replace(body[5], "number iiiiii,", "number six,", 1)
+		return append(body[:6:6], body[7])
+	})
+	if out := chunk(); !strings.Contains(out, "kept 7 of the chunks, wrote 0 new and took away 1\n") {
+		t.Errorf("chunk of a paragraph taken out printed\n%s", out)
+	}
+	if got, want := chunkIDs(t, db, book), append(now[:6:6], now[7]); !reflect.DeepEqual(got, want) {
+		t.Errorf("with a paragraph taken out, the ids are %v, want %v", got, want)
+	}
+	if got := names(t, db, fmt.Sprintf("SELECT ordinal FROM chunks WHERE id = %d", now[7])); got != "6\n" {
+		t.Errorf("the last chunk is at ordinal %s", got)
+	}
+
+	// --full-rechunk writes every chunk anew, keeping nothing of them but
+	// the flags found again by their text
+	if out := chunk("--full-rechunk"); strings.Contains(out, "books had chunks") {
+		t.Errorf("chunk --full-rechunk printed\n%s", out)
+	}
+	if got := names(t, db, fmt.Sprintf("SELECT count(*) FROM chunks WHERE sourceid = %d AND token_count IS NULL AND boilerplate IS NULL", book)); got != "7\n" {
+		t.Errorf("with --full-rechunk, %s of 7 chunks are without a token count or boilerplate", got)
+	}
+	if got := names(t, db, "SELECT count(*) FROM content_flags UNION ALL SELECT count(*) FROM content_scans"); got != "0\n0\n" {
+		t.Errorf("with --full-rechunk, the content flags and scans are\n%s", got)
+	}
+	if got := names(t, db, "SELECT count(*) FROM chunk_flags WHERE chunk_id IS NOT NULL"); got != "1\n" {
+		t.Errorf("with --full-rechunk, %s flags are on chunks", got)
+	}
+}
+
+// A re-release keeps the chunks it shares with the version it supersedes,
+// chunked by chunk, run and run --pipeline alike.
+func TestRechunkReRelease(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		args []string
+	}{
+		{"chunk", nil},
+		{"run", []string{}},
+		{"run --pipeline", []string{"--pipeline"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			db := testDB(t)
+			root := t.TempDir()
+			chunk := func(args ...string) string {
+				t.Helper()
+				out, err := captureStdout(t, func() error {
+					if c.args == nil {
+						if err := ingestCmd([]string{"--target", root}); err != nil {
+							return err
+						}
+						return chunkCmd(args)
+					}
+					return runCmd(append(append([]string{"--target", root}, c.args...), args...))
+				})
+				if err != nil {
+					t.Fatalf("%s: %v", c.name, err)
+				}
+				return out
+			}
+			writeTestZip(t, filepath.Join(root, "etext98", "pandp10.zip"), zipEntry{"pandp10.txt", pandp("first")})
+			chunk()
+			old := chunkIDs(t, db, 1)
+			if _, err := db.Exec("UPDATE chunks SET token_count = 7 WHERE sourceid = 1"); err != nil {
+				t.Fatal(err)
+			}
+			writeTestZip(t, filepath.Join(root, "etext98", "pandp11.zip"), zipEntry{"pandp11.txt", pandp("corrected")})
+			if out := chunk(); !strings.Contains(out, "\n1 books had chunks, or an old version with them: kept 2 of the chunks, wrote 1 new and took away 0\n") {
+				t.Errorf("%s of a re-release printed\n%s", c.name, out)
+			}
+			// the new version has the chunks the two share, and the old
+			// one holds on to its own
+			now := chunkIDs(t, db, 2)
+			if len(old) != 3 || len(now) != 3 || now[0] != old[0] || now[1] != old[1] || now[2] == old[2] {
+				t.Errorf("the old version had chunks %v, and the new one has %v", old, now)
+			}
+			if got := chunkIDs(t, db, 1); !reflect.DeepEqual(got, old[2:]) {
+				t.Errorf("the old version has chunks %v, want %v", got, old[2:])
+			}
+			if got := names(t, db, "SELECT coalesce(token_count, '-') FROM chunks WHERE sourceid = 2 ORDER BY ordinal"); got != "7\n7\n-\n" {
+				t.Errorf("the new version's token counts are\n%s", got)
+			}
+			if got := names(t, db, "SELECT sourceid || ' ' || chunks FROM chunk_counts ORDER BY sourceid"); got != "1 1\n2 3\n" {
+				t.Errorf("the chunk counts are\n%s", got)
+			}
+		})
+	}
+}
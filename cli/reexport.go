@@ -0,0 +1,124 @@
+package cli
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Exports and the server give each chunk its book's title, author and
+// language as they are when asked, but a copy exported before a book's
+// names were put right keeps the wrong ones. files.metadata_updated_at is
+// when a book's name, author or language last changed after it was
+// ingested, kept by a trigger (see migrate) whatever changed it: the
+// catalog, meta import, reparse-headers, metadata-conflicts --resolve or
+// anything after. gutchunk reexport-metadata --since-run 42 writes a line
+// for each chunk of the books changed since, with its id and the book's
+// names as they are now, for a copy to apply over what it has; chunks
+// written since come from gutchunk changes instead. Most commands changing
+// names don't start a run, so --since-run goes by when run 42 started,
+// and takes in what changed during it too: a few lines more than needed
+// rather than any fewer.
+
+// metadataDelta is one line of reexport-metadata.
+type metadataDelta struct {
+	ID       int    `json:"id"`
+	Title    string `json:"title"`
+	Author   string `json:"author"`
+	Language string `json:"language"`
+}
+
+func reexportMetadataCmd(args []string) error {
+	fs := flag.NewFlagSet("reexport-metadata", flag.ExitOnError)
+	sinceRun := fs.Int64("since-run", -1, "chunks of the books whose names changed since this run started, by its id")
+	sinceDate := fs.String("since", "", "chunks of the books whose names changed since this date, or date and time, in UTC")
+	format := fs.String("format", "jsonl", "what to write: jsonl")
+	out := fs.String("out", "-", "file to write to")
+	fs.Parse(args)
+
+	if (*sinceRun >= 0) == (*sinceDate != "") {
+		return usagef("give one of --since-run and --since")
+	}
+	if *format != "jsonl" {
+		return usagef("--format only writes jsonl")
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err = requireSchema(schemaGap{"files", "metadata_updated_at"}); err != nil {
+		return err
+	}
+
+	since := *sinceDate
+	if since != "" {
+		if since, err = parseSince(since); err != nil {
+			return usageError{err.Error()}
+		}
+	} else {
+		err = db.QueryRow("SELECT started_at FROM runs WHERE id = ?", *sinceRun).Scan(&since)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("there is no run %d", *sinceRun)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	chunks, books, err := writeMetadataDelta(db, bw, since)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d chunks of %d books whose names changed since %s\n", chunks, books, since)
+	return bw.Flush()
+}
+
+// writeMetadataDelta writes a metadataDelta for each chunk of the books
+// whose names changed at or after since, as export writes them: leaving
+// out boilerplate and removed books.
+func writeMetadataDelta(db *sql.DB, w io.Writer, since string) (int, int, error) {
+	rows, err := db.Query(`
+		SELECT c.id, c.sourceid, coalesce(f.name, ''), coalesce(f.author, ''), coalesce(f.language, '')
+		FROM chunks c JOIN files f ON f.id = c.sourceid
+		WHERE f.metadata_updated_at >= ? AND f.deleted_at IS NULL AND c.boilerplate IS NULL
+		ORDER BY c.id`, since)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+	enc := json.NewEncoder(w)
+	chunks := 0
+	books := map[int]bool{}
+	for rows.Next() {
+		var d metadataDelta
+		var book int
+		if err = rows.Scan(&d.ID, &book, &d.Title, &d.Author, &d.Language); err != nil {
+			return chunks, len(books), err
+		}
+		if err = enc.Encode(d); err != nil {
+			return chunks, len(books), err
+		}
+		chunks++
+		books[book] = true
+	}
+	return chunks, len(books), rows.Err()
+}
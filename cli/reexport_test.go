@@ -0,0 +1,137 @@
+package cli
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestReexportMetadata(t *testing.T) {
+	db := testDB(t)
+	root := t.TempDir()
+	for i, title := range []string{"Emma", "Persuasion", "Villette"} {
+		dir := string(rune('1' + i))
+		writeTestZip(t, filepath.Join(root, dir, dir+dir+".zip"), zipEntry{dir + dir + ".txt", testBook(title, testParagraphs(2+i))})
+	}
+	for _, cmd := range []func() error{
+		func() error { return ingestCmd([]string{"--target", root}) },
+		func() error { return chunkCmd(nil) },
+	} {
+		if _, err := captureStdout(t, cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// ingested an hour ago, as far as the stamps go
+	for _, q := range []string{
+		"UPDATE runs SET started_at = datetime(started_at, '-1 hour')",
+		"UPDATE files SET metadata_updated_at = datetime(metadata_updated_at, '-1 hour')",
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	delta := func(args ...string) []metadataDelta {
+		t.Helper()
+		out, err := captureStdout(t, func() error { return reexportMetadataCmd(args) })
+		if err != nil {
+			t.Fatalf("reexport-metadata %s: %v", strings.Join(args, " "), err)
+		}
+		var ds []metadataDelta
+		for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+			if line == "" {
+				continue
+			}
+			var d metadataDelta
+			if err = json.Unmarshal([]byte(line), &d); err != nil {
+				t.Fatal(err)
+			}
+			ds = append(ds, d)
+		}
+		return ds
+	}
+	if ds := delta("--since-run", "2"); len(ds) != 0 {
+		t.Errorf("with no names changed, reexport-metadata wrote %+v", ds)
+	}
+
+	// Persuasion given a title and language of its own by its sidecar
+	dir := t.TempDir()
+	if _, err := captureStdout(t, func() error { return metaCmd([]string{"export", "--dir", dir}) }); err != nil {
+		t.Fatal(err)
+	}
+	side := filepath.Join(dir, "22.json")
+	b, err := os.ReadFile(side)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m bookMeta
+	if err = json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	m.Title, m.Author, m.Language = "Persuasion: A Novel", "Jane Austen", "en"
+	if b, err = json.Marshal(m); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(side, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = captureStdout(t, func() error { return metaCmd([]string{"import", "--dir", dir}) }); err != nil {
+		t.Fatal(err)
+	}
+	// and a chunk of it boilerplate, which export leaves out
+	if _, err = db.Exec("UPDATE chunks SET boilerplate = 1 WHERE id = (SELECT min(id) FROM chunks WHERE sourceid = 2)"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := ids(t, db, "SELECT id FROM chunks WHERE sourceid = 2 AND boilerplate IS NULL ORDER BY id")
+	for _, args := range [][]string{{"--since-run", "2"}, {"--since-run", "1", "--format", "jsonl"}, {"--since", "2000-01-01"}} {
+		ds := delta(args...)
+		var got []string
+		for _, d := range ds {
+			got = append(got, strconv.Itoa(d.ID))
+			if d.Title != "Persuasion: A Novel" || d.Author != "Jane Austen" || d.Language != "en" {
+				t.Errorf("reexport-metadata %s wrote %+v", strings.Join(args, " "), d)
+			}
+		}
+		if strings.Join(got, " ") != want {
+			t.Errorf("reexport-metadata %s wrote chunks %s, want %s", strings.Join(args, " "), strings.Join(got, " "), want)
+		}
+	}
+
+	// a name set to what it was isn't a change, and a book removed is
+	// left out
+	if _, err = db.Exec("UPDATE files SET metadata_updated_at = NULL WHERE id = 2; UPDATE files SET name = name, author = author"); err != nil {
+		t.Fatal(err)
+	}
+	if ds := delta("--since-run", "2"); len(ds) != 0 {
+		t.Errorf("with names set to themselves, reexport-metadata wrote %+v", ds)
+	}
+	if _, err = db.Exec("UPDATE files SET language = 'fr' WHERE id = 3"); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "delta.jsonl")
+	if _, err = captureStderr(t, func() error { return reexportMetadataCmd([]string{"--since-run", "2", "--out", out}) }); err != nil {
+		t.Fatal(err)
+	}
+	if b, err = os.ReadFile(out); err != nil || strings.Count(string(b), "\n") != 4 || !strings.Contains(string(b), `"title":"Villette","author":"","language":"fr"}`) {
+		t.Errorf("reexport-metadata --out wrote\n%s(%v)", b, err)
+	}
+	if _, err = captureStdout(t, func() error { return rmCmd([]string{"3"}) }); err != nil {
+		t.Fatal(err)
+	}
+	if ds := delta("--since-run", "2"); len(ds) != 0 {
+		t.Errorf("with the book removed, reexport-metadata wrote %+v", ds)
+	}
+
+	if _, err = captureStdout(t, func() error { return reexportMetadataCmd([]string{"--since-run", "99"}) }); err == nil ||
+		!strings.Contains(err.Error(), "there is no run 99") {
+		t.Errorf("reexport-metadata --since-run 99: %v", err)
+	}
+	for _, args := range [][]string{nil, {"--since-run", "1", "--since", "2000-01-01"}, {"--since", "yesterday"}, {"--since-run", "1", "--format", "csv"}} {
+		if _, err = captureStdout(t, func() error { return reexportMetadataCmd(args) }); exitCode(err) != exitUsage {
+			t.Errorf("reexport-metadata %s: %v, want a usage error", strings.Join(args, " "), err)
+		}
+	}
+}
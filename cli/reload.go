@@ -0,0 +1,205 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// serve reads its --authors-file, --blockphrase-file and --overrides as it
+// starts, and again when it is sent a SIGHUP, or asked to with POST
+// /admin/reload and the --api-key, so an edit to any is taken up without a
+// restart dropping the requests in flight. All are read before any is used,
+// and each request is served by the one configuration it started with, the
+// old or the new, never part of each; one that won't read, an authors file
+// with a bad line say, leaves the old in place, and the reload fails saying
+// why. A reload logs, and answers, how many entries each source had and has
+// and whether they changed. Presets are read from the database by each
+// request naming one, so one saved is used at once; a reload counts them.
+// The books serve chunks are those uploaded to it, which the overrides find
+// by the ebook number in their header (see overrides.find).
+
+// serveConfig is serve's configuration read from files, and the presets
+// there were when it was.
+type serveConfig struct {
+	// authors whose chunks are never served, nil for none
+	authors *authorList
+	// what the chunks of uploads quoting license boilerplate are counted
+	// or dropped by
+	footer *blocklist
+	// what the chunks of uploads are cut by instead, for the books it
+	// names, nil for none
+	overrides *overrides
+	// how many presets there were, and a hash of them all
+	presets    int
+	presetHash string
+}
+
+// serveConfigFlags adds serve's configuration files' flags to fs and
+// returns what reads them.
+func serveConfigFlags(fs *flag.FlagSet) func() (*serveConfig, error) {
+	authors := authorsFlag(fs, "authors.toml whose deny and allow lists say whose chunks never to serve; read again on SIGHUP")
+	footer := footerFlags(fs)
+	overrides := overridesFlag(fs)
+	return func() (*serveConfig, error) {
+		c := &serveConfig{}
+		var err error
+		if c.authors, err = authors(); err != nil {
+			return nil, err
+		}
+		if c.authors != nil {
+			if err = requireSchema(schemaGap{"files", "author_norm"}); err != nil {
+				return nil, err
+			}
+		}
+		if c.footer, err = footer(); err != nil {
+			return nil, err
+		}
+		if c.overrides, err = overrides(); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+}
+
+// reloadOnHUP reloads s each time serve is sent a SIGHUP, until what it
+// returns is called.
+func (s *server) reloadOnHUP() func() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			logReload(s.reload())
+		}
+	}()
+	return func() {
+		signal.Stop(hup)
+		close(hup)
+	}
+}
+
+// configSource is what a reload made of one source of the configuration.
+type configSource struct {
+	Source  string `json:"source"`
+	Before  int    `json:"before"`
+	After   int    `json:"after"`
+	Changed bool   `json:"changed"`
+}
+
+// conf is the configuration a request is served by.
+func (s *server) conf() *serveConfig {
+	return s.config.Load().(*serveConfig)
+}
+
+// readConfig reads the configuration anew.
+func (s *server) readConfig() (*serveConfig, error) {
+	c, err := s.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	var all string
+	err = s.db.QueryRow("SELECT count(*), coalesce(group_concat(name || '?' || params, char(10)), '') FROM (SELECT name, params FROM presets ORDER BY name)").Scan(&c.presets, &all)
+	if err != nil {
+		return nil, fmt.Errorf("could not read presets: %w", err)
+	}
+	c.presetHash = textHash(all)
+	return c, nil
+}
+
+// reload reads the configuration again and, if all of it reads, puts it in
+// place of the old, saying what changed.
+func (s *server) reload() ([]configSource, error) {
+	s.reloading.Lock()
+	defer s.reloading.Unlock()
+	c, err := s.readConfig()
+	if err != nil {
+		return nil, err
+	}
+	old := s.conf()
+	s.config.Store(c)
+	return old.changes(c), nil
+}
+
+// changes is how each source differs in to.
+func (c *serveConfig) changes(to *serveConfig) []configSource {
+	var deny, allow, toDeny, toAllow []string
+	if c.authors != nil {
+		deny, allow = c.authors.deny, c.authors.allow
+	}
+	if to.authors != nil {
+		toDeny, toAllow = to.authors.deny, to.authors.allow
+	}
+	phrases := func(bl *blocklist) ([]string, bool) {
+		if bl == nil {
+			return nil, false
+		}
+		return bl.phrases, bl.strict
+	}
+	was, wasStrict := phrases(c.footer)
+	is, isStrict := phrases(to.footer)
+	return []configSource{
+		{"authors_file", len(deny) + len(allow), len(toDeny) + len(toAllow), !sameStrings(deny, toDeny) || !sameStrings(allow, toAllow)},
+		{"blockphrases", len(was), len(is), wasStrict != isStrict || !sameStrings(was, is)},
+		{"overrides", c.overrides.count(), to.overrides.count(), overridesHash(c.overrides) != overridesHash(to.overrides)},
+		{"presets", c.presets, to.presets, c.presetHash != to.presetHash},
+	}
+}
+
+func overridesHash(o *overrides) string {
+	if o == nil {
+		return ""
+	}
+	return o.hash
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// logReload logs what a reload made of each source, or why it was
+// rejected.
+func logReload(sources []configSource, err error) {
+	if err != nil {
+		log.Printf("warning: reload rejected, keeping the configuration as it was: %v", err)
+		return
+	}
+	parts := make([]string, len(sources))
+	for i, src := range sources {
+		parts[i] = fmt.Sprintf("%s %d to %d", src.Source, src.Before, src.After)
+		if src.Changed {
+			parts[i] += ", changed"
+		}
+	}
+	log.Printf("reloaded the configuration: %s", strings.Join(parts, "; "))
+}
+
+func (s *server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.apiKey == "" {
+		httpError(w, http.StatusForbidden, "reloading over http needs serve --api-key; send serve a SIGHUP instead")
+		return
+	}
+	sources, err := s.reload()
+	logReload(sources, err)
+	if err != nil {
+		httpError(w, http.StatusUnprocessableEntity, "reload rejected, keeping the configuration as it was: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"reloaded": sources})
+}
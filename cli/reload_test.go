@@ -0,0 +1,132 @@
+package cli
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// the override uploadChunks' uploads are cut by once reloadServer's file
+// has it: from the third of their five paragraphs on
+const startAtThird = "[ebook.1342]\nstart-at = \"number iii,\"\n"
+
+// reloadServer is a test server whose configuration is read from an
+// overrides file in a temp directory, at first empty, as serve
+// --overrides would read it. It returns where the file is.
+func reloadServer(t *testing.T) (*server, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "book-overrides.toml")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	config := serveConfigFlags(fs)
+	if err := fs.Parse([]string{"--overrides", path}); err != nil {
+		t.Fatal(err)
+	}
+	s := testServer(t, testDB(t))
+	s.apiKey = "key"
+	s.loadConfig = config
+	c, err := s.readConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.config.Store(c)
+	return s, path
+}
+
+// uploadChunks uploads ebook 1342 of five paragraphs, returning how many
+// chunks it was cut into.
+func uploadChunks(t *testing.T, h http.Handler) int {
+	t.Helper()
+	text := strings.Replace(testBook("Pride and Prejudice", testParagraphs(5)), "\n\nTitle:", " [EBook #1342]\n\nTitle:", 1)
+	w := postBook(h, "tok", "text/plain", text)
+	if w.Code != http.StatusCreated {
+		t.Errorf("upload: %d %s", w.Code, w.Body)
+		return -1
+	}
+	var res struct {
+		Chunks int `json:"chunks"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	return res.Chunks
+}
+
+func postReload(h http.Handler) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/admin/reload", nil)
+	r.Header.Set("X-API-Key", "key")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestReloadOverrides(t *testing.T) {
+	s, path := reloadServer(t)
+	h := s.routes()
+	if err := os.WriteFile(path, []byte(startAtThird), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w := postReload(h)
+	if w.Code != http.StatusOK {
+		t.Fatalf("reload: %d %s", w.Code, w.Body)
+	}
+	var res struct {
+		Reloaded []configSource `json:"reloaded"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	want := configSource{Source: "overrides", Before: 0, After: 1, Changed: true}
+	found := false
+	for _, src := range res.Reloaded {
+		if src.Source == "overrides" {
+			found = true
+			if src != want {
+				t.Errorf("overrides reloaded as %+v, want %+v", src, want)
+			}
+		} else if src.Changed {
+			t.Errorf("%s changed too", src.Source)
+		}
+	}
+	if !found {
+		t.Errorf("the reload didn't say what became of the overrides: %s", w.Body)
+	}
+	if n := uploadChunks(t, h); n != 3 {
+		t.Errorf("after the reload: %d chunks, want 3", n)
+	}
+}
+
+func TestReloadRejectsInvalid(t *testing.T) {
+	s, path := reloadServer(t)
+	h := s.routes()
+	if err := os.WriteFile(path, []byte(startAtThird), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if w := postReload(h); w.Code != http.StatusOK {
+		t.Fatalf("reload: %d %s", w.Code, w.Body)
+	}
+	was := s.conf()
+
+	if err := os.WriteFile(path, []byte(startAtThird+"[ebook.x]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w := postReload(h)
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "bad ebook number") {
+		t.Errorf("reload of a bad overrides file: %d %s, want 422 saying why", w.Code, w.Body)
+	}
+	if s.conf() != was {
+		t.Error("a rejected reload replaced the configuration")
+	}
+	if n := uploadChunks(t, h); n != 3 {
+		t.Errorf("after the rejected reload: %d chunks, want the old overrides' 3", n)
+	}
+}
@@ -0,0 +1,66 @@
+//go:build !windows
+
+package cli
+
+import (
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReloadOnHUP(t *testing.T) {
+	s, path := reloadServer(t)
+	h := s.routes()
+	if n := uploadChunks(t, h); n != 5 {
+		t.Fatalf("before the override: %d chunks, want 5", n)
+	}
+	stop := s.reloadOnHUP()
+	defer stop()
+
+	// uploads go on while the file changes and serve is sent SIGHUPs, each
+	// cut by the old overrides or the new
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	counts := map[int]int{}
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				n := uploadChunks(t, h)
+				mu.Lock()
+				counts[n]++
+				mu.Unlock()
+			}
+		}()
+	}
+	if err := os.WriteFile(path, []byte(startAtThird), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for s.conf().overrides.count() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("the overrides weren't reloaded after a SIGHUP")
+		}
+		syscall.Kill(os.Getpid(), syscall.SIGHUP)
+		time.Sleep(20 * time.Millisecond)
+	}
+	close(done)
+	wg.Wait()
+	for n, k := range counts {
+		if n != 5 && n != 3 {
+			t.Errorf("%d uploads were cut into %d chunks, want 5 or 3", k, n)
+		}
+	}
+	if n := uploadChunks(t, h); n != 3 {
+		t.Errorf("after the reload: %d chunks, want 3", n)
+	}
+}
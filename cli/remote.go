@@ -0,0 +1,404 @@
+package cli
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fetcher gets one file from the mirror, from byte from of it on when the
+// file is still the version validator names (see polite.go). errNotFound
+// means there is no such file; errors wrapping errTransient are worth
+// retrying, and errPartStale that the part had better be started over.
+type fetcher interface {
+	fetch(url string, from int64, validator string) (fetched, error)
+}
+
+// fetched is a file's body, starting at byte from of it: what was asked
+// for when the mirror resumes the file, else 0. validator is its ETag or
+// Last-Modified, if the mirror gave one.
+type fetched struct {
+	body      io.ReadCloser
+	from      int64
+	validator string
+}
+
+var (
+	errNotFound  = errors.New("not found")
+	errTransient = errors.New("transient")
+	errPartStale = fmt.Errorf("%w: the mirror can't go on with the part downloaded", errTransient)
+)
+
+type httpFetcher struct {
+	client *http.Client
+}
+
+func (h httpFetcher) fetch(url string, from int64, validator string) (fetched, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return fetched{}, err
+	}
+	req.Header.Set("User-Agent", "gutchunk")
+	if from > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", from))
+		req.Header.Set("If-Range", validator)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return fetched{}, fmt.Errorf("%w: %v", errTransient, err)
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return fetched{body: resp.Body, validator: responseValidator(resp)}, nil
+	case resp.StatusCode == http.StatusPartialContent && from > 0 && rangeStart(resp) == from:
+		return fetched{body: resp.Body, from: from, validator: validator}, nil
+	case resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		resp.Body.Close()
+		return fetched{}, errPartStale
+	case resp.StatusCode == http.StatusNotFound:
+		resp.Body.Close()
+		return fetched{}, errNotFound
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable:
+		resp.Body.Close()
+		if wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			return fetched{}, retryAfter{resp.Status, wait}
+		}
+		return fetched{}, fmt.Errorf("%w: %s", errTransient, resp.Status)
+	case resp.StatusCode >= 500:
+		resp.Body.Close()
+		return fetched{}, fmt.Errorf("%w: %s", errTransient, resp.Status)
+	}
+	resp.Body.Close()
+	return fetched{}, fmt.Errorf("%s: %s", url, resp.Status)
+}
+
+// responseValidator is what tells the version of resp's file by for
+// If-Range: a strong ETag, else Last-Modified.
+func responseValidator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
+// rangeStart is the first byte of a 206's Content-Range, or -1.
+func rangeStart(resp *http.Response) int64 {
+	var start, end int64
+	if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d", &start, &end); err != nil {
+		return -1
+	}
+	return start
+}
+
+type remoteOptions struct {
+	base        string
+	concurrency int
+	// least time between the start of two requests, across all workers,
+	// and two to one host
+	delay     time.Duration
+	hostDelay time.Duration
+	// bytes a second across all workers, 0 for no limit
+	maxRate int64
+	retries int
+	// keep downloads here and reuse them; empty to delete each after ingest
+	cacheDir string
+	fetch    fetcher
+	polite   *politeness
+}
+
+// mirrorPath is where the aleph mirror keeps ebook n: one directory per
+// digit but the last, then one named for the number, so 123 is at
+// 1/2/123/123.zip. Single digit ebooks sit under 0/.
+func mirrorPath(n int, suffix string) string {
+	s := strconv.Itoa(n)
+	parts := []string{}
+	if len(s) == 1 {
+		parts = append(parts, "0")
+	}
+	for _, c := range s[:len(s)-1] {
+		parts = append(parts, string(c))
+	}
+	return path.Join(append(parts, s, s+suffix+".zip")...)
+}
+
+// editionSuffixes are tried in order for each ebook: plain ascii first, as
+// ingest prefers when walking a mirror, then utf-8 and latin-1 for books
+// only published those ways.
+var editionSuffixes = []string{"", "-0", "-8"}
+
+// parseIDs reads ebook numbers or file ids and inclusive ranges like 100-200, separated
+// by commas, spaces or newlines. # starts a comment.
+func parseIDs(r io.Reader) ([]int, error) {
+	ids := []int{}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		for _, f := range strings.FieldsFunc(line, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+			lo, hi, isRange := strings.Cut(f, "-")
+			a, err := strconv.Atoi(lo)
+			if err != nil || a < 1 {
+				return nil, fmt.Errorf("bad number %q", f)
+			}
+			b := a
+			if isRange {
+				if b, err = strconv.Atoi(hi); err != nil || b < a {
+					return nil, fmt.Errorf("bad range %q", f)
+				}
+			}
+			for n := a; n <= b; n++ {
+				ids = append(ids, n)
+			}
+		}
+	}
+	return ids, s.Err()
+}
+
+type download struct {
+	ebook int
+	url   string
+	file  string
+	keep  bool
+	err   error
+}
+
+// readRemote is readFiles for a mirror reached over http. Ebooks already in
+// the database are not downloaded again, which is also how an interrupted
+// run resumes, and an ebook's part downloaded goes on where it stopped.
+// Downloads run concurrently, paced as polite.go says; ingesting them stays
+// in this goroutine, one journaled transaction per book as for a local walk.
+func readRemote(db *sql.DB, ids []int, opts ingestOptions, ro remoteOptions) error {
+	undone, err := repairJournal(db, ro.base)
+	if err != nil {
+		return err
+	}
+	if len(undone) > 0 {
+		fmt.Printf("cleaned up %d downloads interrupted mid-ingest; fetching them again\n", len(undone))
+	}
+	have, err := ingestedEbooks(db)
+	if err != nil {
+		return err
+	}
+	todo := []int{}
+	for _, id := range ids {
+		if !have[id] {
+			todo = append(todo, id)
+		}
+	}
+	if len(todo) < len(ids) {
+		fmt.Printf("%d of %d ebooks already ingested\n", len(ids)-len(todo), len(ids))
+	}
+	if ro.concurrency < 1 {
+		ro.concurrency = 1
+	}
+	// get falls back on them only where there is no plain zip
+	opts.encodings = true
+
+	if ro.polite == nil {
+		ro.polite = newPoliteness(ro.delay, ro.hostDelay, ro.maxRate)
+	}
+	if len(todo) > 0 {
+		ro.polite.readRobots(ro.base, ro.fetch)
+	}
+	defer func() { fmt.Println(ro.polite.summary()) }()
+
+	queue := make(chan int)
+	done := make(chan download)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		defer close(queue)
+		for _, id := range todo {
+			select {
+			case queue <- id:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	for i := 0; i < ro.concurrency; i++ {
+		go func() {
+			for id := range queue {
+				d := ro.get(id)
+				select {
+				case done <- d:
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+
+	failed := 0
+	for range todo {
+		d := <-done
+		if d.err != nil {
+			failed++
+			fmt.Printf("could not download ebook %d: %v\n", d.ebook, d.err)
+			manifestOut.failed(d.url, d.err)
+			if err = addWarning(db, warnAt{scope: scopeIngest, path: d.url}, sevError, "download", d.err.Error(), ""); err != nil {
+				return err
+			}
+			continue
+		}
+		err = ingestOne(db, ro.base, d.file, d.url, opts)
+		d.remove()
+		if err != nil {
+			return fmt.Errorf("ebook %d: %w", d.ebook, err)
+		}
+	}
+	if failed > 0 {
+		return partialError{failed, len(todo), "ebooks", "could not be downloaded"}
+	}
+	return nil
+}
+
+func ingestedEbooks(db *sql.DB) (map[int]bool, error) {
+	rows, err := db.Query("SELECT DISTINCT ebook FROM files WHERE ebook IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	have := map[int]bool{}
+	for rows.Next() {
+		var n int
+		if err = rows.Scan(&n); err != nil {
+			return nil, err
+		}
+		have[n] = true
+	}
+	return have, rows.Err()
+}
+
+// get downloads the preferred edition of ebook into the cache dir or a temp
+// dir, trying each edition in turn while the mirror says it has none. The
+// file keeps its mirror name so the ebook number can be read from it.
+func (ro remoteOptions) get(ebook int) download {
+	d := download{ebook: ebook}
+	for _, suffix := range editionSuffixes {
+		p := mirrorPath(ebook, suffix)
+		d.url = strings.TrimSuffix(ro.base, "/") + "/" + p
+		if ro.cacheDir != "" {
+			d.file = filepath.Join(ro.cacheDir, filepath.FromSlash(p))
+			d.keep = true
+			if _, err := os.Stat(d.file); err == nil {
+				d.err = nil
+				return d
+			}
+		} else {
+			dir, err := os.MkdirTemp("", "gutchunk-")
+			if err != nil {
+				d.err = err
+				return d
+			}
+			d.file = filepath.Join(dir, path.Base(p))
+		}
+		ro.polite.checkRobots(d.url)
+		d.err = ro.save(&d)
+		if d.err != nil && !d.keep {
+			d.remove()
+		}
+		if !errors.Is(d.err, errNotFound) {
+			return d
+		}
+	}
+	return d
+}
+
+// remove deletes a download that isn't being kept, with its temp dir.
+func (d download) remove() {
+	if !d.keep {
+		os.RemoveAll(filepath.Dir(d.file))
+	}
+}
+
+// save fetches d.url into d.file, retrying transient failures with a
+// doubling backoff, or as long as a Retry-After asks, every worker holding
+// off the host meanwhile.
+func (ro remoteOptions) save(d *download) error {
+	host := ""
+	if u, err := url.Parse(d.url); err == nil {
+		host = u.Host
+	}
+	backoff := time.Second
+	var err error
+	for attempt := 0; attempt <= ro.retries; attempt++ {
+		if attempt > 0 {
+			var ra retryAfter
+			if errors.As(err, &ra) {
+				ro.polite.hold(host, ra.wait)
+			} else {
+				ro.polite.sleep(backoff)
+			}
+			backoff *= 2
+		}
+		ro.polite.wait(host)
+		err = ro.saveOnce(d)
+		if err == nil || !errors.Is(err, errTransient) {
+			return err
+		}
+	}
+	return err
+}
+
+// saveOnce writes d.file's .part, going on with what of it an earlier try
+// left, and renames it when whole, so an interrupted download is never
+// mistaken for a cached one.
+func (ro remoteOptions) saveOnce(d *download) error {
+	part, tag := d.file+".part", d.file+".part.tag"
+	var from int64
+	validator := ""
+	if info, err := os.Stat(part); err == nil && info.Size() > 0 {
+		if b, err := os.ReadFile(tag); err == nil && len(b) > 0 {
+			from, validator = info.Size(), string(b)
+		}
+	}
+	got, err := ro.fetch.fetch(d.url, from, validator)
+	if errors.Is(err, errPartStale) {
+		os.Remove(part)
+		os.Remove(tag)
+	}
+	if err != nil {
+		return err
+	}
+	defer got.body.Close()
+
+	if err = os.MkdirAll(filepath.Dir(d.file), 0755); err != nil {
+		return err
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if got.from > 0 {
+		flags = os.O_WRONLY | os.O_APPEND
+	} else if got.validator != "" {
+		if err = os.WriteFile(tag, []byte(got.validator), 0644); err != nil {
+			return err
+		}
+	} else {
+		os.Remove(tag)
+	}
+	f, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, ro.polite.reader(got.body)); err != nil {
+		f.Close()
+		return fmt.Errorf("%w: %v", errTransient, err)
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	os.Remove(tag)
+	return os.Rename(part, d.file)
+}
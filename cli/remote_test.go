@@ -0,0 +1,184 @@
+package cli
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeMirror serves fixture zips at their mirror paths, counting the
+// requests for each and failing the first for those in flaky with a 503.
+type fakeMirror struct {
+	mu       sync.Mutex
+	files    map[string][]byte
+	flaky    map[string]bool
+	requests map[string]int
+}
+
+func newFakeMirror(t *testing.T, books map[string]string) *fakeMirror {
+	t.Helper()
+	m := &fakeMirror{files: map[string][]byte{}, flaky: map[string]bool{}, requests: map[string]int{}}
+	dir := t.TempDir()
+	for p, title := range books {
+		file := filepath.Join(dir, filepath.FromSlash(p))
+		// each body its own, that none is taken for a duplicate of another
+		body := testParagraphs(2) + "\n\n" + title + "."
+		writeTestZip(t, file, zipEntry{strings.TrimSuffix(filepath.Base(p), ".zip") + ".txt", testBook(title, body)})
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.files["/"+p] = b
+	}
+	return m
+}
+
+func (m *fakeMirror) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	m.requests[r.URL.Path]++
+	n := m.requests[r.URL.Path]
+	b, ok := m.files[r.URL.Path]
+	flaky := m.flaky[r.URL.Path]
+	m.mu.Unlock()
+	switch {
+	case !ok:
+		http.NotFound(w, r)
+	case flaky && n == 1:
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	default:
+		w.Write(b)
+	}
+}
+
+// fetches is how many times the mirror was asked for files other than
+// robots.txt.
+func (m *fakeMirror) fetches() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for p, c := range m.requests {
+		if p != "/robots.txt" {
+			n += c
+		}
+	}
+	return n
+}
+
+func remoteOpts(url string) remoteOptions {
+	return remoteOptions{base: url, concurrency: 2, retries: 2, fetch: httpFetcher{http.DefaultClient}}
+}
+
+func TestReadRemote(t *testing.T) {
+	m := newFakeMirror(t, map[string]string{
+		"1/12/12.zip":       "Twelve",
+		"4/45/45-8.zip":     "Forty-five in latin-1",
+		"1/2/123/123.zip":   "One Two Three",
+		"1/2/123/123-0.zip": "One Two Three in utf-8",
+	})
+	m.flaky["/1/2/123/123.zip"] = true
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	db := testDB(t)
+	err := readRemote(db, []int{12, 45, 123, 7}, ingestOptions{}, remoteOpts(srv.URL))
+	var partial partialError
+	if !errors.As(err, &partial) {
+		t.Fatalf("readRemote: %v, want it partial for the ebook the mirror hasn't", err)
+	}
+	var titles []string
+	for _, b := range ingestRows(t, db) {
+		titles = append(titles, b.name)
+	}
+	sort.Strings(titles)
+	want := []string{"Forty-five in latin-1", "One Two Three", "Twelve"}
+	if !reflect.DeepEqual(titles, want) {
+		t.Errorf("ingested %v, want %v", titles, want)
+	}
+	if n := m.requests["/1/2/123/123.zip"]; n != 2 {
+		t.Errorf("123.zip was asked for %d times, want it retried once", n)
+	}
+	if m.requests["/1/2/123/123-0.zip"] != 0 {
+		t.Error("the utf-8 edition was fetched though the plain one was there")
+	}
+	var warned int
+	if err := db.QueryRow("SELECT count(*) FROM warnings WHERE code = 'download' AND path LIKE '%/0/7/7-8.zip'").Scan(&warned); err != nil {
+		t.Fatal(err)
+	}
+	if warned != 1 {
+		t.Errorf("%d warnings of ebook 7, want 1", warned)
+	}
+	if left, _ := os.ReadDir(tmp); len(left) != 0 {
+		t.Errorf("downloads left in the temp dir: %v", left)
+	}
+
+	// what was ingested isn't fetched again
+	before := m.fetches()
+	if err := readRemote(db, []int{12, 45, 123}, ingestOptions{}, remoteOpts(srv.URL)); err != nil {
+		t.Fatal(err)
+	}
+	if n := m.fetches() - before; n != 0 {
+		t.Errorf("the second run fetched %d files, want none", n)
+	}
+}
+
+func TestReadRemoteCacheDir(t *testing.T) {
+	m := newFakeMirror(t, map[string]string{"1/12/12.zip": "Twelve"})
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	ro := remoteOpts(srv.URL)
+	ro.cacheDir = t.TempDir()
+
+	for i := 0; i < 2; i++ {
+		// a database of its own each time, so only the cache saves a fetch
+		if err := readRemote(testDB(t), []int{12}, ingestOptions{}, ro); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(ro.cacheDir, "1", "12", "12.zip")); err != nil {
+		t.Errorf("the download wasn't kept: %v", err)
+	}
+	if n := m.fetches(); n != 1 {
+		t.Errorf("fetched %d times, want once, the second run reading the cache", n)
+	}
+}
+
+func TestMirrorPath(t *testing.T) {
+	for n, want := range map[int]string{
+		7:     "0/7/7.zip",
+		12:    "1/12/12.zip",
+		123:   "1/2/123/123.zip",
+		12345: "1/2/3/4/12345/12345.zip",
+	} {
+		if got := mirrorPath(n, ""); got != want {
+			t.Errorf("mirrorPath(%d) = %s, want %s", n, got, want)
+		}
+	}
+	if got := mirrorPath(45, "-8"); got != "4/45/45-8.zip" {
+		t.Errorf("mirrorPath(45, -8) = %s", got)
+	}
+}
+
+func TestParseIDs(t *testing.T) {
+	ids, err := parseIDs(strings.NewReader("12, 45\n# a comment\n100-103 7 # and another\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{12, 45, 100, 101, 102, 103, 7}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("parseIDs = %v, want %v", ids, want)
+	}
+	for _, bad := range []string{"x", "0", "5-3", "5-x"} {
+		if _, err := parseIDs(strings.NewReader(bad)); err == nil {
+			t.Errorf("parseIDs(%q) was no error", bad)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package cli
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"git.tilde.town/gutchunker/gutchunk"
+)
+
+// Chunks are stored in the canonical form (see gutchunk.Canonical), which
+// RenderChunk lays out.
+
+// Style is how RenderChunk lays a chunk out.
+type Style int
+
+const (
+	// StyleText puts each kept break on a new line and, given a width,
+	// wraps prose to it. Verse lines are only wrapped if they don't fit.
+	StyleText Style = iota
+	// StyleLine renders everything on one line, with " / " between verse
+	// lines, for json and other line oriented output.
+	StyleLine
+)
+
+// RenderChunk lays out a stored chunk, canonical or not, in style. width
+// is in runes; 0 leaves lines unwrapped.
+func RenderChunk(text string, width int, style Style) string {
+	parts := strings.Split(gutchunk.Canonical(text), "\n\n")
+	if style == StyleLine {
+		return strings.Join(parts, " / ")
+	}
+	if width > 0 {
+		for i, p := range parts {
+			parts[i] = wrap(p, width)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// wrap breaks s at spaces into lines of at most width runes. A word longer
+// than width gets a line to itself.
+func wrap(s string, width int) string {
+	var b strings.Builder
+	line := 0
+	for _, w := range strings.Fields(s) {
+		n := utf8.RuneCountInString(w)
+		if line > 0 && line+1+n > width {
+			b.WriteByte('\n')
+			line = 0
+		} else if line > 0 {
+			b.WriteByte(' ')
+			line++
+		}
+		b.WriteString(w)
+		line += n
+	}
+	return b.String()
+}
@@ -0,0 +1,126 @@
+package cli
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.tilde.town/gutchunker/gutchunk"
+)
+
+var update = flag.Bool("update", false, "rewrite testdata/render/golden from what RenderChunk gives")
+
+// renderings are the ways each chunk in testdata/render is rendered, each
+// golden file named for its chunk and rendering.
+var renderings = []struct {
+	name  string
+	width int
+	style Style
+}{
+	{"text", 0, StyleText},
+	{"wrap-40", 40, StyleText},
+	{"line", 0, StyleLine},
+}
+
+func TestRenderChunkGolden(t *testing.T) {
+	chunks, err := filepath.Glob(filepath.Join("testdata", "render", "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) == 0 {
+		t.Fatal("no fixture chunks")
+	}
+	for _, path := range chunks {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// as a chunk stored before the canonical form, and after
+		legacy := string(b)
+		canonical := gutchunk.Canonical(legacy)
+		name := strings.TrimSuffix(filepath.Base(path), ".txt")
+		for _, r := range renderings {
+			got := RenderChunk(legacy, r.width, r.style)
+			if again := RenderChunk(canonical, r.width, r.style); again != got {
+				t.Errorf("%s %s: the canonical chunk renders as %q, the legacy one as %q", name, r.name, again, got)
+			}
+			if r.width > 0 {
+				for _, l := range strings.Split(got, "\n") {
+					if n := len([]rune(l)); n > r.width && strings.Contains(l, " ") {
+						t.Errorf("%s %s: a line of %d runes: %q", name, r.name, n, l)
+					}
+				}
+			}
+			checkRendering(t, filepath.Join("testdata", "render", "golden", name+"."+r.name+".txt"), got+"\n")
+		}
+	}
+}
+
+func checkRendering(t *testing.T, path, got string) {
+	t.Helper()
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run go test -update to write it)", err)
+	}
+	if got != string(want) {
+		t.Errorf("%s differs from what RenderChunk gives; run go test -update and check the diff\ngot:\n%s", path, got)
+	}
+}
+
+func TestRenormalize(t *testing.T) {
+	db := testDB(t)
+	verse, err := os.ReadFile(filepath.Join("testdata", "render", "verse.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := addBook(t, db, "Songs", "William Blake", "")
+	legacy, canonical := string(verse), gutchunk.Canonical(string(verse))
+	for i, c := range []string{legacy, canonical} {
+		insertChunk(t, db, id, i, c)
+	}
+	if _, err := db.Exec("UPDATE chunks SET token_count = 7"); err != nil {
+		t.Fatal(err)
+	}
+	stored := func() []string {
+		rows, err := db.Query("SELECT chunk || '|' || coalesce(token_count, 'null') FROM chunks ORDER BY ordinal")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var out []string
+		for rows.Next() {
+			var s string
+			if err = rows.Scan(&s); err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, s)
+		}
+		return out
+	}
+
+	before := stored()
+	if err := renormalize(db, true, 5); err != nil {
+		t.Fatal(err)
+	}
+	if after := stored(); strings.Join(after, "\x00") != strings.Join(before, "\x00") {
+		t.Error("renormalize --dry-run wrote")
+	}
+	if err := renormalize(db, false, 5); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{canonical + "|null", canonical + "|7"}
+	if got := stored(); strings.Join(got, "\x00") != strings.Join(want, "\x00") {
+		t.Errorf("renormalized to %q, want %q: the legacy chunk rewritten, its count cleared, and the canonical one left be", got, want)
+	}
+}
@@ -0,0 +1,117 @@
+package cli
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+
+	"git.tilde.town/gutchunker/gutchunk"
+)
+
+func renormalizeCmd(args []string) error {
+	fs := flag.NewFlagSet("renormalize", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "count the chunks that would change and show some, without writing")
+	sample := fs.Int("sample", 5, "changed chunks to show with --dry-run")
+	fs.Parse(args)
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return renormalize(db, *dryRun, *sample)
+}
+
+type renormalized struct {
+	id, sourceid int
+	was, now     string
+}
+
+// renormalize rewrites chunks stored before the canonical form (see
+// gutchunk.Canonical) a batch at a time. Their token counts no longer apply and
+// are cleared for count-tokens to redo.
+func renormalize(db *sql.DB, dryRun bool, sample int) error {
+	last, seen, changed := 0, 0, 0
+	for {
+		rows, err := db.Query("SELECT id, sourceid, chunk FROM chunks WHERE id > ? ORDER BY id LIMIT ?", last, exportBatch)
+		if err != nil {
+			return err
+		}
+		batch := []renormalized{}
+		n := 0
+		for rows.Next() {
+			var r renormalized
+			if err = rows.Scan(&r.id, &r.sourceid, &r.was); err != nil {
+				rows.Close()
+				return err
+			}
+			n++
+			last = r.id
+			if !gutchunk.IsLegacy(r.was) {
+				continue
+			}
+			r.now = gutchunk.Canonical(r.was)
+			batch = append(batch, r)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		seen += n
+
+		if dryRun {
+			for _, r := range batch {
+				if changed < sample {
+					fmt.Printf("chunk %d of book %d:\n  was: %q\n  now: %q\n", r.id, r.sourceid, clipRaw(r.was, 200), clipRaw(r.now, 200))
+				}
+				changed++
+			}
+			continue
+		}
+
+		if len(batch) == 0 {
+			continue
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, r := range batch {
+			if _, err = tx.Exec("UPDATE chunks SET chunk = ?, token_count = NULL WHERE id = ?", r.now, r.id); err != nil {
+				tx.Rollback()
+				return err
+			}
+			// for flag-content to scan again
+			if _, err = tx.Exec("DELETE FROM content_scans WHERE chunk_id = ?", r.id); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+		changed += len(batch)
+		fmt.Printf("%d chunks renormalized\r", changed)
+	}
+
+	if dryRun {
+		fmt.Printf("%d of %d chunks would be renormalized\n", changed, seen)
+	} else {
+		fmt.Printf("%d of %d chunks renormalized\n", changed, seen)
+	}
+	return nil
+}
+
+// clipRaw shortens s to n runes like clip, but keeps its whitespace, which
+// is what renormalizing changes.
+func clipRaw(s string, n int) string {
+	rs := []rune(s)
+	if len(rs) <= n {
+		return s
+	}
+	return string(rs[:n]) + "…"
+}
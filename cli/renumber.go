@@ -0,0 +1,171 @@
+package cli
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+)
+
+// Chunk ordinals count from 0 within a book, but deleting chunks leaves
+// gaps in them, and books chunked before ordinals were stored have none.
+// renumber makes each book's 0 to n-1 again in the order its chunks are
+// read in, moving the footnotes that follow a chunk with it.
+
+type ordinalTrouble struct {
+	book, chunks, numbered, distinct int
+	lo, hi                           sql.NullInt64
+}
+
+func (t ordinalTrouble) String() string {
+	switch {
+	case t.numbered < t.chunks:
+		return fmt.Sprintf("book %d: %d of %d chunks have no ordinal", t.book, t.chunks-t.numbered, t.chunks)
+	case t.distinct < t.chunks:
+		return fmt.Sprintf("book %d: %d chunks share %d ordinals", t.book, t.chunks, t.distinct)
+	}
+	return fmt.Sprintf("book %d: %d chunks numbered %d to %d", t.book, t.chunks, t.lo.Int64, t.hi.Int64)
+}
+
+// ordinalTroubles finds the books, or with book just that one, whose
+// ordinals aren't 0 to n-1.
+func ordinalTroubles(db *sql.DB, book int) ([]ordinalTrouble, error) {
+	// each book's chunks are in one shard, so grouping shard by shard is
+	// grouping them all
+	arms, args := eachShard(`SELECT sourceid, count(*) AS n, count(ordinal) AS numbered, count(DISTINCT ordinal) AS d,
+			min(ordinal) AS lo, max(ordinal) AS hi
+		FROM %s WHERE ? = 0 OR sourceid = ? GROUP BY sourceid`, book, book)
+	rows, err := db.Query(`SELECT sourceid, n, numbered, d, lo, hi FROM (`+arms+`)
+		WHERE numbered < n OR d < n OR lo != 0 OR hi != n - 1 ORDER BY sourceid`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []ordinalTrouble{}
+	for rows.Next() {
+		var t ordinalTrouble
+		if err = rows.Scan(&t.book, &t.chunks, &t.numbered, &t.distinct, &t.lo, &t.hi); err != nil {
+			return nil, err
+		}
+		res = append(res, t)
+	}
+	return res, rows.Err()
+}
+
+// renumberBook numbers book's chunks 0 to n-1 in their order, returning
+// how many changed. A footnote follows the chunk it followed, or when that
+// chunk is gone the one before it.
+func renumberBook(tx *sql.Tx, book int) (int, error) {
+	rows, err := tx.Query("SELECT id, ordinal FROM chunks WHERE sourceid = ? ORDER BY ordinal, id", book)
+	if err != nil {
+		return 0, err
+	}
+	type numbered struct {
+		id  int
+		old sql.NullInt64
+	}
+	chunks := []numbered{}
+	for rows.Next() {
+		var c numbered
+		if err = rows.Scan(&c.id, &c.old); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		chunks = append(chunks, c)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for i, c := range chunks {
+		if c.old.Valid && c.old.Int64 == int64(i) {
+			continue
+		}
+		if _, err = tx.Exec("UPDATE chunks SET ordinal = ? WHERE id = ?", i, c.id); err != nil {
+			return 0, err
+		}
+		changed++
+	}
+	if changed == 0 {
+		return 0, nil
+	}
+
+	notes, err := tx.Query("SELECT id, ordinal FROM footnotes WHERE sourceid = ? AND ordinal IS NOT NULL", book)
+	if err != nil {
+		return 0, err
+	}
+	type note struct{ id, old int }
+	moved := []note{}
+	for notes.Next() {
+		var n note
+		if err = notes.Scan(&n.id, &n.old); err != nil {
+			notes.Close()
+			return 0, err
+		}
+		moved = append(moved, n)
+	}
+	notes.Close()
+	if err = notes.Err(); err != nil {
+		return 0, err
+	}
+	for _, n := range moved {
+		var at interface{}
+		for i, c := range chunks {
+			if c.old.Valid && c.old.Int64 <= int64(n.old) {
+				at = i
+			}
+		}
+		if _, err = tx.Exec("UPDATE footnotes SET ordinal = ? WHERE id = ?", at, n.id); err != nil {
+			return 0, err
+		}
+	}
+	return changed, nil
+}
+
+func renumberCmd(args []string) error {
+	fs := flag.NewFlagSet("renumber", flag.ExitOnError)
+	book := fs.Int("book", 0, "only renumber this file id")
+	check := fs.Bool("check", false, "only list the books whose ordinals aren't 0 to n-1, exiting 1 if there are any")
+	fs.Parse(args)
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	troubles, err := ordinalTroubles(db, *book)
+	if err != nil {
+		return err
+	}
+	if *check {
+		for _, t := range troubles {
+			fmt.Println(t)
+		}
+		fmt.Printf("%d books need renumbering\n", len(troubles))
+		if len(troubles) > 0 {
+			return exitStatus(exitFailure)
+		}
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	chunks := 0
+	for _, t := range troubles {
+		n, err := renumberBook(tx, t.book)
+		if err != nil {
+			return fmt.Errorf("book %d: %w", t.book, err)
+		}
+		chunks += n
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	fmt.Printf("renumbered %d chunks of %d books\n", chunks, len(troubles))
+	return nil
+}
@@ -0,0 +1,103 @@
+package cli
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRenumber(t *testing.T) {
+	db := testDB(t)
+	pruned := addBook(t, db, "Emma", "Jane Austen", "")
+	whole := addBook(t, db, "Persuasion", "Jane Austen", "")
+	for i := 0; i < 5; i++ {
+		for _, id := range []int{pruned, whole} {
+			insertChunk(t, db, id, i, fmt.Sprintf("chunk %d of %d", i, id))
+		}
+	}
+	// one footnote after the chunk pruned, one after a later one
+	for _, at := range []int{2, 3} {
+		if _, err := db.Exec("INSERT INTO footnotes (sourceid, marker, text, ordinal) VALUES (?, ?, 'a note', ?)", pruned, fmt.Sprint(at), at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec("DELETE FROM chunks WHERE sourceid = ? AND ordinal = 2", pruned); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := captureStdout(t, func() error { return renumberCmd([]string{"--check"}) })
+	if exitCode(err) != exitFailure {
+		t.Errorf("--check with gaps: %v, want exit status 1", err)
+	}
+	for _, want := range []string{
+		fmt.Sprintf("book %d: 4 chunks numbered 0 to 4", pruned),
+		"1 books need renumbering",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("--check printed %q, want %q in it", out, want)
+		}
+	}
+
+	if out, err = captureStdout(t, func() error { return renumberCmd(nil) }); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "renumbered 2 chunks of 1 books") {
+		t.Errorf("renumber printed %q", out)
+	}
+	for id, want := range map[int]string{
+		pruned: "0:chunk 0 of %[1]d 1:chunk 1 of %[1]d 2:chunk 3 of %[1]d 3:chunk 4 of %[1]d",
+		whole:  "0:chunk 0 of %[1]d 1:chunk 1 of %[1]d 2:chunk 2 of %[1]d 3:chunk 3 of %[1]d 4:chunk 4 of %[1]d",
+	} {
+		if got, want := numbering(t, db, id), fmt.Sprintf(want, id); got != want {
+			t.Errorf("book %d renumbered %s, want %s", id, got, want)
+		}
+	}
+	var notes string
+	if err = db.QueryRow("SELECT group_concat(marker || '@' || ordinal, ' ') FROM (SELECT marker, ordinal FROM footnotes ORDER BY id)").Scan(&notes); err != nil {
+		t.Fatal(err)
+	}
+	// the pruned chunk's footnote goes with the chunk before it
+	if notes != "2@1 3@2" {
+		t.Errorf("footnotes moved to %s, want 2@1 3@2", notes)
+	}
+
+	if _, err = captureStdout(t, func() error { return renumberCmd([]string{"--check"}) }); err != nil {
+		t.Errorf("--check after renumbering: %v", err)
+	}
+}
+
+func TestRenumberUnnumbered(t *testing.T) {
+	rowidOnly(t, "chunks without ordinals")
+	db := testDB(t)
+	id := addBook(t, db, "Villette", "Charlotte Brontë", "")
+	for i := 0; i < 5; i++ {
+		if _, err := db.Exec("INSERT INTO chunks (sourceid, chunk) VALUES (?, ?)", id, fmt.Sprintf("chunk %d of %d", i, id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out, err := captureStdout(t, func() error { return renumberCmd([]string{"--check"}) })
+	if exitCode(err) != exitFailure || !strings.Contains(out, fmt.Sprintf("book %d: 5 of 5 chunks have no ordinal", id)) {
+		t.Errorf("--check printed %q, %v", out, err)
+	}
+	if out, err = captureStdout(t, func() error { return renumberCmd(nil) }); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "renumbered 5 chunks of 1 books") {
+		t.Errorf("renumber printed %q", out)
+	}
+	// numbered in the order they were stored
+	if got, want := numbering(t, db, id), fmt.Sprintf("0:chunk 0 of %[1]d 1:chunk 1 of %[1]d 2:chunk 2 of %[1]d 3:chunk 3 of %[1]d 4:chunk 4 of %[1]d", id); got != want {
+		t.Errorf("renumbered %s, want %s", got, want)
+	}
+}
+
+// numbering is book id's chunks as ordinal:text, in order.
+func numbering(t *testing.T, db *sql.DB, id int) string {
+	t.Helper()
+	var got string
+	if err := db.QueryRow("SELECT group_concat(ordinal || ':' || chunk, ' ') FROM (SELECT ordinal, chunk FROM chunks WHERE sourceid = ? ORDER BY ordinal)", id).Scan(&got); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
@@ -0,0 +1,317 @@
+package cli
+
+import (
+	"bufio"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Some paragraphs turn up word for word in thousands of books: old
+// license texts, "prepared by volunteers" notices, standard prefaces. Each
+// book's copy is its own chunk, so nothing within a book catches them.
+// boilerplate finds the chunk texts many books share and, once approved,
+// suppresses them: random, serve, export and export-books leave out every
+// chunk with a suppressed text. Famous quotations recur too, in a few books
+// each rather than hundreds, which is why nothing is suppressed without
+// being approved.
+
+// how much of a chunk's hash is shown and taken to name it
+const shortHash = 12
+
+type repeat struct {
+	text              string
+	hash              string
+	books, chunks     int
+	suppressedAlready bool
+}
+
+// findRepeats returns the chunk texts found in at least min books, most
+// books first.
+func findRepeats(db *sql.DB, min int) ([]repeat, error) {
+	rows, err := db.Query(`SELECT c.chunk, count(DISTINCT c.sourceid) AS books, count(*)
+		FROM chunks c JOIN files f ON f.id = c.sourceid
+		WHERE f.deleted_at IS NULL
+		GROUP BY c.chunk HAVING books >= ?
+		ORDER BY books DESC, count(*) DESC`, min)
+	if err != nil {
+		return nil, err
+	}
+	res := []repeat{}
+	for rows.Next() {
+		var r repeat
+		if err = rows.Scan(&r.text, &r.books, &r.chunks); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		r.hash = textHash(r.text)
+		res = append(res, r)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range res {
+		var n int
+		if err = db.QueryRow("SELECT count(*) FROM boilerplate WHERE hash = ?", res[i].hash).Scan(&n); err != nil {
+			return nil, err
+		}
+		res[i].suppressedAlready = n > 0
+	}
+	return res, nil
+}
+
+func boilerplateCmd(args []string) error {
+	fs := flag.NewFlagSet("boilerplate", flag.ExitOnError)
+	min := fs.Int("min-occurrences", 50, "least number of books a chunk's text must be in to be reported")
+	top := fs.Int("top", 20, "texts to report, most books first (0 for all)")
+	suppress := fs.Bool("suppress", false, "suppress the texts reported, asking about each, or those listed in --approve")
+	approve := fs.String("approve", "", "with --suppress, file of the hashes to suppress, one per line, without asking")
+	unsuppress := fs.Bool("unsuppress", false, "stop suppressing the texts with the hashes given as arguments")
+	list := fs.Bool("list", false, "list the suppressed texts")
+	fs.Parse(args)
+
+	if *min < 2 {
+		return usagef("--min-occurrences must be at least 2")
+	}
+	if *approve != "" && !*suppress {
+		return usagef("--approve needs --suppress")
+	}
+	if *unsuppress != (fs.NArg() > 0) {
+		return usagef("--unsuppress needs the hashes to stop suppressing, and only it takes arguments")
+	}
+	var approved map[string]bool
+	if *approve != "" {
+		var err error
+		if approved, err = readHashes(*approve); err != nil {
+			return err
+		}
+	} else if *suppress && !isTerminal(os.Stdin) {
+		return usagef("--suppress needs --approve FILE, or a terminal to ask on")
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch {
+	case *unsuppress:
+		return unsuppressRepeats(db, fs.Args())
+	case *list:
+		return listSuppressed(db)
+	}
+
+	repeats, err := findRepeats(db, *min)
+	if err != nil {
+		return err
+	}
+	shown := repeats
+	if *top > 0 && len(shown) > *top {
+		shown = shown[:*top]
+	}
+	fmt.Printf("%d chunk texts are in %d or more books\n", len(repeats), *min)
+	if len(shown) > 0 {
+		fmt.Printf("%7s %7s  %-*s  %s\n", "books", "chunks", shortHash, "hash", "text")
+	}
+	for _, r := range shown {
+		note := ""
+		if r.suppressedAlready {
+			note = " (suppressed)"
+		}
+		fmt.Printf("%7d %7d  %s  %s%s\n", r.books, r.chunks, r.hash[:shortHash], sampleText(r.text, 60), note)
+	}
+	if !*suppress {
+		return nil
+	}
+
+	chosen := []repeat{}
+	if approved != nil {
+		for _, r := range repeats {
+			if approved[r.hash[:shortHash]] || approved[r.hash] {
+				delete(approved, r.hash[:shortHash])
+				delete(approved, r.hash)
+				chosen = append(chosen, r)
+			}
+		}
+		if len(approved) > 0 {
+			for h := range approved {
+				fmt.Fprintln(os.Stderr, "not among the texts in --min-occurrences books:", h)
+			}
+			return usagef("%d hashes in %s aren't texts boilerplate found", len(approved), *approve)
+		}
+	} else if chosen, err = askRepeats(shown, os.Stdin, os.Stdout); err != nil {
+		return err
+	}
+	n, err := suppressRepeats(db, chosen)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("suppressed %d texts, in %d chunks\n", len(chosen), n)
+	return nil
+}
+
+// sampleText is the start of text on one line, cut at a word.
+func sampleText(text string, n int) string {
+	s := strings.Join(strings.Fields(text), " ")
+	if len(s) <= n {
+		return s
+	}
+	cut := strings.LastIndex(s[:n], " ")
+	if cut < n/2 {
+		cut = n
+	}
+	return s[:cut] + "…"
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// readHashes reads a file of hashes, whole or as shown, one per line.
+// Blank lines, and anything after a #, are ignored, so a saved report can
+// be edited down and used as it is.
+func readHashes(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	res := map[string]bool{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := stripComment(s.Text())
+		if line == "" {
+			continue
+		}
+		h := strings.ToLower(strings.Fields(line)[0])
+		if len(h) != shortHash && len(h) != 64 {
+			return nil, fmt.Errorf("%s: %q isn't a hash as boilerplate shows them", path, h)
+		}
+		res[h] = true
+	}
+	return res, s.Err()
+}
+
+// askRepeats asks on in and out about each of repeats, returning those
+// approved.
+func askRepeats(repeats []repeat, in io.Reader, out io.Writer) ([]repeat, error) {
+	chosen := []repeat{}
+	answers := bufio.NewScanner(in)
+	for _, r := range repeats {
+		if r.suppressedAlready {
+			continue
+		}
+		fmt.Fprintf(out, "\nin %d books:\n%s\nsuppress %s? [y/N/q] ", r.books, r.text, r.hash[:shortHash])
+		if !answers.Scan() {
+			break
+		}
+		switch strings.ToLower(strings.TrimSpace(answers.Text())) {
+		case "y", "yes":
+			chosen = append(chosen, r)
+		case "q", "quit":
+			return chosen, answers.Err()
+		}
+	}
+	return chosen, answers.Err()
+}
+
+// suppressRepeats records repeats as boilerplate and marks their chunks,
+// returning the number marked.
+func suppressRepeats(db *sql.DB, repeats []repeat) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var n int64
+	for _, r := range repeats {
+		if _, err = tx.Exec("INSERT OR REPLACE INTO boilerplate (hash, chunk, books, created_at) VALUES (?, ?, ?, datetime('now'))",
+			r.hash, r.text, r.books); err != nil {
+			return 0, err
+		}
+		res, err := tx.Exec("UPDATE chunks SET boilerplate = 1 WHERE chunk = ? AND boilerplate IS NULL", r.text)
+		if err != nil {
+			return 0, err
+		}
+		marked, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		n += marked
+	}
+	return n, tx.Commit()
+}
+
+func unsuppressRepeats(db *sql.DB, hashes []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, h := range hashes {
+		var hash, text string
+		err := tx.QueryRow("SELECT hash, chunk FROM boilerplate WHERE substr(hash, 1, ?) = ?", len(h), strings.ToLower(h)).Scan(&hash, &text)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("no suppressed text has hash %s", h)
+		}
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec("UPDATE chunks SET boilerplate = NULL WHERE chunk = ? AND boilerplate IS NOT NULL", text); err != nil {
+			return err
+		}
+		if _, err = tx.Exec("DELETE FROM boilerplate WHERE hash = ?", hash); err != nil {
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	fmt.Printf("stopped suppressing %d texts\n", len(hashes))
+	return nil
+}
+
+func listSuppressed(db *sql.DB) error {
+	rows, err := db.Query("SELECT hash, chunk, coalesce(books, 0), created_at FROM boilerplate ORDER BY books DESC")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash, text, at string
+		var books int
+		if err = rows.Scan(&hash, &text, &books, &at); err != nil {
+			return err
+		}
+		fmt.Printf("%s  %s  in %d books when suppressed  %s\n", hash[:shortHash], at, books, sampleText(text, 60))
+	}
+	return rows.Err()
+}
+
+// markBoilerplate marks the chunks just written, with their ids, whose
+// text is suppressed, so rechunking a book doesn't bring its boilerplate
+// back.
+func markBoilerplate(tx *sql.Tx, ids []int64, chunks []string) error {
+	var n int
+	if err := tx.QueryRow("SELECT count(*) FROM boilerplate").Scan(&n); err != nil || n == 0 {
+		return err
+	}
+	for i, c := range chunks {
+		if err := tx.QueryRow("SELECT count(*) FROM boilerplate WHERE hash = ?", textHash(c)).Scan(&n); err != nil {
+			return err
+		}
+		if n == 0 {
+			continue
+		}
+		if _, err := tx.Exec("UPDATE chunks SET boilerplate = 1 WHERE id = ?", ids[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package cli
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var (
+	preparedBy = strings.Repeat("This eBook was prepared by volunteers of the Project, who proofread it page by page and line by line. ", 4)
+	genesis    = strings.Repeat("In the beginning God created the heaven and the earth, and the earth was without form, and void. ", 4)
+)
+
+// repeatedLibrary is 60 chunked books sharing a notice, three of them
+// also quoting a verse, returning the id of one of those.
+func repeatedLibrary(t *testing.T) (*sql.DB, int) {
+	t.Helper()
+	db := testDB(t)
+	var quoting int
+	for i := 0; i < 60; i++ {
+		title := fmt.Sprintf("Book %d", i)
+		body := strings.Repeat(title+" went on about its own affairs for a while. ", 8) + "\n\n" + preparedBy
+		if i%20 == 0 {
+			body += "\n\n" + genesis
+			quoting = addBook(t, db, title, "Someone", testBook(title, body))
+			continue
+		}
+		addBook(t, db, title, "Someone", testBook(title, body))
+	}
+	if err := makeChunks(db, chunkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	return db, quoting
+}
+
+func TestFindRepeats(t *testing.T) {
+	db, _ := repeatedLibrary(t)
+	for _, c := range []struct {
+		min  int
+		want []int
+	}{
+		{50, []int{60}},
+		{3, []int{60, 3}},
+		{4, []int{60}},
+		{61, nil},
+	} {
+		repeats, err := findRepeats(db, c.min)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var books []int
+		for _, r := range repeats {
+			books = append(books, r.books)
+		}
+		if fmt.Sprint(books) != fmt.Sprint(c.want) {
+			t.Errorf("in %d books or more: texts in %v books, want %v", c.min, books, c.want)
+		}
+		if len(repeats) > 0 && (strings.TrimSpace(repeats[0].text) != strings.TrimSpace(preparedBy) || repeats[0].hash != textHash(repeats[0].text)) {
+			t.Errorf("in %d books or more, the first is %+v", c.min, repeats[0])
+		}
+	}
+
+	out, err := captureStdout(t, func() error { return boilerplateCmd(nil) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "1 chunk texts are in 50 or more books") || !strings.Contains(out, "This eBook was prepared") || strings.Contains(out, "In the beginning") {
+		t.Errorf("at the default threshold, boilerplate reported %q", out)
+	}
+}
+
+func TestSuppressRepeats(t *testing.T) {
+	db, quoting := repeatedLibrary(t)
+	marked := func() (notices, verses int) {
+		if err := db.QueryRow("SELECT count(*) FILTER (WHERE chunk LIKE 'This eBook%'), count(*) FILTER (WHERE chunk LIKE 'In the beginning%') FROM chunks WHERE boilerplate = 1").
+			Scan(&notices, &verses); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	repeats, err := findRepeats(db, 50)
+	if err != nil || len(repeats) != 1 {
+		t.Fatalf("%d repeats, %v", len(repeats), err)
+	}
+	approve := filepath.Join(t.TempDir(), "approve")
+	if err = os.WriteFile(approve, []byte(repeats[0].hash[:shortHash]+"  # the volunteers notice\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := captureStdout(t, func() error { return boilerplateCmd([]string{"--suppress", "--approve", approve}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, v := marked(); n != 60 || v != 0 || !strings.Contains(out, "suppressed 1 texts, in 60 chunks") {
+		t.Errorf("suppressing printed %q and marked %d notices and %d verses, want 60 and none", out, n, v)
+	}
+
+	// written again, a book's notice is still suppressed
+	var content string
+	if err = db.QueryRow("SELECT content FROM files WHERE id = ?", quoting).Scan(&content); err != nil {
+		t.Fatal(err)
+	}
+	rechunkBook(t, db, quoting, strings.Replace(content, "own affairs", "own business", -1))
+	if n, _ := marked(); n != 60 {
+		t.Errorf("after rechunking a book, %d notices are suppressed, want 60", n)
+	}
+
+	if _, err = captureStdout(t, func() error { return boilerplateCmd([]string{"--unsuppress", repeats[0].hash[:shortHash]}) }); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := marked(); n != 0 {
+		t.Errorf("after --unsuppress, %d notices are still suppressed", n)
+	}
+	if _, err = captureStdout(t, func() error { return boilerplateCmd([]string{"--unsuppress", repeats[0].hash[:shortHash]}) }); err == nil {
+		t.Error("unsuppressing a text not suppressed was no error")
+	}
+}
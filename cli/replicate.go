@@ -0,0 +1,259 @@
+package cli
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// gutchunk replicate --from primary.db --to replica.db keeps a copy of a
+// database another process writes for serve --replica to read, on a box
+// of its own say, the copy synced over from this one. Every --interval it
+// publishes the primary to the replica as publish does (see publish.go):
+// a consistent copy checked, synced and renamed over the replica, which is
+// the old one or the new one whatever stops replicate partway, and never a
+// part of either. A temp copy an interrupted run left beside the replica
+// is removed when replicate starts. A copy is made only when the
+// primary's PRAGMA data_version says something was written to it since
+// the last, or the replica isn't there: the first copy a replicate makes
+// is always made, data_version saying nothing across processes. Each copy
+// holds a provenance record (see provenance.go) of when it was taken, in
+// the rollback journal mode, so that it can be opened immutable. A cycle
+// that fails leaves the replica as it was and says why, and the next is
+// tried at the next interval; with --once replicate makes one and exits
+// with its error.
+//
+// serve --replica opens the database read-only and immutable, so sqlite
+// takes no locks on it and keeps no log beside it, and refuses what would
+// write to it: uploads, flags, background jobs and logging what
+// /chunks/random served. Its connections are closed after
+// replicaConnLifetime and opened again on the file at the path, so within
+// that of a new copy being put in place every request reads it, and each
+// connection reads one copy throughout; the content cache shared between
+// connections is left off, as it would outlast the copy. GET /healthz
+// says when the copy it reads was taken, for a consumer to tell a replica
+// gone stale.
+
+const replicateInterval = 15 * time.Minute
+
+// replicaConnLifetime is how long serve --replica keeps a connection to
+// the copy it opened.
+const replicaConnLifetime = 30 * time.Second
+
+func replicateCmd(args []string) error {
+	fs := flag.NewFlagSet("replicate", flag.ExitOnError)
+	from := fs.String("from", "", "the primary database to copy (default the database --db names)")
+	to := fs.String("to", "", "the replica to keep up to date")
+	interval := fs.Duration("interval", replicateInterval, "how often to look for writes to the primary and copy it")
+	once := fs.Bool("once", false, "make one copy, if the primary changed, and exit")
+	license := provenanceFlags(fs, false)
+	fs.Parse(args)
+
+	if fs.NArg() > 0 || *to == "" {
+		return usagef("usage: gutchunk replicate --to FILE [--from FILE] [--interval 15m] [--once]")
+	}
+	if *interval <= 0 {
+		return usagef("--interval must be positive")
+	}
+	if *from != "" {
+		dsn = fileDSN(*from)
+	}
+	path := dbFile(dsn)
+	if path == "" {
+		return usagef("replicate copies the database's file, and a database in memory has none")
+	}
+	if same, err := sameFile(path, *to); err != nil {
+		return err
+	} else if same {
+		return usagef("--to %s is the primary itself", *to)
+	}
+	key, err := dbKey()
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if chunkShards > 0 {
+		return fmt.Errorf("the database keeps its chunks in %d shards, and replicate copies only the main file", chunkShards)
+	}
+	if err = removeStaleCopies(*to); err != nil {
+		return err
+	}
+	w, err := watchWrites(db)
+	if err != nil {
+		return err
+	}
+	defer w.conn.Close()
+
+	note, _ := license()
+	copied := false
+	for {
+		err = replicateOnce(db, w, path, *to, key, copied, func(src *publishSource, tmp string) error {
+			return stampReplica(src, tmp, key, fs, note)
+		})
+		if err == nil {
+			copied = true
+		} else if *once {
+			return err
+		} else {
+			fmt.Fprintf(os.Stderr, "error: %v; the replica is left as it was\n", err)
+		}
+		if *once {
+			return nil
+		}
+		select {
+		case <-time.After(*interval):
+		case <-runCtx.Done():
+			return runCtx.Err()
+		}
+	}
+}
+
+// replicateOnce copies the primary at path to the replica at to if
+// anything was written to it since w last saw, or nothing was copied yet
+// or the replica isn't there.
+func replicateOnce(db *sql.DB, w *writeWatch, path, to, key string, copied bool, stamp func(*publishSource, string) error) error {
+	now, err := w.versions()
+	if err != nil {
+		return err
+	}
+	if copied && !changedVersions(w.since, now) {
+		if _, err = os.Stat(to); err == nil {
+			fmt.Printf("%s: nothing written to the primary since the last copy\n", time.Now().UTC().Format(time.RFC3339))
+			return nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	// a checkpoint moves data_version as a write does, so the copy's own
+	// is seen past; what is written after it is copied next time, if the
+	// copy's snapshot didn't catch it
+	start := time.Now()
+	var at []int64
+	src, err := publishCopy(db, path, to, key, func() error {
+		var err error
+		at, err = w.versions()
+		return err
+	}, stamp)
+	if err != nil {
+		return err
+	}
+	w.since = at
+	fmt.Printf("%s: copied %d books and %d chunks to %s in %s\n", time.Now().UTC().Format(time.RFC3339), src.books, src.chunks, to,
+		time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+func changedVersions(since, now []int64) bool {
+	for i := range now {
+		if now[i] != since[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// stampReplica records in the copy at tmp when src was taken, and puts it
+// in the rollback journal mode, so that an immutable reader needs no log.
+func stampReplica(src *publishSource, tmp, key string, fs *flag.FlagSet, note string) error {
+	p, err := newProvenance(src.tx, "replicate", fs, note)
+	if err != nil {
+		return err
+	}
+	db, err := connectDB("file:"+tmp, key, connOptions{})
+	if err != nil {
+		return fmt.Errorf("could not open the copy: %w", err)
+	}
+	defer db.Close()
+	if err = saveProvenance(db, p); err != nil {
+		return err
+	}
+	var mode string
+	return db.QueryRow("PRAGMA journal_mode = DELETE").Scan(&mode)
+}
+
+// removeStaleCopies removes the temp copies beside to that a publish or
+// replicate stopped partway left.
+func removeStaleCopies(to string) error {
+	stale, err := filepath.Glob(filepath.Join(filepath.Dir(to), "."+filepath.Base(to)+".*.tmp"))
+	if err != nil {
+		return err
+	}
+	for _, f := range stale {
+		if err = os.Remove(f); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		fmt.Printf("removed %s, a copy left partway\n", f)
+	}
+	return nil
+}
+
+// replicaDSN is the dsn opening the database file at path as serve
+// --replica reads it.
+func replicaDSN(path string) string {
+	return "file:" + uriEscaper.Replace(path) + "?mode=ro&immutable=1"
+}
+
+// replicaReadOnly refuses every request but those reading, and a reload of
+// the configuration, which writes nothing, on a replica.
+func replicaReadOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet, r.Method == http.MethodHead, r.Method == http.MethodOptions, r.URL.Path == "/admin/reload":
+			h.ServeHTTP(w, r)
+		default:
+			httpError(w, http.StatusServiceUnavailable, "this is a read-only replica")
+		}
+	})
+}
+
+type health struct {
+	OK      bool `json:"ok"`
+	Replica bool `json:"replica"`
+	// when the copy served was taken, and how long ago, with replicate's
+	// record of it
+	SnapshotAt string          `json:"snapshot_at,omitempty"`
+	AgeSeconds float64         `json:"snapshot_age_seconds,omitempty"`
+	Source     *sourceIdentity `json:"source,omitempty"`
+}
+
+// handleHealthz serves GET /healthz.
+func (s *server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	h := health{Replica: s.replica}
+	var n int
+	if err := s.db.QueryRowContext(r.Context(), "SELECT count(*) FROM sqlite_master").Scan(&n); err != nil {
+		httpError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	h.OK = true
+	if s.replica && !lacks("provenance", "") {
+		var record string
+		err := s.db.QueryRowContext(r.Context(), "SELECT record FROM provenance WHERE id = 1").Scan(&record)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			httpError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		var p provenance
+		if err == nil && json.Unmarshal([]byte(record), &p) == nil && p.Command == "replicate" {
+			h.SnapshotAt, h.Source = p.ExportedAt, &p.Source
+			if at, err := time.Parse(time.RFC3339, p.ExportedAt); err == nil {
+				h.AgeSeconds = time.Since(at).Round(time.Second).Seconds()
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, h)
+}
@@ -0,0 +1,210 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplicate(t *testing.T) {
+	db, dir := publishFixture(t)
+	primary := dbFile(dsn)
+	to := filepath.Join(dir, "replica.db")
+	// a copy an earlier run was stopped partway through
+	stale := filepath.Join(dir, ".replica.db.12345.tmp")
+	if err := os.WriteFile(stale, []byte("SQLite format 3\x00 and no more"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := captureStdout(t, func() error { return replicateCmd([]string{"--from", primary, "--to", to, "--once"}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out, "removed "+stale+", a copy left partway\n") || !strings.Contains(out, ": copied 2 books and 6 chunks to "+to+" in ") {
+		t.Errorf("replicate --once printed\n%s", out)
+	}
+	if chunks, version := published(t, to); chunks != 6 || version != schemaVersion {
+		t.Errorf("the replica holds %d chunks at schema version %d", chunks, version)
+	}
+	if names := leftOver(t, dir); names != nil {
+		t.Errorf("replicate left %v", names)
+	}
+	// stamped, and in the rollback journal mode
+	p := provenanceOf(t, to)
+	if p.Command != "replicate" || p.Source.Chunks != 6 {
+		t.Errorf("the replica's record is %+v", p)
+	}
+	replica, err := connectDB(replicaDSN(to), "", connOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mode string
+	if err = replica.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil || mode != "delete" {
+		t.Errorf("the replica's journal mode is %q (%v)", mode, err)
+	}
+	replica.Close()
+
+	// cycle by cycle: a copy only when the primary was written to
+	w, err := watchWrites(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.conn.Close()
+	cycle := func(copied bool, stamp func(*publishSource, string) error) (string, error) {
+		t.Helper()
+		return captureStdout(t, func() error { return replicateOnce(db, w, primary, to, "", copied, stamp) })
+	}
+	if out, err = cycle(false, nil); err != nil || !strings.Contains(out, ": copied 2 books and 6 chunks to ") {
+		t.Fatalf("the first cycle: %v, printing\n%s", err, out)
+	}
+	before, err := os.Stat(to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err = cycle(true, nil); err != nil || !strings.HasSuffix(out, ": nothing written to the primary since the last copy\n") {
+		t.Errorf("a cycle with no change: %v, printing\n%s", err, out)
+	}
+	if after, err := os.Stat(to); err != nil || !os.SameFile(before, after) {
+		t.Errorf("a cycle with no change replaced the replica (%v)", err)
+	}
+	insertChunk(t, db, 1, 3, "Another chunk of Emma.")
+	if out, err = cycle(true, nil); err != nil || !strings.Contains(out, ": copied 2 books and 7 chunks to ") {
+		t.Errorf("a cycle after a write: %v, printing\n%s", err, out)
+	}
+	if err = os.Remove(to); err != nil {
+		t.Fatal(err)
+	}
+	if out, err = cycle(true, nil); err != nil || !strings.Contains(out, ": copied 2 books and 7 chunks to ") {
+		t.Errorf("a cycle with the replica gone: %v, printing\n%s", err, out)
+	}
+
+	// a copy cut short or failing is never put in place
+	insertChunk(t, db, 2, 3, "Another chunk of Persuasion.")
+	for what, stamp := range map[string]func(*publishSource, string) error{
+		"cut short": func(_ *publishSource, tmp string) error {
+			st, err := os.Stat(tmp)
+			if err != nil {
+				return err
+			}
+			return os.Truncate(tmp, st.Size()/2)
+		},
+		"failing": func(*publishSource, string) error { return errors.New("the disk went away") },
+	} {
+		if _, err = cycle(true, stamp); err == nil {
+			t.Errorf("a copy %s was put in place", what)
+		}
+		if chunks, _ := published(t, to); chunks != 7 {
+			t.Errorf("with a copy %s, the replica holds %d chunks", what, chunks)
+		}
+		if names := leftOver(t, dir); names != nil {
+			t.Errorf("with a copy %s, replicate left %v", what, names)
+		}
+	}
+	if out, err = cycle(true, nil); err != nil || !strings.Contains(out, ": copied 2 books and 8 chunks to ") {
+		t.Errorf("a cycle after those that failed: %v, printing\n%s", err, out)
+	}
+
+	for _, args := range [][]string{{}, {"--to", to, "--interval", "0"}, {"--to", to, "more"}, {"--to", primary}} {
+		if _, err = captureStdout(t, func() error { return replicateCmd(args) }); exitCode(err) != exitUsage {
+			t.Errorf("replicate %s: %v, want a usage error", strings.Join(args, " "), err)
+		}
+	}
+}
+
+func TestReplicateEvery(t *testing.T) {
+	db, dir := publishFixture(t)
+	to := filepath.Join(dir, "replica.db")
+	every := func() (string, string, error) {
+		t.Helper()
+		stop := startRunTimeout(t, 300*time.Millisecond)
+		defer stop()
+		var out string
+		errs, err := captureStderr(t, func() error {
+			var err error
+			out, err = captureStdout(t, func() error { return replicateCmd([]string{"--to", to, "--interval", "50ms"}) })
+			return err
+		})
+		return out, errs, err
+	}
+	out, errs, err := every()
+	if !errors.Is(err, errTimedOut) && !errors.Is(err, t.Context().Err()) && err == nil {
+		t.Errorf("replicate stopped with %v", err)
+	}
+	if strings.Count(out, ": copied 2 books and 6 chunks to ") != 1 || !strings.Contains(out, ": nothing written to the primary since the last copy\n") || errs != "" {
+		t.Errorf("replicate every 50ms printed\n%s\nand on stderr\n%s", out, errs)
+	}
+
+	// a cycle failing leaves the replica as it was, and is tried again
+	if _, err = db.Exec("DELETE FROM chunks"); err != nil {
+		t.Fatal(err)
+	}
+	if out, errs, _ = every(); strings.Contains(out, "copied") || strings.Count(errs, "; the replica is left as it was\n") < 2 {
+		t.Errorf("replicate of a primary failing its checks printed\n%s\nand on stderr\n%s", out, errs)
+	}
+	if chunks, _ := published(t, to); chunks != 6 {
+		t.Errorf("the replica holds %d chunks", chunks)
+	}
+}
+
+func TestServeReplica(t *testing.T) {
+	_, dir := publishFixture(t)
+	to := filepath.Join(dir, "replica.db")
+	if _, err := captureStdout(t, func() error { return replicateCmd([]string{"--to", to, "--once"}) }); err != nil {
+		t.Fatal(err)
+	}
+	p := provenanceOf(t, to)
+
+	dsn = replicaDSN(to)
+	db, err := openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s := testServer(t, db)
+	s.replica = true
+	get := func(s *server, method, path string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		s.routes().ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	w := get(s, "GET", "/healthz")
+	var h health
+	if err = json.Unmarshal(w.Body.Bytes(), &h); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("GET /healthz of the replica: %d %s", w.Code, w.Body)
+	}
+	if !h.OK || !h.Replica || h.SnapshotAt != p.ExportedAt || h.AgeSeconds < 0 || h.AgeSeconds > 60 || h.Source == nil || *h.Source != p.Source {
+		t.Errorf("GET /healthz of the replica: %s", w.Body)
+	}
+	if w = get(s, "GET", "/chunks/random"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "A chunk of ") {
+		t.Errorf("GET /chunks/random of the replica: %d %s", w.Code, w.Body)
+	}
+	for _, path := range []string{"/books", "/chunks/1/flag", "/jobs"} {
+		if w = get(s, "POST", path); w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "this is a read-only replica") {
+			t.Errorf("POST %s to the replica: %d %s", path, w.Code, w.Body)
+		}
+	}
+	// read immutable, nothing is kept beside it
+	for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+		if _, err := os.Stat(to + suffix); err == nil {
+			t.Errorf("reading the replica made %s", filepath.Base(to+suffix))
+		}
+	}
+
+	// a server of the primary is no replica
+	primary := testDB(t)
+	w = get(testServer(t, primary), "GET", "/healthz")
+	var ph health
+	if err = json.Unmarshal(w.Body.Bytes(), &ph); err != nil || !ph.OK || ph.Replica || ph.SnapshotAt != "" || ph.Source != nil {
+		t.Errorf("GET /healthz of the primary: %d %s", w.Code, w.Body)
+	}
+	if w = get(testServer(t, primary), "POST", "/healthz"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /healthz: %d", w.Code)
+	}
+}
@@ -0,0 +1,468 @@
+package cli
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chunkFilter is what /chunks/random may be narrowed by.
+type chunkFilter struct {
+	// chunks at least this many bytes long
+	MinLength int
+	// books from this sources row, 0 for any
+	Source int
+	// books in this language, by code, "" for any
+	Language string
+	// with Language, books with no language or und too (see
+	// langdetect.go)
+	Undetermined bool
+	// chunks of at least and at most this many words, 0 for any
+	MinWords, MaxWords int
+	// only the one book of each group dupes --mark found
+	UniqueWorks bool
+	// the globs of an --authors-file, as json arrays, "" for none (see
+	// authorList.where)
+	DenyAuthors, AllowAuthors string
+	// only books dated to these years (see era.go)
+	Era yearRange
+	// only chunks this far through their books (see position.go)
+	Position positionRange
+	// only chunks of this kind, "" for any (see kinds.go)
+	Kind string
+	// only chunks that fit in this many characters with their attribution,
+	// 0 for any (see quoteLength)
+	Fits int
+	// only books check-complete found complete (see completeness.go)
+	CompleteOnly bool
+	// only books of this series, "" for any (see series.go)
+	Series string
+	// leave out chunks flag-content flagged (see contentflags.go)
+	ExcludeFlagged bool
+	// leave out books in this language and chunks of this kind, "" for
+	// none, as a filter expression's -lang and -kind do (see
+	// filterexpr.go)
+	NotLanguage, NotKind string
+	// the globs of a filter expression's author and -author terms, as json
+	// arrays like DenyAuthors and AllowAuthors, "" for none
+	Authors, NotAuthors string
+}
+
+func (f chunkFilter) String() string {
+	s := fmt.Sprintf("min_length=%d source=%d language=%s min_words=%d max_words=%d unique_works=%t",
+		f.MinLength, f.Source, f.Language, f.MinWords, f.MaxWords, f.UniqueWorks)
+	if f.Undetermined {
+		s += " include_undetermined=true"
+	}
+	if f.Era.set {
+		s += " era=" + f.Era.String()
+	}
+	if f.Position.set {
+		s += " position=" + f.Position.String()
+	}
+	if f.Kind != "" {
+		s += " kind=" + f.Kind
+	}
+	if f.Fits > 0 {
+		s += fmt.Sprintf(" fits=%d", f.Fits)
+	}
+	if f.CompleteOnly {
+		s += " complete_only=true"
+	}
+	if f.Series != "" {
+		s += " series=" + f.Series
+	}
+	if f.ExcludeFlagged {
+		s += " exclude_flagged=true"
+	}
+	if f.NotLanguage != "" {
+		s += " not_language=" + f.NotLanguage
+	}
+	if f.NotKind != "" {
+		s += " not_kind=" + f.NotKind
+	}
+	if f.Authors != "" {
+		s += " author=" + f.Authors
+	}
+	if f.NotAuthors != "" {
+		s += " not_author=" + f.NotAuthors
+	}
+	if f.DenyAuthors != "" || f.AllowAuthors != "" {
+		s += " authors-file"
+	}
+	return s
+}
+
+// the query parameters parseFilter reads, which presets may set
+var filterParams = []string{"min_length", "source", "language", "include_undetermined", "min_words", "max_words", "unique_works", "era", "position", "kind", "fits", "complete_only", "series", "exclude_flagged",
+	"not_language", "not_kind", "author", "not_author"}
+
+func (s *server) parseFilter(q url.Values) (chunkFilter, error) {
+	q, err := withPreset(s.db, q)
+	if err != nil {
+		return chunkFilter{}, err
+	}
+	f, err := parseFilter(s.db, q)
+	if u := f.unbridged(false); err == nil && u != nil {
+		return f, fmt.Errorf("the %s filter needs %s, which this database lacks; run gutchunk migrate", u[0][0], u[0][1])
+	}
+	f.DenyAuthors, f.AllowAuthors = s.conf().authors.where()
+	return f, err
+}
+
+// parseFilter reads a chunkFilter from the parameters in filterParams.
+func parseFilter(db *sql.DB, q url.Values) (chunkFilter, error) {
+	var f chunkFilter
+	for _, p := range []struct {
+		name string
+		n    *int
+	}{{"min_length", &f.MinLength}, {"min_words", &f.MinWords}, {"max_words", &f.MaxWords}, {"fits", &f.Fits}} {
+		if v := q.Get(p.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return f, fmt.Errorf("bad %s %q", p.name, v)
+			}
+			*p.n = n
+		}
+	}
+	if f.MaxWords > 0 && f.MinWords > f.MaxWords {
+		return f, fmt.Errorf("min_words %d is over max_words %d", f.MinWords, f.MaxWords)
+	}
+	if v := q.Get("source"); v != "" {
+		id, err := lookupSource(db, v)
+		if err != nil {
+			return f, err
+		}
+		f.Source = id
+	}
+	for _, p := range []struct {
+		name string
+		s    *string
+	}{{"language", &f.Language}, {"not_language", &f.NotLanguage}} {
+		if v := q.Get(p.name); v != "" {
+			*p.s = normalizeLanguages(v)
+			if strings.Contains(*p.s, ",") {
+				return f, fmt.Errorf("bad %s %q; want one", p.name, v)
+			}
+		}
+	}
+	if v := q.Get("include_undetermined"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, fmt.Errorf("bad include_undetermined %q", v)
+		}
+		f.Undetermined = b && f.Language != ""
+	}
+	if v := q.Get("unique_works"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, fmt.Errorf("bad unique_works %q", v)
+		}
+		f.UniqueWorks = b
+	}
+	if v := q.Get("complete_only"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, fmt.Errorf("bad complete_only %q", v)
+		}
+		f.CompleteOnly = b
+	}
+	if v := q.Get("exclude_flagged"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, fmt.Errorf("bad exclude_flagged %q", v)
+		}
+		f.ExcludeFlagged = b
+	}
+	if v := q.Get("era"); v != "" {
+		era, err := parseEra(v)
+		if err != nil {
+			return f, err
+		}
+		f.Era = era
+	}
+	if v := q.Get("position"); v != "" {
+		pos, err := parsePosition(v)
+		if err != nil {
+			return f, err
+		}
+		f.Position = pos
+	}
+	for _, p := range []struct {
+		name string
+		s    *string
+	}{{"kind", &f.Kind}, {"not_kind", &f.NotKind}} {
+		if v := q.Get(p.name); v != "" {
+			kind, err := parseKind(v)
+			if err != nil {
+				return f, err
+			}
+			*p.s = kind
+		}
+	}
+	for _, p := range []struct {
+		name string
+		s    *string
+	}{{"author", &f.Authors}, {"not_author", &f.NotAuthors}} {
+		var globs []string
+		for _, v := range q[p.name] {
+			glob := normalizeGlob(v)
+			if strings.Trim(glob, "*") == "" && glob != "*" {
+				return f, fmt.Errorf("bad %s %q; it has nothing to match", p.name, v)
+			}
+			globs = append(globs, glob)
+		}
+		if globs != nil {
+			list, _ := json.Marshal(globs)
+			*p.s = string(list)
+		}
+	}
+	if v := strings.TrimSpace(q.Get("series")); v != "" {
+		f.Series = v
+	}
+	return f, nil
+}
+
+// words in c, counted as the runs between spaces and line breaks, or for a
+// book in Chinese or Japanese as its characters but spaces, line breaks and
+// the commonest punctuation, as WordCount counts them near enough
+const chunkWords = `(CASE WHEN ` + cjkLanguage + `
+	THEN length(` + cjkLetters + `)
+	ELSE length(c.chunk) - length(replace(replace(c.chunk, ' ', ''), char(10), '')) + 1 END)`
+
+// whether f's language, by its first code, is written in ScriptCJK
+const cjkLanguage = "substr(coalesce(f.language, '') || ',', 1, instr(coalesce(f.language, '') || ',', ',') - 1) IN (" + cjkLanguageCodes + ")"
+
+// c's text without whitespace or the commonest punctuation
+const cjkLetters = `replace(replace(replace(replace(replace(replace(replace(replace(replace(replace(replace(c.chunk,
+	' ', ''), char(10), ''), '。', ''), '、', ''), '，', ''), '！', ''), '？', ''), '「', ''), '」', ''), '：', ''), '　', '')`
+
+// quoteLength is how many characters c comes to quoted with its
+// attribution, as random prints it: the text, a line break and "— Title,
+// by Author". It is the most the text can come to rendered, each kept
+// break taken as the " / " of one line, as /chunks/random gives it;
+// wrapping and the transforms only ever make it shorter.
+const quoteLength = `(length(c.chunk) + (length(c.chunk) - length(replace(c.chunk, char(10) || char(10), ''))) / 2
+	+ 3 + length(` + chunkTitle + `) + CASE WHEN coalesce(f.author, '') = '' THEN 0 ELSE 5 + length(f.author) END)`
+
+// filterConds is the condition f.args() fills in, over chunks c of files f,
+// of those chunks f keeps, and filterWhere of those of them random draws.
+// sqlite doesn't promise to skip a subquery when the ? = ” before it
+// holds, and in export's CASE it doesn't, so an empty list is read as
+// NULL, no rows, rather than as json.
+const filterConds = `length(c.chunk) >= ? AND (? = 0 OR f.source_id = ?)
+	AND (? = '' OR instr(',' || f.language || ',', ',' || ? || ',') > 0 OR ? AND ` + undeterminedLanguage + `)
+	AND (? = 0 OR ` + chunkWords + ` >= ?) AND (? = 0 OR ` + chunkWords + ` <= ?)
+	AND (? = 0 OR ` + representative + `)
+	AND (? = 0 OR f.era_year BETWEEN ? AND ?) AND (? = 0 OR c.position_pct BETWEEN ? AND ?)
+	AND (? = '' OR c.kind = ?) AND (? = 0 OR ` + quoteLength + ` <= ?) AND (? = 0 OR f.completeness = 'complete')
+	AND (? = '' OR f.ebook IN (SELECT ebook FROM ` + seriesRows + ` s WHERE s.name = ?))
+	AND (? = '' OR NOT EXISTS (SELECT 1 FROM json_each(nullif(?, '')) WHERE ` + authorGlobs + `))
+	AND (? = '' OR EXISTS (SELECT 1 FROM json_each(nullif(?, '')) WHERE ` + authorGlobs + `))
+	AND (? = 0 OR NOT ` + contentFlagged + `)
+	AND (? = '' OR instr(',' || coalesce(f.language, '') || ',', ',' || ? || ',') = 0)
+	AND (? = '' OR c.kind IS NULL OR c.kind != ?)
+	AND (? = '' OR EXISTS (SELECT 1 FROM json_each(nullif(?, '')) WHERE ` + authorGlobs + `))
+	AND (? = '' OR NOT EXISTS (SELECT 1 FROM json_each(nullif(?, '')) WHERE ` + authorGlobs + `))`
+
+const filterWhere = filterConds + " AND " + notBanned
+
+// authorGlobs is whether the glob value matches f's author as globRegexp
+// does
+const authorGlobs = "coalesce(f.author_norm, '') GLOB value OR coalesce(f.author_norm, '') GLOB '* ' || value"
+
+func (f chunkFilter) args() []interface{} {
+	return []interface{}{f.MinLength, f.Source, f.Source, f.Language, f.Language, f.Undetermined,
+		f.MinWords, f.MinWords, f.MaxWords, f.MaxWords, f.UniqueWorks,
+		f.Era.set, f.Era.from, f.Era.to, f.Position.set, f.Position.from, f.Position.to, f.Kind, f.Kind, f.Fits, f.Fits, f.CompleteOnly, f.Series, f.Series, f.DenyAuthors, f.DenyAuthors, f.AllowAuthors, f.AllowAuthors, f.ExcludeFlagged,
+		f.NotLanguage, f.NotLanguage, f.NotKind, f.NotKind, f.Authors, f.Authors, f.NotAuthors, f.NotAuthors}
+}
+
+// sampleIDs picks up to n chunk ids matching f uniformly at random.
+func sampleIDs(db *sql.DB, f chunkFilter, n int) ([]int, error) {
+	rows, err := db.Query(`SELECT c.id FROM chunks c JOIN files f ON f.id = c.sourceid
+		WHERE `+filterWhere+` ORDER BY random() LIMIT ?`, append(f.args(), n)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// filteredChunk samples directly, for when there is no reservoir to draw
+// from yet, leaving out what ex does. Without a filter that is
+// randomChunk's seek; with one it counts the matches, which scans.
+func filteredChunk(db *sql.DB, r *rand.Rand, f chunkFilter, ex servedExclusion) (chunkrow, error) {
+	and, exArgs := ex.and()
+	if f == (chunkFilter{}) {
+		return randomChunk(db, r, notBanned+and, exArgs...)
+	}
+	var c chunkrow
+	where := filterWhere + and
+	args := append(f.args(), exArgs...)
+	n, err := countChunks(db, "%s c JOIN files f ON f.id = c.sourceid WHERE "+where, args...)
+	if err != nil {
+		return c, err
+	}
+	if n == 0 {
+		return c, errNoMatch
+	}
+	err = db.QueryRow(`SELECT `+chunkrowCols+` FROM chunks c JOIN files f ON f.id = c.sourceid
+		WHERE `+where+` LIMIT 1 OFFSET ?`, append(args, r.Intn(n))...).
+		Scan(&c.ID, &c.Text, &c.Title, &c.Author, &c.StableID)
+	return c, err
+}
+
+func chunkByID(db *sql.DB, id int) (chunkrow, error) {
+	var c chunkrow
+	err := db.QueryRow(`SELECT `+chunkrowCols+` FROM chunks c JOIN files f ON f.id = c.sourceid WHERE c.id = ?`, id).
+		Scan(&c.ID, &c.Text, &c.Title, &c.Author, &c.StableID)
+	return c, err
+}
+
+// reservoir keeps a few thousand pre-sampled chunk ids per filter so a
+// random chunk costs one primary key lookup. Pools are resampled in the
+// background once older than refresh; requests keep drawing from the old
+// pool meanwhile, or sample directly while a filter's first pool is built.
+type reservoir struct {
+	size    int
+	refresh time.Duration
+	now     func() time.Time
+	build   func(f chunkFilter, n int) ([]int, error)
+
+	mu    sync.Mutex
+	pools map[chunkFilter]*pool
+}
+
+type pool struct {
+	ids      []int
+	built    time.Time
+	building bool
+	err      error
+}
+
+// most filters kept at once; past this the oldest pool is dropped
+const maxPools = 16
+
+func newReservoir(size int, refresh time.Duration, build func(chunkFilter, int) ([]int, error)) *reservoir {
+	return &reservoir{size: size, refresh: refresh, now: time.Now, build: build, pools: map[chunkFilter]*pool{}}
+}
+
+// pick draws a chunk id matching f, or returns false when there is no pool
+// to draw from yet.
+func (rv *reservoir) pick(f chunkFilter, r *rand.Rand) (int, bool) {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+
+	p, ok := rv.pools[f]
+	if !ok {
+		if len(rv.pools) >= maxPools {
+			rv.dropOldest()
+		}
+		p = &pool{}
+		rv.pools[f] = p
+	}
+	if !p.building && (p.built.IsZero() || rv.now().Sub(p.built) >= rv.refresh) {
+		p.building = true
+		go rv.fill(f, p)
+	}
+	if len(p.ids) == 0 {
+		return 0, false
+	}
+	return p.ids[r.Intn(len(p.ids))], true
+}
+
+func (rv *reservoir) fill(f chunkFilter, p *pool) {
+	ids, err := rv.build(f, rv.size)
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	p.building = false
+	p.built = rv.now()
+	p.err = err
+	if err == nil {
+		p.ids = ids
+	}
+}
+
+func (rv *reservoir) dropOldest() {
+	var oldest chunkFilter
+	var at time.Time
+	first := true
+	for f, p := range rv.pools {
+		if p.building {
+			continue
+		}
+		if first || p.built.Before(at) {
+			oldest, at, first = f, p.built, false
+		}
+	}
+	if !first {
+		delete(rv.pools, oldest)
+	}
+}
+
+// invalidate forgets every pool, for when the chunks they were drawn from
+// have changed.
+func (rv *reservoir) invalidate() {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	for f, p := range rv.pools {
+		if !p.building {
+			delete(rv.pools, f)
+		}
+	}
+}
+
+type poolStats struct {
+	Filter     string  `json:"filter"`
+	Size       int     `json:"size"`
+	AgeSeconds float64 `json:"age_seconds"`
+	Building   bool    `json:"building"`
+	Error      string  `json:"error,omitempty"`
+}
+
+func (rv *reservoir) stats() []poolStats {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	st := []poolStats{}
+	for f, p := range rv.pools {
+		ps := poolStats{Filter: f.String(), Size: len(p.ids), Building: p.building}
+		if !p.built.IsZero() {
+			ps.AgeSeconds = rv.now().Sub(p.built).Seconds()
+		}
+		if p.err != nil {
+			ps.Error = p.err.Error()
+		}
+		st = append(st, ps)
+	}
+	return st
+}
+
+// randomFromReservoir draws from rv, falling back to direct sampling when it
+// has nothing for f yet or the chunk drawn has since been deleted.
+func randomFromReservoir(db *sql.DB, rv *reservoir, r *rand.Rand, f chunkFilter) (chunkrow, error) {
+	if rv != nil {
+		if id, ok := rv.pick(f, r); ok {
+			c, err := chunkByID(db, id)
+			if !errors.Is(err, sql.ErrNoRows) {
+				return c, err
+			}
+		}
+	}
+	return filteredChunk(db, r, f, servedExclusion{})
+}
@@ -0,0 +1,191 @@
+package cli
+
+import (
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countedBuilds is a reservoir's build func giving ids 1 to n, counting
+// the builds of each filter.
+type countedBuilds struct {
+	mu     sync.Mutex
+	builds map[chunkFilter]int
+}
+
+func (c *countedBuilds) build(f chunkFilter, n int) ([]int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.builds == nil {
+		c.builds = map[chunkFilter]int{}
+	}
+	c.builds[f]++
+	ids := make([]int, n)
+	for i := range ids {
+		ids[i] = i + 1
+	}
+	return ids, nil
+}
+
+func (c *countedBuilds) count(f chunkFilter) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.builds[f]
+}
+
+// filled waits for f's pool in rv to be built with nothing building.
+func filled(t *testing.T, rv *reservoir, f chunkFilter) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		rv.mu.Lock()
+		p := rv.pools[f]
+		done := p != nil && !p.building && !p.built.IsZero()
+		rv.mu.Unlock()
+		if done {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("the pool of %v was never built", f)
+}
+
+func TestReservoirFilters(t *testing.T) {
+	var b countedBuilds
+	rv := newReservoir(10, time.Hour, b.build)
+	r := rand.New(rand.NewSource(1))
+	english, french := chunkFilter{Language: "en"}, chunkFilter{Language: "fr"}
+
+	if _, ok := rv.pick(english, r); ok {
+		t.Error("a pick before any pool was built drew from one")
+	}
+	filled(t, rv, english)
+	if _, ok := rv.pick(english, r); !ok {
+		t.Error("no pick from the pool built")
+	}
+
+	// another filter is drawn from a pool of its own
+	if _, ok := rv.pick(french, r); ok {
+		t.Error("a new filter drew from another filter's pool")
+	}
+	filled(t, rv, french)
+	if b.count(english) != 1 || b.count(french) != 1 {
+		t.Errorf("built english %d times and french %d, want once each", b.count(english), b.count(french))
+	}
+
+	rv.invalidate()
+	if _, ok := rv.pick(english, r); ok {
+		t.Error("drew from a pool after the reservoir was invalidated")
+	}
+	filled(t, rv, english)
+	if b.count(english) != 2 {
+		t.Errorf("built english %d times after invalidating, want 2", b.count(english))
+	}
+}
+
+func TestReservoirRefresh(t *testing.T) {
+	var b countedBuilds
+	clock := newFakeClock()
+	rv := newReservoir(10, time.Hour, b.build)
+	rv.now = clock.now
+	r := rand.New(rand.NewSource(1))
+	f := chunkFilter{}
+
+	rv.pick(f, r)
+	filled(t, rv, f)
+	clock.advance(59 * time.Minute)
+	rv.pick(f, r)
+	if b.count(f) != 1 {
+		t.Errorf("resampled after %d builds within the hour", b.count(f))
+	}
+	clock.advance(time.Minute)
+	// the old pool is drawn from while the new one is built
+	if _, ok := rv.pick(f, r); !ok {
+		t.Error("nothing drawn while the pool was resampled")
+	}
+	filled(t, rv, f)
+	if b.count(f) != 2 {
+		t.Errorf("%d builds after the hour, want 2", b.count(f))
+	}
+	if st := rv.stats(); len(st) != 1 || st[0].Size != 10 || st[0].AgeSeconds != 0 {
+		t.Errorf("stats %+v, want the one pool of 10, just built", st)
+	}
+}
+
+func TestReservoirUniform(t *testing.T) {
+	var b countedBuilds
+	rv := newReservoir(10, time.Hour, b.build)
+	r := rand.New(rand.NewSource(1))
+	rv.pick(chunkFilter{}, r)
+	filled(t, rv, chunkFilter{})
+
+	const draws = 20000
+	counts := map[int]int{}
+	for i := 0; i < draws; i++ {
+		id, ok := rv.pick(chunkFilter{}, r)
+		if !ok {
+			t.Fatal("nothing drawn")
+		}
+		counts[id]++
+	}
+	if len(counts) != 10 {
+		t.Errorf("drew %d of the pool's 10 ids", len(counts))
+	}
+	// a chi-squared of 27.9 has 9 degrees of freedom 1 time in 1000
+	chi, want := 0.0, float64(draws)/10
+	for _, n := range counts {
+		chi += (float64(n) - want) * (float64(n) - want) / want
+	}
+	if chi > 27.9 {
+		t.Errorf("the draws are far from uniform over the pool: chi-squared %.1f, counts %v", chi, counts)
+	}
+}
+
+func TestRandomFromReservoir(t *testing.T) {
+	db := testDB(t)
+	short := addBook(t, db, "Short", "Someone", "")
+	long := addBook(t, db, "Long", "Someone", "")
+	for i := 0; i < 5; i++ {
+		for _, c := range []struct {
+			id   int
+			text string
+		}{{short, "A short chunk."}, {long, strings.Repeat("A long chunk. ", 20)}} {
+			insertChunk(t, db, c.id, i, c.text)
+		}
+	}
+	rv := newReservoir(100, time.Hour, func(f chunkFilter, n int) ([]int, error) { return sampleIDs(db, f, n) })
+	f := chunkFilter{MinLength: 200}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 2; i++ {
+		// first sampled directly, then from the pool
+		for j := 0; j < 20; j++ {
+			c, err := randomFromReservoir(db, rv, r, f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Title != "Long" {
+				t.Errorf("drew from %s, shorter than min_length", c.Title)
+			}
+		}
+		filled(t, rv, f)
+	}
+}
+
+func TestUploadInvalidatesReservoir(t *testing.T) {
+	var b countedBuilds
+	s := testServer(t, testDB(t))
+	s.reservoir = newReservoir(10, time.Hour, b.build)
+	r := rand.New(rand.NewSource(1))
+	s.reservoir.pick(chunkFilter{}, r)
+	filled(t, s.reservoir, chunkFilter{})
+
+	if w := postBook(s.routes(), "tok", "text/plain", testParagraphs(3)); w.Code != http.StatusCreated {
+		t.Fatalf("upload: %d %s", w.Code, w.Body)
+	}
+	if st := s.reservoir.stats(); len(st) != 0 {
+		t.Errorf("pools %+v left after an upload, want them dropped", st)
+	}
+}
@@ -0,0 +1,592 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gutchunk review puts the things waiting on someone's judgement in front
+// of them one at a time, from a queue: chunks drawn at random, books with
+// warnings, books whose header and catalog disagree on their names, and
+// the volume groups group-volumes would make. Each is shown with what it
+// is of, and an action is taken with a letter and Enter: for a chunk keep
+// it, ban it, give its book a title, see the chunks around it or skip it;
+// for a warning keep the book, acknowledging the warning, or remove it
+// with a tombstone as rm does; for a conflict keep the header's names or
+// the catalog's, as metadata-conflicts --resolve does; for a volume group
+// group it. q, or the end of the input, quits. Decisions are written as
+// the commands making them by hand write them, flags, tombstones, meta
+// names and acknowledgements, each in a transaction with the queue's
+// position, so quitting or being stopped anywhere loses nothing decided,
+// and the next review of the queue, with the same filters, starts where
+// the last stopped; --restart starts it over. Drawn chunks are the same
+// for the same --seed, leaving out those flagged or reviewed already.
+// Every decision, skips too, is logged with the run making it, and review
+// says how many a minute it went through when it quits; --stats says so
+// for each queue over every review.
+
+// reviewQueues are the queues review takes items from.
+var reviewQueues = []string{"chunks", "warnings", "conflicts", "volumes"}
+
+// reviewItem is one thing a queue asks about.
+type reviewItem struct {
+	// the queue's position once it is decided, and what it is logged as:
+	// a chunk, warning or book id
+	position, id int64
+	// the book it is of, and for a chunk where in it
+	book, ordinal int64
+	// what is shown of it
+	text  string
+	group volumeGroup
+}
+
+// reviewAction is what a letter does to an item. An action with decide
+// decides it, writing the decision in tx, and moves on; one with show
+// only writes more about it, and asks again.
+type reviewAction struct {
+	key, name string
+	// when set, a line is read, with this prompt, for decide's arg; an
+	// empty one asks again
+	ask    string
+	decide func(tx *sql.Tx, it reviewItem, arg string) error
+	show   func(db *sql.DB, it reviewItem, out io.Writer) error
+}
+
+// reviewQueue is a queue review takes items from, in order.
+type reviewQueue struct {
+	name string
+	// the queue with its filters, what its position is kept by
+	key     string
+	actions []reviewAction
+	// next is the item after position, false when there are none
+	next func(db *sql.DB, position int64) (reviewItem, bool, error)
+}
+
+// reviewFilters are the flags choosing what a queue holds.
+type reviewFilters struct {
+	warnings  warningQuery
+	book      int64
+	seed      int64
+	threshold float64
+}
+
+func reviewCmd(args []string) error {
+	fs := flag.NewFlagSet("review", flag.ExitOnError)
+	name := fs.String("queue", "chunks", "the queue to review: "+strings.Join(reviewQueues, ", "))
+	var f reviewFilters
+	fs.StringVar(&f.warnings.code, "code", "", "warnings: only warnings with this code, like no_start_marker")
+	fs.StringVar(&f.warnings.severity, "severity", "", "warnings: only warnings at least this severe: "+strings.Join(severities, ", "))
+	fs.StringVar(&f.warnings.scope, "scope", "", "warnings: only warnings of this stage: ingest, chunk or metadata")
+	fs.Int64Var(&f.book, "book", 0, "chunks and warnings: only those of this book")
+	fs.Int64Var(&f.seed, "seed", 1, "chunks: draw the chunks this seed draws")
+	fs.Float64Var(&f.threshold, "threshold", 0.5, "conflicts: titles or authors sharing less than this share of their words, from 0 to 1")
+	restart := fs.Bool("restart", false, "start the queue over, rather than where the last review of it stopped")
+	stats := fs.Bool("stats", false, "instead, say how many decisions have been made in each queue, and how fast")
+	fs.Parse(args)
+
+	if fs.NArg() > 0 {
+		return usagef("usage: gutchunk review [--queue chunks|warnings|conflicts|volumes] [--restart] [--stats]")
+	}
+	known := f.warnings.severity == ""
+	for _, s := range severities {
+		known = known || s == f.warnings.severity
+	}
+	if !known {
+		return usagef("unknown --severity %q; want %s", f.warnings.severity, strings.Join(severities, ", "))
+	}
+	if s := f.warnings.scope; s != "" && s != scopeIngest && s != scopeChunk && s != scopeMetadata {
+		return usagef("unknown --scope %q; want ingest, chunk or metadata", s)
+	}
+	if f.threshold < 0 || f.threshold > 1 {
+		return usagef("--threshold must be between 0 and 1")
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if *stats {
+		return printReviewStats(db)
+	}
+	q, err := newReviewQueue(db, *name, f)
+	if err != nil {
+		return err
+	}
+	if *restart {
+		if _, err = db.Exec("DELETE FROM review_positions WHERE queue = ?", q.key); err != nil {
+			return err
+		}
+	}
+	if err = startRun(db, "review"); err != nil {
+		return err
+	}
+	t, err := review(runCtx, db, q, os.Stdin, os.Stdout)
+	fmt.Printf("\n%s\n", t)
+	if err != nil {
+		return err
+	}
+	// settled names are shown once they are chosen again
+	if q.name == "conflicts" && t.decided > 0 {
+		if _, err = resolveNames(runCtx, db); err != nil {
+			return fmt.Errorf("could not choose books' names: %w", err)
+		}
+	}
+	return nil
+}
+
+// newReviewQueue is the queue name, holding what f lets in.
+func newReviewQueue(db *sql.DB, name string, f reviewFilters) (*reviewQueue, error) {
+	keep := reviewAction{key: "k", name: "keep", decide: func(*sql.Tx, reviewItem, string) error { return nil }}
+	skip := reviewAction{key: "s", name: "skip", decide: func(*sql.Tx, reviewItem, string) error { return nil }}
+	title := reviewAction{key: "t", name: "title", ask: "the book's title: ", decide: func(tx *sql.Tx, it reviewItem, title string) error {
+		return setMetaTitle(tx, it.book, title)
+	}}
+	header := reviewAction{key: "c", name: "context", show: showBookHeader}
+
+	q := &reviewQueue{name: name}
+	var filters []string
+	switch name {
+	case "chunks":
+		only := drawable(false) + " AND c.id NOT IN (SELECT chunk_id FROM chunk_flags WHERE chunk_id IS NOT NULL)" +
+			" AND c.id NOT IN (SELECT item FROM review_log WHERE queue = 'chunks')"
+		if f.book != 0 {
+			only += fmt.Sprintf(" AND c.sourceid = %d", f.book)
+			filters = append(filters, fmt.Sprintf("book=%d", f.book))
+		}
+		filters = append(filters, fmt.Sprintf("seed=%d", f.seed))
+		q.next = func(db *sql.DB, position int64) (reviewItem, bool, error) {
+			return drawReviewChunk(db, f.seed, position, only)
+		}
+		q.actions = []reviewAction{keep,
+			{key: "b", name: "ban", decide: func(tx *sql.Tx, it reviewItem, _ string) error {
+				return setChunkFlag(tx, int(it.id), flagBan, "review")
+			}},
+			title, {key: "c", name: "context", show: showChunkContext}, skip}
+	case "warnings":
+		w := f.warnings
+		w.book = int(f.book)
+		for _, kv := range [][2]string{{"code", w.code}, {"severity", w.severity}, {"scope", w.scope}} {
+			if kv[1] != "" {
+				filters = append(filters, kv[0]+"="+kv[1])
+			}
+		}
+		if f.book != 0 {
+			filters = append(filters, fmt.Sprintf("book=%d", f.book))
+		}
+		q.next = func(db *sql.DB, position int64) (reviewItem, bool, error) {
+			return nextReviewWarning(db, w, position)
+		}
+		keep.decide = func(tx *sql.Tx, it reviewItem, _ string) error {
+			_, err := tx.Exec("UPDATE warnings SET acked_at = datetime('now') WHERE id = ? AND acked_at IS NULL", it.id)
+			return err
+		}
+		q.actions = []reviewAction{keep,
+			{key: "r", name: "remove", decide: func(tx *sql.Tx, it reviewItem, _ string) error {
+				return removeBook(tx, int(it.book), "removed in review")
+			}},
+			title, header, skip}
+	case "conflicts":
+		filters = append(filters, "threshold="+strconv.FormatFloat(f.threshold, 'g', -1, 64))
+		if _, err := resolveNames(context.Background(), db); err != nil {
+			return nil, fmt.Errorf("could not choose books' names: %w", err)
+		}
+		conflicts, err := findNameConflicts(db, f.threshold)
+		if err != nil {
+			return nil, err
+		}
+		q.next = func(db *sql.DB, position int64) (reviewItem, bool, error) {
+			it := nextReviewConflict(conflicts, position)
+			return it, it.book != 0, nil
+		}
+		settle := func(source string) func(*sql.Tx, reviewItem, string) error {
+			return func(tx *sql.Tx, it reviewItem, _ string) error { return settleNamesIn(tx, it.book, source) }
+		}
+		q.actions = []reviewAction{
+			{key: "h", name: "header", decide: settle(nameHeader)},
+			{key: "a", name: "catalog", decide: settle(nameCatalog)},
+			title, header, skip}
+	case "volumes":
+		groups, err := proposeVolumeGroups(db)
+		if err != nil {
+			return nil, err
+		}
+		q.next = func(db *sql.DB, position int64) (reviewItem, bool, error) {
+			return nextReviewGroup(db, groups, position)
+		}
+		q.actions = []reviewAction{
+			{key: "g", name: "group", decide: func(tx *sql.Tx, it reviewItem, _ string) error { return writeVolumeGroup(tx, it.group) }},
+			skip}
+	default:
+		return nil, usagef("unknown --queue %q; want %s", name, strings.Join(reviewQueues, ", "))
+	}
+	q.key = strings.Join(append([]string{name}, filters...), " ")
+	return q, nil
+}
+
+// reviewTally is what a review went through.
+type reviewTally struct {
+	decided, skipped int
+	started          time.Time
+}
+
+func (t reviewTally) String() string {
+	took := time.Since(t.started)
+	n := t.decided + t.skipped
+	s := fmt.Sprintf("reviewed %d, skipping %d, in %s", n, t.skipped, took.Round(time.Second))
+	if took >= time.Second && n > 0 {
+		s += fmt.Sprintf(", %.1f a minute", float64(n)/took.Minutes())
+	}
+	return s
+}
+
+// review asks on in and out about each item of q from where its last
+// review stopped, until the queue is done or is quit, writing each
+// decision as it is made.
+func review(ctx context.Context, db *sql.DB, q *reviewQueue, in io.Reader, out io.Writer) (reviewTally, error) {
+	t := reviewTally{started: time.Now()}
+	var position int64
+	err := db.QueryRow("SELECT position FROM review_positions WHERE queue = ?", q.key).Scan(&position)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return t, err
+	}
+	answers := bufio.NewScanner(in)
+	prompt := reviewPrompt(q.actions)
+	for {
+		if err = ctx.Err(); err != nil {
+			return t, err
+		}
+		it, ok, err := q.next(db, position)
+		if err != nil {
+			return t, err
+		}
+		if !ok {
+			fmt.Fprintf(out, "\nnothing left in the %s queue\n", q.name)
+			return t, nil
+		}
+		fmt.Fprintf(out, "\n%s\n", it.text)
+	ask:
+		for {
+			fmt.Fprint(out, prompt)
+			if !answers.Scan() {
+				return t, answers.Err()
+			}
+			key := strings.ToLower(strings.TrimSpace(answers.Text()))
+			if key == "q" {
+				return t, nil
+			}
+			a, ok := findReviewAction(q.actions, key)
+			if !ok {
+				continue
+			}
+			if a.show != nil {
+				if err = a.show(db, it, out); err != nil {
+					return t, err
+				}
+				continue
+			}
+			var arg string
+			if a.ask != "" {
+				fmt.Fprint(out, a.ask)
+				if !answers.Scan() {
+					return t, answers.Err()
+				}
+				if arg = strings.TrimSpace(answers.Text()); arg == "" {
+					continue
+				}
+			}
+			if err = decideReview(ctx, db, q, it, a, arg); err != nil {
+				return t, fmt.Errorf("could not %s %d: %w", a.name, it.id, err)
+			}
+			position = it.position
+			if a.name == "skip" {
+				t.skipped++
+			} else {
+				t.decided++
+			}
+			break ask
+		}
+	}
+}
+
+// reviewPrompt asks for one of actions by its letter, as "[k]eep".
+func reviewPrompt(actions []reviewAction) string {
+	var names []string
+	for _, a := range append(actions, reviewAction{key: "q", name: "quit"}) {
+		if i := strings.Index(a.name, a.key); i >= 0 {
+			names = append(names, a.name[:i]+"["+a.key+"]"+a.name[i+1:])
+		} else {
+			names = append(names, "["+a.key+"] "+a.name)
+		}
+	}
+	return strings.Join(names, " ") + "? "
+}
+
+func findReviewAction(actions []reviewAction, key string) (reviewAction, bool) {
+	for _, a := range actions {
+		if a.key == key || a.name == key {
+			return a, true
+		}
+	}
+	return reviewAction{}, false
+}
+
+// decideReview writes a's decision on it, with q's position past it and a
+// line of the log, in one transaction.
+func decideReview(ctx context.Context, db *sql.DB, q *reviewQueue, it reviewItem, a reviewAction, arg string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err = a.decide(tx, it, arg); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(`INSERT INTO review_positions (queue, position, updated_at) VALUES (?, ?, datetime('now'))
+		ON CONFLICT (queue) DO UPDATE SET position = excluded.position, updated_at = excluded.updated_at`, q.key, it.position); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("INSERT INTO review_log (run_id, queue, item, action, reviewed_at) VALUES (?, ?, ?, ?, datetime('now'))",
+		nullInt64(currentRun), q.name, it.id, a.name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// drawReviewChunk draws the chunk at position of those seed draws from
+// those only lets in, seeking to a chunk id as randomChunk does but over
+// the ids there are rather than from 1, so a library whose first chunks
+// were taken away doesn't draw the first left over and over. Each
+// position is drawn by itself, so it draws the same chunk until that is
+// decided.
+func drawReviewChunk(db *sql.DB, seed, position int64, only string) (reviewItem, bool, error) {
+	var it reviewItem
+	var min int64
+	err := db.QueryRow("SELECT id FROM chunks ORDER BY id LIMIT 1").Scan(&min)
+	if errors.Is(err, sql.ErrNoRows) {
+		return it, false, nil
+	}
+	if err != nil {
+		return it, false, err
+	}
+	max, err := maxChunkID(db)
+	if err != nil {
+		return it, false, err
+	}
+	r := rand.New(rand.NewSource(seed*1000003 + position))
+	var c chunkrow
+	seek := func(from int64) error {
+		return db.QueryRow(`SELECT `+chunkrowCols+`, c.sourceid, coalesce(c.ordinal, -1)
+			FROM chunks c JOIN files f ON f.id = c.sourceid
+			WHERE c.id >= ? AND `+only+` ORDER BY c.id LIMIT 1`, from).
+			Scan(&c.ID, &c.Text, &c.Title, &c.Author, &c.StableID, &it.book, &it.ordinal)
+	}
+	err = seek(min + r.Int63n(max-min+1))
+	if errors.Is(err, sql.ErrNoRows) {
+		err = seek(min)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return it, false, nil
+	}
+	if err != nil {
+		return it, false, err
+	}
+	it.position, it.id = position+1, int64(c.ID)
+	it.text = fmt.Sprintf("chunk %d, of book %d: %s by %s\n\n%s", c.ID, it.book, orUnknown(c.Title), orUnknown(c.Author), c.Text)
+	return it, true, nil
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+// nextReviewWarning is the first of the warnings w lets in, of a book
+// still there, after warning position.
+func nextReviewWarning(db *sql.DB, w warningQuery, position int64) (reviewItem, bool, error) {
+	where, args := w.where()
+	var it reviewItem
+	var sev, scope, code, msg, title, author string
+	err := db.QueryRow(`SELECT w.id, w.file_id, w.severity, w.scope, w.code, coalesce(w.message, ''), coalesce(f.name, ''), coalesce(f.author, '')
+		FROM warnings w JOIN files f ON f.id = w.file_id
+		WHERE w.id > ? AND f.deleted_at IS NULL AND `+where+` ORDER BY w.id LIMIT 1`, append([]interface{}{position}, args...)...).
+		Scan(&it.id, &it.book, &sev, &scope, &code, &msg, &title, &author)
+	if errors.Is(err, sql.ErrNoRows) {
+		return it, false, nil
+	}
+	if err != nil {
+		return it, false, err
+	}
+	it.position = it.id
+	it.text = fmt.Sprintf("warning %d, %s %s %s, of book %d: %s by %s\n%s", it.id, sev, scope, code, it.book,
+		orUnknown(title), orUnknown(author), msg)
+	return it, true, nil
+}
+
+// nextReviewConflict is the first book of conflicts after book position,
+// with each of its fields they disagree on.
+func nextReviewConflict(conflicts []nameConflict, position int64) reviewItem {
+	var it reviewItem
+	var lines []string
+	for _, nc := range conflicts {
+		if nc.id <= position || (it.book != 0 && nc.id != it.book) {
+			continue
+		}
+		it.book, it.id, it.position = nc.id, nc.id, nc.id
+		lines = append(lines, fmt.Sprintf("%s, %.2f alike:\n  header  %s\n  catalog %s", nc.field, nc.agreement, nc.header, nc.catalog))
+	}
+	if it.book != 0 {
+		it.text = fmt.Sprintf("book %d\n%s", it.book, strings.Join(lines, "\n"))
+	}
+	return it
+}
+
+// nextReviewGroup is the first of groups after the one starting with book
+// position whose volumes aren't all one work already.
+func nextReviewGroup(db *sql.DB, groups []volumeGroup, position int64) (reviewItem, bool, error) {
+	for _, g := range groups {
+		first := int64(g.volumes[0].fileID)
+		if first <= position {
+			continue
+		}
+		ids := make([]interface{}, len(g.volumes))
+		for i, v := range g.volumes {
+			ids[i] = v.fileID
+		}
+		var works, grouped int
+		if err := db.QueryRow("SELECT count(DISTINCT work_id), count(work_id) FROM files WHERE id IN (?"+strings.Repeat(", ?", len(ids)-1)+")", ids...).
+			Scan(&works, &grouped); err != nil {
+			return reviewItem{}, false, err
+		}
+		if works == 1 && grouped == len(ids) {
+			continue
+		}
+		lines := []string{fmt.Sprintf("%s (%s)", g.title, g.author)}
+		for _, v := range g.volumes {
+			lines = append(lines, fmt.Sprintf("  %3d  file %d  %s", v.number, v.fileID, v.title))
+		}
+		return reviewItem{position: first, id: first, book: first, text: strings.Join(lines, "\n"), group: g}, true, nil
+	}
+	return reviewItem{}, false, nil
+}
+
+// showChunkContext writes the chunks either side of it in its book.
+func showChunkContext(db *sql.DB, it reviewItem, out io.Writer) error {
+	if it.ordinal < 0 {
+		fmt.Fprintln(out, "the chunk's place in its book isn't known")
+		return nil
+	}
+	for _, side := range []struct {
+		name    string
+		ordinal int64
+	}{{"before", it.ordinal - 1}, {"after", it.ordinal + 1}} {
+		var text string
+		err := db.QueryRow("SELECT chunk FROM chunks WHERE sourceid = ? AND ordinal = ?", it.book, side.ordinal).Scan(&text)
+		if errors.Is(err, sql.ErrNoRows) {
+			text = "(nothing)"
+		} else if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "\n%s:\n%s\n", side.name, text)
+	}
+	fmt.Fprintln(out)
+	return nil
+}
+
+// how many lines of a book's header showBookHeader shows
+const reviewHeaderLines = 20
+
+// showBookHeader writes the start of the header of it's book.
+func showBookHeader(db *sql.DB, it reviewItem, out io.Writer) error {
+	var header string
+	if err := db.QueryRow("SELECT coalesce(header, '') FROM files WHERE id = ?", it.book).Scan(&header); err != nil {
+		return err
+	}
+	var lines []string
+	for _, l := range strings.Split(header, "\n") {
+		if l = strings.TrimRight(l, " \r\t"); l != "" {
+			lines = append(lines, l)
+		}
+	}
+	if len(lines) == 0 {
+		fmt.Fprintln(out, "the book has no header")
+		return nil
+	}
+	if len(lines) > reviewHeaderLines {
+		lines = append(lines[:reviewHeaderLines], "…")
+	}
+	fmt.Fprintf(out, "\n%s\n\n", strings.Join(lines, "\n"))
+	return nil
+}
+
+// printReviewStats says how many items of each queue have been reviewed,
+// in how many reviews, and how many a minute, a review taking from its
+// start to its last decision.
+func printReviewStats(db *sql.DB) error {
+	rows, err := db.Query(`SELECT l.queue, count(*), sum(l.action = 'skip'),
+			coalesce((julianday(max(l.reviewed_at)) - julianday(r.started_at)) * 86400, 0)
+		FROM review_log l LEFT JOIN runs r ON r.id = l.run_id
+		GROUP BY l.queue, l.run_id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	type queueStats struct {
+		reviewed, skipped, reviews int
+		seconds                    float64
+	}
+	byQueue := map[string]*queueStats{}
+	for rows.Next() {
+		var queue string
+		var n, skipped int
+		var seconds float64
+		if err = rows.Scan(&queue, &n, &skipped, &seconds); err != nil {
+			return err
+		}
+		s := byQueue[queue]
+		if s == nil {
+			s = &queueStats{}
+			byQueue[queue] = s
+		}
+		s.reviewed += n
+		s.skipped += skipped
+		s.reviews++
+		s.seconds += seconds
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if len(byQueue) == 0 {
+		fmt.Println("nothing reviewed yet")
+		return nil
+	}
+	queues := make([]string, 0, len(byQueue))
+	for q := range byQueue {
+		queues = append(queues, q)
+	}
+	sort.Strings(queues)
+	fmt.Printf("%-10s %8s %8s %8s %8s\n", "queue", "reviewed", "skipped", "reviews", "a minute")
+	for _, q := range queues {
+		s := byQueue[q]
+		rate := "-"
+		if s.seconds >= 1 {
+			rate = fmt.Sprintf("%.1f", float64(s.reviewed)/(s.seconds/60))
+		}
+		fmt.Printf("%-10s %8d %8d %8d %8s\n", q, s.reviewed, s.skipped, s.reviews, rate)
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// reviewed runs a review of queue on db, f choosing what it holds, its
+// answers keys, returning what it wrote and went through.
+func reviewed(t *testing.T, db *sql.DB, queue string, f reviewFilters, keys string) (string, reviewTally) {
+	t.Helper()
+	q, err := newReviewQueue(db, queue, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	tally, err := review(context.Background(), db, q, strings.NewReader(keys), &b)
+	if err != nil {
+		t.Fatalf("review of %s answering %q: %v, writing\n%s", queue, keys, err, b.String())
+	}
+	return b.String(), tally
+}
+
+// reviewLog is the queue, item and action of each decision logged, a line
+// each.
+func reviewLog(t *testing.T, db *sql.DB) string {
+	t.Helper()
+	return names(t, db, "SELECT queue || ' ' || item || ' ' || action FROM review_log ORDER BY id")
+}
+
+// reviewPosition is where the next review of the queue keyed key starts.
+func reviewPosition(t *testing.T, db *sql.DB, key string) int64 {
+	t.Helper()
+	var position int64
+	if err := db.QueryRow("SELECT coalesce((SELECT position FROM review_positions WHERE queue = ?), 0)", key).Scan(&position); err != nil {
+		t.Fatal(err)
+	}
+	return position
+}
+
+var reviewedChunk = regexp.MustCompile(`(?m)^chunk (\d+), of book (\d+): `)
+
+// drawnChunks are the chunk and book of each chunk a review showed.
+func drawnChunks(out string) [][2]int {
+	var drawn [][2]int
+	for _, m := range reviewedChunk.FindAllStringSubmatch(out, -1) {
+		var c [2]int
+		fmt.Sscan(m[1], &c[0])
+		fmt.Sscan(m[2], &c[1])
+		drawn = append(drawn, c)
+	}
+	return drawn
+}
+
+func TestReviewChunks(t *testing.T) {
+	db := testDB(t)
+	for _, title := range []string{"Emma", "Persuasion", "Villette"} {
+		book := addBook(t, db, title, "Someone", "")
+		for ordinal := 0; ordinal < 4; ordinal++ {
+			insertChunk(t, db, book, ordinal, fmt.Sprintf("Chunk %d of %s.", ordinal, title))
+		}
+	}
+	f := reviewFilters{seed: 7}
+
+	// an unknown letter and a title left empty ask again, context shows
+	// without deciding, and q quits at the fourth
+	out, tally := reviewed(t, db, "chunks", f, "x\nk\nb\nc\nt\n\nT\nA New Title\nq\n")
+	drawn := drawnChunks(out)
+	if len(drawn) != 4 || tally.decided != 3 || tally.skipped != 0 {
+		t.Fatalf("review of chunks drew %v, deciding %d, writing\n%s", drawn, tally.decided, out)
+	}
+	if prompt := "[k]eep [b]an [t]itle [c]ontext [s]kip [q]uit? "; strings.Count(out, prompt) != 7 {
+		t.Errorf("review of chunks asked\n%s\nwant 7 times %q", out, prompt)
+	}
+	kept, banned, titled := drawn[0], drawn[1], drawn[2]
+	if kept == banned || banned == titled || kept == titled {
+		t.Errorf("review of chunks drew %v", drawn)
+	}
+	before, after := "before:\n(nothing)", "after:\n(nothing)"
+	ordinal := (titled[0] - 1) % 4
+	if ordinal > 0 {
+		before = fmt.Sprintf("before:\nChunk %d of ", ordinal-1)
+	}
+	if ordinal < 3 {
+		after = fmt.Sprintf("after:\nChunk %d of ", ordinal+1)
+	}
+	if !strings.Contains(out, before) || !strings.Contains(out, after) {
+		t.Errorf("the context of chunk %d is\n%s", titled[0], out)
+	}
+	if got := names(t, db, "SELECT chunk_id || ' ' || flag || ' ' || note FROM chunk_flags"); got != fmt.Sprintf("%d ban review\n", banned[0]) {
+		t.Errorf("the flags are\n%s", got)
+	}
+	if got := names(t, db, fmt.Sprintf("SELECT name || ' ' || title_source FROM files WHERE id = %d", titled[1])); got != "A New Title "+nameMeta+"\n" {
+		t.Errorf("the titled book is %s", got)
+	}
+	want := fmt.Sprintf("chunks %d keep\nchunks %d ban\nchunks %d title\n", kept[0], banned[0], titled[0])
+	if got := reviewLog(t, db); got != want {
+		t.Errorf("the log is\n%s\nwant\n%s", got, want)
+	}
+	if got := reviewPosition(t, db, "chunks seed=7"); got != 3 {
+		t.Errorf("the chunks queue stopped at %d", got)
+	}
+
+	// the next review starts where that stopped, never with a chunk
+	// reviewed or flagged, and the end of the input quits
+	out, tally = reviewed(t, db, "chunks", f, "s\ns\n")
+	more := drawnChunks(out)
+	if len(more) != 3 || tally.decided != 0 || tally.skipped != 2 {
+		t.Fatalf("the next review drew %v, skipping %d, writing\n%s", more, tally.skipped, out)
+	}
+	for _, c := range more {
+		if c == kept || c == banned || c == titled {
+			t.Errorf("the next review drew chunk %d again", c[0])
+		}
+	}
+	if reviewPosition(t, db, "chunks seed=7") != 5 || !strings.HasSuffix(reviewLog(t, db), fmt.Sprintf("chunks %d skip\nchunks %d skip\n", more[0][0], more[1][0])) {
+		t.Errorf("skipped, the log is\n%s", reviewLog(t, db))
+	}
+	// a position draws the same chunk until it is decided
+	if more[2] != drawnChunks(first(t, db, "chunks", f))[0] {
+		t.Errorf("the chunk left undecided isn't drawn again")
+	}
+
+	// another seed or book is another queue, started from its start
+	if out, _ = reviewed(t, db, "chunks", reviewFilters{seed: 7, book: int64(banned[1])}, "q\n"); len(drawnChunks(out)) != 1 || drawnChunks(out)[0][1] != banned[1] {
+		t.Errorf("review --book %d drew\n%s", banned[1], out)
+	}
+	if reviewPosition(t, db, fmt.Sprintf("chunks book=%d seed=7", banned[1])) != 0 {
+		t.Errorf("quitting the first chunk moved its queue")
+	}
+
+	// stopped, it decides nothing more
+	q, err := newReviewQueue(db, "chunks", f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = review(ctx, db, q, strings.NewReader("k\n"), &strings.Builder{}); err == nil || reviewPosition(t, db, q.key) != 5 {
+		t.Errorf("a review stopped before it began: %v", err)
+	}
+}
+
+// first is what a review of queue writes before its first answer.
+func first(t *testing.T, db *sql.DB, queue string, f reviewFilters) string {
+	t.Helper()
+	out, _ := reviewed(t, db, queue, f, "")
+	return out
+}
+
+func TestReviewWarnings(t *testing.T) {
+	db := testDB(t)
+	root := t.TempDir()
+	writeTestZip(t, filepath.Join(root, "1", "11.zip"), zipEntry{"11.txt", testBook("Emma", testParagraphs(2))})
+	writeTestZip(t, filepath.Join(root, "2", "22.zip"), zipEntry{"22.txt", "Title: Unmarked\n\nAuthor: Nobody\n\n" + testParagraphs(2)})
+	writeTestZip(t, filepath.Join(root, "3", "33.zip"), zipEntry{"33.html", "<html>not a text</html>"})
+	for _, cmd := range []func() error{
+		func() error { return ingestCmd([]string{"--target", root}) },
+		func() error { return chunkCmd(nil) },
+	} {
+		if _, err := captureStdout(t, cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var startID, chunksID, authorID int64
+	if err := db.QueryRow(`SELECT (SELECT id FROM warnings WHERE code = 'no_start_marker'), (SELECT id FROM warnings WHERE code = 'no_chunks'),
+		(SELECT id FROM warnings WHERE code = 'no_author')`).Scan(&startID, &chunksID, &authorID); err != nil {
+		t.Fatal(err)
+	}
+
+	// kept, a warning is acknowledged
+	var f reviewFilters
+	f.warnings.code = "no_start_marker"
+	out, tally := reviewed(t, db, "warnings", f, "k\n")
+	if !strings.Contains(out, fmt.Sprintf("warning %d, warn chunk no_start_marker, of book 2: Unmarked by Nobody\n", startID)) ||
+		!strings.HasSuffix(out, "\nnothing left in the warnings queue\n") || tally.decided != 1 {
+		t.Errorf("review of no_start_marker warnings wrote\n%s", out)
+	}
+	if got := names(t, db, "SELECT code FROM warnings WHERE acked_at IS NOT NULL"); got != "no_start_marker\n" {
+		t.Errorf("the acknowledged warnings are\n%s", got)
+	}
+	if reviewPosition(t, db, "warnings code=no_start_marker") != startID {
+		t.Errorf("the no_start_marker queue stopped at %d", reviewPosition(t, db, "warnings code=no_start_marker"))
+	}
+
+	// removed, a book's tombstone is left as rm leaves it, and its other
+	// warnings leave the queue; those with no book were never in it
+	f = reviewFilters{}
+	f.warnings.severity = "warn"
+	out, tally = reviewed(t, db, "warnings", f, "c\nr\n")
+	if !strings.Contains(out, fmt.Sprintf("warning %d, warn chunk no_chunks, of book 2: ", chunksID)) || !strings.Contains(out, "? the book has no header\n") ||
+		strings.Contains(out, "no_text_member") || !strings.HasSuffix(out, "\nnothing left in the warnings queue\n") || tally.decided != 1 {
+		t.Errorf("review of warn warnings wrote\n%s", out)
+	}
+	if got := names(t, db, "SELECT id || ' ' || (deleted_at IS NOT NULL) FROM files ORDER BY id"); got != "1 0\n2 1\n" {
+		t.Errorf("the books are\n%s", got)
+	}
+	if got := names(t, db, "SELECT reason FROM tombstones"); got != "removed in review\n" {
+		t.Errorf("the tombstones are\n%s", got)
+	}
+
+	// a book's title given in review is its meta title
+	out, _ = reviewed(t, db, "warnings", reviewFilters{book: 1}, "t\nEmma, Revised\ns\n")
+	if !strings.Contains(out, fmt.Sprintf("warning %d, info metadata no_author, of book 1: Emma by unknown\n", authorID)) {
+		t.Errorf("review of book 1's warnings wrote\n%s", out)
+	}
+	if got := shownNames(t, db); got[0] != "Emma, Revised /  ("+nameMeta+", )" {
+		t.Errorf("the names are %v", got)
+	}
+	want := fmt.Sprintf("warnings %d keep\nwarnings %d remove\nwarnings %d title\n", startID, chunksID, authorID)
+	if got := reviewLog(t, db); got != want {
+		t.Errorf("the log is\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestReviewConflicts(t *testing.T) {
+	db := namedBooks(t)
+	out, tally := reviewed(t, db, "conflicts", reviewFilters{threshold: 0.5}, "c\nh\na\n")
+	for _, want := range []string{
+		"book 2\ntitle, 0.00 alike:\n  header  Pride & Prejudice\n  catalog Emma\n",
+		"book 3\nauthor, 0.00 alike:\n  header  Anonymous\n  catalog Mark Twain\n",
+		"[h]eader c[a]talog [t]itle [c]ontext [s]kip [q]uit? ",
+		"? the book has no header\n",
+		"\nnothing left in the conflicts queue\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("review of conflicts wrote\n%s\nwant %q", out, want)
+		}
+	}
+	if tally.decided != 2 {
+		t.Errorf("review of conflicts decided %d", tally.decided)
+	}
+	// settled as metadata-conflicts --resolve settles them
+	if _, err := resolveNames(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	if got := shownNames(t, db); got[1] != "Pride & Prejudice / J. Austen (meta, meta)" || !strings.HasSuffix(got[2], " / Mark Twain (meta, meta)") {
+		t.Errorf("the names are %v", got)
+	}
+	if out = first(t, db, "conflicts", reviewFilters{threshold: 0.5}); out != "\nnothing left in the conflicts queue\n" {
+		t.Errorf("settled, review of conflicts wrote\n%s", out)
+	}
+	if got := reviewLog(t, db); got != "conflicts 2 header\nconflicts 3 catalog\n" {
+		t.Errorf("the log is\n%s", got)
+	}
+}
+
+func TestReviewVolumes(t *testing.T) {
+	db := testDB(t)
+	for _, title := range []string{"War and Peace, Volume 2", "War and Peace, Volume 1", "Emma, Volume 1"} {
+		addBook(t, db, title, "Leo Tolstoy", testBook(title, testParagraphs(2)))
+	}
+	out, tally := reviewed(t, db, "volumes", reviewFilters{}, "k\ng\n")
+	if !strings.Contains(out, "War and Peace (leo tolstoy)\n    1  file 2  War and Peace, Volume 1\n    2  file 1  War and Peace, Volume 2\n[g]roup [s]kip [q]uit? [g]roup") ||
+		!strings.HasSuffix(out, "\nnothing left in the volumes queue\n") || tally.decided != 1 {
+		t.Errorf("review of volumes wrote\n%s", out)
+	}
+	if got := names(t, db, "SELECT f.id || ' ' || w.title FROM files f JOIN works w ON w.id = f.work_id ORDER BY f.id"); got != "1 War and Peace\n2 War and Peace\n" {
+		t.Errorf("the works are\n%s", got)
+	}
+	// started over, a group made already isn't asked about again
+	if _, err := db.Exec("DELETE FROM review_positions"); err != nil {
+		t.Fatal(err)
+	}
+	if out = first(t, db, "volumes", reviewFilters{}); out != "\nnothing left in the volumes queue\n" {
+		t.Errorf("grouped, review of volumes wrote\n%s", out)
+	}
+}
+
+func TestReviewStats(t *testing.T) {
+	db := namedBooks(t)
+	stats := func() string {
+		t.Helper()
+		out, err := captureStdout(t, func() error { return reviewCmd([]string{"--stats"}) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	if got := stats(); got != "nothing reviewed yet\n" {
+		t.Errorf("review --stats printed\n%s", got)
+	}
+	reviewed(t, db, "conflicts", reviewFilters{threshold: 0.5}, "s\nh\n")
+	if got, want := stats(), "queue      reviewed  skipped  reviews a minute\nconflicts         2        1        1        -\n"; got != want {
+		t.Errorf("review --stats printed\n%s\nwant\n%s", got, want)
+	}
+
+	for _, args := range [][]string{{"more"}, {"--severity", "fatal"}, {"--scope", "export"}, {"--threshold", "2"}} {
+		if _, err := captureStdout(t, func() error { return reviewCmd(args) }); exitCode(err) != exitUsage {
+			t.Errorf("review %s: %v, want a usage error", strings.Join(args, " "), err)
+		}
+	}
+	if _, err := newReviewQueue(db, "books", reviewFilters{}); exitCode(err) != exitUsage {
+		t.Errorf("a queue of books: %v, want a usage error", err)
+	}
+}
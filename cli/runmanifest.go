@@ -0,0 +1,268 @@
+package cli
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ingest --manifest writes a line of json for each archive the run looks
+// at: what it did with it, and the members it read with their sizes and
+// hashes. Two runs' manifests say what changed on the mirror between them
+// (see manifest diff), and a run's error lines are the archives to retry.
+// Lines are buffered and flushed every few seconds, never split across a
+// flush, so a run that dies leaves every line but its last few whole.
+
+const manifestFlushEvery = 2 * time.Second
+
+type manifestMember struct {
+	Name  string `json:"name"`
+	Bytes int    `json:"bytes"`
+	Hash  string `json:"hash"`
+}
+
+type manifestEntry struct {
+	Archive string           `json:"archive"`
+	Action  string           `json:"action"`
+	Reason  string           `json:"reason,omitempty"`
+	Code    string           `json:"code,omitempty"`
+	Members []manifestMember `json:"members,omitempty"`
+	// of the members read
+	Bytes int `json:"bytes"`
+}
+
+// manifestActions is the action for each code an archive is skipped with;
+// other codes are about its contents.
+var manifestActions = map[string]string{
+	codeIngested:    "skipped-duplicate",
+	codeOtherSource: "skipped-duplicate",
+	codeOtherMirror: "skipped-duplicate",
+	codeNotBook:     "skipped-pattern",
+	codeIgnored:     "skipped-pattern",
+	codeOtherLayout: "skipped-pattern",
+	codeSuperseded:  "skipped-superseded",
+	codeTombstoned:  "skipped-removed",
+}
+
+// runManifest is the open --manifest. A nil *runManifest writes nothing.
+type runManifest struct {
+	mu   sync.Mutex
+	f    *os.File
+	w    *bufio.Writer
+	stop chan struct{}
+	// members read of archives not yet done
+	pending map[string][]manifestMember
+}
+
+// manifestOut is the running ingest's manifest, nil without --manifest.
+var manifestOut *runManifest
+
+func openManifest(path string) (*runManifest, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open --manifest: %w", err)
+	}
+	m := &runManifest{f: f, w: bufio.NewWriterSize(f, 64<<10), stop: make(chan struct{}), pending: map[string][]manifestMember{}}
+	go func() {
+		t := time.NewTicker(manifestFlushEvery)
+		defer t.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-t.C:
+				m.mu.Lock()
+				m.w.Flush()
+				m.mu.Unlock()
+			}
+		}
+	}()
+	return m, nil
+}
+
+func (m *runManifest) close() error {
+	if m == nil {
+		return nil
+	}
+	close(m.stop)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	err := m.w.Flush()
+	if cerr := m.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// member notes a member of archive read, to go on its line once it's done.
+func (m *runManifest) member(archive, name string, text []byte) {
+	if m == nil {
+		return
+	}
+	mm := manifestMember{Name: name, Bytes: len(text), Hash: textHash(string(text))}
+	m.mu.Lock()
+	m.pending[archive] = append(m.pending[archive], mm)
+	m.mu.Unlock()
+}
+
+// done writes the line for archive, ingested or, with a reason, skipped.
+func (m *runManifest) done(archive string, r Reason) {
+	action := "ingested"
+	if r.Code != "" {
+		if action = manifestActions[r.Code]; action == "" {
+			action = "skipped-content"
+		}
+	}
+	m.write(manifestEntry{Archive: archive, Action: action, Reason: r.text(), Code: r.Code})
+}
+
+func (m *runManifest) failed(archive string, err error) {
+	m.write(manifestEntry{Archive: archive, Action: "error", Reason: err.Error()})
+}
+
+func (m *runManifest) write(e manifestEntry) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e.Members = m.pending[e.Archive]
+	delete(m.pending, e.Archive)
+	for _, mm := range e.Members {
+		e.Bytes += mm.Bytes
+	}
+	bs, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	bs = append(bs, '\n')
+	// a line is never left half written by a flush of its first part
+	if m.w.Available() < len(bs) {
+		m.w.Flush()
+	}
+	m.w.Write(bs)
+}
+
+// skippedArchive records an archive skipped for r in the events and the
+// manifest.
+func skippedArchive(archive string, r Reason) {
+	events.skipped(archive, r)
+	manifestOut.done(archive, r)
+}
+
+// readRunManifest reads a manifest into a map by archive. A last line cut
+// short, by a run that died mid-write, is left out with a warning.
+func readRunManifest(path string) (map[string]manifestEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	res := map[string]manifestEntry{}
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64<<10), 16<<20)
+	var bad error
+	n := 0
+	for s.Scan() {
+		n++
+		if bad != nil {
+			return nil, bad
+		}
+		var e manifestEntry
+		if err = json.Unmarshal(s.Bytes(), &e); err != nil || e.Archive == "" {
+			bad = fmt.Errorf("%s:%d: not a manifest line", path, n)
+			continue
+		}
+		res[e.Archive] = e
+	}
+	if err = s.Err(); err != nil {
+		return nil, err
+	}
+	if bad != nil {
+		fmt.Fprintf(os.Stderr, "%s: ignoring the last line, cut short\n", path)
+	}
+	return res, nil
+}
+
+type manifestChange struct {
+	archive string
+	// '+' added, '-' removed, '~' changed
+	kind   byte
+	detail string
+}
+
+// diffManifests lists the archives added, removed and changed from a to
+// b, by archive. An archive changed when what was done with it did, or the
+// members read of it differ; an archive skipped unread in either run is
+// only compared by action.
+func diffManifests(a, b map[string]manifestEntry) []manifestChange {
+	res := []manifestChange{}
+	for archive, eb := range b {
+		ea, ok := a[archive]
+		if !ok {
+			res = append(res, manifestChange{archive, '+', eb.Action})
+			continue
+		}
+		if ea.Action != eb.Action {
+			res = append(res, manifestChange{archive, '~', ea.Action + " -> " + eb.Action})
+		} else if len(ea.Members) > 0 && len(eb.Members) > 0 && !sameMembers(ea.Members, eb.Members) {
+			res = append(res, manifestChange{archive, '~', "contents changed"})
+		}
+	}
+	for archive, ea := range a {
+		if _, ok := b[archive]; !ok {
+			res = append(res, manifestChange{archive, '-', ea.Action})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].archive < res[j].archive })
+	return res
+}
+
+func sameMembers(a, b []manifestMember) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func manifestCmd(args []string) error {
+	if len(args) == 0 || args[0] != "diff" {
+		return usagef("usage: gutchunk manifest diff A.jsonl B.jsonl")
+	}
+	fs := flag.NewFlagSet("manifest diff", flag.ExitOnError)
+	fs.Parse(args[1:])
+	if fs.NArg() != 2 {
+		return usagef("usage: gutchunk manifest diff A.jsonl B.jsonl")
+	}
+
+	a, err := readRunManifest(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	b, err := readRunManifest(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	changes := diffManifests(a, b)
+	counts := map[byte]int{}
+	for _, c := range changes {
+		fmt.Printf("%c %s  %s\n", c.kind, c.archive, c.detail)
+		counts[c.kind]++
+	}
+	fmt.Printf("%d added, %d removed, %d changed\n", counts['+'], counts['-'], counts['~'])
+	// like diff, differences are exit status 1
+	if len(changes) > 0 {
+		return exitStatus(1)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiffManifests(t *testing.T) {
+	member := func(name, hash string) []manifestMember { return []manifestMember{{name, 10, hash}} }
+	a := map[string]manifestEntry{
+		"1/11.zip": {Archive: "1/11.zip", Action: "ingested", Members: member("11.txt", "aa")},
+		"2/22.zip": {Archive: "2/22.zip", Action: "ingested", Members: member("22.txt", "bb")},
+		"3/33.zip": {Archive: "3/33.zip", Action: "error"},
+		"4/44.zip": {Archive: "4/44.zip", Action: "skipped-duplicate", Members: member("44.txt", "dd")},
+		"5/55.zip": {Archive: "5/55.zip", Action: "skipped-pattern"},
+	}
+	b := map[string]manifestEntry{
+		"1/11.zip": {Archive: "1/11.zip", Action: "ingested", Members: member("11.txt", "aa")},
+		"2/22.zip": {Archive: "2/22.zip", Action: "ingested", Members: member("22.txt", "b2")},
+		"3/33.zip": {Archive: "3/33.zip", Action: "ingested", Members: member("33.txt", "cc")},
+		// read in one run and not the other
+		"4/44.zip": {Archive: "4/44.zip", Action: "skipped-duplicate"},
+		"6/66.zip": {Archive: "6/66.zip", Action: "ingested", Members: member("66.txt", "ff")},
+	}
+	var got []string
+	for _, c := range diffManifests(a, b) {
+		got = append(got, fmt.Sprintf("%c %s %s", c.kind, c.archive, c.detail))
+	}
+	want := []string{
+		"~ 2/22.zip contents changed",
+		"~ 3/33.zip error -> ingested",
+		"- 5/55.zip skipped-pattern",
+		"+ 6/66.zip ingested",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("diff gave\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if changes := diffManifests(a, a); len(changes) != 0 {
+		t.Errorf("a manifest differs from itself by %v", changes)
+	}
+}
+
+func TestReadRunManifest(t *testing.T) {
+	dir := t.TempDir()
+	whole := `{"archive":"1/11.zip","action":"ingested","bytes":3}` + "\n" + `{"archive":"2/22.zip","action":"error","bytes":0}` + "\n"
+	for name, c := range map[string]struct {
+		text    string
+		entries int
+		bad     bool
+	}{
+		"whole":      {whole, 2, false},
+		"cut short":  {whole + `{"archive":"3/33.zip","act`, 2, false},
+		"bad line":   {`{"archive":"3/3` + "\n" + whole, 0, true},
+		"no archive": {`{"action":"ingested"}` + "\n" + whole, 0, true},
+	} {
+		path := filepath.Join(dir, strings.ReplaceAll(name, " ", "_")+".jsonl")
+		if err := os.WriteFile(path, []byte(c.text), 0644); err != nil {
+			t.Fatal(err)
+		}
+		m, err := readRunManifest(path)
+		if (err != nil) != c.bad || len(m) != c.entries {
+			t.Errorf("%s: read %d entries, %v", name, len(m), err)
+		}
+	}
+}
+
+func TestManifestFlushes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run.jsonl")
+	m, err := openManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.close()
+
+	// more than the buffer holds goes out in whole lines before any flush
+	for i := 0; i < 2000; i++ {
+		archive := fmt.Sprintf("%d/%d.zip", i, i)
+		m.member(archive, fmt.Sprintf("%d.txt", i), []byte("a book"))
+		m.done(archive, Reason{})
+	}
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bs) == 0 || bs[len(bs)-1] != '\n' {
+		tail := bs
+		if len(tail) > 20 {
+			tail = tail[len(tail)-20:]
+		}
+		t.Fatalf("%d bytes written while running, ending %q", len(bs), tail)
+	}
+	written, err := readRunManifest(path)
+	if err != nil || len(written) == 0 {
+		t.Errorf("read %d lines of the manifest while running: %v", len(written), err)
+	}
+	if e := written["0/0.zip"]; e.Action != "ingested" || e.Bytes != 6 || len(e.Members) != 1 || e.Members[0].Name != "0.txt" {
+		t.Errorf("wrote %+v", e)
+	}
+
+	// the rest is flushed within a few seconds though the run goes on
+	m.failed("last.zip", os.ErrNotExist)
+	deadline := time.Now().Add(3 * manifestFlushEvery)
+	for {
+		if bs, err = os.ReadFile(path); err != nil {
+			t.Fatal(err)
+		}
+		if bytes.HasSuffix(bs, []byte(`"action":"error","reason":"file does not exist","bytes":0}`+"\n")) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the manifest wasn't flushed within %v", 3*manifestFlushEvery)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if written, err = readRunManifest(path); err != nil || len(written) != 2001 {
+		t.Errorf("read %d lines of the manifest flushed: %v", len(written), err)
+	}
+}
+
+func TestManifestDiffCmd(t *testing.T) {
+	root := t.TempDir()
+	writeBook := func(archive, text string) {
+		writeTestZip(t, filepath.Join(root, archive), zipEntry{strings.TrimSuffix(filepath.Base(archive), ".zip") + ".txt", testBook("Book "+archive, testParagraphs(2)+text)})
+	}
+	writeBook("1/11.zip", "")
+	writeBook("2/22.zip", "\n\nOf 22.")
+	writeBook("3/33.zip", "\n\nOf 33.")
+	manifests := t.TempDir()
+	run := func(name string) string {
+		testDB(t)
+		path := filepath.Join(manifests, name)
+		if _, err := captureStdout(t, func() error { return ingestCmd([]string{"--target", root, "--manifest", path}) }); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	a := run("a.jsonl")
+	writeBook("2/22.zip", "\n\nOf 22, edited.")
+	if err := os.Remove(filepath.Join(root, "3", "33.zip")); err != nil {
+		t.Fatal(err)
+	}
+	writeBook("4/44.zip", "\n\nOf 44.")
+	b := run("b.jsonl")
+
+	out, err := captureStdout(t, func() error { return manifestCmd([]string{"diff", a, b}) })
+	if exitCode(err) != exitFailure {
+		t.Errorf("diffing different manifests: %v, want exit status 1", err)
+	}
+	want := "~ 2/22.zip  contents changed\n- 3/33.zip  ingested\n+ 4/44.zip  ingested\n1 added, 1 removed, 1 changed\n"
+	if out != want {
+		t.Errorf("manifest diff printed\n%s\nwant\n%s", out, want)
+	}
+	if _, err = captureStdout(t, func() error { return manifestCmd([]string{"diff", b, b}) }); err != nil {
+		t.Errorf("diffing a manifest with itself: %v", err)
+	}
+	if _, err = captureStdout(t, func() error { return manifestCmd([]string{"diff", a}) }); exitCode(err) != exitUsage {
+		t.Errorf("manifest diff of one manifest: %v, want a usage error", err)
+	}
+}
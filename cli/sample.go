@@ -0,0 +1,337 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+)
+
+// gutchunk dump-sample --books 20 --out sample.db writes a small database
+// to hand to someone who wants to see what the corpus looks like: that many
+// books drawn at random from the current ones, with their chunks and
+// whatever every other table holds about them, in the schema this version
+// makes and unencrypted. What refers to a book or a chunk goes only with
+// the books and chunks that do, so the sample holds together on its own:
+// a duplicate_group or suppressed_by of a book left out is cleared, and
+// the catalog keeps only the sample's ebooks. The chunks are written with
+// their text whatever storage the database uses, so --strip-content can
+// leave out the books' content, by far the bulk of them. The full text
+// index and the author stats aren't copied; gutchunk index and
+// refresh-stats make them again.
+
+// sampleTables are the tables dump-sample copies after files and chunks,
+// each with which of its rows go along; "" for every row. They are copied
+// in order, so a condition may go by what the tables before it in the
+// sample hold.
+var sampleTables = []struct{ table, where string }{
+	{"sources", "id IN (SELECT source_id FROM sample.files)"},
+	{"source_conflicts", "file_id IN (SELECT id FROM sample.files)"},
+	{"works", "id IN (SELECT work_id FROM sample.files)"},
+	{"footnotes", "sourceid IN (SELECT id FROM sample.files)"},
+	{"strategy_chunks", "sourceid IN (SELECT id FROM sample.files)"},
+	{"stable_id_map", "sourceid IN (SELECT id FROM sample.files)"},
+	{"ingest_journal", "archive IN (SELECT archive FROM sample.files)"},
+	{"chunk_flags", "chunk_id IN (SELECT id FROM sample.chunks)"},
+	{"content_flags", "chunk_id IN (SELECT id FROM sample.chunks)"},
+	{"content_scans", "chunk_id IN (SELECT id FROM sample.chunks)"},
+	{"boilerplate", ""},
+	{"presets", ""},
+	{"book_meta", "file_id IN (SELECT id FROM sample.files)"},
+	{"catalog", "ebook IN (SELECT ebook FROM sample.files)"},
+	{"gutindex", "ebook IN (SELECT ebook FROM sample.files)"},
+	{"series", "ebook IN (SELECT ebook FROM sample.files)"},
+	{"contributors", "file_id IN (SELECT id FROM sample.files) OR ebook IN (SELECT ebook FROM sample.files)"},
+	{"author_aliases", ""},
+	{"book_similarities", "a IN (SELECT id FROM sample.files) AND b IN (SELECT id FROM sample.files)"},
+	{"tombstones", "file_id IN (SELECT id FROM sample.files)"},
+	{"name_words", "file_id IN (SELECT id FROM sample.files)"},
+	{"name_sources", "file_id IN (SELECT id FROM sample.files)"},
+	{"works_in_file", "file_id IN (SELECT id FROM sample.files)"},
+	{"book_terms", "sourceid IN (SELECT id FROM sample.files)"},
+	{"warnings", "file_id IN (SELECT id FROM sample.files)"},
+	{"runs", ""},
+	{"chunk_log", "file_id IN (SELECT id FROM sample.files)"},
+	{"chunk_counts", "sourceid IN (SELECT id FROM sample.files)"},
+	{"served_log", "chunk_id IN (SELECT id FROM sample.chunks)"},
+}
+
+func dumpSampleCmd(args []string) error {
+	fs := flag.NewFlagSet("dump-sample", flag.ExitOnError)
+	n := fs.Int("books", 20, "how many books to draw")
+	out := fs.String("out", "", "sqlite file to write the sample to; it must not exist yet")
+	seed := fs.Int64("seed", 0, "random seed (default: time based)")
+	strip := fs.Bool("strip-content", false, "leave out the books' content, keeping their headers and chunks")
+	license := provenanceFlags(fs, false)
+	filter := filterFlag(fs, nil)
+	fs.Parse(args)
+
+	if *out == "" {
+		return usagef("--out is required")
+	}
+	if *n <= 0 {
+		return usagef("--books must be positive")
+	}
+	if _, err := os.Stat(*out); err == nil {
+		return fmt.Errorf("%s exists already; give a new file", *out)
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	f, err := filter(db)
+	if err != nil {
+		return err
+	}
+	books, err := sampleBooks(db, *n, false, f, rand.New(rand.NewSource(*seed)))
+	if err != nil {
+		return err
+	}
+	if len(books) == 0 && f != nil {
+		return errors.New("there are no books with chunks the filter keeps to sample")
+	} else if len(books) == 0 {
+		return errors.New("there are no books to sample")
+	}
+	note, _ := license()
+	p, err := newProvenance(db, "dump-sample", fs, note)
+	if err != nil {
+		return err
+	}
+	p.Flags["seed"] = fmt.Sprint(*seed)
+	if err = dumpSample(db, *out, books, *strip, p); err != nil {
+		os.Remove(*out)
+		return err
+	}
+
+	sample, err := sql.Open("sqlite3", *out)
+	if err != nil {
+		return err
+	}
+	defer sample.Close()
+	var chunks int
+	if err = sample.QueryRow("SELECT count(*) FROM chunks").Scan(&chunks); err != nil {
+		return err
+	}
+	problems, err := checkSample(sample)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("wrote %d books and %d chunks to %s\n", len(books), chunks, *out)
+	if len(problems) > 0 {
+		return fmt.Errorf("the sample fails its checks:\n  %s", strings.Join(problems, "\n  "))
+	}
+	fmt.Println("it passes sqlite's integrity and foreign key checks")
+	return nil
+}
+
+// sampleBooks draws up to n of the current books: neither removed nor
+// superseded, with withContent kept with their content, and with f, nil
+// for any, with a chunk random would draw that f keeps.
+func sampleBooks(db *sql.DB, n int, withContent bool, f *chunkFilter, r *rand.Rand) ([]int64, error) {
+	q := "SELECT id FROM files WHERE deleted_at IS NULL AND superseded_by IS NULL AND (? = 0 OR " + hasContent("") + ")"
+	args := []interface{}{withContent}
+	if f != nil {
+		q += " AND id IN (SELECT c.sourceid FROM chunks c JOIN files f ON f.id = c.sourceid WHERE " + filterWhere + ")"
+		args = append(args, f.args()...)
+	}
+	rows, err := db.Query(q+" ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	r.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+	if len(ids) > n {
+		ids = ids[:n]
+	}
+	return ids, nil
+}
+
+// dumpSample makes the schema at out and copies books into it, with p as
+// its provenance.
+func dumpSample(db *sql.DB, out string, books []int64, strip bool, p provenance) error {
+	// connected as openDB connects, for the functions migrate's steps call
+	sample, err := connectDB(fileDSN(out), "", connOptions{})
+	if err != nil {
+		return err
+	}
+	sample.SetMaxOpenConns(1)
+	if _, err = sample.Exec(schemaTables + ";" + chunksTable(chunksRowid, "chunks")); err == nil {
+		err = migrate(sample)
+	}
+	if err == nil {
+		err = saveProvenance(sample, p)
+	}
+	sample.Close()
+	if err != nil {
+		return fmt.Errorf("could not make the sample's schema: %w", err)
+	}
+
+	ctx := context.Background()
+	// ATTACH only holds for the connection it runs on
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// KEY '' leaves the sample unencrypted when the database isn't
+	if _, err = conn.ExecContext(ctx, "ATTACH DATABASE ? AS sample KEY ''", out); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "DETACH DATABASE sample")
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	list := make([]string, len(books))
+	for i, id := range books {
+		list[i] = fmt.Sprint(id)
+	}
+	cols, err := sampleColumns(tx, "files")
+	if err != nil {
+		return err
+	}
+	sel := append([]string{}, cols...)
+	for i, c := range sel {
+		switch {
+		case c == "content" && strip:
+			sel[i] = "NULL"
+		case c == "content":
+			// the sample has no blob store
+			sel[i] = contentCol("")
+		case c == "content_blob" || c == "content_bytes":
+			sel[i] = "NULL"
+		}
+	}
+	steps := []string{
+		fmt.Sprintf("INSERT INTO sample.files (%s) SELECT %s FROM files WHERE id IN (%s)",
+			strings.Join(cols, ", "), strings.Join(sel, ", "), strings.Join(list, ",")),
+		"UPDATE sample.files SET duplicate_group = NULL WHERE duplicate_group NOT IN (SELECT id FROM sample.files)",
+		"UPDATE sample.files SET suppressed_by = NULL WHERE suppressed_by NOT IN (SELECT id FROM sample.files)",
+		fmt.Sprintf("INSERT INTO sample.chunks (%s) SELECT %[1]s FROM chunks WHERE sourceid IN (SELECT id FROM sample.files)", chunkCols),
+	}
+	for _, t := range sampleTables {
+		cols, err := sampleColumns(tx, t.table)
+		if err != nil {
+			return err
+		}
+		q := fmt.Sprintf("INSERT INTO sample.%s (%s) SELECT %[2]s FROM %[1]s", t.table, strings.Join(cols, ", "))
+		if t.where != "" {
+			q += " WHERE " + t.where
+		}
+		steps = append(steps, q)
+	}
+	for _, q := range steps {
+		if _, err = tx.ExecContext(ctx, q); err != nil {
+			return fmt.Errorf("could not copy into the sample: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// sampleColumns lists the columns of table in the sample, to copy by.
+func sampleColumns(tx *sql.Tx, table string) ([]string, error) {
+	rows, err := tx.Query(fmt.Sprintf("SELECT name FROM pragma_table_info('%s', 'sample')", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var cols []string
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		cols = append(cols, name)
+	}
+	return cols, rows.Err()
+}
+
+// checkSample runs sqlite's integrity check and foreign key check over a
+// sample, and checks that every row referring to a book or chunk has it.
+func checkSample(db *sql.DB) ([]string, error) {
+	problems, err := checkIntegrity(db)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range []struct{ what, q string }{
+		{"chunks of books not in it", "SELECT count(*) FROM chunks WHERE sourceid NOT IN (SELECT id FROM files)"},
+		{"footnotes of books not in it", "SELECT count(*) FROM footnotes WHERE sourceid NOT IN (SELECT id FROM files)"},
+		{"flags of chunks not in it", "SELECT count(*) FROM chunk_flags WHERE chunk_id NOT IN (SELECT id FROM chunks)"},
+		{"catalog rows of ebooks not in it", "SELECT count(*) FROM catalog WHERE ebook NOT IN (SELECT ebook FROM files WHERE ebook IS NOT NULL)"},
+	} {
+		var n int
+		if err := db.QueryRow(c.q).Scan(&n); err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			problems = append(problems, fmt.Sprintf("%d %s", n, c.what))
+		}
+	}
+	return problems, nil
+}
+
+// checkIntegrity runs sqlite's integrity check and foreign key check,
+// returning what they find.
+func checkIntegrity(db rowsQueryer) ([]string, error) {
+	var problems []string
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var msg string
+		if err = rows.Scan(&msg); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if msg != "ok" {
+			problems = append(problems, msg)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query("PRAGMA foreign_key_check")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var table, parent string
+		var rowid sql.NullInt64
+		var fk int
+		if err = rows.Scan(&table, &rowid, &parent, &fk); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		problems = append(problems, fmt.Sprintf("%s row %d refers to a missing %s row", table, rowid.Int64, parent))
+	}
+	rows.Close()
+	return problems, rows.Err()
+}
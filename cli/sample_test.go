@@ -0,0 +1,186 @@
+package cli
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sampledLibrary is a file database of six books ingested and chunked,
+// each its ebook's catalog row, the chunks of book 1 pinned and book 2 a
+// duplicate of book 5.
+func sampledLibrary(t *testing.T) *sql.DB {
+	t.Helper()
+	db := testFileDB(t)
+	root := t.TempDir()
+	for i, title := range []string{"Emma", "Persuasion", "Villette", "Shirley", "Middlemarch", "Cranford"} {
+		n := string(rune('1' + i))
+		writeTestZip(t, filepath.Join(root, n, n+n+".zip"), zipEntry{n + n + ".txt", testBook(title, testParagraphs(2+i))})
+	}
+	for _, cmd := range []func() error{
+		func() error { return ingestCmd([]string{"--target", root}) },
+		func() error { return chunkCmd(nil) },
+		func() error { return pinCmd([]string{"1", "2"}) },
+	} {
+		if _, err := captureStdout(t, cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, q := range []string{
+		"INSERT INTO catalog (ebook, author, title) SELECT ebook, 'Someone', name FROM files",
+		"UPDATE files SET duplicate_group = 5 WHERE id IN (2, 5)",
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestDumpSample(t *testing.T) {
+	db := sampledLibrary(t)
+	dump := func(args ...string) (*sql.DB, string) {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "sample.db")
+		out, err := captureStdout(t, func() error { return dumpSampleCmd(append(args, "--out", path)) })
+		if err != nil {
+			t.Fatalf("dump-sample %s: %v", strings.Join(args, " "), err)
+		}
+		if !strings.Contains(out, "it passes sqlite's integrity and foreign key checks") {
+			t.Errorf("dump-sample printed %q", out)
+		}
+		sample, err := connectDB(fileDSN(path), "", connOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { sample.Close() })
+		return sample, path
+	}
+	count := func(db *sql.DB, q string) int {
+		t.Helper()
+		var n int
+		if err := db.QueryRow(q).Scan(&n); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+		return n
+	}
+
+	for _, seed := range []string{"1", "2", "3", "4"} {
+		sample, _ := dump("--books", "3", "--seed", seed)
+		if problems, err := checkSample(sample); err != nil || len(problems) > 0 {
+			t.Fatalf("the sample fails its checks: %v (%v)", problems, err)
+		}
+		if n := count(sample, "SELECT count(*) FROM files"); n != 3 {
+			t.Fatalf("the sample has %d books", n)
+		}
+		// every chunk of the books in it, and no other
+		ids := ids(t, sample, "SELECT id FROM files ORDER BY id")
+		in := strings.ReplaceAll(ids, " ", ",")
+		for _, q := range []string{
+			"SELECT count(*) FROM chunks WHERE sourceid IN (%s)",
+			"SELECT count(*) FROM catalog WHERE ebook IN (SELECT ebook FROM files WHERE id IN (%s))",
+			"SELECT count(*) FROM chunk_flags WHERE chunk_id IN (SELECT id FROM chunks WHERE sourceid IN (%s))",
+		} {
+			if got, want := count(sample, strings.Replace(q, "%s", in, 1)), count(db, strings.Replace(q, "%s", in, 1)); got != want {
+				t.Errorf("of books %s, the sample has %d of %q, want %d", ids, got, q, want)
+			}
+		}
+		if n := count(sample, "SELECT count(*) FROM catalog"); n != 3 {
+			t.Errorf("the sample has %d catalog rows", n)
+		}
+		// a duplicate of a book left out is no one's
+		in2 := count(sample, "SELECT count(*) FROM files WHERE id = 2")
+		in5 := count(sample, "SELECT count(*) FROM files WHERE id = 5")
+		if grouped := count(sample, "SELECT count(*) FROM files WHERE duplicate_group IS NOT NULL"); grouped != in5*(1+in2) {
+			t.Errorf("with book 2 %d and book 5 %d in the sample, %d books are in a duplicate group", in2, in5, grouped)
+		}
+	}
+
+	// what chunks the books again finds them as they were
+	sample, path := dump("--books", "6", "--seed", "1")
+	rep, err := auditChunks(sample, 6, 0, chunkOptions{})
+	if err != nil || rep.Books != 6 || rep.Identical != 6 {
+		t.Errorf("audited, the sample's chunks are %+v (%v)", rep, err)
+	}
+	if got, want := storedTexts(t, sample), storedTexts(t, db); got != want {
+		t.Errorf("the sample's chunks are\n%s", lineDiff(want, got))
+	}
+	if _, err = captureStdout(t, func() error { return dumpSampleCmd([]string{"--books", "1", "--out", path}) }); err == nil ||
+		!strings.Contains(err.Error(), "exists already") {
+		t.Errorf("dumping over a sample: %v", err)
+	}
+
+	stripped, _ := dump("--books", "6", "--strip-content")
+	if n := count(stripped, "SELECT count(*) FROM files WHERE content IS NOT NULL"); n != 0 {
+		t.Errorf("stripped, %d books kept their content", n)
+	}
+	if got, want := storedTexts(t, stripped), storedTexts(t, db); got != want {
+		t.Errorf("stripped, the sample's chunks are\n%s", lineDiff(want, got))
+	}
+	if rep, err = auditChunks(stripped, 6, 0, chunkOptions{}); err != nil || rep.Books != 0 {
+		t.Errorf("audited, the stripped sample's chunks are %+v (%v)", rep, err)
+	}
+
+	for _, args := range [][]string{{"--books", "2"}, {"--books", "0", "--out", filepath.Join(t.TempDir(), "s.db")}} {
+		if _, err = captureStdout(t, func() error { return dumpSampleCmd(args) }); exitCode(err) != exitUsage {
+			t.Errorf("dump-sample %s: %v, want a usage error", strings.Join(args, " "), err)
+		}
+	}
+}
+
+func TestSchemaCmd(t *testing.T) {
+	testFileDB(t)
+	out, err := captureStdout(t, func() error { return schemaCmd(nil) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("-- gutchunk schema version %d\n\nCREATE TABLE", schemaVersion); !strings.HasPrefix(out, want) {
+		t.Errorf("schema printed\n%.200s\nwant it to start %q", out, want)
+	}
+	for _, want := range []string{"\nCREATE TABLE files (\n\tid ", "\nCREATE INDEX", "\nCREATE TRIGGER"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("schema printed no %q", want)
+		}
+	}
+
+	// what it prints makes the same tables
+	path := filepath.Join(t.TempDir(), "made.db")
+	made, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer made.Close()
+	if _, err = made.Exec(out); err != nil {
+		t.Fatalf("running what schema printed: %v", err)
+	}
+	db, err := openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tables := "SELECT name FROM sqlite_master WHERE name NOT LIKE 'sqlite_%' ORDER BY name"
+	if got, want := names(t, made, tables), names(t, db, tables); got != want {
+		t.Errorf("what schema printed makes\n%s", lineDiff(want, got))
+	}
+}
+
+// names is the names query selects, a line each.
+func names(t *testing.T, db *sql.DB, query string) string {
+	t.Helper()
+	rows, err := db.Query(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var b strings.Builder
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		b.WriteString(name + "\n")
+	}
+	return b.String()
+}
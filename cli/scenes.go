@@ -0,0 +1,50 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// --scene-break and --no-scene-breaks change the lines taken for scene
+// breaks (see gutchunk.DefaultSceneBreaks).
+
+type patternList []string
+
+func (p *patternList) String() string {
+	return strings.Join(*p, ", ")
+}
+
+func (p *patternList) Set(v string) error {
+	*p = append(*p, v)
+	return nil
+}
+
+// sceneFlags adds --scene-break and --no-scene-breaks to fs and returns
+// what reads them, giving nil for the defaults.
+func sceneFlags(fs *flag.FlagSet) func() ([]*regexp.Regexp, error) {
+	var patterns patternList
+	fs.Var(&patterns, "scene-break", "regexp a whole trimmed line must match to be a scene break, in place of the defaults (repeatable)")
+	none := fs.Bool("no-scene-breaks", false, "take no lines for scene breaks")
+	return func() ([]*regexp.Regexp, error) {
+		if *none {
+			if len(patterns) > 0 {
+				return nil, usagef("--scene-break and --no-scene-breaks don't go together")
+			}
+			return []*regexp.Regexp{}, nil
+		}
+		if len(patterns) == 0 {
+			return nil, nil
+		}
+		res := []*regexp.Regexp{}
+		for _, p := range patterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return nil, fmt.Errorf("bad --scene-break: %w", err)
+			}
+			res = append(res, re)
+		}
+		return res, nil
+	}
+}
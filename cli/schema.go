@@ -0,0 +1,457 @@
+package cli
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// openDB brings every database it opens up to date, but one it can't write
+// (a read-only copy, say) keeps whatever tables and columns it was made
+// with. Rather than have a query fail on one of them halfway through, or
+// worse match nothing, openDB compares the database with the schema this
+// version makes. The commands that only read go on over empty stand-ins
+// for what is missing, with a note naming it; the rest stop before doing
+// anything, asking for gutchunk migrate.
+
+// schemaVersion is kept in the database's user_version once migrate has
+// run, so an older gutchunk can tell a database it would misread.
+const schemaVersion = 10
+
+// versionSteps are what bringing a database up to each version takes
+// besides the tables and columns migrate adds.
+var versionSteps = []struct {
+	version int
+	run     func(*sql.DB) error
+}{
+	{2, moveWarnings},
+	{3, fillTitleTranslit},
+	{4, fillTitleSort},
+	{5, fillPositions},
+	{6, fillLanguageSource},
+	{7, canonicalizePaths},
+	{8, fillContributors},
+	{9, fillChunkCounts},
+	{10, fillBodyOnly},
+}
+
+// readingCommands are the commands that go on over a database missing
+// tables or columns.
+var readingCommands = map[string]bool{
+	"serve": true, "random": true, "authors": true, "export": true, "cat": true,
+	"stats": true, "grep": true, "flags": true, "coverage": true, "header": true,
+	"tombstones": true, "export-books": true, "list": true, "books": true,
+	"versions": true, "audit-chunks": true, "warnings": true, "changes": true,
+	"schema": true, "dump-sample": true, "similar-lexical": true, "provenance": true,
+}
+
+// schemaGap is a table, or a column of one, the database is missing.
+type schemaGap struct {
+	table, column string
+}
+
+func (g schemaGap) String() string {
+	if g.column == "" {
+		return "table " + g.table
+	}
+	return g.table + "." + g.column
+}
+
+// missingSchema is what the database opened lacks, read through stand-ins.
+var missingSchema []schemaGap
+
+// lacks reports whether the database opened is missing table.column, or
+// table when column is "".
+func lacks(table, column string) bool {
+	for _, g := range missingSchema {
+		if g.table == table && (g.column == "" || g.column == column) {
+			return true
+		}
+	}
+	return false
+}
+
+// requireSchema is needsMigration for what of need the database opened
+// lacks, nil when it lacks none of it.
+func requireSchema(need ...schemaGap) error {
+	var missing needsMigration
+	for _, g := range need {
+		if lacks(g.table, g.column) {
+			missing = append(missing, g)
+		}
+	}
+	if missing != nil {
+		return missing
+	}
+	return nil
+}
+
+// filterColumns are the columns chunkFilter's filters read, by the
+// filter.
+var filterColumns = []struct {
+	filter, table, column string
+	set                   func(*chunkFilter) bool
+	clear                 func(*chunkFilter)
+}{
+	{"source", "files", "source_id", func(f *chunkFilter) bool { return f.Source != 0 }, func(f *chunkFilter) { f.Source = 0 }},
+	{"language", "files", "language", func(f *chunkFilter) bool { return f.Language != "" || f.NotLanguage != "" },
+		func(f *chunkFilter) { f.Language, f.NotLanguage = "", "" }},
+	{"unique_works", "files", "duplicate_group", func(f *chunkFilter) bool { return f.UniqueWorks }, func(f *chunkFilter) { f.UniqueWorks = false }},
+	{"authors-file", "files", "author_norm", func(f *chunkFilter) bool { return f.DenyAuthors != "" || f.AllowAuthors != "" },
+		func(f *chunkFilter) { f.DenyAuthors, f.AllowAuthors = "", "" }},
+	{"era", "files", "era_year", func(f *chunkFilter) bool { return f.Era.set }, func(f *chunkFilter) { f.Era = yearRange{} }},
+	{"position", "chunks", "position_pct", func(f *chunkFilter) bool { return f.Position.set }, func(f *chunkFilter) { f.Position = positionRange{} }},
+	{"kind", "chunks", "kind", func(f *chunkFilter) bool { return f.Kind != "" || f.NotKind != "" }, func(f *chunkFilter) { f.Kind, f.NotKind = "", "" }},
+	{"author", "files", "author_norm", func(f *chunkFilter) bool { return f.Authors != "" || f.NotAuthors != "" },
+		func(f *chunkFilter) { f.Authors, f.NotAuthors = "", "" }},
+	{"complete_only", "files", "completeness", func(f *chunkFilter) bool { return f.CompleteOnly }, func(f *chunkFilter) { f.CompleteOnly = false }},
+	{"series", "series", "name", func(f *chunkFilter) bool { return f.Series != "" }, func(f *chunkFilter) { f.Series = "" }},
+}
+
+// unbridged lists the filters of f set that read a column the database
+// opened lacks, each with the column, and clears them from f when drop is
+// set. A stand-in's nulls would have them match nothing, or everything.
+func (f *chunkFilter) unbridged(drop bool) [][2]string {
+	var which [][2]string
+	for _, fc := range filterColumns {
+		if fc.set(f) && lacks(fc.table, fc.column) {
+			which = append(which, [2]string{fc.filter, fc.table + "." + fc.column})
+			if drop {
+				fc.clear(f)
+			}
+		}
+	}
+	return which
+}
+
+// needsMigration is the error of a command that can't run without gaps.
+type needsMigration []schemaGap
+
+func (e needsMigration) Error() string {
+	return "this database needs migration: run gutchunk migrate (it is missing " + gapList(e) + ")"
+}
+
+func gapList(gaps []schemaGap) string {
+	names := make([]string, len(gaps))
+	for i, g := range gaps {
+		names[i] = g.String()
+	}
+	return strings.Join(names, ", ")
+}
+
+func checkSchemaVersion(q queryer) error {
+	var v int
+	if err := q.QueryRow("PRAGMA user_version").Scan(&v); err != nil {
+		return err
+	}
+	if v > schemaVersion {
+		return fmt.Errorf("this database was made by a newer gutchunk (schema version %d, this one knows %d); upgrade gutchunk to use it", v, schemaVersion)
+	}
+	return nil
+}
+
+// upgradeSchema runs the versionSteps past the database's version and
+// records it as schemaVersion.
+func upgradeSchema(db *sql.DB) error {
+	var v int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&v); err != nil {
+		return err
+	}
+	if v == schemaVersion {
+		return nil
+	}
+	for _, s := range versionSteps {
+		if v < s.version {
+			if err := s.run(db); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", schemaVersion))
+	return err
+}
+
+func isReadonly(err error) bool {
+	var serr sqlite3.Error
+	return errors.As(err, &serr) && serr.Code == sqlite3.ErrReadonly
+}
+
+// expectedTable is a table as this version makes it.
+type expectedTable struct {
+	name, ddl string
+	columns   []string
+}
+
+// expectedSchema makes the schema in a database in memory and reads it
+// back.
+func expectedSchema() ([]expectedTable, error) {
+	mem, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return nil, err
+	}
+	defer mem.Close()
+	mem.SetMaxOpenConns(1)
+	if _, err = mem.Exec(schemaTables + ";" + chunksTable(chunksRowid, "chunks")); err != nil {
+		return nil, err
+	}
+	rows, err := mem.Query("SELECT name, sql FROM sqlite_master WHERE type = 'table' ORDER BY rowid")
+	if err != nil {
+		return nil, err
+	}
+	var tables []expectedTable
+	for rows.Next() {
+		var t expectedTable
+		if err = rows.Scan(&t.name, &t.ddl); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tables = append(tables, t)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range tables {
+		if tables[i].columns, err = tableColumns(mem, "main", tables[i].name); err != nil {
+			return nil, err
+		}
+	}
+	return tables, nil
+}
+
+func tableColumns(q *sql.DB, schema, table string) ([]string, error) {
+	rows, err := q.Query(fmt.Sprintf("SELECT name FROM pragma_table_info('%s', '%s')", table, schema))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var cols []string
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		cols = append(cols, name)
+	}
+	return cols, rows.Err()
+}
+
+// findGaps compares db's main schema with the expected one, returning
+// what it is missing and the statements making temporary stand-ins for
+// it: empty tables, and views adding null columns. Chunks stored as
+// references are left out, chunk_refs being made whole.
+func findGaps(db *sql.DB) ([]schemaGap, []string, error) {
+	tables, err := expectedSchema()
+	if err != nil {
+		return nil, nil, err
+	}
+	refs, err := tableLayout(db, "chunk_refs")
+	if err != nil {
+		return nil, nil, err
+	}
+	var gaps []schemaGap
+	var standIns []string
+	for _, t := range tables {
+		if t.name == "chunks" && refs != "" {
+			continue
+		}
+		have, err := tableColumns(db, "main", t.name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(have) == 0 {
+			gaps = append(gaps, schemaGap{t.name, ""})
+			standIns = append(standIns, strings.Replace(t.ddl, "CREATE TABLE", "CREATE TEMP TABLE", 1))
+			continue
+		}
+		got := map[string]bool{}
+		for _, c := range have {
+			got[c] = true
+		}
+		var nulls []string
+		for _, c := range t.columns {
+			if !got[c] {
+				gaps = append(gaps, schemaGap{t.name, c})
+				nulls = append(nulls, "NULL AS "+c)
+			}
+		}
+		if nulls != nil {
+			standIns = append(standIns, fmt.Sprintf("CREATE TEMP VIEW %s AS SELECT *, %s FROM main.%[1]s", t.name, strings.Join(nulls, ", ")))
+		}
+	}
+	return gaps, standIns, nil
+}
+
+// bridgeSchema is openDB's way on with a database it can't bring up to
+// date. The command running goes on over stand-ins for what the database
+// lacks if it only reads, and stops with needsMigration otherwise.
+func bridgeSchema(db *sql.DB) ([]string, error) {
+	gaps, standIns, err := findGaps(db)
+	if err != nil || len(gaps) == 0 {
+		return nil, err
+	}
+	// sharded chunks are a view of their own already, leaving no room for
+	// a stand-in
+	chunkGaps, shardsKnown := false, true
+	for _, g := range gaps {
+		chunkGaps = chunkGaps || g.table == "chunks"
+		shardsKnown = shardsKnown && g.table != "chunk_shards"
+	}
+	if chunkGaps && shardsKnown {
+		n, err := loadShardCount(db)
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			return nil, needsMigration(gaps)
+		}
+	}
+	if !readingCommands[flag.Arg(0)] {
+		return nil, needsMigration(gaps)
+	}
+	missingSchema = gaps
+	fmt.Fprintf(os.Stderr, "note: this database can't be written and predates %s; reading them as empty (run gutchunk migrate once it can be)\n", gapList(gaps))
+	return standIns, nil
+}
+
+func migrateCmd(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	incremental := fs.Bool("incremental-vacuum", false, "turn on incremental vacuuming for gc-content --vacuum, by one full VACUUM")
+	space := spaceFlags(fs)
+	fs.Parse(args)
+	so, err := space()
+	if err != nil {
+		return err
+	}
+
+	key, err := dbKey()
+	if err != nil {
+		return err
+	}
+	db, err := connectDB(dsn, key, connOptions{foreignKeys: true})
+	if err != nil {
+		return fmt.Errorf("could not connect to %s: %w", dsn, err)
+	}
+	defer db.Close()
+
+	if err = checkSchemaVersion(db); err != nil {
+		return err
+	}
+	gaps, _, err := findGaps(db)
+	if err != nil {
+		return err
+	}
+	if err = createSchema(db); err != nil {
+		if isReadonly(err) {
+			return fmt.Errorf("could not migrate %s, it can't be written", dsn)
+		}
+		return fmt.Errorf("failed to migrate the db schema: %w", err)
+	}
+	if len(gaps) > 0 {
+		fmt.Println("added", gapList(gaps))
+	}
+	fmt.Printf("the schema is up to date (version %d)\n", schemaVersion)
+	if *incremental {
+		return enableIncrementalVacuum(db, so)
+	}
+	return nil
+}
+
+// enableIncrementalVacuum sets auto_vacuum to incremental in a database
+// made before gutchunk did, which takes a VACUUM rewriting all of it.
+func enableIncrementalVacuum(db *sql.DB, so spaceOptions) error {
+	mode, err := autoVacuum(db)
+	if err != nil {
+		return err
+	}
+	if mode == autoVacuumIncremental {
+		fmt.Println("incremental vacuuming is on already")
+		return nil
+	}
+	if err = checkSpace(dbFile(dsn), "the vacuum", so); err != nil {
+		return err
+	}
+	sw := watchSpace(runCtx, dbFile(dsn), so.minFree)
+	defer sw.stop()
+	// the setting and the vacuum taking it up need the one connection
+	conn, err := db.Conn(sw.ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err = conn.ExecContext(sw.ctx, "PRAGMA auto_vacuum = INCREMENTAL"); err != nil {
+		return err
+	}
+	if _, err = conn.ExecContext(sw.ctx, "VACUUM"); err != nil {
+		return sw.err(fmt.Errorf("could not vacuum: %w", err))
+	}
+	fmt.Println("turned on incremental vacuuming")
+	return nil
+}
+
+// schemaStatements are the statements making the main database's tables,
+// indexes, views and triggers, in that order, less sqlite's own and the
+// full text index's shadow tables.
+const schemaStatements = `SELECT sql FROM main.sqlite_master
+	WHERE sql IS NOT NULL AND name NOT LIKE 'sqlite_%'
+		AND name NOT IN (SELECT name FROM pragma_table_list WHERE schema = 'main' AND type = 'shadow')
+	ORDER BY CASE type WHEN 'table' THEN 0 WHEN 'index' THEN 1 WHEN 'view' THEN 2 ELSE 3 END, rowid`
+
+// schemaCmd prints the database's schema as it is, its version first: the
+// statements making its tables, indexes, views and triggers, less sqlite's
+// own and the full text index's shadow tables.
+func schemaCmd(args []string) error {
+	fs := flag.NewFlagSet("schema", flag.ExitOnError)
+	fs.Parse(args)
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var v int
+	if err = db.QueryRow("PRAGMA main.user_version").Scan(&v); err != nil {
+		return err
+	}
+	rows, err := db.Query(schemaStatements)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	fmt.Printf("-- gutchunk schema version %d\n", v)
+	for rows.Next() {
+		var stmt string
+		if err = rows.Scan(&stmt); err != nil {
+			return err
+		}
+		fmt.Printf("\n%s;\n", dedent(stmt))
+	}
+	return rows.Err()
+}
+
+// dedent takes off the lines after the first of stmt the tabs they all
+// start with, which are where its CREATE sat in the source.
+func dedent(stmt string) string {
+	lines := strings.Split(stmt, "\n")
+	common := -1
+	for _, l := range lines[1:] {
+		if strings.TrimSpace(l) == "" {
+			continue
+		}
+		if n := len(l) - len(strings.TrimLeft(l, "\t")); common < 0 || n < common {
+			common = n
+		}
+	}
+	for i := 1; i < len(lines) && common > 0; i++ {
+		if len(lines[i]) >= common {
+			lines[i] = lines[i][common:]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,156 @@
+package cli
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// captureStderr runs f, returning what it printed to stderr.
+func captureStderr(t *testing.T, f func() error) (string, error) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	was := os.Stderr
+	os.Stderr = w
+	out := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- string(b)
+	}()
+	err = f()
+	os.Stderr = was
+	w.Close()
+	return <-out, err
+}
+
+// asCommand has openDB open databases for gutchunk's command name.
+func asCommand(t *testing.T, name string) {
+	t.Helper()
+	if err := flag.CommandLine.Parse([]string{name}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { flag.CommandLine.Parse(nil) })
+}
+
+// oldDatabase is the path of a database of two books by Austen, chunked,
+// from before files.duplicate_group, files.era_year and name_words, the
+// dsn naming it read-only.
+func oldDatabase(t *testing.T) string {
+	t.Helper()
+	db := testFileDB(t)
+	for _, title := range []string{"Emma", "Persuasion"} {
+		id := addBook(t, db, title, "Jane Austen", "")
+		insertChunk(t, db, id, 0, "A chunk of "+title+".")
+	}
+	path := dbFile(dsn)
+	db.Close()
+
+	raw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	for _, q := range []string{"ALTER TABLE files DROP COLUMN duplicate_group", "DROP INDEX files_era_year", "ALTER TABLE files DROP COLUMN era_year", "DROP TABLE name_words"} {
+		if _, err = raw.Exec(q); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+	dsn = fileDSN(path) + "&mode=ro"
+	return path
+}
+
+func TestOldDatabase(t *testing.T) {
+	path := oldDatabase(t)
+	wantGaps := "files.duplicate_group, files.era_year, table name_words"
+
+	asCommand(t, "random")
+	var out string
+	note, err := captureStderr(t, func() error {
+		var err error
+		out, err = captureStdout(t, func() error { return randomCmd([]string{"--era", "1800-1899", "--width", "0"}) })
+		return err
+	})
+	if err != nil || !strings.Contains(out, "A chunk of") {
+		t.Fatalf("random over the old database: %q, %v", out, err)
+	}
+	for _, want := range []string{"predates " + wantGaps + "; reading them as empty", "ignoring the era filter, as this database has no files.era_year"} {
+		if !strings.Contains(note, want) {
+			t.Errorf("random noted %q, want %q", note, want)
+		}
+	}
+	if note, err = captureStderr(t, func() error {
+		_, err := captureStdout(t, func() error { return randomCmd([]string{"--unique-works"}) })
+		return err
+	}); err != nil || !strings.Contains(note, "drawing from every edition, as this database lacks files.duplicate_group") {
+		t.Errorf("random --unique-works over the old database: %q, %v", note, err)
+	}
+	if !lacks("files", "era_year") || !lacks("name_words", "") || lacks("files", "author") {
+		t.Errorf("the old database is missing %v", missingSchema)
+	}
+	// what can't be drawn right without them isn't drawn at all
+	_, err = captureStderr(t, func() error { return randomCmd([]string{"--author", "austen"}) })
+	if err == nil || !strings.Contains(err.Error(), "needs migration: run gutchunk migrate (it is missing table name_words)") {
+		t.Errorf("random --author over the old database: %v", err)
+	}
+
+	asCommand(t, "books")
+	if _, err = captureStderr(t, func() error {
+		out, err = captureStdout(t, func() error { return booksCmd([]string{"--json"}) })
+		return err
+	}); err != nil || strings.Count(out, `"title"`) != 2 {
+		t.Errorf("books over the old database: %q, %v", out, err)
+	}
+
+	// a command that writes stops before it starts
+	asCommand(t, "chunk")
+	if _, err = openDB(); err == nil || err.Error() != "this database needs migration: run gutchunk migrate (it is missing "+wantGaps+")" {
+		t.Errorf("opening the old database to chunk: %v", err)
+	}
+	if _, err = captureStdout(t, func() error { return migrateCmd(nil) }); err == nil || !strings.Contains(err.Error(), "can't be written") {
+		t.Errorf("migrating the database read-only: %v", err)
+	}
+
+	dsn = fileDSN(path)
+	asCommand(t, "migrate")
+	if out, err = captureStdout(t, func() error { return migrateCmd(nil) }); err != nil ||
+		out != fmt.Sprintf("added %s\nthe schema is up to date (version %d)\n", wantGaps, schemaVersion) {
+		t.Errorf("migrate printed %q, %v", out, err)
+	}
+	dsn = fileDSN(path) + "&mode=ro"
+	asCommand(t, "random")
+	db, err := openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if missingSchema != nil {
+		t.Errorf("migrated, the database is missing %v", missingSchema)
+	}
+	var version int
+	if err = db.QueryRow("PRAGMA user_version").Scan(&version); err != nil || version != schemaVersion {
+		t.Errorf("migrated, the database is at version %d (%v)", version, err)
+	}
+}
+
+func TestNewerDatabase(t *testing.T) {
+	db := testFileDB(t)
+	if _, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", schemaVersion+1)); err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("made by a newer gutchunk (schema version %d, this one knows %d)", schemaVersion+1, schemaVersion)
+	for name, open := range map[string]func() error{
+		"open":    func() error { _, err := openDB(); return err },
+		"migrate": func() error { _, err := captureStdout(t, func() error { return migrateCmd(nil) }); return err },
+	} {
+		if err := open(); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: %v, want %q", name, err, want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"git.tilde.town/gutchunker/gutchunk"
+)
+
+// For trying things out, gutchunk --db :memory: keeps the database in
+// memory for the one command, and --db temp in a file of its own under the
+// temp directory, removed when gutchunk exits, or is interrupted; not when
+// it is killed.
+//
+// The database in memory is a gutchunk.MemoryStore, in sqlite's memdb vfs
+// so that every connection of the pool sees the one database, locked as a
+// file would be (see gutchunk/store.go), its tests' too. It is freed once
+// the last connection to it closes, as openDB's reconnecting does, so the
+// store holds one open for as long as gutchunk runs. --shared-cache puts
+// it in a shared cache after all, for whoever wants one (see dsn.go), and
+// a connection is kept open to a database in memory that --db names by a
+// file: uri too.
+var dbFlag = flag.String("db", defaultDB, "the database file, or a file: uri, or :memory: for one in memory for this command only, or temp for a throwaway file removed on exit")
+
+// dsn is the database the command works on, as set by openDatabase.
+var dsn string
+
+const (
+	dbMemory = ":memory:"
+	dbTemp   = "temp"
+)
+
+// inMemory says whether the database the dsn names is in memory, with no
+// file there.
+func inMemory(dsn string) bool {
+	params := dsnParams(dsn)
+	return params.Get("vfs") == "memdb" || params.Get("mode") == "memory" || dsnPath(dsn) == dbMemory
+}
+
+// openDatabase sets dsn by --db, returning what lets go of the database
+// in memory or removes the temp one.
+func openDatabase() (func(), error) {
+	switch *dbFlag {
+	case "":
+		return nil, fmt.Errorf("--db needs a file, %s or %s", dbMemory, dbTemp)
+	case dbMemory:
+		if *sharedCache {
+			dsn = fmt.Sprintf("file:gutchunk-%d?mode=memory&cache=shared", os.Getpid())
+			warnDSN()
+			return keepInMemory()
+		}
+		s, err := gutchunk.NewMemoryStore()
+		if err != nil {
+			return nil, err
+		}
+		dsn = s.DSN()
+		return func() { s.Close() }, nil
+	case dbTemp:
+		// a directory of its own, for the shards and sqlite's files
+		// beside the database
+		dir, err := os.MkdirTemp("", "gutchunk-")
+		if err != nil {
+			return nil, fmt.Errorf("could not make the temp database: %w", err)
+		}
+		path := filepath.Join(dir, "chunker.db")
+		dsn = fileDSN(path)
+		warnDSN()
+		fmt.Fprintf(os.Stderr, "note: using the temp database %s, removed on exit\n", path)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-sig
+			os.RemoveAll(dir)
+			os.Exit(exitCancelled)
+		}()
+		return func() {
+			signal.Stop(sig)
+			os.RemoveAll(dir)
+		}, nil
+	}
+	if !strings.HasPrefix(*dbFlag, "file:") {
+		dsn = fileDSN(*dbFlag)
+		warnDSN()
+		return func() {}, nil
+	}
+	dsn = userDSN(*dbFlag)
+	warnDSN()
+	if inMemory(dsn) {
+		return keepInMemory()
+	}
+	return func() {}, nil
+}
+
+// keepInMemory holds a connection to the database in memory dsn names
+// until what it returns is called.
+func keepInMemory() (func(), error) {
+	keep, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := keep.Conn(context.Background())
+	if err != nil {
+		keep.Close()
+		return nil, fmt.Errorf("could not make the database in memory: %w", err)
+	}
+	return func() {
+		conn.Close()
+		keep.Close()
+	}, nil
+}
+
+// warnDSN prints what is wrong with dsn for a pool of connections.
+func warnDSN() {
+	for _, w := range dsnWarnings(dsn) {
+		fmt.Fprintln(os.Stderr, "warning: "+w)
+	}
+}
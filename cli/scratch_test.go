@@ -0,0 +1,69 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openScratch opens the database --db at names, as main would.
+func openScratch(t *testing.T, at string) func() {
+	t.Helper()
+	flagWas, dsnWas := *dbFlag, dsn
+	*dbFlag = at
+	t.Cleanup(func() { *dbFlag, dsn = flagWas, dsnWas })
+	release, err := openDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return release
+}
+
+// A database in memory outlives openDB's connections, for every command
+// reconnecting, and is gone once released.
+func TestMemoryDatabase(t *testing.T) {
+	release := openScratch(t, dbMemory)
+	db, err := openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := addBook(t, db, "Kept", "Someone", testBook("Kept", testParagraphs(2)))
+	db.Close()
+	if db, err = openDB(); err != nil {
+		t.Fatal(err)
+	}
+	var name string
+	if err = db.QueryRow("SELECT name FROM files WHERE id = ?", id).Scan(&name); err != nil || name != "Kept" {
+		t.Errorf("reconnected, the book is %q, %v", name, err)
+	}
+	db.Close()
+	release()
+
+	openScratch(t, dbMemory)()
+	if db, err = openDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var n int
+	if db.QueryRow("SELECT count(*) FROM files").Scan(&n); n != 0 {
+		t.Errorf("a new database in memory has %d books", n)
+	}
+}
+
+func TestTempDatabase(t *testing.T) {
+	release := openScratch(t, dbTemp)
+	path := dsnPath(dsn)
+	db, err := openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addBook(t, db, "Temp", "Someone", testBook("Temp", testParagraphs(1)))
+	db.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("the temp database isn't there: %v", err)
+	}
+	release()
+	if _, err := os.Stat(filepath.Dir(path)); !os.IsNotExist(err) {
+		t.Errorf("the temp database's directory is left: %v", err)
+	}
+}
@@ -0,0 +1,323 @@
+package cli
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// most matches /search ranks; past this the total is an estimate and
+	// only the first searchCap matches in id order are ranked
+	searchCap = 10000
+	// results per page by default, and at most
+	searchPageSize = 20
+	maxPageSize    = 100
+	// words of context in a snippet
+	snippetTokens = 32
+	// longest snippet marker accepted
+	maxMarker = 32
+
+	// bm25 parameters, as FTS5 uses
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+var errBadQuery = errors.New("bad search query")
+
+type searchResult struct {
+	ID      int     `json:"id"`
+	Title   string  `json:"title"`
+	Author  string  `json:"author"`
+	Score   float64 `json:"score"`
+	Snippet string  `json:"snippet"`
+}
+
+type searchPage struct {
+	Query    string `json:"query"`
+	Page     int    `json:"page"`
+	PageSize int    `json:"page_size"`
+	// with TotalCapped, a lower bound: more than searchCap chunks match
+	Total       int            `json:"total"`
+	TotalCapped bool           `json:"total_capped"`
+	Results     []searchResult `json:"results"`
+	Next        *string        `json:"next"`
+	Prev        *string        `json:"prev"`
+}
+
+type searchQuery struct {
+	q              string
+	page, pageSize int
+	// what snippets wrap matches in
+	markStart, markEnd string
+	filter             chunkFilter
+}
+
+func (s *server) parseSearch(q url.Values) (searchQuery, error) {
+	sq := searchQuery{q: strings.TrimSpace(q.Get("q")), page: 1, pageSize: searchPageSize,
+		markStart: "<mark>", markEnd: "</mark>"}
+	if sq.q == "" {
+		return sq, errors.New("no q given")
+	}
+	if strings.Count(sq.q, `"`)%2 != 0 {
+		return sq, fmt.Errorf("%w: unbalanced quotes", errBadQuery)
+	}
+	if v := q.Get("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return sq, fmt.Errorf("bad page %q", v)
+		}
+		sq.page = n
+	}
+	if v := q.Get("page_size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			return sq, fmt.Errorf("page_size must be 1 to %d", maxPageSize)
+		}
+		sq.pageSize = n
+	}
+	if _, ok := q["mark_start"]; ok {
+		sq.markStart = q.Get("mark_start")
+	}
+	if _, ok := q["mark_end"]; ok {
+		sq.markEnd = q.Get("mark_end")
+	}
+	if len(sq.markStart) > maxMarker || len(sq.markEnd) > maxMarker {
+		return sq, fmt.Errorf("snippet markers may be at most %d bytes", maxMarker)
+	}
+	var err error
+	sq.filter, err = s.parseFilter(q)
+	return sq, err
+}
+
+// handleSearch serves GET /search: chunks matching an FTS query q, best
+// first by bm25, a page at a time, with snippets of the matches. Ties are
+// broken by chunk id so pages neither skip nor repeat results.
+func (s *server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	sq, err := s.parseSearch(r.URL.Query())
+	if errors.Is(err, errNoPreset) {
+		httpError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ok, err := hasFTS(s.db)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		httpError(w, http.StatusServiceUnavailable, "no full text index; run gutchunk index")
+		return
+	}
+
+	p, err := searchChunks(s.db, sq)
+	if errors.Is(err, errBadQuery) {
+		httpError(w, http.StatusBadRequest, err.Error()+"; check quotes, parentheses and operators like AND, OR and NOT")
+		return
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	p.Prev, p.Next = pageLinks(r.URL, p)
+	writeJSON(w, http.StatusOK, p)
+}
+
+// pageLinks returns the urls of the pages before and after p, nil at
+// either end.
+func pageLinks(u *url.URL, p searchPage) (*string, *string) {
+	link := func(page int) *string {
+		q := u.Query()
+		q.Set("page", strconv.Itoa(page))
+		l := u.Path + "?" + q.Encode()
+		return &l
+	}
+	var prev, next *string
+	// past the end, prev is the last page
+	if last := (p.Total + p.PageSize - 1) / p.PageSize; p.Page > last+1 {
+		if last > 0 {
+			prev = link(last)
+		}
+	} else if p.Page > 1 {
+		prev = link(p.Page - 1)
+	}
+	if p.Page*p.PageSize < p.Total {
+		next = link(p.Page + 1)
+	}
+	return prev, next
+}
+
+type searchHit struct {
+	id    int
+	score float64
+	// found only through the transliterated shadow
+	translit bool
+}
+
+// matchChunks returns the chunks of table matching q that sq's filter
+// keeps, searchCap+1 at most, by id.
+func matchChunks(db *sql.DB, table, q string, sq searchQuery) (map[int]searchHit, error) {
+	rows, err := db.Query(`SELECT c.id, matchinfo(`+table+`, 'pcnalx')
+		FROM `+table+` JOIN chunks c ON c.id = `+table+`.docid JOIN files f ON f.id = c.sourceid
+		WHERE `+table+` MATCH ? AND `+filterWhere+` LIMIT ?`,
+		append(append([]interface{}{q}, sq.filter.args()...), searchCap+1)...)
+	if err != nil {
+		return nil, ftsError(err)
+	}
+	defer rows.Close()
+	hits := map[int]searchHit{}
+	for rows.Next() {
+		var h searchHit
+		var info []byte
+		if err = rows.Scan(&h.id, &info); err != nil {
+			return nil, err
+		}
+		h.score = bm25(info)
+		hits[h.id] = h
+	}
+	return hits, ftsError(rows.Err())
+}
+
+// searchChunks searches the index, and its shadow if it has one with the
+// query transliterated, a chunk matching both scoring the better of its
+// scores.
+func searchChunks(db *sql.DB, sq searchQuery) (searchPage, error) {
+	p := searchPage{Query: sq.q, Page: sq.page, PageSize: sq.pageSize, Results: []searchResult{}}
+
+	found, err := matchChunks(db, "chunks_fts", sq.q, sq)
+	if err != nil {
+		return p, err
+	}
+	shadow, err := hasTranslit(db)
+	if err != nil {
+		return p, err
+	}
+	if shadow {
+		tq, _ := translit(sq.q)
+		more, err := matchChunks(db, "chunks_translit_fts", tq, sq)
+		if err != nil {
+			return p, err
+		}
+		for id, h := range more {
+			if f, ok := found[id]; !ok || h.score > f.score {
+				h.translit = !ok
+				found[id] = h
+			}
+		}
+	}
+	hits := make([]searchHit, 0, len(found))
+	for _, h := range found {
+		hits = append(hits, h)
+	}
+	if len(hits) > searchCap {
+		// the first searchCap in id order, as one table's alone would be
+		sort.Slice(hits, func(i, j int) bool { return hits[i].id < hits[j].id })
+		hits = hits[:searchCap]
+		p.TotalCapped = true
+	}
+	p.Total = len(hits)
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].score != hits[j].score {
+			return hits[i].score > hits[j].score
+		}
+		return hits[i].id < hits[j].id
+	})
+	from := (sq.page - 1) * sq.pageSize
+	if from >= len(hits) {
+		return p, nil
+	}
+	hits = hits[from:]
+	if len(hits) > sq.pageSize {
+		hits = hits[:sq.pageSize]
+	}
+
+	for _, h := range hits {
+		res := searchResult{ID: h.id, Score: math.Round(h.score*1000) / 1000}
+		// a chunk only the shadow matched is snippeted from it, in Latin
+		// letters
+		table, q := "chunks_fts", sq.q
+		if h.translit {
+			table = "chunks_translit_fts"
+			q, _ = translit(sq.q)
+		}
+		err = db.QueryRow(`SELECT snippet(`+table+`, ?, ?, '…', -1, ?), coalesce(f.name, ''), coalesce(f.author, '')
+			FROM `+table+` JOIN chunks c ON c.id = `+table+`.docid JOIN files f ON f.id = c.sourceid
+			WHERE `+table+` MATCH ? AND `+table+`.docid = ?`, sq.markStart, sq.markEnd, snippetTokens, q, h.id).
+			Scan(&res.Snippet, &res.Title, &res.Author)
+		if err != nil {
+			return p, ftsError(err)
+		}
+		p.Results = append(p.Results, res)
+	}
+	return p, nil
+}
+
+// ftsError turns sqlite's complaint about a query it can't parse into
+// errBadQuery.
+func ftsError(err error) error {
+	if err != nil && strings.Contains(err.Error(), "malformed MATCH expression") {
+		return fmt.Errorf("%w: %s", errBadQuery, strings.TrimPrefix(err.Error(), "malformed MATCH expression: "))
+	}
+	return err
+}
+
+// bm25 scores a match from FTS4's matchinfo 'pcnalx' blob, higher being
+// better. FTS4 has no ranking of its own. The blob is 32 bit unsigned
+// integers in the machine's byte order, little endian everywhere gutchunk
+// runs.
+func bm25(info []byte) float64 {
+	return weightedBM25(info, nil)
+}
+
+// weightedBM25 is bm25 with each phrase of the query's score multiplied by
+// its weight, weights missing counting 1.
+func weightedBM25(info []byte, weights []float64) float64 {
+	v := func(i int) float64 {
+		if 4*i+4 > len(info) {
+			return 0
+		}
+		return float64(binary.LittleEndian.Uint32(info[4*i:]))
+	}
+	phrases, cols, rows := int(v(0)), int(v(1)), v(2)
+	avg := 3
+	length := avg + cols
+	hits := length + cols
+
+	score := 0.0
+	for p := 0; p < phrases; p++ {
+		for c := 0; c < cols; c++ {
+			x := hits + 3*(p*cols+c)
+			tf, docs := v(x), v(x+2)
+			if tf == 0 {
+				continue
+			}
+			// smoothed so terms in most chunks still count for a little
+			idf := math.Log(1 + (rows-docs+0.5)/(docs+0.5))
+			norm := 1 - bm25B
+			if a := v(avg + c); a > 0 {
+				norm += bm25B * v(length+c) / a
+			}
+			w := 1.0
+			if p < len(weights) {
+				w = weights[p]
+			}
+			score += w * idf * tf * (bm25K1 + 1) / (tf + bm25K1*norm)
+		}
+	}
+	return score
+}
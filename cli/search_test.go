@@ -0,0 +1,140 @@
+package cli
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// searchLibrary is a served database of 25 chunks about whales, each
+// one's whales counted by its ordinal, and 5 about nothing much, indexed.
+func searchLibrary(t *testing.T) (*server, *sql.DB) {
+	t.Helper()
+	db := testDB(t)
+	id := addBook(t, db, "Moby-Dick", "Herman Melville", "")
+	for i := 0; i < 30; i++ {
+		c := fmt.Sprintf("Chunk %d went on about the sea, the ship and the weather for a while.", i)
+		if i < 25 {
+			c += strings.Repeat(" There was a whale.", 1+i%4)
+		}
+		insertChunk(t, db, id, i, c)
+	}
+	indexChunks(t, db)
+	return testServer(t, db), db
+}
+
+func getSearch(t *testing.T, s *server, query string) (*httptest.ResponseRecorder, searchPage) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/search?"+query, nil))
+	var p searchPage
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w, p
+}
+
+func TestSearchPages(t *testing.T) {
+	s, _ := searchLibrary(t)
+	seen := map[int]bool{}
+	last := 1e9
+	for page, want := range []int{10, 10, 5} {
+		w, p := getSearch(t, s, fmt.Sprintf("q=whale&page_size=10&page=%d", page+1))
+		if w.Code != http.StatusOK {
+			t.Fatalf("page %d: %d %s", page+1, w.Code, w.Body)
+		}
+		if p.Total != 25 || len(p.Results) != want {
+			t.Errorf("page %d: %d results of %d, want %d of 25", page+1, len(p.Results), p.Total, want)
+		}
+		for _, r := range p.Results {
+			if seen[r.ID] {
+				t.Errorf("chunk %d on page %d was on an earlier page", r.ID, page+1)
+			}
+			seen[r.ID] = true
+			if r.Score > last {
+				t.Errorf("chunk %d scores %v, more than the one before it", r.ID, r.Score)
+			}
+			last = r.Score
+		}
+		if (p.Prev == nil) != (page == 0) || (p.Next == nil) != (page == 2) {
+			t.Errorf("page %d links back %v and on %v", page+1, p.Prev != nil, p.Next != nil)
+		}
+		if p.Next != nil {
+			u, err := url.Parse(*p.Next)
+			if err != nil || u.Path != "/search" || u.Query().Get("page") != fmt.Sprint(page+2) || u.Query().Get("page_size") != "10" {
+				t.Errorf("page %d links on to %s", page+1, *p.Next)
+			}
+		}
+	}
+	if len(seen) != 25 {
+		t.Errorf("the pages held %d chunks, want all 25 matching", len(seen))
+	}
+
+	// past the end is empty, linking back to the last page
+	w, p := getSearch(t, s, "q=whale&page_size=10&page=7")
+	if w.Code != http.StatusOK || len(p.Results) != 0 || p.Next != nil || p.Prev == nil || !strings.Contains(*p.Prev, "page=3") {
+		t.Errorf("past the last page: %d %s", w.Code, w.Body)
+	}
+	// a page exactly filled has nothing after it
+	if _, p = getSearch(t, s, "q=whale&page_size=5&page=5"); len(p.Results) != 5 || p.Next != nil {
+		t.Errorf("the last page, full: %d results, next %v", len(p.Results), p.Next)
+	}
+	// nothing matching is a page of none, not an error
+	if w, p = getSearch(t, s, "q=narwhal"); w.Code != http.StatusOK || p.Total != 0 || p.Prev != nil || p.Next != nil {
+		t.Errorf("no matches: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestSearchBadRequests(t *testing.T) {
+	s, db := searchLibrary(t)
+	for _, c := range []struct {
+		query, want string
+	}{
+		{"", "no q"},
+		{"q=whale&page=0", "bad page"},
+		{"q=whale&page_size=0", "page_size must be"},
+		{"q=whale&page_size=101", "page_size must be"},
+		{"q=%22a+whale", "unbalanced quotes"},
+		{"q=whale+AND+(ship", "check quotes, parentheses and operators"},
+		{"q=whale&mark_start=" + strings.Repeat("x", 33), "snippet markers"},
+	} {
+		w, _ := getSearch(t, s, c.query)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), c.want) {
+			t.Errorf("%q: %d %s, want 400 saying %s", c.query, w.Code, w.Body, c.want)
+		}
+	}
+
+	// without the index there is nothing to search
+	if _, err := db.Exec("DROP TABLE chunks_fts"); err != nil {
+		t.Fatal(err)
+	}
+	if w, _ := getSearch(t, s, "q=whale"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("without an index: %d %s, want 503", w.Code, w.Body)
+	}
+}
+
+func TestSearchSnippetMarkers(t *testing.T) {
+	s, _ := searchLibrary(t)
+	for _, c := range []struct {
+		query, want string
+	}{
+		{"q=whale&page_size=1", "<mark>whale</mark>"},
+		{"q=whale&page_size=1&mark_start=%5B%5B&mark_end=%5D%5D", "[[whale]]"},
+		{"q=whale&page_size=1&mark_start=&mark_end=", "a whale."},
+	} {
+		w, p := getSearch(t, s, c.query)
+		if w.Code != http.StatusOK || len(p.Results) != 1 {
+			t.Fatalf("%q: %d %s", c.query, w.Code, w.Body)
+		}
+		if r := p.Results[0]; !strings.Contains(r.Snippet, c.want) || r.Title != "Moby-Dick" {
+			t.Errorf("%q: snippet %q of %s, want it to hold %s", c.query, r.Snippet, r.Title, c.want)
+		}
+	}
+}
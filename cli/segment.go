@@ -0,0 +1,211 @@
+package cli
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Chinese and Japanese put no space between words, nor after the end of a
+// sentence: 。, ！ or ？ ends one and the next begins straight after it,
+// and a word is a character or two. Splitting on whitespace, as the rest
+// of gutchunk does, takes a paragraph of either for one sentence of one
+// word. Each place that counts sentences or words — export --max-tokens
+// splitting, truncate and truncate-sentences, random --min-words and
+// --max-words — segments a text by its Script instead: that of its book's
+// language where it is one gutchunk knows, and otherwise that most of the
+// text's letters are in. chunk --max-chunk counts runes for a book in the
+// CJK script rather than bytes, which come three to a character. Korean
+// is written with spaces between words and counts as spaced.
+
+// Script is how a text marks its words and sentences.
+type Script int
+
+const (
+	// ScriptSpaced puts whitespace between words and after sentences.
+	ScriptSpaced Script = iota
+	// ScriptCJK is Chinese and Japanese: each Han, Hiragana or Katakana
+	// character counts as a word, a run of other letters or digits as one,
+	// and a sentence ends at 。！？ or their kin whatever follows.
+	ScriptCJK
+)
+
+func (s Script) String() string {
+	if s == ScriptCJK {
+		return "cjk"
+	}
+	return "spaced"
+}
+
+// Joiner is what goes between a text's sentences, or words, put back
+// together.
+func (s Script) Joiner() string {
+	if s == ScriptCJK {
+		return ""
+	}
+	return " "
+}
+
+// cjkLanguages are the languages written in ScriptCJK.
+var cjkLanguages = map[string]bool{"zh": true, "ja": true}
+
+// the language codes of cjkLanguages for SQL
+const cjkLanguageCodes = "'zh', 'ja'"
+
+// ScriptOf is the script of text in language, a language column: the
+// language's, by its first code, if gutchunk knows it, the script of the
+// text's letters otherwise.
+func ScriptOf(language, text string) Script {
+	code, _, _ := strings.Cut(language, ",")
+	if cjkLanguages[code] {
+		return ScriptCJK
+	}
+	if code != "" && code != "und" && knownLanguages(code) {
+		return ScriptSpaced
+	}
+	return DetectScript(text)
+}
+
+// scriptSample is how much of a text DetectScript reads.
+const scriptSample = 4096
+
+// DetectScript is ScriptCJK when most of the letters of text are Han,
+// Hiragana or Katakana, and ScriptSpaced otherwise. Of a long text it reads
+// the middle, away from a Project Gutenberg header and license in English.
+func DetectScript(text string) Script {
+	if len(text) > scriptSample {
+		from := (len(text) - scriptSample) / 2
+		text = text[from : from+scriptSample]
+	}
+	letters, wide := 0, 0
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		if isWide(r) {
+			wide++
+		}
+	}
+	if wide*2 > letters {
+		return ScriptCJK
+	}
+	return ScriptSpaced
+}
+
+// isWide is whether r is a character ScriptCJK counts as a word by itself.
+func isWide(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana)
+}
+
+var sentenceEnd = regexp.MustCompile(`[.!?]+["'’”)\]]*\s+`)
+
+// a sentence end in ScriptCJK: the ideographic and full-width stops and
+// marks, the closing brackets after them and any space, or a spaced
+// sentence end, for a quotation or a number in the text
+var cjkSentenceEnd = regexp.MustCompile(`[。｡．！？]+[」』）】〕〉》”’"')\]]*\s*|[.!?]+["'’”)\]]*\s+`)
+
+// SentenceEnds are the byte ranges of the first n sentence ends of text,
+// all of them for n < 0, each its punctuation and what follows it up to
+// the next sentence.
+func SentenceEnds(text string, s Script, n int) [][]int {
+	if s == ScriptCJK {
+		return cjkSentenceEnd.FindAllStringIndex(text, n)
+	}
+	return sentenceEnd.FindAllStringIndex(text, n)
+}
+
+// Sentences splits text after each sentence end, trimming each sentence
+// of the whitespace around it.
+func Sentences(text string, s Script) []string {
+	out := []string{}
+	last := 0
+	for _, m := range SentenceEnds(text, s, -1) {
+		if sen := strings.TrimSpace(text[last:m[1]]); sen != "" {
+			out = append(out, sen)
+		}
+		last = m[1]
+	}
+	if rest := strings.TrimSpace(text[last:]); rest != "" {
+		out = append(out, rest)
+	}
+	return out
+}
+
+// WordSpans are the byte ranges of the words of text: in ScriptSpaced the
+// runs between whitespace as strings.Fields has them, and in ScriptCJK
+// each wide character and each run of other letters, digits and marks,
+// the punctuation between them counting as no word.
+func WordSpans(text string, s Script) [][2]int {
+	spans := [][2]int{}
+	start := -1
+	end := func(i int) {
+		if start >= 0 {
+			spans = append(spans, [2]int{start, i})
+			start = -1
+		}
+	}
+	for i, r := range text {
+		switch {
+		case unicode.IsSpace(r):
+			end(i)
+		case s == ScriptSpaced:
+			if start < 0 {
+				start = i
+			}
+		case isWide(r):
+			end(i)
+			spans = append(spans, [2]int{i, i + utf8.RuneLen(r)})
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r):
+			if start < 0 {
+				start = i
+			}
+		default:
+			end(i)
+		}
+	}
+	end(len(text))
+	return spans
+}
+
+// WordCount is how many words text has.
+func WordCount(text string, s Script) int {
+	return len(WordSpans(text, s))
+}
+
+// wordPieces cuts text before each of its words, so that each piece is a
+// word and the punctuation after it, trimmed of whitespace, and joining
+// them with s.Joiner gives text back but for its spacing.
+func wordPieces(text string, s Script) []string {
+	if s == ScriptSpaced {
+		return strings.Fields(text)
+	}
+	spans := WordSpans(text, s)
+	if len(spans) == 0 {
+		return strings.Fields(text)
+	}
+	pieces := []string{}
+	for i, sp := range spans {
+		start, end := sp[0], len(text)
+		if i == 0 {
+			start = 0
+		}
+		if i+1 < len(spans) {
+			end = spans[i+1][0]
+		}
+		if p := strings.TrimSpace(text[start:end]); p != "" {
+			pieces = append(pieces, p)
+		}
+	}
+	return pieces
+}
+
+// chunkSize is the size of chunk as --max-chunk measures it: runes in
+// ScriptCJK, bytes otherwise.
+func chunkSize(chunk string, s Script) int {
+	if s == ScriptCJK {
+		return utf8.RuneCountInString(chunk)
+	}
+	return len(chunk)
+}
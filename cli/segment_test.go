@@ -0,0 +1,213 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// the first sentences of The Romance of the Three Kingdoms and I Am a Cat
+const (
+	zhText = "话说天下大势，分久必合，合久必分。周末七国分争，并入于秦！及秦灭之后，楚、汉分争，又并入于汉？汉朝自高祖斩白蛇而起义，一统天下。"
+	jaText = "「吾輩は猫である。」名前はまだ無い。どこで生れたかとんと見当がつかぬ！何でも薄暗いじめじめした所でニャーニャー泣いていた事だけは記憶している。"
+)
+
+func TestScriptOf(t *testing.T) {
+	english := strings.Repeat("The Project Gutenberg eBook, in English. ", 80)
+	for _, c := range []struct {
+		language, text string
+		want           Script
+	}{
+		{"zh", "", ScriptCJK},
+		{"ja,en", english, ScriptCJK},
+		// known languages go by their code, whatever the text
+		{"en", zhText, ScriptSpaced},
+		{"ko", "나는 학교에 간다.", ScriptSpaced},
+		{"en,zh", zhText, ScriptSpaced},
+		// the rest by most of their letters
+		{"", zhText, ScriptCJK},
+		{"und", jaText, ScriptCJK},
+		{"xx", zhText, ScriptCJK},
+		{"", "Tokyo, 東京.", ScriptSpaced},
+		{"", "", ScriptSpaced},
+		// of a long text, the middle, past an English header
+		{"", english + strings.Repeat(zhText, 20) + english, ScriptCJK},
+	} {
+		if got := ScriptOf(c.language, c.text); got != c.want {
+			t.Errorf("ScriptOf(%q, %.20q) = %s, want %s", c.language, c.text, got, c.want)
+		}
+	}
+}
+
+func TestSentences(t *testing.T) {
+	for _, c := range []struct {
+		text   string
+		script Script
+		want   []string
+	}{
+		{zhText, ScriptCJK, []string{"话说天下大势，分久必合，合久必分。", "周末七国分争，并入于秦！", "及秦灭之后，楚、汉分争，又并入于汉？", "汉朝自高祖斩白蛇而起义，一统天下。"}},
+		// the closing bracket goes with its sentence
+		{jaText, ScriptCJK, []string{"「吾輩は猫である。」", "名前はまだ無い。", "どこで生れたかとんと見当がつかぬ！", "何でも薄暗いじめじめした所でニャーニャー泣いていた事だけは記憶している。"}},
+		{"東京はTokyoです。 2024年に来た．", ScriptCJK, []string{"東京はTokyoです。", "2024年に来た．"}},
+		// a point in a number ends nothing, nor one in English unspaced
+		{"圆周率是3.14左右。他说：“Mr.Li来了。”", ScriptCJK, []string{"圆周率是3.14左右。", "他说：“Mr.Li来了。”"}},
+		{"It was late. \"Go!\" she said. He went", ScriptSpaced, []string{"It was late.", "\"Go!\"", "she said.", "He went"}},
+		// spaced, Chinese is one sentence
+		{zhText, ScriptSpaced, []string{zhText}},
+		{"", ScriptCJK, []string{}},
+	} {
+		if got := Sentences(c.text, c.script); strings.Join(got, "|") != strings.Join(c.want, "|") || len(got) != len(c.want) {
+			t.Errorf("Sentences(%q, %s) = %q, want %q", c.text, c.script, got, c.want)
+		}
+	}
+}
+
+func TestWordCount(t *testing.T) {
+	for _, c := range []struct {
+		text   string
+		script Script
+		want   int
+	}{
+		// a character a word, punctuation none
+		{zhText, ScriptCJK, 53},
+		{jaText, ScriptCJK, 65},
+		// a run of Latin letters or digits one
+		{"東京はTokyoです。2024年に来た。", ScriptCJK, 11},
+		{"ソウル、서울。", ScriptCJK, 4},
+		{"It was a dark and stormy night.", ScriptSpaced, 7},
+		{"나는 학교에 간다.", ScriptSpaced, 3},
+		{zhText, ScriptSpaced, 1},
+		{"。！", ScriptCJK, 0},
+	} {
+		if got := WordCount(c.text, c.script); got != c.want {
+			t.Errorf("WordCount(%q, %s) = %d, want %d", c.text, c.script, got, c.want)
+		}
+	}
+	// cut into words and put back, it is the text
+	for _, text := range []string{zhText, jaText, "東京はTokyoです。 2024年に来た。"} {
+		pieces := wordPieces(text, ScriptCJK)
+		if len(pieces) != WordCount(text, ScriptCJK) || strings.Join(pieces, ScriptCJK.Joiner()) != strings.ReplaceAll(text, " ", "") {
+			t.Errorf("wordPieces(%q) = %q", text, pieces)
+		}
+	}
+	if got := wordPieces("It was  late.", ScriptSpaced); strings.Join(got, ScriptSpaced.Joiner()) != "It was late." {
+		t.Errorf("spaced, wordPieces gave %q", got)
+	}
+}
+
+func TestTruncateCJK(t *testing.T) {
+	for _, c := range []struct {
+		text  string
+		limit int
+		unit  truncUnit
+		want  string
+	}{
+		{zhText, 10, unitWord, "话说天下大势，分久必合…"},
+		{zhText, 2, unitSentence, "话说天下大势，分久必合，合久必分。周末七国分争，并入于秦！…"},
+		{zhText, 10, unitRune, "话说天下大势，分久…"},
+		// back to a sentence that ends within the limit
+		{zhText, 20, unitRune, "话说天下大势，分久必合，合久必分。…"},
+		{jaText, 3, unitSentence, "「吾輩は猫である。」名前はまだ無い。どこで生れたかとんと見当がつかぬ！…"},
+		{jaText, 6, unitWord, "「吾輩は猫であ…"},
+		// a Latin word in it is not cut
+		{"東京はTokyoですね。", 5, unitRune, "東京は…"},
+		{zhText, 4, unitSentence, zhText},
+	} {
+		if got := truncateAtBoundary(c.text, c.limit, c.unit, "…"); got != c.want {
+			t.Errorf("truncating %.12q to %d %v gave %q, want %q", c.text, c.limit, c.unit, got, c.want)
+		}
+	}
+	f, err := truncateSentences("3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := f(jaText); got != "「吾輩は猫である。」名前はまだ無い。どこで生れたかとんと見当がつかぬ！" {
+		t.Errorf("truncate-sentences:3 gave %q", got)
+	}
+}
+
+func TestCJKChunks(t *testing.T) {
+	db := testDB(t)
+	// a paragraph of ten lines of the Chinese, 650 characters and three
+	// times as many bytes, and one of a sentence
+	para := strings.Repeat(zhText+"\n", 10)
+	short := "话说天下大势，分久必合，合久必分。周末七国分争，并入于秦！"
+	zh := addBook(t, db, "三国演义", "罗贯中", testBook("San Guo", para+"\n"+short+"\n\nEnd."))
+	en := addBook(t, db, "Emma", "Jane Austen", testBook("Emma", testParagraphs(2)))
+	if _, err := db.Exec("UPDATE files SET language = CASE id WHEN ? THEN 'zh' ELSE 'en' END", zh); err != nil {
+		t.Fatal(err)
+	}
+	chunks := func(book int) []string {
+		t.Helper()
+		return strings.Split(strings.TrimSuffix(names(t, db, fmt.Sprint("SELECT chunk FROM chunks WHERE sourceid = ", book, " ORDER BY ordinal")), "\n"), "\n")
+	}
+	if _, err := captureStdout(t, func() error { return chunkCmd([]string{"--max-chunk", "200", "--min-chunk", "150"}) }); err != nil {
+		t.Fatal(err)
+	}
+	// --max-chunk counts characters, cutting after the line it reaches
+	// them in, four lines a chunk and two left; the sentence of 29
+	// characters, 87 bytes, is under zh's least size
+	got := chunks(zh)
+	if len(got) != 3 {
+		t.Fatalf("chunked at --max-chunk 200, the Chinese is %d chunks:\n%s", len(got), strings.Join(got, "\n"))
+	}
+	line := utf8.RuneCountInString(zhText) + 1
+	for i, c := range got[:2] {
+		if n := utf8.RuneCountInString(c); n < 200 || n > 200+line {
+			t.Errorf("chunk %d of the Chinese is %d characters", i, n)
+		}
+	}
+	if got := chunks(en); len(got) != 2 {
+		t.Errorf("chunked at --max-chunk 200, Emma is %d chunks", len(got))
+	}
+
+	// random counts their words as characters
+	if _, err := db.Exec("DELETE FROM chunks"); err != nil {
+		t.Fatal(err)
+	}
+	insertChunk(t, db, zh, 0, zhText)
+	insertChunk(t, db, en, 0, "It was a dark and stormy night, the rain falling in torrents.")
+	var sqlWords int
+	if err := db.QueryRow("SELECT "+chunkWords+" FROM chunks c JOIN files f ON f.id = c.sourceid WHERE f.id = ?", zh).Scan(&sqlWords); err != nil || sqlWords != WordCount(zhText, ScriptCJK) {
+		t.Errorf("in SQL the Chinese is %d words (%v), and %d by WordCount", sqlWords, err, WordCount(zhText, ScriptCJK))
+	}
+	for _, c := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--min-words", "50"}, "话说天下"},
+		{[]string{"--max-words", "20"}, "It was a dark"},
+		{[]string{"--min-words", "13", "--max-words", "60"}, "话说天下"},
+	} {
+		for i := 0; i < 5; i++ {
+			out, err := captureStdout(t, func() error { return randomCmd(append([]string{"--width", "0"}, c.args...)) })
+			if err != nil || !strings.HasPrefix(out, c.want) {
+				t.Errorf("random %s drew %q (%v)", strings.Join(c.args, " "), out, err)
+				break
+			}
+		}
+	}
+
+	// export splits them between sentences, joined with no space
+	var parts []string
+	for _, line := range exported(t, "--max-tokens", "30") {
+		var r exportRecord
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatal(err)
+		}
+		if r.SourceID == zh {
+			parts = append(parts, r.Text)
+		}
+	}
+	if len(parts) < 2 || strings.Join(parts, "") != zhText {
+		t.Fatalf("export --max-tokens 30 split the Chinese into %q", parts)
+	}
+	for _, p := range parts {
+		if !strings.ContainsAny(p[len(p)-3:], "。！？") {
+			t.Errorf("export --max-tokens 30 cut the Chinese within a sentence: %q", parts)
+			break
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package cli
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The catalog gives some ebooks a series, as its marc440 field, like "The
+// Barsetshire Chronicles ; 2", and a place in it when the value ends in a
+// number. gutchunk catalog keeps them in the series table, by ebook, and
+// gutchunk series load adds the series and series-position of an
+// overrides file for the books the catalog has none for or misplaces: a
+// book's override goes before what the catalog says of it in the same
+// series. series list and show read them, books and GET /books/{id} give
+// each book's, and the html book page links the books before and after it
+// in the library. random --series keeps to one series' books.
+
+const (
+	seriesCatalog  = "catalog"
+	seriesOverride = "override"
+)
+
+// seriesRows are the series table's rows less the catalog's where an
+// override places the same book in the same series.
+const seriesRows = `(SELECT ebook, name, position FROM series s
+	WHERE source = 'override' OR NOT EXISTS (SELECT 1 FROM series o
+		WHERE o.source = 'override' AND o.ebook = s.ebook AND o.name = s.name))`
+
+// seriesBook is a book of a series: the current book in the library with
+// its ebook number, or with ID 0 one the catalog names that isn't.
+type seriesBook struct {
+	ID       int    `json:"id,omitempty"`
+	Ebook    int    `json:"ebook"`
+	Title    string `json:"title"`
+	Author   string `json:"author"`
+	Position *int   `json:"position"`
+}
+
+// seriesPlace is where a book is in one series: its position, nil when
+// neither the catalog nor an override gives one, and the books of the
+// library before and after it, nil for none.
+type seriesPlace struct {
+	Name     string      `json:"name"`
+	Position *int        `json:"position"`
+	Previous *seriesBook `json:"previous,omitempty"`
+	Next     *seriesBook `json:"next,omitempty"`
+}
+
+// String is p as the books table gives it: "The Barsetshire Chronicles
+// #2".
+func (p seriesPlace) String() string {
+	if p.Position == nil {
+		return p.Name
+	}
+	return fmt.Sprintf("%s #%d", p.Name, *p.Position)
+}
+
+// catalogSeries is a series one catalog record places its ebook in.
+type catalogSeries struct {
+	name     string
+	position sql.NullInt64
+}
+
+// how a marc440 value gives the place in the series after its name: "; 2",
+// ", Book 2", " Vol. 2", " #2"
+var (
+	seriesNumbered = regexp.MustCompile(`(?i)^(.+?)\s*[;,]\s*(?:(?:book|bk|no|number|vol|volume|part|pt)\.?\s*|#\s*)?(\d+)\.?$`)
+	seriesWorded   = regexp.MustCompile(`(?i)^(.+?)\s+(?:(?:book|no|number|vol|volume|part)\.?\s*|#\s*)(\d+)\.?$`)
+)
+
+// parseSeries reads a marc440 value.
+func parseSeries(value string) (catalogSeries, bool) {
+	value = strings.Join(strings.Fields(value), " ")
+	for _, re := range []*regexp.Regexp{seriesNumbered, seriesWorded} {
+		if m := re.FindStringSubmatch(value); m != nil {
+			n, _ := strconv.ParseInt(m[2], 10, 64)
+			return catalogSeries{strings.TrimRight(m[1], " ,;:."), sql.NullInt64{Int64: n, Valid: true}}, true
+		}
+	}
+	value = strings.TrimRight(value, " ,;:.")
+	return catalogSeries{name: value}, value != ""
+}
+
+// saveCatalogSeries replaces what the catalog said before of the series of
+// the ebooks in recs, returning the places it keeps.
+func saveCatalogSeries(tx *sql.Tx, recs []catalogAuthor) (int, error) {
+	n := 0
+	for _, a := range recs {
+		if _, err := tx.Exec("DELETE FROM series WHERE ebook = ? AND source = ?", a.ebook, seriesCatalog); err != nil {
+			return n, err
+		}
+		for _, s := range a.series {
+			if _, err := tx.Exec("INSERT OR REPLACE INTO series (ebook, name, position, source) VALUES (?, ?, ?, ?)",
+				a.ebook, s.name, s.position, seriesCatalog); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+// seriesMembers are the books of the series name in order, those without
+// a position last.
+func seriesMembers(db *sql.DB, name string) ([]seriesBook, error) {
+	rows, err := db.Query(`SELECT s.ebook, s.position, coalesce(f.id, 0), coalesce(f.name, c.title, ''), coalesce(f.author, c.author, '')
+		FROM `+seriesRows+` s
+			LEFT JOIN files f ON f.id = (SELECT min(id) FROM files WHERE ebook = s.ebook AND deleted_at IS NULL AND superseded_by IS NULL)
+			LEFT JOIN catalog c ON c.ebook = s.ebook
+		WHERE s.name = ? ORDER BY s.position IS NULL, s.position, s.ebook`, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	books := []seriesBook{}
+	for rows.Next() {
+		var b seriesBook
+		var pos sql.NullInt64
+		if err = rows.Scan(&b.Ebook, &pos, &b.ID, &b.Title, &b.Author); err != nil {
+			return nil, err
+		}
+		b.Position = nullableInt(pos)
+		books = append(books, b)
+	}
+	return books, rows.Err()
+}
+
+// bookSeries is where the book with ebook number ebook is in each of its
+// series, by name.
+func bookSeries(db *sql.DB, ebook int) ([]seriesPlace, error) {
+	places := []seriesPlace{}
+	if ebook == 0 {
+		return places, nil
+	}
+	rows, err := db.Query("SELECT name, position FROM "+seriesRows+" s WHERE ebook = ? ORDER BY name", ebook)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var p seriesPlace
+		var pos sql.NullInt64
+		if err = rows.Scan(&p.Name, &pos); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		p.Position = nullableInt(pos)
+		places = append(places, p)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for i, p := range places {
+		if p.Position == nil {
+			continue
+		}
+		members, err := seriesMembers(db, p.Name)
+		if err != nil {
+			return nil, err
+		}
+		places[i].Previous, places[i].Next = seriesNeighbours(members, ebook, *p.Position)
+	}
+	return places, nil
+}
+
+// seriesNeighbours are the books of members in the library nearest before
+// and after position that aren't ebook.
+func seriesNeighbours(members []seriesBook, ebook, position int) (prev, next *seriesBook) {
+	for i := range members {
+		b := &members[i]
+		if b.ID == 0 || b.Position == nil || b.Ebook == ebook {
+			continue
+		}
+		if *b.Position < position {
+			prev = b
+		} else if *b.Position > position && next == nil {
+			next = b
+		}
+	}
+	return prev, next
+}
+
+func seriesCmd(args []string) error {
+	if len(args) == 0 {
+		return usagef("usage: gutchunk series list|show|load")
+	}
+	switch args[0] {
+	case "list":
+		return seriesListCmd(args[1:])
+	case "show":
+		return seriesShowCmd(args[1:])
+	case "load":
+		return seriesLoadCmd(args[1:])
+	}
+	return usagef("unknown series command %q; want list, show or load", args[0])
+}
+
+type seriesSummary struct {
+	Name string `json:"name"`
+	// the books the catalog and overrides place in it, those of them in
+	// the library, and those with a position
+	Books      int `json:"books"`
+	InLibrary  int `json:"in_library"`
+	Positioned int `json:"positioned"`
+}
+
+func seriesListCmd(args []string) error {
+	fs := flag.NewFlagSet("series list", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the series as json")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return usagef("usage: gutchunk series list [--json]")
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT min(s.name), count(*),
+			count(CASE WHEN EXISTS (SELECT 1 FROM files f WHERE f.ebook = s.ebook AND f.deleted_at IS NULL AND f.superseded_by IS NULL) THEN 1 END),
+			count(s.position)
+		FROM ` + seriesRows + ` s GROUP BY s.name ORDER BY s.name`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	list := []seriesSummary{}
+	for rows.Next() {
+		var s seriesSummary
+		if err = rows.Scan(&s.Name, &s.Books, &s.InLibrary, &s.Positioned); err != nil {
+			return err
+		}
+		list = append(list, s)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return json.NewEncoder(os.Stdout).Encode(list)
+	}
+	if len(list) == 0 {
+		fmt.Fprintln(os.Stderr, "no series; gutchunk catalog reads them from the catalog")
+		return nil
+	}
+	fmt.Printf("%6s %8s %8s  %s\n", "books", "present", "placed", "series")
+	for _, s := range list {
+		fmt.Printf("%6d %8d %8d  %s\n", s.Books, s.InLibrary, s.Positioned, s.Name)
+	}
+	return nil
+}
+
+func seriesShowCmd(args []string) error {
+	fs := flag.NewFlagSet("series show", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the books as json")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return usagef("usage: gutchunk series show [--json] NAME")
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	books, err := seriesMembers(db, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if len(books) == 0 {
+		return fmt.Errorf("no series %q; see gutchunk series list", fs.Arg(0))
+	}
+	if *asJSON {
+		return json.NewEncoder(os.Stdout).Encode(books)
+	}
+	for _, b := range books {
+		pos, id := "-", "(not in the library)"
+		if b.Position != nil {
+			pos = strconv.Itoa(*b.Position)
+		}
+		if b.ID != 0 {
+			id = "book " + strconv.Itoa(b.ID)
+		}
+		title := b.Title
+		if b.Author != "" {
+			title += " / " + b.Author
+		}
+		fmt.Printf("%4s  ebook %-6d %s  %s\n", pos, b.Ebook, title, id)
+	}
+	return nil
+}
+
+func seriesLoadCmd(args []string) error {
+	fs := flag.NewFlagSet("series load", flag.ExitOnError)
+	loadOverrides := overridesFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return usagef("usage: gutchunk series load --overrides FILE")
+	}
+	ovr, err := loadOverrides()
+	if err != nil {
+		return err
+	}
+	if ovr == nil {
+		return usagef("--overrides is required")
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// the file is the whole of the overrides; one taken out of it goes
+	if _, err = tx.Exec("DELETE FROM series WHERE source = ?", seriesOverride); err != nil {
+		return err
+	}
+	loaded := 0
+	add := func(ebook int, x *bookOverride) error {
+		var pos sql.NullInt64
+		if x.seriesPosition > 0 {
+			pos = sql.NullInt64{Int64: int64(x.seriesPosition), Valid: true}
+		}
+		_, err := tx.Exec("INSERT OR REPLACE INTO series (ebook, name, position, source) VALUES (?, ?, ?, ?)", ebook, x.series, pos, seriesOverride)
+		loaded++
+		return err
+	}
+	for ebook, x := range ovr.ebooks {
+		if x.series == "" {
+			continue
+		}
+		if err = add(ebook, x); err != nil {
+			return err
+		}
+	}
+	for name, x := range ovr.files {
+		if x.series == "" {
+			continue
+		}
+		// series go by ebook number, which the book the file names has to
+		// have
+		var ebook sql.NullInt64
+		err := tx.QueryRow(`SELECT max(ebook) FROM files WHERE deleted_at IS NULL AND (filename = ? OR filename LIKE '%/' || ?)`, name, name).Scan(&ebook)
+		if err != nil {
+			return err
+		}
+		if !ebook.Valid || ebook.Int64 == 0 {
+			fmt.Fprintf(os.Stderr, "%s: no book with an ebook number has the filename %q; its series is left out\n", x.name, name)
+			continue
+		}
+		if err = add(int(ebook.Int64), x); err != nil {
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	fmt.Printf("loaded the series of %d books from the overrides\n", loaded)
+	return nil
+}
@@ -0,0 +1,266 @@
+package cli
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSeries(t *testing.T) {
+	for value, want := range map[string]string{
+		"Chronicles of Barsetshire ; 2":      "Chronicles of Barsetshire #2",
+		"Chronicles of Barsetshire, Book 2":  "Chronicles of Barsetshire #2",
+		"Chronicles of Barsetshire ; no. 2.": "Chronicles of Barsetshire #2",
+		"Chronicles of Barsetshire Vol. 2":   "Chronicles of Barsetshire #2",
+		"Chronicles of Barsetshire #2":       "Chronicles of Barsetshire #2",
+		"Chronicles of  Barsetshire\n; 2":    "Chronicles of Barsetshire #2",
+		"Chronicles of Barsetshire.":         "Chronicles of Barsetshire",
+		// a number in the name isn't a position
+		"Tales of 1001 Nights":  "Tales of 1001 Nights",
+		"Catch-22":              "Catch-22",
+		"The Oz Books, Book 14": "The Oz Books #14",
+	} {
+		s, ok := parseSeries(value)
+		got := seriesPlace{Name: s.name, Position: nullableInt(s.position)}.String()
+		if !ok || got != want {
+			t.Errorf("parseSeries(%q) = %q, %v, want %q", value, got, ok, want)
+		}
+	}
+	if _, ok := parseSeries(" ; "); ok {
+		t.Error(`parseSeries(" ; ") gave a series`)
+	}
+}
+
+// seriesBooks are the Barsetshire novels, by ebook, as the catalog places
+// them, and whether the library has each.
+var seriesBooks = []struct {
+	ebook        int
+	title, marc  string
+	inLibrary    bool
+	secondSeries string
+}{
+	{3166, "The Warden", "Chronicles of Barsetshire ; 1", true, "Trollope's Novels ; 3"},
+	{3409, "Barchester Towers", "Chronicles of Barsetshire, Book 2", true, ""},
+	{3412, "Doctor Thorne", "Chronicles of Barsetshire no. 3", true, ""},
+	{2160, "Framley Parsonage", "Chronicles of Barsetshire ; 4", false, ""},
+	{5000, "The Small House at Allington", "Chronicles of Barsetshire", true, ""},
+	{1342, "Pride and Prejudice", "", true, ""},
+}
+
+// seriesLibrary is a database of seriesBooks' books in the library, a
+// chunk each, the catalog read from a gzipped tar of their RDF.
+func seriesLibrary(t *testing.T) (*sql.DB, map[int]int) {
+	t.Helper()
+	db := testDB(t)
+	rdfs := map[int]string{}
+	ids := map[int]int{}
+	for _, b := range seriesBooks {
+		if b.inLibrary {
+			id := addBook(t, db, b.title, "Anthony Trollope", testParagraphs(1))
+			if _, err := db.Exec("UPDATE files SET ebook = ? WHERE id = ?", b.ebook, id); err != nil {
+				t.Fatal(err)
+			}
+			insertChunk(t, db, id, 0, "A chunk of "+b.title+".")
+			ids[b.ebook] = id
+		}
+		rdf := catalogRDF(b.ebook, b.title, "Trollope, Anthony", "1815", "1882")
+		for _, m := range []string{b.marc, b.secondSeries} {
+			if m != "" {
+				rdf = strings.Replace(rdf, "</dcterms:title>", "</dcterms:title>\n    <pgterms:marc440>"+m+"</pgterms:marc440>", 1)
+			}
+		}
+		rdfs[b.ebook] = rdf
+	}
+	out, err := captureStdout(t, func() error { return catalogCmd([]string{writeCatalog(t, rdfs)}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "6 of them are in series (see gutchunk series list)\n") {
+		t.Errorf("catalog printed\n%s", out)
+	}
+	return db, ids
+}
+
+func TestSeries(t *testing.T) {
+	db, ids := seriesLibrary(t)
+	show := func(args ...string) (string, error) {
+		t.Helper()
+		return captureStdout(t, func() error { return seriesCmd(append([]string{"show"}, args...)) })
+	}
+	out, err := show("chronicles of barsetshire")
+	if want := strings.Join([]string{
+		fmt.Sprintf("   1  ebook 3166   The Warden / Anthony Trollope  book %d", ids[3166]),
+		fmt.Sprintf("   2  ebook 3409   Barchester Towers / Anthony Trollope  book %d", ids[3409]),
+		fmt.Sprintf("   3  ebook 3412   Doctor Thorne / Anthony Trollope  book %d", ids[3412]),
+		"   4  ebook 2160   Framley Parsonage / Trollope, Anthony  (not in the library)",
+		fmt.Sprintf("   -  ebook 5000   The Small House at Allington / Anthony Trollope  book %d", ids[5000]),
+	}, "\n") + "\n"; err != nil || out != want {
+		t.Errorf("series show: %v\n%s", err, lineDiff(want, out))
+	}
+	out, err = captureStdout(t, func() error { return seriesCmd([]string{"list"}) })
+	if want := "" +
+		" books  present   placed  series\n" +
+		"     5        4        4  Chronicles of Barsetshire\n" +
+		"     1        1        1  Trollope's Novels\n"; err != nil || out != want {
+		t.Errorf("series list: %v\n%s", err, lineDiff(want, out))
+	}
+
+	// the next and previous books are those of the library
+	next := func(ebook int) string {
+		t.Helper()
+		places, err := bookSeries(db, ebook)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var s []string
+		for _, p := range places {
+			line := p.String()
+			if p.Previous != nil {
+				line += " after " + p.Previous.Title
+			}
+			if p.Next != nil {
+				line += " before " + p.Next.Title
+			}
+			s = append(s, line)
+		}
+		return strings.Join(s, "; ")
+	}
+	for ebook, want := range map[int]string{
+		3166: "Chronicles of Barsetshire #1 before Barchester Towers; Trollope's Novels #3",
+		3409: "Chronicles of Barsetshire #2 after The Warden before Doctor Thorne",
+		3412: "Chronicles of Barsetshire #3 after Barchester Towers",
+		5000: "Chronicles of Barsetshire",
+		1342: "",
+	} {
+		if got := next(ebook); got != want {
+			t.Errorf("book %d is %q, want %q", ebook, got, want)
+		}
+	}
+
+	// an override places the book the catalog doesn't, and moves another
+	path := filepath.Join(t.TempDir(), "book-overrides.toml")
+	if err = os.WriteFile(path, []byte(`[ebook.5000]
+series = "Chronicles of Barsetshire"
+series-position = 5
+
+[ebook.3412]
+series = "Chronicles of  Barsetshire"
+series-position = 6
+
+[file."Pride and Prejudice.txt"]
+series = "Austen's Novels"
+
+[file."Emma.txt"]
+series = "Austen's Novels"
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var stderr string
+	if stderr, err = captureStderr(t, func() error {
+		out, err = captureStdout(t, func() error { return seriesCmd([]string{"load", "--overrides", path}) })
+		return err
+	}); err != nil || out != "loaded the series of 3 books from the overrides\n" ||
+		stderr != `file."Emma.txt": no book with an ebook number has the filename "Emma.txt"; its series is left out`+"\n" {
+		t.Errorf("series load: %v, printing %q and %q", err, out, stderr)
+	}
+	for ebook, want := range map[int]string{
+		3409: "Chronicles of Barsetshire #2 after The Warden before The Small House at Allington",
+		5000: "Chronicles of Barsetshire #5 after Barchester Towers before Doctor Thorne",
+		3412: "Chronicles of Barsetshire #6 after The Small House at Allington",
+		1342: "Austen's Novels",
+	} {
+		if got := next(ebook); got != want {
+			t.Errorf("with the overrides, book %d is %q, want %q", ebook, got, want)
+		}
+	}
+	// and one taken out of the file is gone as it is loaded again
+	if err = os.WriteFile(path, []byte("[ebook.3412]\nseries = \"Chronicles of Barsetshire\"\nseries-position = 6\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = captureStdout(t, func() error { return seriesCmd([]string{"load", "--overrides", path}) }); err != nil {
+		t.Fatal(err)
+	}
+	if got := next(5000); got != "Chronicles of Barsetshire" {
+		t.Errorf("with its override taken out, book 5000 is %q", got)
+	}
+	// books and GET /books/{id} give them
+	out, err = captureStdout(t, func() error { return booksCmd([]string{"--json"}) })
+	var books []bookRow
+	if err != nil || json.Unmarshal([]byte(out), &books) != nil || len(books) != 5 {
+		t.Fatalf("books --json: %v\n%s", err, out)
+	}
+	for _, b := range books {
+		if want := next(*b.Ebook); b.Ebook != nil && (len(b.Series) == 0) != (want == "") {
+			t.Errorf("books --json gives book %d the series %+v", b.ID, b.Series)
+		}
+	}
+	if out, _ = captureStdout(t, func() error { return booksCmd(nil) }); !strings.Contains(out, "  series\n") || !strings.Contains(out, "  Chronicles of Barsetshire #1 (and 1 more)\n") {
+		t.Errorf("books printed\n%s", out)
+	}
+	s := testServer(t, db)
+	s.ui = true
+	h := s.routes()
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w
+	}
+	w := get(fmt.Sprintf("/books/%d", ids[3409]))
+	var b bookRow
+	if err = json.Unmarshal(w.Body.Bytes(), &b); w.Code != http.StatusOK || err != nil || len(b.Series) != 1 ||
+		b.Series[0].Previous == nil || b.Series[0].Previous.ID != ids[3166] || b.Series[0].Next == nil || b.Series[0].Next.ID != ids[3412] {
+		t.Errorf("GET /books/%d: %d\n%s", ids[3409], w.Code, w.Body)
+	}
+	if w = get("/books/999"); w.Code != http.StatusNotFound {
+		t.Errorf("GET /books/999: %d", w.Code)
+	}
+	page := get(fmt.Sprintf("/ui/books/%d", ids[3409])).Body.String()
+	if !strings.Contains(page, "Chronicles of Barsetshire, number 2") ||
+		!strings.Contains(page, fmt.Sprintf(`before it: <a href="/ui/books/%d">The Warden</a>`, ids[3166])) ||
+		!strings.Contains(page, fmt.Sprintf(`after it: <a href="/ui/books/%d">Doctor Thorne</a>`, ids[3412])) {
+		t.Errorf("the book page of Barchester Towers:\n%s", page)
+	}
+
+	// random keeps to a series
+	drawn := map[string]bool{}
+	for i := 0; i < 40; i++ {
+		out, err := captureStdout(t, func() error { return randomCmd([]string{"--series", "Trollope's novels", "--width", "0"}) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		drawn[strings.TrimSpace(out)] = true
+	}
+	if len(drawn) != 1 || !drawn["A chunk of The Warden.\n— The Warden, by Anthony Trollope"] {
+		t.Errorf("random --series drew %v", drawn)
+	}
+	if _, err = captureStdout(t, func() error { return randomCmd([]string{"--series", "Palliser Novels"}) }); err == nil {
+		t.Error("random --series of no series drew a chunk")
+	}
+
+	if _, err = show("Palliser Novels"); err == nil || err.Error() != `no series "Palliser Novels"; see gutchunk series list` {
+		t.Errorf("series show of no series: %v", err)
+	}
+	for _, args := range [][]string{{}, {"shelve"}, {"show"}, {"list", "extra"}, {"load"}} {
+		if _, err = captureStdout(t, func() error { return seriesCmd(args) }); exitCode(err) != exitUsage {
+			t.Errorf("series %s: %v, want a usage error", strings.Join(args, " "), err)
+		}
+	}
+	// chunk passes over a series, last as it chunks the books again
+	out, err = captureStdout(t, func() error { return chunkCmd([]string{"--overrides", path}) })
+	if err != nil || strings.Contains(out, "chunked with overrides") {
+		t.Errorf("chunk with a series override: %v, printing\n%s", err, out)
+	}
+
+	if err = os.WriteFile(path, []byte("[ebook.3412]\nseries-position = 6\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loadOverrides(path); err == nil || !strings.Contains(err.Error(), "ebook.3412: series-position needs series") {
+		t.Errorf("series-position without series: %v", err)
+	}
+}
@@ -0,0 +1,384 @@
+package cli
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type server struct {
+	db *sql.DB
+	// the pool /chunks/random reads and writes on, with a short busy
+	// timeout (see lanes.go), and how long those took
+	quick   *sql.DB
+	latency latencies
+	w       *writer
+	token   string
+	// largest POST /books body accepted
+	maxBody int64
+	// texts larger than this are chunked in the background
+	asyncAbove int64
+	jobs       *jobQueue
+
+	// public mode: a key for the heavier read endpoints, per client rate
+	// limiting (nil for none), allowed CORS origins and request logging
+	apiKey   string
+	limit    *limiter
+	clientIP func(*http.Request) string
+	origins  []string
+	logger   *log.Logger
+
+	// default width chunks are wrapped to, 0 for single line text
+	width int
+	// give names in capitals as SmartCase has them by default
+	smartCase bool
+	// transforms ?transform= may name, nil for any
+	transforms map[string]bool
+
+	// pre-sampled chunk ids for /chunks/random, nil to always sample
+	reservoir *reservoir
+	// serve the html pages of ui.go too
+	ui bool
+	// the configuration read from files, a *serveConfig swapped whole by a
+	// reload (see reload.go), what reads it, and one reload at a time
+	config     atomic.Value
+	loadConfig func() (*serveConfig, error)
+	reloading  sync.Mutex
+	// serve --replica: the database is a copy replicate keeps, read-only
+	replica bool
+}
+
+func serveCmd(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:8080", "address to listen on")
+	token := fs.String("token", os.Getenv("GUTCHUNK_API_TOKEN"), "shared secret required by write endpoints (or set GUTCHUNK_API_TOKEN)")
+	maxBody := fs.String("max-body", "50MB", "largest accepted upload")
+	asyncAbove := fs.String("async-above", "1MB", "chunk uploads larger than this in the background")
+	apiKey := fs.String("api-key", os.Getenv("GUTCHUNK_API_KEY"), "key required by the heavier read endpoints (or set GUTCHUNK_API_KEY)")
+	rps := fs.Float64("rps", 0, "requests per second allowed per client IP (0 for no limit)")
+	burst := fs.Int("burst", 10, "requests a client IP may make at once before --rps applies")
+	trustForwarded := fs.Bool("trust-forwarded", false, "take client IPs from X-Forwarded-For, when behind a proxy")
+	forwardedHops := fs.Int("forwarded-hops", 1, "with --trust-forwarded, how many proxies append to X-Forwarded-For in front of serve")
+	origins := fs.String("cors-origins", "", "comma separated origins allowed to call the API from a browser, or *")
+	quiet := fs.Bool("quiet", false, "don't log requests")
+	width := fs.Int("width", 0, "wrap chunk text to this many columns by default (0 for one line); ?width= overrides")
+	reservoirSize := fs.Int("reservoir", 10000, "chunk ids to keep pre-sampled for /chunks/random (0 to sample every request)")
+	refresh := fs.Duration("reservoir-refresh", time.Hour, "resample the reservoir this often")
+	allowed := fs.String("transforms", "", "comma separated transforms ?transform= may use (default all of them)")
+	smartCase := fs.Bool("smart-case", false, "give titles and authors in capitals in title case by default; ?smart_case= overrides")
+	ui := fs.Bool("ui", false, "also serve html pages for browsing: a random chunk at /, search and books")
+	config := serveConfigFlags(fs)
+	jobWorkers := fs.Int("job-workers", 1, "background jobs to run at once (0 to leave them to another serve)")
+	jobTimeout := fs.Duration("job-timeout", 10*time.Minute, "take a job back from a worker that stopped renewing its claim for this long")
+	jobAttempts := fs.Int("job-attempts", 3, "times to try a background job before leaving it failed")
+	cacheBooks := fs.Int("content-cache", 64, "books whose content to keep for reading reference chunks (0 for none)")
+	cacheSize := fs.String("content-cache-size", "256MB", "most content to keep for reading reference chunks")
+	replica := fs.Bool("replica", false, "serve a copy gutchunk replicate keeps, read-only, reading each new copy as it is put in place")
+	fs.DurationVar(&interactiveWait, "interactive-wait", interactiveWait, "try /chunks/random's reads and writes again this long while the database is busy before answering 503")
+	fs.Parse(args)
+
+	if *jobWorkers < 0 || *jobAttempts < 1 || *jobTimeout < 2*time.Second {
+		return usagef("--job-workers can't be negative, --job-attempts must be positive and --job-timeout at least 2s")
+	}
+
+	if *cacheBooks < 0 {
+		return usagef("--content-cache can't be negative")
+	}
+	hops := 0
+	if *trustForwarded {
+		if hops = *forwardedHops; hops < 1 {
+			return usagef("--forwarded-hops must be at least 1")
+		}
+	}
+	if *replica {
+		path := dbFile(dsn)
+		if path == "" {
+			return usagef("--replica reads a copy in a file, and a database in memory has none")
+		}
+		dsn = replicaDSN(path)
+		*jobWorkers, *cacheBooks = 0, 0
+	}
+	if *cacheBooks > 0 {
+		size, err := parseSize(*cacheSize)
+		if err != nil {
+			return err
+		}
+		sharedContent = newContentCache(*cacheBooks, size)
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	quick := db
+	if !inMemory(dsn) {
+		if quick, err = openQuickDB(); err != nil {
+			return err
+		}
+		defer quick.Close()
+	}
+	if *replica {
+		db.SetConnMaxLifetime(replicaConnLifetime)
+		quick.SetConnMaxLifetime(replicaConnLifetime)
+	}
+
+	s := &server{db: db, quick: quick, w: writerOf(db), token: *token,
+		apiKey: *apiKey, clientIP: remoteIP(hops), width: *width, smartCase: *smartCase, ui: *ui, replica: *replica}
+	s.w.quick = quick
+	s.jobs = newJobQueue(db, s.w, *jobTimeout, *jobAttempts)
+	if *rps > 0 {
+		s.limit = newLimiter(*rps, *burst, time.Now)
+	}
+	s.loadConfig = config
+	conf, err := s.readConfig()
+	if err != nil {
+		return err
+	}
+	s.config.Store(conf)
+	if *origins != "" {
+		s.origins = strings.Split(*origins, ",")
+	}
+	if *allowed != "" {
+		s.transforms = map[string]bool{}
+		for _, name := range strings.Split(*allowed, ",") {
+			if _, ok := transforms[name]; !ok {
+				return fmt.Errorf("unknown transform %q in --transforms (have %s)", name, transformNames(nil))
+			}
+			s.transforms[name] = true
+		}
+	}
+	if !*quiet {
+		s.logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	if *reservoirSize > 0 {
+		s.reservoir = newReservoir(*reservoirSize, *refresh, func(f chunkFilter, n int) ([]int, error) {
+			return sampleIDs(db, f, n)
+		})
+	}
+	if s.maxBody, err = parseSize(*maxBody); err != nil {
+		return err
+	}
+	if s.asyncAbove, err = parseSize(*asyncAbove); err != nil {
+		return err
+	}
+
+	for i := 0; i < *jobWorkers; i++ {
+		go s.work(s.jobs)
+	}
+	defer s.reloadOnHUP()()
+	fmt.Printf("listening on %s\n", *addr)
+
+	return http.ListenAndServe(*addr, s.routes())
+}
+
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/chunks/random", s.handleRandom)
+	mux.Handle("/chunks/", requireKey(s.apiKey, http.HandlerFunc(s.handleChunkFlag)))
+	mux.HandleFunc("/books", s.handleBooks)
+	mux.Handle("/books/", requireKey(s.apiKey, http.HandlerFunc(s.handleBook)))
+	mux.Handle("/search", requireKey(s.apiKey, http.HandlerFunc(s.handleSearch)))
+	mux.Handle("/changes", requireKey(s.apiKey, http.HandlerFunc(s.handleChanges)))
+	mux.HandleFunc("/jobs", s.handleJobs)
+	mux.HandleFunc("/jobs/", s.handleJobs)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.Handle("/admin/reload", requireKey(s.apiKey, http.HandlerFunc(s.handleReload)))
+	if s.ui {
+		s.uiRoutes(mux)
+	}
+
+	var h http.Handler = mux
+	if s.replica {
+		h = replicaReadOnly(h)
+	}
+	if s.limit != nil {
+		h = s.limit.middleware(s.clientIP, h)
+	}
+	h = cors(s.origins, h)
+	if s.logger != nil {
+		h = logRequests(s.logger, s.clientIP, h)
+	}
+	return h
+}
+
+// authorized checks the Authorization: Bearer header against the configured
+// token. With no token configured nothing is authorized.
+func (s *server) authorized(r *http.Request) bool {
+	if s.token == "" {
+		return false
+	}
+	got := []byte(r.Header.Get("Authorization"))
+	want := []byte("Bearer " + s.token)
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func httpError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func (s *server) handleRandom(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	start := time.Now()
+	defer func() { s.latency.add(time.Since(start)) }()
+
+	f, err := s.parseFilter(r.URL.Query())
+	if errors.Is(err, errNoPreset) {
+		httpError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	p, err := s.parseTransform(r.URL.Query())
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	fields, err := s.parseFields(r.URL.Query())
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ex := servedExclusion{label: r.URL.Query().Get("label")}
+	if v := r.URL.Query().Get("exclude_served"); v != "" {
+		if ex.window, err = parseWindow(v); err != nil {
+			httpError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var c chunkrow
+	var fellBack bool
+	err = retryBusy(func() (err error) {
+		c, fellBack, err = drawUnserved(ex, func(ex servedExclusion) (chunkrow, error) {
+			return unservedFromReservoir(s.quick, s.reservoir, rng, f, ex)
+		})
+		return err
+	})
+	if errors.Is(err, errNoChunks) {
+		httpError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if isBusy(err) {
+		w.Header().Set("Retry-After", "1")
+		httpError(w, http.StatusServiceUnavailable, "the database is busy; try again")
+		return
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if fellBack {
+		log.Print(fellBackNotice(ex))
+	}
+	if !s.replica {
+		err = s.w.interactive(func(tx *sql.Tx) error { return logServed(tx, c.ID, ex.label) })
+		if err != nil {
+			log.Printf("could not log chunk %d served: %v", c.ID, err)
+		}
+	}
+
+	c.Text = s.render(r, p.apply(c.Text))
+	c.Title, c.Author = s.names(r, c.Title, c.Author)
+	if !fields.custom() {
+		writeJSON(w, http.StatusOK, c)
+		return
+	}
+	var facts map[int]chunkFacts
+	err = retryBusy(func() (err error) {
+		facts, err = loadChunkFacts(s.quick, []int{c.ID})
+		return err
+	})
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	cf := facts[c.ID]
+	cf.Text = c.Text
+	cf.Title, cf.Author = s.names(r, cf.Title, cf.Author)
+	rec, err := fields.record(cf, c)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, rec)
+}
+
+// render lays chunk text out for a response: on one line, unless a width is
+// asked for with ?width= or configured with --width.
+func (s *server) render(r *http.Request, text string) string {
+	width := s.width
+	if n, err := strconv.Atoi(r.URL.Query().Get("width")); err == nil && n >= 0 {
+		width = n
+	}
+	if width == 0 {
+		return RenderChunk(text, 0, StyleLine)
+	}
+	return RenderChunk(text, width, StyleText)
+}
+
+// names gives a title and author for a response: as stored, or title-cased
+// from capitals with ?smart_case=true or by --smart-case.
+func (s *server) names(r *http.Request, title, author string) (string, string) {
+	on := s.smartCase
+	if b, err := strconv.ParseBool(r.URL.Query().Get("smart_case")); err == nil {
+		on = b
+	}
+	if !on {
+		return title, author
+	}
+	return SmartCase(title), SmartCase(author)
+}
+
+type metrics struct {
+	// background jobs queued or running
+	Jobs      int         `json:"jobs"`
+	Reservoir []poolStats `json:"reservoir"`
+	// serve --content-cache, nil without it
+	ContentCache *contentCacheStats `json:"content_cache,omitempty"`
+	// the latest /chunks/random
+	Random latencyStats `json:"random"`
+}
+
+func (s *server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	m := metrics{Reservoir: []poolStats{}}
+	var err error
+	if m.Jobs, err = s.jobs.pending(); err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if s.reservoir != nil {
+		m.Reservoir = s.reservoir.stats()
+	}
+	if sharedContent != nil {
+		st := sharedContent.stats()
+		m.ContentCache = &st
+	}
+	m.Random = s.latency.stats()
+	writeJSON(w, http.StatusOK, m)
+}
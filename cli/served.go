@@ -0,0 +1,126 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// random and /chunks/random log each chunk they serve in served_log, with
+// the label of whoever it was for (random --label, ?label=). Given a
+// window, --exclude-served 30d or ?exclude_served=30d, they leave out the
+// chunks served under the same label within it, so a bot drawing once a day
+// doesn't post a chunk twice in a month by chance. The exclusion is a NOT
+// EXISTS on the candidate chunk, which the (label, chunk_id, served_at)
+// index answers with one seek into the window, however long the log. When
+// it leaves nothing to draw, the draw is made without it and a notice
+// logged, rather than failing. maintain prunes the log.
+
+// servedExclusion leaves out the chunks served under label within window.
+// The zero value leaves out nothing.
+type servedExclusion struct {
+	label  string
+	window time.Duration
+}
+
+func (ex servedExclusion) on() bool {
+	return ex.window > 0
+}
+
+// and is " AND " the condition on "chunks c" ex puts, or "" for none, and
+// the arguments it binds, to follow those of what it is added to.
+func (ex servedExclusion) and() (string, []interface{}) {
+	if !ex.on() {
+		return "", nil
+	}
+	return " AND NOT EXISTS (SELECT 1 FROM served_log s WHERE s.label = ? AND s.chunk_id = c.id AND s.served_at >= datetime('now', ?))",
+		[]interface{}{ex.label, ago(ex.window)}
+}
+
+// served reports whether ex leaves out chunk id.
+func (ex servedExclusion) served(db *sql.DB, id int) (bool, error) {
+	if !ex.on() {
+		return false, nil
+	}
+	var served bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM served_log WHERE label = ? AND chunk_id = ? AND served_at >= datetime('now', ?))",
+		ex.label, id, ago(ex.window)).Scan(&served)
+	return served, err
+}
+
+// ago is the datetime modifier going d back.
+func ago(d time.Duration) string {
+	return fmt.Sprintf("-%d seconds", int64(d/time.Second))
+}
+
+func (ex servedExclusion) String() string {
+	label := "without a label"
+	if ex.label != "" {
+		label = fmt.Sprintf("under label %q", ex.label)
+	}
+	return fmt.Sprintf("%s in the last %s", label, formatWindow(ex.window))
+}
+
+// drawUnserved draws with ex, or, when ex leaves no chunk to draw, again
+// without it, reporting that it fell back.
+func drawUnserved(ex servedExclusion, draw func(servedExclusion) (chunkrow, error)) (chunkrow, bool, error) {
+	c, err := draw(ex)
+	if !errors.Is(err, errNoChunks) || !ex.on() {
+		return c, false, err
+	}
+	c, err = draw(servedExclusion{})
+	return c, true, err
+}
+
+// fellBackNotice is what's logged when drawUnserved fell back.
+func fellBackNotice(ex servedExclusion) string {
+	return fmt.Sprintf("every chunk left to draw was served %s; drawing from all of them", ex)
+}
+
+// logServed records that chunk id was served under label.
+func logServed(db execer, id int, label string) error {
+	_, err := db.Exec("INSERT INTO served_log (chunk_id, served_at, label) VALUES (?, datetime('now'), ?)", id, label)
+	return err
+}
+
+// tries of the reservoir before sampling directly under an exclusion
+const servedPicks = 8
+
+// unservedFromReservoir is randomFromReservoir leaving out what ex does. A
+// pool is drawn from until it gives a chunk ex keeps, before sampling
+// directly.
+func unservedFromReservoir(db *sql.DB, rv *reservoir, r *rand.Rand, f chunkFilter, ex servedExclusion) (chunkrow, error) {
+	if !ex.on() {
+		return randomFromReservoir(db, rv, r, f)
+	}
+	for i := 0; rv != nil && i < servedPicks; i++ {
+		id, ok := rv.pick(f, r)
+		if !ok {
+			break
+		}
+		served, err := ex.served(db, id)
+		if err != nil {
+			return chunkrow{}, err
+		}
+		if served {
+			continue
+		}
+		c, err := chunkByID(db, id)
+		if !errors.Is(err, sql.ErrNoRows) {
+			return c, err
+		}
+	}
+	return filteredChunk(db, r, f, ex)
+}
+
+// pruneServed deletes what was logged before keep ago.
+func pruneServed(ctx context.Context, db *sql.DB, keep time.Duration) (int64, error) {
+	res, err := db.ExecContext(ctx, "DELETE FROM served_log WHERE served_at < datetime('now', ?)", ago(keep))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,92 @@
+package cli
+
+import (
+	"database/sql"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// the label servedDB logs its served chunks under, quotes and all
+const quotedLabel = "o'brien's bot"
+
+// servedDB is two chunked books by one author, with every chunk of Emma
+// logged as served under quotedLabel.
+func servedDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db := testDB(t)
+	emma := addBook(t, db, "Emma", "Jane Austen", testBook("Emma", testParagraphs(3)))
+	persuasion := addBook(t, db, "Persuasion", "Jane Austen", testBook("Persuasion", testParagraphs(3)))
+	// for the draws by author
+	for _, id := range []int{emma, persuasion} {
+		if err := saveNameWords(db, int64(id), normalizeAuthor("Jane Austen"), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := makeChunks(db, chunkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.Query("SELECT id FROM chunks WHERE sourceid = ?", emma)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	for _, id := range ids {
+		if err = logServed(db, id, quotedLabel); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+// drawnTitles is the titles of the books 50 draws drew from.
+func drawnTitles(t *testing.T, name string, draw func(r *rand.Rand) (chunkrow, error)) map[string]bool {
+	t.Helper()
+	r := rand.New(rand.NewSource(1))
+	seen := map[string]bool{}
+	for i := 0; i < 50; i++ {
+		c, err := draw(r)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		seen[c.Title] = true
+	}
+	return seen
+}
+
+func TestServedExclusion(t *testing.T) {
+	db := servedDB(t)
+	draws := map[string]func(ex servedExclusion) func(r *rand.Rand) (chunkrow, error){
+		"random": func(ex servedExclusion) func(r *rand.Rand) (chunkrow, error) {
+			return func(r *rand.Rand) (chunkrow, error) { return filteredChunk(db, r, chunkFilter{}, ex) }
+		},
+		"filtered": func(ex servedExclusion) func(r *rand.Rand) (chunkrow, error) {
+			return func(r *rand.Rand) (chunkrow, error) { return filteredChunk(db, r, chunkFilter{MinLength: 10}, ex) }
+		},
+		"author": func(ex servedExclusion) func(r *rand.Rand) (chunkrow, error) {
+			return func(r *rand.Rand) (chunkrow, error) {
+				and, args := ex.and()
+				return matchingChunk(db, r, parseNameQuery("Austen", ""), notBanned+and, args...)
+			}
+		},
+	}
+	for name, draw := range draws {
+		seen := drawnTitles(t, name, draw(servedExclusion{label: quotedLabel, window: time.Hour}))
+		if seen["Emma"] || !seen["Persuasion"] {
+			t.Errorf("%s, leaving out what %q was served: drew from %v, want only Persuasion", name, quotedLabel, seen)
+		}
+		// a label that would match every row, were it spliced into the sql
+		seen = drawnTitles(t, name, draw(servedExclusion{label: "x' OR '1'='1", window: time.Hour}))
+		if !seen["Emma"] || !seen["Persuasion"] {
+			t.Errorf("%s, under another label: drew from %v, want both books", name, seen)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Chunks can be moved out of the main database into shard files next to
+// it, chunks_00.db and so on, each holding the chunks of the books whose id
+// is its number modulo the count. Every connection attaches them and
+// shadows the chunks table with a temp view over all of them, with
+// triggers writing through to the right shard, so queries over chunks work
+// unchanged. sqlite runs joins through the view shard by shard, but
+// materializes the whole view to aggregate over it, so counts and the like
+// go through eachShard instead.
+
+// chunkShards is how many shard files the open database's chunks are in,
+// 0 when they are in the main database.
+var chunkShards int
+
+// a shard's chunks table; keep in step with chunksTable. Each
+// shard's table has a name of its own, as the view's triggers can only
+// name tables without their database.
+const shardChunks = `CREATE TABLE IF NOT EXISTS %s.%s (
+	id          INTEGER PRIMARY KEY,
+	chunk       TEXT,
+	sourceid    INTEGER,
+	ordinal     INTEGER,
+	token_count INTEGER,
+	work_id     INTEGER,
+	scene       INTEGER,
+	boilerplate INTEGER,
+	position_pct REAL,
+	kind        TEXT,
+	stable_id   TEXT
+);
+CREATE INDEX IF NOT EXISTS %[1]s.%[2]s_sourceid ON %[2]s(sourceid)`
+
+const chunkCols = "id, chunk, sourceid, ordinal, token_count, work_id, scene, boilerplate, position_pct, kind, stable_id"
+
+// columns added to chunks since shards were first made, which shards made
+// before them lack
+var shardColumns = []struct{ name, decl string }{
+	{"work_id", "INTEGER"},
+	{"scene", "INTEGER"},
+	{"boilerplate", "INTEGER"},
+	{"position_pct", "REAL"},
+	{"kind", "TEXT"},
+	{"stable_id", "TEXT"},
+}
+
+func shardName(i int) string {
+	return fmt.Sprintf("shard%02d", i)
+}
+
+func shardTable(i int) string {
+	return fmt.Sprintf("chunks_%02d", i)
+}
+
+// shardFile is where shard i of the database at dsn lives.
+func shardFile(dsn string, i int) string {
+	return filepath.Join(filepath.Dir(dbFile(dsn)), fmt.Sprintf("chunks_%02d.db", i))
+}
+
+// attachShards sets up conn to see the n shards of dsn as its chunks.
+func attachShards(conn *sqlite3.SQLiteConn, dsn string, n int) error {
+	stmts := []string{}
+	arms := []string{}
+	inserts, updates, deletes := []string{}, []string{}, []string{}
+	for i := 0; i < n; i++ {
+		s, t := shardName(i), shardTable(i)
+		stmts = append(stmts,
+			fmt.Sprintf("ATTACH DATABASE '%s' AS %s", strings.ReplaceAll(shardFile(dsn, i), "'", "''"), s),
+			fmt.Sprintf(shardChunks, s, t))
+		arms = append(arms, fmt.Sprintf("SELECT %s FROM %s", chunkCols, t))
+		inserts = append(inserts, fmt.Sprintf(`INSERT INTO %s (%s)
+			SELECT coalesce(NEW.id, (SELECT id FROM chunks ORDER BY id DESC LIMIT 1) + 1, 1), NEW.chunk, NEW.sourceid, NEW.ordinal, NEW.token_count, NEW.work_id, NEW.scene, NEW.boilerplate, NEW.position_pct, NEW.kind, NEW.stable_id
+			WHERE coalesce(NEW.sourceid, 0) %% %d = %d;`, t, chunkCols, n, i))
+		updates = append(updates, fmt.Sprintf(`UPDATE %s SET chunk = NEW.chunk, sourceid = NEW.sourceid,
+			ordinal = NEW.ordinal, token_count = NEW.token_count, work_id = NEW.work_id, scene = NEW.scene, boilerplate = NEW.boilerplate, position_pct = NEW.position_pct, kind = NEW.kind, stable_id = NEW.stable_id WHERE id = OLD.id;`, t))
+		deletes = append(deletes, fmt.Sprintf("DELETE FROM %s WHERE id = OLD.id;", t))
+	}
+	stmts = append(stmts,
+		"CREATE TEMP VIEW chunks AS "+strings.Join(arms, " UNION ALL "),
+		"CREATE TEMP TRIGGER chunks_insert INSTEAD OF INSERT ON chunks BEGIN "+strings.Join(inserts, " ")+" END",
+		"CREATE TEMP TRIGGER chunks_update INSTEAD OF UPDATE ON chunks BEGIN "+strings.Join(updates, " ")+" END",
+		"CREATE TEMP TRIGGER chunks_delete INSTEAD OF DELETE ON chunks BEGIN "+strings.Join(deletes, " ")+" END")
+	for _, q := range stmts {
+		if strings.HasPrefix(q, "CREATE TEMP VIEW") {
+			if err := upgradeShards(conn, n); err != nil {
+				return err
+			}
+		}
+		if _, err := conn.Exec(q, nil); err != nil {
+			return fmt.Errorf("could not attach chunk shards: %w", err)
+		}
+	}
+	return nil
+}
+
+// upgradeShards adds shardColumns to attached shards made without them,
+// and the index of the stable ids of each shard's chunks. sqlite has no
+// ADD COLUMN IF NOT EXISTS, so a duplicate is taken as done.
+func upgradeShards(conn *sqlite3.SQLiteConn, n int) error {
+	for i := 0; i < n; i++ {
+		for _, c := range shardColumns {
+			_, err := conn.Exec(fmt.Sprintf("ALTER TABLE %s.%s ADD COLUMN %s %s", shardName(i), shardTable(i), c.name, c.decl), nil)
+			if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+				return fmt.Errorf("could not add %s to shard %d: %w", c.name, i, err)
+			}
+		}
+		if _, err := conn.Exec(fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s.%s_stable_id ON %[2]s(stable_id)", shardName(i), shardTable(i)), nil); err != nil {
+			return fmt.Errorf("could not index shard %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// eachShard writes query, a query over "chunks c" with %s in place of
+// chunks, once against each shard's own table, joined by UNION ALL, and
+// repeats args to match.
+func eachShard(query string, args ...interface{}) (string, []interface{}) {
+	if chunkStorage == storageReference {
+		return fmt.Sprintf(query, "chunks"), args
+	}
+	if chunkShards == 0 {
+		return fmt.Sprintf(query, "main.chunks"), args
+	}
+	arms := []string{}
+	all := []interface{}{}
+	for i := 0; i < chunkShards; i++ {
+		arms = append(arms, fmt.Sprintf(query, shardTable(i)))
+		all = append(all, args...)
+	}
+	return strings.Join(arms, " UNION ALL "), all
+}
+
+// countChunks counts the rows of "SELECT ... FROM from", from being written
+// as for eachShard.
+func countChunks(q queryer, from string, args ...interface{}) (int, error) {
+	arms, all := eachShard("SELECT count(*) AS n FROM "+from, args...)
+	var n int
+	err := q.QueryRow("SELECT coalesce(sum(n), 0) FROM ("+arms+")", all...).Scan(&n)
+	return n, err
+}
+
+// maxChunkID returns the highest chunk id, 0 when there are none. Unlike
+// max(id) it is a seek over sharded chunks too.
+func maxChunkID(q queryer) (int64, error) {
+	var id int64
+	err := q.QueryRow("SELECT id FROM chunks ORDER BY id DESC LIMIT 1").Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return id, err
+}
+
+func loadShardCount(db *sql.DB) (int, error) {
+	var n int
+	err := db.QueryRow("SELECT coalesce(max(n), 0) FROM chunk_shards").Scan(&n)
+	return n, err
+}
+
+func shardCmd(args []string) error {
+	fs := flag.NewFlagSet("shard", flag.ExitOnError)
+	n := fs.Int("n", 8, "number of shard files to spread chunks over")
+	vacuum := fs.Bool("vacuum", false, "vacuum the main database afterwards to give back the space the chunks took")
+	unshard := fs.Bool("unshard", false, "move the chunks back out of the shards into the main database, and remove the shard files")
+	space := spaceFlags(fs)
+	fs.Parse(args)
+	so, err := space()
+	if err != nil {
+		return err
+	}
+
+	if *n < 2 || *n > 100 {
+		return usagef("--n must be between 2 and 100")
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if *unshard {
+		if chunkShards == 0 {
+			return errors.New("the chunks aren't sharded")
+		}
+		// the main database takes the chunks back beside the shards'
+		// copies until they are removed
+		if err = checkSpace(dbFile(dsn), "unshard", so); err != nil {
+			return err
+		}
+		sw := watchSpace(runCtx, dbFile(dsn), so.minFree)
+		defer sw.stop()
+		return sw.err(moveFromShards(sw.ctx, db, chunkShards))
+	}
+	if chunkShards > 0 {
+		return fmt.Errorf("chunks are already split over %d shards; to reshard, gutchunk shard --unshard first", chunkShards)
+	}
+	if inMemory(dsn) {
+		return errors.New("shards are files beside the database, which has none in memory; use --db temp instead")
+	}
+	if chunkLayout == chunksClustered {
+		return errors.New("shards are in the rowid layout; convert the chunks first with gutchunk migrate-layout rowid")
+	}
+	if chunkStorage == storageReference {
+		return errors.New("shards keep chunks' text; convert them back first with gutchunk convert-storage --mode inline")
+	}
+	fts, err := hasFTS(db)
+	if err != nil {
+		return err
+	}
+	if fts {
+		return errors.New("the full text index doesn't work over shards; drop it first with gutchunk index --drop")
+	}
+
+	// the shards hold a copy of the chunks until the main database lets
+	// go of them, and a vacuum rewrites what is left
+	if err = checkSpace(dbFile(dsn), "shard", so); err != nil {
+		return err
+	}
+	sw := watchSpace(runCtx, dbFile(dsn), so.minFree)
+	defer sw.stop()
+	return sw.err(moveToShards(sw.ctx, db, *n, *vacuum))
+}
+
+func moveToShards(ctx context.Context, db *sql.DB, n int, vacuum bool) error {
+	// ATTACH only holds for the connection it runs on
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for i := 0; i < n; i++ {
+		s := shardName(i)
+		if _, err = conn.ExecContext(ctx, fmt.Sprintf("ATTACH DATABASE ? AS %s", s), shardFile(dsn, i)); err != nil {
+			return err
+		}
+		if _, err = conn.ExecContext(ctx, fmt.Sprintf(shardChunks, s, shardTable(i))); err != nil {
+			return err
+		}
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var total int
+	if err = tx.QueryRowContext(ctx, "SELECT count(*) FROM main.chunks").Scan(&total); err != nil {
+		return err
+	}
+	moved := 0
+	for i := 0; i < n; i++ {
+		t := shardTable(i)
+		// left over from a run that died before the main database committed
+		if _, err = tx.ExecContext(ctx, "DELETE FROM "+t); err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (%s) SELECT %[2]s FROM main.chunks WHERE coalesce(sourceid, 0) %% ? = ?", t, chunkCols), n, i)
+		if err != nil {
+			return fmt.Errorf("could not fill %s: %w", shardFile(dsn, i), err)
+		}
+		k, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: %d chunks\n", shardFile(dsn, i), k)
+		moved += int(k)
+	}
+	if moved != total {
+		return fmt.Errorf("moved %d chunks of %d; leaving the database as it was", moved, total)
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM main.chunks"); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, "INSERT INTO chunk_shards (n) VALUES (?)", n); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	fmt.Printf("moved %d chunks into %d shards\n", moved, n)
+
+	if vacuum {
+		if _, err = conn.ExecContext(ctx, "VACUUM main"); err != nil {
+			return fmt.Errorf("could not vacuum: %w", err)
+		}
+	}
+	return nil
+}
+
+// moveFromShards moves the chunks of the n shards back into the main
+// database and removes the shard files. The main database commits first,
+// so a run that dies before removing them leaves files that a later shard
+// empties before filling.
+func moveFromShards(ctx context.Context, db *sql.DB, n int) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer tx.Rollback()
+
+	var total int
+	if total, err = countChunks(tx, "%s"); err != nil {
+		conn.Close()
+		return err
+	}
+	moved := 0
+	for i := 0; i < n; i++ {
+		res, err := tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO main.chunks (%s) SELECT %[1]s FROM %s", chunkCols, shardTable(i)))
+		if err != nil {
+			conn.Close()
+			return fmt.Errorf("could not move the chunks of %s: %w", shardFile(dsn, i), err)
+		}
+		k, err := res.RowsAffected()
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		moved += int(k)
+	}
+	if moved != total {
+		conn.Close()
+		return fmt.Errorf("moved %d chunks of %d; leaving the database as it was", moved, total)
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM chunk_shards"); err != nil {
+		conn.Close()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		conn.Close()
+		return err
+	}
+	fmt.Printf("moved %d chunks out of %d shards\n", moved, n)
+
+	// every connection has the shards attached, and a file attached can't
+	// go until they have let go of it
+	conn.Close()
+	db.Close()
+	for i := 0; i < n; i++ {
+		if err := os.Remove(shardFile(dsn, i)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("the chunks are back in the main database, but %w", err)
+		}
+		os.Remove(shardFile(dsn, i) + "-wal")
+		os.Remove(shardFile(dsn, i) + "-shm")
+	}
+	chunkShards = 0
+	return nil
+}
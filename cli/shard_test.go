@@ -0,0 +1,206 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+// shardedDB is a database in a file with four chunked books, its chunks
+// then moved into two shards, reopened as gutchunk would open it. It
+// returns the books' ids.
+func shardedDB(t *testing.T) (*sql.DB, []int) {
+	t.Helper()
+	db := testFileDB(t)
+	var ids []int
+	for _, title := range []string{"Emma", "Persuasion", "Middlemarch", "Villette"} {
+		ids = append(ids, addBook(t, db, title, "Someone", testBook(title, testParagraphs(5))))
+	}
+	if err := makeChunks(db, chunkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := moveToShards(context.Background(), db, 2, false); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	db, err := openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if chunkShards != 2 {
+		t.Fatalf("the database has %d shards, not 2", chunkShards)
+	}
+	return db, ids
+}
+
+// shardChunkCount is how many chunks of book id shard i holds.
+func shardChunkCount(t *testing.T, db *sql.DB, i, id int) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM "+shardTable(i)+" WHERE sourceid = ?", id).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestShardsRead(t *testing.T) {
+	db, ids := shardedDB(t)
+	var main int
+	if err := db.QueryRow("SELECT count(*) FROM main.chunks").Scan(&main); err != nil {
+		t.Fatal(err)
+	}
+	if main != 0 {
+		t.Errorf("the main database kept %d chunks", main)
+	}
+	for _, id := range ids {
+		n := chunkCount(t, db, id)
+		if n != 5 {
+			t.Errorf("book %d has %d chunks through the view, want 5", id, n)
+		}
+		if in := shardChunkCount(t, db, id%2, id); in != n {
+			t.Errorf("shard %d holds %d of book %d's %d chunks", id%2, in, id, n)
+		}
+	}
+	total, err := countChunks(db, "%s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 20 {
+		t.Errorf("countChunks = %d, want 20", total)
+	}
+}
+
+func TestShardsWrite(t *testing.T) {
+	db, ids := shardedDB(t)
+	id := addBook(t, db, "Shirley", "Someone", testBook("Shirley", testParagraphs(3)))
+	if _, err := chunkHeld(writerOf(db), id, chunkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := shardChunkCount(t, db, id%2, id); n != 3 {
+		t.Errorf("shard %d holds %d chunks of the new book, want 3", id%2, n)
+	}
+	if n := shardChunkCount(t, db, 1-id%2, id); n != 0 {
+		t.Errorf("shard %d holds %d chunks of the new book, want none", 1-id%2, n)
+	}
+
+	// rechunking replaces a book's chunks in its shard
+	if _, err := db.Exec("UPDATE files SET content = ? WHERE id = ?", testBook("Emma", testParagraphs(2)), ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chunkHeld(writerOf(db), ids[0], chunkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := shardChunkCount(t, db, ids[0]%2, ids[0]); n != 2 {
+		t.Errorf("book %d has %d chunks in its shard after rechunking, want 2", ids[0], n)
+	}
+	var dup int
+	if err := db.QueryRow("SELECT count(*) FROM (SELECT id FROM chunks GROUP BY id HAVING count(*) > 1)").Scan(&dup); err != nil {
+		t.Fatal(err)
+	}
+	if dup != 0 {
+		t.Errorf("%d chunk ids are in both shards", dup)
+	}
+}
+
+func TestShardsRandom(t *testing.T) {
+	db, ids := shardedDB(t)
+	r := rand.New(rand.NewSource(1))
+	seen := map[string]bool{}
+	for i := 0; i < 200; i++ {
+		c, err := randomChunk(db, r, drawable(false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[c.Title] = true
+	}
+	if len(seen) != len(ids) {
+		t.Errorf("200 draws came from %d books, want all %d", len(seen), len(ids))
+	}
+}
+
+func TestShardsExport(t *testing.T) {
+	db, _ := shardedDB(t)
+	var buf bytes.Buffer
+	if err := exportChunks(db, &buf, exportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	last := 0
+	sc := bufio.NewScanner(&buf)
+	for sc.Scan() {
+		var c struct {
+			ID int `json:"id"`
+		}
+		if err := json.Unmarshal(sc.Bytes(), &c); err != nil {
+			t.Fatal(err)
+		}
+		if c.ID <= last {
+			t.Errorf("chunk %d exported after %d", c.ID, last)
+		}
+		last = c.ID
+		n++
+	}
+	if n != 20 {
+		t.Errorf("exported %d chunks, want 20", n)
+	}
+}
+
+func TestShardsRefuseIndex(t *testing.T) {
+	db, _ := shardedDB(t)
+	err := indexCmd(nil)
+	if err == nil || !strings.Contains(err.Error(), "shard --unshard") {
+		t.Errorf("index over shards: %v, want it refused, naming shard --unshard", err)
+	}
+	fts, err := hasFTS(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fts {
+		t.Error("index made the full text index over shards after all")
+	}
+}
+
+func TestUnshard(t *testing.T) {
+	db, ids := shardedDB(t)
+	if err := moveFromShards(context.Background(), db, 2); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := os.Stat(shardFile(dsn, i)); !os.IsNotExist(err) {
+			t.Errorf("%s is still there: %v", shardFile(dsn, i), err)
+		}
+	}
+	db, err := openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if chunkShards != 0 {
+		t.Errorf("the database has %d shards after unsharding", chunkShards)
+	}
+	var main int
+	if err := db.QueryRow("SELECT count(*) FROM main.chunks").Scan(&main); err != nil {
+		t.Fatal(err)
+	}
+	if main != 20 {
+		t.Errorf("the main database has %d chunks back, want 20", main)
+	}
+	for _, id := range ids {
+		if n := chunkCount(t, db, id); n != 5 {
+			t.Errorf("book %d has %d chunks, want 5", id, n)
+		}
+	}
+	if chunkLayout == chunksClustered {
+		return
+	}
+	if err := indexCmd(nil); err != nil {
+		t.Errorf("index after unsharding: %v", err)
+	}
+}
@@ -0,0 +1,311 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// gutchunk similar-lexical 1234 finds chunks like chunk 1234 by the words
+// they share, through the full text index and no embeddings. The chunk's
+// words, stopwords and words under three letters left out and each folded
+// as the index folds it, are weighted by how often the chunk uses them
+// and how few chunks of the index do, as fts4aux counts them; the
+// --terms best, leaving out any in half the chunks or more, are asked for
+// together in an OR query, and each chunk matching is scored by bm25 with
+// its terms weighted the same. A chunk of nothing but common words has no
+// terms to look for and nothing like it. --other-books leaves out chunks
+// of the chunk's own book, and the chunk itself is always left out. As
+// with /search, only the first searchCap matches by id are ranked. GET
+// /chunks/{id}/similar does the same, with ?k= and ?other_books=1.
+
+const (
+	similarK     = 10
+	similarTerms = 12
+	maxSimilarK  = 100
+)
+
+// similarTerm is a term of a chunk and what it weighs in finding others
+// like it.
+type similarTerm struct {
+	Term   string  `json:"term"`
+	Weight float64 `json:"weight"`
+}
+
+type similarResult struct {
+	ID      int     `json:"id"`
+	Title   string  `json:"title"`
+	Author  string  `json:"author"`
+	Score   float64 `json:"score"`
+	Snippet string  `json:"snippet"`
+}
+
+type similarReport struct {
+	ID      int             `json:"id"`
+	Terms   []similarTerm   `json:"terms"`
+	Results []similarResult `json:"results"`
+}
+
+// errNoFTS is finding similar chunks without a full text index to find
+// them in.
+var errNoFTS = errors.New("no full text index; run gutchunk index")
+
+func similarLexicalCmd(args []string) error {
+	fs := flag.NewFlagSet("similar-lexical", flag.ExitOnError)
+	k := fs.Int("k", similarK, "most similar chunks to give")
+	terms := fs.Int("terms", similarTerms, "distinctive terms of the chunk to search for")
+	otherBooks := fs.Bool("other-books", false, "leave out chunks of the chunk's own book")
+	asJSON := fs.Bool("json", false, "print the chunks as json")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return usagef("usage: gutchunk similar-lexical [flags] CHUNKID")
+	}
+	id, err := strconv.Atoi(fs.Arg(0))
+	if err != nil {
+		return usagef("bad chunk id %q", fs.Arg(0))
+	}
+	if *k < 1 || *k > maxSimilarK {
+		return usagef("--k must be 1 to %d", maxSimilarK)
+	}
+	if *terms < 1 {
+		return usagef("--terms must be at least 1")
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rep, err := similarChunks(runCtx, db, id, *k, *terms, *otherBooks)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return json.NewEncoder(os.Stdout).Encode(rep)
+	}
+	if len(rep.Terms) == 0 {
+		fmt.Printf("chunk %d has no words rare enough to find others by\n", id)
+		return exitStatus(1)
+	}
+	names := make([]string, len(rep.Terms))
+	for i, t := range rep.Terms {
+		names[i] = t.Term
+	}
+	fmt.Printf("chunk %d, by %s\n", id, strings.Join(names, ", "))
+	if len(rep.Results) == 0 {
+		fmt.Println("no chunks like it")
+		return exitStatus(1)
+	}
+	for _, r := range rep.Results {
+		fmt.Printf("%d\t%.3f\t%s, by %s\n\t%s\n", r.ID, r.Score, r.Title, r.Author, r.Snippet)
+	}
+	return nil
+}
+
+// similarChunks finds the k chunks most like chunk id, terms of its terms
+// at most, leaving out those of its book with otherBooks. It is errNoChunk
+// for a chunk there isn't and errNoFTS without the index.
+func similarChunks(ctx context.Context, db *sql.DB, id, k, terms int, otherBooks bool) (similarReport, error) {
+	rep := similarReport{ID: id, Terms: []similarTerm{}, Results: []similarResult{}}
+	ok, err := hasFTS(db)
+	if err != nil {
+		return rep, err
+	}
+	if !ok {
+		return rep, errNoFTS
+	}
+	var text string
+	var book int
+	err = db.QueryRowContext(ctx, "SELECT chunk, sourceid FROM chunks WHERE id = ?", id).Scan(&text, &book)
+	if errors.Is(err, sql.ErrNoRows) {
+		return rep, fmt.Errorf("%w %d", errNoChunk, id)
+	}
+	if err != nil {
+		return rep, err
+	}
+
+	// fts4aux is a temp table, so everything goes through one connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return rep, err
+	}
+	defer conn.Close()
+	if rep.Terms, err = distinctiveTerms(ctx, conn, text, terms); err != nil || len(rep.Terms) == 0 {
+		return rep, err
+	}
+
+	q := make([]string, len(rep.Terms))
+	weights := make([]float64, len(rep.Terms))
+	for i, t := range rep.Terms {
+		q[i], weights[i] = t.Term, t.Weight
+	}
+	match := strings.Join(q, " OR ")
+	exclude := -1
+	if otherBooks {
+		exclude = book
+	}
+	rows, err := conn.QueryContext(ctx, `SELECT c.id, matchinfo(chunks_fts, 'pcnalx') FROM chunks_fts JOIN chunks c ON c.id = chunks_fts.docid
+		WHERE chunks_fts MATCH ? AND c.id != ? AND c.sourceid != ? LIMIT ?`, match, id, exclude, searchCap)
+	if err != nil {
+		return rep, ftsError(err)
+	}
+	var hits []searchHit
+	for rows.Next() {
+		var h searchHit
+		var info []byte
+		if err = rows.Scan(&h.id, &info); err != nil {
+			rows.Close()
+			return rep, err
+		}
+		h.score = weightedBM25(info, weights)
+		hits = append(hits, h)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return rep, ftsError(err)
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].score != hits[j].score {
+			return hits[i].score > hits[j].score
+		}
+		return hits[i].id < hits[j].id
+	})
+	if len(hits) > k {
+		hits = hits[:k]
+	}
+	for _, h := range hits {
+		r := similarResult{ID: h.id, Score: math.Round(h.score*1000) / 1000}
+		err = conn.QueryRowContext(ctx, `SELECT snippet(chunks_fts, '[', ']', '…', -1, ?), coalesce(f.name, ''), coalesce(f.author, '')
+			FROM chunks_fts JOIN chunks c ON c.id = chunks_fts.docid JOIN files f ON f.id = c.sourceid
+			WHERE chunks_fts MATCH ? AND chunks_fts.docid = ?`, snippetTokens, match, h.id).Scan(&r.Snippet, &r.Title, &r.Author)
+		if err != nil {
+			return rep, ftsError(err)
+		}
+		rep.Results = append(rep.Results, r)
+	}
+	return rep, nil
+}
+
+// chunkTerms counts the words of text the index would find it by, folded
+// as the index folds them, but for stopwords and those too short or all
+// digits to tell chunks apart.
+func chunkTerms(text string) map[string]int {
+	counts := map[string]int{}
+	for _, w := range words(text) {
+		if stopwords[w] {
+			continue
+		}
+		// the index splits "don't" in two, and both halves are stopwords
+		// or too short
+		if strings.ContainsAny(w, "'’") {
+			continue
+		}
+		w = fold(w)
+		if len([]rune(w)) < 3 || strings.IndexFunc(w, func(r rune) bool { return !unicode.IsDigit(r) }) < 0 {
+			continue
+		}
+		counts[w]++
+	}
+	return counts
+}
+
+// distinctiveTerms are the n terms of text that best tell it from the rest
+// of the index, by how often text uses each and the log of how rare it is
+// among the chunks, none in half of them or more.
+func distinctiveTerms(ctx context.Context, conn *sql.Conn, text string, n int) ([]similarTerm, error) {
+	out := []similarTerm{}
+	counts := chunkTerms(text)
+	if len(counts) == 0 {
+		return out, nil
+	}
+	if _, err := conn.ExecContext(ctx, "CREATE VIRTUAL TABLE IF NOT EXISTS temp.chunks_fts_terms USING fts4aux(main, chunks_fts)"); err != nil {
+		return nil, err
+	}
+	var total float64
+	if err := conn.QueryRowContext(ctx, "SELECT count(*) FROM chunks").Scan(&total); err != nil {
+		return nil, err
+	}
+	stmt, err := conn.PrepareContext(ctx, "SELECT documents FROM temp.chunks_fts_terms WHERE term = ? AND col = '*'")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	for term, tf := range counts {
+		var docs float64
+		err := stmt.QueryRowContext(ctx, term).Scan(&docs)
+		if errors.Is(err, sql.ErrNoRows) {
+			// not indexed yet, the chunk included
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if docs*2 >= total {
+			continue
+		}
+		out = append(out, similarTerm{Term: term, Weight: float64(tf) * math.Log(total/docs)})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Weight != out[j].Weight {
+			return out[i].Weight > out[j].Weight
+		}
+		return out[i].Term < out[j].Term
+	})
+	if len(out) > n {
+		out = out[:n]
+	}
+	for i := range out {
+		out[i].Weight = math.Round(out[i].Weight*1000) / 1000
+	}
+	return out, nil
+}
+
+// handleSimilar serves GET /chunks/{id}/similar.
+func (s *server) handleSimilar(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodGet {
+		httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	q := r.URL.Query()
+	k := similarK
+	if v := q.Get("k"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxSimilarK {
+			httpError(w, http.StatusBadRequest, fmt.Sprintf("k must be 1 to %d", maxSimilarK))
+			return
+		}
+		k = n
+	}
+	otherBooks := false
+	if v := q.Get("other_books"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, fmt.Sprintf("bad other_books %q", v))
+			return
+		}
+		otherBooks = b
+	}
+	rep, err := similarChunks(r.Context(), s.db, id, k, similarTerms, otherBooks)
+	switch {
+	case errors.Is(err, errNoChunk):
+		httpError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, errNoFTS):
+		httpError(w, http.StatusServiceUnavailable, err.Error())
+	case err != nil:
+		httpError(w, http.StatusInternalServerError, err.Error())
+	default:
+		writeJSON(w, http.StatusOK, rep)
+	}
+}
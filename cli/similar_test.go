@@ -0,0 +1,161 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestChunkTerms(t *testing.T) {
+	got := chunkTerms("The Héron, the HERON and the heron's nest: it was there in 1851, by the old mill-pond. Don't go!")
+	want := map[string]int{"heron": 2, "nest": 1, "old": 1, "mill": 1, "pond": 1}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("chunkTerms = %v, want %v", got, want)
+	}
+	if got := chunkTerms("It was as it is, and so on to the end of it."); len(got) != 1 || got["end"] != 1 {
+		t.Errorf("chunkTerms of common words = %v", got)
+	}
+}
+
+// similarLibrary is the chunks of three books, a few about herons and the
+// marsh among many of nothing much, and the ids of those about herons,
+// the first two of one book.
+func similarLibrary(t *testing.T) (*server, []int, int) {
+	t.Helper()
+	db := testDB(t)
+	var books []int
+	for _, title := range []string{"The Fens", "Broadland", "Downs"} {
+		books = append(books, addBook(t, db, title, "A. Walker", ""))
+	}
+	ordinal := 0
+	chunk := func(book int, text string) int {
+		t.Helper()
+		ordinal++
+		return insertChunk(t, db, books[book], ordinal, text)
+	}
+	herons := []int{
+		chunk(0, "The grey heron stood in the marsh, and the heron waited among the reeds for a fish."),
+		chunk(0, "At dusk a heron rose from the reeds and flew low over the marsh."),
+		chunk(1, "The heron and the bittern keep to the marsh, and are seldom seen."),
+		chunk(2, "A heron, they say, was once seen on the downs, far from water."),
+	}
+	for i := 0; i < 12; i++ {
+		chunk(i%3, fmt.Sprintf("It was a day like any other day, %d, and the time went by as time does.", i))
+	}
+	common := chunk(2, "It was a day, and the time went by.")
+	chunk(1, "Xylophones quiver.")
+	indexChunks(t, db)
+	return testServer(t, db), herons, common
+}
+
+func TestSimilarLexical(t *testing.T) {
+	s, herons, common := similarLibrary(t)
+	similar := func(args ...string) (string, error) {
+		t.Helper()
+		return captureStdout(t, func() error { return similarLexicalCmd(args) })
+	}
+
+	out, err := similar("--json", fmt.Sprint(herons[0]))
+	var rep similarReport
+	if err != nil || json.Unmarshal([]byte(out), &rep) != nil {
+		t.Fatalf("similar-lexical --json: %v, printing\n%s", err, out)
+	}
+	if len(rep.Terms) == 0 || rep.Terms[0].Term != "heron" {
+		t.Errorf("the chunk's terms are %+v, want heron first", rep.Terms)
+	}
+	for _, term := range rep.Terms {
+		if stopwords[term.Term] || term.Term == "day" || term.Term == "time" {
+			t.Errorf("the chunk is found by %q", term.Term)
+		}
+	}
+	var found []int
+	for i, r := range rep.Results {
+		found = append(found, r.ID)
+		if i > 0 && r.Score > rep.Results[i-1].Score {
+			t.Errorf("the results aren't best first: %+v", rep.Results)
+		}
+	}
+	// the other chunk of the marsh of the same book first, and never the
+	// chunk itself
+	if !reflect.DeepEqual(found, []int{herons[1], herons[2], herons[3]}) {
+		t.Errorf("similar-lexical found %v, want %v", found, herons[1:])
+	}
+	if r := rep.Results[0]; r.Title != "The Fens" || r.Author != "A. Walker" || !strings.Contains(r.Snippet, "[heron]") {
+		t.Errorf("the best result is %+v", r)
+	}
+
+	out, err = similar("--other-books", "--k", "1", fmt.Sprint(herons[0]))
+	if err != nil || !strings.HasPrefix(out, fmt.Sprintf("chunk %d, by heron, ", herons[0])) ||
+		!strings.Contains(out, fmt.Sprintf("\n%d\t", herons[2])) || strings.Count(out, ", by A. Walker\n") != 1 {
+		t.Errorf("similar-lexical --other-books --k 1: %v, printing\n%s", err, out)
+	}
+
+	// nothing to find others by, and nothing found by what there is
+	if out, err = similar(fmt.Sprint(common)); exitCode(err) != 1 || out != fmt.Sprintf("chunk %d has no words rare enough to find others by\n", common) {
+		t.Errorf("similar-lexical of common words: %v, printing\n%s", err, out)
+	}
+	if out, err = similar(fmt.Sprint(common + 1)); exitCode(err) != 1 || !strings.HasSuffix(out, "\nno chunks like it\n") {
+		t.Errorf("similar-lexical of words no other chunk has: %v, printing\n%s", err, out)
+	}
+
+	for _, args := range [][]string{{}, {"one"}, {"1", "2"}, {"--k", "0", "1"}, {"--k", "101", "1"}, {"--terms", "0", "1"}} {
+		if _, err = similar(args...); exitCode(err) != exitUsage {
+			t.Errorf("similar-lexical %s: %v, want a usage error", strings.Join(args, " "), err)
+		}
+	}
+	if _, err = similar("9999"); !errors.Is(err, errNoChunk) {
+		t.Errorf("similar-lexical of a chunk there isn't: %v", err)
+	}
+
+	get := func(method, path string) (*httptest.ResponseRecorder, similarReport) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		s.routes().ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		var rep similarReport
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &rep); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w, rep
+	}
+	if w, rep := get("GET", fmt.Sprintf("/chunks/%d/similar?k=2&other_books=1", herons[0])); w.Code != http.StatusOK ||
+		len(rep.Results) != 2 || rep.Results[0].ID != herons[2] || rep.Results[1].ID != herons[3] {
+		t.Errorf("GET /chunks/%d/similar?k=2&other_books=1: %d %s", herons[0], w.Code, w.Body)
+	}
+	if w, rep := get("GET", fmt.Sprintf("/chunks/%d/similar", common)); w.Code != http.StatusOK || len(rep.Terms) != 0 || len(rep.Results) != 0 {
+		t.Errorf("GET /chunks/%d/similar of common words: %d %s", common, w.Code, w.Body)
+	}
+	for path, code := range map[string]int{
+		"/chunks/9999/similar":                  http.StatusNotFound,
+		"/chunks/1/similar?k=0":                 http.StatusBadRequest,
+		"/chunks/1/similar?k=many":              http.StatusBadRequest,
+		"/chunks/1/similar?other_books=perhaps": http.StatusBadRequest,
+		"/chunks/1/similarly":                   http.StatusNotFound,
+	} {
+		if w, _ := get("GET", path); w.Code != code {
+			t.Errorf("GET %s: %d, want %d", path, w.Code, code)
+		}
+	}
+	if w, _ := get("POST", "/chunks/1/similar"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /chunks/1/similar: %d", w.Code)
+	}
+}
+
+func TestSimilarWithoutIndex(t *testing.T) {
+	db := testDB(t)
+	insertChunk(t, db, addBook(t, db, "The Fens", "", ""), 0, "The grey heron stood in the marsh.")
+	if _, err := captureStdout(t, func() error { return similarLexicalCmd([]string{"1"}) }); !errors.Is(err, errNoFTS) {
+		t.Errorf("similar-lexical without the index: %v", err)
+	}
+	w := httptest.NewRecorder()
+	testServer(t, db).routes().ServeHTTP(w, httptest.NewRequest("GET", "/chunks/1/similar", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET /chunks/1/similar without the index: %d %s", w.Code, w.Body)
+	}
+}
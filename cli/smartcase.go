@@ -0,0 +1,172 @@
+package cli
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Older etexts often give their names in capitals, Title: THE ADVENTURES
+// OF TOM SAWYER, and an attribution in them shouts. random, books, export
+// and serve take --smart-case, and the API ?smart_case=true, for names as
+// SmartCase has them; what is stored is left as it is.
+
+// smallWords stay lowercase in a title unless they start it, end it or
+// follow a colon.
+var smallWords = map[string]bool{
+	"a": true, "an": true, "and": true, "as": true, "at": true, "but": true, "by": true, "for": true,
+	"from": true, "in": true, "nor": true, "of": true, "on": true, "or": true, "the": true, "to": true, "with": true,
+}
+
+var romanNumeral = regexp.MustCompile(`^M{0,3}(CM|CD|D?C{0,3})(XC|XL|L?X{0,3})(IX|IV|V?I{0,3})$`)
+
+// ordinalWords are followed by a number, so a Roman numeral after one is
+// taken for one: "Part II", "Book IX".
+var ordinalWords = map[string]bool{
+	"act": true, "book": true, "canto": true, "chapter": true, "number": true, "no": true, "part": true,
+	"scene": true, "section": true, "series": true, "tome": true, "vol": true, "volume": true,
+}
+
+// regnalNames are those of kings, queens and popes, which a numeral after
+// is the number of: "Henry V", "Louis XIV".
+var regnalNames = map[string]bool{
+	"alexander": true, "alfonso": true, "anne": true, "benedict": true, "boniface": true, "carlos": true,
+	"catherine": true, "charles": true, "christian": true, "clement": true, "constantine": true,
+	"david": true, "edward": true, "elizabeth": true, "ferdinand": true, "francis": true, "frederick": true,
+	"george": true, "gregory": true, "gustavus": true, "henri": true, "henry": true, "innocent": true,
+	"ivan": true, "james": true, "john": true, "leo": true, "louis": true, "mary": true, "napoleon": true,
+	"nicholas": true, "otto": true, "peter": true, "philip": true, "pius": true, "ptolemy": true,
+	"richard": true, "robert": true, "urban": true, "victor": true, "william": true,
+}
+
+// SmartCase title-cases a title or author given in capitals, as
+// "THE LIFE OF KING HENRY V" to "The Life of King Henry V", and gives back
+// any other as it is. Only a name without a lowercase letter anywhere is
+// taken for shouting, so "McTeague" and "A History of the USA" are left
+// alone; and as a lone word of three letters or fewer, or one with dots
+// between its letters, is more likely an acronym than a shout, "USA" and
+// "R.U.R." are too. Shouting is lowercased and each word capitalized,
+// except the small words of English like "of" and "the" within it, and
+// "MCTEAGUE" becomes "McTeague" and "O'BRIEN" "O'Brien". "MAC" is left as
+// "Mac", as in "Machine" or "Macbeth", as there is no telling those from
+// "MacDonald". A Roman numeral stays in capitals where a number would be,
+// after one of ordinalWords or regnalNames or ending the name other than
+// after a small word, so "KING HENRY V" and "PART II" keep theirs and "THE
+// MIX OF CIVIL WAR" becomes "The Mix of Civil War".
+func SmartCase(s string) string {
+	if !shouting(s) {
+		return s
+	}
+	words := wordPattern.FindAllStringIndex(s, -1)
+	var b strings.Builder
+	at := 0
+	// the first word, and the first after a colon or a dash
+	first := true
+	// the word before, in lowercase without its punctuation
+	prev := ""
+	for i, loc := range words {
+		b.WriteString(s[at:loc[0]])
+		w := s[loc[0]:loc[1]]
+		parts := strings.Split(w, "-")
+		for j, part := range parts {
+			if j > 0 {
+				b.WriteByte('-')
+			}
+			lastWord := i == len(words)-1 && j == len(parts)-1
+			numeral := ordinalWords[prev] || regnalNames[prev] || lastWord && prev != "" && !smallWords[prev]
+			b.WriteString(caseWord(part, !(first && j == 0) && !lastWord, numeral))
+			prev = strings.ToLower(wordCore(part))
+		}
+		first = strings.HasSuffix(w, ":") || strings.HasSuffix(w, ";") || w == "—" || w == "--"
+		at = loc[1]
+	}
+	b.WriteString(s[at:])
+	return b.String()
+}
+
+var wordPattern = regexp.MustCompile(`\S+`)
+
+// shouting reports whether s is a name in capitals, as SmartCase takes it.
+func shouting(s string) bool {
+	letters := 0
+	for _, r := range s {
+		if unicode.IsLower(r) {
+			return false
+		}
+		if unicode.IsLetter(r) {
+			letters++
+		}
+	}
+	if letters == 0 {
+		return false
+	}
+	if f := strings.Fields(s); len(f) == 1 {
+		return letters > 3 && !dotted(f[0])
+	}
+	return true
+}
+
+// dotted reports whether w is letters with dots between them, like U.S.A.
+func dotted(w string) bool {
+	return strings.Contains(strings.Trim(w, "."), ".")
+}
+
+// wordBounds is where the letters and digits of w start and end, within
+// any punctuation around them; -1 and -1 without any.
+func wordBounds(w string) (int, int) {
+	start := strings.IndexFunc(w, isWordRune)
+	if start < 0 {
+		return -1, -1
+	}
+	end := strings.LastIndexFunc(w, isWordRune)
+	_, n := utf8.DecodeRuneInString(w[end:])
+	return start, end + n
+}
+
+// wordCore is w without the punctuation around it.
+func wordCore(w string) string {
+	start, end := wordBounds(w)
+	if start < 0 {
+		return ""
+	}
+	return w[start:end]
+}
+
+// caseWord cases one word of shouting, w with any punctuation around it,
+// in lowercase if small and it is one of smallWords, and in capitals if
+// numeral and it is a Roman numeral.
+func caseWord(w string, small, numeral bool) string {
+	start, end := wordBounds(w)
+	if start < 0 {
+		return w
+	}
+	core := w[start:end]
+	lower := strings.ToLower(core)
+	switch {
+	case numeral && romanNumeral.MatchString(core) || dotted(core):
+		// left in capitals
+	case small && smallWords[lower]:
+		core = lower
+	case strings.HasPrefix(lower, "mc") && utf8.RuneCountInString(lower) > 3:
+		core = "Mc" + capitalize(lower[2:])
+	default:
+		core = capitalize(lower)
+		// O'Brien and D'Artagnan, not I'Ll
+		if i := strings.IndexAny(core, "'’"); i > 0 && utf8.RuneCountInString(core[:i]) == 1 {
+			_, n := utf8.DecodeRuneInString(core[i:])
+			if rest := core[i+n:]; utf8.RuneCountInString(rest) >= 3 {
+				core = core[:i+n] + capitalize(rest)
+			}
+		}
+	}
+	return w[:start] + core + w[end:]
+}
+
+func capitalize(s string) string {
+	r, n := utf8.DecodeRuneInString(s)
+	if n == 0 {
+		return s
+	}
+	return string(unicode.ToUpper(r)) + s[n:]
+}
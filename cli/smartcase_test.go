@@ -0,0 +1,59 @@
+package cli
+
+import "testing"
+
+func TestSmartCase(t *testing.T) {
+	for _, c := range []struct{ in, want string }{
+		// shouting
+		{"THE ADVENTURES OF TOM SAWYER", "The Adventures of Tom Sawyer"},
+		{"PRIDE AND PREJUDICE", "Pride and Prejudice"},
+		{"OF MICE AND MEN", "Of Mice and Men"},
+		{"WHAT THE WIND IS FOR", "What the Wind Is For"},
+		{"THE WAR: A HISTORY", "The War: A History"},
+		{"TWENTY THOUSAND LEAGUES UNDER THE SEA", "Twenty Thousand Leagues Under the Sea"},
+		{"LOOKING-GLASS", "Looking-Glass"},
+		{"O'BRIEN", "O'Brien"},
+		{"I'LL TELL YOU", "I'll Tell You"},
+		{"TWAIN, MARK", "Twain, Mark"},
+		{"R.U.R. AND OTHER PLAYS", "R.U.R. and Other Plays"},
+
+		// mixed case, and what is more likely an acronym, are left alone
+		{"McTeague", "McTeague"},
+		{"A History of the USA", "A History of the USA"},
+		{"USA", "USA"},
+		{"R.U.R.", "R.U.R."},
+		{"the iliad", "the iliad"},
+		{"1984", "1984"},
+
+		// Mc and Mac
+		{"MCTEAGUE", "McTeague"},
+		{"THE MCCOYS", "The McCoys"},
+		{"MACBETH", "Macbeth"},
+		{"MACDONALD, GEORGE", "Macdonald, George"},
+		{"MC", "MC"},
+
+		// Roman numerals where a number would be
+		{"THE LIFE OF KING HENRY V", "The Life of King Henry V"},
+		{"KING RICHARD III", "King Richard III"},
+		{"LOUIS XIV AND HIS COURT", "Louis XIV and His Court"},
+		{"HISTORY OF ENGLAND, VOLUME IV", "History of England, Volume IV"},
+		{"THE IDIOT, PART II", "The Idiot, Part II"},
+		{"BOOK IX: THE RETURN", "Book IX: The Return"},
+		{"PARADISE LOST, BOOK XII", "Paradise Lost, Book XII"},
+		{"THE GREAT WAR XI", "The Great War XI"},
+		{"POPE PIUS IX", "Pope Pius IX"},
+
+		// and words that only look like them
+		{"THE MIX OF CIVIL WAR", "The Mix of Civil War"},
+		{"DIX AND HIS DOG", "Dix and His Dog"},
+		{"A VIVID LIFE", "A Vivid Life"},
+		{"THE MIX", "The Mix"},
+		{"LIV ULLMANN", "Liv Ullmann"},
+		{"CIVIL DISOBEDIENCE", "Civil Disobedience"},
+		{"MILD AND DIM", "Mild and Dim"},
+	} {
+		if got := SmartCase(c.in); got != c.want {
+			t.Errorf("SmartCase(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
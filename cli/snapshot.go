@@ -0,0 +1,107 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// An export of the whole library takes hours, and a chunk run writing
+// meanwhile leaves it with some books as they were before the run and
+// some as they were after. export --snapshot reads everything in one read
+// transaction, so it is the database as it was when the export began
+// however long it takes. That needs the database, and its shards, in wal
+// mode, where a reader doesn't hold off writers: in the rollback journal
+// modes the transaction would keep every write waiting until the export
+// was done, so --snapshot refuses to start. Without it export reads as
+// the database goes, and warns at the end if anything was written in the
+// meantime, by PRAGMA data_version going up.
+
+// schemas are the databases a connection has chunks in: main and the
+// shards attached.
+func schemas() []string {
+	s := []string{"main"}
+	for i := 0; i < chunkShards; i++ {
+		s = append(s, shardName(i))
+	}
+	return s
+}
+
+// readSnapshot begins a transaction on db that reads it as it is now until
+// it is rolled back, the shards too.
+func readSnapshot(db *sql.DB) (*sql.Tx, error) {
+	for _, s := range schemas() {
+		var mode string
+		if err := db.QueryRow(fmt.Sprintf("PRAGMA %s.journal_mode", s)).Scan(&mode); err != nil {
+			return nil, err
+		}
+		if !strings.EqualFold(mode, "wal") {
+			return nil, usagef("--snapshot needs the database in wal mode: %s is in %s mode, where reading it in one transaction would hold off every write until the export is done", s, mode)
+		}
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	// sqlite takes a database's snapshot when the transaction first reads
+	// it, so each is read now rather than when the export gets to it
+	for _, s := range schemas() {
+		var n int
+		if err = tx.QueryRow(fmt.Sprintf("SELECT count(*) FROM %s.sqlite_master", s)).Scan(&n); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	return tx, nil
+}
+
+// writeWatch tells whether anything was written to the database since it
+// was made, by other connections, this process's or another's.
+type writeWatch struct {
+	conn  *sql.Conn
+	since []int64
+}
+
+func watchWrites(db *sql.DB) (*writeWatch, error) {
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	w := &writeWatch{conn: conn}
+	if w.since, err = w.versions(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// versions is each schema's data_version, which goes up on a connection
+// whenever another commits a write.
+func (w *writeWatch) versions() ([]int64, error) {
+	var vs []int64
+	for _, s := range schemas() {
+		var v int64
+		if err := w.conn.QueryRowContext(context.Background(), fmt.Sprintf("PRAGMA %s.data_version", s)).Scan(&v); err != nil {
+			return nil, err
+		}
+		vs = append(vs, v)
+	}
+	return vs, nil
+}
+
+// written reports whether anything was written since watchWrites, and lets
+// go of w's connection.
+func (w *writeWatch) written() (bool, error) {
+	defer w.conn.Close()
+	now, err := w.versions()
+	if err != nil {
+		return false, err
+	}
+	for i := range now {
+		if now[i] != w.since[i] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,145 @@
+package cli
+
+import (
+	"bufio"
+	"database/sql"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exportWhileWriting exports the library with args, and once the first
+// chunk is out, while the rest are still to come, rewrites every chunk's
+// v1 as v2 from another connection. It gives the lines exported after the
+// provenance and what export printed on stderr.
+func exportWhileWriting(t *testing.T, db *sql.DB, args ...string) ([]string, string) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	was := os.Stdout
+	os.Stdout = w
+	done := make(chan error, 1)
+	var stderr string
+	go func() {
+		var err error
+		stderr, _ = captureStderr(t, func() error {
+			err = exportCmd(args)
+			return nil
+		})
+		w.Close()
+		done <- err
+	}()
+	defer func() { os.Stdout = was }()
+
+	in := bufio.NewReaderSize(r, 1<<20)
+	var lines []string
+	read := func() bool {
+		line, err := in.ReadString('\n')
+		if err != nil {
+			return false
+		}
+		if !strings.Contains(line, `"gutchunk_provenance"`) {
+			lines = append(lines, line)
+		}
+		return true
+	}
+	for len(lines) == 0 && read() {
+	}
+	// the export is held up on the pipe, and a writer isn't on it
+	wrote := make(chan error, 1)
+	go func() {
+		_, err := db.Exec("UPDATE chunks SET chunk = replace(chunk, 'v1', 'v2')")
+		wrote <- err
+	}()
+	select {
+	case err = <-wrote:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the write waited on the export")
+	}
+	for read() {
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	return lines, stderr
+}
+
+func TestSnapshotExport(t *testing.T) {
+	// chunks enough, and long enough, that the export can't be done
+	// before the pipe it writes to is read
+	db := testFileDB(t)
+	book := addBook(t, db, "Clarissa", "Samuel Richardson", "")
+	if _, err := db.Exec(`
+		WITH RECURSIVE n(i) AS (SELECT 0 UNION ALL SELECT i + 1 FROM n WHERE i < 1499)
+		INSERT INTO chunks (id, sourceid, ordinal, chunk) SELECT i + 1, ?, i, 'v1 ' || printf('%.2000c', 'x') FROM n`, book); err != nil {
+		t.Fatal(err)
+	}
+	versions := func(lines []string) (v1, v2 int) {
+		for _, line := range lines {
+			if strings.Contains(line, `"v1 x`) {
+				v1++
+			} else if strings.Contains(line, `"v2 x`) {
+				v2++
+			}
+		}
+		return v1, v2
+	}
+
+	lines, stderr := exportWhileWriting(t, db, "--snapshot")
+	if v1, v2 := versions(lines); len(lines) != 1500 || v1 != 1500 || v2 != 0 {
+		t.Errorf("export --snapshot wrote %d chunks, %d from before the write and %d from after", len(lines), v1, v2)
+	}
+	if stderr != "" {
+		t.Errorf("export --snapshot warned: %s", stderr)
+	}
+
+	// without, what's read after the write is as the write left it
+	if _, err := db.Exec("UPDATE chunks SET chunk = replace(chunk, 'v2', 'v1')"); err != nil {
+		t.Fatal(err)
+	}
+	lines, stderr = exportWhileWriting(t, db)
+	if v1, v2 := versions(lines); len(lines) != 1500 || v1 == 0 || v2 == 0 {
+		t.Errorf("export wrote %d chunks, %d from before the write and %d from after", len(lines), v1, v2)
+	}
+	if !strings.Contains(stderr, "warning: the database was written to during the export") {
+		t.Errorf("export with a write during it warned %q", stderr)
+	}
+	if stderr, _ = captureStderr(t, func() error {
+		_, err := captureStdout(t, func() error { return exportCmd(nil) })
+		return err
+	}); stderr != "" {
+		t.Errorf("export with no write during it warned %q", stderr)
+	}
+}
+
+func TestWatchWrites(t *testing.T) {
+	db := testFileDB(t)
+	w, err := watchWrites(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written, err := w.written(); err != nil || written {
+		t.Errorf("with nothing written, written() = %v, %v", written, err)
+	}
+	if w, err = watchWrites(db); err != nil {
+		t.Fatal(err)
+	}
+	addBook(t, db, "Pamela", "Samuel Richardson", "")
+	if written, err := w.written(); err != nil || !written {
+		t.Errorf("with a book added, written() = %v, %v", written, err)
+	}
+}
+
+func TestSnapshotNeedsWAL(t *testing.T) {
+	testDB(t)
+	_, err := captureStdout(t, func() error { return exportCmd([]string{"--snapshot"}) })
+	if exitCode(err) != exitUsage || !strings.Contains(err.Error(), "--snapshot needs the database in wal mode: main is in") {
+		t.Errorf("export --snapshot of a database not in wal mode: %v", err)
+	}
+}
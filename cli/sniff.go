@@ -0,0 +1,69 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const sniffLen = 8192
+
+// Sniff is SniffText's verdict on a member's content.
+type Sniff struct {
+	// Binary is set when the content is not text at all; Reason says why.
+	Binary bool
+	Reason string
+	// NULs counts NUL bytes in the whole content.
+	NULs int
+}
+
+var binaryMagic = []struct {
+	prefix []byte
+	kind   string
+}{
+	{[]byte("\x89PNG\r\n\x1a\n"), "png image"},
+	{[]byte("GIF87a"), "gif image"},
+	{[]byte("GIF89a"), "gif image"},
+	{[]byte("\xff\xd8\xff"), "jpeg image"},
+	{[]byte("%PDF-"), "pdf"},
+	{[]byte("PK\x03\x04"), "zip archive"},
+	{[]byte("ID3"), "mp3 audio"},
+	{[]byte("RIFF"), "riff audio or video"},
+}
+
+// SniffText looks at the first few KB of b and decides whether it is text.
+// Anything with a known binary signature, or where more than one byte in ten
+// is a control character other than the usual whitespace or NUL, is binary. Bytes
+// above 0x7f are never counted against it since both latin-1 and utf-8 use
+// them. NULs are counted over all of b so callers can strip or reject them.
+func SniffText(b []byte) Sniff {
+	s := Sniff{NULs: bytes.Count(b, []byte{0})}
+
+	head := b
+	if len(head) > sniffLen {
+		head = head[:sniffLen]
+	}
+	for _, m := range binaryMagic {
+		if bytes.HasPrefix(head, m.prefix) {
+			s.Binary = true
+			s.Reason = m.kind
+			return s
+		}
+	}
+
+	odd := 0
+	for _, c := range head {
+		switch {
+		case c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v':
+		// ^Z ends many old DOS era etexts; NULs are left to the caller
+		case c == 0x1a || c == 0:
+		case c < 0x20 || c == 0x7f:
+			odd++
+		}
+	}
+	if len(head) > 0 && odd*10 > len(head) {
+		s.Binary = true
+		s.Reason = fmt.Sprintf("%d of the first %d bytes are control characters", odd, len(head))
+	}
+
+	return s
+}
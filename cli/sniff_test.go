@@ -0,0 +1,127 @@
+package cli
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// pngBytes is a small image as png encodes it, to be renamed to .txt.
+func pngBytes(t *testing.T) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	if err := png.Encode(&b, image.NewGray(image.Rect(0, 0, 16, 16))); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestSniffText(t *testing.T) {
+	text, err := os.ReadFile(filepath.Join("testdata", "encoding", "quotes.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	latin1, err := os.ReadFile(filepath.Join("testdata", "encoding", "latin1.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nuls := []byte(strings.Repeat("It was a dark\x00 and stormy night.\r\n", 100))
+	picture := pngBytes(t)
+	control := bytes.Repeat([]byte{0x01, 0x02, 'a', 0x1b}, 100)
+
+	for _, c := range []struct {
+		name   string
+		b      []byte
+		binary bool
+		reason string
+		nuls   int
+	}{
+		{"text", text, false, "", 0},
+		{"latin-1", latin1, false, "", 0},
+		{"dos end of file", append([]byte("The End.\r\n"), 0x1a), false, "", 0},
+		{"empty", nil, false, "", 0},
+		{"png renamed to .txt", picture, true, "png image", bytes.Count(picture, []byte{0})},
+		{"nul laced", nuls, false, "", 100},
+		{"control characters", control, true, "300 of the first 400 bytes are control characters", 0},
+	} {
+		s := SniffText(c.b)
+		if s.Binary != c.binary || s.Reason != c.reason || s.NULs != c.nuls {
+			t.Errorf("%s: %+v, want binary %v, reason %q, %d NULs", c.name, s, c.binary, c.reason, c.nuls)
+		}
+	}
+
+	// NULs past the sniffed head are still counted
+	late := append(bytes.Repeat([]byte("a"), 2*sniffLen), 0, 0)
+	if s := SniffText(late); s.NULs != 2 {
+		t.Errorf("%d NULs counted past the head, want 2", s.NULs)
+	}
+}
+
+func TestIngestRejections(t *testing.T) {
+	for _, reject := range []bool{false, true} {
+		root := t.TempDir()
+		writeTestZip(t, filepath.Join(root, "1.zip"), zipEntry{"1.txt", string(pngBytes(t))})
+		laced := strings.Replace(testBook("Laced", testParagraphs(2)), "paragraph", "para\x00graph", -1)
+		writeTestZip(t, filepath.Join(root, "2.zip"), zipEntry{"2.txt", laced})
+		db := testDB(t)
+		if err := readFiles(db, root, ingestOptions{rejectNULs: reject}); err != nil {
+			t.Fatal(err)
+		}
+
+		codes := map[string]string{}
+		rows, err := db.Query("SELECT member, code FROM warnings WHERE scope = ?", scopeIngest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			var member, code string
+			if err = rows.Scan(&member, &code); err != nil {
+				t.Fatal(err)
+			}
+			codes[member] = code
+		}
+		rows.Close()
+		if codes["1.txt"] != "binary" {
+			t.Errorf("the png renamed to .txt was warned of as %q, want binary", codes["1.txt"])
+		}
+
+		var content string
+		err = db.QueryRow("SELECT content FROM files WHERE name = 'Laced'").Scan(&content)
+		switch {
+		case reject:
+			if codes["2.txt"] != "nul" {
+				t.Errorf("with --nul reject the NUL laced member was warned of as %q, want nul", codes["2.txt"])
+			}
+			if err == nil {
+				t.Error("with --nul reject the NUL laced member was stored")
+			}
+		case err != nil:
+			t.Errorf("the NUL laced member wasn't stored: %v", err)
+		case strings.Contains(content, "\x00") || !strings.Contains(content, "paragraph"):
+			t.Error("the NULs weren't stripped from what was stored")
+		}
+	}
+}
+
+func TestScanNameAuthorBounded(t *testing.T) {
+	var b bytes.Buffer
+	for i := 0; i < 10000; i++ {
+		b.WriteString("line after line of front matter\n")
+	}
+	b.WriteString("Title: Too Late\n")
+	title, _, cut := scanNameAuthor(b, defaultHeaderLines)
+	if title != "" || !cut {
+		t.Errorf("the scan found %q, cut %v; want it to stop at %d lines", title, cut, defaultHeaderLines)
+	}
+
+	// nor is one line read whole
+	b.Reset()
+	b.WriteString(strings.Repeat("x", 200000) + "\nTitle: Too Late\n")
+	if title, _, cut = scanNameAuthor(b, 10); title != "" || !cut {
+		t.Errorf("the scan found %q past a long line, cut %v", title, cut)
+	}
+}
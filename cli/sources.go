@@ -0,0 +1,80 @@
+package cli
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// ensureSource returns the id of the source labelled label, recording root
+// for it if it is new.
+func ensureSource(db *sql.DB, root, label string) (int, error) {
+	var id int
+	err := db.QueryRow("SELECT id FROM sources WHERE label = ?", label).Scan(&id)
+	if err == nil {
+		return id, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+	res, err := db.Exec("INSERT INTO sources (root, label, created_at) VALUES (?, ?, datetime('now'))", root, label)
+	if err != nil {
+		return 0, fmt.Errorf("could not record source: %w", err)
+	}
+	n, err := res.LastInsertId()
+	return int(n), err
+}
+
+// lookupSource returns the id of an existing source, for commands filtering
+// by --source.
+func lookupSource(db *sql.DB, label string) (int, error) {
+	var id int
+	err := db.QueryRow("SELECT id FROM sources WHERE label = ?", label).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("no source labelled %q", label)
+	}
+	return id, err
+}
+
+// sourceConflict decides what to do with a book about to be ingested from
+// source when a book of the same filename came from another one, saying
+// why it is skipped, or "" when it isn't. Identical content is a duplicate
+// and is skipped quietly; different content is recorded in
+// source_conflicts, once, and skipped, leaving the earlier copy alone. Rows from
+// before sources were tracked count as another source.
+func sourceConflict(tx *sql.Tx, source int, filename, archive, content string) (string, error) {
+	// books stored without their content still have its hash
+	rows, err := tx.Query("SELECT id, coalesce(content = ?, content_hash = ?, 0) FROM files WHERE filename = ? AND coalesce(source_id, 0) != ?",
+		content, textHash(content), filename, source)
+	if err != nil {
+		return "", err
+	}
+	other := 0
+	for rows.Next() {
+		var id int
+		var same bool
+		if err = rows.Scan(&id, &same); err != nil {
+			rows.Close()
+			return "", err
+		}
+		if same {
+			rows.Close()
+			return "already have it from another source", nil
+		}
+		if other == 0 {
+			other = id
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || other == 0 {
+		return "", err
+	}
+
+	// once, however often the source is ingested again
+	_, err = tx.Exec(`
+		INSERT INTO source_conflicts (filename, file_id, source_id, archive_path, created_at)
+		SELECT ?, ?, ?, ?, datetime('now')
+		WHERE NOT EXISTS (SELECT 1 FROM source_conflicts WHERE filename = ? AND file_id = ? AND source_id = ?)`,
+		filename, other, source, archive, filename, other, source)
+	return fmt.Sprintf("conflict: differs from book %d from another source, keeping that one", other), err
+}
@@ -0,0 +1,115 @@
+package cli
+
+import (
+	"bytes"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// ingestLabelled ingests root as ingest --source-label label would,
+// returning the source's id.
+func ingestLabelled(t *testing.T, db *sql.DB, root, label string) int {
+	t.Helper()
+	id, err := ensureSource(db, root, label)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = readFiles(db, root, ingestOptions{sourceID: id}); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestLabelledIngests(t *testing.T) {
+	emma, persuasion := testBook("Emma", testParagraphs(2)), testBook("Persuasion", testParagraphs(3))
+	a, b := t.TempDir(), t.TempDir()
+	writeTestZip(t, filepath.Join(a, "1.zip"), zipEntry{"1.txt", emma})
+	writeTestZip(t, filepath.Join(a, "2.zip"), zipEntry{"2.txt", persuasion})
+	// the second mirror has one book the same, one changed and one new
+	writeTestZip(t, filepath.Join(b, "1.zip"), zipEntry{"1.txt", strings.Replace(emma, "weather", "season", 1)})
+	writeTestZip(t, filepath.Join(b, "2.zip"), zipEntry{"2.txt", persuasion})
+	writeTestZip(t, filepath.Join(b, "3.zip"), zipEntry{"3.txt", testBook("Villette", testParagraphs(4))})
+
+	db := testDB(t)
+	first := ingestLabelled(t, db, a, "mirror a, 2024-01")
+	second := ingestLabelled(t, db, b, "mirror b, 2024-06")
+	if again := ingestLabelled(t, db, b, "mirror b, 2024-06"); again != second {
+		t.Errorf("the same label was given source %d, then %d", second, again)
+	}
+
+	bySource := map[string]int{}
+	rows, err := db.Query("SELECT name, source_id FROM files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var name string
+		var source int
+		if err = rows.Scan(&name, &source); err != nil {
+			t.Fatal(err)
+		}
+		bySource[name] = source
+	}
+	rows.Close()
+	want := map[string]int{"Emma": first, "Persuasion": first, "Villette": second}
+	if len(bySource) != len(want) {
+		t.Errorf("books %v, want %v", bySource, want)
+	}
+	for name, source := range want {
+		if bySource[name] != source {
+			t.Errorf("%s is from source %d, want %d", name, bySource[name], source)
+		}
+	}
+
+	var filename string
+	var fileID, source, conflicts int
+	if err = db.QueryRow("SELECT count(*), max(filename), max(file_id), max(source_id) FROM source_conflicts").Scan(&conflicts, &filename, &fileID, &source); err != nil {
+		t.Fatal(err)
+	}
+	var emmaID int
+	if err = db.QueryRow("SELECT id FROM files WHERE name = 'Emma'").Scan(&emmaID); err != nil {
+		t.Fatal(err)
+	}
+	if conflicts != 1 || filename != "1.txt" || fileID != emmaID || source != second {
+		t.Errorf("%d conflicts, the last of %s, book %d, source %d; want the changed Emma from source %d against book %d", conflicts, filename, fileID, source, second, emmaID)
+	}
+
+	// stats and export by source
+	if err = makeChunks(db, chunkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		source, books, chunks int
+	}{{first, 2, 5}, {second, 1, 4}, {0, 3, 9}} {
+		st, err := libraryCounts(db, c.source, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Books != c.books || st.Chunks != c.chunks {
+			t.Errorf("stats of source %d: %d books of %d chunks, want %d of %d", c.source, st.Books, st.Chunks, c.books, c.chunks)
+		}
+		var buf bytes.Buffer
+		if err = exportChunks(db, &buf, exportOptions{source: c.source}); err != nil {
+			t.Fatal(err)
+		}
+		if n := strings.Count(buf.String(), "\n"); n != c.chunks {
+			t.Errorf("export of source %d wrote %d chunks, want %d", c.source, n, c.chunks)
+		}
+	}
+}
+
+func TestLookupSource(t *testing.T) {
+	db := testDB(t)
+	id, err := ensureSource(db, "/mnt/mirror", "mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := lookupSource(db, "mirror"); err != nil || got != id {
+		t.Errorf("lookupSource = %d, %v, want %d", got, err, id)
+	}
+	if _, err := lookupSource(db, "elsewhere"); err == nil || !strings.Contains(err.Error(), `no source labelled "elsewhere"`) {
+		t.Errorf("lookupSource of an unknown label: %v", err)
+	}
+}
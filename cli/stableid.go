@@ -0,0 +1,325 @@
+package cli
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A chunk's id is its row's, and a book chunked again gets new ones for
+// the chunks it cuts differently (see rechunk.go), or for all of them with
+// --full-rechunk, so an id kept outside gutchunk, in an index or a
+// citation, can go stale. chunks.stable_id is an id for the chunk that a re-chunk
+// giving the same text gives again: made of the book's ebook number, or
+// its own id without one, the chunking strategy that cut it (see
+// strategy), and the sha256 of its text with its runs of white space made
+// single spaces, counting the earlier chunks of the book with the same
+// text in, so two like paragraphs of a book have ids of their own. A new
+// version of a book takes over the stable ids of the chunks of the old one
+// it shares. A chunk a re-chunk changed, an edited paragraph say, gets a
+// new stable id, and stable_id_map keeps what it was: the chunks of the
+// old run left without their ids are paired, in order, with the new chunks
+// between the same unchanged ones, and the map points each old id at its
+// pair's. gutchunk stable-ids gives the chunks written before stable ids
+// were kept theirs, taken to be of the default strategy, and --resolve
+// looks ids up, old ones through the map. export and the api's chunk
+// responses give each chunk's stable_id with its id.
+
+// strategy names what of opts decides where a book's chunks start and
+// end, the name its strategy gives itself (see strategy.go).
+func (opts chunkOptions) strategy() string {
+	return opts.chunkStrategy().Name()
+}
+
+// defaultStrategy is the strategy chunk cuts with given no flags.
+var defaultStrategy = chunkOptions{}.strategy()
+
+// stableScope is what the stable ids of a book's chunks are made of in
+// place of the book: its ebook number, or its id without one.
+func stableScope(id, ebook int) string {
+	if ebook > 0 {
+		return fmt.Sprintf("pg%d", ebook)
+	}
+	return fmt.Sprintf("book%d", id)
+}
+
+// stableIDs are the stable ids of the chunks of a book, in order.
+func stableIDs(scope, strategy string, chunks []string) []string {
+	ids := make([]string, len(chunks))
+	seen := map[string]int{}
+	for i, c := range chunks {
+		h := textHash(strings.Join(strings.Fields(c), " "))
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%s\x00%d", scope, strategy, h, seen[h])))
+		seen[h]++
+		ids[i] = scope + "-" + hex.EncodeToString(sum[:10])
+	}
+	return ids
+}
+
+// stableMoves pairs the ids of old, a book's chunks' stable ids as they
+// were, "" for none, that new, as they are now, has no more, with those of
+// new that old hadn't, each run of them between two chunks both have with
+// the run of new ones between the same two, in order. Old ones past the
+// end of their run of new ones go to its last; a run of old ones with no
+// new ones was taken out, and goes nowhere.
+func stableMoves(old, new []string) [][2]string {
+	inNew, inOld := map[string]int{}, map[string]bool{}
+	for i, id := range new {
+		inNew[id] = i
+	}
+	for _, id := range old {
+		inOld[id] = true
+	}
+	// the chunks both have, in the order of both
+	type anchor struct{ o, n int }
+	anchors := []anchor{{-1, -1}}
+	for o, id := range old {
+		if n, ok := inNew[id]; ok && id != "" && n > anchors[len(anchors)-1].n {
+			anchors = append(anchors, anchor{o, n})
+		}
+	}
+	anchors = append(anchors, anchor{len(old), len(new)})
+	var moves [][2]string
+	for i := 1; i < len(anchors); i++ {
+		a, b := anchors[i-1], anchors[i]
+		var gone, made []string
+		for _, id := range old[a.o+1 : b.o] {
+			if _, ok := inNew[id]; !ok && id != "" {
+				gone = append(gone, id)
+			}
+		}
+		for _, id := range new[a.n+1 : b.n] {
+			if !inOld[id] {
+				made = append(made, id)
+			}
+		}
+		for j, id := range gone {
+			if len(made) == 0 {
+				break
+			}
+			if j >= len(made) {
+				j = len(made) - 1
+			}
+			moves = append(moves, [2]string{id, made[j]})
+		}
+	}
+	return moves
+}
+
+// bookStableIDs reads the stable ids book id's chunks have, in order.
+func bookStableIDs(tx *sql.Tx, id int) ([]string, error) {
+	rows, err := tx.Query("SELECT coalesce(stable_id, '') FROM chunks WHERE sourceid = ? ORDER BY ordinal, id", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var s string
+		if err = rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		ids = append(ids, s)
+	}
+	return ids, rows.Err()
+}
+
+// newStableIDs gives the stable ids of chunks, book id's chunks to be as
+// cut by strategy, returning them and what records, once they are
+// written, the moves from the ids the chunks there were had.
+func newStableIDs(tx *sql.Tx, id int, strategy string, chunks []string) ([]string, func() error, error) {
+	var ebook int
+	if err := tx.QueryRow("SELECT coalesce(ebook, 0) FROM files WHERE id = ?", id).Scan(&ebook); err != nil {
+		return nil, nil, err
+	}
+	old, err := bookStableIDs(tx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	ids := stableIDs(stableScope(id, ebook), strategy, chunks)
+	list, _ := json.Marshal(ids)
+	// the old version of a book gives up those it shares with the new
+	if _, err = tx.Exec("UPDATE chunks SET stable_id = NULL WHERE stable_id IN (SELECT value FROM json_each(?)) AND sourceid != ?", string(list), id); err != nil {
+		return nil, nil, err
+	}
+	record := func() error {
+		// ids made again are no longer moved
+		if _, err := tx.Exec("DELETE FROM stable_id_map WHERE old_id IN (SELECT value FROM json_each(?))", string(list)); err != nil {
+			return err
+		}
+		for _, m := range stableMoves(old, ids) {
+			// what moved to the old id moves on with it
+			if _, err := tx.Exec("UPDATE stable_id_map SET new_id = ? WHERE new_id = ?", m[1], m[0]); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`INSERT OR REPLACE INTO stable_id_map (old_id, new_id, sourceid, run_id, created_at)
+				VALUES (?, ?, ?, ?, datetime('now'))`, m[0], m[1], id, nullInt64(currentRun)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return ids, record, nil
+}
+
+func stableIDsCmd(args []string) error {
+	fs := flag.NewFlagSet("stable-ids", flag.ExitOnError)
+	resolve := fs.Bool("resolve", false, "look up the stable ids given, old ones through the ids they moved to, instead")
+	fs.Parse(args)
+
+	if *resolve != (fs.NArg() > 0) {
+		return usagef("usage: gutchunk stable-ids [--resolve STABLE_ID...]")
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if *resolve {
+		return resolveStableIDs(db, fs.Args())
+	}
+	books, chunks, err := fillStableIDs(db)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("gave %d chunks of %d books stable ids\n", chunks, books)
+	return nil
+}
+
+// resolveStableIDs prints the chunk each of ids names now.
+func resolveStableIDs(db *sql.DB, ids []string) error {
+	missing := 0
+	for _, sid := range ids {
+		current := sid
+		var moved string
+		err := db.QueryRow("SELECT new_id FROM stable_id_map WHERE old_id = ?", sid).Scan(&moved)
+		if err == nil {
+			current = moved
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		var id, book int
+		err = db.QueryRow("SELECT id, sourceid FROM chunks WHERE stable_id = ?", current).Scan(&id, &book)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			missing++
+			if current != sid {
+				fmt.Printf("%s: moved to %s, which no chunk has\n", sid, current)
+			} else {
+				fmt.Printf("%s: no chunk has it\n", sid)
+			}
+		case err != nil:
+			return err
+		case current != sid:
+			fmt.Printf("%s: moved to %s, chunk %d of book %d\n", sid, current, id, book)
+		default:
+			fmt.Printf("%s: chunk %d of book %d\n", sid, id, book)
+		}
+	}
+	if missing > 0 {
+		return exitStatus(1)
+	}
+	return nil
+}
+
+// fillStableIDs gives the chunks of every book with any chunks without
+// stable ids theirs, as the default strategy cuts them, the current
+// versions of books first so they keep those an old one shares, a book to
+// a transaction, returning how many books and chunks it gave them.
+func fillStableIDs(db *sql.DB) (int, int, error) {
+	rows, err := db.Query(`SELECT f.id, coalesce(f.ebook, 0) FROM files f
+		WHERE EXISTS (SELECT 1 FROM chunks c WHERE c.sourceid = f.id AND c.stable_id IS NULL)
+		ORDER BY f.superseded_by IS NOT NULL, f.id`)
+	if err != nil {
+		return 0, 0, err
+	}
+	type book struct{ id, ebook int }
+	var todo []book
+	for rows.Next() {
+		var b book
+		if err = rows.Scan(&b.id, &b.ebook); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		todo = append(todo, b)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	books, chunks := 0, 0
+	shown := time.Now()
+	for _, b := range todo {
+		if err = runCtx.Err(); err != nil {
+			return books, chunks, err
+		}
+		n, err := fillBookStableIDs(db, b.id, b.ebook)
+		if err != nil {
+			return books, chunks, fmt.Errorf("book %d: %w", b.id, err)
+		}
+		books++
+		chunks += n
+		if time.Since(shown) >= 5*time.Second {
+			shown = time.Now()
+			fmt.Printf("%d of %d books\n", books, len(todo))
+		}
+	}
+	return books, chunks, nil
+}
+
+func fillBookStableIDs(db *sql.DB, id, ebook int) (int, error) {
+	tx, err := db.BeginTx(runCtx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query("SELECT id, chunk, stable_id IS NULL FROM chunks WHERE sourceid = ? ORDER BY ordinal, id", id)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int64
+	var texts []string
+	var missing []bool
+	for rows.Next() {
+		var cid int64
+		var text string
+		var m bool
+		if err = rows.Scan(&cid, &text, &m); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids, texts, missing = append(ids, cid), append(texts, text), append(missing, m)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	n := 0
+	for i, sid := range stableIDs(stableScope(id, ebook), defaultStrategy, texts) {
+		if !missing[i] {
+			continue
+		}
+		// an id another book's chunk has is kept by the book filled first
+		var taken int
+		if err = tx.QueryRow("SELECT count(*) FROM chunks WHERE stable_id = ?", sid).Scan(&taken); err != nil {
+			return 0, err
+		}
+		if taken > 0 {
+			continue
+		}
+		if _, err = tx.Exec("UPDATE chunks SET stable_id = ? WHERE id = ?", sid, ids[i]); err != nil {
+			return 0, err
+		}
+		n++
+	}
+	return n, tx.Commit()
+}
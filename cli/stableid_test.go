@@ -0,0 +1,189 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStableIDsOfChunks(t *testing.T) {
+	chunks := []string{"It was a dark night.", "The end.", "It was  a dark\nnight.", "Another."}
+	ids := stableIDs("pg84", defaultStrategy, chunks)
+	if len(ids) != 4 || !strings.HasPrefix(ids[0], "pg84-") || len(ids[0]) != len("pg84-")+20 {
+		t.Fatalf("stableIDs = %v", ids)
+	}
+	// the same text is another id the second time in a book, however it
+	// is spaced
+	if ids[0] == ids[2] || len(map[string]bool{ids[0]: true, ids[1]: true, ids[2]: true, ids[3]: true}) != 4 {
+		t.Errorf("stableIDs of two like chunks = %v", ids)
+	}
+	if again := stableIDs("pg84", defaultStrategy, []string{"It was a\tdark night. ", "The end."}); again[0] != ids[0] || again[1] != ids[1] {
+		t.Errorf("stableIDs again = %v, want %v", again, ids[:2])
+	}
+	// of another book or strategy, another id
+	for _, other := range [][]string{stableIDs("pg85", defaultStrategy, chunks[:1]), stableIDs("pg84", "scenes", chunks[:1]), stableIDs("book84", defaultStrategy, chunks[:1])} {
+		if other[0] == ids[0] || strings.TrimPrefix(other[0], "pg85-") == strings.TrimPrefix(ids[0], "pg84-") {
+			t.Errorf("another book's or strategy's id is %s, the same as %s", other[0], ids[0])
+		}
+	}
+	if got := stableScope(7, 0); got != "book7" {
+		t.Errorf("the scope of a book without an ebook number is %s", got)
+	}
+}
+
+func TestStableMoves(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		old, new []string
+		want     [][2]string
+	}{
+		{"the same", []string{"a", "b", "c"}, []string{"a", "b", "c"}, nil},
+		{"one changed", []string{"a", "b", "c"}, []string{"a", "x", "c"}, [][2]string{{"b", "x"}}},
+		{"one split", []string{"a", "b", "c"}, []string{"a", "x", "y", "c"}, [][2]string{{"b", "x"}}},
+		{"two joined", []string{"a", "b", "c", "d"}, []string{"a", "x", "d"}, [][2]string{{"b", "x"}, {"c", "x"}}},
+		{"one taken out", []string{"a", "b", "c"}, []string{"a", "c"}, nil},
+		{"one put in", []string{"a", "c"}, []string{"a", "b", "c"}, nil},
+		{"the first and last changed", []string{"a", "b", "c"}, []string{"x", "b", "y"}, [][2]string{{"a", "x"}, {"c", "y"}}},
+		{"none had ids", []string{"", ""}, []string{"x", "y"}, nil},
+		{"moved past another", []string{"a", "b", "c"}, []string{"c", "a", "x"}, [][2]string{{"b", "x"}}},
+	} {
+		if got := stableMoves(c.old, c.new); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: stableMoves(%v, %v) = %v, want %v", c.name, c.old, c.new, got, c.want)
+		}
+	}
+}
+
+func TestStableIDsRechunk(t *testing.T) {
+	db := testDB(t)
+	body := strings.Split(testParagraphs(6), "\n\n")
+	// the fifth paragraph the second's again
+	body[4] = body[1]
+	book := addBook(t, db, "Wuthering Heights", "Emily Brontë", testBook("Wuthering Heights", strings.Join(body, "\n\n")))
+	if _, err := db.Exec("UPDATE files SET ebook = 768 WHERE id = ?", book); err != nil {
+		t.Fatal(err)
+	}
+	chunk := func(args ...string) {
+		t.Helper()
+		if _, err := captureStdout(t, func() error { return chunkCmd(args) }); err != nil {
+			t.Fatalf("chunk %s: %v", strings.Join(args, " "), err)
+		}
+	}
+	stable := func() []string {
+		t.Helper()
+		return strings.Fields(names(t, db, fmt.Sprintf("SELECT stable_id FROM chunks WHERE sourceid = %d ORDER BY ordinal", book)))
+	}
+	chunk()
+	first := stable()
+	if len(first) != 6 || !reflect.DeepEqual(first, stableIDs("pg768", defaultStrategy, body)) {
+		t.Fatalf("chunked, the stable ids are %v", first)
+	}
+
+	// chunked again as it was, the chunks are written again with the
+	// same stable ids
+	chunk("--full-rechunk")
+	if got := stable(); !reflect.DeepEqual(got, first) {
+		t.Errorf("chunked again, the stable ids are %v, want %v", got, first)
+	}
+
+	// a paragraph edited, it alone is given a new id, and the old one
+	// moves to it
+	body[2] = strings.Replace(body[2], "number iii,", "number three,", 1)
+	if _, err := db.Exec("UPDATE files SET content = ? WHERE id = ?", testBook("Wuthering Heights", strings.Join(body, "\n\n")), book); err != nil {
+		t.Fatal(err)
+	}
+	chunk("--full-rechunk")
+	edited := stable()
+	for i := range first {
+		if (edited[i] == first[i]) != (i != 2) {
+			t.Errorf("with the third paragraph edited, chunk %d's stable id went from %s to %s", i, first[i], edited[i])
+		}
+	}
+	if got := names(t, db, "SELECT old_id || ' ' || new_id || ' ' || sourceid FROM stable_id_map"); got != fmt.Sprintf("%s %s %d\n", first[2], edited[2], book) {
+		t.Errorf("the map is\n%s", got)
+	}
+	var id int
+	if err := db.QueryRow("SELECT id FROM chunks WHERE stable_id = ?", edited[2]).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	out, err := captureStdout(t, func() error { return stableIDsCmd([]string{"--resolve", first[2], first[3], "pg768-nonesuch"}) })
+	if want := fmt.Sprintf("%s: moved to %s, chunk %d of book %d\n%s: chunk %d of book %d\npg768-nonesuch: no chunk has it\n",
+		first[2], edited[2], id, book, first[3], id+1, book); exitCode(err) != 1 || out != want {
+		t.Errorf("stable-ids --resolve: %v, printing\n%s\nwant\n%s", err, out, want)
+	}
+
+	// edited back, the first id is made again and no longer moved, and
+	// the edited one moves to it
+	body[2] = strings.Replace(body[2], "number three,", "number iii,", 1)
+	if _, err := db.Exec("UPDATE files SET content = ? WHERE id = ?", testBook("Wuthering Heights", strings.Join(body, "\n\n")), book); err != nil {
+		t.Fatal(err)
+	}
+	chunk("--full-rechunk")
+	again := stable()
+	if got := names(t, db, "SELECT old_id || ' ' || new_id FROM stable_id_map"); !reflect.DeepEqual(again, first) || got != edited[2]+" "+first[2]+"\n" {
+		t.Errorf("edited again, the map is\n%s", got)
+	}
+
+	// they are given with the chunks' ids
+	if _, err = db.Exec("UPDATE chunks SET stable_id = NULL WHERE ordinal = 0"); err != nil {
+		t.Fatal(err)
+	}
+	if out, err = captureStdout(t, func() error { return stableIDsCmd(nil) }); err != nil || out != "gave 1 chunks of 1 books stable ids\n" {
+		t.Errorf("stable-ids: %v, printing\n%s", err, out)
+	}
+	if got := stable(); !reflect.DeepEqual(got, again) {
+		t.Errorf("filled, the stable ids are %v, want %v", got, again)
+	}
+	var r exportRecord
+	if lines := exported(t); json.Unmarshal([]byte(lines[0]), &r) != nil || r.StableID != again[0] {
+		t.Errorf("export wrote %s", lines[0])
+	}
+	s := testServer(t, db)
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/chunks/random", nil))
+	var c chunkrow
+	if err = json.Unmarshal(w.Body.Bytes(), &c); err != nil || c.StableID == "" || !strings.Contains(strings.Join(again, " "), c.StableID) {
+		t.Errorf("GET /chunks/random: %d %s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("GET", fmt.Sprintf("/books/%d/chunks", book), nil))
+	var bc bookChunks
+	if err = json.Unmarshal(w.Body.Bytes(), &bc); err != nil || len(bc.Chunks) != 6 || bc.Chunks[2].StableID != again[2] {
+		t.Errorf("GET /books/%d/chunks: %d %s", book, w.Code, w.Body)
+	}
+	if _, err = captureStdout(t, func() error { return stableIDsCmd([]string{"pg768-x"}) }); exitCode(err) != exitUsage {
+		t.Errorf("stable-ids with an id but no --resolve: %v, want a usage error", err)
+	}
+}
+
+func TestStableIDsReRelease(t *testing.T) {
+	db := testDB(t)
+	root := t.TempDir()
+	run := func(cmd func([]string) error, args ...string) {
+		t.Helper()
+		if _, err := captureStdout(t, func() error { return cmd(args) }); err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+	}
+	writeTestZip(t, filepath.Join(root, "etext98", "pandp10.zip"), zipEntry{"pandp10.txt", pandp("first")})
+	run(ingestCmd, "--target", root)
+	run(chunkCmd)
+	old := names(t, db, "SELECT stable_id FROM chunks WHERE sourceid = 1 ORDER BY ordinal")
+	writeTestZip(t, filepath.Join(root, "etext98", "pandp11.zip"), zipEntry{"pandp11.txt", pandp("corrected")})
+	run(ingestCmd, "--target", root)
+	run(chunkCmd)
+
+	// the new version has the ids of the paragraphs the two share, and
+	// the old one keeps only its own
+	ids := strings.Fields(old)
+	if got := names(t, db, "SELECT coalesce(stable_id, '-') FROM chunks WHERE sourceid = 1 ORDER BY ordinal"); got != ids[2]+"\n" {
+		t.Errorf("the old version's stable ids are\n%s", got)
+	}
+	got := strings.Fields(names(t, db, "SELECT stable_id FROM chunks WHERE sourceid = 2 ORDER BY ordinal"))
+	if len(got) != 3 || got[0] != ids[0] || got[1] != ids[1] || got[2] == ids[2] || !strings.HasPrefix(got[2], "pg1342-") {
+		t.Errorf("the new version's stable ids are %v, the old's %v", got, ids)
+	}
+}
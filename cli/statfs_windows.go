@@ -0,0 +1,7 @@
+package cli
+
+import "errors"
+
+func statFree(dir string) (int64, error) {
+	return 0, errors.New("can't tell free space on windows; pass --force")
+}
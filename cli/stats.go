@@ -0,0 +1,187 @@
+package cli
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+)
+
+type libraryStats struct {
+	Books     int
+	Chunks    int
+	Authors   int
+	Footnotes int
+	Bytes     int64
+}
+
+func statsCmd(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	source := fs.String("source", "", "only count books ingested with this --source-label")
+	positions := fs.Bool("positions", false, "also count the chunks by the tenth of their book they are in")
+	exact := fs.Bool("exact", false, "count the chunks themselves rather than reading the kept counts")
+	filter := filterFlag(fs, map[string][]string{"source": {"source"}})
+	fs.Parse(args)
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	id := 0
+	if *source != "" {
+		if id, err = lookupSource(db, *source); err != nil {
+			return err
+		}
+	}
+	f, err := filter(db)
+	if err != nil {
+		return err
+	}
+	if f != nil {
+		if *positions {
+			return usagef("--positions doesn't combine with --filter")
+		}
+		if id != 0 {
+			f.Source = id
+		}
+		return printFilterCounts(db, *f)
+	}
+
+	st, err := libraryCounts(db, id, *exact)
+	if err != nil {
+		return err
+	}
+	counted := ""
+	if !*exact {
+		cs, kept, err := keptCounts(db)
+		if err != nil {
+			return err
+		}
+		switch {
+		case !kept:
+		case cs.RecountedAt == "":
+			counted = " (kept counts, never recounted)"
+		default:
+			counted = fmt.Sprintf(" (kept counts, recounted %s)", cs.RecountedAt)
+		}
+	}
+
+	fmt.Printf("books:     %d (%s)\n", st.Books, formatSize(st.Bytes))
+	fmt.Printf("authors:   %d\n", st.Authors)
+	fmt.Printf("chunks:    %d%s\n", st.Chunks, counted)
+	fmt.Printf("footnotes: %d\n", st.Footnotes)
+	if *positions {
+		if err = printPositions(db, id, st.Chunks); err != nil {
+			return err
+		}
+	}
+
+	if *source != "" {
+		return nil
+	}
+	return printSources(db)
+}
+
+// libraryCounts counts books from source, or from everywhere when source
+// is 0, and what was made from them, their chunks from the kept counts but
+// with exact.
+func libraryCounts(db *sql.DB, source int, exact bool) (libraryStats, error) {
+	var st libraryStats
+	books := "SELECT id FROM files WHERE (? = 0 OR source_id = ?) AND deleted_at IS NULL"
+	err := db.QueryRow(`
+		SELECT count(*), coalesce(sum(`+contentBytes("")+`), 0), count(DISTINCT nullif(author_norm, ''))
+		FROM files WHERE (? = 0 OR source_id = ?) AND deleted_at IS NULL`, source, source).
+		Scan(&st.Books, &st.Bytes, &st.Authors)
+	if err != nil {
+		return st, err
+	}
+	if exact {
+		st.Chunks, err = countChunks(db, "%s c WHERE c.sourceid IN ("+books+")", source, source)
+	} else {
+		st.Chunks, err = countedChunks(db, books, source, source)
+	}
+	if err != nil {
+		return st, err
+	}
+	err = db.QueryRow("SELECT count(*) FROM footnotes WHERE sourceid IN ("+books+")", source, source).Scan(&st.Footnotes)
+	return st, err
+}
+
+// printFilterCounts prints how many of the books, authors and chunks random
+// draws from f keeps.
+func printFilterCounts(db *sql.DB, f chunkFilter) error {
+	var st libraryStats
+	err := db.QueryRow(`
+		WITH kept AS MATERIALIZED (SELECT c.sourceid, f.author_norm FROM chunks c JOIN files f ON f.id = c.sourceid WHERE `+filterWhere+`)
+		SELECT (SELECT count(DISTINCT sourceid) FROM kept), (SELECT count(*) FROM kept),
+			(SELECT count(DISTINCT nullif(author_norm, '')) FROM kept),
+			(SELECT coalesce(sum(`+contentBytes("")+`), 0) FROM files WHERE id IN (SELECT sourceid FROM kept))`, f.args()...).
+		Scan(&st.Books, &st.Chunks, &st.Authors, &st.Bytes)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("books:     %d (%s)\n", st.Books, formatSize(st.Bytes))
+	fmt.Printf("authors:   %d\n", st.Authors)
+	fmt.Printf("chunks:    %d (those random draws from that the filter keeps)\n", st.Chunks)
+	return nil
+}
+
+func printSources(db *sql.DB) error {
+	rows, err := db.Query(`
+		SELECT s.label, s.root, s.created_at, count(f.id)
+		FROM sources s LEFT JOIN files f ON f.source_id = s.id AND f.deleted_at IS NULL
+		GROUP BY s.id ORDER BY s.id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	first := true
+	for rows.Next() {
+		var label, root, created string
+		var books int
+		if err = rows.Scan(&label, &root, &created, &books); err != nil {
+			return err
+		}
+		if first {
+			fmt.Println("\nsources:")
+			first = false
+		}
+		fmt.Printf("  %s: %d books from %s, first ingested %s\n", label, books, root, created)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	var conflicts int
+	if err = db.QueryRow("SELECT count(*) FROM source_conflicts").Scan(&conflicts); err != nil {
+		return err
+	}
+	if conflicts > 0 {
+		fmt.Printf("\n%d books differed from a copy already ingested from another source; see source_conflicts\n", conflicts)
+	}
+	return nil
+}
+
+// printPositions prints how many of the chunks of the books from source are
+// in each tenth of their books, of all chunks of them.
+func printPositions(db *sql.DB, source, chunks int) error {
+	if lacks("chunks", "position_pct") {
+		fmt.Println("\nno chunk positions in this database; run gutchunk migrate")
+		return nil
+	}
+	tenths, err := positionTenths(db, source)
+	if err != nil {
+		return err
+	}
+	fmt.Println("\nchunks by position in their books:")
+	for i, n := range tenths {
+		pct := 0.0
+		if chunks > 0 {
+			pct = 100 * float64(n) / float64(chunks)
+		}
+		fmt.Printf("  %.1f-%.1f: %7d %5.1f%%\n", float64(i)/10, float64(i+1)/10, n, pct)
+	}
+	return nil
+}
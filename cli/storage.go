@@ -0,0 +1,682 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/mattn/go-sqlite3"
+
+	"git.tilde.town/gutchunker/gutchunk"
+)
+
+// Chunks repeat text their book's content holds already. In the reference
+// storage mode, made by gutchunk convert-storage --mode reference, the
+// table is chunk_refs instead, and a chunk whose text can be had back from
+// the content holds only where in it the chunk is: start_offset to
+// end_offset, in bytes, and strip_refs when footnote markers were taken out
+// of it. Chunks whose text can't be, or whose book has no content, keep it.
+// Every connection shadows chunk_refs with a temp view named chunks, giving
+// each chunk's text sliced out of the content and put through the
+// chunker's handling of lines again (see refText), with triggers writing
+// through, so queries over chunks work unchanged. Each connection keeps
+// the content of the last few books it read chunks of, as chunks are
+// mostly read a book at a time, and serve keeps more for all of them (see
+// contentcache.go).
+
+const (
+	storageInline    = "inline"
+	storageReference = "reference"
+)
+
+// chunkStorage is the storage mode of the open database's chunks.
+var chunkStorage = storageInline
+
+// books whose content a connection keeps for the chunks view
+const refBooks = 4
+
+// refsTable is chunk_refs, named table, in layout.
+func refsTable(layout, table string) []string {
+	return []string{
+		chunksTable(layout, table),
+		"ALTER TABLE " + table + " ADD COLUMN start_offset INTEGER",
+		"ALTER TABLE " + table + " ADD COLUMN end_offset INTEGER",
+		"ALTER TABLE " + table + " ADD COLUMN strip_refs INTEGER",
+	}
+}
+
+const refCols = chunkCols + ", start_offset, end_offset, strip_refs"
+
+var refsView = []string{
+	`CREATE TEMP VIEW chunks AS SELECT id, coalesce(chunk, chunk_text(sourceid, start_offset, end_offset, strip_refs)) AS chunk,
+		sourceid, ordinal, token_count, work_id, scene, boilerplate, position_pct, kind, stable_id, start_offset, end_offset, strip_refs FROM chunk_refs`,
+	// a chunk written with where it is keeps no text of its own
+	`CREATE TEMP TRIGGER chunks_insert INSTEAD OF INSERT ON chunks BEGIN
+		INSERT INTO chunk_refs (` + refCols + `)
+		SELECT coalesce(NEW.id, (SELECT max(id) FROM chunk_refs) + 1, 1), CASE WHEN NEW.start_offset IS NULL THEN NEW.chunk END,
+			NEW.sourceid, NEW.ordinal, NEW.token_count, NEW.work_id, NEW.scene, NEW.boilerplate, NEW.position_pct, NEW.kind, NEW.stable_id, NEW.start_offset, NEW.end_offset, NEW.strip_refs;
+	END`,
+	// and one whose text is changed keeps the new text rather than where
+	// the old was
+	`CREATE TEMP TRIGGER chunks_update INSTEAD OF UPDATE ON chunks BEGIN
+		UPDATE chunk_refs SET
+			chunk = CASE WHEN NEW.chunk IS OLD.chunk THEN chunk ELSE NEW.chunk END,
+			start_offset = CASE WHEN NEW.chunk IS OLD.chunk THEN NEW.start_offset END,
+			end_offset = CASE WHEN NEW.chunk IS OLD.chunk THEN NEW.end_offset END,
+			strip_refs = CASE WHEN NEW.chunk IS OLD.chunk THEN NEW.strip_refs END,
+			sourceid = NEW.sourceid, ordinal = NEW.ordinal, token_count = NEW.token_count,
+			work_id = NEW.work_id, scene = NEW.scene, boilerplate = NEW.boilerplate, position_pct = NEW.position_pct, kind = NEW.kind,
+			stable_id = NEW.stable_id
+		WHERE id = OLD.id;
+	END`,
+	`CREATE TEMP TRIGGER chunks_delete INSTEAD OF DELETE ON chunks BEGIN
+		DELETE FROM chunk_refs WHERE id = OLD.id;
+	END`,
+}
+
+// attachRefs sets up conn to see chunk_refs as its chunks.
+func attachRefs(conn *sqlite3.SQLiteConn) error {
+	rc := &refContent{conn: conn}
+	if err := conn.RegisterFunc("chunk_text", rc.chunkText, false); err != nil {
+		return fmt.Errorf("could not register chunk_text: %w", err)
+	}
+	for _, q := range refsView {
+		if _, err := conn.Exec(q, nil); err != nil {
+			return fmt.Errorf("could not create the chunks view: %w", err)
+		}
+	}
+	return nil
+}
+
+// refContent is the content of the books a connection read chunks of
+// last, the latest last. It is dropped whenever anything has written to
+// the database since, as a book's id can come to name another book.
+type refContent struct {
+	conn  *sqlite3.SQLiteConn
+	stamp [2]int64
+	books []refBook
+	// prepared once, as chunk_text runs for every chunk read
+	stampStmt, contentStmt, hashStmt driver.Stmt
+}
+
+type refBook struct {
+	id      int64
+	content *string
+}
+
+// chunkText is chunk_text(sourceid, start_offset, end_offset, strip_refs),
+// the text of a chunk stored as where it is, NULL for one without.
+func (rc *refContent) chunkText(sourceid, start, end, strip interface{}) (interface{}, error) {
+	id, ok1 := sourceid.(int64)
+	from, ok2 := start.(int64)
+	to, ok3 := end.(int64)
+	if !ok1 || !ok2 || !ok3 {
+		return nil, nil
+	}
+	content, err := rc.content(id)
+	if err != nil {
+		return nil, err
+	}
+	if content == nil {
+		return nil, fmt.Errorf("book %d has no content to give chunk text from", id)
+	}
+	stripped, _ := strip.(int64)
+	return refChunk(*content, from, to, stripped != 0)
+}
+
+func (rc *refContent) content(id int64) (*string, error) {
+	stamp, err := rc.queryStamp()
+	if err != nil {
+		return nil, err
+	}
+	if stamp != rc.stamp {
+		rc.stamp, rc.books = stamp, nil
+	}
+	for i, b := range rc.books {
+		if b.id == id {
+			rc.books = append(append(rc.books[:i:i], rc.books[i+1:]...), b)
+			return b.content, nil
+		}
+	}
+	if sharedContent != nil {
+		hash, err := rc.contentHash(id)
+		if err != nil {
+			return nil, err
+		}
+		if hash != "" {
+			if content, ok := sharedContent.get(contentKey{id, hash}); ok {
+				return rc.keep(refBook{id: id, content: content}), nil
+			}
+		}
+	}
+
+	rows, err := rc.query(&rc.contentStmt, "SELECT "+contentCol("")+", coalesce(content_hash, '') FROM files WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	dest := make([]driver.Value, 2)
+	if err = rows.Next(dest); err != nil {
+		return nil, fmt.Errorf("could not read the content of book %d: %w", id, err)
+	}
+	b := refBook{id: id}
+	switch v := dest[0].(type) {
+	case string:
+		b.content = &v
+	case []byte:
+		s := string(v)
+		b.content = &s
+	}
+	// the hash read with the content, as what was looked up by may have
+	// changed since
+	if hash := driverString(dest[1]); sharedContent != nil && hash != "" {
+		sharedContent.put(contentKey{id, hash}, b.content)
+	}
+	return rc.keep(b), nil
+}
+
+// keep adds b to the books kept, dropping the least lately read for it.
+func (rc *refContent) keep(b refBook) *string {
+	if len(rc.books) == refBooks {
+		rc.books = rc.books[1:]
+	}
+	rc.books = append(rc.books, b)
+	return b.content
+}
+
+// contentHash is the content_hash of book id, "" for none.
+func (rc *refContent) contentHash(id int64) (string, error) {
+	rows, err := rc.query(&rc.hashStmt, "SELECT coalesce(content_hash, '') FROM files WHERE id = ?", id)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	dest := make([]driver.Value, 1)
+	if err = rows.Next(dest); err != nil {
+		return "", fmt.Errorf("could not read the content hash of book %d: %w", id, err)
+	}
+	return driverString(dest[0]), nil
+}
+
+func driverString(v driver.Value) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
+
+// queryStamp is what changes whenever anything, on conn or another
+// connection, has written to the database.
+func (rc *refContent) queryStamp() ([2]int64, error) {
+	var stamp [2]int64
+	rows, err := rc.query(&rc.stampStmt, "SELECT total_changes(), data_version FROM pragma_data_version")
+	if err != nil {
+		return stamp, err
+	}
+	defer rows.Close()
+	dest := make([]driver.Value, 2)
+	if err = rows.Next(dest); err != nil {
+		return stamp, err
+	}
+	stamp[0], _ = dest[0].(int64)
+	stamp[1], _ = dest[1].(int64)
+	return stamp, nil
+}
+
+// query runs q on the connection, prepared into stmt the first time.
+func (rc *refContent) query(stmt *driver.Stmt, q string, args ...driver.Value) (driver.Rows, error) {
+	if *stmt == nil {
+		s, err := rc.conn.Prepare(q)
+		if err != nil {
+			return nil, err
+		}
+		*stmt = s
+	}
+	return (*stmt).Query(args)
+}
+
+// chunkRef is where in its book's content a chunk is.
+type chunkRef struct {
+	start, end int
+	stripRefs  bool
+}
+
+// refChunk is the text of the chunk at start to end of content.
+func refChunk(content string, start, end int64, stripRefs bool) (string, error) {
+	if start < 0 || end < start || end > int64(len(content)) {
+		return "", fmt.Errorf("chunk at %d to %d is outside its book's %d bytes", start, end, len(content))
+	}
+	return refText(content[start:end], stripRefs), nil
+}
+
+// refText makes a chunk of the lines of span as splitBookAt does.
+func refText(span string, stripRefs bool) string {
+	var b strings.Builder
+	s := bufio.NewScanner(strings.NewReader(span))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if stripRefs {
+			line = gutchunk.StripFootnoteRefs(line)
+		}
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	return gutchunk.Canonical(b.String())
+}
+
+// refLine is a line of content, from its first byte that isn't space to
+// its last, split as bufio.ScanLines splits.
+type refLine struct {
+	start, end int
+	text       string
+}
+
+func refLines(content string) []refLine {
+	lines := []refLine{}
+	for at := 0; at < len(content); {
+		n := strings.IndexByte(content[at:], '\n')
+		next := at + n + 1
+		if n < 0 {
+			n, next = len(content)-at, len(content)
+		}
+		line := content[at : at+n]
+		text := strings.TrimSpace(line)
+		start := at + len(line) - len(strings.TrimLeftFunc(line, unicode.IsSpace))
+		lines = append(lines, refLine{start, start + len(text), text})
+		at = next
+	}
+	return lines
+}
+
+// findRefs finds where in content each of a book's chunks, in order, is,
+// nil for those whose text can't be had back from it as they are. A chunk
+// is looked for from the line after the last one found, by its words, and
+// taken only when refText gives exactly its text back.
+func findRefs(content string, chunks []string) []*chunkRef {
+	lines := refLines(content)
+	words := [2][]*string{make([]*string, len(lines)), make([]*string, len(lines))}
+	wordsOf := func(i int, strip bool) string {
+		k := 0
+		if strip {
+			k = 1
+		}
+		if words[k][i] == nil {
+			text := lines[i].text
+			if strip {
+				text = gutchunk.StripFootnoteRefs(text)
+			}
+			w := strings.Join(strings.Fields(text), " ")
+			words[k][i] = &w
+		}
+		return *words[k][i]
+	}
+
+	refs := make([]*chunkRef, len(chunks))
+	from, strip := 0, false
+	for i, chunk := range chunks {
+		want := strings.Join(strings.Fields(chunk), " ")
+		// books are mostly chunked one way throughout, so the way the last
+		// chunk was found is tried first
+		for _, st := range []bool{strip, !strip} {
+			s, e, ok := findSpan(len(lines), func(i int) string { return wordsOf(i, st) }, from, want)
+			if !ok {
+				continue
+			}
+			start, end := lines[s].start, lines[e].end
+			if refText(content[start:end], st) == chunk {
+				refs[i] = &chunkRef{start, end, st}
+				from, strip = e+1, st
+				break
+			}
+		}
+	}
+	return refs
+}
+
+// findSpan finds the first run of lines from line from whose words, words
+// gives, are want, returning its first and last line.
+func findSpan(n int, words func(int) string, from int, want string) (int, int, bool) {
+	if want == "" {
+		return 0, 0, false
+	}
+	for s := from; s < n; s++ {
+		got := words(s)
+		if got == "" || !strings.HasPrefix(want, got) {
+			continue
+		}
+		e := s
+		for len(got) < len(want) && e+1 < n {
+			next := words(e + 1)
+			if next == "" {
+				break
+			}
+			got += " " + next
+			e++
+			if !strings.HasPrefix(want, got) {
+				break
+			}
+		}
+		if got == want {
+			return s, e, true
+		}
+	}
+	return 0, 0, false
+}
+
+// bookRefs finds where book id's chunks are in its content, all nil when
+// it has none.
+func bookRefs(q queryer, id int, chunks []string) ([]*chunkRef, error) {
+	var content sql.NullString
+	if err := q.QueryRow("SELECT "+contentCol("")+" FROM files WHERE id = ?", id).Scan(&content); err != nil {
+		return nil, err
+	}
+	if !content.Valid {
+		return make([]*chunkRef, len(chunks)), nil
+	}
+	return findRefs(content.String, chunks), nil
+}
+
+// refValues are the start_offset, end_offset and strip_refs of ref.
+func refValues(ref *chunkRef) (interface{}, interface{}, interface{}) {
+	if ref == nil {
+		return nil, nil, nil
+	}
+	strip := 0
+	if ref.stripRefs {
+		strip = 1
+	}
+	return ref.start, ref.end, strip
+}
+
+func convertStorageCmd(args []string) error {
+	fs := flag.NewFlagSet("convert-storage", flag.ExitOnError)
+	mode := fs.String("mode", "", "storage to convert chunks to: reference or inline")
+	batch := fs.Int("batch", 1000, "books converted per transaction")
+	vacuum := fs.Bool("vacuum", false, "vacuum the database afterwards to give back the space the old table took")
+	space := spaceFlags(fs)
+	fs.Parse(args)
+
+	if *mode != storageReference && *mode != storageInline {
+		return usagef("usage: gutchunk convert-storage --mode reference|inline [flags]")
+	}
+	if *batch < 1 {
+		return usagef("--batch must be at least 1")
+	}
+	so, err := space()
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if chunkStorage == *mode {
+		fmt.Printf("chunks are stored %s already\n", *mode)
+		return nil
+	}
+	if chunkShards > 0 {
+		return errors.New("sharded chunks always keep their text")
+	}
+	fts, err := hasFTS(db)
+	if err != nil {
+		return err
+	}
+	if fts {
+		return errors.New("the full text index indexes the text chunks store; drop it first with gutchunk index --drop")
+	}
+	if err = checkOrphans(db); err != nil {
+		return err
+	}
+
+	// the copy takes as much again as the chunks, and the text put back
+	// into them as much as their books' content
+	if err = checkSpace(dbFile(dsn), "convert-storage", so); err != nil {
+		return err
+	}
+	sw := watchSpace(runCtx, dbFile(dsn), so.minFree)
+	defer sw.stop()
+	next := "chunk_refs_new"
+	if *mode == storageInline {
+		next = "chunks_new"
+	}
+	if err = convertStorage(sw.ctx, db, *mode, *batch, *vacuum); err != nil {
+		err = sw.err(err)
+		if errors.Is(err, errLowSpace) {
+			// the batches copied are given back too
+			db.Exec("DROP TABLE IF EXISTS " + next)
+		}
+	}
+	return err
+}
+
+// convertStorage copies chunks into a table of the other storage mode,
+// batch books to a transaction, and puts it in place of the old.
+func convertStorage(ctx context.Context, db *sql.DB, to string, batch int, vacuum bool) error {
+	from, next, table := "chunks", "chunk_refs_new", "chunk_refs"
+	create := refsTable(chunkLayout, next)
+	if to == storageInline {
+		from, next, table = "chunk_refs", "chunks_new", "chunks"
+		create = []string{chunksTable(chunkLayout, next)}
+	}
+	// left by a run that was interrupted; the chunks may have changed since
+	if _, err := db.ExecContext(ctx, "DROP TABLE IF EXISTS "+next); err != nil {
+		return err
+	}
+	for _, q := range create {
+		if _, err := db.ExecContext(ctx, q); err != nil {
+			return err
+		}
+	}
+	var total int64
+	if err := db.QueryRowContext(ctx, "SELECT count(*) FROM "+from).Scan(&total); err != nil {
+		return err
+	}
+
+	var copied, refs, last int64 = 0, 0, -1
+	shown := time.Now()
+	for {
+		n, r, upto, err := convertBatch(ctx, db, to, from, next, last, batch)
+		if err != nil {
+			return fmt.Errorf("could not copy chunks: %w", err)
+		}
+		if upto < 0 {
+			break
+		}
+		copied += n
+		refs += r
+		last = upto
+		if time.Since(shown) >= 5*time.Second {
+			shown = time.Now()
+			fmt.Printf("copied %d of %d chunks (%.0f%%)\n", copied, total, 100*float64(copied)/float64(total))
+		}
+	}
+	if copied != total {
+		return fmt.Errorf("copied %d chunks of %d; the chunks changed while copying, run convert-storage again", copied, total)
+	}
+
+	// the chunks view names chunk_refs, and renaming a table checks every
+	// view, so it goes first on the connection doing the swap
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	swap := []string{"DROP VIEW IF EXISTS temp.chunks", "DROP TABLE " + from, "ALTER TABLE " + next + " RENAME TO " + table}
+	if to == storageInline {
+		swap = append(swap, chunksTable(chunkLayout, "chunks"))
+	} else if chunkLayout == chunksRowid {
+		swap = append(swap, "CREATE INDEX chunk_refs_sourceid ON chunk_refs(sourceid)")
+	}
+	swap = append(swap, stableIndex(table))
+	for _, q := range swap {
+		if _, err = tx.ExecContext(ctx, q); err != nil {
+			return fmt.Errorf("could not replace %s: %w", from, err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	conn.Close()
+	if to == storageReference {
+		fmt.Printf("converted %d chunks, %d of them to references into their books' content\n", copied, refs)
+	} else {
+		fmt.Printf("converted %d chunks to keep their text\n", copied)
+	}
+
+	if vacuum {
+		if _, err = db.ExecContext(ctx, "VACUUM"); err != nil {
+			return fmt.Errorf("could not vacuum: %w", err)
+		}
+	}
+	return nil
+}
+
+// convertBatch copies the chunks of the batch books after book last from
+// table from into next, giving each its text (inline) or where it is
+// (reference). It returns how many chunks it copied, how many of them as
+// references, and the last book copied, -1 when there were none left.
+func convertBatch(ctx context.Context, db *sql.DB, to, from, next string, last int64, batch int) (int64, int64, int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, -1, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, "SELECT DISTINCT sourceid FROM "+from+" WHERE sourceid > ? ORDER BY sourceid LIMIT ?", last, batch)
+	if err != nil {
+		return 0, 0, -1, err
+	}
+	books := []int64{}
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, 0, -1, err
+		}
+		books = append(books, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || len(books) == 0 {
+		return 0, 0, -1, err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO "+next+" ("+refCols+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if to == storageInline {
+		stmt, err = tx.PrepareContext(ctx, "INSERT INTO "+next+" ("+chunkCols+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	}
+	if err != nil {
+		return 0, 0, -1, err
+	}
+	defer stmt.Close()
+	var n, refs int64
+	for _, id := range books {
+		chunks, err := loadStoredChunks(ctx, tx, from, id, to == storageInline)
+		if err != nil {
+			return 0, 0, -1, fmt.Errorf("book %d: %w", id, err)
+		}
+		if to == storageReference {
+			texts := make([]string, len(chunks))
+			for i, c := range chunks {
+				texts[i] = c.text.String
+			}
+			found, err := bookRefs(tx, int(id), texts)
+			if err != nil {
+				return 0, 0, -1, fmt.Errorf("book %d: %w", id, err)
+			}
+			for i, c := range chunks {
+				text := interface{}(c.text)
+				if found[i] != nil {
+					text = nil
+					refs++
+				}
+				start, end, strip := refValues(found[i])
+				if _, err = stmt.ExecContext(ctx, append([]interface{}{c.id, text}, append(c.rest, start, end, strip)...)...); err != nil {
+					return 0, 0, -1, err
+				}
+			}
+		} else {
+			for _, c := range chunks {
+				if _, err = stmt.ExecContext(ctx, append([]interface{}{c.id, c.text}, c.rest...)...); err != nil {
+					return 0, 0, -1, err
+				}
+			}
+		}
+		n += int64(len(chunks))
+	}
+	return n, refs, books[len(books)-1], tx.Commit()
+}
+
+// storedChunk is a chunk as convertBatch copies it: its id, text and the
+// rest of chunkCols in order.
+type storedChunk struct {
+	id   int64
+	text sql.NullString
+	rest []interface{}
+}
+
+// loadStoredChunks reads book id's chunks from table, with the text of
+// those stored as references when resolve is set.
+func loadStoredChunks(ctx context.Context, tx *sql.Tx, table string, id int64, resolve bool) ([]storedChunk, error) {
+	cols := chunkCols
+	if resolve {
+		cols = refCols
+	}
+	rows, err := tx.QueryContext(ctx, "SELECT "+cols+" FROM "+table+" WHERE sourceid = ? ORDER BY ordinal, id", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var content *sql.NullString
+	chunks := []storedChunk{}
+	for rows.Next() {
+		var c storedChunk
+		var ordinal, tokens, work, scene, boilerplate, sourceid sql.NullInt64
+		var position sql.NullFloat64
+		var kind, stable sql.NullString
+		var start, end, strip sql.NullInt64
+		dest := []interface{}{&c.id, &c.text, &sourceid, &ordinal, &tokens, &work, &scene, &boilerplate, &position, &kind, &stable}
+		if resolve {
+			dest = append(dest, &start, &end, &strip)
+		}
+		if err = rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		c.rest = []interface{}{sourceid, ordinal, tokens, work, scene, boilerplate, position, kind, stable}
+		if !c.text.Valid && start.Valid {
+			if content == nil {
+				content = &sql.NullString{}
+				if err = tx.QueryRowContext(ctx, "SELECT "+contentCol("")+" FROM files WHERE id = ?", id).Scan(content); err != nil {
+					return nil, err
+				}
+			}
+			if !content.Valid {
+				return nil, fmt.Errorf("chunk %d is in content the book doesn't have", c.id)
+			}
+			text, err := refChunk(content.String, start.Int64, end.Int64, strip.Int64 != 0)
+			if err != nil {
+				return nil, fmt.Errorf("chunk %d: %w", c.id, err)
+			}
+			c.text = sql.NullString{String: text, Valid: true}
+		}
+		chunks = append(chunks, c)
+	}
+	return chunks, rows.Err()
+}
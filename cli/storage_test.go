@@ -0,0 +1,210 @@
+package cli
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.tilde.town/gutchunker/corpus"
+)
+
+// storedTexts is every chunk of db, whole, as the chunks table or view
+// gives it.
+func storedTexts(t testing.TB, db *sql.DB) string {
+	t.Helper()
+	rows, err := db.Query("SELECT id, sourceid, ordinal, coalesce(scene, -1), chunk FROM chunks ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var b strings.Builder
+	for rows.Next() {
+		var id, book, ordinal, scene int
+		var text string
+		if err = rows.Scan(&id, &book, &ordinal, &scene, &text); err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&b, "%d %d %d %d %q\n", id, book, ordinal, scene, text)
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+// storedLibrary is a file database of a generated corpus and the books of
+// writeRunMirror, footnotes and scenes and all, chunked with the footnote
+// markers taken out.
+func storedLibrary(t *testing.T) *sql.DB {
+	t.Helper()
+	opts := corpus.DefaultOptions()
+	opts.Books, opts.BookSize = 6, 24*1024
+	generated := filepath.Join(t.TempDir(), "mirror")
+	if _, err := corpus.Generate(generated, opts); err != nil {
+		t.Fatal(err)
+	}
+	db := testFileDB(t)
+	for _, root := range []string{generated, writeRunMirror(t)} {
+		if _, err := captureStdout(t, func() error { return runCmd([]string{"--target", root, "--scenes", "--strip-refs"}) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestConvertStorage(t *testing.T) {
+	db := storedLibrary(t)
+	// one chunk no longer what its book's content gives
+	if _, err := db.Exec("UPDATE chunks SET chunk = 'Changed by hand.' WHERE id = 2"); err != nil {
+		t.Fatal(err)
+	}
+	inline := storedTexts(t, db)
+	inlineSize, err := dbPagesSize(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	convert := func(mode string) string {
+		t.Helper()
+		out, err := captureStdout(t, func() error { return convertStorageCmd([]string{"--mode", mode, "--batch", "2", "--vacuum"}) })
+		if err != nil {
+			t.Fatalf("convert-storage --mode %s: %v", mode, err)
+		}
+		return out
+	}
+
+	out := convert(storageReference)
+	refs, err := openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer refs.Close()
+	if chunkStorage != storageReference {
+		t.Fatalf("converted, chunks are stored %s", chunkStorage)
+	}
+	var total, kept int
+	if err = refs.QueryRow("SELECT count(*), count(chunk) FROM chunk_refs").Scan(&total, &kept); err != nil {
+		t.Fatal(err)
+	}
+	if kept == 0 || kept > total/4 || !strings.Contains(out, fmt.Sprintf("converted %d chunks, %d of them to references", total, total-kept)) {
+		t.Errorf("converting printed %q, keeping the text of %d chunks of %d", out, kept, total)
+	}
+	var changed sql.NullString
+	if err = refs.QueryRow("SELECT chunk FROM chunk_refs WHERE id = 2").Scan(&changed); err != nil || changed.String != "Changed by hand." {
+		t.Errorf("the chunk changed by hand was stored as %v (%v)", changed, err)
+	}
+	var stripped int
+	if err = refs.QueryRow("SELECT count(*) FROM chunk_refs WHERE strip_refs").Scan(&stripped); err != nil || stripped == 0 {
+		t.Errorf("no chunk was stored with its footnote markers taken out (%v)", err)
+	}
+	if got := storedTexts(t, refs); got != inline {
+		t.Errorf("stored as references, the chunks read\n%s", lineDiff(inline, got))
+	}
+	refSize, err := dbPagesSize(refs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refSize >= inlineSize {
+		t.Errorf("stored as references, the database is %s, inline %s", formatSize(refSize), formatSize(inlineSize))
+	}
+
+	// writes go through the view
+	id := insertChunk(t, refs, 1, 99, "A chunk written since.")
+	if _, err = refs.Exec("UPDATE chunks SET chunk = 'Changed again.' WHERE id = 3"); err != nil {
+		t.Fatal(err)
+	}
+	written := storedTexts(t, refs)
+	if !strings.Contains(written, fmt.Sprintf("%d 1 99 -1 \"A chunk written since.\"", id)) || !strings.Contains(written, `"Changed again."`) {
+		t.Errorf("written through the view, the chunks read\n%s", lineDiff(inline, written))
+	}
+	refs.Close()
+
+	if out = convert(storageInline); !strings.Contains(out, fmt.Sprintf("converted %d chunks to keep their text", total+1)) {
+		t.Errorf("converting back printed %q", out)
+	}
+	back, err := openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer back.Close()
+	if got := storedTexts(t, back); chunkStorage != storageInline || got != written {
+		t.Errorf("stored %s again, the chunks read\n%s", chunkStorage, lineDiff(written, got))
+	}
+	if out = convert(storageInline); !strings.Contains(out, "already") {
+		t.Errorf("converting to inline again printed %q", out)
+	}
+}
+
+func TestConvertStorageRefused(t *testing.T) {
+	rowidOnly(t, "the full text index")
+	db := testFileDB(t)
+	id := addBook(t, db, "Emma", "Jane Austen", testParagraphs(1))
+	insertChunk(t, db, id, 0, testParagraphs(1))
+	indexChunks(t, db)
+	if _, err := captureStdout(t, func() error { return convertStorageCmd([]string{"--mode", storageReference}) }); err == nil ||
+		!strings.Contains(err.Error(), "index --drop") {
+		t.Errorf("converting indexed chunks: %v", err)
+	}
+	if _, err := captureStdout(t, func() error { return convertStorageCmd([]string{"--mode", "zipped"}) }); exitCode(err) != exitUsage {
+		t.Errorf("convert-storage --mode zipped: %v, want a usage error", err)
+	}
+}
+
+func TestFindRefs(t *testing.T) {
+	content := "The first line\nof the first paragraph.\n\n  The second,[1] indented.  \n\nNot a chunk.\n\nThe third."
+	chunks := []string{refText("The first line\nof the first paragraph.", false), "The second, indented.", "nowhere", "The third."}
+	refs := findRefs(content, chunks)
+	if len(refs) != 4 || refs[2] != nil {
+		t.Fatalf("found %+v", refs)
+	}
+	for i, ref := range refs {
+		if ref == nil {
+			continue
+		}
+		text, err := refChunk(content, int64(ref.start), int64(ref.end), ref.stripRefs)
+		if err != nil || text != chunks[i] {
+			t.Errorf("chunk %d is %+v, giving %q (%v)", i, *ref, text, err)
+		}
+	}
+	if !refs[1].stripRefs || refs[0].stripRefs {
+		t.Errorf("the footnote marker is stripped from %+v and %+v", *refs[0], *refs[1])
+	}
+}
+
+func BenchmarkReadChunks(b *testing.B) {
+	for _, mode := range []string{storageInline, storageReference} {
+		b.Run(mode, func(b *testing.B) {
+			db := testFileDB(b)
+			mirror := benchMirror(b, 20, 32*1024)
+			if err := readFiles(db, mirror, ingestOptions{}); err != nil {
+				b.Fatal(err)
+			}
+			if err := makeChunks(db, chunkOptions{}); err != nil {
+				b.Fatal(err)
+			}
+			if mode == storageReference {
+				if err := convertStorage(runCtx, db, storageReference, 1000, true); err != nil {
+					b.Fatal(err)
+				}
+				db.Close()
+				var err error
+				if db, err = openDB(); err != nil {
+					b.Fatal(err)
+				}
+				defer db.Close()
+			}
+			size, err := dbPagesSize(db)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err = scanBooks(db); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(size), "db-bytes")
+		})
+	}
+}
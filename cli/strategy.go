@@ -0,0 +1,112 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"git.tilde.town/gutchunker/gutchunk"
+)
+
+// A strategy is what cuts the body of a book, its lines between the
+// markers, into chunks (see gutchunk.Strategy). gutchunk has one,
+// paragraphs, whose --min-chunk, --merge-short and --max-chunk are its
+// options, and --strategy on chunk, run, chunk-one and audit-chunks names
+// another registered with gutchunk.RegisterStrategy.
+//
+// A strategy of one's own is a package of one's own, whose init registers
+// it with its name and what makes it from the options a book is chunked
+// with, after its overrides and language are applied. A main of one's own
+// importing it and calling Main, as the gutchunk program does, is a
+// gutchunk whose chunk --strategy myscenes cuts by it, with every flag,
+// the database and export as ever. A name registered twice, or one
+// registration refused otherwise, fails every command chunking as it reads
+// its flags, as does a --strategy it doesn't know, listing those it does.
+//
+// The chunks are a strategy's in the order of their ordinals, which says
+// where each is (see chunkPos), with the footnotes it took out, if any;
+// the footer blocklist is applied after. Its name goes into the stable ids
+// of the chunks it cuts (see stableid.go). A book whose chunking panics is
+// retried reduced, by paragraphs.
+
+// strategyFlag adds --strategy to fs, setting it in opts, and returns what
+// checks the strategies registered. A list of them, comma-separated, sets
+// the others to opts.otherStrategies (see multistrategy.go).
+func strategyFlag(fs *flag.FlagSet, opts *chunkOptions) func() error {
+	fs.Func("strategy", "how chunks are cut: "+strings.Join(gutchunk.Strategies(), ", ")+" (default "+gutchunk.DefaultStrategy+"); chunk and run take several, comma-separated, the first's chunks the books'", func(s string) error {
+		if err := gutchunk.CheckStrategies(); err != nil {
+			return err
+		}
+		names := strings.Split(s, ",")
+		seen := map[string]bool{}
+		for i, name := range names {
+			if name == "" && len(names) > 1 {
+				return fmt.Errorf("an empty strategy in %q", s)
+			}
+			if _, err := gutchunk.NewStrategy(name, gutchunk.Options{}); err != nil {
+				return err
+			}
+			if name == "" {
+				name = gutchunk.DefaultStrategy
+			}
+			if seen[name] {
+				return fmt.Errorf("strategy %q is given twice", name)
+			}
+			seen[name], names[i] = true, name
+		}
+		opts.strategyName, opts.otherStrategies = names[0], names[1:]
+		return nil
+	})
+	return func() error {
+		if err := gutchunk.CheckStrategies(); err != nil {
+			return usagef("%v", err)
+		}
+		return nil
+	}
+}
+
+// oneStrategy fails cmd, which cuts with one strategy only, given a list.
+func (opts chunkOptions) oneStrategy(cmd string) error {
+	if len(opts.otherStrategies) > 0 {
+		return usagef("%s takes one --strategy, not %d", cmd, len(opts.otherStrategies)+1)
+	}
+	return nil
+}
+
+// chunkStrategy is the strategy opts cut with. --strategy is checked as
+// the flags are read, so the name is one registered.
+func (opts chunkOptions) chunkStrategy() gutchunk.Strategy {
+	o := opts.chunker()
+	s, err := gutchunk.NewStrategy(o.Strategy, o)
+	if err != nil {
+		panic(fmt.Sprintf("gutchunk: %v", err))
+	}
+	return s
+}
+
+// chunker is opts as the chunker takes them.
+func (opts chunkOptions) chunker() gutchunk.Options {
+	o := gutchunk.Options{
+		BodyOnly:      opts.bodyOnly,
+		Start:         opts.start,
+		End:           opts.end,
+		StartLine:     opts.startLine,
+		EndLine:       opts.endLine,
+		SkipLines:     opts.skipLines,
+		Strategy:      opts.strategyName,
+		MinChunk:      opts.minChunk,
+		MergeShort:    opts.mergeShort,
+		MaxChunk:      opts.window,
+		Runes:         opts.script == ScriptCJK,
+		StripRefs:     opts.stripRefs,
+		KeepFootnotes: opts.keepFootnotes,
+		SceneBreaks:   opts.breaks,
+	}
+	if opts.tagKinds {
+		o.Kind = chunkKind
+	}
+	if opts.trace != nil {
+		o.Trace = opts.trace
+	}
+	return o
+}
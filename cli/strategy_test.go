@@ -0,0 +1,104 @@
+package cli
+
+import (
+	"flag"
+	"io"
+	"strings"
+	"testing"
+
+	"git.tilde.town/gutchunker/gutchunk"
+)
+
+// toyStrategy cuts a chunk of each paragraph's first line, however short,
+// tagging it toy.
+type toyStrategy struct{ opts gutchunk.Options }
+
+func (toyStrategy) Name() string { return "toy" }
+
+func (s toyStrategy) Split(b gutchunk.Body) ([]gutchunk.Chunk, []gutchunk.Footnote) {
+	chunks := []gutchunk.Chunk{}
+	for i, l := range b.Lines {
+		if l != "" && (i == 0 || b.Lines[i-1] == "") {
+			chunks = append(chunks, gutchunk.Chunk{Ordinal: len(chunks), Text: l, Line: i, Position: float64(i) / float64(len(b.Lines)), Kind: "toy"})
+		}
+	}
+	return chunks, nil
+}
+
+func init() {
+	if err := gutchunk.RegisterStrategy("toy", func(opts gutchunk.Options) gutchunk.Strategy { return toyStrategy{opts} }); err != nil {
+		panic(err)
+	}
+}
+
+// parseChunkFlags parses args as a chunking command's flags would be.
+func parseChunkFlags(args ...string) (chunkOptions, error) {
+	var opts chunkOptions
+	fs := flag.NewFlagSet("chunk", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	sizes := chunkSizeFlags(fs, &opts)
+	if err := fs.Parse(args); err != nil {
+		return opts, err
+	}
+	return opts, sizes()
+}
+
+func TestStrategyFlag(t *testing.T) {
+	opts, err := parseChunkFlags("--strategy", "toy")
+	if err != nil || opts.strategyName != "toy" {
+		t.Errorf("--strategy toy: %q, %v", opts.strategyName, err)
+	}
+	_, err = parseChunkFlags("--strategy", "nonesuch")
+	if err == nil || !strings.Contains(err.Error(), `no strategy "nonesuch"; there are paragraphs, toy`) {
+		t.Errorf("--strategy nonesuch: %v", err)
+	}
+	if opts, err = parseChunkFlags(); err != nil || opts.chunkStrategy().Name() != gutchunk.DefaultStrategy {
+		t.Errorf("no --strategy: %v", err)
+	}
+}
+
+// The toy strategy cuts books chunked by it end to end, its chunks stored
+// in its order with what it said of each.
+func TestToyStrategy(t *testing.T) {
+	db := testDB(t)
+	id := addBook(t, db, "Toy", "Someone", testBook("Toy", testParagraphs(3)+"\n\nA short one."))
+	opts, err := parseChunkFlags("--strategy", "toy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = makeChunks(db, opts); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.Query("SELECT chunk, ordinal, kind, stable_id FROM chunks WHERE sourceid = ? ORDER BY ordinal", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	n := 0
+	for ; rows.Next(); n++ {
+		var chunk, kind, stable string
+		var ordinal int
+		if err = rows.Scan(&chunk, &ordinal, &kind, &stable); err != nil {
+			t.Fatal(err)
+		}
+		if ordinal != n || kind != "toy" || stable == "" {
+			t.Errorf("chunk %d: ordinal %d, kind %q, stable id %q", n, ordinal, kind, stable)
+		}
+		if n == 3 && chunk != "A short one." {
+			t.Errorf("the short paragraph was chunked %q", chunk)
+		}
+	}
+	if n != 4 {
+		t.Errorf("%d chunks, want one a paragraph", n)
+	}
+
+	// chunked again by paragraphs, they are cut anew
+	if _, err = chunkHeld(writerOf(db), id, chunkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	var toy int
+	db.QueryRow("SELECT count(*) FROM chunks WHERE sourceid = ? AND kind = 'toy'", id).Scan(&toy)
+	if toy != 0 || chunkCount(t, db, id) != 3 {
+		t.Errorf("by paragraphs: %d chunks, %d of them toy", chunkCount(t, db, id), toy)
+	}
+}
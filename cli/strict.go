@@ -0,0 +1,111 @@
+package cli
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ingest, chunk and run take --strict for checking a chunker config
+// against a few fixtures: the run goes through as always, and then, if it
+// left any warning, prints how many of each code and exits 5. Warnings of
+// severity info, like a book with no author, don't count, unless their
+// code is given: --strict=no_start_marker,no_chunks counts only the
+// warnings with those codes. Only what this run left is counted, so the
+// fixtures must be ingested afresh, as an archive ingested already is
+// skipped without warning again.
+
+// strictFlag is the value of --strict: off, on for every warning, or on for
+// those with the codes listed.
+type strictFlag struct {
+	on    bool
+	codes []string
+}
+
+func (s *strictFlag) String() string {
+	switch {
+	case s == nil || !s.on:
+		return "false"
+	case len(s.codes) == 0:
+		return "true"
+	}
+	return strings.Join(s.codes, ",")
+}
+
+func (s *strictFlag) Set(v string) error {
+	switch v {
+	case "true":
+		*s = strictFlag{on: true}
+	case "false":
+		*s = strictFlag{}
+	default:
+		*s = strictFlag{on: true}
+		for _, c := range strings.Split(v, ",") {
+			if c = strings.TrimSpace(c); c != "" {
+				s.codes = append(s.codes, c)
+			}
+		}
+		if len(s.codes) == 0 {
+			return fmt.Errorf("no warning codes in %q", v)
+		}
+	}
+	return nil
+}
+
+func (s *strictFlag) IsBoolFlag() bool { return true }
+
+func strictFlags(fs *flag.FlagSet) *strictFlag {
+	s := &strictFlag{}
+	fs.Var(s, "strict", "exit 5 if the run leaves any warning, or with =CODE,... any with one of those codes")
+	return s
+}
+
+// strictError is a run that went through but left warnings --strict
+// counts.
+type strictError struct {
+	warnings int
+}
+
+func (e strictError) Error() string {
+	return fmt.Sprintf("%d warnings under --strict; see gutchunk warnings --run %d", e.warnings, currentRun)
+}
+
+// check returns a strictError when this run left warnings s counts, after
+// printing how many of each, and err, how the run ended, when that isn't
+// nil already.
+func (s *strictFlag) check(db *sql.DB, err error) error {
+	if err != nil || !s.on {
+		return err
+	}
+	codes, _ := json.Marshal(append([]string{}, s.codes...))
+	rows, err := db.Query(`SELECT severity, scope, code, count(*) FROM warnings
+		WHERE run_id = ? AND CASE WHEN ? = '[]' THEN severity != ? ELSE code IN (SELECT value FROM json_each(?)) END
+		GROUP BY severity, scope, code ORDER BY count(*) DESC, code`, currentRun, string(codes), sevInfo, string(codes))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	total := 0
+	for rows.Next() {
+		var sev, scope, code string
+		var n int
+		if err = rows.Scan(&sev, &scope, &code, &n); err != nil {
+			return err
+		}
+		if total == 0 {
+			fmt.Fprintln(os.Stderr, "warnings under --strict:")
+		}
+		fmt.Fprintf(os.Stderr, "%7d  %-8s %-8s %s\n", n, sev, scope, code)
+		total += n
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if total > 0 {
+		return strictError{total}
+	}
+	return nil
+}
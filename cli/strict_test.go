@@ -0,0 +1,99 @@
+package cli
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStrictFlag(t *testing.T) {
+	for in, want := range map[string]string{
+		"true":                        "true",
+		"false":                       "false",
+		"no_start_marker":             "no_start_marker",
+		" no_start_marker, no_chunks": "no_start_marker,no_chunks",
+	} {
+		var s strictFlag
+		if err := s.Set(in); err != nil || s.String() != want {
+			t.Errorf("--strict=%s is %s (%v), want %s", in, s.String(), err, want)
+		}
+	}
+	var s strictFlag
+	if err := s.Set(" , "); err == nil {
+		t.Errorf("--strict=' , ' is %s", s.String())
+	}
+}
+
+// strictFixtures is a mirror of two books, Emma as it should be and
+// Persuasion with no START marker, so no chunks, and no author, beside an
+// archive holding only an image.
+func strictFixtures(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	writeTestZip(t, filepath.Join(root, "1", "11.zip"), zipEntry{"11.txt", testBook("Emma", testParagraphs(2))})
+	writeTestZip(t, filepath.Join(root, "2", "22.zip"), zipEntry{"22.txt", "Title: Persuasion\n\n" + testParagraphs(2)})
+	writeTestZip(t, filepath.Join(root, "3", "33.zip"), zipEntry{"33.png", "\x89PNG\r\n\x1a\n"})
+	return root
+}
+
+func TestStrict(t *testing.T) {
+	root := strictFixtures(t)
+	run := func(cmd func([]string) error, args ...string) (string, error) {
+		t.Helper()
+		var err error
+		out, _ := captureStderr(t, func() error {
+			_, err = captureStdout(t, func() error { return cmd(args) })
+			return nil
+		})
+		return out, err
+	}
+
+	// without --strict, warnings are only kept
+	testDB(t)
+	if _, err := run(ingestCmd, "--target", root); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := run(chunkCmd); err != nil {
+		t.Fatal(err)
+	}
+
+	testDB(t)
+	out, err := run(ingestCmd, "--target", root, "--strict")
+	if exitCode(err) != exitStrict || !strings.Contains(out, "warnings under --strict:\n") || !strings.Contains(out, "      1  warn     ingest   no_text_member\n") {
+		t.Errorf("ingest --strict: %v, printing\n%s", err, out)
+	}
+	// a book with no author is only info
+	if strings.Contains(out, "no_author") {
+		t.Errorf("ingest --strict counted info warnings:\n%s", out)
+	}
+	out, err = run(chunkCmd, "--strict")
+	if exitCode(err) != exitStrict || !strings.Contains(out, "      1  warn     chunk    no_start_marker\n") ||
+		!strings.Contains(out, "      1  warn     chunk    no_chunks\n") || strings.Contains(out, "no_text_member") {
+		t.Errorf("chunk --strict: %v, printing\n%s", err, out)
+	}
+	// only this run's warnings count, and only those of the codes given
+	if out, err = run(chunkCmd, "--strict=no_text_member,binary"); err != nil {
+		t.Errorf("chunk --strict=no_text_member,binary: %v, printing\n%s", err, out)
+	}
+
+	testDB(t)
+	if out, err = run(runCmd, "--target", root, "--strict=no_author"); exitCode(err) != exitStrict || !strings.Contains(out, "info     metadata no_author\n") {
+		t.Errorf("run --strict=no_author: %v, printing\n%s", err, out)
+	}
+	testDB(t)
+	if out, err = run(runCmd, "--target", root, "--pipeline", "--strict"); exitCode(err) != exitStrict ||
+		!strings.Contains(out, "no_text_member\n") || !strings.Contains(out, "no_start_marker\n") {
+		t.Errorf("run --pipeline --strict: %v, printing\n%s", err, out)
+	}
+	if !strings.Contains(err.Error(), "3 warnings under --strict; see gutchunk warnings --run") {
+		t.Errorf("run --pipeline --strict: %v", err)
+	}
+
+	// a fixture warning of nothing passes
+	clean := t.TempDir()
+	writeTestZip(t, filepath.Join(clean, "1", "11.zip"), zipEntry{"11.txt", testBook("Emma", testParagraphs(2))})
+	testDB(t)
+	if _, err = run(runCmd, "--target", clean, "--strict"); err != nil {
+		t.Errorf("run --strict of a clean fixture: %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// Some archives' text members hold no book: a placeholder for an audio
+// book pointing at its .mp3 files, or a stub of a few hundred bytes, like
+// a copyright renewal notice. Ingested they would be books of no chunks.
+// A member whose body, what is left once its header and license are cut,
+// is under --min-body-size, or which is short and says one of the stub
+// phrases, is rejected as a stub, like a binary member, and the next text
+// member of the archive tried. The phrases are only looked for in bodies
+// under stubPhraseBytes, as a book quoting one is no stub; the defaults
+// can be added to with --stub-phrase-file, as the footer's can with
+// --blockphrase-file.
+const (
+	defaultMinBodySize = 200
+	stubPhraseBytes    = 16 << 10
+)
+
+// warnStub is the code of the warning left for a member rejected as a
+// stub.
+const warnStub = "stub"
+
+// phrases that only turn up in placeholders standing in for a book
+var defaultStubPhrases = []string{
+	"this is an audio ebook",
+	"this is an audio book",
+	"this audio ebook",
+	"see the .mp3 files",
+	"see the mp3 files",
+	"the audio files are in",
+	"this file is a placeholder",
+	"this ebook has been withdrawn",
+	"this etext has been withdrawn",
+}
+
+var defaultStubList = newBlocklist(defaultStubPhrases, false)
+
+func (o ingestOptions) bodyFloor() int64 {
+	if o.minBodySize == 0 {
+		return defaultMinBodySize
+	}
+	return o.minBodySize
+}
+
+func (o ingestOptions) stubList() *blocklist {
+	if o.stubPhrases != nil {
+		return o.stubPhrases
+	}
+	return defaultStubList
+}
+
+// stubFlags adds --min-body-size and --stub-phrase-file to fs and returns
+// what sets them in o.
+func stubFlags(fs *flag.FlagSet, o *ingestOptions) func() error {
+	size := fs.String("min-body-size", formatSize(defaultMinBodySize), "reject text members whose body after the header is smaller than this as stubs (0 for no floor)")
+	file := fs.String("stub-phrase-file", "", "file of extra phrases marking a short member as a placeholder, one per line")
+	return func() error {
+		n, err := parseSize(*size)
+		if err != nil {
+			return usageError{err.Error()}
+		}
+		o.minBodySize = n
+		if n == 0 {
+			o.minBodySize = -1
+		}
+		phrases, err := loadPhrases(*file, defaultStubPhrases)
+		if err != nil {
+			return fmt.Errorf("could not read stub phrases: %w", err)
+		}
+		o.stubPhrases = newBlocklist(phrases, false)
+		return nil
+	}
+}
+
+// stubReason says why text is a stub rather than a book, "" when it
+// isn't one.
+func stubReason(text string, o ingestOptions) string {
+	lines, m := bookBody(text, false)
+	if m.Starts == 0 {
+		lines, _ = bookBody(text, true)
+	}
+	body := strings.TrimSpace(strings.Join(lines, "\n"))
+	if floor := o.bodyFloor(); floor > 0 && int64(len(body)) < floor {
+		return fmt.Sprintf("%d bytes after its header, under --min-body-size %s", len(body), formatSize(floor))
+	}
+	if len(body) < stubPhraseBytes {
+		list := o.stubList()
+		if i := list.match(body); i >= 0 {
+			return fmt.Sprintf("a placeholder saying %q", list.phrases[i])
+		}
+	}
+	return ""
+}
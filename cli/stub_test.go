@@ -0,0 +1,103 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// a poem of eight short lines, a book however short
+const testPoem = `The sea is calm to-night.
+The tide is full, the moon lies fair
+Upon the straits; on the French coast the light
+Gleams and is gone; the cliffs of England stand,
+Glimmering and vast, out in the tranquil bay.
+Come to the window, sweet is the night-air!
+Only, from the long line of spray
+Where the sea meets the moon-blanch'd land,`
+
+// an audio book's placeholder, long enough to be over the floor
+var testAudioStub = testBook("Audio", "This is an audio eBook. See the .mp3 files in this directory for the reading.\n\nThe reading was recorded by volunteers for the Project, and each chapter is a file of its own, named for its number. The text it was read from is ebook 1342.")
+
+func TestStubReason(t *testing.T) {
+	for _, c := range []struct {
+		text, want string
+	}{
+		{testAudioStub, `a placeholder saying "this is an audio ebook"`},
+		{testBook("Renewal", "Copyright renewed 1954."), "23 bytes after its header, under --min-body-size 200B"},
+		{"This file is a placeholder.", "27 bytes after its header, under --min-body-size 200B"},
+		{testBook("Dover Beach", testPoem), ""},
+		{testBook("Emma", testParagraphs(3)), ""},
+		// a book quoting a phrase is no stub
+		{testBook("Long", "This is an audio eBook, it said.\n\n"+testParagraphs(60)), ""},
+	} {
+		if got := stubReason(c.text, ingestOptions{}); got != c.want {
+			t.Errorf("stubReason(%.40q) = %q, want %q", c.text, got, c.want)
+		}
+	}
+
+	// with no floor, only a phrase makes a stub
+	o := ingestOptions{minBodySize: -1}
+	if got := stubReason(testBook("Renewal", "Copyright renewed 1954."), o); got != "" {
+		t.Errorf("with no floor, the renewal is a stub: %s", got)
+	}
+	o.stubPhrases = newBlocklist(append(defaultStubPhrases, "copyright renewed"), false)
+	if got := stubReason(testBook("Renewal", "Copyright renewed 1954."), o); got != `a placeholder saying "copyright renewed"` {
+		t.Errorf("with a phrase of its own, the renewal is %q", got)
+	}
+}
+
+func TestIngestStubs(t *testing.T) {
+	root := t.TempDir()
+	writeTestZip(t, filepath.Join(root, "1", "11.zip"), zipEntry{"11.txt", testAudioStub}, zipEntry{"11-01.mp3", "ID3"})
+	writeTestZip(t, filepath.Join(root, "2", "22.zip"), zipEntry{"22.txt", testBook("Renewal", "Copyright renewed 1954.")})
+	writeTestZip(t, filepath.Join(root, "3", "33.zip"), zipEntry{"33.txt", testBook("Dover Beach", testPoem)})
+	// a stub beside the book is passed over for it
+	writeTestZip(t, filepath.Join(root, "4", "44.zip"), zipEntry{"44.txt", testBook("Emma", testParagraphs(2))}, zipEntry{"44-readme.txt", testAudioStub[:len(testAudioStub)-1] + strings.Repeat(" ", 900) + "\n"})
+
+	db := testDB(t)
+	out, err := captureStdout(t, func() error { return ingestCmd([]string{"--target", root}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "skipped 3 stubs\n") {
+		t.Errorf("ingest printed\n%s\nwant it to count 3 stubs", out)
+	}
+	if got := names(t, db, "SELECT name FROM files ORDER BY id"); got != "Dover Beach\nEmma\n" {
+		t.Errorf("ingest stored\n%s", got)
+	}
+	if got := warningRows(t, db); !strings.HasPrefix(got, "ingest warn stub 11.txt\ningest warn stub 22.txt\ningest warn stub 44-readme.txt\n") {
+		t.Errorf("ingest warned\n%s", got)
+	}
+
+	// with no floor and a phrase of its own, the renewal is still one
+	phrases := filepath.Join(t.TempDir(), "stubs")
+	if err = os.WriteFile(phrases, []byte("# renewals\ncopyright renewed\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	db = testDB(t)
+	if out, err = captureStdout(t, func() error {
+		return ingestCmd([]string{"--target", root, "--min-body-size", "0", "--stub-phrase-file", phrases})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(t, db, "SELECT name FROM files ORDER BY id"); got != "Dover Beach\nEmma\n" || !strings.Contains(out, "skipped 3 stubs\n") {
+		t.Errorf("with --stub-phrase-file, ingest stored\n%s", got)
+	}
+	// and with no floor alone, a book
+	db = testDB(t)
+	if _, err = captureStdout(t, func() error { return ingestCmd([]string{"--target", root, "--min-body-size", "0"}) }); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(t, db, "SELECT name FROM files ORDER BY id"); got != "Renewal\nDover Beach\nEmma\n" {
+		t.Errorf("with --min-body-size 0, ingest stored\n%s", got)
+	}
+
+	if _, err = captureStdout(t, func() error { return ingestCmd([]string{"--min-body-size", "some"}) }); exitCode(err) != exitUsage {
+		t.Errorf("ingest --min-body-size some: %v, want a usage error", err)
+	}
+	if _, err = captureStdout(t, func() error { return ingestCmd([]string{"--stub-phrase-file", phrases + ".gone"}) }); err == nil {
+		t.Error("ingest with a stub phrase file that isn't there succeeded")
+	}
+}
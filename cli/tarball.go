@@ -0,0 +1,271 @@
+package cli
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// readTar is readFiles for a mirror packed into one tar, gzipped or not,
+// read as a stream so it needn't be unpacked first. Each zip of a book in
+// it is held on its own, in memory or past spill bytes in a temporary
+// file, and ingested as if walked: its path in the tar, less any
+// directories above the mirror's own like a leading "gutenberg/", is taken
+// as its name under root, so the journal, --resume and a later walk of root see
+// the same archives either way.
+//
+// A stream can't be looked ahead in, so the edition filter can't list an
+// etext directory. Its archives are held instead, only the newest edition
+// of each title, and ingested once the tar moves on to another directory.
+func readTar(db *sql.DB, root, tarPath string, spill int64, opts ingestOptions) error {
+	done, _, err := startIngest(db, root, opts)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	in := &countingReader{r: f}
+	br := bufio.NewReader(in)
+	var r io.Reader = br
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tmp, err := os.MkdirTemp("", "gutchunk-tar")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	t := &tarIngest{db: db, root: root, opts: opts, spill: spill, tmp: tmp, done: done, held: map[string]*heldArchive{}}
+	tr := tar.NewReader(r)
+	shown := time.Now()
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", tarPath, err)
+		}
+		if !h.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		rel := mirrorRelative(h.Name)
+		if !isBookArchive(path.Base(rel)) {
+			continue
+		}
+		if err = t.entry(tr, rel, h.Size); err != nil {
+			return err
+		}
+		if time.Since(shown) >= 5*time.Second {
+			shown = time.Now()
+			fmt.Printf("read %s of %s (%.0f%%), %d archives ingested\n",
+				formatSize(in.n), formatSize(fi.Size()), 100*float64(in.n)/float64(fi.Size()), t.ingested)
+		}
+	}
+	if err = t.flush(); err != nil {
+		return err
+	}
+	fmt.Printf("read %s of %s, %d archives ingested\n", formatSize(in.n), tarPath, t.ingested)
+	return nil
+}
+
+// mirrorRelative is the path of a tar entry relative to the mirror root:
+// from its first directory that is one of the mirror's own, a single digit
+// or an etextNN directory, or all of it when none is.
+func mirrorRelative(name string) string {
+	parts := strings.Split(path.Clean(strings.TrimLeft(name, "/")), "/")
+	for i, p := range parts[:len(parts)-1] {
+		if len(p) == 1 && p[0] >= '0' && p[0] <= '9' || etextDir.MatchString(strings.ToLower(p)) {
+			return strings.Join(parts[i:], "/")
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// heldArchive is one zip out of the tar, in data or past the spill size
+// in file.
+type heldArchive struct {
+	archive string
+	edition int
+	data    []byte
+	file    string
+	// ingested before, kept only to supersede older editions
+	done bool
+}
+
+func (h *heldArchive) remove() {
+	if h.file != "" {
+		os.Remove(h.file)
+	}
+}
+
+type tarIngest struct {
+	db    *sql.DB
+	root  string
+	opts  ingestOptions
+	spill int64
+	tmp   string
+	done  map[string]bool
+
+	// the directory being read and its etext archives held, by title code
+	// in the order first seen
+	dir      string
+	held     map[string]*heldArchive
+	codes    []string
+	files    int
+	ingested int
+}
+
+// entry takes the archive read from r, size bytes, ingesting it or, for
+// the etext layout, holding it until its directory is done.
+func (t *tarIngest) entry(r io.Reader, archive string, size int64) error {
+	if dir := filepath.Dir(archive); dir != t.dir {
+		if err := t.flush(); err != nil {
+			return err
+		}
+		t.dir = dir
+	}
+	an := parseArchiveName(archive)
+	if turnedAway(archive, ArchiveInfo{}, t.done, t.opts) {
+		// still supersedes older editions later in the directory
+		if prev := t.held[an.code]; an.layout == layoutEtext && (prev == nil || prev.edition < an.edition) {
+			t.supersede(prev, an.code)
+			t.held[an.code] = &heldArchive{archive: archive, edition: an.edition, done: true}
+		}
+		return nil
+	}
+	if an.layout != layoutEtext {
+		h, err := t.hold(r, archive, size, false)
+		if err != nil {
+			return err
+		}
+		defer h.remove()
+		return t.ingest(h)
+	}
+	prev := t.held[an.code]
+	if prev != nil && prev.edition > an.edition && turnedAway(archive, ArchiveInfo{Superseded: true}, nil, t.opts) {
+		return nil
+	}
+	// etext directories hold hundreds of archives, too many to keep in
+	// memory
+	h, err := t.hold(r, archive, size, true)
+	if err != nil {
+		return err
+	}
+	h.edition = an.edition
+	t.supersede(prev, an.code)
+	t.held[an.code] = h
+	return nil
+}
+
+// supersede drops prev, the archive held for code, for a newer edition.
+func (t *tarIngest) supersede(prev *heldArchive, code string) {
+	if prev == nil {
+		t.codes = append(t.codes, code)
+		return
+	}
+	if !prev.done && turnedAway(prev.archive, ArchiveInfo{Superseded: true}, nil, t.opts) {
+		prev.remove()
+	}
+}
+
+// hold reads an archive out of the tar, into a temporary file when it is
+// over the spill size or toDisk.
+func (t *tarIngest) hold(r io.Reader, archive string, size int64, toDisk bool) (*heldArchive, error) {
+	h := &heldArchive{archive: archive}
+	if !toDisk && size <= t.spill {
+		var err error
+		if h.data, err = io.ReadAll(r); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", archive, err)
+		}
+		return h, nil
+	}
+	t.files++
+	h.file = filepath.Join(t.tmp, fmt.Sprintf("%d.zip", t.files))
+	f, err := os.Create(h.file)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		h.remove()
+		return nil, fmt.Errorf("reading %s: %w", archive, err)
+	}
+	return h, f.Close()
+}
+
+// ingest ingests a held archive as ingestOne would the archive on disk.
+func (t *tarIngest) ingest(h *heldArchive) error {
+	err := ingestJournaled(t.db, t.root, h.archive, func(tx *sql.Tx) (Reason, error) {
+		sw := t.opts.timings.start(h.archive)
+		if h.file != "" {
+			r, err := zip.OpenReader(h.file)
+			if err != nil {
+				return Reason{}, fmt.Errorf("%s: %w", h.archive, err)
+			}
+			defer r.Close()
+			return ingestZip(tx, &r.Reader, h.archive, h.archive, t.opts, &sw)
+		}
+		r, err := zip.NewReader(bytes.NewReader(h.data), int64(len(h.data)))
+		if err != nil {
+			return Reason{}, fmt.Errorf("%s: %w", h.archive, err)
+		}
+		return ingestZip(tx, r, h.archive, h.archive, t.opts, &sw)
+	})
+	if err == nil {
+		t.ingested++
+	}
+	return err
+}
+
+// flush ingests the etext archives held for the directory just read.
+func (t *tarIngest) flush() error {
+	for _, code := range t.codes {
+		h := t.held[code]
+		if h.done {
+			continue
+		}
+		err := t.ingest(h)
+		h.remove()
+		if err != nil {
+			return err
+		}
+	}
+	t.held = map[string]*heldArchive{}
+	t.codes = nil
+	return nil
+}
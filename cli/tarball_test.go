@@ -0,0 +1,138 @@
+package cli
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"database/sql"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writeTestTar packs the files under dir into a tar at path, each under
+// prefix, gzipped when path ends in .gz, with a directory entry of its own
+// for each directory as tar does.
+func writeTestTar(t *testing.T, path, dir, prefix string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var w io.Writer = f
+	if strings.HasSuffix(path, ".gz") {
+		gz := gzip.NewWriter(f)
+		defer gz.Close()
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		h, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		h.Name = prefix + filepath.ToSlash(rel)
+		if info.IsDir() {
+			h.Name += "/"
+		}
+		if err = tw.WriteHeader(h); err != nil || info.IsDir() {
+			return err
+		}
+		bs, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(bs)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMirrorRelative(t *testing.T) {
+	for name, want := range map[string]string{
+		"gutenberg/1/2/3/123/123.zip":  "1/2/3/123/123.zip",
+		"./mirror/etext95/dracu10.zip": "etext95/dracu10.zip",
+		"/1/11.zip":                    "1/11.zip",
+		"books/11.zip":                 "books/11.zip",
+		"11.zip":                       "11.zip",
+	} {
+		if got := mirrorRelative(name); got != want {
+			t.Errorf("mirrorRelative(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestReadTar(t *testing.T) {
+	mirror := t.TempDir()
+	writeTestZip(t, filepath.Join(mirror, "1", "11.zip"), zipEntry{"11.txt", testBook("Book 11", testParagraphs(2))})
+	writeTestZip(t, filepath.Join(mirror, "2", "22.zip"), zipEntry{"22.txt", testBook("Book 22", testParagraphs(2)+"\n\nOf 22.")})
+	writeTestZip(t, filepath.Join(mirror, "etext95", "dracu11.zip"), zipEntry{"dracu11.txt", testBook("Dracula", testParagraphs(2)+"\n\nThe second.")})
+	writeTestZip(t, filepath.Join(mirror, "etext95", "dracu10.zip"), zipEntry{"dracu10.txt", testBook("Dracula", testParagraphs(2)+"\n\nThe first.")})
+	writeTestZip(t, filepath.Join(mirror, "etext95", "alice30a.zip"), zipEntry{"alice30a.txt", testBook("Alice", testParagraphs(2)+"\n\nDown the hole.")})
+	if err := os.WriteFile(filepath.Join(mirror, "README"), []byte("not a book"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"1/11.zip", "2/22.zip", "etext95/alice30a.zip", "etext95/dracu11.zip"}
+
+	for _, c := range []struct {
+		name  string
+		spill int64
+	}{
+		{"mirror.tar.gz", 64 << 20},
+		// every archive held in a temporary file
+		{"mirror.tar", 0},
+	} {
+		packed := filepath.Join(t.TempDir(), c.name)
+		writeTestTar(t, packed, mirror, "gutenberg/")
+		db := testDB(t)
+		if _, err := captureStdout(t, func() error { return readTar(db, mirror, packed, c.spill, ingestOptions{}) }); err != nil {
+			t.Fatal(err)
+		}
+		got := archivesIngested(t, db)
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("%s: ingested %q, want %q", c.name, got, want)
+		}
+		var n int
+		if err := db.QueryRow("SELECT count(*) FROM files WHERE content LIKE '%The first.%'").Scan(&n); err != nil || n != 0 {
+			t.Errorf("%s: the superseded edition of Dracula was ingested", c.name)
+		}
+
+		// a walk of the mirror unpacked sees the same archives
+		if _, err := captureStdout(t, func() error { return readFiles(db, mirror, ingestOptions{resume: true}) }); err != nil {
+			t.Fatal(err)
+		}
+		if got = archivesIngested(t, db); len(got) != len(want) {
+			t.Errorf("%s: walking the mirror after reading the tar ingested %q", c.name, got)
+		}
+	}
+}
+
+// archivesIngested is the archives of db's books, sorted.
+func archivesIngested(t *testing.T, db *sql.DB) []string {
+	t.Helper()
+	rows, err := db.Query("SELECT archive FROM files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var archives []string
+	for rows.Next() {
+		var a string
+		if err = rows.Scan(&a); err != nil {
+			t.Fatal(err)
+		}
+		archives = append(archives, a)
+	}
+	sort.Strings(archives)
+	return archives
+}
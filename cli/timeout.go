@@ -0,0 +1,213 @@
+package cli
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+var (
+	timeout     = flag.Duration("timeout", 0, "give up on the command after this long, rolling back what it was in the middle of writing (0 for never)")
+	dbTimeout   = flag.Duration("db-timeout", 0, "give up on any one database statement, including reading all of a query's rows, after this long (0 for never)")
+	readTimeout = flag.Duration("read-timeout", 0, "give up on reading any one archive or book after this long (0 for never)")
+)
+
+// runCtx is done once --timeout has passed.
+var runCtx = context.Background()
+
+var errTimedOut = errors.New("timed out")
+
+func timedOut(err error) bool {
+	return errors.Is(err, errTimedOut) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// how long a command has to wind down after --timeout before it is stopped
+// where it stands
+const timeoutGrace = 10 * time.Second
+
+// startTimeout sets runCtx's deadline. Statements fail once it passes and
+// the command unwinds, rolling back its transaction; one stuck somewhere
+// nothing can interrupt, like a read from a dead NFS server, is stopped
+// after timeoutGrace with whatever summary it has. Either way sqlite keeps
+// nothing of a transaction that wasn't committed.
+func startTimeout() context.CancelFunc {
+	if *timeout <= 0 {
+		return func() {}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	runCtx = ctx
+	go func() {
+		<-ctx.Done()
+		if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return
+		}
+		time.Sleep(timeoutGrace)
+		fmt.Fprintf(os.Stderr, "error: timed out after %s and did not stop within %s\n", *timeout, timeoutGrace)
+		active.mu.Lock()
+		active.t.report(active.command, errTimedOut)
+		os.Exit(exitCancelled)
+	}()
+	return cancel
+}
+
+// active is the timings of the running command, for reporting on a run
+// stopped by the timeout.
+var active struct {
+	mu      sync.Mutex
+	command string
+	t       *timings
+}
+
+// runTimings starts the timings for command and makes them the ones
+// reported should the command be stopped.
+func runTimings(command string) *timings {
+	t := newTimings()
+	active.mu.Lock()
+	active.command, active.t = command, t
+	active.mu.Unlock()
+	events.emit("run_started", map[string]interface{}{"command": command})
+	return t
+}
+
+// withinRead runs read, giving up on it after --read-timeout or once
+// --timeout passes. A read given up on is left running, as a read blocked
+// in the kernel can't be interrupted; it must not touch anything the
+// caller uses afterwards.
+func withinRead(what string, read func() error) error {
+	if *readTimeout <= 0 && runCtx.Done() == nil {
+		return read()
+	}
+	ctx := runCtx
+	if *readTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *readTimeout)
+		defer cancel()
+	}
+	done := make(chan error, 1)
+	go func() { done <- read() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("reading %s: %w", what, errTimedOut)
+	}
+}
+
+// withDeadlines reports whether database statements need a deadline.
+func withDeadlines() bool {
+	return *timeout > 0 || *dbTimeout > 0
+}
+
+// statementContext bounds one statement by --db-timeout and --timeout.
+func statementContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	var at time.Time
+	if *dbTimeout > 0 {
+		at = time.Now().Add(*dbTimeout)
+	}
+	if d, ok := runCtx.Deadline(); ok && (at.IsZero() || d.Before(at)) {
+		at = d
+	}
+	if at.IsZero() {
+		return ctx, func() {}
+	}
+	return context.WithDeadline(ctx, at)
+}
+
+// deadlineConn gives its statements deadlines, so nothing has to pass
+// contexts around to get them. sqlite interrupts a statement whose context
+// is done.
+type deadlineConn struct {
+	*sqlite3.SQLiteConn
+}
+
+// deadlineErr makes the error of a statement that ran past its deadline
+// say so. Waiting on a lock can't be interrupted, and fails as "database
+// is locked" once the busy timeout set from --db-timeout runs out.
+func deadlineErr(ctx context.Context, err error) error {
+	var serr sqlite3.Error
+	if err == nil || timedOut(err) {
+		return err
+	}
+	if ctx.Err() != nil || errors.As(err, &serr) && serr.Code == sqlite3.ErrBusy && *dbTimeout > 0 {
+		return fmt.Errorf("%v: %w", err, context.DeadlineExceeded)
+	}
+	return err
+}
+
+func (c deadlineConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	ctx, cancel := statementContext(ctx)
+	defer cancel()
+	res, err := c.SQLiteConn.ExecContext(ctx, query, args)
+	return res, deadlineErr(ctx, err)
+}
+
+func (c deadlineConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	ctx, cancel := statementContext(ctx)
+	rows, err := c.SQLiteConn.QueryContext(ctx, query, args)
+	if err != nil {
+		cancel()
+		return nil, deadlineErr(ctx, err)
+	}
+	return deadlineRows{rows.(*sqlite3.SQLiteRows), ctx, cancel}, nil
+}
+
+func (c deadlineConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	s, err := c.SQLiteConn.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return deadlineStmt{s.(*sqlite3.SQLiteStmt)}, nil
+}
+
+func (c deadlineConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+type deadlineStmt struct {
+	*sqlite3.SQLiteStmt
+}
+
+func (s deadlineStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	ctx, cancel := statementContext(ctx)
+	defer cancel()
+	res, err := s.SQLiteStmt.ExecContext(ctx, args)
+	return res, deadlineErr(ctx, err)
+}
+
+func (s deadlineStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	ctx, cancel := statementContext(ctx)
+	rows, err := s.SQLiteStmt.QueryContext(ctx, args)
+	if err != nil {
+		cancel()
+		return nil, deadlineErr(ctx, err)
+	}
+	return deadlineRows{rows.(*sqlite3.SQLiteRows), ctx, cancel}, nil
+}
+
+// deadlineRows holds its statement's deadline until the rows are closed.
+type deadlineRows struct {
+	*sqlite3.SQLiteRows
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (r deadlineRows) Next(dest []driver.Value) error {
+	err := r.SQLiteRows.Next(dest)
+	if err == io.EOF {
+		return err
+	}
+	return deadlineErr(r.ctx, err)
+}
+
+func (r deadlineRows) Close() error {
+	defer r.cancel()
+	return r.SQLiteRows.Close()
+}
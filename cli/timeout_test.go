@@ -0,0 +1,144 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// slowQuery never ends by itself: the store it is put to is as slow as a
+// wedged mount, and only a deadline stops it.
+const slowQuery = "WITH RECURSIVE n(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM n) SELECT count(*) FROM n"
+
+// setFlag sets a duration flag for the test, putting it back after.
+func setFlag(t *testing.T, f *time.Duration, d time.Duration) {
+	t.Helper()
+	was := *f
+	*f = d
+	t.Cleanup(func() { *f = was })
+}
+
+// startRunTimeout gives runCtx a deadline d from now, as --timeout does,
+// returning a func that takes it away again.
+func startRunTimeout(t *testing.T, d time.Duration) func() {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	runCtx = ctx
+	stop := func() {
+		cancel()
+		runCtx = context.Background()
+	}
+	t.Cleanup(stop)
+	return stop
+}
+
+func TestTimeoutRollsBack(t *testing.T) {
+	// the deadline must be set before the connections are made
+	setFlag(t, timeout, time.Hour)
+	db := testDB(t)
+	root := t.TempDir()
+	file := filepath.Join(root, "1", "11.zip")
+	writeTestZip(t, file, zipEntry{"11.txt", testBook("Book 1", testParagraphs(2))})
+	summary := filepath.Join(t.TempDir(), "summary.json")
+	was := *summaryJSON
+	*summaryJSON = summary
+	t.Cleanup(func() { *summaryJSON = was })
+
+	tm := newTimings()
+	opts := ingestOptions{timings: tm}
+	stop := startRunTimeout(t, 100*time.Millisecond)
+	started := time.Now()
+	err := ingestJournaled(db, root, "1/11.zip", func(tx *sql.Tx) (Reason, error) {
+		if _, err := ingestArchive(tx, file, "1/11.zip", opts); err != nil {
+			return Reason{}, err
+		}
+		var n int
+		return Reason{}, tx.QueryRow(slowQuery).Scan(&n)
+	})
+	stop()
+	if !timedOut(err) {
+		t.Fatalf("ingest: %v, want it timed out", err)
+	}
+	if took := time.Since(started); took > 5*time.Second {
+		t.Errorf("the slow statement ran %s past a deadline of 100ms", took)
+	}
+	if code := exitCode(err); code != exitCancelled {
+		t.Errorf("exit status %d for a run timed out, want %d", code, exitCancelled)
+	}
+
+	if n := len(ingestRows(t, db)); n != 0 {
+		t.Errorf("%d books kept by the archive that timed out, want it rolled back", n)
+	}
+	var status string
+	if err := db.QueryRow("SELECT status FROM ingest_journal WHERE archive = '1/11.zip'").Scan(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status != "started" {
+		t.Errorf("the archive that timed out is journaled %s, want started, for the next run to redo", status)
+	}
+
+	if got := tm.report("ingest", err); got != err {
+		t.Errorf("report returned %v, want the run's error", got)
+	}
+	b, rerr := os.ReadFile(summary)
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	var s runSummary
+	if rerr = json.Unmarshal(b, &s); rerr != nil {
+		t.Fatal(rerr)
+	}
+	if s.Status != "timed out" {
+		t.Errorf("the summary has status %q, want timed out: %s", s.Status, b)
+	}
+
+	// the next run, given time, repairs it
+	if err = readFiles(db, root, ingestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(ingestRows(t, db)); n != 1 {
+		t.Errorf("%d books after the next run, want 1", n)
+	}
+}
+
+func TestDBTimeout(t *testing.T) {
+	setFlag(t, dbTimeout, 50*time.Millisecond)
+	db := testDB(t)
+	var n int
+	err := db.QueryRow(slowQuery).Scan(&n)
+	if !timedOut(err) {
+		t.Fatalf("the slow statement: %v, want it timed out by --db-timeout", err)
+	}
+	// only that statement: the next has a deadline of its own
+	if err = db.QueryRow("SELECT 1").Scan(&n); err != nil {
+		t.Errorf("a statement after the slow one: %v", err)
+	}
+}
+
+func TestWithinReadTimeout(t *testing.T) {
+	setFlag(t, readTimeout, 20*time.Millisecond)
+	stuck := make(chan struct{})
+	defer close(stuck)
+	err := withinRead("a.zip", func() error {
+		<-stuck
+		return nil
+	})
+	if !timedOut(err) || exitCode(err) != exitCancelled {
+		t.Errorf("a read stuck past --read-timeout: %v, exit status %d", err, exitCode(err))
+	}
+	if err = withinRead("b.zip", func() error { return nil }); err != nil {
+		t.Errorf("a read in time: %v", err)
+	}
+
+	// --timeout passing stops a read too
+	setFlag(t, readTimeout, 0)
+	stop := startRunTimeout(t, 20*time.Millisecond)
+	defer stop()
+	if err = withinRead("c.zip", func() error { <-stuck; return nil }); !timedOut(err) {
+		t.Errorf("a read stuck past --timeout: %v", err)
+	}
+}
@@ -0,0 +1,187 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// tokenizer counts LLM tokens for a batch of texts at once, so that
+// implementations backed by an external process pay its startup cost once
+// per batch rather than once per chunk.
+type tokenizer interface {
+	count(texts []string) ([]int, error)
+}
+
+// estimator approximates a BPE tokenizer without a vocabulary: common words
+// are one token, long words are split into a few pieces, digits go three
+// to a token, punctuation is a token each and CJK characters are a token
+// each. Good enough for budgeting, and deterministic.
+type estimator struct{}
+
+var tokenPieces = regexp.MustCompile(`\pL+|\pN+|[^\s\pL\pN]`)
+
+func (estimator) count(texts []string) ([]int, error) {
+	out := make([]int, len(texts))
+	for i, t := range texts {
+		out[i] = estimateTokens(t)
+	}
+	return out, nil
+}
+
+func estimateTokens(text string) int {
+	n := 0
+	for _, p := range tokenPieces.FindAllString(text, -1) {
+		rs := []rune(p)
+		switch {
+		case unicode.Is(unicode.Han, rs[0]) || unicode.In(rs[0], unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+			n += len(rs)
+		case unicode.IsDigit(rs[0]):
+			n += (len(rs) + 2) / 3
+		case unicode.IsLetter(rs[0]):
+			n++
+			if len(rs) > 6 {
+				n += (len(rs) - 2) / 5
+			}
+		default:
+			n++
+		}
+	}
+	return n
+}
+
+// cmdTokenizer runs an external command once per batch. The command reads
+// one json encoded string per line on stdin and must print one integer
+// count per line on stdout, in the same order.
+type cmdTokenizer struct {
+	cmd string
+}
+
+func (t cmdTokenizer) count(texts []string) ([]int, error) {
+	var in bytes.Buffer
+	enc := json.NewEncoder(&in)
+	for _, s := range texts {
+		if err := enc.Encode(s); err != nil {
+			return nil, err
+		}
+	}
+
+	c := exec.Command("sh", "-c", t.cmd)
+	c.Stdin = &in
+	var stderr bytes.Buffer
+	c.Stderr = &stderr
+	out, err := c.Output()
+	if err != nil {
+		return nil, fmt.Errorf("tokenizer command failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	counts := make([]int, 0, len(texts))
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, fmt.Errorf("tokenizer command printed %q, not a count", line)
+		}
+		counts = append(counts, n)
+	}
+	if len(counts) != len(texts) {
+		return nil, fmt.Errorf("tokenizer command returned %d counts for %d texts", len(counts), len(texts))
+	}
+	return counts, nil
+}
+
+func newTokenizer(cmd string) tokenizer {
+	if cmd == "" {
+		return estimator{}
+	}
+	return cmdTokenizer{cmd}
+}
+
+func countTokensCmd(args []string) error {
+	fs := flag.NewFlagSet("count-tokens", flag.ExitOnError)
+	cmd := fs.String("tokenizer-cmd", "", "external tokenizer command (default: built-in estimate)")
+	batch := fs.Int("batch", 500, "chunks per tokenizer call and transaction")
+	all := fs.Bool("all", false, "recount chunks that already have a token count")
+	fs.Parse(args)
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if *all {
+		if _, err = db.Exec("UPDATE chunks SET token_count = NULL"); err != nil {
+			return err
+		}
+	}
+
+	return backfillTokens(db, newTokenizer(*cmd), *batch)
+}
+
+// backfillTokens fills token_count for chunks that lack one, batch by batch
+// in id order.
+func backfillTokens(db *sql.DB, tok tokenizer, batch int) error {
+	last, total := 0, 0
+	for {
+		rows, err := db.Query("SELECT id, chunk FROM chunks WHERE token_count IS NULL AND id > ? ORDER BY id LIMIT ?", last, batch)
+		if err != nil {
+			return err
+		}
+		ids, texts := []int{}, []string{}
+		for rows.Next() {
+			var id int
+			var text string
+			if err = rows.Scan(&id, &text); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+			texts = append(texts, text)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			break
+		}
+
+		counts, err := tok.count(texts)
+		if err != nil {
+			return err
+		}
+
+		// in the bulk lane, leaving the database to others between batches
+		err = writerOf(db).do(func(tx *sql.Tx) error {
+			for i, id := range ids {
+				if _, err := tx.Exec("UPDATE chunks SET token_count = ? WHERE id = ?", counts[i], id); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		last = ids[len(ids)-1]
+		total += len(ids)
+		fmt.Printf("%d chunks counted\r", total)
+	}
+	fmt.Printf("%d chunks counted\n", total)
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEstimateTokens(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		want int
+	}{
+		{"", 0},
+		{"The cat sat.", 4},
+		{"Hello, world!", 4},
+		{"don't", 3},
+		// a long word is a few pieces
+		{"extraordinary", 3},
+		{"1234567", 3},
+		{"1812", 2},
+		{"日本語", 3},
+		{"It was the best of times, it was the worst of times.", 14},
+	} {
+		if got := estimateTokens(c.text); got != c.want {
+			t.Errorf("estimateTokens(%q) = %d, want %d", c.text, got, c.want)
+		}
+	}
+}
+
+// lengthCmd is a stub tokenizer counting each text as the length of the
+// json line it is sent as.
+const lengthCmd = `awk '{ print length($0) }'`
+
+func TestCmdTokenizer(t *testing.T) {
+	got, err := cmdTokenizer{lengthCmd}.count([]string{"a", "bcd", "tab\there"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int{3, 5, 11}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("counts %v, want %v", got, want)
+			break
+		}
+	}
+
+	for _, c := range []struct{ cmd, err string }{
+		{"cat >/dev/null; echo 1", "returned 1 counts for 2 texts"},
+		{"cat >/dev/null; echo many; echo 2", `printed "many"`},
+		{"echo broken >&2; exit 3", "broken"},
+	} {
+		_, err := cmdTokenizer{c.cmd}.count([]string{"a", "b"})
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: %v, want an error saying %q", c.cmd, err, c.err)
+		}
+	}
+}
+
+func TestBackfillTokens(t *testing.T) {
+	db := testDB(t)
+	addBook(t, db, "Emma", "Jane Austen", testBook("Emma", testParagraphs(5)))
+	if err := makeChunks(db, chunkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	calls := filepath.Join(t.TempDir(), "calls")
+	if err := backfillTokens(db, cmdTokenizer{"echo >>" + calls + "; " + lengthCmd}, 2); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(b), "\n"); n != 3 {
+		t.Errorf("the tokenizer ran %d times for 5 chunks in batches of 2, want 3", n)
+	}
+	var wrong int
+	if err := db.QueryRow("SELECT count(*) FROM chunks WHERE token_count IS NOT length(json_quote(chunk))").Scan(&wrong); err != nil {
+		t.Fatal(err)
+	}
+	if wrong != 0 {
+		t.Errorf("%d chunks weren't given the tokenizer's count", wrong)
+	}
+}
+
+func TestSplitRecord(t *testing.T) {
+	text := "It was the best of times. It was the worst of times. " +
+		"It was the age of wisdom, it was the age of foolishness, it was the epoch of belief, it was the epoch of incredulity. " +
+		"Short."
+	parts, err := splitRecord(exportRecord{ID: 1, Text: text}, exportOptions{maxTokens: 10, tok: estimator{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sentences within the budget are never cut; the one over it is cut
+	// between words
+	for _, s := range []string{"It was the best of times.", "It was the worst of times.", "Short."} {
+		whole := false
+		for _, p := range parts {
+			whole = whole || strings.Contains(p.Text, s)
+		}
+		if !whole {
+			t.Errorf("%q was cut: parts %+v", s, parts)
+		}
+	}
+	var words []string
+	for i, p := range parts {
+		if p.Part != i+1 {
+			t.Errorf("part %d numbered %d", i+1, p.Part)
+		}
+		if p.Tokens > 10 || estimateTokens(p.Text) > 10 {
+			t.Errorf("part %q is %d tokens, over the budget of 10", p.Text, p.Tokens)
+		}
+		words = append(words, strings.Fields(p.Text)...)
+	}
+	if got := strings.Join(words, " "); got != strings.Join(strings.Fields(text), " ") {
+		t.Errorf("the parts put back together are %q, not the chunk", got)
+	}
+}
@@ -0,0 +1,264 @@
+package cli
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var errNoBook = errors.New("no such book")
+
+func fileIDs(name string, args []string) ([]int, error) {
+	if len(args) == 0 {
+		return nil, usagef("usage: gutchunk %s <file id>...", name)
+	}
+	ids := []int{}
+	for _, a := range args {
+		id, err := strconv.Atoi(a)
+		if err != nil {
+			return nil, usagef("bad file id %q", a)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func rmCmd(args []string) error {
+	fs := flag.NewFlagSet("rm", flag.ExitOnError)
+	reason := fs.String("reason", "", "why, for tombstones listing")
+	fs.Parse(args)
+	ids, err := fileIDs("rm", fs.Args())
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err = startRun(db, "rm"); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, id := range ids {
+		if err = removeBook(tx, id, *reason); err != nil {
+			return fmt.Errorf("book %d: %w", id, err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	fmt.Printf("removed %d books; run gutchunk refresh-stats to stop counting them\n", len(ids))
+	return nil
+}
+
+// removeBook marks book id deleted and leaves a tombstone so ingest won't
+// add it again. Its chunks go; they are made again if it is restored.
+// Flags on them keep their hashes and follow the text back.
+func removeBook(tx *sql.Tx, id int, reason string) error {
+	var filename, content, contentHash sql.NullString
+	var deleted bool
+	err := tx.QueryRow("SELECT filename, content, content_hash, deleted_at IS NOT NULL FROM files WHERE id = ?", id).
+		Scan(&filename, &content, &contentHash, &deleted)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errNoBook
+	}
+	if err != nil || deleted {
+		return err
+	}
+
+	var hash interface{}
+	if content.Valid {
+		hash = textHash(content.String)
+	} else if contentHash.Valid {
+		hash = contentHash.String
+	}
+	if err = logChunks(tx, eventRemoved, 0, "?", id); err != nil {
+		return err
+	}
+	for _, q := range []struct {
+		q    string
+		args []interface{}
+	}{
+		{"UPDATE files SET deleted_at = datetime('now') WHERE id = ?", []interface{}{id}},
+		{"INSERT INTO tombstones (file_id, filename, hash, reason, created_at) VALUES (?, ?, ?, ?, datetime('now'))",
+			[]interface{}{id, filename, hash, reason}},
+		{"UPDATE chunk_flags SET chunk_id = NULL WHERE chunk_id IN (SELECT id FROM chunks WHERE sourceid = ?)", []interface{}{id}},
+		{"DELETE FROM content_flags WHERE chunk_id IN (SELECT id FROM chunks WHERE sourceid = ?)", []interface{}{id}},
+		{"DELETE FROM content_scans WHERE chunk_id IN (SELECT id FROM chunks WHERE sourceid = ?)", []interface{}{id}},
+		{"DELETE FROM chunks WHERE sourceid = ?", []interface{}{id}},
+		{"DELETE FROM footnotes WHERE sourceid = ?", []interface{}{id}},
+		{"DELETE FROM strategy_chunks WHERE sourceid = ?", []interface{}{id}},
+	} {
+		if _, err = tx.Exec(q.q, q.args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tombstoned reports whether a book named filename or with this content
+// was removed with gutchunk rm.
+func tombstoned(tx *sql.Tx, filename, content string) (bool, error) {
+	var n int
+	err := tx.QueryRow("SELECT count(*) FROM tombstones WHERE filename = ? OR hash = ?", filename, textHash(content)).Scan(&n)
+	return n > 0, err
+}
+
+func restoreCmd(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	fs.Parse(args)
+	ids, err := fileIDs("restore", fs.Args())
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	purged := 0
+	for _, id := range ids {
+		res, err := tx.Exec("DELETE FROM tombstones WHERE file_id = ?", id)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return fmt.Errorf("book %d: not removed", id)
+		}
+		res, err = tx.Exec("UPDATE files SET deleted_at = NULL WHERE id = ? AND deleted_at IS NOT NULL", id)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			fmt.Printf("book %d was purged; ingest will add it again\n", id)
+			purged++
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	if purged < len(ids) {
+		fmt.Printf("restored %d books; run gutchunk chunk to chunk them again\n", len(ids)-purged)
+	}
+	return nil
+}
+
+func tombstonesCmd(args []string) error {
+	fs := flag.NewFlagSet("tombstones", flag.ExitOnError)
+	fs.Parse(args)
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT t.file_id, coalesce(t.filename, ''), coalesce(f.name, ''), f.id IS NULL,
+			coalesce(t.reason, ''), t.created_at
+		FROM tombstones t LEFT JOIN files f ON f.id = t.file_id AND f.deleted_at IS NOT NULL ORDER BY t.id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var filename, title, reason, at string
+		var purged bool
+		if err = rows.Scan(&id, &filename, &title, &purged, &reason, &at); err != nil {
+			return err
+		}
+		state := "removed"
+		if purged {
+			state = "purged"
+		}
+		line := fmt.Sprintf("%6d  %-7s %s  %s", id, state, at, filename)
+		if title != "" {
+			line += "  " + title
+		}
+		if reason != "" {
+			line += "  (" + reason + ")"
+		}
+		fmt.Println(line)
+	}
+	return rows.Err()
+}
+
+func purgeCmd(args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	yes := fs.Bool("yes", false, "don't ask first")
+	fs.Parse(args)
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var n int
+	if err = db.QueryRow("SELECT count(*) FROM files WHERE deleted_at IS NOT NULL").Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		fmt.Println("nothing to purge")
+		return nil
+	}
+	if !*yes {
+		fmt.Printf("purge %d removed books for good? their tombstones stay [y/N] ", n)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			return errors.New("not purged")
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	books := "SELECT id FROM files WHERE deleted_at IS NOT NULL"
+	for _, q := range []string{
+		"DELETE FROM chunks WHERE sourceid IN (" + books + ")",
+		"DELETE FROM chunk_counts WHERE sourceid IN (" + books + ")",
+		"DELETE FROM footnotes WHERE sourceid IN (" + books + ")",
+		"DELETE FROM strategy_chunks WHERE sourceid IN (" + books + ")",
+		"DELETE FROM stable_id_map WHERE sourceid IN (" + books + ")",
+		"DELETE FROM book_terms WHERE sourceid IN (" + books + ")",
+		"DELETE FROM book_meta WHERE file_id IN (" + books + ")",
+		"DELETE FROM works_in_file WHERE file_id IN (" + books + ")",
+		"DELETE FROM name_words WHERE file_id IN (" + books + ")",
+		"DELETE FROM sort_keys WHERE file_id IN (" + books + ")",
+		"DELETE FROM name_sources WHERE file_id IN (" + books + ")",
+		"DELETE FROM contributors WHERE file_id IN (" + books + ")",
+		"DELETE FROM book_similarities WHERE a IN (" + books + ") OR b IN (" + books + ")",
+		"DELETE FROM warnings WHERE file_id IN (" + books + ")",
+		"DELETE FROM files WHERE deleted_at IS NOT NULL",
+	} {
+		if _, err = tx.Exec(q); err != nil {
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	fmt.Printf("purged %d books\n", n)
+	return nil
+}
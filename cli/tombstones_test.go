@@ -0,0 +1,135 @@
+package cli
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRemoveStaysGone(t *testing.T) {
+	root := t.TempDir()
+	for i := 1; i <= 2; i++ {
+		writeTestZip(t, filepath.Join(root, fmt.Sprint(i), fmt.Sprintf("%d%d.zip", i, i)),
+			zipEntry{fmt.Sprintf("%d%d.txt", i, i), testBook(fmt.Sprintf("Book %d", i), testParagraphs(2)+fmt.Sprintf("\n\nThe end of %d.", i))})
+	}
+	db := testDB(t)
+	if err := readFiles(db, root, ingestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := makeChunks(db, chunkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	var id int
+	if err := db.QueryRow("SELECT id FROM files WHERE name = 'Book 1'").Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	chunked := chunkCount(t, db, id)
+	if _, err := captureStdout(t, func() error { return rmCmd([]string{"--reason", "a duplicate", fmt.Sprint(id)}) }); err != nil {
+		t.Fatal(err)
+	}
+	if n := chunkCount(t, db, id); n != 0 {
+		t.Errorf("%d chunks of the removed book left", n)
+	}
+
+	// the same tree ingested again from scratch, and a copy of it elsewhere
+	if err := clearJournal(db, root); err != nil {
+		t.Fatal(err)
+	}
+	if err := readFiles(db, root, ingestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	elsewhere := t.TempDir()
+	writeTestZip(t, filepath.Join(elsewhere, "9", "99.zip"), zipEntry{"99.txt", testBook("Book 1", testParagraphs(2)+"\n\nThe end of 1.")})
+	if err := readFiles(db, elsewhere, ingestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := makeChunks(db, chunkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	var copies, live int
+	if err := db.QueryRow("SELECT count(*), count(*) - count(deleted_at) FROM files WHERE name = 'Book 1'").Scan(&copies, &live); err != nil {
+		t.Fatal(err)
+	}
+	if copies != 1 || live != 0 || chunkCount(t, db, id) != 0 {
+		t.Errorf("after ingesting it again, %d rows of the removed book, %d of them live, with %d chunks; want it gone", copies, live, chunkCount(t, db, id))
+	}
+	out, err := captureStdout(t, func() error { return tombstonesCmd(nil) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "removed") || !strings.Contains(out, "Book 1") || !strings.Contains(out, "(a duplicate)") {
+		t.Errorf("tombstones listed %q", out)
+	}
+
+	if _, err = captureStdout(t, func() error { return restoreCmd([]string{fmt.Sprint(id)}) }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = captureStdout(t, func() error { return restoreCmd([]string{fmt.Sprint(id)}) }); err == nil {
+		t.Error("restoring a book not removed was no error")
+	}
+	if err = makeChunks(db, chunkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := chunkCount(t, db, id); n != chunked {
+		t.Errorf("the restored book was chunked into %d chunks, want its %d again", n, chunked)
+	}
+}
+
+func TestPurgeThenRestore(t *testing.T) {
+	root := t.TempDir()
+	writeTestZip(t, filepath.Join(root, "1", "11.zip"), zipEntry{"11.txt", testBook("Book 1", testParagraphs(2))})
+	db := testDB(t)
+	if err := readFiles(db, root, ingestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := makeChunks(db, chunkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	var id int
+	if err := db.QueryRow("SELECT id FROM files").Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []func() error{
+		func() error { return rmCmd([]string{fmt.Sprint(id)}) },
+		func() error { return purgeCmd([]string{"--yes"}) },
+	} {
+		if _, err := captureStdout(t, cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var rows int
+	if err := db.QueryRow("SELECT count(*) FROM files").Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 0 {
+		t.Errorf("%d books left after the purge", rows)
+	}
+
+	// the tombstone outlives the purge until the book is restored
+	if err := clearJournal(db, root); err != nil {
+		t.Fatal(err)
+	}
+	if err := readFiles(db, root, ingestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(ingestRows(t, db)); n != 0 {
+		t.Errorf("the purged book was ingested again %d times while tombstoned", n)
+	}
+	out, err := captureStdout(t, func() error { return restoreCmd([]string{fmt.Sprint(id)}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "was purged; ingest will add it again") {
+		t.Errorf("restoring the purged book printed %q", out)
+	}
+	if err = clearJournal(db, root); err != nil {
+		t.Fatal(err)
+	}
+	if err = readFiles(db, root, ingestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(ingestRows(t, db)); n != 1 {
+		t.Errorf("after restoring the purged book, ingest added it %d times, want once", n)
+	}
+}
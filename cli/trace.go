@@ -0,0 +1,465 @@
+package cli
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"git.tilde.town/gutchunker/gutchunk"
+)
+
+// chunk-one chunks one book in memory, as chunk would, and prints its
+// chunks without writing them. With --trace it follows each paragraph of
+// the body through splitBody instead: its lines as the body gave them, the
+// footnote lines taken out, the reference markers stripped, the canonical
+// form the chunker gave it and what became of it, kept as a chunk, joined
+// to the next by --merge-short, cut at --max-chunk, left out as too short
+// or dropped as license boilerplate, each step saying which rule did it.
+// An ordinal after the book keeps to the paragraphs of that chunk.
+//
+// The steps record what they change through the book's chunkTrace, which
+// chunkOptions holds only for chunk-one --trace; every other chunking has
+// none, and the steps pass over it. Lines are counted in the body, from 1,
+// as it is between the markers or an override's start and end.
+
+// traceStep is what one step did to a paragraph and its text after.
+type traceStep struct {
+	Stage string `json:"stage"`
+	Rule  string `json:"rule"`
+	Text  string `json:"text"`
+}
+
+// tracedLine is a line of the body as it came to a paragraph: taken out as
+// a footnote, or with its reference markers stripped, refs "" for none.
+type tracedLine struct {
+	line     int
+	raw      string
+	footnote bool
+	refs     string
+}
+
+// tracedParagraph is one paragraph of the body and what became of it.
+type tracedParagraph struct {
+	First int `json:"first_line"`
+	Last  int `json:"last_line"`
+	// the chunk it is, or was joined to, -1 for none
+	Chunk   int         `json:"chunk"`
+	Outcome string      `json:"outcome"`
+	Steps   []traceStep `json:"steps"`
+	lines   []tracedLine
+}
+
+// chunkTrace collects the paragraphs of one book as splitBody reads them,
+// the gutchunk.Tracer of its strategy. Its methods do nothing on a nil
+// trace.
+type chunkTrace struct {
+	Paragraphs []*tracedParagraph `json:"paragraphs"`
+	cur        *tracedParagraph
+	// the paragraphs held for --merge-short, and a scene break waiting
+	// for the paragraph before it to end
+	held  []*tracedParagraph
+	scene *tracedParagraph
+	// the bytes chunks are cut at, or runes in script ScriptCJK
+	window int
+	script Script
+}
+
+func (t *chunkTrace) open(i int) *tracedParagraph {
+	if t.cur == nil {
+		t.cur = &tracedParagraph{First: i + 1, Chunk: -1}
+	}
+	t.cur.Last = i + 1
+	return t.cur
+}
+
+// text is the paragraph's lines after the footnotes and references, as
+// splitBody gathers them into a chunk.
+func (p *tracedParagraph) text() []string {
+	lines := []string{}
+	for _, l := range p.lines {
+		if l.footnote {
+			continue
+		}
+		if l.refs != "" {
+			lines = append(lines, l.refs)
+		} else {
+			lines = append(lines, l.raw)
+		}
+	}
+	return lines
+}
+
+// Footnote notes line i of the body, text, taken out as a footnote.
+func (t *chunkTrace) Footnote(i int, text string) {
+	if t == nil {
+		return
+	}
+	p := t.open(i)
+	p.lines = append(p.lines, tracedLine{line: i + 1, raw: text, footnote: true})
+}
+
+// Line notes line i of the body, raw as the body has it and text after
+// its reference markers are stripped. A blank line is the end of the
+// paragraph, which the step after says what became of.
+func (t *chunkTrace) Line(i int, raw, text string) {
+	if t == nil || raw == "" {
+		return
+	}
+	if t.cur != nil && len(t.cur.text()) == 0 {
+		// footnotes before the paragraph, by themselves
+		t.close("taken out as footnotes")
+	}
+	p := t.open(i)
+	l := tracedLine{line: i + 1, raw: raw}
+	if text != raw {
+		l.refs = text
+	}
+	p.lines = append(p.lines, l)
+}
+
+// SceneBreak notes line i, text, as a scene break, left out.
+func (t *chunkTrace) SceneBreak(i int, text string) {
+	if t == nil {
+		return
+	}
+	t.scene = &tracedParagraph{First: i + 1, Last: i + 1, Chunk: -1, Outcome: "left out as a scene break",
+		lines: []tracedLine{{line: i + 1, raw: text}}}
+}
+
+// close ends the paragraph with outcome, and then a scene break after it.
+func (t *chunkTrace) close(outcome string) {
+	if p := t.cur; p != nil {
+		if len(p.text()) == 0 {
+			outcome = "taken out as footnotes"
+		}
+		p.Outcome = outcome
+		p.steps()
+		t.Paragraphs = append(t.Paragraphs, p)
+		t.cur = nil
+	}
+	if t.scene != nil {
+		t.scene.Steps = []traceStep{{"raw", "", t.scene.lines[0].raw}}
+		t.Paragraphs = append(t.Paragraphs, t.scene)
+		t.scene = nil
+	}
+}
+
+// Drop ends the paragraph, of size bytes, as under least, and with
+// dropHeld the paragraphs held for --merge-short with it.
+func (t *chunkTrace) Drop(size, least int, dropHeld bool) {
+	if t == nil {
+		return
+	}
+	if dropHeld {
+		for _, p := range t.held {
+			p.Outcome += ", and left out at a scene break before they made a chunk"
+		}
+		t.held = nil
+	}
+	if t.cur == nil {
+		t.close("")
+		return
+	}
+	t.close(fmt.Sprintf("left out: %d bytes, under the least size of %d", size, least))
+}
+
+// Hold ends the paragraph as held for --merge-short.
+func (t *chunkTrace) Hold(size, least int) {
+	if t == nil || t.cur == nil {
+		return
+	}
+	p := t.cur
+	t.close(fmt.Sprintf("held for --merge-short: %d bytes, under the least size of %d", size, least))
+	t.held = append(t.held, p)
+}
+
+// Emit ends the paragraph as chunk ordinal, whose text is chunk, cut at
+// the trace's window when cut is set, the held paragraphs joined before it.
+func (t *chunkTrace) Emit(ordinal int, chunk string, cut bool) {
+	if t == nil {
+		return
+	}
+	p := t.cur
+	if p == nil {
+		t.close("")
+		return
+	}
+	outcome := fmt.Sprintf("chunk %d", ordinal)
+	if cut {
+		unit := "bytes"
+		if t.script == ScriptCJK {
+			unit = "characters"
+		}
+		outcome += fmt.Sprintf(", cut at --max-chunk %d %s with the paragraph unfinished", t.window, unit)
+	}
+	t.close(outcome)
+	p.Chunk = ordinal
+	if len(t.held) > 0 {
+		for _, h := range t.held {
+			h.Chunk = ordinal
+			h.Outcome = fmt.Sprintf("joined to chunk %d by --merge-short", ordinal)
+		}
+		rule := "the short paragraph before it joined on, its break kept"
+		if len(t.held) > 1 {
+			rule = fmt.Sprintf("the %d short paragraphs before it joined on, their breaks kept", len(t.held))
+		}
+		p.Steps = append(p.Steps, traceStep{"merge-short", rule, chunk})
+		t.held = nil
+	}
+}
+
+// Finish ends the paragraph the body ended in.
+func (t *chunkTrace) Finish() {
+	if t == nil {
+		return
+	}
+	if t.cur != nil {
+		t.close("left out: the body ends without a blank line after it")
+	}
+	t.close("")
+	for _, p := range t.held {
+		p.Outcome += ", and left out at the end of the body before they made a chunk"
+	}
+	t.held = nil
+}
+
+// footer notes which of chunks bl catches, before its filter, and the
+// ordinals the chunks after a dropped one come to.
+func (t *chunkTrace) footer(bl *blocklist, chunks []string) {
+	if t == nil || bl == nil {
+		return
+	}
+	renumbered := make([]int, len(chunks))
+	caught := make([]int, len(chunks))
+	n := 0
+	for i, c := range chunks {
+		caught[i] = bl.match(c)
+		renumbered[i] = n
+		if caught[i] < 0 || !bl.strict {
+			n++
+		}
+	}
+	for _, p := range t.Paragraphs {
+		if p.Chunk < 0 || p.Chunk >= len(chunks) {
+			continue
+		}
+		old := p.Chunk
+		if m := caught[old]; m >= 0 {
+			rule := fmt.Sprintf("quotes the license phrase %q", bl.phrases[m])
+			if bl.strict {
+				p.Steps = append(p.Steps, traceStep{"footer", rule + ", dropped with --strict-footer", ""})
+				p.Chunk, p.Outcome = -1, "dropped as license boilerplate"
+				continue
+			}
+			p.Steps = append(p.Steps, traceStep{"footer", rule + ", counted", chunks[old]})
+		}
+		if renumbered[old] != old {
+			p.Outcome = strings.Replace(p.Outcome, fmt.Sprintf("chunk %d", old), fmt.Sprintf("chunk %d", renumbered[old]), 1)
+			p.Chunk = renumbered[old]
+		}
+	}
+}
+
+// steps fills in p's steps from its lines.
+func (p *tracedParagraph) steps() {
+	raw := make([]string, len(p.lines))
+	var notes, refs []string
+	for i, l := range p.lines {
+		raw[i] = l.raw
+		if l.refs != "" {
+			refs = append(refs, gutchunk.FootnoteRefs(l.raw)...)
+		}
+	}
+	for i := 0; i < len(p.lines); i++ {
+		if !p.lines[i].footnote {
+			continue
+		}
+		j := i
+		for j+1 < len(p.lines) && p.lines[j+1].footnote {
+			j++
+		}
+		notes = append(notes, footnoteRule(p.lines[i].raw, p.lines[i].line, p.lines[j].line))
+		i = j
+	}
+	p.Steps = []traceStep{{"raw", "", strings.Join(raw, "\n")}}
+	text := p.text()
+	if notes != nil {
+		withRefs := []string{}
+		for _, l := range p.lines {
+			if !l.footnote {
+				withRefs = append(withRefs, l.raw)
+			}
+		}
+		p.Steps = append(p.Steps, traceStep{"footnotes", strings.Join(notes, "; "), strings.Join(withRefs, "\n")})
+	}
+	if refs != nil {
+		p.Steps = append(p.Steps, traceStep{"refs", "reference markers " + strings.Join(refs, ", ") + " stripped (--strip-refs)", strings.Join(text, "\n")})
+	}
+	if len(text) > 0 {
+		chunk := strings.Join(text, "\n") + "\n"
+		p.Steps = append(p.Steps, traceStep{"canonical", gutchunk.CanonicalRule(chunk), gutchunk.Canonical(chunk)})
+	}
+}
+
+// footnoteRule says what took out lines first to last, the first of them
+// being line.
+func footnoteRule(line string, first, last int) string {
+	what := gutchunk.FootnoteKind(line)
+	if first == last {
+		return fmt.Sprintf("%s taken out at line %d", what, first)
+	}
+	return fmt.Sprintf("%s taken out at lines %d–%d", what, first, last)
+}
+
+func chunkOneCmd(args []string) error {
+	fs := flag.NewFlagSet("chunk-one", flag.ExitOnError)
+	trace := fs.Bool("trace", false, "follow each paragraph through the chunker, step by step")
+	asJSON := fs.Bool("json", false, "print the chunks, or the trace, as json")
+	var opts chunkOptions
+	fs.BoolVar(&opts.stripRefs, "strip-refs", false, "chunk as chunk --strip-refs would")
+	footer := footerFlags(fs)
+	breaks := sceneFlags(fs)
+	overrides := overridesFlag(fs)
+	langMins := langMinFlag(fs)
+	sizes := chunkSizeFlags(fs, &opts)
+	fs.Parse(args)
+
+	const usage = "usage: gutchunk chunk-one [--trace] [--json] <fileid> [ordinal]"
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		return usagef(usage)
+	}
+	id, err := strconv.Atoi(fs.Arg(0))
+	if err != nil {
+		return usagef("bad file id %q", fs.Arg(0))
+	}
+	ordinal := -1
+	if fs.NArg() == 2 {
+		if ordinal, err = strconv.Atoi(fs.Arg(1)); err != nil || ordinal < 0 {
+			return usagef("bad ordinal %q", fs.Arg(1))
+		}
+		if !*trace {
+			return usagef("an ordinal needs --trace; %s", usage)
+		}
+	}
+	if opts.footer, err = footer(); err != nil {
+		return err
+	}
+	if opts.breaks, err = breaks(); err != nil {
+		return err
+	}
+	if opts.overrides, err = overrides(); err != nil {
+		return err
+	}
+	if opts.langMins, err = langMins(); err != nil {
+		return err
+	}
+	if err = sizes(); err != nil {
+		return err
+	}
+	if err = opts.oneStrategy("chunk-one"); err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var content *string
+	b := bookfile{ID: id}
+	err = db.QueryRow("SELECT coalesce(name, ''), coalesce(author, ''), coalesce(filename, ''), coalesce(ebook, 0), coalesce(language, ''), coalesce(body_only, 0), "+contentCol("")+" FROM files WHERE id = ? AND deleted_at IS NULL", id).
+		Scan(&b.Name, &b.Author, &b.Filename, &b.Ebook, &b.Language, &b.BodyOnly, &content)
+	if err != nil {
+		return fmt.Errorf("book %d: %w", id, err)
+	}
+	if content == nil {
+		return fmt.Errorf("book %d was stored without its content", id)
+	}
+	b.Content = *content
+	if opts, err = opts.overrides.apply(b, opts.forBook(b)); err != nil {
+		return err
+	}
+	if *trace {
+		opts.trace = &chunkTrace{window: opts.window, script: opts.script}
+	}
+	chunks, _, _, _ := splitBookAt(b.Content, opts)
+
+	if !*trace {
+		if *asJSON {
+			return json.NewEncoder(os.Stdout).Encode(chunks)
+		}
+		for i, c := range chunks {
+			fmt.Printf("%d: %s\n\n", i, c)
+		}
+		return nil
+	}
+	paras := opts.trace.Paragraphs
+	if ordinal >= 0 {
+		paras = []*tracedParagraph{}
+		for _, p := range opts.trace.Paragraphs {
+			if p.Chunk == ordinal {
+				paras = append(paras, p)
+			}
+		}
+		if len(paras) == 0 {
+			return fmt.Errorf("book %d has no chunk %d; it has %d", id, ordinal, len(chunks))
+		}
+	}
+	if *asJSON {
+		return json.NewEncoder(os.Stdout).Encode(paras)
+	}
+	fmt.Printf("book %d: %s / %s, %d chunks\n", id, b.Name, b.Author, len(chunks))
+	for _, p := range paras {
+		printTrace(p)
+	}
+	return nil
+}
+
+// printTrace prints what became of p, each step's change as a diff of the
+// text before it.
+func printTrace(p *tracedParagraph) {
+	if p.First == p.Last {
+		fmt.Printf("\n--- line %d: %s\n", p.First, p.Outcome)
+	} else {
+		fmt.Printf("\n--- lines %d–%d: %s\n", p.First, p.Last, p.Outcome)
+	}
+	for _, s := range p.Steps {
+		if s.Rule == "" {
+			fmt.Printf("  %s\n", s.Stage)
+		} else {
+			fmt.Printf("  %s: %s\n", s.Stage, s.Rule)
+		}
+		switch s.Stage {
+		case "raw":
+			for _, l := range p.lines {
+				fmt.Printf("    %5d | %s\n", l.line, l.raw)
+			}
+		case "footnotes":
+			for _, l := range p.lines {
+				if l.footnote {
+					fmt.Printf("    %5d - %s\n", l.line, l.raw)
+				}
+			}
+		case "refs":
+			for _, l := range p.lines {
+				if l.refs != "" {
+					fmt.Printf("    %5d - %s\n", l.line, l.raw)
+					fmt.Printf("    %5d + %s\n", l.line, l.refs)
+				}
+			}
+		default:
+			if s.Text != "" {
+				// a kept break is a line of its own
+				for _, l := range strings.Split(s.Text, "\n") {
+					if l != "" {
+						fmt.Printf("          + %s\n", l)
+					}
+				}
+			}
+		}
+	}
+}
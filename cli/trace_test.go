@@ -0,0 +1,196 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// traceBook is a book whose first paragraph goes through three of the
+// chunker's steps: a footnote block taken out, reference markers stripped
+// and wrapped lines joined across a dash.
+func traceBook(t *testing.T) string {
+	t.Helper()
+	db := testDB(t)
+	body := strings.Join([]string{
+		"Through the night[1] the rain fell in torrents, heavily and without end",
+		"[Footnote 1: The opening words of Paul Clifford,",
+		"by Bulwer-Lytton.]",
+		"--except at occasional intervals, when it was checked by a violent gust",
+		"of wind which swept up the streets[2] (for it is in London that our",
+		"scene lies), rattling along the housetops, and fiercely agitating the",
+		"scanty flame of the lamps that struggled against the darkness.",
+		"",
+		"Short, it was.",
+		"",
+		"* * *",
+		"",
+		testParagraphs(1),
+		"",
+		"*** END OF THE PROJECT GUTENBERG EBOOK PAUL CLIFFORD ***",
+	}, "\n")
+	id := addBook(t, db, "Paul Clifford", "Edward Bulwer-Lytton", testBook("Paul Clifford", body))
+	return fmt.Sprint(id)
+}
+
+func TestChunkTrace(t *testing.T) {
+	id := traceBook(t)
+	trace := func(args ...string) []tracedParagraph {
+		t.Helper()
+		out, err := captureStdout(t, func() error { return chunkOneCmd(append([]string{"--trace", "--json"}, args...)) })
+		var paras []tracedParagraph
+		if err != nil || json.Unmarshal([]byte(out), &paras) != nil {
+			t.Fatalf("chunk-one --trace --json %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+		return paras
+	}
+	outcomes := func(paras []tracedParagraph) string {
+		var s []string
+		for _, p := range paras {
+			stages := []string{}
+			for _, st := range p.Steps {
+				stages = append(stages, st.Stage)
+			}
+			s = append(s, fmt.Sprintf("%d-%d %s (%s)", p.First, p.Last, p.Outcome, strings.Join(stages, " ")))
+		}
+		return strings.Join(s, "\n") + "\n"
+	}
+
+	paras := trace("--strip-refs", id)
+	if got, want := outcomes(paras), ""+
+		"2-8 chunk 0 (raw footnotes refs canonical)\n"+
+		"10-10 left out: 15 bytes, under the least size of 300 (raw canonical)\n"+
+		"12-12 left out as a scene break (raw)\n"+
+		"14-14 chunk 1 (raw canonical)\n"; got != want {
+		t.Errorf("the trace's paragraphs:\n%s", lineDiff(want, got))
+	}
+	// each step says which rule did it, and the text after
+	steps := paras[0].Steps
+	for i, want := range []traceStep{
+		{"raw", "", "Through the night[1] the rain fell in torrents, heavily and without end\n[Footnote 1: The opening words of Paul Clifford,\nby Bulwer-Lytton.]\n--except at occasional"},
+		{"footnotes", "footnote block taken out at lines 3–4", "Through the night[1] the rain fell in torrents, heavily and without end\n--except at occasional"},
+		{"refs", "reference markers [1], [2] stripped (--strip-refs)", "Through the night the rain fell in torrents, heavily and without end\n--except at occasional"},
+		{"canonical", "wrapped lines joined as prose, a dash closed up across lines", "Through the night the rain fell in torrents, heavily and without end--except at occasional"},
+	} {
+		if s := steps[i]; s.Stage != want.Stage || s.Rule != want.Rule || !strings.HasPrefix(s.Text, want.Text) {
+			t.Errorf("step %d is %+v, want %+v", i, s, want)
+		}
+	}
+	if got := steps[3].Text; !strings.HasSuffix(got, "a violent gust of wind which swept up the streets (for it is in London that our scene lies), rattling along the housetops, and fiercely agitating the scanty flame of the lamps that struggled against the darkness.") {
+		t.Errorf("the paragraph's canonical text is %q", got)
+	}
+	// without --strip-refs the markers stay, and there's no step for them
+	if paras = trace(id); len(paras[0].Steps) != 3 || paras[0].Steps[2].Stage != "canonical" || !strings.Contains(paras[0].Steps[2].Text, "night[1] the") {
+		t.Errorf("without --strip-refs, the steps are %+v", paras[0].Steps)
+	}
+
+	// the ordinal keeps to the paragraphs of one chunk
+	if paras = trace(id, "1"); len(paras) != 1 || paras[0].First != 14 {
+		t.Errorf("the trace of chunk 1: %+v", paras)
+	}
+	// the text shows each change as removed and added lines
+	out, err := captureStdout(t, func() error { return chunkOneCmd([]string{"--trace", "--strip-refs", id, "0"}) })
+	if want := "book " + id + ": Paul Clifford / Edward Bulwer-Lytton, 2 chunks\n" +
+		"\n--- lines 2–8: chunk 0\n" +
+		"  raw\n" +
+		"        2 | Through the night[1] the rain fell in torrents, heavily and without end\n" +
+		"        3 | [Footnote 1: The opening words of Paul Clifford,\n" +
+		"        4 | by Bulwer-Lytton.]\n" +
+		"        5 | --except at occasional intervals, when it was checked by a violent gust\n" +
+		"        6 | of wind which swept up the streets[2] (for it is in London that our\n" +
+		"        7 | scene lies), rattling along the housetops, and fiercely agitating the\n" +
+		"        8 | scanty flame of the lamps that struggled against the darkness.\n" +
+
+		"  footnotes: footnote block taken out at lines 3–4\n" +
+		"        3 - [Footnote 1: The opening words of Paul Clifford,\n" +
+		"        4 - by Bulwer-Lytton.]\n" +
+		"  refs: reference markers [1], [2] stripped (--strip-refs)\n" +
+		"        2 - Through the night[1] the rain fell in torrents, heavily and without end\n" +
+		"        2 + Through the night the rain fell in torrents, heavily and without end\n" +
+		"        6 - of wind which swept up the streets[2] (for it is in London that our\n" +
+		"        6 + of wind which swept up the streets (for it is in London that our\n" +
+		"  canonical: wrapped lines joined as prose, a dash closed up across lines\n" +
+		"          + " + steps[3].Text + "\n"; err != nil || out != want {
+		t.Errorf("chunk-one --trace: %v\n%s", err, lineDiff(want, out))
+	}
+
+	// the trace changes nothing of the chunks
+	plain, err := captureStdout(t, func() error { return chunkOneCmd([]string{"--strip-refs", "--json", id}) })
+	var chunks []string
+	if err != nil || json.Unmarshal([]byte(plain), &chunks) != nil || len(chunks) != 2 || chunks[0] != steps[3].Text {
+		t.Errorf("chunk-one --json: %v\n%s", err, plain)
+	}
+
+	for _, args := range [][]string{{}, {"x"}, {id, "1"}, {"--trace", id, "-1"}, {id, "1", "2"}} {
+		if _, err = captureStdout(t, func() error { return chunkOneCmd(args) }); exitCode(err) != exitUsage {
+			t.Errorf("chunk-one %s: %v, want a usage error", strings.Join(args, " "), err)
+		}
+	}
+	if _, err = captureStdout(t, func() error { return chunkOneCmd([]string{"--trace", id, "5"}) }); err == nil || err.Error() != "book "+id+" has no chunk 5; it has 2" {
+		t.Errorf("chunk-one --trace of no chunk: %v", err)
+	}
+}
+
+func TestChunkTraceOutcomes(t *testing.T) {
+	id := traceBook(t)
+	outcomes := func(args ...string) string {
+		t.Helper()
+		out, err := captureStdout(t, func() error { return chunkOneCmd(append([]string{"--trace", "--json"}, args...)) })
+		var paras []tracedParagraph
+		if err != nil || json.Unmarshal([]byte(out), &paras) != nil {
+			t.Fatalf("chunk-one --trace --json %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+		var s []string
+		for _, p := range paras {
+			s = append(s, fmt.Sprintf("%d %d %s", p.First, p.Chunk, p.Outcome))
+		}
+		return strings.Join(s, "\n") + "\n"
+	}
+
+	// a short paragraph held is left out at the scene break after it
+	if got, want := outcomes("--merge-short", id), ""+
+		"2 0 chunk 0\n"+
+		"10 -1 held for --merge-short: 15 bytes, under the least size of 300, and left out at a scene break before they made a chunk\n"+
+		"12 -1 left out as a scene break\n"+
+		"14 1 chunk 1\n"; got != want {
+		t.Errorf("under --merge-short:\n%s", lineDiff(want, got))
+	}
+	// and joined on where there's none
+	if got, want := outcomes("--merge-short", "--no-scene-breaks", id), ""+
+		"2 0 chunk 0\n"+
+		"10 1 joined to chunk 1 by --merge-short\n"+
+		"12 1 joined to chunk 1 by --merge-short\n"+
+		"14 1 chunk 1\n"; got != want {
+		t.Errorf("under --merge-short without scene breaks:\n%s", lineDiff(want, got))
+	}
+
+	if got, want := outcomes("--max-chunk", "150", "--min-chunk", "10", id), ""+
+		"2 0 chunk 0, cut at --max-chunk 150 bytes with the paragraph unfinished\n"+
+		"7 1 chunk 1\n"+
+		"10 2 chunk 2\n"+
+		"12 -1 left out as a scene break\n"+
+		"14 3 chunk 3, cut at --max-chunk 150 bytes with the paragraph unfinished\n"; got != want {
+		t.Errorf("under --max-chunk 150 --min-chunk 10:\n%s", lineDiff(want, got))
+	}
+
+	// a chunk quoting a blockphrase is counted, or dropped and the rest
+	// renumbered
+	phrases := filepath.Join(t.TempDir(), "phrases")
+	if err := os.WriteFile(phrases, []byte("the rain fell in torrents\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := outcomes("--blockphrase-file", phrases, "--strict-footer", id), ""+
+		"2 -1 dropped as license boilerplate\n"+
+		"10 -1 left out: 15 bytes, under the least size of 300\n"+
+		"12 -1 left out as a scene break\n"+
+		"14 0 chunk 0\n"; got != want {
+		t.Errorf("under --strict-footer:\n%s", lineDiff(want, got))
+	}
+	out, _ := captureStdout(t, func() error { return chunkOneCmd([]string{"--trace", "--blockphrase-file", phrases, id}) })
+	if !strings.Contains(out, "  footer: quotes the license phrase \"the rain fell in torrents\", counted\n") {
+		t.Errorf("with a blockphrase, chunk-one --trace printed\n%s", out)
+	}
+}
@@ -0,0 +1,121 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A transform reshapes chunk text as it is read, for consumers wanting it
+// some way other than as stored. Transforms are pure and chain left to
+// right.
+type transform func(string) string
+
+// transforms makes each named transform from its argument, the part of
+// the name after a colon, "" when there is none.
+var transforms = map[string]func(arg string) (transform, error){
+	"collapse-whitespace": noArg(collapseWhitespace),
+	"ascii-quotes":        noArg(asciiQuotes),
+	"strip-brackets":      noArg(stripBrackets),
+	"truncate-sentences":  truncateSentences,
+}
+
+func noArg(t transform) func(string) (transform, error) {
+	return func(arg string) (transform, error) {
+		if arg != "" {
+			return nil, errors.New("takes no argument")
+		}
+		return t, nil
+	}
+}
+
+// collapseWhitespace puts the whole chunk on one line, kept breaks and all.
+func collapseWhitespace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+var asciiQuoter = strings.NewReplacer("‘", "'", "’", "'", "‚", "'", "‛", "'", "“", `"`, "”", `"`, "„", `"`, "‟", `"`)
+
+func asciiQuotes(s string) string {
+	return asciiQuoter.Replace(s)
+}
+
+var bracketed = regexp.MustCompile(`[ \t]*\[[^\[\]\n]*\]`)
+
+// stripBrackets drops bracketed asides like [Illustration] and footnote
+// markers like [12].
+func stripBrackets(s string) string {
+	return bracketed.ReplaceAllString(s, "")
+}
+
+// truncateSentences keeps the first n sentences, as export splits them,
+// of the script of the text's letters.
+func truncateSentences(arg string) (transform, error) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("needs a number of sentences, like truncate-sentences:3")
+	}
+	return func(s string) string {
+		ends := SentenceEnds(s, DetectScript(s), n)
+		if len(ends) < n {
+			return s
+		}
+		return strings.TrimSpace(s[:ends[n-1][1]])
+	}, nil
+}
+
+// pipeline is a chain of transforms. The nil pipeline leaves text alone
+// and costs nothing.
+type pipeline []transform
+
+func (p pipeline) apply(s string) string {
+	for _, t := range p {
+		s = t(s)
+	}
+	return s
+}
+
+// parsePipeline reads a comma separated chain of transform names like
+// "strip-brackets,truncate-sentences:2". With allowed only those names
+// may be used.
+func parsePipeline(spec string, allowed map[string]bool) (pipeline, error) {
+	var p pipeline
+	for _, name := range strings.Split(spec, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		base, arg, _ := strings.Cut(name, ":")
+		mk, ok := transforms[base]
+		if !ok || allowed != nil && !allowed[base] {
+			return nil, fmt.Errorf("unknown transform %q (have %s)", base, transformNames(allowed))
+		}
+		t, err := mk(arg)
+		if err != nil {
+			return nil, fmt.Errorf("transform %s: %w", base, err)
+		}
+		p = append(p, t)
+	}
+	return p, nil
+}
+
+func transformNames(allowed map[string]bool) string {
+	names := []string{}
+	for name := range transforms {
+		if allowed == nil || allowed[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+const transformUsage = "reshape chunk text as it is read: a comma separated chain of collapse-whitespace, ascii-quotes, strip-brackets and truncate-sentences:N"
+
+// parseTransform reads ?transform= against the transforms serve allows.
+func (s *server) parseTransform(q url.Values) (pipeline, error) {
+	return parsePipeline(q.Get("transform"), s.transforms)
+}
@@ -0,0 +1,108 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTransforms(t *testing.T) {
+	for _, c := range []struct {
+		spec, in, want string
+	}{
+		{"collapse-whitespace", "Two lines\nof  verse,\n\n\tand a stanza.\n", "Two lines of verse, and a stanza."},
+		{"ascii-quotes", "“It’s ‘so’,” she said; „Ja‟.", `"It's 'so'," she said; "Ja".`},
+		{"strip-brackets", "He left [Illustration: a door] at once.[12] [Not\nthis one]", "He left at once. [Not\nthis one]"},
+		{"strip-brackets", "Nested [a [b] c] asides.", "Nested [a c] asides."},
+		{"truncate-sentences:2", "One. Two! Three? Four.", "One. Two!"},
+		{"truncate-sentences:5", "One. Two.", "One. Two."},
+		{"truncate-sentences:1", "一つ。二つ。", "一つ。"},
+		{"", "Left  alone.\n", "Left  alone.\n"},
+	} {
+		p, err := parsePipeline(c.spec, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", c.spec, err)
+		}
+		if got := p.apply(c.in); got != c.want {
+			t.Errorf("%s of %q = %q, want %q", c.spec, c.in, got, c.want)
+		}
+	}
+}
+
+func TestPipelineOrder(t *testing.T) {
+	in := "“One.” [1]\nTwo.  Three."
+	for _, c := range []struct {
+		spec, want string
+	}{
+		// left to right: the marker goes before the sentences are counted
+		{"strip-brackets, ascii-quotes,collapse-whitespace,truncate-sentences:2", `"One." Two.`},
+		{"truncate-sentences:1,ascii-quotes", `"One."`},
+	} {
+		p, err := parsePipeline(c.spec, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.apply(in); got != c.want {
+			t.Errorf("%s = %q, want %q", c.spec, got, c.want)
+		}
+	}
+	if p, _ := parsePipeline(" , ", nil); p != nil {
+		t.Errorf("an empty spec gave %d transforms, want the nil pipeline", len(p))
+	}
+}
+
+func TestParsePipelineErrors(t *testing.T) {
+	allowed := map[string]bool{"ascii-quotes": true, "strip-brackets": true}
+	for _, c := range []struct {
+		spec    string
+		allowed map[string]bool
+		want    string
+	}{
+		{"shout", nil, `unknown transform "shout"`},
+		{"collapse-whitespace", allowed, `unknown transform "collapse-whitespace" (have ascii-quotes, strip-brackets)`},
+		{"ascii-quotes:1", nil, "takes no argument"},
+		{"truncate-sentences", nil, "needs a number of sentences"},
+		{"truncate-sentences:0", nil, "needs a number of sentences"},
+	} {
+		if _, err := parsePipeline(c.spec, c.allowed); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: %v, want %s", c.spec, err, c.want)
+		}
+	}
+	if _, err := parsePipeline("strip-brackets,ascii-quotes", allowed); err != nil {
+		t.Errorf("allowed transforms: %v", err)
+	}
+}
+
+func TestServeTransform(t *testing.T) {
+	db := testDB(t)
+	id := addBook(t, db, "Emma", "Jane Austen", "")
+	stored := "“Emma,” [Illustration] said he."
+	insertChunk(t, db, id, 0, stored)
+	s := testServer(t, db)
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.routes().ServeHTTP(w, httptest.NewRequest("GET", fmt.Sprintf("/books/%d/chunks?%s", id, query), nil))
+		return w
+	}
+
+	w := get("transform=strip-brackets,ascii-quotes")
+	var bc bookChunks
+	if err := json.Unmarshal(w.Body.Bytes(), &bc); err != nil || w.Code != http.StatusOK || len(bc.Chunks) != 1 {
+		t.Fatalf("%d %s", w.Code, w.Body)
+	}
+	if got := bc.Chunks[0].Text; got != `"Emma," said he.` {
+		t.Errorf("served %q", got)
+	}
+	var chunk string
+	if err := db.QueryRow("SELECT chunk FROM chunks").Scan(&chunk); err != nil || chunk != stored {
+		t.Errorf("the stored chunk became %q, %v", chunk, err)
+	}
+
+	s.transforms = map[string]bool{"ascii-quotes": true}
+	if w = get("transform=strip-brackets"); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "have ascii-quotes") {
+		t.Errorf("a transform serve does not allow: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,154 @@
+package cli
+
+import (
+	"database/sql"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Transliteration makes books in Cyrillic and Greek findable in Latin
+// letters: "voina i mir" finds «Война и мир». Each letter is replaced on its
+// own by what translitTable gives, lowercased, and everything else is left
+// as it is, so the same text always transliterates the same way. It is
+// meant for finding, not reading, and isn't reversible: и, й and і all give
+// i, for one. Every book's title is transliterated into title_translit and
+// name_words; the text of chunks only into chunks_translit_fts, and only
+// when the full text index is built with --translit.
+//
+// Russian, Ukrainian, Belarusian, Serbian and Macedonian Cyrillic:
+//
+//	а a    б b    в v    г g    ґ g    д d    ђ dj   ѓ gj   е e    ё e
+//	є ye   ж zh   з z    ѕ dz   и i    і i    ї i    й i    ј j    к k
+//	л l    љ lj   м m    н n    њ nj   о o    п p    р r    с s    т t
+//	ћ c    ќ kj   у u    ў u    ф f    х kh   ц ts   ч ch   џ dz   ш sh
+//	щ shch ъ -    ы y    ь -    э e    ю yu   я ya
+//
+// Greek, monotonic and polytonic, the letters with accents, breathings,
+// diaereses or iota subscripts as the plain ones:
+//
+//	α a    β v    γ g    δ d    ε e    ζ z    η i    θ th   ι i    κ k
+//	λ l    μ m    ν n    ξ x    ο o    π p    ρ r    σ s    ς s    τ t
+//	υ y    φ f    χ ch   ψ ps   ω o
+//
+// where - is a letter dropped.
+var translitTable = func() map[rune]string {
+	m := map[rune]string{}
+	for _, t := range []struct {
+		from string
+		to   []string
+	}{
+		{"абвгґдђѓеёєжзѕиіїйјклљмнњопрстћќуўфхцчџшщъыьэюя", []string{
+			"a", "b", "v", "g", "g", "d", "dj", "gj", "e", "e",
+			"ye", "zh", "z", "dz", "i", "i", "i", "i", "j", "k",
+			"l", "lj", "m", "n", "nj", "o", "p", "r", "s", "t",
+			"c", "kj", "u", "u", "f", "kh", "ts", "ch", "dz", "sh",
+			"shch", "", "y", "", "e", "yu", "ya"}},
+		{"αβγδεζηθικλμνξοπρσςτυφχψω", []string{
+			"a", "v", "g", "d", "e", "z", "i", "th", "i", "k",
+			"l", "m", "n", "x", "o", "p", "r", "s", "s", "t",
+			"y", "f", "ch", "ps", "o"}},
+		{"άέήίόύώϊΐϋΰ", []string{"a", "e", "i", "i", "o", "y", "o", "i", "i", "y", "y"}},
+	} {
+		i := 0
+		for _, r := range t.from {
+			m[r] = t.to[i]
+			i++
+		}
+	}
+	// the lowercase letters of the Greek Extended block, by the plain
+	// letter they carry marks on
+	for plain, ranges := range map[rune][][2]rune{
+		'α': {{0x1f00, 0x1f07}, {0x1f70, 0x1f71}, {0x1f80, 0x1f87}, {0x1fb0, 0x1fb4}, {0x1fb6, 0x1fb7}},
+		'ε': {{0x1f10, 0x1f15}, {0x1f72, 0x1f73}},
+		'η': {{0x1f20, 0x1f27}, {0x1f74, 0x1f75}, {0x1f90, 0x1f97}, {0x1fc2, 0x1fc4}, {0x1fc6, 0x1fc7}},
+		'ι': {{0x1f30, 0x1f37}, {0x1f76, 0x1f77}, {0x1fd0, 0x1fd3}, {0x1fd6, 0x1fd7}},
+		'ο': {{0x1f40, 0x1f45}, {0x1f78, 0x1f79}},
+		'υ': {{0x1f50, 0x1f57}, {0x1f7a, 0x1f7b}, {0x1fe0, 0x1fe3}, {0x1fe6, 0x1fe7}},
+		'ρ': {{0x1fe4, 0x1fe5}},
+		'ω': {{0x1f60, 0x1f67}, {0x1f7c, 0x1f7d}, {0x1fa0, 0x1fa7}, {0x1ff2, 0x1ff4}, {0x1ff6, 0x1ff7}},
+	} {
+		for _, rg := range ranges {
+			for r := rg[0]; r <= rg[1]; r++ {
+				m[r] = m[plain]
+			}
+		}
+	}
+	return m
+}()
+
+// translit transliterates s, reporting whether it had anything to
+// transliterate.
+func translit(s string) (string, bool) {
+	var b []byte
+	for i, r := range s {
+		t, ok := translitTable[unicode.ToLower(r)]
+		if !ok {
+			if b != nil {
+				b = utf8.AppendRune(b, r)
+			}
+			continue
+		}
+		if b == nil {
+			b = append(make([]byte, 0, len(s)), s[:i]...)
+		}
+		b = append(b, t...)
+	}
+	if b == nil {
+		return s, false
+	}
+	return string(b), true
+}
+
+// translitSQL is translit(text) in sql, null for text with nothing to
+// transliterate. It is registered on every connection, as the triggers of
+// chunks_translit_fts call it.
+func translitSQL(s string) interface{} {
+	t, ok := translit(s)
+	if !ok {
+		return nil
+	}
+	return t
+}
+
+// titleTranslit is what files.title_translit holds for a folded title.
+func titleTranslit(titleNorm string) sql.NullString {
+	t, ok := translit(titleNorm)
+	return sql.NullString{String: t, Valid: ok}
+}
+
+// fillTitleTranslit transliterates the titles of the books there were
+// before title_translit.
+func fillTitleTranslit(db *sql.DB) error {
+	rows, err := db.Query("SELECT id, coalesce(author_norm, ''), coalesce(title_norm, '') FROM files")
+	if err != nil {
+		return err
+	}
+	todo := map[int64][2]string{}
+	for rows.Next() {
+		var id int64
+		var author, title string
+		if err = rows.Scan(&id, &author, &title); err != nil {
+			rows.Close()
+			return err
+		}
+		if _, ok := translit(title); ok {
+			todo[id] = [2]string{author, title}
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || len(todo) == 0 {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for id, n := range todo {
+		if err = saveNameWords(tx, id, n[0], n[1]); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,127 @@
+package cli
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestTranslit(t *testing.T) {
+	for _, c := range []struct{ in, want string }{
+		{"Война и мир", "voina i mir"},
+		{"Преступление и наказание", "prestuplenie i nakazanie"},
+		{"Кобзар: Їжак і Щедрість", "kobzar: izhak i shchedrist"},
+		{"Ὀδύσσεια", "odysseia"},
+		{"Ἰλιάς, ῥαψῳδία α'", "ilias, rapsodia a'"},
+		// only the letters are changed
+		{"Anna Каренина, 1878", "Anna karenina, 1878"},
+	} {
+		if got, ok := translit(c.in); !ok || got != c.want {
+			t.Errorf("%q transliterates as %q, %v, want %q", c.in, got, ok, c.want)
+		}
+	}
+	if got, ok := translit("Emma"); ok || got != "Emma" {
+		t.Errorf("Emma transliterates as %q, %v", got, ok)
+	}
+}
+
+func TestSearchBooksAcrossScripts(t *testing.T) {
+	db := testDB(t)
+	for _, b := range [][2]string{
+		{"Война и мир", "Лев Толстой"},
+		{"Войны", "Anonymous"},
+		{"War and Peace", "Leo Tolstoy"},
+	} {
+		id := addBook(t, db, b[0], b[1], "")
+		if err := saveNameWords(db, int64(id), normalizeAuthor(b[1]), normalizeTitle(b[0])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var tt string
+	if err := db.QueryRow("SELECT title_translit FROM files WHERE id = 1").Scan(&tt); err != nil || tt != "voina i mir" {
+		t.Errorf("the title is transliterated as %q (%v)", tt, err)
+	}
+	for _, c := range []struct{ query, want string }{
+		{"voina i mir", "Война и мир:exact"},
+		{"Война и мир", "Война и мир:exact"},
+		{"MIR voina", "Война и мир:words"},
+		{"voin", "Войны:prefix Война и мир:prefix"},
+		{"war", "War and Peace:words"},
+	} {
+		matches, err := searchBooks(db, c.query, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, m := range matches {
+			got = append(got, m.Title+":"+m.Match)
+		}
+		if strings.Join(got, " ") != c.want {
+			t.Errorf("searching for %q found %q, want %q", c.query, got, c.want)
+		}
+	}
+}
+
+func TestSearchChunksAcrossScripts(t *testing.T) {
+	rowidOnly(t, "the full text index")
+	db := testDB(t)
+	id := addBook(t, db, "Война и мир", "Лев Толстой", "")
+	insertChunk(t, db, id, 0, "Ну, князь, Генуя и Лукка стали не больше как поместьями.")
+	insertChunk(t, db, id, 1, "Eh bien, mon prince. Gênes et Lucques ne sont plus que des apanages.")
+	s := testServer(t, db)
+	index := func(args ...string) string {
+		t.Helper()
+		out, err := captureStdout(t, func() error { return indexCmd(args) })
+		if err != nil {
+			t.Fatalf("index %s: %v", strings.Join(args, " "), err)
+		}
+		return out
+	}
+	search := func(q string) string {
+		t.Helper()
+		w, p := getSearch(t, s, "q="+url.QueryEscape(q))
+		if w.Code != http.StatusOK {
+			t.Fatalf("searching for %q: %d %s", q, w.Code, w.Body)
+		}
+		var got []string
+		for _, r := range p.Results {
+			got = append(got, fmt.Sprintf("%d %s", r.ID, r.Snippet))
+		}
+		return strings.Join(got, "\n")
+	}
+
+	// without --translit, there is no shadow
+	index()
+	if shadow, err := hasTranslit(db); err != nil || shadow {
+		t.Fatalf("indexed without --translit, the index has a shadow: %v (%v)", shadow, err)
+	}
+	if got := search("knyaz"); got != "" {
+		t.Errorf("without the shadow, knyaz found\n%s", got)
+	}
+
+	if out := index("--translit"); !strings.Contains(out, "built without --translit; starting it over") {
+		t.Errorf("index --translit printed %q", out)
+	}
+	if got := ids(t, db, "SELECT docid FROM chunks_translit_fts ORDER BY docid"); got != "1" {
+		t.Errorf("the shadow holds chunks %s, want only the one in Cyrillic", got)
+	}
+	// found only through the shadow, the snippet is in Latin letters
+	if got := search("knyaz"); !strings.HasPrefix(got, "1 ") || !strings.Contains(got, "<mark>knyaz</mark>") || strings.Contains(got, "\n") {
+		t.Errorf("knyaz found\n%s", got)
+	}
+	// found in the index itself, it is in the book's own
+	if got := search("Генуя"); !strings.HasPrefix(got, "1 ") || !strings.Contains(got, "<mark>Генуя</mark>") || strings.Contains(got, "\n") {
+		t.Errorf("Генуя found\n%s", got)
+	}
+	if got := search("prince"); !strings.HasPrefix(got, "2 ") || strings.Contains(got, "\n") {
+		t.Errorf("prince found\n%s", got)
+	}
+
+	// chunks written since are kept in the shadow by its triggers
+	more := insertChunk(t, db, id, 2, "Я вижу, что я вас пугаю.")
+	if got := search("pugayu"); !strings.HasPrefix(got, fmt.Sprintf("%d ", more)) {
+		t.Errorf("a chunk written since, pugayu found\n%s", got)
+	}
+}
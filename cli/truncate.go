@@ -0,0 +1,157 @@
+package cli
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Quotes cut short for a post, a budget of words, a preview: each wants
+// text cut to a size without ending mid-sentence or mid-word, and
+// gutchunk truncate does the same for the shell.
+
+// truncUnit is what a truncation limit counts.
+type truncUnit int
+
+const (
+	unitRune truncUnit = iota
+	unitWord
+	unitSentence
+)
+
+var truncUnits = map[string]truncUnit{"rune": unitRune, "word": unitWord, "sentence": unitSentence}
+
+// truncateAtBoundary cuts text to at most limit units without ending in
+// the middle of a sentence where it can help it, and never in the middle of
+// a word where there is a word boundary at all: it ends text at the last
+// sentence end, as export splits sentences, within the limit, failing that
+// at the last word, failing that, a single word over the limit, at the
+// limit's rune. In runes ellipsis counts towards the limit and in words and
+// sentences it doesn't. ellipsis is added only when something was cut, and
+// text within the limit comes back as it was. Words and sentences are
+// those of text's script.
+func truncateAtBoundary(text string, limit int, unit truncUnit, ellipsis string) string {
+	if limit <= 0 {
+		return ""
+	}
+	script := DetectScript(text)
+	budget := limit
+	if unit == unitRune {
+		if utf8.RuneCountInString(text) <= limit {
+			return text
+		}
+		if budget -= utf8.RuneCountInString(ellipsis); budget <= 0 {
+			// no room for the ellipsis
+			budget, ellipsis = limit, ""
+		}
+	}
+
+	// max is how much of text the limit allows, in bytes
+	var max int
+	switch unit {
+	case unitRune:
+		max = runeOffset(text, budget)
+	case unitWord:
+		max = wordsEnd(text, budget, script)
+	case unitSentence:
+		ends := SentenceEnds(text, script, budget)
+		if len(ends) < budget || strings.TrimSpace(text[ends[budget-1][1]:]) == "" {
+			return text
+		}
+		return cutAt(text, ends[budget-1][1], ellipsis)
+	}
+	if max >= len(text) {
+		return text
+	}
+	if strings.TrimSpace(text[max:]) == "" {
+		// only whitespace over the limit: nothing cut to mark
+		return strings.TrimRightFunc(text[:max], unicode.IsSpace)
+	}
+
+	// the last sentence ending within the limit, its closing punctuation
+	// and quotes in and the whitespace after left out
+	cut := -1
+	for _, m := range SentenceEnds(text[:max]+" ", script, -1) {
+		end := len(strings.TrimRightFunc(text[:m[1]], unicode.IsSpace))
+		if end <= max {
+			cut = end
+		}
+	}
+	if cut <= 0 {
+		cut = max
+		for _, w := range WordSpans(text, script) {
+			if w[0] < max && max < w[1] {
+				// in the middle of a word: back to the last one before it
+				if w[0] > 0 {
+					cut = w[0]
+				}
+				break
+			}
+		}
+	}
+	return cutAt(text, cut, ellipsis)
+}
+
+func cutAt(text string, at int, ellipsis string) string {
+	kept := strings.TrimRightFunc(text[:at], unicode.IsSpace)
+	if kept == "" {
+		// nothing to hold up the ellipsis
+		return ""
+	}
+	return kept + ellipsis
+}
+
+// runeOffset is the byte offset of rune n of s, len(s) when it has fewer.
+func runeOffset(s string, n int) int {
+	for i := range s {
+		if n == 0 {
+			return i
+		}
+		n--
+	}
+	return len(s)
+}
+
+// wordsEnd is the byte offset of the end of word n of s, words being
+// those of script, len(s) when it has fewer.
+func wordsEnd(s string, n int, script Script) int {
+	if n == 0 {
+		return 0
+	}
+	if spans := WordSpans(s, script); n <= len(spans) {
+		return spans[n-1][1]
+	}
+	return len(s)
+}
+
+func truncateCmd(args []string) error {
+	fs := flag.NewFlagSet("truncate", flag.ExitOnError)
+	limit := fs.Int("limit", 280, "most units of text to keep")
+	unit := fs.String("unit", "rune", "what --limit counts: rune, word or sentence")
+	ellipsis := fs.String("ellipsis", "…", "added to text that was cut, counted in the limit with --unit rune")
+	fs.Parse(args)
+
+	u, ok := truncUnits[*unit]
+	if !ok {
+		return usagef("unknown --unit %q; want rune, word or sentence", *unit)
+	}
+	if *limit < 1 {
+		return usagef("--limit must be positive")
+	}
+	if fs.NArg() > 0 {
+		return usagef("usage: gutchunk truncate [flags] < text")
+	}
+
+	in, err := io.ReadAll(bufio.NewReader(os.Stdin))
+	if err != nil {
+		return err
+	}
+	text := strings.TrimSuffix(string(in), "\n")
+	_, err = fmt.Println(truncateAtBoundary(text, *limit, u, *ellipsis))
+	return err
+}
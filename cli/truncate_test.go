@@ -0,0 +1,72 @@
+package cli
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateAtBoundary(t *testing.T) {
+	long := "This sentence goes on and on " + strings.Repeat("and on ", 40) + "until it stops."
+	tests := []struct {
+		name     string
+		text     string
+		limit    int
+		unit     truncUnit
+		ellipsis string
+		want     string
+	}{
+		{"empty", "", 10, unitRune, "…", ""},
+		{"zero limit", "Some text.", 0, unitRune, "…", ""},
+		{"shorter than the limit", "Short.", 10, unitRune, "…", "Short."},
+		{"exactly the limit", "Exactly ten", 11, unitRune, "…", "Exactly ten"},
+		{"one rune over", "Exactly ten!", 11, unitRune, "…", "Exactly…"},
+		{"last sentence within", "One. Two. Three is long.", 12, unitRune, "…", "One. Two.…"},
+		{"sentence with its quote", `He said "Stop." Then he went on.`, 20, unitRune, "", `He said "Stop."`},
+		{"word when no sentence ends", "alpha beta gamma delta", 14, unitRune, "…", "alpha beta…"},
+		{"enormous sentence", long, 40, unitRune, "…", "This sentence goes on and on and on and…"},
+		{"single word over the limit", "Supercalifragilistic", 6, unitRune, "…", "Super…"},
+		{"ellipsis too long", "alpha beta", 3, unitRune, "......", "alp"},
+		{"ellipsis only when cut", "alpha beta", 10, unitRune, "…", "alpha beta"},
+		{"whitespace over the limit", "0 ", 1, unitRune, "…", "0"},
+		{"trailing whitespace over the limit", "ab   ", 3, unitRune, "…", "ab"},
+		{"multi-byte at the limit", "naïve café", 7, unitRune, "", "naïve"},
+		{"multi-byte straddling the limit", "ééé ééé", 5, unitRune, "", "ééé"},
+		{"multi-byte rune cut", "éééééé", 4, unitRune, "", "éééé"},
+		{"emoji", "🙂🙂🙂 🙂🙂", 4, unitRune, "…", "🙂🙂🙂…"},
+		{"words within", "one two three", 3, unitWord, "…", "one two three"},
+		{"words cut", "one two three four", 2, unitWord, "…", "one two…"},
+		{"words prefer a sentence", "One two. Three four five.", 4, unitWord, "…", "One two.…"},
+		{"words then whitespace", "one two   ", 2, unitWord, "…", "one two"},
+		{"sentences within", "One. Two.", 2, unitSentence, "…", "One. Two."},
+		{"sentences cut", "One. Two. Three.", 2, unitSentence, "…", "One. Two.…"},
+		{"sentences then whitespace", "One. Two.  ", 2, unitSentence, "…", "One. Two.  "},
+	}
+	for _, tt := range tests {
+		got := truncateAtBoundary(tt.text, tt.limit, tt.unit, tt.ellipsis)
+		if got != tt.want {
+			t.Errorf("%s: truncateAtBoundary(%q, %d) = %q, want %q", tt.name, tt.text, tt.limit, got, tt.want)
+		}
+		if tt.unit == unitRune && utf8.RuneCountInString(got) > tt.limit {
+			t.Errorf("%s: %q is over the limit of %d", tt.name, got, tt.limit)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("%s: %q isn't UTF-8", tt.name, got)
+		}
+	}
+}
+
+// However it is cut, text in runes never comes back over the limit.
+func TestTruncateNeverOver(t *testing.T) {
+	texts := []string{"0 ", "a b c d e f", "Tôt. Très tôt!  Trop tôt?", "x\n\n\ny", strings.Repeat("é ", 30)}
+	for _, text := range texts {
+		for limit := 1; limit <= utf8.RuneCountInString(text)+1; limit++ {
+			for _, ellipsis := range []string{"", "…", "..."} {
+				got := truncateAtBoundary(text, limit, unitRune, ellipsis)
+				if n := utf8.RuneCountInString(got); n > limit {
+					t.Errorf("truncateAtBoundary(%q, %d, %q) = %q, %d runes", text, limit, ellipsis, got, n)
+				}
+			}
+		}
+	}
+}
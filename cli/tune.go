@@ -0,0 +1,344 @@
+package cli
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// tune chunks a sample of books in memory under each of a grid of chunk
+// sizes, --min-sizes by --merge-short off and on by --max-sizes, and
+// reports for each setting the chunks it makes, how much of the body text
+// they keep, their median length and how many are of a length in
+// --target. It recommends the setting keeping the most text in chunks
+// within the target, ties going to the one with more of its chunks there,
+// and then to the first in the grid, and says so as the chunk flags that
+// would give it. Nothing is written.
+//
+// The text a setting keeps is measured against every paragraph of the
+// body as the chunker finds them, footnotes taken out, by the bytes other
+// than white space, so the joining of lines and paragraphs doesn't count.
+// A book whose language has a least size of its own, or whose override
+// sets min-chunk, keeps it under every setting, as chunk would.
+
+// tuneSetting is one point of the grid.
+type tuneSetting struct {
+	MinChunk   int  `json:"min_chunk"`
+	MaxChunk   int  `json:"max_chunk"`
+	MergeShort bool `json:"merge_short"`
+}
+
+// flags are the chunk flags giving s.
+func (s tuneSetting) flags() string {
+	f := fmt.Sprintf("--min-chunk %d", s.MinChunk)
+	if s.MaxChunk > 0 {
+		f += fmt.Sprintf(" --max-chunk %d", s.MaxChunk)
+	}
+	if s.MergeShort {
+		f += " --merge-short"
+	}
+	return f
+}
+
+type tuneResult struct {
+	tuneSetting
+	Chunks       int     `json:"chunks"`
+	RetainedPct  float64 `json:"retained_pct"`
+	MedianLength int     `json:"median_length"`
+	InRangePct   float64 `json:"in_range_pct"`
+	// the part of the body text in chunks within the target
+	InRangeTextPct float64 `json:"in_range_text_pct"`
+}
+
+type tuneReport struct {
+	Books       int          `json:"books"`
+	Target      string       `json:"target"`
+	Results     []tuneResult `json:"results"`
+	Recommended tuneResult   `json:"recommended"`
+}
+
+// tuneTally is what a setting's chunks add up to over the sample.
+type tuneTally struct {
+	lengths []int
+	// text bytes kept, and kept in chunks within the target
+	kept, inRange int
+}
+
+// chunkRange is a --target, FROM-TO bytes.
+type chunkRange struct{ from, to int }
+
+func (r chunkRange) String() string { return fmt.Sprintf("%d-%d", r.from, r.to) }
+
+var chunkRangeSpec = regexp.MustCompile(`^(\d+)-(\d+)$`)
+
+func parseChunkRange(s string) (chunkRange, error) {
+	m := chunkRangeSpec.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return chunkRange{}, usagef("bad --target %q; give it as 400-1200", s)
+	}
+	from, _ := strconv.Atoi(m[1])
+	to, _ := strconv.Atoi(m[2])
+	if to < from {
+		return chunkRange{}, usagef("bad --target %q; %d is after %d", s, from, to)
+	}
+	return chunkRange{from, to}, nil
+}
+
+// parseSizeList reads a comma separated list of byte counts, each at least
+// least.
+func parseSizeList(name, spec string, least int) ([]int, error) {
+	sizes := []int{}
+	for _, item := range strings.Split(spec, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(item))
+		if err != nil || n < least {
+			return nil, usagef("bad %s %q; want numbers of bytes, at least %d, like 200,300", name, item, least)
+		}
+		sizes = append(sizes, n)
+	}
+	return sizes, nil
+}
+
+func tuneCmd(args []string) error {
+	fs := flag.NewFlagSet("tune", flag.ExitOnError)
+	sample := fs.Int("sample", 500, "how many books to draw and chunk")
+	seed := fs.Int64("seed", 0, "random seed (default: time based)")
+	targetSpec := fs.String("target", "", "the chunk lengths wanted, in bytes, like 400-1200")
+	minSpec := fs.String("min-sizes", "100,200,300,500", "the --min-chunk sizes to try")
+	maxSpec := fs.String("max-sizes", "0,2000", "the --max-chunk sizes to try, 0 for no limit")
+	workers := fs.Int("workers", 4, "books chunked at once")
+	asJSON := fs.Bool("json", false, "print the report as json")
+	loadOverrides := overridesFlag(fs)
+	fs.Parse(args)
+
+	if fs.NArg() > 0 || *targetSpec == "" {
+		return usagef("usage: gutchunk tune --target FROM-TO [--sample N] [--min-sizes LIST] [--max-sizes LIST] [--json]")
+	}
+	if *sample < 1 || *workers < 1 {
+		return usagef("--sample and --workers must be positive")
+	}
+	target, err := parseChunkRange(*targetSpec)
+	if err != nil {
+		return err
+	}
+	mins, err := parseSizeList("--min-sizes", *minSpec, 1)
+	if err != nil {
+		return err
+	}
+	maxes, err := parseSizeList("--max-sizes", *maxSpec, 0)
+	if err != nil {
+		return err
+	}
+	grid := tuneGrid(mins, maxes)
+	if len(grid) == 0 {
+		return usagef("no --max-sizes is more than a --min-sizes")
+	}
+	ovr, err := loadOverrides()
+	if err != nil {
+		return err
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ids, err := sampleBooks(db, *sample, true, nil, rand.New(rand.NewSource(*seed)))
+	if err != nil {
+		return err
+	}
+	// the last is the sample's whole body text
+	tallies := make([]tuneTally, len(grid)+1)
+	var mu sync.Mutex
+	var tuneErr error
+	books := make(chan bookfile)
+	var wg sync.WaitGroup
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range books {
+				t, err := tuneBook(b, ovr, grid, target)
+				mu.Lock()
+				if err != nil && tuneErr == nil {
+					tuneErr = fmt.Errorf("book %d: %w", b.ID, err)
+				}
+				for i := range t {
+					tallies[i].lengths = append(tallies[i].lengths, t[i].lengths...)
+					tallies[i].kept += t[i].kept
+					tallies[i].inRange += t[i].inRange
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	chunked := 0
+	for i, id := range ids {
+		b, err := loadBook(db, int(id))
+		if err != nil {
+			close(books)
+			wg.Wait()
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "%d of %d\r", i+1, len(ids))
+		books <- b
+		chunked++
+	}
+	close(books)
+	wg.Wait()
+	if chunked > 0 {
+		fmt.Fprintln(os.Stderr)
+	}
+	if tuneErr != nil {
+		return tuneErr
+	}
+	rep := tuneReport{Books: chunked, Target: target.String(), Results: []tuneResult{}}
+	for i, s := range grid {
+		rep.Results = append(rep.Results, tallies[i].result(s, target, tallies[len(grid)].kept))
+	}
+	rep.Recommended = recommendSetting(rep.Results)
+
+	if *asJSON {
+		return json.NewEncoder(os.Stdout).Encode(rep)
+	}
+	printTune(rep)
+	return nil
+}
+
+// tuneGrid is every setting of mins, merge-short off and on, and maxes,
+// leaving out a max no more than its min.
+func tuneGrid(mins, maxes []int) []tuneSetting {
+	grid := []tuneSetting{}
+	for _, least := range mins {
+		for _, merge := range []bool{false, true} {
+			for _, most := range maxes {
+				if most == 0 || most > least {
+					grid = append(grid, tuneSetting{least, most, merge})
+				}
+			}
+		}
+	}
+	return grid
+}
+
+// tuneBook chunks b under each setting of grid, with its override from
+// ovr, and tallies the chunks, the last tally being the body's whole text.
+func tuneBook(b bookfile, ovr *overrides, grid []tuneSetting, target chunkRange) ([]tuneTally, error) {
+	opts, err := ovr.apply(b, chunkOptions{bodyOnly: b.BodyOnly})
+	if err != nil {
+		return nil, err
+	}
+	body, _ := opts.body(b.Content)
+	opts.script = ScriptOf(b.Language, b.Content)
+	// what goes before --min-chunk, as in chunkBook
+	least := opts.minChunk
+	if least == 0 {
+		if n, _ := (*langMinimums)(nil).min(b.Language); n != minChunk {
+			least = n
+		}
+	}
+	t := make([]tuneTally, len(grid)+1)
+	for i, s := range grid {
+		o := opts
+		o.minChunk, o.window, o.mergeShort = s.MinChunk, s.MaxChunk, s.MergeShort
+		if least > 0 {
+			o.minChunk = least
+		}
+		chunks, _, _ := splitBody(body, o)
+		for _, c := range chunks {
+			n := textBytes(c)
+			t[i].lengths = append(t[i].lengths, len(c))
+			t[i].kept += n
+			if len(c) >= target.from && len(c) <= target.to {
+				t[i].inRange += n
+			}
+		}
+	}
+	// every paragraph, only footnotes taken out
+	o := opts
+	o.minChunk, o.window, o.mergeShort = 1, 0, false
+	chunks, _, _ := splitBody(body, o)
+	for _, c := range chunks {
+		t[len(grid)].kept += textBytes(c)
+	}
+	return t, nil
+}
+
+// textBytes is the bytes of s other than white space.
+func textBytes(s string) int {
+	n := 0
+	for _, r := range s {
+		if !unicode.IsSpace(r) {
+			n += utf8.RuneLen(r)
+		}
+	}
+	return n
+}
+
+// result is what t comes to for s, of the text bytes in the bodies.
+func (t tuneTally) result(s tuneSetting, target chunkRange, text int) tuneResult {
+	r := tuneResult{tuneSetting: s, Chunks: len(t.lengths)}
+	if text > 0 {
+		r.RetainedPct = 100 * float64(t.kept) / float64(text)
+		r.InRangeTextPct = 100 * float64(t.inRange) / float64(text)
+	}
+	if len(t.lengths) > 0 {
+		sort.Ints(t.lengths)
+		r.MedianLength = t.lengths[len(t.lengths)/2]
+		in := 0
+		for _, n := range t.lengths {
+			if n >= target.from && n <= target.to {
+				in++
+			}
+		}
+		r.InRangePct = 100 * float64(in) / float64(len(t.lengths))
+	}
+	return r
+}
+
+// recommendSetting is the result of results keeping the most text in
+// chunks within the target, then with the most of its chunks there, then
+// the first.
+func recommendSetting(results []tuneResult) tuneResult {
+	var best tuneResult
+	for i, r := range results {
+		if i == 0 || r.InRangeTextPct > best.InRangeTextPct ||
+			r.InRangeTextPct == best.InRangeTextPct && r.InRangePct > best.InRangePct {
+			best = r
+		}
+	}
+	return best
+}
+
+func printTune(rep tuneReport) {
+	fmt.Printf("%5s %5s %5s %9s %9s %7s %9s %9s\n", "min", "max", "merge", "chunks", "retained", "median", "in range", "its text")
+	for _, r := range rep.Results {
+		most, merge := "-", "no"
+		if r.MaxChunk > 0 {
+			most = strconv.Itoa(r.MaxChunk)
+		}
+		if r.MergeShort {
+			merge = "yes"
+		}
+		mark := ""
+		if r.tuneSetting == rep.Recommended.tuneSetting {
+			mark = "  *"
+		}
+		fmt.Printf("%5d %5s %5s %9d %8.1f%% %7d %8.1f%% %8.1f%%%s\n", r.MinChunk, most, merge, r.Chunks, r.RetainedPct, r.MedianLength, r.InRangePct, r.InRangeTextPct, mark)
+	}
+	r := rep.Recommended
+	fmt.Printf("%d books; chunk %s keeps %.1f%% of their text in chunks of %s bytes\n", rep.Books, r.flags(), r.InRangeTextPct, rep.Target)
+}
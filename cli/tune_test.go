@@ -0,0 +1,157 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// tuneParagraphs are n pairs of a short paragraph, of about 150 bytes,
+// and a longer one after it, of about 500.
+func tuneParagraphs(n int) string {
+	ps := []string{}
+	for i := 0; i < n; i++ {
+		ps = append(ps, fmt.Sprintf("A short one, %03d, %s", i, strings.Repeat("of a few words, ", 8)),
+			fmt.Sprintf("And a longer one, %03d, %s", i, strings.Repeat("that goes on about the weather at length, ", 11)))
+	}
+	return strings.Join(ps, "\n\n")
+}
+
+func TestMergeShort(t *testing.T) {
+	body := strings.Split(strings.Join([]string{"Short, one.", "Short, two.", "A longer paragraph than the others here.", "Short, three.", "* * *", "Short, four.", "Another longer paragraph than the short ones.", ""}, "\n\n"), "\n")
+	split := func(merge bool) string {
+		chunks, _, _ := splitBody(body, chunkOptions{minChunk: 30, mergeShort: merge})
+		return strings.Join(chunks, " | ")
+	}
+	if got := split(false); got != "A longer paragraph than the others here. | Another longer paragraph than the short ones." {
+		t.Errorf("without --merge-short, the chunks are %q", got)
+	}
+	// joined to the next, but not across the scene break
+	if got := split(true); got != "Short, one.\n\nShort, two.\n\nA longer paragraph than the others here. | Short, four.\n\nAnother longer paragraph than the short ones." {
+		t.Errorf("with --merge-short, the chunks are %q", got)
+	}
+}
+
+func TestRecommendSetting(t *testing.T) {
+	r := func(least int, merge bool, inRange, text float64) tuneResult {
+		return tuneResult{tuneSetting: tuneSetting{MinChunk: least, MergeShort: merge}, InRangePct: inRange, InRangeTextPct: text}
+	}
+	for _, c := range []struct {
+		results []tuneResult
+		want    int
+	}{
+		{[]tuneResult{r(100, false, 90, 70), r(200, true, 50, 95), r(300, false, 100, 80)}, 200},
+		// the text in range tied, the most chunks in range
+		{[]tuneResult{r(100, false, 60, 90), r(200, false, 80, 90), r(300, true, 70, 90)}, 200},
+		// tied on both, the first
+		{[]tuneResult{r(100, false, 80, 90), r(200, false, 80, 90)}, 100},
+		{[]tuneResult{r(100, false, 0, 0)}, 100},
+	} {
+		if got := recommendSetting(c.results); got.MinChunk != c.want {
+			t.Errorf("recommendSetting(%+v) = %+v, want min %d", c.results, got, c.want)
+		}
+	}
+	if got := (tuneSetting{200, 2000, true}).flags(); got != "--min-chunk 200 --max-chunk 2000 --merge-short" {
+		t.Errorf("flags = %q", got)
+	}
+	grid := tuneGrid([]int{100, 300}, []int{0, 200})
+	if len(grid) != 6 || grid[0] != (tuneSetting{100, 0, false}) || grid[1] != (tuneSetting{100, 200, false}) || grid[2] != (tuneSetting{100, 0, true}) || grid[4] != (tuneSetting{300, 0, false}) {
+		t.Errorf("tuneGrid = %+v", grid)
+	}
+}
+
+func TestTune(t *testing.T) {
+	db := testDB(t)
+	for i := 0; i < 3; i++ {
+		title := fmt.Sprint("Book ", i+1)
+		addBook(t, db, title, "", testBook(title, tuneParagraphs(10)))
+	}
+	// and one with no content, which can't be chunked
+	none := addBook(t, db, "Stub", "", "")
+	if _, err := db.Exec("UPDATE files SET content = NULL WHERE id = ?", none); err != nil {
+		t.Fatal(err)
+	}
+	tune := func(args ...string) (string, error) {
+		t.Helper()
+		var out string
+		_, err := captureStderr(t, func() error {
+			var err error
+			out, err = captureStdout(t, func() error {
+				return tuneCmd(append([]string{"--target", "400-1200", "--min-sizes", "100,200,500", "--max-sizes", "0,2000", "--seed", "1"}, args...))
+			})
+			return err
+		})
+		return out, err
+	}
+
+	out, err := tune("--json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rep tuneReport
+	if err = json.Unmarshal([]byte(out), &rep); err != nil {
+		t.Fatal(err)
+	}
+	if rep.Books != 3 || rep.Target != "400-1200" || len(rep.Results) != 12 {
+		t.Fatalf("tune reported %d books, for %s, under %d settings", rep.Books, rep.Target, len(rep.Results))
+	}
+	byFlags := map[string]tuneResult{}
+	for _, r := range rep.Results {
+		byFlags[r.flags()] = r
+	}
+	// a short paragraph kept on its own is out of the target, dropped it
+	// is lost, and only joined to the longer one after it is the text all
+	// in chunks of the target's length
+	kept, dropped, merged := byFlags["--min-chunk 100"], byFlags["--min-chunk 200"], byFlags["--min-chunk 200 --merge-short"]
+	if kept.Chunks != 60 || kept.RetainedPct != 100 || kept.InRangePct != 50 || kept.InRangeTextPct > 80 {
+		t.Errorf("keeping the short paragraphs: %+v", kept)
+	}
+	if dropped.Chunks != 30 || dropped.RetainedPct > 80 || dropped.InRangePct != 100 || dropped.InRangeTextPct != dropped.RetainedPct {
+		t.Errorf("dropping the short paragraphs: %+v", dropped)
+	}
+	if merged.Chunks != 30 || merged.RetainedPct != 100 || merged.InRangePct != 100 || merged.InRangeTextPct != 100 || merged.MedianLength < 600 {
+		t.Errorf("merging the short paragraphs: %+v", merged)
+	}
+	// and so under a higher least size, and a max above their length
+	if r := byFlags["--min-chunk 500 --max-chunk 2000 --merge-short"]; r.InRangeTextPct != 100 {
+		t.Errorf("merging under --min-chunk 500: %+v", r)
+	}
+	if rep.Recommended.tuneSetting != merged.tuneSetting {
+		t.Errorf("tune recommended %s", rep.Recommended.flags())
+	}
+
+	out, err = tune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	if len(lines) != 14 || !strings.HasPrefix(lines[0], "  min   max merge    chunks  retained  median  in range  its text") ||
+		!strings.HasSuffix(lines[7], "  *") || strings.Count(out, "*") != 1 ||
+		lines[13] != "3 books; chunk --min-chunk 200 --merge-short keeps 100.0% of their text in chunks of 400-1200 bytes" {
+		t.Errorf("tune printed\n%s", out)
+	}
+	if n := names(t, db, "SELECT count(*) FROM chunks"); n != "0\n" {
+		t.Errorf("tune wrote %s chunks", n)
+	}
+
+	// chunk gives what tune counted
+	if _, err = captureStdout(t, func() error { return chunkCmd([]string{"--min-chunk", "200", "--merge-short"}) }); err != nil {
+		t.Fatal(err)
+	}
+	if n := names(t, db, "SELECT count(*) FROM chunks"); n != fmt.Sprintf("%d\n", merged.Chunks) {
+		t.Errorf("chunk --min-chunk 200 --merge-short wrote %s chunks, tune counted %d", n, merged.Chunks)
+	}
+
+	for _, args := range [][]string{
+		{"--target", "1200-400"}, {"--target", "big"}, {"--min-sizes", "0"}, {"--max-sizes", "-1"},
+		{"--min-sizes", "500", "--max-sizes", "300"}, {"--sample", "0"}, {"extra"},
+	} {
+		if _, err = tune(args...); exitCode(err) != exitUsage {
+			t.Errorf("tune %s: %v, want a usage error", strings.Join(args, " "), err)
+		}
+	}
+	if _, err = captureStdout(t, func() error { return tuneCmd(nil) }); exitCode(err) != exitUsage {
+		t.Errorf("tune without --target: %v, want a usage error", err)
+	}
+}
@@ -0,0 +1,251 @@
+package cli
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"html/template"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serve --ui adds a few plain html pages over the same reads as the json
+// api, for people rather than programs: a random chunk at /, search at
+// /ui/search and a book's chunks a page at a time at /ui/books/{id}. The
+// templates are in ui/, built in. Chunk text is escaped like any other,
+// snippets marking their matches with <mark> and nothing else.
+
+//go:embed ui/*.html
+var uiFiles embed.FS
+
+// chunks on a page of /ui/books/{id}
+const uiBookPage = 50
+
+// what searchChunks is asked to wrap matches in, for snippet to turn into
+// <mark> once the rest is escaped; neither is in chunk text
+const (
+	uiMarkStart = "\x01"
+	uiMarkEnd   = "\x02"
+)
+
+var uiTemplates = parseUITemplates()
+
+func parseUITemplates() map[string]*template.Template {
+	funcs := template.FuncMap{"snippet": markSnippet, "keyed": keyed}
+	pages := map[string]*template.Template{}
+	for _, page := range []string{"home", "search", "book"} {
+		pages[page] = template.Must(template.New("base").Funcs(funcs).ParseFS(uiFiles, "ui/base.html", "ui/"+page+".html"))
+	}
+	return pages
+}
+
+// markSnippet escapes a snippet, marking its matches with <mark>.
+func markSnippet(s string) template.HTML {
+	s = template.HTMLEscapeString(s)
+	s = strings.ReplaceAll(s, uiMarkStart, "<mark>")
+	s = strings.ReplaceAll(s, uiMarkEnd, "</mark>")
+	return template.HTML(s)
+}
+
+// keyed is the query string carrying the api key from page to page, "" for
+// none.
+func keyed(key string) string {
+	if key == "" {
+		return ""
+	}
+	return "?" + url.Values{"key": {key}}.Encode()
+}
+
+// uiPage is what every page's template is given; each uses what it needs.
+type uiPage struct {
+	// the api key the page was asked for with, and what the search box
+	// holds
+	Key, Query string
+
+	// home: the chunk drawn and its book
+	Chunk *chunkrow
+	Book  int
+
+	// search: the page of results, the book of each result's chunk, and
+	// what was wrong with the query
+	Results searchPage
+	Books   map[int]int
+	Error   string
+
+	// book, with the books before and after it in its series
+	Chunks       bookChunks
+	Language     string
+	Ebook        int
+	Contributors []contributor
+	Series       []seriesPlace
+	Total        int
+	Page, Pages  int
+	Prev, Next   string
+}
+
+func (s *server) uiRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/", s.handleUIHome)
+	mux.Handle("/ui/search", requireKey(s.apiKey, http.HandlerFunc(s.handleUISearch)))
+	mux.Handle("/ui/books/", requireKey(s.apiKey, http.HandlerFunc(s.handleUIBook)))
+}
+
+func renderPage(w http.ResponseWriter, status int, page string, p uiPage) {
+	var b strings.Builder
+	if err := uiTemplates[page].ExecuteTemplate(&b, "base", p); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(b.String()))
+}
+
+// handleUIHome serves a random chunk, as /chunks/random does with no
+// filters.
+func (s *server) handleUIHome(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	p := uiPage{Key: r.URL.Query().Get("key")}
+	f, err := s.parseFilter(url.Values{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c, err := randomFromReservoir(s.db, s.reservoir, rand.New(rand.NewSource(time.Now().UnixNano())), f)
+	if err != nil && !errors.Is(err, errNoChunks) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err == nil {
+		p.Chunk = &c
+		if p.Book, err = bookOfChunk(s.db, c.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	renderPage(w, http.StatusOK, "home", p)
+}
+
+// handleUISearch serves the results of /search as a page.
+func (s *server) handleUISearch(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	p := uiPage{Key: q.Get("key"), Query: q.Get("q"), Books: map[int]int{}}
+	sq, err := s.parseSearch(q)
+	if err != nil {
+		p.Error = err.Error()
+		renderPage(w, http.StatusBadRequest, "search", p)
+		return
+	}
+	sq.markStart, sq.markEnd = uiMarkStart, uiMarkEnd
+	ok, err := hasFTS(s.db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		p.Error = "There is no full text index to search; it is built with gutchunk index."
+		renderPage(w, http.StatusServiceUnavailable, "search", p)
+		return
+	}
+	p.Results, err = searchChunks(s.db, sq)
+	if errors.Is(err, errBadQuery) {
+		p.Error = err.Error() + "; check quotes, parentheses and operators like AND, OR and NOT"
+		renderPage(w, http.StatusBadRequest, "search", p)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, res := range p.Results.Results {
+		if p.Books[res.ID], err = bookOfChunk(s.db, res.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	prev, next := pageLinks(r.URL, p.Results)
+	if prev != nil {
+		p.Prev = *prev
+	}
+	if next != nil {
+		p.Next = *next
+	}
+	renderPage(w, http.StatusOK, "search", p)
+}
+
+// handleUIBook serves a book's details and a page of its chunks, read as
+// /books/{id}/chunks reads them.
+func (s *server) handleUIBook(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/ui/books/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	p := uiPage{Key: q.Get("key"), Page: 1}
+	if v := q.Get("page"); v != "" {
+		if p.Page, err = strconv.Atoi(v); err != nil || p.Page < 1 {
+			http.Error(w, "bad page", http.StatusBadRequest)
+			return
+		}
+	}
+	p.Chunks, err = s.loadBookChunks(id, (p.Page-1)*uiBookPage, uiBookPage)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var ebook sql.NullInt64
+	var credits string
+	if err = s.db.QueryRow("SELECT coalesce(language, ''), ebook, "+contributorsJSON+" FROM files f WHERE id = ?", id).Scan(&p.Language, &ebook, &credits); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.Ebook = int(ebook.Int64)
+	if p.Contributors, err = parseContributors(credits); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if p.Series, err = bookSeries(s.db, p.Ebook); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if p.Total, err = countChunks(s.db, "%s WHERE sourceid = ?", id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.Pages = (p.Total + uiBookPage - 1) / uiBookPage
+	if p.Pages == 0 {
+		p.Pages = 1
+	}
+	link := func(page int) string {
+		v := url.Values{"page": {strconv.Itoa(page)}}
+		if p.Key != "" {
+			v.Set("key", p.Key)
+		}
+		return r.URL.Path + "?" + v.Encode()
+	}
+	if p.Page > 1 {
+		p.Prev = link(p.Page - 1)
+	}
+	if p.Page < p.Pages {
+		p.Next = link(p.Page + 1)
+	}
+	renderPage(w, http.StatusOK, "book", p)
+}
+
+// bookOfChunk is the file id of chunk id's book.
+func bookOfChunk(db *sql.DB, id int) (int, error) {
+	var book int
+	err := db.QueryRow("SELECT sourceid FROM chunks WHERE id = ?", id).Scan(&book)
+	return book, err
+}
@@ -0,0 +1,107 @@
+package cli
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMarkSnippet(t *testing.T) {
+	got := string(markSnippet("if a < b, " + uiMarkStart + "<script>" + uiMarkEnd + " & more"))
+	if want := "if a &lt; b, <mark>&lt;script&gt;</mark> &amp; more"; got != want {
+		t.Errorf("markSnippet gave %q, want %q", got, want)
+	}
+}
+
+func TestUIPages(t *testing.T) {
+	db := testDB(t)
+	id := addBook(t, db, "Algebra <b>Made</b> Easy", "Smith & Sons", "")
+	insertChunk(t, db, id, 0, "Let a < b, and <script>alert('x')</script> be a term.")
+	for i := 1; i <= uiBookPage; i++ {
+		insertChunk(t, db, id, i, fmt.Sprintf("Chunk %d of the algebra.", i))
+	}
+	s := testServer(t, db)
+	s.ui = true
+	h := s.routes()
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w
+	}
+	unescaped := []string{"<script>", "<b>Made", "Smith & Sons", `"><script`}
+
+	// a home page drawn until it shows the chunk with markup in it
+	var home string
+	for i := 0; i < 500 && !strings.Contains(home, "alert"); i++ {
+		w := get(`/?key=` + url.QueryEscape(`"><script>`))
+		if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+			t.Fatalf("GET /: %d %s", w.Code, w.Header().Get("Content-Type"))
+		}
+		home = w.Body.String()
+	}
+	for _, want := range []string{
+		"Let a &lt; b, and &lt;script&gt;alert(&#39;x&#39;)&lt;/script&gt; be a term.",
+		"Algebra &lt;b&gt;Made&lt;/b&gt; Easy",
+		"Smith &amp; Sons",
+		`value="&#34;&gt;&lt;script&gt;"`,
+		fmt.Sprintf(`href="/ui/books/%d?key=%%22%%3E%%3Cscript%%3E"`, id),
+	} {
+		if !strings.Contains(home, want) {
+			t.Errorf("the home page has no %s in\n%s", want, home)
+		}
+	}
+	for _, bad := range unescaped {
+		if strings.Contains(home, bad) {
+			t.Errorf("the home page has %s unescaped", bad)
+		}
+	}
+
+	book := get(fmt.Sprintf("/ui/books/%d", id))
+	page := book.Body.String()
+	if book.Code != http.StatusOK || !strings.Contains(page, "&lt;script&gt;alert") || !strings.Contains(page, "page 1 of 2") ||
+		!strings.Contains(page, fmt.Sprintf(`href="/ui/books/%d?page=2"`, id)) || strings.Contains(page, "Chunk 50 ") {
+		t.Errorf("the book's first page: %d\n%s", book.Code, page)
+	}
+	for _, bad := range unescaped {
+		if strings.Contains(page, bad) {
+			t.Errorf("the book's page has %s unescaped", bad)
+		}
+	}
+	if page = get(fmt.Sprintf("/ui/books/%d?page=2", id)).Body.String(); !strings.Contains(page, "Chunk 50 of the algebra.") || strings.Contains(page, "alert") {
+		t.Errorf("the book's second page:\n%s", page)
+	}
+	for target, want := range map[string]int{
+		fmt.Sprintf("/ui/books/%d?page=0", id): http.StatusBadRequest,
+		"/ui/books/999":                        http.StatusNotFound,
+		"/ui/books/algebra":                    http.StatusNotFound,
+		"/nowhere":                             http.StatusNotFound,
+	} {
+		if w := get(target); w.Code != want {
+			t.Errorf("GET %s: %d, want %d", target, w.Code, want)
+		}
+	}
+
+	t.Run("search", func(t *testing.T) {
+		if w := get("/ui/search?q=script"); w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "gutchunk index") {
+			t.Errorf("searching without an index: %d", w.Code)
+		}
+		indexChunks(t, db)
+		w := get("/ui/search?q=script")
+		results := w.Body.String()
+		if w.Code != http.StatusOK || !strings.Contains(results, "<mark>script</mark>") || strings.Contains(results, "<script>") ||
+			!strings.Contains(results, fmt.Sprintf("/ui/books/%d", id)) {
+			t.Errorf("searching for script: %d\n%s", w.Code, results)
+		}
+		if w = get(`/ui/search?q=` + url.QueryEscape(`"unbalanced`)); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "unbalanced quotes") {
+			t.Errorf("a bad query: %d\n%s", w.Code, w.Body)
+		}
+	})
+
+	// the json api is as it was
+	if w := get("/chunks/random"); w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		t.Errorf("GET /chunks/random with the ui: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+}
@@ -0,0 +1,85 @@
+package cli
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseSize parses byte counts like "200k", "512MB" or "2g".
+func parseSize(s string) (int64, error) {
+	t := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "b")
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(t, "k"):
+		mult = 1 << 10
+	case strings.HasSuffix(t, "m"):
+		mult = 1 << 20
+	case strings.HasSuffix(t, "g"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		t = t[:len(t)-1]
+	}
+	n, err := strconv.ParseFloat(t, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+// parseWindow parses lengths of time like "30d", "2w" or "12h", and
+// anything else time.ParseDuration takes.
+func parseWindow(s string) (time.Duration, error) {
+	t := strings.ToLower(strings.TrimSpace(s))
+	unit := time.Duration(0)
+	switch {
+	case strings.HasSuffix(t, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(t, "w"):
+		unit = 7 * 24 * time.Hour
+	}
+	if unit == 0 {
+		d, err := time.ParseDuration(t)
+		if err != nil || d < 0 {
+			return 0, fmt.Errorf("invalid length of time %q; want one like 30d, 2w or 12h", s)
+		}
+		return d, nil
+	}
+	n, err := strconv.ParseFloat(t[:len(t)-1], 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid length of time %q; want one like 30d, 2w or 12h", s)
+	}
+	return time.Duration(n * float64(unit)), nil
+}
+
+func formatWindow(d time.Duration) string {
+	if d > 0 && d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	}
+	return d.String()
+}
+
+// windowFlag is a flag taking what parseWindow does.
+type windowFlag time.Duration
+
+func (w *windowFlag) String() string { return formatWindow(time.Duration(*w)) }
+
+func (w *windowFlag) Set(s string) error {
+	d, err := parseWindow(s)
+	*w = windowFlag(d)
+	return err
+}
@@ -0,0 +1,337 @@
+package cli
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// verify-content checks the books stored against the mirror they came
+// from, changing nothing: each files row's content against its
+// content_hash, and the archive it was ingested from read again, as
+// ingest reads one, against both. What it finds of a book is one of
+// verifyStatuses. A stored text no longer hashing to its content_hash is
+// corrupt whatever the mirror holds; a mirror whose text differs from an
+// intact stored one has changed since, a newer edition replacing the
+// archive included, which isn't corruption but a re-ingest's business. A
+// book whose content is in the blob store (see blobs.go) is checked by its
+// blob, and one whose blob is gone is blob_missing.
+
+const (
+	verifyOK         = "ok"
+	verifyCorrupt    = "corrupt"
+	verifyChanged    = "source_changed"
+	verifyMissing    = "missing"
+	verifyUnreadable = "unreadable"
+	verifyNoBlob     = "blob_missing"
+	// downloaded with ingest --from-url, with no copy here to read
+	verifyUnchecked = "unchecked"
+)
+
+var verifyStatuses = []string{verifyOK, verifyCorrupt, verifyChanged, verifyMissing, verifyUnreadable, verifyNoBlob, verifyUnchecked}
+
+type bookCheck struct {
+	ID      int    `json:"id"`
+	Archive string `json:"archive"`
+	Status  string `json:"status"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+type verifyReport struct {
+	Books  int            `json:"books"`
+	Counts map[string]int `json:"counts"`
+	// every book not ok or unchecked, by id
+	Problems []bookCheck `json:"problems"`
+}
+
+// storedBook is what verify-content reads of a files row.
+type storedBook struct {
+	id                    int
+	archive, member, hash string
+	// the root of its source, which its archive is named under
+	root    string
+	content sql.NullString
+	// the blob holding its content instead, or ""
+	blob string
+}
+
+func verifyContentCmd(args []string) error {
+	fs := flag.NewFlagSet("verify-content", flag.ExitOnError)
+	sample := fs.Int("sample", 0, "check this many books picked at random, 0 for all")
+	workers := fs.Int("workers", 4, "archives read at once")
+	asJSON := fs.Bool("json", false, "print the report as json")
+	fs.Parse(args)
+	if *sample < 0 {
+		return usagef("--sample must be positive, or 0 for every book")
+	}
+	if *workers < 1 {
+		return usagef("--workers must be at least 1")
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rep, err := verifyContent(db, *sample, *workers)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		if err = json.NewEncoder(os.Stdout).Encode(rep); err != nil {
+			return err
+		}
+	} else {
+		printVerify(rep)
+	}
+	if len(rep.Problems) > 0 {
+		return exitStatus(1)
+	}
+	return nil
+}
+
+func verifyContent(db *sql.DB, sample, workers int) (verifyReport, error) {
+	rep := verifyReport{Counts: map[string]int{}, Problems: []bookCheck{}}
+	q := `SELECT f.id, coalesce(f.archive, ''), coalesce(f.archive_path, ''), coalesce(f.content_hash, ''), coalesce(s.root, ''), f.content, coalesce(f.content_blob, '')
+		FROM files f LEFT JOIN sources s ON s.id = f.source_id
+		WHERE f.deleted_at IS NULL AND f.superseded_by IS NULL`
+	var qargs []interface{}
+	if sample > 0 {
+		q += " ORDER BY random() LIMIT ?"
+		qargs = append(qargs, sample)
+	}
+	var total int
+	if err := db.QueryRow("SELECT count(*) FROM ("+q+")", qargs...).Scan(&total); err != nil {
+		return rep, err
+	}
+	rows, err := db.Query(q, qargs...)
+	if err != nil {
+		return rep, err
+	}
+	defer rows.Close()
+
+	books := make(chan storedBook)
+	checks := make(chan bookCheck)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range books {
+				checks <- checkBook(b)
+			}
+		}()
+	}
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for c := range checks {
+			rep.Books++
+			rep.Counts[c.Status]++
+			if c.Status != verifyOK && c.Status != verifyUnchecked {
+				rep.Problems = append(rep.Problems, c)
+			}
+			fmt.Fprintf(os.Stderr, "%d of %d\r", rep.Books, total)
+		}
+	}()
+
+	for rows.Next() {
+		var b storedBook
+		if err = rows.Scan(&b.id, &b.archive, &b.member, &b.hash, &b.root, &b.content, &b.blob); err != nil {
+			break
+		}
+		books <- b
+	}
+	close(books)
+	wg.Wait()
+	close(checks)
+	<-collected
+	if total > 0 {
+		fmt.Fprintln(os.Stderr)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	sort.Slice(rep.Problems, func(i, j int) bool { return rep.Problems[i].ID < rep.Problems[j].ID })
+	return rep, err
+}
+
+// checkBook compares b with the archive it was ingested from.
+func checkBook(b storedBook) bookCheck {
+	c := bookCheck{ID: b.id, Archive: b.archive}
+	want := b.hash
+	if !b.content.Valid && b.blob != "" {
+		store := contentBlobs()
+		if store == nil {
+			c.Status, c.Detail = verifyNoBlob, "its content is in blob "+short(b.blob)+", but the database records no blob store"
+			return c
+		}
+		data, err := store.get(b.blob)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			c.Status, c.Detail = verifyNoBlob, "blob "+short(b.blob)+" is missing from the blob store"
+			return c
+		case errors.Is(err, errBlobCorrupt):
+			c.Status, c.Detail = verifyCorrupt, err.Error()
+			return c
+		case err != nil:
+			c.Status, c.Detail = verifyUnreadable, err.Error()
+			return c
+		}
+		b.content = sql.NullString{String: string(data), Valid: true}
+	}
+	if b.content.Valid {
+		got := textHash(b.content.String)
+		if want != "" && got != want {
+			c.Status, c.Detail = verifyCorrupt, fmt.Sprintf("the stored content hashes to %s, not its content_hash %s", short(got), short(want))
+			return c
+		}
+		// books ingested before content_hash was kept go by their content
+		want = got
+	}
+	if want == "" {
+		c.Status, c.Detail = verifyUnchecked, "stored with neither content nor a content_hash"
+		return c
+	}
+	switch {
+	case b.archive == "":
+		c.Status, c.Detail = verifyMissing, "ingested before the archive was recorded"
+		return c
+	case strings.Contains(b.archive, "://"):
+		c.Status, c.Detail = verifyUnchecked, "downloaded with ingest --from-url"
+		return c
+	}
+
+	file := archiveFile(b.root, b.archive)
+	// ingest would take the newer edition now, whatever this one holds
+	if newer := newerEdition(file); newer != "" {
+		c.Status, c.Detail = verifyChanged, filepath.Base(newer)+" supersedes the archive"
+		return c
+	}
+	if _, err := os.Stat(file); errors.Is(err, fs.ErrNotExist) {
+		c.Status, c.Detail = verifyMissing, "the archive is gone"
+		return c
+	} else if err != nil {
+		c.Status, c.Detail = verifyUnreadable, err.Error()
+		return c
+	}
+	text, err := readStoredMember(file, b.member)
+	if err != nil {
+		c.Status, c.Detail = verifyUnreadable, err.Error()
+		return c
+	}
+	if got := textHash(text); got != want {
+		c.Status, c.Detail = verifyChanged, fmt.Sprintf("%s now hashes to %s, not %s", b.member, short(got), short(want))
+		return c
+	}
+	c.Status = verifyOK
+	return c
+}
+
+// verifyOptions read a member as ingest does, but without the limits and
+// stub checks, which look for books to take rather than at one taken.
+var verifyOptions = ingestOptions{maxFileSize: -1, minBodySize: -1, stubPhrases: &blocklist{}}
+
+// readStoredMember reads the text of member, its path within the archive
+// at file, as ingest would have read it; a cache layout text is its own
+// member, and a #N after the path is the member's Nth text.
+func readStoredMember(file, member string) (string, error) {
+	var sw stopwatch
+	member, part := memberPart(member)
+	if isCacheText(file) {
+		ms, err := readText(file, file, verifyOptions, &sw)
+		if err != nil {
+			return "", err
+		}
+		return memberText(ms[0], part)
+	}
+	r, err := zip.OpenReader(file)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		if f.Name != member {
+			continue
+		}
+		m, err := readMember(f.Name, f.UncompressedSize64, f.Open, file, verifyOptions, &sw)
+		if err != nil {
+			return "", err
+		}
+		return memberText(m, part)
+	}
+	return "", fmt.Errorf("the archive has no member %s", member)
+}
+
+func memberText(m zipMember, part int) (string, error) {
+	if m.reason != "" {
+		return "", fmt.Errorf("%s reads as %s: %s", m.name, m.reason, m.detail)
+	}
+	if part > 1 {
+		if part-2 >= len(m.more) {
+			return "", fmt.Errorf("%s no longer holds %d texts", m.name, part)
+		}
+		return m.more[part-2].text.String(), nil
+	}
+	return m.text.String(), nil
+}
+
+// newerEdition is what supersedes archive, there or gone, as ingest's
+// editionFilter has it: the newest edition of the same etext next to it,
+// or the utf8 text beside a cache layout pgN.txt; "" for nothing.
+func newerEdition(archive string) string {
+	an := parseArchiveName(archive)
+	if an.layout == layoutCache && !strings.HasSuffix(strings.ToLower(archive), ".utf8") {
+		if _, err := os.Stat(archive + ".utf8"); err == nil {
+			return archive + ".utf8"
+		}
+		return ""
+	}
+	if an.layout != layoutEtext {
+		return ""
+	}
+	dir := filepath.Dir(archive)
+	entries, _ := os.ReadDir(dir)
+	newest, edition := "", an.edition
+	for _, e := range entries {
+		name := filepath.Join(dir, e.Name())
+		if o := parseArchiveName(name); o.layout == layoutEtext && o.code == an.code && o.edition > edition {
+			newest, edition = name, o.edition
+		}
+	}
+	return newest
+}
+
+// short is a hash cut to enough of it to tell two apart.
+func short(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+	return hash
+}
+
+func printVerify(rep verifyReport) {
+	for _, c := range rep.Problems {
+		fmt.Printf("book %d (%s): %s, %s\n", c.ID, c.Archive, c.Status, c.Detail)
+	}
+	parts := []string{}
+	for _, s := range verifyStatuses {
+		if n := rep.Counts[s]; n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", n, strings.ReplaceAll(s, "_", " ")))
+		}
+	}
+	if len(parts) == 0 {
+		parts = append(parts, "none")
+	}
+	fmt.Printf("checked %d books: %s\n", rep.Books, strings.Join(parts, ", "))
+}
@@ -0,0 +1,93 @@
+package cli
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyContent(t *testing.T) {
+	root := t.TempDir()
+	archives := []string{"1/11.zip", "2/22.zip", "3/33.zip", "4/44.zip", "5/55.zip", "etext98/dracu10.zip"}
+	for _, a := range archives {
+		stem := strings.TrimSuffix(filepath.Base(a), ".zip")
+		writeTestZip(t, filepath.Join(root, filepath.FromSlash(a)), zipEntry{stem + ".txt", testBook("Book "+stem, testParagraphs(2))})
+	}
+	db := testDB(t)
+	if _, err := captureStdout(t, func() error { return ingestCmd([]string{"--target", root}) }); err != nil {
+		t.Fatal(err)
+	}
+	verify := func(args ...string) (string, error) {
+		t.Helper()
+		var out string
+		_, err := captureStderr(t, func() error {
+			var err error
+			out, err = captureStdout(t, func() error { return verifyContentCmd(args) })
+			return err
+		})
+		return out, err
+	}
+	if out, err := verify(); err != nil || out != "checked 6 books: 6 ok\n" {
+		t.Fatalf("verify-content of an intact mirror: %v, printing\n%s", err, out)
+	}
+
+	// one stored row corrupted, and the mirror changed under the others
+	if _, err := db.Exec("UPDATE files SET content = replace(content, 'moors', 'moons') WHERE archive = '2/22.zip'"); err != nil {
+		t.Fatal(err)
+	}
+	writeTestZip(t, filepath.Join(root, "3", "33.zip"), zipEntry{"33.txt", testBook("Book 33", testParagraphs(3))})
+	if err := os.Remove(filepath.Join(root, "4", "44.zip")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "5", "55.zip"), []byte("not a zip at all"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	writeTestZip(t, filepath.Join(root, "etext98", "dracu11.zip"), zipEntry{"dracu11.txt", testBook("Book dracu11", testParagraphs(2))})
+	before := names(t, db, "SELECT id || ' ' || content_hash || ' ' || length(content) FROM files ORDER BY id")
+
+	out, err := verify()
+	if exitCode(err) != 1 {
+		t.Errorf("verify-content with problems: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	for i, want := range []string{
+		"book 2 (2/22.zip): corrupt, the stored content hashes to ",
+		"book 3 (3/33.zip): source_changed, 33.txt now hashes to ",
+		"book 4 (4/44.zip): missing, the archive is gone",
+		"book 5 (5/55.zip): unreadable, zip: not a valid zip file",
+		"book 6 (etext98/dracu10.zip): source_changed, dracu11.zip supersedes the archive",
+		"checked 6 books: 1 ok, 1 corrupt, 2 source changed, 1 missing, 1 unreadable",
+	} {
+		if i >= len(lines) || !strings.HasPrefix(lines[i], want) {
+			t.Errorf("verify-content printed\n%s\nwant line %d to be %q", out, i+1, want)
+			break
+		}
+	}
+	if got := names(t, db, "SELECT id || ' ' || content_hash || ' ' || length(content) FROM files ORDER BY id"); got != before {
+		t.Errorf("verify-content changed the books:\n%s", lineDiff(before, got))
+	}
+
+	// a corrupt row is corrupt whatever the mirror holds
+	writeTestZip(t, filepath.Join(root, "2", "22.zip"), zipEntry{"22.txt", "something else"})
+	if out, _ = verify("--json", "--workers", "1"); !json.Valid([]byte(out)) {
+		t.Fatalf("verify-content --json printed\n%s", out)
+	}
+	var rep verifyReport
+	if err = json.Unmarshal([]byte(out), &rep); err != nil {
+		t.Fatal(err)
+	}
+	if rep.Books != 6 || len(rep.Problems) != 5 || rep.Problems[0].ID != 2 || rep.Problems[0].Status != verifyCorrupt || rep.Counts[verifyChanged] != 2 {
+		t.Errorf("verify-content --json reported %+v", rep)
+	}
+
+	if out, _ = verify("--sample", "2", "--json"); json.Unmarshal([]byte(out), &rep) != nil || rep.Books != 2 {
+		t.Errorf("verify-content --sample 2 checked %d books", rep.Books)
+	}
+	for _, args := range [][]string{{"--sample", "-1"}, {"--workers", "0"}} {
+		if _, err = verify(args...); exitCode(err) != exitUsage {
+			t.Errorf("verify-content %s: %v, want a usage error", strings.Join(args, " "), err)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package cli
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Gutenberg re-releases an etext with corrections under a new edition of
+// its archive. Ingesting it adds a new version of the book rather than
+// replacing the old one, whose chunks others may have kept the ids of: the
+// old file is marked superseded_by the new one and keeps its chunks,
+// which still resolve by id but are drawn, searched and exported no more
+// (export and grep take --include-superseded for audits). A re-release
+// with the same text as the current version isn't ingested at all.
+// gutchunk versions lists a book's versions and prune-versions deletes the
+// superseded ones for good.
+
+// activeVersion is true of books no newer version replaces.
+const activeVersion = "f.superseded_by IS NULL"
+
+type priorVersion struct {
+	id, version int
+	hash        string
+	// the layout it was ingested from
+	layout string
+}
+
+// currentVersion is the current version of ebook, a zero priorVersion when
+// there is none. Books ingested before versions were, with no hash
+// kept, are hashed here.
+func currentVersion(tx *sql.Tx, ebook int) (priorVersion, error) {
+	var p priorVersion
+	var hash, content sql.NullString
+	err := tx.QueryRow(`SELECT id, coalesce(version, 1), content_hash, CASE WHEN content_hash IS NULL THEN content END, coalesce(layout, '')
+		FROM files WHERE ebook = ? AND deleted_at IS NULL AND superseded_by IS NULL ORDER BY id DESC LIMIT 1`, ebook).
+		Scan(&p.id, &p.version, &hash, &content, &p.layout)
+	if errors.Is(err, sql.ErrNoRows) {
+		return priorVersion{}, nil
+	}
+	if err != nil {
+		return p, err
+	}
+	p.hash = hash.String
+	if !hash.Valid {
+		p.hash = textHash(content.String)
+	}
+	return p, nil
+}
+
+func versionsCmd(args []string) error {
+	fs := flag.NewFlagSet("versions", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return usagef("usage: gutchunk versions EBOOK")
+	}
+	ebook, err := strconv.Atoi(fs.Arg(0))
+	if err != nil {
+		return usagef("bad ebook number %q", fs.Arg(0))
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT f.id, coalesce(f.version, 1), f.superseded_by, f.deleted_at IS NOT NULL,
+			coalesce(f.content_hash, ''), coalesce(j.completed_at, ''), coalesce(f.archive, '')
+		FROM files f LEFT JOIN ingest_journal j ON j.archive = f.archive
+			AND j.root = coalesce((SELECT root FROM sources WHERE id = f.source_id), j.root)
+		WHERE f.ebook = ? ORDER BY f.id`, ebook)
+	if err != nil {
+		return err
+	}
+	type version struct {
+		id, version             int
+		supersededBy            sql.NullInt64
+		deleted                 bool
+		hash, ingested, archive string
+	}
+	versions := []version{}
+	for rows.Next() {
+		var v version
+		if err = rows.Scan(&v.id, &v.version, &v.supersededBy, &v.deleted, &v.hash, &v.ingested, &v.archive); err != nil {
+			rows.Close()
+			return err
+		}
+		versions = append(versions, v)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		fmt.Fprintf(os.Stderr, "no books of ebook %d\n", ebook)
+		return exitStatus(1)
+	}
+
+	for _, v := range versions {
+		state := "current"
+		switch {
+		case v.deleted:
+			state = "removed"
+		case v.supersededBy.Valid:
+			state = fmt.Sprintf("superseded by %d", v.supersededBy.Int64)
+		}
+		chunks, err := countChunks(db, "%s WHERE sourceid = ?", v.id)
+		if err != nil {
+			return err
+		}
+		hash := v.hash
+		if hash == "" {
+			hash = "-"
+		} else if len(hash) > 12 {
+			hash = hash[:12]
+		}
+		ingested := v.ingested
+		if ingested == "" {
+			ingested = "-"
+		}
+		fmt.Printf("v%-3d %6d  %-19s  %s  %5d chunks  %s  %s\n", v.version, v.id, ingested, hash, chunks, state, v.archive)
+	}
+	return nil
+}
+
+func pruneVersionsCmd(args []string) error {
+	fs := flag.NewFlagSet("prune-versions", flag.ExitOnError)
+	ebook := fs.Int("ebook", 0, "only prune the versions of this ebook")
+	yes := fs.Bool("yes", false, "don't ask first")
+	fs.Parse(args)
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	books := "SELECT id FROM files WHERE superseded_by IS NOT NULL AND (? = 0 OR ebook = ?)"
+	var n int
+	if err = db.QueryRow("SELECT count(*) FROM ("+books+")", *ebook, *ebook).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		fmt.Println("no superseded versions to prune")
+		return nil
+	}
+	chunks, err := countChunks(db, "%s WHERE sourceid IN (SELECT id FROM files WHERE superseded_by IS NOT NULL AND (? = 0 OR ebook = ?))", *ebook, *ebook)
+	if err != nil {
+		return err
+	}
+	if !*yes {
+		fmt.Printf("delete %d superseded versions and their %d chunks for good? their chunk ids will stop resolving [y/N] ", n, chunks)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			return errors.New("not pruned")
+		}
+	}
+	if err = startRun(db, "prune-versions"); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec("DELETE FROM book_similarities WHERE a IN ("+books+") OR b IN ("+books+")", *ebook, *ebook, *ebook, *ebook); err != nil {
+		return err
+	}
+	if err = logChunks(tx, eventPruned, 0, books, *ebook, *ebook); err != nil {
+		return err
+	}
+	for _, q := range []string{
+		// flags keep their hashes, as for rm
+		"UPDATE chunk_flags SET chunk_id = NULL WHERE chunk_id IN (SELECT id FROM chunks WHERE sourceid IN (" + books + "))",
+		"DELETE FROM content_flags WHERE chunk_id IN (SELECT id FROM chunks WHERE sourceid IN (" + books + "))",
+		"DELETE FROM content_scans WHERE chunk_id IN (SELECT id FROM chunks WHERE sourceid IN (" + books + "))",
+		"DELETE FROM chunks WHERE sourceid IN (" + books + ")",
+		"DELETE FROM footnotes WHERE sourceid IN (" + books + ")",
+		"DELETE FROM strategy_chunks WHERE sourceid IN (" + books + ")",
+		"DELETE FROM stable_id_map WHERE sourceid IN (" + books + ")",
+		"DELETE FROM book_terms WHERE sourceid IN (" + books + ")",
+		"DELETE FROM book_meta WHERE file_id IN (" + books + ")",
+		"DELETE FROM works_in_file WHERE file_id IN (" + books + ")",
+		"DELETE FROM name_words WHERE file_id IN (" + books + ")",
+		"DELETE FROM sort_keys WHERE file_id IN (" + books + ")",
+		"DELETE FROM name_sources WHERE file_id IN (" + books + ")",
+		"DELETE FROM warnings WHERE file_id IN (" + books + ")",
+		"DELETE FROM files WHERE id IN (" + books + ")",
+	} {
+		if _, err = tx.Exec(q, *ebook, *ebook); err != nil {
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	fmt.Printf("pruned %d superseded versions and %d chunks\n", n, chunks)
+	return nil
+}
@@ -0,0 +1,143 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// pandp is a Pride and Prejudice, ebook 1342, ending with a paragraph
+// about its printing.
+func pandp(printing string) string {
+	return "Title: Pride and Prejudice\n\nAuthor: Jane Austen\n\nRelease Date: August 1998 [EBook #1342]\n\n" +
+		"*** START OF THIS PROJECT GUTENBERG EBOOK PRIDE AND PREJUDICE ***\n\n" + testParagraphs(2) + "\n\n" +
+		strings.Repeat("This is the "+printing+" printing of the book. ", 12) +
+		"\n\n*** END OF THIS PROJECT GUTENBERG EBOOK PRIDE AND PREJUDICE ***\n"
+}
+
+func TestReRelease(t *testing.T) {
+	db := testDB(t)
+	root := t.TempDir()
+	run := func(cmd func([]string) error, args ...string) string {
+		t.Helper()
+		out, err := captureStdout(t, func() error { return cmd(args) })
+		if err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+		return out
+	}
+	writeTestZip(t, filepath.Join(root, "etext98", "pandp10.zip"), zipEntry{"pandp10.txt", pandp("first")})
+	run(ingestCmd, "--target", root)
+	run(chunkCmd)
+	var old int
+	if err := db.QueryRow("SELECT id FROM files").Scan(&old); err != nil {
+		t.Fatal(err)
+	}
+	oldChunks := chunkIDs(t, db, old)
+
+	writeTestZip(t, filepath.Join(root, "etext98", "pandp11.zip"), zipEntry{"pandp11.txt", pandp("corrected")})
+	run(ingestCmd, "--target", root)
+	run(chunkCmd)
+	var current, version int
+	if err := db.QueryRow("SELECT id, version FROM files WHERE superseded_by IS NULL").Scan(&current, &version); err != nil {
+		t.Fatal(err)
+	}
+	var supersededBy int
+	if err := db.QueryRow("SELECT superseded_by FROM files WHERE id = ?", old).Scan(&supersededBy); err != nil || supersededBy != current || version != 2 {
+		t.Fatalf("book %d is superseded by %d (%v); the current version is %d, version %d", old, supersededBy, err, current, version)
+	}
+	if n := chunkCount(t, db, current); n != 3 {
+		t.Errorf("the new version has %d chunks, want 3", n)
+	}
+
+	// the old chunks resolve by id as they did: those the re-release left
+	// as they were are the new version's now (see rechunk.go), the one it
+	// corrected stays the old version's
+	if got, want := fmt.Sprint(chunkIDs(t, db, current)[:2]), fmt.Sprint(oldChunks[:2]); got != want {
+		t.Errorf("the new version's unchanged chunks are %s, want %s", got, want)
+	}
+	s := testServer(t, db)
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("GET", fmt.Sprintf("/books/%d/chunks", old), nil))
+	var page bookChunks
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatalf("GET /books/%d/chunks: %d %s", old, w.Code, w.Body)
+	}
+	if len(page.Chunks) != 1 || page.Chunks[0].ID != oldChunks[2] || !strings.Contains(page.Chunks[0].Text, "first printing") {
+		t.Errorf("the superseded version's chunks are %+v, want chunk %d", page.Chunks, oldChunks[2])
+	}
+
+	// while what is drawn, grepped and exported is of the new version
+	for i := 0; i < 30; i++ {
+		w = httptest.NewRecorder()
+		s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/chunks/random", nil))
+		if strings.Contains(w.Body.String(), "first printing") {
+			t.Fatalf("drew a chunk of the superseded version: %s", w.Body)
+		}
+	}
+	re := regexp.MustCompile(`the \w+ printing`)
+	for _, superseded := range []bool{false, true} {
+		var buf bytes.Buffer
+		if _, err := grepChunks(context.Background(), db, re, grepOptions{superseded: superseded}, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(buf.String(), "first") != superseded || !strings.Contains(buf.String(), "corrected") {
+			t.Errorf("grep with superseded %v found %q", superseded, buf.String())
+		}
+	}
+	if out := run(exportCmd); strings.Contains(out, "first printing") || !strings.Contains(out, "corrected printing") {
+		t.Errorf("export gave %q", out)
+	}
+	if out := run(exportCmd, "--include-superseded"); !strings.Contains(out, "first printing") {
+		t.Errorf("export --include-superseded gave %q", out)
+	}
+
+	// the same text again is no new version
+	writeTestZip(t, filepath.Join(root, "etext98", "pandp12.zip"), zipEntry{"pandp12.txt", pandp("corrected")})
+	run(ingestCmd, "--target", root)
+	var versions int
+	if err := db.QueryRow("SELECT count(*) FROM files").Scan(&versions); err != nil || versions != 2 {
+		t.Errorf("re-releasing the same text made %d versions", versions)
+	}
+
+	out := run(versionsCmd, "1342")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "v1 ") || !strings.Contains(lines[0], fmt.Sprintf("superseded by %d", current)) ||
+		!strings.HasPrefix(lines[1], "v2 ") || !strings.Contains(lines[1], "current") || !strings.Contains(lines[1], "3 chunks") {
+		t.Errorf("versions printed\n%s", out)
+	}
+
+	run(pruneVersionsCmd, "--yes")
+	if n := chunkCount(t, db, old); n != 0 {
+		t.Errorf("pruning left %d chunks of the superseded version", n)
+	}
+	if n := chunkCount(t, db, current); n != 3 {
+		t.Errorf("pruning left the current version %d chunks", n)
+	}
+}
+
+// chunkIDs is the ids of book id's chunks, in order.
+func chunkIDs(t *testing.T, db *sql.DB, id int) []int {
+	t.Helper()
+	rows, err := db.Query("SELECT id FROM chunks WHERE sourceid = ? ORDER BY ordinal", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var c int
+		if err = rows.Scan(&c); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, c)
+	}
+	return ids
+}
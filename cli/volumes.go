@@ -0,0 +1,240 @@
+package cli
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	volumeMarker = regexp.MustCompile(`(?i)[\s,;:.—–-]*\(?\b(?:vol(?:ume)?s?\.?|part|book|tome)\s+(?:the\s+)?([0-9]+|[ivxlc]+|[a-z]+)\b\.?\)?(?:\s*\(?of\s+(?:[0-9]+|[ivxlc]+|[a-z]+)\)?)?\s*$`)
+	titleJunk    = regexp.MustCompile(`[^\pL\pN]+`)
+
+	numberWords = map[string]int{}
+)
+
+func init() {
+	for i, w := range strings.Fields("one two three four five six seven eight nine ten eleven twelve") {
+		numberWords[w] = i + 1
+	}
+	for i, w := range strings.Fields("first second third fourth fifth sixth seventh eighth ninth tenth eleventh twelfth") {
+		numberWords[w] = i + 1
+	}
+}
+
+// normalizeTitle is the key titles are grouped and matched by: folded,
+// with punctuation dropped and whitespace collapsed.
+func normalizeTitle(title string) string {
+	return strings.TrimSpace(titleJunk.ReplaceAllString(fold(title), " "))
+}
+
+// splitVolume separates a trailing volume designator from a title:
+// "War and Peace, Volume 2" gives ("War and Peace", 2). Titles without one
+// come back with volume 0.
+func splitVolume(title string) (string, int) {
+	m := volumeMarker.FindStringSubmatchIndex(title)
+	if m == nil {
+		return title, 0
+	}
+	n := volumeNumber(strings.ToLower(title[m[2]:m[3]]))
+	if n == 0 {
+		return title, 0
+	}
+	base := strings.TrimSpace(title[:m[0]])
+	if base == "" {
+		return title, 0
+	}
+	return base, n
+}
+
+func volumeNumber(s string) int {
+	if n, err := strconv.Atoi(s); err == nil {
+		return n
+	}
+	if n, ok := numberWords[s]; ok {
+		return n
+	}
+	return romanValue(s)
+}
+
+// romanValue parses lowercase roman numerals, returning 0 for anything that
+// is not one.
+func romanValue(s string) int {
+	vals := map[byte]int{'i': 1, 'v': 5, 'x': 10, 'l': 50, 'c': 100}
+	n := 0
+	for i := 0; i < len(s); i++ {
+		v, ok := vals[s[i]]
+		if !ok {
+			return 0
+		}
+		if i+1 < len(s) && vals[s[i+1]] > v {
+			n -= v
+		} else {
+			n += v
+		}
+	}
+	if n == 0 || strings.ToLower(toRoman(n)) != s {
+		return 0
+	}
+	return n
+}
+
+func toRoman(n int) string {
+	syms := []struct {
+		v int
+		s string
+	}{{100, "C"}, {90, "XC"}, {50, "L"}, {40, "XL"}, {10, "X"}, {9, "IX"}, {5, "V"}, {4, "IV"}, {1, "I"}}
+	out := ""
+	for _, sym := range syms {
+		for n >= sym.v {
+			out += sym.s
+			n -= sym.v
+		}
+	}
+	return out
+}
+
+type volume struct {
+	fileID int
+	title  string
+	number int
+}
+
+type volumeGroup struct {
+	title, author string
+	volumes       []volume
+}
+
+// proposeVolumeGroups groups files whose titles differ only by a volume
+// designator and whose authors match. It would rather miss a group than
+// merge two works: a group needs two or more volumes, and two files
+// claiming the same volume number spoil the whole group.
+func proposeVolumeGroups(db *sql.DB) ([]volumeGroup, error) {
+	rows, err := db.Query("SELECT id, coalesce(name, ''), coalesce(author_norm, '') FROM files WHERE deleted_at IS NULL ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byKey := map[string]*volumeGroup{}
+	for rows.Next() {
+		var id int
+		var title, author string
+		if err = rows.Scan(&id, &title, &author); err != nil {
+			return nil, err
+		}
+		base, n := splitVolume(title)
+		if n == 0 || author == "" {
+			continue
+		}
+		key := normalizeTitle(base) + "\x00" + author
+		g, ok := byKey[key]
+		if !ok {
+			g = &volumeGroup{title: base, author: author}
+			byKey[key] = g
+		}
+		g.volumes = append(g.volumes, volume{id, title, n})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	groups := []volumeGroup{}
+	for _, g := range byKey {
+		if len(g.volumes) < 2 {
+			continue
+		}
+		seen := map[int]bool{}
+		dup := false
+		for _, v := range g.volumes {
+			dup = dup || seen[v.number]
+			seen[v.number] = true
+		}
+		if dup {
+			continue
+		}
+		sort.Slice(g.volumes, func(i, j int) bool { return g.volumes[i].number < g.volumes[j].number })
+		groups = append(groups, *g)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].volumes[0].fileID < groups[j].volumes[0].fileID })
+
+	return groups, nil
+}
+
+func groupVolumesCmd(args []string) error {
+	fs := flag.NewFlagSet("group-volumes", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "print proposed groups without writing them")
+	fs.Parse(args)
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	groups, err := proposeVolumeGroups(db)
+	if err != nil {
+		return err
+	}
+
+	for _, g := range groups {
+		fmt.Printf("%s (%s)\n", g.title, g.author)
+		for _, v := range g.volumes {
+			fmt.Printf("  %3d  file %d  %s\n", v.number, v.fileID, v.title)
+		}
+	}
+	if *dryRun {
+		fmt.Printf("%d groups proposed\n", len(groups))
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, g := range groups {
+		if err = writeVolumeGroup(tx, g); err != nil {
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	fmt.Printf("%d works written\n", len(groups))
+
+	return nil
+}
+
+// writeVolumeGroup makes g's volumes the volumes of one work.
+func writeVolumeGroup(tx *sql.Tx, g volumeGroup) error {
+	// reuse the work id a previous run gave any of these volumes
+	var work sql.NullInt64
+	for _, v := range g.volumes {
+		if err := tx.QueryRow("SELECT work_id FROM files WHERE id = ?", v.fileID).Scan(&work); err != nil {
+			return err
+		}
+		if work.Valid {
+			break
+		}
+	}
+	if !work.Valid {
+		res, err := tx.Exec("INSERT INTO works (title, author) VALUES (?, ?)", g.title, g.author)
+		if err != nil {
+			return err
+		}
+		if work.Int64, err = res.LastInsertId(); err != nil {
+			return err
+		}
+	}
+	for _, v := range g.volumes {
+		if _, err := tx.Exec("UPDATE files SET work_id = ?, volume = ? WHERE id = ?", work.Int64, v.number, v.fileID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
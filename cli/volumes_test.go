@@ -0,0 +1,107 @@
+package cli
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestSplitVolume(t *testing.T) {
+	for _, c := range []struct {
+		title, base string
+		n           int
+	}{
+		{"War and Peace, Volume 2", "War and Peace", 2},
+		{"The History of Rome, Vol. IV", "The History of Rome", 4},
+		{"The Decline and Fall of the Roman Empire, Volume XII", "The Decline and Fall of the Roman Empire", 12},
+		{"Clarissa Harlowe, Volume Three", "Clarissa Harlowe", 3},
+		{"Don Quixote, Part the First", "Don Quixote", 1},
+		{"Les Misérables — Tome II", "Les Misérables", 2},
+		{"Memoirs of the Court (Volume 1 of 3)", "Memoirs of the Court", 1},
+		{"Middlemarch: Book 8.", "Middlemarch", 8},
+
+		// near misses: no volume, or a word that only looks like one
+		{"The Book of Tea", "The Book of Tea", 0},
+		{"Henry V", "Henry V", 0},
+		{"A Journey in Part", "A Journey in Part", 0},
+		{"The Story Told, Part Time", "The Story Told, Part Time", 0},
+		{"Volume One", "Volume One", 0},
+		{"Notes, Vol. IIII", "Notes, Vol. IIII", 0},
+	} {
+		base, n := splitVolume(c.title)
+		if base != c.base || n != c.n {
+			t.Errorf("splitVolume(%q) = %q, %d, want %q, %d", c.title, base, n, c.base, c.n)
+		}
+	}
+}
+
+func TestProposeVolumeGroups(t *testing.T) {
+	db := testDB(t)
+	book := func(title, author string) int {
+		return addBook(t, db, title, author, testBook(title, testParagraphs(2)))
+	}
+	war3 := book("War and Peace, Volume III", "Leo Tolstoy")
+	war1 := book("War and Peace, Volume 1", "Leo Tolstoy")
+	war2 := book("War and Peace, Volume Two", "Leo Tolstoy")
+	// the same title by another author is another work
+	book("Bleak House, Volume 1", "Charles Dickens")
+	book("Bleak House, Volume 2", "Someone Else")
+	// two claiming one volume spoil their group
+	book("Clarissa, Volume 1", "Samuel Richardson")
+	book("Clarissa, Volume I", "Samuel Richardson")
+	book("Clarissa, Volume 2", "Samuel Richardson")
+	// a lone volume is no group
+	book("Emma, Volume 1", "Jane Austen")
+
+	groups, err := proposeVolumeGroups(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 {
+		t.Fatalf("proposed %+v, want only War and Peace", groups)
+	}
+	var ids []int
+	for _, v := range groups[0].volumes {
+		ids = append(ids, v.fileID)
+	}
+	if groups[0].title != "War and Peace" || !reflect.DeepEqual(ids, []int{war1, war2, war3}) {
+		t.Errorf("proposed %q of %v, want War and Peace of %v", groups[0].title, ids, []int{war1, war2, war3})
+	}
+
+	// writing it twice keeps one work
+	for i := 0; i < 2; i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = writeVolumeGroup(tx, groups[0]); err != nil {
+			t.Fatal(err)
+		}
+		if err = tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var works, work int
+	if err := db.QueryRow("SELECT count(*), max(id) FROM works").Scan(&works, &work); err != nil {
+		t.Fatal(err)
+	}
+	if works != 1 {
+		t.Errorf("%d works written, want 1", works)
+	}
+
+	if err := makeChunks(db, chunkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	r := rand.New(rand.NewSource(1))
+	seen := map[string]bool{}
+	for i := 0; i < 50; i++ {
+		c, err := workChunk(db, r, work, drawable(false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[c.Title] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("random --work drew from %v, want the three volumes", seen)
+	}
+}
@@ -0,0 +1,361 @@
+package cli
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"git.tilde.town/gutchunker/gutchunk"
+)
+
+// Everything ingest, chunk and the metadata parsers find wrong with a book
+// and go on past is kept in the warnings table, by scope, severity and a
+// code saying what kind of thing it is, with the run that found it: a panic
+// chunking a book and its stack, a member skipped for being binary, a book
+// with no START marker or no title. gutchunk warnings lists and counts them,
+// and --ack marks those listed as reviewed so later listings leave them
+// out.
+
+// scopes of warnings: the stage that found them
+const (
+	scopeIngest   = "ingest"
+	scopeChunk    = "chunk"
+	scopeMetadata = "metadata"
+)
+
+const (
+	sevInfo  = "info"
+	sevWarn  = "warn"
+	sevError = "error"
+)
+
+// severities of warnings, least first
+var severities = []string{sevInfo, sevWarn, sevError}
+
+// codes of the warnings chunking leaves besides those of chunkwarn.go
+const (
+	warnNoStart       = gutchunk.WarnNoStart
+	warnRepeatedStart = gutchunk.WarnRepeatedStart
+	warnNoChunks      = gutchunk.WarnNoChunks
+)
+
+// currentRun is the runs row of this invocation, 0 before startRun.
+var currentRun int64
+
+// startRun records that command is running, for the warnings it leaves.
+func startRun(db *sql.DB, command string) error {
+	res, err := db.Exec("INSERT INTO runs (command, started_at) VALUES (?, datetime('now'))", command)
+	if err != nil {
+		return err
+	}
+	currentRun, err = res.LastInsertId()
+	return err
+}
+
+// warnAt is what a warning is about: a book, or for what was never
+// ingested as one, an archive and a member of it.
+type warnAt struct {
+	scope        string
+	fileID       int64
+	path, member string
+}
+
+// warnf adds a warning with the message format gives.
+func warnf(q execer, at warnAt, severity, code, format string, args ...interface{}) error {
+	return addWarning(q, at, severity, code, fmt.Sprintf(format, args...), "")
+}
+
+// addWarning adds a warning with detail, a panic's stack say, kept with it
+// and not listed.
+func addWarning(q execer, at warnAt, severity, code, message, detail string) error {
+	_, err := q.Exec(`INSERT INTO warnings (scope, severity, code, file_id, path, member, message, detail, run_id, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, datetime('now'))`,
+		at.scope, severity, code, nullInt64(at.fileID), nullString(at.path), nullString(at.member), message, nullString(detail), nullInt64(currentRun))
+	return err
+}
+
+func nullInt64(n int64) interface{} {
+	if n == 0 {
+		return nil
+	}
+	return n
+}
+
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// markerWarnings warns of a book chunked without a START marker, or with
+// more than one, or into no chunks at all, in place of what chunking it
+// last left (see gutchunk.Found.Warnings).
+func markerWarnings(tx *sql.Tx, id int, m gutchunk.Found, chunks int) error {
+	if _, err := tx.Exec("DELETE FROM warnings WHERE scope = ? AND file_id = ? AND code IN (?, ?, ?)", scopeChunk, id, warnNoStart, warnRepeatedStart, warnNoChunks); err != nil {
+		return err
+	}
+	at := warnAt{scope: scopeChunk, fileID: int64(id)}
+	for _, w := range m.Warnings(chunks) {
+		if err := addWarning(tx, at, sevWarn, w.Code, w.Message, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// metadataSeverity is how bad each metadata_status but ok is
+var metadataSeverity = map[string]string{
+	metadataNoTitle:  sevWarn,
+	metadataNoHeader: sevWarn,
+	metadataNoAuthor: sevInfo,
+}
+
+var metadataMessages = map[string]string{
+	metadataNoTitle:  "no title found",
+	metadataNoHeader: "no header found",
+	metadataNoAuthor: "no author found",
+}
+
+// setMetadataStatus sets book id's metadata_status, and the warning it
+// gives in place of any it had.
+func setMetadataStatus(tx *sql.Tx, id int64, status string) error {
+	if _, err := tx.Exec("UPDATE files SET metadata_status = ? WHERE id = ?", status, id); err != nil {
+		return err
+	}
+	return metadataWarning(tx, id, status)
+}
+
+func metadataWarning(tx *sql.Tx, id int64, status string) error {
+	if _, err := tx.Exec("DELETE FROM warnings WHERE scope = ? AND file_id = ?", scopeMetadata, id); err != nil {
+		return err
+	}
+	sev, ok := metadataSeverity[status]
+	if !ok {
+		return nil
+	}
+	return addWarning(tx, warnAt{scope: scopeMetadata, fileID: id}, sev, status, metadataMessages[status], "")
+}
+
+// moveWarnings moves chunk_warnings and skipped_members, where warnings
+// were kept before schema version 2, into warnings, and adds those the
+// metadata status of each book gives.
+func moveWarnings(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, m := range []struct{ table, copy string }{
+		{"chunk_warnings", `INSERT INTO warnings (scope, severity, code, file_id, message, detail, created_at)
+			SELECT 'chunk', CASE kind WHEN 'panic' THEN 'error' ELSE 'warn' END, kind, sourceid, message, stack, created_at
+			FROM chunk_warnings ORDER BY id`},
+		{"skipped_members", `INSERT INTO warnings (scope, severity, code, path, member, message, created_at)
+			SELECT 'ingest', CASE reason WHEN 'download' THEN 'error' ELSE 'warn' END, reason, archive, nullif(member, ''), detail, created_at
+			FROM skipped_members ORDER BY id`},
+	} {
+		var n int
+		if err = tx.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = ?", m.table).Scan(&n); err != nil {
+			return err
+		}
+		if n == 0 {
+			continue
+		}
+		if _, err = tx.Exec(m.copy); err != nil {
+			return fmt.Errorf("could not move %s into warnings: %w", m.table, err)
+		}
+		if _, err = tx.Exec("DROP TABLE " + m.table); err != nil {
+			return err
+		}
+	}
+	for status, sev := range metadataSeverity {
+		if _, err = tx.Exec(`INSERT INTO warnings (scope, severity, code, file_id, message, created_at)
+			SELECT ?, ?, ?, id, ?, datetime('now') FROM files WHERE metadata_status = ? ORDER BY id`,
+			scopeMetadata, sev, status, metadataMessages[status], status); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+type warningQuery struct {
+	// the least severity, "" for any
+	severity     string
+	scope, code  string
+	book         int
+	run          int64
+	acknowledged bool
+}
+
+func (q warningQuery) where() (string, []interface{}) {
+	least := 0
+	for i, s := range severities {
+		if s == q.severity {
+			least = i
+		}
+	}
+	sevs, _ := json.Marshal(severities[least:])
+	return `w.severity IN (SELECT value FROM json_each(?))
+		AND (? = '' OR w.scope = ?) AND (? = '' OR w.code = ?)
+		AND (? = 0 OR w.file_id = ?) AND (? = 0 OR w.run_id = ?)
+		AND (? OR w.acked_at IS NULL)`,
+		[]interface{}{string(sevs), q.scope, q.scope, q.code, q.code, q.book, q.book, q.run, q.run, q.acknowledged}
+}
+
+func warningsCmd(args []string) error {
+	fs := flag.NewFlagSet("warnings", flag.ExitOnError)
+	var q warningQuery
+	fs.StringVar(&q.severity, "severity", "", "only warnings at least this severe: "+strings.Join(severities, ", "))
+	fs.StringVar(&q.scope, "scope", "", "only warnings of this stage: ingest, chunk or metadata")
+	fs.StringVar(&q.code, "code", "", "only warnings with this code, like no_start_marker")
+	fs.IntVar(&q.book, "book", 0, "only warnings about this book")
+	run := fs.String("run", "", "only warnings left by this run: its id, or latest")
+	fs.BoolVar(&q.acknowledged, "all", false, "list acknowledged warnings too")
+	ack := fs.Bool("ack", false, "mark the warnings listed as reviewed, so they are left out from then on")
+	limit := fs.Int("limit", 100, "list at most this many warnings, the latest (0 for all); the counts are of them all")
+	fs.Parse(args)
+
+	known := q.severity == ""
+	for _, s := range severities {
+		known = known || s == q.severity
+	}
+	if !known {
+		return usagef("unknown --severity %q; want %s", q.severity, strings.Join(severities, ", "))
+	}
+	if q.scope != "" && q.scope != scopeIngest && q.scope != scopeChunk && q.scope != scopeMetadata {
+		return usagef("unknown --scope %q; want ingest, chunk or metadata", q.scope)
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch *run {
+	case "":
+	case "latest":
+		err = db.QueryRow("SELECT coalesce(max(id), 0) FROM runs").Scan(&q.run)
+		if err == nil && q.run == 0 {
+			return errors.New("no runs recorded yet")
+		}
+	default:
+		if q.run, err = strconv.ParseInt(*run, 10, 64); err != nil || q.run <= 0 {
+			return usagef("bad --run %q; want a run id or latest", *run)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	where, wargs := q.where()
+	n := *limit
+	if n == 0 {
+		n = -1
+	}
+	rows, err := db.Query(`SELECT w.id, coalesce(w.run_id, 0), w.severity, w.scope, w.code, coalesce(w.file_id, 0),
+			coalesce(w.path, ''), coalesce(w.member, ''), coalesce(w.message, ''), w.acked_at IS NOT NULL
+		FROM warnings w WHERE `+where+` ORDER BY w.id DESC LIMIT ?`, append(wargs, n)...)
+	if err != nil {
+		return err
+	}
+	type row struct {
+		id, run              int64
+		sev, scope, code     string
+		book                 int64
+		path, member, detail string
+		acked                bool
+	}
+	var listed []row
+	for rows.Next() {
+		var r row
+		if err = rows.Scan(&r.id, &r.run, &r.sev, &r.scope, &r.code, &r.book, &r.path, &r.member, &r.detail, &r.acked); err != nil {
+			rows.Close()
+			return err
+		}
+		listed = append(listed, r)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if len(listed) > 0 {
+		fmt.Printf("%7s %5s  %-8s %-8s %-22s %-12s %s\n", "id", "run", "severity", "scope", "code", "about", "message")
+	}
+	// listed latest first, printed in the order they came
+	for i := len(listed) - 1; i >= 0; i-- {
+		r := listed[i]
+		run, about := "-", "book "+strconv.FormatInt(r.book, 10)
+		if r.run != 0 {
+			run = strconv.FormatInt(r.run, 10)
+		}
+		msg := r.detail
+		if r.book == 0 {
+			about = "-"
+			where := r.path
+			if r.member != "" {
+				where += ": " + r.member
+			}
+			msg = strings.TrimPrefix(where+": "+msg, ": ")
+		}
+		if r.acked {
+			msg += " (acknowledged)"
+		}
+		fmt.Printf("%7d %5s  %-8s %-8s %-22s %-12s %s\n", r.id, run, r.sev, r.scope, r.code, about, msg)
+	}
+
+	counts, err := db.Query(`SELECT w.severity, w.scope, w.code, count(*) FROM warnings w WHERE `+where+`
+		GROUP BY w.severity, w.scope, w.code ORDER BY count(*) DESC, w.code`, wargs...)
+	if err != nil {
+		return err
+	}
+	defer counts.Close()
+	total := 0
+	var lines []string
+	for counts.Next() {
+		var sev, scope, code string
+		var c int
+		if err = counts.Scan(&sev, &scope, &code, &c); err != nil {
+			return err
+		}
+		total += c
+		lines = append(lines, fmt.Sprintf("%7d  %-8s %-8s %s", c, sev, scope, code))
+	}
+	if err = counts.Err(); err != nil {
+		return err
+	}
+	if len(listed) > 0 {
+		fmt.Println()
+	}
+	fmt.Printf("%d warnings", total)
+	if total > len(listed) {
+		fmt.Printf(", the latest %d listed", len(listed))
+	}
+	fmt.Println()
+	for _, l := range lines {
+		fmt.Println(l)
+	}
+
+	if *ack && len(listed) > 0 {
+		ids := make([]int64, len(listed))
+		for i, r := range listed {
+			ids[i] = r.id
+		}
+		list, err := json.Marshal(ids)
+		if err != nil {
+			return err
+		}
+		res, err := db.Exec("UPDATE warnings SET acked_at = datetime('now') WHERE acked_at IS NULL AND id IN (SELECT value FROM json_each(?))", string(list))
+		if err != nil {
+			return err
+		}
+		acked, _ := res.RowsAffected()
+		fmt.Printf("acknowledged %d warnings\n", acked)
+	}
+	return nil
+}
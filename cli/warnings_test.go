@@ -0,0 +1,157 @@
+package cli
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// warningRows is the scope, severity and code of each of db's warnings,
+// with the book or member it is about, in order.
+func warningRows(t *testing.T, db *sql.DB) string {
+	t.Helper()
+	rows, err := db.Query(`SELECT scope, severity, code, coalesce(file_id, 0), coalesce(member, path, '')
+		FROM warnings ORDER BY scope, code, file_id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var b strings.Builder
+	for rows.Next() {
+		var scope, sev, code, path string
+		var book int
+		if err = rows.Scan(&scope, &sev, &code, &book, &path); err != nil {
+			t.Fatal(err)
+		}
+		about := filepath.Base(path)
+		if book != 0 {
+			about = fmt.Sprintf("book %d", book)
+		}
+		fmt.Fprintf(&b, "%s %s %s %s\n", scope, sev, code, about)
+	}
+	return b.String()
+}
+
+func TestWarnings(t *testing.T) {
+	db := testDB(t)
+	root := t.TempDir()
+	writeTestZip(t, filepath.Join(root, "1", "11.zip"), zipEntry{"11.txt", testBook("Emma", testParagraphs(2))})
+	writeTestZip(t, filepath.Join(root, "2", "22.zip"), zipEntry{"22.txt", "Title: Unmarked\n\nAuthor: Nobody\n\n" + testParagraphs(2)})
+	writeTestZip(t, filepath.Join(root, "3", "33.zip"), zipEntry{"33.html", "<html>not a text</html>"})
+	run := func(cmd func([]string) error, args ...string) string {
+		t.Helper()
+		out, err := captureStdout(t, func() error { return cmd(args) })
+		if err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+		return out
+	}
+	run(ingestCmd, "--target", root)
+	run(chunkCmd)
+
+	// ingest and chunking both left theirs, the book with no START marker
+	// being chunked into nothing
+	want := "chunk warn no_chunks book 2\nchunk warn no_start_marker book 2\ningest warn no_text_member 33.zip\nmetadata info no_author book 1\n"
+	if got := warningRows(t, db); got != want {
+		t.Fatalf("the warnings are\n%s\nwant\n%s", got, want)
+	}
+	var runs int
+	if err := db.QueryRow("SELECT count(DISTINCT run_id) FROM warnings").Scan(&runs); err != nil || runs != 2 {
+		t.Errorf("the warnings are of %d runs", runs)
+	}
+
+	for _, c := range []struct {
+		args  []string
+		codes []string
+	}{
+		{nil, []string{"no_start_marker", "no_chunks", "no_text_member", "no_author"}},
+		{[]string{"--severity", "warn"}, []string{"no_start_marker", "no_chunks", "no_text_member"}},
+		{[]string{"--scope", "ingest"}, []string{"no_text_member"}},
+		{[]string{"--code", "no_author"}, []string{"no_author"}},
+		{[]string{"--run", "latest"}, []string{"no_start_marker", "no_chunks"}},
+		{[]string{"--book", "2", "--severity", "info"}, []string{"no_start_marker", "no_chunks"}},
+		{[]string{"--code", "no_author", "--severity", "error"}, nil},
+	} {
+		out := run(warningsCmd, c.args...)
+		for _, code := range []string{"no_start_marker", "no_chunks", "no_text_member", "no_author"} {
+			listed := false
+			for _, want := range c.codes {
+				listed = listed || want == code
+			}
+			if strings.Contains(out, " "+code+" ") != listed {
+				t.Errorf("warnings %s listed %s %v:\n%s", strings.Join(c.args, " "), code, !listed, out)
+			}
+		}
+		if counted := fmt.Sprintf("%d warnings\n", len(c.codes)); !strings.HasPrefix(out, counted) && !strings.Contains(out, "\n"+counted) {
+			t.Errorf("warnings %s counted\n%s", strings.Join(c.args, " "), out)
+		}
+	}
+	if out := run(warningsCmd, "--scope", "ingest"); !strings.Contains(out, filepath.Join("3", "33.zip")+": ") {
+		t.Errorf("the ingest warning is listed as\n%s", out)
+	}
+
+	// acknowledged, they are left out unless --all
+	if out := run(warningsCmd, "--severity", "warn", "--ack"); !strings.Contains(out, "acknowledged 3 warnings") {
+		t.Errorf("warnings --ack printed\n%s", out)
+	}
+	if out := run(warningsCmd); strings.Contains(out, "no_start_marker") || !strings.Contains(out, "no_author") || !strings.Contains(out, "1 warnings") {
+		t.Errorf("warnings once two were acknowledged printed\n%s", out)
+	}
+	if out := run(warningsCmd, "--all"); strings.Count(out, "(acknowledged)") != 3 || !strings.Contains(out, "4 warnings") {
+		t.Errorf("warnings --all printed\n%s", out)
+	}
+	if out := run(warningsCmd, "--ack", "--severity", "warn"); strings.Contains(out, "acknowledged") {
+		t.Errorf("acknowledging again printed\n%s", out)
+	}
+
+	// a book chunked again swaps its marker warnings for what it has now
+	if _, err := db.Exec("UPDATE files SET content = ? WHERE id = 2", testBook("Unmarked", testParagraphs(2))); err != nil {
+		t.Fatal(err)
+	}
+	run(chunkCmd, "--full-rechunk")
+	if got := warningRows(t, db); strings.Contains(got, "book 2") {
+		t.Errorf("chunked with a START marker, the warnings are\n%s", got)
+	}
+
+	for _, args := range [][]string{{"--severity", "fatal"}, {"--scope", "export"}, {"--run", "last"}} {
+		if _, err := captureStdout(t, func() error { return warningsCmd(args) }); exitCode(err) != exitUsage {
+			t.Errorf("warnings %s: %v, want a usage error", strings.Join(args, " "), err)
+		}
+	}
+}
+
+func TestMoveWarnings(t *testing.T) {
+	db := testDB(t)
+	id := addBook(t, db, "Villette", "", "")
+	if _, err := db.Exec("UPDATE files SET metadata_status = ? WHERE id = ?", metadataNoTitle, id); err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{
+		"CREATE TABLE chunk_warnings (id INTEGER PRIMARY KEY, sourceid INTEGER, kind TEXT, message TEXT, stack TEXT, created_at TEXT)",
+		"INSERT INTO chunk_warnings (sourceid, kind, message, stack, created_at) VALUES (1, 'panic', 'panic: the chunker choked', 'goroutine 1', '2024-01-02 03:04:05')",
+		"CREATE TABLE skipped_members (id INTEGER PRIMARY KEY, archive TEXT, member TEXT, reason TEXT, detail TEXT, created_at TEXT)",
+		"INSERT INTO skipped_members (archive, member, reason, detail, created_at) VALUES ('3/33.zip', '', 'no_text_member', 'no .txt member', '2024-01-02 03:04:05')",
+		"INSERT INTO skipped_members (archive, member, reason, detail, created_at) VALUES ('4/44.zip', '44.txt', 'binary', 'a png', '2024-01-02 03:04:05')",
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := moveWarnings(db); err != nil {
+		t.Fatal(err)
+	}
+	want := "chunk error panic book 1\ningest warn binary 44.txt\ningest warn no_text_member 33.zip\nmetadata warn no_title book 1\n"
+	if got := warningRows(t, db); got != want {
+		t.Errorf("moved, the warnings are\n%s\nwant\n%s", got, want)
+	}
+	var stack, at string
+	if err := db.QueryRow("SELECT detail, created_at FROM warnings WHERE code = 'panic'").Scan(&stack, &at); err != nil || stack != "goroutine 1" || at != "2024-01-02 03:04:05" {
+		t.Errorf("the panic moved with stack %q at %q (%v)", stack, at, err)
+	}
+	var left int
+	if err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE name IN ('chunk_warnings', 'skipped_members')").Scan(&left); err != nil || left != 0 {
+		t.Errorf("moving left %d of the old tables", left)
+	}
+}
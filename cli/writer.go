@@ -0,0 +1,164 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+)
+
+// errDBClosed is what database/sql gives a database closed.
+var errDBClosed = func() error {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		panic(err)
+	}
+	db.Close()
+	return db.Ping()
+}()
+
+// isClosed is whether db was closed, asked without a connection:
+// database/sql looks for a database closed before it looks at the
+// context, so one cancelled already never waits on the pool or takes a
+// connection from it.
+func isClosed(db *sql.DB) bool {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return errors.Is(db.PingContext(ctx), errDBClosed)
+}
+
+// writer serializes write transactions from concurrent goroutines. SQLite
+// only allows one writer at a time anyway; queueing here rather than in the
+// driver avoids SQLITE_BUSY errors and keeps each transaction short. It has
+// two lanes (see lanes.go): a bulk transaction waits for every interactive
+// one waiting, and for --bulk-yield after the last bulk one.
+type writer struct {
+	db *sql.DB
+	// the pool interactive transactions run on, db when nil
+	quick *sql.DB
+
+	mu   sync.Mutex
+	free *sync.Cond
+	// a transaction holds the lock; interactive ones waiting for it; when
+	// the last bulk one let it go
+	busy     bool
+	waiting  int
+	released time.Time
+}
+
+// writerOf is db's writer. Making one forgets those of the databases
+// closed since, so a process opening database after database, serve's
+// copies or a test's, doesn't keep them all.
+func writerOf(db *sql.DB) *writer {
+	writers.Lock()
+	defer writers.Unlock()
+	if w := writers.of[db]; w != nil {
+		return w
+	}
+	for other := range writers.of {
+		if isClosed(other) {
+			delete(writers.of, other)
+		}
+	}
+	w := &writer{db: db}
+	w.free = sync.NewCond(&w.mu)
+	writers.of[db] = w
+	return w
+}
+
+// lock takes the writer's lock in the interactive lane or the bulk one, a
+// bulk write waiting out --bulk-yield too.
+func (w *writer) lock(interactive, write bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if interactive {
+		w.waiting++
+		for w.busy {
+			w.free.Wait()
+		}
+		w.waiting--
+		w.busy = true
+		return
+	}
+	for {
+		if w.busy || w.waiting > 0 {
+			w.free.Wait()
+			continue
+		}
+		gap := time.Until(w.released.Add(*bulkYield))
+		if !write || gap <= 0 {
+			break
+		}
+		w.mu.Unlock()
+		time.Sleep(gap)
+		w.mu.Lock()
+	}
+	w.busy = true
+}
+
+func (w *writer) unlock(interactive, write bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.busy = false
+	if !interactive && write {
+		w.released = time.Now()
+	}
+	w.free.Broadcast()
+}
+
+// locked runs fn holding the lock.
+func (w *writer) locked(interactive, write bool, fn func() error) error {
+	w.lock(interactive, write)
+	defer w.unlock(interactive, write)
+	return fn()
+}
+
+// do runs fn in a transaction in the bulk lane, committing if it returns
+// nil.
+func (w *writer) do(fn func(tx *sql.Tx) error) error {
+	if err := w.locked(false, true, func() error { return transact(w.db, fn) }); err != nil {
+		return err
+	}
+	// a passive checkpoint takes no lock from writers, so none waits on it
+	walState.committed(w.db)
+	return nil
+}
+
+// interactive runs fn in a transaction as do does, but before any bulk
+// transaction waiting, on the quick pool, retrying it while the database is
+// busy with another process's write.
+func (w *writer) interactive(fn func(tx *sql.Tx) error) error {
+	db := w.db
+	if w.quick != nil {
+		db = w.quick
+	}
+	// its commits are left to the bulk lane, and sqlite, to checkpoint
+	return w.locked(true, true, func() error {
+		return retryBusy(func() error { return transact(db, fn) })
+	})
+}
+
+func transact(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// also rolls back when fn panics, which chunkRecovered recovers from
+	defer tx.Rollback()
+	if err = fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// read runs fn while holding the write lock, for reads that must not
+// overlap a write transaction on another connection.
+func (w *writer) read(fn func(db *sql.DB) error) error {
+	return w.locked(false, false, func() error { return fn(w.db) })
+}
+
+// interactiveRead is read in the interactive lane.
+func (w *writer) interactiveRead(fn func(db *sql.DB) error) error {
+	return w.locked(true, false, func() error { return fn(w.db) })
+}
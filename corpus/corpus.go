@@ -0,0 +1,209 @@
+// Package corpus generates synthetic Project Gutenberg style mirrors for
+// benchmarking. Output is fully determined by Options, so two runs with the
+// same seed produce byte-identical trees.
+package corpus
+
+import (
+	"archive/zip"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type Options struct {
+	Seed  int64
+	Books int
+	// BookSize is the approximate size in bytes of each book's body.
+	BookSize int
+	// ParagraphWords is the mean paragraph length in words; ParagraphSpread
+	// is its standard deviation. Lengths follow a normal distribution clamped
+	// to at least one word.
+	ParagraphWords  int
+	ParagraphSpread int
+	// Latin1 is the fraction (0-1) of books written as ISO-8859-1 instead of
+	// ASCII, exercising the accented part of the vocabulary.
+	Latin1 float64
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Seed:            1,
+		Books:           500,
+		BookSize:        200 * 1024,
+		ParagraphWords:  90,
+		ParagraphSpread: 60,
+		Latin1:          0.1,
+	}
+}
+
+type Stats struct {
+	Books int
+	Bytes int64
+}
+
+var (
+	words = strings.Fields(`the of and to a in that he was it his her with as had
+		for you not be is at on but she said him by my all which have this from were
+		they so me one there been what would when if no their them an or could we
+		upon into more some very little old time man house door night hand eyes
+		before after again down through never long great thought heart good know
+		himself herself shall must away nothing country morning letter father
+		mother sister brother captain madame friend river window garden church`)
+	accented = []string{"café", "naïve", "Brontë", "fiancée", "señor", "déjà",
+		"über", "rôle", "façade", "élan"}
+	names = strings.Fields(`Ada Bertram Clara Dorian Edith Felix Grace Harriet
+		Ivor Julia Kester Lydia Morton Nell Oliver Philippa`)
+	surnames = strings.Fields(`Ashdown Bellweather Crane Dunmore Everly Fairfax
+		Greaves Hollis Ingram Jessop Kettle Lowry Marchbanks Nettleship Orme Pryce`)
+)
+
+// Generate writes opts.Books zipped books under dir using the aleph mirror
+// layout (1/2/3/123/123.zip), one .txt member per archive.
+func Generate(dir string, opts Options) (Stats, error) {
+	r := rand.New(rand.NewSource(opts.Seed))
+	var st Stats
+
+	for i := 0; i < opts.Books; i++ {
+		num := 10000 + i
+		latin1 := r.Float64() < opts.Latin1
+		text := book(r, num, opts, latin1)
+
+		path := filepath.Join(dir, mirrorPath(num))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return st, err
+		}
+		if err := writeZip(path, fmt.Sprintf("%d.txt", num), text); err != nil {
+			return st, fmt.Errorf("could not write %s: %w", path, err)
+		}
+
+		st.Books++
+		st.Bytes += int64(len(text))
+	}
+
+	return st, nil
+}
+
+func mirrorPath(num int) string {
+	s := fmt.Sprint(num)
+	parts := []string{}
+	for _, c := range s[:len(s)-1] {
+		parts = append(parts, string(c))
+	}
+	parts = append(parts, s, s+".zip")
+	return filepath.Join(parts...)
+}
+
+func writeZip(path, member string, content []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	zw := zip.NewWriter(f)
+	w, err := zw.Create(member)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if _, err = w.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func book(r *rand.Rand, num int, opts Options, latin1 bool) []byte {
+	title := strings.Title(strings.Join(pick(r, words, 2+r.Intn(3)), " "))
+	author := names[r.Intn(len(names))] + " " + surnames[r.Intn(len(surnames))]
+	charset := "ASCII"
+	if latin1 {
+		charset = "ISO-8859-1"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "The Project Gutenberg EBook of %s, by %s\n\n", title, author)
+	b.WriteString("This eBook is for the use of anyone anywhere at no cost and with\n")
+	b.WriteString("almost no restrictions whatsoever.  You may copy it, give it away or\n")
+	b.WriteString("re-use it under the terms of the Project Gutenberg License included\n")
+	b.WriteString("with this eBook or online at www.gutenberg.org\n\n\n")
+	fmt.Fprintf(&b, "Title: %s\n\nAuthor: %s\n\n", title, author)
+	fmt.Fprintf(&b, "Release Date: March %d, 2004 [EBook #%d]\n\n", 1+r.Intn(28), num)
+	fmt.Fprintf(&b, "Language: English\n\nCharacter set encoding: %s\n\n", charset)
+	fmt.Fprintf(&b, "*** START OF THIS PROJECT GUTENBERG EBOOK %s ***\n\n\n\n", strings.ToUpper(title))
+
+	start := b.Len()
+	for b.Len()-start < opts.BookSize {
+		writeParagraph(&b, r, opts, latin1)
+	}
+
+	fmt.Fprintf(&b, "\n\n*** END OF THIS PROJECT GUTENBERG EBOOK %s ***\n\n", strings.ToUpper(title))
+	b.WriteString("***** This file should be named " + fmt.Sprint(num) + ".txt *****\n\n")
+	b.WriteString("Updated editions will replace the previous one--the old editions\nwill be renamed.\n")
+
+	if latin1 {
+		return toLatin1(b.String())
+	}
+	return []byte(b.String())
+}
+
+func writeParagraph(b *strings.Builder, r *rand.Rand, opts Options, latin1 bool) {
+	n := int(math.Round(r.NormFloat64()*float64(opts.ParagraphSpread))) + opts.ParagraphWords
+	if n < 1 {
+		n = 1
+	}
+
+	line := 0
+	sentence := 0
+	for i := 0; i < n; i++ {
+		w := words[r.Intn(len(words))]
+		if latin1 && r.Intn(40) == 0 {
+			w = accented[r.Intn(len(accented))]
+		}
+		if sentence == 0 {
+			w = strings.ToUpper(w[:1]) + w[1:]
+		}
+		sentence++
+		if i == n-1 || (sentence > 6 && r.Intn(8) == 0) {
+			w += "."
+			sentence = 0
+		} else if r.Intn(12) == 0 {
+			w += ","
+		}
+
+		if line > 0 && line+len(w) >= 70 {
+			b.WriteString("\n")
+			line = 0
+		} else if line > 0 {
+			b.WriteString(" ")
+			line++
+		}
+		b.WriteString(w)
+		line += len(w)
+	}
+	b.WriteString("\n\n")
+}
+
+func pick(r *rand.Rand, from []string, n int) []string {
+	out := make([]string, n)
+	for i := range out {
+		out[i] = from[r.Intn(len(from))]
+	}
+	return out
+}
+
+func toLatin1(s string) []byte {
+	out := make([]byte, 0, len(s))
+	for _, c := range s {
+		if c > 0xff {
+			c = '?'
+		}
+		out = append(out, byte(c))
+	}
+	return out
+}
@@ -0,0 +1,173 @@
+package corpus
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func small() Options {
+	opts := DefaultOptions()
+	opts.Books = 8
+	opts.BookSize = 4 * 1024
+	return opts
+}
+
+// tree reads every file under dir, by its path there.
+func tree(t *testing.T, dir string) map[string][]byte {
+	t.Helper()
+	files := map[string][]byte{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		files[rel], err = os.ReadFile(path)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// member is the one text of the zip at path.
+func member(t *testing.T, path string) []byte {
+	t.Helper()
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	if len(zr.File) != 1 {
+		t.Fatalf("%s has %d members, want 1", path, len(zr.File))
+	}
+	rc, err := zr.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	text, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return text
+}
+
+func TestGenerateDeterministic(t *testing.T) {
+	a, b, c := t.TempDir(), t.TempDir(), t.TempDir()
+	opts := small()
+	for _, dir := range []string{a, b} {
+		if _, err := Generate(dir, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts.Seed++
+	if _, err := Generate(c, opts); err != nil {
+		t.Fatal(err)
+	}
+	ta, tb := tree(t, a), tree(t, b)
+	if len(ta) != opts.Books {
+		t.Fatalf("%d files, want %d", len(ta), opts.Books)
+	}
+	for path, bs := range ta {
+		if !bytes.Equal(bs, tb[path]) {
+			t.Errorf("%s differs between two runs of one seed", path)
+		}
+	}
+	same := 0
+	for path := range ta {
+		if bytes.Equal(member(t, filepath.Join(a, path)), member(t, filepath.Join(c, path))) {
+			same++
+		}
+	}
+	if same == len(ta) {
+		t.Error("another seed made the same books")
+	}
+}
+
+func TestGenerateBooks(t *testing.T) {
+	dir := t.TempDir()
+	opts := small()
+	st, err := Generate(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Books != opts.Books {
+		t.Errorf("Stats.Books = %d, want %d", st.Books, opts.Books)
+	}
+	// 10000 in the aleph layout
+	text := member(t, filepath.Join(dir, "1", "0", "0", "0", "10000", "10000.zip"))
+	for _, want := range []string{"The Project Gutenberg EBook of ", "\nTitle: ", "\nAuthor: ", "[EBook #10000]",
+		"*** START OF THIS PROJECT GUTENBERG EBOOK ", "*** END OF THIS PROJECT GUTENBERG EBOOK "} {
+		if !bytes.Contains(text, []byte(want)) {
+			t.Errorf("the book has no %q", want)
+		}
+	}
+	start := bytes.Index(text, []byte("***\n"))
+	end := bytes.Index(text, []byte("*** END"))
+	if body := end - start; body < opts.BookSize || body > 2*opts.BookSize {
+		t.Errorf("the body is %d bytes, want about %d", body, opts.BookSize)
+	}
+	if st.Bytes < int64(opts.Books*opts.BookSize) {
+		t.Errorf("Stats.Bytes = %d, under %d books of %d", st.Bytes, opts.Books, opts.BookSize)
+	}
+}
+
+func TestGenerateLatin1(t *testing.T) {
+	for _, c := range []struct {
+		latin1 float64
+		want   string
+	}{{0, "ASCII"}, {1, "ISO-8859-1"}} {
+		dir := t.TempDir()
+		opts := small()
+		opts.Latin1 = c.latin1
+		if _, err := Generate(dir, opts); err != nil {
+			t.Fatal(err)
+		}
+		for path := range tree(t, dir) {
+			text := member(t, filepath.Join(dir, path))
+			if !bytes.Contains(text, []byte("Character set encoding: "+c.want)) {
+				t.Errorf("Latin1 %v: %s isn't said to be %s", c.latin1, path, c.want)
+			}
+			if c.latin1 == 1 && utf8.Valid(text) && bytes.IndexFunc(text, func(r rune) bool { return r > 0x7f }) >= 0 {
+				t.Errorf("%s is UTF-8, not ISO-8859-1", path)
+			}
+			if c.latin1 == 0 && bytes.IndexFunc(text, func(r rune) bool { return r > 0x7f }) >= 0 {
+				t.Errorf("%s isn't ASCII", path)
+			}
+		}
+	}
+}
+
+func TestParagraphLengths(t *testing.T) {
+	dir := t.TempDir()
+	opts := small()
+	opts.Books = 1
+	opts.BookSize = 64 * 1024
+	opts.ParagraphWords, opts.ParagraphSpread = 40, 0
+	if _, err := Generate(dir, opts); err != nil {
+		t.Fatal(err)
+	}
+	text := string(member(t, filepath.Join(dir, "1", "0", "0", "0", "10000", "10000.zip")))
+	body := text[strings.Index(text, "***\n")+4 : strings.Index(text, "*** END")]
+	for _, p := range strings.Split(strings.TrimSpace(body), "\n\n") {
+		if n := len(strings.Fields(p)); n != 40 {
+			t.Fatalf("a paragraph of %d words, want 40 with no spread", n)
+		}
+	}
+}
+
+func BenchmarkGenerate(b *testing.B) {
+	opts := small()
+	for i := 0; i < b.N; i++ {
+		if _, err := Generate(b.TempDir(), opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -2,4 +2,8 @@ module git.tilde.town/gutchunker
 
 go 1.18
 
-require github.com/mattn/go-sqlite3 v1.14.17
+require (
+	github.com/klauspost/compress v1.16.7
+	github.com/mattn/go-sqlite3 v1.14.17
+	golang.org/x/text v0.14.0
+)
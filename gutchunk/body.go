@@ -0,0 +1,282 @@
+package gutchunk
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// A book is read as three parts in turn, its header, its body and its
+// footer, and only the body is chunked. The Markers rule says which lines
+// end the header and start the footer, Gutenberg's START and END lines
+// unless Options give another. Some books have START more than once,
+// after a preamble describing the edition or with the whole header
+// repeated; the header ends at the last START before any real body text.
+// A START further on has the header-like paragraphs around it removed
+// when they hold Title:, Author: or Release Date: lines, and is otherwise
+// dropped by itself, as it is likely quoted.
+//
+// An override (see the command's overrides.go) moves the ends of the body
+// instead: its start line begins the body, and its end line ends it
+// before, whatever markers the book has or hasn't; its start pattern
+// begins the body after the first line it matches, with no START needed,
+// and its end pattern starts the footer at the first line of the body it
+// matches. Lines skipped at the top are blanked rather than cut, so the
+// lines still count as they do for the works of an anthology.
+
+var (
+	// lines of the kind found in a Gutenberg header
+	headerLine = regexp.MustCompile(`^(Title|Author|Release Date|Posting Date|Last Updated|Language|Character set encoding|Produced by|Translator|Translated by|Editor|Edited by|Illustrator)\b|Project Gutenberg|^\[?E-?(Book|Text) #|^\*\*\*`)
+	// the fields that make a block a header rather than prose near a marker
+	headerField = regexp.MustCompile(`^(Title|Author|Release Date):`)
+)
+
+// Markers is the rule for where a book's header ends and its footer
+// starts.
+type Markers interface {
+	// Start reports whether line, trimmed, is a START marker, the header
+	// ending with it
+	Start(line string) bool
+	// End reports whether line is an END marker, the footer starting
+	// with it
+	End(line string) bool
+}
+
+// GutenbergMarkers are the markers of Options without others, the
+// "*** START" and "*** END" lines of a Project Gutenberg book.
+var GutenbergMarkers Markers = gutenbergMarkers{}
+
+type gutenbergMarkers struct{}
+
+func (gutenbergMarkers) Start(line string) bool { return strings.HasPrefix(line, "*** START") }
+func (gutenbergMarkers) End(line string) bool   { return strings.HasPrefix(line, "*** END") }
+
+func (opts Options) markers() Markers {
+	if opts.Markers == nil {
+		return GutenbergMarkers
+	}
+	return opts.Markers
+}
+
+// Found is what finding a body found of its markers: how many START lines
+// the book has, how many repeated header blocks were cut out of the body,
+// and whether it was read from the top, with no header.
+type Found struct {
+	Starts   int
+	Stripped int
+	BodyOnly bool
+}
+
+// Lines are the lines of r, trimmed, as a body is made of them; line n of
+// a book is Lines[n-1]. A line too long to read ends them, with the
+// error.
+func Lines(r io.Reader) ([]string, error) {
+	lines := []string{}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		lines = append(lines, strings.TrimSpace(s.Text()))
+	}
+	return lines, s.Err()
+}
+
+// ReadBody reads a book from r and finds its body, as opts have it. A
+// line too long to read ends the book, the body found in what came
+// before it returned with the error.
+func ReadBody(r io.Reader, opts Options) (Body, error) {
+	lines, err := Lines(r)
+	return FindBody(lines, opts), err
+}
+
+// part is which part of a book a line is in.
+type part int
+
+const (
+	inHeader part = iota
+	inBody
+	inFooter
+)
+
+// FindBody is the body of the book whose lines are lines (see Lines).
+func FindBody(lines []string, opts Options) Body {
+	mk := opts.markers()
+	b := Body{Found: Found{BodyOnly: opts.BodyOnly}}
+	override := opts.Start != nil || opts.StartLine > 0
+	if !override && opts.EndLine > 0 && opts.EndLine-1 < len(lines) {
+		lines = lines[:opts.EndLine-1]
+	}
+
+	// the first line of the body, known before reading on
+	from := len(lines)
+	switch {
+	case opts.StartLine > 0:
+		from = opts.StartLine - 1
+	case opts.Start != nil:
+		for i, line := range lines {
+			if opts.Start.MatchString(line) {
+				from = i + 1
+				break
+			}
+		}
+	default:
+		starts := []int{}
+		for i, line := range lines {
+			if mk.Start(line) {
+				starts = append(starts, i)
+			}
+		}
+		b.Starts = len(starts)
+		if opts.BodyOnly {
+			from = 0
+		} else if len(starts) > 0 {
+			from = starts[bodyStart(lines, starts, mk)] + 1
+		} else {
+			return b
+		}
+	}
+	ends := func(i int, line string) bool {
+		switch {
+		case !override:
+			return mk.End(line)
+		case opts.EndLine > 0:
+			return i >= opts.EndLine-1
+		}
+		return opts.End == nil && mk.End(line)
+	}
+
+	// src[k] is the index in lines of b.Lines[k], for backing out lines
+	out, src := []string{}, []int{}
+	at := inHeader
+	for i := 0; i < len(lines) && at != inFooter; i++ {
+		line := lines[i]
+		switch {
+		case at == inHeader && i < from:
+			continue
+		case ends(i, line):
+			at = inFooter
+			continue
+		}
+		at = inBody
+		if override || !mk.Start(line) {
+			out, src = append(out, line), append(src, i)
+			continue
+		}
+		to := i + 1
+		for to < len(lines) && !ends(to, lines[to]) {
+			to++
+		}
+		before, after := headerAround(lines[:to], i, from, mk)
+		if !anyMatch(headerField, lines[before:after]) {
+			continue
+		}
+		for len(src) > 0 && src[len(src)-1] >= before {
+			out, src = out[:len(out)-1], src[:len(src)-1]
+		}
+		b.Stripped++
+		i = after - 1
+	}
+	if override && len(out) == 0 {
+		out = nil
+	}
+	if opts.End != nil {
+		for i, line := range out {
+			if opts.End.MatchString(line) {
+				out = out[:i]
+				break
+			}
+		}
+	}
+	if opts.SkipLines > 0 {
+		for i := 0; i < opts.SkipLines && i < len(out); i++ {
+			out[i] = ""
+		}
+	}
+	b.Lines = out
+	return b
+}
+
+// BodyStart returns which of the START lines at starts is the one the
+// body follows: the last before any real body text.
+func BodyStart(lines []string, starts []int) int {
+	return bodyStart(lines, starts, GutenbergMarkers)
+}
+
+func bodyStart(lines []string, starts []int, mk Markers) int {
+	for i, at := range starts {
+		next := len(lines)
+		if i+1 < len(starts) {
+			next = starts[i+1]
+		}
+		if hasBodyText(lines[at+1:next], mk) {
+			return i
+		}
+	}
+	return len(starts) - 1
+}
+
+// HasBodyText reports whether lines hold a paragraph long enough to chunk
+// that doesn't look like part of a header.
+func HasBodyText(lines []string) bool {
+	return hasBodyText(lines, GutenbergMarkers)
+}
+
+func hasBodyText(lines []string, mk Markers) bool {
+	for _, p := range spans(lines, 0, len(lines), mk) {
+		para := lines[p[0]:p[1]]
+		if len(strings.Join(para, "\n")) >= MinChunk && !anyMatch(headerLine, para) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerAround widens the START line at i to the run of header-like
+// paragraphs on either side of it, from the body's first line on to the
+// footer, lines ending before it, returning the bounds as [before, after).
+func headerAround(lines []string, i, from int, mk Markers) (int, int) {
+	before := i
+	ps := spans(lines, from, i, mk)
+	for j := len(ps) - 1; j >= 0 && anyMatch(headerLine, lines[ps[j][0]:ps[j][1]]); j-- {
+		before = ps[j][0]
+	}
+	after := i + 1
+	for _, p := range spans(lines, i+1, len(lines), mk) {
+		if !anyMatch(headerLine, lines[p[0]:p[1]]) {
+			break
+		}
+		after = p[1]
+	}
+	return before, after
+}
+
+// spans returns the [start, end) bounds of the runs of non-blank lines in
+// lines[from:to]. START lines separate them like blank ones.
+func spans(lines []string, from, to int, mk Markers) [][2]int {
+	ps := [][2]int{}
+	start := -1
+	for i := from; i < to; i++ {
+		if lines[i] == "" || mk.Start(lines[i]) {
+			if start >= 0 {
+				ps = append(ps, [2]int{start, i})
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		ps = append(ps, [2]int{start, to})
+	}
+	return ps
+}
+
+func anyMatch(re *regexp.Regexp, lines []string) bool {
+	for _, l := range lines {
+		if re.MatchString(l) {
+			return true
+		}
+	}
+	return false
+}
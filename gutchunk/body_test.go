@@ -0,0 +1,122 @@
+package gutchunk
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// book is the lines of a book made of parts, blank lines between them.
+func book(parts ...[]string) []string {
+	return body(parts...).Lines
+}
+
+// first is the first word of each paragraph of b.
+func first(b Body) []string {
+	s := []string{}
+	for _, p := range strings.Split(strings.Join(b.Lines, "\n"), "\n\n") {
+		if p = strings.TrimSpace(p); p != "" {
+			s = append(s, strings.Fields(p)[0])
+		}
+	}
+	return s
+}
+
+// markers are BEGIN and FINIS lines, for a book marked otherwise.
+type markers struct{}
+
+func (markers) Start(line string) bool { return line == "BEGIN" }
+func (markers) End(line string) bool   { return line == "FINIS" }
+
+func TestFindBody(t *testing.T) {
+	start, end := []string{"*** START OF X ***"}, []string{"*** END OF X ***"}
+	header := []string{"Title: X", "Author: Y"}
+	one, two, three := []string{"one"}, []string{"two"}, []string{"three"}
+	long := para("long", 400)
+	// line 3 is START, 5 one, 7 two, 9 three and 11 END
+	marked := book(header, start, one, two, three, end, []string{"license"})
+	tests := []struct {
+		name  string
+		lines []string
+		opts  Options
+		want  []string
+		found Found
+	}{
+		{"markers", marked, Options{}, []string{"one", "two", "three"}, Found{Starts: 1}},
+		{"no markers", book(one, two), Options{}, []string{}, Found{}},
+		{"body only", book(one, two), Options{BodyOnly: true}, []string{"one", "two"}, Found{BodyOnly: true}},
+		{"start line", marked, Options{StartLine: 7}, []string{"two", "three"}, Found{}},
+		{"end line", marked, Options{EndLine: 9}, []string{"one", "two"}, Found{Starts: 1}},
+		{"start and end lines", marked, Options{StartLine: 5, EndLine: 9}, []string{"one", "two"}, Found{}},
+		{"start line past the end", marked, Options{StartLine: 12}, []string{}, Found{}},
+		{"start pattern", marked, Options{Start: regexp.MustCompile(`^one$`)}, []string{"two", "three"}, Found{}},
+		{"start pattern unmatched", marked, Options{Start: regexp.MustCompile(`^four$`)}, []string{}, Found{}},
+		{"start pattern past END", book(one, end, two), Options{Start: regexp.MustCompile(`^one$`), End: regexp.MustCompile(`^two$`)}, []string{"***"}, Found{}},
+		{"end pattern", marked, Options{End: regexp.MustCompile(`^three$`)}, []string{"one", "two"}, Found{Starts: 1}},
+		{"skip lines", marked, Options{SkipLines: 2}, []string{"two", "three"}, Found{Starts: 1}},
+		{"other markers", book(one, []string{"BEGIN"}, two, []string{"FINIS"}, three), Options{Markers: markers{}}, []string{"two"}, Found{Starts: 1}},
+		{"preamble", book(start, one, start, long, end), Options{}, []string{"long"}, Found{Starts: 2}},
+		{"quoted START", book(start, long, start, two, end), Options{}, []string{"long", "two"}, Found{Starts: 2}},
+		{"repeated header", book(start, long, header, start, []string{"Produced by Z"}, two, end), Options{}, []string{"long", "two"}, Found{Starts: 2, Stripped: 1}},
+	}
+	for _, tt := range tests {
+		b := FindBody(tt.lines, tt.opts)
+		if got := first(b); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: body is %q, not %q", tt.name, got, tt.want)
+		}
+		if b.Found != tt.found {
+			t.Errorf("%s: found %+v, not %+v", tt.name, b.Found, tt.found)
+		}
+	}
+}
+
+// TestFindBodyLines checks that the body keeps the book's lines as they
+// count, a line skipped blanked rather than cut.
+func TestFindBodyLines(t *testing.T) {
+	lines := book([]string{"*** START OF X ***"}, []string{"one", "two"}, []string{"three"})
+	b := FindBody(lines, Options{SkipLines: 2})
+	if want := []string{"", "", "two", "", "three", ""}; !reflect.DeepEqual(b.Lines, want) {
+		t.Errorf("body is %q, not %q", b.Lines, want)
+	}
+	if lines[3] != "two" {
+		t.Errorf("skipping lines changed the book's: %q", lines)
+	}
+}
+
+func TestLines(t *testing.T) {
+	got, err := Lines(strings.NewReader("  one \r\ntwo\n\n\tthree"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"one", "two", "", "three"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("lines are %q, not %q", got, want)
+	}
+	if _, err := ReadBody(strings.NewReader("*** START\n"+strings.Repeat("x", 1<<17)), Options{}); err == nil {
+		t.Error("a line too long to read gave no error")
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	tests := []struct {
+		found  Found
+		chunks int
+		want   []string
+	}{
+		{Found{Starts: 1}, 3, []string{}},
+		{Found{}, 3, []string{WarnNoStart}},
+		{Found{BodyOnly: true}, 3, []string{}},
+		{Found{Starts: 3, Stripped: 1}, 3, []string{WarnRepeatedStart}},
+		{Found{Starts: 1}, 0, []string{WarnNoChunks}},
+		{Found{}, 0, []string{WarnNoChunks, WarnNoStart}},
+	}
+	for _, tt := range tests {
+		got := []string{}
+		for _, w := range tt.found.Warnings(tt.chunks) {
+			got = append(got, w.Code)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v, %d chunks: warns %q, not %q", tt.found, tt.chunks, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package gutchunk
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Chunks are stored in a canonical form: each run of prose is one line with
+// single spaces, and "\n\n" appears only where a break is meant to be kept,
+// between the lines of verse. Books wrap their prose at around 70 columns,
+// so the hard line breaks there carry no meaning and are dropped.
+//
+// Chunks written before the canonical form instead have one line per line
+// of the book, each ending in a single "\n".
+
+// IsLegacy reports whether text has the line-per-line form, that is a
+// "\n" that isn't part of a kept "\n\n" break.
+func IsLegacy(text string) bool {
+	return strings.Contains(strings.ReplaceAll(text, "\n\n", ""), "\n")
+}
+
+// Canonical converts a chunk to the canonical form, leaving canonical
+// chunks as they are.
+func Canonical(text string) string {
+	if !IsLegacy(text) {
+		return strings.TrimSpace(text)
+	}
+	lines := []string{}
+	for _, l := range strings.Split(text, "\n") {
+		if l = strings.Join(strings.Fields(l), " "); l != "" {
+			lines = append(lines, l)
+		}
+	}
+	if isVerse(lines) {
+		return strings.Join(lines, "\n\n")
+	}
+	return joinProse(lines)
+}
+
+// wrapWidth is the narrowest column prose is assumed to have been wrapped
+// at. A line that would still have fit the next word within it was broken
+// on purpose.
+const wrapWidth = 60
+
+// isVerse reports whether most of the line breaks in lines were chosen
+// rather than made by wrapping: the next line's first word would have fit.
+func isVerse(lines []string) bool {
+	if len(lines) < 2 {
+		return false
+	}
+	width := wrapWidth
+	for _, l := range lines {
+		if n := utf8.RuneCountInString(l); n > width {
+			width = n
+		}
+	}
+	chosen := 0
+	for i, l := range lines[:len(lines)-1] {
+		next := strings.Fields(lines[i+1])[0]
+		if utf8.RuneCountInString(l)+1+utf8.RuneCountInString(next) <= width {
+			chosen++
+		}
+	}
+	return chosen*2 > len(lines)-1
+}
+
+// joinProse joins wrapped lines with spaces, except around a dash, which
+// Gutenberg texts set closed up: "said--" at the end of one line and "and"
+// at the start of the next become "said--and".
+func joinProse(lines []string) string {
+	var b strings.Builder
+	for i, l := range lines {
+		if i > 0 && !dashEnd(lines[i-1]) && !dashStart(l) {
+			b.WriteByte(' ')
+		}
+		b.WriteString(l)
+	}
+	return b.String()
+}
+
+func dashEnd(s string) bool {
+	return strings.HasSuffix(s, "—") || strings.HasSuffix(s, "--")
+}
+
+func dashStart(s string) bool {
+	return strings.HasPrefix(s, "—") || strings.HasPrefix(s, "--")
+}
+
+// CanonicalRule says what Canonical does to chunk.
+func CanonicalRule(chunk string) string {
+	if !IsLegacy(chunk) {
+		return "trimmed"
+	}
+	lines := []string{}
+	spaced := false
+	for _, l := range strings.Split(chunk, "\n") {
+		f := strings.Join(strings.Fields(l), " ")
+		spaced = spaced || f != l && f != ""
+		if f != "" {
+			lines = append(lines, f)
+		}
+	}
+	rules := []string{}
+	if isVerse(lines) {
+		rules = append(rules, "verse: its line breaks kept")
+	} else if len(lines) > 1 {
+		rules = append(rules, "wrapped lines joined as prose")
+		dashes := 0
+		for i := 1; i < len(lines); i++ {
+			if dashEnd(lines[i-1]) || dashStart(lines[i]) {
+				dashes++
+			}
+		}
+		switch {
+		case dashes == 1:
+			rules = append(rules, "a dash closed up across lines")
+		case dashes > 1:
+			rules = append(rules, fmt.Sprintf("%d dashes closed up across lines", dashes))
+		}
+	} else {
+		rules = append(rules, "one line, kept")
+	}
+	if spaced {
+		rules = append(rules, "runs of spaces made one")
+	}
+	return strings.Join(rules, ", ")
+}
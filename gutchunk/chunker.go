@@ -0,0 +1,67 @@
+package gutchunk
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Warning is what chunking a book warns of, by its code.
+type Warning struct {
+	Code    string
+	Message string
+}
+
+// the codes of the warnings chunking gives
+const (
+	WarnNoStart       = "no_start_marker"
+	WarnRepeatedStart = "repeated_start_marker"
+	WarnNoChunks      = "no_chunks"
+)
+
+// Warnings are what a book whose body f was found of, cut into chunks
+// chunks, warns of: no START marker, or more than one, or no chunks at all.
+func (f Found) Warnings(chunks int) []Warning {
+	ws := []Warning{}
+	if chunks == 0 {
+		ws = append(ws, Warning{WarnNoChunks, "chunked into no chunks"})
+	}
+	switch {
+	case f.Starts == 0 && !f.BodyOnly:
+		ws = append(ws, Warning{WarnNoStart, "no START marker; chunked from the top"})
+	case f.Starts > 1:
+		ws = append(ws, Warning{WarnRepeatedStart, fmt.Sprintf("%d START markers, %d repeated headers removed", f.Starts, f.Stripped)})
+	}
+	return ws
+}
+
+// Split cuts body into chunks by the strategy opts name, in the order of
+// their ordinals, and returns them with the footnotes it took out.
+func Split(body Body, opts Options) ([]Chunk, []Footnote, error) {
+	s, err := NewStrategy(opts.Strategy, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	chunks, notes := s.Split(body)
+	sort.SliceStable(chunks, func(i, j int) bool { return chunks[i].Ordinal < chunks[j].Ordinal })
+	// a book of one chunk is all middle
+	if len(chunks) == 1 {
+		chunks[0].Position = 0.5
+	}
+	return chunks, notes, nil
+}
+
+// ChunkReader reads a book from r and chunks it as opts say, returning its
+// chunks and what it warns of. It is FindBody and then Split, for a book
+// as a whole.
+func ChunkReader(r io.Reader, opts Options) ([]Chunk, []Warning, error) {
+	body, err := ReadBody(r, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	chunks, _, err := Split(body, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return chunks, body.Warnings(len(chunks)), nil
+}
@@ -0,0 +1,152 @@
+package gutchunk
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	footnoteStart   = regexp.MustCompile(`^\[(?i:footnote|note)\s*([^:\]\s]*)\s*:?\s*`)
+	footnoteHeading = regexp.MustCompile(`^(?i)foot-?notes?:?$`)
+	sectionNote     = regexp.MustCompile(`^(?:\[([0-9A-Za-z*]+)\]|(\d+)\.)\s*`)
+	footnoteRef     = regexp.MustCompile(` ?\[(\d+|[A-Z])\]`)
+)
+
+// a footnote that ran this long without its closing bracket is probably an
+// unbalanced bracket in the prose; give the rest of the book back
+const maxFootnoteLines = 100
+
+// Footnote is a footnote a strategy took out of a body.
+type Footnote struct {
+	Marker string
+	Text   string
+	// Ordinal of the chunk emitted just before the footnote, -1 if none.
+	Ordinal int
+}
+
+// footnoteScanner pulls footnotes out of a book's line stream. It knows two
+// shapes: inline bracketed blocks ("[Footnote 12: ...]", possibly spanning
+// paragraphs and containing nested brackets) and end-of-chapter sections
+// headed "FOOTNOTES:" whose paragraphs each start with a marker like "[1]".
+type footnoteScanner struct {
+	notes []Footnote
+	// Ordinal of the last chunk emitted, maintained by the caller.
+	after int
+
+	open    *Footnote
+	depth   int
+	lines   int
+	section bool
+	blank   bool
+}
+
+func newFootnoteScanner() *footnoteScanner {
+	return &footnoteScanner{after: -1}
+}
+
+// take reports whether the trimmed line belongs to a footnote, in which case
+// it must be kept out of chunk text.
+func (f *footnoteScanner) take(text string) bool {
+	if f.open != nil && f.depth > 0 {
+		f.open.Text += "\n" + text
+		f.depth += bracketDepth(text)
+		f.lines++
+		if f.depth <= 0 || f.lines > maxFootnoteLines {
+			f.close()
+		}
+		return true
+	}
+
+	if m := footnoteStart.FindStringSubmatchIndex(text); m != nil {
+		f.close()
+		f.open = &Footnote{Marker: text[m[2]:m[3]], Text: text[m[1]:], Ordinal: f.after}
+		f.depth = bracketDepth(text)
+		f.lines = 1
+		if f.depth <= 0 {
+			f.close()
+		}
+		return true
+	}
+
+	if footnoteHeading.MatchString(text) {
+		f.close()
+		f.section = true
+		f.blank = true
+		return true
+	}
+
+	if !f.section {
+		return false
+	}
+
+	if text == "" {
+		f.blank = true
+		return true
+	}
+	if m := sectionNote.FindStringSubmatchIndex(text); m != nil && f.blank {
+		f.close()
+		marker := ""
+		if m[2] >= 0 {
+			marker = text[m[2]:m[3]]
+		} else {
+			marker = text[m[4]:m[5]]
+		}
+		f.open = &Footnote{Marker: marker, Text: text[m[1]:], Ordinal: f.after}
+		f.blank = false
+		return true
+	}
+	if f.open != nil && !f.blank {
+		f.open.Text += "\n" + text
+		return true
+	}
+
+	// a paragraph without a marker, like the next chapter heading
+	f.close()
+	f.section = false
+	return false
+}
+
+func (f *footnoteScanner) close() {
+	if f.open == nil {
+		return
+	}
+	t := strings.TrimSpace(f.open.Text)
+	if f.depth <= 0 {
+		t = strings.TrimSpace(strings.TrimSuffix(t, "]"))
+	}
+	f.open.Text = t
+	f.notes = append(f.notes, *f.open)
+	f.open = nil
+	f.depth = 0
+}
+
+func bracketDepth(s string) int {
+	return strings.Count(s, "[") - strings.Count(s, "]")
+}
+
+// StripFootnoteRefs removes in-text reference markers like "[12]" or "[A]".
+func StripFootnoteRefs(s string) string {
+	return footnoteRef.ReplaceAllString(s, "")
+}
+
+// FootnoteRefs are the reference markers StripFootnoteRefs removes from s.
+func FootnoteRefs(s string) []string {
+	refs := []string{}
+	for _, m := range footnoteRef.FindAllString(s, -1) {
+		refs = append(refs, strings.TrimSpace(m))
+	}
+	return refs
+}
+
+// FootnoteKind says what shape of footnote line, taken out, starts: a
+// footnote block, a footnote section heading or, for any other, footnote
+// section lines.
+func FootnoteKind(line string) string {
+	switch {
+	case footnoteStart.MatchString(line):
+		return "footnote block"
+	case footnoteHeading.MatchString(line):
+		return "footnote section heading"
+	}
+	return "footnote section lines"
+}
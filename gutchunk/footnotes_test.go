@@ -0,0 +1,136 @@
+package gutchunk
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// scan feeds text's lines to a footnote scanner, the chunk ordinal moving
+// on at each line starting "=", and returns the lines it left as prose.
+func scan(text string) ([]string, []Footnote) {
+	f := newFootnoteScanner()
+	prose := []string{}
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(line, "=") {
+			f.after++
+			continue
+		}
+		if !f.take(line) {
+			prose = append(prose, line)
+		}
+	}
+	f.close()
+	return prose, f.notes
+}
+
+func TestFootnoteScanner(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		prose []string
+		notes []Footnote
+	}{
+		{
+			"inline",
+			"The union of the provinces.[1]\n\n[Footnote 1: Dion Cassius, l. lvi.]\n\nThe senate.",
+			[]string{"The union of the provinces.[1]", "", "", "The senate."},
+			[]Footnote{{"1", "Dion Cassius, l. lvi.", -1}},
+		},
+		{
+			"nested brackets over paragraphs",
+			"=\n[Footnote 2: As in the age of the Antonines [see the chapter\nfollowing], when the senate kept its forms.\n\nThe reader will find more [in the notes].]\nProse again.",
+			[]string{"Prose again."},
+			[]Footnote{{"2", "As in the age of the Antonines [see the chapter\nfollowing], when the senate kept its forms.\n\nThe reader will find more [in the notes].", 0}},
+		},
+		{
+			"quotes",
+			"[Footnote *: He wrote, \"the 'first' of them [sic]\".]",
+			[]string{},
+			[]Footnote{{"*", "He wrote, \"the 'first' of them [sic]\".", -1}},
+		},
+		{
+			"note without a marker",
+			"[Note: the text is the first edition's.]",
+			[]string{},
+			[]Footnote{{"", "the text is the first edition's.", -1}},
+		},
+		{
+			"section",
+			"=\n=\nvariable under cultivation.[A]\n\nFOOTNOTES:\n\n[1] See the observations\nof Andrew Knight.\n\n2. A second note.\n\n[A] The last.\n\nCHAPTER II.",
+			[]string{"variable under cultivation.[A]", "", "CHAPTER II."},
+			[]Footnote{{"1", "See the observations\nof Andrew Knight.", 1}, {"2", "A second note.", 1}, {"A", "The last.", 1}},
+		},
+		{
+			"footnote heading",
+			"Foot-notes\n\n[1] One.\n\nProse.",
+			[]string{"Prose."},
+			[]Footnote{{"1", "One.", -1}},
+		},
+		{
+			"markers outside a section are prose",
+			"[1] is how a reference looks.\n2. And a list.",
+			[]string{"[1] is how a reference looks.", "2. And a list."},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		prose, notes := scan(tt.text)
+		if !reflect.DeepEqual(prose, tt.prose) {
+			t.Errorf("%s: prose %q, want %q", tt.name, prose, tt.prose)
+		}
+		if !reflect.DeepEqual(notes, tt.notes) {
+			t.Errorf("%s: footnotes %+v, want %+v", tt.name, notes, tt.notes)
+		}
+	}
+}
+
+func TestFootnoteUnbalanced(t *testing.T) {
+	lines := []string{"[Footnote 3: a bracket [never closed"}
+	for i := 0; i < 2*maxFootnoteLines; i++ {
+		lines = append(lines, "prose")
+	}
+	prose, notes := scan(strings.Join(lines, "\n"))
+	if len(notes) != 1 {
+		t.Fatalf("%d footnotes, want 1", len(notes))
+	}
+	if n := strings.Count(notes[0].Text, "\n") + 1; n != maxFootnoteLines+1 {
+		t.Errorf("the footnote ran %d lines, want %d", n, maxFootnoteLines+1)
+	}
+	if len(prose) != maxFootnoteLines {
+		t.Errorf("%d lines given back as prose, want %d", len(prose), maxFootnoteLines)
+	}
+}
+
+func TestFootnoteRefs(t *testing.T) {
+	for _, c := range []struct {
+		in, stripped string
+		refs         []string
+	}{
+		{"exposed.[2] It seems", "exposed. It seems", []string{"[2]"}},
+		{"cultivation [A] and [12].", "cultivation and.", []string{"[A]", "[12]"}},
+		{"[Illustration] and [ab] stay", "[Illustration] and [ab] stay", []string{}},
+		{"no markers", "no markers", []string{}},
+	} {
+		if got := StripFootnoteRefs(c.in); got != c.stripped {
+			t.Errorf("StripFootnoteRefs(%q) = %q, want %q", c.in, got, c.stripped)
+		}
+		if got := FootnoteRefs(c.in); !reflect.DeepEqual(got, c.refs) {
+			t.Errorf("FootnoteRefs(%q) = %q, want %q", c.in, got, c.refs)
+		}
+	}
+}
+
+func TestFootnoteKind(t *testing.T) {
+	for line, want := range map[string]string{
+		"[Footnote 1: text": "footnote block",
+		"[note: text]":      "footnote block",
+		"FOOTNOTES:":        "footnote section heading",
+		"[1] See Knight.":   "footnote section lines",
+		"of Andrew Knight.": "footnote section lines",
+	} {
+		if got := FootnoteKind(line); got != want {
+			t.Errorf("FootnoteKind(%q) = %q, want %q", line, got, want)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package gutchunk
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite testdata/golden from what the chunker gives")
+
+// golden is what a fixture book chunks to, as testdata/golden has it.
+type golden struct {
+	Found     Found
+	Chunks    []Chunk
+	Footnotes []Footnote
+	Warnings  []Warning
+}
+
+// variants are the fixture books chunked with options other than the
+// defaults, each golden file named for its book and variant.
+var variants = []struct {
+	book, name string
+	opts       Options
+}{
+	{"verse", "merge-short", Options{MergeShort: true}},
+	{"footnotes-section", "strip-refs", Options{StripRefs: true}},
+	{"footnotes-inline", "keep-footnotes", Options{KeepFootnotes: true}},
+	{"cjk", "runes", Options{Runes: true, MinChunk: 50, MaxChunk: 60}},
+	{"long-paragraphs", "max-chunk", Options{MaxChunk: 500}},
+	{"no-markers", "body-only", Options{BodyOnly: true}},
+	{"scenes", "no-scene-breaks", Options{SceneBreaks: []*regexp.Regexp{}}},
+	{"drama", "merge-short", Options{MergeShort: true, MinChunk: 100}},
+	{"novel", "start-pattern", Options{Start: regexp.MustCompile(`^Chapter 1$`)}},
+	{"novel", "end-pattern", Options{End: regexp.MustCompile(`^"Why, my dear`)}},
+}
+
+func chunkGolden(t *testing.T, book string, opts Options) golden {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", "books", book+".txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	body, err := ReadBody(f, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks, notes, err := Split(body, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return golden{body.Found, chunks, notes, body.Warnings(len(chunks))}
+}
+
+func checkGolden(t *testing.T, name string, got golden) {
+	t.Helper()
+	path := filepath.Join("testdata", "golden", name+".json")
+	out, err := json.MarshalIndent(got, "", "\t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out = append(out, '\n')
+	if *update {
+		if err := os.WriteFile(path, out, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run go test -update to write it)", err)
+	}
+	if !bytes.Equal(out, want) {
+		t.Errorf("%s differs from what the chunker gives; run go test -update and check the diff\ngot:\n%s", path, out)
+	}
+}
+
+func TestGolden(t *testing.T) {
+	books, err := filepath.Glob(filepath.Join("testdata", "books", "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(books) == 0 {
+		t.Fatal("no fixture books")
+	}
+	for _, path := range books {
+		book := strings.TrimSuffix(filepath.Base(path), ".txt")
+		t.Run(book, func(t *testing.T) {
+			checkGolden(t, book, chunkGolden(t, book, Options{}))
+		})
+	}
+	for _, v := range variants {
+		name := v.book + "-" + v.name
+		t.Run(name, func(t *testing.T) {
+			checkGolden(t, name, chunkGolden(t, v.book, v.opts))
+		})
+	}
+}
+
+// TestChunkReader checks that ChunkReader gives what ReadBody and Split
+// do, for every fixture book.
+func TestChunkReader(t *testing.T) {
+	books, _ := filepath.Glob(filepath.Join("testdata", "books", "*.txt"))
+	for _, path := range books {
+		book := strings.TrimSuffix(filepath.Base(path), ".txt")
+		want := chunkGolden(t, book, Options{})
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks, warnings, err := ChunkReader(f, Options{})
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", book, err)
+		}
+		got, _ := json.Marshal(golden{want.Found, chunks, want.Footnotes, warnings})
+		w, _ := json.Marshal(want)
+		if !bytes.Equal(got, w) {
+			t.Errorf("%s: ChunkReader gives\n%s\nnot\n%s", book, got, w)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package gutchunk
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// paragraphs is the paragraphs strategy: the paragraphs of the body, ended
+// as the Boundaries rule says, blank lines and scene breaks by default,
+// and made chunks as the Emitter says, by default those under the least
+// size dropped or with MergeShort joined to the next and those over
+// MaxChunk cut, footnotes taken out.
+type paragraphs struct {
+	opts Options
+}
+
+// Boundary is what a line is to the paragraph it comes in.
+type Boundary int
+
+const (
+	// Within is a line of the paragraph.
+	Within Boundary = iota
+	// Blank ends the paragraph.
+	Blank
+	// SceneBreak ends the paragraph, left out, and the scene.
+	SceneBreak
+)
+
+// Boundaries is the rule for which lines end a paragraph.
+type Boundaries interface {
+	// Boundary is what line, trimmed and its reference markers stripped,
+	// is to the paragraph.
+	Boundary(line string) Boundary
+}
+
+// Emission is what becomes of a paragraph as it ends.
+type Emission int
+
+const (
+	// Emit makes it a chunk, the paragraphs held before it joined on.
+	Emit Emission = iota
+	// Hold keeps it for the next paragraph.
+	Hold
+	// Drop leaves it out, and at a scene break those held with it.
+	Drop
+)
+
+// Emitter is the rule for what paragraphs become chunks.
+type Emitter interface {
+	// Cut reports whether chunk, a paragraph not yet ended, one line of
+	// the book to a line, is a chunk as it is.
+	Cut(chunk string) bool
+	// End says what becomes of a paragraph of size bytes as it ends, held
+	// bytes of others waiting before it, at a scene break when scene.
+	End(size, held int, scene bool) Emission
+}
+
+// sceneBoundaries is the Boundaries of Options without one: blank lines,
+// and the scene breaks of breaks.
+type sceneBoundaries struct {
+	breaks []*regexp.Regexp
+}
+
+func (s sceneBoundaries) Boundary(line string) Boundary {
+	switch {
+	case line == "":
+		return Blank
+	case isSceneBreak(s.breaks, line):
+		return SceneBreak
+	}
+	return Within
+}
+
+func (opts Options) boundaries() Boundaries {
+	if opts.Boundaries == nil {
+		return sceneBoundaries{opts.sceneBreaks()}
+	}
+	return opts.Boundaries
+}
+
+// sizeEmitter is the Emitter of Options without one: a paragraph under
+// least is dropped or, with merge, held, and one grown to max, in bytes or
+// runes, cut.
+type sizeEmitter struct {
+	least, max int
+	runes      bool
+	merge      bool
+}
+
+func (e sizeEmitter) Cut(chunk string) bool {
+	if e.max == 0 {
+		return false
+	}
+	if e.runes {
+		return utf8.RuneCountInString(chunk) >= e.max
+	}
+	return len(chunk) >= e.max
+}
+
+func (e sizeEmitter) End(size, held int, scene bool) Emission {
+	switch {
+	case size+held >= e.least:
+		return Emit
+	case e.merge && size > 0 && !scene:
+		return Hold
+	}
+	return Drop
+}
+
+func (opts Options) emitter() Emitter {
+	if opts.Emitter == nil {
+		return sizeEmitter{least: opts.least(), max: opts.MaxChunk, runes: opts.Runes, merge: opts.MergeShort}
+	}
+	return opts.Emitter
+}
+
+// Name is paragraphs, with MergeShort +merge and the least size, and with
+// MaxChunk +max and the size chunks are cut at.
+func (p paragraphs) Name() string {
+	s := DefaultStrategy
+	if p.opts.MergeShort {
+		s += fmt.Sprintf("+merge%d", p.opts.least())
+	}
+	if p.opts.MaxChunk > 0 {
+		s += fmt.Sprintf("+max%d", p.opts.MaxChunk)
+	}
+	return s
+}
+
+func (p paragraphs) Split(b Body) ([]Chunk, []Footnote) {
+	opts, body := p.opts, b.Lines
+	bounds, emit := opts.boundaries(), opts.emitter()
+	// what the trace is told the least size is
+	least := opts.least()
+	// where each line of the body starts, by bytes, and where it ends
+	offsets := make([]int, len(body)+1)
+	for i, line := range body {
+		offsets[i+1] = offsets[i] + len(line) + 1
+	}
+	position := func(first, last int) float64 {
+		return float64(offsets[first]+offsets[last+1]-1) / 2 / float64(offsets[len(body)])
+	}
+	chunk := ""
+	start := Chunk{}
+	scene, last := 0, 0
+	chunks := []Chunk{}
+	// with MergeShort, the short paragraphs waiting for the next, in the
+	// canonical form, where the first starts and their raw size
+	var held []string
+	var heldStart Chunk
+	heldSize := 0
+	fn := newFootnoteScanner()
+	tr := opts.tracer()
+	for i, text := range body {
+		if !opts.KeepFootnotes && fn.take(text) {
+			tr.Footnote(i, text)
+			continue
+		}
+		raw := text
+		if opts.StripRefs {
+			text = StripFootnoteRefs(text)
+		}
+		bound := bounds.Boundary(text)
+		if bound == SceneBreak {
+			// ends the paragraph like a blank line, and is left out;
+			// short paragraphs aren't merged across it
+			tr.SceneBreak(i, text)
+			scene++
+			text = ""
+		}
+		if bound != Within {
+			// end of "paragraph"
+			switch emit.End(len(chunk), heldSize, bound == SceneBreak) {
+			case Hold:
+				if len(held) == 0 {
+					heldStart = start
+				}
+				held = append(held, Canonical(chunk))
+				heldSize += len(chunk)
+				tr.Hold(len(chunk), least)
+				chunk = ""
+				continue
+			case Drop:
+				tr.Drop(len(chunk), least, bound == SceneBreak)
+				if bound == SceneBreak {
+					held, heldSize = nil, 0
+				}
+				chunk = ""
+				continue
+			}
+		} else {
+			if chunk == "" {
+				start = Chunk{Line: i, Scene: scene}
+			}
+			last = i
+			chunk += text + "\n"
+			tr.Line(i, raw, text)
+			if !emit.Cut(chunk) {
+				continue
+			}
+		}
+		fn.after = len(chunks)
+		start.Ordinal = len(chunks)
+		if len(held) > 0 {
+			// the paragraphs stay paragraphs, as a verse chunk's lines do
+			start.Text = strings.Join(append(held, Canonical(chunk)), "\n\n")
+			start.Line, start.Scene = heldStart.Line, heldStart.Scene
+			held, heldSize = nil, 0
+		} else {
+			start.Text = Canonical(chunk)
+		}
+		tr.Emit(start.Ordinal, start.Text, bound == Within)
+		start.Position = position(start.Line, last)
+		if opts.Kind != nil {
+			start.Kind = opts.Kind(chunk)
+		}
+		chunks = append(chunks, start)
+		chunk = ""
+	}
+	fn.close()
+	tr.Finish()
+	return chunks, fn.notes
+}
@@ -0,0 +1,151 @@
+package gutchunk
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// para is a paragraph of n bytes, wrapped as a book wraps it.
+func para(word string, n int) []string {
+	text := strings.Repeat(word+" ", n/(len(word)+1)+1)[:n]
+	lines := []string{}
+	for len(text) > 60 {
+		cut := strings.LastIndex(text[:60], " ")
+		lines = append(lines, strings.TrimSpace(text[:cut]))
+		text = text[cut+1:]
+	}
+	return append(lines, strings.TrimSpace(text))
+}
+
+func body(parts ...[]string) Body {
+	var b Body
+	for i, p := range parts {
+		if i > 0 {
+			b.Lines = append(b.Lines, "")
+		}
+		b.Lines = append(b.Lines, p...)
+	}
+	b.Lines = append(b.Lines, "")
+	return b
+}
+
+func texts(chunks []Chunk) []string {
+	s := []string{}
+	for _, c := range chunks {
+		s = append(s, strings.Fields(c.Text)[0])
+	}
+	return s
+}
+
+func TestParagraphsSplit(t *testing.T) {
+	long, short := para("long", 400), para("short", 100)
+	tests := []struct {
+		name  string
+		opts  Options
+		body  Body
+		want  []string
+		notes int
+	}{
+		{"short dropped", Options{}, body(long, short, long), []string{"long", "long"}, 0},
+		{"merge short", Options{MergeShort: true}, body(long, short, long), []string{"long", "short"}, 0},
+		{"least size", Options{MinChunk: 50}, body(long, short), []string{"long", "short"}, 0},
+		{"scene break", Options{}, body(long, []string{"* * *"}, long), []string{"long", "long"}, 0},
+		{"no scene breaks", Options{SceneBreaks: []*regexp.Regexp{}, MinChunk: 1}, body(long, []string{"* * *"}, long), []string{"long", "*", "long"}, 0},
+		{"footnote", Options{}, body(long, []string{"[Footnote 1: a note.]"}, long), []string{"long", "long"}, 1},
+		{"footnote kept", Options{KeepFootnotes: true, MinChunk: 1}, body(long, []string{"[Footnote 1: a note.]"}), []string{"long", "[Footnote"}, 0},
+		{"max chunk", Options{MaxChunk: 200, MinChunk: 100}, body(long), []string{"long", "long"}, 0},
+	}
+	for _, tt := range tests {
+		chunks, notes := paragraphs{tt.opts}.Split(tt.body)
+		if got := texts(chunks); strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: chunks %q, want %q", tt.name, got, tt.want)
+		}
+		if len(notes) != tt.notes {
+			t.Errorf("%s: %d footnotes, want %d", tt.name, len(notes), tt.notes)
+		}
+		for i, c := range chunks {
+			if c.Ordinal != i {
+				t.Errorf("%s: chunk %d has ordinal %d", tt.name, i, c.Ordinal)
+			}
+		}
+	}
+}
+
+func TestParagraphsWhere(t *testing.T) {
+	long := para("long", 400)
+	b := body(long, []string{"* * *"}, long, long)
+	chunks, _ := paragraphs{Options{Kind: func(string) string { return "kind" }}}.Split(b)
+	if len(chunks) != 3 {
+		t.Fatalf("%d chunks", len(chunks))
+	}
+	next := len(long) + 3
+	if chunks[1].Line != next || chunks[1].Scene != 1 || chunks[2].Scene != 1 || chunks[0].Scene != 0 {
+		t.Errorf("chunks start at %+v", chunks)
+	}
+	if c := chunks[1]; c.Position <= chunks[0].Position || c.Position >= chunks[2].Position {
+		t.Errorf("positions %v %v %v", chunks[0].Position, c.Position, chunks[2].Position)
+	}
+	if chunks[0].Kind != "kind" {
+		t.Errorf("kind %q", chunks[0].Kind)
+	}
+	if strings.Contains(chunks[0].Text, "\n") {
+		t.Errorf("a chunk isn't canonical: %q", chunks[0].Text)
+	}
+}
+
+func TestParagraphsRunes(t *testing.T) {
+	line := strings.Repeat("字", 200)
+	b := Body{Lines: []string{line, line, ""}}
+	bytes, _ := paragraphs{Options{MaxChunk: 300}}.Split(b)
+	runes, _ := paragraphs{Options{MaxChunk: 300, Runes: true}}.Split(b)
+	if len(bytes) != 2 || len(runes) != 1 {
+		t.Fatalf("%d chunks by bytes, %d by runes", len(bytes), len(runes))
+	}
+	if len(bytes[0].Text) != len(line) || len(runes[0].Text) != 2*len(line)+1 {
+		t.Errorf("cut at %d bytes by bytes and %d by runes", len(bytes[0].Text), len(runes[0].Text))
+	}
+}
+
+// headings ends a paragraph at each line in capitals as well as blank
+// ones, for a body whose paragraphs aren't spaced.
+type headings struct{}
+
+func (headings) Boundary(line string) Boundary {
+	if line == "" || line == strings.ToUpper(line) {
+		return Blank
+	}
+	return Within
+}
+
+// everything makes every paragraph a chunk, however short, and cuts one
+// at each line with a semicolon.
+type everything struct{}
+
+func (everything) Cut(chunk string) bool { return strings.HasSuffix(chunk, ";\n") }
+func (everything) End(size, held int, scene bool) Emission {
+	if size == 0 {
+		return Drop
+	}
+	return Emit
+}
+
+func TestParagraphsRules(t *testing.T) {
+	lines := []string{"One", "ONE", "Two;", "still two", "", "Three", ""}
+	tests := []struct {
+		name string
+		opts Options
+		want []string
+	}{
+		{"defaults", Options{MinChunk: 1}, []string{"One", "Three"}},
+		{"boundaries", Options{MinChunk: 1, Boundaries: headings{}}, []string{"One", "Two;", "Three"}},
+		{"emitter", Options{Emitter: everything{}}, []string{"One", "still", "Three"}},
+		{"both", Options{Boundaries: headings{}, Emitter: everything{}}, []string{"One", "Two;", "still", "Three"}},
+	}
+	for _, tt := range tests {
+		chunks, _ := paragraphs{tt.opts}.Split(Body{Lines: lines})
+		if got := texts(chunks); strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: chunks %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package gutchunk
+
+import "regexp"
+
+// DefaultSceneBreaks are what scene breaks match given no others. Scene
+// breaks are lines of nothing but separator characters, like
+// "* * *" or "-----". They end a paragraph as a blank line does and are
+// never part of a chunk. The patterns match whole trimmed lines, and none
+// of them can match a line with a letter or digit in it, so prose with a
+// few asterisks in it is never taken for a break.
+var DefaultSceneBreaks = []string{
+	`^\*(\s*\*){2,}$`,
+	`^[-–—_](\s*[-–—_]){2,}$`,
+	`^~(\s*~)*$`,
+	`^#(\s*#){2,}$`,
+}
+
+// sceneBreaks returns the patterns separator lines match, the defaults
+// unless the options say otherwise.
+func (o Options) sceneBreaks() []*regexp.Regexp {
+	if o.SceneBreaks != nil {
+		return o.SceneBreaks
+	}
+	return defaultBreaks
+}
+
+var defaultBreaks = mustCompileAll(DefaultSceneBreaks)
+
+func mustCompileAll(patterns []string) []*regexp.Regexp {
+	res := []*regexp.Regexp{}
+	for _, p := range patterns {
+		res = append(res, regexp.MustCompile(p))
+	}
+	return res
+}
+
+func isSceneBreak(breaks []*regexp.Regexp, line string) bool {
+	if line == "" {
+		return false
+	}
+	for _, re := range breaks {
+		if re.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package gutchunk
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestIsSceneBreak(t *testing.T) {
+	for line, want := range map[string]bool{
+		"* * *":       true,
+		"***":         true,
+		"*       *":   false,
+		"-----":       true,
+		"— — —":       true,
+		"~":           true,
+		"~ ~ ~":       true,
+		"# # #":       true,
+		"--":          false,
+		"":            false,
+		"* * * * 1":   false,
+		"Ch***es":     false,
+		"* see below": false,
+		"*** END":     false,
+	} {
+		if got := isSceneBreak(defaultBreaks, line); got != want {
+			t.Errorf("%q taken for a scene break: %v, want %v", line, got, want)
+		}
+	}
+}
+
+func TestSceneBreaksFixture(t *testing.T) {
+	// scenes with no blank lines between their paragraphs, only breaks
+	var lines []string
+	for i, sep := range []string{"* * *", "-----", "~", "***"} {
+		lines = append(lines, para(strings.Repeat("x", i+1), 400)...)
+		lines = append(lines, sep)
+	}
+	lines = append(lines, "He swore, f***ing the ***, and left.")
+	lines = append(lines, para("last", 400)...)
+	b := Body{Lines: append(lines, "")}
+
+	chunks, _ := paragraphs{Options{}}.Split(b)
+	if len(chunks) != 5 {
+		t.Fatalf("%d chunks, want 5: %q", len(chunks), texts(chunks))
+	}
+	for i, c := range chunks {
+		if c.Scene != i {
+			t.Errorf("chunk %d is in scene %d", i, c.Scene)
+		}
+		if strings.Contains(c.Text, "* * *") || strings.Contains(c.Text, "--") || strings.Contains(c.Text, "~") || strings.HasSuffix(c.Text, "***") {
+			t.Errorf("chunk %d holds a separator: %q", i, c.Text)
+		}
+	}
+	if !strings.HasPrefix(chunks[4].Text, "He swore, f***ing the ***, and left.") {
+		t.Errorf("the line of prose with asterisks lost its place: %q", chunks[4].Text)
+	}
+
+	// with breaks of its own, the defaults are prose
+	own := Options{SceneBreaks: []*regexp.Regexp{regexp.MustCompile(`^~$`)}, MinChunk: 1}
+	chunks, _ = paragraphs{own}.Split(b)
+	if len(chunks) != 2 {
+		t.Fatalf("with ~ alone for a break, %d chunks, want 2: %q", len(chunks), texts(chunks))
+	}
+	if !strings.Contains(chunks[0].Text, "* * *") || strings.Contains(chunks[1].Text, "~") || chunks[1].Scene != 1 {
+		t.Errorf("with ~ alone for a break: %+v", chunks)
+	}
+}
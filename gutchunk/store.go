@@ -0,0 +1,65 @@
+package gutchunk
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	// the sqlite3 driver
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// A MemoryStore is a sqlite database in memory for those chunking into
+// one, the gutchunk command's tests among them, with nothing on disk.
+//
+// A plain :memory: database is one per connection, so a pool of them
+// hands each statement a different, empty one. cache=shared has them
+// share it, but locks tables rather than the database, and a statement
+// finding one locked fails at once with SQLITE_LOCKED, which busy_timeout
+// doesn't wait on; a pool of one connection hangs whoever holds one while
+// querying on another. So the database is put in sqlite's memdb vfs under
+// a name of its own, where every connection opened by that name sees it,
+// locked as a file would be, and as it is freed once the last of them
+// closes, the store holds one open until it is closed.
+type MemoryStore struct {
+	dsn  string
+	keep *sql.DB
+	conn *sql.Conn
+}
+
+// stores numbers the stores of this process, for their names.
+var stores int64
+
+// NewMemoryStore makes a new, empty database in memory.
+func NewMemoryStore() (*MemoryStore, error) {
+	s := &MemoryStore{dsn: fmt.Sprintf("file:/gutchunk-%d-%d?vfs=memdb", os.Getpid(), atomic.AddInt64(&stores, 1))}
+	var err error
+	if s.keep, err = sql.Open("sqlite3", s.dsn); err != nil {
+		return nil, err
+	}
+	if s.conn, err = s.keep.Conn(context.Background()); err != nil {
+		s.keep.Close()
+		return nil, fmt.Errorf("could not make the database in memory: %w", err)
+	}
+	return s, nil
+}
+
+// DSN is the uri every connection to the store opens, by the sqlite3
+// driver, with whatever _ options of the driver's are added after an &.
+func (s *MemoryStore) DSN() string {
+	return s.dsn
+}
+
+// Open opens a pool of connections to the store.
+func (s *MemoryStore) Open() (*sql.DB, error) {
+	return sql.Open("sqlite3", s.dsn)
+}
+
+// Close frees the database once the connections opened to it are closed
+// too.
+func (s *MemoryStore) Close() error {
+	s.conn.Close()
+	return s.keep.Close()
+}
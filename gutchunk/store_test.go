@@ -0,0 +1,72 @@
+package gutchunk
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestMemoryStore(t *testing.T) {
+	s, err := NewMemoryStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	db, err := s.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err = db.Exec("CREATE TABLE t (n INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the connections of the pool write beside one another, waiting
+	// rather than failing on a lock
+	db.SetMaxOpenConns(4)
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if _, err := db.Exec("INSERT INTO t VALUES (?)", i); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("a write failed: %v", err)
+	}
+
+	// another pool sees the same database, the first closed
+	db.Close()
+	again, err := s.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	var n int
+	if err = again.QueryRow("SELECT count(*) FROM t").Scan(&n); err != nil || n != 160 {
+		t.Errorf("the store has %d rows (%v), not 160", n, err)
+	}
+
+	// and another store has a database of its own
+	other, err := NewMemoryStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	odb, err := other.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer odb.Close()
+	if err = odb.QueryRow("SELECT count(*) FROM sqlite_master").Scan(&n); err != nil || n != 0 {
+		t.Errorf("a new store has %d tables (%v)", n, err)
+	}
+}
@@ -0,0 +1,223 @@
+// Package gutchunk is the chunker of gutchunk, without its database: the
+// strategies that cut a book's body into chunks, the paragraphs strategy
+// gutchunk chunks with unless told otherwise among them, and what they
+// share, the canonical form of a chunk's text and the footnotes taken out
+// of it. NewMemoryStore gives a database in memory to keep them in, for
+// trying things out and for tests.
+//
+// A strategy of one's own is registered with RegisterStrategy, in the init
+// of a package imported for it by a main of one's own that runs the
+// gutchunk command, package cli's Main (see strategy.go there), and its
+// name given to --strategy.
+package gutchunk
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MinChunk is the least size of a chunk in bytes, given no other.
+const MinChunk = 300
+
+// DefaultStrategy is the strategy books are chunked with given none.
+const DefaultStrategy = "paragraphs"
+
+// Options are how a book is chunked, its overrides and language applied:
+// where its body is, the strategy cutting it and what that strategy is
+// made with. Each rule left nil is the default.
+type Options struct {
+	// the body that starts at the top, with no header; an override's
+	// start and end patterns, or nil, and start and end lines, by number,
+	// 0 for none, which go before either; and the lines at the top of the
+	// body to leave out (see body.go)
+	BodyOnly           bool
+	Start, End         *regexp.Regexp
+	StartLine, EndLine int
+	SkipLines          int
+	// the strategy registered to cut the body, "" for DefaultStrategy
+	Strategy string
+
+	// the least size of a chunk in bytes, 0 for MinChunk; a paragraph
+	// under it is dropped or, with MergeShort, joined to the next
+	MinChunk   int
+	MergeShort bool
+	// the most a chunk grows to before it is cut, 0 for no limit, in
+	// bytes or, with Runes, for Chinese and Japanese, runes
+	MaxChunk int
+	Runes    bool
+	// strip in-text footnote reference markers like [12] from chunks, and
+	// leave footnotes in the text rather than take them out
+	StripRefs     bool
+	KeepFootnotes bool
+	// what separator lines between scenes match, nil for the defaults (see
+	// DefaultSceneBreaks), none for no scene breaks
+	SceneBreaks []*regexp.Regexp
+	// the kind each chunk is tagged with, given its text a line of the book
+	// to a line, or nil to tag none
+	Kind func(text string) string
+	// what follows each paragraph through the strategy, or nil
+	Trace Tracer
+
+	// the rules: which lines end the header and start the footer, which
+	// end a paragraph, and what becomes of a paragraph
+	Markers    Markers
+	Boundaries Boundaries
+	Emitter    Emitter
+}
+
+// Body is a book's body as strategies read it: its lines between the START
+// and END markers, or an override's start and end, trimmed, and what was
+// found finding them.
+type Body struct {
+	Lines []string
+	Found
+}
+
+// Chunk is a chunk a strategy cut from a body.
+type Chunk struct {
+	// its place in the book, from 0, and its text in the canonical form
+	// (see Canonical)
+	Ordinal int
+	Text    string
+	// the line of the body it starts on, the number of scene breaks before
+	// it and how far through the body its middle is, from 0 to 1, by bytes
+	Line     int
+	Scene    int
+	Position float64
+	// its kind, by Options.Kind, or ""
+	Kind string
+}
+
+// Strategy cuts a body into chunks.
+type Strategy interface {
+	// Name is what goes into the stable ids of the chunks the strategy
+	// cuts: its registered name, with whatever of its options changes
+	// where it cuts, so changing them gives the chunks new ids.
+	Name() string
+	// Split returns the chunks of body, with their ordinals in order, and
+	// the footnotes it took out.
+	Split(body Body) ([]Chunk, []Footnote)
+}
+
+// Tracer follows the paragraphs of a body through a strategy, for
+// chunk-one --trace. Lines count from 0 in the body.
+type Tracer interface {
+	// line i, text, was taken out as a footnote
+	Footnote(i int, text string)
+	// line i, raw as the body has it, became text once its reference
+	// markers were stripped
+	Line(i int, raw, text string)
+	// line i, text, is a scene break, left out
+	SceneBreak(i int, text string)
+	// the paragraph of size bytes was dropped as under least, and with
+	// held those held for MergeShort with it
+	Drop(size, least int, held bool)
+	// the paragraph was held for MergeShort
+	Hold(size, least int)
+	// the paragraph became chunk ordinal, cut at MaxChunk when cut is set
+	Emit(ordinal int, chunk string, cut bool)
+	// the body ended
+	Finish()
+}
+
+// registry holds the strategies registered, by name, and the first
+// registration refused.
+var registry = struct {
+	sync.Mutex
+	factories map[string]func(Options) Strategy
+	err       error
+}{factories: map[string]func(Options) Strategy{
+	DefaultStrategy: func(opts Options) Strategy { return paragraphs{opts} },
+}}
+
+// RegisterStrategy registers the strategy called name, made by factory
+// with the options of each book it cuts. A name that is empty, has a
+// space, comma or + in it or is registered already is refused, and the
+// refusal kept for CheckStrategies too, so a program registering in an
+// init, with no one to return the error to, still fails on it as it reads
+// its flags.
+func RegisterStrategy(name string, factory func(Options) Strategy) error {
+	registry.Lock()
+	defer registry.Unlock()
+	var err error
+	switch {
+	case name == "" || strings.ContainsAny(name, "+, \t\n"):
+		err = fmt.Errorf("strategy name %q is empty or has a space, comma or +", name)
+	case factory == nil:
+		err = fmt.Errorf("strategy %q has no factory", name)
+	case registry.factories[name] != nil:
+		err = fmt.Errorf("strategy %q is registered twice", name)
+	}
+	if err != nil {
+		if registry.err == nil {
+			registry.err = err
+		}
+		return err
+	}
+	registry.factories[name] = factory
+	return nil
+}
+
+// CheckStrategies is the first registration RegisterStrategy refused, or
+// nil.
+func CheckStrategies() error {
+	registry.Lock()
+	defer registry.Unlock()
+	return registry.err
+}
+
+// Strategies are the names of the registered strategies, sorted.
+func Strategies() []string {
+	registry.Lock()
+	defer registry.Unlock()
+	names := make([]string, 0, len(registry.factories))
+	for name := range registry.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewStrategy is the strategy registered as name, "" for DefaultStrategy,
+// made with opts.
+func NewStrategy(name string, opts Options) (Strategy, error) {
+	if name == "" {
+		name = DefaultStrategy
+	}
+	registry.Lock()
+	factory := registry.factories[name]
+	registry.Unlock()
+	if factory == nil {
+		return nil, fmt.Errorf("no strategy %q; there are %s", name, strings.Join(Strategies(), ", "))
+	}
+	return factory(opts), nil
+}
+
+// least is the least size of a chunk opts give.
+func (opts Options) least() int {
+	if opts.MinChunk > 0 {
+		return opts.MinChunk
+	}
+	return MinChunk
+}
+
+// nopTracer is the Tracer of Options without one.
+type nopTracer struct{}
+
+func (nopTracer) Footnote(int, string)     {}
+func (nopTracer) Line(int, string, string) {}
+func (nopTracer) SceneBreak(int, string)   {}
+func (nopTracer) Drop(int, int, bool)      {}
+func (nopTracer) Hold(int, int)            {}
+func (nopTracer) Emit(int, string, bool)   {}
+func (nopTracer) Finish()                  {}
+
+func (opts Options) tracer() Tracer {
+	if opts.Trace == nil {
+		return nopTracer{}
+	}
+	return opts.Trace
+}
@@ -0,0 +1,103 @@
+package gutchunk
+
+import (
+	"strings"
+	"testing"
+)
+
+// lines cuts each line of the body into a chunk of its own.
+type lines struct{}
+
+func (lines) Name() string { return "lines" }
+
+func (lines) Split(b Body) ([]Chunk, []Footnote) {
+	chunks := []Chunk{}
+	for i, l := range b.Lines {
+		if l != "" {
+			chunks = append(chunks, Chunk{Ordinal: len(chunks), Text: l, Line: i})
+		}
+	}
+	return chunks, nil
+}
+
+func TestRegisterStrategy(t *testing.T) {
+	// taken out again, and the refusals with it, so the test can run twice
+	was := CheckStrategies()
+	t.Cleanup(func() {
+		registry.Lock()
+		defer registry.Unlock()
+		delete(registry.factories, "test-lines")
+		registry.err = was
+	})
+	newLines := func(Options) Strategy { return lines{} }
+	if err := RegisterStrategy("test-lines", newLines); err != nil {
+		t.Fatal(err)
+	}
+	if CheckStrategies() != nil {
+		t.Fatalf("a good registration was refused: %v", CheckStrategies())
+	}
+	s, err := NewStrategy("test-lines", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunks, _ := s.Split(Body{Lines: []string{"a", "", "b"}}); len(chunks) != 2 || chunks[1].Line != 2 {
+		t.Errorf("the strategy registered cut %+v", chunks)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		factory func(Options) Strategy
+		want    string
+	}{
+		{"test-lines", newLines, "registered twice"},
+		{DefaultStrategy, newLines, "registered twice"},
+		{"", newLines, "empty"},
+		{"my scenes", newLines, "space"},
+		{"a,b", newLines, "comma"},
+		{"a+b", newLines, "+"},
+		{"test-nil", nil, "no factory"},
+	} {
+		err := RegisterStrategy(tt.name, tt.factory)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("RegisterStrategy(%q): %v, want an error saying %q", tt.name, err, tt.want)
+		}
+	}
+	// the first refused is the one kept
+	if err := CheckStrategies(); err == nil || !strings.Contains(err.Error(), `"test-lines" is registered twice`) {
+		t.Errorf("CheckStrategies() = %v", err)
+	}
+	if _, err := NewStrategy("test-nil", Options{}); err == nil {
+		t.Error("a refused strategy was registered")
+	}
+}
+
+func TestNewStrategy(t *testing.T) {
+	s, err := NewStrategy("", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Name() != DefaultStrategy {
+		t.Errorf("the default strategy is %q", s.Name())
+	}
+	_, err = NewStrategy("nonesuch", Options{})
+	if err == nil || !strings.Contains(err.Error(), `no strategy "nonesuch"`) || !strings.Contains(err.Error(), DefaultStrategy) {
+		t.Errorf("an unknown strategy: %v", err)
+	}
+}
+
+func TestParagraphsName(t *testing.T) {
+	for _, tt := range []struct {
+		opts Options
+		want string
+	}{
+		{Options{}, "paragraphs"},
+		{Options{MinChunk: 500}, "paragraphs"},
+		{Options{MergeShort: true}, "paragraphs+merge300"},
+		{Options{MergeShort: true, MinChunk: 200, MaxChunk: 1000}, "paragraphs+merge200+max1000"},
+		{Options{MaxChunk: 1000}, "paragraphs+max1000"},
+	} {
+		if got := (paragraphs{tt.opts}).Name(); got != tt.want {
+			t.Errorf("%+v: %q, want %q", tt.opts, got, tt.want)
+		}
+	}
+}